@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/event"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"github.com/stripe/stripe-go/v76/refund"
+)
+
+// apiKeyRotationGrace is how long a rotated-out key keeps working.
+const apiKeyRotationGrace = 24 * time.Hour
+
+// requireScope authenticates the bearer token, either the bootstrap admin
+// token from the environment, a stored API key carrying scope, or an
+// OAuth2 access token granting it.
+func requireScope(store *Store, bootstrapToken, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, errorBody(c, CodeUnauthorized, "Missing API key"))
+			return
+		}
+
+		if bootstrapToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(bootstrapToken)) == 1 {
+			c.Set("api_key_id", "bootstrap")
+			c.Next()
+			return
+		}
+
+		if oauth2Verifier != nil && isJWT(token) {
+			key, err := oauth2Verifier.Authenticate(c.Request.Context(), token)
+			if err != nil {
+				logf(c.Request.Context(), "OAuth2: rejected token: %v", err)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, errorBody(c, CodeUnauthorized, "Invalid access token"))
+				return
+			}
+			authorizeKey(c, key, scope)
+			return
+		}
+
+		if store != nil {
+			key, err := store.AuthenticateAPIKey(c.Request.Context(), token)
+			if err == nil {
+				authorizeKey(c, key, scope)
+				return
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusUnauthorized, errorBody(c, CodeUnauthorized, "Invalid API key"))
+	}
+}
+
+// hasScope runs requireScope from within a handler, for requests that
+// need scope for only some of what they ask. It reports whether the
+// request may go on; if not, the response is written.
+func hasScope(c *gin.Context, store *Store, bootstrapToken, scope string) bool {
+	requireScope(store, bootstrapToken, scope)(c)
+	return !c.IsAborted()
+}
+
+// authorizeKey lets an authenticated key through if it carries scope and
+// is within its quota.
+func authorizeKey(c *gin.Context, key *APIKey, scope string) {
+	if !key.HasScope(scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, errorBody(c, CodeForbidden, "API key lacks scope "+scope))
+		return
+	}
+	c.Set("api_key_id", key.ID)
+	if !apiKeyQuotas.allow(c, key) {
+		return
+	}
+	c.Next()
+}
+
+// AdminAPI groups operational endpoints used by paymentctl and on-call.
+type AdminAPI struct {
+	Store    *Store
+	Payments PaymentRepository
+	Hub      *EventHub
+	Webhooks *WebhookHandler
+	Flags    *Flags
+	Fees     FeeSchedule
+	Settings *RuntimeSettings
+	// Approvals holds large refunds for a second key; nil refunds
+	// everything straight away.
+	Approvals *RefundApprovals
+}
+
+func (a *AdminAPI) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/admin", requireScope(a.Store, bootstrapToken, "admin"))
+
+	g.POST("/payments/:id/refund", a.refund)
+	g.POST("/payments/:id/resync", a.resync)
+	g.POST("/webhooks/replay", a.replayWebhooks)
+	g.GET("/webhooks/handlers", a.webhookHandlers)
+	g.GET("/events", paymentEventsTail(a.Hub))
+	g.GET("/flags/:key", a.evaluateFlag)
+	g.GET("/config", a.runtimeConfig)
+	g.POST("/config/reload", a.reloadConfig)
+
+	keys := g.Group("/api-keys", a.requireStore)
+	keys.GET("", a.listKeys)
+	keys.POST("", a.createKey)
+	keys.POST("/:id/rotate", a.rotateKey)
+	keys.DELETE("/:id", a.revokeKey)
+	keys.GET("/:id/quota", a.keyQuota)
+	keys.PUT("/:id/quota", a.setKeyQuota)
+}
+
+func (a *AdminAPI) requireStore(c *gin.Context) {
+	if a.Store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "API keys require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// refund issues a full or partial refund. Amount 0 refunds the remainder.
+// Refunds above the refund_approval threshold are recorded for approval
+// instead, answering 202.
+func (a *AdminAPI) refund(c *gin.Context) {
+	var req struct {
+		Amount int64  `json:"amount"`
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if !bindJSON(c, &req) {
+			return
+		}
+	}
+
+	params := &stripe.RefundParams{PaymentIntent: stripe.String(c.Param("id"))}
+	params.Context = c.Request.Context()
+	if req.Amount > 0 {
+		params.Amount = stripe.Int64(req.Amount)
+	}
+	if req.Reason != "" {
+		params.Reason = stripe.String(req.Reason)
+	}
+	params.AddMetadata("requested_by", c.GetString("api_key_id"))
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		params.SetIdempotencyKey(key)
+	}
+	if id := requestIDFrom(c.Request.Context()); id != "" {
+		params.AddMetadata("request_id", id)
+	}
+
+	if isDryRun(c) {
+		a.dryRunRefund(c, req.Amount, req.Reason)
+		return
+	}
+	if a.Approvals.hold(c, req.Amount, req.Reason) {
+		return
+	}
+
+	rf, err := refund.New(params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	recordAdminAction(c, a.Store, c.Param("id"), "refund.requested", rf.ID,
+		gin.H{"amount": rf.Amount, "currency": rf.Currency, "reason": req.Reason})
+
+	respondData(c, http.StatusOK, gin.H{
+		"id":         rf.ID,
+		"payment_id": c.Param("id"),
+		"amount":     rf.Amount,
+		"currency":   rf.Currency,
+		"status":     rf.Status,
+	})
+}
+
+// dryRunRefund checks a refund against the payment's refundable balance.
+// It reads the payment from Stripe but creates nothing.
+func (a *AdminAPI) dryRunRefund(c *gin.Context, amount int64, reason string) {
+	params := &stripe.PaymentIntentParams{}
+	params.Context = c.Request.Context()
+	params.AddExpand("latest_charge")
+	pi, err := paymentintent.Get(c.Param("id"), params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if pi.Status != stripe.PaymentIntentStatusSucceeded || pi.LatestCharge == nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "Payment has no successful charge to refund"))
+		return
+	}
+	remaining := pi.LatestCharge.Amount - pi.LatestCharge.AmountRefunded
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount > remaining {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidAmount, fmt.Sprintf("Refund amount exceeds refundable balance of %d", remaining)))
+		return
+	}
+
+	if !validRefundReason(reason) {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "Invalid refund reason "+reason))
+		return
+	}
+
+	// Stripe doesn't return the processing fee on refunds, so the
+	// original fee is reported alongside.
+	fee, _ := a.Fees.Estimate(pi.LatestCharge.Amount)
+	respondData(c, http.StatusOK, gin.H{
+		"dry_run": true,
+		"refund": gin.H{
+			"payment_id": pi.ID,
+			"amount":     amount,
+			"currency":   pi.Currency,
+			"reason":     reason,
+		},
+		"remaining_after":        remaining - amount,
+		"original_estimated_fee": fee,
+		"requires_approval":      a.Settings.Get().RefundApproval.requires(string(pi.Currency), amount),
+	})
+}
+
+// replayWebhooks refetches events from Stripe and runs them through the
+// webhook pipeline again, e.g. after an outage dropped deliveries. Every
+// handler runs, including those that already applied the event.
+func (a *AdminAPI) replayWebhooks(c *gin.Context) {
+	var req struct {
+		EventIDs []string `json:"event_ids" binding:"required,min=1"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	results := make([]gin.H, 0, len(req.EventIDs))
+	for _, id := range req.EventIDs {
+		params := &stripe.EventParams{}
+		params.Context = c.Request.Context()
+		ev, err := event.Get(id, params)
+		if err != nil {
+			code, msg := classifyError(err)
+			results = append(results, gin.H{"event_id": id, "error": msg, "code": code})
+			continue
+		}
+		if err := a.Webhooks.dispatch(withWebhookReplay(c.Request.Context()), *ev); err != nil {
+			results = append(results, gin.H{"event_id": id, "type": ev.Type, "error": err.Error(), "code": CodeInternal})
+			continue
+		}
+		results = append(results, gin.H{"event_id": id, "type": ev.Type, "replayed": true})
+	}
+
+	respondData(c, http.StatusOK, gin.H{"results": results})
+}
+
+func (a *AdminAPI) listKeys(c *gin.Context) {
+	keys, err := a.Store.ListAPIKeys(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{"api_keys": keys})
+}
+
+func (a *AdminAPI) createKey(c *gin.Context) {
+	var req struct {
+		Name   string   `json:"name" binding:"required"`
+		Scopes []string `json:"scopes" binding:"required,min=1"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	key, secret, err := a.Store.CreateAPIKey(c.Request.Context(), req.Name, req.Scopes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusCreated, gin.H{"api_key": key, "secret": secret})
+}
+
+func (a *AdminAPI) rotateKey(c *gin.Context) {
+	key, secret, err := a.Store.RotateAPIKey(c.Request.Context(), c.Param("id"), apiKeyRotationGrace)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "API key not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{
+		"api_key":            key,
+		"secret":             secret,
+		"previous_key_until": time.Now().UTC().Add(apiKeyRotationGrace),
+	})
+}
+
+func (a *AdminAPI) revokeKey(c *gin.Context) {
+	err := a.Store.RevokeAPIKey(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "API key not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// evaluateFlag shows how a flag resolves for a tenant, to debug rollouts.
+func (a *AdminAPI) evaluateFlag(c *gin.Context) {
+	fc := flagContext(c.Query("tenant_id"), c.Query("targeting_key"), nil)
+	details, err := a.Flags.Details(c.Request.Context(), c.Param("key"), fc)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorBodyWith(c, CodeNotFound, err.Error(), gin.H{"reason": details.Reason}))
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{
+		"key":     details.FlagKey,
+		"value":   details.Value,
+		"variant": details.Variant,
+		"reason":  details.Reason,
+	})
+}
+
+func (a *AdminAPI) runtimeConfig(c *gin.Context) {
+	respondData(c, http.StatusOK, a.Settings.Get())
+}
+
+// reloadConfig is the HTTP equivalent of sending the process SIGHUP.
+func (a *AdminAPI) reloadConfig(c *gin.Context) {
+	if err := a.Settings.Reload(); err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, a.Settings.Get())
+}
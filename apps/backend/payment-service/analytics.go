@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// AnalyticsEvent is the warehouse-facing shape of a payment event. It must
+// never carry PII: no emails, names, card digits or free-form descriptions.
+type AnalyticsEvent struct {
+	EventID    string    `json:"event_id"`
+	Name       string    `json:"name"`
+	OccurredAt time.Time `json:"occurred_at"`
+	PaymentID  string    `json:"payment_id"`
+	// CheckoutSessionID is set on checkout funnel events, which may come
+	// before there is a payment.
+	CheckoutSessionID string  `json:"checkout_session_id,omitempty"`
+	TenantID          string  `json:"tenant_id,omitempty"`
+	OrderID           string  `json:"order_id,omitempty"`
+	CustomerHash      string  `json:"customer_hash,omitempty"`
+	Amount            int64   `json:"amount"`
+	Currency          string  `json:"currency"`
+	Status            string  `json:"status,omitempty"`
+	PaymentMethod     string  `json:"payment_method,omitempty"`
+	ErrorCode         string  `json:"error_code,omitempty"`
+	DeclineCode       string  `json:"decline_code,omitempty"`
+	LatencyMS         int64   `json:"latency_ms"`
+	Livemode          bool    `json:"livemode"`
+	Service           string  `json:"service"`
+	Region            string  `json:"region,omitempty"`
+	SampleRate        float64 `json:"sample_rate"`
+	RequestID         string  `json:"request_id,omitempty"`
+}
+
+// analyticsQueueSize bounds memory use when the broker is slow; events past
+// this are dropped rather than blocking payment handling.
+const analyticsQueueSize = 1024
+
+// AnalyticsEmitter samples, scrubs and publishes payment analytics events
+// in the background.
+type AnalyticsEmitter struct {
+	pub         Publisher
+	topic       string
+	salt        string
+	defaultRate float64
+	rates       map[string]float64
+	queue       chan AnalyticsEvent
+}
+
+// NewAnalyticsEmitter starts the publishing loop. rates is a comma-separated
+// list of name=rate overrides, e.g. "payment.attempted=0.1".
+func NewAnalyticsEmitter(pub Publisher, topic, salt string, defaultRate float64, rates string) *AnalyticsEmitter {
+	e := &AnalyticsEmitter{
+		pub:         pub,
+		topic:       topic,
+		salt:        salt,
+		defaultRate: defaultRate,
+		rates:       parseSampleRates(rates),
+		queue:       make(chan AnalyticsEvent, analyticsQueueSize),
+	}
+	go e.run()
+	return e
+}
+
+func parseSampleRates(s string) map[string]float64 {
+	rates := make(map[string]float64)
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Printf("analytics: ignoring sample rate %q: %v", pair, err)
+			continue
+		}
+		rates[name] = rate
+	}
+	return rates
+}
+
+func (e *AnalyticsEmitter) sampleRate(name string) float64 {
+	if rate, ok := e.rates[name]; ok {
+		return rate
+	}
+	return e.defaultRate
+}
+
+// Emit queues an event after sampling. It never blocks.
+func (e *AnalyticsEmitter) Emit(ev AnalyticsEvent) {
+	rate := e.sampleRate(ev.Name)
+	if rate <= 0 || (rate < 1 && rand.Float64() >= rate) {
+		return
+	}
+
+	ev.EventID = uuid.NewString()
+	ev.Service = "payment-service"
+	ev.Region = serviceRegion
+	ev.SampleRate = rate
+	if ev.OccurredAt.IsZero() {
+		ev.OccurredAt = time.Now().UTC()
+	}
+
+	select {
+	case e.queue <- ev:
+	default:
+		log.Printf("analytics: queue full, dropping %s for %s", ev.Name, ev.PaymentID)
+	}
+}
+
+func (e *AnalyticsEmitter) run() {
+	for ev := range e.queue {
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("analytics: encoding %s: %v", ev.Name, err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := e.pub.Publish(ctx, e.topic, ev.PaymentID, payload); err != nil {
+			log.Printf("analytics: publishing %s for %s: %v", ev.Name, ev.PaymentID, err)
+		}
+		cancel()
+	}
+}
+
+// hashCustomer pseudonymizes a customer ID so the warehouse can join on it
+// without learning the Stripe identifier.
+func (e *AnalyticsEmitter) hashCustomer(customerID string) string {
+	if customerID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(e.salt + customerID))
+	return hex.EncodeToString(sum[:])
+}
+
+// FromPaymentIntent fills the scrubbed, enriched fields of an event from a
+// PaymentIntent. Only allow-listed metadata keys are copied.
+func (e *AnalyticsEmitter) FromPaymentIntent(name string, pi *stripe.PaymentIntent) AnalyticsEvent {
+	ev := AnalyticsEvent{
+		Name:      name,
+		PaymentID: pi.ID,
+		TenantID:  pi.Metadata["tenant_id"],
+		OrderID:   pi.Metadata["order_id"],
+		Amount:    pi.Amount,
+		Currency:  string(pi.Currency),
+		Status:    string(pi.Status),
+		Livemode:  pi.Livemode,
+		RequestID: pi.Metadata["request_id"],
+	}
+	if pi.Customer != nil {
+		ev.CustomerHash = e.hashCustomer(pi.Customer.ID)
+	}
+	if pi.PaymentMethod != nil && pi.PaymentMethod.Type != "" {
+		ev.PaymentMethod = string(pi.PaymentMethod.Type)
+	} else if len(pi.PaymentMethodTypes) > 0 {
+		ev.PaymentMethod = pi.PaymentMethodTypes[0]
+	}
+	if perr := pi.LastPaymentError; perr != nil {
+		ev.ErrorCode = string(perr.Code)
+		ev.DeclineCode = string(perr.DeclineCode)
+		if perr.PaymentMethod != nil && perr.PaymentMethod.Type != "" {
+			ev.PaymentMethod = string(perr.PaymentMethod.Type)
+		}
+	}
+	return ev
+}
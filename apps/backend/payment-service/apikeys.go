@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// apiKeyPrefix marks secrets issued by this service so they are easy to
+// spot in logs and secret scanners.
+const apiKeyPrefix = "psk_"
+
+// APIKey is a stored key. The secret itself is only ever returned once, at
+// creation or rotation.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// QuotaPerMinute and QuotaPerDay are the key's own request quotas;
+	// nil follows the api_key_quotas default and 0 is unlimited.
+	QuotaPerMinute *int `json:"quota_per_minute"`
+	QuotaPerDay    *int `json:"quota_per_day"`
+}
+
+// HasScope reports whether the key grants scope, directly or via "admin".
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == "admin" {
+			return true
+		}
+	}
+	return false
+}
+
+func newAPIKeySecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func splitScopes(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// CreateAPIKey stores a new key and returns it with its secret.
+func (s *Store) CreateAPIKey(ctx context.Context, name string, scopes []string) (*APIKey, string, error) {
+	secret, err := newAPIKeySecret()
+	if err != nil {
+		return nil, "", err
+	}
+	key := &APIKey{
+		ID:        uuid.NewString(),
+		Name:      name,
+		Prefix:    secret[:len(apiKeyPrefix)+6],
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO api_keys (id, name, prefix, key_hash, scopes, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		key.ID, key.Name, key.Prefix, hashAPIKey(secret), strings.Join(scopes, ","), key.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+// RotateAPIKey issues a replacement with the same name, scopes and quotas. The old
+// key keeps working for grace so callers can roll over without downtime.
+func (s *Store) RotateAPIKey(ctx context.Context, id string, grace time.Duration) (*APIKey, string, error) {
+	old, err := s.APIKey(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	key, secret, err := s.CreateAPIKey(ctx, old.Name, old.Scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	if old.QuotaPerMinute != nil || old.QuotaPerDay != nil {
+		if key, err = s.SetAPIKeyQuota(ctx, key.ID, old.QuotaPerMinute, old.QuotaPerDay); err != nil {
+			return nil, "", err
+		}
+	}
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE api_keys SET expires_at = $2
+		WHERE id = $1 AND (expires_at IS NULL OR expires_at > $2)`,
+		id, time.Now().UTC().Add(grace))
+	return key, secret, err
+}
+
+func (s *Store) RevokeAPIKey(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+const apiKeyColumns = `id, name, prefix, scopes, created_at, expires_at, revoked_at, quota_per_minute, quota_per_day`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var key APIKey
+	var scopes string
+	var expires, revoked sql.NullTime
+	var perMinute, perDay sql.NullInt64
+	if err := row.Scan(&key.ID, &key.Name, &key.Prefix, &scopes, &key.CreatedAt, &expires, &revoked, &perMinute, &perDay); err != nil {
+		return nil, err
+	}
+	if perMinute.Valid {
+		n := int(perMinute.Int64)
+		key.QuotaPerMinute = &n
+	}
+	if perDay.Valid {
+		n := int(perDay.Int64)
+		key.QuotaPerDay = &n
+	}
+	key.Scopes = splitScopes(scopes)
+	if expires.Valid {
+		key.ExpiresAt = &expires.Time
+	}
+	if revoked.Valid {
+		key.RevokedAt = &revoked.Time
+	}
+	return &key, nil
+}
+
+func (s *Store) APIKey(ctx context.Context, id string) (*APIKey, error) {
+	return scanAPIKey(s.db.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE id = $1`, id))
+}
+
+func (s *Store) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// AuthenticateAPIKey returns the active key matching secret, or
+// sql.ErrNoRows.
+func (s *Store) AuthenticateAPIKey(ctx context.Context, secret string) (*APIKey, error) {
+	return scanAPIKey(s.db.QueryRowContext(ctx, `
+		SELECT `+apiKeyColumns+` FROM api_keys
+		WHERE key_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())`,
+		hashAPIKey(secret)))
+}
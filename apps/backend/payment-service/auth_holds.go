@@ -0,0 +1,741 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+var authorizationHoldEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_authorization_hold_events_total",
+	Help: "Extended authorization holds, by event (enrolled, reauthorized, reauth_failed, captured, released, expired).",
+}, []string{"event"})
+
+// Metadata on the intents of a hold: the hold, and on re-authorizations
+// the intent each one replaced.
+const (
+	metadataAuthHold     = "authorization_hold_id"
+	metadataReauthorizes = "reauthorizes"
+)
+
+// Authorization hold statuses. Everything but active is final.
+const (
+	authHoldActive   = "active"
+	authHoldCaptured = "captured"
+	authHoldReleased = "released"
+	authHoldExpired  = "expired"
+)
+
+// What a hold does when its card declines a re-authorization: try again
+// each sweep until the current authorization lapses, capture the current
+// authorization while it still can, or release it.
+const (
+	reauthFailureRetry   = "retry"
+	reauthFailureCapture = "capture"
+	reauthFailureRelease = "release"
+)
+
+// defaultAuthValidity is how long an authorization lasts on networks
+// without an entry in defaultAuthValidityHours or validity_hours. Stripe
+// cancels uncaptured payments after seven days whatever the network
+// allows.
+const defaultAuthValidity = 7 * 24 * time.Hour
+
+// defaultAuthValidityHours are networks whose authorizations lapse before
+// Stripe's seven days: Visa's customer-initiated ones last five.
+var defaultAuthValidityHours = map[string]int{"visa": 120}
+
+// AuthorizationHoldConfig drives extended holds. validity_hours overrides
+// how long each card network's authorizations last; a hold is
+// re-authorized reauthorize_before_hours before its authorization would
+// lapse. on_failure is retry, capture or release, per tenant or by
+// default.
+//
+//	"authorization_holds": {
+//	  "validity_hours": {"visa": 120, "mastercard": 168},
+//	  "reauthorize_before_hours": 24,
+//	  "on_failure": "retry",
+//	  "tenants": {"rentals": "capture"}
+//	}
+type AuthorizationHoldConfig struct {
+	ValidityHours map[string]int `json:"validity_hours"`
+	// ReauthorizeBeforeHours zero means 24.
+	ReauthorizeBeforeHours int `json:"reauthorize_before_hours"`
+	// OnFailure empty means retry.
+	OnFailure string            `json:"on_failure"`
+	Tenants   map[string]string `json:"tenants"`
+}
+
+func (cfg AuthorizationHoldConfig) validate() error {
+	for network, hours := range cfg.ValidityHours {
+		if hours < 1 || hours > 30*24 {
+			return fmt.Errorf("authorization_holds: validity_hours %s must be between 1 and 720", network)
+		}
+	}
+	if cfg.ReauthorizeBeforeHours < 0 || cfg.ReauthorizeBeforeHours > 72 {
+		return fmt.Errorf("authorization_holds: reauthorize_before_hours must be between 0 and 72")
+	}
+	check := func(name, v string) error {
+		switch v {
+		case "", reauthFailureRetry, reauthFailureCapture, reauthFailureRelease:
+			return nil
+		}
+		return fmt.Errorf("authorization_holds: %s must be retry, capture or release", name)
+	}
+	if err := check("on_failure", cfg.OnFailure); err != nil {
+		return err
+	}
+	for tenant, v := range cfg.Tenants {
+		if err := check("tenants."+tenant, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validity is how long an authorization on network lasts.
+func (cfg AuthorizationHoldConfig) validity(network string) time.Duration {
+	if hours, ok := cfg.ValidityHours[network]; ok {
+		return time.Duration(hours) * time.Hour
+	}
+	if hours, ok := defaultAuthValidityHours[network]; ok {
+		return time.Duration(hours) * time.Hour
+	}
+	return defaultAuthValidity
+}
+
+func (cfg AuthorizationHoldConfig) lead() time.Duration {
+	if cfg.ReauthorizeBeforeHours == 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(cfg.ReauthorizeBeforeHours) * time.Hour
+}
+
+func (cfg AuthorizationHoldConfig) onFailure(tenantID string) string {
+	if v, ok := cfg.Tenants[tenantID]; ok && tenantID != "" && v != "" {
+		return v
+	}
+	if cfg.OnFailure == "" {
+		return reauthFailureRetry
+	}
+	return cfg.OnFailure
+}
+
+// AuthorizationHold keeps a card authorization alive for as long as a
+// rental or deposit needs it, by re-authorizing on the saved card before
+// each authorization lapses.
+type AuthorizationHold struct {
+	ID                string `json:"id"`
+	PaymentID         string `json:"payment_id"`
+	OriginalPaymentID string `json:"original_payment_id"`
+	TenantID          string `json:"tenant_id,omitempty"`
+	CustomerID        string `json:"customer_id"`
+	PaymentMethod     string `json:"payment_method"`
+	Amount            int64  `json:"amount"`
+	Currency          string `json:"currency"`
+	Network           string `json:"network,omitempty"`
+	Status            string `json:"status"`
+	// HoldUntil is when the hold is no longer needed; it is not
+	// re-authorized past it. Nil holds until captured or released.
+	HoldUntil        *time.Time `json:"hold_until,omitempty"`
+	AuthorizedAt     time.Time  `json:"authorized_at"`
+	AuthExpiresAt    time.Time  `json:"auth_expires_at"`
+	Reauthorizations int        `json:"reauthorizations"`
+	// Failures counts declined re-authorizations since the last one that
+	// went through.
+	Failures  int        `json:"failures"`
+	LastError string     `json:"last_error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+}
+
+const authorizationHoldColumns = `id, payment_id, original_payment_id, tenant_id, customer_id, payment_method, amount, currency,
+	network, status, hold_until, authorized_at, auth_expires_at, reauthorizations, failures, last_error, created_at,
+	updated_at, ended_at`
+
+func scanAuthorizationHold(row interface{ Scan(...interface{}) error }) (*AuthorizationHold, error) {
+	var h AuthorizationHold
+	var holdUntil, ended sql.NullTime
+	if err := row.Scan(&h.ID, &h.PaymentID, &h.OriginalPaymentID, &h.TenantID, &h.CustomerID, &h.PaymentMethod, &h.Amount,
+		&h.Currency, &h.Network, &h.Status, &holdUntil, &h.AuthorizedAt, &h.AuthExpiresAt, &h.Reauthorizations,
+		&h.Failures, &h.LastError, &h.CreatedAt, &h.UpdatedAt, &ended); err != nil {
+		return nil, err
+	}
+	h.HoldUntil = timeOrNil(holdUntil)
+	h.EndedAt = timeOrNil(ended)
+	return &h, nil
+}
+
+var authorizationHoldList = listResource{
+	from: "authorization_holds h",
+	fields: []string{"id", "payment_id", "original_payment_id", "tenant_id", "customer_id", "amount", "currency",
+		"network", "status", "hold_until", "auth_expires_at", "reauthorizations", "failures", "last_error", "created_at"},
+	columns: map[string]listField{
+		"id":                  {"h.id", textField},
+		"payment_id":          {"h.payment_id", textField},
+		"original_payment_id": {"h.original_payment_id", textField},
+		"tenant_id":           {"h.tenant_id", textField},
+		"customer_id":         {"h.customer_id", textField},
+		"amount":              {"h.amount", intField},
+		"currency":            {"h.currency", textField},
+		"network":             {"h.network", textField},
+		"status":              {"h.status", textField},
+		"hold_until":          {"h.hold_until", timeField},
+		"auth_expires_at":     {"h.auth_expires_at", timeField},
+		"reauthorizations":    {"h.reauthorizations", intField},
+		"failures":            {"h.failures", intField},
+		"last_error":          {"h.last_error", textField},
+		"created_at":          {"h.created_at", timeField},
+	},
+}
+
+// CreateAuthorizationHold records h, or returns the hold its payment is
+// already in.
+func (s *Store) CreateAuthorizationHold(ctx context.Context, h *AuthorizationHold) (*AuthorizationHold, error) {
+	created, err := scanAuthorizationHold(s.db.QueryRowContext(ctx, `
+		INSERT INTO authorization_holds (id, payment_id, original_payment_id, tenant_id, customer_id, payment_method,
+			amount, currency, network, status, hold_until, authorized_at, auth_expires_at)
+		VALUES ($1, $2, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT DO NOTHING
+		RETURNING `+authorizationHoldColumns,
+		h.ID, h.PaymentID, h.TenantID, h.CustomerID, h.PaymentMethod, h.Amount, h.Currency, h.Network, h.Status,
+		h.HoldUntil, h.AuthorizedAt, h.AuthExpiresAt))
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.AuthorizationHoldOfPayment(ctx, h.PaymentID)
+	}
+	return created, err
+}
+
+func (s *Store) AuthorizationHold(ctx context.Context, id string) (*AuthorizationHold, error) {
+	return scanAuthorizationHold(s.db.QueryRowContext(ctx, `
+		SELECT `+authorizationHoldColumns+` FROM authorization_holds WHERE id = $1`, id))
+}
+
+// AuthorizationHoldOfPayment finds the hold a payment is, or was first,
+// held by.
+func (s *Store) AuthorizationHoldOfPayment(ctx context.Context, paymentID string) (*AuthorizationHold, error) {
+	return scanAuthorizationHold(s.db.QueryRowContext(ctx, `
+		SELECT `+authorizationHoldColumns+` FROM authorization_holds
+		WHERE payment_id = $1 OR original_payment_id = $1 LIMIT 1`, paymentID))
+}
+
+// DueAuthorizationHolds returns up to limit active holds whose
+// authorization lapses before cutoff: those still wanted, to be
+// re-authorized, and those already lapsed, to be closed.
+func (s *Store) DueAuthorizationHolds(ctx context.Context, cutoff time.Time, limit int) ([]*AuthorizationHold, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+authorizationHoldColumns+` FROM authorization_holds
+		WHERE status = 'active' AND auth_expires_at <= $1
+			AND (hold_until IS NULL OR hold_until > now() OR auth_expires_at <= now())
+		ORDER BY auth_expires_at LIMIT $2`, cutoff, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holds := []*AuthorizationHold{}
+	for rows.Next() {
+		h, err := scanAuthorizationHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, h)
+	}
+	return holds, rows.Err()
+}
+
+// UpdateAuthorizationHold saves h's authorization and counters, provided
+// it is still active on paymentID. It returns sql.ErrNoRows otherwise.
+func (s *Store) UpdateAuthorizationHold(ctx context.Context, h *AuthorizationHold, paymentID string) (*AuthorizationHold, error) {
+	return scanAuthorizationHold(s.db.QueryRowContext(ctx, `
+		UPDATE authorization_holds SET payment_id = $3, network = $4, authorized_at = $5, auth_expires_at = $6,
+			reauthorizations = $7, failures = $8, last_error = $9, updated_at = now()
+		WHERE id = $1 AND status = 'active' AND payment_id = $2
+		RETURNING `+authorizationHoldColumns,
+		h.ID, paymentID, h.PaymentID, h.Network, h.AuthorizedAt, h.AuthExpiresAt, h.Reauthorizations, h.Failures,
+		h.LastError))
+}
+
+// EndAuthorizationHold closes an active hold with status. It returns
+// sql.ErrNoRows when the hold had already ended.
+func (s *Store) EndAuthorizationHold(ctx context.Context, id, status, lastError string) (*AuthorizationHold, error) {
+	return scanAuthorizationHold(s.db.QueryRowContext(ctx, `
+		UPDATE authorization_holds SET status = $2,
+			last_error = CASE WHEN $3 = '' THEN last_error ELSE $3 END, ended_at = now(), updated_at = now()
+		WHERE id = $1 AND status = 'active'
+		RETURNING `+authorizationHoldColumns, id, status, lastError))
+}
+
+// AuthorizationHolds keeps deposits and rental holds authorized past the
+// network's validity window. An authorized, manually captured payment on
+// a customer's saved card is enrolled; before its authorization lapses,
+// per its card network, a worker authorizes the same amount again off
+// session and cancels the old authorization. When the card declines, the
+// tenant's on_failure decides: retry until the current authorization
+// lapses, capture it, or release it. Every outcome is an event on the
+// payment's stream.
+type AuthorizationHolds struct {
+	store    *Store
+	settings *RuntimeSettings
+	hub      *EventHub
+	interval time.Duration
+	payments PaymentRepository
+}
+
+func NewAuthorizationHolds(store *Store, settings *RuntimeSettings, hub *EventHub, interval time.Duration) *AuthorizationHolds {
+	return &AuthorizationHolds{store: store, settings: settings, hub: hub, interval: interval}
+}
+
+// RegisterRoutes mounts enrollment and the holds API, which capture and
+// release customers' money and so need a key with the payments scope.
+func (ah *AuthorizationHolds) RegisterRoutes(r gin.IRouter, bootstrapToken string) {
+	auth := requireScope(ah.store, bootstrapToken, "payments")
+	r.POST("/payment/:id/extended-hold", auth, ah.requireStore, ah.enroll)
+	g := r.Group("/authorization-holds", auth, ah.requireStore)
+	g.GET("", ah.list)
+	g.GET("/:id", ah.get)
+	g.POST("/:id/capture", ah.capture)
+	g.POST("/:id/release", ah.release)
+}
+
+// list lists one tenant's holds, named by tenant_id, which the list
+// query then filters on.
+func (ah *AuthorizationHolds) list(c *gin.Context) {
+	if tenantID := c.Query("tenant_id"); tenantID == "" || strings.Contains(tenantID, ",") {
+		validationFailed(c, []FieldError{{Field: "tenant_id", Code: "required", Message: "must name one tenant"}})
+		return
+	}
+	listHandler(ah.store, authorizationHoldList)(c)
+}
+
+func (ah *AuthorizationHolds) requireStore(c *gin.Context) {
+	if ah.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Authorization holds require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// cardNetwork is the network of pi's authorized card, or "".
+func cardNetwork(pi *stripe.PaymentIntent) string {
+	ch := pi.LatestCharge
+	if ch == nil || ch.PaymentMethodDetails == nil || ch.PaymentMethodDetails.Card == nil {
+		return ""
+	}
+	if n := ch.PaymentMethodDetails.Card.Network; n != "" {
+		return string(n)
+	}
+	return string(ch.PaymentMethodDetails.Card.Brand)
+}
+
+// authorized fills in h's authorization from pi, authorized at.
+func (ah *AuthorizationHolds) authorized(h *AuthorizationHold, pi *stripe.PaymentIntent, at time.Time) {
+	h.PaymentID = pi.ID
+	h.Network = cardNetwork(pi)
+	h.AuthorizedAt = at
+	h.AuthExpiresAt = at.Add(ah.settings.Get().AuthorizationHolds.validity(h.Network))
+}
+
+// enroll puts an authorized payment on a customer's saved card under an
+// extended hold, optionally until hold_until. Enrolling a payment again
+// answers with its hold.
+func (ah *AuthorizationHolds) enroll(c *gin.Context) {
+	var req struct {
+		HoldUntil *time.Time `json:"hold_until"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+	if req.HoldUntil != nil && !req.HoldUntil.After(time.Now()) {
+		validationFailed(c, []FieldError{{Field: "hold_until", Code: "invalid", Message: "must be in the future"}})
+		return
+	}
+	ctx := c.Request.Context()
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	params.AddExpand("latest_charge")
+	pi, err := paymentintent.Get(c.Param("id"), params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if status := paymentStatus(pi); status != string(stripe.PaymentIntentStatusRequiresCapture) {
+		c.JSON(http.StatusConflict, errorBody(c, CodePaymentState, "The payment is "+status+" and can't be held"))
+		return
+	}
+	if pi.Customer == nil || pi.PaymentMethod == nil || cardNetwork(pi) == "" {
+		c.JSON(http.StatusConflict, errorBody(c, CodePaymentState, "Only card payments saved to a customer can be held"))
+		return
+	}
+
+	authorizedAt := time.Unix(pi.LatestCharge.Created, 0).UTC()
+	h := &AuthorizationHold{
+		ID:            "ah_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		TenantID:      pi.Metadata["tenant_id"],
+		CustomerID:    pi.Customer.ID,
+		PaymentMethod: pi.PaymentMethod.ID,
+		Amount:        pi.AmountCapturable,
+		Currency:      string(pi.Currency),
+		Status:        authHoldActive,
+		HoldUntil:     req.HoldUntil,
+	}
+	ah.authorized(h, pi, authorizedAt)
+	created, err := ah.store.CreateAuthorizationHold(ctx, h)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if created.ID != h.ID {
+		respondData(c, http.StatusOK, created)
+		return
+	}
+	meta := &stripe.PaymentIntentParams{}
+	meta.Context = ctx
+	meta.AddMetadata(metadataAuthHold, created.ID)
+	if _, err := paymentintent.Update(pi.ID, meta); err != nil {
+		logf(ctx, "marking payment %s held by %s: %v", pi.ID, created.ID, err)
+	}
+	authorizationHoldEvents.WithLabelValues("enrolled").Inc()
+	recordAdminAction(c, ah.store, created.PaymentID, "authorization_hold.enrolled", created.ID,
+		gin.H{"amount": created.Amount, "hold_until": created.HoldUntil})
+	respondData(c, http.StatusCreated, created)
+}
+
+func (ah *AuthorizationHolds) get(c *gin.Context) {
+	h, err := ah.store.AuthorizationHold(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Authorization hold not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, h)
+}
+
+// activeHold loads the hold a request is about, answering for it unless
+// the hold is still active.
+func (ah *AuthorizationHolds) activeHold(c *gin.Context) (*AuthorizationHold, bool) {
+	h, err := ah.store.AuthorizationHold(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Authorization hold not found"))
+		return nil, false
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return nil, false
+	case h.Status != authHoldActive:
+		c.JSON(http.StatusConflict, errorBodyWith(c, CodePaymentState, "The hold is "+h.Status, gin.H{"status": h.Status}))
+		return nil, false
+	}
+	return h, true
+}
+
+// capture collects amount, or all of it, from the hold's current
+// authorization and ends the hold.
+func (ah *AuthorizationHolds) capture(c *gin.Context) {
+	var req struct {
+		Amount int64 `json:"amount" binding:"gte=0"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+	h, ok := ah.activeHold(c)
+	if !ok {
+		return
+	}
+	if req.Amount > h.Amount {
+		validationFailed(c, []FieldError{{Field: "amount", Code: "too_large",
+			Message: "must be at most the held " + strconv.FormatInt(h.Amount, 10)}})
+		return
+	}
+	h, err := ah.end(c.Request.Context(), h, authHoldCaptured, req.Amount, "")
+	if err == nil {
+		recordAdminAction(c, ah.store, h.PaymentID, "authorization_hold."+authHoldCaptured, h.ID, gin.H{"amount": req.Amount})
+	}
+	ah.respondEnd(c, h, err)
+}
+
+// release cancels the hold's current authorization and ends the hold.
+func (ah *AuthorizationHolds) release(c *gin.Context) {
+	h, ok := ah.activeHold(c)
+	if !ok {
+		return
+	}
+	h, err := ah.end(c.Request.Context(), h, authHoldReleased, 0, "")
+	if err == nil {
+		recordAdminAction(c, ah.store, h.PaymentID, "authorization_hold."+authHoldReleased, h.ID, nil)
+	}
+	ah.respondEnd(c, h, err)
+}
+
+func (ah *AuthorizationHolds) respondEnd(c *gin.Context, h *AuthorizationHold, err error) {
+	var stripeErr *stripe.Error
+	var refused *refusal
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusConflict, errorBody(c, CodePaymentState, "The hold ended meanwhile"))
+	case errors.As(err, &refused):
+		c.JSON(refused.status, errorBodyWith(c, refused.code, refused.message, refused.ext))
+	case errors.As(err, &stripeErr):
+		respondError(c, err)
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+	default:
+		respondData(c, http.StatusOK, h)
+	}
+}
+
+// end captures or cancels the hold's current authorization, then closes
+// the hold. Both carry the hold's idempotency keys, so ending it again
+// after a failure in between does it once.
+func (ah *AuthorizationHolds) end(ctx context.Context, h *AuthorizationHold, status string, amount int64, why string) (*AuthorizationHold, error) {
+	var pi *stripe.PaymentIntent
+	var err error
+	if status == authHoldCaptured {
+		params := &stripe.PaymentIntentCaptureParams{}
+		params.Context = ctx
+		if amount > 0 {
+			params.AmountToCapture = stripe.Int64(amount)
+		}
+		params.SetIdempotencyKey("auth-hold-capture-" + h.PaymentID)
+		hp := &HookPayment{ID: h.PaymentID, TenantID: h.TenantID, CustomerID: h.CustomerID, Amount: h.Amount, Currency: h.Currency}
+		if refused := lifecycleHooks.preCapture(ctx, hp, params); refused != nil {
+			return nil, refused
+		}
+		pi, err = paymentintent.Capture(h.PaymentID, params)
+	} else {
+		params := &stripe.PaymentIntentCancelParams{
+			CancellationReason: stripe.String(string(stripe.PaymentIntentCancellationReasonRequestedByCustomer)),
+		}
+		params.Context = ctx
+		params.SetIdempotencyKey("auth-hold-release-" + h.PaymentID)
+		pi, err = paymentintent.Cancel(h.PaymentID, params)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ctx = context.WithoutCancel(ctx)
+	ah.save(ctx, pi)
+	h, err = ah.store.EndAuthorizationHold(ctx, h.ID, status, why)
+	if err != nil {
+		return nil, err
+	}
+	authorizationHoldEvents.WithLabelValues(status).Inc()
+	ah.publish(ctx, pi, "payment.hold_"+status)
+	return h, nil
+}
+
+// paymentIntentEvent ends a hold whose current payment was captured or
+// canceled some other way, such as POST /payment/:id/capture. Intents a
+// re-authorization replaced are not the current one and change nothing.
+func (ah *AuthorizationHolds) paymentIntentEvent(ctx context.Context, typ stripe.EventType, pi *stripe.PaymentIntent) error {
+	if ah == nil || ah.store == nil || pi.Metadata[metadataAuthHold] == "" {
+		return nil
+	}
+	var status string
+	switch typ {
+	case "payment_intent.succeeded":
+		status = authHoldCaptured
+	case "payment_intent.canceled":
+		status = authHoldReleased
+	default:
+		return nil
+	}
+	h, err := ah.store.AuthorizationHold(ctx, pi.Metadata[metadataAuthHold])
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("authorization hold of %s: %w", pi.ID, err)
+	}
+	if h.Status != authHoldActive || h.PaymentID != pi.ID {
+		return nil
+	}
+	if _, err := ah.store.EndAuthorizationHold(ctx, h.ID, status, ""); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("ending authorization hold %s: %w", h.ID, err)
+	}
+	authorizationHoldEvents.WithLabelValues(status).Inc()
+	return nil
+}
+
+func (ah *AuthorizationHolds) publish(ctx context.Context, pi *stripe.PaymentIntent, typ string) {
+	ah.hub.Publish(PaymentEvent{
+		PaymentID:  pi.ID,
+		TenantID:   pi.Metadata["tenant_id"],
+		CustomerID: customerIDOf(pi.Customer),
+		Type:       typ,
+		Status:     paymentStatus(pi),
+		Amount:     pi.Amount,
+		Currency:   string(pi.Currency),
+		CreatedAt:  time.Now().UTC(),
+		RequestID:  requestIDFrom(ctx),
+	})
+}
+
+// Run re-authorizes holds coming up on their network's expiry every
+// interval until ctx is done.
+func (ah *AuthorizationHolds) Run(ctx context.Context) {
+	if ah == nil || ah.store == nil {
+		return
+	}
+	ticker := time.NewTicker(ah.interval)
+	defer ticker.Stop()
+	for {
+		if err := ah.sweep(ctx); err != nil {
+			log.Printf("authorization holds: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ah *AuthorizationHolds) sweep(ctx context.Context) error {
+	cutoff := time.Now().Add(ah.settings.Get().AuthorizationHolds.lead())
+	due, err := ah.store.DueAuthorizationHolds(ctx, cutoff, 100)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, h := range due {
+		if err := ah.reauthorize(ctx, h); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			errs = append(errs, fmt.Errorf("re-authorizing hold %s: %w", h.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reauthorize moves h to a new authorization of the same amount on the
+// same card, then cancels the old one. A hold whose authorization lapsed
+// is closed as expired; one the card declines is handled per the
+// tenant's on_failure. Errors other than declines are retried next sweep.
+func (ah *AuthorizationHolds) reauthorize(ctx context.Context, h *AuthorizationHold) error {
+	if !time.Now().Before(h.AuthExpiresAt) {
+		_, err := ah.store.EndAuthorizationHold(ctx, h.ID, authHoldExpired, "authorization lapsed")
+		if err == nil {
+			authorizationHoldEvents.WithLabelValues("expired").Inc()
+			logf(ctx, "authorization hold %s: %s lapsed before it was re-authorized", h.ID, h.PaymentID)
+		}
+		return err
+	}
+
+	get := &stripe.PaymentIntentParams{}
+	get.Context = ctx
+	old, err := paymentintent.Get(h.PaymentID, get)
+	if err != nil {
+		return err
+	}
+	params := &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(h.Amount),
+		Currency:      stripe.String(h.Currency),
+		Customer:      stripe.String(h.CustomerID),
+		PaymentMethod: stripe.String(h.PaymentMethod),
+		CaptureMethod: stripe.String(string(stripe.PaymentIntentCaptureMethodManual)),
+		Confirm:       stripe.Bool(true),
+		OffSession:    stripe.Bool(true),
+	}
+	params.Context = ctx
+	if old.Description != "" {
+		params.Description = stripe.String(old.Description)
+	}
+	for k, v := range old.Metadata {
+		params.AddMetadata(k, v)
+	}
+	params.AddMetadata(metadataAuthHold, h.ID)
+	params.AddMetadata(metadataReauthorizes, old.ID)
+	params.AddExpand("latest_charge")
+	params.SetIdempotencyKey(fmt.Sprintf("auth-hold-%s-%d", h.ID, h.Reauthorizations+1))
+	pi, err := paymentintent.New(params)
+
+	var stripeErr *stripe.Error
+	switch {
+	case errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeCard:
+		return ah.reauthFailed(ctx, h, old, declineOf(stripeErr))
+	case err != nil:
+		return err
+	case pi.Status != stripe.PaymentIntentStatusRequiresCapture:
+		// Nothing to hold; don't leave it waiting on the customer.
+		cancel := &stripe.PaymentIntentCancelParams{}
+		cancel.Context = ctx
+		if _, err := paymentintent.Cancel(pi.ID, cancel); err != nil {
+			logf(ctx, "canceling re-authorization %s of hold %s: %v", pi.ID, h.ID, err)
+		}
+		return ah.reauthFailed(ctx, h, old, "re-authorization "+string(pi.Status))
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	previous := h.PaymentID
+	h.Reauthorizations++
+	h.Failures, h.LastError = 0, ""
+	ah.authorized(h, pi, time.Unix(pi.LatestCharge.Created, 0).UTC())
+	if h, err = ah.store.UpdateAuthorizationHold(ctx, h, previous); err != nil {
+		return err
+	}
+	ah.save(ctx, pi)
+	authorizationHoldEvents.WithLabelValues("reauthorized").Inc()
+	ah.publish(ctx, pi, "payment.hold_reauthorized")
+
+	// The hold has moved, so a failure to release the old authorization
+	// is logged; it lapses by itself soon enough.
+	cancel := &stripe.PaymentIntentCancelParams{
+		CancellationReason: stripe.String(string(stripe.PaymentIntentCancellationReasonDuplicate)),
+	}
+	cancel.Context = ctx
+	cancel.SetIdempotencyKey("auth-hold-replaced-" + previous)
+	if old, err = paymentintent.Cancel(previous, cancel); err != nil {
+		logf(ctx, "releasing %s replaced by %s in hold %s: %v", previous, pi.ID, h.ID, err)
+		return nil
+	}
+	ah.save(ctx, old)
+	return nil
+}
+
+// save records a changed intent; its webhook fills the gap on failure.
+func (ah *AuthorizationHolds) save(ctx context.Context, pi *stripe.PaymentIntent) {
+	if ah.payments == nil {
+		return
+	}
+	if err := ah.payments.SavePayment(ctx, pi); err != nil {
+		logf(ctx, "saving payment %s: %v", pi.ID, err)
+	}
+}
+
+// reauthFailed records a declined re-authorization and applies the
+// tenant's on_failure to the current one.
+func (ah *AuthorizationHolds) reauthFailed(ctx context.Context, h *AuthorizationHold, current *stripe.PaymentIntent, reason string) error {
+	ctx = context.WithoutCancel(ctx)
+	authorizationHoldEvents.WithLabelValues("reauth_failed").Inc()
+	logf(ctx, "authorization hold %s: re-authorization declined: %s", h.ID, reason)
+	ah.publish(ctx, current, "payment.hold_reauth_failed")
+
+	switch ah.settings.Get().AuthorizationHolds.onFailure(h.TenantID) {
+	case reauthFailureCapture:
+		_, err := ah.end(ctx, h, authHoldCaptured, 0, reason)
+		return err
+	case reauthFailureRelease:
+		_, err := ah.end(ctx, h, authHoldReleased, 0, reason)
+		return err
+	}
+	h.Failures++
+	h.LastError = reason
+	_, err := ah.store.UpdateAuthorizationHold(ctx, h, h.PaymentID)
+	return err
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var balanceHolds = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_balance_holds_total",
+	Help: "Holds placed on and released from sellers' balances, by reason.",
+}, []string{"reason", "action"})
+
+// Balance hold statuses.
+const (
+	holdActive   = "active"
+	holdReleased = "released"
+)
+
+var (
+	errBalanceHoldState = errors.New("balance hold is already released")
+	// errHoldExceedsBalance refuses a hold beyond what the seller has left
+	// that isn't already held.
+	errHoldExceedsBalance = errors.New("hold exceeds the seller's unheld balance")
+)
+
+func sellerLedgerAccount(accountID string) string { return "seller:" + accountID }
+
+func reserveLedgerAccount(accountID string) string { return "reserve:" + accountID }
+
+// BalanceHold keeps part of a seller's balance out of their payouts, while
+// a dispute is open or a fraud investigation runs. Placing one moves the
+// amount from the seller's ledger account to their reserve, and releasing
+// it moves it back, so what is held is the reserve's balance.
+type BalanceHold struct {
+	ID          string     `json:"id"`
+	AccountID   string     `json:"account_id"`
+	TenantID    string     `json:"tenant_id,omitempty"`
+	SellerID    string     `json:"seller_id,omitempty"`
+	Amount      int64      `json:"amount"`
+	Currency    string     `json:"currency"`
+	Reason      string     `json:"reason"`
+	Reference   string     `json:"reference,omitempty"`
+	Note        string     `json:"note,omitempty"`
+	Status      string     `json:"status"`
+	PlacedBy    string     `json:"placed_by,omitempty"`
+	ReleasedBy  string     `json:"released_by,omitempty"`
+	ReleaseNote string     `json:"release_note,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ReleasedAt  *time.Time `json:"released_at,omitempty"`
+}
+
+const balanceHoldColumns = `id, account_id, tenant_id, seller_id, amount, currency, reason, reference, note, status,
+	placed_by, released_by, release_note, created_at, released_at`
+
+func scanBalanceHold(row interface{ Scan(...interface{}) error }) (*BalanceHold, error) {
+	var h BalanceHold
+	var released sql.NullTime
+	if err := row.Scan(&h.ID, &h.AccountID, &h.TenantID, &h.SellerID, &h.Amount, &h.Currency, &h.Reason,
+		&h.Reference, &h.Note, &h.Status, &h.PlacedBy, &h.ReleasedBy, &h.ReleaseNote, &h.CreatedAt, &released); err != nil {
+		return nil, err
+	}
+	h.ReleasedAt = timeOrNil(released)
+	return &h, nil
+}
+
+var balanceHoldList = listResource{
+	from: "balance_holds h",
+	fields: []string{"id", "account_id", "tenant_id", "seller_id", "amount", "currency", "reason", "reference",
+		"status", "placed_by", "released_by", "created_at", "released_at"},
+	columns: map[string]listField{
+		"id":          {"h.id", textField},
+		"account_id":  {"h.account_id", textField},
+		"tenant_id":   {"h.tenant_id", textField},
+		"seller_id":   {"h.seller_id", textField},
+		"amount":      {"h.amount", intField},
+		"currency":    {"h.currency", textField},
+		"reason":      {"h.reason", textField},
+		"reference":   {"h.reference", textField},
+		"status":      {"h.status", textField},
+		"placed_by":   {"h.placed_by", textField},
+		"released_by": {"h.released_by", textField},
+		"created_at":  {"h.created_at", timeField},
+		"released_at": {"h.released_at", timeField},
+	},
+}
+
+// heldBalances is what holds keep back from accountID, per currency: its
+// reserve's balance in the ledger.
+func heldBalances(ctx context.Context, q interface {
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}, accountID string) (map[string]int64, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT t.currency, sum(e.amount)
+		FROM ledger_entries e JOIN ledger_transactions t ON t.id = e.transaction_id
+		WHERE e.account = $1
+		GROUP BY t.currency`, reserveLedgerAccount(accountID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	held := map[string]int64{}
+	for rows.Next() {
+		var currency string
+		var amount int64
+		if err := rows.Scan(&currency, &amount); err != nil {
+			return nil, err
+		}
+		if amount != 0 {
+			held[currency] = amount
+		}
+	}
+	return held, rows.Err()
+}
+
+func (s *Store) HeldBalances(ctx context.Context, accountID string) (map[string]int64, error) {
+	return heldBalances(ctx, s.db, accountID)
+}
+
+// PlaceBalanceHold saves h and moves its amount into the seller's reserve.
+// balance is the seller's balance in h's currency; the hold is refused
+// with errHoldExceedsBalance if it and the holds already placed would be
+// more than that. Holds on one account are placed one at a time.
+func (s *Store) PlaceBalanceHold(ctx context.Context, h *BalanceHold, balance int64) (*BalanceHold, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM connected_accounts WHERE id = $1 FOR UPDATE`, h.AccountID); err != nil {
+		return nil, err
+	}
+	held, err := heldBalances(ctx, tx, h.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if held[h.Currency]+h.Amount > balance {
+		return nil, errHoldExceedsBalance
+	}
+	saved, err := scanBalanceHold(tx.QueryRowContext(ctx, `
+		INSERT INTO balance_holds (id, account_id, tenant_id, seller_id, amount, currency, reason, reference, note,
+			status, placed_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING `+balanceHoldColumns,
+		h.ID, h.AccountID, h.TenantID, h.SellerID, h.Amount, h.Currency, h.Reason, h.Reference, h.Note, holdActive, h.PlacedBy))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := postLedger(ctx, tx, "balance_hold.placed", saved.ID, saved.Currency,
+		LedgerEntry{Account: sellerLedgerAccount(saved.AccountID), Amount: -saved.Amount},
+		LedgerEntry{Account: reserveLedgerAccount(saved.AccountID), Amount: saved.Amount}); err != nil {
+		return nil, err
+	}
+	return saved, tx.Commit()
+}
+
+// ReleaseBalanceHold returns a hold's amount to the seller. Releasing a
+// released hold is errBalanceHoldState.
+func (s *Store) ReleaseBalanceHold(ctx context.Context, id, actor, note string) (*BalanceHold, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	h, err := scanBalanceHold(tx.QueryRowContext(ctx, `SELECT `+balanceHoldColumns+` FROM balance_holds WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		return nil, err
+	}
+	if h.Status != holdActive {
+		return h, errBalanceHoldState
+	}
+	h, err = scanBalanceHold(tx.QueryRowContext(ctx, `
+		UPDATE balance_holds SET status = $2, released_by = $3, release_note = $4, released_at = now()
+		WHERE id = $1
+		RETURNING `+balanceHoldColumns, id, holdReleased, actor, note))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := postLedger(ctx, tx, "balance_hold.released", h.ID, h.Currency,
+		LedgerEntry{Account: reserveLedgerAccount(h.AccountID), Amount: -h.Amount},
+		LedgerEntry{Account: sellerLedgerAccount(h.AccountID), Amount: h.Amount}); err != nil {
+		return nil, err
+	}
+	return h, tx.Commit()
+}
+
+func (s *Store) BalanceHold(ctx context.Context, id string) (*BalanceHold, error) {
+	return scanBalanceHold(s.db.QueryRowContext(ctx, `SELECT `+balanceHoldColumns+` FROM balance_holds WHERE id = $1`, id))
+}
+
+// BalanceHolds places and releases holds on sellers' balances. Holds
+// bound on-demand payouts and the balance sellers are shown; Stripe's own
+// scheduled payouts don't see them, so a seller under investigation
+// should be moved to a manual payout schedule too.
+type BalanceHolds struct {
+	store *Store
+}
+
+func NewBalanceHolds(store *Store) *BalanceHolds {
+	return &BalanceHolds{store: store}
+}
+
+// RegisterRoutes mounts balance holds under the connect scope.
+func (bh *BalanceHolds) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	auth := requireScope(bh.store, bootstrapToken, connectScope)
+	r.POST("/sellers/:id/holds", auth, bh.requireStore, bh.place)
+
+	g := r.Group("/connect/holds", auth, bh.requireStore)
+	g.GET("", listHandler(bh.store, balanceHoldList))
+	g.GET("/:id", bh.get)
+	g.POST("/:id/release", bh.release)
+}
+
+func (bh *BalanceHolds) requireStore(c *gin.Context) {
+	if bh.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Balance holds require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// place holds back part of the seller's balance, pending funds included,
+// up to what isn't already held.
+func (bh *BalanceHolds) place(c *gin.Context) {
+	var req struct {
+		Amount    int64  `json:"amount" binding:"required,min=1"`
+		Currency  string `json:"currency" binding:"required,len=3"`
+		Reason    string `json:"reason" binding:"required,oneof=dispute fraud_investigation other"`
+		Reference string `json:"reference" binding:"max=200"`
+		Note      string `json:"note" binding:"max=1000"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	req.Currency = strings.ToLower(req.Currency)
+	a, ok := sellerAccount(c, bh.store)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	b, err := sellerBalance(ctx, a.ID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	total := balanceAmount(b.Available, req.Currency) + balanceAmount(b.Pending, req.Currency)
+
+	h, err := bh.store.PlaceBalanceHold(ctx, &BalanceHold{
+		ID:        "hold_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		AccountID: a.ID,
+		TenantID:  a.TenantID,
+		SellerID:  a.SellerID,
+		Amount:    req.Amount,
+		Currency:  req.Currency,
+		Reason:    req.Reason,
+		Reference: req.Reference,
+		Note:      req.Note,
+		PlacedBy:  c.GetString("api_key_id"),
+	}, total)
+	if errors.Is(err, errHoldExceedsBalance) {
+		c.JSON(http.StatusUnprocessableEntity, errorBodyWith(c, CodeInsufficientBalance, "Hold exceeds the seller's unheld balance",
+			gin.H{"balance": total, "currency": req.Currency}))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	balanceHolds.WithLabelValues(h.Reason, "placed").Inc()
+	respondData(c, http.StatusCreated, h)
+}
+
+func (bh *BalanceHolds) get(c *gin.Context) {
+	h, err := bh.store.BalanceHold(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Balance hold not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, h)
+}
+
+func (bh *BalanceHolds) release(c *gin.Context) {
+	var req struct {
+		Note string `json:"note" binding:"max=1000"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+	h, err := bh.store.ReleaseBalanceHold(c.Request.Context(), c.Param("id"), c.GetString("api_key_id"), req.Note)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Balance hold not found"))
+		return
+	case errors.Is(err, errBalanceHoldState):
+		c.JSON(http.StatusConflict, errorBodyWith(c, CodeBalanceHoldState, "Hold is already released", gin.H{"hold": h}))
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	balanceHolds.WithLabelValues(h.Reason, "released").Inc()
+	respondData(c, http.StatusOK, h)
+}
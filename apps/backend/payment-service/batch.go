@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"golang.org/x/text/language"
+)
+
+// BatchPaymentRequest is the body of POST /payments/batch.
+type BatchPaymentRequest struct {
+	// Items are validated one by one so a bad item fails alone.
+	Payments []PaymentRequest `json:"payments" binding:"required,min=1"`
+}
+
+// BatchItemResult is one item's outcome, at the item's index.
+type BatchItemResult struct {
+	Index   int      `json:"index"`
+	Status  string   `json:"status"`
+	Payment *Payment `json:"payment,omitempty"`
+	// DryRun is the preview for ?dry_run=true.
+	DryRun gin.H `json:"dry_run,omitempty"`
+	// Error is the problem document the single create endpoint would
+	// have returned for this item.
+	Error gin.H `json:"error,omitempty"`
+}
+
+// BatchCreator runs POST /payments/batch. Items go through the same checks
+// as POST /payment/create, at most parallelism at a time.
+type BatchCreator struct {
+	payments    *PaymentService
+	fees        FeeSchedule
+	maxItems    int
+	parallelism int
+}
+
+func NewBatchCreator(payments *PaymentService, fees FeeSchedule, maxItems, parallelism int) *BatchCreator {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	return &BatchCreator{payments: payments, fees: fees, maxItems: maxItems, parallelism: parallelism}
+}
+
+// RegisterRoutes mounts the batch endpoint. The reply is 200 whenever the
+// batch itself was accepted; each item reports its own outcome. Retrying a
+// batch with the same Idempotency-Key is safe: item i is created with
+// "<key>:<i>", so items that already succeeded are returned, not repeated.
+func (b *BatchCreator) RegisterRoutes(r *gin.Engine) {
+	r.POST("/payments/batch", b.create)
+}
+
+func (b *BatchCreator) create(c *gin.Context) {
+	var req BatchPaymentRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if len(req.Payments) > b.maxItems {
+		c.JSON(http.StatusUnprocessableEntity, errorBodyWith(c, CodeValidationFailed, "Request validation failed",
+			gin.H{"fields": []FieldError{{Field: "payments", Code: "too_long", Message: fmt.Sprintf("must have at most %d items", b.maxItems)}}}))
+		return
+	}
+
+	key := c.GetHeader("Idempotency-Key")
+	dryRun := isDryRun(c)
+
+	results := make([]BatchItemResult, len(req.Payments))
+	sem := make(chan struct{}, b.parallelism)
+	var wg sync.WaitGroup
+	for i := range req.Payments {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			itemKey := ""
+			if key != "" {
+				itemKey = key + ":" + strconv.Itoa(i)
+			}
+			results[i] = b.createOne(c, i, req.Payments[i], itemKey, dryRun)
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, res := range results {
+		if res.Status == "succeeded" {
+			succeeded++
+		}
+	}
+	respondList(c, http.StatusOK, results, gin.H{
+		"total":     len(results),
+		"succeeded": succeeded,
+		"failed":    len(results) - succeeded,
+	})
+}
+
+// createOne must not write to c; it only reads request metadata such as
+// the language for error copy.
+func (b *BatchCreator) createOne(c *gin.Context, i int, req PaymentRequest, key string, dryRun bool) BatchItemResult {
+	ctx := c.Request.Context()
+	lang := requestLanguage(c)
+	res := BatchItemResult{Index: i, Status: "failed"}
+
+	if fields := req.validate(); len(fields) > 0 {
+		for j := range fields {
+			fields[j].Field = fmt.Sprintf("payments[%d].%s", i, fields[j].Field)
+		}
+		res.Error = itemProblem(lang, CodeValidationFailed, "", "Request validation failed", gin.H{"fields": fields})
+		return res
+	}
+
+	req.dryRun = dryRun
+	params, refused := b.payments.Params(ctx, req)
+	if refused != nil {
+		res.Error = itemProblem(lang, refused.code, "", refused.message, refused.ext)
+		return res
+	}
+	if dryRun {
+		res.Status = "succeeded"
+		res.DryRun = dryRunIntent(params.PaymentIntentParams, b.fees)
+		return res
+	}
+
+	pi, err := b.payments.Create(ctx, req, params, key)
+	if err != nil {
+		res.Error = providerProblem(lang, err)
+		return res
+	}
+	p := paymentData(pi, true)
+	res.Status = "succeeded"
+	res.Payment = &p
+	return res
+}
+
+// itemProblem is a problem document for an outcome reported inside
+// another response, such as a batch item or a job. Its status is the one
+// the payment would have had on its own.
+func itemProblem(lang language.Tag, code ErrorCode, decline, message string, ext gin.H) gin.H {
+	body := gin.H{
+		"type":         errorTypeBaseURL + string(code),
+		"title":        codeTitles[code],
+		"status":       codeStatus[code],
+		"detail":       message,
+		"code":         code,
+		"user_message": userMessage(lang, code, decline),
+	}
+	for k, v := range ext {
+		body[k] = v
+	}
+	return body
+}
+
+// providerProblem is itemProblem for a Stripe error.
+func providerProblem(lang language.Tag, err error) gin.H {
+	code, msg := classifyError(err)
+	var decline string
+	var se *stripe.Error
+	if errors.As(err, &se) {
+		decline = string(se.DeclineCode)
+	}
+	return itemProblem(lang, code, decline, msg, nil)
+}
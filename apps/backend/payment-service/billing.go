@@ -0,0 +1,1454 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+var (
+	billingSubscriptionsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "payment_service_billing_subscriptions_created_total",
+		Help: "Subscriptions created on the service's own recurring billing.",
+	})
+	billingCharges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_billing_charges_total",
+		Help: "Subscription invoice charge attempts, by outcome (paid, processing, declined, uncollectible, error).",
+	}, []string{"outcome"})
+	billingEnded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_billing_subscriptions_ended_total",
+		Help: "Subscriptions that ended or stopped being charged, by status (canceled, unpaid, incomplete_expired).",
+	}, []string{"status"})
+)
+
+// BillingConfig sets how our own subscriptions retry a declined renewal.
+// A declined invoice is tried again after each of retry_hours, counted
+// from the decline; once they run out it is uncollectible and the
+// subscription becomes final_status: canceled, as with Stripe's default
+// settings, or unpaid, which keeps it until it is given a new payment
+// method. trial_will_end_hours before a trial ends, a
+// customer.subscription.trial_will_end event is published.
+//
+//	"billing": {"retry_hours": [72, 120, 168], "final_status": "unpaid", "trial_will_end_hours": 48}
+type BillingConfig struct {
+	// RetryHours empty means 24, 72 and 120.
+	RetryHours []int `json:"retry_hours"`
+	// FinalStatus empty means canceled.
+	FinalStatus string `json:"final_status"`
+	// TrialWillEndHours zero means 72, Stripe's three days.
+	TrialWillEndHours int `json:"trial_will_end_hours"`
+}
+
+func (cfg BillingConfig) validate() error {
+	if cfg.TrialWillEndHours < 0 {
+		return fmt.Errorf("billing: trial_will_end_hours must not be negative")
+	}
+	for _, h := range cfg.RetryHours {
+		if h <= 0 {
+			return fmt.Errorf("billing: retry_hours must be positive")
+		}
+	}
+	switch cfg.FinalStatus {
+	case "", subscriptionCanceled, subscriptionUnpaid:
+	default:
+		return fmt.Errorf("billing: final_status must be canceled or unpaid")
+	}
+	return nil
+}
+
+func (cfg BillingConfig) retryHours() []int {
+	if len(cfg.RetryHours) == 0 {
+		return []int{24, 72, 120}
+	}
+	return cfg.RetryHours
+}
+
+func (cfg BillingConfig) trialWillEnd() time.Duration {
+	if cfg.TrialWillEndHours == 0 {
+		return 72 * time.Hour
+	}
+	return time.Duration(cfg.TrialWillEndHours) * time.Hour
+}
+
+func (cfg BillingConfig) finalStatus() string {
+	if cfg.FinalStatus == "" {
+		return subscriptionCanceled
+	}
+	return cfg.FinalStatus
+}
+
+// Subscription statuses, named as Stripe names them. A subscription is
+// incomplete until its first invoice is paid and incomplete_expired if
+// that doesn't happen within incompleteExpiry; past_due while a renewal
+// is being retried; unpaid once the retries ran out under final_status
+// unpaid.
+const (
+	subscriptionIncomplete        = "incomplete"
+	subscriptionIncompleteExpired = "incomplete_expired"
+	subscriptionTrialing          = "trialing"
+	subscriptionActive            = "active"
+	subscriptionPastDue           = "past_due"
+	subscriptionUnpaid            = "unpaid"
+	subscriptionCanceled          = "canceled"
+)
+
+// Billing invoice statuses. An open invoice is charged at
+// next_attempt_at, or waits for a new payment method when that is unset.
+// Charging is a claimed attempt in flight and processing one whose
+// payment method settles asynchronously.
+const (
+	billingInvoiceOpen          = "open"
+	billingInvoiceCharging      = "charging"
+	billingInvoiceProcessing    = "processing"
+	billingInvoicePaid          = "paid"
+	billingInvoiceUncollectible = "uncollectible"
+	billingInvoiceVoid          = "void"
+)
+
+// Stripe gives a subscription 23 hours to pay its first invoice.
+const incompleteExpiry = 23 * time.Hour
+
+// billingLease is how long a claimed invoice stays claimed.
+const billingLease = 10 * time.Minute
+
+// Metadata tying a PaymentIntent to its subscription invoice.
+const (
+	billingMetadataSubscription = "billing_subscription_id"
+	billingMetadataInvoice      = "billing_invoice_id"
+)
+
+var errSubscriptionState = errors.New("subscription is not in a state that allows this")
+
+// BillingPlan is a price charged every interval_count intervals. A
+// licensed plan charges Amount at the start of each period; a metered
+// one charges at its end for the usage reported during it, at Amount per
+// unit or by Tiers.
+type BillingPlan struct {
+	ID              string `json:"id"`
+	TenantID        string `json:"tenant_id,omitempty"`
+	Name            string `json:"name"`
+	Currency        string `json:"currency"`
+	Amount          int64  `json:"amount"`
+	Interval        string `json:"interval"`
+	IntervalCount   int    `json:"interval_count"`
+	TrialPeriodDays int    `json:"trial_period_days,omitempty"`
+	// UsageType is licensed or metered; the fields after it only apply
+	// to metered plans.
+	UsageType         string             `json:"usage_type"`
+	AggregateUsage    string             `json:"aggregate_usage,omitempty"`
+	TiersMode         string             `json:"tiers_mode,omitempty"`
+	Tiers             []PriceTier        `json:"tiers,omitempty"`
+	TransformQuantity *TransformQuantity `json:"transform_quantity,omitempty"`
+	CreatedAt         time.Time          `json:"created_at"`
+}
+
+// boundary is the n-th period boundary counted from anchor, which may be
+// negative. Months are counted from the anchor rather than from the
+// previous boundary, so a plan anchored on the 31st bills on the last
+// day of shorter months and on the 31st again after them.
+func (p *BillingPlan) boundary(anchor time.Time, n int) time.Time {
+	k := n * p.IntervalCount
+	switch p.Interval {
+	case "day":
+		return anchor.AddDate(0, 0, k)
+	case "week":
+		return anchor.AddDate(0, 0, 7*k)
+	case "year":
+		return addMonths(anchor, 12*k)
+	default:
+		return addMonths(anchor, k)
+	}
+}
+
+// period returns the billing period that starts at start: it ends at the
+// first boundary after start, and its amount is prorated by time when
+// start isn't a boundary itself, as for a subscription anchored to a
+// later day than it started on. start is never more than a period
+// before the anchor.
+func (p *BillingPlan) period(anchor, start time.Time) (end time.Time, amount int64) {
+	n := 0
+	for !p.boundary(anchor, n).After(start) {
+		n++
+	}
+	end, prev := p.boundary(anchor, n), p.boundary(anchor, n-1)
+	if !prev.Before(start) {
+		return end, p.Amount
+	}
+	return end, fractionOf(p.Amount, int64(end.Sub(start)), int64(end.Sub(prev)), roundHalfUp)
+}
+
+// BillingSubscription charges a plan to a customer's saved payment method
+// every billing period, with the fields and statuses of a Stripe
+// subscription so callers can treat both alike.
+type BillingSubscription struct {
+	ID         string `json:"id"`
+	Status     string `json:"status"`
+	TenantID   string `json:"tenant_id,omitempty"`
+	CustomerID string `json:"customer_id"`
+	PlanID     string `json:"plan_id"`
+	// Quantity multiplies a licensed plan's price, such as per seat.
+	Quantity int `json:"quantity"`
+	// PaymentMethod is a Stripe pm_ or a vaulted vpm_ ID, looked up at
+	// each charge so a vaulted card follows its latest token. A trial
+	// may start without one.
+	PaymentMethod      string     `json:"payment_method,omitempty"`
+	BillingCycleAnchor time.Time  `json:"billing_cycle_anchor"`
+	CurrentPeriodStart time.Time  `json:"current_period_start"`
+	CurrentPeriodEnd   time.Time  `json:"current_period_end"`
+	TrialEnd           *time.Time `json:"trial_end,omitempty"`
+	// TrialEndBehavior is what a trial ending without a payment method
+	// does: cancel, or create_invoice, which leaves the first invoice
+	// waiting for one and the subscription past_due.
+	TrialEndBehavior  string     `json:"trial_end_behavior"`
+	CancelAtPeriodEnd bool       `json:"cancel_at_period_end"`
+	CanceledAt        *time.Time `json:"canceled_at,omitempty"`
+	EndedAt           *time.Time `json:"ended_at,omitempty"`
+	LatestInvoice     string     `json:"latest_invoice,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+
+	// pending are proration lines for the next invoice. Only
+	// changeBillingSubscription loads them.
+	pending []BillingInvoiceLine
+}
+
+// ended reports whether s will never be charged again.
+func (s *BillingSubscription) ended() bool {
+	return s.Status == subscriptionCanceled || s.Status == subscriptionIncompleteExpired
+}
+
+// BillingInvoice is what one billing period of a subscription costs and
+// how charging it went.
+type BillingInvoice struct {
+	ID             string `json:"id"`
+	SubscriptionID string `json:"subscription_id"`
+	// BillingReason is subscription_create for the first period,
+	// subscription_cycle for a renewal and subscription_update for a
+	// plan change invoiced straight away.
+	BillingReason string     `json:"billing_reason"`
+	PeriodStart   time.Time  `json:"period_start"`
+	PeriodEnd     time.Time  `json:"period_end"`
+	Amount        int64      `json:"amount"`
+	Currency      string     `json:"currency"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	Declines      int        `json:"declines"`
+	PaymentID     string     `json:"payment_id,omitempty"`
+	DeclineCode   string     `json:"decline_code,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	PaidAt        *time.Time `json:"paid_at,omitempty"`
+	// UsageQuantity is the aggregated usage a metered invoice bills.
+	UsageQuantity *int64               `json:"usage_quantity,omitempty"`
+	Lines         []BillingInvoiceLine `json:"lines"`
+	CreatedAt     time.Time            `json:"created_at"`
+}
+
+// BillingInvoiceLine is one part of an invoice's amount.
+type BillingInvoiceLine struct {
+	Description string `json:"description"`
+	Quantity    int64  `json:"quantity"`
+	UnitAmount  int64  `json:"unit_amount"`
+	Amount      int64  `json:"amount"`
+}
+
+// unresolved reports whether the invoice may still be paid.
+func (i *BillingInvoice) unresolved() bool {
+	switch i.Status {
+	case billingInvoiceOpen, billingInvoiceCharging, billingInvoiceProcessing:
+		return true
+	}
+	return false
+}
+
+const billingPlanColumns = `id, tenant_id, name, currency, amount, interval, interval_count, trial_period_days,
+	usage_type, aggregate_usage, tiers_mode, tiers, transform_divide_by, transform_round, created_at`
+
+func scanBillingPlan(row interface{ Scan(...interface{}) error }) (*BillingPlan, error) {
+	var p BillingPlan
+	var tiers []byte
+	var divideBy int64
+	var round string
+	if err := row.Scan(&p.ID, &p.TenantID, &p.Name, &p.Currency, &p.Amount, &p.Interval, &p.IntervalCount,
+		&p.TrialPeriodDays, &p.UsageType, &p.AggregateUsage, &p.TiersMode, &tiers, &divideBy, &round, &p.CreatedAt); err != nil {
+		return nil, err
+	}
+	if len(tiers) > 0 {
+		if err := json.Unmarshal(tiers, &p.Tiers); err != nil {
+			return nil, err
+		}
+	}
+	if divideBy > 0 {
+		p.TransformQuantity = &TransformQuantity{DivideBy: divideBy, Round: round}
+	}
+	return &p, nil
+}
+
+const billingSubscriptionColumns = `id, tenant_id, customer_id, plan_id, quantity, payment_method, status,
+	billing_cycle_anchor, current_period_start, current_period_end, trial_end, trial_end_behavior, cancel_at_period_end,
+	canceled_at, ended_at, latest_invoice, created_at, updated_at`
+
+func scanBillingSubscription(row interface{ Scan(...interface{}) error }) (*BillingSubscription, error) {
+	var s BillingSubscription
+	var trialEnd, canceled, ended sql.NullTime
+	if err := row.Scan(&s.ID, &s.TenantID, &s.CustomerID, &s.PlanID, &s.Quantity, &s.PaymentMethod, &s.Status,
+		&s.BillingCycleAnchor, &s.CurrentPeriodStart, &s.CurrentPeriodEnd, &trialEnd, &s.TrialEndBehavior, &s.CancelAtPeriodEnd,
+		&canceled, &ended, &s.LatestInvoice, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		return nil, err
+	}
+	s.TrialEnd, s.CanceledAt, s.EndedAt = timeOrNil(trialEnd), timeOrNil(canceled), timeOrNil(ended)
+	return &s, nil
+}
+
+const billingInvoiceColumns = `id, subscription_id, billing_reason, period_start, period_end, amount, currency, status, attempts, declines,
+	COALESCE(payment_id, ''), decline_code, next_attempt_at, paid_at, usage_quantity, created_at`
+
+func scanBillingInvoice(row interface{ Scan(...interface{}) error }) (*BillingInvoice, error) {
+	var i BillingInvoice
+	var next, paid sql.NullTime
+	var usage sql.NullInt64
+	if err := row.Scan(&i.ID, &i.SubscriptionID, &i.BillingReason, &i.PeriodStart, &i.PeriodEnd, &i.Amount, &i.Currency, &i.Status,
+		&i.Attempts, &i.Declines, &i.PaymentID, &i.DeclineCode, &next, &paid, &usage, &i.CreatedAt); err != nil {
+		return nil, err
+	}
+	i.NextAttemptAt, i.PaidAt = timeOrNil(next), timeOrNil(paid)
+	if usage.Valid {
+		i.UsageQuantity = &usage.Int64
+	}
+	return &i, nil
+}
+
+func (s *Store) CreateBillingPlan(ctx context.Context, p *BillingPlan) (*BillingPlan, error) {
+	var tiers []byte
+	if len(p.Tiers) > 0 {
+		var err error
+		if tiers, err = json.Marshal(p.Tiers); err != nil {
+			return nil, err
+		}
+	}
+	var divideBy int64
+	var round string
+	if p.TransformQuantity != nil {
+		divideBy, round = p.TransformQuantity.DivideBy, p.TransformQuantity.Round
+	}
+	return scanBillingPlan(s.db.QueryRowContext(ctx, `
+		INSERT INTO billing_plans (id, tenant_id, name, currency, amount, interval, interval_count, trial_period_days,
+			usage_type, aggregate_usage, tiers_mode, tiers, transform_divide_by, transform_round)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING `+billingPlanColumns,
+		p.ID, p.TenantID, p.Name, p.Currency, p.Amount, p.Interval, p.IntervalCount, p.TrialPeriodDays,
+		p.UsageType, p.AggregateUsage, p.TiersMode, tiers, divideBy, round))
+}
+
+func (s *Store) BillingPlan(ctx context.Context, id string) (*BillingPlan, error) {
+	return scanBillingPlan(s.db.QueryRowContext(ctx, `SELECT `+billingPlanColumns+` FROM billing_plans WHERE id = $1`, id))
+}
+
+func insertBillingInvoice(ctx context.Context, tx *sql.Tx, i *BillingInvoice) error {
+	var usage sql.NullInt64
+	if i.UsageQuantity != nil {
+		usage = sql.NullInt64{Int64: *i.UsageQuantity, Valid: true}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO billing_invoices
+			(id, subscription_id, billing_reason, period_start, period_end, amount, currency, status, next_attempt_at, paid_at,
+			 usage_quantity)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		i.ID, i.SubscriptionID, i.BillingReason, i.PeriodStart, i.PeriodEnd, i.Amount, i.Currency, i.Status, nullTimeOf(i.NextAttemptAt),
+		nullTimeOf(i.PaidAt), usage); err != nil {
+		return err
+	}
+	for n, line := range i.Lines {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO billing_invoice_lines (invoice_id, position, description, quantity, unit_amount, amount)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			i.ID, n, line.Description, line.Quantity, line.UnitAmount, line.Amount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateBillingSubscription records sub with its first invoice, if it
+// has one yet, and claims its trial for each of trialFingerprints,
+// failing with errTrialUsed if any had a trial before. A retry with the
+// same idempotency key gets the subscription the first attempt recorded.
+func (s *Store) CreateBillingSubscription(ctx context.Context, sub *BillingSubscription, first *BillingInvoice,
+	trialFingerprints []string, idempotencyKey string) (*BillingSubscription, error) {
+	key := sql.NullString{String: idempotencyKey, Valid: idempotencyKey != ""}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	created, err := scanBillingSubscription(tx.QueryRowContext(ctx, `
+		INSERT INTO billing_subscriptions
+			(id, tenant_id, customer_id, plan_id, quantity, payment_method, status, billing_cycle_anchor, current_period_start,
+			 current_period_end, trial_end, trial_end_behavior, latest_invoice, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		ON CONFLICT (idempotency_key) DO NOTHING
+		RETURNING `+billingSubscriptionColumns,
+		sub.ID, sub.TenantID, sub.CustomerID, sub.PlanID, sub.Quantity, sub.PaymentMethod, sub.Status, sub.BillingCycleAnchor,
+		sub.CurrentPeriodStart, sub.CurrentPeriodEnd, nullTimeOf(sub.TrialEnd), sub.TrialEndBehavior, sub.LatestInvoice, key))
+	if errors.Is(err, sql.ErrNoRows) && key.Valid {
+		tx.Rollback()
+		return scanBillingSubscription(s.db.QueryRowContext(ctx, `
+			SELECT `+billingSubscriptionColumns+` FROM billing_subscriptions WHERE idempotency_key = $1`, key))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if first != nil {
+		if err := insertBillingInvoice(ctx, tx, first); err != nil {
+			return nil, err
+		}
+	}
+	if used, err := claimTrial(ctx, tx, created, trialFingerprints); err != nil || used {
+		if used {
+			err = errTrialUsed
+		}
+		return nil, err
+	}
+	return created, tx.Commit()
+}
+
+func (s *Store) BillingSubscription(ctx context.Context, id string) (*BillingSubscription, error) {
+	return scanBillingSubscription(s.db.QueryRowContext(ctx, `
+		SELECT `+billingSubscriptionColumns+` FROM billing_subscriptions WHERE id = $1`, id))
+}
+
+// BillingInvoices lists a subscription's invoices, newest first.
+func (s *Store) BillingInvoices(ctx context.Context, subscriptionID string) ([]*BillingInvoice, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+billingInvoiceColumns+` FROM billing_invoices WHERE subscription_id = $1 ORDER BY period_start DESC`,
+		subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*BillingInvoice{}
+	byID := map[string]*BillingInvoice{}
+	for rows.Next() {
+		i, err := scanBillingInvoice(rows)
+		if err != nil {
+			return nil, err
+		}
+		i.Lines = []BillingInvoiceLine{}
+		out = append(out, i)
+		byID[i.ID] = i
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	lines, err := s.db.QueryContext(ctx, `
+		SELECT l.invoice_id, l.description, l.quantity, l.unit_amount, l.amount
+		FROM billing_invoice_lines l JOIN billing_invoices i ON i.id = l.invoice_id
+		WHERE i.subscription_id = $1
+		ORDER BY l.invoice_id, l.position`, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer lines.Close()
+	for lines.Next() {
+		var id string
+		var l BillingInvoiceLine
+		if err := lines.Scan(&id, &l.Description, &l.Quantity, &l.UnitAmount, &l.Amount); err != nil {
+			return nil, err
+		}
+		if i := byID[id]; i != nil {
+			i.Lines = append(i.Lines, l)
+		}
+	}
+	return out, lines.Err()
+}
+
+// changeBillingSubscription applies fn to a subscription and its latest
+// invoice, which may be nil, under their row locks and saves both, along
+// with the subscription's pending items. An invoice fn returns becomes
+// the latest. fn
+// refuses a change by returning errSubscriptionState, in which case the
+// subscription is returned as it was.
+func (s *Store) changeBillingSubscription(ctx context.Context, id string,
+	fn func(sub *BillingSubscription, latest *BillingInvoice) (*BillingInvoice, error)) (*BillingSubscription, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	sub, err := scanBillingSubscription(tx.QueryRowContext(ctx, `
+		SELECT `+billingSubscriptionColumns+` FROM billing_subscriptions WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		return nil, err
+	}
+	var latest *BillingInvoice
+	if sub.LatestInvoice != "" {
+		if latest, err = scanBillingInvoice(tx.QueryRowContext(ctx, `
+			SELECT `+billingInvoiceColumns+` FROM billing_invoices WHERE id = $1 FOR UPDATE`, sub.LatestInvoice)); err != nil {
+			return nil, err
+		}
+	}
+	if sub.pending, err = billingPendingItems(ctx, tx, sub.ID); err != nil {
+		return nil, err
+	}
+	before := *sub
+	next, err := fn(sub, latest)
+	if err != nil {
+		return &before, err
+	}
+
+	if !reflect.DeepEqual(sub.pending, before.pending) {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM billing_pending_items WHERE subscription_id = $1`, sub.ID); err != nil {
+			return nil, err
+		}
+		for n, line := range sub.pending {
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO billing_pending_items (subscription_id, position, description, quantity, unit_amount, amount)
+				VALUES ($1, $2, $3, $4, $5, $6)`,
+				sub.ID, n, line.Description, line.Quantity, line.UnitAmount, line.Amount); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if latest != nil {
+		paymentID := sql.NullString{String: latest.PaymentID, Valid: latest.PaymentID != ""}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE billing_invoices SET
+				status = $2, attempts = $3, declines = $4, payment_id = $5, decline_code = $6, next_attempt_at = $7,
+				paid_at = $8, updated_at = now()
+			WHERE id = $1`,
+			latest.ID, latest.Status, latest.Attempts, latest.Declines, paymentID, latest.DeclineCode,
+			nullTimeOf(latest.NextAttemptAt), nullTimeOf(latest.PaidAt)); err != nil {
+			return nil, err
+		}
+	}
+	if next != nil {
+		if err := insertBillingInvoice(ctx, tx, next); err != nil {
+			return nil, err
+		}
+		sub.LatestInvoice = next.ID
+	}
+	updated, err := scanBillingSubscription(tx.QueryRowContext(ctx, `
+		UPDATE billing_subscriptions SET
+			payment_method = $2, status = $3, current_period_start = $4, current_period_end = $5,
+			cancel_at_period_end = $6, canceled_at = $7, ended_at = $8, latest_invoice = $9, plan_id = $10, quantity = $11,
+			billing_cycle_anchor = $12, trial_end = $13,
+			trial_will_end_sent_at = CASE WHEN trial_end IS DISTINCT FROM $13 THEN NULL ELSE trial_will_end_sent_at END,
+			updated_at = now()
+		WHERE id = $1
+		RETURNING `+billingSubscriptionColumns,
+		sub.ID, sub.PaymentMethod, sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.CancelAtPeriodEnd,
+		nullTimeOf(sub.CanceledAt), nullTimeOf(sub.EndedAt), sub.LatestInvoice, sub.PlanID, sub.Quantity,
+		sub.BillingCycleAnchor, nullTimeOf(sub.TrialEnd)))
+	if err != nil {
+		return nil, err
+	}
+	updated.pending = sub.pending
+	return updated, tx.Commit()
+}
+
+func billingPendingItems(ctx context.Context, q queryer, subscriptionID string) ([]BillingInvoiceLine, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT description, quantity, unit_amount, amount FROM billing_pending_items
+		WHERE subscription_id = $1 ORDER BY position`, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var lines []BillingInvoiceLine
+	for rows.Next() {
+		var l BillingInvoiceLine
+		if err := rows.Scan(&l.Description, &l.Quantity, &l.UnitAmount, &l.Amount); err != nil {
+			return nil, err
+		}
+		lines = append(lines, l)
+	}
+	return lines, rows.Err()
+}
+
+// DueBillingSubscriptions lists subscriptions whose period has ended and
+// incomplete ones past their deadline.
+func (s *Store) DueBillingSubscriptions(ctx context.Context, limit int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id FROM billing_subscriptions
+		WHERE (status IN ('trialing', 'active') AND current_period_end <= now())
+			OR (status = 'incomplete' AND created_at <= $2)
+		ORDER BY current_period_end
+		LIMIT $1`, limit, time.Now().Add(-incompleteExpiry).UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+const claimBillingInvoice = `
+	UPDATE billing_invoices SET status = 'charging', next_attempt_at = $2, updated_at = now()
+	WHERE id = (
+		SELECT i.id FROM billing_invoices i
+		JOIN billing_subscriptions s ON s.id = i.subscription_id
+		WHERE s.status IN ('incomplete', 'active', 'past_due', 'unpaid') AND s.latest_invoice = i.id
+			AND i.status IN ('open', 'charging') AND i.next_attempt_at <= now() AND %s
+		ORDER BY i.next_attempt_at
+		LIMIT 1
+		FOR UPDATE OF i SKIP LOCKED)
+	RETURNING ` + billingInvoiceColumns
+
+// ClaimDueBillingInvoice marks the next invoice due as charging and
+// returns it, or sql.ErrNoRows. next_attempt_at becomes the claim's
+// lease, so a charge abandoned mid-call becomes due again. skip lists
+// subscriptions that already failed in this sweep.
+func (s *Store) ClaimDueBillingInvoice(ctx context.Context, skip []string) (*BillingInvoice, error) {
+	if skip == nil {
+		skip = []string{}
+	}
+	return scanBillingInvoice(s.db.QueryRowContext(ctx, fmt.Sprintf(claimBillingInvoice, `i.subscription_id <> ALL($1)`),
+		skip, time.Now().Add(billingLease).UTC()))
+}
+
+// ClaimBillingInvoice claims invoice id if it is due.
+func (s *Store) ClaimBillingInvoice(ctx context.Context, id string) (*BillingInvoice, error) {
+	return scanBillingInvoice(s.db.QueryRowContext(ctx, fmt.Sprintf(claimBillingInvoice, `i.id = $1`),
+		id, time.Now().Add(billingLease).UTC()))
+}
+
+// BillingEvent is published on the billing topic with the type Stripe
+// would give the same change: customer.subscription.created, .updated,
+// .deleted and .trial_will_end, and invoice.paid and
+// invoice.payment_failed.
+type BillingEvent struct {
+	Type         string               `json:"type"`
+	Subscription *BillingSubscription `json:"subscription"`
+	Invoice      *BillingInvoice      `json:"invoice,omitempty"`
+	CreatedAt    time.Time            `json:"created_at"`
+}
+
+// Billing is recurring billing run by the service itself, for providers
+// without native subscriptions: plans, subscriptions with trials and
+// billing cycle anchors, usage reporting for metered plans, and a worker
+// that renews them at the end of each period and charges and retries
+// their invoices. Charges go through
+// PaymentService like any other payment, off-session on the
+// subscription's saved payment method, so they get the same limits,
+// routing and webhooks. The API follows Stripe's subscriptions.
+type Billing struct {
+	store     *Store
+	settings  *RuntimeSettings
+	payments  *PaymentService
+	publisher Publisher
+	topic     string
+	interval  time.Duration
+	// maxUsageBatch caps the records in one POST /billing/usage.
+	maxUsageBatch int
+}
+
+func NewBilling(store *Store, settings *RuntimeSettings, payments *PaymentService, publisher Publisher, topic string,
+	interval time.Duration, maxUsageBatch int) *Billing {
+	return &Billing{store: store, settings: settings, payments: payments, publisher: publisher, topic: topic,
+		interval: interval, maxUsageBatch: maxUsageBatch}
+}
+
+func (b *Billing) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/billing", requireScope(b.store, bootstrapToken, "billing"), b.requireStore)
+	g.POST("/plans", b.createPlan)
+	g.GET("/plans/:id", b.getPlan)
+	g.POST("/subscriptions", b.createSubscription)
+	g.GET("/subscriptions/:id", b.getSubscription)
+	g.POST("/subscriptions/:id", b.updateSubscription)
+	g.DELETE("/subscriptions/:id", b.cancelSubscription)
+	g.POST("/subscriptions/:id/preview-change", b.previewChange)
+	g.POST("/subscriptions/:id/trial", b.updateTrial)
+	g.GET("/subscriptions/:id/invoices", b.invoices)
+	g.POST("/subscriptions/:id/usage", b.recordUsage)
+	g.GET("/subscriptions/:id/usage", b.usageSummary)
+	g.POST("/usage", b.recordUsageBatch)
+}
+
+func (b *Billing) requireStore(c *gin.Context) {
+	if b.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Recurring billing requires DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// respondChange answers a failed subscription change, returning false, or
+// returns true when err is nil.
+func (b *Billing) respondChange(c *gin.Context, sub *BillingSubscription, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Subscription not found"))
+	case errors.Is(err, errSubscriptionState):
+		c.JSON(http.StatusConflict, errorBodyWith(c, CodeSubscriptionState, "Subscription is "+sub.Status,
+			gin.H{"status": sub.Status}))
+	default:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+	}
+	return false
+}
+
+func (b *Billing) createPlan(c *gin.Context) {
+	var req struct {
+		Name            string `json:"name" binding:"required"`
+		Amount          int64  `json:"amount" binding:"gte=0"`
+		Currency        string `json:"currency" binding:"required,len=3"`
+		Interval        string `json:"interval" binding:"required,oneof=day week month year"`
+		IntervalCount   int    `json:"interval_count" binding:"omitempty,gte=1,lte=365"`
+		TrialPeriodDays int    `json:"trial_period_days" binding:"omitempty,gte=0,lte=730"`
+		TenantID        string `json:"tenant_id"`
+
+		UsageType         string             `json:"usage_type" binding:"omitempty,oneof=licensed metered"`
+		AggregateUsage    string             `json:"aggregate_usage" binding:"omitempty,oneof=sum max last_during_period"`
+		TiersMode         string             `json:"tiers_mode" binding:"omitempty,oneof=graduated volume"`
+		Tiers             []PriceTier        `json:"tiers"`
+		TransformQuantity *TransformQuantity `json:"transform_quantity"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.IntervalCount == 0 {
+		req.IntervalCount = 1
+	}
+	want := &BillingPlan{
+		ID:                "plan_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		TenantID:          req.TenantID,
+		Name:              req.Name,
+		Currency:          strings.ToLower(req.Currency),
+		Amount:            req.Amount,
+		Interval:          req.Interval,
+		IntervalCount:     req.IntervalCount,
+		TrialPeriodDays:   req.TrialPeriodDays,
+		UsageType:         req.UsageType,
+		AggregateUsage:    req.AggregateUsage,
+		TiersMode:         req.TiersMode,
+		Tiers:             req.Tiers,
+		TransformQuantity: req.TransformQuantity,
+	}
+	if fields := want.validatePricing(); len(fields) > 0 {
+		validationFailed(c, fields)
+		return
+	}
+	plan, err := b.store.CreateBillingPlan(c.Request.Context(), want)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusCreated, plan)
+}
+
+func (b *Billing) getPlan(c *gin.Context) {
+	plan, err := b.store.BillingPlan(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Plan not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, plan)
+}
+
+// createSubscription starts a subscription. Without a trial the first
+// invoice of a licensed plan is charged before the response, and a
+// declined first charge leaves it incomplete, as with Stripe's
+// allow_incomplete; a metered plan is active straight away. A trial ends
+// with the first invoice, needs no payment method, and is given once per
+// customer and card. A billing_cycle_anchor renews the subscription on
+// that date's schedule, with the first period prorated up to it.
+func (b *Billing) createSubscription(c *gin.Context) {
+	var req struct {
+		CustomerID         string     `json:"customer_id" binding:"required"`
+		PlanID             string     `json:"plan_id" binding:"required"`
+		PaymentMethod      string     `json:"payment_method" binding:"omitempty,startswith=pm_|startswith=vpm_"`
+		BillingCycleAnchor *time.Time `json:"billing_cycle_anchor"`
+		TrialPeriodDays    *int       `json:"trial_period_days" binding:"omitempty,gte=0,lte=730"`
+		TrialEndBehavior   string     `json:"trial_end_behavior" binding:"omitempty,oneof=cancel create_invoice"`
+		Quantity           int        `json:"quantity" binding:"omitempty,gte=1,lte=100000"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	if req.TrialEndBehavior == "" {
+		req.TrialEndBehavior = trialEndCreateInvoice
+	}
+	ctx := c.Request.Context()
+	plan, err := b.store.BillingPlan(ctx, req.PlanID)
+	if errors.Is(err, sql.ErrNoRows) {
+		validationFailed(c, []FieldError{{Field: "plan_id", Code: "invalid", Message: "no such plan"}})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if plan.UsageType == usageMetered && req.Quantity != 1 {
+		validationFailed(c, []FieldError{{Field: "quantity", Code: "invalid", Message: "metered plans are billed by usage, not quantity"}})
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	start := now
+	trialDays := plan.TrialPeriodDays
+	if req.TrialPeriodDays != nil {
+		trialDays = *req.TrialPeriodDays
+	}
+	var trialEnd *time.Time
+	if trialDays > 0 {
+		end := now.AddDate(0, 0, trialDays)
+		trialEnd, start = &end, end
+	}
+	if req.PaymentMethod == "" && trialEnd == nil {
+		validationFailed(c, []FieldError{{Field: "payment_method", Code: "required", Message: "required unless the subscription starts with a trial"}})
+		return
+	}
+	anchor := start
+	if req.BillingCycleAnchor != nil {
+		anchor = req.BillingCycleAnchor.UTC().Truncate(time.Second)
+		if anchor.Before(now) || plan.boundary(anchor, -1).After(start) {
+			validationFailed(c, []FieldError{{Field: "billing_cycle_anchor", Code: "invalid",
+				Message: "must be in the future and within one billing period of the first one"}})
+			return
+		}
+	}
+	if req.PaymentMethod != "" {
+		if _, err := paymentMethodToken(ctx, b.store, req.PaymentMethod, req.CustomerID); err != nil {
+			var refused *refusal
+			if errors.As(err, &refused) {
+				validationFailed(c, []FieldError{{Field: "payment_method", Code: "invalid", Message: "must be a vaulted payment method of the customer that Stripe can charge"}})
+			} else {
+				c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			}
+			return
+		}
+	}
+	var fingerprints []string
+	if trialEnd != nil {
+		if fingerprints, err = trialFingerprints(ctx, b.store, req.CustomerID, req.PaymentMethod); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+	if plan.UsageType != usageMetered {
+		if _, refused := b.payments.Params(ctx, PaymentRequest{
+			Amount:        plan.Amount * int64(req.Quantity),
+			Currency:      plan.Currency,
+			CustomerID:    req.CustomerID,
+			TenantID:      plan.TenantID,
+			skipDiscounts: true,
+		}); refused != nil {
+			c.JSON(refused.status, errorBodyWith(c, refused.code, refused.message, refused.ext))
+			return
+		}
+	}
+
+	want := &BillingSubscription{
+		ID:                 "sub_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		TenantID:           plan.TenantID,
+		CustomerID:         req.CustomerID,
+		PlanID:             plan.ID,
+		Quantity:           req.Quantity,
+		PaymentMethod:      req.PaymentMethod,
+		BillingCycleAnchor: anchor,
+		TrialEnd:           trialEnd,
+		TrialEndBehavior:   req.TrialEndBehavior,
+	}
+	var first *BillingInvoice
+	switch {
+	case trialEnd != nil:
+		want.Status = subscriptionTrialing
+		want.CurrentPeriodStart, want.CurrentPeriodEnd = now, *trialEnd
+	case plan.UsageType == usageMetered:
+		// Nothing is owed until the first period's usage is in.
+		end, _ := plan.period(anchor, start)
+		want.Status = subscriptionActive
+		want.CurrentPeriodStart, want.CurrentPeriodEnd = start, end
+	default:
+		end, amount := plan.period(anchor, start)
+		want.Status = subscriptionIncomplete
+		want.CurrentPeriodStart, want.CurrentPeriodEnd = start, end
+		first = newBillingInvoice(want, plan, start, end, amount)
+		first.BillingReason = billingReasonCreate
+		want.LatestInvoice = first.ID
+	}
+	sub, err := b.store.CreateBillingSubscription(ctx, want, first, fingerprints, c.GetHeader("Idempotency-Key"))
+	if errors.Is(err, errTrialUsed) {
+		c.JSON(http.StatusConflict, errorBody(c, CodeTrialUsed, "This customer or card already had a trial; subscribe with trial_period_days 0"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if sub.PlanID != want.PlanID || sub.CustomerID != want.CustomerID {
+		c.JSON(http.StatusConflict, errorBody(c, CodeIdempotencyConflict, "Idempotency-Key was already used for a different subscription"))
+		return
+	}
+	if sub.ID == want.ID {
+		billingSubscriptionsCreated.Inc()
+		b.emit(ctx, "customer.subscription.created", sub, nil)
+		if first != nil {
+			sub = b.chargeNow(ctx, sub)
+		}
+	}
+	respondData(c, http.StatusCreated, sub)
+}
+
+// chargeNow charges the subscription's latest invoice if it is due and
+// returns the subscription as it then is. A charge that fails is left to
+// the worker.
+func (b *Billing) chargeNow(ctx context.Context, sub *BillingSubscription) *BillingSubscription {
+	inv, err := b.store.ClaimBillingInvoice(ctx, sub.LatestInvoice)
+	if errors.Is(err, sql.ErrNoRows) {
+		return sub
+	}
+	if err == nil {
+		err = b.chargeInvoice(ctx, inv)
+	}
+	if err != nil {
+		logf(ctx, "charging invoice %s of subscription %s: %v", sub.LatestInvoice, sub.ID, err)
+		return sub
+	}
+	if current, err := b.store.BillingSubscription(ctx, sub.ID); err == nil {
+		return current
+	}
+	return sub
+}
+
+// newBillingInvoice opens the renewal invoice for a licensed plan's
+// period, at unitAmount for each of the subscription's quantity.
+func newBillingInvoice(sub *BillingSubscription, plan *BillingPlan, start, end time.Time, unitAmount int64) *BillingInvoice {
+	now := time.Now().UTC()
+	qty := int64(max(sub.Quantity, 1))
+	return &BillingInvoice{
+		ID:             "bin_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		SubscriptionID: sub.ID,
+		BillingReason:  billingReasonCycle,
+		PeriodStart:    start,
+		PeriodEnd:      end,
+		Amount:         unitAmount * qty,
+		Currency:       plan.Currency,
+		Status:         billingInvoiceOpen,
+		NextAttemptAt:  &now,
+		Lines:          []BillingInvoiceLine{{Description: plan.Name, Quantity: qty, UnitAmount: unitAmount, Amount: unitAmount * qty}},
+	}
+}
+
+func (b *Billing) getSubscription(c *gin.Context) {
+	sub, err := b.store.BillingSubscription(c.Request.Context(), c.Param("id"))
+	if !b.respondChange(c, sub, err) {
+		return
+	}
+	respondData(c, http.StatusOK, sub)
+}
+
+func (b *Billing) invoices(c *gin.Context) {
+	ctx := c.Request.Context()
+	sub, err := b.store.BillingSubscription(ctx, c.Param("id"))
+	if !b.respondChange(c, sub, err) {
+		return
+	}
+	invoices, err := b.store.BillingInvoices(ctx, sub.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondList(c, http.StatusOK, invoices, gin.H{"subscription_id": sub.ID})
+}
+
+// updateSubscription changes the payment method or cancel_at_period_end,
+// or the plan and quantity, prorated per proration_behavior. A new
+// payment method makes an unpaid invoice due again at once with its
+// retries reset, which is how an incomplete, past_due or unpaid
+// subscription is brought back, and a card-less trial gets its card; a
+// card that already had a trial ends this one now. A plan change is made
+// on its own, after the other fields.
+func (b *Billing) updateSubscription(c *gin.Context) {
+	var req struct {
+		PaymentMethod     string `json:"payment_method" binding:"omitempty,startswith=pm_|startswith=vpm_"`
+		CancelAtPeriodEnd *bool  `json:"cancel_at_period_end"`
+		planChange
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.PaymentMethod == "" && req.CancelAtPeriodEnd == nil && req.requested() {
+		if sub, ok := b.changePlan(c, &req.planChange); ok {
+			respondData(c, http.StatusOK, sub)
+		}
+		return
+	}
+	ctx := c.Request.Context()
+	sub, err := b.change(ctx, c.Param("id"), func(s *BillingSubscription, latest *BillingInvoice) (*BillingInvoice, error) {
+		if s.ended() {
+			return nil, errSubscriptionState
+		}
+		if req.CancelAtPeriodEnd != nil {
+			s.CancelAtPeriodEnd = *req.CancelAtPeriodEnd
+		}
+		if req.PaymentMethod != "" {
+			s.PaymentMethod = req.PaymentMethod
+			if latest != nil && latest.Status == billingInvoiceOpen && (latest.Declines > 0 || latest.NextAttemptAt == nil) {
+				now := time.Now().UTC()
+				latest.Declines, latest.NextAttemptAt = 0, &now
+			}
+			if latest != nil && latest.Status == billingInvoiceUncollectible && s.Status == subscriptionUnpaid {
+				now := time.Now().UTC()
+				latest.Status, latest.Declines, latest.NextAttemptAt = billingInvoiceOpen, 0, &now
+			}
+		}
+		return nil, nil
+	})
+	if !b.respondChange(c, sub, err) {
+		return
+	}
+	if req.PaymentMethod != "" && sub.Status == subscriptionTrialing {
+		sub = b.checkTrialCard(ctx, sub)
+	} else if req.PaymentMethod != "" && sub.Status != subscriptionActive {
+		sub = b.chargeNow(ctx, sub)
+	}
+	if req.requested() {
+		var ok bool
+		if sub, ok = b.changePlan(c, &req.planChange); !ok {
+			return
+		}
+	}
+	respondData(c, http.StatusOK, sub)
+}
+
+// cancelSubscription ends the subscription now; its unpaid invoice is
+// voided. Periods already paid are not refunded, and an invoice being
+// charged must finish first.
+func (b *Billing) cancelSubscription(c *gin.Context) {
+	sub, err := b.change(c.Request.Context(), c.Param("id"), func(s *BillingSubscription, latest *BillingInvoice) (*BillingInvoice, error) {
+		if s.ended() {
+			return nil, errSubscriptionState
+		}
+		if latest != nil {
+			switch latest.Status {
+			case billingInvoiceCharging, billingInvoiceProcessing:
+				return nil, errSubscriptionState
+			case billingInvoiceOpen, billingInvoiceUncollectible:
+				latest.Status, latest.NextAttemptAt = billingInvoiceVoid, nil
+			}
+		}
+		b.end(s, subscriptionCanceled)
+		return nil, nil
+	})
+	if !b.respondChange(c, sub, err) {
+		return
+	}
+	respondData(c, http.StatusOK, sub)
+}
+
+// end stops s with status.
+func (b *Billing) end(s *BillingSubscription, status string) {
+	now := time.Now().UTC()
+	s.Status = status
+	if status != subscriptionUnpaid {
+		s.EndedAt = &now
+		if s.CanceledAt == nil {
+			s.CanceledAt = &now
+		}
+	}
+	billingEnded.WithLabelValues(status).Inc()
+}
+
+// change applies fn through the store and publishes the subscription
+// event the change amounts to.
+func (b *Billing) change(ctx context.Context, id string,
+	fn func(s *BillingSubscription, latest *BillingInvoice) (*BillingInvoice, error)) (*BillingSubscription, error) {
+	var before BillingSubscription
+	sub, err := b.store.changeBillingSubscription(ctx, id, func(s *BillingSubscription, latest *BillingInvoice) (*BillingInvoice, error) {
+		before = *s
+		return fn(s, latest)
+	})
+	if err != nil {
+		return sub, err
+	}
+	switch {
+	case sub.ended() && !before.ended():
+		b.emit(ctx, "customer.subscription.deleted", sub, nil)
+	case sub.Status != before.Status || sub.CurrentPeriodEnd != before.CurrentPeriodEnd ||
+		sub.CancelAtPeriodEnd != before.CancelAtPeriodEnd || sub.PaymentMethod != before.PaymentMethod ||
+		sub.PlanID != before.PlanID || sub.Quantity != before.Quantity:
+		b.emit(ctx, "customer.subscription.updated", sub, nil)
+	}
+	return sub, nil
+}
+
+// emit publishes a billing event. The change is already saved, so a
+// broker failure is logged rather than retried.
+func (b *Billing) emit(ctx context.Context, typ string, sub *BillingSubscription, inv *BillingInvoice) {
+	payload, err := json.Marshal(BillingEvent{Type: typ, Subscription: sub, Invoice: inv, CreatedAt: time.Now().UTC()})
+	if err == nil {
+		err = b.publisher.Publish(ctx, b.topic, sub.ID, payload)
+	}
+	if err != nil {
+		logf(ctx, "publishing %s for %s: %v", typ, sub.ID, err)
+	}
+}
+
+// Run renews subscriptions, charges their invoices and announces trials
+// about to end every interval until ctx is done.
+func (b *Billing) Run(ctx context.Context) {
+	if b == nil || b.store == nil {
+		return
+	}
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		if err := b.renewDue(ctx); err != nil {
+			log.Printf("billing renewals: %v", err)
+		}
+		if err := b.chargeDue(ctx); err != nil {
+			log.Printf("billing charges: %v", err)
+		}
+		if err := b.notifyTrialsEnding(ctx); err != nil {
+			log.Printf("billing trial notices: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *Billing) renewDue(ctx context.Context) error {
+	for {
+		ids, err := b.store.DueBillingSubscriptions(ctx, 100)
+		if err != nil {
+			return err
+		}
+		renewed := 0
+		for _, id := range ids {
+			ok, err := b.renew(ctx, id)
+			if err != nil {
+				log.Printf("renewing subscription %s: %v", id, err)
+			}
+			if ok {
+				renewed++
+			}
+		}
+		// Subscriptions waiting on an invoice stay due, so stop once a
+		// pass makes no progress.
+		if renewed == 0 || len(ids) < 100 {
+			return nil
+		}
+	}
+}
+
+// renew moves a subscription whose period ended into its next one and
+// opens that period's invoice, or ends it when it was set to cancel at
+// period end or its trial ended without a payment method and should
+// cancel. A metered plan is invoiced instead for the period that
+// ended, before it advances or ends; usage during a trial is free. One
+// still paying for its last period waits for that invoice. An incomplete
+// subscription past its deadline expires.
+func (b *Billing) renew(ctx context.Context, id string) (bool, error) {
+	sub, err := b.store.BillingSubscription(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	plan, err := b.store.BillingPlan(ctx, sub.PlanID)
+	if err != nil {
+		return false, err
+	}
+	_, err = b.change(ctx, id, func(s *BillingSubscription, latest *BillingInvoice) (*BillingInvoice, error) {
+		now := time.Now().UTC()
+		if s.Status == subscriptionIncomplete {
+			if now.Sub(s.CreatedAt) < incompleteExpiry || latest == nil || latest.Status == billingInvoiceCharging ||
+				latest.Status == billingInvoiceProcessing {
+				return nil, errSubscriptionState
+			}
+			latest.Status, latest.NextAttemptAt = billingInvoiceVoid, nil
+			b.end(s, subscriptionIncompleteExpired)
+			return nil, nil
+		}
+		if (s.Status != subscriptionActive && s.Status != subscriptionTrialing) || s.CurrentPeriodEnd.After(now) {
+			return nil, errSubscriptionState
+		}
+		if (latest != nil && latest.unresolved()) || s.PlanID != plan.ID {
+			return nil, errSubscriptionState
+		}
+		if s.Status == subscriptionTrialing && s.PaymentMethod == "" && s.TrialEndBehavior == trialEndCancel {
+			b.end(s, subscriptionCanceled)
+			return nil, nil
+		}
+		metered := plan.UsageType == usageMetered
+		var inv *BillingInvoice
+		if metered && s.Status == subscriptionActive && (latest == nil || latest.PeriodEnd.Before(s.CurrentPeriodEnd)) {
+			usage, err := b.store.BillingUsage(ctx, s.ID, plan.AggregateUsage, s.CurrentPeriodStart, s.CurrentPeriodEnd)
+			if err != nil {
+				return nil, err
+			}
+			inv = newMeteredInvoice(s, plan, s.CurrentPeriodStart, s.CurrentPeriodEnd, usage)
+			settlePending(s, inv)
+			awaitPaymentMethod(s, inv)
+			if s.CancelAtPeriodEnd {
+				// It ends once the last period is paid for.
+				return inv, nil
+			}
+		}
+		if s.CancelAtPeriodEnd {
+			b.end(s, subscriptionCanceled)
+			ended := s.CurrentPeriodEnd
+			s.EndedAt = &ended
+			return nil, nil
+		}
+		start := s.CurrentPeriodEnd
+		end, amount := plan.period(s.BillingCycleAnchor, start)
+		s.CurrentPeriodStart, s.CurrentPeriodEnd = start, end
+		if s.Status == subscriptionTrialing {
+			s.Status = subscriptionActive
+		}
+		if !metered {
+			inv = newBillingInvoice(s, plan, start, end, amount)
+			settlePending(s, inv)
+			awaitPaymentMethod(s, inv)
+		}
+		return inv, nil
+	})
+	if errors.Is(err, errSubscriptionState) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *Billing) chargeDue(ctx context.Context) error {
+	var failed []string
+	for {
+		inv, err := b.store.ClaimDueBillingInvoice(ctx, failed)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := b.chargeInvoice(ctx, inv); err != nil {
+			log.Printf("charging invoice %s of subscription %s: %v", inv.ID, inv.SubscriptionID, err)
+			failed = append(failed, inv.SubscriptionID)
+		}
+	}
+}
+
+// chargeInvoice charges a claimed invoice. The first attempt creates its
+// PaymentIntent and later ones confirm the same intent again, so an
+// invoice has one payment however often it is declined; the idempotency
+// key names the attempt so one repeated after a crash doesn't charge
+// twice. Errors other than declines and refusals leave the claim to
+// expire and be retried.
+func (b *Billing) chargeInvoice(ctx context.Context, claimed *BillingInvoice) error {
+	sub, err := b.store.BillingSubscription(ctx, claimed.SubscriptionID)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("billing-%s-%d", claimed.ID, claimed.Attempts+1)
+	pm, err := paymentMethodToken(ctx, b.store, sub.PaymentMethod, sub.CustomerID)
+	var pi *stripe.PaymentIntent
+	switch {
+	case err != nil:
+	case claimed.PaymentID == "":
+		req := PaymentRequest{
+			Amount:      claimed.Amount,
+			Currency:    claimed.Currency,
+			Description: "Subscription " + sub.ID,
+			CustomerID:  sub.CustomerID,
+			TenantID:    sub.TenantID,
+			Metadata: map[string]string{
+				billingMetadataSubscription: sub.ID,
+				billingMetadataInvoice:      claimed.ID,
+			},
+			skipDiscounts: true,
+		}
+		params, refused := b.payments.Params(ctx, req)
+		if refused != nil {
+			err = refused
+			break
+		}
+		params.AutomaticPaymentMethods = nil
+		params.PaymentMethodTypes = nil
+		params.PaymentMethod = stripe.String(pm)
+		params.Confirm = stripe.Bool(true)
+		params.OffSession = stripe.Bool(true)
+		pi, err = b.payments.Create(ctx, req, params, key)
+	default:
+		params := &stripe.PaymentIntentConfirmParams{
+			PaymentMethod: stripe.String(pm),
+			OffSession:    stripe.Bool(true),
+		}
+		params.Context = ctx
+		params.SetIdempotencyKey(key)
+		pi, err = paymentintent.Confirm(claimed.PaymentID, params)
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	var stripeErr *stripe.Error
+	var refused *refusal
+	var decline string
+	switch {
+	case err == nil:
+	case errors.As(err, &stripeErr) && (stripeErr.Type == stripe.ErrorTypeCard || stripeErr.Type == stripe.ErrorTypeInvalidRequest):
+		decline = declineOf(stripeErr)
+		if stripeErr.PaymentIntent != nil {
+			pi = stripeErr.PaymentIntent
+		}
+	case errors.As(err, &refused):
+		decline = string(refused.code)
+	default:
+		billingCharges.WithLabelValues("error").Inc()
+		return err
+	}
+
+	var settled *BillingInvoice
+	_, err = b.change(ctx, sub.ID, func(s *BillingSubscription, latest *BillingInvoice) (*BillingInvoice, error) {
+		if latest == nil || latest.ID != claimed.ID || latest.Status != billingInvoiceCharging {
+			return nil, errSubscriptionState
+		}
+		latest.Attempts++
+		if pi != nil {
+			latest.PaymentID = pi.ID
+		}
+		switch {
+		case decline != "":
+			b.declined(s, latest, decline)
+		case pi.Status == stripe.PaymentIntentStatusSucceeded:
+			b.paid(s, latest)
+		case pi.Status == stripe.PaymentIntentStatusProcessing:
+			latest.Status, latest.NextAttemptAt = billingInvoiceProcessing, nil
+			billingCharges.WithLabelValues("processing").Inc()
+		default:
+			// Off-session, anything else means the customer has to step
+			// in, such as to authenticate.
+			b.declined(s, latest, string(pi.Status))
+		}
+		copied := *latest
+		settled = &copied
+		return nil, nil
+	})
+	if errors.Is(err, errSubscriptionState) {
+		return nil
+	}
+	if err == nil {
+		b.invoiceEvent(ctx, sub.ID, settled)
+	}
+	return err
+}
+
+// paid marks inv paid and the subscription active.
+func (b *Billing) paid(s *BillingSubscription, inv *BillingInvoice) {
+	now := time.Now().UTC()
+	inv.Status, inv.NextAttemptAt, inv.PaidAt, inv.DeclineCode = billingInvoicePaid, nil, &now, ""
+	if s.Status != subscriptionTrialing {
+		s.Status = subscriptionActive
+	}
+	billingCharges.WithLabelValues("paid").Inc()
+}
+
+// declined schedules inv's next retry, or gives up on it once the
+// retries run out and moves the subscription to the configured final
+// status. A first invoice isn't retried: the subscription stays
+// incomplete until it gets a new payment method or expires.
+func (b *Billing) declined(s *BillingSubscription, inv *BillingInvoice, decline string) {
+	cfg := b.settings.Get().Billing
+	inv.DeclineCode = decline
+	inv.Declines++
+	if s.Status == subscriptionIncomplete {
+		inv.Status, inv.NextAttemptAt = billingInvoiceOpen, nil
+		billingCharges.WithLabelValues("declined").Inc()
+		return
+	}
+	if hours := cfg.retryHours(); inv.Declines <= len(hours) {
+		next := time.Now().Add(time.Duration(hours[inv.Declines-1]) * time.Hour).UTC()
+		inv.Status, inv.NextAttemptAt = billingInvoiceOpen, &next
+		s.Status = subscriptionPastDue
+		billingCharges.WithLabelValues("declined").Inc()
+		return
+	}
+	inv.Status, inv.NextAttemptAt = billingInvoiceUncollectible, nil
+	billingCharges.WithLabelValues("uncollectible").Inc()
+	b.end(s, cfg.finalStatus())
+}
+
+// invoiceEvent publishes the outcome of charging inv.
+func (b *Billing) invoiceEvent(ctx context.Context, subscriptionID string, inv *BillingInvoice) {
+	var typ string
+	switch inv.Status {
+	case billingInvoicePaid:
+		typ = "invoice.paid"
+	case billingInvoiceOpen, billingInvoiceUncollectible:
+		typ = "invoice.payment_failed"
+	default:
+		return
+	}
+	sub, err := b.store.BillingSubscription(ctx, subscriptionID)
+	if err != nil {
+		logf(ctx, "publishing %s for %s: %v", typ, subscriptionID, err)
+		return
+	}
+	b.emit(ctx, typ, sub, inv)
+}
+
+// paymentIntentEvent settles invoices whose payment method finished
+// processing after the charge returned.
+func (b *Billing) paymentIntentEvent(ctx context.Context, typ stripe.EventType, pi *stripe.PaymentIntent) error {
+	subID, invID := pi.Metadata[billingMetadataSubscription], pi.Metadata[billingMetadataInvoice]
+	if b == nil || b.store == nil || subID == "" || invID == "" {
+		return nil
+	}
+	if typ != "payment_intent.succeeded" && typ != "payment_intent.payment_failed" {
+		return nil
+	}
+	var settled *BillingInvoice
+	_, err := b.change(ctx, subID, func(s *BillingSubscription, latest *BillingInvoice) (*BillingInvoice, error) {
+		if latest == nil || latest.ID != invID || latest.Status != billingInvoiceProcessing || latest.PaymentID != pi.ID {
+			return nil, errSubscriptionState
+		}
+		if typ == "payment_intent.succeeded" {
+			b.paid(s, latest)
+		} else {
+			b.declined(s, latest, declineOf(pi.LastPaymentError))
+		}
+		copied := *latest
+		settled = &copied
+		return nil, nil
+	})
+	if errors.Is(err, errSubscriptionState) || errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err == nil {
+		b.invoiceEvent(ctx, subID, settled)
+	}
+	return err
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	portalconfig "github.com/stripe/stripe-go/v76/billingportal/configuration"
+	portalsession "github.com/stripe/stripe-go/v76/billingportal/session"
+	"github.com/stripe/stripe-go/v76/customer"
+)
+
+// Billing portal features a profile can turn on.
+const (
+	portalPaymentMethodUpdate = "payment_method_update"
+	portalInvoiceHistory      = "invoice_history"
+	portalCustomerUpdate      = "customer_update"
+	portalSubscriptionCancel  = "subscription_cancel"
+	portalSubscriptionPause   = "subscription_pause"
+)
+
+// portalProfileKey is the metadata key on the Stripe portal
+// configurations made for a profile, holding its fingerprint.
+const portalProfileKey = "portal_profile"
+
+var (
+	portalFeatures       = []string{portalPaymentMethodUpdate, portalInvoiceHistory, portalCustomerUpdate, portalSubscriptionCancel, portalSubscriptionPause}
+	portalCustomerFields = []string{"email", "address", "shipping", "phone", "tax_id", "name"}
+)
+
+// BillingPortalProfiles set up the Stripe billing portal customers are
+// sent to, by default and per tenant; a tenant's profile replaces the
+// default whole.
+//
+//	"billing_portal": {
+//	  "default": {"return_url": "https://app.sucify.com/account", "features": ["payment_method_update", "invoice_history"]},
+//	  "tenants": {"acme": {"return_url": "https://acme.example/billing", "return_hosts": ["m.acme.example"],
+//	    "features": ["payment_method_update", "invoice_history", "customer_update", "subscription_cancel"],
+//	    "customer_update": ["email", "address", "tax_id"], "headline": "Acme billing"}}
+//	}
+type BillingPortalProfiles struct {
+	Default BillingPortalProfile            `json:"default"`
+	Tenants map[string]BillingPortalProfile `json:"tenants"`
+}
+
+type BillingPortalProfile struct {
+	// ReturnURL is where the portal's back link goes when the request
+	// names none.
+	ReturnURL string `json:"return_url"`
+	// ReturnHosts are other hosts a request's return_url may point at,
+	// besides ReturnURL's.
+	ReturnHosts []string `json:"return_hosts"`
+	// Features are what customers may do in the portal. Empty means
+	// payment_method_update and invoice_history.
+	Features []string `json:"features"`
+	// CustomerUpdate are the details customer_update lets customers
+	// change. Empty means email and address.
+	CustomerUpdate []string `json:"customer_update"`
+	// SubscriptionCancelMode is "at_period_end", the default, or
+	// "immediately".
+	SubscriptionCancelMode string `json:"subscription_cancel_mode"`
+	Headline               string `json:"headline"`
+	PrivacyPolicyURL       string `json:"privacy_policy_url"`
+	TermsOfServiceURL      string `json:"terms_of_service_url"`
+	// ConfigurationID uses a portal configuration made in the Stripe
+	// dashboard instead, ignoring the features above.
+	ConfigurationID string `json:"configuration_id"`
+}
+
+func (p BillingPortalProfiles) validate() error {
+	check := func(name string, profile BillingPortalProfile) error {
+		for _, u := range []string{profile.ReturnURL, profile.PrivacyPolicyURL, profile.TermsOfServiceURL} {
+			if u != "" && !absoluteHTTPURL(u) {
+				return fmt.Errorf("billing_portal %s: %q is not an absolute http(s) URL", name, u)
+			}
+		}
+		for _, f := range profile.Features {
+			if !containsString(portalFeatures, f) {
+				return fmt.Errorf("billing_portal %s: unknown feature %q", name, f)
+			}
+		}
+		for _, f := range profile.CustomerUpdate {
+			if !containsString(portalCustomerFields, f) {
+				return fmt.Errorf("billing_portal %s: customer_update can't include %q", name, f)
+			}
+		}
+		switch profile.SubscriptionCancelMode {
+		case "", "at_period_end", "immediately":
+		default:
+			return fmt.Errorf("billing_portal %s: subscription_cancel_mode must be at_period_end or immediately", name)
+		}
+		if profile.ConfigurationID != "" && !strings.HasPrefix(profile.ConfigurationID, "bpc_") {
+			return fmt.Errorf("billing_portal %s: configuration_id must be a portal configuration ID", name)
+		}
+		return nil
+	}
+	if err := check("default", p.Default); err != nil {
+		return err
+	}
+	for tenant, profile := range p.Tenants {
+		if err := check("tenants."+tenant, profile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// effective resolves one tenant's profile.
+func (p BillingPortalProfiles) effective(tenantID string) BillingPortalProfile {
+	if profile, ok := p.Tenants[tenantID]; ok && tenantID != "" {
+		return profile
+	}
+	return p.Default
+}
+
+func (p BillingPortalProfile) features() []string {
+	if len(p.Features) == 0 {
+		return []string{portalPaymentMethodUpdate, portalInvoiceHistory}
+	}
+	return p.Features
+}
+
+// returnURL is where a session's back link goes: requested, which must be
+// on one of the profile's hosts when it has any, or the profile's own.
+func (p BillingPortalProfile) returnURL(requested string) (string, error) {
+	if requested == "" {
+		if p.ReturnURL == "" {
+			return "", errors.New("is required, the tenant has no default")
+		}
+		return p.ReturnURL, nil
+	}
+	u, err := url.Parse(requested)
+	if err != nil || !absoluteHTTPURL(requested) {
+		return "", errors.New("must be an absolute http(s) URL")
+	}
+	hosts := p.ReturnHosts
+	if d, err := url.Parse(p.ReturnURL); err == nil && d.Host != "" {
+		hosts = append([]string{d.Host}, hosts...)
+	}
+	if len(hosts) > 0 && !containsString(hosts, u.Host) {
+		return "", fmt.Errorf("must be on %s", strings.Join(hosts, " or "))
+	}
+	return requested, nil
+}
+
+// fingerprint identifies the portal configuration a profile makes, so
+// one is made per tenant and profile, not per session, and a changed
+// profile makes a new one.
+func (p BillingPortalProfile) fingerprint() string {
+	p.ReturnURL, p.ReturnHosts = "", nil
+	b, _ := json.Marshal(p)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (p BillingPortalProfile) configurationParams() *stripe.BillingPortalConfigurationParams {
+	enabled := func(f string) *bool { return stripe.Bool(containsString(p.features(), f)) }
+	params := &stripe.BillingPortalConfigurationParams{
+		BusinessProfile: &stripe.BillingPortalConfigurationBusinessProfileParams{},
+		Features: &stripe.BillingPortalConfigurationFeaturesParams{
+			PaymentMethodUpdate: &stripe.BillingPortalConfigurationFeaturesPaymentMethodUpdateParams{Enabled: enabled(portalPaymentMethodUpdate)},
+			InvoiceHistory:      &stripe.BillingPortalConfigurationFeaturesInvoiceHistoryParams{Enabled: enabled(portalInvoiceHistory)},
+			CustomerUpdate:      &stripe.BillingPortalConfigurationFeaturesCustomerUpdateParams{Enabled: enabled(portalCustomerUpdate)},
+			SubscriptionCancel:  &stripe.BillingPortalConfigurationFeaturesSubscriptionCancelParams{Enabled: enabled(portalSubscriptionCancel)},
+			SubscriptionPause:   &stripe.BillingPortalConfigurationFeaturesSubscriptionPauseParams{Enabled: enabled(portalSubscriptionPause)},
+		},
+	}
+	if *params.Features.CustomerUpdate.Enabled {
+		fields := p.CustomerUpdate
+		if len(fields) == 0 {
+			fields = []string{"email", "address"}
+		}
+		params.Features.CustomerUpdate.AllowedUpdates = stripe.StringSlice(fields)
+	}
+	if *params.Features.SubscriptionCancel.Enabled {
+		mode := p.SubscriptionCancelMode
+		if mode == "" {
+			mode = "at_period_end"
+		}
+		params.Features.SubscriptionCancel.Mode = stripe.String(mode)
+	}
+	for _, f := range []struct {
+		dst **string
+		v   string
+	}{
+		{&params.BusinessProfile.Headline, p.Headline},
+		{&params.BusinessProfile.PrivacyPolicyURL, p.PrivacyPolicyURL},
+		{&params.BusinessProfile.TermsOfServiceURL, p.TermsOfServiceURL},
+	} {
+		if f.v != "" {
+			*f.dst = stripe.String(f.v)
+		}
+	}
+	return params
+}
+
+// BillingPortal hands customers a Stripe billing portal session, where
+// they manage their cards, invoices and subscriptions on Stripe's screens
+// rather than ours. What the portal offers is each tenant's portal
+// profile, made into a Stripe portal configuration on first use.
+type BillingPortal struct {
+	store    *Store
+	settings *RuntimeSettings
+
+	mu sync.Mutex
+	// configs are the portal configurations made so far, by tenant and
+	// profile fingerprint.
+	configs map[string]string
+}
+
+func NewBillingPortal(store *Store, settings *RuntimeSettings) *BillingPortal {
+	return &BillingPortal{store: store, settings: settings, configs: map[string]string{}}
+}
+
+// RegisterRoutes mounts portal sessions under the customers scope.
+func (bp *BillingPortal) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	r.POST("/customers/:id/portal-session", requireScope(bp.store, bootstrapToken, "customers"), bp.createSession)
+}
+
+// createSession opens a portal session for a customer of the tenant. The
+// URL it returns is single use and short lived; send the customer there
+// straight away.
+func (bp *BillingPortal) createSession(c *gin.Context) {
+	var req struct {
+		TenantID  string `json:"tenant_id"`
+		ReturnURL string `json:"return_url"`
+		Locale    string `json:"locale"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	ctx := c.Request.Context()
+	customerID := c.Param("id")
+	profile := bp.settings.Get().BillingPortal.effective(req.TenantID)
+	returnURL, err := profile.returnURL(req.ReturnURL)
+	if err != nil {
+		validationFailed(c, []FieldError{{Field: "return_url", Code: "invalid", Message: err.Error()}})
+		return
+	}
+
+	// Only the tenant's own customers, when the customer names a tenant.
+	cp := &stripe.CustomerParams{}
+	cp.Context = ctx
+	cust, err := customer.Get(customerID, cp)
+	var se *stripe.Error
+	switch {
+	case errors.As(err, &se) && se.Code == stripe.ErrorCodeResourceMissing,
+		err == nil && (cust.Deleted || (cust.Metadata["tenant_id"] != "" && cust.Metadata["tenant_id"] != req.TenantID)):
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Customer not found"))
+		return
+	case err != nil:
+		respondError(c, err)
+		return
+	}
+
+	configID, err := bp.configuration(ctx, req.TenantID, profile)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	params := &stripe.BillingPortalSessionParams{
+		Customer:      stripe.String(customerID),
+		Configuration: stripe.String(configID),
+		ReturnURL:     stripe.String(returnURL),
+	}
+	if req.Locale != "" {
+		params.Locale = stripe.String(req.Locale)
+	}
+	params.Context = ctx
+	session, err := portalsession.New(params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	logf(ctx, "billing portal: session %s for %s (tenant %q)", session.ID, customerID, req.TenantID)
+	respondData(c, http.StatusCreated, gin.H{
+		"id":            session.ID,
+		"url":           session.URL,
+		"customer_id":   customerID,
+		"return_url":    session.ReturnURL,
+		"configuration": configID,
+	})
+}
+
+// configuration returns the portal configuration of the tenant's
+// profile: the one it names, one made for it earlier, found by its
+// metadata after a restart, or a new one.
+func (bp *BillingPortal) configuration(ctx context.Context, tenantID string, profile BillingPortalProfile) (string, error) {
+	if profile.ConfigurationID != "" {
+		return profile.ConfigurationID, nil
+	}
+	fingerprint := profile.fingerprint()
+	key := tenantID + "/" + fingerprint
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if id, ok := bp.configs[key]; ok {
+		return id, nil
+	}
+
+	list := &stripe.BillingPortalConfigurationListParams{Active: stripe.Bool(true)}
+	list.Context = ctx
+	iter := portalconfig.List(list)
+	for iter.Next() {
+		cfg := iter.BillingPortalConfiguration()
+		if cfg.Metadata[portalProfileKey] == fingerprint && cfg.Metadata["tenant_id"] == tenantID {
+			bp.configs[key] = cfg.ID
+			return cfg.ID, nil
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return "", err
+	}
+
+	params := profile.configurationParams()
+	params.Context = ctx
+	params.SetIdempotencyKey("portal-config-" + key)
+	params.AddMetadata(portalProfileKey, fingerprint)
+	params.AddMetadata("tenant_id", tenantID)
+	cfg, err := portalconfig.New(params)
+	if err != nil {
+		return "", err
+	}
+	logf(ctx, "billing portal: made configuration %s for tenant %q", cfg.ID, tenantID)
+	bp.configs[key] = cfg.ID
+	return cfg.ID, nil
+}
+
+func absoluteHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
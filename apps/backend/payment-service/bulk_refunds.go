@@ -0,0 +1,694 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"github.com/stripe/stripe-go/v76/refund"
+)
+
+var bulkRefundItemsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_bulk_refund_items_total",
+	Help: "Bulk refund items processed, by outcome (refunded, held, failed).",
+}, []string{"outcome"})
+
+// bulkRefundScope lets an API key start and follow bulk refunds.
+const bulkRefundScope = "refunds"
+
+// Bulk refund statuses. Pending and running jobs are picked up by the
+// worker; the rest are final.
+const (
+	bulkRefundPending   = "pending"
+	bulkRefundRunning   = "running"
+	bulkRefundCompleted = "completed"
+	bulkRefundFailed    = "failed"
+	bulkRefundCanceled  = "canceled"
+)
+
+// Bulk refund item statuses. A held item is waiting in the refund
+// approval queue.
+const (
+	bulkItemPending  = "pending"
+	bulkItemRefunded = "refunded"
+	bulkItemHeld     = "held"
+	bulkItemFailed   = "failed"
+)
+
+const (
+	// bulkRefundBatch is how many items a job takes at a time, and how
+	// often it checks that it was not canceled.
+	bulkRefundBatch = 50
+	// bulkRefundLease is how long a claimed job stays claimed without a
+	// batch finishing; an instance that dies mid-job hands it over.
+	bulkRefundLease = 5 * time.Minute
+	// bulkRefundMaxFailures is how many batches in a row may fail before
+	// a job gives up.
+	bulkRefundMaxFailures = 5
+)
+
+// BulkRefund refunds a set of payments in the background. Filter is the
+// payments list query the set was matched with, if it was not given.
+// Progress is the share of items done, whatever their outcome.
+type BulkRefund struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Reason      string     `json:"reason,omitempty"`
+	Filter      string     `json:"filter,omitempty"`
+	Total       int        `json:"total"`
+	Refunded    int        `json:"refunded"`
+	Held        int        `json:"held"`
+	Failed      int        `json:"failed"`
+	Progress    float64    `json:"progress"`
+	Failures    int        `json:"failures"`
+	LastError   string     `json:"last_error,omitempty"`
+	RequestedBy string     `json:"requested_by,omitempty"`
+	Report      string     `json:"report"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+// BulkRefundItem is one payment of a bulk refund. Amount 0 refunds what
+// is left of it; Refunded is what was. Reason, when set, is used instead
+// of the job's.
+type BulkRefundItem struct {
+	Seq             int       `json:"seq"`
+	PaymentID       string    `json:"payment_id"`
+	Amount          int64     `json:"amount"`
+	Reason          string    `json:"reason,omitempty"`
+	Status          string    `json:"status"`
+	RefundID        string    `json:"refund_id,omitempty"`
+	RefundRequestID string    `json:"refund_request_id,omitempty"`
+	Refunded        int64     `json:"refunded"`
+	Currency        string    `json:"currency,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+const bulkRefundColumns = `id, status, reason, filter, total, refunded, held, failed, failures, last_error,
+	requested_by, created_at, updated_at, finished_at`
+
+func scanBulkRefund(row interface{ Scan(...interface{}) error }) (*BulkRefund, error) {
+	var b BulkRefund
+	var finished sql.NullTime
+	if err := row.Scan(&b.ID, &b.Status, &b.Reason, &b.Filter, &b.Total, &b.Refunded, &b.Held, &b.Failed,
+		&b.Failures, &b.LastError, &b.RequestedBy, &b.CreatedAt, &b.UpdatedAt, &finished); err != nil {
+		return nil, err
+	}
+	b.FinishedAt = timeOrNil(finished)
+	if b.Total > 0 {
+		b.Progress = round4(float64(b.Refunded+b.Held+b.Failed) / float64(b.Total))
+	}
+	b.Report = "/refunds/bulk/" + b.ID + "/report"
+	return &b, nil
+}
+
+const bulkRefundItemColumns = `seq, payment_id, amount, reason, status, refund_id, refund_request_id, refunded, currency,
+	error, updated_at`
+
+func scanBulkRefundItem(row interface{ Scan(...interface{}) error }) (*BulkRefundItem, error) {
+	var it BulkRefundItem
+	if err := row.Scan(&it.Seq, &it.PaymentID, &it.Amount, &it.Reason, &it.Status, &it.RefundID, &it.RefundRequestID,
+		&it.Refunded, &it.Currency, &it.Error, &it.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &it, nil
+}
+
+var bulkRefundList = listResource{
+	from: "bulk_refunds b",
+	fields: []string{"id", "status", "reason", "total", "refunded", "held", "failed", "last_error", "requested_by",
+		"created_at", "finished_at"},
+	columns: map[string]listField{
+		"id":           {"b.id", textField},
+		"status":       {"b.status", textField},
+		"reason":       {"b.reason", textField},
+		"total":        {"b.total", intField},
+		"refunded":     {"b.refunded", intField},
+		"held":         {"b.held", intField},
+		"failed":       {"b.failed", intField},
+		"last_error":   {"b.last_error", textField},
+		"requested_by": {"b.requested_by", textField},
+		"created_at":   {"b.created_at", timeField},
+		"finished_at":  {"b.finished_at", timeField},
+	},
+}
+
+// CreateBulkRefund records a pending job with its items, numbered from 1.
+// A retry with the same idempotency key gets the job the first attempt
+// recorded.
+func (s *Store) CreateBulkRefund(ctx context.Context, b *BulkRefund, items []BulkRefundItem, idempotencyKey string) (*BulkRefund, error) {
+	key := sql.NullString{String: idempotencyKey, Valid: idempotencyKey != ""}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	created, err := scanBulkRefund(tx.QueryRowContext(ctx, `
+		INSERT INTO bulk_refunds (id, status, reason, filter, total, requested_by, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (idempotency_key) DO NOTHING
+		RETURNING `+bulkRefundColumns,
+		b.ID, bulkRefundPending, b.Reason, b.Filter, len(items), b.RequestedBy, key))
+	if errors.Is(err, sql.ErrNoRows) && key.Valid {
+		return scanBulkRefund(s.db.QueryRowContext(ctx, `
+			SELECT `+bulkRefundColumns+` FROM bulk_refunds WHERE idempotency_key = $1`, key))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make([]int64, len(items))
+	payments := make([]string, len(items))
+	amounts := make([]int64, len(items))
+	reasons := make([]string, len(items))
+	for i, it := range items {
+		seqs[i], payments[i], amounts[i], reasons[i] = int64(i+1), it.PaymentID, it.Amount, it.Reason
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO bulk_refund_items (bulk_refund_id, seq, payment_id, amount, reason)
+		SELECT $1, i.seq, i.payment_id, i.amount, i.reason
+		FROM unnest($2::int[], $3::text[], $4::bigint[], $5::text[]) AS i (seq, payment_id, amount, reason)`,
+		created.ID, seqs, payments, amounts, reasons); err != nil {
+		return nil, err
+	}
+	return created, tx.Commit()
+}
+
+func (s *Store) BulkRefund(ctx context.Context, id string) (*BulkRefund, error) {
+	return scanBulkRefund(s.db.QueryRowContext(ctx, `SELECT `+bulkRefundColumns+` FROM bulk_refunds WHERE id = $1`, id))
+}
+
+// ClaimBulkRefund marks the oldest open job nobody holds as running for
+// bulkRefundLease and returns it, or sql.ErrNoRows.
+func (s *Store) ClaimBulkRefund(ctx context.Context) (*BulkRefund, error) {
+	return scanBulkRefund(s.db.QueryRowContext(ctx, `
+		UPDATE bulk_refunds SET status = 'running', lease_until = $1, updated_at = now()
+		WHERE id = (
+			SELECT id FROM bulk_refunds
+			WHERE status IN ('pending', 'running') AND (lease_until IS NULL OR lease_until <= now())
+			ORDER BY created_at LIMIT 1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING `+bulkRefundColumns, time.Now().Add(bulkRefundLease).UTC()))
+}
+
+// ExtendBulkRefund renews a running job's lease. It returns sql.ErrNoRows
+// once the job was canceled.
+func (s *Store) ExtendBulkRefund(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE bulk_refunds SET lease_until = $2, updated_at = now()
+		WHERE id = $1 AND status = 'running'`, id, time.Now().Add(bulkRefundLease).UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+// PendingBulkRefundItems returns up to limit of a job's items not yet
+// done, in order.
+func (s *Store) PendingBulkRefundItems(ctx context.Context, id string, limit int) ([]*BulkRefundItem, error) {
+	var items []*BulkRefundItem
+	err := s.EachBulkRefundItem(ctx, id, bulkItemPending, limit, func(it *BulkRefundItem) error {
+		items = append(items, it)
+		return nil
+	})
+	return items, err
+}
+
+// EachBulkRefundItem calls fn for a job's items in order, only those in
+// status when it is set, stopping at fn's first error. limit 0 reads
+// every item.
+func (s *Store) EachBulkRefundItem(ctx context.Context, id, status string, limit int, fn func(*BulkRefundItem) error) error {
+	var limitArg interface{}
+	if limit > 0 {
+		limitArg = limit
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+bulkRefundItemColumns+` FROM bulk_refund_items
+		WHERE bulk_refund_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY seq LIMIT $3`, id, status, limitArg)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		it, err := scanBulkRefundItem(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(it); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// RecordBulkRefundItem saves a pending item's outcome and counts it on
+// its job. The count is kept even if the job was canceled meanwhile,
+// since the refund was made.
+func (s *Store) RecordBulkRefundItem(ctx context.Context, id string, it *BulkRefundItem) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE bulk_refund_items SET status = $3, refund_id = $4, refund_request_id = $5, refunded = $6,
+			currency = $7, error = $8, updated_at = now()
+		WHERE bulk_refund_id = $1 AND seq = $2 AND status = 'pending'`,
+		id, it.Seq, it.Status, it.RefundID, it.RefundRequestID, it.Refunded, it.Currency, it.Error)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE bulk_refunds SET
+			refunded = refunded + CASE WHEN $2 = 'refunded' THEN 1 ELSE 0 END,
+			held = held + CASE WHEN $2 = 'held' THEN 1 ELSE 0 END,
+			failed = failed + CASE WHEN $2 = 'failed' THEN 1 ELSE 0 END,
+			failures = 0, last_error = '', updated_at = now()
+		WHERE id = $1`, id, it.Status); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// FailBulkRefundBatch records a batch that failed. The job is picked up
+// again once its lease runs out, and fails for good after
+// bulkRefundMaxFailures in a row.
+func (s *Store) FailBulkRefundBatch(ctx context.Context, id, lastError string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE bulk_refunds SET failures = failures + 1, last_error = $2, updated_at = now(),
+			status = CASE WHEN failures + 1 >= $3 THEN 'failed' ELSE status END,
+			finished_at = CASE WHEN failures + 1 >= $3 THEN now() ELSE finished_at END
+		WHERE id = $1 AND status = 'running'`, id, lastError, bulkRefundMaxFailures)
+	return err
+}
+
+// FinishBulkRefund moves an open job to a final status.
+func (s *Store) FinishBulkRefund(ctx context.Context, id, status string) (*BulkRefund, error) {
+	return scanBulkRefund(s.db.QueryRowContext(ctx, `
+		UPDATE bulk_refunds SET status = $2, lease_until = NULL, finished_at = now(), updated_at = now()
+		WHERE id = $1 AND status IN ('pending', 'running')
+		RETURNING `+bulkRefundColumns, id, status))
+}
+
+// BulkRefunds refunds many payments at once, as after a product recall:
+// the caller lists payment IDs with per-item amounts, or gives a filter
+// in the GET /payments syntax, and gets a job back straight away. A
+// worker refunds the items a batch at a time, parallelism at once, each
+// under its own idempotency key so a job resumed after a restart never
+// refunds twice. Refunds above the refund approval thresholds go to the
+// approval queue instead, as from the admin refund endpoint. The job
+// reports progress as it goes, and a CSV report lists every item's
+// outcome.
+type BulkRefunds struct {
+	store       *Store
+	settings    *RuntimeSettings
+	interval    time.Duration
+	parallelism int
+	maxItems    int
+}
+
+func NewBulkRefunds(store *Store, settings *RuntimeSettings, interval time.Duration, parallelism, maxItems int) *BulkRefunds {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	return &BulkRefunds{store: store, settings: settings, interval: interval, parallelism: parallelism, maxItems: maxItems}
+}
+
+func (br *BulkRefunds) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/refunds/bulk", requireScope(br.store, bootstrapToken, bulkRefundScope), br.requireStore)
+	g.POST("", br.create)
+	g.POST("/import", br.importCSV)
+	g.GET("", listHandler(br.store, bulkRefundList))
+	g.GET("/:id", br.get)
+	g.GET("/:id/report", br.report)
+	g.POST("/:id/cancel", br.cancel)
+}
+
+func (br *BulkRefunds) requireStore(c *gin.Context) {
+	if br.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Bulk refunds require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// validRefundReason accepts the reasons Stripe takes, or none.
+func validRefundReason(reason string) bool {
+	switch stripe.RefundReason(reason) {
+	case "", stripe.RefundReasonDuplicate, stripe.RefundReasonFraudulent, stripe.RefundReasonRequestedByCustomer:
+		return true
+	}
+	return false
+}
+
+// create starts a job for the given items, or for the payments filter
+// matches now, each refunding amount (0 for what is left of it).
+func (br *BulkRefunds) create(c *gin.Context) {
+	var req struct {
+		Items []struct {
+			PaymentID string `json:"payment_id" binding:"required"`
+			Amount    int64  `json:"amount" binding:"gte=0"`
+		} `json:"items" binding:"dive"`
+		Filter string `json:"filter"`
+		Amount int64  `json:"amount" binding:"gte=0"`
+		Reason string `json:"reason"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if (len(req.Items) == 0) == (req.Filter == "") {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "Give either items or filter"))
+		return
+	}
+	if !validRefundReason(req.Reason) {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "Invalid refund reason "+req.Reason))
+		return
+	}
+	ctx := c.Request.Context()
+
+	var items []BulkRefundItem
+	if req.Filter != "" {
+		q, err := parseListQuery(req.Filter, paymentList, true)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "filter: "+err.Error()))
+			return
+		}
+		q.Fields, q.Sort = []string{"id"}, []ListSort{{Field: "created_at"}}
+		err = br.store.EachListRow(ctx, paymentList, q, br.maxItems+1, func(row map[string]interface{}) error {
+			items = append(items, BulkRefundItem{PaymentID: row["id"].(string), Amount: req.Amount})
+			return nil
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+		if len(items) == 0 {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "filter matches no payments"))
+			return
+		}
+	} else {
+		seen := make(map[string]bool, len(req.Items))
+		for _, it := range req.Items {
+			if seen[it.PaymentID] {
+				c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "Payment "+it.PaymentID+" is listed more than once"))
+				return
+			}
+			seen[it.PaymentID] = true
+			items = append(items, BulkRefundItem{PaymentID: it.PaymentID, Amount: it.Amount})
+		}
+	}
+	if len(items) > br.maxItems {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, fmt.Sprintf("A bulk refund takes at most %d payments", br.maxItems)))
+		return
+	}
+
+	want := &BulkRefund{
+		ID:          "brf_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		Reason:      req.Reason,
+		Filter:      req.Filter,
+		RequestedBy: c.GetString("api_key_id"),
+	}
+	b, err := br.store.CreateBulkRefund(ctx, want, items, c.GetHeader("Idempotency-Key"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if b.ID == want.ID {
+		logf(ctx, "bulk refund %s of %d payments started by %s", b.ID, b.Total, b.RequestedBy)
+	}
+	respondData(c, http.StatusAccepted, b)
+}
+
+func (br *BulkRefunds) get(c *gin.Context) {
+	b, err := br.store.BulkRefund(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Bulk refund not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, b)
+}
+
+var bulkRefundReportColumns = []string{"seq", "payment_id", "amount", "reason", "status", "refund_id", "refund_request_id",
+	"refunded", "currency", "error", "updated_at"}
+
+// report streams the job's items and their outcomes as CSV, only those
+// in ?status= when it is given. It can be fetched while the job runs.
+func (br *BulkRefunds) report(c *gin.Context) {
+	ctx := c.Request.Context()
+	b, err := br.store.BulkRefund(ctx, c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Bulk refund not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="bulk_refund_%s.csv"`, b.ID))
+	c.Status(http.StatusOK)
+
+	w := &csvRowWriter{w: csv.NewWriter(c.Writer)}
+	err = w.Write(bulkRefundReportColumns)
+	if err == nil {
+		err = br.store.EachBulkRefundItem(ctx, b.ID, c.Query("status"), 0, func(it *BulkRefundItem) error {
+			return w.Write([]string{strconv.Itoa(it.Seq), it.PaymentID, strconv.FormatInt(it.Amount, 10), it.Reason, it.Status,
+				it.RefundID, it.RefundRequestID, strconv.FormatInt(it.Refunded, 10), it.Currency, it.Error,
+				it.UpdatedAt.UTC().Format(time.RFC3339)})
+		})
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		// The status is sent, so all that's left is to cut the file short.
+		logf(ctx, "bulk refund %s report: %v", b.ID, err)
+	}
+}
+
+// cancel stops an open job after the batch in flight. Items not reached
+// stay pending in the report.
+func (br *BulkRefunds) cancel(c *gin.Context) {
+	b, err := br.store.FinishBulkRefund(c.Request.Context(), c.Param("id"), bulkRefundCanceled)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusConflict, errorBody(c, CodeInvalidRequest, "The bulk refund is not running"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	logf(c.Request.Context(), "bulk refund %s canceled by %s", b.ID, c.GetString("api_key_id"))
+	respondData(c, http.StatusOK, b)
+}
+
+// Run works through open jobs every interval until ctx is done.
+func (br *BulkRefunds) Run(ctx context.Context) {
+	if br.store == nil {
+		return
+	}
+	ticker := time.NewTicker(br.interval)
+	defer ticker.Stop()
+	for {
+		if err := br.sweep(ctx); err != nil {
+			log.Printf("bulk refunds: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep claims open jobs one at a time and runs each to the end, or
+// until a batch fails.
+func (br *BulkRefunds) sweep(ctx context.Context) error {
+	for ctx.Err() == nil {
+		b, err := br.store.ClaimBulkRefund(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := br.run(ctx, b); err != nil {
+			logf(ctx, "bulk refund %s: %v", b.ID, err)
+			if err := br.store.FailBulkRefundBatch(context.WithoutCancel(ctx), b.ID, err.Error()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// run refunds b's pending items a batch at a time.
+func (br *BulkRefunds) run(ctx context.Context, b *BulkRefund) error {
+	for {
+		err := br.store.ExtendBulkRefund(ctx, b.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			logf(ctx, "bulk refund %s canceled", b.ID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		items, err := br.store.PendingBulkRefundItems(ctx, b.ID, bulkRefundBatch)
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			done, err := br.store.FinishBulkRefund(ctx, b.ID, bulkRefundCompleted)
+			if err == nil {
+				logf(ctx, "bulk refund %s completed: %d refunded, %d held for approval, %d failed",
+					done.ID, done.Refunded, done.Held, done.Failed)
+			}
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return err
+		}
+		if err := br.batch(ctx, b, items); err != nil {
+			return err
+		}
+	}
+}
+
+// batch refunds items parallelism at a time, saving each outcome as it
+// comes. An item the provider could not be reached for stays pending,
+// and the first such error fails the batch.
+func (br *BulkRefunds) batch(ctx context.Context, b *BulkRefund, items []*BulkRefundItem) error {
+	var mu sync.Mutex
+	var first error
+	sem := make(chan struct{}, br.parallelism)
+	var wg sync.WaitGroup
+	for _, it := range items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(it *BulkRefundItem) {
+			defer func() { <-sem; wg.Done() }()
+			err := br.refund(ctx, b, it)
+			if err == nil {
+				err = br.store.RecordBulkRefundItem(context.WithoutCancel(ctx), b.ID, it)
+				bulkRefundItemsTotal.WithLabelValues(it.Status).Inc()
+			}
+			if err != nil {
+				mu.Lock()
+				if first == nil {
+					first = fmt.Errorf("payment %s: %w", it.PaymentID, err)
+				}
+				mu.Unlock()
+			}
+		}(it)
+	}
+	wg.Wait()
+	return first
+}
+
+// refund refunds one item, or holds it for approval, setting its
+// outcome. A refusal from the provider fails the item; an error is
+// returned only when the provider could not be reached, for the item to
+// be tried again.
+func (br *BulkRefunds) refund(ctx context.Context, b *BulkRefund, it *BulkRefundItem) error {
+	key := fmt.Sprintf("bulk-refund-%s-%d", b.ID, it.Seq)
+	reason := it.Reason
+	if reason == "" {
+		reason = b.Reason
+	}
+	refused := func(err error) error {
+		if providerFailure(err) {
+			return err
+		}
+		_, msg := classifyError(err)
+		it.Status, it.Error = bulkItemFailed, msg
+		return nil
+	}
+
+	if cfg := br.settings.Get().RefundApproval; len(cfg.Thresholds) > 0 {
+		params := &stripe.PaymentIntentParams{}
+		params.Context = ctx
+		params.AddExpand("latest_charge")
+		pi, err := paymentintent.Get(it.PaymentID, params)
+		if err != nil {
+			return refused(err)
+		}
+		amount := it.Amount
+		if amount == 0 && pi.LatestCharge != nil {
+			amount = pi.LatestCharge.Amount - pi.LatestCharge.AmountRefunded
+		}
+		if amount > 0 && cfg.requires(string(pi.Currency), amount) {
+			want := &RefundRequest{
+				ID:          uuid.NewString(),
+				PaymentID:   pi.ID,
+				Currency:    string(pi.Currency),
+				Amount:      amount,
+				Reason:      reason,
+				Status:      refundRequestPending,
+				RequestedBy: b.RequestedBy,
+			}
+			rr, err := br.store.CreateRefundRequest(ctx, want, key)
+			if err != nil {
+				return err
+			}
+			if rr.ID == want.ID {
+				refundRequestsTotal.WithLabelValues("requested").Inc()
+			}
+			it.Status, it.RefundRequestID, it.Currency = bulkItemHeld, rr.ID, rr.Currency
+			return nil
+		}
+	}
+
+	params := &stripe.RefundParams{PaymentIntent: stripe.String(it.PaymentID)}
+	params.Context = ctx
+	if it.Amount > 0 {
+		params.Amount = stripe.Int64(it.Amount)
+	}
+	if reason != "" {
+		params.Reason = stripe.String(reason)
+	}
+	params.AddMetadata("requested_by", b.RequestedBy)
+	params.AddMetadata("bulk_refund_id", b.ID)
+	params.SetIdempotencyKey(key)
+	rf, err := refund.New(params)
+	if err != nil {
+		return refused(err)
+	}
+	if err := br.store.RecordAdminAction(context.WithoutCancel(ctx), it.PaymentID, "refund.requested", rf.ID, b.RequestedBy,
+		gin.H{"amount": rf.Amount, "currency": rf.Currency, "reason": reason, "bulk_refund_id": b.ID}); err != nil {
+		logf(ctx, "recording refund %s of %s: %v", rf.ID, it.PaymentID, err)
+	}
+	it.Status, it.RefundID, it.Refunded, it.Currency = bulkItemRefunded, rf.ID, rf.Amount, string(rf.Currency)
+	return nil
+}
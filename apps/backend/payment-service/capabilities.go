@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/countryspec"
+)
+
+// paymentMethodCurrencies lists the currencies each payment method can be
+// charged in, per Stripe's documentation; nil means any currency the
+// account supports. countries, where set, limits a method to customers
+// in those countries.
+var paymentMethodCurrencies = map[string]struct {
+	currencies []string
+	countries  []string
+}{
+	"card":              {},
+	"link":              {},
+	"us_bank_account":   {[]string{"usd"}, nil},
+	"acss_debit":        {[]string{"cad", "usd"}, []string{"CA"}},
+	"sepa_debit":        {[]string{"eur"}, nil},
+	"bacs_debit":        {[]string{"gbp"}, []string{"GB"}},
+	"au_becs_debit":     {[]string{"aud"}, []string{"AU"}},
+	"ideal":             {[]string{"eur"}, []string{"NL"}},
+	"bancontact":        {[]string{"eur"}, []string{"BE"}},
+	"eps":               {[]string{"eur"}, []string{"AT"}},
+	"p24":               {[]string{"eur", "pln"}, []string{"PL"}},
+	"blik":              {[]string{"pln"}, []string{"PL"}},
+	"klarna":            {[]string{"usd", "eur", "gbp", "dkk", "nok", "sek", "aud", "cad", "nzd", "chf", "czk", "pln"}, nil},
+	"afterpay_clearpay": {[]string{"usd", "cad", "aud", "nzd", "gbp"}, nil},
+	"affirm":            {[]string{"usd", "cad"}, []string{"US", "CA"}},
+	"alipay":            {[]string{"cny", "aud", "cad", "eur", "gbp", "hkd", "jpy", "sgd", "myr", "nzd", "usd"}, nil},
+	"wechat_pay":        {[]string{"cny", "aud", "cad", "eur", "gbp", "hkd", "jpy", "sgd", "usd", "dkk", "nok", "sek", "chf"}, nil},
+	"oxxo":              {[]string{"mxn"}, []string{"MX"}},
+	"boleto":            {[]string{"brl"}, []string{"BR"}},
+	"konbini":           {[]string{"jpy"}, []string{"JP"}},
+	"paynow":            {[]string{"sgd"}, []string{"SG"}},
+	"promptpay":         {[]string{"thb"}, []string{"TH"}},
+	"grabpay":           {[]string{"sgd", "myr"}, []string{"SG", "MY"}},
+	"fpx":               {[]string{"myr"}, []string{"MY"}},
+}
+
+// minimumChargeAmounts are Stripe's minimum charges in minor units.
+// Currencies not listed report 0; Stripe still enforces its 0.50 USD
+// equivalent when charging.
+var minimumChargeAmounts = map[string]int64{
+	"usd": 50, "aed": 200, "aud": 50, "bgn": 100, "brl": 50, "cad": 50, "chf": 50, "czk": 1500,
+	"dkk": 250, "eur": 50, "gbp": 30, "hkd": 400, "huf": 17500, "inr": 50, "jpy": 50, "mxn": 1000,
+	"myr": 200, "nok": 300, "nzd": 50, "pln": 200, "ron": 200, "sek": 300, "sgd": 50, "thb": 1000,
+}
+
+// CapabilityCache keeps what the Stripe account can accept in memory, so
+// checkout can decide which buttons to render without a provider round
+// trip. It refreshes in the background and keeps serving the last good
+// copy when a refresh fails.
+type CapabilityCache struct {
+	country  string
+	interval time.Duration
+
+	mu         sync.RWMutex
+	currencies map[string]bool
+	refreshed  time.Time
+}
+
+// NewCapabilityCache reads the account's country from Stripe unless
+// STRIPE_ACCOUNT_COUNTRY names it.
+func NewCapabilityCache(interval time.Duration) *CapabilityCache {
+	cc := &CapabilityCache{country: strings.ToUpper(os.Getenv("STRIPE_ACCOUNT_COUNTRY")), interval: interval}
+	go cc.refreshLoop()
+	return cc
+}
+
+func (cc *CapabilityCache) refreshLoop() {
+	for {
+		if err := cc.refresh(context.Background()); err != nil {
+			logf(context.Background(), "refreshing payment capabilities: %v", err)
+		}
+		time.Sleep(cc.interval)
+	}
+}
+
+func (cc *CapabilityCache) refresh(ctx context.Context) error {
+	country := cc.country
+	if country == "" {
+		acct := &stripe.Account{}
+		params := &stripe.Params{Context: ctx}
+		if err := stripe.GetBackend(stripe.APIBackend).Call(http.MethodGet, "/v1/account", stripe.Key, params, acct); err != nil {
+			return err
+		}
+		country = acct.Country
+	}
+
+	params := &stripe.CountrySpecParams{}
+	params.Context = ctx
+	spec, err := countryspec.Get(country, params)
+	if err != nil {
+		return err
+	}
+	currencies := make(map[string]bool, len(spec.SupportedPaymentCurrencies))
+	for _, cur := range spec.SupportedPaymentCurrencies {
+		currencies[string(cur)] = true
+	}
+
+	cc.mu.Lock()
+	cc.country = country
+	cc.currencies = currencies
+	cc.refreshed = time.Now().UTC()
+	cc.mu.Unlock()
+	return nil
+}
+
+// Capabilities is GET /payment/capabilities for one currency.
+type Capabilities struct {
+	Currency       string   `json:"currency"`
+	Country        string   `json:"country,omitempty"`
+	Supported      bool     `json:"supported"`
+	PaymentMethods []string `json:"payment_methods"`
+	// CardBrands are the brands the tenant accepts, when it limits them.
+	CardBrands    []string `json:"card_brands,omitempty"`
+	MinimumAmount int64    `json:"minimum_amount"`
+	// MaximumAmount is the tenant's policy limit, when there is one.
+	MaximumAmount int64  `json:"maximum_amount,omitempty"`
+	RefreshedAt   string `json:"refreshed_at,omitempty"`
+}
+
+// lookup answers from the cache. ok is false before the first refresh.
+func (cc *CapabilityCache) lookup(currency string) (supported bool, refreshed time.Time, ok bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	if cc.refreshed.IsZero() {
+		return false, time.Time{}, false
+	}
+	return cc.currencies[currency], cc.refreshed, true
+}
+
+// methodsFor narrows candidates to those that take currency and, when
+// country is known, customers in that country.
+func methodsFor(candidates []string, currency, country string) []string {
+	out := []string{}
+	for _, m := range candidates {
+		rule, known := paymentMethodCurrencies[m]
+		if !known {
+			continue
+		}
+		if rule.currencies != nil && !containsString(rule.currencies, currency) {
+			continue
+		}
+		if country != "" && rule.countries != nil && !containsString(rule.countries, country) {
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// RegisterRoutes mounts GET /payment/capabilities?currency=usd, optionally
+// with country (the customer's) and tenant_id, which applies the tenant's
+// payment method flags, accepted methods and card brands, and amount
+// policy as POST /payment/create would.
+func (cc *CapabilityCache) RegisterRoutes(r *gin.Engine, settings *RuntimeSettings, flags *Flags) {
+	r.GET("/payment/capabilities", func(c *gin.Context) {
+		currency := strings.ToLower(c.Query("currency"))
+		if len(currency) != 3 {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidCurrency, "currency must be a three-letter ISO code"))
+			return
+		}
+		country := strings.ToUpper(c.Query("country"))
+		tenantID := c.Query("tenant_id")
+
+		supported, refreshed, ok := cc.lookup(currency)
+		if !ok {
+			c.Header("Retry-After", "5")
+			c.JSON(http.StatusServiceUnavailable, errorBody(c, CodeProviderUnavailable, "Payment capabilities are still loading"))
+			return
+		}
+
+		cfg := settings.Get()
+		allowed, limits := cfg.AmountPolicies.effective(tenantID, currency)
+		if len(allowed) > 0 && !containsFold(allowed, currency) {
+			supported = false
+		}
+
+		caps := Capabilities{
+			Currency:       currency,
+			Country:        country,
+			Supported:      supported,
+			PaymentMethods: []string{},
+			MinimumAmount:  minimumChargeAmounts[currency],
+			MaximumAmount:  limits.Max,
+			RefreshedAt:    refreshed.Format(time.RFC3339),
+		}
+		if limits.Min > caps.MinimumAmount {
+			caps.MinimumAmount = limits.Min
+		}
+		if max, ok := cfg.MaxAmounts[currency]; ok && (caps.MaximumAmount == 0 || max < caps.MaximumAmount) {
+			caps.MaximumAmount = max
+		}
+
+		if supported {
+			// The same flags that pick methods at create time
+			fc := flagContext(tenantID, "", map[string]interface{}{"currency": currency})
+			candidates := flags.Strings(c.Request.Context(), flagPaymentMethodTypes, cfg.PaymentMethodTypes, fc)
+			if flags.Bool(c.Request.Context(), flagAutomaticPaymentMethods, false, fc) || len(candidates) == 0 {
+				candidates = make([]string, 0, len(paymentMethodCurrencies))
+				for m := range paymentMethodCurrencies {
+					candidates = append(candidates, m)
+				}
+				sort.Strings(candidates)
+			}
+			caps.PaymentMethods = methodsFor(candidates, currency, country)
+			methods, brands := cfg.AmountPolicies.acceptance(tenantID)
+			if len(methods) > 0 {
+				accepted := []string{}
+				for _, m := range caps.PaymentMethods {
+					if containsString(methods, m) {
+						accepted = append(accepted, m)
+					}
+				}
+				caps.PaymentMethods = accepted
+			}
+			if containsString(caps.PaymentMethods, "card") {
+				caps.CardBrands = brands
+			}
+		}
+
+		// Safe for browsers and CDNs to reuse briefly; it changes rarely.
+		c.Header("Cache-Control", "public, max-age=300")
+		respondData(c, http.StatusOK, caps)
+	})
+}
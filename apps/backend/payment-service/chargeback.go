@@ -0,0 +1,630 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+)
+
+var (
+	chargebackRiskFlags = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "payment_service_chargeback_risk_flags_total",
+		Help: "Successful payments flagged as resembling earlier chargebacks.",
+	})
+	chargebackRiskAlerts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_chargeback_risk_alerts_total",
+		Help: "Tenant dispute threshold alerts emitted, by card network and level.",
+	}, []string{"network", "level"})
+)
+
+// ChargebackRiskConfig sets when payments are flagged and tenants warned.
+// Networks are the card networks' monthly dispute thresholds by card
+// brand: a tenant is over one once both its dispute ratio and count
+// reach them, and warned once both reach warn_at of them. A payment is
+// flagged when the signals it shares with earlier disputes score at
+// least flag_score.
+//
+//	"chargeback_risk": {"networks": {"visa": {"ratio": 0.009, "count": 100}},
+//	                    "warn_at": 0.75, "flag_score": 50, "lookback_days": 180,
+//	                    "bin_min_payments": 50, "bin_dispute_rate": 0.01}
+type ChargebackRiskConfig struct {
+	// Networks empty means Visa's 0.9% and Mastercard's 1.5%, both at
+	// 100 disputes.
+	Networks map[string]DisputeThreshold `json:"networks"`
+	// WarnAt zero means 0.75.
+	WarnAt float64 `json:"warn_at"`
+	// FlagScore zero means 50.
+	FlagScore int `json:"flag_score"`
+	// LookbackDays is how far back disputes count against a card,
+	// customer or BIN. Zero means 180.
+	LookbackDays int `json:"lookback_days"`
+	// BINMinPayments zero means 50; a BIN with fewer payments in the
+	// lookback never counts as high risk.
+	BINMinPayments int64 `json:"bin_min_payments"`
+	// BINDisputeRate zero means 0.01.
+	BINDisputeRate float64 `json:"bin_dispute_rate"`
+}
+
+// DisputeThreshold is a card network's monthly limit: disputes over
+// successful payments, and a minimum number of disputes.
+type DisputeThreshold struct {
+	Ratio float64 `json:"ratio"`
+	Count int64   `json:"count"`
+}
+
+func (cfg ChargebackRiskConfig) validate() error {
+	for network, t := range cfg.Networks {
+		if t.Ratio <= 0 || t.Ratio >= 1 || t.Count < 0 {
+			return fmt.Errorf("chargeback_risk: networks.%s needs a ratio between 0 and 1 and a count of at least 0", network)
+		}
+	}
+	if cfg.WarnAt < 0 || cfg.WarnAt >= 1 {
+		return fmt.Errorf("chargeback_risk: warn_at must be at least 0 and below 1")
+	}
+	if cfg.FlagScore < 0 || cfg.LookbackDays < 0 || cfg.BINMinPayments < 0 {
+		return fmt.Errorf("chargeback_risk: flag_score, lookback_days and bin_min_payments must not be negative")
+	}
+	if cfg.BINDisputeRate < 0 || cfg.BINDisputeRate >= 1 {
+		return fmt.Errorf("chargeback_risk: bin_dispute_rate must be at least 0 and below 1")
+	}
+	return nil
+}
+
+func (cfg ChargebackRiskConfig) networks() map[string]DisputeThreshold {
+	if len(cfg.Networks) == 0 {
+		return map[string]DisputeThreshold{
+			"visa":       {Ratio: 0.009, Count: 100},
+			"mastercard": {Ratio: 0.015, Count: 100},
+		}
+	}
+	return cfg.Networks
+}
+
+func (cfg ChargebackRiskConfig) warnAt() float64 {
+	if cfg.WarnAt == 0 {
+		return 0.75
+	}
+	return cfg.WarnAt
+}
+
+func (cfg ChargebackRiskConfig) flagScore() int {
+	if cfg.FlagScore == 0 {
+		return 50
+	}
+	return cfg.FlagScore
+}
+
+func (cfg ChargebackRiskConfig) lookback() time.Duration {
+	if cfg.LookbackDays == 0 {
+		return 180 * 24 * time.Hour
+	}
+	return time.Duration(cfg.LookbackDays) * 24 * time.Hour
+}
+
+func (cfg ChargebackRiskConfig) binMinPayments() int64 {
+	if cfg.BINMinPayments == 0 {
+		return 50
+	}
+	return cfg.BINMinPayments
+}
+
+func (cfg ChargebackRiskConfig) binDisputeRate() float64 {
+	if cfg.BINDisputeRate == 0 {
+		return 0.01
+	}
+	return cfg.BINDisputeRate
+}
+
+// paymentCard is the card a payment was made with.
+type paymentCard struct {
+	BIN         string
+	Brand       string
+	Country     string
+	Fingerprint string
+	// Funding is credit, debit, prepaid or unknown.
+	Funding string
+}
+
+func paymentCardOf(ch *stripe.Charge) (paymentCard, bool) {
+	if ch.PaymentMethodDetails == nil || ch.PaymentMethodDetails.Card == nil {
+		return paymentCard{}, false
+	}
+	card := ch.PaymentMethodDetails.Card
+	return paymentCard{
+		BIN:         card.IIN,
+		Brand:       string(card.Brand),
+		Country:     card.Country,
+		Fingerprint: card.Fingerprint,
+		Funding:     string(card.Funding),
+	}, true
+}
+
+// SavePaymentCard records the card a charge was made with on its
+// payment. It reports false when the payment isn't stored yet.
+func (s *Store) SavePaymentCard(ctx context.Context, paymentID string, card paymentCard) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE payments SET card_bin = $2, card_brand = $3, card_country = $4, card_fingerprint = $5, updated_at = now()
+		WHERE id = $1`,
+		paymentID, card.BIN, card.Brand, card.Country, card.Fingerprint)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// chargebackHistory is what earlier payments sharing a payment's card,
+// customer and BIN say about it. The payment itself is never counted.
+type chargebackHistory struct {
+	TenantID         string
+	CardDisputes     int64
+	CustomerDisputes int64
+	BINPayments      int64
+	BINDisputes      int64
+}
+
+// ChargebackHistory counts the disputes opened since since against
+// payments with the same card fingerprint, the same customer of the same
+// tenant, and the same BIN, and the BIN's successful payments.
+func (s *Store) ChargebackHistory(ctx context.Context, paymentID string, since time.Time) (chargebackHistory, error) {
+	var h chargebackHistory
+	err := s.db.QueryRowContext(ctx, `
+		SELECT p.tenant_id,
+			(SELECT COUNT(*) FROM disputes d JOIN payments o ON o.id = d.payment_id
+				WHERE p.card_fingerprint <> '' AND o.card_fingerprint = p.card_fingerprint
+					AND o.id <> p.id AND d.created_at >= $2),
+			(SELECT COUNT(*) FROM disputes d JOIN payments o ON o.id = d.payment_id
+				WHERE p.customer_id <> '' AND o.tenant_id = p.tenant_id AND o.customer_id = p.customer_id
+					AND o.id <> p.id AND d.created_at >= $2),
+			(SELECT COUNT(*) FROM payments o
+				WHERE p.card_bin <> '' AND o.card_bin = p.card_bin AND o.status = 'succeeded'
+					AND o.id <> p.id AND o.created_at >= $2),
+			(SELECT COUNT(*) FROM disputes d JOIN payments o ON o.id = d.payment_id
+				WHERE p.card_bin <> '' AND o.card_bin = p.card_bin AND o.id <> p.id AND d.created_at >= $2)
+		FROM payments p WHERE p.id = $1`, paymentID, since).
+		Scan(&h.TenantID, &h.CardDisputes, &h.CustomerDisputes, &h.BINPayments, &h.BINDisputes)
+	return h, err
+}
+
+// scoreChargebackRisk weighs the history: a card disputed before counts
+// most, then a customer who disputed with another card, then a BIN
+// disputed more often than bin_dispute_rate.
+func scoreChargebackRisk(h chargebackHistory, cfg ChargebackRiskConfig) (int, []string) {
+	score := 0
+	var reasons []string
+	if h.CardDisputes > 0 {
+		score += 60
+		reasons = append(reasons, "card_disputed_before")
+	}
+	if h.CustomerDisputes > 0 {
+		score += 40
+		reasons = append(reasons, "customer_disputed_before")
+	}
+	if h.BINPayments >= cfg.binMinPayments() && float64(h.BINDisputes)/float64(h.BINPayments) >= cfg.binDisputeRate() {
+		score += 30
+		reasons = append(reasons, "high_dispute_bin")
+	}
+	if score > 100 {
+		score = 100
+	}
+	return score, reasons
+}
+
+// ChargebackRiskFlag is a payment flagged when it succeeded, and the
+// event emitted for it.
+type ChargebackRiskFlag struct {
+	Type      string    `json:"type"`
+	PaymentID string    `json:"payment_id"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	Score     int       `json:"score"`
+	Reasons   []string  `json:"reasons"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SaveChargebackRiskFlag records f, reporting false when the payment was
+// already flagged.
+func (s *Store) SaveChargebackRiskFlag(ctx context.Context, f ChargebackRiskFlag) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO chargeback_risk_flags (payment_id, tenant_id, score, reasons, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (payment_id) DO NOTHING`,
+		f.PaymentID, f.TenantID, f.Score, strings.Join(f.Reasons, ","), f.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ChargebackRiskFlags lists the flags raised between from and to, newest
+// first, optionally for one tenant.
+func (s *Store) ChargebackRiskFlags(ctx context.Context, from, to time.Time, tenantID string, limit int) ([]ChargebackRiskFlag, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT payment_id, tenant_id, score, reasons, created_at FROM chargeback_risk_flags
+		WHERE created_at >= $1 AND created_at < $2 AND ($3 = '' OR tenant_id = $3)
+		ORDER BY created_at DESC LIMIT $4`, from, to, tenantID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := []ChargebackRiskFlag{}
+	for rows.Next() {
+		f := ChargebackRiskFlag{Type: "payment.chargeback_risk_flagged"}
+		var reasons string
+		if err := rows.Scan(&f.PaymentID, &f.TenantID, &f.Score, &reasons, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		f.Reasons = strings.Split(reasons, ",")
+		flags = append(flags, f)
+	}
+	return flags, rows.Err()
+}
+
+// disputeRatio is a tenant's successful payments and disputes on one card
+// network in a month.
+type disputeRatio struct {
+	TenantID string
+	Network  string
+	Payments int64
+	Disputes int64
+}
+
+// DisputeRatios counts each tenant's successful payments and the
+// disputes opened against its payments since month began, by card brand,
+// the way the networks count them for their monthly programs.
+func (s *Store) DisputeRatios(ctx context.Context, month time.Time) ([]disputeRatio, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT tenant_id, card_brand, SUM(sale), SUM(dispute) FROM (
+			SELECT tenant_id, card_brand, 1 AS sale, 0 AS dispute FROM payments
+			WHERE status = 'succeeded' AND card_brand <> '' AND created_at >= $1
+			UNION ALL
+			SELECT p.tenant_id, p.card_brand, 0, 1 FROM disputes d JOIN payments p ON p.id = d.payment_id
+			WHERE p.card_brand <> '' AND d.created_at >= $1) t
+		GROUP BY tenant_id, card_brand`, month)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ratios []disputeRatio
+	for rows.Next() {
+		var r disputeRatio
+		if err := rows.Scan(&r.TenantID, &r.Network, &r.Payments, &r.Disputes); err != nil {
+			return nil, err
+		}
+		ratios = append(ratios, r)
+	}
+	return ratios, rows.Err()
+}
+
+// ChargebackRiskAlert is the event emitted when a tenant nears or passes
+// a card network's dispute threshold.
+type ChargebackRiskAlert struct {
+	Type           string  `json:"type"`
+	TenantID       string  `json:"tenant_id"`
+	Network        string  `json:"network"`
+	Month          string  `json:"month"`
+	Level          string  `json:"level"`
+	Payments       int64   `json:"payments"`
+	Disputes       int64   `json:"disputes"`
+	DisputeRate    float64 `json:"dispute_rate"`
+	ThresholdRatio float64 `json:"threshold_ratio"`
+	ThresholdCount int64   `json:"threshold_count"`
+}
+
+// ClaimChargebackRiskAlert records the alert and passes it to emit inside
+// one transaction, so it is emitted once per tenant, network, month and
+// level, and again on the next sweep when emit fails.
+func (s *Store) ClaimChargebackRiskAlert(ctx context.Context, month time.Time, a ChargebackRiskAlert, emit func(ChargebackRiskAlert) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO chargeback_risk_alerts (tenant_id, network, month, level, payments, disputes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT DO NOTHING`,
+		a.TenantID, a.Network, month, a.Level, a.Payments, a.Disputes)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	if err := emit(a); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Threshold alert levels.
+const (
+	chargebackWarning  = "warning"
+	chargebackExceeded = "exceeded"
+)
+
+// chargebackAlertLevel reports how close r is to t, or "" when it is
+// below warnAt of both.
+func chargebackAlertLevel(r disputeRatio, t DisputeThreshold, warnAt float64) string {
+	if r.Payments == 0 {
+		return ""
+	}
+	rate := float64(r.Disputes) / float64(r.Payments)
+	switch {
+	case rate >= t.Ratio && r.Disputes >= t.Count:
+		return chargebackExceeded
+	case rate >= t.Ratio*warnAt && float64(r.Disputes) >= math.Ceil(float64(t.Count)*warnAt):
+		return chargebackWarning
+	}
+	return ""
+}
+
+// ChargebackRisk tracks dispute rates per tenant, payment method and BIN.
+// When a card payment succeeds, its card is recorded on the local copy
+// and the payment is flagged if it shares a card, customer or risky BIN
+// with earlier disputes; a worker warns when a tenant's month-to-date
+// dispute rate on a card network nears that network's threshold. Flags
+// and alerts go to the broker, and flags to the event hub too.
+type ChargebackRisk struct {
+	store     *Store
+	settings  *RuntimeSettings
+	hub       *EventHub
+	publisher Publisher
+	topic     string
+	interval  time.Duration
+}
+
+func NewChargebackRisk(store *Store, settings *RuntimeSettings, hub *EventHub, publisher Publisher, topic string, interval time.Duration) *ChargebackRisk {
+	return &ChargebackRisk{
+		store:     store,
+		settings:  settings,
+		hub:       hub,
+		publisher: publisher,
+		topic:     topic,
+		interval:  interval,
+	}
+}
+
+// RegisterRoutes mounts the risk reports, which name flagged customers
+// and payments and so need a key with the fraud scope.
+func (cr *ChargebackRisk) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/reports/chargeback-risk", requireScope(cr.store, bootstrapToken, "fraud"))
+	g.GET("", cr.report)
+	g.GET("/flagged", cr.flagged)
+}
+
+// chargeSucceeded records the card of a successful charge and flags its
+// payment if it resembles earlier chargebacks.
+func (cr *ChargebackRisk) chargeSucceeded(ctx context.Context, ch *stripe.Charge) error {
+	if cr == nil || cr.store == nil || ch.PaymentIntent == nil {
+		return nil
+	}
+	card, ok := paymentCardOf(ch)
+	if !ok {
+		return nil
+	}
+	paymentID := ch.PaymentIntent.ID
+	saved, err := cr.store.SavePaymentCard(ctx, paymentID, card)
+	if err != nil {
+		return fmt.Errorf("saving card for %s: %w", paymentID, err)
+	}
+	if !saved {
+		return nil
+	}
+
+	cfg := cr.settings.Get().ChargebackRisk
+	h, err := cr.store.ChargebackHistory(ctx, paymentID, time.Now().Add(-cfg.lookback()))
+	if err != nil {
+		return fmt.Errorf("chargeback history for %s: %w", paymentID, err)
+	}
+	score, reasons := scoreChargebackRisk(h, cfg)
+	if score < cfg.flagScore() {
+		return nil
+	}
+	flag := ChargebackRiskFlag{
+		Type:      "payment.chargeback_risk_flagged",
+		PaymentID: paymentID,
+		TenantID:  h.TenantID,
+		Score:     score,
+		Reasons:   reasons,
+		CreatedAt: time.Now().UTC(),
+	}
+	created, err := cr.store.SaveChargebackRiskFlag(ctx, flag)
+	if err != nil || !created {
+		return err
+	}
+	chargebackRiskFlags.Inc()
+	payload, err := json.Marshal(flag)
+	if err != nil {
+		return err
+	}
+	// The flag is saved, so a broker failure is logged rather than
+	// redelivered into a second flag.
+	if err := cr.publisher.Publish(ctx, cr.topic, paymentID, payload); err != nil {
+		logf(ctx, "publishing chargeback risk flag for %s: %v", paymentID, err)
+	}
+	cr.hub.Publish(PaymentEvent{
+		PaymentID: paymentID,
+		TenantID:  flag.TenantID,
+		Type:      flag.Type,
+		Status:    string(stripe.PaymentIntentStatusSucceeded),
+		Amount:    ch.Amount,
+		Currency:  string(ch.Currency),
+		CreatedAt: flag.CreatedAt,
+	})
+	return nil
+}
+
+// Run checks tenants against the network thresholds every interval until
+// ctx is done.
+func (cr *ChargebackRisk) Run(ctx context.Context) {
+	if cr == nil || cr.store == nil {
+		return
+	}
+	ticker := time.NewTicker(cr.interval)
+	defer ticker.Stop()
+	for {
+		if err := cr.sweep(ctx); err != nil {
+			log.Printf("chargeback risk: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cr *ChargebackRisk) sweep(ctx context.Context) error {
+	cfg := cr.settings.Get().ChargebackRisk
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	ratios, err := cr.store.DisputeRatios(ctx, month)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	networks := cfg.networks()
+	for _, r := range ratios {
+		t, ok := networks[r.Network]
+		if !ok {
+			continue
+		}
+		level := chargebackAlertLevel(r, t, cfg.warnAt())
+		if level == "" {
+			continue
+		}
+		alert := ChargebackRiskAlert{
+			Type:           "chargeback_risk.threshold_" + level,
+			TenantID:       r.TenantID,
+			Network:        r.Network,
+			Month:          month.Format("2006-01"),
+			Level:          level,
+			Payments:       r.Payments,
+			Disputes:       r.Disputes,
+			DisputeRate:    float64(r.Disputes) / float64(r.Payments),
+			ThresholdRatio: t.Ratio,
+			ThresholdCount: t.Count,
+		}
+		err := cr.store.ClaimChargebackRiskAlert(ctx, month, alert, func(a ChargebackRiskAlert) error {
+			payload, err := json.Marshal(a)
+			if err != nil {
+				return err
+			}
+			if err := cr.publisher.Publish(ctx, cr.topic, a.TenantID, payload); err != nil {
+				return err
+			}
+			chargebackRiskAlerts.WithLabelValues(a.Network, a.Level).Inc()
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s alert for %q: %w", r.Network, level, r.TenantID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Chargeback risk reports count successful payments by when they were
+// made and disputes by when they were opened, each under the disputed
+// payment's tenant, method and card. Like every report they are split by
+// currency; compare network thresholds against the alerts, which count
+// across currencies.
+var chargebackRiskReport = reportSource{
+	from: `(SELECT p.tenant_id, p.currency, p.payment_method, p.card_bin, p.card_brand, p.card_country,
+			p.created_at AS at, 1 AS sale, 0 AS dispute, 0::BIGINT AS disputed,
+			CASE WHEN f.payment_id IS NULL THEN 0 ELSE 1 END AS flagged
+		FROM payments p LEFT JOIN chargeback_risk_flags f ON f.payment_id = p.id
+		WHERE p.status = 'succeeded'
+		UNION ALL
+		SELECT p.tenant_id, d.currency, p.payment_method, p.card_bin, p.card_brand, p.card_country,
+			d.created_at, 0, 1, d.amount, 0
+		FROM disputes d JOIN payments p ON p.id = d.payment_id) p`,
+	created: "p.at",
+	dimensions: map[string]string{
+		"day":            `to_char(date_trunc('day', p.at AT TIME ZONE 'UTC'), 'YYYY-MM-DD')`,
+		"week":           `to_char(date_trunc('week', p.at AT TIME ZONE 'UTC'), 'YYYY-MM-DD')`,
+		"month":          `to_char(date_trunc('month', p.at AT TIME ZONE 'UTC'), 'YYYY-MM')`,
+		"currency":       `p.currency`,
+		"tenant":         `p.tenant_id`,
+		"payment_method": `p.payment_method`,
+		"bin":            `p.card_bin`,
+		"brand":          `p.card_brand`,
+		"country":        `p.card_country`,
+	},
+	exprs: []string{"SUM(p.sale)", "SUM(p.dispute)", "SUM(p.disputed)", "SUM(p.flagged)"},
+	names: []string{"payments", "disputes", "disputed_amount", "flagged"},
+}
+
+// chargebackRiskRow is a report row with its dispute rate.
+type chargebackRiskRow struct {
+	ReportRow
+	DisputeRate float64 `json:"dispute_rate"`
+}
+
+func (cr *ChargebackRisk) report(c *gin.Context) {
+	if cr.store == nil {
+		c.JSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Reports require DATABASE_URL"))
+		return
+	}
+	q, err := parseReportQuery(c, chargebackRiskReport)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, err.Error()))
+		return
+	}
+	rows, err := cr.store.Report(c.Request.Context(), chargebackRiskReport, q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+
+	out := make([]chargebackRiskRow, len(rows))
+	for i, row := range rows {
+		out[i] = chargebackRiskRow{ReportRow: row}
+		if n := row.Totals["payments"]; n > 0 {
+			out[i].DisputeRate = float64(row.Totals["disputes"]) / float64(n)
+		}
+	}
+	respondList(c, http.StatusOK, out, gin.H{
+		"from":       q.From.Format(time.RFC3339),
+		"to":         q.To.Format(time.RFC3339),
+		"group_by":   q.GroupBy,
+		"thresholds": cr.settings.Get().ChargebackRisk.networks(),
+	})
+}
+
+// flagged lists flagged payments, newest first.
+func (cr *ChargebackRisk) flagged(c *gin.Context) {
+	if cr.store == nil {
+		c.JSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Reports require DATABASE_URL"))
+		return
+	}
+	q, err := parseReportQuery(c, chargebackRiskReport)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, err.Error()))
+		return
+	}
+	flags, err := cr.store.ChargebackRiskFlags(c.Request.Context(), q.From, q.To, q.TenantID, 500)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondList(c, http.StatusOK, flags, gin.H{
+		"from": q.From.Format(time.RFC3339),
+		"to":   q.To.Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+var checkoutTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_checkout_transitions_total",
+	Help: "Checkout session transitions, by the status entered.",
+}, []string{"status"})
+
+// Checkout session statuses, in funnel order. A session only moves
+// forward, except that any open session can be abandoned and any session,
+// abandoned ones included, can be paid: a payment that lands late still
+// counts.
+const (
+	checkoutCreated        = "created"
+	checkoutMethodSelected = "method_selected"
+	checkoutAuthenticated  = "authenticated"
+	checkoutPaid           = "paid"
+	checkoutAbandoned      = "abandoned"
+)
+
+var checkoutFunnel = []string{checkoutCreated, checkoutMethodSelected, checkoutAuthenticated, checkoutPaid}
+
+// checkoutMetadataID ties a PaymentIntent to its checkout session.
+const checkoutMetadataID = "checkout_session_id"
+
+// checkoutMaxTTL bounds expires_in_seconds.
+const checkoutMaxTTL = 7 * 24 * time.Hour
+
+var errCheckoutState = errors.New("checkout session is not in a state that allows this")
+
+// CheckoutSession is a customer's checkout from before its PaymentIntent
+// exists until it is paid or abandoned.
+type CheckoutSession struct {
+	ID                string `json:"id"`
+	Status            string `json:"status"`
+	Amount            int64  `json:"amount"`
+	Currency          string `json:"currency"`
+	TenantID          string `json:"tenant_id,omitempty"`
+	OrderID           string `json:"order_id,omitempty"`
+	CustomerID        string `json:"customer_id,omitempty"`
+	PaymentMethodType string `json:"payment_method_type,omitempty"`
+	PaymentID         string `json:"payment_id,omitempty"`
+	// PaymentAmount is what the PaymentIntent charges, after promotions.
+	PaymentAmount int64     `json:"payment_amount,omitempty"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	// ClientSecret is filled in for sessions that can still be paid, so
+	// the frontend can resume them.
+	ClientSecret string `json:"client_secret,omitempty"`
+
+	request PaymentRequest
+}
+
+func (cs *CheckoutSession) open() bool {
+	return cs.Status != checkoutPaid && cs.Status != checkoutAbandoned
+}
+
+// CheckoutEvent is one entry in a session's history. Events with equal
+// from and to statuses record something that happened without moving the
+// session, such as a decline.
+type CheckoutEvent struct {
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// checkoutPath is the statuses a session passes through going from one
+// status to another, in order, or nil when it can't.
+func checkoutPath(from, to string) []string {
+	if from == to || from == checkoutPaid {
+		return nil
+	}
+	if to == checkoutAbandoned {
+		if from == checkoutAbandoned {
+			return nil
+		}
+		return []string{checkoutAbandoned}
+	}
+	if from == checkoutAbandoned {
+		if to == checkoutPaid {
+			return []string{checkoutPaid}
+		}
+		return nil
+	}
+	var path []string
+	started := false
+	for _, s := range checkoutFunnel {
+		if started {
+			path = append(path, s)
+			if s == to {
+				return path
+			}
+		}
+		started = started || s == from
+	}
+	return nil
+}
+
+const checkoutSessionColumns = `id, status, amount, currency, tenant_id, request, payment_method_type,
+	COALESCE(payment_id, ''), payment_amount, expires_at, created_at, updated_at`
+
+func scanCheckoutSession(row interface{ Scan(...interface{}) error }) (*CheckoutSession, error) {
+	var cs CheckoutSession
+	var request []byte
+	if err := row.Scan(&cs.ID, &cs.Status, &cs.Amount, &cs.Currency, &cs.TenantID, &request, &cs.PaymentMethodType,
+		&cs.PaymentID, &cs.PaymentAmount, &cs.ExpiresAt, &cs.CreatedAt, &cs.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(request, &cs.request); err != nil {
+		return nil, fmt.Errorf("decoding checkout session %s: %w", cs.ID, err)
+	}
+	cs.OrderID = cs.request.OrderID
+	cs.CustomerID = cs.request.CustomerID
+	return &cs, nil
+}
+
+// CreateCheckoutSession records a session and its "created" event. A retry
+// with the same idempotency key gets the session the first attempt
+// recorded.
+func (s *Store) CreateCheckoutSession(ctx context.Context, cs *CheckoutSession, idempotencyKey string) (*CheckoutSession, error) {
+	request, err := json.Marshal(cs.request)
+	if err != nil {
+		return nil, err
+	}
+	key := sql.NullString{String: idempotencyKey, Valid: idempotencyKey != ""}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	created, err := scanCheckoutSession(tx.QueryRowContext(ctx, `
+		INSERT INTO checkout_sessions (id, status, amount, currency, tenant_id, request, expires_at, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (idempotency_key) DO NOTHING
+		RETURNING `+checkoutSessionColumns,
+		cs.ID, cs.Status, cs.Amount, cs.Currency, cs.TenantID, string(request), cs.ExpiresAt, key))
+	if errors.Is(err, sql.ErrNoRows) && key.Valid {
+		return scanCheckoutSession(s.db.QueryRowContext(ctx, `
+			SELECT `+checkoutSessionColumns+` FROM checkout_sessions WHERE idempotency_key = $1`, key))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO checkout_session_events (session_id, to_status) VALUES ($1, $2)`, created.ID, created.Status); err != nil {
+		return nil, err
+	}
+	return created, tx.Commit()
+}
+
+func (s *Store) CheckoutSession(ctx context.Context, id string) (*CheckoutSession, error) {
+	return scanCheckoutSession(s.db.QueryRowContext(ctx, `
+		SELECT `+checkoutSessionColumns+` FROM checkout_sessions WHERE id = $1`, id))
+}
+
+// CheckoutEvents lists a session's history, oldest first.
+func (s *Store) CheckoutEvents(ctx context.Context, id string) ([]CheckoutEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT from_status, to_status, detail, created_at FROM checkout_session_events
+		WHERE session_id = $1 ORDER BY created_at, id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []CheckoutEvent{}
+	for rows.Next() {
+		var e CheckoutEvent
+		if err := rows.Scan(&e.From, &e.To, &e.Detail, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// changeCheckoutSession applies fn to a session under its row lock and
+// saves the result. fn moves the session by setting its status; the
+// statuses it passes through on the way are recorded as events, and
+// returned. note, when fn sets it, is the detail of the last of them, or
+// an event of its own when the session doesn't move.
+// fn refuses a change by returning an error, in which case the session is
+// returned as it was.
+func (s *Store) changeCheckoutSession(ctx context.Context, id string, fn func(cs *CheckoutSession, note *string) error) (*CheckoutSession, []CheckoutEvent, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	cs, err := scanCheckoutSession(tx.QueryRowContext(ctx, `
+		SELECT `+checkoutSessionColumns+` FROM checkout_sessions WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		return nil, nil, err
+	}
+	before := *cs
+	var note string
+	if err := fn(cs, &note); err != nil {
+		return &before, nil, err
+	}
+
+	var events []CheckoutEvent
+	from := before.Status
+	for _, to := range checkoutPath(before.Status, cs.Status) {
+		events = append(events, CheckoutEvent{From: from, To: to})
+		from = to
+	}
+	if len(events) == 0 && cs.Status != before.Status {
+		return &before, nil, errCheckoutState
+	}
+	switch {
+	case note == "":
+	case len(events) > 0:
+		events[len(events)-1].Detail = note
+	default:
+		events = append(events, CheckoutEvent{From: from, To: from, Detail: note})
+	}
+	for i, e := range events {
+		if err := tx.QueryRowContext(ctx, `
+			INSERT INTO checkout_session_events (session_id, from_status, to_status, detail) VALUES ($1, $2, $3, $4)
+			RETURNING created_at`, id, e.From, e.To, e.Detail).Scan(&events[i].CreatedAt); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	paymentID := sql.NullString{String: cs.PaymentID, Valid: cs.PaymentID != ""}
+	cs, err = scanCheckoutSession(tx.QueryRowContext(ctx, `
+		UPDATE checkout_sessions SET
+			status = $2, payment_method_type = $3, payment_id = $4, payment_amount = $5, updated_at = now()
+		WHERE id = $1
+		RETURNING `+checkoutSessionColumns,
+		id, cs.Status, cs.PaymentMethodType, paymentID, cs.PaymentAmount))
+	if err != nil {
+		return nil, nil, err
+	}
+	return cs, events, tx.Commit()
+}
+
+// ExpiredCheckoutSessions lists up to 100 open sessions past their expiry.
+func (s *Store) ExpiredCheckoutSessions(ctx context.Context) ([]*CheckoutSession, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+checkoutSessionColumns+` FROM checkout_sessions
+		WHERE status IN ('created', 'method_selected', 'authenticated') AND expires_at <= now()
+		ORDER BY expires_at LIMIT 100`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*CheckoutSession
+	for rows.Next() {
+		cs, err := scanCheckoutSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, cs)
+	}
+	return sessions, rows.Err()
+}
+
+// Checkout runs checkout sessions: a session is created with the order's
+// amount before any PaymentIntent, which is only created once the
+// customer picks a payment method. Webhooks move it through
+// authentication to paid; a worker abandons sessions that expire and
+// cancels their intents. Every transition is recorded and emitted to
+// analytics as checkout.<status>, for funnel reporting. An open session
+// returns its client secret, so a customer who leaves can resume it.
+type Checkout struct {
+	store     *Store
+	payments  *PaymentService
+	analytics *AnalyticsEmitter
+	ttl       time.Duration
+	interval  time.Duration
+}
+
+func NewCheckout(store *Store, payments *PaymentService, analytics *AnalyticsEmitter, ttl, interval time.Duration) *Checkout {
+	return &Checkout{store: store, payments: payments, analytics: analytics, ttl: ttl, interval: interval}
+}
+
+func (co *Checkout) RegisterRoutes(r *gin.Engine) {
+	g := r.Group("/checkout/sessions", co.requireStore)
+	g.POST("", co.create)
+	g.GET("/:id", co.get)
+	g.GET("/:id/events", co.events)
+	g.POST("/:id/payment-method", co.selectMethod)
+	g.POST("/:id/cancel", co.cancel)
+}
+
+func (co *Checkout) requireStore(c *gin.Context) {
+	if co.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Checkout sessions require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// respondChange answers a failed session lookup or change, returning
+// false, or returns true when err is nil.
+func (co *Checkout) respondChange(c *gin.Context, cs *CheckoutSession, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Checkout session not found"))
+	case errors.Is(err, errCheckoutState):
+		c.JSON(http.StatusConflict, errorBodyWith(c, CodeCheckoutSessionState, "Checkout session is "+cs.Status,
+			gin.H{"status": cs.Status}))
+	default:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+	}
+	return false
+}
+
+// emit reports transitions to analytics once they are committed.
+func (co *Checkout) emit(ctx context.Context, cs *CheckoutSession, events []CheckoutEvent) {
+	for _, e := range events {
+		if e.From == e.To {
+			continue
+		}
+		checkoutTransitions.WithLabelValues(e.To).Inc()
+		co.analytics.Emit(AnalyticsEvent{
+			Name:              "checkout." + e.To,
+			OccurredAt:        e.CreatedAt,
+			PaymentID:         cs.PaymentID,
+			CheckoutSessionID: cs.ID,
+			TenantID:          cs.TenantID,
+			OrderID:           cs.OrderID,
+			CustomerHash:      co.analytics.hashCustomer(cs.CustomerID),
+			Amount:            cs.Amount,
+			Currency:          cs.Currency,
+			Status:            e.To,
+			PaymentMethod:     cs.PaymentMethodType,
+			RequestID:         requestIDFrom(ctx),
+		})
+	}
+}
+
+// create opens a session for a payment request. It is checked against
+// promotions and limits as a payment would be, but nothing is sent to
+// Stripe yet.
+func (co *Checkout) create(c *gin.Context) {
+	var req struct {
+		PaymentRequest
+		ExpiresInSeconds int64 `json:"expires_in_seconds"`
+	}
+	if !decodeJSON(c, &req) {
+		return
+	}
+	fields := req.PaymentRequest.validate()
+	if req.ExpiresInSeconds < 0 || time.Duration(req.ExpiresInSeconds)*time.Second > checkoutMaxTTL {
+		fields = append(fields, FieldError{Field: "expires_in_seconds", Code: "too_large",
+			Message: fmt.Sprintf("must be between 0 and %d", int64(checkoutMaxTTL/time.Second))})
+	}
+	if len(fields) > 0 {
+		validationFailed(c, fields)
+		return
+	}
+	ctx := c.Request.Context()
+	if _, refused := co.payments.Params(ctx, req.PaymentRequest); refused != nil {
+		c.JSON(refused.status, errorBodyWith(c, refused.code, refused.message, refused.ext))
+		return
+	}
+
+	ttl := co.ttl
+	if req.ExpiresInSeconds > 0 {
+		ttl = time.Duration(req.ExpiresInSeconds) * time.Second
+	}
+	want := &CheckoutSession{
+		ID:        "cs_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		Status:    checkoutCreated,
+		Amount:    req.Amount,
+		Currency:  strings.ToLower(req.Currency),
+		TenantID:  req.TenantID,
+		ExpiresAt: time.Now().Add(ttl).UTC(),
+		request:   req.PaymentRequest,
+	}
+	cs, err := co.store.CreateCheckoutSession(ctx, want, c.GetHeader("Idempotency-Key"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if cs.Amount != want.Amount || cs.Currency != want.Currency {
+		c.JSON(http.StatusConflict, errorBody(c, CodeIdempotencyConflict, "Idempotency-Key was already used for a different checkout"))
+		return
+	}
+	if cs.ID == want.ID {
+		co.emit(ctx, cs, []CheckoutEvent{{To: checkoutCreated, CreatedAt: cs.CreatedAt}})
+	}
+	respondData(c, http.StatusCreated, cs)
+}
+
+// get returns a session, with the client secret of its PaymentIntent
+// while it can still be paid.
+func (co *Checkout) get(c *gin.Context) {
+	ctx := c.Request.Context()
+	cs, err := co.store.CheckoutSession(ctx, c.Param("id"))
+	if !co.respondChange(c, cs, err) {
+		return
+	}
+	if cs.open() && cs.PaymentID != "" {
+		params := &stripe.PaymentIntentParams{}
+		params.Context = ctx
+		pi, err := paymentintent.Get(cs.PaymentID, params)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		cs.ClientSecret = pi.ClientSecret
+	}
+	respondData(c, http.StatusOK, cs)
+}
+
+func (co *Checkout) events(c *gin.Context) {
+	events, err := co.store.CheckoutEvents(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if len(events) == 0 {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Checkout session not found"))
+		return
+	}
+	respondData(c, http.StatusOK, events)
+}
+
+// selectMethod records the customer's payment method type and creates the
+// session's PaymentIntent for it, or switches the existing intent to the
+// new type. The intent's idempotency key is the session's, so a retried
+// request can't create a second one.
+func (co *Checkout) selectMethod(c *gin.Context) {
+	var req struct {
+		Type string `json:"type" binding:"required"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	ctx := c.Request.Context()
+	cs, err := co.store.CheckoutSession(ctx, c.Param("id"))
+	if !co.respondChange(c, cs, err) {
+		return
+	}
+	if !cs.open() || time.Now().After(cs.ExpiresAt) || cs.Status == checkoutAuthenticated {
+		co.respondChange(c, cs, errCheckoutState)
+		return
+	}
+
+	var pi *stripe.PaymentIntent
+	if cs.PaymentID == "" {
+		preq := cs.request
+		preq.Metadata = map[string]string{}
+		for k, v := range cs.request.Metadata {
+			preq.Metadata[k] = v
+		}
+		preq.Metadata[checkoutMetadataID] = cs.ID
+		params, refused := co.payments.Params(ctx, preq)
+		if refused != nil {
+			c.JSON(refused.status, errorBodyWith(c, refused.code, refused.message, refused.ext))
+			return
+		}
+		params.AutomaticPaymentMethods = nil
+		params.PaymentMethodTypes = stripe.StringSlice([]string{req.Type})
+		if pi, err = co.payments.Create(ctx, preq, params, "checkout-session-"+cs.ID); err != nil {
+			respondError(c, err)
+			return
+		}
+	} else {
+		params := &stripe.PaymentIntentParams{PaymentMethodTypes: stripe.StringSlice([]string{req.Type})}
+		params.Context = ctx
+		if pi, err = paymentintent.Update(cs.PaymentID, params); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+
+	cs, events, err := co.store.changeCheckoutSession(context.WithoutCancel(ctx), cs.ID, func(s *CheckoutSession, note *string) error {
+		if s.Status == checkoutCreated {
+			s.Status = checkoutMethodSelected
+		} else if s.PaymentMethodType != req.Type {
+			*note = "payment method changed to " + req.Type
+		}
+		s.PaymentMethodType = req.Type
+		s.PaymentID = pi.ID
+		s.PaymentAmount = pi.Amount
+		return nil
+	})
+	if !co.respondChange(c, cs, err) {
+		return
+	}
+	co.emit(ctx, cs, events)
+	cs.ClientSecret = pi.ClientSecret
+	respondData(c, http.StatusOK, cs)
+}
+
+// cancel abandons an open session at the customer's request and cancels
+// its intent.
+func (co *Checkout) cancel(c *gin.Context) {
+	ctx := c.Request.Context()
+	cs, err := co.store.CheckoutSession(ctx, c.Param("id"))
+	if !co.respondChange(c, cs, err) {
+		return
+	}
+	if !cs.open() {
+		co.respondChange(c, cs, errCheckoutState)
+		return
+	}
+	cs, err = co.abandon(ctx, cs, "canceled by customer")
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) {
+			respondError(c, err)
+			return
+		}
+	}
+	if !co.respondChange(c, cs, err) {
+		return
+	}
+	respondData(c, http.StatusOK, cs)
+}
+
+// abandon cancels a session's intent, if it has one that can still be
+// canceled, then marks the session abandoned.
+func (co *Checkout) abandon(ctx context.Context, cs *CheckoutSession, why string) (*CheckoutSession, error) {
+	if cs.PaymentID != "" {
+		params := &stripe.PaymentIntentCancelParams{
+			CancellationReason: stripe.String(string(stripe.PaymentIntentCancellationReasonAbandoned)),
+		}
+		params.Context = ctx
+		// An intent that is processing or already final can't be
+		// canceled. The session is abandoned all the same; should the
+		// payment succeed, its webhook moves the session to paid.
+		_, err := paymentintent.Cancel(cs.PaymentID, params)
+		var stripeErr *stripe.Error
+		if err != nil && !(errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodePaymentIntentUnexpectedState) {
+			return cs, err
+		}
+	}
+	ctx = context.WithoutCancel(ctx)
+	updated, events, err := co.store.changeCheckoutSession(ctx, cs.ID, func(s *CheckoutSession, note *string) error {
+		if !s.open() {
+			return nil
+		}
+		s.Status = checkoutAbandoned
+		*note = why
+		return nil
+	})
+	if err != nil {
+		return updated, err
+	}
+	co.emit(ctx, updated, events)
+	return updated, nil
+}
+
+// paymentIntentEvent moves the session of a checkout's intent: through
+// authenticated once the customer has confirmed and passed any challenge,
+// to paid when it succeeds, and to abandoned when it is canceled.
+// Declines and authentication challenges are recorded without moving it.
+func (co *Checkout) paymentIntentEvent(ctx context.Context, typ stripe.EventType, pi *stripe.PaymentIntent) error {
+	id := pi.Metadata[checkoutMetadataID]
+	if co == nil || co.store == nil || id == "" {
+		return nil
+	}
+	var fn func(s *CheckoutSession, note *string) error
+	switch typ {
+	case "payment_intent.requires_action":
+		fn = func(s *CheckoutSession, note *string) error {
+			*note = "authentication required"
+			return nil
+		}
+	case "payment_intent.processing", "payment_intent.amount_capturable_updated":
+		fn = func(s *CheckoutSession, note *string) error {
+			if s.Status == checkoutCreated || s.Status == checkoutMethodSelected {
+				s.Status = checkoutAuthenticated
+			}
+			return nil
+		}
+	case "payment_intent.succeeded":
+		fn = func(s *CheckoutSession, note *string) error {
+			s.Status = checkoutPaid
+			return nil
+		}
+	case "payment_intent.payment_failed":
+		fn = func(s *CheckoutSession, note *string) error {
+			*note = "payment failed"
+			if e := pi.LastPaymentError; e != nil {
+				*note += ": " + declineOf(e)
+			}
+			return nil
+		}
+	case "payment_intent.canceled":
+		fn = func(s *CheckoutSession, note *string) error {
+			if s.open() {
+				s.Status = checkoutAbandoned
+				*note = "payment canceled"
+			}
+			return nil
+		}
+	default:
+		return nil
+	}
+	cs, events, err := co.store.changeCheckoutSession(ctx, id, func(s *CheckoutSession, note *string) error {
+		if s.PaymentID == "" {
+			s.PaymentID, s.PaymentAmount = pi.ID, pi.Amount
+		}
+		return fn(s, note)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil && !errors.Is(err, errCheckoutState) {
+		return fmt.Errorf("updating checkout session %s for %s: %w", id, pi.ID, err)
+	}
+	co.emit(ctx, cs, events)
+	return nil
+}
+
+// Run abandons expired sessions every interval until ctx is done.
+func (co *Checkout) Run(ctx context.Context) {
+	if co == nil || co.store == nil {
+		return
+	}
+	ticker := time.NewTicker(co.interval)
+	defer ticker.Stop()
+	for {
+		if err := co.expire(ctx); err != nil {
+			log.Printf("checkout expiry: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expire abandons one batch of expired sessions. A session whose cancel
+// failed is tried again next time.
+func (co *Checkout) expire(ctx context.Context) error {
+	sessions, err := co.store.ExpiredCheckoutSessions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, cs := range sessions {
+		if _, err := co.abandon(ctx, cs, "expired"); err != nil {
+			log.Printf("expiring checkout session %s: %v", cs.ID, err)
+		}
+	}
+	return nil
+}
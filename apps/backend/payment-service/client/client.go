@@ -0,0 +1,288 @@
+// Package client is the Go SDK for the payment service. It owns the
+// resilience behaviour every caller needs: per-call timeouts, retries that
+// are safe because writes carry idempotency keys, and optional hedged reads.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Options configures a Client. Zero values pick the defaults noted.
+type Options struct {
+	// APIKey is sent as a bearer token when set.
+	APIKey string
+	// HTTPClient defaults to a client with no overall timeout; per-call
+	// timeouts come from Timeout.
+	HTTPClient *http.Client
+	// Timeout bounds each attempt. Default 10s.
+	Timeout time.Duration
+	// MaxRetries is how many times a failed attempt is retried. Default 2;
+	// negative disables retries.
+	MaxRetries int
+	// RetryBackoff is the base delay, doubled per attempt with jitter.
+	// Default 200ms.
+	RetryBackoff time.Duration
+	// HedgeAfter, when set, makes GetPayment send a second request if the
+	// first has not answered within this long, and use whichever wins.
+	HedgeAfter time.Duration
+	// UserAgent is appended to the SDK's own.
+	UserAgent string
+}
+
+// Client talks to one payment service deployment. It is safe for
+// concurrent use.
+type Client struct {
+	baseURL string
+	opts    Options
+	http    *http.Client
+}
+
+func New(baseURL string, opts Options) *Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 2
+	} else if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 200 * time.Millisecond
+	}
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	return &Client{baseURL: strings.TrimSuffix(baseURL, "/"), opts: opts, http: httpClient}
+}
+
+// CallOption adjusts a single call.
+type CallOption func(*callConfig)
+
+type callConfig struct {
+	timeout        time.Duration
+	maxRetries     int
+	idempotencyKey string
+	hedgeAfter     time.Duration
+}
+
+// WithTimeout overrides the per-attempt timeout for one call.
+func WithTimeout(d time.Duration) CallOption {
+	return func(c *callConfig) { c.timeout = d }
+}
+
+// WithMaxRetries overrides the retry count for one call; 0 disables retries.
+func WithMaxRetries(n int) CallOption {
+	return func(c *callConfig) { c.maxRetries = n }
+}
+
+// WithIdempotencyKey sets the key writes are sent with. Without it a fresh
+// key is generated per call and reused across that call's retries.
+func WithIdempotencyKey(key string) CallOption {
+	return func(c *callConfig) { c.idempotencyKey = key }
+}
+
+// WithHedgeAfter overrides Options.HedgeAfter for one read; 0 disables it.
+func WithHedgeAfter(d time.Duration) CallOption {
+	return func(c *callConfig) { c.hedgeAfter = d }
+}
+
+func (c *Client) config(opts []CallOption) callConfig {
+	cfg := callConfig{timeout: c.opts.Timeout, maxRetries: c.opts.MaxRetries, hedgeAfter: c.opts.HedgeAfter}
+	for _, o := range opts {
+		o(&cfg)
+	}
+	return cfg
+}
+
+// Error is a non-2xx reply from the service, decoded from its problem
+// document (or the legacy error shape).
+type Error struct {
+	StatusCode  int    `json:"status"`
+	Type        string `json:"type"`
+	Title       string `json:"title"`
+	Code        string `json:"code"`
+	Message     string `json:"detail"`
+	UserMessage string `json:"user_message"`
+	RequestID   string `json:"request_id"`
+
+	retryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("payment service: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("payment service: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// retryable is true for failures another attempt may fix.
+func (e *Error) retryable() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusConflict:
+		// A concurrent retry of ours still holds the idempotency key.
+		return e.Code == "idempotency_conflict"
+	}
+	return false
+}
+
+// do runs one logical call with retries and decodes the reply into out.
+// Only GETs and writes carrying an idempotency key are retried, so a
+// retry can never double-charge.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}, cfg callConfig) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	if method != http.MethodGet && cfg.idempotencyKey == "" {
+		cfg.idempotencyKey = uuid.NewString()
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, method, path, payload, out, cfg)
+		if err == nil || attempt >= cfg.maxRetries || ctx.Err() != nil {
+			return err
+		}
+
+		var apiErr *Error
+		wait := c.backoff(attempt)
+		if errors.As(err, &apiErr) {
+			if !apiErr.retryable() {
+				return err
+			}
+			if apiErr.retryAfter > 0 {
+				wait = apiErr.retryAfter
+			}
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.opts.RetryBackoff << attempt
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, payload []byte, out interface{}, cfg callConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+
+	var r io.Reader
+	if payload != nil {
+		r = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, r)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cfg.idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", cfg.idempotencyKey)
+	}
+	if c.opts.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.APIKey)
+	}
+	ua := "payment-service-go"
+	if c.opts.UserAgent != "" {
+		ua += " " + c.opts.UserAgent
+	}
+	req.Header.Set("User-Agent", ua)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		apiErr := &Error{}
+		var legacy struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(raw, apiErr) == nil && apiErr.Message == "" && json.Unmarshal(raw, &legacy) == nil {
+			apiErr.Message = legacy.Error
+		}
+		apiErr.StatusCode = resp.StatusCode
+		if apiErr.RequestID == "" {
+			apiErr.RequestID = resp.Header.Get("X-Request-ID")
+		}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			apiErr.retryAfter = time.Duration(secs) * time.Second
+		}
+		return apiErr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// hedged runs fn, and again if the first hasn't returned after delay,
+// returning the first success. Only for idempotent reads.
+func hedged[T any](ctx context.Context, delay time.Duration, fn func(context.Context) (T, error)) (T, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		v   T
+		err error
+	}
+	results := make(chan result, 2)
+	launch := func() {
+		v, err := fn(ctx)
+		results <- result{v, err}
+	}
+
+	go launch()
+	inflight := 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			go launch()
+			inflight++
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				return r.v, nil
+			}
+			// Wait for the hedge, if one is out; a failure before the hedge
+			// delay is returned as-is rather than hedged.
+			if inflight == 0 {
+				return r.v, r.err
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// PaymentRequest is the body of POST /payment/create.
+type PaymentRequest struct {
+	Amount       int64             `json:"amount"`
+	Currency     string            `json:"currency"`
+	Description  string            `json:"description,omitempty"`
+	OrderID      string            `json:"order_id,omitempty"`
+	CustomerID   string            `json:"customer_id,omitempty"`
+	TenantID     string            `json:"tenant_id,omitempty"`
+	ReceiptEmail string            `json:"receipt_email,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// CreatedPayment is what the frontend needs to confirm the payment.
+type CreatedPayment struct {
+	ID           string `json:"id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// Payment is the status view from GET /payment/:id.
+type Payment struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Amount int64  `json:"amount"`
+}
+
+// CreatePayment creates a PaymentIntent. Retries reuse one idempotency key,
+// so at most one intent is created per call; pass WithIdempotencyKey with
+// your own stable key (an order ID, say) to also dedupe across calls.
+func (c *Client) CreatePayment(ctx context.Context, req PaymentRequest, opts ...CallOption) (*CreatedPayment, error) {
+	var out CreatedPayment
+	if err := c.do(ctx, http.MethodPost, "/payment/create", req, &out, c.config(opts)); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetPayment fetches a payment's status, hedged when HedgeAfter is set.
+func (c *Client) GetPayment(ctx context.Context, id string, opts ...CallOption) (*Payment, error) {
+	cfg := c.config(opts)
+	get := func(ctx context.Context) (*Payment, error) {
+		var out Payment
+		if err := c.do(ctx, http.MethodGet, "/payment/"+url.PathEscape(id), nil, &out, cfg); err != nil {
+			return nil, err
+		}
+		return &out, nil
+	}
+	if cfg.hedgeAfter <= 0 {
+		return get(ctx)
+	}
+	return hedged(ctx, cfg.hedgeAfter, get)
+}
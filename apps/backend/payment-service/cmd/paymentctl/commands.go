@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func refundCmd() *cobra.Command {
+	var amount int64
+	var reason string
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:   "refund <payment_id>",
+		Short: "Refund a payment in full, or partially with --amount; large refunds wait for approval",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := "/admin/payments/" + url.PathEscape(args[0]) + "/refund"
+			if dryRun {
+				path += "?dry_run=true"
+			}
+			return call(http.MethodPost, path, map[string]interface{}{
+				"amount": amount,
+				"reason": reason,
+			})
+		},
+	}
+	cmd.Flags().Int64Var(&amount, "amount", 0, "amount in minor units (default: remaining balance)")
+	cmd.Flags().StringVar(&reason, "reason", "", "duplicate, fraudulent or requested_by_customer")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "validate the refund without issuing it")
+	return cmd
+}
+
+func refundRequestsCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "refund-requests", Short: "Review refunds held for approval"}
+
+	var status string
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List refund requests, newest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodGet, "/admin/refund-requests?status="+url.QueryEscape(status), nil)
+		},
+	}
+	list.Flags().StringVar(&status, "status", "pending", "pending, approved, refunded, rejected or failed; empty for all")
+	cmd.AddCommand(list)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "show <request_id>",
+		Short: "Show a refund request and its audit trail",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodGet, "/admin/refund-requests/"+url.PathEscape(args[0]), nil)
+		},
+	})
+
+	for _, action := range []struct{ name, short string }{
+		{"approve", "Approve a refund request and issue the refund"},
+		{"reject", "Reject a refund request"},
+	} {
+		action := action
+		var note string
+		c := &cobra.Command{
+			Use:   action.name + " <request_id>",
+			Short: action.short,
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return call(http.MethodPost, "/admin/refund-requests/"+url.PathEscape(args[0])+"/"+action.name,
+					map[string]interface{}{"note": note})
+			},
+		}
+		c.Flags().StringVar(&note, "note", "", "note kept with the decision")
+		cmd.AddCommand(c)
+	}
+	return cmd
+}
+
+func resyncCmd() *cobra.Command {
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:   "resync <payment_id>",
+		Short: "Refetch a payment from Stripe, replay missed transitions and report what changed",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := "/admin/payments/" + url.PathEscape(args[0]) + "/resync"
+			if dryRun {
+				path += "?dry_run=true"
+			}
+			return call(http.MethodPost, path, nil)
+		},
+	}
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "report what would change without replaying or saving")
+	return cmd
+}
+
+func webhooksCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "webhooks", Short: "Webhook operations"}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "replay <event_id>...",
+		Short: "Re-run Stripe events through the webhook pipeline",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodPost, "/admin/webhooks/replay", map[string]interface{}{"event_ids": args})
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "handlers",
+		Short: "List webhook handlers and their successes and failures in the last hour",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodGet, "/admin/webhooks/handlers", nil)
+		},
+	})
+	return cmd
+}
+
+func configCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "config", Short: "Inspect and reload runtime configuration"}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "show",
+		Short: "Print the runtime config in effect",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodGet, "/admin/config", nil)
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "reload",
+		Short: "Reread the runtime config and feature flag files",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodPost, "/admin/config/reload", nil)
+		},
+	})
+	return cmd
+}
+
+func keysCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "keys", Short: "Manage API keys"}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List API keys",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodGet, "/admin/api-keys", nil)
+		},
+	})
+
+	var scopes []string
+	create := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create an API key; the secret is printed once",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodPost, "/admin/api-keys", map[string]interface{}{"name": args[0], "scopes": scopes})
+		},
+	}
+	create.Flags().StringSliceVar(&scopes, "scope", []string{"admin"}, "scopes to grant (repeatable)")
+	cmd.AddCommand(create)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "rotate <key_id>",
+		Short: "Issue a replacement key; the old one keeps working for 24h",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodPost, "/admin/api-keys/"+url.PathEscape(args[0])+"/rotate", nil)
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "revoke <key_id>",
+		Short: "Revoke an API key immediately",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodDelete, "/admin/api-keys/"+url.PathEscape(args[0]), nil)
+		},
+	})
+
+	var perMinute, perDay int
+	quota := &cobra.Command{
+		Use:   "quota <key_id>",
+		Short: "Show a key's request quotas and usage, or set them with --per-minute and --per-day",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := "/admin/api-keys/" + url.PathEscape(args[0]) + "/quota"
+			if !cmd.Flags().Changed("per-minute") && !cmd.Flags().Changed("per-day") {
+				return call(http.MethodGet, path, nil)
+			}
+			body := map[string]interface{}{}
+			for name, n := range map[string]int{"per_minute": perMinute, "per_day": perDay} {
+				if n >= 0 {
+					body[name] = n
+				}
+			}
+			return call(http.MethodPut, path, body)
+		},
+	}
+	quota.Flags().IntVar(&perMinute, "per-minute", -1, "requests per minute, 0 for unlimited (default: the configured default)")
+	quota.Flags().IntVar(&perDay, "per-day", -1, "requests per day, 0 for unlimited (default: the configured default)")
+	cmd.AddCommand(quota)
+	return cmd
+}
+
+func importsCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "imports", Short: "Backfill payments, charges and refunds from Stripe"}
+
+	var from, to string
+	start := &cobra.Command{
+		Use:   "start",
+		Short: "Start an import, optionally of payments created in [--from, --to)",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodPost, "/admin/imports", map[string]interface{}{"from": from, "to": to})
+		},
+	}
+	start.Flags().StringVar(&from, "from", "", "earliest creation date (YYYY-MM-DD or RFC 3339)")
+	start.Flags().StringVar(&to, "to", "", "creation date to stop before (YYYY-MM-DD or RFC 3339)")
+	cmd.AddCommand(start)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List imports, newest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodGet, "/admin/imports?sort=-created_at", nil)
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "show <import_id>",
+		Short: "Show an import's progress",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodGet, "/admin/imports/"+url.PathEscape(args[0]), nil)
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "cancel <import_id>",
+		Short: "Stop an import after the page in flight",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodPost, "/admin/imports/"+url.PathEscape(args[0])+"/cancel", nil)
+		},
+	})
+	return cmd
+}
+
+func eventsCmd() *cobra.Command {
+	var paymentID string
+	cmd := &cobra.Command{Use: "events", Short: "Payment event operations"}
+	tail := &cobra.Command{
+		Use:   "tail",
+		Short: "Stream payment events as they arrive",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := "/admin/events"
+			if paymentID != "" {
+				path += "?payment_id=" + url.QueryEscape(paymentID)
+			}
+			req, err := newRequest(http.MethodGet, path, nil)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Accept", "text/event-stream")
+
+			// No client timeout: the stream stays open until interrupted.
+			resp, err := http.DefaultClient.Do(req.WithContext(cmd.Context()))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("%s", resp.Status)
+			}
+
+			scanner := bufio.NewScanner(resp.Body)
+			event := ""
+			for scanner.Scan() {
+				line := scanner.Text()
+				switch {
+				case strings.HasPrefix(line, "event:"):
+					event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+				case strings.HasPrefix(line, "data:") && event != "ping":
+					fmt.Println(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+				}
+			}
+			return scanner.Err()
+		},
+	}
+	tail.Flags().StringVar(&paymentID, "payment", "", "only show events for this payment")
+	cmd.AddCommand(tail)
+	return cmd
+}
+
+func sandboxCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "sandbox", Short: "Seed and reset QA fixtures (test keys or mock provider only)"}
+
+	var file string
+	seed := &cobra.Command{
+		Use:   "seed",
+		Short: "Create customers, saved cards and payments from a JSON spec",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var spec interface{}
+			if file != "" {
+				raw, err := os.ReadFile(file)
+				if err != nil {
+					return err
+				}
+				if err := json.Unmarshal(raw, &spec); err != nil {
+					return fmt.Errorf("parsing %s: %w", file, err)
+				}
+			}
+			return call(http.MethodPost, "/sandbox/seed", spec)
+		},
+	}
+	seed.Flags().StringVarP(&file, "file", "f", "", "seed spec (default: one customer with one card)")
+	cmd.AddCommand(seed)
+
+	var tenant string
+	reset := &cobra.Command{
+		Use:   "reset",
+		Short: "Remove seeded fixtures",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return call(http.MethodPost, "/sandbox/reset", map[string]interface{}{"tenant_id": tenant})
+		},
+	}
+	reset.Flags().StringVar(&tenant, "tenant", "", "only remove this tenant's fixtures")
+	cmd.AddCommand(reset)
+	return cmd
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/event"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+func devCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "dev", Short: "Local development helpers"}
+	cmd.AddCommand(listenCmd())
+	return cmd
+}
+
+// listenCmd polls the Stripe event list and forwards each new event to the
+// local webhook handler, signed with the local webhook secret, so the async
+// flow works without the Stripe CLI.
+func listenCmd() *cobra.Command {
+	var (
+		apiKey    string
+		secret    string
+		forwardTo string
+		interval  time.Duration
+		since     time.Duration
+		types     []string
+	)
+	cmd := &cobra.Command{
+		Use:   "listen",
+		Short: "Forward Stripe test-mode events to the local webhook endpoint",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Read here rather than as flag defaults so --help doesn't print secrets.
+			if apiKey == "" {
+				apiKey = os.Getenv("STRIPE_SECRET_KEY")
+			}
+			if secret == "" {
+				secret = os.Getenv("STRIPE_WEBHOOK_SECRET")
+			}
+			if apiKey == "" {
+				return fmt.Errorf("--api-key or STRIPE_SECRET_KEY is required")
+			}
+			if !strings.HasPrefix(apiKey, "sk_test_") && !strings.HasPrefix(apiKey, "rk_test_") {
+				return fmt.Errorf("dev listen only runs with test-mode keys")
+			}
+			if secret == "" {
+				return fmt.Errorf("--webhook-secret or STRIPE_WEBHOOK_SECRET is required; use the service's value")
+			}
+			if forwardTo == "" {
+				forwardTo = strings.TrimSuffix(serverURL, "/") + "/webhook"
+			}
+			stripe.Key = apiKey
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer stop()
+
+			l := &listener{secret: secret, forwardTo: forwardTo, types: map[string]bool{}}
+			for _, t := range types {
+				l.types[t] = true
+			}
+			return l.run(ctx, interval, since)
+		},
+	}
+	cmd.Flags().StringVar(&apiKey, "api-key", "", "Stripe test-mode secret key (default: $STRIPE_SECRET_KEY)")
+	cmd.Flags().StringVar(&secret, "webhook-secret", "", "secret the local service verifies signatures with (default: $STRIPE_WEBHOOK_SECRET)")
+	cmd.Flags().StringVar(&forwardTo, "forward-to", "", "webhook URL (default: <server>/webhook)")
+	cmd.Flags().DurationVar(&interval, "interval", 2*time.Second, "how often to poll for events")
+	cmd.Flags().DurationVar(&since, "since", 0, "also forward events from this far back")
+	cmd.Flags().StringSliceVar(&types, "events", nil, "only forward these event types (repeatable)")
+	return cmd
+}
+
+type listener struct {
+	secret    string
+	forwardTo string
+	types     map[string]bool
+	cursor    string
+}
+
+func (l *listener) run(ctx context.Context, interval, since time.Duration) error {
+	if err := l.start(ctx, since); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Forwarding events to %s (Ctrl-C to stop)\n", l.forwardTo)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		params := &stripe.EventListParams{}
+		params.Context = ctx
+		params.EndingBefore = stripe.String(l.cursor)
+		// With ending_before the iterator walks forward, oldest first.
+		it := event.List(params)
+		for it.Next() {
+			l.forward(ctx, it.Event())
+		}
+		if err := it.Err(); err != nil && ctx.Err() == nil {
+			fmt.Fprintln(os.Stderr, "Polling events:", err)
+		}
+	}
+}
+
+// start sets the cursor to the newest event, first forwarding anything
+// created within since, oldest first.
+func (l *listener) start(ctx context.Context, since time.Duration) error {
+	params := &stripe.EventListParams{}
+	params.Context = ctx
+	if since > 0 {
+		params.CreatedRange = &stripe.RangeQueryParams{GreaterThanOrEqual: time.Now().Add(-since).Unix()}
+	} else {
+		params.Limit = stripe.Int64(1)
+		params.Single = true
+	}
+
+	var backlog []*stripe.Event
+	it := event.List(params)
+	for it.Next() {
+		backlog = append(backlog, it.Event())
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("listing events: %w", err)
+	}
+	if len(backlog) == 0 {
+		return fmt.Errorf("no events yet in this account; create a test payment and retry")
+	}
+	l.cursor = backlog[0].ID
+
+	if since > 0 {
+		for i := len(backlog) - 1; i >= 0; i-- {
+			l.forward(ctx, backlog[i])
+		}
+	}
+	return nil
+}
+
+// forward posts one event the way Stripe would and prints the outcome.
+func (l *listener) forward(ctx context.Context, evt *stripe.Event) {
+	l.cursor = evt.ID
+	if len(l.types) > 0 && !l.types[string(evt.Type)] {
+		return
+	}
+
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: %v\n", evt.ID, evt.Type, err)
+		return
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: l.secret})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.forwardTo, bytes.NewReader(payload))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: %v\n", evt.ID, evt.Type, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", signed.Header)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		fmt.Printf("%s  %-40s  %s  error: %v\n", time.Unix(evt.Created, 0).Format(time.TimeOnly), evt.Type, evt.ID, err)
+		return
+	}
+	resp.Body.Close()
+	fmt.Printf("%s  %-40s  %s  [%d]\n", time.Unix(evt.Created, 0).Format(time.TimeOnly), evt.Type, evt.ID, resp.StatusCode)
+}
@@ -0,0 +1,108 @@
+// Command paymentctl is an operator CLI for the payment service admin API.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	serverURL string
+	token     string
+)
+
+func main() {
+	root := &cobra.Command{
+		Use:           "paymentctl",
+		Short:         "Operate the payment service",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	root.PersistentFlags().StringVar(&serverURL, "server", envOr("PAYMENTCTL_SERVER", "http://localhost:8080"), "payment service base URL")
+	root.PersistentFlags().StringVar(&token, "token", os.Getenv("PAYMENTCTL_TOKEN"), "admin API key")
+
+	root.AddCommand(refundCmd(), refundRequestsCmd(), resyncCmd(), webhooksCmd(), keysCmd(), importsCmd(), eventsCmd(), configCmd(), sandboxCmd(), devCmd())
+
+	if err := root.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+func newRequest(method, path string, body interface{}) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(serverURL, "/")+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// call sends a request to the admin API and pretty-prints the JSON reply.
+func call(method, path string, body interface{}) error {
+	req, err := newRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Detail string `json:"detail"`
+			Error  string `json:"error"`
+		}
+		if json.Unmarshal(out, &e) == nil && e.Detail+e.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, e.Detail+e.Error)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, out, "", "  "); err != nil {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	fmt.Println(pretty.String())
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+// compressor is what gzip, flate and brotli writers have in common.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// compressors pools writers per encoding; each one holds tens of
+// kilobytes of state that is wasteful to allocate per response.
+var compressors = map[string]*sync.Pool{
+	"br": {New: func() interface{} { return brotli.NewWriterLevel(nil, 5) }},
+	"gzip": {New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}},
+	"deflate": {New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}},
+}
+
+// compressibleTypes are media types worth compressing. Everything else,
+// such as XLSX (already a zip) or images, is sent as is, and so is
+// text/event-stream, whose events must reach the client as they happen.
+var compressibleTypes = map[string]bool{
+	"application/json":                  true,
+	"application/problem+json":          true,
+	"application/graphql-response+json": true,
+	ndjsonContentType:                   true,
+	"text/csv":                          true,
+	"text/plain":                        true,
+	"text/html":                         true,
+}
+
+// compressionEncodingsFromEnv reads COMPRESSION_ENCODINGS, the encodings
+// to offer in order of preference, or "none".
+func compressionEncodingsFromEnv() []string {
+	v := os.Getenv("COMPRESSION_ENCODINGS")
+	if v == "" {
+		return []string{"br", "gzip", "deflate"}
+	}
+	if v == "none" {
+		return nil
+	}
+	var out []string
+	for _, enc := range strings.Split(v, ",") {
+		enc = strings.TrimSpace(enc)
+		if _, ok := compressors[enc]; !ok {
+			log.Fatalf("Invalid COMPRESSION_ENCODINGS: unknown encoding %q", enc)
+		}
+		out = append(out, enc)
+	}
+	return out
+}
+
+// compression encodes responses of at least minSize bytes in the first of
+// encodings the client accepts. Smaller ones go out as they are: below a
+// kilobyte or so the headers cost more than compression saves.
+func compression(encodings []string, minSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(encodings) == 0 || c.Request.Method == http.MethodHead || c.GetHeader("Upgrade") != "" {
+			c.Next()
+			return
+		}
+		// Without an encoding in common the writer only adds Vary, so
+		// caches don't serve this identity response to gzip clients.
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"), encodings)
+		w := &compressWriter{ResponseWriter: c.Writer, encoding: encoding, minSize: minSize}
+		if encoding == "" {
+			w.minSize = 0
+		}
+		c.Writer = w
+		// On a panic the buffer is dropped, leaving recovery a clean
+		// response to write its 500 into.
+		defer func() { c.Writer = w.ResponseWriter }()
+		c.Next()
+		w.Close()
+	}
+}
+
+// negotiateEncoding picks the first of ours that Accept-Encoding allows.
+func negotiateEncoding(header string, ours []string) string {
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		accepted[strings.ToLower(name)] = q
+	}
+	for _, enc := range ours {
+		q, ok := accepted[enc]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > 0 {
+			return enc
+		}
+	}
+	return ""
+}
+
+// compressWriter holds the start of the body until it knows whether the
+// response is big enough to compress, then either compresses the rest or
+// passes it through untouched.
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	minSize  int
+
+	buf     []byte
+	decided bool
+	enc     compressor
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < w.minSize {
+			return len(p), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush commits a stream to compression however little it has written so
+// far, since streams are usually long.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(true)
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// decide settles the encoding and writes out what was buffered.
+func (w *compressWriter) decide(large bool) error {
+	w.decided = true
+	h := w.Header()
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if !compressibleTypes[mediaType] {
+		return w.writeBuffered()
+	}
+	h.Add("Vary", "Accept-Encoding")
+
+	status := w.Status()
+	if !large || w.encoding == "" || h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" ||
+		status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent {
+		return w.writeBuffered()
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", w.encoding)
+	// The encoded bytes differ from the identity ones, so a strong
+	// validator would be wrong for them.
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.enc = compressors[w.encoding].Get().(compressor)
+	w.enc.Reset(w.ResponseWriter)
+	return w.writeBuffered()
+}
+
+func (w *compressWriter) writeBuffered() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// Close sends whatever is still buffered and finishes the encoding.
+func (w *compressWriter) Close() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.enc != nil {
+		w.enc.Close()
+		compressors[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
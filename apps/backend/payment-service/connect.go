@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/account"
+	"github.com/stripe/stripe-go/v76/accountlink"
+	"github.com/stripe/stripe-go/v76/loginlink"
+)
+
+var connectOnboardingTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_connect_onboarding_transitions_total",
+	Help: "Connected accounts entering an onboarding status (pending, restricted, complete, rejected).",
+}, []string{"status"})
+
+// connectScope lets an API key onboard marketplace sellers.
+const connectScope = "connect"
+
+// Onboarding statuses, derived from the account. Pending accounts haven't
+// submitted their details; restricted ones have, but Stripe needs more
+// before charges or payouts are enabled; complete ones can do both.
+// Rejected accounts were refused by Stripe or the platform.
+const (
+	onboardingPending    = "pending"
+	onboardingRestricted = "restricted"
+	onboardingComplete   = "complete"
+	onboardingRejected   = "rejected"
+)
+
+// SellerRequirements is what Stripe still needs to verify a seller.
+// CurrentlyDue must be provided by CurrentDeadline, or charges or payouts
+// are disabled; PastDue, a subset of it, already has been. EventuallyDue
+// will be needed as volume grows, and PendingVerification was submitted
+// and is being checked. DisabledReason says why the account is restricted.
+type SellerRequirements struct {
+	CurrentlyDue        []string   `json:"currently_due"`
+	EventuallyDue       []string   `json:"eventually_due"`
+	PastDue             []string   `json:"past_due"`
+	PendingVerification []string   `json:"pending_verification"`
+	DisabledReason      string     `json:"disabled_reason,omitempty"`
+	CurrentDeadline     *time.Time `json:"current_deadline,omitempty"`
+}
+
+// ConnectedAccount is a seller's Stripe connected account as last
+// reported by Stripe. RestrictedAt is when it last became restricted or
+// rejected, and is cleared once it is complete again.
+type ConnectedAccount struct {
+	ID               string             `json:"id"`
+	TenantID         string             `json:"tenant_id,omitempty"`
+	SellerID         string             `json:"seller_id,omitempty"`
+	Type             string             `json:"type"`
+	Country          string             `json:"country"`
+	Email            string             `json:"email,omitempty"`
+	OnboardingStatus string             `json:"onboarding_status"`
+	ChargesEnabled   bool               `json:"charges_enabled"`
+	PayoutsEnabled   bool               `json:"payouts_enabled"`
+	DetailsSubmitted bool               `json:"details_submitted"`
+	Capabilities     map[string]string  `json:"capabilities"`
+	Requirements     SellerRequirements `json:"requirements"`
+	PayoutSchedule   *PayoutSchedule    `json:"payout_schedule,omitempty"`
+	OnboardedAt      *time.Time         `json:"onboarded_at,omitempty"`
+	RestrictedAt     *time.Time         `json:"restricted_at,omitempty"`
+	CreatedAt        time.Time          `json:"created_at"`
+	UpdatedAt        time.Time          `json:"updated_at"`
+}
+
+// restricted reports whether the seller can't take charges or receive
+// payouts until they act, or at all.
+func (a *ConnectedAccount) restricted() bool {
+	return a.OnboardingStatus == onboardingRestricted || a.OnboardingStatus == onboardingRejected
+}
+
+// onboardingStatus places acct in the onboarding funnel.
+func onboardingStatus(acct *stripe.Account) string {
+	var reason string
+	if acct.Requirements != nil {
+		reason = string(acct.Requirements.DisabledReason)
+	}
+	switch {
+	case strings.HasPrefix(reason, "rejected."):
+		return onboardingRejected
+	case acct.ChargesEnabled && acct.PayoutsEnabled && acct.DetailsSubmitted:
+		return onboardingComplete
+	case acct.DetailsSubmitted:
+		return onboardingRestricted
+	}
+	return onboardingPending
+}
+
+// connectedAccountData is what is kept of acct. The tenant and seller come
+// from the metadata set when it was created here.
+func connectedAccountData(acct *stripe.Account) *ConnectedAccount {
+	a := &ConnectedAccount{
+		ID:               acct.ID,
+		TenantID:         acct.Metadata["tenant_id"],
+		SellerID:         acct.Metadata["seller_id"],
+		Type:             string(acct.Type),
+		Country:          acct.Country,
+		Email:            acct.Email,
+		OnboardingStatus: onboardingStatus(acct),
+		ChargesEnabled:   acct.ChargesEnabled,
+		PayoutsEnabled:   acct.PayoutsEnabled,
+		DetailsSubmitted: acct.DetailsSubmitted,
+		Capabilities:     map[string]string{},
+		Requirements: SellerRequirements{
+			CurrentlyDue: []string{}, EventuallyDue: []string{}, PastDue: []string{}, PendingVerification: []string{},
+		},
+		CreatedAt: time.Unix(acct.Created, 0).UTC(),
+	}
+	if c := acct.Capabilities; c != nil {
+		if c.CardPayments != "" {
+			a.Capabilities["card_payments"] = string(c.CardPayments)
+		}
+		if c.Transfers != "" {
+			a.Capabilities["transfers"] = string(c.Transfers)
+		}
+	}
+	if acct.Settings != nil && acct.Settings.Payouts != nil && acct.Settings.Payouts.Schedule != nil {
+		s := acct.Settings.Payouts.Schedule
+		a.PayoutSchedule = &PayoutSchedule{Interval: string(s.Interval), WeeklyAnchor: s.WeeklyAnchor,
+			MonthlyAnchor: s.MonthlyAnchor, DelayDays: s.DelayDays}
+	}
+	if r := acct.Requirements; r != nil {
+		a.Requirements.CurrentlyDue = append(a.Requirements.CurrentlyDue, r.CurrentlyDue...)
+		a.Requirements.EventuallyDue = append(a.Requirements.EventuallyDue, r.EventuallyDue...)
+		a.Requirements.PastDue = append(a.Requirements.PastDue, r.PastDue...)
+		a.Requirements.PendingVerification = append(a.Requirements.PendingVerification, r.PendingVerification...)
+		a.Requirements.DisabledReason = string(r.DisabledReason)
+		if r.CurrentDeadline > 0 {
+			t := time.Unix(r.CurrentDeadline, 0).UTC()
+			a.Requirements.CurrentDeadline = &t
+		}
+	}
+	return a
+}
+
+const connectedAccountColumns = `id, tenant_id, seller_id, type, country, email, onboarding_status, charges_enabled,
+	payouts_enabled, details_submitted, capabilities, requirements_due, eventually_due, past_due,
+	pending_verification, disabled_reason, current_deadline, payout_schedule, onboarded_at, restricted_at,
+	created_at, updated_at`
+
+func scanConnectedAccount(row interface{ Scan(...interface{}) error }) (*ConnectedAccount, error) {
+	var a ConnectedAccount
+	var capabilities, schedule []byte
+	var currentlyDue, eventuallyDue, pastDue, pending string
+	var deadline, onboarded, restricted sql.NullTime
+	if err := row.Scan(&a.ID, &a.TenantID, &a.SellerID, &a.Type, &a.Country, &a.Email, &a.OnboardingStatus,
+		&a.ChargesEnabled, &a.PayoutsEnabled, &a.DetailsSubmitted, &capabilities, &currentlyDue, &eventuallyDue,
+		&pastDue, &pending, &a.Requirements.DisabledReason, &deadline, &schedule, &onboarded, &restricted,
+		&a.CreatedAt, &a.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(capabilities, &a.Capabilities); err != nil {
+		return nil, err
+	}
+	if schedule != nil {
+		if err := json.Unmarshal(schedule, &a.PayoutSchedule); err != nil {
+			return nil, err
+		}
+	}
+	a.Requirements.CurrentlyDue = splitScopes(currentlyDue)
+	a.Requirements.EventuallyDue = splitScopes(eventuallyDue)
+	a.Requirements.PastDue = splitScopes(pastDue)
+	a.Requirements.PendingVerification = splitScopes(pending)
+	a.Requirements.CurrentDeadline = timeOrNil(deadline)
+	a.OnboardedAt, a.RestrictedAt = timeOrNil(onboarded), timeOrNil(restricted)
+	return &a, nil
+}
+
+var connectedAccountList = listResource{
+	from: "connected_accounts a",
+	fields: []string{"id", "tenant_id", "seller_id", "type", "country", "email", "onboarding_status",
+		"disabled_reason", "current_deadline", "onboarded_at", "restricted_at", "created_at", "updated_at"},
+	columns: map[string]listField{
+		"id":                {"a.id", textField},
+		"tenant_id":         {"a.tenant_id", textField},
+		"seller_id":         {"a.seller_id", textField},
+		"type":              {"a.type", textField},
+		"country":           {"a.country", textField},
+		"email":             {"a.email", textField},
+		"onboarding_status": {"a.onboarding_status", textField},
+		"disabled_reason":   {"a.disabled_reason", textField},
+		"current_deadline":  {"a.current_deadline", timeField},
+		"onboarded_at":      {"a.onboarded_at", timeField},
+		"restricted_at":     {"a.restricted_at", timeField},
+		"created_at":        {"a.created_at", timeField},
+		"updated_at":        {"a.updated_at", timeField},
+	},
+}
+
+// SaveConnectedAccount upserts a, returning the stored row and the
+// onboarding status it had before ("" if it is new). onboarded_at is set
+// the first time it is complete; restricted_at whenever it becomes
+// restricted or rejected, and cleared when it is complete.
+func (s *Store) SaveConnectedAccount(ctx context.Context, a *ConnectedAccount) (*ConnectedAccount, string, error) {
+	capabilities, err := json.Marshal(a.Capabilities)
+	if err != nil {
+		return nil, "", err
+	}
+	var schedule []byte
+	if a.PayoutSchedule != nil {
+		if schedule, err = json.Marshal(a.PayoutSchedule); err != nil {
+			return nil, "", err
+		}
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+	var previous string
+	err = tx.QueryRowContext(ctx, `SELECT onboarding_status FROM connected_accounts WHERE id = $1 FOR UPDATE`, a.ID).Scan(&previous)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, "", err
+	}
+	saved, err := scanConnectedAccount(tx.QueryRowContext(ctx, `
+		INSERT INTO connected_accounts (id, tenant_id, seller_id, type, country, email, onboarding_status,
+			charges_enabled, payouts_enabled, details_submitted, capabilities, requirements_due, eventually_due,
+			past_due, pending_verification, disabled_reason, current_deadline, payout_schedule, onboarded_at,
+			restricted_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18,
+			CASE WHEN $7 = 'complete' THEN now() END,
+			CASE WHEN $7 IN ('restricted', 'rejected') THEN now() END, $19)
+		ON CONFLICT (id) DO UPDATE SET
+			email = EXCLUDED.email,
+			onboarding_status = EXCLUDED.onboarding_status,
+			charges_enabled = EXCLUDED.charges_enabled,
+			payouts_enabled = EXCLUDED.payouts_enabled,
+			details_submitted = EXCLUDED.details_submitted,
+			capabilities = EXCLUDED.capabilities,
+			requirements_due = EXCLUDED.requirements_due,
+			eventually_due = EXCLUDED.eventually_due,
+			past_due = EXCLUDED.past_due,
+			pending_verification = EXCLUDED.pending_verification,
+			disabled_reason = EXCLUDED.disabled_reason,
+			current_deadline = EXCLUDED.current_deadline,
+			payout_schedule = COALESCE(EXCLUDED.payout_schedule, connected_accounts.payout_schedule),
+			onboarded_at = COALESCE(connected_accounts.onboarded_at, EXCLUDED.onboarded_at),
+			restricted_at = CASE
+				WHEN EXCLUDED.onboarding_status IN ('restricted', 'rejected')
+					THEN COALESCE(connected_accounts.restricted_at, now())
+				WHEN EXCLUDED.onboarding_status = 'complete' THEN NULL
+				ELSE connected_accounts.restricted_at END,
+			updated_at = now()
+		RETURNING `+connectedAccountColumns,
+		a.ID, a.TenantID, a.SellerID, a.Type, a.Country, a.Email, a.OnboardingStatus, a.ChargesEnabled,
+		a.PayoutsEnabled, a.DetailsSubmitted, capabilities, strings.Join(a.Requirements.CurrentlyDue, ","),
+		strings.Join(a.Requirements.EventuallyDue, ","), strings.Join(a.Requirements.PastDue, ","),
+		strings.Join(a.Requirements.PendingVerification, ","), a.Requirements.DisabledReason,
+		a.Requirements.CurrentDeadline, schedule, a.CreatedAt))
+	if err != nil {
+		return nil, "", err
+	}
+	return saved, previous, tx.Commit()
+}
+
+func (s *Store) ConnectedAccount(ctx context.Context, id string) (*ConnectedAccount, error) {
+	return scanConnectedAccount(s.db.QueryRowContext(ctx, `
+		SELECT `+connectedAccountColumns+` FROM connected_accounts WHERE id = $1`, id))
+}
+
+// SellerConnectedAccount is the account created for a tenant's seller.
+func (s *Store) SellerConnectedAccount(ctx context.Context, tenantID, sellerID string) (*ConnectedAccount, error) {
+	return scanConnectedAccount(s.db.QueryRowContext(ctx, `
+		SELECT `+connectedAccountColumns+` FROM connected_accounts WHERE tenant_id = $1 AND seller_id = $2`,
+		tenantID, sellerID))
+}
+
+// SellerRestricted is published when a seller's account becomes restricted
+// or is rejected, so the seller can be told what Stripe needs from them.
+type SellerRestricted struct {
+	Type             string             `json:"type"`
+	AccountID        string             `json:"account_id"`
+	TenantID         string             `json:"tenant_id,omitempty"`
+	SellerID         string             `json:"seller_id,omitempty"`
+	OnboardingStatus string             `json:"onboarding_status"`
+	ChargesEnabled   bool               `json:"charges_enabled"`
+	PayoutsEnabled   bool               `json:"payouts_enabled"`
+	Requirements     SellerRequirements `json:"requirements"`
+	CreatedAt        time.Time          `json:"created_at"`
+}
+
+// Connect onboards marketplace sellers as Stripe connected accounts. An
+// account is created here, the seller completes Stripe's hosted
+// onboarding through an account link, and account.updated webhooks keep
+// its onboarding status, capabilities and verification requirements
+// current. Escrow releases and other transfers can go to an account once
+// transfers is active.
+type Connect struct {
+	store     *Store
+	publisher Publisher
+	topic     string
+}
+
+func NewConnect(store *Store, publisher Publisher, topic string) *Connect {
+	return &Connect{store: store, publisher: publisher, topic: topic}
+}
+
+// RegisterRoutes mounts seller onboarding under the connect scope, along
+// with the requirements the seller dashboard polls.
+func (cn *Connect) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/connect/accounts", requireScope(cn.store, bootstrapToken, connectScope), cn.requireStore)
+	g.POST("", cn.create)
+	g.GET("", listHandler(cn.store, connectedAccountList))
+	g.GET("/:id", cn.get)
+	g.POST("/:id/onboarding-link", cn.onboardingLink)
+	g.POST("/:id/login-link", cn.loginLink)
+
+	r.GET("/sellers/:id/requirements", requireScope(cn.store, bootstrapToken, connectScope), cn.requireStore, cn.requirements)
+}
+
+func (cn *Connect) requireStore(c *gin.Context) {
+	if cn.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Connected accounts require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// save stores acct, counting a change of onboarding status and
+// publishing seller.restricted when it has just become restricted.
+func (cn *Connect) save(ctx context.Context, acct *stripe.Account) (*ConnectedAccount, error) {
+	a, previous, err := cn.store.SaveConnectedAccount(ctx, connectedAccountData(acct))
+	if err != nil {
+		return nil, err
+	}
+	if a.OnboardingStatus == previous {
+		return a, nil
+	}
+	connectOnboardingTransitions.WithLabelValues(a.OnboardingStatus).Inc()
+	if previous != "" {
+		logf(ctx, "connect: account %s onboarding %s -> %s", a.ID, previous, a.OnboardingStatus)
+	}
+	wasRestricted := previous == onboardingRestricted || previous == onboardingRejected
+	if a.restricted() && !wasRestricted {
+		cn.publishRestricted(ctx, a)
+	}
+	return a, nil
+}
+
+// publishRestricted tells the broker a seller was restricted. The account
+// is saved, so a broker failure is logged rather than redelivered.
+func (cn *Connect) publishRestricted(ctx context.Context, a *ConnectedAccount) {
+	payload, err := json.Marshal(SellerRestricted{
+		Type:             "seller.restricted",
+		AccountID:        a.ID,
+		TenantID:         a.TenantID,
+		SellerID:         a.SellerID,
+		OnboardingStatus: a.OnboardingStatus,
+		ChargesEnabled:   a.ChargesEnabled,
+		PayoutsEnabled:   a.PayoutsEnabled,
+		Requirements:     a.Requirements,
+		CreatedAt:        time.Now().UTC(),
+	})
+	if err != nil {
+		logf(ctx, "encoding seller.restricted for %s: %v", a.ID, err)
+		return
+	}
+	if err := cn.publisher.Publish(ctx, cn.topic, a.ID, payload); err != nil {
+		logf(ctx, "publishing seller.restricted for %s: %v", a.ID, err)
+	}
+}
+
+// create opens an Express or Custom account requesting card payments and
+// transfers. With a seller_id it is idempotent: asking again for the same
+// tenant and seller answers with the account already made.
+func (cn *Connect) create(c *gin.Context) {
+	var req struct {
+		Type         string `json:"type" binding:"required,oneof=express custom"`
+		Country      string `json:"country" binding:"required,len=2"`
+		Email        string `json:"email" binding:"omitempty,email,max=320"`
+		BusinessType string `json:"business_type" binding:"omitempty,oneof=individual company non_profit government_entity"`
+		TenantID     string `json:"tenant_id" binding:"max=200"`
+		SellerID     string `json:"seller_id" binding:"max=200"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	ctx := c.Request.Context()
+	if req.SellerID != "" {
+		a, err := cn.store.SellerConnectedAccount(ctx, req.TenantID, req.SellerID)
+		if err == nil {
+			respondData(c, http.StatusOK, a)
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+	}
+
+	params := &stripe.AccountParams{
+		Type:    stripe.String(req.Type),
+		Country: stripe.String(strings.ToUpper(req.Country)),
+		Capabilities: &stripe.AccountCapabilitiesParams{
+			CardPayments: &stripe.AccountCapabilitiesCardPaymentsParams{Requested: stripe.Bool(true)},
+			Transfers:    &stripe.AccountCapabilitiesTransfersParams{Requested: stripe.Bool(true)},
+		},
+	}
+	params.Context = ctx
+	if req.Email != "" {
+		params.Email = stripe.String(req.Email)
+	}
+	if req.BusinessType != "" {
+		params.BusinessType = stripe.String(req.BusinessType)
+	}
+	if req.TenantID != "" {
+		params.AddMetadata("tenant_id", req.TenantID)
+	}
+	if req.SellerID != "" {
+		params.AddMetadata("seller_id", req.SellerID)
+		params.SetIdempotencyKey(fmt.Sprintf("connect-account-%s-%s", req.TenantID, req.SellerID))
+	}
+	acct, err := account.New(params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	a, err := cn.save(context.WithoutCancel(ctx), acct)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusCreated, a)
+}
+
+// get answers with the stored account, or with ?refresh=true with
+// Stripe's current view of it, saved first.
+func (cn *Connect) get(c *gin.Context) {
+	ctx := c.Request.Context()
+	if c.Query("refresh") == "true" {
+		params := &stripe.AccountParams{}
+		params.Context = ctx
+		acct, err := account.GetByID(c.Param("id"), params)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		a, err := cn.save(ctx, acct)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+		respondData(c, http.StatusOK, a)
+		return
+	}
+	a, err := cn.store.ConnectedAccount(ctx, c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Connected account not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, a)
+}
+
+// sellerAccount looks up the account of the seller named by the path's
+// :id and ?tenant_id, answering 404 when there is none.
+func sellerAccount(c *gin.Context, store *Store) (*ConnectedAccount, bool) {
+	a, err := store.SellerConnectedAccount(c.Request.Context(), c.Query("tenant_id"), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Seller has no connected account"))
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return nil, false
+	}
+	return a, true
+}
+
+// requirements answers with what Stripe needs from a tenant's seller, for
+// the seller dashboard. Sellers are identified by the seller_id given when
+// their account was created, within ?tenant_id.
+func (cn *Connect) requirements(c *gin.Context) {
+	a, ok := sellerAccount(c, cn.store)
+	if !ok {
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{
+		"seller_id":         a.SellerID,
+		"tenant_id":         a.TenantID,
+		"account_id":        a.ID,
+		"onboarding_status": a.OnboardingStatus,
+		"restricted":        a.restricted(),
+		"restricted_at":     a.RestrictedAt,
+		"charges_enabled":   a.ChargesEnabled,
+		"payouts_enabled":   a.PayoutsEnabled,
+		"capabilities":      a.Capabilities,
+		"requirements":      a.Requirements,
+		"updated_at":        a.UpdatedAt,
+	})
+}
+
+// onboardingLink creates a single-use link to Stripe's hosted onboarding.
+// Links expire within minutes, so they are made when the seller is about
+// to use them; refresh_url should make a new one. type account_update
+// lets an onboarded seller change their details.
+func (cn *Connect) onboardingLink(c *gin.Context) {
+	var req struct {
+		RefreshURL string `json:"refresh_url" binding:"required,url"`
+		ReturnURL  string `json:"return_url" binding:"required,url"`
+		Type       string `json:"type" binding:"omitempty,oneof=account_onboarding account_update"`
+		Collect    string `json:"collect" binding:"omitempty,oneof=currently_due eventually_due"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.Type == "" {
+		req.Type = string(stripe.AccountLinkTypeAccountOnboarding)
+	}
+	params := &stripe.AccountLinkParams{
+		Account:    stripe.String(c.Param("id")),
+		RefreshURL: stripe.String(req.RefreshURL),
+		ReturnURL:  stripe.String(req.ReturnURL),
+		Type:       stripe.String(req.Type),
+	}
+	params.Context = c.Request.Context()
+	if req.Collect != "" {
+		params.Collect = stripe.String(req.Collect)
+	}
+	link, err := accountlink.New(params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondData(c, http.StatusCreated, gin.H{"url": link.URL, "expires_at": time.Unix(link.ExpiresAt, 0).UTC()})
+}
+
+// loginLink creates a link into an Express account's dashboard, where the
+// seller follows their payouts.
+func (cn *Connect) loginLink(c *gin.Context) {
+	params := &stripe.LoginLinkParams{Account: stripe.String(c.Param("id"))}
+	params.Context = c.Request.Context()
+	link, err := loginlink.New(params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondData(c, http.StatusCreated, gin.H{"url": link.URL})
+}
+
+// accountUpdated keeps a connected account's onboarding status current.
+// Accounts created elsewhere, in the dashboard say, are tracked too, with
+// no tenant or seller.
+func (cn *Connect) accountUpdated(ctx context.Context, acct *stripe.Account) error {
+	if cn == nil || cn.store == nil {
+		return nil
+	}
+	_, err := cn.save(ctx, acct)
+	return err
+}
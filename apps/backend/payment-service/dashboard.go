@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DailyStats is a day's payments in one currency, by creation date in
+// UTC. SuccessRate is the share of payments that reached an outcome that
+// succeeded; canceled and unfinished ones don't count either way.
+// RefundRate is the share of the volume received that was refunded.
+type DailyStats struct {
+	Day         string  `json:"day"`
+	Currency    string  `json:"currency"`
+	Payments    int64   `json:"payments"`
+	Succeeded   int64   `json:"succeeded"`
+	Failed      int64   `json:"failed"`
+	Volume      int64   `json:"volume"`
+	Refunded    int64   `json:"refunded"`
+	SuccessRate float64 `json:"success_rate"`
+	RefundRate  float64 `json:"refund_rate"`
+}
+
+// DailyStats sums the payments created since since, of tenantID or of
+// all tenants when it is empty, per day and currency.
+func (s *Store) DailyStats(ctx context.Context, since time.Time, tenantID string) ([]DailyStats, error) {
+	rows, err := s.reader().QueryContext(ctx, `
+		SELECT to_char(date_trunc('day', created_at AT TIME ZONE 'UTC'), 'YYYY-MM-DD'), currency,
+			COUNT(*),
+			COUNT(*) FILTER (WHERE state IN ('succeeded', 'partially_refunded', 'refunded', 'disputed')),
+			COUNT(*) FILTER (WHERE state = 'failed'),
+			COALESCE(SUM(amount_received), 0), COALESCE(SUM(amount_refunded), 0)
+		FROM payments
+		WHERE created_at >= $1 AND ($2 = '' OR tenant_id = $2)
+		GROUP BY 1, 2 ORDER BY 1, 2`, since, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []DailyStats{}
+	for rows.Next() {
+		var d DailyStats
+		if err := rows.Scan(&d.Day, &d.Currency, &d.Payments, &d.Succeeded, &d.Failed, &d.Volume, &d.Refunded); err != nil {
+			return nil, err
+		}
+		if n := d.Succeeded + d.Failed; n > 0 {
+			d.SuccessRate = float64(d.Succeeded) / float64(n)
+		}
+		if d.Volume > 0 {
+			d.RefundRate = float64(d.Refunded) / float64(d.Volume)
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// FailedPayment is a payment whose last attempt failed, and why.
+type FailedPayment struct {
+	ID             string    `json:"id"`
+	TenantID       string    `json:"tenant_id,omitempty"`
+	Amount         int64     `json:"amount"`
+	Currency       string    `json:"currency"`
+	PaymentMethod  string    `json:"payment_method,omitempty"`
+	FailureCode    string    `json:"failure_code,omitempty"`
+	DeclineCode    string    `json:"decline_code,omitempty"`
+	FailureMessage string    `json:"failure_message,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// RecentFailedPayments returns the limit latest failed payments, of
+// tenantID or of all tenants when it is empty.
+func (s *Store) RecentFailedPayments(ctx context.Context, tenantID string, limit int) ([]FailedPayment, error) {
+	rows, err := s.reader().QueryContext(ctx, `
+		SELECT id, tenant_id, amount, currency, payment_method, failure_code, decline_code, failure_message,
+			created_at, updated_at
+		FROM payments
+		WHERE state = 'failed' AND ($1 = '' OR tenant_id = $1)
+		ORDER BY created_at DESC LIMIT $2`, tenantID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []FailedPayment{}
+	for rows.Next() {
+		var p FailedPayment
+		if err := rows.Scan(&p.ID, &p.TenantID, &p.Amount, &p.Currency, &p.PaymentMethod, &p.FailureCode,
+			&p.DeclineCode, &p.FailureMessage, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// OpenDispute is a dispute not yet won, lost or closed.
+type OpenDispute struct {
+	ID            string     `json:"id"`
+	PaymentID     string     `json:"payment_id,omitempty"`
+	TenantID      string     `json:"tenant_id,omitempty"`
+	Amount        int64      `json:"amount"`
+	Currency      string     `json:"currency"`
+	Status        string     `json:"status"`
+	Reason        string     `json:"reason,omitempty"`
+	EvidenceDueBy *time.Time `json:"evidence_due_by,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// OpenDisputes returns the open disputes, those whose evidence is due
+// soonest first, of tenantID or of all tenants when it is empty.
+func (s *Store) OpenDisputes(ctx context.Context, tenantID string) ([]OpenDispute, error) {
+	rows, err := s.reader().QueryContext(ctx, `
+		SELECT d.id, d.payment_id, COALESCE(p.tenant_id, ''), d.amount, d.currency, d.status, d.reason,
+			d.evidence_due_by, d.created_at
+		FROM disputes d LEFT JOIN payments p ON p.id = d.payment_id
+		WHERE d.status NOT IN ('won', 'lost', 'warning_closed') AND ($1 = '' OR p.tenant_id = $1)
+		ORDER BY d.evidence_due_by NULLS LAST, d.created_at`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []OpenDispute{}
+	for rows.Next() {
+		var d OpenDispute
+		var due sql.NullTime
+		if err := rows.Scan(&d.ID, &d.PaymentID, &d.TenantID, &d.Amount, &d.Currency, &d.Status, &d.Reason,
+			&due, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		d.EvidenceDueBy = timeOrNil(due)
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// DeadLetterDepth is how many entries of a kind wait in the dead-letter
+// queue, and since when.
+type DeadLetterDepth struct {
+	Kind    string    `json:"kind"`
+	Pending int64     `json:"pending"`
+	Oldest  time.Time `json:"oldest"`
+}
+
+// DeadLetterDepths counts the pending dead letters by kind.
+func (s *Store) DeadLetterDepths(ctx context.Context) ([]DeadLetterDepth, error) {
+	rows, err := s.reader().QueryContext(ctx, `
+		SELECT kind, COUNT(*), MIN(created_at) FROM dead_letters WHERE status = $1
+		GROUP BY kind ORDER BY kind`, deadLetterPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []DeadLetterDepth{}
+	for rows.Next() {
+		var d DeadLetterDepth
+		if err := rows.Scan(&d.Kind, &d.Pending, &d.Oldest); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// Dashboard backs the internal ops dashboard: daily volume and rates,
+// recent failures and their decline reasons, open disputes, and how the
+// dead-letter queue and provider accounts are doing. The lists take
+// ?tenant_id= to narrow them to one tenant.
+type Dashboard struct {
+	store  *Store
+	health *ProviderHealth
+}
+
+func NewDashboard(store *Store, health *ProviderHealth) *Dashboard {
+	return &Dashboard{store: store, health: health}
+}
+
+func (d *Dashboard) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/admin/dashboard", requireScope(d.store, bootstrapToken, "admin"))
+	g.GET("/health", d.healthSummary)
+
+	db := g.Group("", d.requireStore)
+	db.GET("/stats", d.stats)
+	db.GET("/failed-payments", d.failedPayments)
+	db.GET("/disputes", d.disputes)
+}
+
+func (d *Dashboard) requireStore(c *gin.Context) {
+	if d.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "The dashboard requires DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// stats answers the last ?days= days' stats, 30 by default and at most 90.
+func (d *Dashboard) stats(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days < 1 || days > 90 {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "days must be between 1 and 90"))
+		return
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, 1-days)
+	stats, err := d.store.DailyStats(c.Request.Context(), since, c.Query("tenant_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondList(c, http.StatusOK, stats, gin.H{"from": since.Format(time.RFC3339), "days": days})
+}
+
+// failedPayments answers the latest ?limit= failed payments, 50 by
+// default.
+func (d *Dashboard) failedPayments(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "limit must be between 1 and 500"))
+		return
+	}
+	payments, err := d.store.RecentFailedPayments(c.Request.Context(), c.Query("tenant_id"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondList(c, http.StatusOK, payments, nil)
+}
+
+func (d *Dashboard) disputes(c *gin.Context) {
+	disputes, err := d.store.OpenDisputes(c.Request.Context(), c.Query("tenant_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondList(c, http.StatusOK, disputes, nil)
+}
+
+// healthSummary answers the provider accounts' health and, with a store,
+// the dead-letter queue's depth.
+func (d *Dashboard) healthSummary(c *gin.Context) {
+	accounts, healthy := d.health.Status()
+	body := gin.H{"providers": gin.H{"healthy": healthy, "accounts": accounts}}
+	if d.store != nil {
+		depths, err := d.store.DeadLetterDepths(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+		var pending int64
+		for _, dl := range depths {
+			pending += dl.Pending
+		}
+		body["dead_letters"] = gin.H{"pending": pending, "by_kind": depths}
+	}
+	respondData(c, http.StatusOK, body)
+}
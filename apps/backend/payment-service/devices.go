@@ -0,0 +1,93 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// Metadata carrying a payment's device signals, which Stripe Radar rules
+// can also test, as ::device_id:: and the like.
+const (
+	metadataClientIP  = "client_ip"
+	metadataUserAgent = "user_agent"
+	metadataDeviceID  = "device_id"
+)
+
+// maxUserAgent is the longest user agent kept, the most a Stripe metadata
+// value holds; longer ones are cut rather than refused.
+const maxUserAgent = 500
+
+// deviceIDPattern is the shape of the IDs our frontend SDK gives devices.
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,128}$`)
+
+// paymentDevice is what a payment's client said about where it was made.
+type paymentDevice struct {
+	ClientIP  string
+	UserAgent string
+	DeviceID  string
+}
+
+// validateDevice checks the device signals of r, in field order.
+func (r *PaymentRequest) validateDevice() []FieldError {
+	var fields []FieldError
+	if r.DeviceID != "" && !deviceIDPattern.MatchString(r.DeviceID) {
+		fields = append(fields, FieldError{Field: "device_id", Code: "invalid", Message: "must be 8 to 128 letters, digits, - or _"})
+	}
+	if r.RadarSession != "" && !strings.HasPrefix(r.RadarSession, "rs_") {
+		fields = append(fields, FieldError{Field: "radar_session", Code: "invalid", Message: "must be an rs_ Radar session"})
+	}
+	return fields
+}
+
+// fillDevice falls back to what the caller's own request says for the
+// signals the body left out.
+func (r *PaymentRequest) fillDevice(c *gin.Context) {
+	if r.ClientIP == "" {
+		r.ClientIP = c.ClientIP()
+	}
+	if r.UserAgent == "" {
+		r.UserAgent = c.Request.UserAgent()
+	}
+}
+
+// addDeviceMetadata records req's device signals on the intent and hands
+// its Radar session to Stripe, so Radar scores the payment with the
+// browser details Stripe.js collected.
+func (r *PaymentRequest) addDeviceMetadata(params *stripe.PaymentIntentParams) {
+	if r.ClientIP != "" {
+		params.AddMetadata(metadataClientIP, r.ClientIP)
+	}
+	if r.UserAgent != "" {
+		params.AddMetadata(metadataUserAgent, truncateUTF8(r.UserAgent, maxUserAgent))
+	}
+	if r.DeviceID != "" {
+		params.AddMetadata(metadataDeviceID, r.DeviceID)
+	}
+	if r.RadarSession != "" {
+		params.RadarOptions = &stripe.PaymentIntentRadarOptionsParams{Session: stripe.String(r.RadarSession)}
+	}
+}
+
+// deviceOf is the device signals recorded on pi.
+func deviceOf(pi *stripe.PaymentIntent) paymentDevice {
+	return paymentDevice{
+		ClientIP:  pi.Metadata[metadataClientIP],
+		UserAgent: pi.Metadata[metadataUserAgent],
+		DeviceID:  pi.Metadata[metadataDeviceID],
+	}
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
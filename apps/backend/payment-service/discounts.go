@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// Promotions are the discounts applied when a payment is created: the
+// request's amount is the subtotal, and what is charged is worked out here
+// rather than taken from the client.
+//
+//	"promotions": [
+//	  {"id": "welcome", "first_purchase": true, "percent_off": 10, "max_discount": {"usd": 2000}},
+//	  {"id": "spring", "code": "SPRING5", "amount_off": {"usd": 500}, "min_amount": {"usd": 2500},
+//	   "stackable": true, "max_redemptions": 1000, "max_per_customer": 1,
+//	   "ends_at": "2026-06-01T00:00:00Z"}
+//	]
+type Promotion struct {
+	ID string `json:"id"`
+	// Code is what a customer enters at checkout. Promotions without one
+	// apply to every payment they match.
+	Code string `json:"code"`
+	// PercentOff or AmountOff, one of the two. AmountOff is in minor units
+	// per currency, and the promotion applies only in those currencies.
+	PercentOff float64          `json:"percent_off"`
+	AmountOff  map[string]int64 `json:"amount_off"`
+	// MaxDiscount caps a percentage discount, per currency.
+	MaxDiscount map[string]int64 `json:"max_discount"`
+	// MinAmount is the smallest subtotal it applies to, per currency.
+	MinAmount map[string]int64 `json:"min_amount"`
+	// Tenants limits it to some tenants; empty means all.
+	Tenants []string `json:"tenants"`
+	// FirstPurchase limits it to customers without a succeeded payment to
+	// the tenant.
+	FirstPurchase bool `json:"first_purchase"`
+	// Stackable promotions combine with each other. One that isn't applies
+	// on its own, and only when it beats the stackable ones together.
+	Stackable bool `json:"stackable"`
+	// MaxRedemptions and MaxPerCustomer cap its uses overall and per
+	// customer; zero is unlimited. Canceled payments give their use back.
+	MaxRedemptions int64      `json:"max_redemptions"`
+	MaxPerCustomer int64      `json:"max_per_customer"`
+	StartsAt       *time.Time `json:"starts_at"`
+	EndsAt         *time.Time `json:"ends_at"`
+}
+
+// needsStore reports whether checking the promotion reads payment history.
+func (p Promotion) needsStore() bool {
+	return p.FirstPurchase || p.MaxRedemptions > 0 || p.MaxPerCustomer > 0
+}
+
+// promotionIDPattern keeps IDs safe to list in PaymentIntent metadata.
+var promotionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func validatePromotions(promos []Promotion) error {
+	ids := map[string]bool{}
+	codes := map[string]bool{}
+	for _, p := range promos {
+		if !promotionIDPattern.MatchString(p.ID) {
+			return fmt.Errorf("promotions: invalid id %q", p.ID)
+		}
+		if ids[p.ID] {
+			return fmt.Errorf("promotions: duplicate id %q", p.ID)
+		}
+		ids[p.ID] = true
+		if code := strings.ToUpper(p.Code); code != "" {
+			if codes[code] {
+				return fmt.Errorf("promotions %s: duplicate code %q", p.ID, p.Code)
+			}
+			codes[code] = true
+		}
+		if (p.PercentOff > 0) == (len(p.AmountOff) > 0) {
+			return fmt.Errorf("promotions %s: set one of percent_off and amount_off", p.ID)
+		}
+		if p.PercentOff < 0 || p.PercentOff > 100 {
+			return fmt.Errorf("promotions %s: percent_off must be between 0 and 100", p.ID)
+		}
+		for _, m := range []map[string]int64{p.AmountOff, p.MaxDiscount, p.MinAmount} {
+			for cur, v := range m {
+				if len(cur) != 3 || v < 0 {
+					return fmt.Errorf("promotions %s: invalid amount %s=%d", p.ID, cur, v)
+				}
+			}
+		}
+		if p.MaxRedemptions < 0 || p.MaxPerCustomer < 0 {
+			return fmt.Errorf("promotions %s: usage limits must not be negative", p.ID)
+		}
+		if p.StartsAt != nil && p.EndsAt != nil && !p.EndsAt.After(*p.StartsAt) {
+			return fmt.Errorf("promotions %s: ends_at must be after starts_at", p.ID)
+		}
+	}
+	return nil
+}
+
+// AppliedDiscount is one promotion's share of a payment's discount.
+type AppliedDiscount struct {
+	PromotionID string `json:"promotion_id"`
+	Code        string `json:"code,omitempty"`
+	Amount      int64  `json:"amount"`
+}
+
+// DiscountQuote is what a payment is charged once promotions apply.
+type DiscountQuote struct {
+	Subtotal  int64             `json:"subtotal"`
+	Discount  int64             `json:"discount"`
+	Amount    int64             `json:"amount"`
+	Discounts []AppliedDiscount `json:"discounts"`
+}
+
+// Metadata recording the discount on the PaymentIntent.
+const (
+	metadataSubtotal  = "subtotal"
+	metadataDiscount  = "discount_amount"
+	metadataDiscounts = "discounts"
+)
+
+// addMetadata records q on params as subtotal, discount_amount and
+// discounts ("<promotion id>:<amount>,...").
+func (q *DiscountQuote) addMetadata(params *stripe.PaymentIntentParams) {
+	parts := make([]string, len(q.Discounts))
+	for i, d := range q.Discounts {
+		parts[i] = d.PromotionID + ":" + strconv.FormatInt(d.Amount, 10)
+	}
+	params.AddMetadata(metadataSubtotal, strconv.FormatInt(q.Subtotal, 10))
+	params.AddMetadata(metadataDiscount, strconv.FormatInt(q.Discount, 10))
+	params.AddMetadata(metadataDiscounts, strings.Join(parts, ","))
+}
+
+func parseDiscountsMetadata(v string) []AppliedDiscount {
+	var out []AppliedDiscount
+	for _, part := range strings.Split(v, ",") {
+		id, amount, ok := strings.Cut(part, ":")
+		n, err := strconv.ParseInt(amount, 10, 64)
+		if !ok || err != nil {
+			continue
+		}
+		out = append(out, AppliedDiscount{PromotionID: id, Amount: n})
+	}
+	return out
+}
+
+// Reasons a requested promotion code is refused.
+const (
+	promoUnknown       = "unknown"
+	promoExpired       = "expired"
+	promoNotApplicable = "not_applicable"
+	promoNotEligible   = "not_eligible"
+	promoExhausted     = "exhausted"
+	promoNotCombinable = "not_combinable"
+)
+
+func promotionRefused(code, reason string) *PolicyViolation {
+	return &PolicyViolation{
+		Code:    CodePromotionInvalid,
+		Message: fmt.Sprintf("Promotion code %s can't be applied: %s", code, strings.ReplaceAll(reason, "_", " ")),
+		Ext:     gin.H{"promo_code": code, "reason": reason},
+	}
+}
+
+// promotionError is a promotion that ran out between the quote and the
+// payment being created.
+type promotionError struct{ id string }
+
+func (e *promotionError) Error() string {
+	return fmt.Sprintf("Promotion %s has no uses left", e.id)
+}
+
+// DiscountEngine applies the live promotions to payments.
+type DiscountEngine struct {
+	settings *RuntimeSettings
+	store    *Store
+}
+
+func NewDiscountEngine(settings *RuntimeSettings, store *Store) *DiscountEngine {
+	if store == nil {
+		for _, p := range settings.Get().Promotions {
+			if p.needsStore() {
+				log.Println("promotions use first_purchase or usage limits but DATABASE_URL is not set; those promotions are not applied")
+				break
+			}
+		}
+	}
+	return &DiscountEngine{settings: settings, store: store}
+}
+
+// Quote applies the codes the customer entered and any automatic
+// promotions the payment matches. It returns nil when nothing applies, and
+// a violation when a requested code can't be used: silently charging full
+// price for a code the customer typed would be worse than saying no.
+func (e *DiscountEngine) Quote(ctx context.Context, req PaymentRequest) (*DiscountQuote, *PolicyViolation, error) {
+	if e == nil {
+		return nil, nil, nil
+	}
+	promos := e.settings.Get().Promotions
+	if len(promos) == 0 && len(req.PromoCodes) == 0 {
+		return nil, nil, nil
+	}
+	currency := strings.ToLower(req.Currency)
+	check := &promotionCheck{engine: e, req: req, currency: currency, now: time.Now()}
+
+	requested := map[string]Promotion{}
+	var candidates []Promotion
+	for _, code := range req.PromoCodes {
+		p, ok := promotionByCode(promos, code)
+		if !ok {
+			return nil, promotionRefused(code, promoUnknown), nil
+		}
+		if _, dup := requested[p.ID]; dup {
+			continue
+		}
+		reason, err := check.eligible(ctx, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if reason != "" {
+			return nil, promotionRefused(code, reason), nil
+		}
+		requested[p.ID] = p
+		candidates = append(candidates, p)
+	}
+	for _, p := range promos {
+		if p.Code != "" {
+			continue
+		}
+		reason, err := check.eligible(ctx, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if reason == "" {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, nil
+	}
+
+	// The options are every stackable promotion together, or one that
+	// doesn't stack on its own. Only options that honour every code the
+	// customer entered count.
+	var stack []Promotion
+	var options [][]Promotion
+	for _, p := range candidates {
+		if p.Stackable {
+			stack = append(stack, p)
+		} else {
+			options = append(options, []Promotion{p})
+		}
+	}
+	if len(stack) > 0 {
+		options = append(options, stack)
+	}
+	var best *DiscountQuote
+	for _, opt := range options {
+		if !includesAll(opt, requested) {
+			continue
+		}
+		if q := applyPromotions(opt, req.Amount, currency); best == nil || q.Discount > best.Discount {
+			best = q
+		}
+	}
+	if best == nil {
+		for _, p := range requested {
+			if !p.Stackable {
+				return nil, promotionRefused(p.Code, promoNotCombinable), nil
+			}
+		}
+	}
+	if best == nil || best.Discount == 0 {
+		return nil, nil, nil
+	}
+	return best, nil, nil
+}
+
+func promotionByCode(promos []Promotion, code string) (Promotion, bool) {
+	for _, p := range promos {
+		if p.Code != "" && strings.EqualFold(p.Code, strings.TrimSpace(code)) {
+			return p, true
+		}
+	}
+	return Promotion{}, false
+}
+
+func includesAll(opt []Promotion, required map[string]Promotion) bool {
+	n := 0
+	for _, p := range opt {
+		if _, ok := required[p.ID]; ok {
+			n++
+		}
+	}
+	return n == len(required)
+}
+
+// applyPromotions takes percentages off first, then fixed amounts, so a
+// fixed discount is never multiplied down. A charge never drops below the
+// currency's Stripe minimum, or one minor unit.
+func applyPromotions(promos []Promotion, subtotal int64, currency string) *DiscountQuote {
+	ordered := append([]Promotion(nil), promos...)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].PercentOff > 0 && ordered[j].PercentOff == 0 })
+
+	floor := minimumChargeAmounts[currency]
+	if floor == 0 {
+		floor = 1
+	}
+	q := &DiscountQuote{Subtotal: subtotal, Discounts: []AppliedDiscount{}}
+	running := subtotal
+	for _, p := range ordered {
+		off := p.AmountOff[currency]
+		if p.PercentOff > 0 {
+			off = percentOf(running, p.PercentOff, roundDown)
+			if max, ok := p.MaxDiscount[currency]; ok && off > max {
+				off = max
+			}
+		}
+		if running-off < floor {
+			off = running - floor
+		}
+		if off <= 0 {
+			continue
+		}
+		running -= off
+		q.Discounts = append(q.Discounts, AppliedDiscount{PromotionID: p.ID, Code: p.Code, Amount: off})
+	}
+	q.Amount = running
+	q.Discount = subtotal - running
+	return q
+}
+
+// promotionCheck evaluates promotions for one payment, reading the
+// customer's history at most once.
+type promotionCheck struct {
+	engine   *DiscountEngine
+	req      PaymentRequest
+	currency string
+	now      time.Time
+
+	paid *bool
+}
+
+// eligible returns why p doesn't apply, or "".
+func (pc *promotionCheck) eligible(ctx context.Context, p Promotion) (string, error) {
+	if (p.StartsAt != nil && pc.now.Before(*p.StartsAt)) || (p.EndsAt != nil && !pc.now.Before(*p.EndsAt)) {
+		return promoExpired, nil
+	}
+	if len(p.Tenants) > 0 && !containsString(p.Tenants, pc.req.TenantID) {
+		return promoNotApplicable, nil
+	}
+	if _, ok := p.AmountOff[pc.currency]; p.PercentOff == 0 && !ok {
+		return promoNotApplicable, nil
+	}
+	if pc.req.Amount < p.MinAmount[pc.currency] {
+		return promoNotApplicable, nil
+	}
+	if !p.needsStore() {
+		return "", nil
+	}
+
+	store := pc.engine.store
+	if store == nil {
+		return promoNotApplicable, nil
+	}
+	if (p.FirstPurchase || p.MaxPerCustomer > 0) && pc.req.CustomerID == "" {
+		return promoNotEligible, nil
+	}
+	if p.FirstPurchase {
+		if pc.paid == nil {
+			paid, err := store.CustomerHasPaid(ctx, pc.req.TenantID, pc.req.CustomerID)
+			if err != nil {
+				return "", fmt.Errorf("reading purchase history: %w", err)
+			}
+			pc.paid = &paid
+		}
+		if *pc.paid {
+			return promoNotEligible, nil
+		}
+	}
+	if p.MaxRedemptions > 0 || p.MaxPerCustomer > 0 {
+		total, mine, err := promotionUsage(ctx, store.db, p.ID, pc.req.CustomerID)
+		if err != nil {
+			return "", fmt.Errorf("reading promotion usage: %w", err)
+		}
+		if (p.MaxRedemptions > 0 && total >= p.MaxRedemptions) || (p.MaxPerCustomer > 0 && mine >= p.MaxPerCustomer) {
+			return promoExhausted, nil
+		}
+	}
+	return "", nil
+}
+
+// reserve takes a use of each promotion the payment was quoted with,
+// failing with a promotionError if one ran out since. It returns the
+// reservations for attach or release.
+func (e *DiscountEngine) reserve(ctx context.Context, req PaymentRequest, discounts []AppliedDiscount) ([]string, error) {
+	if e == nil || e.store == nil || len(discounts) == 0 {
+		return nil, nil
+	}
+	byID := map[string]Promotion{}
+	for _, p := range e.settings.Get().Promotions {
+		byID[p.ID] = p
+	}
+	var rs []promotionReservation
+	for _, d := range discounts {
+		p := byID[d.PromotionID]
+		rs = append(rs, promotionReservation{promotionID: d.PromotionID, amount: d.Amount,
+			maxRedemptions: p.MaxRedemptions, maxPerCustomer: p.MaxPerCustomer})
+	}
+	return e.store.ReservePromotions(ctx, req.TenantID, req.CustomerID, strings.ToLower(req.Currency), rs)
+}
+
+func (e *DiscountEngine) attach(ctx context.Context, reserved []string, paymentID string) {
+	if len(reserved) == 0 {
+		return
+	}
+	if err := e.store.AttachPromotionRedemptions(ctx, reserved, paymentID); err != nil {
+		logf(ctx, "recording promotions on %s: %v", paymentID, err)
+	}
+}
+
+func (e *DiscountEngine) release(ctx context.Context, reserved []string) {
+	if len(reserved) == 0 {
+		return
+	}
+	if err := e.store.ReleasePromotionRedemptions(ctx, reserved); err != nil {
+		logf(ctx, "releasing promotion reservations: %v", err)
+	}
+}
+
+// CustomerHasPaid reports whether the customer has a succeeded payment to
+// the tenant.
+func (s *Store) CustomerHasPaid(ctx context.Context, tenantID, customerID string) (bool, error) {
+	var paid bool
+	err := s.db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM payments WHERE tenant_id = $1 AND customer_id = $2 AND status = 'succeeded')`,
+		tenantID, customerID).Scan(&paid)
+	return paid, err
+}
+
+// promotionUsage counts a promotion's uses, in total and by customerID.
+// Uses on canceled payments don't count; reservations only count while
+// fresh, so a crash between reserving and creating the intent doesn't
+// keep a use forever.
+func promotionUsage(ctx context.Context, q interface {
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}, promotionID, customerID string) (total, customer int64, err error) {
+	err = q.QueryRowContext(ctx, `
+		SELECT count(*), count(*) FILTER (WHERE $2 <> '' AND r.customer_id = $2)
+		FROM promotion_redemptions r LEFT JOIN payments p ON p.id = r.payment_id
+		WHERE r.promotion_id = $1
+			AND (r.payment_id IS NOT NULL OR r.created_at > now() - interval '5 minutes')
+			AND COALESCE(p.status, '') <> 'canceled'`,
+		promotionID, customerID).Scan(&total, &customer)
+	return total, customer, err
+}
+
+type promotionReservation struct {
+	promotionID    string
+	amount         int64
+	maxRedemptions int64
+	maxPerCustomer int64
+}
+
+// ReservePromotions records a use of each promotion, not yet tied to a
+// payment. Limited promotions are locked while they are counted, so two
+// payments can't both take the last use.
+func (s *Store) ReservePromotions(ctx context.Context, tenantID, customerID, currency string, rs []promotionReservation) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// A fixed lock order keeps two payments from deadlocking on the same
+	// pair of promotions.
+	sort.Slice(rs, func(i, j int) bool { return rs[i].promotionID < rs[j].promotionID })
+	ids := make([]string, 0, len(rs))
+	for _, r := range rs {
+		if r.maxRedemptions > 0 || r.maxPerCustomer > 0 {
+			if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('promotion:' || $1))`, r.promotionID); err != nil {
+				return nil, err
+			}
+			total, mine, err := promotionUsage(ctx, tx, r.promotionID, customerID)
+			if err != nil {
+				return nil, err
+			}
+			if (r.maxRedemptions > 0 && total >= r.maxRedemptions) || (r.maxPerCustomer > 0 && mine >= r.maxPerCustomer) {
+				return nil, &promotionError{id: r.promotionID}
+			}
+		}
+		id := uuid.NewString()
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO promotion_redemptions (id, promotion_id, tenant_id, customer_id, currency, amount)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			id, r.promotionID, tenantID, customerID, currency, r.amount); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, tx.Commit()
+}
+
+// AttachPromotionRedemptions ties reservations to the payment they were
+// for. A retry that got an existing intent back already has its uses
+// recorded, so its duplicate reservations are dropped.
+func (s *Store) AttachPromotionRedemptions(ctx context.Context, ids []string, paymentID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE promotion_redemptions r SET payment_id = $2
+		WHERE r.id = ANY($1) AND NOT EXISTS (
+			SELECT 1 FROM promotion_redemptions o WHERE o.payment_id = $2 AND o.promotion_id = r.promotion_id)`,
+		ids, paymentID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM promotion_redemptions WHERE id = ANY($1) AND payment_id IS NULL`, ids); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReleasePromotionRedemptions gives back uses reserved for a payment that
+// wasn't created.
+func (s *Store) ReleasePromotionRedemptions(ctx context.Context, ids []string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM promotion_redemptions WHERE id = ANY($1) AND payment_id IS NULL`, ids)
+	return err
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// discoveryScheme marks sibling-service URLs that are resolved through
+// service discovery, e.g. discovery://mailer-service. Requests are rewritten
+// to plain http against one of the healthy instances.
+const discoveryScheme = "discovery"
+
+// Registration describes this instance to the discovery backend.
+type Registration struct {
+	Name    string
+	ID      string
+	Address string
+	Port    int
+	Tags    []string
+}
+
+// Discovery registers this service and resolves sibling services to
+// host:port addresses.
+type Discovery interface {
+	Register(ctx context.Context, reg Registration) error
+	Deregister(ctx context.Context) error
+	Resolve(ctx context.Context, service string) ([]string, error)
+}
+
+// NewDiscovery returns the backend named by kind, or nil when discovery is
+// disabled and sibling URLs come straight from config.
+func NewDiscovery(kind string) (Discovery, error) {
+	switch kind {
+	case "", "none":
+		return nil, nil
+	case "static":
+		return newStaticDiscovery(os.Getenv("DISCOVERY_STATIC"))
+	case "consul":
+		addr := os.Getenv("CONSUL_HTTP_ADDR")
+		if addr == "" {
+			addr = "http://127.0.0.1:8500"
+		}
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		return &consulDiscovery{
+			addr:  strings.TrimRight(addr, "/"),
+			token: os.Getenv("CONSUL_HTTP_TOKEN"),
+			http:  &http.Client{Timeout: 5 * time.Second},
+		}, nil
+	case "kubernetes":
+		ns := os.Getenv("KUBERNETES_NAMESPACE")
+		if ns == "" {
+			ns = "default"
+		}
+		portName := os.Getenv("DISCOVERY_PORT_NAME")
+		if portName == "" {
+			portName = "http"
+		}
+		return &kubernetesDiscovery{namespace: ns, portName: portName}, nil
+	default:
+		return nil, fmt.Errorf("unknown discovery backend %q", kind)
+	}
+}
+
+// serviceURL returns the configured URL for a sibling service, falling back
+// to a discovery URL for service when discovery is enabled.
+func serviceURL(env, service string, d Discovery) string {
+	if u := os.Getenv(env); u != "" {
+		return u
+	}
+	if d != nil {
+		return discoveryScheme + "://" + service
+	}
+	return ""
+}
+
+// staticDiscovery serves a fixed list of instances, for local development.
+// The spec is "svc=host:port,host:port;other=host:port".
+type staticDiscovery struct {
+	services map[string][]string
+}
+
+func newStaticDiscovery(spec string) (*staticDiscovery, error) {
+	d := &staticDiscovery{services: map[string][]string{}}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, addrs, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid DISCOVERY_STATIC entry %q", entry)
+		}
+		for _, addr := range strings.Split(addrs, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				d.services[strings.TrimSpace(name)] = append(d.services[strings.TrimSpace(name)], addr)
+			}
+		}
+	}
+	return d, nil
+}
+
+func (d *staticDiscovery) Register(context.Context, Registration) error { return nil }
+
+func (d *staticDiscovery) Deregister(context.Context) error { return nil }
+
+func (d *staticDiscovery) Resolve(_ context.Context, service string) ([]string, error) {
+	addrs := d.services[service]
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no static instances for %s", service)
+	}
+	return addrs, nil
+}
+
+// consulDiscovery talks to the local Consul agent's HTTP API.
+type consulDiscovery struct {
+	addr  string
+	token string
+	http  *http.Client
+
+	mu sync.Mutex
+	id string
+}
+
+func (d *consulDiscovery) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var raw []byte
+	if body != nil {
+		var err error
+		if raw, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, d.addr+path, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.token != "" {
+		req.Header.Set("X-Consul-Token", d.token)
+	}
+
+	resp, err := d.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("consul request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("consul returned %s for %s", resp.Status, path)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// Register adds the instance with an HTTP check against /health, so Consul
+// only hands it out while healthy and reaps it if the process dies.
+func (d *consulDiscovery) Register(ctx context.Context, reg Registration) error {
+	check := map[string]interface{}{
+		"HTTP":                           fmt.Sprintf("http://%s/health", net.JoinHostPort(reg.Address, strconv.Itoa(reg.Port))),
+		"Interval":                       "10s",
+		"Timeout":                        "2s",
+		"DeregisterCriticalServiceAfter": "1m",
+	}
+	body := map[string]interface{}{
+		"ID":      reg.ID,
+		"Name":    reg.Name,
+		"Address": reg.Address,
+		"Port":    reg.Port,
+		"Tags":    reg.Tags,
+		"Check":   check,
+	}
+	if err := d.do(ctx, http.MethodPut, "/v1/agent/service/register", body, nil); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.id = reg.ID
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *consulDiscovery) Deregister(ctx context.Context) error {
+	d.mu.Lock()
+	id := d.id
+	d.mu.Unlock()
+	if id == "" {
+		return nil
+	}
+	return d.do(ctx, http.MethodPut, "/v1/agent/service/deregister/"+url.PathEscape(id), nil, nil)
+}
+
+func (d *consulDiscovery) Resolve(ctx context.Context, service string) ([]string, error) {
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	if err := d.do(ctx, http.MethodGet, "/v1/health/service/"+url.PathEscape(service)+"?passing=true", nil, &entries); err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no healthy instances of %s in consul", service)
+	}
+	return addrs, nil
+}
+
+// kubernetesDiscovery resolves headless services through cluster DNS. The
+// pod's readiness probe takes care of health, so registration is a no-op.
+type kubernetesDiscovery struct {
+	namespace string
+	portName  string
+}
+
+func (d *kubernetesDiscovery) Register(context.Context, Registration) error { return nil }
+
+func (d *kubernetesDiscovery) Deregister(context.Context) error { return nil }
+
+func (d *kubernetesDiscovery) Resolve(ctx context.Context, service string) ([]string, error) {
+	host := fmt.Sprintf("%s.%s.svc.cluster.local", service, d.namespace)
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, d.portName, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %w", host, err)
+	}
+
+	addrs := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+	return addrs, nil
+}
+
+// discoveryTransport load-balances discovery:// requests round-robin over
+// the resolved instances. Resolutions are cached briefly and dropped when a
+// request to an instance fails, so the next call picks up fresh addresses.
+type discoveryTransport struct {
+	discovery Discovery
+	base      http.RoundTripper
+	ttl       time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*resolvedService
+}
+
+type resolvedService struct {
+	addrs   []string
+	expires time.Time
+	next    uint64
+}
+
+func newDiscoveryTransport(d Discovery) http.RoundTripper {
+	if d == nil {
+		return http.DefaultTransport
+	}
+	return &discoveryTransport{
+		discovery: d,
+		base:      http.DefaultTransport,
+		ttl:       15 * time.Second,
+		cache:     map[string]*resolvedService{},
+	}
+}
+
+func (t *discoveryTransport) pick(ctx context.Context, service string) (string, error) {
+	t.mu.Lock()
+	entry, ok := t.cache[service]
+	t.mu.Unlock()
+
+	if !ok || time.Now().After(entry.expires) {
+		addrs, err := t.discovery.Resolve(ctx, service)
+		if err != nil {
+			return "", err
+		}
+		if len(addrs) == 0 {
+			return "", fmt.Errorf("no instances of %s", service)
+		}
+		entry = &resolvedService{addrs: addrs, expires: time.Now().Add(t.ttl)}
+		t.mu.Lock()
+		t.cache[service] = entry
+		t.mu.Unlock()
+	}
+
+	n := atomic.AddUint64(&entry.next, 1)
+	return entry.addrs[(n-1)%uint64(len(entry.addrs))], nil
+}
+
+func (t *discoveryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != discoveryScheme {
+		return t.base.RoundTrip(req)
+	}
+
+	service := req.URL.Host
+	addr, err := t.pick(req.Context(), service)
+	if err != nil {
+		return nil, err
+	}
+
+	out := req.Clone(req.Context())
+	out.URL.Scheme = "http"
+	out.URL.Host = addr
+	out.Host = service
+
+	resp, err := t.base.RoundTrip(out)
+	if err != nil {
+		t.mu.Lock()
+		delete(t.cache, service)
+		t.mu.Unlock()
+	}
+	return resp, err
+}
+
+// registerSelf registers this instance and returns a function that removes
+// it again on shutdown.
+func registerSelf(d Discovery, port string) (func(), error) {
+	if d == nil {
+		return func() {}, nil
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PORT %q", port)
+	}
+	address := os.Getenv("SERVICE_ADDRESS")
+	if address == "" {
+		if address, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	name := os.Getenv("SERVICE_NAME")
+	if name == "" {
+		name = "payment-service"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	reg := Registration{
+		Name:    name,
+		ID:      fmt.Sprintf("%s-%s-%d", name, address, p),
+		Address: address,
+		Port:    p,
+		Tags:    []string{"http"},
+	}
+	if err := d.Register(ctx, reg); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := d.Deregister(ctx); err != nil {
+			log.Printf("Deregistering from discovery: %v", err)
+		}
+	}, nil
+}
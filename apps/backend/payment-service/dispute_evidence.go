@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/dispute"
+	"github.com/stripe/stripe-go/v76/file"
+)
+
+var disputeRemindersSent = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "payment_service_dispute_reminders_total",
+	Help: "Dispute evidence deadline reminders emitted.",
+})
+
+// disputeTextFields are the evidence fields that take text. Stripe caps
+// each at disputeTextMax characters.
+var disputeTextFields = map[string]bool{
+	"access_activity_log": true, "billing_address": true, "cancellation_policy_disclosure": true,
+	"cancellation_rebuttal": true, "customer_email_address": true, "customer_name": true,
+	"customer_purchase_ip": true, "duplicate_charge_explanation": true, "duplicate_charge_id": true,
+	"product_description": true, "refund_policy_disclosure": true, "refund_refusal_explanation": true,
+	"service_date": true, "shipping_address": true, "shipping_carrier": true, "shipping_date": true,
+	"shipping_tracking_number": true, "uncategorized_text": true,
+}
+
+// disputeFileFields are the evidence fields that take an uploaded file.
+var disputeFileFields = map[string]bool{
+	"cancellation_policy": true, "customer_communication": true, "customer_signature": true,
+	"duplicate_charge_documentation": true, "receipt": true, "refund_policy": true,
+	"service_documentation": true, "shipping_documentation": true, "uncategorized_file": true,
+}
+
+const disputeTextMax = 20000
+
+// disputeFileMaxBytes is Stripe's limit for a dispute evidence file.
+const disputeFileMaxBytes = 5 << 20
+
+// defaultDisputeReminderHours apply when the runtime config sets none.
+var defaultDisputeReminderHours = []int{72, 24}
+
+// DisputeReminder is the event emitted as a dispute's evidence deadline
+// approaches. ReminderHours is the configured offset that fired.
+type DisputeReminder struct {
+	Type          string    `json:"type"`
+	DisputeID     string    `json:"dispute_id"`
+	PaymentID     string    `json:"payment_id,omitempty"`
+	Amount        int64     `json:"amount"`
+	Currency      string    `json:"currency"`
+	Status        string    `json:"status"`
+	Reason        string    `json:"reason,omitempty"`
+	EvidenceDueBy time.Time `json:"evidence_due_by"`
+	ReminderHours int       `json:"reminder_hours"`
+}
+
+// ClaimDisputeReminders records the reminders due at offset hours and
+// passes the disputes they are for to emit, inside one transaction: when
+// emit fails nothing is recorded and the reminders are sent again on the
+// next sweep. A dispute already reminded at a shorter offset is skipped,
+// so offsets must be claimed shortest first.
+func (s *Store) ClaimDisputeReminders(ctx context.Context, hours int, emit func([]DisputeReminder) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		WITH sent AS (
+			INSERT INTO dispute_reminders (dispute_id, hours)
+			SELECT d.id, $1 FROM disputes d
+			WHERE d.status IN ('needs_response', 'warning_needs_response')
+				AND d.evidence_due_by > now() AND d.evidence_due_by <= now() + make_interval(hours => $1)
+				AND NOT EXISTS (SELECT 1 FROM dispute_reminders r WHERE r.dispute_id = d.id AND r.hours <= $1)
+			ON CONFLICT DO NOTHING
+			RETURNING dispute_id)
+		SELECT d.id, d.payment_id, d.amount, d.currency, d.status, d.reason, d.evidence_due_by
+		FROM disputes d JOIN sent ON sent.dispute_id = d.id`, hours)
+	if err != nil {
+		return err
+	}
+	var due []DisputeReminder
+	for rows.Next() {
+		r := DisputeReminder{Type: "dispute.evidence_due_soon", ReminderHours: hours}
+		if err := rows.Scan(&r.DisputeID, &r.PaymentID, &r.Amount, &r.Currency, &r.Status, &r.Reason, &r.EvidenceDueBy); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(due) == 0 {
+		return nil
+	}
+	if err := emit(due); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisputeEvidence assembles and submits evidence for disputes. Drafts
+// live on the Stripe dispute itself: text is saved with submit=false,
+// files are uploaded to Stripe Files and attached by ID, and service logs
+// are pulled from the order service for the payment's order. Submission
+// is refused once the evidence is past due. A worker emits reminders to
+// the broker and the event hub as deadlines approach, from the local
+// dispute copies the webhooks keep. orders and store may be nil.
+type DisputeEvidence struct {
+	store     *Store
+	orders    *OrderClient
+	settings  *RuntimeSettings
+	hub       *EventHub
+	publisher Publisher
+	topic     string
+	interval  time.Duration
+}
+
+func NewDisputeEvidence(store *Store, orders *OrderClient, settings *RuntimeSettings, hub *EventHub, publisher Publisher, topic string, interval time.Duration) *DisputeEvidence {
+	return &DisputeEvidence{
+		store:     store,
+		orders:    orders,
+		settings:  settings,
+		hub:       hub,
+		publisher: publisher,
+		topic:     topic,
+		interval:  interval,
+	}
+}
+
+// RegisterRoutes mounts the evidence builder for keys with the disputes
+// scope.
+func (d *DisputeEvidence) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/admin/disputes/:id/evidence", requireScope(d.store, bootstrapToken, "disputes"))
+	g.GET("", d.get)
+	g.PUT("", d.update)
+	g.POST("/files", d.upload)
+	g.POST("/service-logs", d.serviceLogs)
+	g.POST("/submit", d.submit)
+}
+
+// disputeView is a dispute's evidence and where it stands.
+func disputeView(dp *stripe.Dispute) gin.H {
+	view := gin.H{
+		"id":       dp.ID,
+		"status":   dp.Status,
+		"reason":   dp.Reason,
+		"amount":   dp.Amount,
+		"currency": dp.Currency,
+		"evidence": dp.Evidence,
+	}
+	if dp.EvidenceDetails != nil {
+		view["has_evidence"] = dp.EvidenceDetails.HasEvidence
+		view["past_due"] = dp.EvidenceDetails.PastDue
+		view["submission_count"] = dp.EvidenceDetails.SubmissionCount
+		if dp.EvidenceDetails.DueBy > 0 {
+			view["evidence_due_by"] = time.Unix(dp.EvidenceDetails.DueBy, 0).UTC()
+		}
+	}
+	return view
+}
+
+func (d *DisputeEvidence) get(c *gin.Context) {
+	params := &stripe.DisputeParams{}
+	params.Context = c.Request.Context()
+	dp, err := dispute.Get(c.Param("id"), params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondData(c, http.StatusOK, disputeView(dp))
+}
+
+// save writes evidence fields to the dispute's draft; an empty value
+// clears a field.
+func (d *DisputeEvidence) save(c *gin.Context, fields map[string]string) {
+	params := &stripe.DisputeParams{Submit: stripe.Bool(false)}
+	params.Context = c.Request.Context()
+	for k, v := range fields {
+		params.AddExtra("evidence["+k+"]", v)
+	}
+	dp, err := dispute.Update(c.Param("id"), params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondData(c, http.StatusOK, disputeView(dp))
+}
+
+// update saves text evidence, such as shipping carrier and tracking
+// number, given as an object of evidence field names to values.
+func (d *DisputeEvidence) update(c *gin.Context) {
+	var fields map[string]string
+	if !decodeJSON(c, &fields) {
+		return
+	}
+	var problems []FieldError
+	for k, v := range fields {
+		switch {
+		case !disputeTextFields[k]:
+			problems = append(problems, FieldError{Field: k, Code: "invalid_choice", Message: "not a text evidence field"})
+		case len([]rune(v)) > disputeTextMax:
+			problems = append(problems, FieldError{Field: k, Code: "too_large", Message: fmt.Sprintf("at most %d characters", disputeTextMax)})
+		}
+	}
+	if len(fields) == 0 {
+		problems = append(problems, FieldError{Field: "evidence", Code: "required", Message: "no evidence fields given"})
+	}
+	if len(problems) > 0 {
+		sort.Slice(problems, func(i, j int) bool { return problems[i].Field < problems[j].Field })
+		validationFailed(c, problems)
+		return
+	}
+	d.save(c, fields)
+}
+
+// upload proxies a multipart file to Stripe Files and attaches it to the
+// evidence field named by the "field" form value.
+func (d *DisputeEvidence) upload(c *gin.Context) {
+	field := c.PostForm("field")
+	if !disputeFileFields[field] {
+		validationFailed(c, []FieldError{{Field: "field", Code: "invalid_choice", Message: "not a file evidence field"}})
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, disputeFileMaxBytes+1<<20)
+	fh, err := c.FormFile("file")
+	if err != nil {
+		validationFailed(c, []FieldError{{Field: "file", Code: "required", Message: "multipart file is required"}})
+		return
+	}
+	if fh.Size > disputeFileMaxBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, errorBody(c, CodePayloadTooLarge,
+			fmt.Sprintf("Evidence files are limited to %d bytes", disputeFileMaxBytes)))
+		return
+	}
+	f, err := fh.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	defer f.Close()
+
+	params := &stripe.FileParams{
+		FileReader: f,
+		Filename:   stripe.String(fh.Filename),
+		Purpose:    stripe.String(string(stripe.FilePurposeDisputeEvidence)),
+	}
+	params.Context = c.Request.Context()
+	uploaded, err := file.New(params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	d.save(c, map[string]string{field: uploaded.ID})
+}
+
+// serviceLogs pulls the activity log of the disputed payment's order from
+// the order service into a text evidence field, access_activity_log
+// unless the body names another. Logs longer than Stripe allows keep
+// their newest entries.
+func (d *DisputeEvidence) serviceLogs(c *gin.Context) {
+	var req struct {
+		Field string `json:"field"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+	if req.Field == "" {
+		req.Field = "access_activity_log"
+	}
+	if !disputeTextFields[req.Field] {
+		validationFailed(c, []FieldError{{Field: "field", Code: "invalid_choice", Message: "not a text evidence field"}})
+		return
+	}
+	if d.orders == nil {
+		c.JSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Service logs require ORDER_SERVICE_URL"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	params := &stripe.DisputeParams{}
+	params.Context = ctx
+	params.AddExpand("payment_intent")
+	dp, err := dispute.Get(c.Param("id"), params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	var orderID string
+	if dp.PaymentIntent != nil {
+		orderID = dp.PaymentIntent.Metadata["order_id"]
+	}
+	if orderID == "" {
+		c.JSON(http.StatusUnprocessableEntity, errorBody(c, CodeInvalidRequest, "Disputed payment has no order_id"))
+		return
+	}
+	entries, err := d.orders.Logs(ctx, orderID)
+	if err != nil {
+		logf(ctx, "order logs for %s: %v", orderID, err)
+		c.JSON(http.StatusBadGateway, errorBody(c, CodeUpstreamFailed, "Order service unavailable"))
+		return
+	}
+	if len(entries) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, errorBody(c, CodeInvalidRequest, "Order "+orderID+" has no activity logs"))
+		return
+	}
+	d.save(c, map[string]string{req.Field: formatOrderLogs(entries, disputeTextMax)})
+}
+
+// formatOrderLogs renders entries one per line, dropping the oldest until
+// the text fits in max characters.
+func formatOrderLogs(entries []OrderLogEntry, max int) string {
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		line := e.At.UTC().Format(time.RFC3339) + " " + e.Type
+		if e.IP != "" {
+			line += " ip=" + e.IP
+		}
+		if e.Message != "" {
+			line += " " + e.Message
+		}
+		lines[i] = line
+	}
+	text := strings.Join(lines, "\n")
+	for len([]rune(text)) > max && len(lines) > 1 {
+		lines = lines[1:]
+		text = strings.Join(lines, "\n")
+	}
+	if r := []rune(text); len(r) > max {
+		text = string(r[len(r)-max:])
+	}
+	return text
+}
+
+// submit sends the draft to the card network. There is no taking it back.
+func (d *DisputeEvidence) submit(c *gin.Context) {
+	ctx := c.Request.Context()
+	params := &stripe.DisputeParams{}
+	params.Context = ctx
+	dp, err := dispute.Get(c.Param("id"), params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if dp.EvidenceDetails != nil {
+		due := time.Unix(dp.EvidenceDetails.DueBy, 0).UTC()
+		if dp.EvidenceDetails.PastDue || dp.EvidenceDetails.DueBy > 0 && time.Now().After(due) {
+			c.JSON(http.StatusUnprocessableEntity, errorBody(c, CodeInvalidRequest,
+				"Evidence was due by "+due.Format(time.RFC3339)))
+			return
+		}
+		if !dp.EvidenceDetails.HasEvidence {
+			c.JSON(http.StatusUnprocessableEntity, errorBody(c, CodeInvalidRequest, "Dispute has no evidence to submit"))
+			return
+		}
+	}
+
+	params = &stripe.DisputeParams{Submit: stripe.Bool(true)}
+	params.Context = ctx
+	dp, err = dispute.Update(dp.ID, params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if d.store != nil {
+		if err := d.store.SaveDispute(context.WithoutCancel(ctx), dp); err != nil {
+			logf(ctx, "saving dispute %s: %v", dp.ID, err)
+		}
+	}
+	respondData(c, http.StatusOK, disputeView(dp))
+}
+
+// reminderHours are the offsets before the deadline to remind at,
+// shortest first.
+func (d *DisputeEvidence) reminderHours() []int {
+	hours := append([]int(nil), d.settings.Get().DisputeReminderHours...)
+	if len(hours) == 0 {
+		hours = append(hours, defaultDisputeReminderHours...)
+	}
+	sort.Ints(hours)
+	return hours
+}
+
+// Run emits the reminders that are due every interval until ctx is done.
+func (d *DisputeEvidence) Run(ctx context.Context) {
+	if d == nil || d.store == nil {
+		return
+	}
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		if err := d.remind(ctx); err != nil {
+			log.Printf("dispute reminders: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *DisputeEvidence) remind(ctx context.Context) error {
+	var errs []error
+	for _, h := range d.reminderHours() {
+		err := d.store.ClaimDisputeReminders(ctx, h, func(due []DisputeReminder) error {
+			for _, r := range due {
+				payload, err := json.Marshal(r)
+				if err != nil {
+					return err
+				}
+				if err := d.publisher.Publish(ctx, d.topic, r.DisputeID, payload); err != nil {
+					return fmt.Errorf("publishing reminder for %s: %w", r.DisputeID, err)
+				}
+			}
+			// The hub is in-process and can't fail, so it goes last and
+			// only once the broker has all of them.
+			for _, r := range due {
+				disputeRemindersSent.Inc()
+				d.hub.Publish(PaymentEvent{
+					PaymentID: r.PaymentID,
+					Type:      r.Type,
+					Status:    r.Status,
+					Amount:    r.Amount,
+					Currency:  r.Currency,
+					CreatedAt: time.Now().UTC(),
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%dh reminders: %w", h, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+// SaveDispute upserts the local copy of a dispute from its webhook.
+func (s *Store) SaveDispute(ctx context.Context, d *stripe.Dispute) error {
+	var paymentID, chargeID string
+	if d.PaymentIntent != nil {
+		paymentID = d.PaymentIntent.ID
+	}
+	if d.Charge != nil {
+		chargeID = d.Charge.ID
+	}
+	var dueBy sql.NullTime
+	if d.EvidenceDetails != nil && d.EvidenceDetails.DueBy > 0 {
+		dueBy = sql.NullTime{Time: time.Unix(d.EvidenceDetails.DueBy, 0).UTC(), Valid: true}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO disputes (id, payment_id, charge_id, amount, currency, status, reason, evidence_due_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE SET
+			amount = EXCLUDED.amount,
+			status = EXCLUDED.status,
+			reason = EXCLUDED.reason,
+			evidence_due_by = EXCLUDED.evidence_due_by,
+			updated_at = now()`,
+		d.ID, paymentID, chargeID, d.Amount, string(d.Currency), string(d.Status), string(d.Reason), dueBy,
+		time.Unix(d.Created, 0).UTC()); err != nil {
+		return err
+	}
+	if paymentID != "" {
+		if err := advancePaymentState(ctx, tx, paymentID, "dispute", false); err != nil {
+			return err
+		}
+		if err := appendPaymentEvent(ctx, tx, paymentID, "dispute"); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+)
+
+var deadLettersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_dead_letters_total",
+	Help: "Dead-letter queue entries, by kind (webhook, publish, merchant_webhook) and outcome (added, retried, retry_failed, discarded, resolved).",
+}, []string{"kind", "outcome"})
+
+const (
+	// What failed: a Stripe webhook event the service could not apply, a
+	// publish to the broker, or a merchant webhook delivery out of
+	// attempts.
+	deadLetterWebhook         = "webhook"
+	deadLetterPublish         = "publish"
+	deadLetterMerchantWebhook = "merchant_webhook"
+
+	deadLetterPending   = "pending"
+	deadLetterRetrying  = "retrying"
+	deadLetterRetried   = "retried"
+	deadLetterDiscarded = "discarded"
+
+	// deadLetterLease is how long a retry holds its entry; one left
+	// retrying past it, by a restart mid-retry, can be retried again.
+	deadLetterLease = 5 * time.Minute
+)
+
+var errDeadLetterState = errors.New("dead letter is not pending")
+
+// DeadLetter is a failure kept for an operator to retry or discard.
+// Payload is what a retry sends: the Stripe event, the broker message or
+// the merchant webhook body.
+type DeadLetter struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	Ref        string          `json:"ref,omitempty"`
+	Topic      string          `json:"topic,omitempty"`
+	Key        string          `json:"key,omitempty"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Error      string          `json:"error"`
+	Attempts   int             `json:"attempts"`
+	Status     string          `json:"status"`
+	Edited     bool            `json:"edited"`
+	RetryError string          `json:"retry_error,omitempty"`
+	ResolvedBy string          `json:"resolved_by,omitempty"`
+	Note       string          `json:"note,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+	ResolvedAt *time.Time      `json:"resolved_at,omitempty"`
+}
+
+const deadLetterColumns = `id, kind, ref, topic, key, payload, error, attempts, status, edited, retry_error,
+	resolved_by, note, created_at, updated_at, resolved_at`
+
+func scanDeadLetter(row interface{ Scan(...interface{}) error }) (*DeadLetter, error) {
+	var d DeadLetter
+	var payload string
+	var resolvedAt sql.NullTime
+	if err := row.Scan(&d.ID, &d.Kind, &d.Ref, &d.Topic, &d.Key, &payload, &d.Error, &d.Attempts, &d.Status,
+		&d.Edited, &d.RetryError, &d.ResolvedBy, &d.Note, &d.CreatedAt, &d.UpdatedAt, &resolvedAt); err != nil {
+		return nil, err
+	}
+	// Everything this service sends is JSON; anything else is shown as a
+	// string rather than breaking the response.
+	if json.Valid([]byte(payload)) {
+		d.Payload = json.RawMessage(payload)
+	} else {
+		d.Payload, _ = json.Marshal(payload)
+	}
+	if resolvedAt.Valid {
+		d.ResolvedAt = &resolvedAt.Time
+	}
+	return &d, nil
+}
+
+// The dead-letter queue without payloads, filterable by kind, ref, topic
+// or status; GET /admin/dlq/:id has the payload.
+var deadLetterList = listResource{
+	from: "dead_letters",
+	fields: []string{"id", "kind", "ref", "topic", "key", "error", "attempts", "status", "retry_error",
+		"resolved_by", "note", "created_at", "updated_at", "resolved_at"},
+	columns: map[string]listField{
+		"id":          {"id", textField},
+		"kind":        {"kind", textField},
+		"ref":         {"ref", textField},
+		"topic":       {"topic", textField},
+		"key":         {"key", textField},
+		"error":       {"error", textField},
+		"attempts":    {"attempts", intField},
+		"status":      {"status", textField},
+		"retry_error": {"retry_error", textField},
+		"resolved_by": {"resolved_by", textField},
+		"note":        {"note", textField},
+		"created_at":  {"created_at", timeField},
+		"updated_at":  {"updated_at", timeField},
+		"resolved_at": {"resolved_at", timeField},
+	},
+}
+
+// AddDeadLetter stores a failure, or, when an open entry for the same
+// kind and ref exists, counts it as another attempt there. added is
+// whether the entry is new.
+func (s *Store) AddDeadLetter(ctx context.Context, d *DeadLetter) (stored *DeadLetter, added bool, err error) {
+	stored, err = scanDeadLetter(s.db.QueryRowContext(ctx, `
+		INSERT INTO dead_letters (id, kind, ref, topic, key, payload, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (kind, ref) WHERE status IN ('pending', 'retrying') AND ref <> ''
+		DO UPDATE SET attempts = dead_letters.attempts + 1, error = EXCLUDED.error, updated_at = now()
+		RETURNING `+deadLetterColumns,
+		"dlq_"+strings.ReplaceAll(uuid.NewString(), "-", ""), d.Kind, d.Ref, d.Topic, d.Key, string(d.Payload), d.Error))
+	if err != nil {
+		return nil, false, err
+	}
+	return stored, stored.Attempts == 1, nil
+}
+
+func (s *Store) DeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	return scanDeadLetter(s.db.QueryRowContext(ctx, `SELECT `+deadLetterColumns+` FROM dead_letters WHERE id = $1`, id))
+}
+
+// ClaimDeadLetter marks a pending entry, or one whose retry outlived its
+// lease, as retrying, replacing its payload when payload is set. It
+// returns the entry with errDeadLetterState when it cannot be retried.
+func (s *Store) ClaimDeadLetter(ctx context.Context, id string, payload json.RawMessage) (*DeadLetter, error) {
+	d, err := scanDeadLetter(s.db.QueryRowContext(ctx, `
+		UPDATE dead_letters SET status = $2,
+			payload = CASE WHEN $3 <> '' THEN $3 ELSE payload END,
+			edited = edited OR $3 <> '',
+			updated_at = now()
+		WHERE id = $1 AND (status = $4 OR (status = $2 AND updated_at < $5))
+		RETURNING `+deadLetterColumns,
+		id, deadLetterRetrying, string(payload), deadLetterPending, time.Now().Add(-deadLetterLease)))
+	if errors.Is(err, sql.ErrNoRows) {
+		if d, err = s.DeadLetter(ctx, id); err != nil {
+			return nil, err
+		}
+		return d, errDeadLetterState
+	}
+	return d, err
+}
+
+// FinishDeadLetterRetry records a claimed entry's retry: retried when
+// retryErr is nil, otherwise pending again with the error kept.
+func (s *Store) FinishDeadLetterRetry(ctx context.Context, id, actor string, retryErr error) (*DeadLetter, error) {
+	if retryErr != nil {
+		return scanDeadLetter(s.db.QueryRowContext(ctx, `
+			UPDATE dead_letters SET status = $2, attempts = attempts + 1, retry_error = $3, updated_at = now()
+			WHERE id = $1
+			RETURNING `+deadLetterColumns, id, deadLetterPending, retryErr.Error()))
+	}
+	return scanDeadLetter(s.db.QueryRowContext(ctx, `
+		UPDATE dead_letters SET status = $2, retry_error = '', resolved_by = $3, updated_at = now(), resolved_at = now()
+		WHERE id = $1
+		RETURNING `+deadLetterColumns, id, deadLetterRetried, actor))
+}
+
+// DiscardDeadLetter closes a pending entry without retrying it. It
+// returns the entry with errDeadLetterState when it is not pending.
+func (s *Store) DiscardDeadLetter(ctx context.Context, id, actor, note string) (*DeadLetter, error) {
+	d, err := scanDeadLetter(s.db.QueryRowContext(ctx, `
+		UPDATE dead_letters SET status = $2, resolved_by = $3, note = $4, updated_at = now(), resolved_at = now()
+		WHERE id = $1 AND status = $5
+		RETURNING `+deadLetterColumns, id, deadLetterDiscarded, actor, note, deadLetterPending))
+	if errors.Is(err, sql.ErrNoRows) {
+		if d, err = s.DeadLetter(ctx, id); err != nil {
+			return nil, err
+		}
+		return d, errDeadLetterState
+	}
+	return d, err
+}
+
+// ResolveDeadLetters closes the pending entries for kind and ref once
+// what failed has gone through on its own, such as a webhook event
+// Stripe redelivered. It returns how many there were.
+func (s *Store) ResolveDeadLetters(ctx context.Context, kind, ref, by string) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE dead_letters SET status = $3, resolved_by = $4, updated_at = now(), resolved_at = now()
+		WHERE kind = $1 AND ref = $2 AND status = $5`, kind, ref, deadLetterRetried, by, deadLetterPending)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeadLetters keeps work that failed and would otherwise only be a log
+// line: Stripe webhook events that could not be applied, publishes to
+// the broker, and merchant webhook deliveries out of attempts. Entries
+// are stored, and also published to topic when it is set, for an
+// operator to inspect under /admin/dlq and retry, with the payload
+// edited if need be, or discard.
+type DeadLetters struct {
+	store *Store
+	// publisher is the undecorated transport, so a retry or the entry's
+	// own publish failing does not add entries.
+	publisher Publisher
+	topic     string
+	webhooks  *WebhookHandler
+	merchant  *MerchantWebhooks
+}
+
+func NewDeadLetters(store *Store, publisher Publisher, topic string) *DeadLetters {
+	return &DeadLetters{store: store, publisher: publisher, topic: topic}
+}
+
+// RegisterRoutes mounts the queue under the admin scope.
+func (dl *DeadLetters) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/admin/dlq", requireScope(dl.store, bootstrapToken, "admin"), dl.requireStore)
+	g.GET("", listHandler(dl.store, deadLetterList))
+	g.GET("/:id", dl.get)
+	g.POST("/:id/retry", dl.retry)
+	g.POST("/:id/discard", dl.discard)
+}
+
+func (dl *DeadLetters) requireStore(c *gin.Context) {
+	if dl.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "The dead-letter queue requires DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// record keeps a failure. Recording is best effort: a failure to record
+// is logged, and what failed is reported to its caller as before.
+func (dl *DeadLetters) record(ctx context.Context, d *DeadLetter) {
+	if dl == nil || dl.store == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	stored, added, err := dl.store.AddDeadLetter(ctx, d)
+	if err != nil {
+		logf(ctx, "dead letters: recording %s %s: %v", d.Kind, d.Ref, err)
+		return
+	}
+	if !added {
+		return
+	}
+	deadLettersTotal.WithLabelValues(d.Kind, "added").Inc()
+	if dl.topic == "" || dl.publisher == nil {
+		return
+	}
+	payload, err := json.Marshal(stored)
+	if err != nil {
+		logf(ctx, "dead letters: encoding %s: %v", stored.ID, err)
+		return
+	}
+	if err := dl.publisher.Publish(ctx, dl.topic, stored.ID, payload); err != nil {
+		logf(ctx, "dead letters: publishing %s to %s: %v", stored.ID, dl.topic, err)
+	}
+}
+
+// webhookFailed keeps a Stripe event whose processing failed. Stripe
+// redelivers it too; a redelivery that fails again counts as an attempt
+// on the same entry.
+func (dl *DeadLetters) webhookFailed(ctx context.Context, event stripe.Event, payload []byte, err error) {
+	dl.record(ctx, &DeadLetter{Kind: deadLetterWebhook, Ref: event.ID, Topic: string(event.Type), Payload: payload, Error: err.Error()})
+}
+
+// resolved closes the pending entries for kind and ref once what failed
+// went through another way.
+func (dl *DeadLetters) resolved(ctx context.Context, kind, ref, by string) {
+	if dl == nil || dl.store == nil || ref == "" {
+		return
+	}
+	n, err := dl.store.ResolveDeadLetters(context.WithoutCancel(ctx), kind, ref, by)
+	if err != nil {
+		logf(ctx, "dead letters: resolving %s %s: %v", kind, ref, err)
+		return
+	}
+	deadLettersTotal.WithLabelValues(kind, "resolved").Add(float64(n))
+}
+
+// deadLetterPublisher keeps publishes that fail in the dead-letter
+// queue. The error is still returned, so publishers log and carry on as
+// before.
+type deadLetterPublisher struct {
+	Publisher
+	dl *DeadLetters
+}
+
+func (p deadLetterPublisher) Publish(ctx context.Context, topic, key string, payload []byte) error {
+	err := p.Publisher.Publish(ctx, topic, key, payload)
+	if err != nil {
+		p.dl.record(ctx, &DeadLetter{Kind: deadLetterPublish, Topic: topic, Key: key, Payload: payload, Error: err.Error()})
+	}
+	return err
+}
+
+// replay does again what d recorded failing, with d's payload.
+func (dl *DeadLetters) replay(ctx context.Context, d *DeadLetter) error {
+	switch d.Kind {
+	case deadLetterWebhook:
+		if dl.webhooks == nil {
+			return errors.New("webhook processing is not configured")
+		}
+		var event stripe.Event
+		if err := json.Unmarshal(d.Payload, &event); err != nil {
+			return fmt.Errorf("decoding event: %w", err)
+		}
+		return dl.webhooks.dispatch(ctx, event)
+
+	case deadLetterPublish:
+		if dl.publisher == nil {
+			return errors.New("event transport is not configured")
+		}
+		return dl.publisher.Publish(ctx, d.Topic, d.Key, d.Payload)
+
+	case deadLetterMerchantWebhook:
+		if dl.merchant == nil {
+			return errors.New("merchant webhooks are not configured")
+		}
+		delivery, err := dl.store.MerchantWebhookDelivery(ctx, d.Ref)
+		if err != nil {
+			return fmt.Errorf("loading delivery %s: %w", d.Ref, err)
+		}
+		if delivery.Status == merchantDeliveryCanceled {
+			return errors.New("the delivery's endpoint was deleted")
+		}
+		delivery.Payload = d.Payload
+		_, attempt, err := dl.merchant.attempt(ctx, delivery, true)
+		if err != nil {
+			return err
+		}
+		if attempt.Error != "" {
+			return errors.New(attempt.Error)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown dead letter kind %q", d.Kind)
+}
+
+func (dl *DeadLetters) get(c *gin.Context) {
+	d, err := dl.store.DeadLetter(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Dead letter not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, d)
+}
+
+// retry does the entry's work again, with payload in place of the
+// recorded one when it is given, and answers with the outcome. A failed
+// retry leaves the entry pending with the error in retry_error.
+func (dl *DeadLetters) retry(c *gin.Context) {
+	var req struct {
+		Payload json.RawMessage `json:"payload"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+	if string(req.Payload) == "null" {
+		req.Payload = nil
+	}
+	d, err := dl.store.DeadLetter(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Dead letter not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if d.Kind == deadLetterWebhook && len(req.Payload) > 0 {
+		var event stripe.Event
+		if err := json.Unmarshal(req.Payload, &event); err != nil || event.ID == "" || event.Type == "" {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "payload must be a Stripe event with an id and type"))
+			return
+		}
+	}
+
+	d, err = dl.store.ClaimDeadLetter(c.Request.Context(), d.ID, req.Payload)
+	if errors.Is(err, errDeadLetterState) {
+		c.JSON(http.StatusConflict, errorBodyWith(c, CodeDeadLetterState, "Dead letter is "+d.Status, gin.H{"dead_letter": d}))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+
+	ctx := c.Request.Context()
+	retryErr := dl.replay(ctx, d)
+	if retryErr != nil {
+		logf(ctx, "dead letters: retrying %s (%s): %v", d.ID, d.Kind, retryErr)
+		deadLettersTotal.WithLabelValues(d.Kind, "retry_failed").Inc()
+	} else {
+		deadLettersTotal.WithLabelValues(d.Kind, "retried").Inc()
+	}
+	d, err = dl.store.FinishDeadLetterRetry(context.WithoutCancel(ctx), d.ID, c.GetString("api_key_id"), retryErr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{"dead_letter": d, "succeeded": retryErr == nil})
+}
+
+func (dl *DeadLetters) discard(c *gin.Context) {
+	var req struct {
+		Note string `json:"note" binding:"max=1000"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+	d, err := dl.store.DiscardDeadLetter(c.Request.Context(), c.Param("id"), c.GetString("api_key_id"), req.Note)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Dead letter not found"))
+		return
+	case errors.Is(err, errDeadLetterState):
+		c.JSON(http.StatusConflict, errorBodyWith(c, CodeDeadLetterState, "Dead letter is "+d.Status, gin.H{"dead_letter": d}))
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	deadLettersTotal.WithLabelValues(d.Kind, "discarded").Inc()
+	respondData(c, http.StatusOK, d)
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/balance"
+)
+
+// doctorTimeout bounds each connectivity check.
+const doctorTimeout = 5 * time.Second
+
+type checkStatus string
+
+const (
+	checkPass checkStatus = "PASS"
+	checkWarn checkStatus = "WARN"
+	checkFail checkStatus = "FAIL"
+	checkSkip checkStatus = "SKIP"
+)
+
+type checkResult struct {
+	Name   string
+	Status checkStatus
+	Detail string
+}
+
+type doctorCheck struct {
+	name string
+	run  func(ctx context.Context) (checkStatus, string)
+}
+
+// runDoctor validates configuration and dependencies without serving
+// traffic, prints a report and returns the process exit code: non-zero if
+// any check failed. Warnings are reported but don't fail the run.
+func runDoctor() int {
+	checks := []doctorCheck{
+		{"settings", checkSettings},
+		{"region", checkRegion},
+		{"stripe key", checkStripeKey},
+		{"stripe api", checkStripeAPI},
+		{"webhook secret", checkWebhookSecret},
+		{"runtime config", checkRuntimeConfig},
+		{"feature flags", checkFeatureFlags},
+		{"database", checkDatabase},
+		{"storage", checkStorage},
+		{"redis", checkRedis},
+		{"broker", checkBroker},
+		{"discovery", checkDiscovery},
+		{"oauth2", checkOAuth2},
+		{"mailer", checkMailer},
+		{"export dir", checkExportDir},
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	failed := 0
+	for _, check := range checks {
+		ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+		status, detail := check.run(ctx)
+		cancel()
+		if status == checkFail {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", status, check.name, detail)
+	}
+	w.Flush()
+
+	if failed > 0 {
+		fmt.Printf("\n%d check(s) failed\n", failed)
+		return 1
+	}
+	fmt.Println("\nAll checks passed")
+	return 0
+}
+
+func mockProvider() bool {
+	return os.Getenv("PAYMENT_PROVIDER") == "mock"
+}
+
+// checkSettings parses every numeric and duration setting the service
+// would otherwise log.Fatal on at startup.
+func checkSettings(context.Context) (checkStatus, string) {
+	durations := []string{
+		"SETTLEMENT_RECONCILE_INTERVAL", "SETTLEMENT_LOOKBACK",
+		"HTTP_READ_TIMEOUT", "HTTP_READ_HEADER_TIMEOUT", "HTTP_WRITE_TIMEOUT", "HTTP_IDLE_TIMEOUT",
+		"SHUTDOWN_GRACE_PERIOD", "MOCK_LATENCY", "MOCK_CONFIRM_DELAY",
+		"STRIPE_TIMEOUT_READ", "STRIPE_TIMEOUT_WRITE", "STRIPE_TIMEOUT_LIST",
+		"STRIPE_HTTP_IDLE_CONN_TIMEOUT", "STRIPE_HTTP_DIAL_TIMEOUT", "STRIPE_HTTP_KEEPALIVE",
+		"STRIPE_HTTP_TLS_HANDSHAKE_TIMEOUT", "STRIPE_HTTP_RESPONSE_HEADER_TIMEOUT",
+		"PAYMENT_JOB_TTL", "CAPABILITIES_REFRESH_INTERVAL", "LOAD_SHED_TARGET_LATENCY",
+		"HTTP_TCP_KEEPALIVE", "GIFT_CARD_LOOKUP_WINDOW", "ESCROW_RELEASE_AFTER", "ESCROW_RELEASE_INTERVAL",
+		"DUNNING_INTERVAL", "PAYMENT_RETRY_INTERVAL", "DISPUTE_REMINDER_INTERVAL",
+		"CHECKOUT_SESSION_TTL", "CHECKOUT_EXPIRY_INTERVAL", "PAYMENT_PLAN_INTERVAL",
+		"FX_RATES_REFRESH_INTERVAL", "FX_RATES_MAX_AGE", "FEE_SYNC_INTERVAL", "FEE_SYNC_LOOKBACK",
+		"CHARGEBACK_RISK_INTERVAL", "DOCUMENT_LINK_TTL", "BILLING_INTERVAL", "TAX_ID_RECHECK_INTERVAL",
+		"RECEIPT_LINK_TTL", "REDIS_TIMEOUT", "PAYMENT_REVIEW_INTERVAL", "PAYMENT_EXPIRY_TTL", "PAYMENT_EXPIRY_INTERVAL",
+		"AUTHORIZATION_HOLD_INTERVAL", "STRIPE_IMPORT_INTERVAL", "SHADOW_TIMEOUT",
+		"ROUTING_STATS_INTERVAL", "ROUTING_STATS_LOOKBACK", "READ_MODEL_INTERVAL", "BULK_REFUND_INTERVAL",
+		"SLO_EVAL_INTERVAL", "PROVIDER_HEALTH_INTERVAL", "PROVIDER_HEALTH_TIMEOUT",
+		"STARTUP_WAIT_TIMEOUT", "STARTUP_WAIT_MAX_BACKOFF",
+		"DATABASE_REPLICA_MAX_LAG", "DATABASE_REPLICA_CHECK_INTERVAL", "DATABASE_CONN_MAX_LIFETIME",
+		"DATABASE_CONN_MAX_IDLE_TIME", "DATABASE_STATEMENT_TIMEOUT", "WEBHOOK_EVENT_RETENTION", "WEBHOOK_DEDUPE_TTL",
+		"OAUTH2_JWKS_REFRESH",
+	}
+	ints := []string{"PORT", "HTTP_MAX_HEADER_BYTES", "HTTP_MAX_CONNECTIONS", "PROCESSING_FEE_FIXED",
+		"BATCH_MAX_ITEMS", "BATCH_PARALLELISM", "PAYMENT_JOB_WORKERS", "PAYMENT_JOB_QUEUE_DEPTH",
+		"STRIPE_HTTP_MAX_IDLE_CONNS", "STRIPE_HTTP_MAX_IDLE_CONNS_PER_HOST", "STRIPE_HTTP_MAX_CONNS_PER_HOST",
+		"STRIPE_MAX_NETWORK_RETRIES", "WEBHOOK_WORKERS", "WEBHOOK_QUEUE_DEPTH", "LOAD_SHED_MAX_IN_FLIGHT",
+		"COMPRESSION_MIN_BYTES", "HTTP2_MAX_CONCURRENT_STREAMS", "GIFT_CARD_LOOKUP_MAX_FAILURES",
+		"TOKENIZE_RATE_PER_MINUTE", "TOKENIZE_RATE_BURST", "USAGE_BATCH_MAX_ITEMS",
+		"RECEIPT_LOOKUP_RATE_PER_MINUTE", "RECEIPT_LOOKUP_RATE_BURST", "FRAUD_LIST_IMPORT_MAX_ROWS",
+		"SHADOW_MAX_IN_FLIGHT", "BULK_REFUND_WORKERS", "BULK_REFUND_MAX_ITEMS",
+		"PROVIDER_HEALTH_FAILURES", "REDIS_STREAM_MAXLEN", "DATABASE_MAX_OPEN_CONNS", "DATABASE_MAX_IDLE_CONNS"}
+	floats := []string{"ANALYTICS_SAMPLE_RATE", "PROCESSING_FEE_PERCENT", "DATABASE_POOL_SATURATION_THRESHOLD"}
+
+	var problems []string
+	for _, name := range durations {
+		if v := os.Getenv(name); v != "" {
+			if _, err := time.ParseDuration(v); err != nil {
+				problems = append(problems, name)
+			}
+		}
+	}
+	for _, name := range ints {
+		if v := os.Getenv(name); v != "" {
+			if _, err := strconv.Atoi(v); err != nil {
+				problems = append(problems, name)
+			}
+		}
+	}
+	for _, name := range floats {
+		if v := os.Getenv(name); v != "" {
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				problems = append(problems, name)
+			}
+		}
+	}
+	switch p := os.Getenv("PAYMENT_PROVIDER"); p {
+	case "", "stripe", "mock":
+	default:
+		problems = append(problems, "PAYMENT_PROVIDER")
+	}
+	if key := os.Getenv("ALT_STRIPE_SECRET_KEY"); key != "" && !strings.HasPrefix(key, "sk_") && !strings.HasPrefix(key, "rk_") {
+		problems = append(problems, "ALT_STRIPE_SECRET_KEY")
+	}
+	if v := os.Getenv("STRIPE_API_VERSION_TARGET"); v != "" && !stripeVersionPattern.MatchString(v) {
+		problems = append(problems, "STRIPE_API_VERSION_TARGET")
+	}
+	switch p := os.Getenv("SHADOW_PROVIDER"); p {
+	case "", "mock":
+	case "stripe":
+		if key := os.Getenv("SHADOW_STRIPE_KEY"); !strings.HasPrefix(key, "sk_test_") && !strings.HasPrefix(key, "rk_test_") {
+			problems = append(problems, "SHADOW_STRIPE_KEY")
+		}
+	default:
+		problems = append(problems, "SHADOW_PROVIDER")
+	}
+	if _, err := parseMockDeclines(os.Getenv("MOCK_DECLINES")); err != nil {
+		problems = append(problems, "MOCK_DECLINES")
+	}
+
+	if len(problems) > 0 {
+		return checkFail, "invalid " + strings.Join(problems, ", ")
+	}
+	return checkPass, "all settings parse"
+}
+
+func checkRegion(context.Context) (checkStatus, string) {
+	if serviceRegion == "" {
+		return checkSkip, "REGION not set, data residency off"
+	}
+	if !regionPattern.MatchString(serviceRegion) {
+		return checkFail, fmt.Sprintf("invalid REGION %q", serviceRegion)
+	}
+	endpoints, err := parseRegionEndpoints(os.Getenv("REGION_ENDPOINTS"))
+	if err != nil {
+		return checkFail, err.Error()
+	}
+	if _, ok := endpoints[serviceRegion]; ok {
+		return checkWarn, "REGION_ENDPOINTS names this instance's own region " + serviceRegion
+	}
+	var others []string
+	for region := range endpoints {
+		others = append(others, region)
+	}
+	if len(others) == 0 {
+		return checkPass, "region " + serviceRegion + "; other regions' payments are refused"
+	}
+	sort.Strings(others)
+	return checkPass, "region " + serviceRegion + "; forwards to " + strings.Join(others, ", ")
+}
+
+func checkStripeKey(context.Context) (checkStatus, string) {
+	if mockProvider() {
+		return checkSkip, "PAYMENT_PROVIDER=mock"
+	}
+	key := regionEnv("STRIPE_SECRET_KEY")
+	switch {
+	case key == "":
+		return checkFail, "STRIPE_SECRET_KEY not set"
+	case strings.HasPrefix(key, "sk_test_"), strings.HasPrefix(key, "rk_test_"):
+		return checkPass, "test mode key"
+	case strings.HasPrefix(key, "sk_live_"), strings.HasPrefix(key, "rk_live_"):
+		return checkPass, "live mode key"
+	case strings.HasPrefix(key, "pk_"):
+		return checkFail, "STRIPE_SECRET_KEY is a publishable key"
+	}
+	return checkFail, "STRIPE_SECRET_KEY is not a Stripe secret key"
+}
+
+func checkStripeAPI(ctx context.Context) (checkStatus, string) {
+	if mockProvider() {
+		return checkSkip, "PAYMENT_PROVIDER=mock"
+	}
+	if regionEnv("STRIPE_SECRET_KEY") == "" {
+		return checkSkip, "no key"
+	}
+	stripe.Key = regionEnv("STRIPE_SECRET_KEY")
+	params := &stripe.BalanceParams{}
+	params.Context = ctx
+	b, err := balance.Get(params)
+	if err != nil {
+		var se *stripe.Error
+		if errors.As(err, &se) {
+			return checkFail, fmt.Sprintf("balance retrieve: %s (%s)", se.Msg, se.Code)
+		}
+		return checkFail, "balance retrieve: " + err.Error()
+	}
+	if target := os.Getenv("STRIPE_API_VERSION_TARGET"); target != "" && target != stripeAPIVersion {
+		// The target must be a version Stripe knows before reads are
+		// compared on it.
+		params := &stripe.BalanceParams{}
+		params.Context = ctx
+		params.Headers = http.Header{"Stripe-Version": []string{target}}
+		if _, err := balance.Get(params); err != nil {
+			return checkFail, fmt.Sprintf("balance retrieve on STRIPE_API_VERSION_TARGET %s: %v", target, err)
+		}
+		return checkPass, fmt.Sprintf("balance retrieved (livemode=%t) on %s and %s", b.Livemode, stripeAPIVersion, target)
+	}
+	return checkPass, fmt.Sprintf("balance retrieved (livemode=%t) on %s", b.Livemode, stripeAPIVersion)
+}
+
+func checkWebhookSecret(context.Context) (checkStatus, string) {
+	secret := regionEnv("STRIPE_WEBHOOK_SECRET")
+	switch {
+	case secret == "" && mockProvider():
+		return checkPass, "mock provider signs with " + mockWebhookSecret
+	case secret == "":
+		return checkWarn, "STRIPE_WEBHOOK_SECRET not set, webhooks will be rejected"
+	case !strings.HasPrefix(secret, "whsec_"):
+		return checkFail, "STRIPE_WEBHOOK_SECRET does not start with whsec_"
+	}
+	return checkPass, "set"
+}
+
+func checkRuntimeConfig(context.Context) (checkStatus, string) {
+	path := os.Getenv("RUNTIME_CONFIG_FILE")
+	if _, err := LoadRuntimeSettings(path); err != nil {
+		return checkFail, err.Error()
+	}
+	if path == "" {
+		return checkPass, "environment defaults"
+	}
+	return checkPass, path
+}
+
+func checkFeatureFlags(context.Context) (checkStatus, string) {
+	kind := os.Getenv("FEATURE_FLAG_PROVIDER")
+	if _, err := NewFlags(kind); err != nil {
+		return checkFail, err.Error()
+	}
+	if kind == "" {
+		kind = "none"
+	}
+	return checkPass, "provider " + kind
+}
+
+func checkDatabase(ctx context.Context) (checkStatus, string) {
+	dsn := regionEnv("DATABASE_URL")
+	if dsn == "" {
+		return checkSkip, "DATABASE_URL not set"
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return checkFail, err.Error()
+	}
+	defer db.Close()
+	if err := db.PingContext(ctx); err != nil {
+		return checkFail, "connect: " + err.Error()
+	}
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+		return checkFail, err.Error()
+	}
+	if !exists {
+		return checkWarn, "connected; schema not created yet (applied on startup)"
+	}
+	pending, err := pendingMigrations(ctx, db)
+	if err != nil {
+		return checkFail, err.Error()
+	}
+	if len(pending) > 0 {
+		return checkWarn, fmt.Sprintf("connected; %d migration(s) pending (applied on startup)", len(pending))
+	}
+	return checkPass, "connected; schema up to date"
+}
+
+// checkRedis speaks just enough RESP to authenticate and PING, so the check
+// doesn't need a client library.
+func checkRedis(ctx context.Context) (checkStatus, string) {
+	raw := regionEnv("REDIS_URL")
+	if raw == "" {
+		return checkSkip, "REDIS_URL not set"
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return checkFail, "invalid REDIS_URL"
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	if u.Scheme == "rediss" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: u.Hostname()}}).DialContext(ctx, "tcp", host)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return checkFail, "connect: " + err.Error()
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	rd := bufio.NewReader(conn)
+	command := func(args ...string) (string, error) {
+		var b strings.Builder
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, a := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+		}
+		if _, err := conn.Write([]byte(b.String())); err != nil {
+			return "", err
+		}
+		line, err := rd.ReadString('\n')
+		return strings.TrimSpace(line), err
+	}
+
+	if pass, ok := u.User.Password(); ok {
+		args := []string{"AUTH", pass}
+		if name := u.User.Username(); name != "" {
+			args = []string{"AUTH", name, pass}
+		}
+		if reply, err := command(args...); err != nil || !strings.HasPrefix(reply, "+OK") {
+			return checkFail, "auth failed: " + reply
+		}
+	}
+	reply, err := command("PING")
+	if err != nil {
+		return checkFail, "ping: " + err.Error()
+	}
+	if reply != "+PONG" {
+		return checkFail, "unexpected PING reply " + reply
+	}
+	return checkPass, "PONG from " + host
+}
+
+func checkBroker(ctx context.Context) (checkStatus, string) {
+	transport := os.Getenv("EVENT_TRANSPORT")
+	switch transport {
+	case "", "none":
+		return checkSkip, "EVENT_TRANSPORT=none"
+	case "log":
+		return checkPass, "events go to the service log"
+	case "kafka":
+	case "sns":
+		return checkSNS(ctx, os.Getenv("SNS_TOPIC_ARN_PREFIX"))
+	case "sqs":
+		return checkSQS(ctx, os.Getenv("SQS_QUEUE_URL_PREFIX"))
+	case "pubsub":
+		return checkPubSub(ctx, os.Getenv("PUBSUB_PROJECT_ID"), os.Getenv("PUBSUB_TOPIC_PREFIX"))
+	case "redis":
+		if regionEnv("REDIS_URL") == "" {
+			return checkFail, "REDIS_URL not set"
+		}
+		return checkRedis(ctx)
+	default:
+		return checkFail, fmt.Sprintf("unknown EVENT_TRANSPORT %q", transport)
+	}
+
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		return checkFail, "KAFKA_BROKERS not set"
+	}
+	var lastErr error
+	for _, addr := range strings.Split(brokers, ",") {
+		conn, err := kafka.DialContext(ctx, "tcp", strings.TrimSpace(addr))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer conn.Close()
+		cluster, err := conn.Brokers()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return checkPass, fmt.Sprintf("connected via %s, %d broker(s) in cluster", addr, len(cluster))
+	}
+	return checkFail, "no broker reachable: " + lastErr.Error()
+}
+
+func checkDiscovery(ctx context.Context) (checkStatus, string) {
+	d, err := NewDiscovery(os.Getenv("DISCOVERY_BACKEND"))
+	if err != nil {
+		return checkFail, err.Error()
+	}
+	if d == nil {
+		return checkSkip, "DISCOVERY_BACKEND not set"
+	}
+	if os.Getenv("MAILER_SERVICE_URL") != "" {
+		return checkPass, "configured; mailer uses a fixed URL"
+	}
+	addrs, err := d.Resolve(ctx, "mailer-service")
+	if err != nil {
+		return checkFail, "resolving mailer-service: " + err.Error()
+	}
+	return checkPass, fmt.Sprintf("mailer-service has %d instance(s)", len(addrs))
+}
+
+func checkOAuth2(ctx context.Context) (checkStatus, string) {
+	issuer := strings.TrimSuffix(os.Getenv("OAUTH2_ISSUER"), "/")
+	if issuer == "" {
+		return checkSkip, "OAUTH2_ISSUER not set"
+	}
+	if os.Getenv("OAUTH2_AUDIENCE") == "" {
+		return checkFail, "OAUTH2_AUDIENCE not set"
+	}
+	v := &OAuth2Verifier{issuer: issuer, jwksURL: os.Getenv("OAUTH2_JWKS_URL"), http: &http.Client{}}
+	if err := v.fetchKeys(ctx); err != nil {
+		return checkFail, err.Error()
+	}
+	return checkPass, fmt.Sprintf("%d signing key(s) from %s", len(v.keys), v.jwksURL)
+}
+
+func checkMailer(ctx context.Context) (checkStatus, string) {
+	raw := os.Getenv("MAILER_SERVICE_URL")
+	if raw == "" {
+		return checkSkip, "MAILER_SERVICE_URL not set"
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return checkFail, "invalid MAILER_SERVICE_URL"
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", host)
+	if err != nil {
+		return checkFail, "connect: " + err.Error()
+	}
+	conn.Close()
+	return checkPass, host + " reachable"
+}
+
+func checkExportDir(context.Context) (checkStatus, string) {
+	dir := os.Getenv("EXPORT_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return checkFail, err.Error()
+	}
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return checkFail, "not writable: " + err.Error()
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	status, detail := checkPass, dir+" writable"
+	if os.Getenv("EXPORT_SIGNING_KEY") == "" {
+		status, detail = checkWarn, detail+"; EXPORT_SIGNING_KEY not set"
+	}
+	return status, detail
+}
@@ -0,0 +1,865 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/invoice"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"golang.org/x/text/language"
+)
+
+// InvoiceProfiles are the seller details printed on receipt and invoice
+// PDFs. A tenant's profile overrides the default field by field.
+//
+//	"invoices": {
+//	  "default": {"seller_name": "Sucify GmbH", "address": ["Hauptstr. 1", "10115 Berlin"], "vat_id": "DE123456789",
+//	    "tax_rate": 19, "footer": "Amtsgericht Berlin HRB 12345", "attach_to_receipts": "invoice"},
+//	  "tenants": {"acme": {"seller_name": "Acme SARL", "vat_id": "FR12345678901", "tax_rate": 20, "language": "fr"}}
+//	}
+type InvoiceProfiles struct {
+	Default InvoiceProfile            `json:"default"`
+	Tenants map[string]InvoiceProfile `json:"tenants"`
+}
+
+type InvoiceProfile struct {
+	// SellerName defaults to RECEIPT_BRAND_NAME.
+	SellerName string   `json:"seller_name"`
+	Address    []string `json:"address"`
+	VATID      string   `json:"vat_id"`
+	// TaxRate is the VAT percentage included in what payments charge. An
+	// item in a payment's "items" metadata can carry its own tax_rate.
+	// Unset means no VAT.
+	TaxRate *float64 `json:"tax_rate"`
+	// NumberPrefix starts the invoice numbers given to payments. Empty
+	// means "INV-".
+	NumberPrefix string `json:"number_prefix"`
+	// Footer is printed at the bottom of every page.
+	Footer string `json:"footer"`
+	// Language is used when a download doesn't ask for one, before
+	// Accept-Language.
+	Language string `json:"language"`
+	// AttachToReceipts is "receipt" or "invoice" to attach that PDF to
+	// receipt emails. Empty attaches nothing.
+	AttachToReceipts string `json:"attach_to_receipts"`
+}
+
+// Document kinds.
+const (
+	documentReceipt = "receipt"
+	documentInvoice = "invoice"
+)
+
+const defaultInvoicePrefix = "INV-"
+
+func (p InvoiceProfiles) validate() error {
+	check := func(name string, profile InvoiceProfile) error {
+		if profile.TaxRate != nil && (*profile.TaxRate < 0 || *profile.TaxRate >= 100) {
+			return fmt.Errorf("invoices %s: tax_rate must be at least 0 and below 100", name)
+		}
+		if profile.Language != "" {
+			if _, err := language.Parse(profile.Language); err != nil {
+				return fmt.Errorf("invoices %s: invalid language %q", name, profile.Language)
+			}
+		}
+		switch profile.AttachToReceipts {
+		case "", documentReceipt, documentInvoice:
+		default:
+			return fmt.Errorf("invoices %s: attach_to_receipts must be receipt or invoice", name)
+		}
+		return nil
+	}
+	if err := check("default", p.Default); err != nil {
+		return err
+	}
+	for tenant, profile := range p.Tenants {
+		if err := check("tenants."+tenant, profile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// effective resolves one tenant's profile.
+func (p InvoiceProfiles) effective(tenantID string) InvoiceProfile {
+	out := p.Default
+	override, ok := p.Tenants[tenantID]
+	if tenantID == "" || !ok {
+		return out
+	}
+	for _, f := range []struct{ dst, src *string }{
+		{&out.SellerName, &override.SellerName},
+		{&out.VATID, &override.VATID},
+		{&out.NumberPrefix, &override.NumberPrefix},
+		{&out.Footer, &override.Footer},
+		{&out.Language, &override.Language},
+		{&out.AttachToReceipts, &override.AttachToReceipts},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+	if len(override.Address) > 0 {
+		out.Address = override.Address
+	}
+	if override.TaxRate != nil {
+		out.TaxRate = override.TaxRate
+	}
+	return out
+}
+
+func (p InvoiceProfile) taxRate() float64 {
+	if p.TaxRate == nil {
+		return 0
+	}
+	return *p.TaxRate
+}
+
+func (p InvoiceProfile) numberPrefix() string {
+	if p.NumberPrefix == "" {
+		return defaultInvoicePrefix
+	}
+	return p.NumberPrefix
+}
+
+// PaymentInvoiceNumber returns the number and issue date of a payment's
+// invoice, giving it the tenant's next number the first time. Numbers
+// are gap-free: a render that loses the race for a payment rolls its
+// increment back and reads the winner's number.
+func (s *Store) PaymentInvoiceNumber(ctx context.Context, paymentID, tenantID, prefix string) (string, time.Time, error) {
+	var number string
+	var issued time.Time
+	lookup := func() error {
+		return s.db.QueryRowContext(ctx, `
+			SELECT number, issued_at FROM payment_invoices WHERE payment_id = $1`, paymentID).Scan(&number, &issued)
+	}
+	if err := lookup(); !errors.Is(err, sql.ErrNoRows) {
+		return number, issued, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var next int64
+	if err := tx.QueryRowContext(ctx, `
+		INSERT INTO invoice_sequences (tenant_id, last_number) VALUES ($1, 1)
+		ON CONFLICT (tenant_id) DO UPDATE SET last_number = invoice_sequences.last_number + 1
+		RETURNING last_number`, tenantID).Scan(&next); err != nil {
+		return "", time.Time{}, err
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO payment_invoices (payment_id, tenant_id, number) VALUES ($1, $2, $3)
+		ON CONFLICT (payment_id) DO NOTHING
+		RETURNING number, issued_at`, paymentID, tenantID, fmt.Sprintf("%s%06d", prefix, next)).Scan(&number, &issued)
+	if errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		return number, issued, lookup()
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return number, issued, tx.Commit()
+}
+
+// document is a receipt or invoice laid out for printing. Amounts are in
+// minor units of currency.
+type document struct {
+	kind      string
+	lang      language.Tag
+	seller    InvoiceProfile
+	number    string
+	reference string
+	issued    time.Time
+	paid      time.Time
+	currency  string
+	buyer     []string
+	lines     []documentLine
+	taxes     []documentTax
+	net       int64
+	tax       int64
+	total     int64
+	payments  []documentPayment
+	refunded  int64
+	// taxIncluded is set when line amounts include VAT, as they do for
+	// payments; Stripe invoices list lines before tax.
+	taxIncluded bool
+	// taxTreatment is taxReverseCharge or taxZeroRated for a sale to a
+	// business charged no VAT; the document says why.
+	taxTreatment string
+	// rounding is how the VAT a payment's lines include is rounded.
+	rounding RoundingMode
+}
+
+type documentLine struct {
+	description string
+	quantity    int64
+	unitAmount  int64
+	amount      int64
+	taxRate     *float64
+}
+
+type documentTax struct {
+	rate float64
+	net  int64
+	tax  int64
+}
+
+type documentPayment struct {
+	label  string
+	amount int64
+}
+
+// summarizeIncludedTax works out the VAT contained in each rate's lines
+// and the document totals, for line amounts that include it.
+func (doc *document) summarizeIncludedTax() {
+	gross := map[float64]int64{}
+	for _, l := range doc.lines {
+		var rate float64
+		if l.taxRate != nil {
+			rate = *l.taxRate
+		}
+		gross[rate] += l.amount
+		doc.total += l.amount
+	}
+	for rate, amount := range gross {
+		tax := includedTax(amount, rate, doc.rounding)
+		doc.taxes = append(doc.taxes, documentTax{rate: rate, net: amount - tax, tax: tax})
+		doc.tax += tax
+	}
+	sort.Slice(doc.taxes, func(i, j int) bool { return doc.taxes[i].rate > doc.taxes[j].rate })
+	doc.net = doc.total - doc.tax
+}
+
+// discountLines spreads a discount over the VAT rates of lines, in
+// proportion to their amounts, one line per rate. The shares add up to
+// the discount to the minor unit.
+func discountLines(lines []documentLine, discount int64, description string) ([]documentLine, error) {
+	var rates []*float64
+	var weights []int64
+	for _, l := range lines {
+		i := 0
+		for ; i < len(rates); i++ {
+			if sameRate(rates[i], l.taxRate) {
+				break
+			}
+		}
+		if i == len(rates) {
+			rates, weights = append(rates, l.taxRate), append(weights, 0)
+		}
+		weights[i] += max(l.amount, 0)
+	}
+	shares, err := allocate(discount, weights)
+	if err != nil {
+		return nil, err
+	}
+	out := []documentLine{}
+	for i, share := range shares {
+		if share > 0 {
+			out = append(out, documentLine{description: description, amount: -share, taxRate: rates[i]})
+		}
+	}
+	return out, nil
+}
+
+func sameRate(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func (doc *document) filename() string {
+	if doc.kind == documentInvoice && doc.number != "" {
+		return strings.Map(func(r rune) rune {
+			if r == '/' || r == '\\' || r == '"' {
+				return '-'
+			}
+			return r
+		}, doc.number) + ".pdf"
+	}
+	return doc.kind + "-" + doc.reference + ".pdf"
+}
+
+func formatTaxRate(rate float64) string {
+	return strconv.FormatFloat(rate, 'f', -1, 64) + "%"
+}
+
+// Page geometry, in points.
+const (
+	docLeft   = 50.0
+	docRight  = 545.0
+	docBottom = 770.0
+)
+
+// pdf lays the document out on as many pages as its lines need.
+func (doc *document) pdf() []byte {
+	label := func(key string) string { return documentLabel(doc.lang, key) }
+	w := newPDFWriter()
+
+	// Seller on the left, document title and references on the right.
+	w.Text(docLeft, 70, 16, true, doc.seller.SellerName)
+	y := 86.0
+	for _, line := range doc.seller.Address {
+		w.Text(docLeft, y, 9, false, line)
+		y += 12
+	}
+	if doc.seller.VATID != "" {
+		w.Text(docLeft, y, 9, false, label("vat_id")+" "+doc.seller.VATID)
+	}
+	w.TextRight(docRight, 70, 20, true, label(doc.kind))
+	refs := [][2]string{}
+	if doc.number != "" {
+		refs = append(refs, [2]string{label("invoice_number"), doc.number})
+	}
+	refs = append(refs, [2]string{label("payment_reference"), doc.reference})
+	if doc.kind == documentInvoice {
+		refs = append(refs, [2]string{label("issue_date"), doc.issued.UTC().Format("2006-01-02")})
+	}
+	if !doc.paid.IsZero() {
+		refs = append(refs, [2]string{label("payment_date"), doc.paid.UTC().Format("2006-01-02")})
+	}
+	y = 92
+	for _, ref := range refs {
+		w.Text(340, y, 9, true, ref[0])
+		w.TextRight(docRight, y, 9, false, ref[1])
+		y += 12
+	}
+
+	y = 170
+	if len(doc.buyer) > 0 {
+		w.Text(docLeft, y, 9, true, label("billed_to"))
+		for _, line := range doc.buyer {
+			y += 12
+			w.Text(docLeft, y, 9, false, line)
+		}
+	}
+
+	header := func(y float64) float64 {
+		w.Text(docLeft, y, 9, true, label("description"))
+		w.TextRight(320, y, 9, true, label("quantity"))
+		w.TextRight(400, y, 9, true, label("unit_price"))
+		w.TextRight(460, y, 9, true, label("tax_rate"))
+		w.TextRight(docRight, y, 9, true, label("amount"))
+		w.Line(docLeft, docRight, y+5)
+		return y + 20
+	}
+	// room makes sure the next h points fit on the page.
+	room := func(y, h float64) float64 {
+		if y+h <= docBottom {
+			return y
+		}
+		w.AddPage()
+		return header(70)
+	}
+
+	y = header(math.Max(y+40, 250))
+	for _, l := range doc.lines {
+		y = room(y, 16)
+		w.Text(docLeft, y, 9, false, fitText(l.description, 210, 9, false))
+		if l.quantity > 0 {
+			w.TextRight(320, y, 9, false, strconv.FormatInt(l.quantity, 10))
+			w.TextRight(400, y, 9, false, formatAmount(l.unitAmount, doc.currency))
+		}
+		if l.taxRate != nil {
+			w.TextRight(460, y, 9, false, formatTaxRate(*l.taxRate))
+		}
+		w.TextRight(docRight, y, 9, false, formatAmount(l.amount, doc.currency))
+		y += 16
+	}
+	w.Line(docLeft, docRight, y-10)
+
+	totals := [][2]string{
+		{label("net"), formatAmount(doc.net, doc.currency)},
+		{label("tax"), formatAmount(doc.tax, doc.currency)},
+	}
+	y = room(y, float64(16*(len(totals)+2+len(doc.payments))))
+	for _, t := range totals {
+		w.Text(340, y, 9, false, t[0])
+		w.TextRight(docRight, y, 9, false, t[1])
+		y += 14
+	}
+	w.Text(340, y+2, 11, true, label("total"))
+	w.TextRight(docRight, y+2, 11, true, formatAmount(doc.total, doc.currency))
+	y += 22
+	for _, p := range doc.payments {
+		w.Text(340, y, 9, false, p.label)
+		w.TextRight(docRight, y, 9, false, formatAmount(p.amount, doc.currency))
+		y += 14
+	}
+	if doc.refunded > 0 {
+		w.Text(340, y, 9, false, label("refunded"))
+		w.TextRight(docRight, y, 9, false, formatAmount(-doc.refunded, doc.currency))
+		y += 14
+	}
+
+	if len(doc.taxes) > 0 && doc.tax != 0 {
+		y = room(y+16, float64(30+14*len(doc.taxes)))
+		w.Text(docLeft, y, 9, true, label("tax_summary"))
+		w.TextRight(200, y, 9, true, label("tax_rate"))
+		w.TextRight(300, y, 9, true, label("net"))
+		w.TextRight(400, y, 9, true, label("tax"))
+		y += 14
+		for _, t := range doc.taxes {
+			w.TextRight(200, y, 9, false, formatTaxRate(t.rate))
+			w.TextRight(300, y, 9, false, formatAmount(t.net, doc.currency))
+			w.TextRight(400, y, 9, false, formatAmount(t.tax, doc.currency))
+			y += 14
+		}
+	}
+	if doc.taxIncluded && doc.tax != 0 {
+		y = room(y+10, 14)
+		w.Text(docLeft, y, 8, false, label("prices_include_tax"))
+	}
+	if doc.taxTreatment != "" {
+		y = room(y+10, 14)
+		w.Text(docLeft, y, 8, false, fitText(label(doc.taxTreatment), docRight-docLeft, 8, false))
+	}
+
+	// Footers go on last, once the page count is known.
+	pages := w.Pages()
+	for i := 0; i < pages; i++ {
+		w.SetPage(i)
+		w.Line(docLeft, docRight, 800)
+		if doc.seller.Footer != "" {
+			w.Text(docLeft, 812, 8, false, fitText(doc.seller.Footer, 420, 8, false))
+		}
+		w.TextRight(docRight, 812, 8, false, fmt.Sprintf("%s %d/%d", label("page"), i+1, pages))
+	}
+	return w.Bytes()
+}
+
+// fitText shortens s with an ellipsis to fit width.
+func fitText(s string, width, size float64, bold bool) string {
+	if pdfTextWidth(s, size, bold) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && pdfTextWidth(string(runes)+"…", size, bold) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "…"
+}
+
+// Documents renders receipt and invoice PDFs for payments and Stripe
+// invoices, laid out with the tenant's invoice profile and localized,
+// and hands out signed links to download them without an API key.
+// Invoices for payments are numbered by the store; Stripe invoices keep
+// Stripe's numbers.
+type Documents struct {
+	store      *Store
+	settings   *RuntimeSettings
+	brand      string
+	signingKey []byte
+	baseURL    string
+	ttl        time.Duration
+}
+
+func NewDocuments(store *Store, settings *RuntimeSettings, brand string, signingKey []byte, baseURL string, ttl time.Duration) *Documents {
+	return &Documents{store: store, settings: settings, brand: brand, signingKey: signingKey, baseURL: baseURL, ttl: ttl}
+}
+
+// RegisterRoutes mounts link creation under the documents scope and the
+// signed downloads, which take no API key.
+func (d *Documents) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	r.POST("/documents", requireScope(d.store, bootstrapToken, "documents"), d.link)
+	r.GET("/documents/:kind/:id", d.download)
+}
+
+func (d *Documents) profile(tenantID string) InvoiceProfile {
+	p := d.settings.Get().Invoices.effective(tenantID)
+	if p.SellerName == "" {
+		p.SellerName = d.brand
+	}
+	return p
+}
+
+// documentLanguage picks the first of requested, the profile's language
+// and Accept-Language that is given.
+func documentLanguage(requested string, profile InvoiceProfile, accept string) language.Tag {
+	for _, l := range []string{requested, profile.Language} {
+		if tag, err := language.Parse(l); l != "" && err == nil {
+			_, idx, _ := languageMatcher.Match(tag)
+			return supportedLanguages[idx]
+		}
+	}
+	prefs, _, _ := language.ParseAcceptLanguage(accept)
+	_, idx, _ := languageMatcher.Match(prefs...)
+	return supportedLanguages[idx]
+}
+
+// build fetches and lays out the document for a payment (pi_) or Stripe
+// invoice (in_). Documents that can't be produced come back as a
+// *refusal.
+func (d *Documents) build(ctx context.Context, kind, id, lang, accept string) (*document, error) {
+	if strings.HasPrefix(id, "in_") {
+		params := &stripe.InvoiceParams{}
+		params.Context = ctx
+		params.AddExpand("total_tax_amounts.tax_rate")
+		inv, err := invoice.Get(id, params)
+		if err != nil {
+			return nil, err
+		}
+		return d.invoiceDocument(ctx, inv, lang, accept)
+	}
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	params.AddExpand("latest_charge")
+	params.AddExpand("customer")
+	pi, err := paymentintent.Get(id, params)
+	if err != nil {
+		return nil, err
+	}
+	return d.paymentDocument(ctx, kind, pi, lang, accept)
+}
+
+// paymentDocument lays out a payment. Amounts charged include VAT, so the
+// lines are the payment's items at their gross amounts, then any
+// discount, split over the items' VAT rates, any card surcharge, and the
+// tip, which carries no VAT. Items that don't add up
+// to what was charged, or a payment without any, print as one line. A
+// payment recorded as reverse-charged or zero-rated carries no VAT at
+// all and prints the buyer's tax ID and why. Loyalty
+// points are tender rather than a price reduction: they are listed with
+// the card as part of what paid the total.
+func (d *Documents) paymentDocument(ctx context.Context, kind string, pi *stripe.PaymentIntent, lang, accept string) (*document, error) {
+	if pi.Status != stripe.PaymentIntentStatusSucceeded {
+		return nil, &refusal{http.StatusConflict, CodePaymentState, "The payment is " + string(pi.Status) + " and has no " + kind, nil}
+	}
+	tenantID := pi.Metadata["tenant_id"]
+	profile := d.profile(tenantID)
+	doc := &document{
+		kind:        kind,
+		lang:        documentLanguage(lang, profile, accept),
+		seller:      profile,
+		reference:   pi.ID,
+		paid:        time.Unix(pi.Created, 0),
+		currency:    string(pi.Currency),
+		taxIncluded: true,
+		rounding:    d.settings.Get().Rounding.mode(string(pi.Currency)),
+	}
+	doc.issued = doc.paid
+	if kind == documentInvoice {
+		if d.store == nil {
+			return nil, &refusal{http.StatusServiceUnavailable, CodeNotConfigured, "Invoices for payments require DATABASE_URL", nil}
+		}
+		number, issued, err := d.store.PaymentInvoiceNumber(ctx, pi.ID, tenantID, profile.numberPrefix())
+		if err != nil {
+			return nil, err
+		}
+		doc.number, doc.issued = number, issued
+	}
+	if cust := pi.Customer; cust != nil {
+		doc.buyer = append(doc.buyer, cust.Name)
+		doc.buyer = append(doc.buyer, addressLines(cust.Address)...)
+	}
+	if email := receiptEmail(pi); email != "" {
+		doc.buyer = append(doc.buyer, email)
+	}
+	if treatment := pi.Metadata[metadataTaxTreatment]; treatment != "" {
+		doc.taxTreatment = treatment
+		doc.buyer = append(doc.buyer, documentLabel(doc.lang, "vat_id")+" "+pi.Metadata[metadataCustomerTaxID])
+	}
+	doc.buyer = nonEmpty(doc.buyer)
+
+	charged := pi.AmountReceived
+	if charged == 0 {
+		charged = pi.Amount
+	}
+	tip, _ := tipOf(pi)
+	discount, _ := strconv.ParseInt(pi.Metadata[metadataDiscount], 10, 64)
+	points, _ := strconv.ParseInt(pi.Metadata[metadataPointsValue], 10, 64)
+	surcharge := surchargeOf(pi)
+	goods := charged + points + discount - tip - surcharge
+	rate := profile.TaxRate
+	if doc.taxTreatment != "" {
+		zero := 0.0
+		rate = &zero
+	}
+
+	var items []ReceiptItem
+	if raw := pi.Metadata["items"]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &items); err != nil {
+			log.Printf("%s for %s: ignoring malformed items metadata: %v", kind, pi.ID, err)
+		}
+	}
+	var itemsTotal int64
+	for _, item := range items {
+		if item.Quantity < 1 {
+			item.Quantity = 1
+		}
+		line := documentLine{
+			description: item.Name,
+			quantity:    item.Quantity,
+			unitAmount:  item.Amount,
+			amount:      item.Amount * item.Quantity,
+			taxRate:     rate,
+		}
+		if item.TaxRate != nil && doc.taxTreatment == "" {
+			line.taxRate = item.TaxRate
+		}
+		doc.lines = append(doc.lines, line)
+		itemsTotal += line.amount
+	}
+	if itemsTotal != goods {
+		description := pi.Description
+		if description == "" {
+			description = documentLabel(doc.lang, "payment") + " " + pi.ID
+		}
+		doc.lines = []documentLine{{description: description, amount: goods, taxRate: rate}}
+	}
+	if discount > 0 {
+		lines, err := discountLines(doc.lines, discount, documentLabel(doc.lang, "discount"))
+		if err != nil {
+			return nil, err
+		}
+		doc.lines = append(doc.lines, lines...)
+	}
+	if surcharge > 0 {
+		doc.lines = append(doc.lines, documentLine{description: documentLabel(doc.lang, "card_surcharge"), amount: surcharge, taxRate: rate})
+	}
+	if tip > 0 {
+		zero := 0.0
+		doc.lines = append(doc.lines, documentLine{description: documentLabel(doc.lang, "tip"), amount: tip, taxRate: &zero})
+	}
+	doc.summarizeIncludedTax()
+
+	if points > 0 {
+		doc.payments = append(doc.payments, documentPayment{documentLabel(doc.lang, "paid_points"), points})
+	}
+	paidCard := documentLabel(doc.lang, "paid_card")
+	if ch := pi.LatestCharge; ch != nil {
+		if pmd := ch.PaymentMethodDetails; pmd != nil && pmd.Card != nil {
+			paidCard += " (" + titleCase(string(pmd.Card.Brand)) + " " + pmd.Card.Last4 + ")"
+		}
+		doc.refunded = ch.AmountRefunded
+	}
+	doc.payments = append(doc.payments, documentPayment{paidCard, charged})
+	return doc, nil
+}
+
+// invoiceDocument lays out a finalized Stripe invoice with Stripe's
+// number, lines before tax and tax amounts. Stripe decides the tax; a
+// customer Stripe reverse-charges gets the reverse-charge note.
+func (d *Documents) invoiceDocument(ctx context.Context, inv *stripe.Invoice, lang, accept string) (*document, error) {
+	if inv.Status == stripe.InvoiceStatusDraft || inv.Number == "" {
+		return nil, &refusal{http.StatusConflict, CodePaymentState, "The invoice is still a draft", nil}
+	}
+	profile := d.profile(invoiceTenant(inv))
+	doc := &document{
+		kind:      documentInvoice,
+		lang:      documentLanguage(lang, profile, accept),
+		seller:    profile,
+		number:    inv.Number,
+		reference: inv.ID,
+		issued:    time.Unix(inv.Created, 0),
+		currency:  string(inv.Currency),
+		net:       inv.TotalExcludingTax,
+		tax:       inv.Tax,
+		total:     inv.Total,
+	}
+	if st := inv.StatusTransitions; st != nil {
+		if st.FinalizedAt > 0 {
+			doc.issued = time.Unix(st.FinalizedAt, 0)
+		}
+		if st.PaidAt > 0 {
+			doc.paid = time.Unix(st.PaidAt, 0)
+		}
+	}
+	doc.buyer = append(doc.buyer, inv.CustomerName)
+	doc.buyer = append(doc.buyer, addressLines(inv.CustomerAddress)...)
+	doc.buyer = append(doc.buyer, inv.CustomerEmail)
+	for _, id := range inv.CustomerTaxIDs {
+		doc.buyer = append(doc.buyer, documentLabel(doc.lang, "vat_id")+" "+id.Value)
+	}
+	doc.buyer = nonEmpty(doc.buyer)
+	if inv.CustomerTaxExempt != nil && *inv.CustomerTaxExempt == stripe.CustomerTaxExemptReverse {
+		doc.taxTreatment = taxReverseCharge
+	}
+
+	rates := map[string]float64{}
+	for _, t := range inv.TotalTaxAmounts {
+		var rate float64
+		if t.TaxRate != nil {
+			rate = t.TaxRate.Percentage
+			rates[t.TaxRate.ID] = rate
+		}
+		doc.taxes = append(doc.taxes, documentTax{rate: rate, net: t.TaxableAmount, tax: t.Amount})
+		doc.taxIncluded = doc.taxIncluded || t.Inclusive
+	}
+
+	lines := inv.Lines.Data
+	if inv.Lines.HasMore {
+		lines = nil
+		it := invoice.ListLines(&stripe.InvoiceListLinesParams{Invoice: stripe.String(inv.ID), ListParams: stripe.ListParams{Context: ctx}})
+		for it.Next() {
+			lines = append(lines, it.InvoiceLineItem())
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, li := range lines {
+		line := documentLine{description: li.Description, quantity: li.Quantity, amount: li.AmountExcludingTax}
+		if li.Quantity > 0 {
+			line.unitAmount = int64(math.Round(li.UnitAmountExcludingTax))
+		}
+		for _, t := range li.TaxAmounts {
+			if t.TaxRate == nil {
+				continue
+			}
+			if rate, ok := rates[t.TaxRate.ID]; ok {
+				line.taxRate = &rate
+				break
+			}
+		}
+		doc.lines = append(doc.lines, line)
+	}
+	var discount int64
+	for _, da := range inv.TotalDiscountAmounts {
+		discount += da.Amount
+	}
+	if discount > 0 {
+		doc.lines = append(doc.lines, documentLine{description: documentLabel(doc.lang, "discount"), amount: -discount})
+	}
+	// Inclusive tax is already in the line amounts Stripe reports, so the
+	// printed lines are the ones before tax either way.
+	doc.taxIncluded = false
+	if inv.AmountPaid > 0 {
+		doc.payments = append(doc.payments, documentPayment{documentLabel(doc.lang, "paid"), inv.AmountPaid})
+	}
+	return doc, nil
+}
+
+func addressLines(a *stripe.Address) []string {
+	if a == nil {
+		return nil
+	}
+	return []string{a.Line1, a.Line2, strings.TrimSpace(a.PostalCode + " " + a.City), a.State, a.Country}
+}
+
+func nonEmpty(lines []string) []string {
+	out := lines[:0]
+	for _, l := range lines {
+		if l = strings.TrimSpace(l); l != "" {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// Attachment renders the PDF the tenant's profile attaches to pi's
+// receipt email, or returns nil when it attaches none.
+func (d *Documents) Attachment(ctx context.Context, pi *stripe.PaymentIntent) (*Attachment, error) {
+	kind := d.profile(pi.Metadata["tenant_id"]).AttachToReceipts
+	if kind == "" {
+		return nil, nil
+	}
+	doc, err := d.paymentDocument(ctx, kind, pi, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return &Attachment{Filename: doc.filename(), ContentType: "application/pdf", Content: doc.pdf()}, nil
+}
+
+func (d *Documents) sign(kind, id, lang string, expires int64) string {
+	mac := hmac.New(sha256.New, d.signingKey)
+	fmt.Fprintf(mac, "document:%s:%s:%s:%d", kind, id, lang, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// link checks the document can be produced and returns a signed download
+// link for it. Invoices for payments get their number here if they don't
+// have one yet.
+func (d *Documents) link(c *gin.Context) {
+	var req struct {
+		Kind     string `json:"kind" binding:"required,oneof=receipt invoice"`
+		ID       string `json:"id" binding:"required"`
+		Language string `json:"language"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	switch {
+	case strings.HasPrefix(req.ID, "in_"):
+		if req.Kind != documentInvoice {
+			validationFailed(c, []FieldError{{Field: "kind", Code: "invalid_choice", Message: "Stripe invoices only have an invoice document"}})
+			return
+		}
+	case !strings.HasPrefix(req.ID, "pi_"):
+		validationFailed(c, []FieldError{{Field: "id", Code: "invalid", Message: "must be a payment (pi_) or invoice (in_) ID"}})
+		return
+	}
+	if req.Language != "" {
+		if _, err := language.Parse(req.Language); err != nil {
+			validationFailed(c, []FieldError{{Field: "language", Code: "invalid", Message: "must be a language tag such as de or fr-CA"}})
+			return
+		}
+	}
+	if _, err := d.build(c.Request.Context(), req.Kind, req.ID, req.Language, ""); err != nil {
+		d.respondBuildError(c, err)
+		return
+	}
+
+	expires := time.Now().Add(d.ttl).Unix()
+	q := url.Values{}
+	if req.Language != "" {
+		q.Set("lang", req.Language)
+	}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("signature", d.sign(req.Kind, req.ID, req.Language, expires))
+	respondData(c, http.StatusOK, gin.H{
+		"url":        fmt.Sprintf("%s/documents/%s/%s?%s", d.baseURL, req.Kind, url.PathEscape(req.ID), q.Encode()),
+		"expires_at": unixRFC3339(expires),
+	})
+}
+
+func (d *Documents) download(c *gin.Context) {
+	kind, id, lang := c.Param("kind"), c.Param("id"), c.Query("lang")
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires ||
+		!hmac.Equal([]byte(c.Query("signature")), []byte(d.sign(kind, id, lang, expires))) {
+		c.JSON(http.StatusForbidden, errorBody(c, CodeForbidden, "Invalid or expired download link"))
+		return
+	}
+	doc, err := d.build(c.Request.Context(), kind, id, lang, c.GetHeader("Accept-Language"))
+	if err != nil {
+		d.respondBuildError(c, err)
+		return
+	}
+	c.Header("Content-Disposition", `inline; filename="`+doc.filename()+`"`)
+	c.Header("Cache-Control", "private, no-store")
+	c.Data(http.StatusOK, "application/pdf", doc.pdf())
+}
+
+func (d *Documents) respondBuildError(c *gin.Context, err error) {
+	var refused *refusal
+	if errors.As(err, &refused) {
+		c.JSON(refused.status, errorBodyWith(c, refused.code, refused.message, refused.ext))
+		return
+	}
+	var se *stripe.Error
+	if errors.As(err, &se) {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+}
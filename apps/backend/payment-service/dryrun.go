@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// isDryRun reports whether a mutating request asked to be validated and
+// priced without touching the provider, via ?dry_run=true or X-Dry-Run.
+func isDryRun(c *gin.Context) bool {
+	v := c.Query("dry_run")
+	if v == "" {
+		v = c.GetHeader("X-Dry-Run")
+	}
+	ok, _ := strconv.ParseBool(strings.TrimSpace(v))
+	return ok
+}
+
+// FeeSchedule estimates processing fees as a percentage plus a fixed
+// amount in the charge currency's minor unit. It mirrors the contracted
+// Stripe rate closely enough for previews; balance transactions remain the
+// source of truth.
+type FeeSchedule struct {
+	Percent float64
+	Fixed   int64
+}
+
+// feeScheduleFromEnv reads PROCESSING_FEE_PERCENT and PROCESSING_FEE_FIXED,
+// defaulting to Stripe's standard card pricing.
+func feeScheduleFromEnv() FeeSchedule {
+	fs := FeeSchedule{Percent: 2.9, Fixed: 30}
+	if v := os.Getenv("PROCESSING_FEE_PERCENT"); v != "" {
+		if p, err := strconv.ParseFloat(v, 64); err == nil {
+			fs.Percent = p
+		}
+	}
+	if v := os.Getenv("PROCESSING_FEE_FIXED"); v != "" {
+		if f, err := strconv.ParseInt(v, 10, 64); err == nil {
+			fs.Fixed = f
+		}
+	}
+	return fs
+}
+
+// Estimate returns the fee and net for amount, rounding the fee half-up.
+func (fs FeeSchedule) Estimate(amount int64) (fee, net int64) {
+	fee = percentOf(amount, fs.Percent, roundHalfUp) + fs.Fixed
+	if fee > amount {
+		fee = amount
+	}
+	return fee, amount - fee
+}
+
+// dryRunIntent describes the PaymentIntent create would send to Stripe.
+func dryRunIntent(params *stripe.PaymentIntentParams, fees FeeSchedule) gin.H {
+	amount := stripe.Int64Value(params.Amount)
+	fee, net := fees.Estimate(amount)
+
+	intent := gin.H{
+		"amount":   amount,
+		"currency": strings.ToLower(stripe.StringValue(params.Currency)),
+		"metadata": params.Metadata,
+	}
+	if params.Description != nil {
+		intent["description"] = *params.Description
+	}
+	if params.Customer != nil {
+		intent["customer_id"] = *params.Customer
+	}
+	if params.CaptureMethod != nil {
+		intent["capture_method"] = *params.CaptureMethod
+	}
+	if params.AutomaticPaymentMethods != nil {
+		intent["automatic_payment_methods"] = true
+	}
+	if len(params.PaymentMethodTypes) > 0 {
+		types := make([]string, 0, len(params.PaymentMethodTypes))
+		for _, t := range params.PaymentMethodTypes {
+			types = append(types, stripe.StringValue(t))
+		}
+		intent["payment_method_types"] = types
+	}
+
+	return gin.H{
+		"dry_run":       true,
+		"payment":       intent,
+		"estimated_fee": fee,
+		"estimated_net": net,
+	}
+}
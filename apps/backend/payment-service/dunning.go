@@ -0,0 +1,719 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/invoice"
+	"github.com/stripe/stripe-go/v76/subscription"
+)
+
+//go:embed templates/dunning.html
+var dunningTemplates embed.FS
+
+// DunningPolicies decide how failed subscription invoices are chased. A
+// tenant's policy overrides the default field by field. Dunning assumes
+// Stripe's own retries and end-of-dunning cancellation are turned off for
+// these subscriptions, since both would race it.
+//
+//	"dunning": {
+//	  "default": {"retry_schedule_hours": [24, 72, 120], "grace_period_hours": 72},
+//	  "tenants": {"acme": {"retry_schedule_hours": [12, 48], "grace_period_hours": 0}}
+//	}
+type DunningPolicies struct {
+	Default DunningPolicy            `json:"default"`
+	Tenants map[string]DunningPolicy `json:"tenants"`
+}
+
+type DunningPolicy struct {
+	// RetryScheduleHours are the waits before each retry, counted from the
+	// failure before it. Once they run out the grace period starts.
+	RetryScheduleHours []int `json:"retry_schedule_hours"`
+	// GracePeriodHours is how long the subscription keeps running after
+	// the last retry fails before it is canceled.
+	GracePeriodHours *int `json:"grace_period_hours"`
+}
+
+// defaultDunningSchedule and defaultDunningGrace apply when no policy
+// sets them.
+var defaultDunningSchedule = []int{24, 72, 120}
+
+const defaultDunningGrace = 72
+
+func (p DunningPolicies) validate() error {
+	check := func(name string, policy DunningPolicy) error {
+		for _, h := range policy.RetryScheduleHours {
+			if h <= 0 {
+				return fmt.Errorf("dunning %s: retry_schedule_hours must be positive", name)
+			}
+		}
+		if policy.GracePeriodHours != nil && *policy.GracePeriodHours < 0 {
+			return fmt.Errorf("dunning %s: grace_period_hours must not be negative", name)
+		}
+		return nil
+	}
+	if err := check("default", p.Default); err != nil {
+		return err
+	}
+	for tenant, policy := range p.Tenants {
+		if err := check("tenants."+tenant, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// effective resolves the retry schedule and grace period for one tenant.
+func (p DunningPolicies) effective(tenantID string) (schedule []time.Duration, grace time.Duration) {
+	hours, graceHours := defaultDunningSchedule, defaultDunningGrace
+	for i, policy := range []DunningPolicy{p.Default, p.Tenants[tenantID]} {
+		if i == 1 && tenantID == "" {
+			break
+		}
+		if len(policy.RetryScheduleHours) > 0 {
+			hours = policy.RetryScheduleHours
+		}
+		if policy.GracePeriodHours != nil {
+			graceHours = *policy.GracePeriodHours
+		}
+	}
+	for _, h := range hours {
+		schedule = append(schedule, time.Duration(h)*time.Hour)
+	}
+	return schedule, time.Duration(graceHours) * time.Hour
+}
+
+// Dunning case statuses. Retrying and grace cases are open; the rest are
+// how a case ended: the invoice was paid, the subscription was canceled,
+// or the invoice was voided or written off outside dunning.
+const (
+	dunningRetrying  = "retrying"
+	dunningGrace     = "grace"
+	dunningRecovered = "recovered"
+	dunningCanceled  = "canceled"
+	dunningClosed    = "closed"
+)
+
+// dunningLease is how long a claimed retry or cancellation stays claimed,
+// so an instance that dies mid-call is covered by another.
+const dunningLease = 10 * time.Minute
+
+// DunningCase tracks one unpaid subscription invoice from its first
+// failure to the end of dunning.
+type DunningCase struct {
+	ID             string `json:"id"`
+	SubscriptionID string `json:"subscription_id"`
+	InvoiceID      string `json:"invoice_id"`
+	InvoiceURL     string `json:"invoice_url,omitempty"`
+	CustomerID     string `json:"customer_id,omitempty"`
+	CustomerEmail  string `json:"-"`
+	TenantID       string `json:"tenant_id,omitempty"`
+	Currency       string `json:"currency"`
+	AmountDue      int64  `json:"amount_due"`
+	Status         string `json:"status"`
+	// Attempts is Stripe's count of payment attempts on the invoice.
+	Attempts    int64      `json:"attempts"`
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
+	GraceEndsAt *time.Time `json:"grace_ends_at,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+func (c *DunningCase) open() bool {
+	return c.Status == dunningRetrying || c.Status == dunningGrace
+}
+
+// DunningEvent is one entry in a case's history.
+type DunningEvent struct {
+	Type      string    `json:"type"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const dunningCaseColumns = `id, subscription_id, invoice_id, invoice_url, customer_id, customer_email, tenant_id, currency,
+	amount_due, status, attempts, next_retry_at, grace_ends_at, last_error, resolved_at, created_at, updated_at`
+
+func scanDunningCase(row interface{ Scan(...interface{}) error }) (*DunningCase, error) {
+	var c DunningCase
+	var nextRetry, graceEnds, resolved sql.NullTime
+	if err := row.Scan(&c.ID, &c.SubscriptionID, &c.InvoiceID, &c.InvoiceURL, &c.CustomerID, &c.CustomerEmail,
+		&c.TenantID, &c.Currency, &c.AmountDue, &c.Status, &c.Attempts, &nextRetry, &graceEnds, &c.LastError,
+		&resolved, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+	c.NextRetryAt = timeOrNil(nextRetry)
+	c.GraceEndsAt = timeOrNil(graceEnds)
+	c.ResolvedAt = timeOrNil(resolved)
+	return &c, nil
+}
+
+// CreateDunningCase opens a case for c's invoice and returns it, or the
+// case that already exists for the invoice or, failing that, the
+// subscription's open case.
+func (s *Store) CreateDunningCase(ctx context.Context, c *DunningCase) (*DunningCase, error) {
+	created, err := scanDunningCase(s.db.QueryRowContext(ctx, `
+		INSERT INTO dunning_cases
+			(id, subscription_id, invoice_id, invoice_url, customer_id, customer_email, tenant_id, currency, amount_due, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT DO NOTHING
+		RETURNING `+dunningCaseColumns,
+		c.ID, c.SubscriptionID, c.InvoiceID, c.InvoiceURL, c.CustomerID, c.CustomerEmail, c.TenantID, c.Currency,
+		c.AmountDue, c.Status))
+	if !errors.Is(err, sql.ErrNoRows) {
+		return created, err
+	}
+	existing, err := s.DunningCaseByInvoice(ctx, c.InvoiceID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return existing, err
+	}
+	return s.OpenDunningCase(ctx, c.SubscriptionID)
+}
+
+func (s *Store) DunningCaseByInvoice(ctx context.Context, invoiceID string) (*DunningCase, error) {
+	return scanDunningCase(s.db.QueryRowContext(ctx, `
+		SELECT `+dunningCaseColumns+` FROM dunning_cases WHERE invoice_id = $1`, invoiceID))
+}
+
+func (s *Store) OpenDunningCase(ctx context.Context, subscriptionID string) (*DunningCase, error) {
+	return scanDunningCase(s.db.QueryRowContext(ctx, `
+		SELECT `+dunningCaseColumns+` FROM dunning_cases
+		WHERE subscription_id = $1 AND status IN ('retrying', 'grace')`, subscriptionID))
+}
+
+// LatestDunningCase is the subscription's open case, or else its most
+// recent one.
+func (s *Store) LatestDunningCase(ctx context.Context, subscriptionID string) (*DunningCase, error) {
+	return scanDunningCase(s.db.QueryRowContext(ctx, `
+		SELECT `+dunningCaseColumns+` FROM dunning_cases WHERE subscription_id = $1
+		ORDER BY status IN ('retrying', 'grace') DESC, created_at DESC LIMIT 1`, subscriptionID))
+}
+
+// DunningEvents lists a case's history, oldest first.
+func (s *Store) DunningEvents(ctx context.Context, caseID string) ([]DunningEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT type, detail, created_at FROM dunning_events WHERE case_id = $1 ORDER BY created_at, id`, caseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []DunningEvent{}
+	for rows.Next() {
+		var e DunningEvent
+		if err := rows.Scan(&e.Type, &e.Detail, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *Store) AddDunningEvent(ctx context.Context, caseID, typ, detail string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO dunning_events (case_id, type, detail) VALUES ($1, $2, $3)`, caseID, typ, detail)
+	return err
+}
+
+// changeDunningCase applies fn to a case under its row lock and saves the
+// result with the events fn returns. A change that leaves the case as it
+// was writes nothing, so redelivered webhooks are free.
+func (s *Store) changeDunningCase(ctx context.Context, id string, fn func(c *DunningCase) []DunningEvent) (*DunningCase, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	c, err := scanDunningCase(tx.QueryRowContext(ctx, `SELECT `+dunningCaseColumns+` FROM dunning_cases WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		return nil, false, err
+	}
+	before := *c
+	events := fn(c)
+	if *c == before {
+		return c, false, nil
+	}
+
+	for _, e := range events {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO dunning_events (case_id, type, detail) VALUES ($1, $2, $3)`, id, e.Type, e.Detail); err != nil {
+			return nil, false, err
+		}
+	}
+	c, err = scanDunningCase(tx.QueryRowContext(ctx, `
+		UPDATE dunning_cases SET
+			status = $2, attempts = $3, next_retry_at = $4, grace_ends_at = $5, last_error = $6, resolved_at = $7,
+			invoice_url = $8, updated_at = now()
+		WHERE id = $1
+		RETURNING `+dunningCaseColumns,
+		id, c.Status, c.Attempts, nullTimeOf(c.NextRetryAt), nullTimeOf(c.GraceEndsAt), c.LastError,
+		nullTimeOf(c.ResolvedAt), c.InvoiceURL))
+	if err != nil {
+		return nil, false, err
+	}
+	return c, true, tx.Commit()
+}
+
+// ClaimDueDunningCase returns the next case with a retry or cancellation
+// due, pushing that time back by dunningLease so no other instance takes
+// it meanwhile, or sql.ErrNoRows when nothing is due. skip lists cases
+// that already failed in this sweep.
+func (s *Store) ClaimDueDunningCase(ctx context.Context, skip []string) (*DunningCase, error) {
+	if skip == nil {
+		skip = []string{}
+	}
+	return scanDunningCase(s.db.QueryRowContext(ctx, `
+		UPDATE dunning_cases SET
+			next_retry_at = CASE WHEN status = 'retrying' THEN $2 ELSE next_retry_at END,
+			grace_ends_at = CASE WHEN status = 'grace' THEN $2 ELSE grace_ends_at END,
+			updated_at = now()
+		WHERE id = (
+			SELECT id FROM dunning_cases
+			WHERE id <> ALL($1) AND (
+				(status = 'retrying' AND next_retry_at <= now())
+				OR (status = 'grace' AND grace_ends_at <= now()))
+			ORDER BY updated_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING `+dunningCaseColumns,
+		skip, time.Now().Add(dunningLease).UTC()))
+}
+
+// Dunning chases failed subscription invoices: it retries them on the
+// tenant's schedule, emails the customer at each step through the mailer,
+// lets the subscription run on for a grace period once the retries are
+// spent, and then cancels it. Stripe webhooks drive the state; a worker
+// makes the retries and cancellations that fall due. mailer may be nil,
+// in which case no emails are sent.
+type Dunning struct {
+	store     *Store
+	settings  *RuntimeSettings
+	mailer    *MailerClient
+	brand     string
+	interval  time.Duration
+	templates *template.Template
+}
+
+func NewDunning(store *Store, settings *RuntimeSettings, mailer *MailerClient, brand string, interval time.Duration) *Dunning {
+	return &Dunning{
+		store:     store,
+		settings:  settings,
+		mailer:    mailer,
+		brand:     brand,
+		interval:  interval,
+		templates: template.Must(template.ParseFS(dunningTemplates, "templates/dunning.html")),
+	}
+}
+
+// RegisterRoutes mounts the dunning state of a subscription under the
+// payments:read scope, and a manual retry under the admin scope.
+func (d *Dunning) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	r.GET("/subscriptions/:id/dunning", requireScope(d.store, bootstrapToken, readPaymentsScope), d.requireStore, d.state)
+
+	admin := r.Group("/admin/subscriptions", requireScope(d.store, bootstrapToken, "admin"), d.requireStore)
+	admin.POST("/:id/dunning/retry", d.retryNow)
+}
+
+func (d *Dunning) requireStore(c *gin.Context) {
+	if d.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Dunning requires DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// DunningState is the body of GET /subscriptions/:id/dunning. Status is
+// "none" for a subscription that has never been in dunning.
+type DunningState struct {
+	SubscriptionID string         `json:"subscription_id"`
+	Status         string         `json:"status"`
+	Case           *DunningCase   `json:"case,omitempty"`
+	Events         []DunningEvent `json:"events,omitempty"`
+}
+
+func (d *Dunning) state(c *gin.Context) {
+	ctx := c.Request.Context()
+	state := DunningState{SubscriptionID: c.Param("id"), Status: "none"}
+	dc, err := d.store.LatestDunningCase(ctx, state.SubscriptionID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if dc != nil {
+		state.Status, state.Case = dc.Status, dc
+		if state.Events, err = d.store.DunningEvents(ctx, dc.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+	}
+	respondData(c, http.StatusOK, state)
+}
+
+// retryNow schedules an open case's next retry for the next sweep. A case
+// in its grace period goes back to retrying, and a failure then starts the
+// grace period over.
+func (d *Dunning) retryNow(c *gin.Context) {
+	ctx := c.Request.Context()
+	open, err := d.store.OpenDunningCase(ctx, c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Subscription has no open dunning case"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	dc, _, err := d.store.changeDunningCase(ctx, open.ID, func(dc *DunningCase) []DunningEvent {
+		if !dc.open() {
+			return nil
+		}
+		now := time.Now().UTC()
+		dc.Status = dunningRetrying
+		dc.NextRetryAt = &now
+		dc.GraceEndsAt = nil
+		return []DunningEvent{{Type: "retry_requested", Detail: "by " + c.GetString("api_key_id")}}
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, dc)
+}
+
+func invoiceTenant(inv *stripe.Invoice) string {
+	if inv.SubscriptionDetails != nil && inv.SubscriptionDetails.Metadata["tenant_id"] != "" {
+		return inv.SubscriptionDetails.Metadata["tenant_id"]
+	}
+	return inv.Metadata["tenant_id"]
+}
+
+// invoiceEvent applies an invoice webhook to the invoice's case.
+func (d *Dunning) invoiceEvent(ctx context.Context, typ stripe.EventType, inv *stripe.Invoice) error {
+	if d == nil || d.store == nil || inv.Subscription == nil {
+		return nil
+	}
+	switch typ {
+	case "invoice.payment_failed":
+		return d.failed(ctx, inv, "")
+	case "invoice.paid":
+		return d.resolve(ctx, inv.ID, dunningRecovered, "invoice paid")
+	case "invoice.voided", "invoice.marked_uncollectible":
+		return d.resolve(ctx, inv.ID, dunningClosed, "invoice "+string(inv.Status))
+	}
+	return nil
+}
+
+// subscriptionDeleted ends the open case of a subscription canceled
+// outside dunning.
+func (d *Dunning) subscriptionDeleted(ctx context.Context, sub *stripe.Subscription) error {
+	if d == nil || d.store == nil {
+		return nil
+	}
+	open, err := d.store.OpenDunningCase(ctx, sub.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading dunning case for %s: %w", sub.ID, err)
+	}
+	return d.resolve(ctx, open.InvoiceID, dunningCanceled, "subscription canceled")
+}
+
+// failed records a failed payment attempt on inv, opening its case on the
+// first one. Attempts are counted by Stripe, so a redelivered failure
+// changes nothing. The case moves to the next retry on the schedule, or
+// into its grace period when none is left, and the customer is told
+// which. reason is the decline, when the caller knows it.
+func (d *Dunning) failed(ctx context.Context, inv *stripe.Invoice, reason string) error {
+	dc, err := d.store.CreateDunningCase(ctx, &DunningCase{
+		ID:             uuid.NewString(),
+		SubscriptionID: inv.Subscription.ID,
+		InvoiceID:      inv.ID,
+		InvoiceURL:     inv.HostedInvoiceURL,
+		CustomerID:     customerIDOf(inv.Customer),
+		CustomerEmail:  inv.CustomerEmail,
+		TenantID:       invoiceTenant(inv),
+		Currency:       string(inv.Currency),
+		AmountDue:      inv.AmountDue,
+		Status:         dunningRetrying,
+	})
+	if err != nil {
+		return fmt.Errorf("opening dunning case for %s: %w", inv.ID, err)
+	}
+	if dc.InvoiceID != inv.ID {
+		// Another invoice of the subscription is already in dunning;
+		// cancellation at the end of it settles this one too.
+		return d.store.AddDunningEvent(ctx, dc.ID, "invoice_failed", inv.ID)
+	}
+
+	schedule, grace := d.settings.Get().Dunning.effective(dc.TenantID)
+	var notify string
+	id := dc.ID
+	dc, changed, err := d.store.changeDunningCase(ctx, id, func(dc *DunningCase) []DunningEvent {
+		if dc.Status != dunningRetrying || inv.AttemptCount <= dc.Attempts {
+			return nil
+		}
+		now := time.Now().UTC()
+		dc.Attempts = inv.AttemptCount
+		if inv.HostedInvoiceURL != "" {
+			dc.InvoiceURL = inv.HostedInvoiceURL
+		}
+		if reason != "" {
+			dc.LastError = reason
+		}
+		failure := DunningEvent{Type: "payment_failed", Detail: fmt.Sprintf("attempt %d", dc.Attempts)}
+		if reason != "" {
+			failure.Detail += ": " + reason
+		}
+
+		if i := int(dc.Attempts) - 1; i < len(schedule) {
+			next := now.Add(schedule[i])
+			dc.NextRetryAt = &next
+			notify = "retry"
+			return []DunningEvent{failure, {Type: "retry_scheduled", Detail: next.Format(time.RFC3339)}}
+		}
+		ends := now.Add(grace)
+		dc.Status = dunningGrace
+		dc.NextRetryAt = nil
+		dc.GraceEndsAt = &ends
+		notify = "final_notice"
+		return []DunningEvent{failure, {Type: "grace_started", Detail: "cancels at " + ends.Format(time.RFC3339)}}
+	})
+	if err != nil {
+		return fmt.Errorf("updating dunning case %s: %w", id, err)
+	}
+	if changed {
+		d.notifyAsync(ctx, dc, notify)
+	}
+	return nil
+}
+
+// resolve ends the open case for invoiceID with status.
+func (d *Dunning) resolve(ctx context.Context, invoiceID, status, detail string) error {
+	dc, err := d.store.DunningCaseByInvoice(ctx, invoiceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading dunning case for %s: %w", invoiceID, err)
+	}
+	id := dc.ID
+	dc, changed, err := d.store.changeDunningCase(ctx, id, func(dc *DunningCase) []DunningEvent {
+		if !dc.open() {
+			return nil
+		}
+		now := time.Now().UTC()
+		dc.Status = status
+		dc.NextRetryAt = nil
+		dc.GraceEndsAt = nil
+		dc.ResolvedAt = &now
+		return []DunningEvent{{Type: status, Detail: detail}}
+	})
+	if err != nil {
+		return fmt.Errorf("updating dunning case %s: %w", id, err)
+	}
+	if changed && (status == dunningRecovered || status == dunningCanceled) {
+		d.notifyAsync(ctx, dc, status)
+	}
+	return nil
+}
+
+func customerIDOf(c *stripe.Customer) string {
+	if c == nil {
+		return ""
+	}
+	return c.ID
+}
+
+// Run makes the retries and cancellations that are due every interval
+// until ctx is done.
+func (d *Dunning) Run(ctx context.Context) {
+	if d == nil || d.store == nil {
+		return
+	}
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		if err := d.processDue(ctx); err != nil {
+			log.Printf("dunning: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dunning) processDue(ctx context.Context) error {
+	var failed []string
+	for {
+		dc, err := d.store.ClaimDueDunningCase(ctx, failed)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if dc.Status == dunningGrace {
+			err = d.cancel(ctx, dc)
+		} else {
+			err = d.retry(ctx, dc)
+		}
+		if err != nil {
+			log.Printf("dunning case %s: %v", dc.ID, err)
+			failed = append(failed, dc.ID)
+		}
+	}
+}
+
+// retry attempts to pay a case's invoice. The idempotency key names the
+// attempt, so a retry repeated after a crash doesn't charge twice. A
+// decline is recorded from the invoice as Stripe now sees it, the same way
+// the payment_failed webhook that follows is; other errors leave the case
+// claimed until its lease runs out.
+func (d *Dunning) retry(ctx context.Context, dc *DunningCase) error {
+	params := &stripe.InvoicePayParams{}
+	params.Context = ctx
+	params.SetIdempotencyKey(fmt.Sprintf("dunning-%s-%d", dc.ID, dc.Attempts))
+	inv, err := invoice.Pay(dc.InvoiceID, params)
+	if err == nil {
+		return d.resolve(ctx, inv.ID, dunningRecovered, "paid on retry")
+	}
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) {
+		return err
+	}
+
+	getParams := &stripe.InvoiceParams{}
+	getParams.Context = ctx
+	inv, gerr := invoice.Get(dc.InvoiceID, getParams)
+	if gerr != nil {
+		return fmt.Errorf("retry: %v; fetching invoice: %w", err, gerr)
+	}
+	switch inv.Status {
+	case stripe.InvoiceStatusPaid:
+		return d.resolve(ctx, inv.ID, dunningRecovered, "invoice paid")
+	case stripe.InvoiceStatusVoid, stripe.InvoiceStatusUncollectible:
+		return d.resolve(ctx, inv.ID, dunningClosed, "invoice "+string(inv.Status))
+	}
+	if stripeErr.Type != stripe.ErrorTypeCard {
+		return err
+	}
+	return d.failed(ctx, inv, stripeErr.Msg)
+}
+
+// cancel ends a case whose grace period is over by canceling the
+// subscription. One that is already gone is treated as canceled.
+func (d *Dunning) cancel(ctx context.Context, dc *DunningCase) error {
+	params := &stripe.SubscriptionCancelParams{}
+	params.Context = ctx
+	params.SetIdempotencyKey("dunning-cancel-" + dc.ID)
+	if _, err := subscription.Cancel(dc.SubscriptionID, params); err != nil {
+		var stripeErr *stripe.Error
+		if !errors.As(err, &stripeErr) || stripeErr.Code != stripe.ErrorCodeResourceMissing {
+			return err
+		}
+	}
+	return d.resolve(ctx, dc.InvoiceID, dunningCanceled, "grace period ended")
+}
+
+// dunningView is the data handed to the dunning email template.
+type dunningView struct {
+	Brand      string
+	Kind       string
+	Amount     string
+	NextRetry  string
+	GraceEnds  string
+	InvoiceURL string
+	InvoiceID  string
+}
+
+var dunningSubjects = map[string]string{
+	"retry":          "Your %s payment didn't go through",
+	"final_notice":   "Action needed: your %s subscription will be canceled",
+	dunningCanceled:  "Your %s subscription has been canceled",
+	dunningRecovered: "Your %s payment went through",
+}
+
+// notifyAsync emails the customer about a step of their case without
+// holding up the webhook or sweep, and records the outcome in the case's
+// history.
+func (d *Dunning) notifyAsync(ctx context.Context, dc *DunningCase, kind string) {
+	if d.mailer == nil || dc.CustomerEmail == "" || kind == "" {
+		return
+	}
+	ctx = withRequestID(context.Background(), requestIDFrom(ctx))
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		typ, detail := "email_sent", kind
+		if err := d.send(ctx, dc, kind); err != nil {
+			logf(ctx, "dunning email for %s: %v", dc.ID, err)
+			typ, detail = "email_failed", kind+": "+err.Error()
+		}
+		if err := d.store.AddDunningEvent(ctx, dc.ID, typ, detail); err != nil {
+			logf(ctx, "recording dunning email for %s: %v", dc.ID, err)
+		}
+	}()
+}
+
+func (d *Dunning) send(ctx context.Context, dc *DunningCase, kind string) error {
+	view := dunningView{
+		Brand:      d.brand,
+		Kind:       kind,
+		Amount:     formatAmount(dc.AmountDue, dc.Currency),
+		InvoiceURL: dc.InvoiceURL,
+		InvoiceID:  dc.InvoiceID,
+	}
+	if dc.NextRetryAt != nil {
+		view.NextRetry = dc.NextRetryAt.Format("January 2, 2006")
+	}
+	if dc.GraceEndsAt != nil {
+		view.GraceEnds = dc.GraceEndsAt.Format("January 2, 2006")
+	}
+
+	var html bytes.Buffer
+	if err := d.templates.Execute(&html, view); err != nil {
+		return fmt.Errorf("rendering dunning email: %w", err)
+	}
+	return d.mailer.Send(ctx, Email{
+		To:       dc.CustomerEmail,
+		Subject:  fmt.Sprintf(dunningSubjects[kind], d.brand),
+		HTML:     html.String(),
+		Text:     dunningText(view),
+		TenantID: dc.TenantID,
+		Tags:     map[string]string{"subscription_id": dc.SubscriptionID, "invoice_id": dc.InvoiceID, "kind": "dunning_" + kind},
+	})
+}
+
+func dunningText(v dunningView) string {
+	var text string
+	switch v.Kind {
+	case "retry":
+		text = fmt.Sprintf("We couldn't collect your subscription payment of %s. We'll try again on %s.\n", v.Amount, v.NextRetry)
+	case "final_notice":
+		text = fmt.Sprintf("We still couldn't collect your subscription payment of %s. Your subscription will be canceled on %s unless the invoice is paid.\n", v.Amount, v.GraceEnds)
+	case dunningCanceled:
+		text = fmt.Sprintf("Your subscription has been canceled because its payment of %s couldn't be collected.\n", v.Amount)
+	case dunningRecovered:
+		text = fmt.Sprintf("Thanks, your subscription payment of %s went through.\n", v.Amount)
+	}
+	if v.InvoiceURL != "" && (v.Kind == "retry" || v.Kind == "final_notice") {
+		text += "\nPay or update your payment method: " + v.InvoiceURL + "\n"
+	}
+	return text + "\nInvoice reference " + v.InvoiceID + "\n"
+}
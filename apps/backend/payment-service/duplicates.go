@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+var duplicatePaymentsSeen = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_duplicate_payments_total",
+	Help: "Payments repeating an earlier payment's card, amount and currency within the duplicate window, by action taken.",
+}, []string{"action"})
+
+const (
+	duplicateBlock = "block"
+	duplicateFlag  = "flag"
+	duplicateOff   = "off"
+
+	// metadataDuplicateOf names the earlier payment a flagged one repeats.
+	metadataDuplicateOf = "duplicate_of"
+)
+
+// DuplicatePaymentsConfig catches double submits, such as a mobile client
+// sending a payment again after its connection dropped: a payment of the
+// same amount and currency on the same card as another of the tenant's
+// within window_seconds. "block" refuses it with duplicate_payment;
+// "flag" lets it through with duplicate_of in its metadata and a
+// payment.duplicate_suspected event. A tenant's rule overrides the
+// default field by field, and "off" turns detection off for it.
+//
+//	"duplicate_payments": {"action": "flag", "window_seconds": 600,
+//	                       "tenants": {"acme": {"action": "block"}}}
+type DuplicatePaymentsConfig struct {
+	// Action empty means off.
+	Action string `json:"action"`
+	// WindowSeconds zero means 600.
+	WindowSeconds int                             `json:"window_seconds"`
+	Tenants       map[string]DuplicatePaymentRule `json:"tenants"`
+}
+
+type DuplicatePaymentRule struct {
+	Action        string `json:"action"`
+	WindowSeconds int    `json:"window_seconds"`
+}
+
+func (cfg DuplicatePaymentsConfig) validate() error {
+	check := func(name string, r DuplicatePaymentRule) error {
+		switch r.Action {
+		case "", duplicateBlock, duplicateFlag, duplicateOff:
+		default:
+			return fmt.Errorf("duplicate_payments %s: action must be one of block, flag, off", name)
+		}
+		if r.WindowSeconds < 0 {
+			return fmt.Errorf("duplicate_payments %s: window_seconds must not be negative", name)
+		}
+		return nil
+	}
+	if err := check("default", DuplicatePaymentRule{Action: cfg.Action, WindowSeconds: cfg.WindowSeconds}); err != nil {
+		return err
+	}
+	for tenant, r := range cfg.Tenants {
+		if err := check("tenants."+tenant, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rule resolves the action and window for one tenant. The action is ""
+// when detection is off.
+func (cfg DuplicatePaymentsConfig) rule(tenantID string) (string, time.Duration) {
+	action, seconds := cfg.Action, cfg.WindowSeconds
+	if r, ok := cfg.Tenants[tenantID]; ok && tenantID != "" {
+		if r.Action != "" {
+			action = r.Action
+		}
+		if r.WindowSeconds != 0 {
+			seconds = r.WindowSeconds
+		}
+	}
+	if seconds == 0 {
+		seconds = 600
+	}
+	if action == duplicateOff {
+		action = ""
+	}
+	return action, time.Duration(seconds) * time.Second
+}
+
+// duplicateKey is what a payment is compared to the tenant's others on.
+type duplicateKey struct {
+	PaymentID   string
+	TenantID    string
+	Fingerprint string
+	Amount      int64
+	Currency    string
+	CreatedAt   time.Time
+}
+
+// PaymentDuplicateKey returns a stored payment's key and the payment it
+// was flagged as repeating, if any.
+func (s *Store) PaymentDuplicateKey(ctx context.Context, paymentID string) (duplicateKey, string, error) {
+	k := duplicateKey{PaymentID: paymentID}
+	var duplicateOf string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT tenant_id, card_fingerprint, amount, currency, created_at, duplicate_of
+		FROM payments WHERE id = $1`, paymentID).
+		Scan(&k.TenantID, &k.Fingerprint, &k.Amount, &k.Currency, &k.CreatedAt, &duplicateOf)
+	return k, duplicateOf, err
+}
+
+// DuplicatePayment returns the first of the tenant's payments in the
+// window before k was made that shares its card, amount and currency, or
+// "" when there is none. Canceled payments and those whose card was
+// declined don't count, so paying again after a decline is no duplicate.
+func (s *Store) DuplicatePayment(ctx context.Context, k duplicateKey, window time.Duration) (string, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id FROM payments
+		WHERE tenant_id = $1 AND card_fingerprint = $2 AND amount = $3 AND currency = $4
+			AND id <> $5 AND created_at >= $6 AND created_at < $7
+			AND status NOT IN ('canceled', 'requires_payment_method')
+		ORDER BY created_at LIMIT 1`,
+		k.TenantID, k.Fingerprint, k.Amount, strings.ToLower(k.Currency), k.PaymentID, k.CreatedAt.Add(-window), k.CreatedAt).
+		Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return id, err
+}
+
+// SavePaymentFingerprint records the card of a payment created with one,
+// before its charge does.
+func (s *Store) SavePaymentFingerprint(ctx context.Context, paymentID, fingerprint string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE payments SET card_fingerprint = $2, updated_at = now()
+		WHERE id = $1 AND card_fingerprint = ''`, paymentID, fingerprint)
+	return err
+}
+
+// FlagDuplicatePayment records that a payment repeats another, reporting
+// false when it was already flagged.
+func (s *Store) FlagDuplicatePayment(ctx context.Context, paymentID, duplicateOf string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE payments SET duplicate_of = $2, updated_at = now()
+		WHERE id = $1 AND duplicate_of = ''`, paymentID, duplicateOf)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DuplicatePayments spots payments that repeat one the tenant took
+// moments earlier on the same card. A payment created with a
+// payment_method is checked before its intent is created and can be
+// blocked; one confirmed client-side only shows its card once charged, so
+// it is checked when the charge succeeds and can only be flagged, for
+// support to refund. Flags are events on the payment's stream.
+type DuplicatePayments struct {
+	store    *Store
+	settings *RuntimeSettings
+	hub      *EventHub
+}
+
+func NewDuplicatePayments(store *Store, settings *RuntimeSettings, hub *EventHub) *DuplicatePayments {
+	return &DuplicatePayments{store: store, settings: settings, hub: hub}
+}
+
+// check refuses a payment on the card with fingerprint repeating an
+// earlier one when the tenant blocks duplicates, or marks it in params
+// when the tenant flags them.
+func (d *DuplicatePayments) check(ctx context.Context, req PaymentRequest, fingerprint string, params *stripe.PaymentIntentParams) *refusal {
+	if d == nil || d.store == nil || fingerprint == "" {
+		return nil
+	}
+	action, window := d.settings.Get().DuplicatePayments.rule(req.TenantID)
+	if action == "" {
+		return nil
+	}
+	of, err := d.store.DuplicatePayment(ctx, duplicateKey{
+		TenantID:    req.TenantID,
+		Fingerprint: fingerprint,
+		Amount:      stripe.Int64Value(params.Amount),
+		Currency:    stripe.StringValue(params.Currency),
+		CreatedAt:   time.Now(),
+	}, window)
+	if err != nil {
+		logf(ctx, "duplicate check: %v", err)
+		return &refusal{http.StatusInternalServerError, CodeInternal, "Could not check for duplicate payments", nil}
+	}
+	if of == "" {
+		return nil
+	}
+	if action == duplicateBlock {
+		duplicatePaymentsSeen.WithLabelValues(duplicateBlock).Inc()
+		return &refusal{http.StatusConflict, CodeDuplicatePayment,
+			"Duplicate of " + of + ": same card, amount and currency", gin.H{"duplicate_of": of}}
+	}
+	params.AddMetadata(metadataDuplicateOf, of)
+	return nil
+}
+
+// created records the card of a payment created with one, so a repeat is
+// caught before either is confirmed, and flags the payment when check
+// found it repeats another.
+func (d *DuplicatePayments) created(ctx context.Context, pi *stripe.PaymentIntent) {
+	if d == nil || d.store == nil || pi.PaymentMethod == nil || pi.PaymentMethod.Card == nil {
+		return
+	}
+	if err := d.store.SavePaymentFingerprint(ctx, pi.ID, pi.PaymentMethod.Card.Fingerprint); err != nil {
+		logf(ctx, "saving card for %s: %v", pi.ID, err)
+		return
+	}
+	if of := pi.Metadata[metadataDuplicateOf]; of != "" {
+		if _, err := d.flag(ctx, pi.ID, of, string(pi.Status), pi.Amount, string(pi.Currency)); err != nil {
+			logf(ctx, "flagging duplicate payment %s: %v", pi.ID, err)
+		}
+	}
+}
+
+// chargeSucceeded flags a payment whose card, once charged, turns out to
+// have paid the same amount moments before, and marks its intent.
+func (d *DuplicatePayments) chargeSucceeded(ctx context.Context, ch *stripe.Charge) error {
+	if d == nil || d.store == nil || ch.PaymentIntent == nil {
+		return nil
+	}
+	card, ok := paymentCardOf(ch)
+	if !ok || card.Fingerprint == "" {
+		return nil
+	}
+	paymentID := ch.PaymentIntent.ID
+	key, flaggedAs, err := d.store.PaymentDuplicateKey(ctx, paymentID)
+	if errors.Is(err, sql.ErrNoRows) || flaggedAs != "" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading payment %s: %w", paymentID, err)
+	}
+	action, window := d.settings.Get().DuplicatePayments.rule(key.TenantID)
+	if action == "" {
+		return nil
+	}
+	key.Fingerprint = card.Fingerprint
+	of, err := d.store.DuplicatePayment(ctx, key, window)
+	if err != nil || of == "" {
+		return err
+	}
+	flagged, err := d.flag(ctx, paymentID, of, string(stripe.PaymentIntentStatusSucceeded), ch.Amount, string(ch.Currency))
+	if err != nil || !flagged {
+		return err
+	}
+	// The flag is saved, so a failure here is logged rather than
+	// redelivered.
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	params.AddMetadata(metadataDuplicateOf, of)
+	if _, err := paymentintent.Update(paymentID, params); err != nil {
+		logf(ctx, "marking duplicate payment %s: %v", paymentID, err)
+	}
+	return nil
+}
+
+// flag records that paymentID repeats of and publishes the event once.
+func (d *DuplicatePayments) flag(ctx context.Context, paymentID, of, status string, amount int64, currency string) (bool, error) {
+	flagged, err := d.store.FlagDuplicatePayment(ctx, paymentID, of)
+	if err != nil || !flagged {
+		return false, err
+	}
+	duplicatePaymentsSeen.WithLabelValues(duplicateFlag).Inc()
+	d.hub.Publish(PaymentEvent{
+		PaymentID: paymentID,
+		Type:      "payment.duplicate_suspected",
+		Status:    status,
+		Amount:    amount,
+		Currency:  currency,
+		CreatedAt: time.Now().UTC(),
+		RequestID: requestIDFrom(ctx),
+	})
+	return true, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// errPrivateAddress refuses a call a caller's URL would make into the
+// service's own network.
+var errPrivateAddress = errors.New("not a public address")
+
+// sharedAddressSpace is carrier-grade NAT space, which some clusters use
+// for pods and services.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddr reports whether ip is a public unicast address: not
+// loopback, private, link-local, where cloud metadata services answer,
+// shared, multicast or unspecified.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// resolvesPublic reports whether the host of raw resolves to public
+// addresses only, so a URL that doesn't is refused when it is given. The
+// egress client checks again when it connects, as the name may resolve
+// differently by then.
+func resolvesPublic(ctx context.Context, raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil {
+		return publicAddr(ip)
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !publicAddr(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newEgressClient returns a client for URLs callers give us, such as
+// callbacks and webhook endpoints. It connects to public addresses only,
+// checked on the address dialed after DNS resolution, and never through
+// a proxy, which would connect on its behalf.
+func newEgressClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second, Control: dialPublic}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+func dialPublic(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(ip) {
+		return fmt.Errorf("%s: %w", host, errPrivateAddress)
+	}
+	return nil
+}
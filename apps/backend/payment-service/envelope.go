@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// apiVersionHeader selects the response shape. Version 1 is each
+// endpoint's original body; version 2 wraps every response in the
+// documented envelope:
+//
+//	{"data": ..., "meta": {"request_id": ..., "api_version": 2, ...}}
+//	{"errors": [problem, ...], "meta": {...}}
+//
+// Fields are snake_case and timestamps RFC 3339 in UTC in both versions.
+const apiVersionHeader = "API-Version"
+
+const latestAPIVersion = 2
+
+// defaultAPIVersion applies when a request doesn't ask for one, so the
+// default can move to 2 once clients have migrated.
+var defaultAPIVersion = func() int {
+	if v, err := strconv.Atoi(os.Getenv("DEFAULT_API_VERSION")); err == nil && v >= 1 && v <= latestAPIVersion {
+		return v
+	}
+	return 1
+}()
+
+// apiVersion is the version the request asked for, clamped to the known
+// range, and echoed back in the response header. Handlers ask several
+// times per request, so the answer is kept on the context.
+func apiVersion(c *gin.Context) int {
+	if v, ok := c.Get("api_version"); ok {
+		return v.(int)
+	}
+	v := defaultAPIVersion
+	if n, err := strconv.Atoi(c.GetHeader(apiVersionHeader)); err == nil {
+		v = n
+	}
+	if v < 1 {
+		v = 1
+	} else if v > latestAPIVersion {
+		v = latestAPIVersion
+	}
+	c.Header(apiVersionHeader, strconv.Itoa(v))
+	c.Set("api_version", v)
+	return v
+}
+
+func envelopeMeta(c *gin.Context, extra gin.H) gin.H {
+	meta := gin.H{"api_version": latestAPIVersion}
+	if id := requestIDFrom(c.Request.Context()); id != "" {
+		meta["request_id"] = id
+	}
+	for k, v := range extra {
+		meta[k] = v
+	}
+	return meta
+}
+
+// envelope is the version 2 success body. A struct rather than gin.H
+// spares the encoder sorting map keys; the output is the same.
+type envelope struct {
+	Data interface{} `json:"data"`
+	Meta gin.H       `json:"meta"`
+}
+
+// jsonBuffers are reused across responses. Bodies past maxPooledBuffer
+// are left to the garbage collector so one large list doesn't pin its
+// buffer forever.
+var jsonBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+const maxPooledBuffer = 64 << 10
+
+// writeJSON is c.JSON encoding into a pooled buffer instead of a fresh
+// slice per response.
+func writeJSON(c *gin.Context, status int, v interface{}) {
+	buf := jsonBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			jsonBuffers.Put(buf)
+		}
+	}()
+
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		c.JSON(status, v) // which panics with the error, as before
+		return
+	}
+	// Encode ends with a newline that json.Marshal, and so c.JSON, don't.
+	c.Data(status, "application/json; charset=utf-8", bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// respondData writes a success body, enveloped for version 2.
+func respondData(c *gin.Context, status int, data interface{}) {
+	if apiVersion(c) < 2 {
+		writeJSON(c, status, data)
+		return
+	}
+	writeJSON(c, status, envelope{Data: data, Meta: envelopeMeta(c, nil)})
+}
+
+// respondRawData is respondData for a body already encoded, such as one
+// cached across requests.
+func respondRawData(c *gin.Context, status int, raw []byte) {
+	if apiVersion(c) < 2 {
+		c.Data(status, "application/json; charset=utf-8", raw)
+		return
+	}
+	writeJSON(c, status, envelope{Data: json.RawMessage(raw), Meta: envelopeMeta(c, nil)})
+}
+
+// respondList writes a collection. Version 1 puts meta's members beside
+// "data"; version 2 moves them under "meta".
+func respondList(c *gin.Context, status int, data interface{}, meta gin.H) {
+	if apiVersion(c) < 2 {
+		body := gin.H{"data": data}
+		for k, v := range meta {
+			body[k] = v
+		}
+		writeJSON(c, status, body)
+		return
+	}
+	writeJSON(c, status, envelope{Data: data, Meta: envelopeMeta(c, meta)})
+}
+
+// Payment is the version 2 representation of a payment on the create and
+// status endpoints.
+type Payment struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	Amount       int64  `json:"amount"`
+	Currency     string `json:"currency"`
+	CustomerID   string `json:"customer_id,omitempty"`
+	OrderID      string `json:"order_id,omitempty"`
+	TenantID     string `json:"tenant_id,omitempty"`
+	Description  string `json:"description,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	CreatedAt    string `json:"created_at"`
+	// Subtotal and Discounts are set when promotions reduced Amount.
+	Subtotal  int64             `json:"subtotal,omitempty"`
+	Discounts []AppliedDiscount `json:"discounts,omitempty"`
+	// Tip and Surcharge are part of Amount. AmountCapturable is what a manually
+	// captured payment has authorized but not yet collected.
+	Tip              int64 `json:"tip,omitempty"`
+	Surcharge        int64 `json:"surcharge,omitempty"`
+	AmountCapturable int64 `json:"amount_capturable,omitempty"`
+	// DuplicateOf is the earlier payment this one looks like a double
+	// submit of.
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	// Region is where the payment's data is kept, when REGION is set;
+	// calls about the payment go to that region.
+	Region string `json:"region,omitempty"`
+	// PublishableKey comes with the client secret of payments on the
+	// alternate provider account, which the client must confirm with.
+	PublishableKey string `json:"publishable_key,omitempty"`
+}
+
+// paymentData builds a Payment; the client secret is only handed back
+// to whoever created the intent.
+func paymentData(pi *stripe.PaymentIntent, withSecret bool) Payment {
+	p := Payment{
+		ID:          pi.ID,
+		Status:      paymentStatus(pi),
+		Amount:      pi.Amount,
+		Currency:    string(pi.Currency),
+		OrderID:     pi.Metadata["order_id"],
+		TenantID:    pi.Metadata["tenant_id"],
+		Description: pi.Description,
+		CreatedAt:   unixRFC3339(pi.Created),
+	}
+	if pi.Customer != nil {
+		p.CustomerID = pi.Customer.ID
+	}
+	if withSecret {
+		p.ClientSecret = pi.ClientSecret
+		if pi.Metadata[metadataProviderArm] == armAlternate {
+			p.PublishableKey = alternatePublishableKey
+		}
+	}
+	if v := pi.Metadata[metadataDiscounts]; v != "" {
+		p.Subtotal, _ = strconv.ParseInt(pi.Metadata[metadataSubtotal], 10, 64)
+		p.Discounts = parseDiscountsMetadata(v)
+	}
+	p.Tip, _ = tipOf(pi)
+	p.Surcharge = surchargeOf(pi)
+	p.AmountCapturable = pi.AmountCapturable
+	p.DuplicateOf = pi.Metadata[metadataDuplicateOf]
+	p.Region = regionOf(pi)
+	return p
+}
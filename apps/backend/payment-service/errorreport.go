@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// ErrorReporter sends unexpected failures, such as recovered panics, to
+// whatever alerts on-call.
+type ErrorReporter interface {
+	Report(ctx context.Context, err error, tags map[string]string)
+	// Flush waits up to timeout for queued reports to be delivered.
+	Flush(timeout time.Duration)
+}
+
+// NewErrorReporter builds the reporter selected by ERROR_REPORTER.
+func NewErrorReporter(kind, dsn, environment string) (ErrorReporter, error) {
+	switch kind {
+	case "", "log":
+		return logReporter{}, nil
+	case "sentry":
+		if dsn == "" {
+			return nil, fmt.Errorf("ERROR_REPORTER=sentry requires SENTRY_DSN")
+		}
+		if err := sentry.Init(sentry.ClientOptions{
+			Dsn:              dsn,
+			Environment:      environment,
+			AttachStacktrace: true,
+		}); err != nil {
+			return nil, fmt.Errorf("sentry: %w", err)
+		}
+		return sentryReporter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown error reporter %q", kind)
+	}
+}
+
+// logReporter only logs, for local development.
+type logReporter struct{}
+
+func (logReporter) Report(ctx context.Context, err error, tags map[string]string) {
+	logf(ctx, "error report: %v %v", err, tags)
+}
+
+func (logReporter) Flush(time.Duration) {}
+
+type sentryReporter struct{}
+
+func (sentryReporter) Report(ctx context.Context, err error, tags map[string]string) {
+	hub := sentry.CurrentHub().Clone()
+	hub.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetTags(tags)
+		if id := requestIDFrom(ctx); id != "" {
+			scope.SetTag("request_id", id)
+		}
+	})
+	hub.CaptureException(err)
+}
+
+func (sentryReporter) Flush(timeout time.Duration) {
+	sentry.Flush(timeout)
+}
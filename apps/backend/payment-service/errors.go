@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// ErrorCode is the stable, machine-readable reason returned in every error
+// body. Clients should branch on the code, never on the message text.
+type ErrorCode string
+
+const (
+	// Payment method problems, safe to show to the customer.
+	CodeCardDeclined           ErrorCode = "card_declined"
+	CodeInsufficientFunds      ErrorCode = "insufficient_funds"
+	CodeExpiredCard            ErrorCode = "expired_card"
+	CodeIncorrectCVC           ErrorCode = "incorrect_cvc"
+	CodeInvalidCardNumber      ErrorCode = "invalid_card_number"
+	CodeAuthenticationRequired ErrorCode = "authentication_required"
+	CodeProcessingError        ErrorCode = "processing_error"
+
+	// Request problems.
+	CodeInvalidRequest      ErrorCode = "invalid_request"
+	CodeValidationFailed    ErrorCode = "validation_failed"
+	CodeInvalidAmount       ErrorCode = "invalid_amount"
+	CodeInvalidCurrency     ErrorCode = "invalid_currency"
+	CodeNotFound            ErrorCode = "not_found"
+	CodeIdempotencyConflict ErrorCode = "idempotency_conflict"
+	CodePayloadTooLarge     ErrorCode = "payload_too_large"
+
+	// Tenant amount policy violations, decided before Stripe is called.
+	CodeAmountBelowMinimum ErrorCode = "amount_below_minimum"
+	CodeAmountAboveMaximum ErrorCode = "amount_above_maximum"
+	CodeDailyLimitExceeded ErrorCode = "daily_limit_exceeded"
+	CodeCurrencyNotAllowed ErrorCode = "currency_not_allowed"
+	CodeMethodNotAllowed   ErrorCode = "payment_method_not_allowed"
+	CodePromotionInvalid   ErrorCode = "promotion_invalid"
+
+	// Stored value.
+	CodeInsufficientBalance ErrorCode = "insufficient_balance"
+	CodeGiftCardInactive    ErrorCode = "gift_card_inactive"
+
+	// Marketplace escrow.
+	CodeEscrowState ErrorCode = "invalid_escrow_state"
+
+	// Refund approval.
+	CodeRefundRequestState ErrorCode = "invalid_refund_request_state"
+
+	// Checkout sessions.
+	CodeCheckoutSessionState ErrorCode = "invalid_checkout_session_state"
+
+	// Tips and manual capture.
+	CodePaymentState ErrorCode = "invalid_payment_state"
+
+	// Double submits.
+	CodeDuplicatePayment ErrorCode = "duplicate_payment"
+
+	// Fraud lists and velocity rules.
+	CodePaymentBlocked   ErrorCode = "payment_blocked"
+	CodeVelocityExceeded ErrorCode = "velocity_exceeded"
+
+	// Data residency.
+	CodeWrongRegion ErrorCode = "wrong_region"
+
+	// Data subject requests.
+	CodeErasureBlocked ErrorCode = "erasure_blocked"
+
+	// Payment plans.
+	CodePaymentPlanState ErrorCode = "invalid_payment_plan_state"
+
+	// Payment method vault.
+	CodeVaultConflict ErrorCode = "vault_conflict"
+
+	// FX quotes.
+	CodeFXQuoteExpired ErrorCode = "fx_quote_expired"
+
+	// Payment quotes.
+	CodeQuoteExpired ErrorCode = "quote_expired"
+	CodeQuoteChanged ErrorCode = "quote_changed"
+
+	// Recurring billing.
+	CodeSubscriptionState ErrorCode = "invalid_subscription_state"
+	CodeTrialUsed         ErrorCode = "trial_already_used"
+
+	// Merchant webhooks.
+	CodeWebhookDeliveryState ErrorCode = "invalid_webhook_delivery_state"
+
+	// Dead-letter queue.
+	CodeDeadLetterState ErrorCode = "invalid_dead_letter_state"
+
+	// Seller payouts.
+	CodePayoutsDisabled  ErrorCode = "payouts_disabled"
+	CodeBalanceHoldState ErrorCode = "invalid_balance_hold_state"
+
+	// Caller identity.
+	CodeUnauthorized  ErrorCode = "unauthorized"
+	CodeForbidden     ErrorCode = "forbidden"
+	CodeQuotaExceeded ErrorCode = "quota_exceeded"
+
+	// Our side or the provider's.
+	CodeRateLimited         ErrorCode = "rate_limited"
+	CodeOverloaded          ErrorCode = "overloaded"
+	CodeProviderUnavailable ErrorCode = "provider_unavailable"
+	CodeUpstreamFailed      ErrorCode = "upstream_failed"
+	CodeNotConfigured       ErrorCode = "not_configured"
+	CodeInternal            ErrorCode = "internal_error"
+)
+
+// errorBody is the JSON shape of every error response: an RFC 7807
+// problem document whose code, request_id and user_message members are
+// extensions. The detail text is for developers; user_message is safe to
+// show customers as-is. ERROR_FORMAT=legacy restores the old
+// {"error", "code", "user_message"} shape for clients still migrating.
+// API version 2 carries the document in the envelope's errors list.
+func errorBody(c *gin.Context, code ErrorCode, message string) gin.H {
+	return localizedErrorBody(c, code, "", message, nil)
+}
+
+// errorBodyWith adds extension members, such as per-field errors.
+func errorBodyWith(c *gin.Context, code ErrorCode, message string, ext gin.H) gin.H {
+	return localizedErrorBody(c, code, "", message, ext)
+}
+
+func localizedErrorBody(c *gin.Context, code ErrorCode, decline, message string, ext gin.H) gin.H {
+	body := problemBody(c, code, decline, message)
+	for k, v := range ext {
+		body[k] = v
+	}
+	if apiVersion(c) >= 2 {
+		return gin.H{"errors": []gin.H{body}, "meta": envelopeMeta(c, nil)}
+	}
+	if !legacyErrors {
+		// c.JSON only sets Content-Type when it is still unset.
+		c.Header("Content-Type", problemContentType)
+	}
+	return body
+}
+
+func problemBody(c *gin.Context, code ErrorCode, decline, message string) gin.H {
+	lang := requestLanguage(c)
+	c.Header("Content-Language", lang.String())
+	if legacyErrors {
+		return gin.H{"error": message, "code": code, "user_message": userMessage(lang, code, decline)}
+	}
+
+	body := gin.H{
+		"type":         errorTypeBaseURL + string(code),
+		"title":        codeTitles[code],
+		"status":       problemStatus{c},
+		"detail":       message,
+		"instance":     c.Request.URL.Path,
+		"code":         code,
+		"user_message": userMessage(lang, code, decline),
+	}
+	if id := requestIDFrom(c.Request.Context()); id != "" {
+		body["request_id"] = id
+	}
+	return body
+}
+
+const problemContentType = "application/problem+json"
+
+// legacyErrors keeps the pre-problem+json error shape. Deprecated: the
+// compatibility flag goes away next release.
+var legacyErrors = os.Getenv("ERROR_FORMAT") == "legacy"
+
+// errorTypeBaseURL prefixes the code to form each problem's type URI. The
+// default is relative, resolved against the service and served by
+// errorTypeDocs.
+var errorTypeBaseURL = func() string {
+	if base := os.Getenv("ERROR_TYPE_BASE_URL"); base != "" {
+		return base
+	}
+	return "/errors/"
+}()
+
+// problemStatus renders as the response's status code, which callers set
+// in the same c.JSON call that marshals the body, so it can never disagree
+// with the status line.
+type problemStatus struct{ c *gin.Context }
+
+func (s problemStatus) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Itoa(s.c.Writer.Status())), nil
+}
+
+// codeTitles is the fixed, human-readable summary of each problem type.
+var codeTitles = map[ErrorCode]string{
+	CodeCardDeclined:           "Card declined",
+	CodeInsufficientFunds:      "Insufficient funds",
+	CodeExpiredCard:            "Card expired",
+	CodeIncorrectCVC:           "Incorrect CVC",
+	CodeInvalidCardNumber:      "Invalid card number",
+	CodeAuthenticationRequired: "Authentication required",
+	CodeProcessingError:        "Card processing error",
+	CodeInvalidRequest:         "Invalid request",
+	CodeValidationFailed:       "Validation failed",
+	CodeInvalidAmount:          "Invalid amount",
+	CodeInvalidCurrency:        "Invalid currency",
+	CodeNotFound:               "Not found",
+	CodeIdempotencyConflict:    "Idempotency conflict",
+	CodePayloadTooLarge:        "Payload too large",
+	CodeAmountBelowMinimum:     "Amount below minimum",
+	CodeAmountAboveMaximum:     "Amount above maximum",
+	CodeDailyLimitExceeded:     "Daily limit exceeded",
+	CodeCurrencyNotAllowed:     "Currency not allowed",
+	CodeMethodNotAllowed:       "Payment method not allowed",
+	CodePromotionInvalid:       "Promotion not applicable",
+	CodeInsufficientBalance:    "Insufficient balance",
+	CodeGiftCardInactive:       "Gift card inactive",
+	CodeEscrowState:            "Escrow state conflict",
+	CodeRefundRequestState:     "Refund request state conflict",
+	CodeCheckoutSessionState:   "Checkout session state conflict",
+	CodePaymentState:           "Payment state conflict",
+	CodeDuplicatePayment:       "Duplicate payment",
+	CodePaymentBlocked:         "Payment blocked",
+	CodeVelocityExceeded:       "Velocity limit exceeded",
+	CodeWrongRegion:            "Wrong region",
+	CodeErasureBlocked:         "Erasure blocked",
+	CodePaymentPlanState:       "Payment plan state conflict",
+	CodeVaultConflict:          "Vault conflict",
+	CodeFXQuoteExpired:         "FX quote expired",
+	CodeQuoteExpired:           "Quote expired",
+	CodeQuoteChanged:           "Quote no longer matches",
+	CodeSubscriptionState:      "Subscription state conflict",
+	CodeTrialUsed:              "Trial already used",
+	CodeWebhookDeliveryState:   "Webhook delivery state conflict",
+	CodePayoutsDisabled:        "Payouts disabled",
+	CodeBalanceHoldState:       "Balance hold state conflict",
+	CodeDeadLetterState:        "Dead letter state conflict",
+	CodeUnauthorized:           "Unauthorized",
+	CodeForbidden:              "Forbidden",
+	CodeQuotaExceeded:          "API key quota exceeded",
+	CodeRateLimited:            "Rate limited",
+	CodeOverloaded:             "Service overloaded",
+	CodeProviderUnavailable:    "Payment provider unavailable",
+	CodeUpstreamFailed:         "Upstream service failed",
+	CodeNotConfigured:          "Not configured",
+	CodeInternal:               "Internal error",
+}
+
+// errorTypeDocs serves GET /errors/:code, the document behind each
+// problem type URI.
+func errorTypeDocs(c *gin.Context) {
+	code := ErrorCode(c.Param("code"))
+	title, ok := codeTitles[code]
+	if !ok {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Unknown error code "+string(code)))
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{
+		"type":         errorTypeBaseURL + string(code),
+		"title":        title,
+		"status":       codeStatus[code],
+		"code":         code,
+		"user_message": userMessage(requestLanguage(c), code, ""),
+	})
+}
+
+// declineCodes maps Stripe decline codes that clients act on differently.
+// Everything else, including fraud-related declines, is a plain decline so
+// we don't tell a fraudster which check tripped.
+var declineCodes = map[stripe.DeclineCode]ErrorCode{
+	stripe.DeclineCodeInsufficientFunds: CodeInsufficientFunds,
+	"expired_card":                      CodeExpiredCard,
+	"incorrect_cvc":                     CodeIncorrectCVC,
+	"invalid_cvc":                       CodeIncorrectCVC,
+	"incorrect_number":                  CodeInvalidCardNumber,
+	"invalid_number":                    CodeInvalidCardNumber,
+	"authentication_required":           CodeAuthenticationRequired,
+	"processing_error":                  CodeProcessingError,
+}
+
+// stripeCodes maps Stripe error codes onto the taxonomy.
+var stripeCodes = map[stripe.ErrorCode]ErrorCode{
+	stripe.ErrorCodeCardDeclined:                 CodeCardDeclined,
+	stripe.ErrorCodeCardDeclineRateLimitExceeded: CodeCardDeclined,
+	stripe.ErrorCodeExpiredCard:                  CodeExpiredCard,
+	stripe.ErrorCodeIncorrectCVC:                 CodeIncorrectCVC,
+	stripe.ErrorCodeInvalidCVC:                   CodeIncorrectCVC,
+	stripe.ErrorCodeIncorrectNumber:              CodeInvalidCardNumber,
+	stripe.ErrorCodeInvalidExpiryMonth:           CodeExpiredCard,
+	stripe.ErrorCodeInvalidExpiryYear:            CodeExpiredCard,
+	stripe.ErrorCodeAuthenticationRequired:       CodeAuthenticationRequired,
+	stripe.ErrorCodeProcessingError:              CodeProcessingError,
+	stripe.ErrorCodeAmountTooSmall:               CodeInvalidAmount,
+	stripe.ErrorCodeAmountTooLarge:               CodeInvalidAmount,
+	stripe.ErrorCodeResourceMissing:              CodeNotFound,
+	stripe.ErrorCodeRateLimit:                    CodeRateLimited,
+	stripe.ErrorCodeIdempotencyKeyInUse:          CodeIdempotencyConflict,
+}
+
+// codeStatus is the HTTP status for each code.
+var codeStatus = map[ErrorCode]int{
+	CodeCardDeclined:           http.StatusPaymentRequired,
+	CodeInsufficientFunds:      http.StatusPaymentRequired,
+	CodeExpiredCard:            http.StatusPaymentRequired,
+	CodeIncorrectCVC:           http.StatusPaymentRequired,
+	CodeInvalidCardNumber:      http.StatusPaymentRequired,
+	CodeAuthenticationRequired: http.StatusPaymentRequired,
+	CodeProcessingError:        http.StatusPaymentRequired,
+	CodeInvalidRequest:         http.StatusBadRequest,
+	CodeValidationFailed:       http.StatusUnprocessableEntity,
+	CodeInvalidAmount:          http.StatusBadRequest,
+	CodeInvalidCurrency:        http.StatusBadRequest,
+	CodeNotFound:               http.StatusNotFound,
+	CodeIdempotencyConflict:    http.StatusConflict,
+	CodePayloadTooLarge:        http.StatusRequestEntityTooLarge,
+	CodeAmountBelowMinimum:     http.StatusUnprocessableEntity,
+	CodeAmountAboveMaximum:     http.StatusUnprocessableEntity,
+	CodeDailyLimitExceeded:     http.StatusUnprocessableEntity,
+	CodeCurrencyNotAllowed:     http.StatusUnprocessableEntity,
+	CodeMethodNotAllowed:       http.StatusUnprocessableEntity,
+	CodePromotionInvalid:       http.StatusUnprocessableEntity,
+	CodeInsufficientBalance:    http.StatusUnprocessableEntity,
+	CodeGiftCardInactive:       http.StatusUnprocessableEntity,
+	CodeEscrowState:            http.StatusConflict,
+	CodeRefundRequestState:     http.StatusConflict,
+	CodeCheckoutSessionState:   http.StatusConflict,
+	CodePaymentState:           http.StatusConflict,
+	CodeDuplicatePayment:       http.StatusConflict,
+	CodePaymentBlocked:         http.StatusForbidden,
+	CodeVelocityExceeded:       http.StatusTooManyRequests,
+	CodeWrongRegion:            http.StatusMisdirectedRequest,
+	CodeErasureBlocked:         http.StatusConflict,
+	CodePaymentPlanState:       http.StatusConflict,
+	CodeVaultConflict:          http.StatusConflict,
+	CodeFXQuoteExpired:         http.StatusUnprocessableEntity,
+	CodeQuoteExpired:           http.StatusUnprocessableEntity,
+	CodeQuoteChanged:           http.StatusConflict,
+	CodeSubscriptionState:      http.StatusConflict,
+	CodeTrialUsed:              http.StatusConflict,
+	CodeWebhookDeliveryState:   http.StatusConflict,
+	CodePayoutsDisabled:        http.StatusConflict,
+	CodeBalanceHoldState:       http.StatusConflict,
+	CodeDeadLetterState:        http.StatusConflict,
+	CodeUnauthorized:           http.StatusUnauthorized,
+	CodeForbidden:              http.StatusForbidden,
+	CodeQuotaExceeded:          http.StatusTooManyRequests,
+	CodeRateLimited:            http.StatusTooManyRequests,
+	CodeOverloaded:             http.StatusServiceUnavailable,
+	CodeProviderUnavailable:    http.StatusServiceUnavailable,
+	CodeUpstreamFailed:         http.StatusBadGateway,
+	CodeNotConfigured:          http.StatusServiceUnavailable,
+	CodeInternal:               http.StatusInternalServerError,
+}
+
+// classifyStripeError maps a Stripe API error onto the taxonomy. Card
+// messages come from Stripe already customer-safe and are passed through.
+func classifyStripeError(se *stripe.Error) (ErrorCode, string) {
+	if code, ok := declineCodes[se.DeclineCode]; ok {
+		return code, se.Msg
+	}
+	if code, ok := stripeCodes[se.Code]; ok {
+		return code, se.Msg
+	}
+
+	switch se.Type {
+	case stripe.ErrorTypeCard:
+		return CodeCardDeclined, se.Msg
+	case stripe.ErrorTypeIdempotency:
+		return CodeIdempotencyConflict, se.Msg
+	case stripe.ErrorTypeInvalidRequest:
+		switch {
+		case se.Param == "currency":
+			return CodeInvalidCurrency, se.Msg
+		case se.Param == "amount":
+			return CodeInvalidAmount, se.Msg
+		case se.HTTPStatusCode == http.StatusUnauthorized || se.HTTPStatusCode == http.StatusForbidden:
+			// Our API key is wrong; the caller can't fix that.
+			return CodeProviderUnavailable, "Payment provider rejected our credentials"
+		case se.HTTPStatusCode == http.StatusNotFound:
+			return CodeNotFound, se.Msg
+		}
+		return CodeInvalidRequest, se.Msg
+	}
+	return CodeProviderUnavailable, "Payment provider unavailable"
+}
+
+// classifyError returns the code and message for an arbitrary error.
+// Errors that aren't from Stripe (network failures talking to it, mostly)
+// are treated as the provider being unavailable, apart from promotions
+// and points that ran out while the payment was being created.
+func classifyError(err error) (ErrorCode, string) {
+	var se *stripe.Error
+	if errors.As(err, &se) {
+		return classifyStripeError(se)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return CodeProviderUnavailable, "Payment provider timed out"
+	}
+	if errors.Is(err, errTenantThrottled) {
+		return CodeRateLimited, "Too many payment provider calls for this tenant; retry shortly"
+	}
+	var pe *promotionError
+	if errors.As(err, &pe) {
+		return CodePromotionInvalid, pe.Error()
+	}
+	if errors.Is(err, errInsufficientPoints) {
+		return CodeInsufficientBalance, "Points balance is too low"
+	}
+	if errors.Is(err, errPointsReversed) {
+		return CodeIdempotencyConflict, "This payment's points were given back; retry with a new Idempotency-Key"
+	}
+	return CodeProviderUnavailable, "Payment provider unavailable"
+}
+
+// respondError writes a provider error using the taxonomy.
+func respondError(c *gin.Context, err error) {
+	code, msg := classifyError(err)
+	var decline string
+	var se *stripe.Error
+	if errors.As(err, &se) {
+		decline = string(se.DeclineCode)
+	}
+	c.JSON(codeStatus[code], localizedErrorBody(c, code, decline, msg, nil))
+}
+
+// graphQLErrorPresenter puts the same codes in GraphQL error extensions.
+func graphQLErrorPresenter(ctx context.Context, err error) *gqlerror.Error {
+	gqlErr := graphql.DefaultErrorPresenter(ctx, err)
+	var se *stripe.Error
+	if errors.As(err, &se) {
+		code, msg := classifyStripeError(se)
+		gqlErr.Message = msg
+		if gqlErr.Extensions == nil {
+			gqlErr.Extensions = map[string]interface{}{}
+		}
+		gqlErr.Extensions["code"] = code
+	}
+	return gqlErr
+}
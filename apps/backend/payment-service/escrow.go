@@ -0,0 +1,746 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"github.com/stripe/stripe-go/v76/transfer"
+)
+
+var escrowReleases = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_escrow_releases_total",
+	Help: "Transfers of escrowed seller shares, by outcome (released, failed).",
+}, []string{"outcome"})
+
+// Escrow statuses. A pending escrow waits for its payment. Held funds are
+// released once the order is delivered or release_at passes; frozen ones
+// wait for a dispute to close or an operator. Releasing marks a Transfer
+// in flight.
+const (
+	escrowPending   = "pending"
+	escrowHeld      = "held"
+	escrowFrozen    = "frozen"
+	escrowReleasing = "releasing"
+	escrowReleased  = "released"
+	escrowCanceled  = "canceled"
+)
+
+// escrowMaxReleaseAfter bounds the hold period a caller may ask for.
+const escrowMaxReleaseAfter = 90 * 24 * time.Hour
+
+// escrowReleaseStale is how long a release may stay in flight before a
+// sweep takes it over from an instance that died mid-transfer. Transfers
+// are idempotent per escrow, so the retry can't pay the seller twice.
+const escrowReleaseStale = 5 * time.Minute
+
+// escrowMetadataID ties a PaymentIntent and its Transfer to their escrow.
+const escrowMetadataID = "escrow_id"
+
+var errEscrowState = errors.New("escrow is not in a state that allows this")
+
+// Escrow is a marketplace payment collected on the platform whose seller
+// share is paid out later, by a Transfer to the seller's connected
+// account, rather than with the charge.
+type Escrow struct {
+	ID            string `json:"id"`
+	PaymentID     string `json:"payment_id,omitempty"`
+	TenantID      string `json:"tenant_id,omitempty"`
+	OrderID       string `json:"order_id,omitempty"`
+	SellerAccount string `json:"seller_account"`
+	Currency      string `json:"currency"`
+	Amount        int64  `json:"amount"`
+	SellerAmount  int64  `json:"seller_amount"`
+	PlatformFee   int64  `json:"platform_fee"`
+	Status        string `json:"status"`
+	// ReleaseAfterSeconds is how long after payment the share is released
+	// without a delivery confirmation.
+	ReleaseAfterSeconds int64      `json:"release_after_seconds"`
+	ChargeID            string     `json:"charge_id,omitempty"`
+	TransferID          string     `json:"transfer_id,omitempty"`
+	DisputeID           string     `json:"dispute_id,omitempty"`
+	StatusReason        string     `json:"status_reason,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	FundedAt            *time.Time `json:"funded_at,omitempty"`
+	DeliveredAt         *time.Time `json:"delivered_at,omitempty"`
+	ReleaseAt           *time.Time `json:"release_at,omitempty"`
+	ReleasedAt          *time.Time `json:"released_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+}
+
+const escrowColumns = `id, COALESCE(payment_id, ''), tenant_id, order_id, seller_account, currency, amount, seller_amount,
+	status, release_after_seconds, charge_id, transfer_id, dispute_id, status_reason, last_error,
+	funded_at, delivered_at, release_at, released_at, created_at, updated_at`
+
+func scanEscrow(row interface{ Scan(...interface{}) error }) (*Escrow, error) {
+	var e Escrow
+	var funded, delivered, releaseAt, released sql.NullTime
+	if err := row.Scan(&e.ID, &e.PaymentID, &e.TenantID, &e.OrderID, &e.SellerAccount, &e.Currency, &e.Amount,
+		&e.SellerAmount, &e.Status, &e.ReleaseAfterSeconds, &e.ChargeID, &e.TransferID, &e.DisputeID,
+		&e.StatusReason, &e.LastError, &funded, &delivered, &releaseAt, &released, &e.CreatedAt, &e.UpdatedAt); err != nil {
+		return nil, err
+	}
+	e.PlatformFee = e.Amount - e.SellerAmount
+	e.FundedAt = timeOrNil(funded)
+	e.DeliveredAt = timeOrNil(delivered)
+	e.ReleaseAt = timeOrNil(releaseAt)
+	e.ReleasedAt = timeOrNil(released)
+	return &e, nil
+}
+
+func timeOrNil(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func nullTimeOf(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+// CreateEscrow records a pending escrow before its payment is created, so
+// the payment's webhooks always find it. A retry with the same
+// idempotency key gets the escrow the first attempt recorded.
+func (s *Store) CreateEscrow(ctx context.Context, e *Escrow, idempotencyKey string) (*Escrow, error) {
+	key := sql.NullString{String: idempotencyKey, Valid: idempotencyKey != ""}
+	created, err := scanEscrow(s.db.QueryRowContext(ctx, `
+		INSERT INTO escrows (id, tenant_id, order_id, seller_account, currency, amount, seller_amount, release_after_seconds, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (idempotency_key) DO NOTHING
+		RETURNING `+escrowColumns,
+		e.ID, e.TenantID, e.OrderID, e.SellerAccount, e.Currency, e.Amount, e.SellerAmount, e.ReleaseAfterSeconds, key))
+	if !errors.Is(err, sql.ErrNoRows) || !key.Valid {
+		return created, err
+	}
+	return scanEscrow(s.db.QueryRowContext(ctx, `SELECT `+escrowColumns+` FROM escrows WHERE idempotency_key = $1`, key))
+}
+
+func (s *Store) Escrow(ctx context.Context, id string) (*Escrow, error) {
+	return scanEscrow(s.db.QueryRowContext(ctx, `SELECT `+escrowColumns+` FROM escrows WHERE id = $1`, id))
+}
+
+func (s *Store) EscrowByPayment(ctx context.Context, paymentID string) (*Escrow, error) {
+	return scanEscrow(s.db.QueryRowContext(ctx, `SELECT `+escrowColumns+` FROM escrows WHERE payment_id = $1`, paymentID))
+}
+
+// SetEscrowPayment links an escrow to its PaymentIntent. Only the linked
+// payment funds or cancels the escrow.
+func (s *Store) SetEscrowPayment(ctx context.Context, id, paymentID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE escrows SET payment_id = $2, updated_at = now() WHERE id = $1 AND payment_id IS NULL`, id, paymentID)
+	return err
+}
+
+// DeleteUnpaidEscrow removes an escrow whose payment could not be created.
+func (s *Store) DeleteUnpaidEscrow(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM escrows WHERE id = $1 AND payment_id IS NULL AND status = 'pending'`, id)
+	return err
+}
+
+// changeEscrow applies fn to an escrow under its row lock and saves the
+// result, posting the ledger entries fn returns in the same transaction.
+// fn refuses a change by returning errEscrowState, in which case the
+// escrow is returned as it was. A change that leaves the escrow as it was
+// writes nothing, so redelivered webhooks are free.
+func (s *Store) changeEscrow(ctx context.Context, id string, fn func(e *Escrow) ([]LedgerEntry, error)) (*Escrow, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	e, err := scanEscrow(tx.QueryRowContext(ctx, `SELECT `+escrowColumns+` FROM escrows WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		return nil, err
+	}
+	before := *e
+	entries, err := fn(e)
+	if err != nil {
+		return &before, err
+	}
+	if *e == before {
+		return e, nil
+	}
+
+	if len(entries) > 0 {
+		if _, err := postLedger(ctx, tx, "escrow."+e.Status, e.ID, e.Currency, entries...); err != nil {
+			return nil, err
+		}
+	}
+	e, err = scanEscrow(tx.QueryRowContext(ctx, `
+		UPDATE escrows SET
+			payment_id = NULLIF($2, ''), status = $3, charge_id = $4, transfer_id = $5, dispute_id = $6,
+			status_reason = $7, last_error = $8, funded_at = $9, delivered_at = $10, release_at = $11,
+			released_at = $12, updated_at = now()
+		WHERE id = $1
+		RETURNING `+escrowColumns,
+		e.ID, e.PaymentID, e.Status, e.ChargeID, e.TransferID, e.DisputeID, e.StatusReason, e.LastError,
+		nullTimeOf(e.FundedAt), nullTimeOf(e.DeliveredAt), nullTimeOf(e.ReleaseAt), nullTimeOf(e.ReleasedAt)))
+	if err != nil {
+		return nil, err
+	}
+	return e, tx.Commit()
+}
+
+// ClaimDueEscrow marks the next escrow due for release as releasing and
+// returns it, or sql.ErrNoRows when none is due. Instances sweeping at
+// the same time skip each other's rows, and releases left in flight
+// longer than escrowReleaseStale are taken over. skip lists escrows that
+// already failed in this sweep.
+func (s *Store) ClaimDueEscrow(ctx context.Context, skip []string) (*Escrow, error) {
+	if skip == nil {
+		skip = []string{}
+	}
+	return scanEscrow(s.db.QueryRowContext(ctx, `
+		UPDATE escrows SET status = 'releasing', updated_at = now()
+		WHERE id = (
+			SELECT id FROM escrows
+			WHERE id <> ALL($1) AND (
+				(status = 'held' AND (delivered_at IS NOT NULL OR release_at <= now()))
+				OR (status = 'releasing' AND updated_at < $2))
+			ORDER BY release_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING `+escrowColumns,
+		skip, time.Now().Add(-escrowReleaseStale)))
+}
+
+func escrowAccount(id string) string { return "escrow:" + id }
+
+// fundingEntries are the ledger entries for an escrow's payment: the
+// seller share is held and the platform fee is earned straight away.
+func fundingEntries(e *Escrow) []LedgerEntry {
+	entries := []LedgerEntry{
+		{Account: ledgerStripeClearing, Amount: -e.Amount},
+		{Account: escrowAccount(e.ID), Amount: e.SellerAmount},
+	}
+	if e.PlatformFee > 0 {
+		entries = append(entries, LedgerEntry{Account: salesAccount(e.TenantID), Amount: e.PlatformFee})
+	}
+	return entries
+}
+
+// reversed negates entries, for undoing them.
+func reversed(entries []LedgerEntry) []LedgerEntry {
+	out := make([]LedgerEntry, len(entries))
+	for i, e := range entries {
+		out[i] = LedgerEntry{Account: e.Account, Amount: -e.Amount}
+	}
+	return out
+}
+
+// Escrows holds the seller share of marketplace payments on the platform
+// and releases it with a Transfer once the order is delivered or the hold
+// period ends, whichever comes first. Disputes and partial refunds freeze
+// the release; full refunds and lost disputes cancel it.
+type Escrows struct {
+	store        *Store
+	payments     *PaymentService
+	releaseAfter time.Duration
+	interval     time.Duration
+}
+
+func NewEscrows(store *Store, payments *PaymentService, releaseAfter, interval time.Duration) *Escrows {
+	return &Escrows{store: store, payments: payments, releaseAfter: releaseAfter, interval: interval}
+}
+
+// RegisterRoutes mounts the escrow API for the marketplace backend, which
+// needs a key with the escrow scope, and operator holds and releases under
+// the admin scope.
+func (e *Escrows) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/escrows", requireScope(e.store, bootstrapToken, "escrow"), e.requireStore)
+	g.POST("", e.create)
+	g.GET("/:id", e.get)
+	g.POST("/:id/delivery", e.confirmDelivery)
+
+	admin := r.Group("/admin/escrows", requireScope(e.store, bootstrapToken, "admin"), e.requireStore)
+	admin.POST("/:id/hold", e.hold)
+	admin.POST("/:id/release", e.forceRelease)
+}
+
+func (e *Escrows) requireStore(c *gin.Context) {
+	if e.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Escrow requires DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// respondChange answers a failed escrow change, returning false, or
+// returns true when err is nil.
+func (e *Escrows) respondChange(c *gin.Context, escrow *Escrow, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Escrow not found"))
+	case errors.Is(err, errEscrowState):
+		c.JSON(http.StatusConflict, errorBodyWith(c, CodeEscrowState, "Escrow is "+escrow.Status,
+			gin.H{"status": escrow.Status}))
+	default:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+	}
+	return false
+}
+
+// create records an escrow and the PaymentIntent that funds it. The
+// intent carries the escrow's ID as its transfer group, so the release
+// Transfer is grouped with the charge in the Dashboard.
+func (e *Escrows) create(c *gin.Context) {
+	var req struct {
+		Amount              int64             `json:"amount" binding:"required,gt=0"`
+		Currency            string            `json:"currency" binding:"required,len=3"`
+		SellerAccount       string            `json:"seller_account" binding:"required,startswith=acct_"`
+		PlatformFee         int64             `json:"platform_fee" binding:"gte=0"`
+		ReleaseAfterSeconds int64             `json:"release_after_seconds" binding:"gte=0"`
+		Description         string            `json:"description"`
+		OrderID             string            `json:"order_id"`
+		CustomerID          string            `json:"customer_id"`
+		TenantID            string            `json:"tenant_id"`
+		ReceiptEmail        string            `json:"receipt_email"`
+		Metadata            map[string]string `json:"metadata"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if fields := validateMetadata(req.Metadata); len(fields) > 0 {
+		validationFailed(c, fields)
+		return
+	}
+	if req.PlatformFee >= req.Amount {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidAmount, "platform_fee must be less than amount"))
+		return
+	}
+	releaseAfter := e.releaseAfter
+	if req.ReleaseAfterSeconds > 0 {
+		releaseAfter = time.Duration(req.ReleaseAfterSeconds) * time.Second
+	}
+	if releaseAfter > escrowMaxReleaseAfter {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest,
+			fmt.Sprintf("release_after_seconds must be at most %d", int64(escrowMaxReleaseAfter/time.Second))))
+		return
+	}
+	ctx := c.Request.Context()
+	key := c.GetHeader("Idempotency-Key")
+
+	want := &Escrow{
+		ID:                  uuid.NewString(),
+		TenantID:            req.TenantID,
+		OrderID:             req.OrderID,
+		SellerAccount:       req.SellerAccount,
+		Currency:            strings.ToLower(req.Currency),
+		Amount:              req.Amount,
+		SellerAmount:        req.Amount - req.PlatformFee,
+		ReleaseAfterSeconds: int64(releaseAfter / time.Second),
+	}
+	escrow, err := e.store.CreateEscrow(ctx, want, key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if escrow.Amount != want.Amount || escrow.SellerAmount != want.SellerAmount ||
+		escrow.SellerAccount != want.SellerAccount || escrow.Currency != want.Currency {
+		c.JSON(http.StatusConflict, errorBody(c, CodeIdempotencyConflict, "Idempotency-Key was already used for a different escrow"))
+		return
+	}
+
+	metadata := map[string]string{}
+	for k, v := range req.Metadata {
+		metadata[k] = v
+	}
+	metadata[escrowMetadataID] = escrow.ID
+	preq := PaymentRequest{
+		Amount:        escrow.Amount,
+		Currency:      escrow.Currency,
+		Description:   req.Description,
+		OrderID:       req.OrderID,
+		CustomerID:    req.CustomerID,
+		TenantID:      req.TenantID,
+		ReceiptEmail:  req.ReceiptEmail,
+		Metadata:      metadata,
+		transferGroup: escrow.ID,
+	}
+	pi, ok := e.payments.createFor(c, preq, key)
+	if !ok {
+		if escrow.PaymentID == "" {
+			if err := e.store.DeleteUnpaidEscrow(context.WithoutCancel(ctx), escrow.ID); err != nil {
+				logf(ctx, "deleting unpaid escrow %s: %v", escrow.ID, err)
+			}
+		}
+		return
+	}
+	if escrow.PaymentID == "" {
+		if err := e.store.SetEscrowPayment(ctx, escrow.ID, pi.ID); err != nil {
+			// Unlinked, the payment would never fund the escrow.
+			cancel := &stripe.PaymentIntentCancelParams{}
+			cancel.Context = context.WithoutCancel(ctx)
+			if _, cerr := paymentintent.Cancel(pi.ID, cancel); cerr != nil {
+				logf(ctx, "canceling unlinked escrow payment %s: %v", pi.ID, cerr)
+			}
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+		escrow.PaymentID = pi.ID
+	}
+	respondData(c, http.StatusCreated, gin.H{"escrow": escrow, "payment": paymentData(pi, true)})
+}
+
+func (e *Escrows) get(c *gin.Context) {
+	escrow, err := e.store.Escrow(c.Request.Context(), c.Param("id"))
+	if e.respondChange(c, escrow, err) {
+		respondData(c, http.StatusOK, escrow)
+	}
+}
+
+// confirmDelivery is the delivery callback. The seller share is released
+// straight away, or by the next sweep once the payment succeeds if it
+// hasn't yet; a frozen escrow keeps the confirmation for when it thaws.
+// Repeated callbacks are harmless.
+func (e *Escrows) confirmDelivery(c *gin.Context) {
+	ctx := c.Request.Context()
+	escrow, err := e.store.changeEscrow(ctx, c.Param("id"), func(es *Escrow) ([]LedgerEntry, error) {
+		if es.Status == escrowCanceled {
+			return nil, errEscrowState
+		}
+		if es.DeliveredAt == nil {
+			now := time.Now().UTC()
+			es.DeliveredAt = &now
+		}
+		return nil, nil
+	})
+	if !e.respondChange(c, escrow, err) {
+		return
+	}
+	if escrow.Status == escrowHeld {
+		released, err := e.release(ctx, escrow.ID, escrowHeld)
+		if err != nil {
+			// The sweep retries; the response shows the failure.
+			logf(ctx, "releasing escrow %s: %v", escrow.ID, err)
+		}
+		if released != nil {
+			escrow = released
+		}
+	}
+	respondData(c, http.StatusOK, escrow)
+}
+
+// hold freezes a held escrow until an operator releases it.
+func (e *Escrows) hold(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason" binding:"required"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	escrow, err := e.store.changeEscrow(c.Request.Context(), c.Param("id"), func(es *Escrow) ([]LedgerEntry, error) {
+		if es.Status != escrowHeld && es.Status != escrowFrozen {
+			return nil, errEscrowState
+		}
+		es.Status = escrowFrozen
+		es.StatusReason = req.Reason
+		return nil, nil
+	})
+	if e.respondChange(c, escrow, err) {
+		respondData(c, http.StatusOK, escrow)
+	}
+}
+
+// forceRelease pays out a held or frozen escrow now, whatever its release
+// conditions, for operators settling a dispute or support case.
+func (e *Escrows) forceRelease(c *gin.Context) {
+	ctx := c.Request.Context()
+	escrow, err := e.release(ctx, c.Param("id"), escrowHeld, escrowFrozen)
+	if errors.Is(err, sql.ErrNoRows) || errors.Is(err, errEscrowState) {
+		e.respondChange(c, escrow, err)
+		return
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondData(c, http.StatusOK, escrow)
+}
+
+// release claims an escrow in one of the from statuses and pays out its
+// seller share.
+func (e *Escrows) release(ctx context.Context, id string, from ...string) (*Escrow, error) {
+	claimed, err := e.store.changeEscrow(ctx, id, func(es *Escrow) ([]LedgerEntry, error) {
+		for _, s := range from {
+			if es.Status == s {
+				es.Status = escrowReleasing
+				return nil, nil
+			}
+		}
+		return nil, errEscrowState
+	})
+	if err != nil {
+		return claimed, err
+	}
+	return e.transfer(ctx, claimed)
+}
+
+// transfer pays a claimed escrow's seller share to the seller's account
+// and records the outcome. The Transfer's idempotency key is the escrow's,
+// so a retry after a crash finds the first Transfer instead of paying
+// twice. Requests Stripe will keep refusing, such as to a closed account,
+// freeze the escrow for an operator; other failures leave it held for the
+// next sweep.
+func (e *Escrows) transfer(ctx context.Context, es *Escrow) (*Escrow, error) {
+	params := &stripe.TransferParams{
+		Amount:            stripe.Int64(es.SellerAmount),
+		Currency:          stripe.String(es.Currency),
+		Destination:       stripe.String(es.SellerAccount),
+		TransferGroup:     stripe.String(es.ID),
+		SourceTransaction: stripe.String(es.ChargeID),
+	}
+	params.Context = ctx
+	params.SetIdempotencyKey("escrow-release-" + es.ID)
+	params.AddMetadata(escrowMetadataID, es.ID)
+	params.AddMetadata("payment_id", es.PaymentID)
+	if es.OrderID != "" {
+		params.AddMetadata("order_id", es.OrderID)
+	}
+
+	tr, err := transfer.New(params)
+	ctx = context.WithoutCancel(ctx)
+	if err != nil {
+		escrowReleases.WithLabelValues("failed").Inc()
+		var stripeErr *stripe.Error
+		refused := errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeInvalidRequest
+		updated, uerr := e.store.changeEscrow(ctx, es.ID, func(cur *Escrow) ([]LedgerEntry, error) {
+			cur.LastError = err.Error()
+			if cur.Status == escrowReleasing {
+				cur.Status = escrowHeld
+				if refused {
+					cur.Status = escrowFrozen
+					cur.StatusReason = "transfer refused by Stripe"
+				}
+			}
+			return nil, nil
+		})
+		if uerr != nil {
+			logf(ctx, "recording failed release of escrow %s: %v", es.ID, uerr)
+			return es, err
+		}
+		return updated, err
+	}
+
+	escrowReleases.WithLabelValues("released").Inc()
+	return e.store.changeEscrow(ctx, es.ID, func(cur *Escrow) ([]LedgerEntry, error) {
+		now := time.Now().UTC()
+		cur.Status = escrowReleased
+		cur.TransferID = tr.ID
+		cur.ReleasedAt = &now
+		cur.LastError = ""
+		return []LedgerEntry{
+			{Account: escrowAccount(cur.ID), Amount: -cur.SellerAmount},
+			{Account: ledgerConnectTransfers, Amount: cur.SellerAmount},
+		}, nil
+	})
+}
+
+// Run releases due escrows every interval until ctx is done.
+func (e *Escrows) Run(ctx context.Context) {
+	if e == nil || e.store == nil {
+		return
+	}
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		if err := e.releaseDue(ctx); err != nil {
+			log.Printf("escrow release: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// releaseDue releases every escrow that is due, trying each once.
+func (e *Escrows) releaseDue(ctx context.Context) error {
+	var failed []string
+	for {
+		es, err := e.store.ClaimDueEscrow(ctx, failed)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := e.transfer(ctx, es); err != nil {
+			log.Printf("releasing escrow %s: %v", es.ID, err)
+			failed = append(failed, es.ID)
+		}
+	}
+}
+
+// cancelEscrow undoes an escrow's funding when its payment is canceled or given
+// back. Once the share is on its way to the seller, getting it back is a
+// Transfer reversal for an operator, so the escrow only records why.
+func cancelEscrow(reason string) func(es *Escrow) ([]LedgerEntry, error) {
+	return func(es *Escrow) ([]LedgerEntry, error) {
+		switch es.Status {
+		case escrowPending:
+			es.Status = escrowCanceled
+			es.StatusReason = reason
+		case escrowHeld, escrowFrozen:
+			es.Status = escrowCanceled
+			es.StatusReason = reason
+			return reversed(fundingEntries(es)), nil
+		case escrowReleasing, escrowReleased:
+			es.StatusReason = reason
+		}
+		return nil, nil
+	}
+}
+
+// freezeEscrow stops a held escrow from being released. Escrows already
+// released only record why.
+func freezeEscrow(reason string) func(es *Escrow) ([]LedgerEntry, error) {
+	return func(es *Escrow) ([]LedgerEntry, error) {
+		switch es.Status {
+		case escrowHeld:
+			es.Status = escrowFrozen
+			es.StatusReason = reason
+		case escrowReleasing, escrowReleased:
+			es.StatusReason = reason
+		}
+		return nil, nil
+	}
+}
+
+// paymentIntentEvent funds an escrow when its payment succeeds and
+// cancels it when the payment is canceled. Metadata only names the escrow:
+// the event must be for the payment linked to it, and a success must be
+// for the escrow's amount and currency.
+func (e *Escrows) paymentIntentEvent(ctx context.Context, typ stripe.EventType, pi *stripe.PaymentIntent) error {
+	id := pi.Metadata[escrowMetadataID]
+	if e == nil || e.store == nil || id == "" {
+		return nil
+	}
+
+	var fn func(es *Escrow) ([]LedgerEntry, error)
+	switch typ {
+	case "payment_intent.succeeded":
+		fn = func(es *Escrow) ([]LedgerEntry, error) {
+			if es.Status != escrowPending {
+				return nil, nil
+			}
+			if es.PaymentID == "" {
+				// create hasn't linked it yet; the redelivery will find it.
+				return nil, errors.New("escrow has no payment yet")
+			}
+			if es.PaymentID != pi.ID {
+				return nil, nil
+			}
+			if pi.AmountReceived != es.Amount || string(pi.Currency) != es.Currency {
+				logf(ctx, "escrow %s: payment %s received %d %s, want %d %s",
+					es.ID, pi.ID, pi.AmountReceived, pi.Currency, es.Amount, es.Currency)
+				return nil, nil
+			}
+			now := time.Now().UTC()
+			releaseAt := now.Add(time.Duration(es.ReleaseAfterSeconds) * time.Second)
+			es.Status = escrowHeld
+			es.PaymentID = pi.ID
+			if pi.LatestCharge != nil {
+				es.ChargeID = pi.LatestCharge.ID
+			}
+			es.FundedAt = &now
+			es.ReleaseAt = &releaseAt
+			return fundingEntries(es), nil
+		}
+	case "payment_intent.canceled":
+		cancel := cancelEscrow("payment canceled")
+		fn = func(es *Escrow) ([]LedgerEntry, error) {
+			if es.PaymentID != pi.ID {
+				return nil, nil
+			}
+			return cancel(es)
+		}
+	default:
+		return nil
+	}
+	if _, err := e.store.changeEscrow(ctx, id, fn); errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("updating escrow %s for %s: %w", id, pi.ID, err)
+	}
+	return nil
+}
+
+// chargeRefunded cancels the escrow of a fully refunded payment and
+// freezes that of a partly refunded one, leaving an operator to decide
+// what the seller is owed.
+func (e *Escrows) chargeRefunded(ctx context.Context, ch *stripe.Charge) error {
+	if e == nil || e.store == nil || ch.PaymentIntent == nil || ch.AmountRefunded == 0 {
+		return nil
+	}
+	fn := freezeEscrow("partially refunded")
+	if ch.Refunded {
+		fn = cancelEscrow("refunded")
+	}
+	return e.changeByPayment(ctx, ch.PaymentIntent.ID, fn)
+}
+
+// disputeEvent freezes an escrow while its payment is disputed. A won
+// dispute lets the release go ahead; a lost one cancels it.
+func (e *Escrows) disputeEvent(ctx context.Context, typ stripe.EventType, d *stripe.Dispute) error {
+	if e == nil || e.store == nil || d.PaymentIntent == nil {
+		return nil
+	}
+
+	switch typ {
+	case "charge.dispute.created":
+		return e.changeByPayment(ctx, d.PaymentIntent.ID, func(es *Escrow) ([]LedgerEntry, error) {
+			es.DisputeID = d.ID
+			return freezeEscrow("dispute " + d.ID + " opened")(es)
+		})
+	case "charge.dispute.closed":
+		return e.changeByPayment(ctx, d.PaymentIntent.ID, func(es *Escrow) ([]LedgerEntry, error) {
+			if es.DisputeID != d.ID {
+				return nil, nil
+			}
+			if d.Status == stripe.DisputeStatusLost {
+				return cancelEscrow("dispute " + d.ID + " lost")(es)
+			}
+			if es.Status == escrowFrozen {
+				es.Status = escrowHeld
+				es.StatusReason = ""
+			}
+			return nil, nil
+		})
+	}
+	return nil
+}
+
+func (e *Escrows) changeByPayment(ctx context.Context, paymentID string, fn func(es *Escrow) ([]LedgerEntry, error)) error {
+	es, err := e.store.EscrowByPayment(ctx, paymentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading escrow for %s: %w", paymentID, err)
+	}
+	if _, err := e.store.changeEscrow(ctx, es.ID, fn); err != nil {
+		return fmt.Errorf("updating escrow %s: %w", es.ID, err)
+	}
+	return nil
+}
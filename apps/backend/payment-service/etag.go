@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"golang.org/x/sync/singleflight"
+)
+
+// PaymentCache serves GET /payment/:id for checkout pages that poll. Each
+// intent is fetched from Stripe at most once per TTL however many pages
+// are polling it, and webhooks evict entries as soon as the intent
+// changes, so the TTL only bounds staleness when a webhook is lost.
+type PaymentCache struct {
+	ttl   time.Duration
+	group singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]*cachedPayment
+}
+
+type cachedPayment struct {
+	pi          *stripe.PaymentIntent
+	fetchedAt   time.Time
+	fingerprint string
+	// modifiedAt is when we first saw the intent in its current state.
+	modifiedAt time.Time
+	// bodies holds the status response per API version, encoded once per
+	// fetch rather than once per poll.
+	bodies [latestAPIVersion + 1]cachedBody
+}
+
+type cachedBody struct {
+	raw  []byte
+	etag string
+}
+
+// paymentStatusV1 is the version 1 status body. Its fields are in the
+// order gin.H would sort them, so ETags match those of earlier releases.
+type paymentStatusV1 struct {
+	Amount int64  `json:"amount"`
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Region string `json:"region,omitempty"`
+}
+
+func statusBody(pi *stripe.PaymentIntent, version int) interface{} {
+	if version >= 2 {
+		return paymentData(pi, false)
+	}
+	return paymentStatusV1{Amount: pi.Amount, ID: pi.ID, Status: paymentStatus(pi), Region: regionOf(pi)}
+}
+
+// settledTTL is how long terminal intents are cached; they can't change.
+const settledTTL = time.Hour
+
+func NewPaymentCache(ttl time.Duration, hub *EventHub) *PaymentCache {
+	pc := &PaymentCache{ttl: ttl, entries: map[string]*cachedPayment{}}
+	go pc.evictOnEvents(hub)
+	go pc.janitor()
+	return pc
+}
+
+// get returns the entry for id, fetching it if absent or expired.
+func (pc *PaymentCache) get(ctx context.Context, id string) (*cachedPayment, error) {
+	pc.mu.Lock()
+	e, ok := pc.entries[id]
+	pc.mu.Unlock()
+	if ok && time.Since(e.fetchedAt) < pc.lifetime(e) {
+		return e, nil
+	}
+
+	v, err, _ := pc.group.Do(id, func() (interface{}, error) {
+		// Shared by every caller waiting on this id, so one leaving
+		// mustn't cancel it for the rest.
+		params := &stripe.PaymentIntentParams{}
+		params.Context = context.WithoutCancel(ctx)
+		pi, err := paymentintent.Get(id, params)
+		if err != nil {
+			return nil, err
+		}
+		return pc.store(pi), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*cachedPayment), nil
+}
+
+// Status serves GET /payment/:id. Pollers revalidate with If-None-Match,
+// and both the 304 and the full body come straight from the cache entry.
+func (pc *PaymentCache) Status(c *gin.Context) {
+	e, err := pc.get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	body := e.bodies[apiVersion(c)]
+	if notModified(c, body.etag, e.modifiedAt) {
+		return
+	}
+	respondRawData(c, http.StatusOK, body.raw)
+}
+
+func (pc *PaymentCache) lifetime(e *cachedPayment) time.Duration {
+	if isTerminalStatus(string(e.pi.Status)) {
+		return settledTTL
+	}
+	return pc.ttl
+}
+
+func (pc *PaymentCache) store(pi *stripe.PaymentIntent) *cachedPayment {
+	now := time.Now().UTC().Truncate(time.Second)
+	fp := paymentStatus(pi) + "|" + strconv.FormatInt(pi.Amount, 10) + "|" + strconv.FormatInt(pi.AmountReceived, 10)
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	e := &cachedPayment{pi: pi, fetchedAt: time.Now(), fingerprint: fp, modifiedAt: now}
+	for v := 1; v <= latestAPIVersion; v++ {
+		raw, err := json.Marshal(statusBody(pi, v))
+		if err != nil {
+			continue
+		}
+		e.bodies[v] = cachedBody{raw: raw, etag: bodyETag(v, raw)}
+	}
+	if old, ok := pc.entries[pi.ID]; ok && old.fingerprint == fp {
+		e.modifiedAt = old.modifiedAt
+	}
+	pc.entries[pi.ID] = e
+	return e
+}
+
+// evictOnEvents expires an entry whenever a webhook reports a change. The
+// entry stays so the refetch can keep modifiedAt if nothing visible moved.
+func (pc *PaymentCache) evictOnEvents(hub *EventHub) {
+	events, _ := hub.Subscribe("")
+	for ev := range events {
+		pc.mu.Lock()
+		if e, ok := pc.entries[ev.PaymentID]; ok {
+			e.fetchedAt = time.Time{}
+		}
+		pc.mu.Unlock()
+	}
+}
+
+func (pc *PaymentCache) janitor() {
+	for range time.Tick(time.Minute) {
+		pc.mu.Lock()
+		for id, e := range pc.entries {
+			if time.Since(e.fetchedAt) > pc.lifetime(e) {
+				delete(pc.entries, id)
+			}
+		}
+		pc.mu.Unlock()
+	}
+}
+
+// bodyETag hashes an encoded body and its API version, never the
+// envelope, whose request_id differs on every response.
+func bodyETag(version int, raw []byte) string {
+	sum := sha256.Sum256(append([]byte(strconv.Itoa(version)+"\n"), raw...))
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// notModified sets validators and answers 304 when the client's
+// If-None-Match already has etag.
+func notModified(c *gin.Context, etag string, modified time.Time) bool {
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", modified.Format(http.TimeFormat))
+	// Revalidate on every poll; 304s are cheap.
+	c.Header("Cache-Control", "private, no-cache")
+	c.Header("Vary", "API-Version")
+
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+		return true
+	}
+	return false
+}
+
+// etagMatches applies If-None-Match's weak comparison.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// BenchmarkPaymentStatus serves GET /payment/:id from a warm cache, as
+// pollers mostly get it, with the full body and with a 304 for a poller
+// that already has it.
+func BenchmarkPaymentStatus(b *testing.B) {
+	gin.SetMode(gin.ReleaseMode)
+	pc := &PaymentCache{ttl: time.Hour, entries: map[string]*cachedPayment{}}
+	e := pc.store(&stripe.PaymentIntent{
+		ID:             "pi_bench",
+		Amount:         2500,
+		AmountReceived: 2500,
+		Currency:       stripe.CurrencyUSD,
+		Status:         stripe.PaymentIntentStatusSucceeded,
+		Created:        1700000000,
+		Metadata:       map[string]string{"order_id": "1001"},
+	})
+	r := gin.New()
+	r.GET("/payment/:id", pc.Status)
+
+	for version := 1; version <= latestAPIVersion; version++ {
+		version := version
+		newRequest := func(etag string) func() *http.Request {
+			return func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/payment/pi_bench", nil)
+				req.Header.Set(apiVersionHeader, strconv.Itoa(version))
+				if etag != "" {
+					req.Header.Set("If-None-Match", etag)
+				}
+				return req
+			}
+		}
+		b.Run(fmt.Sprintf("v%d", version), func(b *testing.B) {
+			benchmarkHandler(b, r, newRequest(""), http.StatusOK)
+		})
+		b.Run(fmt.Sprintf("v%d_not_modified", version), func(b *testing.B) {
+			benchmarkHandler(b, r, newRequest(e.bodies[version].etag), http.StatusNotModified)
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// PaymentEvent is a status transition for a single payment, as reported by
+// a Stripe webhook.
+type PaymentEvent struct {
+	PaymentID string    `json:"payment_id"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	Type      string    `json:"type"`
+	Status    string    `json:"status"`
+	Amount    int64     `json:"amount"`
+	Currency  string    `json:"currency"`
+	CreatedAt time.Time `json:"created_at"`
+	// RequestID is the request that caused the change, or for webhooks
+	// the request that created the payment.
+	RequestID string `json:"request_id,omitempty"`
+	// Region is the region of the instance that saw the change, when
+	// REGION is set.
+	Region string `json:"region,omitempty"`
+	// CustomerID is set for events of payments with a customer.
+	CustomerID string `json:"customer_id,omitempty"`
+}
+
+// subscriberBuffer is how many events a slow subscriber may fall behind
+// before further events are dropped for it.
+const subscriberBuffer = 16
+
+// EventHub fans out payment events to in-process subscribers.
+type EventHub struct {
+	mu   sync.RWMutex
+	subs map[string]map[chan PaymentEvent]struct{}
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subs: make(map[string]map[chan PaymentEvent]struct{})}
+}
+
+// Subscribe registers for events of one payment, or of all payments when
+// paymentID is empty. The returned function must be called to unsubscribe.
+func (h *EventHub) Subscribe(paymentID string) (<-chan PaymentEvent, func()) {
+	ch := make(chan PaymentEvent, subscriberBuffer)
+
+	h.mu.Lock()
+	if h.subs[paymentID] == nil {
+		h.subs[paymentID] = make(map[chan PaymentEvent]struct{})
+	}
+	h.subs[paymentID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs[paymentID], ch)
+			if len(h.subs[paymentID]) == 0 {
+				delete(h.subs, paymentID)
+			}
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish delivers an event to subscribers of its payment and to wildcard
+// subscribers. It never blocks on a slow subscriber.
+func (h *EventHub) Publish(ev PaymentEvent) {
+	if ev.Region == "" {
+		ev.Region = serviceRegion
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, key := range []string{ev.PaymentID, ""} {
+		for ch := range h.subs[key] {
+			select {
+			case ch <- ev:
+			default:
+			}
+		}
+	}
+}
+
+// isTerminalStatus reports whether a PaymentIntent status will not change
+// again on its own.
+func isTerminalStatus(status string) bool {
+	return status == "succeeded" || status == "canceled"
+}
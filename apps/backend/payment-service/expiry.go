@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+var paymentsExpiredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_payments_expired_total",
+	Help: "Stale incomplete payments swept, by outcome (expired, completed, failed).",
+}, []string{"outcome"})
+
+// paymentStatusAbandoned is the local status of a payment the sweeper
+// canceled. Stripe has it as canceled, with cancellation_reason abandoned.
+const paymentStatusAbandoned = "abandoned"
+
+// expiryBatch is how many stale payments one sweep takes on.
+const expiryBatch = 100
+
+// StalePayment is an incomplete payment left past the TTL.
+type StalePayment struct {
+	ID        string
+	TenantID  string
+	OrderID   string
+	Amount    int64
+	Currency  string
+	Status    string
+	CreatedAt time.Time
+}
+
+// StalePayments returns up to limit payments still waiting on the
+// customer that were created before cutoff, oldest first. Intents of open
+// checkout sessions are left to the session's own expiry.
+func (s *Store) StalePayments(ctx context.Context, cutoff time.Time, limit int) ([]*StalePayment, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT p.id, p.tenant_id, p.order_id, p.amount, p.currency, p.status, p.created_at FROM payments p
+		WHERE p.status IN ('requires_payment_method', 'requires_confirmation', 'requires_action')
+			AND p.created_at <= $1
+			AND NOT EXISTS (SELECT 1 FROM checkout_sessions cs WHERE cs.payment_id = p.id
+				AND cs.status IN ('created', 'method_selected', 'authenticated'))
+		ORDER BY p.created_at LIMIT $2`, cutoff, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stale := []*StalePayment{}
+	for rows.Next() {
+		var p StalePayment
+		if err := rows.Scan(&p.ID, &p.TenantID, &p.OrderID, &p.Amount, &p.Currency, &p.Status, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		stale = append(stale, &p)
+	}
+	return stale, rows.Err()
+}
+
+// MarkPaymentAbandoned sets a canceled or still incomplete payment to
+// abandoned, reporting false when it had moved on meanwhile.
+func (s *Store) MarkPaymentAbandoned(ctx context.Context, paymentID string) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE payments SET status = $2, updated_at = now()
+		WHERE id = $1 AND status IN ('requires_payment_method', 'requires_confirmation', 'requires_action', 'canceled')`,
+		paymentID, paymentStatusAbandoned)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := advancePaymentState(ctx, tx, paymentID, "expiry", false); err != nil {
+		return false, err
+	}
+	if err := appendPaymentEvent(ctx, tx, paymentID, "expiry"); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// PaymentExpired is published when a stale payment is canceled, so the
+// order it was for can release its stock and reservation.
+type PaymentExpired struct {
+	Type      string `json:"type"`
+	PaymentID string `json:"payment_id"`
+	TenantID  string `json:"tenant_id,omitempty"`
+	OrderID   string `json:"order_id,omitempty"`
+	Amount    int64  `json:"amount"`
+	Currency  string `json:"currency"`
+	// Status is what the payment was left at.
+	Status           string    `json:"status"`
+	PaymentCreatedAt time.Time `json:"payment_created_at"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// PaymentExpiry cancels PaymentIntents the customer never completed.
+// Every interval, payments still requiring a payment method, confirmation
+// or action ttl after they were created are canceled on Stripe as
+// abandoned, marked abandoned locally and announced as payment.expired,
+// both on the payment's stream and on the broker for the order service.
+// A zero ttl turns the sweeper off.
+type PaymentExpiry struct {
+	store     *Store
+	payments  PaymentRepository
+	hub       *EventHub
+	publisher Publisher
+	topic     string
+	ttl       time.Duration
+	interval  time.Duration
+}
+
+func NewPaymentExpiry(store *Store, hub *EventHub, publisher Publisher, topic string, ttl, interval time.Duration) *PaymentExpiry {
+	return &PaymentExpiry{store: store, hub: hub, publisher: publisher, topic: topic, ttl: ttl, interval: interval}
+}
+
+// Run expires stale payments every interval until ctx is done.
+func (pe *PaymentExpiry) Run(ctx context.Context) {
+	if pe == nil || pe.store == nil || pe.ttl <= 0 {
+		return
+	}
+	ticker := time.NewTicker(pe.interval)
+	defer ticker.Stop()
+	for {
+		if err := pe.sweep(ctx); err != nil {
+			log.Printf("payment expiry: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep expires one batch of stale payments. A payment whose cancel
+// failed is tried again next time.
+func (pe *PaymentExpiry) sweep(ctx context.Context) error {
+	stale, err := pe.store.StalePayments(ctx, time.Now().Add(-pe.ttl), expiryBatch)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, p := range stale {
+		if err := pe.expire(ctx, p); err != nil {
+			paymentsExpiredTotal.WithLabelValues("failed").Inc()
+			errs = append(errs, fmt.Errorf("expiring %s: %w", p.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// expire cancels one stale payment. The cancel carries an idempotency key
+// of its own, so a retry after a failure in between cancels once. An
+// intent that moved on since the store last heard of it is saved as it
+// is instead.
+func (pe *PaymentExpiry) expire(ctx context.Context, p *StalePayment) error {
+	params := &stripe.PaymentIntentCancelParams{
+		CancellationReason: stripe.String(string(stripe.PaymentIntentCancellationReasonAbandoned)),
+	}
+	params.Context = ctx
+	params.SetIdempotencyKey("expire-" + p.ID)
+	pi, err := paymentintent.Cancel(p.ID, params)
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodePaymentIntentUnexpectedState {
+		get := &stripe.PaymentIntentParams{}
+		get.Context = ctx
+		if pi, err = paymentintent.Get(p.ID, get); err != nil {
+			return err
+		}
+		if pi.Status != stripe.PaymentIntentStatusCanceled {
+			paymentsExpiredTotal.WithLabelValues("completed").Inc()
+			return pe.payments.SavePayment(ctx, pi)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if err := pe.payments.SavePayment(ctx, pi); err != nil {
+		return err
+	}
+	marked, err := pe.store.MarkPaymentAbandoned(ctx, p.ID)
+	if err != nil || !marked {
+		return err
+	}
+	paymentsExpiredTotal.WithLabelValues("expired").Inc()
+	logf(ctx, "payment expiry: %s abandoned at %s after %s", p.ID, p.Status, time.Since(p.CreatedAt).Round(time.Minute))
+
+	now := time.Now().UTC()
+	pe.hub.Publish(PaymentEvent{
+		PaymentID:  p.ID,
+		TenantID:   p.TenantID,
+		CustomerID: customerIDOf(pi.Customer),
+		Type:       "payment.expired",
+		Status:     paymentStatusAbandoned,
+		Amount:     p.Amount,
+		Currency:   p.Currency,
+		CreatedAt:  now,
+		RequestID:  pi.Metadata["request_id"],
+	})
+
+	// The payment is canceled and saved, so a broker failure is logged
+	// rather than retried.
+	payload, err := json.Marshal(PaymentExpired{
+		Type:             "payment.expired",
+		PaymentID:        p.ID,
+		TenantID:         p.TenantID,
+		OrderID:          p.OrderID,
+		Amount:           p.Amount,
+		Currency:         p.Currency,
+		Status:           p.Status,
+		PaymentCreatedAt: p.CreatedAt,
+		CreatedAt:        now,
+	})
+	if err != nil {
+		logf(ctx, "encoding payment.expired for %s: %v", p.ID, err)
+		return nil
+	}
+	if err := pe.publisher.Publish(ctx, pe.topic, p.ID, payload); err != nil {
+		logf(ctx, "publishing payment.expired for %s: %v", p.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"github.com/stripe/stripe-go/v76/refund"
+	"github.com/xuri/excelize/v2"
+)
+
+// exportColumn is one selectable column of an export.
+type exportColumn[T any] struct {
+	name  string
+	value func(T) string
+}
+
+var paymentColumns = []exportColumn[*stripe.PaymentIntent]{
+	{"id", func(pi *stripe.PaymentIntent) string { return pi.ID }},
+	{"created_at", func(pi *stripe.PaymentIntent) string { return unixRFC3339(pi.Created) }},
+	{"amount", func(pi *stripe.PaymentIntent) string { return strconv.FormatInt(pi.Amount, 10) }},
+	{"amount_received", func(pi *stripe.PaymentIntent) string { return strconv.FormatInt(pi.AmountReceived, 10) }},
+	{"currency", func(pi *stripe.PaymentIntent) string { return string(pi.Currency) }},
+	{"status", func(pi *stripe.PaymentIntent) string { return string(pi.Status) }},
+	{"description", func(pi *stripe.PaymentIntent) string { return pi.Description }},
+	{"customer_id", func(pi *stripe.PaymentIntent) string {
+		if pi.Customer == nil {
+			return ""
+		}
+		return pi.Customer.ID
+	}},
+	{"order_id", func(pi *stripe.PaymentIntent) string { return pi.Metadata["order_id"] }},
+	{"tenant_id", func(pi *stripe.PaymentIntent) string { return pi.Metadata["tenant_id"] }},
+}
+
+var refundColumns = []exportColumn[*stripe.Refund]{
+	{"id", func(r *stripe.Refund) string { return r.ID }},
+	{"created_at", func(r *stripe.Refund) string { return unixRFC3339(r.Created) }},
+	{"payment_id", func(r *stripe.Refund) string {
+		if r.PaymentIntent == nil {
+			return ""
+		}
+		return r.PaymentIntent.ID
+	}},
+	{"amount", func(r *stripe.Refund) string { return strconv.FormatInt(r.Amount, 10) }},
+	{"currency", func(r *stripe.Refund) string { return string(r.Currency) }},
+	{"status", func(r *stripe.Refund) string { return string(r.Status) }},
+	{"reason", func(r *stripe.Refund) string { return string(r.Reason) }},
+}
+
+func unixRFC3339(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+// selectColumns picks the requested columns, in request order, or all of
+// them when none are requested.
+func selectColumns[T any](all []exportColumn[T], requested string) ([]exportColumn[T], error) {
+	if requested == "" {
+		return all, nil
+	}
+	var cols []exportColumn[T]
+	for _, name := range strings.Split(requested, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, col := range all {
+			if col.name == name {
+				cols = append(cols, col)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+	}
+	return cols, nil
+}
+
+// ExportRequest describes one export, synchronous or not.
+type ExportRequest struct {
+	Kind    string // payments or refunds
+	Format  string // csv, xlsx or ndjson
+	From    time.Time
+	To      time.Time
+	Columns string
+}
+
+func (r ExportRequest) filename() string {
+	return fmt.Sprintf("%s_%s_%s.%s", r.Kind, r.From.Format("20060102"), r.To.Format("20060102"), r.Format)
+}
+
+func (r ExportRequest) contentType() string {
+	switch r.Format {
+	case "xlsx":
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case "ndjson":
+		return ndjsonContentType
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// rowWriter is implemented by each export format.
+type rowWriter interface {
+	Write(row []string) error
+	Close() error
+}
+
+type csvRowWriter struct {
+	w    *csv.Writer
+	rows int
+}
+
+func (c *csvRowWriter) Write(row []string) error {
+	if err := c.w.Write(row); err != nil {
+		return err
+	}
+	// Flush regularly so streamed responses reach the client as they grow.
+	c.rows++
+	if c.rows%100 == 0 {
+		c.w.Flush()
+	}
+	return c.w.Error()
+}
+
+func (c *csvRowWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type xlsxRowWriter struct {
+	out    io.Writer
+	file   *excelize.File
+	stream *excelize.StreamWriter
+	row    int
+}
+
+func newXLSXRowWriter(out io.Writer) (*xlsxRowWriter, error) {
+	f := excelize.NewFile()
+	sw, err := f.NewStreamWriter("Sheet1")
+	if err != nil {
+		return nil, err
+	}
+	return &xlsxRowWriter{out: out, file: f, stream: sw}, nil
+}
+
+func (x *xlsxRowWriter) Write(row []string) error {
+	x.row++
+	cells := make([]interface{}, len(row))
+	for i, v := range row {
+		cells[i] = v
+	}
+	cell, err := excelize.CoordinatesToCellName(1, x.row)
+	if err != nil {
+		return err
+	}
+	return x.stream.SetRow(cell, cells)
+}
+
+func (x *xlsxRowWriter) Close() error {
+	defer x.file.Close()
+	if err := x.stream.Flush(); err != nil {
+		return err
+	}
+	_, err := x.file.WriteTo(x.out)
+	return err
+}
+
+func newRowWriter(format string, out io.Writer) (rowWriter, error) {
+	switch format {
+	case "xlsx":
+		return newXLSXRowWriter(out)
+	case "ndjson":
+		return &ndjsonRowWriter{w: newNDJSONWriter(out)}, nil
+	}
+	return &csvRowWriter{w: csv.NewWriter(out)}, nil
+}
+
+// writeExport lists the requested objects from Stripe and writes them out
+// row by row.
+func writeExport(ctx context.Context, req ExportRequest, out io.Writer) (int, error) {
+	w, err := newRowWriter(req.Format, out)
+	if err != nil {
+		return 0, err
+	}
+
+	created := &stripe.RangeQueryParams{
+		GreaterThanOrEqual: req.From.Unix(),
+		LesserThan:         req.To.Unix(),
+	}
+
+	var rows int
+	switch req.Kind {
+	case "refunds":
+		cols, err := selectColumns(refundColumns, req.Columns)
+		if err != nil {
+			return 0, err
+		}
+		params := &stripe.RefundListParams{CreatedRange: created}
+		params.Context = ctx
+		rows, err = writeRows(w, cols, refund.List(params).Iter, func(v interface{}) *stripe.Refund { return v.(*stripe.Refund) })
+		if err != nil {
+			return rows, err
+		}
+	default:
+		cols, err := selectColumns(paymentColumns, req.Columns)
+		if err != nil {
+			return 0, err
+		}
+		params := &stripe.PaymentIntentListParams{CreatedRange: created}
+		params.Context = ctx
+		params.AddExpand("data.customer")
+		rows, err = writeRows(w, cols, paymentintent.List(params).Iter, func(v interface{}) *stripe.PaymentIntent { return v.(*stripe.PaymentIntent) })
+		if err != nil {
+			return rows, err
+		}
+	}
+
+	return rows, w.Close()
+}
+
+func writeRows[T any](w rowWriter, cols []exportColumn[T], it *stripe.Iter, cast func(interface{}) T) (int, error) {
+	header := make([]string, len(cols))
+	for i, col := range cols {
+		header[i] = col.name
+	}
+	if err := w.Write(header); err != nil {
+		return 0, err
+	}
+
+	rows := 0
+	for it.Next() {
+		item := cast(it.Current())
+		row := make([]string, len(cols))
+		for i, col := range cols {
+			row[i] = col.value(item)
+		}
+		if err := w.Write(row); err != nil {
+			return rows, err
+		}
+		rows++
+	}
+	return rows, it.Err()
+}
+
+// ExportJob tracks an asynchronous export.
+type ExportJob struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	Rows      int       `json:"rows"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	path      string
+	request   ExportRequest
+}
+
+// CreateExportJob records a new asynchronous export.
+func (s *Store) CreateExportJob(ctx context.Context, job *ExportJob) error {
+	r := job.request
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO export_jobs (id, kind, format, from_at, to_at, columns, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		job.ID, r.Kind, r.Format, r.From, r.To, r.Columns, job.Status, job.CreatedAt)
+	return err
+}
+
+// UpdateExportJob records an export's progress, and its file once done.
+func (s *Store) UpdateExportJob(ctx context.Context, job *ExportJob, content []byte) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE export_jobs SET status = $2, row_count = $3, error = $4, content = COALESCE($5, content),
+			updated_at = now()
+		WHERE id = $1`, job.ID, job.Status, job.Rows, job.Error, content)
+	return err
+}
+
+// ExportJob returns an export without its file, or sql.ErrNoRows.
+func (s *Store) ExportJob(ctx context.Context, id string) (*ExportJob, error) {
+	var job ExportJob
+	r := &job.request
+	if err := s.db.QueryRowContext(ctx, `
+		SELECT id, kind, format, from_at, to_at, columns, status, row_count, error, created_at
+		FROM export_jobs WHERE id = $1`, id).
+		Scan(&job.ID, &r.Kind, &r.Format, &r.From, &r.To, &r.Columns, &job.Status, &job.Rows, &job.Error,
+			&job.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ExportJobFile returns a finished export's file, or sql.ErrNoRows.
+func (s *Store) ExportJobFile(ctx context.Context, id string) ([]byte, error) {
+	var content []byte
+	err := s.db.QueryRowContext(ctx, `
+		SELECT content FROM export_jobs WHERE id = $1 AND content IS NOT NULL`, id).Scan(&content)
+	return content, err
+}
+
+// DeleteExportJobs deletes the exports started before cutoff, with their
+// files.
+func (s *Store) DeleteExportJobs(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM export_jobs WHERE created_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Exporter runs exports and hands out signed download links for the
+// asynchronous ones. With a store, jobs and their files are kept there,
+// so any instance can answer for them; without one, in memory and dir.
+type Exporter struct {
+	store      *Store
+	dir        string
+	signingKey []byte
+	baseURL    string
+	asyncAfter time.Duration
+	ttl        time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*ExportJob
+}
+
+func NewExporter(store *Store, dir string, signingKey []byte, baseURL string, asyncAfter, ttl time.Duration) *Exporter {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Printf("export dir %s: %v", dir, err)
+	}
+	e := &Exporter{
+		store:      store,
+		dir:        dir,
+		signingKey: signingKey,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		asyncAfter: asyncAfter,
+		ttl:        ttl,
+		jobs:       make(map[string]*ExportJob),
+	}
+	go e.janitor()
+	return e
+}
+
+func (e *Exporter) sign(jobID string, expires int64) string {
+	mac := hmac.New(sha256.New, e.signingKey)
+	fmt.Fprintf(mac, "%s:%d", jobID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (e *Exporter) downloadURL(job *ExportJob) string {
+	expires := job.CreatedAt.Add(e.ttl).Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("signature", e.sign(job.ID, expires))
+	return fmt.Sprintf("%s/payments/export/%s/download?%s", e.baseURL, job.ID, q.Encode())
+}
+
+func (e *Exporter) start(ctx context.Context, req ExportRequest) (*ExportJob, error) {
+	job := &ExportJob{
+		ID:        uuid.NewString(),
+		Status:    "pending",
+		CreatedAt: time.Now().UTC(),
+		request:   req,
+	}
+	job.path = filepath.Join(e.dir, job.ID+"."+req.Format)
+
+	if e.store != nil {
+		if err := e.store.CreateExportJob(ctx, job); err != nil {
+			return nil, err
+		}
+	} else {
+		e.mu.Lock()
+		e.jobs[job.ID] = job
+		e.mu.Unlock()
+	}
+
+	go e.run(job)
+	return job, nil
+}
+
+// run writes the export to its file, which goes to the store once done.
+func (e *Exporter) run(job *ExportJob) {
+	e.update(job, nil, func(j *ExportJob) { j.Status = "running" })
+
+	f, err := os.Create(job.path)
+	if err != nil {
+		e.update(job, nil, func(j *ExportJob) { j.Status, j.Error = "failed", err.Error() })
+		return
+	}
+
+	rows, err := writeExport(context.Background(), job.request, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	var content []byte
+	if err == nil && e.store != nil {
+		content, err = os.ReadFile(job.path)
+		os.Remove(job.path)
+	}
+	if err != nil {
+		log.Printf("export %s: %v", job.ID, err)
+		os.Remove(job.path)
+		e.update(job, nil, func(j *ExportJob) { j.Status, j.Rows, j.Error = "failed", rows, err.Error() })
+		return
+	}
+	e.update(job, content, func(j *ExportJob) { j.Status, j.Rows = "done", rows })
+}
+
+func (e *Exporter) update(job *ExportJob, content []byte, fn func(*ExportJob)) {
+	e.mu.Lock()
+	fn(job)
+	e.mu.Unlock()
+	if e.store != nil {
+		if err := e.store.UpdateExportJob(context.Background(), job, content); err != nil {
+			log.Printf("export %s: recording %s: %v", job.ID, job.Status, err)
+		}
+	}
+}
+
+func (e *Exporter) get(ctx context.Context, id string) (ExportJob, bool, error) {
+	if e.store != nil {
+		job, err := e.store.ExportJob(ctx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ExportJob{}, false, nil
+		}
+		if err != nil {
+			return ExportJob{}, false, err
+		}
+		return *job, true, nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	job, ok := e.jobs[id]
+	if !ok {
+		return ExportJob{}, false, nil
+	}
+	return *job, true, nil
+}
+
+// janitor removes expired jobs and their files.
+func (e *Exporter) janitor() {
+	for range time.Tick(time.Hour) {
+		if e.store != nil {
+			if _, err := e.store.DeleteExportJobs(context.Background(), time.Now().Add(-e.ttl)); err != nil {
+				log.Printf("export janitor: %v", err)
+			}
+			continue
+		}
+		e.mu.Lock()
+		for id, job := range e.jobs {
+			if time.Since(job.CreatedAt) > e.ttl {
+				os.Remove(job.path)
+				delete(e.jobs, id)
+			}
+		}
+		e.mu.Unlock()
+	}
+}
+
+func parseExportTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// parseExportRequest reads the query string of GET /payments/export.
+func parseExportRequest(c *gin.Context) (ExportRequest, error) {
+	defaultFormat := "csv"
+	if wantsNDJSON(c) {
+		defaultFormat = "ndjson"
+	}
+	req := ExportRequest{
+		Kind:    c.DefaultQuery("type", "payments"),
+		Format:  c.DefaultQuery("format", defaultFormat),
+		Columns: c.Query("columns"),
+		To:      time.Now().UTC(),
+	}
+	if req.Kind != "payments" && req.Kind != "refunds" {
+		return req, fmt.Errorf("type must be payments or refunds")
+	}
+	if req.Format != "csv" && req.Format != "xlsx" && req.Format != "ndjson" {
+		return req, fmt.Errorf("format must be csv, xlsx or ndjson")
+	}
+
+	from, err := parseExportTime(c.Query("from"))
+	if err != nil {
+		return req, fmt.Errorf("from must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+	}
+	req.From = from
+	if v := c.Query("to"); v != "" {
+		if req.To, err = parseExportTime(v); err != nil {
+			return req, fmt.Errorf("to must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+		}
+	}
+	if !req.To.After(req.From) {
+		return req, fmt.Errorf("to must be after from")
+	}
+
+	// Validate columns up front so a bad request fails before streaming.
+	if req.Kind == "refunds" {
+		_, err = selectColumns(refundColumns, req.Columns)
+	} else {
+		_, err = selectColumns(paymentColumns, req.Columns)
+	}
+	return req, err
+}
+
+// RegisterRoutes mounts the export endpoints. Exports and their status
+// need a key with payments:read; the download link is what is shared.
+func (e *Exporter) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	auth := requireScope(e.store, bootstrapToken, readPaymentsScope)
+
+	// Stream small ranges directly; queue large ones or explicit async=true.
+	r.GET("/payments/export", auth, func(c *gin.Context) {
+		req, err := parseExportRequest(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, err.Error()))
+			return
+		}
+
+		if c.Query("async") == "true" || req.To.Sub(req.From) > e.asyncAfter {
+			job, err := e.start(c.Request.Context(), req)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+				return
+			}
+			respondData(c, http.StatusAccepted, gin.H{
+				"job_id":     job.ID,
+				"status":     job.Status,
+				"status_url": "/payments/export/" + job.ID,
+			})
+			return
+		}
+
+		c.Header("Content-Type", req.contentType())
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, req.filename()))
+		disableWriteDeadline(c.Writer)
+		if _, err := writeExport(c.Request.Context(), req, c.Writer); err != nil {
+			// Headers are already sent; all we can do is log and cut the stream.
+			logf(c.Request.Context(), "export %s: %v", req.filename(), err)
+		}
+	})
+
+	r.GET("/payments/export/:job_id", auth, func(c *gin.Context) {
+		job, ok, err := e.get(c.Request.Context(), c.Param("job_id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Export not found"))
+			return
+		}
+		resp := gin.H{"job": job}
+		if job.Status == "done" {
+			resp["download_url"] = e.downloadURL(&job)
+		}
+		respondData(c, http.StatusOK, resp)
+	})
+
+	r.GET("/payments/export/:job_id/download", func(c *gin.Context) {
+		jobID := c.Param("job_id")
+		expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+		if err != nil || time.Now().Unix() > expires ||
+			!hmac.Equal([]byte(c.Query("signature")), []byte(e.sign(jobID, expires))) {
+			c.JSON(http.StatusForbidden, errorBody(c, CodeForbidden, "Invalid or expired download link"))
+			return
+		}
+
+		job, ok, err := e.get(c.Request.Context(), jobID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+		if !ok || job.Status != "done" {
+			c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Export not found"))
+			return
+		}
+
+		c.Header("Content-Type", job.request.contentType())
+		disableWriteDeadline(c.Writer)
+		if e.store == nil {
+			c.FileAttachment(job.path, job.request.filename())
+			return
+		}
+		content, err := e.store.ExportJobFile(c.Request.Context(), jobID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, job.request.filename()))
+		c.Data(http.StatusOK, job.request.contentType(), content)
+	})
+}
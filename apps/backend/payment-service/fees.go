@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/balancetransaction"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+var feeTransactionsSynced = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "payment_service_fee_transactions_synced_total",
+	Help: "Balance transactions recorded with their provider fees.",
+})
+
+// PaymentFee is one balance transaction and what the provider kept of it:
+// a payment's charge, a refund or dispute against it, or an account-level
+// fee. Amounts are in the balance currency, which differs from the
+// payment's when Stripe converted it at ExchangeRate. Fee is the sum of
+// the breakdown.
+type PaymentFee struct {
+	BalanceTransactionID string    `json:"balance_transaction_id"`
+	Provider             string    `json:"provider"`
+	PaymentID            string    `json:"payment_id,omitempty"`
+	SourceID             string    `json:"source_id,omitempty"`
+	Type                 string    `json:"type"`
+	Currency             string    `json:"currency"`
+	Amount               int64     `json:"amount"`
+	Fee                  int64     `json:"fee"`
+	Net                  int64     `json:"net"`
+	ProcessingFee        int64     `json:"processing_fee"`
+	ApplicationFee       int64     `json:"application_fee"`
+	Tax                  int64     `json:"tax"`
+	ExchangeRate         float64   `json:"exchange_rate,omitempty"`
+	CreatedAt            time.Time `json:"created_at"`
+	AvailableOn          time.Time `json:"available_on"`
+	// Account is the Stripe account the transaction is on, primary or
+	// alternate.
+	Account string `json:"account"`
+}
+
+// paymentFeeOf reads bt, with its source expanded where the payment it
+// belongs to is wanted.
+func paymentFeeOf(bt *stripe.BalanceTransaction) PaymentFee {
+	f := PaymentFee{
+		BalanceTransactionID: bt.ID,
+		Provider:             "stripe",
+		Account:              armPrimary,
+		Type:                 string(bt.Type),
+		Currency:             string(bt.Currency),
+		Amount:               bt.Amount,
+		Fee:                  bt.Fee,
+		Net:                  bt.Net,
+		ExchangeRate:         bt.ExchangeRate,
+		CreatedAt:            time.Unix(bt.Created, 0).UTC(),
+		AvailableOn:          time.Unix(bt.AvailableOn, 0).UTC(),
+	}
+	for _, d := range bt.FeeDetails {
+		switch d.Type {
+		case "application_fee":
+			f.ApplicationFee += d.Amount
+		case "tax":
+			f.Tax += d.Amount
+		default:
+			// stripe_fee, and the payment_method_passthrough_fee some
+			// methods add for the network
+			f.ProcessingFee += d.Amount
+		}
+	}
+	if s := bt.Source; s != nil {
+		f.SourceID = s.ID
+		switch {
+		case s.Charge != nil && s.Charge.PaymentIntent != nil:
+			f.PaymentID = s.Charge.PaymentIntent.ID
+		case s.Refund != nil && s.Refund.PaymentIntent != nil:
+			f.PaymentID = s.Refund.PaymentIntent.ID
+		case s.Dispute != nil && s.Dispute.PaymentIntent != nil:
+			f.PaymentID = s.Dispute.PaymentIntent.ID
+		}
+	}
+	return f
+}
+
+// payoutTransaction reports balance transaction types that move money to
+// or from the bank rather than earning or costing anything.
+func payoutTransaction(t stripe.BalanceTransactionType) bool {
+	switch t {
+	case stripe.BalanceTransactionTypePayout, stripe.BalanceTransactionTypePayoutCancel, stripe.BalanceTransactionTypePayoutFailure:
+		return true
+	}
+	return false
+}
+
+const paymentFeeColumns = `balance_transaction_id, provider, payment_id, source_id, type, currency, amount, fee, net,
+	processing_fee, application_fee, tax, COALESCE(exchange_rate, 0), created_at, available_on, account`
+
+func (s *Store) SavePaymentFee(ctx context.Context, f PaymentFee) error {
+	rate := sql.NullFloat64{Float64: f.ExchangeRate, Valid: f.ExchangeRate != 0}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO payment_fees (balance_transaction_id, provider, payment_id, source_id, type, currency, amount, fee, net,
+			processing_fee, application_fee, tax, exchange_rate, created_at, available_on, account)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		ON CONFLICT (balance_transaction_id) DO UPDATE SET
+			payment_id = CASE WHEN EXCLUDED.payment_id = '' THEN payment_fees.payment_id ELSE EXCLUDED.payment_id END,
+			amount = EXCLUDED.amount, fee = EXCLUDED.fee, net = EXCLUDED.net,
+			processing_fee = EXCLUDED.processing_fee, application_fee = EXCLUDED.application_fee, tax = EXCLUDED.tax,
+			available_on = EXCLUDED.available_on, synced_at = now()`,
+		f.BalanceTransactionID, f.Provider, f.PaymentID, f.SourceID, f.Type, f.Currency, f.Amount, f.Fee, f.Net,
+		f.ProcessingFee, f.ApplicationFee, f.Tax, rate, f.CreatedAt, f.AvailableOn, f.Account)
+	return err
+}
+
+// PaymentFees lists a payment's balance transactions, oldest first.
+func (s *Store) PaymentFees(ctx context.Context, paymentID string) ([]PaymentFee, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+paymentFeeColumns+` FROM payment_fees WHERE payment_id = $1 ORDER BY created_at, balance_transaction_id`,
+		paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	fees := []PaymentFee{}
+	for rows.Next() {
+		var f PaymentFee
+		if err := rows.Scan(&f.BalanceTransactionID, &f.Provider, &f.PaymentID, &f.SourceID, &f.Type, &f.Currency,
+			&f.Amount, &f.Fee, &f.Net, &f.ProcessingFee, &f.ApplicationFee, &f.Tax, &f.ExchangeRate,
+			&f.CreatedAt, &f.AvailableOn, &f.Account); err != nil {
+			return nil, err
+		}
+		fees = append(fees, f)
+	}
+	return fees, rows.Err()
+}
+
+// FeeTracker records the fees the provider actually charged, from its
+// balance transactions, so net revenue is what reached the balance
+// rather than an estimate from PROCESSING_FEE_PERCENT.
+type FeeTracker struct {
+	store    *Store
+	interval time.Duration
+	lookback time.Duration
+	// altKey is the alternate Stripe account's key, whose balance
+	// transactions are synced too; "" when there is none.
+	altKey string
+}
+
+func NewFeeTracker(store *Store, interval, lookback time.Duration) *FeeTracker {
+	return &FeeTracker{store: store, interval: interval, lookback: lookback}
+}
+
+// Run records balance transactions created within the lookback, then
+// repeats every interval until ctx is done. Transactions seen before are
+// updated in place.
+func (ft *FeeTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(ft.interval)
+	defer ticker.Stop()
+	for {
+		to := time.Now()
+		if _, err := ft.Sync(ctx, to.Add(-ft.lookback), to); err != nil {
+			log.Printf("fee sync: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync records the balance transactions created in [from, to), on the
+// alternate account as well when there is one, and returns how many
+// there were.
+func (ft *FeeTracker) Sync(ctx context.Context, from, to time.Time) (int, error) {
+	accounts := [][2]string{{armPrimary, stripe.Key}}
+	if ft.altKey != "" {
+		accounts = append(accounts, [2]string{armAlternate, ft.altKey})
+	}
+	n := 0
+	for _, a := range accounts {
+		account, key := a[0], a[1]
+		params := &stripe.BalanceTransactionListParams{
+			CreatedRange: &stripe.RangeQueryParams{GreaterThanOrEqual: from.Unix(), LesserThan: to.Unix()},
+		}
+		params.Context = ctx
+		params.AddExpand("data.source")
+
+		client := balancetransaction.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
+		it := client.List(params)
+		for it.Next() {
+			bt := it.BalanceTransaction()
+			if payoutTransaction(bt.Type) {
+				continue
+			}
+			f := paymentFeeOf(bt)
+			f.Account = account
+			if err := ft.store.SavePaymentFee(ctx, f); err != nil {
+				return n, err
+			}
+			feeTransactionsSynced.Inc()
+			n++
+		}
+		if err := it.Err(); err != nil {
+			return n, fmt.Errorf("listing %s balance transactions: %w", account, err)
+		}
+	}
+	return n, nil
+}
+
+// fetch records the balance transaction of a payment's charge, for
+// payments the sweep hasn't reached yet.
+func (ft *FeeTracker) fetch(ctx context.Context, paymentID string) error {
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	params.AddExpand("latest_charge.balance_transaction")
+	pi, err := paymentintent.Get(paymentID, params)
+	if err != nil {
+		return err
+	}
+	ch := pi.LatestCharge
+	if ch == nil || ch.BalanceTransaction == nil || ch.BalanceTransaction.Created == 0 {
+		return nil
+	}
+	f := paymentFeeOf(ch.BalanceTransaction)
+	f.PaymentID, f.SourceID = pi.ID, ch.ID
+	if pi.Metadata[metadataProviderArm] == armAlternate {
+		f.Account = armAlternate
+	}
+	return ft.store.SavePaymentFee(ctx, f)
+}
+
+// PaymentFeeSummary totals a payment's balance transactions in one
+// balance currency.
+type PaymentFeeSummary struct {
+	Currency       string `json:"currency"`
+	Amount         int64  `json:"amount"`
+	Fee            int64  `json:"fee"`
+	ProcessingFee  int64  `json:"processing_fee"`
+	ApplicationFee int64  `json:"application_fee"`
+	Tax            int64  `json:"tax"`
+	Net            int64  `json:"net"`
+}
+
+func summarizeFees(fees []PaymentFee) []PaymentFeeSummary {
+	var out []PaymentFeeSummary
+	index := map[string]int{}
+	for _, f := range fees {
+		i, ok := index[f.Currency]
+		if !ok {
+			i = len(out)
+			index[f.Currency] = i
+			out = append(out, PaymentFeeSummary{Currency: f.Currency})
+		}
+		s := &out[i]
+		s.Amount += f.Amount
+		s.Fee += f.Fee
+		s.ProcessingFee += f.ProcessingFee
+		s.ApplicationFee += f.ApplicationFee
+		s.Tax += f.Tax
+		s.Net += f.Net
+	}
+	if out == nil {
+		out = []PaymentFeeSummary{}
+	}
+	return out
+}
+
+// RegisterRoutes mounts a payment's fee details under payments:read and a
+// manual sync for backfilling fees of an earlier period.
+func (ft *FeeTracker) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	r.GET("/payment/:id/fees", requireScope(ft.store, bootstrapToken, readPaymentsScope), ft.paymentFees(bootstrapToken))
+	r.POST("/admin/fees/sync", requireScope(ft.store, bootstrapToken, "admin"), ft.sync)
+}
+
+// paymentFees answers a payment's fees and net revenue from the local
+// store, reading the charge's from Stripe when none are recorded yet or
+// with ?refresh=true, which needs the admin scope.
+func (ft *FeeTracker) paymentFees(bootstrapToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		refresh := c.Query("refresh") == "true"
+		if refresh && !hasScope(c, ft.store, bootstrapToken, "admin") {
+			return
+		}
+		ctx := c.Request.Context()
+		id := c.Param("id")
+		fees, err := ft.store.PaymentFees(ctx, id)
+		if err == nil && (len(fees) == 0 || refresh) {
+			if err := ft.fetch(ctx, id); err != nil {
+				respondError(c, err)
+				return
+			}
+			fees, err = ft.store.PaymentFees(ctx, id)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+		respondData(c, http.StatusOK, gin.H{
+			"payment_id":   id,
+			"transactions": fees,
+			"totals":       summarizeFees(fees),
+		})
+	}
+}
+
+func (ft *FeeTracker) sync(c *gin.Context) {
+	var req struct {
+		From string `json:"from" binding:"required"`
+		To   string `json:"to"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	from, err := parseExportTime(req.From)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "from must be a date (YYYY-MM-DD) or RFC 3339 timestamp"))
+		return
+	}
+	to := time.Now()
+	if req.To != "" {
+		if to, err = parseExportTime(req.To); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "to must be a date (YYYY-MM-DD) or RFC 3339 timestamp"))
+			return
+		}
+	}
+	if !to.After(from) {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "to must be after from"))
+		return
+	}
+	n, err := ft.Sync(c.Request.Context(), from, to)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, errorBodyWith(c, CodeUpstreamFailed, err.Error(), gin.H{"synced": n}))
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{"synced": n, "from": from.UTC(), "to": to.UTC()})
+}
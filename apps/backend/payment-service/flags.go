@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+
+	"github.com/open-feature/go-sdk/openfeature"
+)
+
+// Flag keys evaluated by the service.
+const (
+	flagAutomaticPaymentMethods = "payments.automatic_payment_methods"
+	flagPaymentMethodTypes      = "payments.payment_method_types"
+)
+
+// Flags evaluates feature flags through OpenFeature so the backing
+// provider (file, env or LaunchDarkly) can be swapped by configuration.
+type Flags struct {
+	client *openfeature.Client
+	reload func() error
+}
+
+// NewFlags installs the provider named by kind and returns an evaluator.
+func NewFlags(kind string) (*Flags, error) {
+	var provider openfeature.FeatureProvider
+	reload := func() error { return nil }
+	switch kind {
+	case "", "none":
+		provider = openfeature.NoopProvider{}
+	case "env":
+		p, err := newStaticFlagProvider("env", []byte(os.Getenv("FEATURE_FLAGS")))
+		if err != nil {
+			return nil, err
+		}
+		provider = p
+	case "file":
+		path := os.Getenv("FEATURE_FLAGS_FILE")
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading FEATURE_FLAGS_FILE: %w", err)
+		}
+		p, err := newStaticFlagProvider("file", raw)
+		if err != nil {
+			return nil, err
+		}
+		provider = p
+		reload = func() error {
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("reading FEATURE_FLAGS_FILE: %w", err)
+			}
+			return p.replace(raw)
+		}
+	case "launchdarkly":
+		p, err := newLaunchDarklyProvider(os.Getenv("LAUNCHDARKLY_SDK_KEY"))
+		if err != nil {
+			return nil, err
+		}
+		provider = p
+	default:
+		return nil, fmt.Errorf("unknown feature flag provider %q", kind)
+	}
+
+	if err := openfeature.SetProviderAndWait(provider); err != nil {
+		return nil, err
+	}
+	return &Flags{client: openfeature.NewClient("payment-service"), reload: reload}, nil
+}
+
+// Reload rereads the flag file; other providers update themselves.
+func (f *Flags) Reload() error {
+	return f.reload()
+}
+
+// flagContext targets flags at a tenant, using the most stable identifier
+// available as the rollout bucket key.
+func flagContext(tenantID, targetingKey string, attrs map[string]interface{}) openfeature.EvaluationContext {
+	if targetingKey == "" {
+		targetingKey = tenantID
+	}
+	all := map[string]interface{}{"tenant_id": tenantID}
+	for k, v := range attrs {
+		all[k] = v
+	}
+	return openfeature.NewEvaluationContext(targetingKey, all)
+}
+
+func (f *Flags) Bool(ctx context.Context, key string, def bool, ec openfeature.EvaluationContext) bool {
+	v, err := f.client.BooleanValue(ctx, key, def, ec)
+	if err != nil {
+		logf(ctx, "flag %s: %v", key, err)
+	}
+	return v
+}
+
+// Strings evaluates an object flag holding a list of strings.
+func (f *Flags) Strings(ctx context.Context, key string, def []string, ec openfeature.EvaluationContext) []string {
+	v, err := f.client.ObjectValue(ctx, key, def, ec)
+	if err != nil {
+		logf(ctx, "flag %s: %v", key, err)
+		return def
+	}
+	switch list := v.(type) {
+	case []string:
+		return list
+	case []interface{}:
+		out := make([]string, 0, len(list))
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				logf(ctx, "flag %s: non-string element %v", key, item)
+				return def
+			}
+			out = append(out, s)
+		}
+		return out
+	}
+	logf(ctx, "flag %s: expected a list, got %T", key, v)
+	return def
+}
+
+// Details exposes the raw evaluation for debugging from the admin API.
+func (f *Flags) Details(ctx context.Context, key string, ec openfeature.EvaluationContext) (openfeature.InterfaceEvaluationDetails, error) {
+	return f.client.ObjectValueDetails(ctx, key, nil, ec)
+}
+
+// staticFlag is one flag of the file/env provider. Tenant overrides win;
+// otherwise Percentage of targeting keys get Value and the rest Default.
+// Value defaults to true so boolean rollouts only need a percentage.
+type staticFlag struct {
+	Default    interface{}            `json:"default"`
+	Value      interface{}            `json:"value"`
+	Percentage float64                `json:"percentage"`
+	Tenants    map[string]interface{} `json:"tenants"`
+}
+
+// staticFlagProvider serves flags from a JSON document, e.g.
+//
+//	{"payments.automatic_payment_methods": {"default": false, "percentage": 10, "tenants": {"acme": true}}}
+type staticFlagProvider struct {
+	name string
+
+	mu    sync.RWMutex
+	flags map[string]staticFlag
+}
+
+func newStaticFlagProvider(name string, raw []byte) (*staticFlagProvider, error) {
+	p := &staticFlagProvider{name: name, flags: map[string]staticFlag{}}
+	if err := p.replace(raw); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// replace swaps in a new flag document; a malformed one is rejected whole.
+func (p *staticFlagProvider) replace(raw []byte) error {
+	flags := map[string]staticFlag{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &flags); err != nil {
+			return fmt.Errorf("parsing %s feature flags: %w", p.name, err)
+		}
+	}
+	p.mu.Lock()
+	p.flags = flags
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *staticFlagProvider) Metadata() openfeature.Metadata {
+	return openfeature.Metadata{Name: "payment-service-" + p.name}
+}
+
+func (p *staticFlagProvider) Hooks() []openfeature.Hook { return nil }
+
+// rolloutBucket maps a flag and targeting key to a stable value in [0, 100).
+func rolloutBucket(flag, key string) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(flag + ":" + key))
+	return float64(h.Sum32()%10000) / 100
+}
+
+func (p *staticFlagProvider) resolve(flag string, evalCtx openfeature.FlattenedContext) (interface{}, openfeature.ProviderResolutionDetail) {
+	p.mu.RLock()
+	def, ok := p.flags[flag]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, openfeature.ProviderResolutionDetail{
+			ResolutionError: openfeature.NewFlagNotFoundResolutionError(flag),
+			Reason:          openfeature.ErrorReason,
+		}
+	}
+
+	value := def.Value
+	if value == nil {
+		value = true
+	}
+
+	if tenant, _ := evalCtx["tenant_id"].(string); tenant != "" {
+		if v, ok := def.Tenants[tenant]; ok {
+			return v, openfeature.ProviderResolutionDetail{Reason: openfeature.TargetingMatchReason, Variant: "tenant"}
+		}
+	}
+	if key, _ := evalCtx[openfeature.TargetingKey].(string); key != "" && def.Percentage > 0 {
+		if rolloutBucket(flag, key) < def.Percentage {
+			return value, openfeature.ProviderResolutionDetail{Reason: openfeature.SplitReason, Variant: "rollout"}
+		}
+	}
+	if def.Default == nil {
+		return nil, openfeature.ProviderResolutionDetail{Reason: openfeature.DefaultReason, Variant: "default"}
+	}
+	return def.Default, openfeature.ProviderResolutionDetail{Reason: openfeature.StaticReason, Variant: "default"}
+}
+
+func typeMismatch(flag string) openfeature.ProviderResolutionDetail {
+	return openfeature.ProviderResolutionDetail{
+		ResolutionError: openfeature.NewTypeMismatchResolutionError(flag),
+		Reason:          openfeature.ErrorReason,
+	}
+}
+
+func (p *staticFlagProvider) BooleanEvaluation(_ context.Context, flag string, defaultValue bool, evalCtx openfeature.FlattenedContext) openfeature.BoolResolutionDetail {
+	v, detail := p.resolve(flag, evalCtx)
+	if v == nil {
+		return openfeature.BoolResolutionDetail{Value: defaultValue, ProviderResolutionDetail: detail}
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return openfeature.BoolResolutionDetail{Value: defaultValue, ProviderResolutionDetail: typeMismatch(flag)}
+	}
+	return openfeature.BoolResolutionDetail{Value: b, ProviderResolutionDetail: detail}
+}
+
+func (p *staticFlagProvider) StringEvaluation(_ context.Context, flag string, defaultValue string, evalCtx openfeature.FlattenedContext) openfeature.StringResolutionDetail {
+	v, detail := p.resolve(flag, evalCtx)
+	if v == nil {
+		return openfeature.StringResolutionDetail{Value: defaultValue, ProviderResolutionDetail: detail}
+	}
+	s, ok := v.(string)
+	if !ok {
+		return openfeature.StringResolutionDetail{Value: defaultValue, ProviderResolutionDetail: typeMismatch(flag)}
+	}
+	return openfeature.StringResolutionDetail{Value: s, ProviderResolutionDetail: detail}
+}
+
+func (p *staticFlagProvider) FloatEvaluation(_ context.Context, flag string, defaultValue float64, evalCtx openfeature.FlattenedContext) openfeature.FloatResolutionDetail {
+	v, detail := p.resolve(flag, evalCtx)
+	if v == nil {
+		return openfeature.FloatResolutionDetail{Value: defaultValue, ProviderResolutionDetail: detail}
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return openfeature.FloatResolutionDetail{Value: defaultValue, ProviderResolutionDetail: typeMismatch(flag)}
+	}
+	return openfeature.FloatResolutionDetail{Value: f, ProviderResolutionDetail: detail}
+}
+
+func (p *staticFlagProvider) IntEvaluation(_ context.Context, flag string, defaultValue int64, evalCtx openfeature.FlattenedContext) openfeature.IntResolutionDetail {
+	v, detail := p.resolve(flag, evalCtx)
+	if v == nil {
+		return openfeature.IntResolutionDetail{Value: defaultValue, ProviderResolutionDetail: detail}
+	}
+	// JSON numbers decode as float64.
+	f, ok := v.(float64)
+	if !ok || f != float64(int64(f)) {
+		return openfeature.IntResolutionDetail{Value: defaultValue, ProviderResolutionDetail: typeMismatch(flag)}
+	}
+	return openfeature.IntResolutionDetail{Value: int64(f), ProviderResolutionDetail: detail}
+}
+
+func (p *staticFlagProvider) ObjectEvaluation(_ context.Context, flag string, defaultValue interface{}, evalCtx openfeature.FlattenedContext) openfeature.InterfaceResolutionDetail {
+	v, detail := p.resolve(flag, evalCtx)
+	if v == nil {
+		v = defaultValue
+	}
+	return openfeature.InterfaceResolutionDetail{Value: v, ProviderResolutionDetail: detail}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/launchdarkly/go-sdk-common/v3/ldcontext"
+	"github.com/launchdarkly/go-sdk-common/v3/ldreason"
+	"github.com/launchdarkly/go-sdk-common/v3/ldvalue"
+	ld "github.com/launchdarkly/go-server-sdk/v7"
+	"github.com/open-feature/go-sdk/openfeature"
+)
+
+// launchDarklyProvider adapts the LaunchDarkly server SDK to OpenFeature.
+// Evaluation contexts become LaunchDarkly contexts of kind "tenant" keyed by
+// the targeting key, with the remaining attributes copied across.
+type launchDarklyProvider struct {
+	client *ld.LDClient
+}
+
+func newLaunchDarklyProvider(sdkKey string) (*launchDarklyProvider, error) {
+	if sdkKey == "" {
+		return nil, fmt.Errorf("FEATURE_FLAG_PROVIDER=launchdarkly requires LAUNCHDARKLY_SDK_KEY")
+	}
+	client, err := ld.MakeClient(sdkKey, 5*time.Second)
+	if err != nil && client == nil {
+		return nil, fmt.Errorf("starting LaunchDarkly client: %w", err)
+	}
+	// A timeout still returns a usable client that serves defaults until
+	// the first flag payload arrives.
+	return &launchDarklyProvider{client: client}, nil
+}
+
+func (p *launchDarklyProvider) Metadata() openfeature.Metadata {
+	return openfeature.Metadata{Name: "launchdarkly"}
+}
+
+func (p *launchDarklyProvider) Hooks() []openfeature.Hook { return nil }
+
+func (p *launchDarklyProvider) Shutdown() {
+	p.client.Close()
+}
+
+func (p *launchDarklyProvider) Init(openfeature.EvaluationContext) error { return nil }
+
+func (p *launchDarklyProvider) Status() openfeature.State {
+	if p.client.Initialized() {
+		return openfeature.ReadyState
+	}
+	return openfeature.NotReadyState
+}
+
+func toLDContext(evalCtx openfeature.FlattenedContext) (ldcontext.Context, error) {
+	key, _ := evalCtx[openfeature.TargetingKey].(string)
+	if key == "" {
+		return ldcontext.Context{}, fmt.Errorf("missing targeting key")
+	}
+	b := ldcontext.NewBuilder(key).Kind("tenant")
+	for k, v := range evalCtx {
+		if k == openfeature.TargetingKey {
+			continue
+		}
+		b.SetValue(k, ldvalue.CopyArbitraryValue(v))
+	}
+	return b.TryBuild()
+}
+
+func resolutionDetail(detail ldreason.EvaluationDetail, err error) openfeature.ProviderResolutionDetail {
+	if err != nil {
+		return openfeature.ProviderResolutionDetail{
+			ResolutionError: openfeature.NewGeneralResolutionError(err.Error()),
+			Reason:          openfeature.ErrorReason,
+		}
+	}
+	out := openfeature.ProviderResolutionDetail{Reason: openfeature.Reason(detail.Reason.GetKind())}
+	if detail.VariationIndex.IsDefined() {
+		out.Variant = fmt.Sprint(detail.VariationIndex.IntValue())
+	}
+	return out
+}
+
+func invalidContext(err error) openfeature.ProviderResolutionDetail {
+	return openfeature.ProviderResolutionDetail{
+		ResolutionError: openfeature.NewTargetingKeyMissingResolutionError(err.Error()),
+		Reason:          openfeature.ErrorReason,
+	}
+}
+
+func (p *launchDarklyProvider) BooleanEvaluation(_ context.Context, flag string, defaultValue bool, evalCtx openfeature.FlattenedContext) openfeature.BoolResolutionDetail {
+	lc, err := toLDContext(evalCtx)
+	if err != nil {
+		return openfeature.BoolResolutionDetail{Value: defaultValue, ProviderResolutionDetail: invalidContext(err)}
+	}
+	v, detail, err := p.client.BoolVariationDetail(flag, lc, defaultValue)
+	return openfeature.BoolResolutionDetail{Value: v, ProviderResolutionDetail: resolutionDetail(detail, err)}
+}
+
+func (p *launchDarklyProvider) StringEvaluation(_ context.Context, flag string, defaultValue string, evalCtx openfeature.FlattenedContext) openfeature.StringResolutionDetail {
+	lc, err := toLDContext(evalCtx)
+	if err != nil {
+		return openfeature.StringResolutionDetail{Value: defaultValue, ProviderResolutionDetail: invalidContext(err)}
+	}
+	v, detail, err := p.client.StringVariationDetail(flag, lc, defaultValue)
+	return openfeature.StringResolutionDetail{Value: v, ProviderResolutionDetail: resolutionDetail(detail, err)}
+}
+
+func (p *launchDarklyProvider) FloatEvaluation(_ context.Context, flag string, defaultValue float64, evalCtx openfeature.FlattenedContext) openfeature.FloatResolutionDetail {
+	lc, err := toLDContext(evalCtx)
+	if err != nil {
+		return openfeature.FloatResolutionDetail{Value: defaultValue, ProviderResolutionDetail: invalidContext(err)}
+	}
+	v, detail, err := p.client.Float64VariationDetail(flag, lc, defaultValue)
+	return openfeature.FloatResolutionDetail{Value: v, ProviderResolutionDetail: resolutionDetail(detail, err)}
+}
+
+func (p *launchDarklyProvider) IntEvaluation(_ context.Context, flag string, defaultValue int64, evalCtx openfeature.FlattenedContext) openfeature.IntResolutionDetail {
+	lc, err := toLDContext(evalCtx)
+	if err != nil {
+		return openfeature.IntResolutionDetail{Value: defaultValue, ProviderResolutionDetail: invalidContext(err)}
+	}
+	v, detail, err := p.client.IntVariationDetail(flag, lc, int(defaultValue))
+	return openfeature.IntResolutionDetail{Value: int64(v), ProviderResolutionDetail: resolutionDetail(detail, err)}
+}
+
+func (p *launchDarklyProvider) ObjectEvaluation(_ context.Context, flag string, defaultValue interface{}, evalCtx openfeature.FlattenedContext) openfeature.InterfaceResolutionDetail {
+	lc, err := toLDContext(evalCtx)
+	if err != nil {
+		return openfeature.InterfaceResolutionDetail{Value: defaultValue, ProviderResolutionDetail: invalidContext(err)}
+	}
+	v, detail, err := p.client.JSONVariationDetail(flag, lc, ldvalue.CopyArbitraryValue(defaultValue))
+	return openfeature.InterfaceResolutionDetail{Value: v.AsArbitraryValue(), ProviderResolutionDetail: resolutionDetail(detail, err)}
+}
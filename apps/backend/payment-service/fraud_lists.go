@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var fraudListBlocks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_fraud_list_blocks_total",
+	Help: "Payments refused by a blocklist entry, by entry type.",
+}, []string{"type"})
+
+const (
+	fraudListBlock = "block"
+	fraudListAllow = "allow"
+
+	fraudCardFingerprint = "card_fingerprint"
+	fraudEmail           = "email"
+	fraudCustomerID      = "customer_id"
+	fraudIP              = "ip"
+	fraudBIN             = "bin"
+)
+
+// maxFraudListImportBody bounds an import, whatever its row count.
+const maxFraudListImportBody = 16 << 20
+
+// fraudListColumns are the columns of an export, and of an import, which
+// needs list, type and value.
+var fraudListColumns = []string{"list", "type", "value", "tenant_id", "reason", "expires_at"}
+
+// normalizeFraudValue puts a value in the form it is stored and matched
+// in, or reports false when it isn't one of typ.
+func normalizeFraudValue(typ, v string) (string, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return "", false
+	}
+	switch typ {
+	case fraudCardFingerprint, fraudCustomerID:
+		return v, true
+	case fraudEmail:
+		v = strings.ToLower(v)
+		return v, validEmail(v)
+	case fraudIP:
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return "", false
+		}
+		return addr.Unmap().String(), true
+	case fraudBIN:
+		if len(v) != 6 && len(v) != 8 || strings.Trim(v, "0123456789") != "" {
+			return "", false
+		}
+		return v, true
+	}
+	return "", false
+}
+
+// FraudListEntry blocks or allows payments from one card, email,
+// customer, IP or BIN, for one tenant or, with no tenant, all of them.
+type FraudListEntry struct {
+	ID        string     `json:"id"`
+	TenantID  string     `json:"tenant_id,omitempty"`
+	List      string     `json:"list"`
+	Type      string     `json:"type"`
+	Value     string     `json:"value"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+var fraudListEntryList = listResource{
+	from: "fraud_list_entries e",
+	fields: []string{"id", "tenant_id", "list", "type", "value", "reason", "created_by", "expires_at",
+		"created_at", "updated_at"},
+	columns: map[string]listField{
+		"id":         {"e.id", textField},
+		"tenant_id":  {"e.tenant_id", textField},
+		"list":       {"e.list", textField},
+		"type":       {"e.type", textField},
+		"value":      {"e.value", textField},
+		"reason":     {"e.reason", textField},
+		"created_by": {"e.created_by", textField},
+		"expires_at": {"e.expires_at", timeField},
+		"created_at": {"e.created_at", timeField},
+		"updated_at": {"e.updated_at", timeField},
+	},
+}
+
+// The audit log of list changes; action is added, updated or removed.
+var fraudListChangeList = listResource{
+	from:   "fraud_list_changes h",
+	fields: []string{"id", "entry_id", "tenant_id", "list", "type", "value", "action", "actor", "reason", "created_at"},
+	columns: map[string]listField{
+		"id":         {"h.id", intField},
+		"entry_id":   {"h.entry_id", textField},
+		"tenant_id":  {"h.tenant_id", textField},
+		"list":       {"h.list", textField},
+		"type":       {"h.type", textField},
+		"value":      {"h.value", textField},
+		"action":     {"h.action", textField},
+		"actor":      {"h.actor", textField},
+		"reason":     {"h.reason", textField},
+		"created_at": {"h.created_at", timeField},
+	},
+}
+
+// SaveFraudListEntries adds entries, or updates the reason and expiry of
+// those already on their list, in one transaction, recording each change
+// as actor's. It fills in each entry as stored and reports how many were
+// added.
+func (s *Store) SaveFraudListEntries(ctx context.Context, entries []*FraudListEntry, actor string) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	added := 0
+	for _, e := range entries {
+		var inserted bool
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO fraud_list_entries (id, tenant_id, list, type, value, reason, created_by, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (tenant_id, list, type, value) DO UPDATE SET
+				reason = EXCLUDED.reason, expires_at = EXCLUDED.expires_at, updated_at = now()
+			RETURNING id, created_by, created_at, updated_at, xmax = 0`,
+			e.ID, e.TenantID, e.List, e.Type, e.Value, e.Reason, actor, e.ExpiresAt).
+			Scan(&e.ID, &e.CreatedBy, &e.CreatedAt, &e.UpdatedAt, &inserted)
+		if err != nil {
+			return 0, err
+		}
+		action := "updated"
+		if inserted {
+			action = "added"
+			added++
+		}
+		if err := recordFraudListChange(ctx, tx, e, action, actor, e.Reason); err != nil {
+			return 0, err
+		}
+	}
+	return added, tx.Commit()
+}
+
+// DeleteFraudListEntry removes an entry, recording the change as actor's.
+// It returns sql.ErrNoRows when there is no such entry.
+func (s *Store) DeleteFraudListEntry(ctx context.Context, id, actor, reason string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	e := &FraudListEntry{ID: id}
+	err = tx.QueryRowContext(ctx, `
+		DELETE FROM fraud_list_entries WHERE id = $1 RETURNING tenant_id, list, type, value`, id).
+		Scan(&e.TenantID, &e.List, &e.Type, &e.Value)
+	if err != nil {
+		return err
+	}
+	if err := recordFraudListChange(ctx, tx, e, "removed", actor, reason); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func recordFraudListChange(ctx context.Context, tx *sql.Tx, e *FraudListEntry, action, actor, reason string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO fraud_list_changes (entry_id, tenant_id, list, type, value, action, actor, reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		e.ID, e.TenantID, e.List, e.Type, e.Value, action, actor, reason)
+	return err
+}
+
+// MatchFraudLists returns the live entries for the tenant, or for all
+// tenants, that match any of the type and value pairs.
+func (s *Store) MatchFraudLists(ctx context.Context, tenantID string, types, values []string) ([]FraudListEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, list, type FROM fraud_list_entries
+		WHERE tenant_id IN ('', $1) AND (expires_at IS NULL OR expires_at > now())
+			AND (type, value) IN (SELECT * FROM unnest($2::text[], $3::text[]))`,
+		tenantID, types, values)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []FraudListEntry
+	for rows.Next() {
+		var e FraudListEntry
+		if err := rows.Scan(&e.ID, &e.List, &e.Type); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// EachFraudListEntry calls fn with each entry on list, or both lists,
+// for the tenant, or for all of them, oldest first.
+func (s *Store) EachFraudListEntry(ctx context.Context, list, tenantID string, fn func(*FraudListEntry) error) error {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, tenant_id, list, type, value, reason, created_by, expires_at, created_at, updated_at
+		FROM fraud_list_entries
+		WHERE ($1 = '' OR list = $1) AND ($2 = '' OR tenant_id = $2)
+		ORDER BY created_at, id`, list, tenantID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e FraudListEntry
+		if err := rows.Scan(&e.ID, &e.TenantID, &e.List, &e.Type, &e.Value, &e.Reason, &e.CreatedBy,
+			&e.ExpiresAt, &e.CreatedAt, &e.UpdatedAt); err != nil {
+			return err
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// FraudLists are the fraud team's blocklists and allowlists of card
+// fingerprints, emails, customer IDs, IPs and BINs, checked before a
+// payment is created. A payment matching an allowlist entry goes ahead
+// whatever else it matches; otherwise one matching a blocklist entry is
+// refused with payment_blocked. Cards and BINs are only known for
+// payments created with a payment_method, and the IP is the request's
+// client_ip or, failing that, the caller's. Every change is kept in an
+// audit log, and the lists move between environments as CSV.
+type FraudLists struct {
+	store         *Store
+	maxImportRows int
+}
+
+func NewFraudLists(store *Store, maxImportRows int) *FraudLists {
+	return &FraudLists{store: store, maxImportRows: maxImportRows}
+}
+
+// RegisterRoutes mounts the lists under the fraud scope.
+func (f *FraudLists) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/fraud/lists", requireScope(f.store, bootstrapToken, "fraud"), f.requireStore)
+	g.GET("", listHandler(f.store, fraudListEntryList))
+	g.POST("", f.create)
+	g.DELETE("/:id", f.delete)
+	g.GET("/changes", listHandler(f.store, fraudListChangeList))
+	g.GET("/export", f.export)
+	g.POST("/import", f.importCSV)
+}
+
+func (f *FraudLists) requireStore(c *gin.Context) {
+	if f.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Fraud lists require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// check refuses a payment on a blocklist and not on an allowlist.
+func (f *FraudLists) check(ctx context.Context, req PaymentRequest, card paymentCard) *refusal {
+	if f == nil || f.store == nil {
+		return nil
+	}
+	var types, values []string
+	add := func(typ, v string) {
+		if v, ok := normalizeFraudValue(typ, v); ok {
+			types, values = append(types, typ), append(values, v)
+		}
+	}
+	add(fraudEmail, req.ReceiptEmail)
+	add(fraudCustomerID, req.CustomerID)
+	add(fraudIP, req.ClientIP)
+	add(fraudCardFingerprint, card.Fingerprint)
+	for _, n := range []int{6, 8} {
+		if len(card.BIN) >= n {
+			add(fraudBIN, card.BIN[:n])
+		}
+	}
+	if len(types) == 0 {
+		return nil
+	}
+
+	matches, err := f.store.MatchFraudLists(ctx, req.TenantID, types, values)
+	if err != nil {
+		logf(ctx, "fraud lists: %v", err)
+		return &refusal{http.StatusInternalServerError, CodeInternal, "Could not check fraud lists", nil}
+	}
+	var blocked *FraudListEntry
+	for i, e := range matches {
+		if e.List == fraudListAllow {
+			return nil
+		}
+		if blocked == nil {
+			blocked = &matches[i]
+		}
+	}
+	if blocked == nil {
+		return nil
+	}
+	fraudListBlocks.WithLabelValues(blocked.Type).Inc()
+	logf(ctx, "payment blocked by fraud list entry %s (%s)", blocked.ID, blocked.Type)
+	return &refusal{http.StatusForbidden, CodePaymentBlocked, "Payment blocked by fraud list entry " + blocked.ID, nil}
+}
+
+// fraudListInput is one entry to add, from a request body or an import
+// row.
+type fraudListInput struct {
+	List      string     `json:"list" binding:"required,oneof=block allow"`
+	Type      string     `json:"type" binding:"required,oneof=card_fingerprint email customer_id ip bin"`
+	Value     string     `json:"value" binding:"required"`
+	TenantID  string     `json:"tenant_id"`
+	Reason    string     `json:"reason" binding:"max=500"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// entry checks an import row as the binding tags would, and a request
+// body further than they can, naming fields under prefix.
+func (in fraudListInput) entry(prefix string) (*FraudListEntry, []FieldError) {
+	var fields []FieldError
+	if in.List != fraudListBlock && in.List != fraudListAllow {
+		fields = append(fields, FieldError{Field: prefix + "list", Code: "invalid_choice", Message: "must be one of: block, allow"})
+	}
+	value, ok := normalizeFraudValue(in.Type, in.Value)
+	switch in.Type {
+	case fraudCardFingerprint, fraudEmail, fraudCustomerID, fraudIP, fraudBIN:
+		if !ok {
+			fields = append(fields, FieldError{Field: prefix + "value", Code: "invalid", Message: "is not a valid " + in.Type})
+		}
+	default:
+		fields = append(fields, FieldError{Field: prefix + "type", Code: "invalid_choice",
+			Message: "must be one of: card_fingerprint, email, customer_id, ip, bin"})
+	}
+	if len(in.Reason) > 500 {
+		fields = append(fields, FieldError{Field: prefix + "reason", Code: "too_long", Message: "must be at most 500 characters"})
+	}
+	return &FraudListEntry{
+		ID:        "fle_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		TenantID:  in.TenantID,
+		List:      in.List,
+		Type:      in.Type,
+		Value:     value,
+		Reason:    in.Reason,
+		ExpiresAt: in.ExpiresAt,
+	}, fields
+}
+
+// create adds an entry. Adding one already on its list updates its
+// reason and expiry.
+func (f *FraudLists) create(c *gin.Context) {
+	var in fraudListInput
+	if !bindJSON(c, &in) {
+		return
+	}
+	e, fields := in.entry("")
+	if in.ExpiresAt != nil && !in.ExpiresAt.After(time.Now()) {
+		fields = append(fields, FieldError{Field: "expires_at", Code: "invalid", Message: "must be in the future"})
+	}
+	if len(fields) > 0 {
+		validationFailed(c, fields)
+		return
+	}
+	added, err := f.store.SaveFraudListEntries(c.Request.Context(), []*FraudListEntry{e}, c.GetString("api_key_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	status := http.StatusOK
+	if added > 0 {
+		status = http.StatusCreated
+	}
+	respondData(c, status, e)
+}
+
+// delete removes an entry, with an optional ?reason= for the audit log.
+func (f *FraudLists) delete(c *gin.Context) {
+	err := f.store.DeleteFraudListEntry(c.Request.Context(), c.Param("id"), c.GetString("api_key_id"), c.Query("reason"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Fraud list entry not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// export streams the entries as CSV, optionally one ?list= and one
+// ?tenant_id=, in the columns import reads.
+func (f *FraudLists) export(c *gin.Context) {
+	list := c.Query("list")
+	if list != "" && list != fraudListBlock && list != fraudListAllow {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "list must be block or allow"))
+		return
+	}
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="fraud_lists_%s.csv"`, time.Now().UTC().Format("20060102")))
+	c.Status(http.StatusOK)
+
+	w := &csvRowWriter{w: csv.NewWriter(c.Writer)}
+	err := w.Write(fraudListColumns)
+	if err == nil {
+		err = f.store.EachFraudListEntry(ctx, list, c.Query("tenant_id"), func(e *FraudListEntry) error {
+			var expires string
+			if e.ExpiresAt != nil {
+				expires = e.ExpiresAt.UTC().Format(time.RFC3339)
+			}
+			return w.Write([]string{e.List, e.Type, e.Value, e.TenantID, e.Reason, expires})
+		})
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		// The status is sent, so all that's left is to cut the file short.
+		logf(ctx, "exporting fraud lists: %v", err)
+	}
+}
+
+// importCSV adds the entries of a CSV body with a header row, in the
+// columns export writes; list, type and value are required. Nothing is
+// added unless every row is valid. Expired entries are imported as they
+// are, so an export can be imported elsewhere unchanged.
+func (f *FraudLists) importCSV(c *gin.Context) {
+	r := csv.NewReader(http.MaxBytesReader(c.Writer, c.Request.Body, maxFraudListImportBody))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "Body must be CSV with a header row"))
+		return
+	}
+	col := map[string]int{}
+	for i, name := range header {
+		col[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, name := range []string{"list", "type", "value"} {
+		if _, ok := col[name]; !ok {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "CSV header lacks a "+name+" column"))
+			return
+		}
+	}
+
+	var entries []*FraudListEntry
+	var fields []FieldError
+	for row := 0; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "Invalid CSV: "+err.Error()))
+			return
+		}
+		if row >= f.maxImportRows {
+			c.JSON(http.StatusRequestEntityTooLarge, errorBody(c, CodePayloadTooLarge,
+				fmt.Sprintf("At most %d rows can be imported at once", f.maxImportRows)))
+			return
+		}
+		cell := func(name string) string {
+			if i, ok := col[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		prefix := fmt.Sprintf("rows[%d].", row)
+		in := fraudListInput{List: cell("list"), Type: cell("type"), Value: cell("value"), TenantID: cell("tenant_id"), Reason: cell("reason")}
+		if v := cell("expires_at"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				fields = append(fields, FieldError{Field: prefix + "expires_at", Code: "invalid", Message: "must be an RFC 3339 timestamp"})
+			} else {
+				in.ExpiresAt = &t
+			}
+		}
+		e, errs := in.entry(prefix)
+		fields = append(fields, errs...)
+		entries = append(entries, e)
+	}
+	if len(fields) > 0 {
+		validationFailed(c, fields)
+		return
+	}
+
+	added, err := f.store.SaveFraudListEntries(c.Request.Context(), entries, c.GetString("api_key_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{"imported": len(entries), "added": added, "updated": len(entries) - added})
+}
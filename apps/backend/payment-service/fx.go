@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+)
+
+var fxQuotes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_fx_quotes_total",
+	Help: "FX quotes, by result (locked, used, expired, mismatched).",
+}, []string{"result"})
+
+// FXConfig prices cross-currency checkout. The markup is added to the
+// mid-market rate, so the customer pays slightly more in their currency
+// than the plain conversion.
+//
+//	"fx": {"markup_percent": 1.5, "quote_ttl_seconds": 600, "local_currencies": ["eur", "gbp"]}
+type FXConfig struct {
+	MarkupPercent float64 `json:"markup_percent"`
+	// QuoteTTLSeconds zero means 600.
+	QuoteTTLSeconds int `json:"quote_ttl_seconds"`
+	// LocalCurrencies empty allows any currency with a rate.
+	LocalCurrencies []string `json:"local_currencies"`
+}
+
+func (cfg FXConfig) validate() error {
+	if cfg.MarkupPercent < 0 || cfg.MarkupPercent >= 100 {
+		return fmt.Errorf("fx: markup_percent must be at least 0 and below 100")
+	}
+	if cfg.QuoteTTLSeconds < 0 {
+		return fmt.Errorf("fx: quote_ttl_seconds must not be negative")
+	}
+	return nil
+}
+
+func (cfg FXConfig) quoteTTL() time.Duration {
+	if cfg.QuoteTTLSeconds == 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(cfg.QuoteTTLSeconds) * time.Second
+}
+
+func (cfg FXConfig) allows(currency string) bool {
+	return len(cfg.LocalCurrencies) == 0 || containsString(cfg.LocalCurrencies, currency)
+}
+
+// threeDecimalCurrencies have a thousandth as their minor unit.
+var threeDecimalCurrencies = map[string]bool{"bhd": true, "jod": true, "kwd": true, "omr": true, "tnd": true}
+
+// minorUnitsPerMajor is how many minor units make one unit of currency.
+func minorUnitsPerMajor(currency string) float64 {
+	switch {
+	case zeroDecimalCurrencies[currency]:
+		return 1
+	case threeDecimalCurrencies[currency]:
+		return 1000
+	}
+	return 100
+}
+
+// FXRates keeps exchange rates in memory, refreshed in the background
+// from FX_RATES_URL, which answers {"base": "usd", "rates": {"eur": 0.92}}
+// in units of each currency per unit of base. The last good copy is
+// served when a refresh fails, until it is older than maxAge.
+type FXRates struct {
+	url      string
+	interval time.Duration
+	maxAge   time.Duration
+	http     *http.Client
+
+	mu        sync.RWMutex
+	rates     map[string]float64
+	refreshed time.Time
+}
+
+// NewFXRates fetches rates from url. With no url, fixed rates are used
+// as they are and never go stale; with neither it returns nil and FX
+// quotes are unavailable.
+func NewFXRates(url string, interval, maxAge time.Duration, fixed map[string]float64) *FXRates {
+	fx := &FXRates{url: url, interval: interval, maxAge: maxAge, http: &http.Client{Timeout: 10 * time.Second}}
+	switch {
+	case url != "":
+		go fx.refreshLoop()
+	case fixed != nil:
+		fx.rates = fixed
+	default:
+		return nil
+	}
+	return fx
+}
+
+func (fx *FXRates) refreshLoop() {
+	for {
+		if err := fx.refresh(context.Background()); err != nil {
+			logf(context.Background(), "refreshing FX rates: %v", err)
+		}
+		time.Sleep(fx.interval)
+	}
+}
+
+func (fx *FXRates) refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fx.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := fx.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("FX rates request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("FX rates source returned %s", resp.Status)
+	}
+	var body struct {
+		Base  string             `json:"base"`
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("decoding FX rates: %w", err)
+	}
+	if body.Base == "" || len(body.Rates) == 0 {
+		return errors.New("FX rates source returned no rates")
+	}
+
+	rates := make(map[string]float64, len(body.Rates)+1)
+	for cur, r := range body.Rates {
+		if r > 0 {
+			rates[strings.ToLower(cur)] = r
+		}
+	}
+	rates[strings.ToLower(body.Base)] = 1
+
+	fx.mu.Lock()
+	fx.rates = rates
+	fx.refreshed = time.Now().UTC()
+	fx.mu.Unlock()
+	return nil
+}
+
+var (
+	errFXRatesStale  = errors.New("FX rates are stale")
+	errFXUnsupported = errors.New("no FX rate for currency")
+)
+
+// Rate returns the mid-market rate from one currency to another, in
+// units of to per unit of from.
+func (fx *FXRates) Rate(from, to string) (float64, error) {
+	fx.mu.RLock()
+	defer fx.mu.RUnlock()
+	if fx.url != "" && time.Since(fx.refreshed) > fx.maxAge {
+		return 0, errFXRatesStale
+	}
+	f, t := fx.rates[from], fx.rates[to]
+	if f == 0 || t == 0 {
+		return 0, errFXUnsupported
+	}
+	return t / f, nil
+}
+
+// FXQuote guarantees the local-currency price of an amount until it
+// expires. A payment created with its ID is charged LocalAmount in
+// LocalCurrency, whatever the rates have done since.
+type FXQuote struct {
+	ID            string `json:"id"`
+	TenantID      string `json:"tenant_id,omitempty"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	LocalAmount   int64  `json:"local_amount"`
+	LocalCurrency string `json:"local_currency"`
+	// Rate is what Amount was converted at, MidRate plus the markup.
+	Rate          float64   `json:"rate"`
+	MidRate       float64   `json:"mid_rate"`
+	MarkupPercent float64   `json:"markup_percent"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (q *FXQuote) expired(now time.Time) bool {
+	return !now.Before(q.ExpiresAt)
+}
+
+const fxQuoteColumns = `id, tenant_id, amount, currency, local_amount, local_currency, rate, mid_rate, markup_percent,
+	expires_at, created_at`
+
+func scanFXQuote(row interface{ Scan(...interface{}) error }) (*FXQuote, error) {
+	var q FXQuote
+	if err := row.Scan(&q.ID, &q.TenantID, &q.Amount, &q.Currency, &q.LocalAmount, &q.LocalCurrency, &q.Rate, &q.MidRate,
+		&q.MarkupPercent, &q.ExpiresAt, &q.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+func (s *Store) CreateFXQuote(ctx context.Context, q *FXQuote) (*FXQuote, error) {
+	return scanFXQuote(s.db.QueryRowContext(ctx, `
+		INSERT INTO fx_quotes
+			(id, tenant_id, amount, currency, local_amount, local_currency, rate, mid_rate, markup_percent, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING `+fxQuoteColumns,
+		q.ID, q.TenantID, q.Amount, q.Currency, q.LocalAmount, q.LocalCurrency, q.Rate, q.MidRate, q.MarkupPercent,
+		q.ExpiresAt))
+}
+
+func (s *Store) FXQuote(ctx context.Context, id string) (*FXQuote, error) {
+	return scanFXQuote(s.db.QueryRowContext(ctx, `SELECT `+fxQuoteColumns+` FROM fx_quotes WHERE id = $1`, id))
+}
+
+// Metadata recording the quote a payment was converted with.
+const (
+	metadataFXQuote          = "fx_quote_id"
+	metadataFXRate           = "fx_rate"
+	metadataFXSourceAmount   = "fx_source_amount"
+	metadataFXSourceCurrency = "fx_source_currency"
+)
+
+// lockedQuote returns req's FX quote, refusing one that has expired or
+// is for a different amount than req charges.
+func (s *PaymentService) lockedQuote(ctx context.Context, req PaymentRequest) (*FXQuote, *refusal) {
+	if s.store == nil {
+		return nil, &refusal{http.StatusServiceUnavailable, CodeNotConfigured, "FX quotes require DATABASE_URL", nil}
+	}
+	q, err := s.store.FXQuote(ctx, req.FXQuoteID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, &refusal{http.StatusBadRequest, CodeInvalidRequest, "Unknown fx_quote_id", nil}
+	}
+	if err != nil {
+		logf(ctx, "fx quote %s: %v", req.FXQuoteID, err)
+		return nil, &refusal{http.StatusInternalServerError, CodeInternal, "Could not read the FX quote", nil}
+	}
+	if q.expired(time.Now()) {
+		fxQuotes.WithLabelValues("expired").Inc()
+		return nil, &refusal{codeStatus[CodeFXQuoteExpired], CodeFXQuoteExpired, "FX quote expired at " + q.ExpiresAt.Format(time.RFC3339),
+			gin.H{"expires_at": q.ExpiresAt}}
+	}
+	if q.Amount != req.Amount || q.Currency != strings.ToLower(req.Currency) {
+		fxQuotes.WithLabelValues("mismatched").Inc()
+		return nil, &refusal{http.StatusBadRequest, CodeInvalidAmount,
+			fmt.Sprintf("The FX quote is for %d %s, not %d %s", q.Amount, q.Currency, req.Amount, strings.ToLower(req.Currency)), nil}
+	}
+	fxQuotes.WithLabelValues("used").Inc()
+	return q, nil
+}
+
+func (q *FXQuote) addMetadata(params *stripe.PaymentIntentParams) {
+	params.AddMetadata(metadataFXQuote, q.ID)
+	params.AddMetadata(metadataFXRate, strconv.FormatFloat(q.Rate, 'f', -1, 64))
+	params.AddMetadata(metadataFXSourceAmount, strconv.FormatInt(q.Amount, 10))
+	params.AddMetadata(metadataFXSourceCurrency, q.Currency)
+}
+
+// FXQuotes locks exchange rates for cross-currency checkout, so what a
+// customer is shown in their currency is what they are charged.
+type FXQuotes struct {
+	store    *Store
+	settings *RuntimeSettings
+	rates    *FXRates
+}
+
+func NewFXQuotes(store *Store, settings *RuntimeSettings, rates *FXRates) *FXQuotes {
+	return &FXQuotes{store: store, settings: settings, rates: rates}
+}
+
+func (fq *FXQuotes) RegisterRoutes(r gin.IRouter) {
+	r.POST("/fx/lock", fq.requireStore, fq.lock)
+	r.GET("/fx/quotes/:id", fq.requireStore, fq.get)
+}
+
+func (fq *FXQuotes) requireStore(c *gin.Context) {
+	switch {
+	case fq.store == nil:
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "FX quotes require DATABASE_URL"))
+	case fq.rates == nil:
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "FX quotes require FX_RATES_URL"))
+	default:
+		c.Next()
+	}
+}
+
+// lock quotes amount in local_currency at the current rate plus markup,
+// guaranteed until the quote expires.
+func (fq *FXQuotes) lock(c *gin.Context) {
+	var req struct {
+		Amount        int64  `json:"amount" binding:"required,gt=0"`
+		Currency      string `json:"currency" binding:"required,len=3"`
+		LocalCurrency string `json:"local_currency" binding:"required,len=3"`
+		TenantID      string `json:"tenant_id"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	from, to := strings.ToLower(req.Currency), strings.ToLower(req.LocalCurrency)
+	if from == to {
+		validationFailed(c, []FieldError{{Field: "local_currency", Code: "invalid", Message: "must differ from currency"}})
+		return
+	}
+	cfg := fq.settings.Get().FX
+	if !cfg.allows(to) {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidCurrency, "Payments aren't quoted in "+to))
+		return
+	}
+	mid, err := fq.rates.Rate(from, to)
+	switch {
+	case errors.Is(err, errFXUnsupported):
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidCurrency, "No exchange rate from "+from+" to "+to))
+		return
+	case err != nil:
+		c.Header("Retry-After", "60")
+		c.JSON(http.StatusServiceUnavailable, errorBody(c, CodeProviderUnavailable, "Exchange rates are unavailable"))
+		return
+	}
+
+	rate := mid * (1 + cfg.MarkupPercent/100)
+	if float64(req.Amount)/minorUnitsPerMajor(from)*rate*minorUnitsPerMajor(to) > math.MaxInt64/2 {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidAmount, "Amount can't be expressed in "+to))
+		return
+	}
+	local := convertMinor(req.Amount, from, to, rate, fq.settings.Get().Rounding.mode(to))
+	if local < 1 {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidAmount, "Amount can't be expressed in "+to))
+		return
+	}
+	q, err := fq.store.CreateFXQuote(c.Request.Context(), &FXQuote{
+		ID:            "fxq_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		TenantID:      req.TenantID,
+		Amount:        req.Amount,
+		Currency:      from,
+		LocalAmount:   local,
+		LocalCurrency: to,
+		Rate:          rate,
+		MidRate:       mid,
+		MarkupPercent: cfg.MarkupPercent,
+		ExpiresAt:     time.Now().Add(cfg.quoteTTL()).UTC(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	fxQuotes.WithLabelValues("locked").Inc()
+	respondData(c, http.StatusCreated, q)
+}
+
+func (fq *FXQuotes) get(c *gin.Context) {
+	q, err := fq.store.FXQuote(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "FX quote not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, q)
+}
@@ -0,0 +1,839 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+)
+
+var giftCardLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_gift_card_lookups_total",
+	Help: "Gift card code lookups, by outcome (found, not_found, blocked).",
+}, []string{"outcome"})
+
+// GiftCard is a stored value card. Status is active, voided, or expired
+// once ExpiresAt has passed.
+type GiftCard struct {
+	ID           string     `json:"id"`
+	Last4        string     `json:"last4"`
+	TenantID     string     `json:"tenant_id,omitempty"`
+	Currency     string     `json:"currency"`
+	InitialValue int64      `json:"initial_value"`
+	Balance      int64      `json:"balance"`
+	Status       string     `json:"status"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	ReplacedBy   string     `json:"replaced_by,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// Gift card transaction types. A reissue moves the balance of a voided
+// card onto its replacement, which records it as an issue.
+const (
+	giftCardIssue      = "issue"
+	giftCardRedemption = "redemption"
+	giftCardReversal   = "reversal"
+	giftCardVoid       = "void"
+	giftCardReissue    = "reissue"
+)
+
+// GiftCardTransaction is one movement of a gift card's balance, signed as
+// for wallets.
+type GiftCardTransaction struct {
+	ID           string    `json:"id"`
+	GiftCardID   string    `json:"gift_card_id"`
+	Type         string    `json:"type"`
+	Amount       int64     `json:"amount"`
+	BalanceAfter int64     `json:"balance_after"`
+	PaymentID    string    `json:"payment_id,omitempty"`
+	OrderID      string    `json:"order_id,omitempty"`
+	Description  string    `json:"description,omitempty"`
+	Reverses     string    `json:"reverses,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+var errGiftCardInactive = errors.New("gift card is voided or expired")
+
+// giftCardAlphabet leaves out 0, 1, I and O, which are easily misread on
+// a printed card. Its 32 letters make each character 5 bits, so a
+// 16-character code carries 80.
+const giftCardAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// newGiftCardCode returns a code formatted as XXXX-XXXX-XXXX-XXXX.
+func newGiftCardCode() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for i, v := range b {
+		if i > 0 && i%4 == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(giftCardAlphabet[v%32])
+	}
+	return sb.String(), nil
+}
+
+// normalizeGiftCardCode accepts codes typed in any case, with or without
+// separators.
+func normalizeGiftCardCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+}
+
+func hashGiftCardCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeGiftCardCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+const giftCardColumns = `id, last4, tenant_id, currency, initial_value, balance, status, expires_at, COALESCE(replaced_by, ''), created_at, updated_at`
+
+func scanGiftCard(row interface{ Scan(...interface{}) error }) (*GiftCard, error) {
+	var g GiftCard
+	var expires sql.NullTime
+	if err := row.Scan(&g.ID, &g.Last4, &g.TenantID, &g.Currency, &g.InitialValue, &g.Balance, &g.Status, &expires,
+		&g.ReplacedBy, &g.CreatedAt, &g.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if expires.Valid {
+		g.ExpiresAt = &expires.Time
+		if g.Status == "active" && expires.Time.Before(time.Now()) {
+			g.Status = "expired"
+		}
+	}
+	return &g, nil
+}
+
+const giftCardTransactionColumns = `id, gift_card_id, type, amount, balance_after, payment_id, order_id, description, COALESCE(reverses, ''), created_at`
+
+func scanGiftCardTransaction(row interface{ Scan(...interface{}) error }) (*GiftCardTransaction, error) {
+	var t GiftCardTransaction
+	if err := row.Scan(&t.ID, &t.GiftCardID, &t.Type, &t.Amount, &t.BalanceAfter, &t.PaymentID, &t.OrderID,
+		&t.Description, &t.Reverses, &t.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// giftCardMovement is a change to apply to a gift card, as walletMovement
+// is for wallets.
+type giftCardMovement struct {
+	cardID         string
+	typ            string
+	amount         int64
+	counterAccount string
+	paymentID      string
+	orderID        string
+	description    string
+	reverses       string
+	idempotencyKey string
+}
+
+// insertGiftCardTransaction posts m to the ledger and records it, inside
+// tx, leaving the card's balance for the caller to update. It returns the
+// ledger transaction too, for a transfer's other side to share.
+func insertGiftCardTransaction(ctx context.Context, tx *sql.Tx, m giftCardMovement, currency string, after int64) (*GiftCardTransaction, string, error) {
+	id := uuid.NewString()
+	ledgerID, err := postLedger(ctx, tx, "gift_card."+m.typ, id, currency,
+		LedgerEntry{Account: giftCardAccount(m.cardID), Amount: m.amount},
+		LedgerEntry{Account: m.counterAccount, Amount: -m.amount})
+	if err != nil {
+		return nil, "", err
+	}
+	t, err := recordGiftCardTransaction(ctx, tx, id, m, after, ledgerID)
+	return t, ledgerID, err
+}
+
+func recordGiftCardTransaction(ctx context.Context, tx *sql.Tx, id string, m giftCardMovement, after int64, ledgerID string) (*GiftCardTransaction, error) {
+	return scanGiftCardTransaction(tx.QueryRowContext(ctx, `
+		INSERT INTO gift_card_transactions
+			(id, gift_card_id, type, amount, balance_after, payment_id, order_id, description, reverses, idempotency_key, ledger_transaction_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING `+giftCardTransactionColumns,
+		id, m.cardID, m.typ, m.amount, after, m.paymentID, m.orderID, m.description,
+		sql.NullString{String: m.reverses, Valid: m.reverses != ""},
+		sql.NullString{String: m.idempotencyKey, Valid: m.idempotencyKey != ""},
+		ledgerID))
+}
+
+// insertGiftCard creates a card row holding amount and returns it with
+// its code. The caller records where the value came from.
+func insertGiftCard(ctx context.Context, tx *sql.Tx, tenantID, currency string, amount int64, expiresAt *time.Time) (*GiftCard, string, error) {
+	code, err := newGiftCardCode()
+	if err != nil {
+		return nil, "", err
+	}
+	var expires sql.NullTime
+	if expiresAt != nil {
+		expires = sql.NullTime{Time: expiresAt.UTC(), Valid: true}
+	}
+	card, err := scanGiftCard(tx.QueryRowContext(ctx, `
+		INSERT INTO gift_cards (id, code_hash, last4, tenant_id, currency, initial_value, balance, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6, $7)
+		RETURNING `+giftCardColumns,
+		uuid.NewString(), hashGiftCardCode(code), code[len(code)-4:], tenantID, currency, amount, expires))
+	if err != nil {
+		return nil, "", err
+	}
+	return card, code, nil
+}
+
+// IssueGiftCard creates a card and returns it with its code, which is not
+// stored and can't be shown again.
+func (s *Store) IssueGiftCard(ctx context.Context, tenantID, currency string, amount int64, expiresAt *time.Time, description string) (*GiftCard, string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	card, code, err := insertGiftCard(ctx, tx, tenantID, currency, amount, expiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, _, err := insertGiftCardTransaction(ctx, tx, giftCardMovement{
+		cardID:         card.ID,
+		typ:            giftCardIssue,
+		amount:         amount,
+		counterAccount: ledgerGiftCardsIssued,
+		description:    description,
+	}, currency, amount); err != nil {
+		return nil, "", err
+	}
+	return card, code, tx.Commit()
+}
+
+func (s *Store) GiftCard(ctx context.Context, id string) (*GiftCard, error) {
+	return scanGiftCard(s.db.QueryRowContext(ctx, `SELECT `+giftCardColumns+` FROM gift_cards WHERE id = $1`, id))
+}
+
+// GiftCardByCode returns the card with code, or sql.ErrNoRows.
+func (s *Store) GiftCardByCode(ctx context.Context, code string) (*GiftCard, error) {
+	return scanGiftCard(s.db.QueryRowContext(ctx, `
+		SELECT `+giftCardColumns+` FROM gift_cards WHERE code_hash = $1`, hashGiftCardCode(code)))
+}
+
+func (s *Store) GiftCardTransaction(ctx context.Context, id string) (*GiftCardTransaction, error) {
+	return scanGiftCardTransaction(s.db.QueryRowContext(ctx, `
+		SELECT `+giftCardTransactionColumns+` FROM gift_card_transactions WHERE id = $1`, id))
+}
+
+// GiftCardTransactions lists a card's history, newest first.
+func (s *Store) GiftCardTransactions(ctx context.Context, cardID string, limit, offset int) ([]*GiftCardTransaction, bool, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+giftCardTransactionColumns+` FROM gift_card_transactions
+		WHERE gift_card_id = $1 ORDER BY created_at DESC, id LIMIT $2 OFFSET $3`,
+		cardID, limit+1, offset)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	txs := []*GiftCardTransaction{}
+	for rows.Next() {
+		t, err := scanGiftCardTransaction(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		txs = append(txs, t)
+	}
+	if len(txs) > limit {
+		return txs[:limit], true, rows.Err()
+	}
+	return txs, false, rows.Err()
+}
+
+// SetGiftCardTransactionPayment records the card payment for the rest of
+// a checkout on its redemption, which a cancellation of that payment alone
+// may reverse.
+func (s *Store) SetGiftCardTransactionPayment(ctx context.Context, id, paymentID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE gift_card_transactions SET payment_id = $2 WHERE id = $1 AND payment_id = ''`, id, paymentID)
+	return err
+}
+
+// GiftCardTransactionReversed reports whether a reversal of id exists.
+func (s *Store) GiftCardTransactionReversed(ctx context.Context, id string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM gift_card_transactions WHERE reverses = $1`, id).Scan(&n)
+	return n > 0, err
+}
+
+// lockGiftCard reads a card inside tx, holding its row lock until tx ends.
+func lockGiftCard(ctx context.Context, tx *sql.Tx, id string) (*GiftCard, error) {
+	return scanGiftCard(tx.QueryRowContext(ctx, `SELECT `+giftCardColumns+` FROM gift_cards WHERE id = $1 FOR UPDATE`, id))
+}
+
+// applyGiftCardMovement is applyWalletMovement for gift cards. Only active
+// cards can be redeemed; reversals are accepted whatever the status, so a
+// voided card still gets back what a failed checkout took, ready to be
+// reissued.
+func (s *Store) applyGiftCardMovement(ctx context.Context, m giftCardMovement) (*GiftCardTransaction, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	card, err := lockGiftCard(ctx, tx, m.cardID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT ` + giftCardTransactionColumns + ` FROM gift_card_transactions WHERE `
+	var prior *GiftCardTransaction
+	switch {
+	case m.idempotencyKey != "":
+		prior, err = scanGiftCardTransaction(tx.QueryRowContext(ctx, query+`gift_card_id = $1 AND idempotency_key = $2`, m.cardID, m.idempotencyKey))
+	case m.reverses != "":
+		prior, err = scanGiftCardTransaction(tx.QueryRowContext(ctx, query+`reverses = $1`, m.reverses))
+	default:
+		err = sql.ErrNoRows
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return prior, err
+	}
+
+	if m.typ == giftCardRedemption && card.Status != "active" {
+		return nil, errGiftCardInactive
+	}
+	after := card.Balance + m.amount
+	if after < 0 {
+		return nil, errInsufficientBalance
+	}
+	t, _, err := insertGiftCardTransaction(ctx, tx, m, card.Currency, after)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE gift_cards SET balance = $2, updated_at = now() WHERE id = $1`, m.cardID, after); err != nil {
+		return nil, err
+	}
+	return t, tx.Commit()
+}
+
+// VoidGiftCard retires an active or expired card, writing its remaining
+// balance off against issuance.
+func (s *Store) VoidGiftCard(ctx context.Context, id, reason string) (*GiftCard, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	card, err := lockGiftCard(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if card.Status == "voided" {
+		return nil, errGiftCardInactive
+	}
+	if card.Balance > 0 {
+		if _, _, err := insertGiftCardTransaction(ctx, tx, giftCardMovement{
+			cardID:         id,
+			typ:            giftCardVoid,
+			amount:         -card.Balance,
+			counterAccount: ledgerGiftCardsIssued,
+			description:    reason,
+		}, card.Currency, 0); err != nil {
+			return nil, err
+		}
+	}
+	card, err = scanGiftCard(tx.QueryRowContext(ctx, `
+		UPDATE gift_cards SET balance = 0, status = 'voided', updated_at = now() WHERE id = $1
+		RETURNING `+giftCardColumns, id))
+	if err != nil {
+		return nil, err
+	}
+	return card, tx.Commit()
+}
+
+// ReissueGiftCard voids a card and moves its balance onto a new one with a
+// new code, for a lost or leaked code or an expired card being extended.
+// The replacement keeps the old expiry unless expiresAt is set.
+func (s *Store) ReissueGiftCard(ctx context.Context, id string, expiresAt *time.Time, reason string) (*GiftCard, string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	old, err := lockGiftCard(ctx, tx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	if old.Status == "voided" {
+		return nil, "", errGiftCardInactive
+	}
+	if old.Balance == 0 {
+		return nil, "", errInsufficientBalance
+	}
+	if expiresAt == nil {
+		expiresAt = old.ExpiresAt
+	}
+
+	// One ledger transfer from the old card to the new, recorded on both.
+	card, code, err := insertGiftCard(ctx, tx, old.TenantID, old.Currency, old.Balance, expiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+	_, ledgerID, err := insertGiftCardTransaction(ctx, tx, giftCardMovement{
+		cardID:         old.ID,
+		typ:            giftCardReissue,
+		amount:         -old.Balance,
+		counterAccount: giftCardAccount(card.ID),
+		description:    reason,
+	}, old.Currency, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := recordGiftCardTransaction(ctx, tx, uuid.NewString(), giftCardMovement{
+		cardID:      card.ID,
+		typ:         giftCardIssue,
+		amount:      old.Balance,
+		description: "reissued from " + old.ID,
+	}, old.Balance, ledgerID); err != nil {
+		return nil, "", err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE gift_cards SET balance = 0, status = 'voided', replaced_by = $2, updated_at = now() WHERE id = $1`,
+		old.ID, card.ID); err != nil {
+		return nil, "", err
+	}
+	return card, code, tx.Commit()
+}
+
+// Metadata on card PaymentIntents paying the rest of a gift card checkout.
+const (
+	giftCardMetadataID          = "gift_card_id"
+	giftCardMetadataTransaction = "gift_card_transaction_id"
+)
+
+// GiftCards issues gift cards and redeems them at checkout, with a card
+// paying whatever the gift card doesn't cover. Looking a card up by code
+// is the only way in without an admin token, so failed lookups are
+// limited per client IP: codes are 80 random bits, and the limit keeps
+// anyone from walking through them.
+type GiftCards struct {
+	store    *Store
+	payments *PaymentService
+	failures *ipRateLimiter
+}
+
+// NewGiftCards allows maxFailures failed lookups per client IP, refilled
+// over window. maxFailures 0 disables the limit.
+func NewGiftCards(store *Store, payments *PaymentService, maxFailures int, window time.Duration) *GiftCards {
+	g := &GiftCards{store: store, payments: payments}
+	if maxFailures > 0 && window > 0 {
+		g.failures = newIPRateLimiter(RateLimitConfig{RequestsPerSecond: float64(maxFailures) / window.Seconds(), Burst: maxFailures})
+		g.failures.idle = window
+	}
+	return g
+}
+
+// RegisterRoutes mounts lookup and redemption, which take the code in the
+// body so it stays out of URLs and access logs, and issuance, void and
+// reissue under the admin scope.
+func (g *GiftCards) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	pub := r.Group("/gift-cards", g.requireStore)
+	pub.POST("/lookup", g.lookup)
+	pub.POST("/redeem", g.redeem)
+
+	admin := r.Group("/admin/gift-cards", requireScope(g.store, bootstrapToken, "admin"), g.requireStore)
+	admin.POST("", g.issue)
+	admin.GET("/:id", g.get)
+	admin.GET("/:id/transactions", g.transactions)
+	admin.POST("/:id/void", g.void)
+	admin.POST("/:id/reissue", g.reissue)
+}
+
+func (g *GiftCards) requireStore(c *gin.Context) {
+	if g.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Gift cards require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// byCode finds the card for code, counting a miss against the client and
+// refusing clients that have missed too often.
+func (g *GiftCards) byCode(c *gin.Context, code string) (*GiftCard, bool) {
+	ip := c.ClientIP()
+	if g.failures != nil {
+		if wait := g.failures.retryAfter(ip); wait > 0 {
+			giftCardLookups.WithLabelValues("blocked").Inc()
+			c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, errorBody(c, CodeRateLimited, "Too many failed gift card lookups"))
+			return nil, false
+		}
+	}
+
+	card, err := g.store.GiftCardByCode(c.Request.Context(), code)
+	if errors.Is(err, sql.ErrNoRows) {
+		giftCardLookups.WithLabelValues("not_found").Inc()
+		if g.failures != nil {
+			g.failures.allow(ip)
+		}
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Gift card not found"))
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return nil, false
+	}
+	giftCardLookups.WithLabelValues("found").Inc()
+	return card, true
+}
+
+// load fetches the card named in the path for admin routes.
+func (g *GiftCards) load(c *gin.Context) (*GiftCard, bool) {
+	card, err := g.store.GiftCard(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Gift card not found"))
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return nil, false
+	}
+	return card, true
+}
+
+func giftCardInactive(c *gin.Context, status string) {
+	c.JSON(http.StatusUnprocessableEntity, errorBodyWith(c, CodeGiftCardInactive, "Gift card is "+status,
+		gin.H{"gift_card_status": status}))
+}
+
+func (g *GiftCards) lookup(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if card, ok := g.byCode(c, req.Code); ok {
+		respondData(c, http.StatusOK, card)
+	}
+}
+
+// GiftCardCheckout is the outcome of POST /gift-cards/redeem.
+type GiftCardCheckout struct {
+	GiftCardAmount int64                `json:"gift_card_amount"`
+	CardAmount     int64                `json:"card_amount"`
+	Balance        int64                `json:"balance"`
+	Transaction    *GiftCardTransaction `json:"gift_card_transaction,omitempty"`
+	// Payment is the card PaymentIntent for the remainder.
+	Payment *Payment `json:"payment,omitempty"`
+}
+
+// redeem pays an order with a gift card, splitting the tender with a card
+// when card_remainder is set, exactly as a wallet checkout does: the gift
+// card is debited first and the debit reversed if the card payment can't
+// be created or is later canceled.
+func (g *GiftCards) redeem(c *gin.Context) {
+	var req struct {
+		Code          string            `json:"code" binding:"required"`
+		Amount        int64             `json:"amount" binding:"required,gt=0"`
+		Currency      string            `json:"currency" binding:"required,len=3"`
+		OrderID       string            `json:"order_id"`
+		Description   string            `json:"description"`
+		CustomerID    string            `json:"customer_id"`
+		CardRemainder bool              `json:"card_remainder"`
+		Metadata      map[string]string `json:"metadata"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if fields := validateMetadata(req.Metadata); len(fields) > 0 {
+		validationFailed(c, fields)
+		return
+	}
+	card, ok := g.byCode(c, req.Code)
+	if !ok {
+		return
+	}
+	if !strings.EqualFold(req.Currency, card.Currency) {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidCurrency, "Gift card is in "+card.Currency))
+		return
+	}
+	if card.Status != "active" {
+		giftCardInactive(c, card.Status)
+		return
+	}
+	ctx := c.Request.Context()
+	key := c.GetHeader("Idempotency-Key")
+
+	debit := req.Amount
+	if card.Balance < debit {
+		if !req.CardRemainder {
+			insufficientBalance(c, card.Balance)
+			return
+		}
+		debit = card.Balance
+	}
+
+	out := GiftCardCheckout{Balance: card.Balance}
+	if debit > 0 {
+		m := giftCardMovement{
+			cardID:         card.ID,
+			typ:            giftCardRedemption,
+			amount:         -debit,
+			counterAccount: salesAccount(card.TenantID),
+			orderID:        req.OrderID,
+			description:    req.Description,
+		}
+		if key != "" {
+			m.idempotencyKey = key + ":gift_card"
+		}
+		t, err := g.store.applyGiftCardMovement(ctx, m)
+		switch {
+		case errors.Is(err, errInsufficientBalance):
+			insufficientBalance(c, card.Balance)
+			return
+		case errors.Is(err, errGiftCardInactive):
+			giftCardInactive(c, "inactive")
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+		if reversed, err := g.store.GiftCardTransactionReversed(ctx, t.ID); err != nil || reversed {
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			} else {
+				c.JSON(http.StatusConflict, errorBody(c, CodeIdempotencyConflict, "This redemption was reversed; retry with a new Idempotency-Key"))
+			}
+			return
+		}
+		out.Transaction = t
+		out.GiftCardAmount = -t.Amount
+		out.Balance = t.BalanceAfter
+	}
+	out.CardAmount = req.Amount - out.GiftCardAmount
+
+	if out.CardAmount > 0 {
+		metadata := map[string]string{}
+		for k, v := range req.Metadata {
+			metadata[k] = v
+		}
+		metadata[giftCardMetadataID] = card.ID
+		if out.Transaction != nil {
+			metadata[giftCardMetadataTransaction] = out.Transaction.ID
+		}
+		preq := PaymentRequest{
+			Amount:      out.CardAmount,
+			Currency:    card.Currency,
+			Description: req.Description,
+			OrderID:     req.OrderID,
+			CustomerID:  req.CustomerID,
+			TenantID:    card.TenantID,
+			Metadata:    metadata,
+		}
+		cardKey := ""
+		if key != "" {
+			cardKey = key + ":card"
+		}
+		pi, ok := g.payments.createFor(c, preq, cardKey)
+		if !ok {
+			if out.Transaction != nil {
+				if _, err := g.reverse(context.WithoutCancel(ctx), card.TenantID, out.Transaction, "card payment for the remainder failed"); err != nil {
+					logf(ctx, "reversing gift card redemption %s: %v", out.Transaction.ID, err)
+				}
+			}
+			return
+		}
+		if out.Transaction != nil {
+			if err := g.store.SetGiftCardTransactionPayment(ctx, out.Transaction.ID, pi.ID); err != nil {
+				logf(ctx, "recording payment %s on gift card redemption %s: %v", pi.ID, out.Transaction.ID, err)
+			}
+			out.Transaction.PaymentID = pi.ID
+		}
+		p := paymentData(pi, true)
+		out.Payment = &p
+	}
+	respondData(c, http.StatusCreated, out)
+}
+
+// reverse gives a redemption back to its card.
+func (g *GiftCards) reverse(ctx context.Context, tenantID string, t *GiftCardTransaction, why string) (*GiftCardTransaction, error) {
+	if t.Type != giftCardRedemption {
+		return nil, fmt.Errorf("only redemptions are reversed, not %s %s", t.Type, t.ID)
+	}
+	return g.store.applyGiftCardMovement(ctx, giftCardMovement{
+		cardID:         t.GiftCardID,
+		typ:            giftCardReversal,
+		amount:         -t.Amount,
+		counterAccount: salesAccount(tenantID),
+		orderID:        t.OrderID,
+		description:    why,
+		reverses:       t.ID,
+	})
+}
+
+// GiftCardIssued carries a new card's code, which is shown only here.
+type GiftCardIssued struct {
+	*GiftCard
+	Code string `json:"code"`
+}
+
+func (g *GiftCards) issue(c *gin.Context) {
+	var req struct {
+		Amount      int64      `json:"amount" binding:"required,gt=0"`
+		Currency    string     `json:"currency" binding:"required,len=3"`
+		TenantID    string     `json:"tenant_id"`
+		ExpiresAt   *time.Time `json:"expires_at"`
+		Description string     `json:"description"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "expires_at must be in the future"))
+		return
+	}
+
+	card, code, err := g.store.IssueGiftCard(c.Request.Context(), req.TenantID, strings.ToLower(req.Currency), req.Amount,
+		req.ExpiresAt, req.Description)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusCreated, GiftCardIssued{GiftCard: card, Code: code})
+}
+
+func (g *GiftCards) get(c *gin.Context) {
+	if card, ok := g.load(c); ok {
+		respondData(c, http.StatusOK, card)
+	}
+}
+
+func (g *GiftCards) transactions(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 100 {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "limit must be between 1 and 100"))
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "offset must be a non-negative integer"))
+		return
+	}
+	card, ok := g.load(c)
+	if !ok {
+		return
+	}
+
+	txs, hasMore, err := g.store.GiftCardTransactions(c.Request.Context(), card.ID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondList(c, http.StatusOK, txs, gin.H{
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": hasMore,
+		"balance":  card.Balance,
+	})
+}
+
+func (g *GiftCards) void(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason" binding:"required"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	card, err := g.store.VoidGiftCard(c.Request.Context(), c.Param("id"), req.Reason)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Gift card not found"))
+	case errors.Is(err, errGiftCardInactive):
+		giftCardInactive(c, "voided")
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+	default:
+		respondData(c, http.StatusOK, card)
+	}
+}
+
+// reissue replaces a card with a new code holding its balance. An expired
+// card needs a new expires_at, or its replacement would be expired too.
+func (g *GiftCards) reissue(c *gin.Context) {
+	var req struct {
+		Reason    string     `json:"reason" binding:"required"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "expires_at must be in the future"))
+		return
+	}
+	old, ok := g.load(c)
+	if !ok {
+		return
+	}
+	if old.Status == "expired" && req.ExpiresAt == nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "expires_at is required to reissue an expired gift card"))
+		return
+	}
+
+	card, code, err := g.store.ReissueGiftCard(c.Request.Context(), old.ID, req.ExpiresAt, req.Reason)
+	switch {
+	case errors.Is(err, errGiftCardInactive):
+		giftCardInactive(c, "voided")
+	case errors.Is(err, errInsufficientBalance):
+		c.JSON(http.StatusUnprocessableEntity, errorBodyWith(c, CodeInsufficientBalance, "Gift card has no balance to reissue",
+			gin.H{"balance": 0}))
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+	default:
+		respondData(c, http.StatusCreated, GiftCardIssued{GiftCard: card, Code: code})
+	}
+}
+
+// paymentIntentEvent returns a redemption to its card when the card
+// payment for the rest of the checkout is canceled: the redemption must
+// record that payment, whatever the metadata names. Redeliveries find the
+// reversal already made.
+func (g *GiftCards) paymentIntentEvent(ctx context.Context, typ stripe.EventType, pi *stripe.PaymentIntent) error {
+	txID := pi.Metadata[giftCardMetadataTransaction]
+	if g == nil || g.store == nil || txID == "" || typ != "payment_intent.canceled" {
+		return nil
+	}
+	t, err := g.store.GiftCardTransaction(ctx, txID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading gift card transaction for %s: %w", pi.ID, err)
+	}
+	if t.PaymentID != pi.ID {
+		logf(ctx, "payment %s names gift card redemption %s but is not its card payment", pi.ID, t.ID)
+		return nil
+	}
+	if _, err := g.reverse(ctx, pi.Metadata["tenant_id"], t, "card payment "+pi.ID+" canceled"); err != nil {
+		return fmt.Errorf("reversing gift card redemption %s: %w", t.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package graph
+
+// This file will be automatically regenerated based on the schema, any resolver implementations
+// will be copied through when generating and any unknown code will be moved to the end.
+// Code generated by github.com/99designs/gqlgen version v0.17.45
+
+import (
+	"context"
+	"payment-service/graph/model"
+)
+
+// FindCustomerByID is the resolver for the findCustomerByID field.
+func (r *entityResolver) FindCustomerByID(ctx context.Context, id string) (*model.Customer, error) {
+	return getCustomer(ctx, id)
+}
+
+// FindOrderByID is the resolver for the findOrderByID field.
+func (r *entityResolver) FindOrderByID(ctx context.Context, id string) (*model.Order, error) {
+	return &model.Order{ID: id}, nil
+}
+
+// FindPaymentByID is the resolver for the findPaymentByID field.
+func (r *entityResolver) FindPaymentByID(ctx context.Context, id string) (*model.Payment, error) {
+	return getPayment(ctx, id)
+}
+
+// FindRefundByID is the resolver for the findRefundByID field.
+func (r *entityResolver) FindRefundByID(ctx context.Context, id string) (*model.Refund, error) {
+	return getRefund(ctx, id)
+}
+
+// FindUserByID is the resolver for the findUserByID field.
+func (r *entityResolver) FindUserByID(ctx context.Context, id string) (*model.User, error) {
+	return &model.User{ID: id}, nil
+}
+
+// Entity returns EntityResolver implementation.
+func (r *Resolver) Entity() EntityResolver { return &entityResolver{r} }
+
+type entityResolver struct{ *Resolver }
@@ -0,0 +1,53 @@
+package model
+
+// Payment mirrors a Stripe PaymentIntent. CustomerID is kept unexported from
+// the schema and used to resolve the customer field lazily.
+type Payment struct {
+	ID          string  `json:"id"`
+	Amount      int64   `json:"amount"`
+	Currency    string  `json:"currency"`
+	Status      string  `json:"status"`
+	Description *string `json:"description,omitempty"`
+	OrderID     *string `json:"orderId,omitempty"`
+	CreatedAt   string  `json:"createdAt"`
+	CustomerID  string  `json:"-"`
+}
+
+func (Payment) IsEntity() {}
+
+// Refund mirrors a Stripe Refund.
+type Refund struct {
+	ID        string  `json:"id"`
+	Amount    int64   `json:"amount"`
+	Currency  string  `json:"currency"`
+	Status    string  `json:"status"`
+	Reason    *string `json:"reason,omitempty"`
+	CreatedAt string  `json:"createdAt"`
+	PaymentID string  `json:"-"`
+}
+
+func (Refund) IsEntity() {}
+
+// Customer mirrors a Stripe Customer.
+type Customer struct {
+	ID     string  `json:"id"`
+	Email  *string `json:"email,omitempty"`
+	Name   *string `json:"name,omitempty"`
+	UserID *string `json:"userId,omitempty"`
+}
+
+func (Customer) IsEntity() {}
+
+// Order is a stub for the order subgraph's entity.
+type Order struct {
+	ID string `json:"id"`
+}
+
+func (Order) IsEntity() {}
+
+// User is a stub for the auth subgraph's entity.
+type User struct {
+	ID string `json:"id"`
+}
+
+func (User) IsEntity() {}
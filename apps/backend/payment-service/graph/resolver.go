@@ -0,0 +1,7 @@
+package graph
+
+// This file will not be regenerated automatically.
+//
+// Resolver is the root of the payment subgraph. All data is read from Stripe
+// directly, so it carries no state of its own.
+type Resolver struct{}
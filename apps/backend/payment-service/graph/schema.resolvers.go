@@ -0,0 +1,91 @@
+package graph
+
+// This file will be automatically regenerated based on the schema, any resolver implementations
+// will be copied through when generating and any unknown code will be moved to the end.
+// Code generated by github.com/99designs/gqlgen version v0.17.45
+
+import (
+	"context"
+	"payment-service/graph/model"
+)
+
+// Payments is the resolver for the payments field.
+func (r *customerResolver) Payments(ctx context.Context, obj *model.Customer) ([]*model.Payment, error) {
+	return listCustomerPayments(ctx, obj.ID)
+}
+
+// Payments is the resolver for the payments field.
+func (r *orderResolver) Payments(ctx context.Context, obj *model.Order) ([]*model.Payment, error) {
+	return searchPayments(ctx, "metadata['order_id']:"+searchValue(obj.ID))
+}
+
+// Customer is the resolver for the customer field.
+func (r *paymentResolver) Customer(ctx context.Context, obj *model.Payment) (*model.Customer, error) {
+	if obj.CustomerID == "" {
+		return nil, nil
+	}
+	return getCustomer(ctx, obj.CustomerID)
+}
+
+// Refunds is the resolver for the refunds field.
+func (r *paymentResolver) Refunds(ctx context.Context, obj *model.Payment) ([]*model.Refund, error) {
+	return listRefunds(ctx, obj.ID)
+}
+
+// Payment is the resolver for the payment field.
+func (r *queryResolver) Payment(ctx context.Context, id string) (*model.Payment, error) {
+	return getPayment(ctx, id)
+}
+
+// Refund is the resolver for the refund field.
+func (r *queryResolver) Refund(ctx context.Context, id string) (*model.Refund, error) {
+	return getRefund(ctx, id)
+}
+
+// Customer is the resolver for the customer field.
+func (r *queryResolver) Customer(ctx context.Context, id string) (*model.Customer, error) {
+	return getCustomer(ctx, id)
+}
+
+// PaymentsByOrder is the resolver for the paymentsByOrder field.
+func (r *queryResolver) PaymentsByOrder(ctx context.Context, orderID string) ([]*model.Payment, error) {
+	return searchPayments(ctx, "metadata['order_id']:"+searchValue(orderID))
+}
+
+// Payment is the resolver for the payment field.
+func (r *refundResolver) Payment(ctx context.Context, obj *model.Refund) (*model.Payment, error) {
+	if obj.PaymentID == "" {
+		return nil, nil
+	}
+	return getPayment(ctx, obj.PaymentID)
+}
+
+// Customer is the resolver for the customer field.
+func (r *userResolver) Customer(ctx context.Context, obj *model.User) (*model.Customer, error) {
+	return findCustomerByUser(ctx, obj.ID)
+}
+
+// Customer returns CustomerResolver implementation.
+func (r *Resolver) Customer() CustomerResolver { return &customerResolver{r} }
+
+// Order returns OrderResolver implementation.
+func (r *Resolver) Order() OrderResolver { return &orderResolver{r} }
+
+// Payment returns PaymentResolver implementation.
+func (r *Resolver) Payment() PaymentResolver { return &paymentResolver{r} }
+
+// Query returns QueryResolver implementation.
+func (r *Resolver) Query() QueryResolver { return &queryResolver{r} }
+
+// Refund returns RefundResolver implementation.
+func (r *Resolver) Refund() RefundResolver { return &refundResolver{r} }
+
+// User returns UserResolver implementation.
+func (r *Resolver) User() UserResolver { return &userResolver{r} }
+
+type customerResolver struct{ *Resolver }
+type orderResolver struct{ *Resolver }
+type paymentResolver struct{ *Resolver }
+type queryResolver struct{ *Resolver }
+type refundResolver struct{ *Resolver }
+type userResolver struct{ *Resolver }
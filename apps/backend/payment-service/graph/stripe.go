@@ -0,0 +1,185 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/customer"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"github.com/stripe/stripe-go/v76/refund"
+
+	"payment-service/graph/model"
+)
+
+// maxListed caps how many objects a single list field will page through.
+const maxListed = 100
+
+func isNotFound(err error) bool {
+	var stripeErr *stripe.Error
+	return errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == http.StatusNotFound
+}
+
+// searchEscaper escapes backslashes as well as quotes, in one pass, so a
+// value ending in a backslash can't escape the closing quote.
+var searchEscaper = strings.NewReplacer(`\`, `\\`, "'", `\'`)
+
+// searchValue quotes a value for use in a Stripe search query.
+func searchValue(v string) string {
+	return "'" + searchEscaper.Replace(v) + "'"
+}
+
+func formatTime(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func toPayment(pi *stripe.PaymentIntent) *model.Payment {
+	p := &model.Payment{
+		ID:          pi.ID,
+		Amount:      pi.Amount,
+		Currency:    string(pi.Currency),
+		Status:      string(pi.Status),
+		Description: optional(pi.Description),
+		OrderID:     optional(pi.Metadata["order_id"]),
+		CreatedAt:   formatTime(pi.Created),
+	}
+	if pi.Customer != nil {
+		p.CustomerID = pi.Customer.ID
+	}
+	return p
+}
+
+func toRefund(r *stripe.Refund) *model.Refund {
+	out := &model.Refund{
+		ID:        r.ID,
+		Amount:    r.Amount,
+		Currency:  string(r.Currency),
+		Status:    string(r.Status),
+		Reason:    optional(string(r.Reason)),
+		CreatedAt: formatTime(r.Created),
+	}
+	if r.PaymentIntent != nil {
+		out.PaymentID = r.PaymentIntent.ID
+	}
+	return out
+}
+
+func toCustomer(c *stripe.Customer) *model.Customer {
+	return &model.Customer{
+		ID:     c.ID,
+		Email:  optional(c.Email),
+		Name:   optional(c.Name),
+		UserID: optional(c.Metadata["user_id"]),
+	}
+}
+
+func getPayment(ctx context.Context, id string) (*model.Payment, error) {
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	pi, err := paymentintent.Get(id, params)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching payment %s: %w", id, err)
+	}
+	return toPayment(pi), nil
+}
+
+func getRefund(ctx context.Context, id string) (*model.Refund, error) {
+	params := &stripe.RefundParams{}
+	params.Context = ctx
+	r, err := refund.Get(id, params)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching refund %s: %w", id, err)
+	}
+	return toRefund(r), nil
+}
+
+func getCustomer(ctx context.Context, id string) (*model.Customer, error) {
+	params := &stripe.CustomerParams{}
+	params.Context = ctx
+	c, err := customer.Get(id, params)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching customer %s: %w", id, err)
+	}
+	if c.Deleted {
+		return nil, nil
+	}
+	return toCustomer(c), nil
+}
+
+func searchPayments(ctx context.Context, query string) ([]*model.Payment, error) {
+	params := &stripe.PaymentIntentSearchParams{}
+	params.Context = ctx
+	params.Query = query
+	payments := []*model.Payment{}
+	it := paymentintent.Search(params)
+	for it.Next() && len(payments) < maxListed {
+		payments = append(payments, toPayment(it.PaymentIntent()))
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("searching payments: %w", err)
+	}
+	return payments, nil
+}
+
+func listCustomerPayments(ctx context.Context, customerID string) ([]*model.Payment, error) {
+	params := &stripe.PaymentIntentListParams{Customer: stripe.String(customerID)}
+	params.Context = ctx
+	payments := []*model.Payment{}
+	it := paymentintent.List(params)
+	for it.Next() && len(payments) < maxListed {
+		payments = append(payments, toPayment(it.PaymentIntent()))
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("listing payments for customer %s: %w", customerID, err)
+	}
+	return payments, nil
+}
+
+func listRefunds(ctx context.Context, paymentID string) ([]*model.Refund, error) {
+	params := &stripe.RefundListParams{PaymentIntent: stripe.String(paymentID)}
+	params.Context = ctx
+	refunds := []*model.Refund{}
+	it := refund.List(params)
+	for it.Next() && len(refunds) < maxListed {
+		refunds = append(refunds, toRefund(it.Refund()))
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("listing refunds for payment %s: %w", paymentID, err)
+	}
+	return refunds, nil
+}
+
+func findCustomerByUser(ctx context.Context, userID string) (*model.Customer, error) {
+	params := &stripe.CustomerSearchParams{}
+	params.Context = ctx
+	params.Query = "metadata['user_id']:" + searchValue(userID)
+	params.Limit = stripe.Int64(1)
+	it := customer.Search(params)
+	if it.Next() {
+		return toCustomer(it.Customer()), nil
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("searching customer for user %s: %w", userID, err)
+	}
+	return nil, nil
+}
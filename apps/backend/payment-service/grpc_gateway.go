@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	paymentsv1 "payment-service/proto/payments/v1"
+)
+
+// newGRPCGateway serves the gRPC API as REST under /v1, from the routes
+// in the .proto files' google.api.http options, by calling the gRPC
+// server at grpcAddr. The Authorization header goes through as the
+// call's metadata, so keys and scopes work as they do over gRPC. JSON
+// fields keep the .proto files' snake_case names.
+func newGRPCGateway(ctx context.Context, grpcAddr string) (*runtime.ServeMux, error) {
+	mux := runtime.NewServeMux(runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
+		MarshalOptions:   protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true},
+		UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true},
+	}))
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if err := paymentsv1.RegisterPaymentsServiceHandlerFromEndpoint(ctx, mux, grpcAddr, opts); err != nil {
+		return nil, err
+	}
+	if err := paymentsv1.RegisterPaymentEventsServiceHandlerFromEndpoint(ctx, mux, grpcAddr, opts); err != nil {
+		return nil, err
+	}
+	return mux, nil
+}
+
+// grpcGatewayHandler mounts the gateway on gin. Watches stream for as long
+// as the client stays, so they go without the write deadline.
+func grpcGatewayHandler(mux *runtime.ServeMux) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if strings.HasSuffix(c.Request.URL.Path, ":watch") {
+			disableWriteDeadline(c.Writer)
+		}
+		mux.ServeHTTP(c.Writer, c.Request)
+	}
+}
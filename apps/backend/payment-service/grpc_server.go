@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	paymentsv1 "payment-service/proto/payments/v1"
+)
+
+// Scopes an API key needs for each gRPC method. Methods not listed, the
+// health and reflection services, need no key.
+const (
+	watchPaymentsScope = "payments:watch"
+	readPaymentsScope  = "payments:read"
+)
+
+var grpcMethodScopes = map[string]string{
+	paymentsv1.PaymentEventsService_WatchPayments_FullMethodName: watchPaymentsScope,
+	paymentsv1.PaymentsService_GetPayment_FullMethodName:         readPaymentsScope,
+}
+
+// grpcHealthInterval is how often the health service picks up the
+// provider accounts' health.
+const grpcHealthInterval = 5 * time.Second
+
+var grpcWatchers = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "payment_service_grpc_payment_watchers",
+	Help: "WatchPayments streams currently open.",
+})
+
+// newGRPCServer builds the gRPC API for internal consumers. Calls carry an
+// API key or OAuth2 access token with the method's scope, or the
+// bootstrap token, as "authorization: Bearer <key>" metadata, and count
+// against the key's quota once per call. Keepalive pings stand in for the
+// REST streams' heartbeats on idle connections. The standard health
+// service reports SERVING while the provider accounts are healthy, and
+// reflection lets grpcurl and the like list the API without the .proto
+// files.
+func newGRPCServer(hub *EventHub, store *Store, payments *PaymentCache, ph *ProviderHealth, bootstrapToken string) *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(grpcUnaryAuth(store, bootstrapToken)),
+		grpc.StreamInterceptor(grpcStreamAuth(store, bootstrapToken)),
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: streamHeartbeat}),
+	)
+	paymentsv1.RegisterPaymentEventsServiceServer(srv, &paymentEventsServer{hub: hub})
+	paymentsv1.RegisterPaymentsServiceServer(srv, &paymentsServer{payments: payments})
+
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go reportGRPCHealth(hs, ph)
+	reflection.Register(srv)
+	return srv
+}
+
+// serveGRPC runs srv on addr until it is stopped.
+func serveGRPC(addr string, srv *grpc.Server) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("gRPC: %v", err)
+	}
+	log.Printf("gRPC API listening on %s", addr)
+	if err := srv.Serve(ln); err != nil {
+		log.Printf("gRPC: %v", err)
+	}
+}
+
+// reportGRPCHealth keeps the overall health status in step with the
+// provider accounts', as /readyz does for HTTP.
+func reportGRPCHealth(hs *health.Server, ph *ProviderHealth) {
+	for {
+		serving := healthpb.HealthCheckResponse_SERVING
+		if _, ok := ph.Status(); !ok {
+			serving = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		hs.SetServingStatus("", serving)
+		time.Sleep(grpcHealthInterval)
+	}
+}
+
+// grpcUnaryAuth is requireScope for unary calls.
+func grpcUnaryAuth(store *Store, bootstrapToken string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := grpcAuthorize(ctx, store, bootstrapToken, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// grpcStreamAuth is requireScope for streaming calls.
+func grpcStreamAuth(store *Store, bootstrapToken string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := grpcAuthorize(ss.Context(), store, bootstrapToken, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func grpcAuthorize(ctx context.Context, store *Store, bootstrapToken, method string) error {
+	scope, ok := grpcMethodScopes[method]
+	if !ok {
+		return nil
+	}
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		token = strings.TrimPrefix(md.Get("authorization")[0], "Bearer ")
+	}
+	if token == "" {
+		return status.Error(codes.Unauthenticated, "Missing API key")
+	}
+	if bootstrapToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(bootstrapToken)) == 1 {
+		return nil
+	}
+	var key *APIKey
+	var err error
+	switch {
+	case oauth2Verifier != nil && isJWT(token):
+		if key, err = oauth2Verifier.Authenticate(ctx, token); err != nil {
+			logf(ctx, "OAuth2: rejected token: %v", err)
+			return status.Error(codes.Unauthenticated, "Invalid access token")
+		}
+	case store == nil:
+		return status.Error(codes.Unauthenticated, "Invalid API key")
+	default:
+		key, err = store.AuthenticateAPIKey(ctx, token)
+		if errors.Is(err, sql.ErrNoRows) {
+			return status.Error(codes.Unauthenticated, "Invalid API key")
+		}
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	if !key.HasScope(scope) {
+		return status.Error(codes.PermissionDenied, "API key lacks scope "+scope)
+	}
+	if apiKeyQuotas != nil {
+		if _, ok := apiKeyQuotas.take(ctx, key, time.Now()); !ok {
+			apiKeyRequests.WithLabelValues(key.ID, "throttled").Inc()
+			return status.Error(codes.ResourceExhausted, "API key "+key.Name+" is over its request quota")
+		}
+		apiKeyRequests.WithLabelValues(key.ID, "allowed").Inc()
+	}
+	return nil
+}
+
+// grpcStatusCodes maps the HTTP statuses of the error taxonomy onto gRPC
+// codes; anything else is Internal.
+var grpcStatusCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnprocessableEntity: codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.FailedPrecondition,
+	http.StatusPaymentRequired:     codes.FailedPrecondition,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusMisdirectedRequest:  codes.FailedPrecondition,
+	http.StatusBadGateway:          codes.Unavailable,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+}
+
+// grpcError is respondError for gRPC: the taxonomy's code goes along as
+// the status message's prefix.
+func grpcError(err error) error {
+	code, msg := classifyError(err)
+	c, ok := grpcStatusCodes[codeStatus[code]]
+	if !ok {
+		c = codes.Internal
+	}
+	return status.Error(c, string(code)+": "+msg)
+}
+
+// paymentsServer answers payment lookups from the REST API's cache.
+type paymentsServer struct {
+	paymentsv1.UnimplementedPaymentsServiceServer
+	payments *PaymentCache
+}
+
+func (s *paymentsServer) GetPayment(ctx context.Context, req *paymentsv1.GetPaymentRequest) (*paymentsv1.GetPaymentResponse, error) {
+	if req.GetPaymentId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "payment_id is required")
+	}
+	e, err := s.payments.get(ctx, req.GetPaymentId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &paymentsv1.GetPaymentResponse{Payment: paymentProto(e.pi)}, nil
+}
+
+func paymentProto(pi *stripe.PaymentIntent) *paymentsv1.Payment {
+	p := paymentData(pi, false)
+	return &paymentsv1.Payment{
+		Id:               p.ID,
+		Status:           p.Status,
+		Amount:           p.Amount,
+		Currency:         p.Currency,
+		CustomerId:       p.CustomerID,
+		OrderId:          p.OrderID,
+		TenantId:         p.TenantID,
+		Description:      p.Description,
+		CreatedAt:        timestamppb.New(time.Unix(pi.Created, 0)),
+		Subtotal:         p.Subtotal,
+		Tip:              p.Tip,
+		Surcharge:        p.Surcharge,
+		AmountCapturable: p.AmountCapturable,
+		DuplicateOf:      p.DuplicateOf,
+		Region:           p.Region,
+	}
+}
+
+// paymentEventsServer streams the event hub's payment events.
+type paymentEventsServer struct {
+	paymentsv1.UnimplementedPaymentEventsServiceServer
+	hub *EventHub
+}
+
+// WatchPayments sends the events matching req as they are published. A
+// payment ID subscribes to that payment alone; tenant and customer
+// filter all payments' events.
+func (s *paymentEventsServer) WatchPayments(req *paymentsv1.WatchPaymentsRequest, stream paymentsv1.PaymentEventsService_WatchPaymentsServer) error {
+	events, unsubscribe := s.hub.Subscribe(req.GetPaymentId())
+	defer unsubscribe()
+	grpcWatchers.Inc()
+	defer grpcWatchers.Dec()
+
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if !watchMatches(req, ev) {
+				continue
+			}
+			if err := stream.Send(&paymentsv1.WatchPaymentsResponse{Event: paymentEventProto(ev)}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func watchMatches(req *paymentsv1.WatchPaymentsRequest, ev PaymentEvent) bool {
+	return (req.GetTenantId() == "" || req.GetTenantId() == ev.TenantID) &&
+		(req.GetCustomerId() == "" || req.GetCustomerId() == ev.CustomerID)
+}
+
+func paymentEventProto(ev PaymentEvent) *paymentsv1.PaymentEvent {
+	return &paymentsv1.PaymentEvent{
+		PaymentId:  ev.PaymentID,
+		TenantId:   ev.TenantID,
+		CustomerId: ev.CustomerID,
+		Type:       ev.Type,
+		Status:     ev.Status,
+		Amount:     ev.Amount,
+		Currency:   ev.Currency,
+		CreatedAt:  timestamppb.New(ev.CreatedAt),
+		RequestId:  ev.RequestID,
+		Region:     ev.Region,
+	}
+}
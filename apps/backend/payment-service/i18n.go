@@ -0,0 +1,97 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/language"
+)
+
+// Customer-facing error copy lives in locales/<lang>.json, keyed by error
+// code and, for declines, by the card network's decline code, along with
+// the labels printed on receipt and invoice PDFs. English is the fallback
+// for anything missing from a translation.
+//
+//go:embed locales/*.json
+var localeFS embed.FS
+
+type messageCatalog struct {
+	Errors   map[ErrorCode]string `json:"errors"`
+	Declines map[string]string    `json:"declines"`
+	// Documents are receipt and invoice labels, keyed by field.
+	Documents map[string]string `json:"documents"`
+}
+
+var (
+	catalogs           = map[language.Tag]messageCatalog{}
+	supportedLanguages []language.Tag
+	languageMatcher    language.Matcher
+)
+
+func init() {
+	entries, err := localeFS.ReadDir("locales")
+	if err != nil {
+		log.Fatalf("reading locales: %v", err)
+	}
+
+	// English goes first so the matcher falls back to it.
+	supportedLanguages = []language.Tag{language.English}
+	for _, e := range entries {
+		raw, err := localeFS.ReadFile(path.Join("locales", e.Name()))
+		if err != nil {
+			log.Fatalf("reading locale %s: %v", e.Name(), err)
+		}
+		var cat messageCatalog
+		if err := json.Unmarshal(raw, &cat); err != nil {
+			log.Fatalf("parsing locale %s: %v", e.Name(), err)
+		}
+		tag := language.Make(strings.TrimSuffix(e.Name(), ".json"))
+		catalogs[tag] = cat
+		if tag != language.English {
+			supportedLanguages = append(supportedLanguages, tag)
+		}
+	}
+	languageMatcher = language.NewMatcher(supportedLanguages)
+}
+
+// requestLanguage picks the best supported language for Accept-Language.
+func requestLanguage(c *gin.Context) language.Tag {
+	prefs, _, _ := language.ParseAcceptLanguage(c.GetHeader("Accept-Language"))
+	_, idx, _ := languageMatcher.Match(prefs...)
+	return supportedLanguages[idx]
+}
+
+// userMessage returns customer-safe copy for code in lang. A known decline
+// code refines a generic card decline.
+func userMessage(lang language.Tag, code ErrorCode, decline string) string {
+	lookup := func(cat messageCatalog) string {
+		if decline != "" {
+			if msg, ok := cat.Declines[decline]; ok {
+				return msg
+			}
+		}
+		return cat.Errors[code]
+	}
+	if msg := lookup(catalogs[lang]); msg != "" {
+		return msg
+	}
+	if msg := lookup(catalogs[language.English]); msg != "" {
+		return msg
+	}
+	return catalogs[language.English].Errors[CodeInternal]
+}
+
+// documentLabel returns the receipt or invoice label key in lang.
+func documentLabel(lang language.Tag, key string) string {
+	if label := catalogs[lang].Documents[key]; label != "" {
+		return label
+	}
+	if label := catalogs[language.English].Documents[key]; label != "" {
+		return label
+	}
+	return key
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/form"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+var (
+	inflightMutations = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "payment_service_inflight_provider_mutations",
+		Help: "Payment and refund calls to the provider currently in flight.",
+	})
+	unconfirmedOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_unconfirmed_operations_total",
+		Help: "Provider mutations cut off by shutdown, by outcome (recorded, resolved, unresolved).",
+	}, []string{"outcome"})
+)
+
+// errDraining refuses provider mutations once shutdown has begun; the
+// callers' retries, bulk refund batches and the like, pick them up on
+// another instance.
+var errDraining = errors.New("shutting down, not starting new payment provider calls")
+
+// Unconfirmed operation statuses.
+const (
+	unconfirmedPending    = "pending"
+	unconfirmedResolved   = "resolved"
+	unconfirmedUnresolved = "unresolved"
+)
+
+// inflightOp is a payment or refund call to the provider that hasn't
+// answered yet, with what identifies what it was doing.
+type inflightOp struct {
+	Operation      string
+	PaymentID      string
+	OrderID        string
+	TenantID       string
+	IdempotencyKey string
+	StartedAt      time.Time
+}
+
+// trackedMutation reports whether a call moves money or payment state:
+// creating, confirming, capturing or canceling a payment, or a refund.
+func trackedMutation(method, path string) bool {
+	if method != http.MethodPost {
+		return false
+	}
+	return path == "/v1/refunds" || path == "/v1/payment_intents" ||
+		(strings.HasPrefix(path, "/v1/payment_intents/pi_") && !strings.HasPrefix(path, "/v1/payment_intents/search"))
+}
+
+// inflightOpOf describes a tracked call from its path and params.
+func inflightOpOf(method, path string, params stripe.ParamsContainer) *inflightOp {
+	op, _ := stripeOperation(method, path)
+	o := &inflightOp{Operation: op, StartedAt: time.Now().UTC()}
+	if parts := strings.Split(strings.TrimPrefix(path, "/v1/"), "/"); len(parts) > 1 && parts[0] == "payment_intents" {
+		o.PaymentID = parts[1]
+	}
+	if rp, ok := params.(*stripe.RefundParams); ok && rp != nil && rp.PaymentIntent != nil {
+		o.PaymentID = *rp.PaymentIntent
+	}
+	if p := paramsOf(params); p != nil {
+		o.OrderID, o.TenantID = p.Metadata["order_id"], p.Metadata["tenant_id"]
+		if p.IdempotencyKey != nil {
+			o.IdempotencyKey = *p.IdempotencyKey
+		}
+	}
+	return o
+}
+
+// InflightOps keeps a registry of the payment and refund calls in flight
+// to the provider, whoever made them: handlers, async jobs, bulk refunds
+// or retries. On shutdown, once the HTTP server has stopped, Drain
+// refuses new ones and waits for these to answer; those still without an
+// answer when the grace period ends are stored as unconfirmed, since the
+// provider may or may not have acted on them, and Resolve settles them
+// against the provider on the next start.
+type InflightOps struct {
+	stripe.Backend
+
+	mu       sync.Mutex
+	ops      map[*inflightOp]struct{}
+	draining bool
+	idle     chan struct{}
+}
+
+// installInflightTracking wraps the installed API backend.
+func installInflightTracking() *InflightOps {
+	t := &InflightOps{Backend: stripe.GetBackend(stripe.APIBackend), ops: map[*inflightOp]struct{}{}}
+	stripe.SetBackend(stripe.APIBackend, t)
+	return t
+}
+
+func (t *InflightOps) track(method, path string, params stripe.ParamsContainer, call func() error) error {
+	if !trackedMutation(method, path) {
+		return call()
+	}
+	op := inflightOpOf(method, path, params)
+	t.mu.Lock()
+	if t.draining {
+		t.mu.Unlock()
+		return errDraining
+	}
+	t.ops[op] = struct{}{}
+	t.mu.Unlock()
+	inflightMutations.Inc()
+
+	defer func() {
+		inflightMutations.Dec()
+		t.mu.Lock()
+		delete(t.ops, op)
+		if len(t.ops) == 0 && t.idle != nil {
+			close(t.idle)
+			t.idle = nil
+		}
+		t.mu.Unlock()
+	}()
+	return call()
+}
+
+func (t *InflightOps) Call(method, path, key string, params stripe.ParamsContainer, v stripe.LastResponseSetter) error {
+	return t.track(method, path, params, func() error {
+		return t.Backend.Call(method, path, key, params, v)
+	})
+}
+
+func (t *InflightOps) CallRaw(method, path, key string, body *form.Values, params *stripe.Params, v stripe.LastResponseSetter) error {
+	return t.track(method, path, params, func() error {
+		return t.Backend.CallRaw(method, path, key, body, params, v)
+	})
+}
+
+func (t *InflightOps) CallMultipart(method, path, key, boundary string, body *bytes.Buffer, params *stripe.Params, v stripe.LastResponseSetter) error {
+	return t.track(method, path, params, func() error {
+		return t.Backend.CallMultipart(method, path, key, boundary, body, params, v)
+	})
+}
+
+// Drain stops new payment and refund calls and waits for those in flight
+// until ctx is done. The ones still in flight then are stored as
+// unconfirmed, or logged without a store.
+func (t *InflightOps) Drain(ctx context.Context, store *Store) {
+	t.mu.Lock()
+	t.draining = true
+	var idle chan struct{}
+	if len(t.ops) > 0 {
+		idle = make(chan struct{})
+		t.idle = idle
+		log.Printf("Shutdown: waiting for %d payment provider call(s) in flight", len(t.ops))
+	}
+	t.mu.Unlock()
+	if idle == nil {
+		return
+	}
+
+	select {
+	case <-idle:
+		log.Println("Shutdown: payment provider calls finished")
+		return
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	left := make([]*inflightOp, 0, len(t.ops))
+	for op := range t.ops {
+		left = append(left, op)
+	}
+	t.mu.Unlock()
+	// The grace period is spent; give the writes a moment of their own.
+	wctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, op := range left {
+		log.Printf("Shutdown: %s of payment %q order %q (idempotency key %q) cut off, outcome unknown",
+			op.Operation, op.PaymentID, op.OrderID, op.IdempotencyKey)
+		if store == nil {
+			continue
+		}
+		if err := store.AddUnconfirmedOperation(wctx, op); err != nil {
+			log.Printf("Shutdown: recording unconfirmed %s: %v", op.Operation, err)
+			continue
+		}
+		unconfirmedOperations.WithLabelValues("recorded").Inc()
+	}
+}
+
+// UnconfirmedOperation is a provider mutation cut off by a shutdown, and
+// what became of it.
+type UnconfirmedOperation struct {
+	ID             string     `json:"id"`
+	Operation      string     `json:"operation"`
+	PaymentID      string     `json:"payment_id,omitempty"`
+	OrderID        string     `json:"order_id,omitempty"`
+	TenantID       string     `json:"tenant_id,omitempty"`
+	IdempotencyKey string     `json:"idempotency_key,omitempty"`
+	Status         string     `json:"status"`
+	Resolution     string     `json:"resolution,omitempty"`
+	StartedAt      time.Time  `json:"started_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+}
+
+var unconfirmedOperationList = listResource{
+	from: "unconfirmed_operations",
+	fields: []string{"id", "operation", "payment_id", "order_id", "tenant_id", "idempotency_key", "status",
+		"resolution", "started_at", "created_at", "resolved_at"},
+	columns: map[string]listField{
+		"id":              {"id", textField},
+		"operation":       {"operation", textField},
+		"payment_id":      {"payment_id", textField},
+		"order_id":        {"order_id", textField},
+		"tenant_id":       {"tenant_id", textField},
+		"idempotency_key": {"idempotency_key", textField},
+		"status":          {"status", textField},
+		"resolution":      {"resolution", textField},
+		"started_at":      {"started_at", timeField},
+		"created_at":      {"created_at", timeField},
+		"resolved_at":     {"resolved_at", timeField},
+	},
+}
+
+func (s *Store) AddUnconfirmedOperation(ctx context.Context, op *inflightOp) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO unconfirmed_operations (id, operation, payment_id, order_id, tenant_id, idempotency_key, started_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		"uop_"+strings.ReplaceAll(uuid.NewString(), "-", ""), op.Operation, op.PaymentID, op.OrderID, op.TenantID,
+		op.IdempotencyKey, op.StartedAt)
+	return err
+}
+
+// PendingUnconfirmedOperations lists the operations not yet looked into,
+// oldest first.
+func (s *Store) PendingUnconfirmedOperations(ctx context.Context) ([]UnconfirmedOperation, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, operation, payment_id, order_id, tenant_id, idempotency_key, status, resolution, started_at, created_at
+		FROM unconfirmed_operations WHERE status = 'pending' ORDER BY started_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []UnconfirmedOperation
+	for rows.Next() {
+		var op UnconfirmedOperation
+		if err := rows.Scan(&op.ID, &op.Operation, &op.PaymentID, &op.OrderID, &op.TenantID, &op.IdempotencyKey,
+			&op.Status, &op.Resolution, &op.StartedAt, &op.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, op)
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) SettleUnconfirmedOperation(ctx context.Context, id, status, resolution string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE unconfirmed_operations SET status = $2, resolution = $3, resolved_at = now() WHERE id = $1`,
+		id, status, resolution)
+	return err
+}
+
+// ResolveUnconfirmed settles the operations earlier shutdowns cut off.
+// Each payment involved is fetched from the provider and brought up to
+// date as a resync would: events the service missed are replayed and
+// the provider's copy saved. A payment creation cut off before Stripe
+// returned an ID is looked for by its order; without one it is left
+// unresolved for an operator, who can find it in the list. Provider
+// errors leave the operation pending for the next start.
+func ResolveUnconfirmed(ctx context.Context, store *Store, webhooks *WebhookHandler) {
+	ops, err := store.PendingUnconfirmedOperations(ctx)
+	if err != nil {
+		log.Printf("unconfirmed operations: %v", err)
+		return
+	}
+	for _, op := range ops {
+		status, resolution, err := resolveUnconfirmed(ctx, webhooks, op)
+		if err != nil {
+			log.Printf("unconfirmed operations: %s %s: %v", op.ID, op.Operation, err)
+			continue
+		}
+		if err := store.SettleUnconfirmedOperation(ctx, op.ID, status, resolution); err != nil {
+			log.Printf("unconfirmed operations: %s: %v", op.ID, err)
+			continue
+		}
+		unconfirmedOperations.WithLabelValues(status).Inc()
+		log.Printf("unconfirmed operations: %s %s %s: %s", op.ID, op.Operation, status, resolution)
+	}
+}
+
+func resolveUnconfirmed(ctx context.Context, webhooks *WebhookHandler, op UnconfirmedOperation) (string, string, error) {
+	ids := []string{}
+	switch {
+	case op.PaymentID != "":
+		ids = append(ids, op.PaymentID)
+	case op.OrderID != "":
+		query := fmt.Sprintf("metadata['order_id']:'%s'", strings.ReplaceAll(op.OrderID, "'", "\\'"))
+		it := paymentintent.Search(&stripe.PaymentIntentSearchParams{
+			SearchParams: stripe.SearchParams{Query: query, Context: ctx},
+		})
+		for it.Next() {
+			if pi := it.PaymentIntent(); time.Unix(pi.Created, 0).After(op.StartedAt.Add(-time.Minute)) {
+				ids = append(ids, pi.ID)
+			}
+		}
+		if err := it.Err(); err != nil {
+			return "", "", err
+		}
+		if len(ids) == 0 {
+			return unconfirmedResolved, "no payment was created for order " + op.OrderID, nil
+		}
+	default:
+		return unconfirmedUnresolved, "nothing identifies the payment; check the provider for the idempotency key", nil
+	}
+
+	for _, id := range ids {
+		if err := repairPayment(ctx, webhooks, id); err != nil {
+			return "", "", fmt.Errorf("payment %s: %w", id, err)
+		}
+	}
+	return unconfirmedResolved, "synced payment " + strings.Join(ids, ", ") + " from the provider", nil
+}
+
+// repairPayment is a resync of payment id without a report: missed
+// events are replayed and the provider's copy saved.
+func repairPayment(ctx context.Context, webhooks *WebhookHandler, id string) error {
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	params.AddExpand("latest_charge.refunds")
+	params.AddExpand("payment_method")
+	pi, err := paymentintent.Get(id, params)
+	if err != nil {
+		return err
+	}
+	local, err := webhooks.Payments.PaymentState(ctx, pi.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		local, err = &paymentState{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	events, err := missedEvents(local, pi)
+	if err != nil {
+		return err
+	}
+	for _, ev := range events {
+		if err := webhooks.dispatch(ctx, ev); err != nil {
+			return fmt.Errorf("replaying %s: %w", ev.Type, err)
+		}
+	}
+	if err := webhooks.Payments.SavePayment(ctx, pi); err != nil {
+		return err
+	}
+	if pi.LatestCharge != nil && pi.LatestCharge.PaymentIntent != nil {
+		return webhooks.Payments.SaveCharge(ctx, pi.LatestCharge)
+	}
+	return nil
+}
+
+func registerUnconfirmedRoutes(r *gin.Engine, store *Store, bootstrapToken string) {
+	r.GET("/admin/unconfirmed-operations", requireScope(store, bootstrapToken, "admin"),
+		listHandler(store, unconfirmedOperationList))
+}
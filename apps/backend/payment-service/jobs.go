@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/text/language"
+)
+
+// PaymentJob tracks a payment created with ?async=true.
+type PaymentJob struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // pending, running, succeeded or failed
+	// Payment is set once the intent exists.
+	Payment *Payment `json:"payment,omitempty"`
+	// Error is the problem document the synchronous call would have
+	// returned.
+	Error       gin.H     `json:"error,omitempty"`
+	CallbackURL string    `json:"callback_url,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	req            PaymentRequest
+	params         *PaymentParams
+	idempotencyKey string
+	lang           language.Tag
+}
+
+// JobQueue runs async payments on a fixed pool of workers, so a slow
+// provider ties up workers here rather than the caller's threads. Jobs are
+// kept in memory for ttl; a restart loses queued jobs, though any intent
+// already created is still reported by webhooks and GET /payment/:id.
+type JobQueue struct {
+	payments       *PaymentService
+	ttl            time.Duration
+	callbackSecret []byte
+	callbacks      *http.Client
+
+	queue chan *PaymentJob
+	wg    sync.WaitGroup
+
+	mu     sync.Mutex
+	jobs   map[string]*PaymentJob
+	byKey  map[string]string
+	closed bool
+}
+
+func NewJobQueue(payments *PaymentService, workers, depth int, ttl time.Duration, callbackSecret string) *JobQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := &JobQueue{
+		payments:       payments,
+		ttl:            ttl,
+		callbackSecret: []byte(callbackSecret),
+		callbacks:      newEgressClient(10 * time.Second),
+		queue:          make(chan *PaymentJob, depth),
+		jobs:           map[string]*PaymentJob{},
+		byKey:          map[string]string{},
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	go q.janitor()
+	return q
+}
+
+// errQueueFull means the caller should back off and retry.
+var errQueueFull = fmt.Errorf("job queue is full")
+
+// Submit queues a payment. A repeated Idempotency-Key returns the job
+// already queued for it instead of a new one.
+func (q *JobQueue) Submit(req PaymentRequest, params *PaymentParams, idempotencyKey, callbackURL string, lang language.Tag) (PaymentJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return PaymentJob{}, errQueueFull
+	}
+	if id, ok := q.byKey[idempotencyKey]; ok && idempotencyKey != "" {
+		if job, ok := q.jobs[id]; ok {
+			return *job, nil
+		}
+	}
+
+	now := time.Now().UTC()
+	job := &PaymentJob{
+		ID:             uuid.NewString(),
+		Status:         "pending",
+		CallbackURL:    callbackURL,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		req:            req,
+		params:         params,
+		idempotencyKey: idempotencyKey,
+		lang:           lang,
+	}
+	if job.idempotencyKey == "" {
+		// The job's own ID keeps a retried Stripe call from charging twice.
+		job.idempotencyKey = "job:" + job.ID
+	}
+	select {
+	case q.queue <- job:
+	default:
+		return PaymentJob{}, errQueueFull
+	}
+	q.jobs[job.ID] = job
+	if idempotencyKey != "" {
+		q.byKey[idempotencyKey] = job.ID
+	}
+	return *job, nil
+}
+
+func (q *JobQueue) Get(id string) (PaymentJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return PaymentJob{}, false
+	}
+	return *job, true
+}
+
+func (q *JobQueue) update(job *PaymentJob, fn func(*PaymentJob)) PaymentJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fn(job)
+	job.UpdatedAt = time.Now().UTC()
+	return *job
+}
+
+func (q *JobQueue) worker() {
+	defer q.wg.Done()
+	for job := range q.queue {
+		q.run(job)
+	}
+}
+
+func (q *JobQueue) run(job *PaymentJob) {
+	q.update(job, func(j *PaymentJob) { j.Status = "running" })
+	ctx := job.params.Context
+
+	pi, err := q.payments.Create(ctx, job.req, job.params, job.idempotencyKey)
+	done := q.update(job, func(j *PaymentJob) {
+		if err != nil {
+			j.Status, j.Error = "failed", providerProblem(j.lang, err)
+			return
+		}
+		p := paymentData(pi, true)
+		j.Status, j.Payment = "succeeded", &p
+	})
+	if err != nil {
+		logf(ctx, "payment job %s: %v", job.ID, err)
+	}
+	if done.CallbackURL != "" {
+		q.callback(ctx, done)
+	}
+}
+
+// callback POSTs the finished job to its callback URL, retrying a few
+// times. With PAYMENT_JOB_CALLBACK_SECRET set the body is signed in
+// X-Signature as hex HMAC-SHA256, so receivers can tell it came from us.
+func (q *JobQueue) callback(ctx context.Context, job PaymentJob) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return
+	}
+	for attempt := 0; attempt < 4; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<attempt) * time.Second)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.CallbackURL, bytes.NewReader(body))
+		if err != nil {
+			logf(ctx, "payment job %s callback: %v", job.ID, err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if id := requestIDFrom(ctx); id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		if len(q.callbackSecret) > 0 {
+			mac := hmac.New(sha256.New, q.callbackSecret)
+			mac.Write(body)
+			req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := q.callbacks.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		logf(ctx, "payment job %s callback attempt %d: %v", job.ID, attempt+1, err)
+	}
+}
+
+// Shutdown stops taking jobs and waits for queued ones to finish, or for
+// ctx to end.
+func (q *JobQueue) Shutdown(ctx context.Context) {
+	q.mu.Lock()
+	q.closed = true
+	close(q.queue)
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() { q.wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Payment jobs still running at shutdown: %d queued", len(q.queue))
+	}
+}
+
+// janitor forgets finished jobs after ttl.
+func (q *JobQueue) janitor() {
+	for range time.Tick(time.Minute) {
+		q.mu.Lock()
+		for id, job := range q.jobs {
+			finished := job.Status == "succeeded" || job.Status == "failed"
+			if finished && time.Since(job.UpdatedAt) > q.ttl {
+				delete(q.jobs, id)
+				if q.byKey[job.idempotencyKey] == id {
+					delete(q.byKey, job.idempotencyKey)
+				}
+			}
+		}
+		q.mu.Unlock()
+	}
+}
+
+// validCallbackURL accepts absolute http(s) URLs only. Where they may
+// point is resolvesPublic's to check.
+func validCallbackURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// RegisterRoutes mounts the job status endpoint.
+func (q *JobQueue) RegisterRoutes(r *gin.Engine) {
+	r.GET("/jobs/:id", func(c *gin.Context) {
+		job, ok := q.Get(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Job not found"))
+			return
+		}
+		respondData(c, http.StatusOK, job)
+	})
+}
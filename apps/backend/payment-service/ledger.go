@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// LedgerEntry moves amount into account; entries of one transaction sum
+// to zero, so what one account gains another has given up. Accounts are
+// named by what they hold:
+//
+//	wallet:<id>              a customer's stored balance
+//	giftcard:<id>            a gift card's remaining value
+//	giftcards:issued         value put on gift cards and taken off by voids
+//	escrow:<id>              a seller's share of a marketplace payment, held
+//	connect:transfers        money paid out to connected accounts
+//	seller:<account>         a connected account's balance, less what is held
+//	reserve:<account>        the part of it held back from payouts
+//	stripe:clearing          money collected through Stripe
+//	sales[:<tenant>]         value spent at checkout
+//	promotions:store_credit  credit granted without a payment
+type LedgerEntry struct {
+	Account string `json:"account"`
+	Amount  int64  `json:"amount"`
+}
+
+const (
+	ledgerStripeClearing   = "stripe:clearing"
+	ledgerStoreCredit      = "promotions:store_credit"
+	ledgerGiftCardsIssued  = "giftcards:issued"
+	ledgerConnectTransfers = "connect:transfers"
+)
+
+func walletAccount(id string) string { return "wallet:" + id }
+
+func giftCardAccount(id string) string { return "giftcard:" + id }
+
+func salesAccount(tenantID string) string {
+	if tenantID == "" {
+		return "sales"
+	}
+	return "sales:" + tenantID
+}
+
+// postLedger records a balanced transaction inside tx and returns its ID.
+// reference ties it to what caused it, such as a payment or wallet
+// transaction.
+func postLedger(ctx context.Context, tx *sql.Tx, kind, reference, currency string, entries ...LedgerEntry) (string, error) {
+	var sum int64
+	for _, e := range entries {
+		sum += e.Amount
+	}
+	if len(entries) < 2 || sum != 0 {
+		return "", fmt.Errorf("unbalanced ledger transaction %s: %d entries summing to %d", kind, len(entries), sum)
+	}
+
+	id := uuid.NewString()
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO ledger_transactions (id, kind, reference, currency) VALUES ($1, $2, $3, $4)`,
+		id, kind, reference, currency); err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO ledger_entries (transaction_id, account, amount) VALUES ($1, $2, $3)`,
+			id, e.Account, e.Amount); err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
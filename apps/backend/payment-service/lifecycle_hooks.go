@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+)
+
+var (
+	lifecycleHookRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_lifecycle_hook_runs_total",
+		Help: "Lifecycle hook runs, by hook, point and outcome (allowed, vetoed, failed).",
+	}, []string{"hook", "point", "outcome"})
+	lifecycleHookDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "payment_service_lifecycle_hook_duration_seconds",
+		Help:    "Time a lifecycle hook took, by hook.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"hook"})
+)
+
+// Lifecycle hook points. The pre_ points run before the operation and may
+// veto it or add metadata to it; the post_ points run after it, in the
+// background, for side effects.
+const (
+	hookPreCreate   = "pre_create"
+	hookPostCreate  = "post_create"
+	hookPreCapture  = "pre_capture"
+	hookPostSuccess = "post_success"
+	hookPostRefund  = "post_refund"
+)
+
+var hookPoints = map[string]bool{
+	hookPreCreate: true, hookPostCreate: true, hookPreCapture: true, hookPostSuccess: true, hookPostRefund: true,
+}
+
+const (
+	defaultHookTimeout = 2 * time.Second
+	hookResponseMax    = 65536
+)
+
+// HookPayment is what a hook is shown of the payment. ID is empty before
+// creation.
+type HookPayment struct {
+	ID             string            `json:"id,omitempty"`
+	TenantID       string            `json:"tenant_id,omitempty"`
+	OrderID        string            `json:"order_id,omitempty"`
+	CustomerID     string            `json:"customer_id,omitempty"`
+	Amount         int64             `json:"amount"`
+	AmountRefunded int64             `json:"amount_refunded,omitempty"`
+	Currency       string            `json:"currency"`
+	Status         string            `json:"status,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+}
+
+func hookPaymentOf(pi *stripe.PaymentIntent) *HookPayment {
+	p := &HookPayment{
+		ID:       pi.ID,
+		TenantID: pi.Metadata["tenant_id"],
+		OrderID:  pi.Metadata["order_id"],
+		Amount:   pi.Amount,
+		Currency: string(pi.Currency),
+		Status:   paymentStatus(pi),
+		Metadata: maps.Clone(pi.Metadata),
+	}
+	if pi.Customer != nil {
+		p.CustomerID = pi.Customer.ID
+	}
+	return p
+}
+
+// hookPaymentOfCharge describes ch's payment, which Stripe gives the
+// intent's metadata.
+func hookPaymentOfCharge(ch *stripe.Charge) *HookPayment {
+	p := &HookPayment{
+		ID:             ch.PaymentIntent.ID,
+		TenantID:       ch.Metadata["tenant_id"],
+		OrderID:        ch.Metadata["order_id"],
+		Amount:         ch.Amount,
+		AmountRefunded: ch.AmountRefunded,
+		Currency:       string(ch.Currency),
+		Status:         string(ch.Status),
+		Metadata:       maps.Clone(ch.Metadata),
+	}
+	if ch.Customer != nil {
+		p.CustomerID = ch.Customer.ID
+	}
+	return p
+}
+
+// HookResult is a hook's answer. Veto refuses the operation, with Reason
+// shown to the caller; Metadata is added to the payment. Post hooks'
+// answers are ignored.
+type HookResult struct {
+	Veto     bool              `json:"veto"`
+	Reason   string            `json:"reason,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// LifecyclePlugin is custom payment logic compiled into the service. A
+// deployment or fork adds its own in a file of its own, registering it
+// from init with RegisterLifecyclePlugin, and turns it on, for the points
+// and tenants it wants, in the lifecycle_hooks config.
+type LifecyclePlugin interface {
+	Run(ctx context.Context, point string, p *HookPayment) (*HookResult, error)
+}
+
+// LifecyclePluginFunc adapts a function to a LifecyclePlugin.
+type LifecyclePluginFunc func(ctx context.Context, point string, p *HookPayment) (*HookResult, error)
+
+func (f LifecyclePluginFunc) Run(ctx context.Context, point string, p *HookPayment) (*HookResult, error) {
+	return f(ctx, point, p)
+}
+
+var lifecyclePlugins = map[string]LifecyclePlugin{}
+
+// RegisterLifecyclePlugin makes plugin available to the config as name.
+// Call it from init.
+func RegisterLifecyclePlugin(name string, plugin LifecyclePlugin) {
+	if _, dup := lifecyclePlugins[name]; dup {
+		panic("lifecycle plugin registered twice: " + name)
+	}
+	lifecyclePlugins[name] = plugin
+}
+
+// LifecycleHook runs a compiled-in plugin, or POSTs to url, at points,
+// for tenants (empty is every tenant). A hook that fails or times out
+// (timeout_ms, 0 means 2000) refuses a pre_ operation unless fail_open is
+// set.
+type LifecycleHook struct {
+	Name      string   `json:"name"`
+	Plugin    string   `json:"plugin"`
+	URL       string   `json:"url"`
+	Points    []string `json:"points"`
+	Tenants   []string `json:"tenants"`
+	TimeoutMS int      `json:"timeout_ms"`
+	FailOpen  bool     `json:"fail_open"`
+}
+
+// LifecycleHookConfig lists the hooks, which run in order at each point;
+// the first veto stops the rest.
+//
+//	"lifecycle_hooks": {"hooks": [
+//	  {"name": "erp", "url": "https://erp.internal/payment-hooks", "points": ["pre_create", "post_success"],
+//	   "tenants": ["acme"], "timeout_ms": 1500},
+//	  {"name": "bonus", "plugin": "loyalty_bonus", "points": ["post_refund"], "fail_open": true}]}
+type LifecycleHookConfig struct {
+	Hooks []LifecycleHook `json:"hooks"`
+}
+
+func (cfg LifecycleHookConfig) validate() error {
+	names := map[string]bool{}
+	for i, h := range cfg.Hooks {
+		if h.Name == "" {
+			return fmt.Errorf("lifecycle_hooks: hook %d needs a name", i)
+		}
+		if names[h.Name] {
+			return fmt.Errorf("lifecycle_hooks: %q is listed twice", h.Name)
+		}
+		names[h.Name] = true
+		if (h.Plugin == "") == (h.URL == "") {
+			return fmt.Errorf("lifecycle_hooks: %q needs exactly one of plugin and url", h.Name)
+		}
+		if _, ok := lifecyclePlugins[h.Plugin]; h.Plugin != "" && !ok {
+			return fmt.Errorf("lifecycle_hooks: %q: no plugin %q is compiled in", h.Name, h.Plugin)
+		}
+		if len(h.Points) == 0 {
+			return fmt.Errorf("lifecycle_hooks: %q needs points", h.Name)
+		}
+		for _, p := range h.Points {
+			if !hookPoints[p] {
+				return fmt.Errorf("lifecycle_hooks: %q: unknown point %q", h.Name, p)
+			}
+		}
+		if h.TimeoutMS < 0 {
+			return fmt.Errorf("lifecycle_hooks: %q: timeout_ms must not be negative", h.Name)
+		}
+	}
+	return nil
+}
+
+func (h LifecycleHook) applies(point, tenant string) bool {
+	if !containsString(h.Points, point) {
+		return false
+	}
+	return len(h.Tenants) == 0 || containsString(h.Tenants, tenant)
+}
+
+func (h LifecycleHook) timeout() time.Duration {
+	if h.TimeoutMS == 0 {
+		return defaultHookTimeout
+	}
+	return time.Duration(h.TimeoutMS) * time.Millisecond
+}
+
+// LifecycleHooks runs the configured hooks, so custom logic for a tenant
+// or deployment lives beside mainline instead of in a fork of it: before
+// a payment is created or captured, where it may veto the operation or
+// add metadata, and after a payment is created, succeeds or is refunded.
+// HTTP hooks get the point and payment as JSON, signed in X-Signature as
+// hex HMAC-SHA256 when a secret is set, and answer a HookResult, or
+// nothing, with a 2xx. A hook may add metadata keys but not change those
+// the payment it was shown already has.
+type LifecycleHooks struct {
+	settings *RuntimeSettings
+	secret   []byte
+	http     *http.Client
+}
+
+// lifecycleHooks is shared by the payment paths that run hooks; nil runs
+// none.
+var lifecycleHooks *LifecycleHooks
+
+func NewLifecycleHooks(settings *RuntimeSettings, secret string) *LifecycleHooks {
+	return &LifecycleHooks{settings: settings, secret: []byte(secret), http: &http.Client{}}
+}
+
+// pre runs point's hooks for p in order, collecting the metadata they
+// add, which later hooks see on p, and refuses on the first veto, or failure of a hook that isn't
+// fail_open.
+func (lh *LifecycleHooks) pre(ctx context.Context, point string, p *HookPayment) (map[string]string, *refusal) {
+	if lh == nil {
+		return nil, nil
+	}
+	var added map[string]string
+	for _, h := range lh.settings.Get().LifecycleHooks.Hooks {
+		if !h.applies(point, p.TenantID) {
+			continue
+		}
+		res, err := lh.run(ctx, h, point, p)
+		switch {
+		case err != nil && h.FailOpen:
+			logf(ctx, "lifecycle hook %s %s: %v; continuing", h.Name, point, err)
+			continue
+		case err != nil:
+			logf(ctx, "lifecycle hook %s %s: %v", h.Name, point, err)
+			return nil, &refusal{http.StatusBadGateway, CodeUpstreamFailed, "Could not run the " + h.Name + " hook", gin.H{"hook": h.Name}}
+		case res == nil:
+			continue
+		case res.Veto:
+			reason := res.Reason
+			if reason == "" {
+				reason = "Refused by the " + h.Name + " hook"
+			}
+			return nil, &refusal{codeStatus[CodePaymentBlocked], CodePaymentBlocked, reason, gin.H{"hook": h.Name}}
+		}
+		for k, v := range res.Metadata {
+			if _, ok := p.Metadata[k]; ok {
+				logf(ctx, "lifecycle hook %s %s: ignoring metadata %q the payment already has", h.Name, point, k)
+				continue
+			}
+			if added == nil {
+				added = map[string]string{}
+			}
+			if p.Metadata == nil {
+				p.Metadata = map[string]string{}
+			}
+			added[k], p.Metadata[k] = v, v
+		}
+	}
+	return added, nil
+}
+
+// post runs point's hooks for p in the background; failures are logged.
+func (lh *LifecycleHooks) post(ctx context.Context, point string, p *HookPayment) {
+	if lh == nil {
+		return
+	}
+	var hooks []LifecycleHook
+	for _, h := range lh.settings.Get().LifecycleHooks.Hooks {
+		if h.applies(point, p.TenantID) {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		for _, h := range hooks {
+			if _, err := lh.run(ctx, h, point, p); err != nil {
+				logf(ctx, "lifecycle hook %s %s for %s: %v", h.Name, point, p.ID, err)
+			}
+		}
+	}()
+}
+
+// preCreate runs the pre_create hooks on params, adding the metadata they
+// return.
+func (lh *LifecycleHooks) preCreate(ctx context.Context, req PaymentRequest, params *stripe.PaymentIntentParams) *refusal {
+	if lh == nil {
+		return nil
+	}
+	p := &HookPayment{
+		TenantID:   req.TenantID,
+		OrderID:    req.OrderID,
+		CustomerID: req.CustomerID,
+		Amount:     stripe.Int64Value(params.Amount),
+		Currency:   stripe.StringValue(params.Currency),
+		Metadata:   maps.Clone(params.Metadata),
+	}
+	added, refused := lh.pre(ctx, hookPreCreate, p)
+	for k, v := range added {
+		params.AddMetadata(k, v)
+	}
+	return refused
+}
+
+// preCapture runs the pre_capture hooks on p, adding the metadata they
+// return to the capture's params.
+func (lh *LifecycleHooks) preCapture(ctx context.Context, p *HookPayment, params *stripe.PaymentIntentCaptureParams) *refusal {
+	added, refused := lh.pre(ctx, hookPreCapture, p)
+	for k, v := range added {
+		params.AddMetadata(k, v)
+	}
+	return refused
+}
+
+func (lh *LifecycleHooks) run(ctx context.Context, h LifecycleHook, point string, p *HookPayment) (*HookResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+	started := time.Now()
+	var res *HookResult
+	var err error
+	if h.Plugin != "" {
+		res, err = lifecyclePlugins[h.Plugin].Run(ctx, point, p)
+	} else {
+		res, err = lh.call(ctx, h, point, p)
+	}
+	lifecycleHookDuration.WithLabelValues(h.Name).Observe(time.Since(started).Seconds())
+	outcome := "allowed"
+	switch {
+	case err != nil:
+		outcome = "failed"
+	case res != nil && res.Veto:
+		outcome = "vetoed"
+	}
+	lifecycleHookRuns.WithLabelValues(h.Name, point, outcome).Inc()
+	return res, err
+}
+
+func (lh *LifecycleHooks) call(ctx context.Context, h LifecycleHook, point string, p *HookPayment) (*HookResult, error) {
+	body, err := json.Marshal(gin.H{"hook": h.Name, "point": point, "payment": p})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	if len(lh.secret) > 0 {
+		mac := hmac.New(sha256.New, lh.secret)
+		mac.Write(body)
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := lh.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, hookResponseMax))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if len(bytes.TrimSpace(answer)) == 0 {
+		return nil, nil
+	}
+	var res HookResult
+	if err := json.Unmarshal(answer, &res); err != nil {
+		return nil, fmt.Errorf("decoding answer: %w", err)
+	}
+	return &res, nil
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The list endpoints share one query syntax:
+//
+//	status=succeeded                     equality
+//	status=succeeded,processing          any of (text and integer fields)
+//	status!=canceled                     inequality
+//	created_at>=2024-01-01&amount<5000   ranges (integer and time fields)
+//	sort=-created_at,amount              ordering, - for descending
+//	fields=id,amount,status              sparse fieldsets
+//	limit=50&offset=100                  paging
+//
+// Filters are ANDed. Times take a date or an RFC 3339 timestamp. With
+// Accept: application/x-ndjson the rows are streamed one per line, and
+// limit is optional and uncapped.
+
+type fieldKind int
+
+const (
+	textField fieldKind = iota
+	intField
+	timeField
+)
+
+type listField struct {
+	expr string
+	kind fieldKind
+}
+
+// listResource describes a list endpoint. Only the exprs in columns are
+// ever interpolated into queries; everything from the request is bound.
+type listResource struct {
+	from    string
+	fields  []string
+	columns map[string]listField
+}
+
+var paymentList = listResource{
+	from: "payments p",
+	fields: []string{"id", "tenant_id", "customer_id", "order_id", "amount", "amount_received", "amount_refunded",
+		"currency", "status", "state", "payment_method", "description", "region", "created_at", "updated_at"},
+	columns: map[string]listField{
+		"id":              {"p.id", textField},
+		"tenant_id":       {"p.tenant_id", textField},
+		"customer_id":     {"p.customer_id", textField},
+		"order_id":        {"p.order_id", textField},
+		"amount":          {"p.amount", intField},
+		"amount_received": {"p.amount_received", intField},
+		"amount_refunded": {"p.amount_refunded", intField},
+		"currency":        {"p.currency", textField},
+		"status":          {"p.status", textField},
+		"state":           {"p.state", textField},
+		"payment_method":  {"p.payment_method", textField},
+		"description":     {"p.description", textField},
+		"region":          {"p.region", textField},
+		"created_at":      {"p.created_at", timeField},
+		"updated_at":      {"p.updated_at", timeField},
+	},
+}
+
+var refundList = listResource{
+	from:   "refunds r JOIN payments p ON p.id = r.payment_id",
+	fields: []string{"id", "payment_id", "tenant_id", "amount", "currency", "status", "reason", "created_at", "updated_at"},
+	columns: map[string]listField{
+		"id":         {"r.id", textField},
+		"payment_id": {"r.payment_id", textField},
+		"tenant_id":  {"p.tenant_id", textField},
+		"amount":     {"r.amount", intField},
+		"currency":   {"r.currency", textField},
+		"status":     {"r.status", textField},
+		"reason":     {"r.reason", textField},
+		"created_at": {"r.created_at", timeField},
+		"updated_at": {"r.updated_at", timeField},
+	},
+}
+
+// Disputes can arrive before we have the payment, hence the outer join.
+var disputeList = listResource{
+	from: "disputes d LEFT JOIN payments p ON p.id = d.payment_id",
+	fields: []string{"id", "payment_id", "charge_id", "tenant_id", "amount", "currency", "status", "reason",
+		"evidence_due_by", "created_at", "updated_at"},
+	columns: map[string]listField{
+		"id":              {"d.id", textField},
+		"payment_id":      {"d.payment_id", textField},
+		"charge_id":       {"d.charge_id", textField},
+		"tenant_id":       {"COALESCE(p.tenant_id, '')", textField},
+		"amount":          {"d.amount", intField},
+		"currency":        {"d.currency", textField},
+		"status":          {"d.status", textField},
+		"reason":          {"d.reason", textField},
+		"evidence_due_by": {"d.evidence_due_by", timeField},
+		"created_at":      {"d.created_at", timeField},
+		"updated_at":      {"d.updated_at", timeField},
+	},
+}
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+// ListQuery is a parsed, validated list request.
+type ListQuery struct {
+	Filters []ListFilter
+	Sort    []ListSort
+	Fields  []string
+	// Limit 0 means every matching row; only streamed lists allow it.
+	Limit  int
+	Offset int
+}
+
+type ListFilter struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+type ListSort struct {
+	Field string
+	Desc  bool
+}
+
+var listTerm = regexp.MustCompile(`^([a-z_]+)(>=|<=|!=|=|>|<)(.*)$`)
+
+// parseListQuery parses the raw query string rather than url.Values, since
+// range operators like created_at>=x don't survive key=value splitting.
+// A streamed query has no default or maximum limit.
+func parseListQuery(rawQuery string, m listResource, stream bool) (ListQuery, error) {
+	q := ListQuery{Limit: defaultListLimit}
+	if stream {
+		q.Limit = 0
+	}
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		term, err := url.QueryUnescape(part)
+		if err != nil {
+			return q, fmt.Errorf("malformed query %q", part)
+		}
+		sm := listTerm.FindStringSubmatch(term)
+		if sm == nil {
+			return q, fmt.Errorf("malformed filter %q", term)
+		}
+		name, op, value := sm[1], sm[2], sm[3]
+
+		switch name {
+		case "sort", "fields", "limit", "offset":
+			if op != "=" {
+				return q, fmt.Errorf("%s takes =", name)
+			}
+			if err := q.setOption(name, value, m, stream); err != nil {
+				return q, err
+			}
+			continue
+		}
+
+		col, ok := m.columns[name]
+		if !ok {
+			return q, fmt.Errorf("unknown field %q", name)
+		}
+		f, err := parseListFilter(name, op, value, col.kind)
+		if err != nil {
+			return q, err
+		}
+		q.Filters = append(q.Filters, f)
+	}
+
+	if len(q.Sort) == 0 {
+		q.Sort = []ListSort{{Field: "created_at", Desc: true}}
+	}
+	if len(q.Fields) == 0 {
+		q.Fields = m.fields
+	}
+	return q, nil
+}
+
+func (q *ListQuery) setOption(name, value string, m listResource, stream bool) error {
+	switch name {
+	case "sort":
+		for _, s := range strings.Split(value, ",") {
+			desc := strings.HasPrefix(s, "-")
+			s = strings.TrimPrefix(s, "-")
+			if _, ok := m.columns[s]; !ok {
+				return fmt.Errorf("unknown sort field %q", s)
+			}
+			q.Sort = append(q.Sort, ListSort{Field: s, Desc: desc})
+		}
+	case "fields":
+		for _, f := range strings.Split(value, ",") {
+			if _, ok := m.columns[f]; !ok {
+				return fmt.Errorf("unknown field %q", f)
+			}
+			if !containsString(q.Fields, f) {
+				q.Fields = append(q.Fields, f)
+			}
+		}
+	case "limit":
+		n, err := strconv.Atoi(value)
+		if stream && (err != nil || n < 1) {
+			return fmt.Errorf("limit must be a positive integer")
+		}
+		if !stream && (err != nil || n < 1 || n > maxListLimit) {
+			return fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		q.Limit = n
+	case "offset":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("offset must be a non-negative integer")
+		}
+		q.Offset = n
+	}
+	return nil
+}
+
+func parseListFilter(name, op, value string, kind fieldKind) (ListFilter, error) {
+	f := ListFilter{Field: name, Op: op}
+	ranged := op == ">" || op == ">=" || op == "<" || op == "<="
+	if ranged && kind == textField {
+		return f, fmt.Errorf("%s does not support %s", name, op)
+	}
+
+	values := []string{value}
+	if op == "=" && kind != timeField && strings.Contains(value, ",") {
+		values = strings.Split(value, ",")
+		f.Op = "in"
+	}
+
+	switch kind {
+	case textField:
+		if f.Op == "in" {
+			f.Value = values
+		} else {
+			f.Value = value
+		}
+	case intField:
+		ints := make([]int64, len(values))
+		for i, v := range values {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return f, fmt.Errorf("%s must be an integer", name)
+			}
+			ints[i] = n
+		}
+		if f.Op == "in" {
+			f.Value = ints
+		} else {
+			f.Value = ints[0]
+		}
+	case timeField:
+		t, err := parseExportTime(value)
+		if err != nil {
+			return f, fmt.Errorf("%s must be a date (YYYY-MM-DD) or RFC 3339 timestamp", name)
+		}
+		f.Value = t
+	}
+	return f, nil
+}
+
+// List runs a parsed query. It fetches one row past the limit to report
+// whether there are more.
+func (s *Store) List(ctx context.Context, m listResource, q ListQuery) ([]map[string]interface{}, bool, error) {
+	out := []map[string]interface{}{}
+	err := s.EachListRow(ctx, m, q, q.Limit+1, func(row map[string]interface{}) error {
+		out = append(out, row)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(out) > q.Limit
+	if hasMore {
+		out = out[:q.Limit]
+	}
+	return out, hasMore, nil
+}
+
+// EachListRow runs a parsed query and calls fn for each row as it is read,
+// stopping at fn's first error. limit 0 reads every row. It reads from
+// the replica when there is a usable one.
+func (s *Store) EachListRow(ctx context.Context, m listResource, q ListQuery, limit int, fn func(map[string]interface{}) error) error {
+	var selects []string
+	for _, f := range q.Fields {
+		selects = append(selects, m.columns[f].expr)
+	}
+
+	var where []string
+	var args []interface{}
+	for _, f := range q.Filters {
+		args = append(args, f.Value)
+		expr := m.columns[f.Field].expr
+		if f.Op == "in" {
+			where = append(where, fmt.Sprintf("%s = ANY($%d)", expr, len(args)))
+		} else {
+			where = append(where, fmt.Sprintf("%s %s $%d", expr, f.Op, len(args)))
+		}
+	}
+	if len(where) == 0 {
+		where = []string{"TRUE"}
+	}
+
+	var order []string
+	for _, o := range q.Sort {
+		dir := "ASC"
+		if o.Desc {
+			dir = "DESC"
+		}
+		order = append(order, m.columns[o.Field].expr+" "+dir)
+	}
+	// Ties broken by id keep offset paging stable.
+	order = append(order, m.columns["id"].expr)
+
+	// A nil LIMIT is LIMIT ALL.
+	var limitArg interface{}
+	if limit > 0 {
+		limitArg = limit
+	}
+	args = append(args, limitArg, q.Offset)
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE %s ORDER BY %s LIMIT $%d OFFSET $%d`,
+		strings.Join(selects, ", "), m.from, strings.Join(where, " AND "), strings.Join(order, ", "),
+		len(args)-1, len(args))
+
+	rows, err := s.reader().QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		dest := make([]interface{}, len(q.Fields))
+		for i, f := range q.Fields {
+			switch m.columns[f].kind {
+			case textField:
+				dest[i] = new(string)
+			case intField:
+				dest[i] = new(int64)
+			case timeField:
+				dest[i] = new(sql.NullTime)
+			}
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+
+		row := make(map[string]interface{}, len(q.Fields))
+		for i, f := range q.Fields {
+			switch v := dest[i].(type) {
+			case *string:
+				row[f] = *v
+			case *int64:
+				row[f] = *v
+			case *sql.NullTime:
+				if v.Valid {
+					row[f] = v.Time.UTC().Format(time.RFC3339)
+				} else {
+					row[f] = nil
+				}
+			}
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func listHandler(store *Store, m listResource) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if store == nil {
+			c.JSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Lists require DATABASE_URL"))
+			return
+		}
+
+		stream := wantsNDJSON(c)
+		q, err := parseListQuery(c.Request.URL.RawQuery, m, stream)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, err.Error()))
+			return
+		}
+		if stream {
+			streamList(c, store, m, q)
+			return
+		}
+
+		rows, hasMore, err := store.List(c.Request.Context(), m, q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+
+		respondList(c, http.StatusOK, rows, gin.H{
+			"limit":    q.Limit,
+			"offset":   q.Offset,
+			"has_more": hasMore,
+		})
+	}
+}
+
+// streamList writes rows as NDJSON while they are read, so memory stays
+// flat however many rows match. Once the first row is out the status is
+// committed; a later failure ends the stream with an {"error": ...} line.
+func streamList(c *gin.Context, store *Store, m listResource, q ListQuery) {
+	ctx := c.Request.Context()
+	disableWriteDeadline(c.Writer)
+	c.Header("Content-Type", ndjsonContentType)
+	c.Status(http.StatusOK)
+
+	w := newNDJSONWriter(c.Writer)
+	err := store.EachListRow(ctx, m, q, q.Limit, func(row map[string]interface{}) error {
+		return w.Encode(row)
+	})
+	if err != nil {
+		logf(ctx, "streaming list: %v", err)
+		if ctx.Err() == nil {
+			w.Encode(gin.H{"error": errorBody(c, CodeInternal, "List stream failed")})
+		}
+	}
+	w.Flush()
+}
+
+// RegisterListRoutes mounts the filterable list endpoints, which list
+// every tenant's rows and so need a key with the payments:read scope.
+// Payments are listed from the read models when there are any.
+func RegisterListRoutes(r *gin.Engine, store *Store, readModels *ReadModels, bootstrapToken string) {
+	g := r.Group("", requireScope(store, bootstrapToken, readPaymentsScope))
+	g.GET("/payments", readModels.serve(listHandler(store, paymentSummaryList), listHandler(store, paymentList)))
+	g.GET("/refunds", listHandler(store, refundList))
+	g.GET("/disputes", listHandler(store, disputeList))
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "payment_service_requests_in_flight",
+		Help: "Requests being handled, excluding event streams.",
+	})
+	requestsShed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_requests_shed_total",
+		Help: "Requests rejected by load shedding, by priority.",
+	}, []string{"priority"})
+)
+
+type requestPriority int
+
+const (
+	priorityLow requestPriority = iota
+	priorityNormal
+	priorityCritical
+)
+
+func (p requestPriority) String() string {
+	switch p {
+	case priorityLow:
+		return "low"
+	case priorityCritical:
+		return "critical"
+	}
+	return "normal"
+}
+
+// routePriorities ranks routes for shedding; unlisted routes are normal.
+// Critical routes move money or acknowledge Stripe and are never shed.
+// Low ones are polls and lookups a client can simply repeat.
+var routePriorities = map[string]requestPriority{
+	"/payment/create":                           priorityCritical,
+	"/payments/batch":                           priorityCritical,
+	"/webhook":                                  priorityCritical,
+	"/wallets/:id/checkout":                     priorityCritical,
+	"/wallets/:id/top-ups":                      priorityCritical,
+	"/wallets/:id":                              priorityLow,
+	"/customers/:id/points":                     priorityLow,
+	"/customers/:id/points/transactions":        priorityLow,
+	"/customers/:id/tax-ids":                    priorityLow,
+	"/gift-cards/redeem":                        priorityCritical,
+	"/gift-cards/lookup":                        priorityLow,
+	"/escrows":                                  priorityCritical,
+	"/escrows/:id/delivery":                     priorityCritical,
+	"/escrows/:id":                              priorityLow,
+	"/subscriptions/:id/dunning":                priorityLow,
+	"/payment/:id/retry":                        priorityLow,
+	"/payment/:id/tip":                          priorityCritical,
+	"/payment/:id/capture":                      priorityCritical,
+	"/checkout/sessions":                        priorityCritical,
+	"/checkout/sessions/:id/payment-method":     priorityCritical,
+	"/checkout/sessions/:id":                    priorityLow,
+	"/checkout/sessions/:id/events":             priorityLow,
+	"/payment-plans":                            priorityCritical,
+	"/payment-plans/:id/payoff":                 priorityCritical,
+	"/payment-plans/:id":                        priorityLow,
+	"/billing/subscriptions":                    priorityCritical,
+	"/billing/subscriptions/:id":                priorityLow,
+	"/billing/subscriptions/:id/preview-change": priorityLow,
+	"/fx/lock":                                  priorityCritical,
+	"/fx/quotes/:id":                            priorityLow,
+	"/tokenize/card":                            priorityCritical,
+	"/payment/:id":                              priorityLow,
+	"/jobs/:id":                                 priorityLow,
+	"/payments/export/:job_id":                  priorityLow,
+	"/payment/capabilities":                     priorityLow,
+	"/reports/payments":                         priorityLow,
+	"/reports/refunds":                          priorityLow,
+	"/refunds/bulk/:id":                         priorityLow,
+	"/reports/fees":                             priorityLow,
+	"/payment/:id/fees":                         priorityLow,
+	"/payment/:id/history":                      priorityLow,
+	"/payment/:id/timeline":                     priorityLow,
+	"/payment/:id/changes":                      priorityLow,
+	"/payment/:id/as-of":                        priorityLow,
+	"/reports/chargeback-risk":                  priorityLow,
+	"/reports/chargeback-risk/flagged":          priorityLow,
+	"/reports/settlements/:payout_id":           priorityLow,
+	"/documents/:kind/:id":                      priorityLow,
+	"/receipts/:token":                          priorityLow,
+}
+
+// loadShedExempt routes are neither shed nor counted: probes, scrapes,
+// and event streams, which stay open for minutes and would read as load.
+var loadShedExempt = map[string]bool{
+	"/health":             true,
+	"/readyz":             true,
+	"/metrics":            true,
+	"/payment/:id/events": true,
+	"/payment/:id/ws":     true,
+	"/admin/events":       true,
+}
+
+// Exports and NDJSON lists run as long as the data takes to send, so
+// their latency says nothing about load; they count as in flight only.
+var loadShedUntimed = map[string]bool{
+	"/payments/export":                  true,
+	"/payments/export/:job_id/download": true,
+	"/refunds/bulk/:id/report":          true,
+}
+
+// LoadShedder rejects lower-priority requests when the service is past
+// what it can serve well, so payment creation keeps its latency through a
+// spike instead of everything slowing down together. Load is the number
+// of requests in flight and a moving average of their latency: low
+// priority is shed at half of maxInFlight or once latency passes target,
+// normal priority at maxInFlight or twice target.
+type LoadShedder struct {
+	maxInFlight int64
+	target      time.Duration
+	inFlight    atomic.Int64
+
+	mu      sync.Mutex
+	latency float64 // seconds, exponentially weighted
+	sampled time.Time
+}
+
+// NewLoadShedder returns nil, which sheds nothing, when both limits are 0.
+func NewLoadShedder(maxInFlight int, target time.Duration) *LoadShedder {
+	if maxInFlight <= 0 && target <= 0 {
+		return nil
+	}
+	return &LoadShedder{maxInFlight: int64(maxInFlight), target: target}
+}
+
+const (
+	latencyWeight = 0.1
+	// latencyHalfLife decays the average while no samples arrive, so a
+	// burst of slow requests doesn't keep shedding after traffic stops.
+	latencyHalfLife = time.Second
+)
+
+func (l *LoadShedder) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.latency = l.decayed(time.Now())*(1-latencyWeight) + d.Seconds()*latencyWeight
+	l.sampled = time.Now()
+}
+
+// decayed must be called with mu held.
+func (l *LoadShedder) decayed(now time.Time) float64 {
+	if l.sampled.IsZero() {
+		return 0
+	}
+	idle := now.Sub(l.sampled)
+	if idle <= latencyHalfLife {
+		return l.latency
+	}
+	return l.latency * math.Pow(0.5, idle.Seconds()/latencyHalfLife.Seconds())
+}
+
+// shed reports whether a request of priority p should be turned away.
+func (l *LoadShedder) shed(p requestPriority) bool {
+	if p == priorityCritical {
+		return false
+	}
+	factor := int64(1)
+	if p == priorityLow {
+		factor = 2
+	}
+	if l.maxInFlight > 0 && l.inFlight.Load()*factor >= l.maxInFlight {
+		return true
+	}
+	if l.target > 0 {
+		l.mu.Lock()
+		latency := l.decayed(time.Now())
+		l.mu.Unlock()
+		limit := l.target.Seconds() * 2 / float64(factor)
+		if latency >= limit {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware sheds and tracks requests. Shed requests get a 503 with
+// Retry-After, which well-behaved clients back off on.
+func (l *LoadShedder) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if l == nil || loadShedExempt[c.FullPath()] {
+			c.Next()
+			return
+		}
+		p, ok := routePriorities[c.FullPath()]
+		if !ok {
+			p = priorityNormal
+		}
+		if l.shed(p) {
+			requestsShed.WithLabelValues(p.String()).Inc()
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeOverloaded, "Service is overloaded"))
+			return
+		}
+
+		timed := !loadShedUntimed[c.FullPath()] && !wantsNDJSON(c)
+		l.inFlight.Add(1)
+		requestsInFlight.Inc()
+		started := time.Now()
+		defer func() {
+			l.inFlight.Add(-1)
+			requestsInFlight.Dec()
+			if timed {
+				l.observe(time.Since(started))
+			}
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// LoyaltyConfig runs the points program. Customers earn points on what
+// they pay by card and spend them as partial tender at payment creation,
+// with the card paying at least the currency's minimum charge.
+//
+//	"loyalty": {"earn_rates": {"usd": 0.01}, "point_values": {"usd": 1}, "max_redeem_percent": 50}
+type LoyaltyConfig struct {
+	// EarnRates are points per minor unit paid, by currency: 0.01 earns a
+	// point per dollar. Currencies without a rate earn nothing.
+	EarnRates map[string]float64 `json:"earn_rates"`
+	// PointValues are what one point pays, in minor units of each
+	// currency. Points can't be spent in currencies without a value.
+	PointValues map[string]int64 `json:"point_values"`
+	// MaxRedeemPercent caps the share of a payment points may cover. Zero
+	// means no cap.
+	MaxRedeemPercent float64 `json:"max_redeem_percent"`
+}
+
+func (cfg LoyaltyConfig) validate() error {
+	for cur, rate := range cfg.EarnRates {
+		if len(cur) != 3 || rate < 0 {
+			return fmt.Errorf("loyalty: invalid earn_rates entry %s=%g", cur, rate)
+		}
+	}
+	for cur, value := range cfg.PointValues {
+		if len(cur) != 3 || value <= 0 {
+			return fmt.Errorf("loyalty: invalid point_values entry %s=%d", cur, value)
+		}
+	}
+	if cfg.MaxRedeemPercent < 0 || cfg.MaxRedeemPercent > 100 {
+		return fmt.Errorf("loyalty: max_redeem_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// LoyaltyAccount is a customer's points balance with a tenant.
+type LoyaltyAccount struct {
+	TenantID   string    `json:"tenant_id,omitempty"`
+	CustomerID string    `json:"customer_id"`
+	Balance    int64     `json:"balance"`
+	UpdatedAt  time.Time `json:"updated_at,omitempty"`
+}
+
+// Loyalty transaction types. Payments earn points when they succeed and
+// redeem them when they are created; a reversal takes back some or all of
+// an earlier transaction, and adjustments are made by hand.
+const (
+	loyaltyEarn       = "earn"
+	loyaltyRedeem     = "redeem"
+	loyaltyReversal   = "reversal"
+	loyaltyAdjustment = "adjustment"
+)
+
+// LoyaltyTransaction is one movement of a points balance. Points are
+// signed: earned points are positive, redeemed ones negative.
+type LoyaltyTransaction struct {
+	ID           string    `json:"id"`
+	TenantID     string    `json:"tenant_id,omitempty"`
+	CustomerID   string    `json:"customer_id"`
+	Type         string    `json:"type"`
+	Points       int64     `json:"points"`
+	BalanceAfter int64     `json:"balance_after"`
+	PaymentID    string    `json:"payment_id,omitempty"`
+	Description  string    `json:"description,omitempty"`
+	Reverses     string    `json:"reverses,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+var (
+	errInsufficientPoints = errors.New("points balance is too low")
+	// errPointsReversed is a replayed redemption that was given back
+	// when its payment failed.
+	errPointsReversed = errors.New("points redemption was reversed")
+)
+
+const loyaltyTransactionColumns = `id, tenant_id, customer_id, type, points, balance_after, payment_id, description, COALESCE(reverses, ''), created_at`
+
+func scanLoyaltyTransaction(row interface{ Scan(...interface{}) error }) (*LoyaltyTransaction, error) {
+	var t LoyaltyTransaction
+	if err := row.Scan(&t.ID, &t.TenantID, &t.CustomerID, &t.Type, &t.Points, &t.BalanceAfter, &t.PaymentID,
+		&t.Description, &t.Reverses, &t.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// LoyaltyAccount returns the customer's balance, which is zero until they
+// first earn points.
+func (s *Store) LoyaltyAccount(ctx context.Context, tenantID, customerID string) (*LoyaltyAccount, error) {
+	a := &LoyaltyAccount{TenantID: tenantID, CustomerID: customerID}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT balance, updated_at FROM loyalty_accounts WHERE tenant_id = $1 AND customer_id = $2`,
+		tenantID, customerID).Scan(&a.Balance, &a.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return a, nil
+	}
+	return a, err
+}
+
+func (s *Store) LoyaltyTransaction(ctx context.Context, id string) (*LoyaltyTransaction, error) {
+	return scanLoyaltyTransaction(s.db.QueryRowContext(ctx, `
+		SELECT `+loyaltyTransactionColumns+` FROM loyalty_transactions WHERE id = $1`, id))
+}
+
+// LoyaltyTransactions lists a customer's points history, newest first.
+func (s *Store) LoyaltyTransactions(ctx context.Context, tenantID, customerID string, limit, offset int) ([]*LoyaltyTransaction, bool, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+loyaltyTransactionColumns+` FROM loyalty_transactions
+		WHERE tenant_id = $1 AND customer_id = $2 ORDER BY created_at DESC, id LIMIT $3 OFFSET $4`,
+		tenantID, customerID, limit+1, offset)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	txs := []*LoyaltyTransaction{}
+	for rows.Next() {
+		t, err := scanLoyaltyTransaction(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		txs = append(txs, t)
+	}
+	if len(txs) > limit {
+		return txs[:limit], true, rows.Err()
+	}
+	return txs, false, rows.Err()
+}
+
+// PaymentLoyaltyTransaction returns the payment's earn or redeem
+// transaction, or sql.ErrNoRows.
+func (s *Store) PaymentLoyaltyTransaction(ctx context.Context, paymentID, typ string) (*LoyaltyTransaction, error) {
+	return scanLoyaltyTransaction(s.db.QueryRowContext(ctx, `
+		SELECT `+loyaltyTransactionColumns+` FROM loyalty_transactions
+		WHERE payment_id = $1 AND type = $2 ORDER BY created_at LIMIT 1`, paymentID, typ))
+}
+
+// AttachLoyaltyPayment records the payment a redemption paid for, once
+// the payment exists.
+func (s *Store) AttachLoyaltyPayment(ctx context.Context, id, paymentID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE loyalty_transactions SET payment_id = $2 WHERE id = $1 AND payment_id = ''`, id, paymentID)
+	return err
+}
+
+// loyaltyMovement is a change to apply to a points balance.
+type loyaltyMovement struct {
+	tenantID       string
+	customerID     string
+	typ            string
+	points         int64
+	paymentID      string
+	description    string
+	idempotencyKey string
+}
+
+// lockLoyaltyAccount opens the customer's account if needed and holds its
+// row lock for the rest of tx, returning the balance.
+func lockLoyaltyAccount(ctx context.Context, tx *sql.Tx, tenantID, customerID string) (int64, error) {
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO loyalty_accounts (tenant_id, customer_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		tenantID, customerID); err != nil {
+		return 0, err
+	}
+	var balance int64
+	err := tx.QueryRowContext(ctx, `
+		SELECT balance FROM loyalty_accounts WHERE tenant_id = $1 AND customer_id = $2 FOR UPDATE`,
+		tenantID, customerID).Scan(&balance)
+	return balance, err
+}
+
+func insertLoyaltyTransaction(ctx context.Context, tx *sql.Tx, m loyaltyMovement, after int64, reverses string) (*LoyaltyTransaction, error) {
+	t, err := scanLoyaltyTransaction(tx.QueryRowContext(ctx, `
+		INSERT INTO loyalty_transactions
+			(id, tenant_id, customer_id, type, points, balance_after, payment_id, description, reverses, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING `+loyaltyTransactionColumns,
+		uuid.NewString(), m.tenantID, m.customerID, m.typ, m.points, after, m.paymentID, m.description,
+		sql.NullString{String: reverses, Valid: reverses != ""},
+		sql.NullString{String: m.idempotencyKey, Valid: m.idempotencyKey != ""}))
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE loyalty_accounts SET balance = $3, updated_at = now() WHERE tenant_id = $1 AND customer_id = $2`,
+		m.tenantID, m.customerID, after)
+	return t, err
+}
+
+// applyLoyaltyMovement moves a points balance under the account's row
+// lock. A movement already applied, identified by its idempotency key or
+// the payment it earned on, returns the original transaction. Spending
+// past the balance fails with errInsufficientPoints.
+func (s *Store) applyLoyaltyMovement(ctx context.Context, m loyaltyMovement) (*LoyaltyTransaction, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	balance, err := lockLoyaltyAccount(ctx, tx, m.tenantID, m.customerID)
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT ` + loyaltyTransactionColumns + ` FROM loyalty_transactions WHERE `
+	var prior *LoyaltyTransaction
+	switch {
+	case m.idempotencyKey != "":
+		prior, err = scanLoyaltyTransaction(tx.QueryRowContext(ctx, query+`tenant_id = $1 AND customer_id = $2 AND idempotency_key = $3`,
+			m.tenantID, m.customerID, m.idempotencyKey))
+	case m.typ == loyaltyEarn:
+		prior, err = scanLoyaltyTransaction(tx.QueryRowContext(ctx, query+`type = 'earn' AND payment_id = $1`, m.paymentID))
+	default:
+		err = sql.ErrNoRows
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return prior, err
+	}
+
+	after := balance + m.points
+	if m.points < 0 && after < 0 {
+		return nil, errInsufficientPoints
+	}
+	t, err := insertLoyaltyTransaction(ctx, tx, m, after, "")
+	if err != nil {
+		return nil, err
+	}
+	return t, tx.Commit()
+}
+
+// ReverseLoyaltyTransaction takes back num/den of transaction id's points,
+// counting reversals already made, so a refund reversed in parts never
+// takes back more than it should and redelivery changes nothing. It
+// returns nil when nothing was left to reverse. Taking back earned points
+// may leave the balance below zero.
+func (s *Store) ReverseLoyaltyTransaction(ctx context.Context, id string, num, den int64, why string) (*LoyaltyTransaction, error) {
+	original, err := s.LoyaltyTransaction(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	balance, err := lockLoyaltyAccount(ctx, tx, original.TenantID, original.CustomerID)
+	if err != nil {
+		return nil, err
+	}
+	var reversed int64
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(points), 0) FROM loyalty_transactions WHERE reverses = $1`, id).Scan(&reversed); err != nil {
+		return nil, err
+	}
+	if num > den {
+		num = den
+	}
+	target := -original.Points * num / den
+	delta := target - reversed
+	if delta == 0 || (delta > 0) != (target > 0) {
+		return nil, nil
+	}
+	t, err := insertLoyaltyTransaction(ctx, tx, loyaltyMovement{
+		tenantID:    original.TenantID,
+		customerID:  original.CustomerID,
+		typ:         loyaltyReversal,
+		points:      delta,
+		paymentID:   original.PaymentID,
+		description: why,
+	}, balance+delta, id)
+	if err != nil {
+		return nil, err
+	}
+	return t, tx.Commit()
+}
+
+// LoyaltyTransactionReversed reports whether id was reversed at all.
+func (s *Store) LoyaltyTransactionReversed(ctx context.Context, id string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM loyalty_transactions WHERE reverses = $1`, id).Scan(&n)
+	return n > 0, err
+}
+
+// Metadata on PaymentIntents paid partly with points.
+const (
+	metadataPointsRedeemed    = "loyalty_points_redeemed"
+	metadataPointsValue       = "loyalty_points_value"
+	metadataPointsTransaction = "loyalty_transaction_id"
+)
+
+// pointsRedemption is the part of a payment points will pay.
+type pointsRedemption struct {
+	Points int64
+	Value  int64
+}
+
+func (p *pointsRedemption) addMetadata(params *stripe.PaymentIntentParams) {
+	if p == nil {
+		return
+	}
+	params.AddMetadata(metadataPointsRedeemed, strconv.FormatInt(p.Points, 10))
+	params.AddMetadata(metadataPointsValue, strconv.FormatInt(p.Value, 10))
+}
+
+// Loyalty keeps customers' points balances: points are earned when a
+// payment succeeds, spent as partial tender when one is created, taken
+// back in proportion when it is refunded and given back when a payment
+// they paid for is canceled or fully refunded. Every movement is a
+// loyalty transaction. Points aren't money and stay out of the ledger.
+type Loyalty struct {
+	store    *Store
+	settings *RuntimeSettings
+}
+
+func NewLoyalty(store *Store, settings *RuntimeSettings) *Loyalty {
+	return &Loyalty{store: store, settings: settings}
+}
+
+// RegisterRoutes mounts customers' balances and history under the
+// payments:read scope, and manual adjustments under the admin scope. The
+// reads take the tenant as ?tenant_id=; keys are not bound to a tenant,
+// so any tenant's points are open to a key with the scope, as payments
+// are.
+func (l *Loyalty) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/customers/:id/points", requireScope(l.store, bootstrapToken, readPaymentsScope), l.requireStore)
+	g.GET("", l.balance)
+	g.GET("/transactions", l.transactions)
+
+	admin := r.Group("/admin/customers/:id/points", requireScope(l.store, bootstrapToken, "admin"), l.requireStore)
+	admin.POST("/adjustments", l.adjust)
+}
+
+func (l *Loyalty) requireStore(c *gin.Context) {
+	if l.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Loyalty points require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+func (l *Loyalty) balance(c *gin.Context) {
+	a, err := l.store.LoyaltyAccount(c.Request.Context(), c.Query("tenant_id"), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, a)
+}
+
+func (l *Loyalty) transactions(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 100 {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "limit must be between 1 and 100"))
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "offset must be a non-negative integer"))
+		return
+	}
+	ctx := c.Request.Context()
+	tenantID, customerID := c.Query("tenant_id"), c.Param("id")
+
+	txs, hasMore, err := l.store.LoyaltyTransactions(ctx, tenantID, customerID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	a, err := l.store.LoyaltyAccount(ctx, tenantID, customerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondList(c, http.StatusOK, txs, gin.H{
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": hasMore,
+		"balance":  a.Balance,
+	})
+}
+
+// adjust grants or removes points by hand, for goodwill gestures and
+// corrections.
+func (l *Loyalty) adjust(c *gin.Context) {
+	var req struct {
+		TenantID string `json:"tenant_id"`
+		Points   int64  `json:"points" binding:"required"`
+		Reason   string `json:"reason" binding:"required"`
+		// PaymentID is the payment the adjustment is for, if any, whose
+		// timeline then shows it.
+		PaymentID string `json:"payment_id"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	t, err := l.store.applyLoyaltyMovement(c.Request.Context(), loyaltyMovement{
+		tenantID:       req.TenantID,
+		customerID:     c.Param("id"),
+		typ:            loyaltyAdjustment,
+		points:         req.Points,
+		description:    req.Reason,
+		idempotencyKey: c.GetHeader("Idempotency-Key"),
+	})
+	if errors.Is(err, errInsufficientPoints) {
+		l.insufficientPoints(c, req.TenantID, c.Param("id"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	recordAdminAction(c, l.store, req.PaymentID, "loyalty.adjusted", t.ID,
+		gin.H{"customer_id": c.Param("id"), "points": req.Points, "reason": req.Reason})
+	respondData(c, http.StatusCreated, t)
+}
+
+func (l *Loyalty) insufficientPoints(c *gin.Context, tenantID, customerID string) {
+	ext := gin.H{}
+	if a, err := l.store.LoyaltyAccount(c.Request.Context(), tenantID, customerID); err == nil {
+		ext["balance"] = a.Balance
+	}
+	c.JSON(http.StatusUnprocessableEntity, errorBodyWith(c, CodeInsufficientBalance, "Points balance is too low", ext))
+}
+
+// quote works out how much of req points will pay: as many of the points
+// asked for as fit under the redemption cap and above the minimum card
+// charge. The balance is checked here and again when they are spent.
+func (l *Loyalty) quote(ctx context.Context, req PaymentRequest) (*pointsRedemption, *refusal) {
+	if l == nil || l.store == nil {
+		return nil, &refusal{http.StatusServiceUnavailable, CodeNotConfigured, "Loyalty points require DATABASE_URL", nil}
+	}
+	cfg := l.settings.Get().Loyalty
+	currency := strings.ToLower(req.Currency)
+	value := cfg.PointValues[currency]
+	if value == 0 {
+		return nil, &refusal{http.StatusUnprocessableEntity, CodeInvalidRequest,
+			"Points can't be redeemed for " + strings.ToUpper(currency) + " payments", nil}
+	}
+
+	floor := minimumChargeAmounts[currency]
+	if floor == 0 {
+		floor = 1
+	}
+	payable := req.Amount - floor
+	if cfg.MaxRedeemPercent > 0 {
+		if max := percentOf(req.Amount, cfg.MaxRedeemPercent, roundDown); max < payable {
+			payable = max
+		}
+	}
+	points := req.RedeemPoints
+	if n := payable / value; n < points {
+		points = n
+	}
+	if points <= 0 {
+		return nil, &refusal{http.StatusUnprocessableEntity, CodeInvalidAmount, "Amount is too small to pay with points", nil}
+	}
+
+	a, err := l.store.LoyaltyAccount(ctx, req.TenantID, req.CustomerID)
+	if err != nil {
+		logf(ctx, "loyalty balance: %v", err)
+		return nil, &refusal{http.StatusInternalServerError, CodeInternal, "Could not read points balance", nil}
+	}
+	if a.Balance < points {
+		return nil, &refusal{http.StatusUnprocessableEntity, CodeInsufficientBalance, "Points balance is too low",
+			gin.H{"balance": a.Balance}}
+	}
+	return &pointsRedemption{Points: points, Value: points * value}, nil
+}
+
+// redeem spends the points quoted for params, before the intent is
+// created, and returns the redemption for attach or release. A retry with
+// the same idempotency key gets the original redemption back, and fails
+// with errPointsReversed if it was given back since.
+func (l *Loyalty) redeem(ctx context.Context, req PaymentRequest, points *pointsRedemption, params *stripe.PaymentIntentParams, idempotencyKey string) (string, error) {
+	if l == nil || l.store == nil || points == nil {
+		return "", nil
+	}
+	m := loyaltyMovement{
+		tenantID:    req.TenantID,
+		customerID:  req.CustomerID,
+		typ:         loyaltyRedeem,
+		points:      -points.Points,
+		description: req.Description,
+	}
+	if idempotencyKey != "" {
+		m.idempotencyKey = idempotencyKey + ":points"
+	}
+	t, err := l.store.applyLoyaltyMovement(ctx, m)
+	if err != nil {
+		return "", err
+	}
+	if reversed, err := l.store.LoyaltyTransactionReversed(ctx, t.ID); err != nil || reversed {
+		if err == nil {
+			err = errPointsReversed
+		}
+		return "", err
+	}
+	params.AddMetadata(metadataPointsTransaction, t.ID)
+	return t.ID, nil
+}
+
+func (l *Loyalty) attach(ctx context.Context, id, paymentID string) {
+	if id == "" {
+		return
+	}
+	if err := l.store.AttachLoyaltyPayment(ctx, id, paymentID); err != nil {
+		logf(ctx, "recording points redemption on %s: %v", paymentID, err)
+	}
+}
+
+func (l *Loyalty) release(ctx context.Context, id string) {
+	if id == "" {
+		return
+	}
+	if _, err := l.store.ReverseLoyaltyTransaction(ctx, id, 1, 1, "payment creation failed"); err != nil {
+		logf(ctx, "giving back points redemption %s: %v", id, err)
+	}
+}
+
+// paymentIntentEvent earns points on a succeeded payment and gives back
+// the points spent on a canceled one. Both are safe to redeliver. The
+// redemption named in the metadata is given back only if it paid for
+// this payment.
+func (l *Loyalty) paymentIntentEvent(ctx context.Context, typ stripe.EventType, pi *stripe.PaymentIntent) error {
+	if l == nil || l.store == nil {
+		return nil
+	}
+
+	switch typ {
+	case "payment_intent.succeeded":
+		if pi.Customer == nil || pi.Customer.ID == "" {
+			return nil
+		}
+		amount := pi.AmountReceived
+		if amount == 0 {
+			amount = pi.Amount
+		}
+		points := timesRate(amount, l.settings.Get().Loyalty.EarnRates[string(pi.Currency)], roundDown)
+		if points <= 0 {
+			return nil
+		}
+		_, err := l.store.applyLoyaltyMovement(ctx, loyaltyMovement{
+			tenantID:    pi.Metadata["tenant_id"],
+			customerID:  pi.Customer.ID,
+			typ:         loyaltyEarn,
+			points:      points,
+			paymentID:   pi.ID,
+			description: pi.Description,
+		})
+		if err != nil {
+			return fmt.Errorf("earning points on %s: %w", pi.ID, err)
+		}
+
+	case "payment_intent.canceled":
+		id := pi.Metadata[metadataPointsTransaction]
+		if id == "" {
+			return nil
+		}
+		t, err := l.store.LoyaltyTransaction(ctx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading points redemption for %s: %w", pi.ID, err)
+		}
+		if t.Type != loyaltyRedeem || t.PaymentID != pi.ID {
+			return nil
+		}
+		if _, err := l.store.ReverseLoyaltyTransaction(ctx, id, 1, 1, "payment "+pi.ID+" canceled"); err != nil {
+			return fmt.Errorf("giving back points for %s: %w", pi.ID, err)
+		}
+	}
+	return nil
+}
+
+// chargeRefunded takes back the refunded share of the points a payment
+// earned and, once it is fully refunded, gives back the points spent on
+// it.
+func (l *Loyalty) chargeRefunded(ctx context.Context, ch *stripe.Charge) error {
+	if l == nil || l.store == nil || ch.PaymentIntent == nil || ch.Amount == 0 {
+		return nil
+	}
+	paymentID := ch.PaymentIntent.ID
+
+	earned, err := l.store.PaymentLoyaltyTransaction(ctx, paymentID, loyaltyEarn)
+	if err == nil {
+		_, err = l.store.ReverseLoyaltyTransaction(ctx, earned.ID, ch.AmountRefunded, ch.Amount, "payment "+paymentID+" refunded")
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("taking back points earned on %s: %w", paymentID, err)
+	}
+	if ch.AmountRefunded < ch.Amount {
+		return nil
+	}
+	redeemed, err := l.store.PaymentLoyaltyTransaction(ctx, paymentID, loyaltyRedeem)
+	if err == nil {
+		_, err = l.store.ReverseLoyaltyTransaction(ctx, redeemed.ID, 1, 1, "payment "+paymentID+" refunded")
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("giving back points spent on %s: %w", paymentID, err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Email is the payload accepted by the internal mailer service.
+type Email struct {
+	To          string            `json:"to"`
+	Subject     string            `json:"subject"`
+	HTML        string            `json:"html"`
+	Text        string            `json:"text"`
+	TenantID    string            `json:"tenant_id,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Attachments []Attachment      `json:"attachments,omitempty"`
+}
+
+// Attachment is a file sent with an email; Content is base64 on the wire.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     []byte `json:"content"`
+}
+
+// MailerClient sends email through the monorepo's mailer service. With
+// store set, emails tagged with a payment_id are logged for the payment's
+// timeline.
+type MailerClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+	store   *Store
+}
+
+// NewMailerClient accepts a discovery:// base URL when transport is
+// discovery-aware.
+func NewMailerClient(baseURL, token string, transport http.RoundTripper) *MailerClient {
+	return &MailerClient{
+		baseURL: baseURL,
+		token:   token,
+		http:    &http.Client{Timeout: 10 * time.Second, Transport: transport},
+	}
+}
+
+func (m *MailerClient) Send(ctx context.Context, email Email) error {
+	err := m.send(ctx, email)
+	if paymentID := email.Tags["payment_id"]; m.store != nil && paymentID != "" {
+		// The email is gone either way; a gap in the log is all this costs.
+		if lerr := m.store.RecordPaymentEmail(context.WithoutCancel(ctx), paymentID, email.Tags["kind"], email.To, err); lerr != nil {
+			logf(ctx, "logging email for %s: %v", paymentID, lerr)
+		}
+	}
+	return err
+}
+
+func (m *MailerClient) send(ctx context.Context, email Email) error {
+	body, err := json.Marshal(email)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.baseURL+"/send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.token != "" {
+		req.Header.Set("Authorization", "Bearer "+m.token)
+	}
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+
+	resp, err := m.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("mailer request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("mailer returned %s", resp.Status)
+	}
+	return nil
+}
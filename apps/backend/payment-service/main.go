@@ -1,25 +1,98 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"flag"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/99designs/gqlgen/graphql/handler"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/stripe/stripe-go/v76"
-	"github.com/stripe/stripe-go/v76/paymentintent"
+	"google.golang.org/grpc"
+
+	"payment-service/graph"
 )
 
+// PaymentRequest is checked by its validate method rather than binding
+// tags: it is the busiest body in the service and the checks are few.
 type PaymentRequest struct {
-	Amount      int64  `json:"amount"`
-	Currency    string `json:"currency"`
+	// Amount is the subtotal; promotions may charge less.
+	Amount      int64  `json:"amount"`   // required, > 0
+	Currency    string `json:"currency"` // required, 3 letters
 	Description string `json:"description"`
+	OrderID     string `json:"order_id"`
+	CustomerID  string `json:"customer_id"`
+	TenantID    string `json:"tenant_id"`
+	// ReceiptEmail is where our own receipts go; Stripe's receipt_email is
+	// left unset so customers don't get two.
+	ReceiptEmail string            `json:"receipt_email"`
+	Metadata     map[string]string `json:"metadata"`
+	// PromoCodes are promotion codes the customer entered.
+	PromoCodes []string `json:"promo_codes"`
+	// Tip is charged on top of the discounted amount and is never
+	// discounted itself. With CaptureMethod "manual" the payment is only
+	// authorized and the tip may change until POST /payment/:id/capture.
+	Tip           int64  `json:"tip"`
+	CaptureMethod string `json:"capture_method"`
+	// Multicapture asks, with manual capture, for an authorization the
+	// card lets POST /payment/:id/captures capture once per shipment.
+	Multicapture bool `json:"multicapture"`
+	// FXQuoteID charges the quote's local amount and currency instead;
+	// Amount and Currency are what the quote converted, after promotions.
+	FXQuoteID string `json:"fx_quote_id"`
+	// QuoteID is a quote from POST /payment/quote for this same request.
+	// The payment is refused rather than charged differently from it.
+	QuoteID string `json:"quote_id"`
+	// RedeemPoints spends the customer's loyalty points on the payment,
+	// after promotions and before the tip. Only as many as fit are used.
+	RedeemPoints int64 `json:"redeem_points"`
+	// PaymentMethod is a pm_ or vaulted vpm_ card the client will confirm
+	// with. Given up front, the card is checked for duplicate payments
+	// before the intent is created, and surcharged by its funding type.
+	PaymentMethod string `json:"payment_method"`
+	// ClientIP is the customer's IP address, checked against the fraud
+	// lists. The create endpoint falls back to the caller's, as it does
+	// for UserAgent.
+	ClientIP  string `json:"client_ip"`
+	UserAgent string `json:"user_agent"`
+	// DeviceID is the device our frontend SDK fingerprinted the customer
+	// on. With the IP and user agent it is kept with the payment for the
+	// velocity and risk rules, and passed on to Radar in metadata.
+	DeviceID string `json:"device_id"`
+	// RadarSession is the rs_ session Stripe.js collected in the
+	// customer's browser, for Radar to score the payment with.
+	RadarSession string `json:"radar_session"`
+	// Region and CustomerCountry say where the customer's data must stay,
+	// when REGION is set; see ResidencyConfig.
+	Region          string `json:"region"`
+	CustomerCountry string `json:"customer_country"`
+
+	// dryRun is set for previews, which velocity rules check without
+	// counting.
+	dryRun bool
+	// skipDiscounts is set for payments that are part of another
+	// checkout, such as a wallet's card remainder.
+	skipDiscounts bool
+	// transferGroup ties the charge to the Transfers that later pay out
+	// of it, for escrowed marketplace payments.
+	transferGroup string
 }
 
 type PaymentResponse struct {
 	ClientSecret string `json:"client_secret"`
 	ID           string `json:"id"`
+	DuplicateOf  string `json:"duplicate_of,omitempty"`
+	Region       string `json:"region,omitempty"`
+	// PublishableKey is set for payments on the alternate provider
+	// account, which the client must confirm with.
+	PublishableKey string `json:"publishable_key,omitempty"`
 }
 
 func main() {
@@ -28,101 +101,951 @@ func main() {
 		log.Println("No .env file found")
 	}
 
-	// Initialize Stripe
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	// Diagnostics only: `payment-service --check` or `payment-service doctor`
+	check := flag.Bool("check", false, "validate configuration and dependencies, then exit")
+	flag.Parse()
+	if *check || flag.Arg(0) == "doctor" {
+		os.Exit(runDoctor())
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	// Initialize Stripe, or the in-memory mock for local development. With
+	// REGION set, NAME_<REGION> settings win over NAME, so each region uses
+	// its own Stripe account, database and Redis
+	if serviceRegion != "" && !regionPattern.MatchString(serviceRegion) {
+		log.Fatalf("Invalid REGION %q", serviceRegion)
+	}
+	stripe.Key = regionEnv("STRIPE_SECRET_KEY")
+	checkStripeAPIVersion()
+	webhookSecret := regionEnv("STRIPE_WEBHOOK_SECRET")
+	var mock *MockStripe
+	switch provider := os.Getenv("PAYMENT_PROVIDER"); provider {
+	case "", "stripe":
+		installStripeHTTP(stripeHTTPConfigFromEnv())
+	case "mock":
+		if webhookSecret == "" {
+			webhookSecret = mockWebhookSecret
+		}
+		declines, err := parseMockDeclines(os.Getenv("MOCK_DECLINES"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		webhookURL := os.Getenv("MOCK_WEBHOOK_URL")
+		if webhookURL == "" {
+			webhookURL = "http://127.0.0.1:" + port + "/webhook"
+		}
+		mockBaseURL := os.Getenv("PUBLIC_BASE_URL")
+		if mockBaseURL == "" {
+			mockBaseURL = "http://127.0.0.1:" + port
+		}
+		mock = NewMockStripe(MockConfig{
+			Latency:       envDuration("MOCK_LATENCY", 0),
+			ConfirmDelay:  envDuration("MOCK_CONFIRM_DELAY", 2*time.Second),
+			Declines:      declines,
+			WebhookURL:    webhookURL,
+			WebhookSecret: webhookSecret,
+			BaseURL:       mockBaseURL,
+		})
+		mock.Install()
+		log.Println("PAYMENT_PROVIDER=mock, Stripe calls are served in-memory")
+	default:
+		log.Fatalf("Unknown PAYMENT_PROVIDER %q", provider)
+	}
+
+	// Per-operation deadlines on every Stripe call, mock included
+	installStripeDeadlines(stripeTimeoutsFromEnv())
 
-	// Initialize Gin router
-	r := gin.Default()
+	// Postgres, Redis and the broker may still be starting alongside us
+	waitForDependencies(envDuration("STARTUP_WAIT_TIMEOUT", 2*time.Minute), envDuration("STARTUP_WAIT_MAX_BACKOFF", 10*time.Second))
 
-	// CORS middleware
-	r.Use(func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	// Local payment store, required for reporting
+	var store *Store
+	if dsn := regionEnv("DATABASE_URL"); dsn != "" {
+		pool := dbPoolConfigFromEnv()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		opened, err := OpenStore(ctx, dsn, pool)
+		cancel()
+		if err != nil {
+			log.Fatalf("Opening store: %v", err)
+		}
+		defer opened.Close()
+		store = opened
+		store.RegisterPoolMetrics()
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
+		// Lists, reports and status lookups read from the replica while
+		// it keeps up
+		if replicaDSN := regionEnv("DATABASE_REPLICA_URL"); replicaDSN != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := store.AttachReplica(ctx, replicaDSN, pool, envDuration("DATABASE_REPLICA_MAX_LAG", 10*time.Second))
+			cancel()
+			if err != nil {
+				log.Fatalf("Opening replica: %v", err)
+			}
+			go store.WatchReplica(context.Background(), envDuration("DATABASE_REPLICA_CHECK_INTERVAL", 5*time.Second))
 		}
+	} else {
+		log.Println("DATABASE_URL not set, local store and reports disabled")
+	}
+
+	// Payment and refund records: Postgres unless STORAGE_BACKEND picks
+	// another datastore
+	repoCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	paymentRepo, err := OpenPaymentRepository(repoCtx, os.Getenv("STORAGE_BACKEND"), store)
+	cancel()
+	if err != nil {
+		log.Fatalf("Opening payment repository: %v", err)
+	}
+	if backend := os.Getenv("STORAGE_BACKEND"); backend != "" && backend != "postgres" {
+		defer paymentRepo.Close()
+		log.Printf("STORAGE_BACKEND=%s, payment records kept there", backend)
+	}
+
+	// Service discovery for registration and calls to sibling services
+	discovery, err := NewDiscovery(os.Getenv("DISCOVERY_BACKEND"))
+	if err != nil {
+		log.Fatalf("Initializing service discovery: %v", err)
+	}
+	siblings := newDiscoveryTransport(discovery)
+
+	// In-process fan-out of webhook-driven status changes
+	hub := NewEventHub()
+
+	// Receipts and dunning emails are only sent when the mailer service is
+	// configured
+	var mailer *MailerClient
+	var receipts *ReceiptService
+	brand := os.Getenv("RECEIPT_BRAND_NAME")
+	if brand == "" {
+		brand = "Sucify"
+	}
+	if mailerURL := serviceURL("MAILER_SERVICE_URL", "mailer-service", discovery); mailerURL != "" {
+		mailer = NewMailerClient(mailerURL, os.Getenv("MAILER_SERVICE_TOKEN"), siblings)
+		mailer.store = store
+		receipts = NewReceiptService(mailer, brand, os.Getenv("RECEIPT_TEMPLATE_DIR"))
+	} else {
+		log.Println("MAILER_SERVICE_URL not set and discovery disabled, receipts and dunning emails disabled")
+	}
+
+	// Event transport shared by everything that publishes to the broker
+	publisher, err := NewPublisher(context.Background(), os.Getenv("EVENT_TRANSPORT"))
+	if err != nil {
+		log.Fatalf("Event transport: %v", err)
+	}
+	defer publisher.Close()
+
+	// Failed webhook events, publishes and merchant deliveries kept for
+	// an operator to retry or discard
+	deadLetters := NewDeadLetters(store, publisher, os.Getenv("DLQ_TOPIC"))
+	publisher = deadLetterPublisher{Publisher: publisher, dl: deadLetters}
+
+	// Analytics events for the data warehouse
+	analyticsTopic := os.Getenv("ANALYTICS_TOPIC")
+	if analyticsTopic == "" {
+		analyticsTopic = "warehouse.payments.events"
+	}
+	sampleRate := 1.0
+	if v := os.Getenv("ANALYTICS_SAMPLE_RATE"); v != "" {
+		if sampleRate, err = strconv.ParseFloat(v, 64); err != nil {
+			log.Fatalf("Invalid ANALYTICS_SAMPLE_RATE: %v", err)
+		}
+	}
+	analytics := NewAnalyticsEmitter(publisher, analyticsTopic, os.Getenv("ANALYTICS_SALT"), sampleRate, os.Getenv("ANALYTICS_SAMPLE_RATES"))
+
+	// Finance exports; download links are signed so they can be shared
+	// without auth
+	exportDir := os.Getenv("EXPORT_DIR")
+	if exportDir == "" {
+		exportDir = os.TempDir()
+	}
+	exportKey := []byte(os.Getenv("EXPORT_SIGNING_KEY"))
+	if len(exportKey) == 0 {
+		exportKey = make([]byte, 32)
+		if _, err := rand.Read(exportKey); err != nil {
+			log.Fatalf("Generating export signing key: %v", err)
+		}
+		log.Println("EXPORT_SIGNING_KEY not set, download links will not survive a restart")
+	}
+	exporter := NewExporter(store, exportDir, exportKey, os.Getenv("PUBLIC_BASE_URL"), 31*24*time.Hour, 24*time.Hour)
+
+	// Feature flags for per-tenant and percentage rollouts
+	flags, err := NewFlags(os.Getenv("FEATURE_FLAG_PROVIDER"))
+	if err != nil {
+		log.Fatalf("Initializing feature flags: %v", err)
+	}
+
+	// Reloadable runtime settings (SIGHUP or POST /admin/config/reload)
+	settings, err := LoadRuntimeSettings(os.Getenv("RUNTIME_CONFIG_FILE"))
+	if err != nil {
+		log.Fatalf("Loading runtime config: %v", err)
+	}
+	settings.OnReload(flags.Reload)
+	settings.ReloadOnSIGHUP()
+
+	// A share of live payments sent to an alternate provider account, and
+	// a sample mirrored to a provider under evaluation
+	routing := NewProviderRouting(store, settings,
+		envDuration("ROUTING_STATS_INTERVAL", 5*time.Minute), envDuration("ROUTING_STATS_LOOKBACK", 30*24*time.Hour))
+	installShadowProvider(settings)
 
-		c.Next()
+	// A sample of reads compared with the Stripe API version to upgrade to
+	installAPIVersionShadow(settings, mock == nil)
+
+	// Payment and refund calls in flight, drained on shutdown
+	inflight := installInflightTracking()
+
+	// Each tenant's share of the Stripe account's rate limit
+	installTenantLimits(settings)
+
+	// Fee estimates for dry runs
+	fees := feeScheduleFromEnv()
+
+	// Error reporting for panics and other failures on-call should see
+	reporter, err := NewErrorReporter(os.Getenv("ERROR_REPORTER"), os.Getenv("SENTRY_DSN"), os.Getenv("SENTRY_ENVIRONMENT"))
+	if err != nil {
+		log.Fatalf("Error reporter: %v", err)
+	}
+	defer reporter.Flush(2 * time.Second)
+
+	// Initialize Gin router; access logs are structured JSON on stdout, and
+	// panics become 500s that still carry a request ID and reach the log
+	r := gin.New()
+	r.Use(requestID(), accessLog(slog.New(slog.NewJSONHandler(os.Stdout, nil))), recovery(reporter))
+
+	// Routes under the runtime config's SLOs count toward their error
+	// budgets, shed requests included
+	slos := NewSLOs(settings, reporter, envDuration("SLO_EVAL_INTERVAL", 30*time.Second))
+	r.Use(slos.Middleware())
+	go slos.Run(context.Background())
+
+	// CORS and per-IP rate limits follow the runtime config; under
+	// overload, polls are shed first so payment creation keeps up
+	shedder := NewLoadShedder(envInt("LOAD_SHED_MAX_IN_FLIGHT", 512), envDuration("LOAD_SHED_TARGET_LATENCY", 750*time.Millisecond))
+	r.Use(settings.CORS(), shedder.Middleware(), settings.RateLimit())
+
+	// Lists, exports and reports run to megabytes of JSON and CSV
+	r.Use(compression(compressionEncodingsFromEnv(), envInt("COMPRESSION_MIN_BYTES", 1024)))
+
+	// Unknown routes get problem documents like every other error
+	r.HandleMethodNotAllowed = true
+	r.NoRoute(func(c *gin.Context) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "No route for "+c.Request.Method+" "+c.Request.URL.Path))
+	})
+	r.NoMethod(func(c *gin.Context) {
+		c.JSON(http.StatusMethodNotAllowed, errorBody(c, CodeInvalidRequest, "Method "+c.Request.Method+" not allowed on "+c.Request.URL.Path))
 	})
+	r.GET("/errors/:code", errorTypeDocs)
+	RegisterMetricsRoute(r)
 
 	// Root endpoint
 	r.GET("/", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
+		respondData(c, http.StatusOK, gin.H{
 			"message": "Payment Service API",
 			"version": "1.0.0",
+			// Send API-Version: 2 for the {data, meta, errors} envelope
+			"api_versions": []int{1, latestAPIVersion},
+			// The Stripe API version the service is pinned to
+			"stripe_api_version": stripeAPIVersion,
 			"endpoints": []string{
 				"GET /health - Health check",
-				"POST /payment/create - Create payment intent",
+				"GET /readyz - Readiness: database and payment provider health",
+				"GET /errors/:code - Documentation for an error type",
+				"GET /metrics - Prometheus metrics",
+				"POST /payment/create - Create payment intent (?dry_run=true to preview, ?async=true&callback_url= to queue; with REGION set, other regions' payments are forwarded there)",
+				"POST /payment/quote - Full price breakdown of a payment without creating it; pass its id as quote_id to payment creation",
+				"POST /fx/lock, GET /fx/quotes/:id - Lock an exchange rate, then pass fx_quote_id to payment creation",
+				"GET /jobs/:id - Async payment status",
+				"POST /payments/batch - Create up to BATCH_MAX_ITEMS payments, with per-item results",
+				"GET /payment/capabilities?currency= - Payment methods and amount limits for checkout",
 				"GET /payment/:id - Get payment status",
+				"GET /payment/:id/fees - Provider fees and net revenue of a payment (?refresh=true to re-read)",
+				"GET /payment/:id/history - A payment's lifecycle state and the transitions it went through",
+				"GET /payment/:id/timeline - Everything that happened to a payment, in order (?kind= to filter)",
+				"GET /payment/:id/changes, /payment/:id/as-of?at= - A payment's append-only event stream, and the payment rebuilt from it as of any time",
+				"GET /payment/:id/events - Stream payment status (SSE)",
+				"GET /payment/:id/ws - Stream payment status (WebSocket)",
+				"POST /payment/:id/receipt - Resend payment receipt (receipts scope to send it to another email)",
+				"POST /documents - Signed link to a receipt or invoice PDF of a payment or Stripe invoice (documents scope)",
+				"GET /documents/:kind/:id - Download a receipt or invoice PDF through its signed link",
+				"POST /receipts/links - Signed link customers open to see a receipt and its refunds (receipts scope)",
+				"GET /receipts/:token - Receipt and refund status through its signed link, no login needed",
+				"POST /payment/:id/tip - Change the tip before capture",
+				"POST /payment/:id/increment - Raise an authorized payment to a higher total where the card allows",
+				"POST /payment/:id/capture - Capture a manually captured payment with its tip",
+				"POST /payment/:id/captures, GET /payment/:id/captures, POST /payment/:id/captures/release - Capture an authorization per shipment, recharging the saved card where it can't be captured more than once",
+				"POST /payment/:id/extended-hold, GET /authorization-holds, GET /authorization-holds/:id, POST /authorization-holds/:id/capture|release - Hold an authorization past its network expiry by re-authorizing it",
+				"POST /wallets, GET /wallets/:id, GET /wallets/:id/transactions - Customer wallets and history (wallets scope)",
+				"POST /wallets/:id/top-ups - Top up a wallet by card (wallets scope)",
+				"POST /wallets/:id/checkout - Pay from a wallet, optionally with a card for the rest (wallets scope)",
+				"POST /gift-cards/lookup, /gift-cards/redeem - Gift card balance and redemption, optionally with a card for the rest",
+				"POST /escrows, GET /escrows/:id - Marketplace payments held until release (escrow scope)",
+				"POST /escrows/:id/delivery - Delivery confirmation; releases the seller's share",
+				"GET /subscriptions/:id/dunning - Dunning state and history of a subscription",
+				"GET /payment/:id/retry - Off-session retry state of a declined payment",
+				"POST /checkout/sessions, GET /checkout/sessions/:id - Resumable checkout sessions",
+				"POST /checkout/sessions/:id/payment-method, /cancel - Pick a payment method, or abandon the checkout",
+				"GET /checkout/sessions/:id/events - Checkout funnel history",
+				"GET, PUT /customers/:id/payment-retries - Customer opt-out from payment retries",
+				"GET /customers/:id/points, /customers/:id/points/transactions - Loyalty points balance and history",
+				"POST, GET /customers/:id/tax-ids - Customer tax IDs, with VAT numbers checked against VIES",
+				"POST /customers/:id/tax-ids/:tax_id/verify, DELETE /customers/:id/tax-ids/:tax_id - Re-check or remove a tax ID",
+				"POST /customers/:id/portal-session - Stripe billing portal session for the customer to manage cards, invoices and subscriptions",
+				"POST /payment-plans/preview, /payment-plans, GET /payment-plans/:id - Installment plans (payment_plans scope)",
+				"PUT /payment-plans/:id/payment-method, POST /payment-plans/:id/payoff, /cancel - Change card, pay off early, or cancel a plan",
+				"POST /billing/plans, GET /billing/plans/:id - Plans for subscriptions billed by the service (billing scope)",
+				"POST /billing/subscriptions, GET, POST, DELETE /billing/subscriptions/:id - Create, update or cancel a subscription",
+				"POST /billing/subscriptions/:id/preview-change - Prorated credit and charge of a plan or quantity change, before making it",
+				"POST /billing/subscriptions/:id/trial - Extend a trial, or end it now and charge the first invoice",
+				"GET /billing/subscriptions/:id/invoices - A subscription's invoices, their lines and charge attempts",
+				"POST, GET /billing/subscriptions/:id/usage - Report usage for a metered subscription, or see the current period's",
+				"POST /billing/usage - Report up to USAGE_BATCH_MAX_ITEMS usage records, with per-record results",
+				"POST, GET /vault/payment-methods, GET, DELETE /vault/payment-methods/:id - Saved payment methods mapped to provider tokens (vault scope)",
+				"PUT /vault/payment-methods/:id/tokens/:provider - Add or replace a provider's token for a vaulted payment method",
+				"POST /tokenize/card - Exchange raw card details for a payment method token (tokenize scope)",
+				"GET /privacy/customers/:id/export, POST /privacy/customers/:id/delete - Export or erase a customer's data (privacy scope)",
+				"GET /privacy/requests, /privacy/requests/:id - Audit log of data subject requests",
+				"POST /admin/retention/run (?dry_run=true to count), GET /admin/retention/archive/:source/:id - Data retention sweeps and archived payments and refunds",
+				"POST /webhook - Stripe webhook receiver",
+				"POST, GET /merchant-webhooks/endpoints, GET, PUT, DELETE /merchant-webhooks/endpoints/:id, POST /merchant-webhooks/endpoints/:id/rotate-secret - Tenants' signed webhook endpoints (webhooks scope)",
+				"GET /merchant-webhooks/deliveries, /merchant-webhooks/deliveries/:id, /merchant-webhooks/attempts, POST /merchant-webhooks/deliveries/:id/redeliver - Merchant webhook deliveries and attempt log",
+				"POST, GET /connect/accounts, GET /connect/accounts/:id - Sellers' Stripe connected accounts and onboarding status (connect scope)",
+				"POST /connect/accounts/:id/onboarding-link, POST /connect/accounts/:id/login-link - Hosted onboarding and Express dashboard links",
+				"GET /sellers/:id/requirements - A seller's verification requirements and restriction, for the seller dashboard",
+				"GET, PUT /sellers/:id/payout-schedule, GET /sellers/:id/balance, POST /sellers/:id/payouts - Seller payout schedules and on-demand payouts",
+				"GET /connect/payout-audit - Audit log of seller payouts and schedule changes",
+				"POST /sellers/:id/holds, GET /connect/holds, /connect/holds/:id, POST /connect/holds/:id/release - Holds keeping part of a seller's balance out of payouts",
+				"POST /mock/payment/:id/confirm - Drive a mock payment (PAYMENT_PROVIDER=mock only)",
+				"POST /sandbox/seed, /sandbox/reset - QA fixtures (test keys or PAYMENT_PROVIDER=mock only)",
+				"POST|GET /sandbox/test-clocks, GET|DELETE /sandbox/test-clocks/:id, POST /sandbox/test-clocks/:id/advance - Stripe test clocks (test keys or PAYMENT_PROVIDER=mock only)",
+				"/admin/* - Operational API (refunds, resync, webhook replay and handlers, API keys, gift cards, wallet adjustments, escrow holds and releases, loyalty point adjustments, dunning retries, payment retry cancellation, refund approvals, dispute evidence, fee sync, Stripe imports, provider routing report and decisions, payment change feed, read model status and rebuild, dead-letter queue, unconfirmed operations, SLO summary, event tail, flag evaluation, config reload)",
+				"GET /admin/dashboard/stats, /failed-payments, /disputes, /health - Ops dashboard: daily volume, success and refund rates, recent declines, open disputes, dead-letter depth and provider health",
+				"POST /refunds/bulk - Refund a list of payments, or those a filter matches, in the background (POST /refunds/bulk/import takes a CSV, ?dry_run=true previews it); GET /refunds/bulk/:id for progress and /refunds/bulk/:id/report for the CSV of outcomes",
+				"GET /payments, /refunds, /disputes - Filter (field=, field>=, field!=), sort, fields, limit/offset",
+				"GET /payments/export - Export payments or refunds as CSV/XLSX/NDJSON (payments:read scope)",
+				"GET /payments/export/:job_id - Asynchronous export status (payments:read scope)",
+				"GET /reports/payments - Payment totals grouped by day/week/currency/status/method/tenant",
+				"GET /reports/customer-ltv, /customers/:id/ltv - Customers' lifetime value per currency",
+				"GET /reports/refunds - Refund totals grouped by day/week/currency/status/method/tenant",
+				"GET /reports/fees - Provider fees and net revenue grouped by day/week/month/currency/provider/type/tenant",
+				"GET /reports/chargeback-risk - Dispute rates grouped by day/week/month/currency/tenant/method/bin/brand/country",
+				"GET /reports/chargeback-risk/flagged - Payments flagged as resembling earlier chargebacks",
+				"GET, POST /fraud/lists, DELETE /fraud/lists/:id - Blocked and allowed cards, emails, customers, IPs and BINs (fraud scope)",
+				"GET /fraud/lists/changes - Audit log of fraud list changes",
+				"GET /fraud/lists/export, POST /fraud/lists/import - Fraud lists as CSV",
+				"GET /admin/payment-reviews, GET /admin/payment-reviews/:id - Flagged payments held for review (payments:review scope)",
+				"POST /admin/payment-reviews/:id/approve, POST /admin/payment-reviews/:id/decline - Capture or cancel a held payment",
+				"POST /risk/evaluate - Dry-run a payment through the risk rules, or rules given (fraud scope)",
+				"GET /reports/settlements/:payout_id - Payout reconciliation against local records",
+				"POST /graphql - Federated GraphQL subgraph",
 			},
 		})
 	})
 
 	// Health check endpoint
 	r.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
+		respondData(c, http.StatusOK, gin.H{
 			"status":  "healthy",
 			"service": "payment-service",
 		})
 	})
 
+	// Readiness, from the database and provider checks run in the background
+	providerHealth := NewProviderHealth(routing.alternateKey(), envDuration("PROVIDER_HEALTH_INTERVAL", 30*time.Second),
+		envDuration("PROVIDER_HEALTH_TIMEOUT", 5*time.Second), envInt("PROVIDER_HEALTH_FAILURES", 3))
+	go providerHealth.Run(context.Background())
+	r.GET("/readyz", readyz(store, providerHealth))
+
+	// Per-tenant amount and currency rules, checked before Stripe
+	policies := NewPolicyEngine(settings, store)
+	// Promotions, applied server-side to the subtotal
+	discounts := NewDiscountEngine(settings, store)
+	// Loyalty points, earned on payments and spent as partial tender
+	loyalty := NewLoyalty(store, settings)
+	loyalty.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	paymentsSvc := NewPaymentService(settings, flags, policies, discounts, loyalty, store, analytics)
+	paymentsSvc.payments = paymentRepo
+
+	// Custom lifecycle logic: compiled-in plugins and HTTP hooks
+	lifecycleHooks = NewLifecycleHooks(settings, os.Getenv("LIFECYCLE_HOOK_SECRET"))
+
+	// Data residency: payments of other regions are forwarded there, or
+	// refused
+	var residency *Residency
+	if serviceRegion != "" {
+		endpoints, err := parseRegionEndpoints(os.Getenv("REGION_ENDPOINTS"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		residency = NewResidency(settings, endpoints)
+		paymentsSvc.residency = residency
+		log.Printf("REGION=%s, payments are kept in their customer's region", serviceRegion)
+	}
+
+	// Velocity rules against card testing, counted in Redis
+	var redis *Redis
+	if raw := regionEnv("REDIS_URL"); raw != "" {
+		redis, err = NewRedis(raw, envDuration("REDIS_TIMEOUT", 250*time.Millisecond))
+		if err != nil {
+			log.Fatalf("Redis: %v", err)
+		}
+		defer redis.Close()
+		paymentsSvc.velocity = NewVelocity(redis, settings)
+	} else {
+		log.Println("REDIS_URL not set, velocity rules disabled and API key quotas counted per instance")
+	}
+
+	// Per-API-key request quotas, shared through Redis when it is set
+	apiKeyQuotas = NewAPIKeyQuotas(settings, redis)
+
+	// Access tokens from the identity provider, accepted wherever API keys are
+	oauth2Verifier = NewOAuth2VerifierFromEnv(settings)
+
+	// Fraud team block and allow lists, checked before payments are created
+	fraudLists := NewFraudLists(store, envInt("FRAUD_LIST_IMPORT_MAX_ROWS", 10000))
+	fraudLists.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	paymentsSvc.fraudLists = fraudLists
+
+	// Double submits on the same card, blocked or flagged per tenant
+	duplicates := NewDuplicatePayments(store, settings, hub)
+	paymentsSvc.duplicates = duplicates
+	paymentsSvc.routing = routing
+	if routing != nil {
+		routing.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+		go routing.Run(context.Background())
+	}
+
+	// Worker pool for ?async=true payments, polled at GET /jobs/:id
+	jobs := NewJobQueue(paymentsSvc, envInt("PAYMENT_JOB_WORKERS", 16), envInt("PAYMENT_JOB_QUEUE_DEPTH", 1000),
+		envDuration("PAYMENT_JOB_TTL", 24*time.Hour), os.Getenv("PAYMENT_JOB_CALLBACK_SECRET"))
+	jobs.RegisterRoutes(r)
+
 	// Create payment intent
-	r.POST("/payment/create", func(c *gin.Context) {
+	r.POST("/payment/create", residency.forward, func(c *gin.Context) {
 		var req PaymentRequest
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if !decodeJSON(c, &req) {
+			return
+		}
+		if fields := req.validate(); len(fields) > 0 {
+			validationFailed(c, fields)
 			return
 		}
+		req.fillDevice(c)
+		req.dryRun = isDryRun(c)
+
+		// Async payments outlive the request, so their Stripe call must too
+		async := c.Query("async") == "true"
+		ctx := c.Request.Context()
+		if async {
+			ctx = context.WithoutCancel(ctx)
+		}
 
-		params := &stripe.PaymentIntentParams{
-			Amount:   stripe.Int64(req.Amount),
-			Currency: stripe.String(req.Currency),
+		params, refused := paymentsSvc.Params(ctx, req)
+		if refused != nil {
+			c.JSON(refused.status, errorBodyWith(c, refused.code, refused.message, refused.ext))
+			return
 		}
 
-		if req.Description != "" {
-			params.Description = stripe.String(req.Description)
+		// Validated and priced, but nothing is sent to Stripe
+		if isDryRun(c) {
+			respondData(c, http.StatusOK, dryRunIntent(params.PaymentIntentParams, fees))
+			return
 		}
 
-		pi, err := paymentintent.New(params)
+		if async {
+			callbackURL := c.Query("callback_url")
+			if callbackURL != "" && !validCallbackURL(callbackURL) {
+				c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "callback_url must be an absolute http(s) URL"))
+				return
+			}
+			if callbackURL != "" && !resolvesPublic(c.Request.Context(), callbackURL) {
+				c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "callback_url must point to a public address"))
+				return
+			}
+			job, err := jobs.Submit(req, params, c.GetHeader("Idempotency-Key"), callbackURL, requestLanguage(c))
+			if err != nil {
+				c.Header("Retry-After", "1")
+				c.JSON(http.StatusServiceUnavailable, errorBody(c, CodeProviderUnavailable, "Payment job queue is full"))
+				return
+			}
+			respondData(c, http.StatusAccepted, gin.H{
+				"job_id":     job.ID,
+				"status":     job.Status,
+				"status_url": "/jobs/" + job.ID,
+			})
+			return
+		}
+
+		pi, err := paymentsSvc.Create(c.Request.Context(), req, params, c.GetHeader("Idempotency-Key"))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			respondError(c, err)
+			return
+		}
+
+		if apiVersion(c) >= 2 {
+			respondData(c, http.StatusCreated, paymentData(pi, true))
 			return
 		}
 
 		response := PaymentResponse{
 			ClientSecret: pi.ClientSecret,
 			ID:           pi.ID,
+			DuplicateOf:  pi.Metadata[metadataDuplicateOf],
+			Region:       regionOf(pi),
+		}
+		if pi.Metadata[metadataProviderArm] == armAlternate {
+			response.PublishableKey = alternatePublishableKey
 		}
 
-		c.JSON(http.StatusOK, response)
+		respondData(c, http.StatusOK, response)
 	})
 
-	// Get payment status
-	r.GET("/payment/:id", func(c *gin.Context) {
-		paymentID := c.Param("id")
+	// Price breakdowns checkout frontends show, then redeem at creation
+	NewPaymentQuotes(store, settings, paymentsSvc, fees).RegisterRoutes(r, residency)
 
-		pi, err := paymentintent.Get(paymentID, nil)
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+	// Batch creation for invoicing runs
+	NewBatchCreator(paymentsSvc, fees, envInt("BATCH_MAX_ITEMS", 500), envInt("BATCH_PARALLELISM", 8)).RegisterRoutes(r)
+
+	// What checkout can offer per currency, cached from Stripe
+	NewCapabilityCache(envDuration("CAPABILITIES_REFRESH_INTERVAL", time.Hour)).RegisterRoutes(r, settings, flags)
+
+	// Get payment status; pollers revalidate with If-None-Match
+	payments := NewPaymentCache(envDuration("PAYMENT_CACHE_TTL", 5*time.Second), hub)
+	r.GET("/payment/:id", payments.Status)
+
+	// Real-time payment status streaming
+	r.GET("/payment/:id/events", paymentEventsSSE(hub))
+	r.GET("/payment/:id/ws", paymentEventsWS(hub))
+
+	// Receipt and invoice PDFs behind signed links, also attached to
+	// receipt emails when the tenant's invoice profile asks for them
+	documents := NewDocuments(store, settings, brand, exportKey, os.Getenv("PUBLIC_BASE_URL"), envDuration("DOCUMENT_LINK_TTL", 7*24*time.Hour))
+	documents.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	if receipts != nil {
+		receipts.documents = documents
+	}
+
+	// Receipt links customers open without logging in, put in receipt
+	// emails and handed out for texts
+	renderer := receipts
+	if renderer == nil {
+		renderer = NewReceiptService(nil, brand, os.Getenv("RECEIPT_TEMPLATE_DIR"))
+	}
+	receiptLinks := NewReceiptLinks(store, renderer, exportKey, os.Getenv("PUBLIC_BASE_URL"),
+		envDuration("RECEIPT_LINK_TTL", 30*24*time.Hour), envInt("RECEIPT_LOOKUP_RATE_PER_MINUTE", 30), envInt("RECEIPT_LOOKUP_RATE_BURST", 10))
+	receiptLinks.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	if receipts != nil {
+		receipts.links = receiptLinks
+	}
+
+	// Resend a receipt to the payment's receipt email or, with the receipts
+	// scope, to a different address
+	r.POST("/payment/:id/receipt", func(c *gin.Context) {
+		if receipts == nil {
+			c.JSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Receipts are not configured"))
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{
-			"id":     pi.ID,
-			"status": pi.Status,
-			"amount": pi.Amount,
-		})
+		var req struct {
+			Email string `json:"email"`
+		}
+		if c.Request.ContentLength > 0 {
+			if !bindJSON(c, &req) {
+				return
+			}
+		}
+
+		// Anyone may resend a receipt where it went; sending a payment's
+		// details elsewhere takes a key.
+		if req.Email != "" && !hasScope(c, store, os.Getenv("ADMIN_API_TOKEN"), "receipts") {
+			return
+		}
+		if err := receipts.Send(c.Request.Context(), c.Param("id"), req.Email); err != nil {
+			c.JSON(http.StatusBadGateway, errorBody(c, CodeUpstreamFailed, err.Error()))
+			return
+		}
+
+		respondData(c, http.StatusOK, gin.H{"sent": true})
 	})
 
-	// Start server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Tips adjusted and authorizations raised after authorization, and
+	// manual capture
+	tips := NewTips(store, settings)
+	tips.payments = paymentRepo
+	tips.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+	// Customer wallets, settled by the webhooks below
+	wallets := NewWallets(store, paymentsSvc)
+	wallets.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+	// Gift cards, with failed code lookups limited per client IP
+	giftCards := NewGiftCards(store, paymentsSvc,
+		envInt("GIFT_CARD_LOOKUP_MAX_FAILURES", 5), envDuration("GIFT_CARD_LOOKUP_WINDOW", 15*time.Minute))
+	giftCards.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+	// Marketplace escrow: seller shares are transferred on delivery or
+	// after the hold period, never with the charge
+	escrows := NewEscrows(store, paymentsSvc,
+		envDuration("ESCROW_RELEASE_AFTER", 14*24*time.Hour), envDuration("ESCROW_RELEASE_INTERVAL", time.Minute))
+	escrows.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	go escrows.Run(context.Background())
+
+	// Dunning for failed subscription invoices: retries on the tenant's
+	// schedule, customer emails, grace period, then cancellation
+	dunning := NewDunning(store, settings, mailer, brand, envDuration("DUNNING_INTERVAL", 5*time.Minute))
+	dunning.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	go dunning.Run(context.Background())
+
+	// Off-session retries of soft-declined payments on saved cards
+	retries := NewPaymentRetries(store, settings, envDuration("PAYMENT_RETRY_INTERVAL", time.Minute))
+	retries.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	go retries.Run(context.Background())
+
+	// Checkout sessions: the funnel from cart to payment, resumable until
+	// they expire
+	checkout := NewCheckout(store, paymentsSvc, analytics,
+		envDuration("CHECKOUT_SESSION_TTL", 24*time.Hour), envDuration("CHECKOUT_EXPIRY_INTERVAL", time.Minute))
+	checkout.RegisterRoutes(r)
+	go checkout.Run(context.Background())
+
+	// Payments the customer never completed, canceled past their TTL so
+	// their orders can be released
+	expiryTopic := os.Getenv("PAYMENT_EXPIRY_TOPIC")
+	if expiryTopic == "" {
+		expiryTopic = "payments.expired"
+	}
+	expiry := NewPaymentExpiry(store, hub, publisher, expiryTopic,
+		envDuration("PAYMENT_EXPIRY_TTL", 24*time.Hour), envDuration("PAYMENT_EXPIRY_INTERVAL", 10*time.Minute))
+	expiry.payments = paymentRepo
+	go expiry.Run(context.Background())
+
+	// Deposits and rental holds kept authorized past the card network's
+	// validity window
+	authHolds := NewAuthorizationHolds(store, settings, hub, envDuration("AUTHORIZATION_HOLD_INTERVAL", 15*time.Minute))
+	authHolds.payments = paymentRepo
+	authHolds.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	go authHolds.Run(context.Background())
+
+	// Orders shipped in parts, captured per shipment against one
+	// authorization or recharged to the saved card
+	splitCaptures := NewSplitCaptures(store, settings, hub, envDuration("SPLIT_CAPTURE_INTERVAL", 5*time.Minute))
+	splitCaptures.payments = paymentRepo
+	splitCaptures.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	go splitCaptures.Run(context.Background())
+
+	// Locked exchange rates for cross-currency checkout, accepted as
+	// fx_quote_id at payment creation
+	var fixedRates map[string]float64
+	if mock != nil {
+		fixedRates = mockFXRates
+	}
+	fxRates := NewFXRates(os.Getenv("FX_RATES_URL"), envDuration("FX_RATES_REFRESH_INTERVAL", 5*time.Minute),
+		envDuration("FX_RATES_MAX_AGE", time.Hour), fixedRates)
+	NewFXQuotes(store, settings, fxRates).RegisterRoutes(r)
+
+	// Saved payment methods under our own IDs, mapped to provider tokens
+	NewVault(store).RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+	// Installment and layaway plans charged on a schedule
+	plans := NewPaymentPlans(store, settings, paymentsSvc, envDuration("PAYMENT_PLAN_INTERVAL", time.Minute))
+	plans.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	go plans.Run(context.Background())
+
+	// Recurring billing run by the service, for providers without native
+	// subscriptions
+	billingTopic := os.Getenv("BILLING_EVENTS_TOPIC")
+	if billingTopic == "" {
+		billingTopic = "payments.billing"
 	}
+	billing := NewBilling(store, settings, paymentsSvc, publisher, billingTopic, envDuration("BILLING_INTERVAL", time.Minute),
+		envInt("USAGE_BATCH_MAX_ITEMS", 1000))
+	billing.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	go billing.Run(context.Background())
+
+	// Customers' tax IDs, checked against VIES, which make payments to
+	// businesses reverse-charged or zero-rated
+	var vies vatChecker = NewVIES(os.Getenv("VIES_URL"))
+	if mock != nil {
+		vies = mockVIES{}
+	}
+	taxIDs := NewTaxIDs(store, settings, vies, envDuration("TAX_ID_RECHECK_INTERVAL", 15*time.Minute))
+	taxIDs.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	go taxIDs.Run(context.Background())
+
+	// Stripe's billing portal, for customers to manage cards, invoices and
+	// subscriptions themselves
+	NewBillingPortal(store, settings).RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
 
+	// Raw card exchange for internal tools that can't use Stripe Elements
+	NewCardTokenizer(store, envInt("TOKENIZE_RATE_PER_MINUTE", 60), envInt("TOKENIZE_RATE_BURST", 10),
+		os.Getenv("TOKENIZE_REQUIRE_TLS") != "false").RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+	// Chargeback risk: dispute rates per tenant, method and BIN, flags on
+	// payments like earlier chargebacks, and network threshold warnings
+	riskTopic := os.Getenv("CHARGEBACK_RISK_TOPIC")
+	if riskTopic == "" {
+		riskTopic = "payments.chargeback_risk"
+	}
+	chargebackRisk := NewChargebackRisk(store, settings, hub, publisher, riskTopic,
+		envDuration("CHARGEBACK_RISK_INTERVAL", time.Hour))
+	chargebackRisk.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	go chargebackRisk.Run(context.Background())
+
+	// Flagged payments held uncaptured for reviewers, canceled past the SLA
+	reviews := NewPaymentReviews(store, settings, hub, envDuration("PAYMENT_REVIEW_INTERVAL", time.Minute))
+	reviews.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	paymentsSvc.reviews = reviews
+	go reviews.Run(context.Background())
+
+	// Declarative risk rules from the runtime config, with a dry run
+	riskEngine := NewRiskEngine(store, settings, paymentsSvc)
+	riskEngine.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	paymentsSvc.risk = riskEngine
+
+	// Data subject requests: a customer's data exported, or erased along
+	// with their Stripe customer
+	NewPrivacy(store).RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+	// Retention: PII anonymized and old payments archived per tenant policy
+	retention := NewRetention(store, settings, envDuration("RETENTION_INTERVAL", 24*time.Hour))
+	retention.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	go retention.Run(context.Background())
+
+	// Tenants' own webhook endpoints for their payment events
+	merchantWebhooks := NewMerchantWebhooks(store, hub, envDuration("MERCHANT_WEBHOOK_INTERVAL", 10*time.Second),
+		envInt("MERCHANT_WEBHOOK_MAX_ATTEMPTS", 16))
+	merchantWebhooks.deadLetters = deadLetters
+	merchantWebhooks.sandbox = sandboxMode(mock)
+	merchantWebhooks.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	go merchantWebhooks.Run(context.Background())
+
+	// Marketplace sellers onboarded as Stripe connected accounts, with
+	// seller.restricted on the broker when Stripe holds their charges or
+	// payouts
+	connectTopic := os.Getenv("CONNECT_EVENTS_TOPIC")
+	if connectTopic == "" {
+		connectTopic = "payments.connect"
+	}
+	connect := NewConnect(store, publisher, connectTopic)
+	connect.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	NewSellerPayouts(store, settings, connect).RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	NewBalanceHolds(store).RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+	// Stripe webhooks, each delivery kept in the webhook event store
+	webhookEvents := NewWebhookEvents(store, envDuration("WEBHOOK_EVENT_RETENTION", 90*24*time.Hour))
+	webhookEvents.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	go webhookEvents.Prune(context.Background())
+	webhooks := &WebhookHandler{
+		Secret:          webhookSecret,
+		ConnectSecret:   regionEnv("STRIPE_CONNECT_WEBHOOK_SECRET"),
+		AlternateSecret: os.Getenv("ALT_STRIPE_WEBHOOK_SECRET"),
+		Hub:             hub,
+		Receipts:        receipts,
+		Analytics:       analytics,
+		Store:           store,
+		Payments:        paymentRepo,
+		Wallets:         wallets,
+		GiftCards:       giftCards,
+		Escrows:         escrows,
+		Dunning:         dunning,
+		Retries:         retries,
+		Checkout:        checkout,
+		Plans:           plans,
+		Billing:         billing,
+		Risk:            chargebackRisk,
+		Loyalty:         loyalty,
+		Duplicates:      duplicates,
+		Reviews:         reviews,
+		Connect:         connect,
+		AuthHolds:       authHolds,
+		Routing:         routing,
+		DeadLetters:     deadLetters,
+		Events:          webhookEvents,
+		DedupeTTL:       envDuration("WEBHOOK_DEDUPE_TTL", webhookDedupeTTL),
+	}
+	webhooks.Pool = NewWebhookPool(envInt("WEBHOOK_WORKERS", 32), envInt("WEBHOOK_QUEUE_DEPTH", 100), webhooks.handleEvent)
+	r.POST("/webhook", webhooks.Handle)
+	deadLetters.webhooks, deadLetters.merchant = webhooks, merchantWebhooks
+	deadLetters.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+	// Aggregates for the internal ops dashboard
+	NewDashboard(store, providerHealth).RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+	// Payment and refund calls an earlier shutdown cut off
+	if store != nil {
+		registerUnconfirmedRoutes(r, store, os.Getenv("ADMIN_API_TOKEN"))
+		go ResolveUnconfirmed(context.Background(), store, webhooks)
+	}
+
+	// Lifecycle controls for the mock provider
+	if mock != nil {
+		mock.RegisterRoutes(r)
+	}
+
+	// QA fixtures, refused unless on test keys or the mock provider
+	sandbox := &Sandbox{Store: store, Payments: paymentRepo, Mock: mock}
+	sandbox.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+	// Dispute evidence, with service logs from the order service when it
+	// is configured, and deadline reminders on the broker
+	var orders *OrderClient
+	if orderURL := serviceURL("ORDER_SERVICE_URL", "order-service", discovery); orderURL != "" {
+		orders = NewOrderClient(orderURL, os.Getenv("ORDER_SERVICE_TOKEN"), siblings)
+	} else {
+		log.Println("ORDER_SERVICE_URL not set and discovery disabled, dispute service logs disabled")
+	}
+	disputeTopic := os.Getenv("DISPUTE_EVENTS_TOPIC")
+	if disputeTopic == "" {
+		disputeTopic = "payments.disputes"
+	}
+	disputeEvidence := NewDisputeEvidence(store, orders, settings, hub, publisher, disputeTopic,
+		envDuration("DISPUTE_REMINDER_INTERVAL", 15*time.Minute))
+	disputeEvidence.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	go disputeEvidence.Run(context.Background())
+
+	// Refunds above the refund_approval thresholds wait for a second key
+	approvals := NewRefundApprovals(store, settings)
+	approvals.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+	// Refunds of many payments at once, by ID list or payments filter
+	bulkRefunds := NewBulkRefunds(store, settings, envDuration("BULK_REFUND_INTERVAL", 10*time.Second),
+		envInt("BULK_REFUND_WORKERS", 4), envInt("BULK_REFUND_MAX_ITEMS", 50000))
+	bulkRefunds.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	go bulkRefunds.Run(context.Background())
+
+	// Operational API for paymentctl
+	admin := &AdminAPI{Store: store, Payments: paymentRepo, Hub: hub, Webhooks: webhooks, Flags: flags, Fees: fees, Settings: settings, Approvals: approvals}
+	admin.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+	slos.RegisterRoutes(r, store, os.Getenv("ADMIN_API_TOKEN"))
+
+	// Payment and refund exports
+	exporter.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+	// Read models projected from payment events, for lists and reports
+	var readModels *ReadModels
+	if store != nil {
+		readModels = NewReadModels(store, envDuration("READ_MODEL_INTERVAL", 5*time.Second))
+		readModels.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+		go readModels.Run(context.Background())
+	}
+
+	// Aggregate reports and filterable lists from the local store
+	RegisterReportRoutes(r, store, readModels, os.Getenv("ADMIN_API_TOKEN"))
+	RegisterListRoutes(r, store, readModels, os.Getenv("ADMIN_API_TOKEN"))
+
+	// Payout reconciliation needs the local store to match against
+	if store != nil {
+		reconciler := NewReconciler(store,
+			envDuration("SETTLEMENT_RECONCILE_INTERVAL", 6*time.Hour),
+			envDuration("SETTLEMENT_LOOKBACK", 30*24*time.Hour))
+		reconciler.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+		go reconciler.Run(context.Background())
+
+		// Provider fees per payment, from balance transactions
+		feeTracker := NewFeeTracker(store, envDuration("FEE_SYNC_INTERVAL", time.Hour), envDuration("FEE_SYNC_LOOKBACK", 72*time.Hour))
+		feeTracker.altKey = routing.alternateKey()
+		feeTracker.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+		go feeTracker.Run(context.Background())
+
+		// Lifecycle state transitions per payment
+		NewPaymentStates(store).RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+		// Webhooks, transitions, refunds, disputes, emails and admin
+		// actions merged per payment, for support
+		NewPaymentTimelines(store).RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+		// Payments' event streams, for audit, temporal queries and projections
+		NewPaymentEventStore(store).RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+
+		// Backfill of payments taken before the local store existed
+		imports := NewStripeImports(store, envDuration("STRIPE_IMPORT_INTERVAL", 30*time.Second))
+		imports.payments = paymentRepo
+		imports.RegisterRoutes(r, os.Getenv("ADMIN_API_TOKEN"))
+		go imports.Run(context.Background())
+	} else {
+		notConfigured := func(c *gin.Context) {
+			c.JSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Reports require DATABASE_URL"))
+		}
+		r.GET("/reports/settlements/:payout_id", notConfigured)
+		r.GET("/payment/:id/fees", notConfigured)
+		r.GET("/payment/:id/history", notConfigured)
+		r.GET("/payment/:id/timeline", notConfigured)
+		r.GET("/payment/:id/changes", notConfigured)
+		r.GET("/payment/:id/as-of", notConfigured)
+	}
+
+	// GraphQL subgraph for the federation gateway
+	gql := handler.NewDefaultServer(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+	gql.SetErrorPresenter(graphQLErrorPresenter)
+	r.POST("/graphql", gin.WrapH(gql))
+	r.GET("/graphql", gin.WrapH(gql))
+
+	// Register with discovery; Consul also reaps us via the health check
+	// if we die without deregistering
+	deregister, err := registerSelf(discovery, port)
+	if err != nil {
+		log.Fatalf("Registering with service discovery: %v", err)
+	}
+
+	// gRPC API for internal consumers: payment lookups and events as they
+	// happen, also served as REST under /v1 through the gateway
+	var grpcServer *grpc.Server
+	if grpcPort := os.Getenv("GRPC_PORT"); grpcPort != "" {
+		grpcServer = newGRPCServer(hub, store, payments, providerHealth, os.Getenv("ADMIN_API_TOKEN"))
+		go serveGRPC(":"+grpcPort, grpcServer)
+
+		gateway, err := newGRPCGateway(context.Background(), "localhost:"+grpcPort)
+		if err != nil {
+			log.Fatalf("gRPC gateway: %v", err)
+		}
+		r.Any("/v1/*path", grpcGatewayHandler(gateway))
+	}
+
+	// Start server
 	log.Printf("Payment service starting on port %s", port)
-	log.Fatal(r.Run(":" + port))
+	serverCfg := serverConfigFromEnv()
+	if err := serve(":"+port, r, serverCfg, deregister); err != nil {
+		log.Fatal(err)
+	}
+
+	// Watchers reconnect to another instance
+	if grpcServer != nil {
+		grpcServer.Stop()
+	}
+
+	// Let queued webhook events and async payments finish within the same
+	// grace period
+	ctx, cancel := context.WithTimeout(context.Background(), serverCfg.ShutdownGrace)
+	webhooks.Pool.Shutdown(ctx)
+	jobs.Shutdown(ctx)
+	inflight.Drain(ctx, store)
+	cancel()
+}
+
+// envDuration reads a Go duration (e.g. "90s", "6h") from the environment.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return d
+}
+
+// envInt reads an integer from the environment.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return n
 }
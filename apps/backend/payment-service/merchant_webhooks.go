@@ -0,0 +1,868 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var merchantWebhookAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_merchant_webhook_attempts_total",
+	Help: "Merchant webhook delivery attempts by outcome (succeeded, retrying, failed).",
+}, []string{"outcome"})
+
+// merchantWebhookScope lets an API key manage tenants' webhook endpoints
+// and their deliveries.
+const merchantWebhookScope = "webhooks"
+
+// merchantWebhookSecretPrefix starts every endpoint's signing secret.
+const merchantWebhookSecretPrefix = "mwhsec_"
+
+// Endpoint statuses. A disabled endpoint gets no new deliveries, and its
+// pending ones wait until it is enabled again.
+const (
+	merchantEndpointEnabled  = "enabled"
+	merchantEndpointDisabled = "disabled"
+)
+
+// Delivery statuses. A pending delivery is retried with exponential
+// backoff until it succeeds or runs out of attempts and fails; canceled
+// ones belonged to an endpoint that was deleted.
+const (
+	merchantDeliveryPending   = "pending"
+	merchantDeliverySucceeded = "succeeded"
+	merchantDeliveryFailed    = "failed"
+	merchantDeliveryCanceled  = "canceled"
+)
+
+const (
+	// merchantWebhookLease is how long a claimed delivery is held before
+	// another worker may take it, well over merchantWebhookTimeout.
+	merchantWebhookLease = 2 * time.Minute
+	// merchantWebhookTimeout bounds a single attempt.
+	merchantWebhookTimeout = 10 * time.Second
+	// merchantWebhookBackoff is the wait after the first failure; it
+	// doubles with each further one, up to merchantWebhookMaxBackoff.
+	merchantWebhookBackoff    = 30 * time.Second
+	merchantWebhookMaxBackoff = 6 * time.Hour
+	// merchantWebhookRotationGrace is how long the previous secret keeps
+	// signing after a rotation, so receivers can switch without gaps.
+	merchantWebhookRotationGrace = 24 * time.Hour
+	// merchantWebhookResponseMax is how much of a receiver's response is
+	// kept in the attempt log.
+	merchantWebhookResponseMax = 1024
+)
+
+// merchantEventPattern is an event type such as payment_intent.succeeded,
+// or * for all of them.
+var merchantEventPattern = regexp.MustCompile(`^(\*|[a-z_]+(\.[a-z_]+)+)$`)
+
+// MerchantWebhookEndpoint is where a tenant receives its payment events.
+// Events lists the types sent; empty means all of them. Secret is only
+// shown when it is created or rotated.
+type MerchantWebhookEndpoint struct {
+	ID          string    `json:"id"`
+	TenantID    string    `json:"tenant_id"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Description string    `json:"description,omitempty"`
+	Status      string    `json:"status"`
+	Secret      string    `json:"secret,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	secret         string
+	previousSecret string
+	previousUntil  *time.Time
+}
+
+// subscribed reports whether the endpoint takes events of type typ.
+func (e *MerchantWebhookEndpoint) subscribed(typ string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, want := range e.Events {
+		if want == "*" || want == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// secrets are the secrets a delivery is signed with now: the current one
+// and, during a rotation's grace period, the previous one.
+func (e *MerchantWebhookEndpoint) secrets(now time.Time) []string {
+	secrets := []string{e.secret}
+	if e.previousSecret != "" && e.previousUntil != nil && now.Before(*e.previousUntil) {
+		secrets = append(secrets, e.previousSecret)
+	}
+	return secrets
+}
+
+const merchantEndpointColumns = `id, tenant_id, url, events, description, status, secret, previous_secret,
+	previous_secret_expires_at, created_at, updated_at`
+
+func scanMerchantEndpoint(row interface{ Scan(...interface{}) error }) (*MerchantWebhookEndpoint, error) {
+	var e MerchantWebhookEndpoint
+	var events string
+	var until sql.NullTime
+	if err := row.Scan(&e.ID, &e.TenantID, &e.URL, &events, &e.Description, &e.Status, &e.secret,
+		&e.previousSecret, &until, &e.CreatedAt, &e.UpdatedAt); err != nil {
+		return nil, err
+	}
+	e.Events = splitScopes(events)
+	e.previousUntil = timeOrNil(until)
+	return &e, nil
+}
+
+// MerchantWebhookDelivery is one event on its way to one endpoint.
+type MerchantWebhookDelivery struct {
+	ID             string          `json:"id"`
+	EndpointID     string          `json:"endpoint_id"`
+	TenantID       string          `json:"tenant_id"`
+	EventID        string          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+const merchantDeliveryColumns = `id, endpoint_id, tenant_id, event_id, event_type, payload, status, attempts,
+	next_attempt_at, last_status_code, last_error, delivered_at, created_at, updated_at`
+
+func scanMerchantDelivery(row interface{ Scan(...interface{}) error }) (*MerchantWebhookDelivery, error) {
+	var d MerchantWebhookDelivery
+	var payload []byte
+	var next, delivered sql.NullTime
+	if err := row.Scan(&d.ID, &d.EndpointID, &d.TenantID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts,
+		&next, &d.LastStatusCode, &d.LastError, &delivered, &d.CreatedAt, &d.UpdatedAt); err != nil {
+		return nil, err
+	}
+	d.Payload = payload
+	d.NextAttemptAt, d.DeliveredAt = timeOrNil(next), timeOrNil(delivered)
+	return &d, nil
+}
+
+// MerchantWebhookAttempt is one try at a delivery, for the attempt log.
+type MerchantWebhookAttempt struct {
+	DeliveryID string    `json:"delivery_id"`
+	Attempt    int       `json:"attempt"`
+	Manual     bool      `json:"manual"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Response   string    `json:"response,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+var merchantEndpointList = listResource{
+	from:   "merchant_webhook_endpoints e",
+	fields: []string{"id", "tenant_id", "url", "events", "description", "status", "created_at", "updated_at"},
+	columns: map[string]listField{
+		"id":          {"e.id", textField},
+		"tenant_id":   {"e.tenant_id", textField},
+		"url":         {"e.url", textField},
+		"events":      {"e.events", textField},
+		"description": {"e.description", textField},
+		"status":      {"e.status", textField},
+		"created_at":  {"e.created_at", timeField},
+		"updated_at":  {"e.updated_at", timeField},
+	},
+}
+
+// Deliveries without their payloads; GET .../deliveries/:id has it.
+var merchantDeliveryList = listResource{
+	from: "merchant_webhook_deliveries d",
+	fields: []string{"id", "endpoint_id", "tenant_id", "event_id", "event_type", "status", "attempts",
+		"next_attempt_at", "last_status_code", "last_error", "delivered_at", "created_at", "updated_at"},
+	columns: map[string]listField{
+		"id":               {"d.id", textField},
+		"endpoint_id":      {"d.endpoint_id", textField},
+		"tenant_id":        {"d.tenant_id", textField},
+		"event_id":         {"d.event_id", textField},
+		"event_type":       {"d.event_type", textField},
+		"status":           {"d.status", textField},
+		"attempts":         {"d.attempts", intField},
+		"next_attempt_at":  {"d.next_attempt_at", timeField},
+		"last_status_code": {"d.last_status_code", intField},
+		"last_error":       {"d.last_error", textField},
+		"delivered_at":     {"d.delivered_at", timeField},
+		"created_at":       {"d.created_at", timeField},
+		"updated_at":       {"d.updated_at", timeField},
+	},
+}
+
+// The attempt log, filterable by delivery_id, endpoint_id or tenant_id.
+var merchantAttemptList = listResource{
+	from: "merchant_webhook_attempts a JOIN merchant_webhook_deliveries d ON d.id = a.delivery_id",
+	fields: []string{"delivery_id", "endpoint_id", "tenant_id", "event_type", "attempt", "trigger", "status_code",
+		"error", "response", "duration_ms", "created_at"},
+	columns: map[string]listField{
+		"delivery_id": {"a.delivery_id", textField},
+		"endpoint_id": {"d.endpoint_id", textField},
+		"tenant_id":   {"d.tenant_id", textField},
+		"event_type":  {"d.event_type", textField},
+		"attempt":     {"a.attempt", intField},
+		"trigger":     {"a.trigger", textField},
+		"status_code": {"a.status_code", intField},
+		"error":       {"a.error", textField},
+		"response":    {"a.response", textField},
+		"duration_ms": {"a.duration_ms", intField},
+		"created_at":  {"a.created_at", timeField},
+	},
+}
+
+func (s *Store) CreateMerchantWebhookEndpoint(ctx context.Context, e *MerchantWebhookEndpoint) (*MerchantWebhookEndpoint, error) {
+	return scanMerchantEndpoint(s.db.QueryRowContext(ctx, `
+		INSERT INTO merchant_webhook_endpoints (id, tenant_id, url, events, description, status, secret)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+merchantEndpointColumns,
+		e.ID, e.TenantID, e.URL, strings.Join(e.Events, ","), e.Description, e.Status, e.secret))
+}
+
+func (s *Store) MerchantWebhookEndpoint(ctx context.Context, id string) (*MerchantWebhookEndpoint, error) {
+	return scanMerchantEndpoint(s.db.QueryRowContext(ctx, `
+		SELECT `+merchantEndpointColumns+` FROM merchant_webhook_endpoints WHERE id = $1`, id))
+}
+
+// EnabledMerchantWebhookEndpoints are the endpoints a tenant's events go
+// to.
+func (s *Store) EnabledMerchantWebhookEndpoints(ctx context.Context, tenantID string) ([]*MerchantWebhookEndpoint, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+merchantEndpointColumns+` FROM merchant_webhook_endpoints
+		WHERE tenant_id = $1 AND status = 'enabled' ORDER BY created_at`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*MerchantWebhookEndpoint
+	for rows.Next() {
+		e, err := scanMerchantEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) UpdateMerchantWebhookEndpoint(ctx context.Context, e *MerchantWebhookEndpoint) (*MerchantWebhookEndpoint, error) {
+	return scanMerchantEndpoint(s.db.QueryRowContext(ctx, `
+		UPDATE merchant_webhook_endpoints SET url = $2, events = $3, description = $4, status = $5, updated_at = now()
+		WHERE id = $1
+		RETURNING `+merchantEndpointColumns,
+		e.ID, e.URL, strings.Join(e.Events, ","), e.Description, e.Status))
+}
+
+// RotateMerchantWebhookSecret replaces an endpoint's secret, keeping the
+// old one valid until graceUntil.
+func (s *Store) RotateMerchantWebhookSecret(ctx context.Context, id, secret string, graceUntil time.Time) (*MerchantWebhookEndpoint, error) {
+	return scanMerchantEndpoint(s.db.QueryRowContext(ctx, `
+		UPDATE merchant_webhook_endpoints
+		SET previous_secret = secret, previous_secret_expires_at = $3, secret = $2, updated_at = now()
+		WHERE id = $1
+		RETURNING `+merchantEndpointColumns,
+		id, secret, graceUntil))
+}
+
+// DeleteMerchantWebhookEndpoint removes an endpoint and cancels its
+// pending deliveries; their log stays.
+func (s *Store) DeleteMerchantWebhookEndpoint(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `DELETE FROM merchant_webhook_endpoints WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE merchant_webhook_deliveries SET status = 'canceled', next_attempt_at = NULL, updated_at = now()
+		WHERE endpoint_id = $1 AND status = 'pending'`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// EnqueueMerchantWebhooks adds one pending delivery per endpoint, due now.
+func (s *Store) EnqueueMerchantWebhooks(ctx context.Context, endpoints []*MerchantWebhookEndpoint, eventID, eventType string, payload []byte) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, e := range endpoints {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO merchant_webhook_deliveries
+				(id, endpoint_id, tenant_id, event_id, event_type, payload, status, next_attempt_at)
+			VALUES ($1, $2, $3, $4, $5, $6, 'pending', now())
+			ON CONFLICT (endpoint_id, event_id) DO NOTHING`,
+			"whd_"+strings.ReplaceAll(uuid.NewString(), "-", ""), e.ID, e.TenantID, eventID, eventType, payload); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PaymentTenant is the tenant of a stored payment, "" when there is none
+// or the payment isn't stored.
+func (s *Store) PaymentTenant(ctx context.Context, paymentID string) (string, error) {
+	var tenant string
+	err := s.db.QueryRowContext(ctx, `SELECT tenant_id FROM payments WHERE id = $1`, paymentID).Scan(&tenant)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return tenant, err
+}
+
+func (s *Store) MerchantWebhookDelivery(ctx context.Context, id string) (*MerchantWebhookDelivery, error) {
+	return scanMerchantDelivery(s.db.QueryRowContext(ctx, `
+		SELECT `+merchantDeliveryColumns+` FROM merchant_webhook_deliveries WHERE id = $1`, id))
+}
+
+// ClaimDueMerchantWebhook takes the next pending delivery that is due on
+// an enabled endpoint, or returns sql.ErrNoRows. next_attempt_at becomes
+// the claim's lease, so a delivery abandoned mid-attempt comes due again.
+// skip lists deliveries that already errored in this sweep.
+func (s *Store) ClaimDueMerchantWebhook(ctx context.Context, skip []string) (*MerchantWebhookDelivery, error) {
+	if skip == nil {
+		skip = []string{}
+	}
+	return scanMerchantDelivery(s.db.QueryRowContext(ctx, `
+		UPDATE merchant_webhook_deliveries SET next_attempt_at = $2, updated_at = now()
+		WHERE id = (
+			SELECT d.id FROM merchant_webhook_deliveries d
+			JOIN merchant_webhook_endpoints e ON e.id = d.endpoint_id AND e.status = 'enabled'
+			WHERE d.id <> ALL($1) AND d.status = 'pending' AND d.next_attempt_at <= now()
+			ORDER BY d.next_attempt_at
+			LIMIT 1
+			FOR UPDATE OF d SKIP LOCKED)
+		RETURNING `+merchantDeliveryColumns,
+		skip, time.Now().Add(merchantWebhookLease).UTC()))
+}
+
+// RecordMerchantWebhookAttempt logs attempt and moves its delivery to d's
+// status and schedule.
+func (s *Store) RecordMerchantWebhookAttempt(ctx context.Context, d *MerchantWebhookDelivery, a *MerchantWebhookAttempt) (*MerchantWebhookDelivery, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	trigger := "automatic"
+	if a.Manual {
+		trigger = "manual"
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO merchant_webhook_attempts (delivery_id, attempt, trigger, status_code, error, response, duration_ms)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		a.DeliveryID, a.Attempt, trigger, a.StatusCode, a.Error, a.Response, a.DurationMS); err != nil {
+		return nil, err
+	}
+	updated, err := scanMerchantDelivery(tx.QueryRowContext(ctx, `
+		UPDATE merchant_webhook_deliveries
+		SET status = $2, attempts = $3, next_attempt_at = $4, last_status_code = $5, last_error = $6,
+			delivered_at = $7, updated_at = now()
+		WHERE id = $1
+		RETURNING `+merchantDeliveryColumns,
+		d.ID, d.Status, d.Attempts, d.NextAttemptAt, d.LastStatusCode, d.LastError, d.DeliveredAt))
+	if err != nil {
+		return nil, err
+	}
+	return updated, tx.Commit()
+}
+
+// MerchantWebhooks delivers payment events to the webhook endpoints
+// platform tenants register. Every event carrying a tenant becomes a
+// pending delivery per subscribed endpoint, stored before anything is
+// sent; a worker posts them, signed with the endpoint's secret, and
+// retries failures with exponential backoff up to maxAttempts, which at
+// the default of 16 spans about a day and a half. Each
+// attempt, and each manual redelivery, is kept in the attempt log.
+//
+// A delivery is signed in X-Webhook-Signature as
+// "t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<body>">". During a secret
+// rotation there is a v1 for the old secret too. Receivers should check
+// that one v1 matches and that t is recent. X-Webhook-Event-ID stays the
+// same across retries and redeliveries, so receivers can drop repeats.
+type MerchantWebhooks struct {
+	store       *Store
+	hub         *EventHub
+	client      *http.Client
+	interval    time.Duration
+	maxAttempts int
+	// deadLetters keeps deliveries that run out of attempts.
+	deadLetters *DeadLetters
+	// sandbox allows plain http endpoints, for local receivers.
+	sandbox bool
+}
+
+func NewMerchantWebhooks(store *Store, hub *EventHub, interval time.Duration, maxAttempts int) *MerchantWebhooks {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	// A redirect is reported as the attempt's status, not followed, so
+	// an endpoint can't send deliveries somewhere it wasn't checked for.
+	client := newEgressClient(merchantWebhookTimeout)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	return &MerchantWebhooks{
+		store:       store,
+		hub:         hub,
+		client:      client,
+		interval:    interval,
+		maxAttempts: maxAttempts,
+	}
+}
+
+// RegisterRoutes mounts endpoint management and the delivery log under
+// the webhooks scope.
+func (mw *MerchantWebhooks) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/merchant-webhooks", requireScope(mw.store, bootstrapToken, merchantWebhookScope), mw.requireStore)
+	g.POST("/endpoints", mw.createEndpoint)
+	g.GET("/endpoints", listHandler(mw.store, merchantEndpointList))
+	g.GET("/endpoints/:id", mw.getEndpoint)
+	g.PUT("/endpoints/:id", mw.updateEndpoint)
+	g.DELETE("/endpoints/:id", mw.deleteEndpoint)
+	g.POST("/endpoints/:id/rotate-secret", mw.rotateSecret)
+	g.GET("/deliveries", listHandler(mw.store, merchantDeliveryList))
+	g.GET("/deliveries/:id", mw.getDelivery)
+	g.POST("/deliveries/:id/redeliver", mw.redeliver)
+	g.GET("/attempts", listHandler(mw.store, merchantAttemptList))
+}
+
+func (mw *MerchantWebhooks) requireStore(c *gin.Context) {
+	if mw.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Merchant webhooks require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+func newMerchantWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return merchantWebhookSecretPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// merchantEndpointInput is the body of a create or update.
+type merchantEndpointInput struct {
+	TenantID    string   `json:"tenant_id"`
+	URL         string   `json:"url" binding:"required,max=2048"`
+	Events      []string `json:"events" binding:"max=100"`
+	Description string   `json:"description" binding:"max=500"`
+	Status      string   `json:"status"`
+}
+
+// problems checks the input. Outside sandbox mode the URL must be https;
+// it must resolve to public addresses either way.
+func (in merchantEndpointInput) problems(ctx context.Context, create, sandbox bool) []FieldError {
+	var problems []FieldError
+	if create && in.TenantID == "" {
+		problems = append(problems, FieldError{Field: "tenant_id", Code: "required", Message: "is required"})
+	}
+	switch {
+	case !validCallbackURL(in.URL):
+		problems = append(problems, FieldError{Field: "url", Code: "invalid", Message: "must be an absolute http(s) URL"})
+	case !sandbox && !strings.HasPrefix(strings.ToLower(in.URL), "https://"):
+		problems = append(problems, FieldError{Field: "url", Code: "invalid", Message: "must be an https URL"})
+	case !resolvesPublic(ctx, in.URL):
+		problems = append(problems, FieldError{Field: "url", Code: "invalid", Message: "must point to a public address"})
+	}
+	for i, ev := range in.Events {
+		if !merchantEventPattern.MatchString(ev) {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("events[%d]", i), Code: "invalid",
+				Message: "must be an event type such as payment_intent.succeeded, or *"})
+		}
+	}
+	switch in.Status {
+	case "", merchantEndpointEnabled, merchantEndpointDisabled:
+	default:
+		problems = append(problems, FieldError{Field: "status", Code: "invalid_choice", Message: "must be one of: enabled, disabled"})
+	}
+	return problems
+}
+
+func (mw *MerchantWebhooks) createEndpoint(c *gin.Context) {
+	var in merchantEndpointInput
+	if !bindJSON(c, &in) {
+		return
+	}
+	if problems := in.problems(c.Request.Context(), true, mw.sandbox); len(problems) > 0 {
+		validationFailed(c, problems)
+		return
+	}
+	secret, err := newMerchantWebhookSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	status := in.Status
+	if status == "" {
+		status = merchantEndpointEnabled
+	}
+	e, err := mw.store.CreateMerchantWebhookEndpoint(c.Request.Context(), &MerchantWebhookEndpoint{
+		ID:          "we_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		TenantID:    in.TenantID,
+		URL:         in.URL,
+		Events:      in.Events,
+		Description: in.Description,
+		Status:      status,
+		secret:      secret,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	e.Secret = e.secret
+	respondData(c, http.StatusCreated, e)
+}
+
+// endpoint loads the endpoint named in the path, answering 404 itself.
+func (mw *MerchantWebhooks) endpoint(c *gin.Context) (*MerchantWebhookEndpoint, bool) {
+	e, err := mw.store.MerchantWebhookEndpoint(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Webhook endpoint not found"))
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return nil, false
+	}
+	return e, true
+}
+
+func (mw *MerchantWebhooks) getEndpoint(c *gin.Context) {
+	if e, ok := mw.endpoint(c); ok {
+		respondData(c, http.StatusOK, e)
+	}
+}
+
+// updateEndpoint replaces an endpoint's URL, events, description and
+// status. The tenant can't change.
+func (mw *MerchantWebhooks) updateEndpoint(c *gin.Context) {
+	var in merchantEndpointInput
+	if !bindJSON(c, &in) {
+		return
+	}
+	if problems := in.problems(c.Request.Context(), false, mw.sandbox); len(problems) > 0 {
+		validationFailed(c, problems)
+		return
+	}
+	e, ok := mw.endpoint(c)
+	if !ok {
+		return
+	}
+	e.URL, e.Events, e.Description = in.URL, in.Events, in.Description
+	if in.Status != "" {
+		e.Status = in.Status
+	}
+	e, err := mw.store.UpdateMerchantWebhookEndpoint(c.Request.Context(), e)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, e)
+}
+
+func (mw *MerchantWebhooks) deleteEndpoint(c *gin.Context) {
+	err := mw.store.DeleteMerchantWebhookEndpoint(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Webhook endpoint not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// rotateSecret issues a new signing secret. The old one keeps signing
+// alongside it for merchantWebhookRotationGrace.
+func (mw *MerchantWebhooks) rotateSecret(c *gin.Context) {
+	secret, err := newMerchantWebhookSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	e, err := mw.store.RotateMerchantWebhookSecret(c.Request.Context(), c.Param("id"), secret,
+		time.Now().Add(merchantWebhookRotationGrace).UTC())
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Webhook endpoint not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	e.Secret = e.secret
+	respondData(c, http.StatusOK, gin.H{"endpoint": e, "previous_secret_expires_at": e.previousUntil})
+}
+
+func (mw *MerchantWebhooks) delivery(c *gin.Context) (*MerchantWebhookDelivery, bool) {
+	d, err := mw.store.MerchantWebhookDelivery(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Webhook delivery not found"))
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return nil, false
+	}
+	return d, true
+}
+
+func (mw *MerchantWebhooks) getDelivery(c *gin.Context) {
+	if d, ok := mw.delivery(c); ok {
+		respondData(c, http.StatusOK, d)
+	}
+}
+
+// redeliver sends a delivery again now, whatever its status, and answers
+// with the outcome. Success marks it succeeded; a failure is logged but
+// neither fails a pending delivery nor schedules more retries.
+func (mw *MerchantWebhooks) redeliver(c *gin.Context) {
+	d, ok := mw.delivery(c)
+	if !ok {
+		return
+	}
+	if d.Status == merchantDeliveryCanceled {
+		c.JSON(http.StatusConflict, errorBody(c, CodeWebhookDeliveryState, "The delivery's endpoint was deleted"))
+		return
+	}
+	d, attempt, err := mw.attempt(c.Request.Context(), d, true)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusConflict, errorBody(c, CodeWebhookDeliveryState, "The delivery's endpoint was deleted"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{"delivery": d, "attempt": attempt})
+}
+
+// Run queues deliveries for the hub's events and sends those due every
+// interval until ctx is done.
+func (mw *MerchantWebhooks) Run(ctx context.Context) {
+	if mw == nil || mw.store == nil {
+		return
+	}
+	go mw.listen(ctx)
+	ticker := time.NewTicker(mw.interval)
+	defer ticker.Stop()
+	for {
+		if err := mw.deliverDue(ctx); err != nil {
+			log.Printf("merchant webhooks: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// listen queues each event as it is published. Queueing runs off the
+// subscription so the hub never finds it behind and drops events.
+func (mw *MerchantWebhooks) listen(ctx context.Context) {
+	events, unsubscribe := mw.hub.Subscribe("")
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-events:
+			go func() {
+				if err := mw.enqueue(context.WithoutCancel(ctx), ev); err != nil {
+					log.Printf("merchant webhooks: queueing %s for %s: %v", ev.Type, ev.PaymentID, err)
+				}
+			}()
+		}
+	}
+}
+
+// enqueue stores a delivery of ev for each of its tenant's endpoints
+// that subscribes to it. Events without a tenant take the payment's.
+func (mw *MerchantWebhooks) enqueue(ctx context.Context, ev PaymentEvent) error {
+	if ev.TenantID == "" {
+		tenant, err := mw.store.PaymentTenant(ctx, ev.PaymentID)
+		if err != nil {
+			return err
+		}
+		ev.TenantID = tenant
+	}
+	if ev.TenantID == "" {
+		return nil
+	}
+	endpoints, err := mw.store.EnabledMerchantWebhookEndpoints(ctx, ev.TenantID)
+	if err != nil {
+		return err
+	}
+	var subscribed []*MerchantWebhookEndpoint
+	for _, e := range endpoints {
+		if e.subscribed(ev.Type) {
+			subscribed = append(subscribed, e)
+		}
+	}
+	if len(subscribed) == 0 {
+		return nil
+	}
+	eventID := "evt_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	payload, err := json.Marshal(gin.H{
+		"id":         eventID,
+		"type":       ev.Type,
+		"tenant_id":  ev.TenantID,
+		"created_at": ev.CreatedAt,
+		"data":       ev,
+	})
+	if err != nil {
+		return err
+	}
+	return mw.store.EnqueueMerchantWebhooks(ctx, subscribed, eventID, ev.Type, payload)
+}
+
+func (mw *MerchantWebhooks) deliverDue(ctx context.Context) error {
+	var failed []string
+	for {
+		d, err := mw.store.ClaimDueMerchantWebhook(ctx, failed)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, _, err := mw.attempt(ctx, d, false); err != nil {
+			log.Printf("delivering webhook %s: %v", d.ID, err)
+			failed = append(failed, d.ID)
+		}
+	}
+}
+
+// attempt posts d to its endpoint and records the outcome. An error
+// means the outcome couldn't be recorded; the receiver's own failures
+// are outcomes.
+func (mw *MerchantWebhooks) attempt(ctx context.Context, d *MerchantWebhookDelivery, manual bool) (*MerchantWebhookDelivery, *MerchantWebhookAttempt, error) {
+	e, err := mw.store.MerchantWebhookEndpoint(ctx, d.EndpointID)
+	if err != nil {
+		return nil, nil, err
+	}
+	a := &MerchantWebhookAttempt{DeliveryID: d.ID, Attempt: d.Attempts + 1, Manual: manual}
+	started := time.Now()
+	a.StatusCode, a.Response, err = mw.post(ctx, e, d, started)
+	a.DurationMS = time.Since(started).Milliseconds()
+	a.CreatedAt = time.Now().UTC()
+	if err == nil && (a.StatusCode < 200 || a.StatusCode > 299) {
+		err = fmt.Errorf("status %d", a.StatusCode)
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	d.Attempts, d.LastStatusCode, d.LastError = a.Attempt, a.StatusCode, a.Error
+	switch {
+	case err == nil:
+		d.Status, d.NextAttemptAt, d.DeliveredAt = merchantDeliverySucceeded, nil, &a.CreatedAt
+		merchantWebhookAttempts.WithLabelValues("succeeded").Inc()
+		if manual {
+			mw.deadLetters.resolved(ctx, deadLetterMerchantWebhook, d.ID, "redelivery")
+		}
+	case manual:
+		// Neither the status nor the schedule moves.
+	case d.Attempts >= mw.maxAttempts:
+		d.Status, d.NextAttemptAt = merchantDeliveryFailed, nil
+		merchantWebhookAttempts.WithLabelValues("failed").Inc()
+		mw.deadLetters.record(ctx, &DeadLetter{Kind: deadLetterMerchantWebhook, Ref: d.ID, Topic: d.EventType,
+			Key: d.EndpointID, Payload: d.Payload, Error: a.Error})
+	default:
+		next := time.Now().Add(merchantWebhookDelay(d.Attempts)).UTC()
+		d.NextAttemptAt = &next
+		merchantWebhookAttempts.WithLabelValues("retrying").Inc()
+	}
+	d, err = mw.store.RecordMerchantWebhookAttempt(ctx, d, a)
+	return d, a, err
+}
+
+// merchantWebhookDelay is the backoff after the attempts-th failure.
+func merchantWebhookDelay(attempts int) time.Duration {
+	delay := merchantWebhookBackoff
+	for i := 1; i < attempts && delay < merchantWebhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > merchantWebhookMaxBackoff {
+		delay = merchantWebhookMaxBackoff
+	}
+	return delay
+}
+
+// post sends the payload signed at now, returning the status and the
+// start of the response body.
+func (mw *MerchantWebhooks) post(ctx context.Context, e *MerchantWebhookEndpoint, d *MerchantWebhookDelivery, now time.Time) (int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "payment-service-webhooks/1")
+	req.Header.Set("X-Webhook-Event-ID", d.EventID)
+	req.Header.Set("X-Webhook-Event-Type", d.EventType)
+	req.Header.Set("X-Webhook-Delivery-ID", d.ID)
+	req.Header.Set("X-Webhook-Signature", signMerchantWebhook(e.secrets(now), now, d.Payload))
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	resp, err := mw.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, merchantWebhookResponseMax))
+	return resp.StatusCode, string(body), nil
+}
+
+// signMerchantWebhook builds the X-Webhook-Signature value, one v1 per
+// secret.
+func signMerchantWebhook(secrets []string, at time.Time, body []byte) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	parts := []string{"t=" + ts}
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(ts + "."))
+		mac.Write(body)
+		parts = append(parts, "v1="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return strings.Join(parts, ",")
+}
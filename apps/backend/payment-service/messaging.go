@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Publisher delivers serialized events to a broker topic. Key is used for
+// partitioning, the message group on AWS or the ordering key on Pub/Sub,
+// so events for the same payment stay ordered.
+type Publisher interface {
+	Publish(ctx context.Context, topic, key string, payload []byte) error
+	Close() error
+}
+
+// NewPublisher builds the publisher selected by EVENT_TRANSPORT, from the
+// transport's own settings.
+func NewPublisher(ctx context.Context, transport string) (Publisher, error) {
+	switch transport {
+	case "", "none":
+		return noopPublisher{}, nil
+	case "log":
+		return logPublisher{}, nil
+	case "kafka":
+		brokers := os.Getenv("KAFKA_BROKERS")
+		if brokers == "" {
+			return nil, fmt.Errorf("EVENT_TRANSPORT=kafka requires KAFKA_BROKERS")
+		}
+		return newKafkaPublisher(strings.Split(brokers, ",")), nil
+	case "sns":
+		return newSNSPublisher(ctx, os.Getenv("SNS_TOPIC_ARN_PREFIX"))
+	case "sqs":
+		return newSQSPublisher(ctx, os.Getenv("SQS_QUEUE_URL_PREFIX"))
+	case "pubsub":
+		return newPubSubPublisher(ctx, os.Getenv("PUBSUB_PROJECT_ID"), os.Getenv("PUBSUB_TOPIC_PREFIX"))
+	case "redis":
+		return newRedisStreamPublisher(regionEnv("REDIS_URL"), envDuration("REDIS_TIMEOUT", 250*time.Millisecond),
+			os.Getenv("REDIS_STREAM_PREFIX"), os.Getenv("REDIS_STREAM_GROUPS"), envInt("REDIS_STREAM_MAXLEN", 100000))
+	default:
+		return nil, fmt.Errorf("unknown event transport %q", transport)
+	}
+}
+
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(context.Context, string, string, []byte) error { return nil }
+func (noopPublisher) Close() error                                          { return nil }
+
+// logPublisher writes events to the service log, for local development.
+type logPublisher struct{}
+
+func (logPublisher) Publish(_ context.Context, topic, key string, payload []byte) error {
+	log.Printf("event topic=%s key=%s %s", topic, key, payload)
+	return nil
+}
+
+func (logPublisher) Close() error { return nil }
+
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func newKafkaPublisher(brokers []string) *kafkaPublisher {
+	return &kafkaPublisher{writer: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: 50 * time.Millisecond,
+	}}
+}
+
+func (k *kafkaPublisher) Publish(ctx context.Context, topic, key string, payload []byte) error {
+	return k.writer.WriteMessages(ctx, kafka.Message{
+		Topic: topic,
+		Key:   []byte(key),
+		Value: payload,
+	})
+}
+
+func (k *kafkaPublisher) Close() error {
+	return k.writer.Close()
+}
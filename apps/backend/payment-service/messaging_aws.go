@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// In AWS-only environments events go to FIFO SNS topics, which fan out to
+// the consumers' SQS queues, or straight to one FIFO queue per topic. The
+// event's key is the message group, so like Kafka's partitioning the
+// events of one payment are delivered in order; the deduplication ID is
+// a hash of key and payload, so a retried publish within SQS's five
+// minute window is delivered once. Credentials and region come from the
+// usual AWS environment variables, instance profile or IRSA.
+
+// awsResourceName turns a topic such as "payments.disputes" into the
+// FIFO topic or queue name "payments-disputes.fifo"; AWS names can't
+// have dots.
+func awsResourceName(topic string) string {
+	return strings.ReplaceAll(topic, ".", "-") + ".fifo"
+}
+
+// awsMessageGroup is the event's key, or the topic for events without
+// one, which are then ordered among themselves.
+func awsMessageGroup(topic, key string) string {
+	if key == "" {
+		return topic
+	}
+	return key
+}
+
+func awsDeduplicationID(key string, payload []byte) string {
+	h := sha256.New()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func loadAWSConfig(ctx context.Context) (aws.Config, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("loading AWS config: %w", err)
+	}
+	return cfg, nil
+}
+
+// snsPublisher publishes to the FIFO topic under arnPrefix named after
+// each topic, e.g. arn:aws:sns:eu-west-1:123456789012:payments-disputes.fifo.
+type snsPublisher struct {
+	client    *sns.Client
+	arnPrefix string
+}
+
+func newSNSPublisher(ctx context.Context, arnPrefix string) (*snsPublisher, error) {
+	if arnPrefix == "" {
+		return nil, fmt.Errorf("EVENT_TRANSPORT=sns requires SNS_TOPIC_ARN_PREFIX")
+	}
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &snsPublisher{client: sns.NewFromConfig(cfg), arnPrefix: arnPrefix}, nil
+}
+
+func (p *snsPublisher) Publish(ctx context.Context, topic, key string, payload []byte) error {
+	_, err := p.client.Publish(ctx, &sns.PublishInput{
+		TopicArn:               aws.String(p.arnPrefix + awsResourceName(topic)),
+		Message:                aws.String(string(payload)),
+		MessageGroupId:         aws.String(awsMessageGroup(topic, key)),
+		MessageDeduplicationId: aws.String(awsDeduplicationID(key, payload)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"topic": {DataType: aws.String("String"), StringValue: aws.String(topic)},
+		},
+	})
+	return err
+}
+
+func (p *snsPublisher) Close() error { return nil }
+
+// sqsPublisher sends to the FIFO queue under urlPrefix named after each
+// topic, e.g. https://sqs.eu-west-1.amazonaws.com/123456789012/payments-disputes.fifo.
+type sqsPublisher struct {
+	client    *sqs.Client
+	urlPrefix string
+}
+
+func newSQSPublisher(ctx context.Context, urlPrefix string) (*sqsPublisher, error) {
+	if urlPrefix == "" {
+		return nil, fmt.Errorf("EVENT_TRANSPORT=sqs requires SQS_QUEUE_URL_PREFIX")
+	}
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &sqsPublisher{client: sqs.NewFromConfig(cfg), urlPrefix: urlPrefix}, nil
+}
+
+func (p *sqsPublisher) Publish(ctx context.Context, topic, key string, payload []byte) error {
+	_, err := p.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:               aws.String(p.urlPrefix + awsResourceName(topic)),
+		MessageBody:            aws.String(string(payload)),
+		MessageGroupId:         aws.String(awsMessageGroup(topic, key)),
+		MessageDeduplicationId: aws.String(awsDeduplicationID(key, payload)),
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+			"topic": {DataType: aws.String("String"), StringValue: aws.String(topic)},
+		},
+	})
+	return err
+}
+
+func (p *sqsPublisher) Close() error { return nil }
+
+// checkSNS and checkSQS are the doctor's broker checks for the AWS
+// transports: the credentials work and the topics or queues under the
+// prefix are listed.
+func checkSNS(ctx context.Context, arnPrefix string) (checkStatus, string) {
+	if arnPrefix == "" {
+		return checkFail, "SNS_TOPIC_ARN_PREFIX not set"
+	}
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return checkFail, err.Error()
+	}
+	n := 0
+	pages := sns.NewListTopicsPaginator(sns.NewFromConfig(cfg), &sns.ListTopicsInput{})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return checkFail, "listing topics: " + err.Error()
+		}
+		for _, t := range page.Topics {
+			if strings.HasPrefix(aws.ToString(t.TopicArn), arnPrefix) {
+				n++
+			}
+		}
+	}
+	return checkPass, fmt.Sprintf("%d SNS topic(s) under %s", n, arnPrefix)
+}
+
+func checkSQS(ctx context.Context, urlPrefix string) (checkStatus, string) {
+	if urlPrefix == "" {
+		return checkFail, "SQS_QUEUE_URL_PREFIX not set"
+	}
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return checkFail, err.Error()
+	}
+	out, err := sqs.NewFromConfig(cfg).ListQueues(ctx, &sqs.ListQueuesInput{MaxResults: aws.Int32(1000)})
+	if err != nil {
+		return checkFail, "listing queues: " + err.Error()
+	}
+	n := 0
+	for _, url := range out.QueueUrls {
+		if strings.HasPrefix(url, urlPrefix) {
+			n++
+		}
+	}
+	return checkPass, fmt.Sprintf("%d SQS queue(s) under %s", n, urlPrefix)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisStreamPublisher appends events to Redis Streams, for small
+// deployments that run Redis anyway and no broker. Each topic is the
+// stream of the same name with the prefix in front; an entry holds the
+// event's key and payload, and since a stream is one ordered log the
+// events of a payment stay in order. Consumers read with XREADGROUP and
+// XACK, so each of a group's consumers gets its share of the entries and
+// unacknowledged ones can be claimed after a crash. The groups named up
+// front are created from the start of each stream before its first
+// entry, so a consumer started after the service misses nothing. Streams
+// are trimmed to about maxLen entries.
+type redisStreamPublisher struct {
+	redis  *Redis
+	prefix string
+	groups []string
+	maxLen int
+
+	mu    sync.Mutex
+	ready map[string]bool
+}
+
+func newRedisStreamPublisher(rawURL string, timeout time.Duration, prefix, groups string, maxLen int) (*redisStreamPublisher, error) {
+	if rawURL == "" {
+		return nil, fmt.Errorf("EVENT_TRANSPORT=redis requires REDIS_URL")
+	}
+	redis, err := NewRedis(rawURL, timeout)
+	if err != nil {
+		return nil, err
+	}
+	p := &redisStreamPublisher{redis: redis, prefix: prefix, maxLen: maxLen, ready: map[string]bool{}}
+	for _, g := range strings.Split(groups, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			p.groups = append(p.groups, g)
+		}
+	}
+	return p, nil
+}
+
+// ensureGroups creates the consumer groups on stream once per process.
+// A group that is already there is left where it has read to.
+func (p *redisStreamPublisher) ensureGroups(ctx context.Context, stream string) error {
+	p.mu.Lock()
+	done := p.ready[stream]
+	p.mu.Unlock()
+	if done {
+		return nil
+	}
+	for _, g := range p.groups {
+		_, err := p.redis.Do(ctx, "XGROUP", "CREATE", stream, g, "0", "MKSTREAM")
+		var re redisError
+		if err != nil && !(errors.As(err, &re) && strings.HasPrefix(string(re), "BUSYGROUP")) {
+			return fmt.Errorf("creating consumer group %s on %s: %w", g, stream, err)
+		}
+	}
+	p.mu.Lock()
+	p.ready[stream] = true
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *redisStreamPublisher) Publish(ctx context.Context, topic, key string, payload []byte) error {
+	stream := p.prefix + topic
+	if err := p.ensureGroups(ctx, stream); err != nil {
+		return err
+	}
+	args := []string{"XADD", stream}
+	if p.maxLen > 0 {
+		args = append(args, "MAXLEN", "~", strconv.Itoa(p.maxLen))
+	}
+	args = append(args, "*", "key", key, "payload", string(payload))
+	_, err := p.redis.Do(ctx, args...)
+	return err
+}
+
+func (p *redisStreamPublisher) Close() error {
+	p.redis.Close()
+	return nil
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var billingUsageRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_billing_usage_records_total",
+	Help: "Usage records reported for metered subscriptions, by outcome (recorded, duplicate, rejected).",
+}, []string{"outcome"})
+
+// Plan usage types.
+const (
+	usageLicensed = "licensed"
+	usageMetered  = "metered"
+)
+
+// usageClockSkew is how far in the future a usage timestamp may be.
+const usageClockSkew = 5 * time.Minute
+
+// PriceTier prices the units up to UpTo, or all remaining units when
+// UpTo is null, which the last tier must be.
+type PriceTier struct {
+	UpTo       *int64 `json:"up_to"`
+	UnitAmount int64  `json:"unit_amount"`
+	FlatAmount int64  `json:"flat_amount,omitempty"`
+}
+
+// TransformQuantity bills usage in packages, such as per 1000 requests:
+// the usage is divided by DivideBy and rounded up, or down.
+type TransformQuantity struct {
+	DivideBy int64  `json:"divide_by"`
+	Round    string `json:"round"`
+}
+
+// validatePricing checks the plan's price fields and fills in their
+// defaults. A metered plan is priced by Amount per unit or by Tiers,
+// graduated or volume as with Stripe, and aggregates usage by sum unless
+// told otherwise.
+func (p *BillingPlan) validatePricing() []FieldError {
+	var fields []FieldError
+	bad := func(field, code, msg string) {
+		fields = append(fields, FieldError{Field: field, Code: code, Message: msg})
+	}
+
+	if p.UsageType == "" {
+		p.UsageType = usageLicensed
+	}
+	if p.UsageType == usageLicensed {
+		if p.Amount <= 0 {
+			bad("amount", "too_small", "must be greater than 0")
+		}
+		if p.AggregateUsage != "" || p.TiersMode != "" || len(p.Tiers) > 0 || p.TransformQuantity != nil {
+			bad("usage_type", "invalid", "aggregate_usage, tiers and transform_quantity only apply to metered plans")
+		}
+		return fields
+	}
+
+	if p.AggregateUsage == "" {
+		p.AggregateUsage = "sum"
+	}
+	if len(p.Tiers) == 0 {
+		if p.Amount <= 0 {
+			bad("amount", "too_small", "must be greater than 0 for a metered plan without tiers")
+		}
+		if p.TiersMode != "" {
+			bad("tiers", "required", "required with tiers_mode")
+		}
+	} else {
+		if p.Amount != 0 {
+			bad("amount", "invalid", "must be 0 when the plan has tiers")
+		}
+		if p.TiersMode == "" {
+			bad("tiers_mode", "required", "required with tiers")
+		}
+		if p.TransformQuantity != nil {
+			bad("transform_quantity", "invalid", "cannot be combined with tiers")
+		}
+		var prev int64
+		for i, t := range p.Tiers {
+			field := fmt.Sprintf("tiers[%d]", i)
+			last := i == len(p.Tiers)-1
+			switch {
+			case t.UnitAmount < 0 || t.FlatAmount < 0:
+				bad(field, "too_small", "amounts must not be negative")
+			case last && t.UpTo != nil:
+				bad(field+".up_to", "invalid", "must be null on the last tier")
+			case !last && t.UpTo == nil:
+				bad(field+".up_to", "required", "only the last tier may be unbounded")
+			case !last && *t.UpTo <= prev:
+				bad(field+".up_to", "invalid", "must be greater than the previous tier's")
+			}
+			if t.UpTo != nil {
+				prev = *t.UpTo
+			}
+		}
+	}
+	if t := p.TransformQuantity; t != nil {
+		if t.Round == "" {
+			t.Round = "up"
+		}
+		if t.DivideBy <= 0 {
+			bad("transform_quantity.divide_by", "too_small", "must be greater than 0")
+		}
+		if t.Round != "up" && t.Round != "down" {
+			bad("transform_quantity.round", "invalid_choice", "must be up or down")
+		}
+	}
+	return fields
+}
+
+// price is what a metered plan charges for usage, as invoice lines. The
+// quantity billed is the usage after transform_quantity.
+func (p *BillingPlan) price(usage int64) []BillingInvoiceLine {
+	q := usage
+	if t := p.TransformQuantity; t != nil {
+		q = usage / t.DivideBy
+		if usage%t.DivideBy != 0 && t.Round != "down" {
+			q++
+		}
+	}
+	if len(p.Tiers) == 0 {
+		return []BillingInvoiceLine{{Description: p.Name, Quantity: q, UnitAmount: p.Amount, Amount: q * p.Amount}}
+	}
+
+	lines := []BillingInvoiceLine{}
+	flat := func(desc string, amount int64) {
+		if amount > 0 {
+			lines = append(lines, BillingInvoiceLine{Description: desc, Quantity: 1, UnitAmount: amount, Amount: amount})
+		}
+	}
+	if p.TiersMode == "volume" {
+		// The whole quantity is priced at the tier it falls in.
+		t := p.Tiers[len(p.Tiers)-1]
+		for _, tier := range p.Tiers {
+			if tier.UpTo != nil && q <= *tier.UpTo {
+				t = tier
+				break
+			}
+		}
+		lines = append(lines, BillingInvoiceLine{Description: p.Name, Quantity: q, UnitAmount: t.UnitAmount, Amount: q * t.UnitAmount})
+		flat(p.Name+": flat fee", t.FlatAmount)
+		return lines
+	}
+
+	// Graduated: each tier prices the units that fall within it.
+	var from int64
+	for _, t := range p.Tiers {
+		if q <= from {
+			break
+		}
+		n, units := q-from, fmt.Sprintf("units %d and above", from+1)
+		if t.UpTo != nil {
+			n, units = min(q, *t.UpTo)-from, fmt.Sprintf("units %d-%d", from+1, *t.UpTo)
+			from = *t.UpTo
+		}
+		lines = append(lines, BillingInvoiceLine{Description: p.Name + ": " + units, Quantity: n, UnitAmount: t.UnitAmount, Amount: n * t.UnitAmount})
+		flat(p.Name+": flat fee for "+units, t.FlatAmount)
+		if t.UpTo == nil {
+			break
+		}
+	}
+	return lines
+}
+
+// newMeteredInvoice invoices a metered plan's period for its usage. An
+// invoice for nothing is paid as it is created.
+func newMeteredInvoice(sub *BillingSubscription, plan *BillingPlan, start, end time.Time, usage int64) *BillingInvoice {
+	lines := plan.price(usage)
+	var amount int64
+	for _, l := range lines {
+		amount += l.Amount
+	}
+	inv := newBillingInvoice(sub, plan, start, end, amount)
+	inv.UsageQuantity, inv.Lines = &usage, lines
+	if amount == 0 {
+		now := time.Now().UTC()
+		inv.Status, inv.NextAttemptAt, inv.PaidAt = billingInvoicePaid, nil, &now
+	}
+	return inv
+}
+
+// UsageRecord is usage reported for a metered subscription at Timestamp.
+type UsageRecord struct {
+	ID             string    `json:"id"`
+	SubscriptionID string    `json:"subscription_id"`
+	Quantity       int64     `json:"quantity"`
+	Timestamp      time.Time `json:"timestamp"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Why RecordUsage turned a record down.
+var (
+	errUsageSubscription = errors.New("subscription not found")
+	errUsageNotMetered   = errors.New("subscription's plan is not metered")
+	errUsageEnded        = errors.New("subscription has ended")
+	errUsageTimestamp    = errors.New("timestamp must be within the current billing period and not in the future")
+	errUsageDuplicate    = errors.New("a record with this idempotency key was already reported")
+)
+
+// RecordUsage stores records in one statement and returns, at each
+// record's index, nil or why it wasn't stored; errUsageDuplicate means an
+// earlier one with the same idempotency key was kept instead. The
+// subscriptions are share-locked while their periods are checked, so a
+// renewal closing a period waits for records in flight and sees them.
+func (s *Store) RecordUsage(ctx context.Context, records []*UsageRecord) ([]error, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var ids []string
+	seen := map[string]bool{}
+	for _, r := range records {
+		if !seen[r.SubscriptionID] {
+			seen[r.SubscriptionID] = true
+			ids = append(ids, r.SubscriptionID)
+		}
+	}
+	type period struct {
+		status, usageType string
+		start             time.Time
+	}
+	subs := map[string]period{}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT s.id, s.status, s.current_period_start, p.usage_type
+		FROM billing_subscriptions s JOIN billing_plans p ON p.id = s.plan_id
+		WHERE s.id = ANY($1)
+		FOR SHARE OF s`, ids)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id string
+		var p period
+		if err := rows.Scan(&id, &p.status, &p.start, &p.usageType); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		subs[id] = p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	outcomes := make([]error, len(records))
+	var recIDs, subIDs, keys []string
+	var quantities []int64
+	var times []time.Time
+	latest := time.Now().Add(usageClockSkew)
+	for i, r := range records {
+		p, ok := subs[r.SubscriptionID]
+		switch {
+		case !ok:
+			outcomes[i] = errUsageSubscription
+		case p.usageType != usageMetered:
+			outcomes[i] = errUsageNotMetered
+		case p.status == subscriptionCanceled || p.status == subscriptionIncompleteExpired:
+			outcomes[i] = errUsageEnded
+		case r.Timestamp.Before(p.start) || r.Timestamp.After(latest):
+			outcomes[i] = errUsageTimestamp
+		}
+		if outcomes[i] != nil {
+			continue
+		}
+		recIDs = append(recIDs, r.ID)
+		subIDs = append(subIDs, r.SubscriptionID)
+		keys = append(keys, r.IdempotencyKey)
+		quantities = append(quantities, r.Quantity)
+		times = append(times, r.Timestamp)
+	}
+	if len(recIDs) == 0 {
+		return outcomes, nil
+	}
+
+	inserted := map[string]bool{}
+	rows, err = tx.QueryContext(ctx, `
+		INSERT INTO billing_usage_records (id, subscription_id, idempotency_key, quantity, timestamp)
+		SELECT id, subscription_id, NULLIF(key, ''), quantity, ts
+		FROM unnest($1::text[], $2::text[], $3::text[], $4::bigint[], $5::timestamptz[]) AS r (id, subscription_id, key, quantity, ts)
+		ON CONFLICT (subscription_id, idempotency_key) DO NOTHING
+		RETURNING id`, recIDs, subIDs, keys, quantities, times)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		inserted[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, r := range records {
+		if outcomes[i] == nil && !inserted[r.ID] {
+			outcomes[i] = errUsageDuplicate
+		}
+	}
+	return outcomes, tx.Commit()
+}
+
+// UsageRecordByKey is the record kept for an idempotency key.
+func (s *Store) UsageRecordByKey(ctx context.Context, subscriptionID, key string) (*UsageRecord, error) {
+	var r UsageRecord
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, subscription_id, quantity, timestamp, idempotency_key, created_at
+		FROM billing_usage_records WHERE subscription_id = $1 AND idempotency_key = $2`, subscriptionID, key).
+		Scan(&r.ID, &r.SubscriptionID, &r.Quantity, &r.Timestamp, &r.IdempotencyKey, &r.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// BillingUsage aggregates a subscription's usage from start up to end:
+// the sum, the largest record (max) or the latest one
+// (last_during_period). It reads outside any transaction; while the
+// caller holds the subscription's row lock, RecordUsage can't add to the
+// period, so the total is final.
+func (s *Store) BillingUsage(ctx context.Context, subscriptionID, aggregate string, start, end time.Time) (int64, error) {
+	var sum, largest, last int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(quantity), 0), COALESCE(MAX(quantity), 0),
+			COALESCE((SELECT quantity FROM billing_usage_records
+				WHERE subscription_id = $1 AND timestamp >= $2 AND timestamp < $3
+				ORDER BY timestamp DESC, created_at DESC LIMIT 1), 0)
+		FROM billing_usage_records
+		WHERE subscription_id = $1 AND timestamp >= $2 AND timestamp < $3`,
+		subscriptionID, start, end).Scan(&sum, &largest, &last)
+	switch aggregate {
+	case "max":
+		return largest, err
+	case "last_during_period":
+		return last, err
+	}
+	return sum, err
+}
+
+// usageRefusal is the problem a rejected usage record gets.
+func usageRefusal(err error) (status int, code ErrorCode) {
+	switch {
+	case errors.Is(err, errUsageSubscription):
+		return http.StatusNotFound, CodeNotFound
+	case errors.Is(err, errUsageTimestamp):
+		return http.StatusUnprocessableEntity, CodeValidationFailed
+	}
+	return http.StatusConflict, CodeSubscriptionState
+}
+
+// recordUsage reports usage for one subscription. With an
+// Idempotency-Key the same report sent again answers with the record
+// first stored.
+func (b *Billing) recordUsage(c *gin.Context) {
+	var req struct {
+		Quantity  *int64     `json:"quantity" binding:"required,gte=0"`
+		Timestamp *time.Time `json:"timestamp"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	ctx := c.Request.Context()
+	rec := newUsageRecord(c.Param("id"), *req.Quantity, req.Timestamp, c.GetHeader("Idempotency-Key"))
+	outcomes, err := b.store.RecordUsage(ctx, []*UsageRecord{rec})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	switch err := outcomes[0]; {
+	case err == nil:
+		billingUsageRecords.WithLabelValues("recorded").Inc()
+		rec.CreatedAt = time.Now().UTC()
+		respondData(c, http.StatusCreated, rec)
+	case errors.Is(err, errUsageDuplicate):
+		billingUsageRecords.WithLabelValues("duplicate").Inc()
+		kept, err := b.store.UsageRecordByKey(ctx, rec.SubscriptionID, rec.IdempotencyKey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+		respondData(c, http.StatusOK, kept)
+	case errors.Is(err, errUsageTimestamp):
+		billingUsageRecords.WithLabelValues("rejected").Inc()
+		validationFailed(c, []FieldError{{Field: "timestamp", Code: "invalid", Message: err.Error()}})
+	default:
+		billingUsageRecords.WithLabelValues("rejected").Inc()
+		status, code := usageRefusal(err)
+		c.JSON(status, errorBody(c, code, err.Error()))
+	}
+}
+
+// UsageBatchResult is one record's outcome in POST /billing/usage:
+// recorded, duplicate or failed.
+type UsageBatchResult struct {
+	Index  int          `json:"index"`
+	Status string       `json:"status"`
+	Record *UsageRecord `json:"record,omitempty"`
+	Error  gin.H        `json:"error,omitempty"`
+}
+
+// recordUsageBatch reports usage for any number of subscriptions at once,
+// for metering pipelines that flush in bulk. Each record reports its own
+// outcome. A record without its own idempotency_key gets
+// "<Idempotency-Key>:<index>", so a retried batch stores nothing twice.
+func (b *Billing) recordUsageBatch(c *gin.Context) {
+	var req struct {
+		Records []struct {
+			SubscriptionID string     `json:"subscription_id" binding:"required"`
+			Quantity       *int64     `json:"quantity" binding:"required,gte=0"`
+			Timestamp      *time.Time `json:"timestamp"`
+			IdempotencyKey string     `json:"idempotency_key" binding:"max=255"`
+		} `json:"records" binding:"required,min=1,dive"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if len(req.Records) > b.maxUsageBatch {
+		validationFailed(c, []FieldError{{Field: "records", Code: "too_long", Message: fmt.Sprintf("must have at most %d items", b.maxUsageBatch)}})
+		return
+	}
+	key := c.GetHeader("Idempotency-Key")
+	records := make([]*UsageRecord, len(req.Records))
+	for i, r := range req.Records {
+		recKey := r.IdempotencyKey
+		if recKey == "" && key != "" {
+			recKey = key + ":" + strconv.Itoa(i)
+		}
+		records[i] = newUsageRecord(r.SubscriptionID, *r.Quantity, r.Timestamp, recKey)
+	}
+	outcomes, err := b.store.RecordUsage(c.Request.Context(), records)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+
+	lang := requestLanguage(c)
+	now := time.Now().UTC()
+	results := make([]UsageBatchResult, len(records))
+	counts := map[string]int{}
+	for i, err := range outcomes {
+		res := UsageBatchResult{Index: i}
+		switch {
+		case err == nil:
+			res.Status = "recorded"
+			records[i].CreatedAt = now
+			res.Record = records[i]
+			billingUsageRecords.WithLabelValues("recorded").Inc()
+		case errors.Is(err, errUsageDuplicate):
+			res.Status = "duplicate"
+			billingUsageRecords.WithLabelValues("duplicate").Inc()
+		default:
+			res.Status = "failed"
+			_, code := usageRefusal(err)
+			res.Error = itemProblem(lang, code, "", err.Error(), nil)
+			billingUsageRecords.WithLabelValues("rejected").Inc()
+		}
+		counts[res.Status]++
+		results[i] = res
+	}
+	respondList(c, http.StatusOK, results, gin.H{
+		"total":     len(results),
+		"recorded":  counts["recorded"],
+		"duplicate": counts["duplicate"],
+		"failed":    counts["failed"],
+	})
+}
+
+func newUsageRecord(subscriptionID string, quantity int64, timestamp *time.Time, key string) *UsageRecord {
+	ts := time.Now().UTC()
+	if timestamp != nil {
+		ts = timestamp.UTC()
+	}
+	return &UsageRecord{
+		ID:             "ur_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		SubscriptionID: subscriptionID,
+		Quantity:       quantity,
+		Timestamp:      ts,
+		IdempotencyKey: key,
+	}
+}
+
+// usageSummary is the usage of a metered subscription's current period
+// so far and the invoice lines it would come to, like Stripe's upcoming
+// invoice.
+func (b *Billing) usageSummary(c *gin.Context) {
+	ctx := c.Request.Context()
+	sub, err := b.store.BillingSubscription(ctx, c.Param("id"))
+	if !b.respondChange(c, sub, err) {
+		return
+	}
+	plan, err := b.store.BillingPlan(ctx, sub.PlanID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if plan.UsageType != usageMetered {
+		c.JSON(http.StatusConflict, errorBody(c, CodeSubscriptionState, errUsageNotMetered.Error()))
+		return
+	}
+	usage, err := b.store.BillingUsage(ctx, sub.ID, plan.AggregateUsage, sub.CurrentPeriodStart, sub.CurrentPeriodEnd)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	// Usage during a trial isn't billed.
+	lines := []BillingInvoiceLine{}
+	if sub.Status != subscriptionTrialing {
+		lines = plan.price(usage)
+	}
+	var amount int64
+	for _, l := range lines {
+		amount += l.Amount
+	}
+	respondData(c, http.StatusOK, gin.H{
+		"subscription_id": sub.ID,
+		"period_start":    sub.CurrentPeriodStart,
+		"period_end":      sub.CurrentPeriodEnd,
+		"aggregate_usage": plan.AggregateUsage,
+		"usage_quantity":  usage,
+		"lines":           lines,
+		"amount":          amount,
+		"currency":        plan.Currency,
+	})
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are scraped from GET /metrics by the monorepo's Prometheus (see
+// monitoring/prometheus). Names are prefixed payment_service_.
+
+var panicsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_panics_total",
+	Help: "Handler panics recovered, by route.",
+}, []string{"route"})
+
+// RegisterMetricsRoute mounts the Prometheus scrape endpoint.
+func RegisterMetricsRoute(r *gin.Engine) {
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+}
@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS payments (
+    id              TEXT PRIMARY KEY,
+    tenant_id       TEXT NOT NULL DEFAULT '',
+    customer_id     TEXT NOT NULL DEFAULT '',
+    order_id        TEXT NOT NULL DEFAULT '',
+    amount          BIGINT NOT NULL,
+    amount_received BIGINT NOT NULL DEFAULT 0,
+    amount_refunded BIGINT NOT NULL DEFAULT 0,
+    currency        TEXT NOT NULL,
+    status          TEXT NOT NULL,
+    payment_method  TEXT NOT NULL DEFAULT '',
+    description     TEXT NOT NULL DEFAULT '',
+    created_at      TIMESTAMPTZ NOT NULL,
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS payments_created_at_idx ON payments (created_at);
+CREATE INDEX IF NOT EXISTS payments_tenant_created_idx ON payments (tenant_id, created_at);
+
+CREATE TABLE IF NOT EXISTS refunds (
+    id         TEXT PRIMARY KEY,
+    payment_id TEXT NOT NULL,
+    amount     BIGINT NOT NULL,
+    currency   TEXT NOT NULL,
+    status     TEXT NOT NULL,
+    reason     TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS refunds_payment_idx ON refunds (payment_id);
+CREATE INDEX IF NOT EXISTS refunds_created_at_idx ON refunds (created_at);
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS settlement_reports (
+    payout_id       TEXT PRIMARY KEY,
+    amount          BIGINT NOT NULL,
+    currency        TEXT NOT NULL,
+    status          TEXT NOT NULL,
+    arrival_date    TIMESTAMPTZ NOT NULL,
+    gross           BIGINT NOT NULL,
+    fees            BIGINT NOT NULL,
+    net             BIGINT NOT NULL,
+    matched_count   INTEGER NOT NULL,
+    unmatched_count INTEGER NOT NULL,
+    discrepancy     BIGINT NOT NULL,
+    reconciled_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS settlement_items (
+    payout_id              TEXT NOT NULL REFERENCES settlement_reports (payout_id) ON DELETE CASCADE,
+    balance_transaction_id TEXT NOT NULL,
+    type                   TEXT NOT NULL,
+    source_id              TEXT NOT NULL DEFAULT '',
+    payment_id             TEXT NOT NULL DEFAULT '',
+    amount                 BIGINT NOT NULL,
+    fee                    BIGINT NOT NULL,
+    net                    BIGINT NOT NULL,
+    match_status           TEXT NOT NULL,
+    note                   TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (payout_id, balance_transaction_id)
+);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS disputes (
+    id              TEXT PRIMARY KEY,
+    payment_id      TEXT NOT NULL DEFAULT '',
+    charge_id       TEXT NOT NULL DEFAULT '',
+    amount          BIGINT NOT NULL,
+    currency        TEXT NOT NULL,
+    status          TEXT NOT NULL,
+    reason          TEXT NOT NULL DEFAULT '',
+    evidence_due_by TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ NOT NULL,
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS disputes_payment_idx ON disputes (payment_id);
+CREATE INDEX IF NOT EXISTS disputes_created_at_idx ON disputes (created_at);
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS payments_customer_created_idx ON payments (tenant_id, customer_id, created_at);
@@ -0,0 +1,56 @@
+-- Double-entry ledger for value held by this service. Each transaction's
+-- entries sum to zero; an account's balance is the sum of its entries.
+CREATE TABLE IF NOT EXISTS ledger_transactions (
+    id         TEXT PRIMARY KEY,
+    kind       TEXT NOT NULL,
+    reference  TEXT NOT NULL DEFAULT '',
+    currency   TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id             BIGSERIAL PRIMARY KEY,
+    transaction_id TEXT NOT NULL REFERENCES ledger_transactions (id),
+    account        TEXT NOT NULL,
+    amount         BIGINT NOT NULL,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_account_idx ON ledger_entries (account, created_at);
+CREATE INDEX IF NOT EXISTS ledger_entries_transaction_idx ON ledger_entries (transaction_id);
+
+CREATE TABLE IF NOT EXISTS wallets (
+    id          TEXT PRIMARY KEY,
+    tenant_id   TEXT NOT NULL DEFAULT '',
+    customer_id TEXT NOT NULL,
+    currency    TEXT NOT NULL,
+    balance     BIGINT NOT NULL DEFAULT 0 CHECK (balance >= 0),
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (tenant_id, customer_id, currency)
+);
+
+CREATE TABLE IF NOT EXISTS wallet_transactions (
+    id                    TEXT PRIMARY KEY,
+    wallet_id             TEXT NOT NULL REFERENCES wallets (id),
+    type                  TEXT NOT NULL,
+    amount                BIGINT NOT NULL,
+    balance_after         BIGINT NOT NULL,
+    payment_id            TEXT NOT NULL DEFAULT '',
+    order_id              TEXT NOT NULL DEFAULT '',
+    description           TEXT NOT NULL DEFAULT '',
+    reverses              TEXT,
+    idempotency_key       TEXT,
+    ledger_transaction_id TEXT NOT NULL REFERENCES ledger_transactions (id),
+    created_at            TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS wallet_transactions_wallet_idx ON wallet_transactions (wallet_id, created_at);
+-- A retried request, a redelivered top-up webhook or a second reversal
+-- must not move the balance again.
+CREATE UNIQUE INDEX IF NOT EXISTS wallet_transactions_idempotency_idx
+    ON wallet_transactions (wallet_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS wallet_transactions_top_up_idx
+    ON wallet_transactions (payment_id) WHERE type = 'top_up';
+CREATE UNIQUE INDEX IF NOT EXISTS wallet_transactions_reverses_idx
+    ON wallet_transactions (reverses) WHERE reverses IS NOT NULL;
@@ -0,0 +1,37 @@
+-- Gift cards are looked up by the hash of their code; the code itself is
+-- shown once, when the card is issued.
+CREATE TABLE IF NOT EXISTS gift_cards (
+    id            TEXT PRIMARY KEY,
+    code_hash     TEXT NOT NULL UNIQUE,
+    last4         TEXT NOT NULL,
+    tenant_id     TEXT NOT NULL DEFAULT '',
+    currency      TEXT NOT NULL,
+    initial_value BIGINT NOT NULL CHECK (initial_value > 0),
+    balance       BIGINT NOT NULL CHECK (balance >= 0),
+    status        TEXT NOT NULL DEFAULT 'active',
+    expires_at    TIMESTAMPTZ,
+    replaced_by   TEXT REFERENCES gift_cards (id),
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS gift_card_transactions (
+    id                    TEXT PRIMARY KEY,
+    gift_card_id          TEXT NOT NULL REFERENCES gift_cards (id),
+    type                  TEXT NOT NULL,
+    amount                BIGINT NOT NULL,
+    balance_after         BIGINT NOT NULL,
+    payment_id            TEXT NOT NULL DEFAULT '',
+    order_id              TEXT NOT NULL DEFAULT '',
+    description           TEXT NOT NULL DEFAULT '',
+    reverses              TEXT,
+    idempotency_key       TEXT,
+    ledger_transaction_id TEXT NOT NULL REFERENCES ledger_transactions (id),
+    created_at            TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS gift_card_transactions_card_idx ON gift_card_transactions (gift_card_id, created_at);
+CREATE UNIQUE INDEX IF NOT EXISTS gift_card_transactions_idempotency_idx
+    ON gift_card_transactions (gift_card_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS gift_card_transactions_reverses_idx
+    ON gift_card_transactions (reverses) WHERE reverses IS NOT NULL;
@@ -0,0 +1,17 @@
+-- One row per discount applied to a payment. Rows without a payment are
+-- reservations held while the intent is created; they count towards usage
+-- limits for a few minutes in case the process dies before cleaning up.
+CREATE TABLE IF NOT EXISTS promotion_redemptions (
+    id           TEXT PRIMARY KEY,
+    promotion_id TEXT NOT NULL,
+    payment_id   TEXT,
+    tenant_id    TEXT NOT NULL DEFAULT '',
+    customer_id  TEXT NOT NULL DEFAULT '',
+    currency     TEXT NOT NULL,
+    amount       BIGINT NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS promotion_redemptions_promotion_idx ON promotion_redemptions (promotion_id, customer_id);
+CREATE UNIQUE INDEX IF NOT EXISTS promotion_redemptions_payment_idx
+    ON promotion_redemptions (payment_id, promotion_id) WHERE payment_id IS NOT NULL;
@@ -0,0 +1,31 @@
+-- Marketplace payments whose seller share stays on the platform until the
+-- order is delivered or the hold period ends. release_at is set once the
+-- payment succeeds, release_after_seconds after it; transfer_id once the
+-- share has been paid out. status_reason says why an escrow was frozen or
+-- canceled, or what happened to it after release.
+CREATE TABLE IF NOT EXISTS escrows (
+    id                    TEXT PRIMARY KEY,
+    payment_id            TEXT UNIQUE,
+    tenant_id             TEXT NOT NULL DEFAULT '',
+    order_id              TEXT NOT NULL DEFAULT '',
+    seller_account        TEXT NOT NULL,
+    currency              TEXT NOT NULL,
+    amount                BIGINT NOT NULL CHECK (amount > 0),
+    seller_amount         BIGINT NOT NULL CHECK (seller_amount > 0 AND seller_amount <= amount),
+    status                TEXT NOT NULL DEFAULT 'pending',
+    release_after_seconds BIGINT NOT NULL,
+    charge_id             TEXT NOT NULL DEFAULT '',
+    transfer_id           TEXT NOT NULL DEFAULT '',
+    dispute_id            TEXT NOT NULL DEFAULT '',
+    status_reason         TEXT NOT NULL DEFAULT '',
+    last_error            TEXT NOT NULL DEFAULT '',
+    idempotency_key       TEXT UNIQUE,
+    funded_at             TIMESTAMPTZ,
+    delivered_at          TIMESTAMPTZ,
+    release_at            TIMESTAMPTZ,
+    released_at           TIMESTAMPTZ,
+    created_at            TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at            TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS escrows_due_idx ON escrows (status, release_at);
@@ -0,0 +1,37 @@
+-- One row per unpaid subscription invoice this service is chasing. A
+-- subscription has at most one open case (retrying or grace) at a time;
+-- events are its history, including the emails sent.
+CREATE TABLE IF NOT EXISTS dunning_cases (
+    id              TEXT PRIMARY KEY,
+    subscription_id TEXT NOT NULL,
+    invoice_id      TEXT NOT NULL UNIQUE,
+    invoice_url     TEXT NOT NULL DEFAULT '',
+    customer_id     TEXT NOT NULL DEFAULT '',
+    customer_email  TEXT NOT NULL DEFAULT '',
+    tenant_id       TEXT NOT NULL DEFAULT '',
+    currency        TEXT NOT NULL,
+    amount_due      BIGINT NOT NULL,
+    status          TEXT NOT NULL,
+    attempts        INT NOT NULL DEFAULT 0,
+    next_retry_at   TIMESTAMPTZ,
+    grace_ends_at   TIMESTAMPTZ,
+    last_error      TEXT NOT NULL DEFAULT '',
+    resolved_at     TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS dunning_cases_open_idx
+    ON dunning_cases (subscription_id) WHERE status IN ('retrying', 'grace');
+CREATE INDEX IF NOT EXISTS dunning_cases_subscription_idx ON dunning_cases (subscription_id, created_at);
+CREATE INDEX IF NOT EXISTS dunning_cases_due_idx ON dunning_cases (status, next_retry_at, grace_ends_at);
+
+CREATE TABLE IF NOT EXISTS dunning_events (
+    id         BIGSERIAL PRIMARY KEY,
+    case_id    TEXT NOT NULL REFERENCES dunning_cases (id),
+    type       TEXT NOT NULL,
+    detail     TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS dunning_events_case_idx ON dunning_events (case_id, created_at);
@@ -0,0 +1,35 @@
+-- Off-session retries of one-off payments that failed with a soft
+-- decline. Attempts are logged per customer for the daily cap.
+CREATE TABLE IF NOT EXISTS payment_retries (
+    payment_id      TEXT PRIMARY KEY,
+    tenant_id       TEXT NOT NULL DEFAULT '',
+    customer_id     TEXT NOT NULL,
+    payment_method  TEXT NOT NULL,
+    currency        TEXT NOT NULL,
+    amount          BIGINT NOT NULL,
+    status          TEXT NOT NULL,
+    attempts        INT NOT NULL DEFAULT 0,
+    decline_code    TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ,
+    resolved_at     TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS payment_retries_due_idx ON payment_retries (status, next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS payment_retry_attempts (
+    id           BIGSERIAL PRIMARY KEY,
+    payment_id   TEXT NOT NULL REFERENCES payment_retries (payment_id),
+    customer_id  TEXT NOT NULL,
+    outcome      TEXT NOT NULL,
+    decline_code TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS payment_retry_attempts_customer_idx ON payment_retry_attempts (customer_id, created_at);
+
+CREATE TABLE IF NOT EXISTS payment_retry_opt_outs (
+    customer_id TEXT PRIMARY KEY,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
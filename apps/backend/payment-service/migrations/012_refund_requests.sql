@@ -0,0 +1,33 @@
+-- Refunds held for a second key's approval. Events are the audit trail:
+-- who requested, approved or rejected each one, and how it was executed.
+CREATE TABLE IF NOT EXISTS refund_requests (
+    id              TEXT PRIMARY KEY,
+    payment_id      TEXT NOT NULL,
+    currency        TEXT NOT NULL,
+    amount          BIGINT NOT NULL CHECK (amount > 0),
+    reason          TEXT NOT NULL DEFAULT '',
+    status          TEXT NOT NULL,
+    requested_by    TEXT NOT NULL,
+    decided_by      TEXT NOT NULL DEFAULT '',
+    decision_note   TEXT NOT NULL DEFAULT '',
+    refund_id       TEXT NOT NULL DEFAULT '',
+    last_error      TEXT NOT NULL DEFAULT '',
+    idempotency_key TEXT UNIQUE,
+    decided_at      TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS refund_requests_status_idx ON refund_requests (status, created_at);
+CREATE INDEX IF NOT EXISTS refund_requests_payment_idx ON refund_requests (payment_id);
+
+CREATE TABLE IF NOT EXISTS refund_request_events (
+    id         BIGSERIAL PRIMARY KEY,
+    request_id TEXT NOT NULL REFERENCES refund_requests (id),
+    action     TEXT NOT NULL,
+    actor      TEXT NOT NULL DEFAULT '',
+    detail     TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS refund_request_events_request_idx ON refund_request_events (request_id, created_at);
@@ -0,0 +1,10 @@
+-- Evidence deadline reminders already emitted, one per dispute and
+-- reminder offset.
+CREATE TABLE IF NOT EXISTS dispute_reminders (
+    dispute_id TEXT NOT NULL REFERENCES disputes (id),
+    hours      INT NOT NULL,
+    sent_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (dispute_id, hours)
+);
+
+CREATE INDEX IF NOT EXISTS disputes_evidence_due_idx ON disputes (status, evidence_due_by);
@@ -0,0 +1,32 @@
+-- Checkout sessions exist before their PaymentIntent and track the
+-- funnel: created, method_selected, authenticated, then paid or
+-- abandoned. Events record every transition for funnel analytics.
+CREATE TABLE IF NOT EXISTS checkout_sessions (
+    id                  TEXT PRIMARY KEY,
+    tenant_id           TEXT NOT NULL DEFAULT '',
+    currency            TEXT NOT NULL,
+    amount              BIGINT NOT NULL CHECK (amount > 0),
+    request             JSONB NOT NULL,
+    status              TEXT NOT NULL,
+    payment_method_type TEXT NOT NULL DEFAULT '',
+    payment_id          TEXT UNIQUE,
+    payment_amount      BIGINT NOT NULL DEFAULT 0,
+    idempotency_key     TEXT UNIQUE,
+    expires_at          TIMESTAMPTZ NOT NULL,
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS checkout_sessions_expiry_idx ON checkout_sessions (status, expires_at);
+
+CREATE TABLE IF NOT EXISTS checkout_session_events (
+    id          BIGSERIAL PRIMARY KEY,
+    session_id  TEXT NOT NULL REFERENCES checkout_sessions (id),
+    from_status TEXT NOT NULL DEFAULT '',
+    to_status   TEXT NOT NULL,
+    detail      TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS checkout_session_events_session_idx ON checkout_session_events (session_id, created_at);
+CREATE INDEX IF NOT EXISTS checkout_session_events_funnel_idx ON checkout_session_events (to_status, created_at);
@@ -0,0 +1,45 @@
+-- Installment and layaway plans: a total split into scheduled off-session
+-- charges on a saved payment method. resume_status is the status a plan
+-- returns to when an early payoff is declined. An installment's attempts
+-- count all its charges; declines only those since its payment method
+-- last changed.
+CREATE TABLE IF NOT EXISTS payment_plans (
+    id              TEXT PRIMARY KEY,
+    tenant_id       TEXT NOT NULL DEFAULT '',
+    order_id        TEXT NOT NULL DEFAULT '',
+    customer_id     TEXT NOT NULL,
+    payment_method  TEXT NOT NULL,
+    currency        TEXT NOT NULL,
+    total_amount    BIGINT NOT NULL CHECK (total_amount > 0),
+    frequency       TEXT NOT NULL,
+    description     TEXT NOT NULL DEFAULT '',
+    status          TEXT NOT NULL,
+    resume_status   TEXT NOT NULL DEFAULT '',
+    missed_count    INT NOT NULL DEFAULT 0,
+    payoff_attempts INT NOT NULL DEFAULT 0,
+    payoff_id       TEXT,
+    idempotency_key TEXT UNIQUE,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS payment_plans_customer_idx ON payment_plans (customer_id, created_at);
+
+CREATE TABLE IF NOT EXISTS payment_plan_installments (
+    plan_id         TEXT NOT NULL REFERENCES payment_plans (id),
+    seq             INT NOT NULL,
+    amount          BIGINT NOT NULL CHECK (amount > 0),
+    due_at          TIMESTAMPTZ NOT NULL,
+    status          TEXT NOT NULL,
+    attempts        INT NOT NULL DEFAULT 0,
+    declines        INT NOT NULL DEFAULT 0,
+    payment_id      TEXT,
+    decline_code    TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ,
+    paid_at         TIMESTAMPTZ,
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (plan_id, seq)
+);
+
+CREATE INDEX IF NOT EXISTS payment_plan_installments_due_idx ON payment_plan_installments (status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS payment_plan_installments_payment_idx ON payment_plan_installments (payment_id);
@@ -0,0 +1,28 @@
+-- Our own IDs for customers' saved payment methods, each mapped to the
+-- token every provider that can charge it holds. fingerprint is Stripe's,
+-- used to keep one vaulted method per card and customer. A network token
+-- is stored as the token service's reference, never the token number.
+CREATE TABLE IF NOT EXISTS vaulted_payment_methods (
+    id          TEXT PRIMARY KEY,
+    tenant_id   TEXT NOT NULL DEFAULT '',
+    customer_id TEXT NOT NULL,
+    brand       TEXT NOT NULL DEFAULT '',
+    last4       TEXT NOT NULL DEFAULT '',
+    exp_month   INT NOT NULL DEFAULT 0,
+    exp_year    INT NOT NULL DEFAULT 0,
+    fingerprint TEXT NOT NULL DEFAULT '',
+    status      TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS vaulted_payment_methods_customer_idx ON vaulted_payment_methods (customer_id, fingerprint);
+
+CREATE TABLE IF NOT EXISTS vaulted_payment_method_tokens (
+    vault_id   TEXT NOT NULL REFERENCES vaulted_payment_methods (id),
+    provider   TEXT NOT NULL,
+    token      TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (vault_id, provider),
+    UNIQUE (provider, token)
+);
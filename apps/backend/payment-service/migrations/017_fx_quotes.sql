@@ -0,0 +1,16 @@
+-- Locked exchange rates for cross-currency checkout. A quote is kept
+-- after it expires, as the record of the rate its payments were charged
+-- at.
+CREATE TABLE IF NOT EXISTS fx_quotes (
+    id             TEXT PRIMARY KEY,
+    tenant_id      TEXT NOT NULL DEFAULT '',
+    amount         BIGINT NOT NULL CHECK (amount > 0),
+    currency       TEXT NOT NULL,
+    local_amount   BIGINT NOT NULL CHECK (local_amount > 0),
+    local_currency TEXT NOT NULL,
+    rate           DOUBLE PRECISION NOT NULL,
+    mid_rate       DOUBLE PRECISION NOT NULL,
+    markup_percent DOUBLE PRECISION NOT NULL DEFAULT 0,
+    expires_at     TIMESTAMPTZ NOT NULL,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,24 @@
+-- Provider balance transactions with their fee breakdown, one row each.
+-- Amounts are in the balance currency. payment_id is empty for
+-- account-level fees, which are kept so fee totals match payouts.
+CREATE TABLE IF NOT EXISTS payment_fees (
+    balance_transaction_id TEXT PRIMARY KEY,
+    provider               TEXT NOT NULL DEFAULT 'stripe',
+    payment_id             TEXT NOT NULL DEFAULT '',
+    source_id              TEXT NOT NULL DEFAULT '',
+    type                   TEXT NOT NULL,
+    currency               TEXT NOT NULL,
+    amount                 BIGINT NOT NULL,
+    fee                    BIGINT NOT NULL,
+    net                    BIGINT NOT NULL,
+    processing_fee         BIGINT NOT NULL DEFAULT 0,
+    application_fee        BIGINT NOT NULL DEFAULT 0,
+    tax                    BIGINT NOT NULL DEFAULT 0,
+    exchange_rate          DOUBLE PRECISION,
+    created_at             TIMESTAMPTZ NOT NULL,
+    available_on           TIMESTAMPTZ NOT NULL,
+    synced_at              TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS payment_fees_payment_idx ON payment_fees (payment_id);
+CREATE INDEX IF NOT EXISTS payment_fees_created_at_idx ON payment_fees (created_at);
@@ -0,0 +1,34 @@
+-- The card behind each payment, from its charge, so dispute rates can be
+-- tracked per BIN and card network and repeat disputers recognised.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS card_bin TEXT NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS card_brand TEXT NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS card_country TEXT NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS card_fingerprint TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS payments_card_fingerprint_idx ON payments (card_fingerprint) WHERE card_fingerprint <> '';
+CREATE INDEX IF NOT EXISTS payments_card_bin_created_idx ON payments (card_bin, created_at) WHERE card_bin <> '';
+
+-- Payments that looked like earlier chargebacks when they succeeded.
+-- reasons is a comma-separated list of the signals that matched.
+CREATE TABLE IF NOT EXISTS chargeback_risk_flags (
+    payment_id TEXT PRIMARY KEY REFERENCES payments (id),
+    tenant_id  TEXT NOT NULL DEFAULT '',
+    score      INT NOT NULL,
+    reasons    TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS chargeback_risk_flags_created_idx ON chargeback_risk_flags (created_at);
+
+-- Threshold alerts already emitted, one per tenant, card network, month
+-- and level.
+CREATE TABLE IF NOT EXISTS chargeback_risk_alerts (
+    tenant_id  TEXT NOT NULL,
+    network    TEXT NOT NULL,
+    month      DATE NOT NULL,
+    level      TEXT NOT NULL,
+    payments   BIGINT NOT NULL,
+    disputes   BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, network, month, level)
+);
@@ -0,0 +1,35 @@
+-- Loyalty points per customer and tenant. Points have no currency; the
+-- loyalty config values them per currency when they are redeemed. The
+-- balance can go below zero when points earned on a refunded payment
+-- were already spent.
+CREATE TABLE IF NOT EXISTS loyalty_accounts (
+    tenant_id   TEXT NOT NULL DEFAULT '',
+    customer_id TEXT NOT NULL,
+    balance     BIGINT NOT NULL DEFAULT 0,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, customer_id)
+);
+
+CREATE TABLE IF NOT EXISTS loyalty_transactions (
+    id              TEXT PRIMARY KEY,
+    tenant_id       TEXT NOT NULL DEFAULT '',
+    customer_id     TEXT NOT NULL,
+    type            TEXT NOT NULL,
+    points          BIGINT NOT NULL,
+    balance_after   BIGINT NOT NULL,
+    payment_id      TEXT NOT NULL DEFAULT '',
+    description     TEXT NOT NULL DEFAULT '',
+    reverses        TEXT REFERENCES loyalty_transactions (id),
+    idempotency_key TEXT,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS loyalty_transactions_customer_idx ON loyalty_transactions (tenant_id, customer_id, created_at);
+CREATE INDEX IF NOT EXISTS loyalty_transactions_payment_idx ON loyalty_transactions (payment_id) WHERE payment_id <> '';
+-- A retried request or a redelivered webhook must not move the balance
+-- again. Refunds reverse an earn in parts, so reverses isn't unique.
+CREATE UNIQUE INDEX IF NOT EXISTS loyalty_transactions_idempotency_idx
+    ON loyalty_transactions (tenant_id, customer_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS loyalty_transactions_earn_idx
+    ON loyalty_transactions (payment_id) WHERE type = 'earn';
@@ -0,0 +1,18 @@
+-- Invoices issued for payments. EU invoices need gap-free sequential
+-- numbers per seller, so a payment's number is assigned once, the first
+-- time its invoice is rendered, and kept with the issue date so the
+-- document reads the same every time it is downloaded. Stripe invoices
+-- carry their own numbers and aren't recorded here.
+CREATE TABLE IF NOT EXISTS invoice_sequences (
+    tenant_id   TEXT PRIMARY KEY,
+    last_number BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS payment_invoices (
+    payment_id TEXT PRIMARY KEY,
+    tenant_id  TEXT NOT NULL DEFAULT '',
+    number     TEXT NOT NULL,
+    issued_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS payment_invoices_number_idx ON payment_invoices (tenant_id, number);
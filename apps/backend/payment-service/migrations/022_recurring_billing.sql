@@ -0,0 +1,64 @@
+-- Subscriptions billed by the service itself rather than by Stripe, for
+-- providers without native subscriptions. Plans are immutable once
+-- created; a price change is a new plan.
+CREATE TABLE IF NOT EXISTS billing_plans (
+    id                TEXT PRIMARY KEY,
+    tenant_id         TEXT NOT NULL DEFAULT '',
+    name              TEXT NOT NULL,
+    currency          TEXT NOT NULL,
+    amount            BIGINT NOT NULL,
+    interval          TEXT NOT NULL,
+    interval_count    INT NOT NULL DEFAULT 1,
+    trial_period_days INT NOT NULL DEFAULT 0,
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS billing_subscriptions (
+    id                   TEXT PRIMARY KEY,
+    tenant_id            TEXT NOT NULL DEFAULT '',
+    customer_id          TEXT NOT NULL,
+    plan_id              TEXT NOT NULL REFERENCES billing_plans (id),
+    payment_method       TEXT NOT NULL,
+    status               TEXT NOT NULL,
+    billing_cycle_anchor TIMESTAMPTZ NOT NULL,
+    current_period_start TIMESTAMPTZ NOT NULL,
+    current_period_end   TIMESTAMPTZ NOT NULL,
+    trial_end            TIMESTAMPTZ,
+    cancel_at_period_end BOOLEAN NOT NULL DEFAULT false,
+    canceled_at          TIMESTAMPTZ,
+    ended_at             TIMESTAMPTZ,
+    latest_invoice       TEXT NOT NULL DEFAULT '',
+    idempotency_key      TEXT UNIQUE,
+    created_at           TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at           TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS billing_subscriptions_customer_idx ON billing_subscriptions (tenant_id, customer_id);
+CREATE INDEX IF NOT EXISTS billing_subscriptions_renewal_idx ON billing_subscriptions (current_period_end)
+    WHERE status IN ('trialing', 'active');
+
+-- One invoice per subscription and billing period. next_attempt_at is
+-- when an open invoice is charged next, and the lease of one being
+-- charged.
+CREATE TABLE IF NOT EXISTS billing_invoices (
+    id              TEXT PRIMARY KEY,
+    subscription_id TEXT NOT NULL REFERENCES billing_subscriptions (id),
+    period_start    TIMESTAMPTZ NOT NULL,
+    period_end      TIMESTAMPTZ NOT NULL,
+    amount          BIGINT NOT NULL,
+    currency        TEXT NOT NULL,
+    status          TEXT NOT NULL,
+    attempts        INT NOT NULL DEFAULT 0,
+    declines        INT NOT NULL DEFAULT 0,
+    payment_id      TEXT,
+    decline_code    TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ,
+    paid_at         TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (subscription_id, period_start)
+);
+
+CREATE INDEX IF NOT EXISTS billing_invoices_due_idx ON billing_invoices (next_attempt_at)
+    WHERE status IN ('open', 'charging');
+CREATE INDEX IF NOT EXISTS billing_invoices_payment_idx ON billing_invoices (payment_id) WHERE payment_id IS NOT NULL;
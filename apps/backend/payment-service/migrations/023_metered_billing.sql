@@ -0,0 +1,36 @@
+-- Metered plans bill each period in arrears for the usage reported during
+-- it, priced per unit or by tiers.
+ALTER TABLE billing_plans ADD COLUMN IF NOT EXISTS usage_type TEXT NOT NULL DEFAULT 'licensed';
+ALTER TABLE billing_plans ADD COLUMN IF NOT EXISTS aggregate_usage TEXT NOT NULL DEFAULT '';
+ALTER TABLE billing_plans ADD COLUMN IF NOT EXISTS tiers_mode TEXT NOT NULL DEFAULT '';
+ALTER TABLE billing_plans ADD COLUMN IF NOT EXISTS tiers JSONB;
+ALTER TABLE billing_plans ADD COLUMN IF NOT EXISTS transform_divide_by BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE billing_plans ADD COLUMN IF NOT EXISTS transform_round TEXT NOT NULL DEFAULT '';
+
+-- Usage reported against a metered subscription. The idempotency key is
+-- the client's, so a record sent twice is kept once.
+CREATE TABLE IF NOT EXISTS billing_usage_records (
+    id              TEXT PRIMARY KEY,
+    subscription_id TEXT NOT NULL REFERENCES billing_subscriptions (id),
+    quantity        BIGINT NOT NULL,
+    timestamp       TIMESTAMPTZ NOT NULL,
+    idempotency_key TEXT,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (subscription_id, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS billing_usage_records_period_idx ON billing_usage_records (subscription_id, timestamp);
+
+ALTER TABLE billing_invoices ADD COLUMN IF NOT EXISTS usage_quantity BIGINT;
+
+-- What an invoice's amount is made of: the plan for a licensed period, or
+-- one line per pricing tier the usage reached.
+CREATE TABLE IF NOT EXISTS billing_invoice_lines (
+    invoice_id  TEXT NOT NULL REFERENCES billing_invoices (id),
+    position    INT NOT NULL,
+    description TEXT NOT NULL,
+    quantity    BIGINT NOT NULL,
+    unit_amount BIGINT NOT NULL,
+    amount      BIGINT NOT NULL,
+    PRIMARY KEY (invoice_id, position)
+);
@@ -0,0 +1,21 @@
+-- Plan and quantity changes on our own subscriptions. A change mid-period
+-- is prorated: either onto the next renewal invoice, through pending
+-- items, or onto an invoice of its own. Only one invoice per period comes
+-- from renewals; update invoices start wherever the change was made.
+ALTER TABLE billing_subscriptions ADD COLUMN IF NOT EXISTS quantity INT NOT NULL DEFAULT 1;
+
+ALTER TABLE billing_invoices ADD COLUMN IF NOT EXISTS billing_reason TEXT NOT NULL DEFAULT 'subscription_cycle';
+ALTER TABLE billing_invoices DROP CONSTRAINT IF EXISTS billing_invoices_subscription_id_period_start_key;
+CREATE UNIQUE INDEX IF NOT EXISTS billing_invoices_period_idx ON billing_invoices (subscription_id, period_start)
+    WHERE billing_reason <> 'subscription_update';
+
+-- Proration lines waiting for the subscription's next invoice.
+CREATE TABLE IF NOT EXISTS billing_pending_items (
+    subscription_id TEXT NOT NULL REFERENCES billing_subscriptions (id),
+    position        INT NOT NULL,
+    description     TEXT NOT NULL,
+    quantity        BIGINT NOT NULL,
+    unit_amount     BIGINT NOT NULL,
+    amount          BIGINT NOT NULL,
+    PRIMARY KEY (subscription_id, position)
+);
@@ -0,0 +1,18 @@
+-- Trials on our own subscriptions may start without a payment method;
+-- trial_end_behavior says what happens if none was added by the end.
+ALTER TABLE billing_subscriptions ADD COLUMN IF NOT EXISTS trial_end_behavior TEXT NOT NULL DEFAULT 'create_invoice';
+ALTER TABLE billing_subscriptions ADD COLUMN IF NOT EXISTS trial_will_end_sent_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS billing_subscriptions_trial_idx ON billing_subscriptions (trial_end)
+    WHERE status = 'trialing' AND trial_will_end_sent_at IS NULL;
+
+-- Who has had a trial, per tenant: the customer, and the card behind any
+-- payment method a trial was given with, so a new customer ID with the
+-- same card doesn't get another one.
+CREATE TABLE IF NOT EXISTS billing_trials (
+    tenant_id       TEXT NOT NULL,
+    fingerprint     TEXT NOT NULL,
+    subscription_id TEXT NOT NULL REFERENCES billing_subscriptions (id),
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, fingerprint)
+);
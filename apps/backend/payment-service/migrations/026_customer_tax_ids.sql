@@ -0,0 +1,24 @@
+-- Customers' tax IDs and what checking them returned. EU VAT numbers are
+-- checked against VIES; a check that couldn't be made is pending and
+-- tried again. Only a verified number makes a payment reverse-charged.
+CREATE TABLE IF NOT EXISTS customer_tax_ids (
+    id                  TEXT PRIMARY KEY,
+    tenant_id           TEXT NOT NULL DEFAULT '',
+    customer_id         TEXT NOT NULL,
+    type                TEXT NOT NULL,
+    value               TEXT NOT NULL,
+    country             TEXT NOT NULL,
+    status              TEXT NOT NULL,
+    verified_name       TEXT NOT NULL DEFAULT '',
+    verified_address    TEXT NOT NULL DEFAULT '',
+    -- VIES's consultation number, the proof a number was valid when checked.
+    consultation_number TEXT NOT NULL DEFAULT '',
+    checked_at          TIMESTAMPTZ,
+    next_check_at       TIMESTAMPTZ,
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (tenant_id, customer_id, type, value)
+);
+
+CREATE INDEX IF NOT EXISTS customer_tax_ids_customer_idx ON customer_tax_ids (tenant_id, customer_id);
+CREATE INDEX IF NOT EXISTS customer_tax_ids_pending_idx ON customer_tax_ids (next_check_at)
+    WHERE status = 'pending';
@@ -0,0 +1,6 @@
+-- The earlier payment a payment repeats: same tenant, card, amount and
+-- currency within the duplicate window. Set once, when it is flagged.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS duplicate_of TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS payments_duplicate_lookup_idx
+    ON payments (tenant_id, card_fingerprint, amount, currency, created_at) WHERE card_fingerprint <> '';
@@ -0,0 +1,36 @@
+-- Cards, emails, customers, IPs and BINs the fraud team has blocked or
+-- allowed. tenant_id '' applies to every tenant. Entries past expires_at
+-- are kept but no longer match.
+CREATE TABLE IF NOT EXISTS fraud_list_entries (
+    id         TEXT PRIMARY KEY,
+    tenant_id  TEXT NOT NULL DEFAULT '',
+    list       TEXT NOT NULL,
+    type       TEXT NOT NULL,
+    value      TEXT NOT NULL,
+    reason     TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (tenant_id, list, type, value)
+);
+
+CREATE INDEX IF NOT EXISTS fraud_list_entries_value_idx ON fraud_list_entries (type, value);
+
+-- Every change to the lists and who made it. Rows outlive the entries
+-- they describe.
+CREATE TABLE IF NOT EXISTS fraud_list_changes (
+    id         BIGSERIAL PRIMARY KEY,
+    entry_id   TEXT NOT NULL,
+    tenant_id  TEXT NOT NULL DEFAULT '',
+    list       TEXT NOT NULL,
+    type       TEXT NOT NULL,
+    value      TEXT NOT NULL,
+    action     TEXT NOT NULL,
+    actor      TEXT NOT NULL DEFAULT '',
+    reason     TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS fraud_list_changes_created_idx ON fraud_list_changes (created_at);
+CREATE INDEX IF NOT EXISTS fraud_list_changes_entry_idx ON fraud_list_changes (entry_id);
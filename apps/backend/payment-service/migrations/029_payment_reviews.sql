@@ -0,0 +1,22 @@
+-- Payments held uncaptured for a reviewer after a risk rule flagged them.
+-- reasons is a comma-separated list of the rules that did. capture is
+-- auto when the service captures on approval, manual when the client
+-- does. Pending reviews past due_at are canceled.
+CREATE TABLE IF NOT EXISTS payment_reviews (
+    payment_id TEXT PRIMARY KEY,
+    tenant_id  TEXT NOT NULL DEFAULT '',
+    amount     BIGINT NOT NULL,
+    currency   TEXT NOT NULL,
+    reasons    TEXT NOT NULL,
+    capture    TEXT NOT NULL,
+    status     TEXT NOT NULL DEFAULT 'pending',
+    decided_by TEXT NOT NULL DEFAULT '',
+    note       TEXT NOT NULL DEFAULT '',
+    due_at     TIMESTAMPTZ NOT NULL,
+    decided_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS payment_reviews_due_idx ON payment_reviews (due_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS payment_reviews_created_idx ON payment_reviews (created_at);
@@ -0,0 +1,4 @@
+-- The region whose instance created each payment, when REGION is set. Each
+-- region has its own database, so rows from elsewhere mean a misrouted
+-- webhook or restore.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS region TEXT NOT NULL DEFAULT '';
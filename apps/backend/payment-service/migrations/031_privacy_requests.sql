@@ -0,0 +1,15 @@
+-- The audit log of data subject requests: every export and erasure of a
+-- customer's data, who asked for it and, for an erasure, how many rows of
+-- each table were deleted or anonymized. It keeps the customer ID, which
+-- is what shows the request was honored, and nothing else about them.
+CREATE TABLE IF NOT EXISTS privacy_requests (
+    id          TEXT PRIMARY KEY,
+    customer_id TEXT NOT NULL,
+    action      TEXT NOT NULL,
+    actor       TEXT NOT NULL DEFAULT '',
+    reason      TEXT NOT NULL DEFAULT '',
+    summary     JSONB NOT NULL DEFAULT '{}',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS privacy_requests_customer_idx ON privacy_requests (customer_id, created_at);
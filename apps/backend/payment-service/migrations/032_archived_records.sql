@@ -0,0 +1,15 @@
+-- Payments and refunds the retention job moved out of the working tables
+-- after their financial retention period, each a JSON copy of the row as
+-- it was, PII already removed. Nothing here is read by the service except
+-- the admin lookup.
+CREATE TABLE IF NOT EXISTS archived_records (
+    source      TEXT NOT NULL,
+    id          TEXT NOT NULL,
+    tenant_id   TEXT NOT NULL DEFAULT '',
+    record      JSONB NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL,
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (source, id)
+);
+
+CREATE INDEX IF NOT EXISTS archived_records_created_idx ON archived_records (created_at);
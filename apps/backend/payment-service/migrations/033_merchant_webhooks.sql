@@ -0,0 +1,58 @@
+-- Webhook endpoints platform tenants register for their payment events.
+-- events is a comma-separated list of event types, empty for all. The
+-- previous secret keeps signing until previous_secret_expires_at after a
+-- rotation.
+CREATE TABLE IF NOT EXISTS merchant_webhook_endpoints (
+    id                         TEXT PRIMARY KEY,
+    tenant_id                  TEXT NOT NULL,
+    url                        TEXT NOT NULL,
+    events                     TEXT NOT NULL DEFAULT '',
+    description                TEXT NOT NULL DEFAULT '',
+    status                     TEXT NOT NULL,
+    secret                     TEXT NOT NULL,
+    previous_secret            TEXT NOT NULL DEFAULT '',
+    previous_secret_expires_at TIMESTAMPTZ,
+    created_at                 TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at                 TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS merchant_webhook_endpoints_tenant_idx ON merchant_webhook_endpoints (tenant_id);
+
+-- One event on its way to one endpoint. Deliveries outlive their endpoint
+-- for the log, so endpoint_id has no foreign key.
+CREATE TABLE IF NOT EXISTS merchant_webhook_deliveries (
+    id               TEXT PRIMARY KEY,
+    endpoint_id      TEXT NOT NULL,
+    tenant_id        TEXT NOT NULL,
+    event_id         TEXT NOT NULL,
+    event_type       TEXT NOT NULL,
+    payload          JSONB NOT NULL,
+    status           TEXT NOT NULL,
+    attempts         INT NOT NULL DEFAULT 0,
+    next_attempt_at  TIMESTAMPTZ,
+    last_status_code INT NOT NULL DEFAULT 0,
+    last_error       TEXT NOT NULL DEFAULT '',
+    delivered_at     TIMESTAMPTZ,
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (endpoint_id, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS merchant_webhook_deliveries_due_idx ON merchant_webhook_deliveries (next_attempt_at)
+    WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS merchant_webhook_deliveries_tenant_idx ON merchant_webhook_deliveries (tenant_id, created_at);
+
+-- Every attempt at a delivery, automatic or a manual redelivery.
+CREATE TABLE IF NOT EXISTS merchant_webhook_attempts (
+    id          BIGSERIAL PRIMARY KEY,
+    delivery_id TEXT NOT NULL REFERENCES merchant_webhook_deliveries (id),
+    attempt     INT NOT NULL,
+    trigger     TEXT NOT NULL,
+    status_code INT NOT NULL DEFAULT 0,
+    error       TEXT NOT NULL DEFAULT '',
+    response    TEXT NOT NULL DEFAULT '',
+    duration_ms BIGINT NOT NULL DEFAULT 0,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS merchant_webhook_attempts_delivery_idx ON merchant_webhook_attempts (delivery_id, created_at);
@@ -0,0 +1,26 @@
+-- Sellers' Stripe connected accounts, kept current from account.updated.
+-- requirements_due is a comma-separated list of the fields Stripe needs
+-- now; capabilities maps each requested capability to its status.
+CREATE TABLE IF NOT EXISTS connected_accounts (
+    id                TEXT PRIMARY KEY,
+    tenant_id         TEXT NOT NULL DEFAULT '',
+    seller_id         TEXT NOT NULL DEFAULT '',
+    type              TEXT NOT NULL,
+    country           TEXT NOT NULL,
+    email             TEXT NOT NULL DEFAULT '',
+    onboarding_status TEXT NOT NULL,
+    charges_enabled   BOOLEAN NOT NULL DEFAULT false,
+    payouts_enabled   BOOLEAN NOT NULL DEFAULT false,
+    details_submitted BOOLEAN NOT NULL DEFAULT false,
+    capabilities      JSONB NOT NULL DEFAULT '{}',
+    requirements_due  TEXT NOT NULL DEFAULT '',
+    disabled_reason   TEXT NOT NULL DEFAULT '',
+    current_deadline  TIMESTAMPTZ,
+    onboarded_at      TIMESTAMPTZ,
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS connected_accounts_seller_idx
+    ON connected_accounts (tenant_id, seller_id) WHERE seller_id <> '';
+CREATE INDEX IF NOT EXISTS connected_accounts_status_idx ON connected_accounts (onboarding_status);
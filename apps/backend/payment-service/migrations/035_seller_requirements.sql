@@ -0,0 +1,8 @@
+-- Each kind of verification requirement kept separately, as comma-separated
+-- lists; requirements_due holds those currently due. restricted_at is when
+-- the account last became restricted or rejected.
+ALTER TABLE connected_accounts
+    ADD COLUMN IF NOT EXISTS eventually_due       TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS past_due             TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS pending_verification TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS restricted_at        TIMESTAMPTZ;
@@ -0,0 +1,26 @@
+-- Sellers' payout schedules as last set on their connected accounts.
+ALTER TABLE connected_accounts ADD COLUMN IF NOT EXISTS payout_schedule JSONB;
+
+-- The audit log of seller payouts: each on-demand payout made or refused,
+-- and each schedule change, with who asked for it. schedule is the
+-- schedule a change set; reason is why a payout was refused.
+CREATE TABLE IF NOT EXISTS seller_payout_audit (
+    id         TEXT PRIMARY KEY,
+    account_id TEXT NOT NULL,
+    tenant_id  TEXT NOT NULL DEFAULT '',
+    seller_id  TEXT NOT NULL DEFAULT '',
+    action     TEXT NOT NULL,
+    payout_id  TEXT NOT NULL DEFAULT '',
+    amount     BIGINT NOT NULL DEFAULT 0,
+    currency   TEXT NOT NULL DEFAULT '',
+    method     TEXT NOT NULL DEFAULT '',
+    schedule   JSONB,
+    reason     TEXT NOT NULL DEFAULT '',
+    actor      TEXT NOT NULL DEFAULT '',
+    request_id TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS seller_payout_audit_account_idx ON seller_payout_audit (account_id, created_at);
+CREATE UNIQUE INDEX IF NOT EXISTS seller_payout_audit_payout_idx
+    ON seller_payout_audit (payout_id) WHERE action = 'payout_created';
@@ -0,0 +1,22 @@
+-- Holds on sellers' balances, kept out of their payouts until released.
+-- The amounts held are in the ledger, moved between seller:<account> and
+-- reserve:<account>; this is what each hold is for and who placed it.
+CREATE TABLE IF NOT EXISTS balance_holds (
+    id           TEXT PRIMARY KEY,
+    account_id   TEXT NOT NULL,
+    tenant_id    TEXT NOT NULL DEFAULT '',
+    seller_id    TEXT NOT NULL DEFAULT '',
+    amount       BIGINT NOT NULL CHECK (amount > 0),
+    currency     TEXT NOT NULL,
+    reason       TEXT NOT NULL,
+    reference    TEXT NOT NULL DEFAULT '',
+    note         TEXT NOT NULL DEFAULT '',
+    status       TEXT NOT NULL,
+    placed_by    TEXT NOT NULL DEFAULT '',
+    released_by  TEXT NOT NULL DEFAULT '',
+    release_note TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    released_at  TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS balance_holds_account_idx ON balance_holds (account_id, status);
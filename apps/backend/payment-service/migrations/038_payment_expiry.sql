@@ -0,0 +1,4 @@
+-- Incomplete payments, oldest first, for the sweeper that cancels those
+-- left past PAYMENT_EXPIRY_TTL and marks them abandoned.
+CREATE INDEX IF NOT EXISTS payments_incomplete_idx ON payments (created_at)
+    WHERE status IN ('requires_payment_method', 'requires_confirmation', 'requires_action');
@@ -0,0 +1,13 @@
+-- Price breakdowns quoted before checkout. A payment created with a
+-- quote's ID must be for the same request and come to the same total; the
+-- quote is kept after it expires, as the record of what was shown.
+CREATE TABLE IF NOT EXISTS payment_quotes (
+    id         TEXT PRIMARY KEY,
+    tenant_id  TEXT NOT NULL DEFAULT '',
+    request    JSONB NOT NULL,
+    breakdown  JSONB NOT NULL,
+    total      BIGINT NOT NULL,
+    currency   TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
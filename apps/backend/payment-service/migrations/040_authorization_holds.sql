@@ -0,0 +1,27 @@
+-- Card authorizations held past the network's validity, such as rental
+-- deposits. Before each authorization lapses the hold is moved to a new
+-- one on the same saved card; payment_id is the one currently held.
+CREATE TABLE IF NOT EXISTS authorization_holds (
+    id                  TEXT PRIMARY KEY,
+    payment_id          TEXT NOT NULL,
+    original_payment_id TEXT NOT NULL UNIQUE,
+    tenant_id           TEXT NOT NULL DEFAULT '',
+    customer_id         TEXT NOT NULL,
+    payment_method      TEXT NOT NULL,
+    amount              BIGINT NOT NULL CHECK (amount > 0),
+    currency            TEXT NOT NULL,
+    network             TEXT NOT NULL DEFAULT '',
+    status              TEXT NOT NULL,
+    hold_until          TIMESTAMPTZ,
+    authorized_at       TIMESTAMPTZ NOT NULL,
+    auth_expires_at     TIMESTAMPTZ NOT NULL,
+    reauthorizations    INT NOT NULL DEFAULT 0,
+    failures            INT NOT NULL DEFAULT 0,
+    last_error          TEXT NOT NULL DEFAULT '',
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ended_at            TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS authorization_holds_payment_idx ON authorization_holds (payment_id);
+CREATE INDEX IF NOT EXISTS authorization_holds_due_idx ON authorization_holds (auth_expires_at) WHERE status = 'active';
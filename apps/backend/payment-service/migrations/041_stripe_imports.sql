@@ -0,0 +1,24 @@
+-- Backfills of payments, charges and refunds from Stripe. cursor is the
+-- last PaymentIntent imported, so an import that stopped resumes after
+-- it; lease_until keeps one instance on an import at a time.
+CREATE TABLE IF NOT EXISTS stripe_imports (
+    id           TEXT PRIMARY KEY,
+    status       TEXT NOT NULL,
+    created_gte  TIMESTAMPTZ,
+    created_lt   TIMESTAMPTZ,
+    cursor       TEXT NOT NULL DEFAULT '',
+    payments     INTEGER NOT NULL DEFAULT 0,
+    charges      INTEGER NOT NULL DEFAULT 0,
+    refunds      INTEGER NOT NULL DEFAULT 0,
+    skipped      INTEGER NOT NULL DEFAULT 0,
+    failures     INTEGER NOT NULL DEFAULT 0,
+    last_error   TEXT NOT NULL DEFAULT '',
+    requested_by TEXT NOT NULL DEFAULT '',
+    lease_until  TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at  TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS stripe_imports_open_idx ON stripe_imports (created_at)
+    WHERE status IN ('pending', 'running');
@@ -0,0 +1,13 @@
+-- Which provider arm each A/B-routed payment went to. Calls about the
+-- payment use that arm's account; outcome is pending until the payment
+-- succeeds or a confirmation fails, for auth rates per arm.
+CREATE TABLE IF NOT EXISTS payment_routes (
+    payment_id  TEXT PRIMARY KEY,
+    arm         TEXT NOT NULL,
+    outcome     TEXT NOT NULL DEFAULT 'pending',
+    latency_ms  INTEGER NOT NULL DEFAULT 0,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS payment_routes_arm_idx ON payment_routes (arm, created_at);
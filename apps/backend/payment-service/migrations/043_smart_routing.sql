@@ -0,0 +1,9 @@
+-- What smart routing decided for each payment and from what: reason is
+-- percent, smart, insufficient_data or unhealthy, decision the estimates
+-- per arm. The card and method the payment was attempted with feed the
+-- auth rates later decisions use.
+ALTER TABLE payment_routes ADD COLUMN IF NOT EXISTS reason TEXT NOT NULL DEFAULT 'percent';
+ALTER TABLE payment_routes ADD COLUMN IF NOT EXISTS decision JSONB;
+ALTER TABLE payment_routes ADD COLUMN IF NOT EXISTS card_bin TEXT NOT NULL DEFAULT '';
+ALTER TABLE payment_routes ADD COLUMN IF NOT EXISTS card_country TEXT NOT NULL DEFAULT '';
+ALTER TABLE payment_routes ADD COLUMN IF NOT EXISTS payment_method TEXT NOT NULL DEFAULT '';
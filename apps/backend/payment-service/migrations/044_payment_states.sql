@@ -0,0 +1,31 @@
+-- The service's own lifecycle state of each payment, derived from the
+-- provider status, refunds and disputes, and every transition it went
+-- through. Existing payments start from a backfilled state.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS state TEXT NOT NULL DEFAULT 'created';
+
+CREATE TABLE IF NOT EXISTS payment_state_transitions (
+    id              BIGSERIAL PRIMARY KEY,
+    payment_id      TEXT NOT NULL,
+    from_state      TEXT NOT NULL DEFAULT '',
+    to_state        TEXT NOT NULL,
+    provider_status TEXT NOT NULL DEFAULT '',
+    source          TEXT NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS payment_state_transitions_payment_idx ON payment_state_transitions (payment_id, id);
+
+UPDATE payments p SET state = CASE
+    WHEN p.status = 'requires_action' THEN 'requires_action'
+    WHEN p.status IN ('processing', 'requires_capture', 'pending_review') THEN 'processing'
+    WHEN p.status IN ('canceled', 'abandoned') THEN 'canceled'
+    WHEN p.status <> 'succeeded' THEN 'created'
+    WHEN EXISTS (SELECT 1 FROM disputes d WHERE d.payment_id = p.id AND d.status NOT IN ('won', 'warning_closed')) THEN 'disputed'
+    WHEN p.amount_refunded > 0 AND p.amount_refunded >= p.amount_received THEN 'refunded'
+    WHEN p.amount_refunded > 0 THEN 'partially_refunded'
+    ELSE 'succeeded' END
+WHERE NOT EXISTS (SELECT 1 FROM payment_state_transitions t WHERE t.payment_id = p.id);
+
+INSERT INTO payment_state_transitions (payment_id, to_state, provider_status, source)
+SELECT p.id, p.state, p.status, 'backfill' FROM payments p
+WHERE NOT EXISTS (SELECT 1 FROM payment_state_transitions t WHERE t.payment_id = p.id);
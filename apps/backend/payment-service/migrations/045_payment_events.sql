@@ -0,0 +1,49 @@
+-- Append-only stream of changes to each payment, numbered per payment.
+-- data holds the fields that changed; folding a payment's events in
+-- version order, from its latest snapshot on, gives the payment as it
+-- was at any time. Customer IDs, card details and descriptions stay out
+-- of the stream, so erasure and retention never have to rewrite it;
+-- payment_method is only the method's type, such as card.
+CREATE TABLE IF NOT EXISTS payment_events (
+    id          BIGSERIAL PRIMARY KEY,
+    payment_id  TEXT NOT NULL,
+    version     INTEGER NOT NULL,
+    type        TEXT NOT NULL,
+    data        JSONB NOT NULL,
+    source      TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (payment_id, version)
+);
+
+CREATE INDEX IF NOT EXISTS payment_events_created_idx ON payment_events (created_at);
+
+CREATE TABLE IF NOT EXISTS payment_snapshots (
+    payment_id  TEXT NOT NULL,
+    version     INTEGER NOT NULL,
+    state       JSONB NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (payment_id, version)
+);
+
+-- Existing payments start their stream from what is stored now.
+INSERT INTO payment_events (payment_id, version, type, data, source, created_at)
+SELECT p.id, 1, 'payment.backfilled', jsonb_build_object(
+        'tenant_id', p.tenant_id,
+        'order_id', p.order_id,
+        'amount', p.amount,
+        'amount_received', p.amount_received,
+        'amount_refunded', p.amount_refunded,
+        'currency', p.currency,
+        'status', p.status,
+        'state', p.state,
+        'payment_method', p.payment_method,
+        'region', p.region,
+        'refunds', COALESCE((SELECT jsonb_object_agg(r.id, jsonb_build_object(
+            'amount', r.amount, 'status', r.status, 'reason', r.reason))
+            FROM refunds r WHERE r.payment_id = p.id), '{}'::jsonb),
+        'disputes', COALESCE((SELECT jsonb_object_agg(d.id, jsonb_build_object(
+            'amount', d.amount, 'status', d.status, 'reason', d.reason))
+            FROM disputes d WHERE d.payment_id = p.id), '{}'::jsonb)),
+    'backfill', p.updated_at
+FROM payments p
+WHERE NOT EXISTS (SELECT 1 FROM payment_events e WHERE e.payment_id = p.id);
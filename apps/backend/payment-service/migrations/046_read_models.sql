@@ -0,0 +1,71 @@
+-- Read models projected from payment_events, serving lists and reports
+-- apart from the tables payments are written to. Each is only written by
+-- the projector, which records in read_model_checkpoints the last event
+-- it applied.
+CREATE TABLE IF NOT EXISTS read_model_checkpoints (
+    name           TEXT PRIMARY KEY,
+    last_event_id  BIGINT NOT NULL DEFAULT 0,
+    updated_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- One row per payment: its aggregate as of version, flattened for lists,
+-- with the customer looked up when projected.
+CREATE TABLE IF NOT EXISTS payment_summaries (
+    id              TEXT PRIMARY KEY,
+    tenant_id       TEXT NOT NULL DEFAULT '',
+    customer_id     TEXT NOT NULL DEFAULT '',
+    order_id        TEXT NOT NULL DEFAULT '',
+    amount          BIGINT NOT NULL DEFAULT 0,
+    amount_received BIGINT NOT NULL DEFAULT 0,
+    amount_refunded BIGINT NOT NULL DEFAULT 0,
+    currency        TEXT NOT NULL DEFAULT '',
+    status          TEXT NOT NULL DEFAULT '',
+    state           TEXT NOT NULL DEFAULT '',
+    payment_method  TEXT NOT NULL DEFAULT '',
+    description     TEXT NOT NULL DEFAULT '',
+    region          TEXT NOT NULL DEFAULT '',
+    refund_count    INTEGER NOT NULL DEFAULT 0,
+    dispute_count   INTEGER NOT NULL DEFAULT 0,
+    version         INTEGER NOT NULL,
+    aggregate       JSONB NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL,
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS payment_summaries_created_idx ON payment_summaries (created_at);
+CREATE INDEX IF NOT EXISTS payment_summaries_tenant_created_idx ON payment_summaries (tenant_id, created_at);
+CREATE INDEX IF NOT EXISTS payment_summaries_customer_idx ON payment_summaries (customer_id);
+
+-- Payments by UTC day of creation and their current status.
+CREATE TABLE IF NOT EXISTS payment_daily_totals (
+    day             DATE NOT NULL,
+    tenant_id       TEXT NOT NULL,
+    currency        TEXT NOT NULL,
+    status          TEXT NOT NULL,
+    payment_method  TEXT NOT NULL,
+    count           BIGINT NOT NULL DEFAULT 0,
+    amount          BIGINT NOT NULL DEFAULT 0,
+    amount_received BIGINT NOT NULL DEFAULT 0,
+    amount_refunded BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (day, tenant_id, currency, status, payment_method)
+);
+
+-- What each customer has paid, per currency.
+CREATE TABLE IF NOT EXISTS customer_ltv (
+    tenant_id        TEXT NOT NULL,
+    customer_id      TEXT NOT NULL,
+    currency         TEXT NOT NULL,
+    payments         BIGINT NOT NULL DEFAULT 0,
+    amount_received  BIGINT NOT NULL DEFAULT 0,
+    amount_refunded  BIGINT NOT NULL DEFAULT 0,
+    first_payment_at TIMESTAMPTZ,
+    last_payment_at  TIMESTAMPTZ,
+    updated_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, customer_id, currency)
+);
+
+-- Streams recorded before the aggregate carried the payment's creation
+-- time gain it on their first event.
+UPDATE payment_events e SET data = e.data || jsonb_build_object('created_at', p.created_at)
+FROM payments p
+WHERE e.payment_id = p.id AND e.version = 1 AND NOT e.data ? 'created_at';
@@ -0,0 +1,29 @@
+-- Work that failed and is not retried on its own: Stripe webhook events
+-- the service could not apply, broker publishes, and merchant webhook
+-- deliveries out of attempts. ref is the webhook event or delivery it
+-- came from; a failing event redelivered by Stripe bumps attempts on its
+-- open entry rather than adding one. payload is what a retry sends,
+-- edited or as recorded. An entry is retrying while a retry is under way;
+-- one left retrying past its lease can be retried again.
+CREATE TABLE IF NOT EXISTS dead_letters (
+    id           TEXT PRIMARY KEY,
+    kind         TEXT NOT NULL,
+    ref          TEXT NOT NULL DEFAULT '',
+    topic        TEXT NOT NULL DEFAULT '',
+    key          TEXT NOT NULL DEFAULT '',
+    payload      TEXT NOT NULL,
+    error        TEXT NOT NULL,
+    attempts     INTEGER NOT NULL DEFAULT 1,
+    status       TEXT NOT NULL DEFAULT 'pending',
+    edited       BOOLEAN NOT NULL DEFAULT false,
+    retry_error  TEXT NOT NULL DEFAULT '',
+    resolved_by  TEXT NOT NULL DEFAULT '',
+    note         TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    resolved_at  TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS dead_letters_status_idx ON dead_letters (status, created_at);
+CREATE UNIQUE INDEX IF NOT EXISTS dead_letters_open_ref_idx ON dead_letters (kind, ref)
+    WHERE status IN ('pending', 'retrying') AND ref <> '';
@@ -0,0 +1,46 @@
+-- Bulk refunds: a list of payments, given or matched by a payments list
+-- filter when the job was created, refunded in the background. Each item
+-- is refunded under its own idempotency key, so a job picked up again
+-- after a restart or a failed batch does not refund twice; lease_until
+-- keeps one instance on a job at a time.
+CREATE TABLE IF NOT EXISTS bulk_refunds (
+    id              TEXT PRIMARY KEY,
+    status          TEXT NOT NULL,
+    reason          TEXT NOT NULL DEFAULT '',
+    filter          TEXT NOT NULL DEFAULT '',
+    total           INTEGER NOT NULL DEFAULT 0,
+    refunded        INTEGER NOT NULL DEFAULT 0,
+    held            INTEGER NOT NULL DEFAULT 0,
+    failed          INTEGER NOT NULL DEFAULT 0,
+    failures        INTEGER NOT NULL DEFAULT 0,
+    last_error      TEXT NOT NULL DEFAULT '',
+    requested_by    TEXT NOT NULL DEFAULT '',
+    idempotency_key TEXT UNIQUE,
+    lease_until     TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at     TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS bulk_refunds_open_idx ON bulk_refunds (created_at)
+    WHERE status IN ('pending', 'running');
+
+-- amount 0 refunds what is left of the payment. held items went to the
+-- refund approval queue as refund_request_id.
+CREATE TABLE IF NOT EXISTS bulk_refund_items (
+    bulk_refund_id    TEXT NOT NULL REFERENCES bulk_refunds (id) ON DELETE CASCADE,
+    seq               INTEGER NOT NULL,
+    payment_id        TEXT NOT NULL,
+    amount            BIGINT NOT NULL DEFAULT 0,
+    status            TEXT NOT NULL DEFAULT 'pending',
+    refund_id         TEXT NOT NULL DEFAULT '',
+    refund_request_id TEXT NOT NULL DEFAULT '',
+    refunded          BIGINT NOT NULL DEFAULT 0,
+    currency          TEXT NOT NULL DEFAULT '',
+    error             TEXT NOT NULL DEFAULT '',
+    updated_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (bulk_refund_id, seq)
+);
+
+CREATE INDEX IF NOT EXISTS bulk_refund_items_pending_idx ON bulk_refund_items (bulk_refund_id, seq)
+    WHERE status = 'pending';
@@ -0,0 +1,3 @@
+-- A bulk refund imported from CSV carries a reason per row; an item
+-- without one takes its job's.
+ALTER TABLE bulk_refund_items ADD COLUMN IF NOT EXISTS reason TEXT NOT NULL DEFAULT '';
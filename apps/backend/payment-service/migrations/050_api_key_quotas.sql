@@ -0,0 +1,4 @@
+-- Per-key request quotas. NULL follows the runtime config's
+-- api_key_quotas default; 0 is unlimited.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS quota_per_minute INTEGER;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS quota_per_day INTEGER;
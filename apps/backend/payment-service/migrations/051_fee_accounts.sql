@@ -0,0 +1,3 @@
+-- Which Stripe account each balance transaction is on, so fee reports
+-- can be split or consolidated across the primary and alternate.
+ALTER TABLE payment_fees ADD COLUMN IF NOT EXISTS account TEXT NOT NULL DEFAULT 'primary';
@@ -0,0 +1,20 @@
+-- Payment and refund calls to Stripe still in flight when a shutdown's
+-- grace period ran out: Stripe may or may not have acted on them. The
+-- next start fetches the payments involved and syncs them, then marks
+-- each resolved, or unresolved when nothing identifies the payment.
+CREATE TABLE IF NOT EXISTS unconfirmed_operations (
+    id              TEXT PRIMARY KEY,
+    operation       TEXT NOT NULL,
+    payment_id      TEXT NOT NULL DEFAULT '',
+    order_id        TEXT NOT NULL DEFAULT '',
+    tenant_id       TEXT NOT NULL DEFAULT '',
+    idempotency_key TEXT NOT NULL DEFAULT '',
+    status          TEXT NOT NULL DEFAULT 'pending',
+    resolution      TEXT NOT NULL DEFAULT '',
+    started_at      TIMESTAMPTZ NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    resolved_at     TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS unconfirmed_operations_pending_idx ON unconfirmed_operations (started_at)
+    WHERE status = 'pending';
@@ -0,0 +1,22 @@
+-- Every webhook delivery from Stripe, so "did we receive the event?" is
+-- answered without the Stripe dashboard. id is Stripe's event ID, and a
+-- redelivery bumps attempts on the event's row. Deliveries whose
+-- signature didn't verify are kept too, under a generated ID, with
+-- signature 'invalid' and what the payload claimed it was.
+CREATE TABLE IF NOT EXISTS webhook_events (
+    id              TEXT PRIMARY KEY,
+    type            TEXT NOT NULL DEFAULT '',
+    payment_id      TEXT NOT NULL DEFAULT '',
+    signature       TEXT NOT NULL,
+    status          TEXT NOT NULL,
+    attempts        INTEGER NOT NULL DEFAULT 1,
+    last_error      TEXT NOT NULL DEFAULT '',
+    payload         TEXT NOT NULL,
+    received_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    processed_at    TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS webhook_events_received_idx ON webhook_events (received_at);
+CREATE INDEX IF NOT EXISTS webhook_events_payment_idx ON webhook_events (payment_id) WHERE payment_id <> '';
+CREATE INDEX IF NOT EXISTS webhook_events_type_idx ON webhook_events (type, received_at);
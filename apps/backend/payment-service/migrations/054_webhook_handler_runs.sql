@@ -0,0 +1,16 @@
+-- Which webhook handlers have applied which Stripe events, so a
+-- redelivery, on any instance and across restarts, skips the handlers
+-- that already ran. A handler claims its row ('running') before it runs
+-- and marks it 'done' after; a failure deletes the claim, and a claim
+-- older than the lease is taken to be from an instance that died.
+CREATE TABLE IF NOT EXISTS webhook_handler_runs (
+    event_id     TEXT NOT NULL,
+    handler      TEXT NOT NULL,
+    status       TEXT NOT NULL,
+    claimed_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ,
+    expires_at   TIMESTAMPTZ,
+    PRIMARY KEY (event_id, handler)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_handler_runs_expires_idx ON webhook_handler_runs (expires_at);
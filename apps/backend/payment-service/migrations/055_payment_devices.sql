@@ -0,0 +1,10 @@
+-- The device a payment was made from, as the client reported it at
+-- creation: the customer's IP address and user agent, and the device ID
+-- our frontend SDK fingerprints the browser or app with. Kept for the
+-- risk rules' device counts and cleared with the payment's other PII.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS client_ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS device_id TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS payments_device_created_idx
+    ON payments (tenant_id, device_id, created_at) WHERE device_id <> '';
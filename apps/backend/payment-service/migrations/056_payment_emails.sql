@@ -0,0 +1,14 @@
+-- Emails sent about a payment, such as its receipt, as the mailer service
+-- took them or turned them down. The recipient is kept masked, so erasure
+-- and retention have nothing to clear here.
+CREATE TABLE IF NOT EXISTS payment_emails (
+    id         BIGSERIAL PRIMARY KEY,
+    payment_id TEXT NOT NULL,
+    kind       TEXT NOT NULL,
+    recipient  TEXT NOT NULL DEFAULT '',
+    status     TEXT NOT NULL,
+    error      TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS payment_emails_payment_idx ON payment_emails (payment_id, created_at);
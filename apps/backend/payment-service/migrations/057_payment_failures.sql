@@ -0,0 +1,8 @@
+-- Why a payment's last attempt failed, from the intent's last payment
+-- error: Stripe's error code, the issuer's decline code for card
+-- declines, and the message. Cleared again when the intent moves on.
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS failure_code TEXT NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS decline_code TEXT NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS failure_message TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS payments_failed_created_idx ON payments (created_at) WHERE state = 'failed';
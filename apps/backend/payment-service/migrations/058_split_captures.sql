@@ -0,0 +1,41 @@
+-- Authorizations captured in parts, one per shipment. mode is
+-- multicapture when the card lets the one authorization be captured
+-- several times, recharge when the first shipment is captured from it
+-- and the rest charged anew to the saved card. captured counts what the
+-- shipments took, including those in flight, so it never passes
+-- authorized. Open ones are closed, and what is left of the authorization
+-- released, shortly before auth_expires_at.
+CREATE TABLE IF NOT EXISTS split_captures (
+    payment_id      TEXT PRIMARY KEY,
+    tenant_id       TEXT NOT NULL DEFAULT '',
+    customer_id     TEXT NOT NULL DEFAULT '',
+    payment_method  TEXT NOT NULL DEFAULT '',
+    currency        TEXT NOT NULL,
+    authorized      BIGINT NOT NULL CHECK (authorized > 0),
+    captured        BIGINT NOT NULL DEFAULT 0 CHECK (captured >= 0 AND captured <= authorized),
+    mode            TEXT NOT NULL,
+    status          TEXT NOT NULL,
+    auth_expires_at TIMESTAMPTZ NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ended_at        TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS split_captures_due_idx ON split_captures (auth_expires_at) WHERE status = 'open';
+
+-- Each shipment's capture. charge_id is the intent that collected it: the
+-- authorized one, or a recharge's. A failed capture may be tried again
+-- under the same shipment ID; attempts keeps the provider's idempotency
+-- keys apart.
+CREATE TABLE IF NOT EXISTS shipment_captures (
+    payment_id  TEXT NOT NULL REFERENCES split_captures (payment_id),
+    shipment_id TEXT NOT NULL,
+    amount      BIGINT NOT NULL CHECK (amount > 0),
+    status      TEXT NOT NULL,
+    charge_id   TEXT NOT NULL DEFAULT '',
+    attempts    INT NOT NULL DEFAULT 1,
+    last_error  TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (payment_id, shipment_id)
+);
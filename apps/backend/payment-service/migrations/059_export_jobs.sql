@@ -0,0 +1,20 @@
+-- Asynchronous exports, kept here rather than in the instance that ran
+-- them so any instance behind the load balancer can answer a job's status
+-- and serve its file. content is the finished file; jobs are deleted
+-- with their files once their download links expire.
+CREATE TABLE IF NOT EXISTS export_jobs (
+    id         TEXT PRIMARY KEY,
+    kind       TEXT NOT NULL,
+    format     TEXT NOT NULL,
+    from_at    TIMESTAMPTZ NOT NULL,
+    to_at      TIMESTAMPTZ NOT NULL,
+    columns    TEXT NOT NULL DEFAULT '',
+    status     TEXT NOT NULL,
+    row_count  INT NOT NULL DEFAULT 0,
+    error      TEXT NOT NULL DEFAULT '',
+    content    BYTEA,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS export_jobs_created_idx ON export_jobs (created_at);
@@ -0,0 +1,10 @@
+-- The PaymentIntents created to top up a wallet. The succeeded webhook
+-- credits a wallet only for an intent recorded here, for the amount and
+-- currency recorded, whatever the intent's metadata says.
+CREATE TABLE IF NOT EXISTS wallet_top_ups (
+    payment_id TEXT PRIMARY KEY,
+    wallet_id  TEXT NOT NULL REFERENCES wallets (id),
+    amount     BIGINT NOT NULL CHECK (amount > 0),
+    currency   TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
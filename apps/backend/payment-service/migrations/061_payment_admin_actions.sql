@@ -0,0 +1,18 @@
+-- What operators did to a payment, and with which key, for its timeline:
+-- refunds, resyncs, captures, releases and the wallet and points
+-- adjustments made for it. object_id is what was acted on, such as the
+-- refund or the authorization hold.
+CREATE TABLE IF NOT EXISTS payment_admin_actions (
+    id         BIGSERIAL PRIMARY KEY,
+    payment_id TEXT NOT NULL,
+    action     TEXT NOT NULL,
+    object_id  TEXT NOT NULL DEFAULT '',
+    actor      TEXT NOT NULL DEFAULT '',
+    detail     JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS payment_admin_actions_payment_idx ON payment_admin_actions (payment_id, created_at);
+
+-- The key a refund was requested with, from its requested_by metadata.
+ALTER TABLE refunds ADD COLUMN IF NOT EXISTS requested_by TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,6 @@
+-- Descriptions are free text that can name the customer, which erasure
+-- clears from payments but can't rewrite in an append-only stream, so the
+-- stream no longer keeps them. This removes those an earlier backfill and
+-- earlier events recorded.
+UPDATE payment_events SET data = data - 'description' WHERE data ? 'description';
+UPDATE payment_snapshots SET state = state - 'description' WHERE state ? 'description';
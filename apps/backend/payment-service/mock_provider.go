@@ -0,0 +1,1684 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/form"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+// mockWebhookSecret signs mock webhooks when STRIPE_WEBHOOK_SECRET is unset.
+const mockWebhookSecret = "whsec_mock"
+
+// MockConfig controls how the mock provider behaves.
+type MockConfig struct {
+	// Latency is added to every API call.
+	Latency time.Duration
+	// ConfirmDelay is how long after creation an intent confirms itself,
+	// standing in for the customer finishing Stripe.js. Zero disables it;
+	// intents then wait for an explicit confirm.
+	ConfirmDelay time.Duration
+	// Declines maps amounts to decline codes, e.g. 402 -> card_declined.
+	Declines map[int64]string
+	// WebhookURL receives signed events; empty disables emission.
+	WebhookURL    string
+	WebhookSecret string
+	// BaseURL is where the service is reached, for the mock's hosted
+	// onboarding pages behind account links.
+	BaseURL string
+}
+
+// parseMockDeclines reads "amount:decline_code,..." as used by MOCK_DECLINES.
+func parseMockDeclines(spec string) (map[int64]string, error) {
+	out := map[int64]string{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		amount, code, ok := strings.Cut(entry, ":")
+		n, err := strconv.ParseInt(amount, 10, 64)
+		if !ok || err != nil || code == "" {
+			return nil, fmt.Errorf("invalid MOCK_DECLINES entry %q", entry)
+		}
+		out[n] = code
+	}
+	return out, nil
+}
+
+// MockStripe is an in-memory stand-in for the Stripe API, installed as the
+// stripe-go backend so every package-level call in the service hits it.
+// It walks intents through their lifecycle, declines on demand and signs
+// and delivers webhooks like Stripe would.
+//
+// An intent's outcome comes from the Stripe test payment method it is
+// confirmed with (pm_card_chargeDeclined and friends), then its
+// "mock_outcome" metadata, then the configured decline amounts; anything
+// else succeeds. Outcomes are
+// decline codes (card_declined, insufficient_funds, expired_card, ...) or
+// authentication_required, which parks the intent in requires_action.
+type MockStripe struct {
+	cfg    MockConfig
+	events chan []byte
+	http   *http.Client
+
+	mu        sync.Mutex
+	intents   map[string]*stripe.PaymentIntent
+	refunds   map[string]*stripe.Refund
+	transfers map[string]*stripe.Transfer
+	customers map[string]*stripe.Customer
+	clocks    map[string]*stripe.TestHelpersTestClock
+	accounts  map[string]*stripe.Account
+	payouts   map[string]*stripe.Payout
+	// payoutAccounts maps a payout to the connected account it came from.
+	payoutAccounts map[string]string
+	log            map[string]*stripe.Event
+	order          []string
+	customerOrder  []string
+	clockOrder     []string
+	accountOrder   []string
+	// idempotent maps an Idempotency-Key to the path it was used on and
+	// the object it created.
+	idempotent map[string][2]string
+}
+
+func NewMockStripe(cfg MockConfig) *MockStripe {
+	m := &MockStripe{
+		cfg:    cfg,
+		events: make(chan []byte, 256),
+		http:   &http.Client{Timeout: 10 * time.Second},
+	}
+	m.Reset()
+	go m.deliver()
+	return m
+}
+
+// Reset discards every object and event, for sandbox resets.
+func (m *MockStripe) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.intents = map[string]*stripe.PaymentIntent{}
+	m.refunds = map[string]*stripe.Refund{}
+	m.transfers = map[string]*stripe.Transfer{}
+	m.customers = map[string]*stripe.Customer{}
+	m.clocks = map[string]*stripe.TestHelpersTestClock{}
+	m.accounts = map[string]*stripe.Account{}
+	m.payouts = map[string]*stripe.Payout{}
+	m.payoutAccounts = map[string]string{}
+	m.log = map[string]*stripe.Event{}
+	m.order = nil
+	m.customerOrder = nil
+	m.clockOrder = nil
+	m.accountOrder = nil
+	m.idempotent = map[string][2]string{}
+}
+
+// Install makes stripe-go use the mock for all API calls.
+func (m *MockStripe) Install() {
+	stripe.SetBackend(stripe.APIBackend, m)
+	if stripe.Key == "" {
+		stripe.Key = "sk_test_mock"
+	}
+}
+
+// RegisterRoutes adds the mock-only endpoints used to drive intents when
+// auto-confirm is off and to stand in for Stripe's hosted onboarding.
+func (m *MockStripe) RegisterRoutes(r *gin.Engine) {
+	r.POST("/mock/payment/:id/confirm", func(c *gin.Context) {
+		var req struct {
+			Outcome       string `json:"outcome"`
+			PaymentMethod string `json:"payment_method"`
+		}
+		if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+			return
+		}
+		pi, err := m.confirm(c.Param("id"), req.Outcome, req.PaymentMethod)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		respondData(c, http.StatusOK, gin.H{"id": pi.ID, "status": pi.Status})
+	})
+
+	// Account links point here. Visiting one finishes onboarding as if the
+	// seller had filled in every form, then goes back to return_url. With
+	// ?outcome=restricted the seller's ID document is still wanted, so
+	// payouts stay disabled.
+	r.GET("/mock/connect/accounts/:id/onboard", func(c *gin.Context) {
+		acct, err := m.completeOnboarding(c.Param("id"), c.Query("outcome") == "restricted")
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		if returnURL := c.Query("return_url"); returnURL != "" {
+			c.Redirect(http.StatusFound, returnURL)
+			return
+		}
+		respondData(c, http.StatusOK, gin.H{"id": acct.ID, "charges_enabled": acct.ChargesEnabled, "payouts_enabled": acct.PayoutsEnabled})
+	})
+}
+
+func mockID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + "_mock_" + hex.EncodeToString(b)
+}
+
+func mockError(status int, typ stripe.ErrorType, code stripe.ErrorCode, param, msg string) *stripe.Error {
+	return &stripe.Error{HTTPStatusCode: status, Type: typ, Code: code, Param: param, Msg: msg}
+}
+
+func mockNotFound(kind, id string) *stripe.Error {
+	return mockError(http.StatusNotFound, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeResourceMissing, "id",
+		fmt.Sprintf("No such %s: '%s'", kind, id))
+}
+
+func mockUnsupported(method, path string) *stripe.Error {
+	return mockError(http.StatusNotImplemented, stripe.ErrorTypeAPI, "", "",
+		fmt.Sprintf("%s %s is not supported by the mock provider", method, path))
+}
+
+// respond copies obj into v through JSON, as the real backend would, so
+// callers never share memory with the mock's state.
+func respond(obj interface{}, v stripe.LastResponseSetter) error {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// delay adds the configured latency, cut short like a real request when
+// the call's context ends first.
+func (m *MockStripe) delay(p *stripe.Params) error {
+	if m.cfg.Latency <= 0 {
+		return nil
+	}
+	ctx := context.Background()
+	if p != nil && p.Context != nil {
+		ctx = p.Context
+	}
+	t := time.NewTimer(m.cfg.Latency)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (m *MockStripe) Call(method, path, key string, params stripe.ParamsContainer, v stripe.LastResponseSetter) error {
+	if err := m.delay(paramsOf(params)); err != nil {
+		return err
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/v1/"), "/")
+	if method == http.MethodPost {
+		if done, err := m.replayIdempotent(path, params, v); done {
+			return err
+		}
+	}
+
+	switch {
+	case method == http.MethodPost && path == "/v1/payment_intents":
+		p, _ := params.(*stripe.PaymentIntentParams)
+		pi, err := m.createIntent(p)
+		if pi != nil {
+			m.recordIdempotent(path, params, pi.ID)
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if rerr := respond(pi, v); rerr != nil {
+				return rerr
+			}
+		}
+		return err
+
+	case method == http.MethodGet && len(parts) == 2 && parts[0] == "payment_intents":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		pi, ok := m.intents[parts[1]]
+		if !ok {
+			return mockNotFound("payment_intent", parts[1])
+		}
+		return respond(pi, v)
+
+	case method == http.MethodPost && len(parts) == 3 && parts[0] == "payment_intents" && parts[2] == "confirm":
+		var outcome, pm string
+		if p, ok := params.(*stripe.PaymentIntentConfirmParams); ok && p.PaymentMethod != nil {
+			outcome, pm = mockTestCards[*p.PaymentMethod], *p.PaymentMethod
+		}
+		pi, err := m.confirm(parts[1], outcome, pm)
+		if pi != nil {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if rerr := respond(pi, v); rerr != nil {
+				return rerr
+			}
+		}
+		return err
+
+	case method == http.MethodPost && len(parts) == 2 && parts[0] == "payment_intents":
+		p, _ := params.(*stripe.PaymentIntentParams)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		pi, err := m.update(parts[1], p)
+		if err != nil {
+			return err
+		}
+		return respond(pi, v)
+
+	case method == http.MethodPost && len(parts) == 3 && parts[0] == "payment_intents" && parts[2] == "increment_authorization":
+		p, _ := params.(*stripe.PaymentIntentIncrementAuthorizationParams)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		pi, err := m.incrementAuthorization(parts[1], p)
+		if err != nil {
+			return err
+		}
+		return respond(pi, v)
+
+	case method == http.MethodPost && len(parts) == 3 && parts[0] == "payment_intents" && parts[2] == "capture":
+		p, _ := params.(*stripe.PaymentIntentCaptureParams)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		pi, err := m.capture(parts[1], p)
+		if err != nil {
+			return err
+		}
+		return respond(pi, v)
+
+	case method == http.MethodPost && len(parts) == 3 && parts[0] == "payment_intents" && parts[2] == "cancel":
+		pi, err := m.cancel(parts[1])
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return respond(pi, v)
+
+	case method == http.MethodPost && path == "/v1/refunds":
+		p, _ := params.(*stripe.RefundParams)
+		rf, err := m.createRefund(p)
+		if err != nil {
+			return err
+		}
+		m.recordIdempotent(path, params, rf.ID)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return respond(rf, v)
+
+	case method == http.MethodGet && len(parts) == 2 && parts[0] == "refunds":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		rf, ok := m.refunds[parts[1]]
+		if !ok {
+			return mockNotFound("refund", parts[1])
+		}
+		return respond(rf, v)
+
+	case method == http.MethodPost && path == "/v1/transfers":
+		p, _ := params.(*stripe.TransferParams)
+		tr, err := m.createTransfer(p)
+		if err != nil {
+			return err
+		}
+		m.recordIdempotent(path, params, tr.ID)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return respond(tr, v)
+
+	case method == http.MethodGet && len(parts) == 2 && parts[0] == "events":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		ev, ok := m.log[parts[1]]
+		if !ok {
+			return mockNotFound("event", parts[1])
+		}
+		return respond(ev, v)
+
+	case method == http.MethodPost && path == "/v1/customers":
+		p, _ := params.(*stripe.CustomerParams)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if p != nil && p.TestClock != nil && m.clocks[*p.TestClock] == nil {
+			return mockNotFound("test_clock", *p.TestClock)
+		}
+		return respond(m.createCustomer(p), v)
+
+	case method == http.MethodPost && path == "/v1/test_helpers/test_clocks":
+		p, _ := params.(*stripe.TestHelpersTestClockParams)
+		if p == nil || p.FrozenTime == nil {
+			return mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeParameterMissing, "frozen_time",
+				"Missing required param: frozen_time.")
+		}
+		now := time.Now()
+		tc := &stripe.TestHelpersTestClock{
+			ID:           mockID("clock"),
+			Object:       "test_helpers.test_clock",
+			Created:      now.Unix(),
+			DeletesAfter: now.Add(30 * 24 * time.Hour).Unix(),
+			FrozenTime:   *p.FrozenTime,
+			Status:       stripe.TestHelpersTestClockStatusReady,
+		}
+		if p.Name != nil {
+			tc.Name = *p.Name
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.clocks[tc.ID] = tc
+		m.clockOrder = append(m.clockOrder, tc.ID)
+		return respond(tc, v)
+
+	case len(parts) == 3 && parts[0] == "test_helpers" && parts[1] == "test_clocks":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		tc, ok := m.clocks[parts[2]]
+		if !ok {
+			return mockNotFound("test_clock", parts[2])
+		}
+		if method == http.MethodDelete {
+			// Like Stripe, deleting a clock deletes its customers.
+			delete(m.clocks, tc.ID)
+			for id, c := range m.customers {
+				if c.TestClock != nil && c.TestClock.ID == tc.ID {
+					delete(m.customers, id)
+				}
+			}
+			return respond(gin.H{"id": tc.ID, "object": tc.Object, "deleted": true}, v)
+		}
+		return respond(tc, v)
+
+	case method == http.MethodPost && len(parts) == 4 && parts[0] == "test_helpers" && parts[1] == "test_clocks" && parts[3] == "advance":
+		// The mock has no subscriptions to run, so a clock is ready again
+		// as soon as it is moved.
+		p, _ := params.(*stripe.TestHelpersTestClockAdvanceParams)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		tc, ok := m.clocks[parts[2]]
+		if !ok {
+			return mockNotFound("test_clock", parts[2])
+		}
+		if p == nil || p.FrozenTime == nil || *p.FrozenTime <= tc.FrozenTime {
+			return mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, "", "frozen_time",
+				"The frozen_time must be after the test clock's current frozen_time.")
+		}
+		tc.FrozenTime = *p.FrozenTime
+		m.emit("test_helpers.test_clock.ready", tc)
+		return respond(tc, v)
+
+	case len(parts) == 2 && parts[0] == "customers":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		c, ok := m.customers[parts[1]]
+		if !ok {
+			return mockNotFound("customer", parts[1])
+		}
+		switch method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if p, ok := params.(*stripe.CustomerParams); ok {
+				updateMockCustomer(c, p)
+			}
+		case http.MethodDelete:
+			delete(m.customers, c.ID)
+			return respond(gin.H{"id": c.ID, "object": "customer", "deleted": true}, v)
+		}
+		return respond(c, v)
+
+	case method == http.MethodPost && path == "/v1/payment_methods":
+		p, _ := params.(*stripe.PaymentMethodParams)
+		pm, err := mockCardPaymentMethod(p)
+		if err != nil {
+			return err
+		}
+		return respond(pm, v)
+
+	case method == http.MethodGet && len(parts) == 2 && parts[0] == "payment_methods":
+		pm, err := mockTestPaymentMethod(parts[1])
+		if err != nil {
+			return err
+		}
+		return respond(pm, v)
+
+	case method == http.MethodPost && len(parts) == 3 && parts[0] == "payment_methods" && parts[2] == "detach":
+		pm, err := mockTestPaymentMethod(parts[1])
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.emit("payment_method.detached", pm)
+		m.mu.Unlock()
+		return respond(pm, v)
+
+	case method == http.MethodPost && len(parts) == 3 && parts[0] == "payment_methods" && parts[2] == "attach":
+		p, _ := params.(*stripe.PaymentMethodAttachParams)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		pm, err := m.attachPaymentMethod(parts[1], p)
+		if err != nil {
+			return err
+		}
+		return respond(pm, v)
+
+	case method == http.MethodGet && len(parts) == 2 && parts[0] == "payouts":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		po, ok := m.payouts[parts[1]]
+		if !ok {
+			return mockNotFound("payout", parts[1])
+		}
+		return respond(po, v)
+
+	case method == http.MethodPost && path == "/v1/payouts":
+		p, _ := params.(*stripe.PayoutParams)
+		m.mu.Lock()
+		po, err := m.createPayout(p)
+		if err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		err = respond(po, v)
+		m.mu.Unlock()
+		m.recordIdempotent(path, params, po.ID)
+		return err
+
+	case method == http.MethodGet && path == "/v1/balance":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		var available []*stripe.Amount
+		if p := paramsOf(params); p != nil && p.StripeAccount != nil {
+			available = m.accountBalance(*p.StripeAccount)
+		}
+		return respond(&stripe.Balance{Object: "balance", Available: available, InstantAvailable: available,
+			Pending: []*stripe.Amount{}}, v)
+
+	case method == http.MethodPost && path == "/v1/accounts":
+		p, _ := params.(*stripe.AccountParams)
+		m.mu.Lock()
+		acct, err := m.createAccount(p)
+		if err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		err = respond(acct, v)
+		m.mu.Unlock()
+		m.recordIdempotent(path, params, acct.ID)
+		return err
+
+	case len(parts) == 2 && parts[0] == "accounts":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		acct, ok := m.accounts[parts[1]]
+		if !ok {
+			return mockNotFound("account", parts[1])
+		}
+		if method == http.MethodPost {
+			if p, ok := params.(*stripe.AccountParams); ok {
+				updateMockAccount(acct, p)
+				m.emit("account.updated", acct)
+			}
+		}
+		return respond(acct, v)
+
+	case method == http.MethodPost && path == "/v1/account_links":
+		p, _ := params.(*stripe.AccountLinkParams)
+		if p == nil || p.Account == nil || p.ReturnURL == nil || p.Type == nil {
+			return mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeParameterMissing, "account",
+				"Missing required param: account, return_url or type.")
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.accounts[*p.Account] == nil {
+			return mockNotFound("account", *p.Account)
+		}
+		now := time.Now()
+		return respond(&stripe.AccountLink{
+			Object:    "account_link",
+			Created:   now.Unix(),
+			ExpiresAt: now.Add(5 * time.Minute).Unix(),
+			URL: fmt.Sprintf("%s/mock/connect/accounts/%s/onboard?return_url=%s",
+				m.cfg.BaseURL, *p.Account, url.QueryEscape(*p.ReturnURL)),
+		}, v)
+
+	case method == http.MethodPost && len(parts) == 3 && parts[0] == "accounts" && parts[2] == "login_links":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		acct, ok := m.accounts[parts[1]]
+		if !ok {
+			return mockNotFound("account", parts[1])
+		}
+		if acct.Type != stripe.AccountTypeExpress {
+			return mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, "", "account",
+				"Login links can only be created for Express accounts.")
+		}
+		return respond(&stripe.LoginLink{Object: "login_link", Created: time.Now().Unix(),
+			URL: m.cfg.BaseURL + "/mock/connect/accounts/" + acct.ID + "/dashboard"}, v)
+
+	case method == http.MethodGet && path == "/v1/account":
+		return respond(map[string]interface{}{
+			"id": "acct_mock", "object": "account", "country": "US", "default_currency": "usd",
+		}, v)
+
+	case method == http.MethodGet && len(parts) == 2 && parts[0] == "country_specs":
+		return respond(map[string]interface{}{
+			"id": parts[1], "object": "country_spec", "default_currency": "usd",
+			"supported_payment_currencies": mockCurrencies,
+			"supported_payment_methods":    []string{"ach", "card", "stripe"},
+		}, v)
+	}
+	return mockUnsupported(method, path)
+}
+
+// CallRaw serves list and search endpoints. Everything is returned in one
+// page, newest first.
+func (m *MockStripe) CallRaw(method, path, key string, body *form.Values, params *stripe.Params, v stripe.LastResponseSetter) error {
+	if err := m.delay(params); err != nil {
+		return err
+	}
+	if method != http.MethodGet {
+		return mockUnsupported(method, path)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	created := createdFilter(body)
+	switch path {
+	case "/v1/payment_intents":
+		customer := formValue(body, "customer")
+		data := []*stripe.PaymentIntent{}
+		m.eachIntent(func(pi *stripe.PaymentIntent) {
+			if created(pi.Created) && (customer == "" || (pi.Customer != nil && pi.Customer.ID == customer)) {
+				data = append(data, pi)
+			}
+		})
+		return respond(gin.H{"object": "list", "url": path, "has_more": false, "data": data}, v)
+
+	case "/v1/payment_intents/search":
+		match, err := parseMockSearch(formValue(body, "query"))
+		if err != nil {
+			return mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, "", "query", err.Error())
+		}
+		data := []*stripe.PaymentIntent{}
+		m.eachIntent(func(pi *stripe.PaymentIntent) {
+			if match(intentSearchField(pi)) {
+				data = append(data, pi)
+			}
+		})
+		return respond(gin.H{"object": "search_result", "url": path, "has_more": false, "data": data}, v)
+
+	case "/v1/customers/search":
+		match, err := parseMockSearch(formValue(body, "query"))
+		if err != nil {
+			return mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, "", "query", err.Error())
+		}
+		data := []*stripe.Customer{}
+		for _, id := range m.customerOrder {
+			if c, ok := m.customers[id]; ok && match(customerSearchField(c)) {
+				data = append(data, c)
+			}
+		}
+		return respond(gin.H{"object": "search_result", "url": path, "has_more": false, "data": data}, v)
+
+	case "/v1/test_helpers/test_clocks":
+		data := []*stripe.TestHelpersTestClock{}
+		for i := len(m.clockOrder) - 1; i >= 0; i-- {
+			if tc, ok := m.clocks[m.clockOrder[i]]; ok {
+				data = append(data, tc)
+			}
+		}
+		return respond(gin.H{"object": "list", "url": path, "has_more": false, "data": data}, v)
+
+	case "/v1/refunds":
+		paymentID := formValue(body, "payment_intent")
+		data := []*stripe.Refund{}
+		for _, rf := range m.refunds {
+			if created(rf.Created) && (paymentID == "" || (rf.PaymentIntent != nil && rf.PaymentIntent.ID == paymentID)) {
+				data = append(data, rf)
+			}
+		}
+		sort.Slice(data, func(i, j int) bool { return data[i].Created > data[j].Created })
+		return respond(gin.H{"object": "list", "url": path, "has_more": false, "data": data}, v)
+
+	case "/v1/payouts", "/v1/balance_transactions":
+		return respond(gin.H{"object": "list", "url": path, "has_more": false, "data": []interface{}{}}, v)
+	}
+	return mockUnsupported(method, path)
+}
+
+func (m *MockStripe) CallStreaming(method, path, key string, params stripe.ParamsContainer, v stripe.StreamingLastResponseSetter) error {
+	return mockUnsupported(method, path)
+}
+
+func (m *MockStripe) CallMultipart(method, path, key, boundary string, body *bytes.Buffer, params *stripe.Params, v stripe.LastResponseSetter) error {
+	return mockUnsupported(method, path)
+}
+
+func (m *MockStripe) SetMaxNetworkRetries(int64) {}
+
+// eachIntent visits intents newest first. Callers hold m.mu.
+func (m *MockStripe) eachIntent(fn func(*stripe.PaymentIntent)) {
+	for i := len(m.order) - 1; i >= 0; i-- {
+		fn(m.intents[m.order[i]])
+	}
+}
+
+func formValue(body *form.Values, key string) string {
+	if body == nil {
+		return ""
+	}
+	if vals := body.Get(key); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+func createdFilter(body *form.Values) func(int64) bool {
+	bound := func(key string) (int64, bool) {
+		n, err := strconv.ParseInt(formValue(body, key), 10, 64)
+		return n, err == nil
+	}
+	gte, hasGTE := bound("created[gte]")
+	lte, hasLTE := bound("created[lte]")
+	gt, hasGT := bound("created[gt]")
+	lt, hasLT := bound("created[lt]")
+	return func(t int64) bool {
+		return (!hasGTE || t >= gte) && (!hasLTE || t <= lte) && (!hasGT || t > gt) && (!hasLT || t < lt)
+	}
+}
+
+var mockSearchTerm = regexp.MustCompile(`^(metadata\['([^']+)'\]|status|customer|currency|email):'((?:[^'\\]|\\.)*)'$`)
+
+// mockSearchField reads a searchable field from an object; key is the
+// metadata key when field is "metadata".
+type mockSearchField func(field, key string) string
+
+// parseMockSearch understands the subset of Stripe's search language the
+// service uses: AND-ed equality on metadata keys and a few plain fields.
+func parseMockSearch(query string) (func(mockSearchField) bool, error) {
+	type term struct{ field, key, value string }
+	var terms []term
+	for _, raw := range strings.Split(query, " AND ") {
+		sm := mockSearchTerm.FindStringSubmatch(strings.TrimSpace(raw))
+		if sm == nil {
+			return nil, fmt.Errorf("unsupported search clause %q", raw)
+		}
+		field := sm[1]
+		if sm[2] != "" {
+			field = "metadata"
+		}
+		terms = append(terms, term{field: field, key: sm[2], value: strings.ReplaceAll(sm[3], `\'`, "'")})
+	}
+
+	return func(get mockSearchField) bool {
+		for _, t := range terms {
+			if get(t.field, t.key) != t.value {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func intentSearchField(pi *stripe.PaymentIntent) mockSearchField {
+	return func(field, key string) string {
+		switch field {
+		case "metadata":
+			return pi.Metadata[key]
+		case "status":
+			return string(pi.Status)
+		case "currency":
+			return string(pi.Currency)
+		case "customer":
+			if pi.Customer != nil {
+				return pi.Customer.ID
+			}
+		}
+		return ""
+	}
+}
+
+func customerSearchField(c *stripe.Customer) mockSearchField {
+	return func(field, key string) string {
+		switch field {
+		case "metadata":
+			return c.Metadata[key]
+		case "email":
+			return c.Email
+		}
+		return ""
+	}
+}
+
+func (m *MockStripe) createIntent(p *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	if p == nil || p.Amount == nil {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeParameterMissing, "amount", "Missing required param: amount.")
+	}
+	currency := strings.ToLower(stripe.StringValue(p.Currency))
+	if len(currency) != 3 {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, "", "currency", fmt.Sprintf("Invalid currency: %s.", currency))
+	}
+	if *p.Amount < 1 {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeAmountTooSmall, "amount", "Amount must be at least 1.")
+	}
+
+	id := mockID("pi")
+	pi := &stripe.PaymentIntent{
+		ID:            id,
+		Object:        "payment_intent",
+		Amount:        *p.Amount,
+		Currency:      stripe.Currency(currency),
+		Description:   stripe.StringValue(p.Description),
+		Metadata:      map[string]string{},
+		ClientSecret:  id + "_secret_" + mockID("cs")[8:],
+		Status:        stripe.PaymentIntentStatusRequiresPaymentMethod,
+		CaptureMethod: stripe.PaymentIntentCaptureMethodAutomatic,
+		Created:       time.Now().Unix(),
+		TransferGroup: stripe.StringValue(p.TransferGroup),
+	}
+	for _, t := range p.PaymentMethodTypes {
+		pi.PaymentMethodTypes = append(pi.PaymentMethodTypes, stripe.StringValue(t))
+	}
+	if len(pi.PaymentMethodTypes) == 0 {
+		pi.PaymentMethodTypes = []string{"card"}
+	}
+	if p.Customer != nil {
+		pi.Customer = &stripe.Customer{ID: *p.Customer}
+	}
+	if p.PaymentMethod != nil && !stripe.BoolValue(p.Confirm) {
+		pi.PaymentMethod = &stripe.PaymentMethod{ID: *p.PaymentMethod, Type: stripe.PaymentMethodTypeCard}
+		if pm, err := mockTestPaymentMethod(*p.PaymentMethod); err == nil {
+			pi.PaymentMethod = pm
+		}
+		pi.Status = stripe.PaymentIntentStatusRequiresConfirmation
+	}
+	for k, v := range p.Metadata {
+		pi.Metadata[k] = v
+	}
+	if p.CaptureMethod != nil {
+		pi.CaptureMethod = stripe.PaymentIntentCaptureMethod(*p.CaptureMethod)
+	}
+	if o := p.PaymentMethodOptions; o != nil && o.Card != nil && o.Card.RequestIncrementalAuthorization != nil {
+		pi.PaymentMethodOptions = &stripe.PaymentIntentPaymentMethodOptions{Card: &stripe.PaymentIntentPaymentMethodOptionsCard{
+			RequestIncrementalAuthorization: stripe.PaymentIntentPaymentMethodOptionsCardRequestIncrementalAuthorization(*o.Card.RequestIncrementalAuthorization),
+		}}
+	}
+
+	m.mu.Lock()
+	m.intents[id] = pi
+	m.order = append(m.order, id)
+	m.emit("payment_intent.created", pi)
+	m.mu.Unlock()
+
+	if stripe.BoolValue(p.Confirm) {
+		var outcome, pm string
+		if p.PaymentMethod != nil {
+			outcome, pm = mockTestCards[*p.PaymentMethod], *p.PaymentMethod
+		}
+		return m.confirm(id, outcome, pm)
+	}
+	if m.cfg.ConfirmDelay > 0 {
+		time.AfterFunc(m.cfg.ConfirmDelay, func() {
+			if _, err := m.confirm(id, "", ""); err != nil {
+				log.Printf("mock provider: %s: %v", id, err)
+			}
+		})
+	}
+	return pi, nil
+}
+
+// outcome decides how an intent confirms. Callers hold m.mu.
+func (m *MockStripe) outcome(pi *stripe.PaymentIntent, override string) string {
+	if override != "" {
+		return override
+	}
+	if o := pi.Metadata["mock_outcome"]; o != "" {
+		return o
+	}
+	return m.cfg.Declines[pi.Amount]
+}
+
+// confirm runs an intent to its outcome. A decline returns the updated
+// intent together with the card error, like Stripe's confirm endpoint.
+// pm is the saved payment method confirmed with, if any, else the one
+// the intent was created with; test card tokens decide the outcome unless
+// override does, and they and an empty pm get a fresh ID.
+func (m *MockStripe) confirm(id, override, pm string) (*stripe.PaymentIntent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pi, ok := m.intents[id]
+	if !ok {
+		return nil, mockNotFound("payment_intent", id)
+	}
+	switch pi.Status {
+	case stripe.PaymentIntentStatusRequiresPaymentMethod, stripe.PaymentIntentStatusRequiresConfirmation, stripe.PaymentIntentStatusRequiresAction:
+	default:
+		return pi, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodePaymentIntentUnexpectedState, "",
+			fmt.Sprintf("This PaymentIntent's status is %s and cannot be confirmed.", pi.Status))
+	}
+
+	if pm == "" && pi.PaymentMethod != nil {
+		pm = pi.PaymentMethod.ID
+	}
+	if override == "" {
+		override = mockTestCards[pm]
+	}
+	var fingerprint string
+	if card, err := mockTestPaymentMethod(pm); err == nil {
+		fingerprint = card.Card.Fingerprint
+	}
+	if _, ok := mockTestCards[pm]; ok || pm == "" {
+		pm = mockID("pm")
+	}
+	pi.PaymentMethod = &stripe.PaymentMethod{ID: pm, Type: stripe.PaymentMethodTypeCard}
+	pi.LastPaymentError = nil
+
+	outcome := m.outcome(pi, override)
+	if outcome == "authentication_required" && pi.Status != stripe.PaymentIntentStatusRequiresAction {
+		pi.Status = stripe.PaymentIntentStatusRequiresAction
+		m.emit("payment_intent.requires_action", pi)
+		return pi, nil
+	}
+
+	pi.Status = stripe.PaymentIntentStatusProcessing
+	m.emit("payment_intent.processing", pi)
+
+	if outcome != "" && outcome != "succeeded" && outcome != "authentication_required" {
+		cardErr := mockError(http.StatusPaymentRequired, stripe.ErrorTypeCard, stripe.ErrorCodeCardDeclined, "",
+			"Your card was declined.")
+		cardErr.DeclineCode = stripe.DeclineCode(outcome)
+		if outcome == "expired_card" || outcome == "incorrect_cvc" || outcome == "processing_error" {
+			cardErr.Code = stripe.ErrorCode(outcome)
+		}
+		cardErr.PaymentMethod = &stripe.PaymentMethod{ID: pm, Type: stripe.PaymentMethodTypeCard, Customer: pi.Customer}
+		pi.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+		pi.LastPaymentError = cardErr
+		pi.PaymentMethod = nil
+		m.emit("payment_intent.payment_failed", pi)
+
+		withIntent := *cardErr
+		withIntent.PaymentIntent = pi
+		return pi, &withIntent
+	}
+
+	ch := &stripe.Charge{
+		ID:            mockID("ch"),
+		Object:        "charge",
+		Amount:        pi.Amount,
+		Currency:      pi.Currency,
+		Paid:          true,
+		Captured:      true,
+		Status:        stripe.ChargeStatusSucceeded,
+		Created:       time.Now().Unix(),
+		PaymentIntent: &stripe.PaymentIntent{ID: pi.ID},
+		PaymentMethodDetails: &stripe.ChargePaymentMethodDetails{
+			Type: stripe.ChargePaymentMethodDetailsTypeCard,
+			Card: &stripe.ChargePaymentMethodDetailsCard{Brand: "visa", Last4: "4242", IIN: "424242", Country: "US",
+				ExpMonth: 12, ExpYear: int64(time.Now().Year() + 3), Fingerprint: fingerprint},
+		},
+		Refunds:  &stripe.RefundList{Data: []*stripe.Refund{}},
+		Metadata: pi.Metadata,
+	}
+	pi.LatestCharge = ch
+	if pi.CaptureMethod == stripe.PaymentIntentCaptureMethodManual {
+		ch.Captured = false
+		if o := pi.PaymentMethodOptions; o != nil && o.Card != nil &&
+			o.Card.RequestIncrementalAuthorization == stripe.PaymentIntentPaymentMethodOptionsCardRequestIncrementalAuthorizationIfAvailable {
+			ch.PaymentMethodDetails.Card.IncrementalAuthorization = &stripe.ChargePaymentMethodDetailsCardIncrementalAuthorization{
+				Status: stripe.ChargePaymentMethodDetailsCardIncrementalAuthorizationStatusAvailable,
+			}
+		}
+		pi.Status = stripe.PaymentIntentStatusRequiresCapture
+		pi.AmountCapturable = pi.Amount
+		m.emit("charge.succeeded", ch)
+		m.emit("payment_intent.amount_capturable_updated", pi)
+		return pi, nil
+	}
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	pi.AmountReceived = pi.Amount
+	ch.BalanceTransaction = mockBalanceTransaction(ch, pi.Amount)
+	m.emit("charge.succeeded", ch)
+	m.emit("payment_intent.succeeded", pi)
+	return pi, nil
+}
+
+// update applies the amount, metadata and payment method types of p.
+// Like Stripe, the amount can only change before the intent is
+// authorized. Callers hold m.mu.
+func (m *MockStripe) update(id string, p *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	pi, ok := m.intents[id]
+	if !ok {
+		return nil, mockNotFound("payment_intent", id)
+	}
+	if p == nil {
+		return pi, nil
+	}
+	if p.Amount != nil {
+		switch pi.Status {
+		case stripe.PaymentIntentStatusRequiresPaymentMethod, stripe.PaymentIntentStatusRequiresConfirmation:
+		default:
+			return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodePaymentIntentUnexpectedState, "amount",
+				fmt.Sprintf("This PaymentIntent's amount could not be updated because it has a status of %s.", pi.Status))
+		}
+		pi.Amount = *p.Amount
+	}
+	for k, v := range p.Metadata {
+		// Like Stripe, an empty value removes the key.
+		if v == "" {
+			delete(pi.Metadata, k)
+			continue
+		}
+		pi.Metadata[k] = v
+	}
+	if len(p.PaymentMethodTypes) > 0 {
+		pi.PaymentMethodTypes = nil
+		for _, t := range p.PaymentMethodTypes {
+			pi.PaymentMethodTypes = append(pi.PaymentMethodTypes, stripe.StringValue(t))
+		}
+	}
+	return pi, nil
+}
+
+// incrementAuthorization raises a manually captured intent's
+// authorization to p.Amount when its card allows it. Callers hold m.mu.
+func (m *MockStripe) incrementAuthorization(id string, p *stripe.PaymentIntentIncrementAuthorizationParams) (*stripe.PaymentIntent, error) {
+	pi, ok := m.intents[id]
+	if !ok {
+		return nil, mockNotFound("payment_intent", id)
+	}
+	ch := pi.LatestCharge
+	if pi.Status != stripe.PaymentIntentStatusRequiresCapture || ch == nil || ch.PaymentMethodDetails.Card.IncrementalAuthorization == nil {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodePaymentIntentUnexpectedState, "",
+			"This PaymentIntent does not support incremental authorization.")
+	}
+	if p == nil || p.Amount == nil || *p.Amount <= pi.Amount {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeParameterInvalidInteger, "amount",
+			"The amount must be greater than the currently authorized amount.")
+	}
+	pi.Amount, pi.AmountCapturable, ch.Amount = *p.Amount, *p.Amount, *p.Amount
+	if p.Description != nil {
+		pi.Description = *p.Description
+	}
+	for k, v := range p.Metadata {
+		pi.Metadata[k] = v
+	}
+	m.emit("payment_intent.amount_capturable_updated", pi)
+	return pi, nil
+}
+
+// capture collects a manually captured intent, releasing whatever of the
+// authorization isn't captured. Callers hold m.mu.
+func (m *MockStripe) capture(id string, p *stripe.PaymentIntentCaptureParams) (*stripe.PaymentIntent, error) {
+	pi, ok := m.intents[id]
+	if !ok {
+		return nil, mockNotFound("payment_intent", id)
+	}
+	if pi.Status != stripe.PaymentIntentStatusRequiresCapture {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodePaymentIntentUnexpectedState, "",
+			fmt.Sprintf("This PaymentIntent could not be captured because it has a status of %s.", pi.Status))
+	}
+	amount := pi.AmountCapturable
+	if p != nil && p.AmountToCapture != nil {
+		if *p.AmountToCapture > amount {
+			return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeAmountTooLarge, "amount_to_capture",
+				"The amount to capture cannot exceed the amount capturable.")
+		}
+		amount = *p.AmountToCapture
+	}
+	ch := pi.LatestCharge
+	ch.Captured = true
+	ch.AmountCaptured = amount
+	ch.AmountRefunded = ch.Amount - amount
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	pi.AmountReceived = amount
+	pi.AmountCapturable = 0
+	ch.BalanceTransaction = mockBalanceTransaction(ch, amount)
+	m.emit("charge.captured", ch)
+	m.emit("payment_intent.succeeded", pi)
+	return pi, nil
+}
+
+// mockBalanceTransaction is what a captured charge adds to the balance,
+// less Stripe's standard 2.9% + 30 card fee.
+func mockBalanceTransaction(ch *stripe.Charge, amount int64) *stripe.BalanceTransaction {
+	fee := (amount*29+500)/1000 + 30
+	now := time.Now()
+	return &stripe.BalanceTransaction{
+		ID:          mockID("txn"),
+		Object:      "balance_transaction",
+		Amount:      amount,
+		Currency:    ch.Currency,
+		Fee:         fee,
+		Net:         amount - fee,
+		FeeDetails:  []*stripe.BalanceTransactionFeeDetail{{Type: "stripe_fee", Amount: fee, Currency: ch.Currency, Description: "Stripe processing fees"}},
+		Type:        stripe.BalanceTransactionTypeCharge,
+		Status:      stripe.BalanceTransactionStatusPending,
+		Created:     now.Unix(),
+		AvailableOn: now.AddDate(0, 0, 2).Unix(),
+	}
+}
+
+func (m *MockStripe) cancel(id string) (*stripe.PaymentIntent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pi, ok := m.intents[id]
+	if !ok {
+		return nil, mockNotFound("payment_intent", id)
+	}
+	if pi.Status == stripe.PaymentIntentStatusSucceeded || pi.Status == stripe.PaymentIntentStatusCanceled {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodePaymentIntentUnexpectedState, "",
+			fmt.Sprintf("This PaymentIntent's status is %s and cannot be canceled.", pi.Status))
+	}
+	pi.Status = stripe.PaymentIntentStatusCanceled
+	pi.CanceledAt = time.Now().Unix()
+	m.emit("payment_intent.canceled", pi)
+	return pi, nil
+}
+
+// replayIdempotent answers a create retried with the same Idempotency-Key
+// with the object the first request made, as Stripe does. Reusing a key on
+// another endpoint is an idempotency error.
+func (m *MockStripe) replayIdempotent(path string, params stripe.ParamsContainer, v stripe.LastResponseSetter) (bool, error) {
+	key := mockIdempotencyKey(params)
+	if key == "" {
+		return false, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen, ok := m.idempotent[key]
+	if !ok {
+		return false, nil
+	}
+	if seen[0] != path {
+		return true, mockError(http.StatusBadRequest, stripe.ErrorTypeIdempotency, stripe.ErrorCodeIdempotencyKeyInUse, "",
+			"Keys for idempotent requests can only be used with the same parameters they were first used with.")
+	}
+	if pi, ok := m.intents[seen[1]]; ok {
+		return true, respond(pi, v)
+	}
+	if rf, ok := m.refunds[seen[1]]; ok {
+		return true, respond(rf, v)
+	}
+	if acct, ok := m.accounts[seen[1]]; ok {
+		return true, respond(acct, v)
+	}
+	if po, ok := m.payouts[seen[1]]; ok {
+		return true, respond(po, v)
+	}
+	if tr, ok := m.transfers[seen[1]]; ok {
+		return true, respond(tr, v)
+	}
+	return false, nil
+}
+
+func (m *MockStripe) recordIdempotent(path string, params stripe.ParamsContainer, id string) {
+	key := mockIdempotencyKey(params)
+	if key == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.idempotent[key] = [2]string{path, id}
+}
+
+func mockIdempotencyKey(params stripe.ParamsContainer) string {
+	if p := paramsOf(params); p != nil {
+		return stripe.StringValue(p.IdempotencyKey)
+	}
+	return ""
+}
+
+// mockCurrencies is what the mock account accepts.
+var mockCurrencies = []string{"usd", "eur", "gbp", "cad", "aud", "jpy", "chf", "sek", "nok", "dkk", "pln", "mxn", "brl", "sgd"}
+
+// mockFXRates are plausible rates per US dollar for mockCurrencies, used
+// for FX quotes when the mock provider runs without FX_RATES_URL.
+var mockFXRates = map[string]float64{
+	"usd": 1, "eur": 0.92, "gbp": 0.79, "cad": 1.36, "aud": 1.52, "jpy": 149.5, "chf": 0.88,
+	"sek": 10.45, "nok": 10.6, "dkk": 6.87, "pln": 3.98, "mxn": 17.1, "brl": 4.97, "sgd": 1.34,
+}
+
+// mockVIES stands in for VIES when the mock provider runs: every
+// well-formed VAT number is valid, except ones ending in 0000, which are
+// not registered, and ones ending in 9999, whose registry is down.
+type mockVIES struct{}
+
+func (mockVIES) Check(_ context.Context, vatID, _ string) (*viesResult, error) {
+	switch {
+	case strings.HasSuffix(vatID, "9999"):
+		return nil, fmt.Errorf("VIES: MS_UNAVAILABLE")
+	case strings.HasSuffix(vatID, "0000"):
+		return &viesResult{}, nil
+	}
+	return &viesResult{Valid: true, Name: "Mock Business " + vatID, Address: "1 Test Street", ConsultationNumber: "WAPIAAAA" + vatID}, nil
+}
+
+// mockTestCards maps Stripe's test payment methods to mock outcomes.
+var mockTestCards = map[string]string{
+	"pm_card_visa":                            "succeeded",
+	"pm_card_mastercard":                      "succeeded",
+	"pm_card_amex":                            "succeeded",
+	"pm_card_chargeDeclined":                  "generic_decline",
+	"pm_card_chargeDeclinedInsufficientFunds": "insufficient_funds",
+	"pm_card_chargeDeclinedExpiredCard":       "expired_card",
+	"pm_card_chargeDeclinedIncorrectCvc":      "incorrect_cvc",
+	"pm_card_chargeDeclinedProcessingError":   "processing_error",
+	"pm_card_authenticationRequired":          "authentication_required",
+}
+
+// mockCardBrands gives attached test cards a plausible brand.
+var mockCardBrands = map[string]string{"pm_card_mastercard": "mastercard", "pm_card_amex": "amex"}
+
+// mockTestNumbers are Stripe's test card numbers and the test card each
+// behaves as. Other numbers behave as pm_card_visa.
+var mockTestNumbers = map[string]string{
+	"4242424242424242": "pm_card_visa",
+	"5555555555554444": "pm_card_mastercard",
+	"378282246310005":  "pm_card_amex",
+	"4000000000000002": "pm_card_chargeDeclined",
+	"4000000000009995": "pm_card_chargeDeclinedInsufficientFunds",
+	"4000000000000069": "pm_card_chargeDeclinedExpiredCard",
+	"4000000000000127": "pm_card_chargeDeclinedIncorrectCvc",
+	"4000000000000119": "pm_card_chargeDeclinedProcessingError",
+	"4000002760003184": "pm_card_authenticationRequired",
+}
+
+// mockTestPaymentMethod answers a lookup of a test card token as the
+// card its test number describes, expiring three years from now. Saved
+// cards aren't kept, so other IDs aren't found.
+func mockTestPaymentMethod(token string) (*stripe.PaymentMethod, error) {
+	for number, t := range mockTestNumbers {
+		if t == token {
+			exp := int64(time.Now().Year() + 3)
+			return mockCardPaymentMethod(&stripe.PaymentMethodParams{
+				Card: &stripe.PaymentMethodCardParams{Number: &number, ExpMonth: stripe.Int64(12), ExpYear: &exp},
+			})
+		}
+	}
+	return nil, mockNotFound("payment_method", token)
+}
+
+// mockCardPaymentMethod answers a payment method created from raw card
+// details. Its ID is the matching test card token, so confirming and
+// attaching it behave as that card does.
+func mockCardPaymentMethod(p *stripe.PaymentMethodParams) (*stripe.PaymentMethod, error) {
+	if p == nil || p.Card == nil || p.Card.Number == nil {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeParameterMissing, "card[number]",
+			"Missing required param: card[number].")
+	}
+	number := *p.Card.Number
+	token, ok := mockTestNumbers[number]
+	if !ok {
+		token = "pm_card_visa"
+	}
+	brand := mockCardBrands[token]
+	if brand == "" {
+		brand = "visa"
+	}
+	sum := sha256.Sum256([]byte(number))
+	return &stripe.PaymentMethod{
+		ID:      token,
+		Object:  "payment_method",
+		Type:    stripe.PaymentMethodTypeCard,
+		Created: time.Now().Unix(),
+		Card: &stripe.PaymentMethodCard{
+			Brand:       stripe.PaymentMethodCardBrand(brand),
+			Last4:       number[len(number)-4:],
+			ExpMonth:    stripe.Int64Value(p.Card.ExpMonth),
+			ExpYear:     stripe.Int64Value(p.Card.ExpYear),
+			Fingerprint: hex.EncodeToString(sum[:8]),
+		},
+	}, nil
+}
+
+// createCustomer stores a new customer. Callers hold m.mu.
+func (m *MockStripe) createCustomer(p *stripe.CustomerParams) *stripe.Customer {
+	c := &stripe.Customer{
+		ID:       mockID("cus"),
+		Object:   "customer",
+		Created:  time.Now().Unix(),
+		Metadata: map[string]string{},
+	}
+	if p != nil {
+		updateMockCustomer(c, p)
+	}
+	m.customers[c.ID] = c
+	m.customerOrder = append(m.customerOrder, c.ID)
+	m.emit("customer.created", c)
+	return c
+}
+
+// mockOnboardingFields is what Stripe asks a new individual seller for.
+var mockOnboardingFields = []string{
+	"business_profile.url", "external_account", "individual.dob.day", "individual.first_name",
+	"individual.last_name", "tos_acceptance.date", "tos_acceptance.ip",
+}
+
+// createAccount opens a connected account with nothing submitted and its
+// requested capabilities inactive. Callers hold m.mu.
+func (m *MockStripe) createAccount(p *stripe.AccountParams) (*stripe.Account, error) {
+	if p == nil || p.Type == nil {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeParameterMissing, "type",
+			"Missing required param: type.")
+	}
+	acct := &stripe.Account{
+		ID:           mockID("acct"),
+		Object:       "account",
+		Type:         stripe.AccountType(*p.Type),
+		Country:      "US",
+		Created:      time.Now().Unix(),
+		Metadata:     map[string]string{},
+		Capabilities: &stripe.AccountCapabilities{},
+		Settings: &stripe.AccountSettings{Payouts: &stripe.AccountSettingsPayouts{
+			Schedule: &stripe.AccountSettingsPayoutsSchedule{Interval: "daily", DelayDays: 2},
+		}},
+		Requirements: &stripe.AccountRequirements{
+			CurrentlyDue:   append([]string{}, mockOnboardingFields...),
+			EventuallyDue:  append([]string{}, mockOnboardingFields...),
+			DisabledReason: stripe.AccountRequirementsDisabledReasonFieldsNeeded,
+		},
+	}
+	if p.Country != nil {
+		acct.Country = *p.Country
+	}
+	if c := p.Capabilities; c != nil {
+		if c.CardPayments != nil {
+			acct.Capabilities.CardPayments = stripe.AccountCapabilityStatusInactive
+		}
+		if c.Transfers != nil {
+			acct.Capabilities.Transfers = stripe.AccountCapabilityStatusInactive
+		}
+	}
+	updateMockAccount(acct, p)
+	m.accounts[acct.ID] = acct
+	m.accountOrder = append(m.accountOrder, acct.ID)
+	m.emit("account.created", acct)
+	return acct, nil
+}
+
+func updateMockAccount(acct *stripe.Account, p *stripe.AccountParams) {
+	if p.Email != nil {
+		acct.Email = *p.Email
+	}
+	if p.BusinessType != nil {
+		acct.BusinessType = stripe.AccountBusinessType(*p.BusinessType)
+	}
+	if p.Settings != nil && p.Settings.Payouts != nil && p.Settings.Payouts.Schedule != nil {
+		ps, s := p.Settings.Payouts.Schedule, acct.Settings.Payouts.Schedule
+		if ps.Interval != nil {
+			s.Interval = stripe.AccountSettingsPayoutsScheduleInterval(*ps.Interval)
+			s.WeeklyAnchor, s.MonthlyAnchor = "", 0
+		}
+		if ps.WeeklyAnchor != nil {
+			s.WeeklyAnchor = *ps.WeeklyAnchor
+		}
+		if ps.MonthlyAnchor != nil {
+			s.MonthlyAnchor = *ps.MonthlyAnchor
+		}
+		if ps.DelayDays != nil {
+			s.DelayDays = *ps.DelayDays
+		}
+	}
+	for k, v := range p.Metadata {
+		if v == "" {
+			delete(acct.Metadata, k)
+			continue
+		}
+		acct.Metadata[k] = v
+	}
+}
+
+// accountBalance is what transfers have paid into a connected account,
+// less its payouts, per currency. Callers hold m.mu.
+func (m *MockStripe) accountBalance(id string) []*stripe.Amount {
+	totals := map[stripe.Currency]int64{}
+	for _, tr := range m.transfers {
+		if tr.Destination != nil && tr.Destination.ID == id {
+			totals[tr.Currency] += tr.Amount - tr.AmountReversed
+		}
+	}
+	for _, po := range m.payouts {
+		if m.payoutAccounts[po.ID] == id {
+			totals[po.Currency] -= po.Amount
+		}
+	}
+	out := []*stripe.Amount{}
+	for currency, amount := range totals {
+		out = append(out, &stripe.Amount{Currency: currency, Amount: amount})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Currency < out[j].Currency })
+	return out
+}
+
+// createPayout pays out of a connected account's balance. The mock keeps
+// no platform balance, so payouts must be made on a connected account.
+// Callers hold m.mu.
+func (m *MockStripe) createPayout(p *stripe.PayoutParams) (*stripe.Payout, error) {
+	if p == nil || p.Amount == nil || p.Currency == nil {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeParameterMissing, "",
+			"Missing required param: amount and currency are required.")
+	}
+	if p.StripeAccount == nil || m.accounts[*p.StripeAccount] == nil {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeBalanceInsufficient, "amount",
+			"You have insufficient funds in your Stripe account.")
+	}
+	acct := m.accounts[*p.StripeAccount]
+	if !acct.PayoutsEnabled {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, "", "",
+			"Payouts are not enabled on this account.")
+	}
+	currency := stripe.Currency(strings.ToLower(*p.Currency))
+	if *p.Amount <= 0 || *p.Amount > balanceAmount(m.accountBalance(acct.ID), string(currency)) {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeBalanceInsufficient, "amount",
+			"You have insufficient funds in your Stripe account.")
+	}
+
+	now := time.Now()
+	po := &stripe.Payout{
+		ID:          mockID("po"),
+		Object:      "payout",
+		Amount:      *p.Amount,
+		Currency:    currency,
+		Method:      stripe.PayoutMethodStandard,
+		Status:      stripe.PayoutStatusPending,
+		Description: stripe.StringValue(p.Description),
+		Created:     now.Unix(),
+		ArrivalDate: now.Add(2 * 24 * time.Hour).Unix(),
+		Metadata:    map[string]string{},
+	}
+	if stripe.StringValue(p.Method) == string(stripe.PayoutMethodInstant) {
+		po.Method, po.ArrivalDate = stripe.PayoutMethodInstant, now.Unix()
+	}
+	for k, v := range p.Metadata {
+		po.Metadata[k] = v
+	}
+	m.payouts[po.ID] = po
+	m.payoutAccounts[po.ID] = acct.ID
+	m.emit("payout.created", po)
+	return po, nil
+}
+
+// completeOnboarding submits everything an account still needs, turning
+// on its capabilities, charges and payouts. A restricted account lacks an
+// identity document instead, and its payouts and transfers stay off.
+func (m *MockStripe) completeOnboarding(id string, restricted bool) (*stripe.Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	acct, ok := m.accounts[id]
+	if !ok {
+		return nil, mockNotFound("account", id)
+	}
+	acct.DetailsSubmitted, acct.ChargesEnabled, acct.PayoutsEnabled = true, true, true
+	acct.Requirements = &stripe.AccountRequirements{CurrentlyDue: []string{}, EventuallyDue: []string{}, PastDue: []string{}}
+	if acct.Capabilities.CardPayments != "" {
+		acct.Capabilities.CardPayments = stripe.AccountCapabilityStatusActive
+	}
+	if acct.Capabilities.Transfers != "" {
+		acct.Capabilities.Transfers = stripe.AccountCapabilityStatusActive
+	}
+	if restricted {
+		document := []string{"individual.verification.document"}
+		acct.PayoutsEnabled = false
+		acct.Requirements.CurrentlyDue, acct.Requirements.EventuallyDue = document, document
+		acct.Requirements.CurrentDeadline = time.Now().Add(14 * 24 * time.Hour).Unix()
+		if acct.Capabilities.Transfers != "" {
+			acct.Capabilities.Transfers = stripe.AccountCapabilityStatusInactive
+		}
+	}
+	m.emit("account.updated", acct)
+	copied := *acct
+	return &copied, nil
+}
+
+func updateMockCustomer(c *stripe.Customer, p *stripe.CustomerParams) {
+	if p.Email != nil {
+		c.Email = *p.Email
+	}
+	if p.Name != nil {
+		c.Name = *p.Name
+	}
+	if p.Description != nil {
+		c.Description = *p.Description
+	}
+	if p.TestClock != nil {
+		c.TestClock = &stripe.TestHelpersTestClock{ID: *p.TestClock}
+	}
+	for k, v := range p.Metadata {
+		if v == "" {
+			delete(c.Metadata, k)
+			continue
+		}
+		c.Metadata[k] = v
+	}
+	if p.InvoiceSettings != nil && p.InvoiceSettings.DefaultPaymentMethod != nil {
+		c.InvoiceSettings = &stripe.CustomerInvoiceSettings{
+			DefaultPaymentMethod: &stripe.PaymentMethod{ID: *p.InvoiceSettings.DefaultPaymentMethod},
+		}
+	}
+}
+
+// attachPaymentMethod turns a test token into a saved card, as Stripe does
+// when attaching pm_card_* to a customer. Callers hold m.mu.
+func (m *MockStripe) attachPaymentMethod(token string, p *stripe.PaymentMethodAttachParams) (*stripe.PaymentMethod, error) {
+	if p == nil || p.Customer == nil {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeParameterMissing, "customer",
+			"Missing required param: customer.")
+	}
+	c, ok := m.customers[*p.Customer]
+	if !ok {
+		return nil, mockNotFound("customer", *p.Customer)
+	}
+	if _, ok := mockTestCards[token]; !ok {
+		return nil, mockNotFound("payment_method", token)
+	}
+
+	brand := mockCardBrands[token]
+	if brand == "" {
+		brand = "visa"
+	}
+	pm := &stripe.PaymentMethod{
+		ID:       mockID("pm"),
+		Object:   "payment_method",
+		Type:     stripe.PaymentMethodTypeCard,
+		Created:  time.Now().Unix(),
+		Customer: &stripe.Customer{ID: c.ID},
+		Card:     &stripe.PaymentMethodCard{Brand: stripe.PaymentMethodCardBrand(brand), Last4: "4242", ExpMonth: 12, ExpYear: int64(time.Now().Year() + 3)},
+		Metadata: map[string]string{"mock_token": token},
+	}
+	m.emit("payment_method.attached", pm)
+	return pm, nil
+}
+
+func (m *MockStripe) createRefund(p *stripe.RefundParams) (*stripe.Refund, error) {
+	if p == nil || (p.PaymentIntent == nil && p.Charge == nil) {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeParameterMissing, "payment_intent",
+			"One of charge or payment_intent is required.")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var pi *stripe.PaymentIntent
+	if p.PaymentIntent != nil {
+		pi = m.intents[*p.PaymentIntent]
+	} else {
+		m.eachIntent(func(candidate *stripe.PaymentIntent) {
+			if candidate.LatestCharge != nil && candidate.LatestCharge.ID == *p.Charge {
+				pi = candidate
+			}
+		})
+	}
+	if pi == nil || pi.LatestCharge == nil {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeChargeNotRefundable, "",
+			"This payment has no successful charge to refund.")
+	}
+
+	ch := pi.LatestCharge
+	remaining := ch.Amount - ch.AmountRefunded
+	amount := remaining
+	if p.Amount != nil {
+		amount = *p.Amount
+	}
+	if amount <= 0 || amount > remaining {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeAmountTooLarge, "amount",
+			fmt.Sprintf("Refund amount (%d) is greater than unrefunded amount on charge (%d).", amount, remaining))
+	}
+
+	rf := &stripe.Refund{
+		ID:            mockID("re"),
+		Object:        "refund",
+		Amount:        amount,
+		Currency:      ch.Currency,
+		Status:        stripe.RefundStatusSucceeded,
+		Reason:        stripe.RefundReason(stripe.StringValue(p.Reason)),
+		Created:       time.Now().Unix(),
+		Charge:        &stripe.Charge{ID: ch.ID},
+		PaymentIntent: &stripe.PaymentIntent{ID: pi.ID},
+		Metadata:      p.Metadata,
+	}
+	m.refunds[rf.ID] = rf
+
+	ch.AmountRefunded += amount
+	ch.Refunded = ch.AmountRefunded == ch.Amount
+	ch.Refunds.Data = append(ch.Refunds.Data, rf)
+	ch.Refunds.TotalCount = uint32(len(ch.Refunds.Data))
+
+	m.emit("refund.created", rf)
+	m.emit("charge.refunded", ch)
+	return rf, nil
+}
+
+// emit records an event and queues it for delivery. Callers hold m.mu so
+// the snapshot matches the state that produced it.
+func (m *MockStripe) emit(typ string, obj interface{}) {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		log.Printf("mock provider: encoding %s: %v", typ, err)
+		return
+	}
+	ev := &stripe.Event{
+		ID:         mockID("evt"),
+		Object:     "event",
+		APIVersion: stripe.APIVersion,
+		Created:    time.Now().Unix(),
+		Type:       stripe.EventType(typ),
+		Data:       &stripe.EventData{Raw: raw},
+	}
+	m.log[ev.ID] = ev
+
+	if m.cfg.WebhookURL == "" {
+		return
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("mock provider: encoding event %s: %v", ev.ID, err)
+		return
+	}
+	select {
+	case m.events <- payload:
+	default:
+		log.Printf("mock provider: webhook queue full, dropping %s", ev.ID)
+	}
+}
+
+// deliver posts queued events one at a time so receivers see them in
+// order, retrying a few times like Stripe does (on a much shorter clock).
+func (m *MockStripe) deliver() {
+	for payload := range m.events {
+		for attempt := 0; attempt < 4; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+				Payload: payload,
+				Secret:  m.cfg.WebhookSecret,
+			})
+			req, err := http.NewRequest(http.MethodPost, m.cfg.WebhookURL, bytes.NewReader(payload))
+			if err != nil {
+				log.Printf("mock provider: %v", err)
+				break
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Stripe-Signature", signed.Header)
+
+			resp, err := m.http.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode < 300 {
+					break
+				}
+				err = fmt.Errorf("receiver returned %s", resp.Status)
+			}
+			log.Printf("mock provider: delivering webhook (attempt %d): %v", attempt+1, err)
+		}
+	}
+}
+
+// createTransfer pays out of a succeeded mock charge. Transfers need a
+// source_transaction here, since the mock keeps no platform balance.
+func (m *MockStripe) createTransfer(p *stripe.TransferParams) (*stripe.Transfer, error) {
+	if p == nil || p.Amount == nil || p.Destination == nil || p.SourceTransaction == nil {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeParameterMissing, "",
+			"Missing required param: amount, destination and source_transaction are required.")
+	}
+	if !strings.HasPrefix(*p.Destination, "acct_") {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeResourceMissing, "destination",
+			fmt.Sprintf("No such destination: '%s'", *p.Destination))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ch *stripe.Charge
+	m.eachIntent(func(pi *stripe.PaymentIntent) {
+		if pi.LatestCharge != nil && pi.LatestCharge.ID == *p.SourceTransaction {
+			ch = pi.LatestCharge
+		}
+	})
+	if ch == nil {
+		return nil, mockNotFound("charge", *p.SourceTransaction)
+	}
+	if *p.Amount <= 0 || *p.Amount > ch.Amount-ch.AmountRefunded {
+		return nil, mockError(http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeBalanceInsufficient, "amount",
+			"Transfer amount exceeds what remains of the source transaction.")
+	}
+
+	tr := &stripe.Transfer{
+		ID:                mockID("tr"),
+		Object:            "transfer",
+		Amount:            *p.Amount,
+		Currency:          stripe.Currency(strings.ToLower(stripe.StringValue(p.Currency))),
+		Destination:       &stripe.Account{ID: *p.Destination},
+		SourceTransaction: &stripe.Charge{ID: ch.ID},
+		TransferGroup:     stripe.StringValue(p.TransferGroup),
+		Metadata:          map[string]string{},
+		Created:           time.Now().Unix(),
+	}
+	for k, v := range p.Metadata {
+		tr.Metadata[k] = v
+	}
+	m.transfers[tr.ID] = tr
+	m.emit("transfer.created", tr)
+	return tr, nil
+}
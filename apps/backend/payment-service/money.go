@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+// RoundingMode decides what happens to a fraction of a minor unit.
+type RoundingMode string
+
+const (
+	// roundHalfUp rounds halves away from zero, as Stripe does.
+	roundHalfUp RoundingMode = "half_up"
+	// roundHalfEven rounds halves to the even neighbour, so rounding many
+	// amounts doesn't drift one way.
+	roundHalfEven RoundingMode = "half_even"
+	// roundDown truncates towards zero; roundUp rounds away from it.
+	roundDown RoundingMode = "down"
+	roundUp   RoundingMode = "up"
+)
+
+func (m RoundingMode) valid() bool {
+	switch m {
+	case roundHalfUp, roundHalfEven, roundDown, roundUp:
+		return true
+	}
+	return false
+}
+
+// RoundingConfig picks the rounding mode of computed amounts, such as
+// fees, taxes, surcharges and conversions, per currency. Amounts the
+// customer is promised, such as promotions and points, always round in
+// their favour regardless.
+//
+//	"rounding": {"default": "half_up", "currencies": {"chf": "half_even"}}
+type RoundingConfig struct {
+	// Default empty means half_up.
+	Default    RoundingMode            `json:"default"`
+	Currencies map[string]RoundingMode `json:"currencies"`
+}
+
+func (cfg RoundingConfig) validate() error {
+	if cfg.Default != "" && !cfg.Default.valid() {
+		return fmt.Errorf("rounding: default must be half_up, half_even, down or up")
+	}
+	for cur, m := range cfg.Currencies {
+		if len(cur) != 3 || !m.valid() {
+			return fmt.Errorf("rounding: currencies %s must be a currency code with half_up, half_even, down or up", cur)
+		}
+	}
+	return nil
+}
+
+func (cfg RoundingConfig) mode(currency string) RoundingMode {
+	if m, ok := cfg.Currencies[currency]; ok {
+		return m
+	}
+	if cfg.Default == "" {
+		return roundHalfUp
+	}
+	return cfg.Default
+}
+
+// decimalRat is f as the decimal it prints as, so a rate of 1.15 is
+// exactly 115/100 rather than the binary fraction nearest it, which would
+// put a half just below the rounding boundary.
+func decimalRat(f float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'f', -1, 64))
+	return r
+}
+
+// roundRat rounds r to a whole number of minor units.
+func roundRat(r *big.Rat, mode RoundingMode) int64 {
+	num, den := r.Num(), r.Denom()
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() == 0 {
+		return q.Int64()
+	}
+	away := big.NewInt(int64(num.Sign()))
+	// Twice the remainder against the denominator places the fraction
+	// below, at or above a half.
+	half := new(big.Int).Abs(rem)
+	half.Lsh(half, 1)
+	cmp := half.Cmp(den)
+	switch mode {
+	case roundDown:
+	case roundUp:
+		q.Add(q, away)
+	case roundHalfEven:
+		if cmp > 0 || (cmp == 0 && q.Bit(0) == 1) {
+			q.Add(q, away)
+		}
+	default:
+		if cmp >= 0 {
+			q.Add(q, away)
+		}
+	}
+	return q.Int64()
+}
+
+// percentOf is percent of amount, rounded.
+func percentOf(amount int64, percent float64, mode RoundingMode) int64 {
+	r := new(big.Rat).Mul(new(big.Rat).SetInt64(amount), decimalRat(percent))
+	return roundRat(r.Quo(r, big.NewRat(100, 1)), mode)
+}
+
+// includedTax is the tax a gross amount includes at rate percent.
+func includedTax(gross int64, rate float64, mode RoundingMode) int64 {
+	r := decimalRat(rate)
+	share := new(big.Rat).Quo(r, new(big.Rat).Add(r, big.NewRat(100, 1)))
+	return roundRat(share.Mul(share, new(big.Rat).SetInt64(gross)), mode)
+}
+
+// fractionOf is num/den of amount, rounded, for shares of a period.
+func fractionOf(amount, num, den int64, mode RoundingMode) int64 {
+	r := new(big.Rat).SetFrac(big.NewInt(num), big.NewInt(den))
+	return roundRat(r.Mul(r, new(big.Rat).SetInt64(amount)), mode)
+}
+
+// timesRate is amount times rate, rounded, for rates per minor unit such
+// as the points earned on a payment.
+func timesRate(amount int64, rate float64, mode RoundingMode) int64 {
+	return roundRat(new(big.Rat).Mul(new(big.Rat).SetInt64(amount), decimalRat(rate)), mode)
+}
+
+// convertMinor converts amount in minor units of one currency to minor
+// units of another at rate, in whole units of to per unit of from.
+func convertMinor(amount int64, from, to string, rate float64, mode RoundingMode) int64 {
+	r := new(big.Rat).Mul(new(big.Rat).SetInt64(amount), decimalRat(rate))
+	r.Mul(r, new(big.Rat).SetFrac64(int64(minorUnitsPerMajor(to)), int64(minorUnitsPerMajor(from))))
+	return roundRat(r, mode)
+}
+
+// allocate splits total into parts in proportion to weights, with the
+// largest remainder method: each part is first rounded down, then the
+// minor units left over go one each to the parts that lost the most,
+// earlier parts first on a tie. The parts always add up to total. A
+// negative total is split as its magnitude and negated; a negative weight
+// is an error, and all-zero weights split evenly.
+func allocate(total int64, weights []int64) ([]int64, error) {
+	parts := make([]int64, len(weights))
+	var sum int64
+	for i, w := range weights {
+		if w < 0 {
+			return nil, fmt.Errorf("allocate: weight %d is negative: %d", i, w)
+		}
+		sum += w
+	}
+	if len(weights) == 0 {
+		return parts, nil
+	}
+	if total < 0 {
+		neg, err := allocate(-total, weights)
+		for i, p := range neg {
+			parts[i] = -p
+		}
+		return parts, err
+	}
+	if sum == 0 {
+		weights = make([]int64, len(weights))
+		for i := range weights {
+			weights[i] = 1
+		}
+		sum = int64(len(weights))
+	}
+
+	t, s := big.NewInt(total), big.NewInt(sum)
+	remainders := make([]*big.Int, len(weights))
+	left := total
+	for i, w := range weights {
+		q, rem := new(big.Int).QuoRem(new(big.Int).Mul(t, big.NewInt(w)), s, new(big.Int))
+		parts[i], remainders[i] = q.Int64(), rem
+		left -= parts[i]
+	}
+	for ; left > 0; left-- {
+		best := -1
+		for i, rem := range remainders {
+			if rem.Sign() > 0 && (best < 0 || rem.Cmp(remainders[best]) > 0) {
+				best = i
+			}
+		}
+		parts[best]++
+		remainders[best] = new(big.Int)
+	}
+	return parts, nil
+}
+
+// splitEvenly splits total into n parts differing by at most one minor
+// unit, the larger ones first.
+func splitEvenly(total int64, n int) []int64 {
+	weights := make([]int64, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	parts, _ := allocate(total, weights)
+	return parts
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func TestRoundRat(t *testing.T) {
+	tests := []struct {
+		num, den int64
+		mode     RoundingMode
+		want     int64
+	}{
+		{10, 4, roundHalfUp, 3},
+		{-10, 4, roundHalfUp, -3},
+		{10, 4, roundHalfEven, 2},
+		{14, 4, roundHalfEven, 4},
+		{-10, 4, roundHalfEven, -2},
+		{9, 4, roundHalfUp, 2},
+		{11, 4, roundHalfEven, 3},
+		{11, 4, roundDown, 2},
+		{-11, 4, roundDown, -2},
+		{9, 4, roundUp, 3},
+		{-9, 4, roundUp, -3},
+		{12, 4, roundUp, 3},
+		{0, 7, roundUp, 0},
+	}
+	for _, tt := range tests {
+		if got := roundRat(big.NewRat(tt.num, tt.den), tt.mode); got != tt.want {
+			t.Errorf("roundRat(%d/%d, %s) = %d, want %d", tt.num, tt.den, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		total   int64
+		weights []int64
+		want    []int64
+	}{
+		{100, []int64{1, 1, 1}, []int64{34, 33, 33}},
+		{-100, []int64{1, 1, 1}, []int64{-34, -33, -33}},
+		{10, []int64{1, 2}, []int64{3, 7}},
+		{5, []int64{0, 0}, []int64{3, 2}},
+		{7, []int64{0, 3}, []int64{0, 7}},
+		{0, []int64{1, 2}, []int64{0, 0}},
+		{5, nil, []int64{}},
+		// 1000 by 1:1:1:1:1:1:1 leaves 6 units over; the first six parts
+		// tie on the remainder and take one each.
+		{1000, []int64{1, 1, 1, 1, 1, 1, 1}, []int64{143, 143, 143, 143, 143, 143, 142}},
+	}
+	for _, tt := range tests {
+		got, err := allocate(tt.total, tt.weights)
+		if err != nil {
+			t.Errorf("allocate(%d, %v): %v", tt.total, tt.weights, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("allocate(%d, %v) = %v, want %v", tt.total, tt.weights, got, tt.want)
+		}
+		var sum int64
+		for _, p := range got {
+			sum += p
+		}
+		if len(tt.weights) > 0 && sum != tt.total {
+			t.Errorf("allocate(%d, %v) adds up to %d", tt.total, tt.weights, sum)
+		}
+	}
+
+	for _, total := range []int64{100, -100} {
+		if parts, err := allocate(total, []int64{3, -1}); err == nil {
+			t.Errorf("allocate(%d, [3 -1]) = %v, want an error", total, parts)
+		}
+	}
+}
+
+func TestConvertMinor(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		from, to string
+		rate     float64
+		mode     RoundingMode
+		want     int64
+	}{
+		{1000, "usd", "eur", 0.92, roundHalfUp, 920},
+		// 1.15 as a binary float is just below 1.15; read as the decimal
+		// it prints as, 10 cents come to exactly 11.5 and round up.
+		{10, "usd", "eur", 1.15, roundHalfUp, 12},
+		{10, "usd", "eur", 1.15, roundHalfEven, 12},
+		{30, "usd", "eur", 1.15, roundHalfEven, 34},
+		{10, "usd", "eur", 1.15, roundDown, 11},
+		{1000, "usd", "jpy", 150.25, roundHalfUp, 1503},
+		{1503, "jpy", "usd", 0.0066556, roundHalfUp, 1000},
+		{1000, "usd", "kwd", 0.307, roundHalfUp, 3070},
+		{-1000, "usd", "eur", 0.92, roundHalfUp, -920},
+	}
+	for _, tt := range tests {
+		if got := convertMinor(tt.amount, tt.from, tt.to, tt.rate, tt.mode); got != tt.want {
+			t.Errorf("convertMinor(%d, %s, %s, %v, %s) = %d, want %d", tt.amount, tt.from, tt.to, tt.rate, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestTimesRate(t *testing.T) {
+	// 0.29 as a binary float times 100 is 28.999999999999996.
+	if got := timesRate(100, 0.29, roundDown); got != 29 {
+		t.Errorf("timesRate(100, 0.29, down) = %d, want 29", got)
+	}
+	if got := timesRate(1999, 0.01, roundDown); got != 19 {
+		t.Errorf("timesRate(1999, 0.01, down) = %d, want 19", got)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ndjsonContentType is newline-delimited JSON, one object per line. List
+// and export endpoints stream it row by row instead of building the whole
+// result in memory; a slow reader slows the database cursor down with it,
+// since each write blocks until the connection takes it.
+const ndjsonContentType = "application/x-ndjson"
+
+// wantsNDJSON reports whether the client asked for an NDJSON stream.
+func wantsNDJSON(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), ndjsonContentType)
+}
+
+// ndjsonWriter encodes one value per line, flushing every so often so the
+// client sees rows as they are produced.
+type ndjsonWriter struct {
+	enc     *json.Encoder
+	flusher http.Flusher
+	n       int
+}
+
+func newNDJSONWriter(w io.Writer) *ndjsonWriter {
+	flusher, _ := w.(http.Flusher)
+	return &ndjsonWriter{enc: json.NewEncoder(w), flusher: flusher}
+}
+
+func (w *ndjsonWriter) Encode(v interface{}) error {
+	if err := w.enc.Encode(v); err != nil {
+		return err
+	}
+	w.n++
+	if w.n%100 == 0 {
+		w.Flush()
+	}
+	return nil
+}
+
+func (w *ndjsonWriter) Flush() {
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+}
+
+// ndjsonRowWriter adapts ndjsonWriter to the export rowWriter: the first
+// row is the header, and each later row becomes an object keyed by it.
+type ndjsonRowWriter struct {
+	w      *ndjsonWriter
+	header []string
+}
+
+// numericExportColumns are written as JSON numbers rather than strings.
+var numericExportColumns = map[string]bool{"amount": true, "amount_received": true}
+
+func (n *ndjsonRowWriter) Write(row []string) error {
+	if n.header == nil {
+		n.header = row
+		return nil
+	}
+	obj := make(map[string]interface{}, len(row))
+	for i, v := range row {
+		if numericExportColumns[n.header[i]] {
+			obj[n.header[i]] = json.Number(v)
+		} else {
+			obj[n.header[i]] = v
+		}
+	}
+	return n.w.Encode(obj)
+}
+
+func (n *ndjsonRowWriter) Close() error {
+	n.w.Flush()
+	return nil
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// oauth2Leeway is the clock skew allowed on a token's exp and nbf.
+const oauth2Leeway = time.Minute
+
+// oauth2MinRefresh stops a stream of tokens signed by unknown keys from
+// refetching the key set on every request.
+const oauth2MinRefresh = 30 * time.Second
+
+// oauth2Principal prefixes the API key ID a client's tokens authenticate
+// as, in logs, metrics and quotas.
+const oauth2Principal = "oauth2:"
+
+var oauth2Tokens = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_oauth2_tokens_total",
+	Help: "OAuth2 access tokens presented, by result (accepted, rejected).",
+}, []string{"result"})
+
+// oauth2Verifier accepts access tokens from the identity provider in
+// place of API keys; nil accepts none. requireScope and the gRPC API
+// consult it for bearer tokens that are JWTs.
+var oauth2Verifier *OAuth2Verifier
+
+// OAuth2Config maps access token scopes onto the service's. Token scopes
+// without a mapping are taken as they are, and a client listed under
+// clients gets no more than its scopes there, whatever its token says.
+//
+//	"oauth2": {"scopes": {"payments.refund": ["admin"]},
+//	           "clients": {"ledger-sync": ["billing", "payments:read"]}}
+type OAuth2Config struct {
+	Scopes  map[string][]string `json:"scopes"`
+	Clients map[string][]string `json:"clients"`
+}
+
+func (cfg OAuth2Config) validate() error {
+	for scope, mapped := range cfg.Scopes {
+		if scope == "" || len(mapped) == 0 {
+			return fmt.Errorf("oauth2: scope %q must map to at least one scope", scope)
+		}
+	}
+	for client := range cfg.Clients {
+		if client == "" {
+			return fmt.Errorf("oauth2: clients need an ID")
+		}
+	}
+	return nil
+}
+
+// scopesFor is what a client's token scopes grant here.
+func (cfg OAuth2Config) scopesFor(client string, tokenScopes []string) []string {
+	var granted []string
+	for _, s := range tokenScopes {
+		if mapped, ok := cfg.Scopes[s]; ok {
+			granted = append(granted, mapped...)
+		} else {
+			granted = append(granted, s)
+		}
+	}
+	allowed, listed := cfg.Clients[client]
+	if !listed {
+		return granted
+	}
+	var out []string
+	for _, s := range granted {
+		for _, a := range allowed {
+			if s == a {
+				out = append(out, s)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// OAuth2Verifier checks client-credentials access tokens issued by the
+// internal identity provider: JWTs signed with a key from the issuer's
+// JWKS, found through its OpenID discovery document, for our audience and
+// unexpired. Machine callers rotate their credentials at the provider
+// rather than asking for a new API key. The key set is refetched every
+// refresh interval, and sooner when a token names a key it doesn't hold,
+// which is how a key rotation shows up.
+type OAuth2Verifier struct {
+	issuer   string
+	audience string
+	jwksURL  string
+	refresh  time.Duration
+	settings *RuntimeSettings
+	http     *http.Client
+
+	// mu guards jwksURL once discovered, and the fields below. fetching
+	// is closed when the fetch under way ends.
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	fetching  chan struct{}
+}
+
+// NewOAuth2VerifierFromEnv returns the verifier set up by OAUTH2_ISSUER
+// and OAUTH2_AUDIENCE, or nil when OAUTH2_ISSUER is unset.
+// OAUTH2_JWKS_URL skips discovery.
+func NewOAuth2VerifierFromEnv(settings *RuntimeSettings) *OAuth2Verifier {
+	issuer := strings.TrimSuffix(os.Getenv("OAUTH2_ISSUER"), "/")
+	if issuer == "" {
+		return nil
+	}
+	audience := os.Getenv("OAUTH2_AUDIENCE")
+	if audience == "" {
+		log.Fatal("OAUTH2_ISSUER requires OAUTH2_AUDIENCE")
+	}
+	v := &OAuth2Verifier{
+		issuer:   issuer,
+		audience: audience,
+		jwksURL:  os.Getenv("OAUTH2_JWKS_URL"),
+		refresh:  envDuration("OAUTH2_JWKS_REFRESH", time.Hour),
+		settings: settings,
+		http:     &http.Client{Timeout: 10 * time.Second},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	// Tokens are still checked if the provider is down at startup; the
+	// keys are fetched on the first one.
+	if err := v.fetchKeys(ctx); err != nil {
+		log.Printf("OAuth2: fetching keys from %s: %v", issuer, err)
+	} else {
+		log.Printf("OAuth2 access tokens from %s accepted for %s", issuer, audience)
+	}
+	return v
+}
+
+// isJWT tells an access token from an API key.
+func isJWT(token string) bool {
+	return strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2
+}
+
+// oauth2Claims are the claims read from an access token.
+type oauth2Claims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	ClientID  string          `json:"client_id"`
+	AZP       string          `json:"azp"`
+	Scope     string          `json:"scope"`
+	SCP       json.RawMessage `json:"scp"`
+}
+
+// client is who the token was issued to.
+func (c *oauth2Claims) client() string {
+	switch {
+	case c.ClientID != "":
+		return c.ClientID
+	case c.AZP != "":
+		return c.AZP
+	}
+	return c.Subject
+}
+
+// scopes reads "scope", space separated, or "scp", a list or a string.
+func (c *oauth2Claims) scopes() []string {
+	if c.Scope != "" {
+		return strings.Fields(c.Scope)
+	}
+	var list []string
+	if json.Unmarshal(c.SCP, &list) == nil {
+		return list
+	}
+	var s string
+	if json.Unmarshal(c.SCP, &s) == nil {
+		return strings.Fields(s)
+	}
+	return nil
+}
+
+func (c *oauth2Claims) hasAudience(aud string) bool {
+	var list []string
+	if json.Unmarshal(c.Audience, &list) != nil {
+		var s string
+		if json.Unmarshal(c.Audience, &s) != nil {
+			return false
+		}
+		list = []string{s}
+	}
+	for _, a := range list {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate verifies token and returns the client it was issued to as
+// an API key, with the scopes its token grants here, so scope checks and
+// quotas treat it like one.
+func (v *OAuth2Verifier) Authenticate(ctx context.Context, token string) (*APIKey, error) {
+	claims, err := v.verify(ctx, token, time.Now())
+	if err != nil {
+		oauth2Tokens.WithLabelValues("rejected").Inc()
+		return nil, err
+	}
+	oauth2Tokens.WithLabelValues("accepted").Inc()
+	client := claims.client()
+	key := &APIKey{
+		ID:     oauth2Principal + client,
+		Name:   client,
+		Scopes: v.settings.Get().OAuth2.scopesFor(client, claims.scopes()),
+	}
+	if claims.ExpiresAt != nil {
+		exp := time.Unix(int64(*claims.ExpiresAt), 0).UTC()
+		key.ExpiresAt = &exp
+	}
+	return key, nil
+}
+
+func (v *OAuth2Verifier) verify(ctx context.Context, token string, now time.Time) (*oauth2Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("bad signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("bad signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key for %s", header.Alg)
+	}
+
+	var claims oauth2Claims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != v.issuer:
+		return nil, fmt.Errorf("issuer %q not trusted", claims.Issuer)
+	case !claims.hasAudience(v.audience):
+		return nil, errors.New("token is for another audience")
+	case claims.ExpiresAt == nil:
+		return nil, errors.New("token has no expiry")
+	case now.Add(-oauth2Leeway).After(time.Unix(int64(*claims.ExpiresAt), 0)):
+		return nil, errors.New("token expired")
+	case claims.NotBefore != nil && now.Add(oauth2Leeway).Before(time.Unix(int64(*claims.NotBefore), 0)):
+		return nil, errors.New("token not yet valid")
+	case claims.client() == "":
+		return nil, errors.New("token names no client")
+	}
+	return &claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// key returns the signing key kid, refetching the key set when it is due
+// or doesn't hold kid.
+func (v *OAuth2Verifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	since, inFlight := time.Since(v.fetchedAt), v.fetching != nil
+	v.mu.Unlock()
+	if (!ok && (inFlight || since >= oauth2MinRefresh)) || since >= v.refresh {
+		if err := v.fetchKeys(ctx); err != nil {
+			logf(ctx, "OAuth2: refreshing keys: %v", err)
+		}
+		v.mu.Lock()
+		key, ok = v.keys[kid]
+		v.mu.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys loads the key set, or waits for the fetch already under way.
+// mu is not held over the network, so tokens signed by keys already held
+// are checked meanwhile; the new set is swapped in once fetched. A failed
+// fetch keeps the keys already held.
+func (v *OAuth2Verifier) fetchKeys(ctx context.Context) error {
+	v.mu.Lock()
+	if done := v.fetching; done != nil {
+		v.mu.Unlock()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	done := make(chan struct{})
+	// Counted as an attempt either way, so a provider outage isn't
+	// hammered.
+	v.fetching, v.fetchedAt = done, time.Now()
+	jwksURL := v.jwksURL
+	v.mu.Unlock()
+
+	keys, jwksURL, err := v.loadKeys(ctx, jwksURL)
+
+	v.mu.Lock()
+	v.jwksURL = jwksURL
+	if err == nil {
+		v.keys = keys
+	}
+	v.fetching = nil
+	v.mu.Unlock()
+	close(done)
+	return err
+}
+
+// loadKeys fetches the key set from jwksURL, discovering it first when
+// empty, and returns it with the URL it came from.
+func (v *OAuth2Verifier) loadKeys(ctx context.Context, jwksURL string) (map[string]crypto.PublicKey, string, error) {
+	if jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(ctx, v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, "", fmt.Errorf("discovery: %w", err)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, "", errors.New("discovery: no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(ctx, jwksURL, &set); err != nil {
+		return nil, jwksURL, fmt.Errorf("key set: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			logf(ctx, "OAuth2: skipping key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return nil, jwksURL, errors.New("key set has no usable signing keys")
+	}
+	return keys, jwksURL, nil
+}
+
+func (v *OAuth2Verifier) getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// jsonWebKey is an RSA or P-256 public key from a JWKS.
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	b64 := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("bad %s key parameter", k.Kty)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point not on P-256")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// OrderLogEntry is one entry of an order's activity in the order service:
+// placement, fulfilment, shipping, and customer access to what was bought.
+type OrderLogEntry struct {
+	At      time.Time `json:"at"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+	IP      string    `json:"ip,omitempty"`
+}
+
+// OrderClient reads from the monorepo's order service.
+type OrderClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// NewOrderClient accepts a discovery:// base URL when transport is
+// discovery-aware.
+func NewOrderClient(baseURL, token string, transport http.RoundTripper) *OrderClient {
+	return &OrderClient{
+		baseURL: baseURL,
+		token:   token,
+		http:    &http.Client{Timeout: 10 * time.Second, Transport: transport},
+	}
+}
+
+// Logs returns an order's activity log, oldest first.
+func (o *OrderClient) Logs(ctx context.Context, orderID string) ([]OrderLogEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.baseURL+"/orders/"+url.PathEscape(orderID)+"/logs", nil)
+	if err != nil {
+		return nil, err
+	}
+	if o.token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.token)
+	}
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+
+	resp, err := o.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("order service request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("order service returned %s", resp.Status)
+	}
+	var body struct {
+		Data []OrderLogEntry `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding order logs: %w", err)
+	}
+	return body.Data, nil
+}
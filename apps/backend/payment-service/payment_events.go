@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// paymentSnapshotEvery is how many events a payment's stream grows by
+// between snapshots.
+const paymentSnapshotEvery = 50
+
+// paymentFeedSettle is how old an event must be before the feed hands it
+// out. IDs are taken when a transaction starts writing, not when it
+// commits, so a consumer paging by ID could otherwise skip an event
+// committed after a higher one.
+const paymentFeedSettle = 10 * time.Second
+
+// PaymentAggregate is a payment as its event stream tells it. Customer
+// and card details and the free-text description are left out: they are
+// erased or anonymized in place, which an append-only stream cannot be.
+// PaymentMethod is only the method's type.
+type PaymentAggregate struct {
+	TenantID       string                   `json:"tenant_id"`
+	OrderID        string                   `json:"order_id"`
+	Amount         int64                    `json:"amount"`
+	AmountReceived int64                    `json:"amount_received"`
+	AmountRefunded int64                    `json:"amount_refunded"`
+	Currency       string                   `json:"currency"`
+	Status         string                   `json:"status"`
+	State          string                   `json:"state"`
+	PaymentMethod  string                   `json:"payment_method"`
+	Region         string                   `json:"region"`
+	Refunds        map[string]AggregateItem `json:"refunds"`
+	Disputes       map[string]AggregateItem `json:"disputes"`
+	CreatedAt      time.Time                `json:"created_at"`
+}
+
+// AggregateItem is a refund or dispute of a payment.
+type AggregateItem struct {
+	Amount int64  `json:"amount"`
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+func newPaymentAggregate() *PaymentAggregate {
+	return &PaymentAggregate{Refunds: map[string]AggregateItem{}, Disputes: map[string]AggregateItem{}}
+}
+
+// apply folds one event's changed fields into a. Refunds and disputes
+// named in the event replace those in a; the others stay.
+func (a *PaymentAggregate) apply(data []byte) error {
+	if err := json.Unmarshal(data, a); err != nil {
+		return err
+	}
+	a.CreatedAt = a.CreatedAt.UTC()
+	return nil
+}
+
+// paymentDiff is the event data taking prev to next: the top-level fields
+// that differ, and of refunds and disputes only the entries that do. It
+// is nil when nothing changed.
+func paymentDiff(prev, next *PaymentAggregate) (json.RawMessage, error) {
+	p, err := aggregateFields(prev)
+	if err != nil {
+		return nil, err
+	}
+	n, err := aggregateFields(next)
+	if err != nil {
+		return nil, err
+	}
+	diff := map[string]interface{}{}
+	for k, v := range n {
+		if bytes.Equal(p[k], v) {
+			continue
+		}
+		switch k {
+		case "refunds":
+			if d := itemsDiff(prev.Refunds, next.Refunds); len(d) > 0 {
+				diff[k] = d
+			}
+		case "disputes":
+			if d := itemsDiff(prev.Disputes, next.Disputes); len(d) > 0 {
+				diff[k] = d
+			}
+		default:
+			diff[k] = v
+		}
+	}
+	if len(diff) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(diff)
+}
+
+func aggregateFields(a *PaymentAggregate) (map[string]json.RawMessage, error) {
+	raw, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	return fields, json.Unmarshal(raw, &fields)
+}
+
+func itemsDiff(prev, next map[string]AggregateItem) map[string]AggregateItem {
+	d := map[string]AggregateItem{}
+	for id, item := range next {
+		if old, ok := prev[id]; !ok || old != item {
+			d[id] = item
+		}
+	}
+	return d
+}
+
+// paymentEventType names the change from prev to next, the payment's
+// version-th event.
+func paymentEventType(version int, prev, next *PaymentAggregate) string {
+	switch {
+	case version == 1:
+		return "payment.created"
+	case prev.State != next.State:
+		return "payment." + next.State
+	case len(itemsDiff(prev.Refunds, next.Refunds)) > 0:
+		return "payment.refund_updated"
+	case len(itemsDiff(prev.Disputes, next.Disputes)) > 0:
+		return "payment.dispute_updated"
+	}
+	return "payment.updated"
+}
+
+// storedPaymentAggregate reads a payment's stored row, refunds and
+// disputes within tx, locking the row, or returns sql.ErrNoRows.
+func storedPaymentAggregate(ctx context.Context, tx *sql.Tx, paymentID string) (*PaymentAggregate, error) {
+	a := newPaymentAggregate()
+	if err := tx.QueryRowContext(ctx, `
+		SELECT tenant_id, order_id, amount, amount_received, amount_refunded, currency, status, state,
+			payment_method, region, created_at
+		FROM payments WHERE id = $1 FOR UPDATE`, paymentID).
+		Scan(&a.TenantID, &a.OrderID, &a.Amount, &a.AmountReceived, &a.AmountRefunded, &a.Currency, &a.Status,
+			&a.State, &a.PaymentMethod, &a.Region, &a.CreatedAt); err != nil {
+		return nil, err
+	}
+	a.CreatedAt = a.CreatedAt.UTC()
+	for _, items := range []struct {
+		query string
+		into  map[string]AggregateItem
+	}{
+		{`SELECT id, amount, status, reason FROM refunds WHERE payment_id = $1`, a.Refunds},
+		{`SELECT id, amount, status, reason FROM disputes WHERE payment_id = $1`, a.Disputes},
+	} {
+		rows, err := tx.QueryContext(ctx, items.query, paymentID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id string
+			var item AggregateItem
+			if err := rows.Scan(&id, &item.Amount, &item.Status, &item.Reason); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			items.into[id] = item
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// loadPaymentAggregate rebuilds a payment from its latest snapshot and
+// the events after it, as of at when it is not zero. It returns the
+// version reached, 0 when the payment had no events by then.
+func loadPaymentAggregate(ctx context.Context, q queryer, paymentID string, at time.Time) (*PaymentAggregate, int, error) {
+	until := sql.NullTime{Time: at, Valid: !at.IsZero()}
+	a := newPaymentAggregate()
+	version := 0
+
+	rows, err := q.QueryContext(ctx, `
+		SELECT version, state FROM payment_snapshots
+		WHERE payment_id = $1 AND ($2::timestamptz IS NULL OR created_at <= $2)
+		ORDER BY version DESC LIMIT 1`, paymentID, until)
+	if err != nil {
+		return nil, 0, err
+	}
+	for rows.Next() {
+		var state []byte
+		if err := rows.Scan(&version, &state); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		if err := a.apply(state); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err = q.QueryContext(ctx, `
+		SELECT version, data FROM payment_events
+		WHERE payment_id = $1 AND version > $2 AND ($3::timestamptz IS NULL OR created_at <= $3)
+		ORDER BY version`, paymentID, version, until)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&version, &data); err != nil {
+			return nil, 0, err
+		}
+		if err := a.apply(data); err != nil {
+			return nil, 0, err
+		}
+	}
+	return a, version, rows.Err()
+}
+
+// appendPaymentEvent appends to a payment's stream, within tx, whatever
+// changed in its stored row, refunds and disputes since the stream's last
+// event, snapshotting every paymentSnapshotEvery events. source names
+// what made the change. A payment not stored locally has no stream.
+func appendPaymentEvent(ctx context.Context, tx *sql.Tx, paymentID, source string) error {
+	next, err := storedPaymentAggregate(ctx, tx, paymentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	prev, version, err := loadPaymentAggregate(ctx, tx, paymentID, time.Time{})
+	if err != nil {
+		return err
+	}
+	data, err := paymentDiff(prev, next)
+	if err != nil || data == nil {
+		return err
+	}
+	version++
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_events (payment_id, version, type, data, source)
+		VALUES ($1, $2, $3, $4, $5)`,
+		paymentID, version, paymentEventType(version, prev, next), []byte(data), source); err != nil {
+		return err
+	}
+	if version%paymentSnapshotEvery == 0 {
+		state, err := json.Marshal(next)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO payment_snapshots (payment_id, version, state) VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING`, paymentID, version, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PaymentChange is one event of a payment's stream.
+type PaymentChange struct {
+	ID        int64           `json:"id"`
+	PaymentID string          `json:"payment_id"`
+	Version   int             `json:"version"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	Source    string          `json:"source"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func scanPaymentChanges(rows *sql.Rows) ([]PaymentChange, error) {
+	defer rows.Close()
+	out := []PaymentChange{}
+	for rows.Next() {
+		var e PaymentChange
+		if err := rows.Scan(&e.ID, &e.PaymentID, &e.Version, &e.Type, &e.Data, &e.Source, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+const paymentChangeColumns = `id, payment_id, version, type, data, source, created_at`
+
+// PaymentChanges returns a payment's events, oldest first.
+func (s *Store) PaymentChanges(ctx context.Context, paymentID string) ([]PaymentChange, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+paymentChangeColumns+` FROM payment_events WHERE payment_id = $1 ORDER BY version`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	return scanPaymentChanges(rows)
+}
+
+// PaymentChangeFeed returns up to limit events of all payments after the
+// one with ID after, in ID order, for rebuilding projections elsewhere.
+func (s *Store) PaymentChangeFeed(ctx context.Context, after int64, limit int) ([]PaymentChange, error) {
+	return paymentChangeFeed(ctx, s.db, after, limit)
+}
+
+func paymentChangeFeed(ctx context.Context, q queryer, after int64, limit int) ([]PaymentChange, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT `+paymentChangeColumns+` FROM payment_events
+		WHERE id > $1 AND created_at < $2
+		ORDER BY id LIMIT $3`, after, time.Now().Add(-paymentFeedSettle), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanPaymentChanges(rows)
+}
+
+// PaymentEventStore serves payments' event streams: each payment's
+// events, a payment rebuilt as of any time, and the feed of all events.
+type PaymentEventStore struct {
+	store *Store
+}
+
+func NewPaymentEventStore(store *Store) *PaymentEventStore {
+	return &PaymentEventStore{store: store}
+}
+
+// RegisterRoutes mounts a payment's changes and as-of view under
+// payments:read, like its timeline, and the feed of all events under the
+// admin scope.
+func (pe *PaymentEventStore) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	read := requireScope(pe.store, bootstrapToken, readPaymentsScope)
+	r.GET("/payment/:id/changes", read, pe.changes)
+	r.GET("/payment/:id/as-of", read, pe.asOf)
+	r.GET("/admin/payment-changes", requireScope(pe.store, bootstrapToken, "admin"), pe.feed)
+}
+
+func (pe *PaymentEventStore) changes(c *gin.Context) {
+	events, err := pe.store.PaymentChanges(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if len(events) == 0 {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Payment not found"))
+		return
+	}
+	respondList(c, http.StatusOK, events, gin.H{"payment_id": c.Param("id")})
+}
+
+// asOf rebuilds a payment from its events up to ?at= (a date or RFC 3339
+// timestamp), or up to now without it.
+func (pe *PaymentEventStore) asOf(c *gin.Context) {
+	var at time.Time
+	if s := c.Query("at"); s != "" {
+		var err error
+		if at, err = parseExportTime(s); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "at must be a date (YYYY-MM-DD) or RFC 3339 timestamp"))
+			return
+		}
+	}
+	a, version, err := loadPaymentAggregate(c.Request.Context(), pe.store.db, c.Param("id"), at)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if version == 0 {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Payment had no recorded state by then"))
+		return
+	}
+	body := gin.H{"payment_id": c.Param("id"), "version": version, "payment": a}
+	if !at.IsZero() {
+		body["at"] = at
+	}
+	respondData(c, http.StatusOK, body)
+}
+
+// feed pages through every payment's events in ID order: pass the last
+// ID seen as ?after= to continue.
+func (pe *PaymentEventStore) feed(c *gin.Context) {
+	after, err := strconv.ParseInt(c.DefaultQuery("after", "0"), 10, 64)
+	if err != nil || after < 0 {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "after must be a non-negative event id"))
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "limit must be between 1 and 1000"))
+		return
+	}
+	events, err := pe.store.PaymentChangeFeed(c.Request.Context(), after, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	next := after
+	if len(events) > 0 {
+		next = events[len(events)-1].ID
+	}
+	respondList(c, http.StatusOK, events, gin.H{"after": after, "next_after": next, "has_more": len(events) == limit})
+}
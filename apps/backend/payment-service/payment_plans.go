@@ -0,0 +1,993 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+var (
+	paymentPlansCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "payment_service_payment_plans_created_total",
+		Help: "Installment plans created.",
+	})
+	paymentPlanCharges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_payment_plan_charges_total",
+		Help: "Installment charge attempts, by outcome (paid, processing, declined, missed, error).",
+	}, []string{"outcome"})
+	paymentPlanResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_payment_plan_results_total",
+		Help: "Plans that ended or defaulted, by result (completed, paid_off, defaulted, canceled).",
+	}, []string{"result"})
+)
+
+// PaymentPlanConfig sets the rules for installment plans. A declined
+// installment is tried again after each of retry_hours, counted from the
+// decline; once they run out it is missed, and a plan with max_missed
+// missed installments defaults and stops charging until the customer
+// gives it a new payment method.
+//
+//	"payment_plans": {"retry_hours": [24, 72], "max_missed": 2, "max_installments": 12}
+type PaymentPlanConfig struct {
+	// RetryHours empty means 24 and 72.
+	RetryHours []int `json:"retry_hours"`
+	// MaxMissed zero means 2.
+	MaxMissed int `json:"max_missed"`
+	// MaxInstallments zero means 12.
+	MaxInstallments int `json:"max_installments"`
+}
+
+func (cfg PaymentPlanConfig) validate() error {
+	for _, h := range cfg.RetryHours {
+		if h <= 0 {
+			return fmt.Errorf("payment_plans: retry_hours must be positive")
+		}
+	}
+	if cfg.MaxMissed < 0 || cfg.MaxInstallments < 0 {
+		return fmt.Errorf("payment_plans: max_missed and max_installments must not be negative")
+	}
+	return nil
+}
+
+func (cfg PaymentPlanConfig) retryHours() []int {
+	if len(cfg.RetryHours) == 0 {
+		return []int{24, 72}
+	}
+	return cfg.RetryHours
+}
+
+func (cfg PaymentPlanConfig) maxMissed() int {
+	if cfg.MaxMissed == 0 {
+		return 2
+	}
+	return cfg.MaxMissed
+}
+
+func (cfg PaymentPlanConfig) maxInstallments() int {
+	if cfg.MaxInstallments == 0 {
+		return 12
+	}
+	return cfg.MaxInstallments
+}
+
+// Plan statuses. An active plan has its installments charged as they
+// fall due; a defaulted one missed too many and waits for a new payment
+// method. paying_off marks an early payoff in flight.
+const (
+	planActive    = "active"
+	planPayingOff = "paying_off"
+	planCompleted = "completed"
+	planDefaulted = "defaulted"
+	planCanceled  = "canceled"
+)
+
+// Installment statuses. A scheduled installment is charged at
+// next_attempt_at: its due date, or the retry after a decline. Charging
+// is a claimed attempt in flight and processing one whose payment method
+// settles asynchronously.
+const (
+	installmentScheduled  = "scheduled"
+	installmentCharging   = "charging"
+	installmentProcessing = "processing"
+	installmentPaid       = "paid"
+	installmentMissed     = "missed"
+	installmentCanceled   = "canceled"
+)
+
+// paymentPlanLease is how long a claimed installment stays claimed, so an
+// instance that dies mid-charge is covered by another.
+const paymentPlanLease = 10 * time.Minute
+
+// Metadata tying a PaymentIntent to its plan. The installment is its
+// sequence number, or "payoff" for an early payoff.
+const (
+	planMetadataID          = "payment_plan_id"
+	planMetadataInstallment = "payment_plan_installment"
+)
+
+var errPlanState = errors.New("payment plan is not in a state that allows this")
+
+// planFrequencies give the due date of installment i, counted from 0.
+var planFrequencies = map[string]func(start time.Time, i int) time.Time{
+	"weekly":   func(t time.Time, i int) time.Time { return t.AddDate(0, 0, 7*i) },
+	"biweekly": func(t time.Time, i int) time.Time { return t.AddDate(0, 0, 14*i) },
+	"monthly":  addMonths,
+}
+
+// addMonths moves t on by n calendar months, keeping its day of the month
+// where the month has one: a plan started on the 31st falls due on the
+// last day of shorter months rather than early in the next.
+func addMonths(t time.Time, n int) time.Time {
+	y, m, d := t.Date()
+	first := time.Date(y, m+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); d > last {
+		d = last
+	}
+	return first.AddDate(0, 0, d-1)
+}
+
+// PaymentPlan splits a total into installments charged off-session on the
+// customer's saved payment method. Stripe's own installments only exist
+// in a few markets, so the schedule is ours.
+type PaymentPlan struct {
+	ID         string `json:"id"`
+	Status     string `json:"status"`
+	TenantID   string `json:"tenant_id,omitempty"`
+	OrderID    string `json:"order_id,omitempty"`
+	CustomerID string `json:"customer_id"`
+	// PaymentMethod is a Stripe pm_ or a vaulted vpm_ ID, looked up at
+	// each charge so a vaulted card follows its latest token.
+	PaymentMethod string            `json:"payment_method"`
+	Currency      string            `json:"currency"`
+	TotalAmount   int64             `json:"total_amount"`
+	Frequency     string            `json:"frequency"`
+	Description   string            `json:"description,omitempty"`
+	MissedCount   int               `json:"missed_count"`
+	PayoffID      string            `json:"payoff_id,omitempty"`
+	Balance       int64             `json:"balance"`
+	Installments  []PlanInstallment `json:"installments"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+
+	resumeStatus   string
+	payoffAttempts int
+}
+
+// PlanInstallment is one scheduled charge of a plan.
+type PlanInstallment struct {
+	PlanID        string     `json:"-"`
+	Seq           int        `json:"seq"`
+	Amount        int64      `json:"amount"`
+	DueAt         time.Time  `json:"due_at"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	Declines      int        `json:"declines"`
+	PaymentID     string     `json:"payment_id,omitempty"`
+	DeclineCode   string     `json:"decline_code,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	PaidAt        *time.Time `json:"paid_at,omitempty"`
+}
+
+// outstanding reports whether the installment is still owed and not
+// being charged.
+func (i PlanInstallment) outstanding() bool {
+	return i.Status == installmentScheduled || i.Status == installmentMissed
+}
+
+// planSchedule splits total into n installments due every frequency from
+// start. The remainder of an uneven split goes to the first
+// installments, one minor unit each.
+func planSchedule(total int64, n int, frequency string, start time.Time) []PlanInstallment {
+	due := planFrequencies[frequency]
+	out := make([]PlanInstallment, n)
+	for i, amount := range splitEvenly(total, n) {
+		at := due(start, i).UTC()
+		out[i] = PlanInstallment{Seq: i + 1, Amount: amount, DueAt: at, Status: installmentScheduled, NextAttemptAt: &at}
+	}
+	return out
+}
+
+const paymentPlanColumns = `id, tenant_id, order_id, customer_id, payment_method, currency, total_amount, frequency,
+	description, status, resume_status, missed_count, payoff_attempts, COALESCE(payoff_id, ''), created_at, updated_at`
+
+func scanPaymentPlan(row interface{ Scan(...interface{}) error }) (*PaymentPlan, error) {
+	var p PaymentPlan
+	if err := row.Scan(&p.ID, &p.TenantID, &p.OrderID, &p.CustomerID, &p.PaymentMethod, &p.Currency, &p.TotalAmount,
+		&p.Frequency, &p.Description, &p.Status, &p.resumeStatus, &p.MissedCount, &p.payoffAttempts, &p.PayoffID,
+		&p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+const planInstallmentColumns = `plan_id, seq, amount, due_at, status, attempts, declines, COALESCE(payment_id, ''), decline_code,
+	next_attempt_at, paid_at`
+
+func scanPlanInstallment(row interface{ Scan(...interface{}) error }) (*PlanInstallment, error) {
+	var i PlanInstallment
+	var next, paid sql.NullTime
+	if err := row.Scan(&i.PlanID, &i.Seq, &i.Amount, &i.DueAt, &i.Status, &i.Attempts, &i.Declines, &i.PaymentID, &i.DeclineCode,
+		&next, &paid); err != nil {
+		return nil, err
+	}
+	i.NextAttemptAt = timeOrNil(next)
+	i.PaidAt = timeOrNil(paid)
+	return &i, nil
+}
+
+// queryer is what loading a plan needs from either the pool or a
+// transaction.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// loadInstallments fills in p's installments and balance.
+func loadInstallments(ctx context.Context, q queryer, p *PaymentPlan, lock bool) error {
+	query := `SELECT ` + planInstallmentColumns + ` FROM payment_plan_installments WHERE plan_id = $1 ORDER BY seq`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+	rows, err := q.QueryContext(ctx, query, p.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	p.Installments, p.Balance = nil, 0
+	for rows.Next() {
+		i, err := scanPlanInstallment(rows)
+		if err != nil {
+			return err
+		}
+		if i.Status != installmentPaid && i.Status != installmentCanceled {
+			p.Balance += i.Amount
+		}
+		p.Installments = append(p.Installments, *i)
+	}
+	return rows.Err()
+}
+
+// CreatePaymentPlan records p and its installments. A retry with the same
+// idempotency key gets the plan the first attempt recorded.
+func (s *Store) CreatePaymentPlan(ctx context.Context, p *PaymentPlan, idempotencyKey string) (*PaymentPlan, error) {
+	key := sql.NullString{String: idempotencyKey, Valid: idempotencyKey != ""}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	created, err := scanPaymentPlan(tx.QueryRowContext(ctx, `
+		INSERT INTO payment_plans
+			(id, tenant_id, order_id, customer_id, payment_method, currency, total_amount, frequency, description, status, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (idempotency_key) DO NOTHING
+		RETURNING `+paymentPlanColumns,
+		p.ID, p.TenantID, p.OrderID, p.CustomerID, p.PaymentMethod, p.Currency, p.TotalAmount, p.Frequency,
+		p.Description, planActive, key))
+	if errors.Is(err, sql.ErrNoRows) && key.Valid {
+		tx.Rollback()
+		existing, err := scanPaymentPlan(s.db.QueryRowContext(ctx, `
+			SELECT `+paymentPlanColumns+` FROM payment_plans WHERE idempotency_key = $1`, key))
+		if err != nil {
+			return nil, err
+		}
+		return existing, loadInstallments(ctx, s.db, existing, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range p.Installments {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO payment_plan_installments (plan_id, seq, amount, due_at, status, next_attempt_at)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			created.ID, i.Seq, i.Amount, i.DueAt, i.Status, nullTimeOf(i.NextAttemptAt)); err != nil {
+			return nil, err
+		}
+	}
+	if err := loadInstallments(ctx, tx, created, false); err != nil {
+		return nil, err
+	}
+	return created, tx.Commit()
+}
+
+func (s *Store) PaymentPlan(ctx context.Context, id string) (*PaymentPlan, error) {
+	p, err := scanPaymentPlan(s.db.QueryRowContext(ctx, `SELECT `+paymentPlanColumns+` FROM payment_plans WHERE id = $1`, id))
+	if err != nil {
+		return nil, err
+	}
+	return p, loadInstallments(ctx, s.db, p, false)
+}
+
+// changePaymentPlan applies fn to a plan and its installments under their
+// row locks and saves the result. fn refuses a change by returning
+// errPlanState, in which case the plan is returned as it was.
+func (s *Store) changePaymentPlan(ctx context.Context, id string, fn func(p *PaymentPlan) error) (*PaymentPlan, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	p, err := scanPaymentPlan(tx.QueryRowContext(ctx, `SELECT `+paymentPlanColumns+` FROM payment_plans WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		return nil, err
+	}
+	if err := loadInstallments(ctx, tx, p, true); err != nil {
+		return nil, err
+	}
+	before := *p
+	before.Installments = append([]PlanInstallment(nil), p.Installments...)
+	if err := fn(p); err != nil {
+		return &before, err
+	}
+
+	payoffID := sql.NullString{String: p.PayoffID, Valid: p.PayoffID != ""}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE payment_plans SET
+			payment_method = $2, status = $3, resume_status = $4, missed_count = $5, payoff_attempts = $6,
+			payoff_id = $7, updated_at = now()
+		WHERE id = $1`,
+		p.ID, p.PaymentMethod, p.Status, p.resumeStatus, p.MissedCount, p.payoffAttempts, payoffID); err != nil {
+		return nil, err
+	}
+	for n, i := range p.Installments {
+		if i == before.Installments[n] {
+			continue
+		}
+		if err := s.saveInstallment(ctx, tx, &i); err != nil {
+			return nil, err
+		}
+	}
+	if err := loadInstallments(ctx, tx, p, false); err != nil {
+		return nil, err
+	}
+	p.UpdatedAt = time.Now().UTC()
+	return p, tx.Commit()
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *Store) saveInstallment(ctx context.Context, e execer, i *PlanInstallment) error {
+	paymentID := sql.NullString{String: i.PaymentID, Valid: i.PaymentID != ""}
+	_, err := e.ExecContext(ctx, `
+		UPDATE payment_plan_installments SET
+			status = $3, attempts = $4, declines = $5, payment_id = $6, decline_code = $7, next_attempt_at = $8,
+			paid_at = $9, updated_at = now()
+		WHERE plan_id = $1 AND seq = $2`,
+		i.PlanID, i.Seq, i.Status, i.Attempts, i.Declines, paymentID, i.DeclineCode, nullTimeOf(i.NextAttemptAt), nullTimeOf(i.PaidAt))
+	return err
+}
+
+// ClaimDueInstallment marks the next installment due on an active plan as
+// charging and returns it, or sql.ErrNoRows. next_attempt_at becomes the
+// claim's lease, so a charge abandoned mid-call becomes due again. skip
+// lists plans that already failed in this sweep.
+func (s *Store) ClaimDueInstallment(ctx context.Context, skip []string) (*PlanInstallment, error) {
+	if skip == nil {
+		skip = []string{}
+	}
+	return scanPlanInstallment(s.db.QueryRowContext(ctx, `
+		UPDATE payment_plan_installments SET status = 'charging', next_attempt_at = $2, updated_at = now()
+		WHERE (plan_id, seq) = (
+			SELECT i.plan_id, i.seq FROM payment_plan_installments i
+			JOIN payment_plans p ON p.id = i.plan_id
+			WHERE p.status = 'active' AND i.plan_id <> ALL($1)
+				AND i.status IN ('scheduled', 'charging') AND i.next_attempt_at <= now()
+			ORDER BY i.next_attempt_at
+			LIMIT 1
+			FOR UPDATE OF i SKIP LOCKED)
+		RETURNING `+planInstallmentColumns,
+		skip, time.Now().Add(paymentPlanLease).UTC()))
+}
+
+// PaymentPlans runs installment plans: creation with a schedule preview,
+// a worker that charges installments as they fall due, retries and
+// defaults for declined ones, and early payoff of the balance. Charges go
+// through PaymentService like any other payment, off-session on the
+// plan's saved payment method.
+type PaymentPlans struct {
+	store    *Store
+	settings *RuntimeSettings
+	payments *PaymentService
+	interval time.Duration
+}
+
+func NewPaymentPlans(store *Store, settings *RuntimeSettings, payments *PaymentService, interval time.Duration) *PaymentPlans {
+	return &PaymentPlans{store: store, settings: settings, payments: payments, interval: interval}
+}
+
+func (pp *PaymentPlans) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/payment-plans", requireScope(pp.store, bootstrapToken, "payment_plans"))
+	g.POST("/preview", pp.preview)
+	g.POST("", pp.requireStore, pp.create)
+	g.GET("/:id", pp.requireStore, pp.get)
+	g.PUT("/:id/payment-method", pp.requireStore, pp.setPaymentMethod)
+	g.POST("/:id/payoff", pp.requireStore, pp.payoff)
+	g.POST("/:id/cancel", pp.requireStore, pp.cancel)
+}
+
+func (pp *PaymentPlans) requireStore(c *gin.Context) {
+	if pp.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Payment plans require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// respondChange answers a failed plan change, returning false, or returns
+// true when err is nil.
+func (pp *PaymentPlans) respondChange(c *gin.Context, p *PaymentPlan, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Payment plan not found"))
+	case errors.Is(err, errPlanState):
+		c.JSON(http.StatusConflict, errorBodyWith(c, CodePaymentPlanState, "Payment plan is "+p.Status,
+			gin.H{"status": p.Status}))
+	default:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+	}
+	return false
+}
+
+// PaymentPlanTerms are what a plan's schedule is built from. StartAt is
+// when the first installment is due; it defaults to now, for a first
+// installment charged by the worker's next sweep.
+type PaymentPlanTerms struct {
+	TotalAmount  int64      `json:"total_amount" binding:"required,gt=0"`
+	Currency     string     `json:"currency" binding:"required,len=3"`
+	Installments int        `json:"installments" binding:"required,gte=2"`
+	Frequency    string     `json:"frequency" binding:"required,oneof=weekly biweekly monthly"`
+	StartAt      *time.Time `json:"start_at"`
+}
+
+// schedule checks t against the configured limits and builds its
+// installments, or answers the request and returns nil.
+func (pp *PaymentPlans) schedule(c *gin.Context, t PaymentPlanTerms) []PlanInstallment {
+	var fields []FieldError
+	if max := pp.settings.Get().PaymentPlans.maxInstallments(); t.Installments > max {
+		fields = append(fields, FieldError{Field: "installments", Code: "too_large", Message: fmt.Sprintf("must be at most %d", max)})
+	}
+	if int64(t.Installments) > t.TotalAmount {
+		fields = append(fields, FieldError{Field: "total_amount", Code: "too_small", Message: "must be at least one minor unit per installment"})
+	}
+	if len(fields) > 0 {
+		validationFailed(c, fields)
+		return nil
+	}
+	start := time.Now().UTC()
+	if t.StartAt != nil && t.StartAt.After(start) {
+		start = t.StartAt.UTC()
+	}
+	return planSchedule(t.TotalAmount, t.Installments, t.Frequency, start)
+}
+
+// preview returns the schedule a plan with these terms would have.
+func (pp *PaymentPlans) preview(c *gin.Context) {
+	var req PaymentPlanTerms
+	if !bindJSON(c, &req) {
+		return
+	}
+	installments := pp.schedule(c, req)
+	if installments == nil {
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{
+		"total_amount": req.TotalAmount,
+		"currency":     strings.ToLower(req.Currency),
+		"frequency":    req.Frequency,
+		"installments": installments,
+	})
+}
+
+// create records a plan. Its largest installment is priced as a payment
+// first, so a plan whose charges the tenant's limits would refuse is
+// refused up front.
+func (pp *PaymentPlans) create(c *gin.Context) {
+	var req struct {
+		PaymentPlanTerms
+		CustomerID    string `json:"customer_id" binding:"required"`
+		PaymentMethod string `json:"payment_method" binding:"required,startswith=pm_|startswith=vpm_"`
+		TenantID      string `json:"tenant_id"`
+		OrderID       string `json:"order_id"`
+		Description   string `json:"description"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	installments := pp.schedule(c, req.PaymentPlanTerms)
+	if installments == nil {
+		return
+	}
+	ctx := c.Request.Context()
+	if _, err := paymentMethodToken(ctx, pp.store, req.PaymentMethod, req.CustomerID); err != nil {
+		var refused *refusal
+		if errors.As(err, &refused) {
+			validationFailed(c, []FieldError{{Field: "payment_method", Code: "invalid", Message: "must be a vaulted payment method of the customer that Stripe can charge"}})
+		} else {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		}
+		return
+	}
+	_, refused := pp.payments.Params(ctx, PaymentRequest{
+		Amount:        installments[0].Amount,
+		Currency:      req.Currency,
+		CustomerID:    req.CustomerID,
+		TenantID:      req.TenantID,
+		skipDiscounts: true,
+	})
+	if refused != nil {
+		c.JSON(refused.status, errorBodyWith(c, refused.code, refused.message, refused.ext))
+		return
+	}
+
+	want := &PaymentPlan{
+		ID:            uuid.NewString(),
+		TenantID:      req.TenantID,
+		OrderID:       req.OrderID,
+		CustomerID:    req.CustomerID,
+		PaymentMethod: req.PaymentMethod,
+		Currency:      strings.ToLower(req.Currency),
+		TotalAmount:   req.TotalAmount,
+		Frequency:     req.Frequency,
+		Description:   req.Description,
+		Installments:  installments,
+	}
+	plan, err := pp.store.CreatePaymentPlan(ctx, want, c.GetHeader("Idempotency-Key"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if plan.TotalAmount != want.TotalAmount || plan.Currency != want.Currency || plan.CustomerID != want.CustomerID ||
+		len(plan.Installments) != len(want.Installments) {
+		c.JSON(http.StatusConflict, errorBody(c, CodeIdempotencyConflict, "Idempotency-Key was already used for a different payment plan"))
+		return
+	}
+	if plan.ID == want.ID {
+		paymentPlansCreated.Inc()
+	}
+	respondData(c, http.StatusCreated, plan)
+}
+
+func (pp *PaymentPlans) get(c *gin.Context) {
+	plan, err := pp.store.PaymentPlan(c.Request.Context(), c.Param("id"))
+	if !pp.respondChange(c, plan, err) {
+		return
+	}
+	respondData(c, http.StatusOK, plan)
+}
+
+// setPaymentMethod replaces the plan's payment method. Installments
+// declined on the old one are due again at once with their retries
+// reset, and a defaulted plan becomes active with its missed installments
+// rescheduled.
+func (pp *PaymentPlans) setPaymentMethod(c *gin.Context) {
+	var req struct {
+		PaymentMethod string `json:"payment_method" binding:"required,startswith=pm_|startswith=vpm_"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	plan, err := pp.store.changePaymentPlan(c.Request.Context(), c.Param("id"), func(p *PaymentPlan) error {
+		if p.Status != planActive && p.Status != planDefaulted {
+			return errPlanState
+		}
+		now := time.Now().UTC()
+		p.PaymentMethod = req.PaymentMethod
+		p.Status, p.MissedCount = planActive, 0
+		for n := range p.Installments {
+			i := &p.Installments[n]
+			switch {
+			case i.Status == installmentMissed || i.Status == installmentScheduled && i.Declines > 0:
+				i.Status, i.Declines, i.NextAttemptAt = installmentScheduled, 0, &now
+			case i.Status == installmentScheduled && i.NextAttemptAt != nil && i.NextAttemptAt.Before(now):
+				i.NextAttemptAt = &now
+			}
+		}
+		return nil
+	})
+	if !pp.respondChange(c, plan, err) {
+		return
+	}
+	respondData(c, http.StatusOK, plan)
+}
+
+// cancel stops a plan. Installments already paid are not refunded; one
+// being charged must finish first.
+func (pp *PaymentPlans) cancel(c *gin.Context) {
+	plan, err := pp.store.changePaymentPlan(c.Request.Context(), c.Param("id"), func(p *PaymentPlan) error {
+		if p.Status != planActive && p.Status != planDefaulted {
+			return errPlanState
+		}
+		for n := range p.Installments {
+			i := &p.Installments[n]
+			switch {
+			case i.Status == installmentCharging || i.Status == installmentProcessing:
+				return errPlanState
+			case i.outstanding():
+				i.Status, i.NextAttemptAt = installmentCanceled, nil
+			}
+		}
+		p.Status = planCanceled
+		return nil
+	})
+	if !pp.respondChange(c, plan, err) {
+		return
+	}
+	paymentPlanResults.WithLabelValues("canceled").Inc()
+	respondData(c, http.StatusOK, plan)
+}
+
+// payoff charges the plan's whole balance now, on its payment method or
+// the one in the request. The plan is marked paying_off first, which
+// stops the worker from claiming its installments; a payoff interrupted
+// by a crash is resumed by calling payoff again, with the same Stripe
+// idempotency key so the balance can't be charged twice.
+func (pp *PaymentPlans) payoff(c *gin.Context) {
+	var req struct {
+		PaymentMethod string `json:"payment_method" binding:"omitempty,startswith=pm_|startswith=vpm_"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+	ctx := c.Request.Context()
+	plan, err := pp.store.changePaymentPlan(ctx, c.Param("id"), func(p *PaymentPlan) error {
+		stale := p.Status == planPayingOff && time.Since(p.UpdatedAt) > paymentPlanLease
+		if p.Status != planActive && p.Status != planDefaulted && !stale {
+			return errPlanState
+		}
+		owed := false
+		for _, i := range p.Installments {
+			if i.Status == installmentCharging || i.Status == installmentProcessing {
+				return errPlanState
+			}
+			owed = owed || i.outstanding()
+		}
+		if !owed {
+			return errPlanState
+		}
+		// A resumed payoff must repeat the interrupted request exactly.
+		if !stale {
+			p.resumeStatus = p.Status
+			p.payoffAttempts++
+			if req.PaymentMethod != "" {
+				p.PaymentMethod = req.PaymentMethod
+			}
+		}
+		p.Status = planPayingOff
+		return nil
+	})
+	if !pp.respondChange(c, plan, err) {
+		return
+	}
+
+	pi, err := pp.charge(ctx, plan, plan.Balance, "payoff", fmt.Sprintf("payment-plan-%s-payoff-%d", plan.ID, plan.payoffAttempts))
+	ctx = context.WithoutCancel(ctx)
+	var stripeErr *stripe.Error
+	var refused *refusal
+	switch {
+	case err == nil && pi.Status == stripe.PaymentIntentStatusProcessing:
+		// The payment_intent.succeeded webhook finishes the payoff.
+		plan, err = pp.store.changePaymentPlan(ctx, plan.ID, func(p *PaymentPlan) error {
+			p.PayoffID = pi.ID
+			return nil
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+		respondData(c, http.StatusAccepted, plan)
+		return
+	case err == nil:
+		if plan, err = pp.finishPayoff(ctx, plan.ID, pi); err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+		respondData(c, http.StatusOK, plan)
+		return
+	case errors.As(err, &refused):
+	case errors.As(err, &stripeErr) && (stripeErr.Type == stripe.ErrorTypeCard || stripeErr.Type == stripe.ErrorTypeInvalidRequest):
+	default:
+		// Unknown outcome: the plan stays paying_off until payoff is
+		// called again.
+		respondError(c, err)
+		return
+	}
+
+	// Declined or refused: the plan carries on as it was.
+	if _, rerr := pp.store.changePaymentPlan(ctx, plan.ID, func(p *PaymentPlan) error {
+		if p.Status != planPayingOff {
+			return errPlanState
+		}
+		p.Status = p.resumeStatus
+		return nil
+	}); rerr != nil && !errors.Is(rerr, errPlanState) {
+		logf(ctx, "resuming payment plan %s: %v", plan.ID, rerr)
+	}
+	if refused != nil {
+		c.JSON(refused.status, errorBodyWith(c, refused.code, refused.message, refused.ext))
+		return
+	}
+	respondError(c, err)
+}
+
+// finishPayoff marks the balance paid by pi and completes the plan.
+func (pp *PaymentPlans) finishPayoff(ctx context.Context, id string, pi *stripe.PaymentIntent) (*PaymentPlan, error) {
+	plan, err := pp.store.changePaymentPlan(ctx, id, func(p *PaymentPlan) error {
+		if p.Status != planPayingOff {
+			return errPlanState
+		}
+		now := time.Now().UTC()
+		for n := range p.Installments {
+			if i := &p.Installments[n]; i.outstanding() {
+				i.Status, i.PaymentID, i.PaidAt, i.NextAttemptAt = installmentPaid, pi.ID, &now, nil
+			}
+		}
+		p.Status, p.PayoffID = planCompleted, pi.ID
+		return nil
+	})
+	if errors.Is(err, errPlanState) {
+		return plan, nil
+	}
+	if err == nil {
+		paymentPlanResults.WithLabelValues("paid_off").Inc()
+	}
+	return plan, err
+}
+
+// charge creates and confirms an off-session payment of amount for plan.
+// A declined payment comes back as the card error, with the intent it
+// left behind in the error's PaymentIntent.
+func (pp *PaymentPlans) charge(ctx context.Context, plan *PaymentPlan, amount int64, installment, idempotencyKey string) (*stripe.PaymentIntent, error) {
+	req := PaymentRequest{
+		Amount:      amount,
+		Currency:    plan.Currency,
+		Description: plan.Description,
+		OrderID:     plan.OrderID,
+		CustomerID:  plan.CustomerID,
+		TenantID:    plan.TenantID,
+		Metadata: map[string]string{
+			planMetadataID:          plan.ID,
+			planMetadataInstallment: installment,
+		},
+		skipDiscounts: true,
+	}
+	params, refused := pp.payments.Params(ctx, req)
+	if refused != nil {
+		return nil, refused
+	}
+	pm, err := paymentMethodToken(ctx, pp.store, plan.PaymentMethod, plan.CustomerID)
+	if err != nil {
+		return nil, err
+	}
+	params.AutomaticPaymentMethods = nil
+	params.PaymentMethodTypes = nil
+	params.PaymentMethod = stripe.String(pm)
+	params.Confirm = stripe.Bool(true)
+	params.OffSession = stripe.Bool(true)
+	return pp.payments.Create(ctx, req, params, idempotencyKey)
+}
+
+// paymentIntentEvent settles installments and payoffs whose payment
+// method finished processing after the charge returned.
+func (pp *PaymentPlans) paymentIntentEvent(ctx context.Context, typ stripe.EventType, pi *stripe.PaymentIntent) error {
+	planID := pi.Metadata[planMetadataID]
+	if pp == nil || pp.store == nil || planID == "" {
+		return nil
+	}
+	if typ != "payment_intent.succeeded" && typ != "payment_intent.payment_failed" {
+		return nil
+	}
+	if pi.Metadata[planMetadataInstallment] == "payoff" {
+		if typ == "payment_intent.succeeded" {
+			_, err := pp.finishPayoff(ctx, planID, pi)
+			return err
+		}
+		_, err := pp.store.changePaymentPlan(ctx, planID, func(p *PaymentPlan) error {
+			if p.Status != planPayingOff || p.PayoffID != pi.ID {
+				return errPlanState
+			}
+			p.Status, p.PayoffID = p.resumeStatus, ""
+			return nil
+		})
+		if errors.Is(err, errPlanState) {
+			return nil
+		}
+		return err
+	}
+
+	seq, err := strconv.Atoi(pi.Metadata[planMetadataInstallment])
+	if err != nil {
+		return nil
+	}
+	_, err = pp.store.changePaymentPlan(ctx, planID, func(p *PaymentPlan) error {
+		for n := range p.Installments {
+			i := &p.Installments[n]
+			if i.Seq != seq || i.Status != installmentProcessing || i.PaymentID != pi.ID {
+				continue
+			}
+			if typ == "payment_intent.succeeded" {
+				pp.paid(p, i)
+			} else {
+				pp.declined(p, i, declineOf(pi.LastPaymentError))
+			}
+			return nil
+		}
+		return errPlanState
+	})
+	if errors.Is(err, errPlanState) || errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+// paid marks i paid and completes p once nothing is left to pay.
+func (pp *PaymentPlans) paid(p *PaymentPlan, i *PlanInstallment) {
+	now := time.Now().UTC()
+	i.Status, i.NextAttemptAt, i.PaidAt, i.DeclineCode = installmentPaid, nil, &now, ""
+	paymentPlanCharges.WithLabelValues("paid").Inc()
+	for _, other := range p.Installments {
+		if other.Status != installmentPaid {
+			return
+		}
+	}
+	if p.Status == planActive {
+		p.Status = planCompleted
+		paymentPlanResults.WithLabelValues("completed").Inc()
+	}
+}
+
+// declined schedules i's next retry, or marks it missed once the retries
+// run out; enough missed installments default the plan.
+func (pp *PaymentPlans) declined(p *PaymentPlan, i *PlanInstallment, decline string) {
+	cfg := pp.settings.Get().PaymentPlans
+	i.DeclineCode = decline
+	i.Declines++
+	if hours := cfg.retryHours(); i.Declines <= len(hours) {
+		next := time.Now().Add(time.Duration(hours[i.Declines-1]) * time.Hour).UTC()
+		i.Status, i.NextAttemptAt = installmentScheduled, &next
+		paymentPlanCharges.WithLabelValues("declined").Inc()
+		return
+	}
+	i.Status, i.NextAttemptAt = installmentMissed, nil
+	paymentPlanCharges.WithLabelValues("missed").Inc()
+	if p.MissedCount++; p.Status == planActive && p.MissedCount >= cfg.maxMissed() {
+		p.Status = planDefaulted
+		paymentPlanResults.WithLabelValues("defaulted").Inc()
+	}
+}
+
+// Run charges the installments that are due every interval until ctx is
+// done.
+func (pp *PaymentPlans) Run(ctx context.Context) {
+	if pp == nil || pp.store == nil {
+		return
+	}
+	ticker := time.NewTicker(pp.interval)
+	defer ticker.Stop()
+	for {
+		if err := pp.chargeDue(ctx); err != nil {
+			log.Printf("payment plans: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (pp *PaymentPlans) chargeDue(ctx context.Context) error {
+	var failed []string
+	for {
+		i, err := pp.store.ClaimDueInstallment(ctx, failed)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := pp.chargeInstallment(ctx, i); err != nil {
+			log.Printf("charging installment %d of plan %s: %v", i.Seq, i.PlanID, err)
+			failed = append(failed, i.PlanID)
+		}
+	}
+}
+
+// chargeInstallment charges a claimed installment. The first attempt
+// creates its PaymentIntent and later ones confirm the same intent again,
+// so an installment has one payment however often it is declined. The
+// idempotency key names the attempt, counted over the installment's life
+// rather than since its last payment method change, so one repeated
+// after a crash doesn't charge twice. Errors other than declines and refusals leave the
+// claim to expire and be retried.
+func (pp *PaymentPlans) chargeInstallment(ctx context.Context, claimed *PlanInstallment) error {
+	plan, err := pp.store.PaymentPlan(ctx, claimed.PlanID)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("payment-plan-%s-%d-%d", plan.ID, claimed.Seq, claimed.Attempts+1)
+	var pi *stripe.PaymentIntent
+	if claimed.PaymentID == "" {
+		pi, err = pp.charge(ctx, plan, claimed.Amount, strconv.Itoa(claimed.Seq), key)
+	} else if pm, tokenErr := paymentMethodToken(ctx, pp.store, plan.PaymentMethod, plan.CustomerID); tokenErr != nil {
+		err = tokenErr
+	} else {
+		params := &stripe.PaymentIntentConfirmParams{
+			PaymentMethod: stripe.String(pm),
+			OffSession:    stripe.Bool(true),
+		}
+		params.Context = ctx
+		params.SetIdempotencyKey(key)
+		pi, err = paymentintent.Confirm(claimed.PaymentID, params)
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	var stripeErr *stripe.Error
+	var refused *refusal
+	var decline string
+	switch {
+	case err == nil:
+	case errors.As(err, &stripeErr) && (stripeErr.Type == stripe.ErrorTypeCard || stripeErr.Type == stripe.ErrorTypeInvalidRequest):
+		decline = declineOf(stripeErr)
+		if stripeErr.PaymentIntent != nil {
+			pi = stripeErr.PaymentIntent
+		}
+	case errors.As(err, &refused):
+		decline = string(refused.code)
+	default:
+		paymentPlanCharges.WithLabelValues("error").Inc()
+		return err
+	}
+
+	_, err = pp.store.changePaymentPlan(ctx, plan.ID, func(p *PaymentPlan) error {
+		for n := range p.Installments {
+			i := &p.Installments[n]
+			if i.Seq != claimed.Seq {
+				continue
+			}
+			if i.Status != installmentCharging {
+				return errPlanState
+			}
+			i.Attempts++
+			if pi != nil {
+				i.PaymentID = pi.ID
+			}
+			switch {
+			case decline != "":
+				pp.declined(p, i, decline)
+			case pi.Status == stripe.PaymentIntentStatusSucceeded:
+				pp.paid(p, i)
+			case pi.Status == stripe.PaymentIntentStatusProcessing:
+				i.Status, i.NextAttemptAt = installmentProcessing, nil
+				paymentPlanCharges.WithLabelValues("processing").Inc()
+			default:
+				// Off-session, anything else means the customer has to
+				// step in, such as to authenticate.
+				pp.declined(p, i, string(pi.Status))
+			}
+			return nil
+		}
+		return errPlanState
+	})
+	if errors.Is(err, errPlanState) {
+		return nil
+	}
+	return err
+}
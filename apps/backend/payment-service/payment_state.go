@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+)
+
+var paymentTransitionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_payment_transitions_total",
+	Help: "Payment state transitions, by from and to state and outcome (applied, rejected).",
+}, []string{"from", "to", "outcome"})
+
+// Payment states. Unlike the provider's statuses, which each consumer
+// read its own way, a payment's state only moves along paymentTransitions.
+const (
+	stateCreated           = "created"
+	stateRequiresAction    = "requires_action"
+	stateProcessing        = "processing"
+	stateSucceeded         = "succeeded"
+	stateFailed            = "failed"
+	stateCanceled          = "canceled"
+	statePartiallyRefunded = "partially_refunded"
+	stateRefunded          = "refunded"
+	stateDisputed          = "disputed"
+)
+
+// paymentTransitions are the lifecycle's steps. A payment may skip states
+// it went through between two saves, so any state reachable from the
+// current one is allowed; going back is not, bar a retry after a decline
+// and a dispute closing in the merchant's favor. The steps out of
+// disputed are only taken from a disputed payment.
+var paymentTransitions = map[string][]string{
+	stateCreated:           {stateRequiresAction, stateProcessing, stateSucceeded, stateFailed, stateCanceled},
+	stateRequiresAction:    {stateProcessing, stateSucceeded, stateFailed, stateCanceled},
+	stateProcessing:        {stateSucceeded, stateFailed, stateCanceled},
+	stateFailed:            {stateCreated, stateRequiresAction, stateProcessing, stateSucceeded, stateCanceled},
+	stateSucceeded:         {statePartiallyRefunded, stateRefunded, stateDisputed},
+	statePartiallyRefunded: {stateRefunded, stateDisputed},
+	stateRefunded:          {stateDisputed},
+	stateDisputed:          {stateSucceeded, statePartiallyRefunded, stateRefunded},
+}
+
+// canTransition reports whether a payment in from may move to to.
+func canTransition(from, to string) bool {
+	seen := map[string]bool{from: true}
+	next := []string{from}
+	for len(next) > 0 {
+		state := next[0]
+		next = next[1:]
+		for _, s := range paymentTransitions[state] {
+			if s == to {
+				return true
+			}
+			if !seen[s] && s != stateDisputed {
+				seen[s] = true
+				next = append(next, s)
+			}
+		}
+	}
+	return false
+}
+
+// lifecycleState is the state a payment's stored row describes: its
+// provider status, whether the last attempt was declined, what was
+// received and refunded, and whether a dispute is open or lost.
+func lifecycleState(status string, failed bool, received, refunded int64, disputed bool) string {
+	switch status {
+	case string(stripe.PaymentIntentStatusRequiresPaymentMethod):
+		if failed {
+			return stateFailed
+		}
+		return stateCreated
+	case string(stripe.PaymentIntentStatusRequiresConfirmation):
+		return stateCreated
+	case string(stripe.PaymentIntentStatusRequiresAction):
+		return stateRequiresAction
+	case string(stripe.PaymentIntentStatusProcessing), string(stripe.PaymentIntentStatusRequiresCapture), paymentStatusPendingReview:
+		return stateProcessing
+	case string(stripe.PaymentIntentStatusCanceled), paymentStatusAbandoned:
+		return stateCanceled
+	case string(stripe.PaymentIntentStatusSucceeded):
+	default:
+		return ""
+	}
+	switch {
+	case disputed:
+		return stateDisputed
+	case refunded > 0 && refunded >= received:
+		return stateRefunded
+	case refunded > 0:
+		return statePartiallyRefunded
+	}
+	return stateSucceeded
+}
+
+// advancePaymentState moves a stored payment to the state its row now
+// describes, within tx, and records the transition. source names what
+// changed the row (payment_intent, charge or dispute); failed is whether
+// the provider reported the last attempt as declined. A transition the
+// lifecycle does not allow, such as a late webhook taking a succeeded
+// payment back to processing, leaves the state as it was.
+func advancePaymentState(ctx context.Context, tx *sql.Tx, paymentID, source string, failed bool) error {
+	var from, status string
+	var received, refunded int64
+	var disputed bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT state, status, amount_received, amount_refunded, EXISTS (
+			SELECT 1 FROM disputes d WHERE d.payment_id = p.id AND d.status NOT IN ('won', 'warning_closed'))
+		FROM payments p WHERE id = $1 FOR UPDATE`, paymentID).Scan(&from, &status, &received, &refunded, &disputed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// A payment stored for the first time starts its history as created.
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_state_transitions (payment_id, to_state, provider_status, source)
+		SELECT $1, $2, $3, $4
+		WHERE NOT EXISTS (SELECT 1 FROM payment_state_transitions WHERE payment_id = $1)`,
+		paymentID, stateCreated, status, source); err != nil {
+		return err
+	}
+
+	to := lifecycleState(status, failed, received, refunded, disputed)
+	if to == "" || to == from {
+		return nil
+	}
+	if !canTransition(from, to) {
+		paymentTransitionsTotal.WithLabelValues(from, to, "rejected").Inc()
+		logf(ctx, "payment state: %s stays %s, %s (%s from %s) is not a valid transition", paymentID, from, to, status, source)
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE payments SET state = $2 WHERE id = $1`, paymentID, to); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_state_transitions (payment_id, from_state, to_state, provider_status, source)
+		VALUES ($1, $2, $3, $4, $5)`, paymentID, from, to, status, source); err != nil {
+		return err
+	}
+	paymentTransitionsTotal.WithLabelValues(from, to, "applied").Inc()
+	return nil
+}
+
+// PaymentTransition is one step of a payment's lifecycle. From is empty
+// for the first.
+type PaymentTransition struct {
+	From           string    `json:"from,omitempty"`
+	To             string    `json:"to"`
+	ProviderStatus string    `json:"provider_status,omitempty"`
+	Source         string    `json:"source"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// PaymentLifecycle is a payment's current state and how it got there.
+type PaymentLifecycle struct {
+	PaymentID   string              `json:"payment_id"`
+	State       string              `json:"state"`
+	Status      string              `json:"status"`
+	Transitions []PaymentTransition `json:"transitions"`
+}
+
+// PaymentLifecycle returns a stored payment's transitions, oldest first, or
+// sql.ErrNoRows.
+func (s *Store) PaymentLifecycle(ctx context.Context, paymentID string) (*PaymentLifecycle, error) {
+	h := &PaymentLifecycle{PaymentID: paymentID, Transitions: []PaymentTransition{}}
+	db := s.reader()
+	if err := db.QueryRowContext(ctx, `SELECT state, status FROM payments WHERE id = $1`, paymentID).
+		Scan(&h.State, &h.Status); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT from_state, to_state, provider_status, source, created_at
+		FROM payment_state_transitions WHERE payment_id = $1 ORDER BY id`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t PaymentTransition
+		if err := rows.Scan(&t.From, &t.To, &t.ProviderStatus, &t.Source, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		h.Transitions = append(h.Transitions, t)
+	}
+	return h, rows.Err()
+}
+
+// PaymentStates serves payments' lifecycle history.
+type PaymentStates struct {
+	store *Store
+}
+
+func NewPaymentStates(store *Store) *PaymentStates {
+	return &PaymentStates{store: store}
+}
+
+func (ps *PaymentStates) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	r.GET("/payment/:id/history", requireScope(ps.store, bootstrapToken, readPaymentsScope), ps.history)
+}
+
+func (ps *PaymentStates) history(c *gin.Context) {
+	h, err := ps.store.PaymentLifecycle(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Payment not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, h)
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"github.com/stripe/stripe-go/v76/paymentmethod"
+)
+
+// PaymentService creates payment intents for the single and batch create
+// endpoints, so both apply the same limits, flags and bookkeeping.
+type PaymentService struct {
+	settings  *RuntimeSettings
+	flags     *Flags
+	policies  *PolicyEngine
+	discounts *DiscountEngine
+	loyalty   *Loyalty
+	store     *Store
+	analytics *AnalyticsEmitter
+	// payments is where created payments are recorded: store, or the
+	// repository STORAGE_BACKEND picked.
+	payments PaymentRepository
+	// residency, fraudLists, velocity, risk, duplicates, reviews and
+	// routing may be nil.
+	residency  *Residency
+	fraudLists *FraudLists
+	velocity   *Velocity
+	risk       *RiskEngine
+	reviews    *PaymentReviews
+	duplicates *DuplicatePayments
+	routing    *ProviderRouting
+}
+
+func NewPaymentService(settings *RuntimeSettings, flags *Flags, policies *PolicyEngine, discounts *DiscountEngine, loyalty *Loyalty, store *Store, analytics *AnalyticsEmitter) *PaymentService {
+	return &PaymentService{settings: settings, flags: flags, policies: policies, discounts: discounts, loyalty: loyalty, store: store, analytics: analytics}
+}
+
+// validate reports the same errors the binding tags amount
+// "required,gt=0", currency "required,len=3", receipt_email
+// "omitempty,email", tip "gte=0", capture_method
+// "omitempty,oneof=automatic manual" and redeem_points "gte=0" would, in
+// field order.
+func (r *PaymentRequest) validate() []FieldError {
+	var fields []FieldError
+	switch {
+	case r.Amount == 0:
+		fields = append(fields, FieldError{Field: "amount", Code: "required", Message: "is required"})
+	case r.Amount < 0:
+		fields = append(fields, FieldError{Field: "amount", Code: "too_small", Message: "must be greater than 0"})
+	}
+	switch {
+	case r.Currency == "":
+		fields = append(fields, FieldError{Field: "currency", Code: "required", Message: "is required"})
+	case utf8.RuneCountInString(r.Currency) != 3:
+		fields = append(fields, FieldError{Field: "currency", Code: "invalid_length", Message: "must have exactly 3 characters"})
+	}
+	if r.ReceiptEmail != "" && !validEmail(r.ReceiptEmail) {
+		fields = append(fields, FieldError{Field: "receipt_email", Code: "invalid_email", Message: "must be a valid email address"})
+	}
+	fields = append(fields, validateMetadata(r.Metadata)...)
+	if r.Tip < 0 {
+		fields = append(fields, FieldError{Field: "tip", Code: "too_small", Message: "must be at least 0"})
+	}
+	switch stripe.PaymentIntentCaptureMethod(r.CaptureMethod) {
+	case "", stripe.PaymentIntentCaptureMethodAutomatic, stripe.PaymentIntentCaptureMethodManual:
+	default:
+		fields = append(fields, FieldError{Field: "capture_method", Code: "invalid_choice", Message: "must be one of: automatic, manual"})
+	}
+	if r.Multicapture && r.CaptureMethod != string(stripe.PaymentIntentCaptureMethodManual) {
+		fields = append(fields, FieldError{Field: "multicapture", Code: "invalid", Message: "requires capture_method manual"})
+	}
+	switch {
+	case r.RedeemPoints < 0:
+		fields = append(fields, FieldError{Field: "redeem_points", Code: "too_small", Message: "must be at least 0"})
+	case r.RedeemPoints > 0 && r.CustomerID == "":
+		fields = append(fields, FieldError{Field: "redeem_points", Code: "invalid", Message: "requires customer_id"})
+	}
+	switch {
+	case r.PaymentMethod == "":
+	case !strings.HasPrefix(r.PaymentMethod, "pm_") && !strings.HasPrefix(r.PaymentMethod, vaultIDPrefix):
+		fields = append(fields, FieldError{Field: "payment_method", Code: "invalid", Message: "must be a pm_ or " + vaultIDPrefix + " payment method"})
+	case strings.HasPrefix(r.PaymentMethod, vaultIDPrefix) && r.CustomerID == "":
+		fields = append(fields, FieldError{Field: "payment_method", Code: "invalid", Message: "requires customer_id"})
+	}
+	if r.ClientIP != "" {
+		if _, err := netip.ParseAddr(r.ClientIP); err != nil {
+			fields = append(fields, FieldError{Field: "client_ip", Code: "invalid", Message: "must be an IP address"})
+		}
+	}
+	fields = append(fields, r.validateDevice()...)
+	if r.Region != "" && !regionPattern.MatchString(strings.ToLower(r.Region)) {
+		fields = append(fields, FieldError{Field: "region", Code: "invalid", Message: "must be a region name such as eu"})
+	}
+	if r.CustomerCountry != "" && utf8.RuneCountInString(r.CustomerCountry) != 2 {
+		fields = append(fields, FieldError{Field: "customer_country", Code: "invalid_length", Message: "must have exactly 2 characters"})
+	}
+	// A tip changed later would be in the wrong currency.
+	if r.FXQuoteID != "" && (r.Tip > 0 || r.CaptureMethod == string(stripe.PaymentIntentCaptureMethodManual)) {
+		fields = append(fields, FieldError{Field: "fx_quote_id", Code: "invalid", Message: "can't be combined with a tip or manual capture"})
+	}
+	return fields
+}
+
+// reservedMetadata are the metadata keys the service sets on its intents
+// and trusts when it reads them back, from webhooks and the like; a
+// caller's metadata may not carry them.
+var reservedMetadata = map[string]bool{
+	"order_id": true, "tenant_id": true, "receipt_email": true, "request_id": true, "payment_id": true,
+	"shadow": true, "shadow_of": true,
+	metadataClientIP: true, metadataUserAgent: true, metadataDeviceID: true,
+	metadataSubtotal: true, metadataDiscount: true, metadataDiscounts: true,
+	metadataTip: true, metadataPreTip: true,
+	metadataSurcharge: true, metadataSurchargeRate: true,
+	metadataTaxTreatment: true, metadataCustomerTaxID: true,
+	metadataQuote: true, metadataRegion: true, metadataDuplicateOf: true,
+	metadataProviderArm: true, metadataRoutingDecision: true,
+	metadataRiskRule: true, metadataRiskAction: true,
+	metadataAuthHold: true, metadataReauthorizes: true,
+	metadataSplitCaptureOf: true, metadataShipmentID: true,
+	escrowMetadataID: true, checkoutMetadataID: true,
+}
+
+// reservedMetadataPrefixes reserve whole families of service keys,
+// including those added later.
+var reservedMetadataPrefixes = []string{
+	"wallet_", "gift_card_", "loyalty_", "review_", "fx_", "billing_", "payment_plan", "escrow_", "checkout_",
+}
+
+func reservedMetadataKey(k string) bool {
+	if reservedMetadata[k] {
+		return true
+	}
+	for _, prefix := range reservedMetadataPrefixes {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateMetadata refuses a caller's metadata keys the service owns, in
+// key order.
+func validateMetadata(metadata map[string]string) []FieldError {
+	var keys []string
+	for k := range metadata {
+		if reservedMetadataKey(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var fields []FieldError
+	for _, k := range keys {
+		fields = append(fields, FieldError{Field: "metadata." + k, Code: "reserved", Message: "is set by the service"})
+	}
+	return fields
+}
+
+// refusal is a payment turned down before reaching Stripe. It is an
+// error for callers that report failures rather than write responses.
+type refusal struct {
+	status  int
+	code    ErrorCode
+	message string
+	ext     gin.H
+}
+
+func (r *refusal) Error() string { return r.message }
+
+// PaymentParams are the intent parameters Params builds, with the
+// promotions and points it priced them with for Create to reserve. The intent's
+// metadata records the same for whoever reads it, but Create doesn't take
+// them from there: a caller's metadata could say anything.
+type PaymentParams struct {
+	*stripe.PaymentIntentParams
+	discounts []AppliedDiscount
+	points    *pointsRedemption
+}
+
+// Params applies promotions, checks the amount to charge against the
+// limits and builds the intent parameters, or explains why the payment is
+// refused.
+func (s *PaymentService) Params(ctx context.Context, req PaymentRequest) (*PaymentParams, *refusal) {
+	if refused := s.residency.check(req); refused != nil {
+		return nil, refused
+	}
+	var quoted *PaymentQuote
+	if req.QuoteID != "" {
+		q, refused := s.redeemableQuote(ctx, req)
+		if refused != nil {
+			return nil, refused
+		}
+		quoted = q
+	}
+	token, card, refused := s.paymentMethod(ctx, req)
+	if refused != nil {
+		return nil, refused
+	}
+	if refused := s.fraudLists.check(ctx, req, card); refused != nil {
+		return nil, refused
+	}
+	if refused := s.velocity.check(ctx, req, card); refused != nil {
+		return nil, refused
+	}
+
+	var quote *DiscountQuote
+	if !req.skipDiscounts {
+		q, violation, err := s.discounts.Quote(ctx, req)
+		if err != nil {
+			logf(ctx, "promotions: %v", err)
+			return nil, &refusal{http.StatusInternalServerError, CodeInternal, "Could not apply promotions", nil}
+		}
+		if violation != nil {
+			return nil, &refusal{codeStatus[violation.Code], violation.Code, violation.Message, violation.Ext}
+		}
+		if quote = q; quote != nil {
+			req.Amount = quote.Amount
+		}
+	}
+	var points *pointsRedemption
+	if req.RedeemPoints > 0 {
+		p, refused := s.loyalty.quote(ctx, req)
+		if refused != nil {
+			return nil, refused
+		}
+		points = p
+		req.Amount -= p.Value
+	}
+	cfg := s.settings.Get()
+	surcharge := cfg.Surcharges.surcharge(req, card, req.Amount, cfg.Rounding.mode(strings.ToLower(req.Currency)))
+	req.Amount += surcharge.Amount
+	preTip := req.Amount
+	req.Amount += req.Tip
+	var fx *FXQuote
+	if req.FXQuoteID != "" {
+		q, refused := s.lockedQuote(ctx, req)
+		if refused != nil {
+			return nil, refused
+		}
+		fx = q
+		req.Amount, req.Currency = q.LocalAmount, q.LocalCurrency
+	}
+
+	if max, ok := cfg.MaxAmounts[strings.ToLower(req.Currency)]; ok && req.Amount > max {
+		return nil, &refusal{http.StatusBadRequest, CodeInvalidAmount, fmt.Sprintf("Amount exceeds the %d limit for %s", max, req.Currency), nil}
+	}
+	violation, err := s.policies.Check(ctx, req.TenantID, req.CustomerID, req.Currency, req.Amount)
+	if err != nil {
+		logf(ctx, "amount policy: %v", err)
+		return nil, &refusal{http.StatusInternalServerError, CodeInternal, "Could not check payment limits", nil}
+	}
+	if violation != nil {
+		return nil, &refusal{codeStatus[violation.Code], violation.Code, violation.Message, violation.Ext}
+	}
+	risk, refused := s.risk.check(ctx, req, card)
+	if refused != nil {
+		return nil, refused
+	}
+
+	params := &stripe.PaymentIntentParams{
+		Amount:   stripe.Int64(req.Amount),
+		Currency: stripe.String(req.Currency),
+	}
+	params.Context = ctx
+
+	if req.Description != "" {
+		params.Description = stripe.String(req.Description)
+	}
+	if req.CustomerID != "" {
+		params.Customer = stripe.String(req.CustomerID)
+	}
+	if req.transferGroup != "" {
+		params.TransferGroup = stripe.String(req.transferGroup)
+	}
+	for k, v := range req.Metadata {
+		params.AddMetadata(k, v)
+	}
+	if req.OrderID != "" {
+		params.AddMetadata("order_id", req.OrderID)
+	}
+	if req.TenantID != "" {
+		params.AddMetadata("tenant_id", req.TenantID)
+	}
+	if req.ReceiptEmail != "" {
+		params.AddMetadata("receipt_email", req.ReceiptEmail)
+	}
+	if id := requestIDFrom(ctx); id != "" {
+		params.AddMetadata("request_id", id)
+	}
+	req.addDeviceMetadata(params)
+	s.residency.addMetadata(params)
+	if quote != nil {
+		quote.addMetadata(params)
+	}
+	points.addMetadata(params)
+	surcharge.addMetadata(params)
+	req.addTipMetadata(params, preTip)
+	req.addMulticapture(params)
+	if fx != nil {
+		fx.addMetadata(params)
+	}
+	s.addTaxTreatment(ctx, req, params)
+	if token != "" {
+		params.PaymentMethod = stripe.String(token)
+		params.AddExpand("payment_method")
+	}
+	if refused := s.duplicates.check(ctx, req, card.Fingerprint, params); refused != nil {
+		return nil, refused
+	}
+	s.reviews.hold(req, params, false)
+	s.risk.apply(risk, req, params, s.reviews)
+	if refused := quoted.redeem(params); refused != nil {
+		return nil, refused
+	}
+
+	// Payment methods are rolled out per tenant behind flags
+	fc := flagContext(req.TenantID, req.CustomerID, map[string]interface{}{
+		"currency": req.Currency,
+		"amount":   req.Amount,
+	})
+	if s.flags.Bool(ctx, flagAutomaticPaymentMethods, false, fc) {
+		params.AutomaticPaymentMethods = &stripe.PaymentIntentAutomaticPaymentMethodsParams{
+			Enabled: stripe.Bool(true),
+		}
+	} else if types := s.flags.Strings(ctx, flagPaymentMethodTypes, cfg.PaymentMethodTypes, fc); len(types) > 0 {
+		params.PaymentMethodTypes = stripe.StringSlice(types)
+	}
+	if violation := s.policies.CheckPaymentMethods(req.TenantID, req.CustomerCountry, card, params); violation != nil {
+		return nil, &refusal{codeStatus[violation.Code], violation.Code, violation.Message, violation.Ext}
+	}
+	if refused := lifecycleHooks.preCreate(ctx, req, params); refused != nil {
+		return nil, refused
+	}
+	s.routing.route(req, card, params)
+	priced := &PaymentParams{PaymentIntentParams: params, points: points}
+	if quote != nil {
+		priced.discounts = quote.Discounts
+	}
+	return priced, nil
+}
+
+// paymentMethod resolves req's payment method to the Stripe one to charge
+// and, when there is a store to check it against, its card. A card that
+// can't be looked up is left empty; creating the intent will fail with
+// Stripe's reason.
+func (s *PaymentService) paymentMethod(ctx context.Context, req PaymentRequest) (string, paymentCard, *refusal) {
+	if req.PaymentMethod == "" {
+		return "", paymentCard{}, nil
+	}
+	token, err := paymentMethodToken(ctx, s.store, req.PaymentMethod, req.CustomerID)
+	var refused *refusal
+	if errors.As(err, &refused) {
+		return "", paymentCard{}, refused
+	}
+	if err != nil {
+		logf(ctx, "payment method %s: %v", req.PaymentMethod, err)
+		return "", paymentCard{}, &refusal{http.StatusInternalServerError, CodeInternal, "Could not look up the payment method", nil}
+	}
+	if s.store == nil {
+		return token, paymentCard{}, nil
+	}
+	params := &stripe.PaymentMethodParams{}
+	params.Context = ctx
+	pm, err := paymentmethod.Get(token, params)
+	if err != nil {
+		logf(ctx, "payment method %s: %v", token, err)
+		return token, paymentCard{}, nil
+	}
+	if pm.Card == nil {
+		return token, paymentCard{}, nil
+	}
+	return token, paymentCard{
+		BIN:         pm.Card.IIN,
+		Brand:       string(pm.Card.Brand),
+		Country:     pm.Card.Country,
+		Fingerprint: pm.Card.Fingerprint,
+		Funding:     string(pm.Card.Funding),
+	}, nil
+}
+
+// Create sends params to Stripe and records the outcome. Retries carrying
+// the same idempotency key get the original intent back.
+func (s *PaymentService) Create(ctx context.Context, req PaymentRequest, priced *PaymentParams, idempotencyKey string) (*stripe.PaymentIntent, error) {
+	params := priced.PaymentIntentParams
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
+
+	reserved, err := s.discounts.reserve(ctx, req, priced.discounts)
+	if err != nil {
+		return nil, err
+	}
+	redemption, err := s.loyalty.redeem(ctx, req, priced.points, params, idempotencyKey)
+	if err != nil {
+		s.discounts.release(context.WithoutCancel(ctx), reserved)
+		return nil, err
+	}
+
+	started := time.Now()
+	pi, err := paymentintent.New(params)
+	if err != nil {
+		s.routing.failed(params, time.Since(started))
+		s.discounts.release(context.WithoutCancel(ctx), reserved)
+		s.loyalty.release(context.WithoutCancel(ctx), redemption)
+		ev := AnalyticsEvent{
+			Name:      "payment.attempted",
+			TenantID:  req.TenantID,
+			OrderID:   req.OrderID,
+			Amount:    req.Amount,
+			Currency:  req.Currency,
+			Status:    "error",
+			LatencyMS: time.Since(started).Milliseconds(),
+			RequestID: requestIDFrom(ctx),
+		}
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) {
+			ev.ErrorCode = string(stripeErr.Code)
+			ev.DeclineCode = string(stripeErr.DeclineCode)
+		}
+		s.analytics.Emit(ev)
+		return nil, err
+	}
+	s.routing.created(ctx, pi, time.Since(started))
+	s.discounts.attach(ctx, reserved, pi.ID)
+	s.loyalty.attach(ctx, redemption, pi.ID)
+
+	if s.payments != nil {
+		if err := s.payments.SavePayment(ctx, pi); err != nil {
+			// The webhook for this intent will fill the gap.
+			logf(ctx, "saving payment %s: %v", pi.ID, err)
+		}
+	}
+	s.duplicates.created(ctx, pi)
+	lifecycleHooks.post(ctx, hookPostCreate, hookPaymentOf(pi))
+
+	ev := s.analytics.FromPaymentIntent("payment.attempted", pi)
+	ev.LatencyMS = time.Since(started).Milliseconds()
+	s.analytics.Emit(ev)
+	return pi, nil
+}
+
+// createFor runs Params and Create for a payment another endpoint takes on
+// a customer's behalf, such as the rest of a wallet checkout. Promotions
+// don't apply to it. When the payment is refused or fails it writes the
+// error response itself.
+func (s *PaymentService) createFor(c *gin.Context, req PaymentRequest, idempotencyKey string) (*stripe.PaymentIntent, bool) {
+	req.skipDiscounts = true
+	params, refused := s.Params(c.Request.Context(), req)
+	if refused != nil {
+		c.JSON(refused.status, errorBodyWith(c, refused.code, refused.message, refused.ext))
+		return nil, false
+	}
+	pi, err := s.Create(c.Request.Context(), req, params, idempotencyKey)
+	if err != nil {
+		respondError(c, err)
+		return nil, false
+	}
+	return pi, true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// benchmarkHandler serves a request from newRequest per iteration through
+// h, as gin would in production, and reports the 99th percentile latency
+// next to ns/op. With BENCH_P99_BUDGET set, such as 200us, a p99 over it
+// fails the benchmark, so CI can guard the hot handlers' tail.
+func benchmarkHandler(b *testing.B, h http.Handler, newRequest func() *http.Request, want int) {
+	b.Helper()
+	requests := make([]*http.Request, b.N)
+	for i := range requests {
+		requests[i] = newRequest()
+	}
+	latencies := make([]time.Duration, b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i, req := range requests {
+		w := httptest.NewRecorder()
+		start := time.Now()
+		h.ServeHTTP(w, req)
+		latencies[i] = time.Since(start)
+		if w.Code != want {
+			b.Fatalf("status %d, want %d: %s", w.Code, want, w.Body.String())
+		}
+	}
+	b.StopTimer()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p99 := latencies[len(latencies)*99/100]
+	b.ReportMetric(float64(p99.Nanoseconds()), "p99-ns")
+	if budget, err := time.ParseDuration(os.Getenv("BENCH_P99_BUDGET")); err == nil && p99 > budget {
+		b.Errorf("p99 %v over the %v budget", p99, budget)
+	}
+}
+
+// benchmarkCreateBody is a typical checkout's create request.
+var benchmarkCreateBody = []byte(`{"amount":2500,"currency":"usd","description":"Order 1001","order_id":"1001",` +
+	`"customer_id":"cus_bench","receipt_email":"buyer@example.com","capture_method":"automatic",` +
+	`"metadata":{"cart_id":"cart_1001","channel":"web"}}`)
+
+// BenchmarkCreatePayment covers what POST /payment/create does on either
+// side of pricing and the Stripe call: decoding and validating the body,
+// filling in the device, and encoding the response for each API version.
+func BenchmarkCreatePayment(b *testing.B) {
+	gin.SetMode(gin.ReleaseMode)
+	pi := &stripe.PaymentIntent{
+		ID:           "pi_bench",
+		Amount:       2500,
+		Currency:     stripe.CurrencyUSD,
+		Status:       stripe.PaymentIntentStatusRequiresPaymentMethod,
+		ClientSecret: "pi_bench_secret_bench",
+		Created:      1700000000,
+		Metadata:     map[string]string{"order_id": "1001"},
+	}
+	r := gin.New()
+	r.POST("/payment/create", func(c *gin.Context) {
+		var req PaymentRequest
+		if !decodeJSON(c, &req) {
+			return
+		}
+		if fields := req.validate(); len(fields) > 0 {
+			validationFailed(c, fields)
+			return
+		}
+		req.fillDevice(c)
+		if apiVersion(c) >= 2 {
+			respondData(c, http.StatusCreated, paymentData(pi, true))
+			return
+		}
+		respondData(c, http.StatusOK, PaymentResponse{ClientSecret: pi.ClientSecret, ID: pi.ID, Region: regionOf(pi)})
+	})
+
+	for version := 1; version <= latestAPIVersion; version++ {
+		version, want := version, http.StatusOK
+		if version >= 2 {
+			want = http.StatusCreated
+		}
+		b.Run(fmt.Sprintf("v%d", version), func(b *testing.B) {
+			benchmarkHandler(b, r, func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/payment/create", bytes.NewReader(benchmarkCreateBody))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set(apiVersionHeader, strconv.Itoa(version))
+				return req
+			}, want)
+		})
+	}
+}
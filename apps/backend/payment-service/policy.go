@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// AmountPolicies are the charge rules checked before a payment reaches
+// Stripe. A tenant's policy overrides the default field by field: each of
+// its allowed_* lists, when set, replaces the default list, and each of
+// its per-currency limits replaces the default entry for that currency.
+//
+//	"amount_policies": {
+//	  "default": {"allowed_currencies": ["usd", "eur"],
+//	              "limits": {"usd": {"min": 50, "max": 1000000}}},
+//	  "tenants": {"acme": {"allowed_payment_methods": ["card", "sepa_debit"],
+//	                       "allowed_card_brands": ["visa", "mastercard"],
+//	                       "limits": {"usd": {"max": 50000, "daily_per_customer": 200000}}}}
+//	}
+type AmountPolicies struct {
+	Default AmountPolicy            `json:"default"`
+	Tenants map[string]AmountPolicy `json:"tenants"`
+}
+
+type AmountPolicy struct {
+	// AllowedCurrencies is empty to allow any currency.
+	AllowedCurrencies []string `json:"allowed_currencies"`
+	// AllowedPaymentMethods are Stripe payment method types, such as card
+	// or sepa_debit, and AllowedCardBrands card brands, such as visa or
+	// amex. Either is empty to allow any.
+	AllowedPaymentMethods []string                `json:"allowed_payment_methods"`
+	AllowedCardBrands     []string                `json:"allowed_card_brands"`
+	Limits                map[string]AmountLimits `json:"limits"`
+}
+
+// cardBrands are the brands Stripe reports on cards.
+var cardBrands = []string{"amex", "cartes_bancaires", "diners", "discover", "eftpos_au", "jcb", "mastercard", "unionpay", "visa"}
+
+// AmountLimits are in minor units; zero means no limit.
+type AmountLimits struct {
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+	// DailyPerCustomer caps what one customer can pay a tenant per UTC day,
+	// counting this payment. It needs DATABASE_URL.
+	DailyPerCustomer int64 `json:"daily_per_customer"`
+}
+
+func (p AmountPolicies) validate() error {
+	check := func(name string, policy AmountPolicy) error {
+		for _, cur := range policy.AllowedCurrencies {
+			if len(cur) != 3 {
+				return fmt.Errorf("amount_policies %s: invalid currency %q", name, cur)
+			}
+		}
+		for _, m := range policy.AllowedPaymentMethods {
+			if _, known := paymentMethodCurrencies[m]; !known {
+				return fmt.Errorf("amount_policies %s: unknown payment method %q", name, m)
+			}
+		}
+		for _, brand := range policy.AllowedCardBrands {
+			if !containsString(cardBrands, brand) {
+				return fmt.Errorf("amount_policies %s: unknown card brand %q", name, brand)
+			}
+		}
+		for cur, l := range policy.Limits {
+			if len(cur) != 3 {
+				return fmt.Errorf("amount_policies %s: invalid currency %q", name, cur)
+			}
+			if l.Min < 0 || l.Max < 0 || l.DailyPerCustomer < 0 {
+				return fmt.Errorf("amount_policies %s.%s: limits must not be negative", name, cur)
+			}
+			if l.Max > 0 && l.Min > l.Max {
+				return fmt.Errorf("amount_policies %s.%s: min exceeds max", name, cur)
+			}
+		}
+		return nil
+	}
+	if err := check("default", p.Default); err != nil {
+		return err
+	}
+	for tenant, policy := range p.Tenants {
+		if err := check("tenants."+tenant, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasDailyLimits reports whether any policy needs the store.
+func (p AmountPolicies) hasDailyLimits() bool {
+	policies := []AmountPolicy{p.Default}
+	for _, policy := range p.Tenants {
+		policies = append(policies, policy)
+	}
+	for _, policy := range policies {
+		for _, l := range policy.Limits {
+			if l.DailyPerCustomer > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// effective resolves the allowed currencies and limits for one tenant and
+// currency.
+func (p AmountPolicies) effective(tenantID, currency string) (allowed []string, limits AmountLimits) {
+	allowed = p.Default.AllowedCurrencies
+	limits = p.Default.Limits[currency]
+	if t, ok := p.Tenants[tenantID]; ok && tenantID != "" {
+		if len(t.AllowedCurrencies) > 0 {
+			allowed = t.AllowedCurrencies
+		}
+		if l, ok := t.Limits[currency]; ok {
+			limits = l
+		}
+	}
+	return allowed, limits
+}
+
+// acceptance resolves the payment methods and card brands one tenant
+// accepts.
+func (p AmountPolicies) acceptance(tenantID string) (methods, brands []string) {
+	methods, brands = p.Default.AllowedPaymentMethods, p.Default.AllowedCardBrands
+	if t, ok := p.Tenants[tenantID]; ok && tenantID != "" {
+		if len(t.AllowedPaymentMethods) > 0 {
+			methods = t.AllowedPaymentMethods
+		}
+		if len(t.AllowedCardBrands) > 0 {
+			brands = t.AllowedCardBrands
+		}
+	}
+	return methods, brands
+}
+
+// PolicyViolation explains why a payment was refused. Ext carries the
+// limit that applied so clients can tell the customer what is allowed.
+type PolicyViolation struct {
+	Code    ErrorCode
+	Message string
+	Ext     gin.H
+}
+
+// PolicyEngine evaluates the live amount policies.
+type PolicyEngine struct {
+	settings *RuntimeSettings
+	store    *Store
+}
+
+func NewPolicyEngine(settings *RuntimeSettings, store *Store) *PolicyEngine {
+	if store == nil && settings.Get().AmountPolicies.hasDailyLimits() {
+		log.Println("amount_policies set daily_per_customer limits but DATABASE_URL is not set; daily limits are not enforced")
+	}
+	return &PolicyEngine{settings: settings, store: store}
+}
+
+// Check returns the first rule the payment breaks, or nil. An error means
+// the daily total couldn't be read and the payment should not proceed.
+func (e *PolicyEngine) Check(ctx context.Context, tenantID, customerID, currency string, amount int64) (*PolicyViolation, error) {
+	currency = strings.ToLower(currency)
+	allowed, limits := e.settings.Get().AmountPolicies.effective(tenantID, currency)
+
+	if len(allowed) > 0 && !containsFold(allowed, currency) {
+		return &PolicyViolation{
+			Code:    CodeCurrencyNotAllowed,
+			Message: fmt.Sprintf("Currency %s is not allowed for this tenant", currency),
+			Ext:     gin.H{"allowed_currencies": allowed},
+		}, nil
+	}
+	if limits.Min > 0 && amount < limits.Min {
+		return &PolicyViolation{
+			Code:    CodeAmountBelowMinimum,
+			Message: fmt.Sprintf("Amount is below the %d %s minimum", limits.Min, currency),
+			Ext:     gin.H{"limit": limits.Min, "currency": currency},
+		}, nil
+	}
+	if limits.Max > 0 && amount > limits.Max {
+		return &PolicyViolation{
+			Code:    CodeAmountAboveMaximum,
+			Message: fmt.Sprintf("Amount exceeds the %d %s maximum", limits.Max, currency),
+			Ext:     gin.H{"limit": limits.Max, "currency": currency},
+		}, nil
+	}
+
+	// Payments without a customer can't be attributed, so only per-payment
+	// limits apply to them.
+	if limits.DailyPerCustomer == 0 || customerID == "" || e.store == nil {
+		return nil, nil
+	}
+	since := time.Now().UTC().Truncate(24 * time.Hour)
+	total, err := e.store.CustomerTotalSince(ctx, tenantID, customerID, currency, since)
+	if err != nil {
+		return nil, fmt.Errorf("reading daily total: %w", err)
+	}
+	if total+amount > limits.DailyPerCustomer {
+		remaining := limits.DailyPerCustomer - total
+		if remaining < 0 {
+			remaining = 0
+		}
+		return &PolicyViolation{
+			Code:    CodeDailyLimitExceeded,
+			Message: fmt.Sprintf("Payment would exceed the customer's %d %s daily limit", limits.DailyPerCustomer, currency),
+			Ext:     gin.H{"limit": limits.DailyPerCustomer, "remaining": remaining, "currency": currency},
+		}, nil
+	}
+	return nil, nil
+}
+
+// CheckPaymentMethods holds params to the payment methods the tenant
+// accepts, narrowing the types they offer, and refuses a card given up
+// front whose brand isn't accepted. Cards the customer enters at checkout
+// are left to the types offered.
+func (e *PolicyEngine) CheckPaymentMethods(tenantID, country string, card paymentCard, params *stripe.PaymentIntentParams) *PolicyViolation {
+	methods, brands := e.settings.Get().AmountPolicies.acceptance(tenantID)
+	if card.Brand != "" {
+		if len(methods) > 0 && !containsString(methods, "card") {
+			return &PolicyViolation{
+				Code:    CodeMethodNotAllowed,
+				Message: "Cards are not accepted for this tenant",
+				Ext:     gin.H{"allowed_payment_methods": methods},
+			}
+		}
+		if len(brands) > 0 && !containsFold(brands, card.Brand) {
+			return &PolicyViolation{
+				Code:    CodeMethodNotAllowed,
+				Message: fmt.Sprintf("Card brand %s is not accepted for this tenant", card.Brand),
+				Ext:     gin.H{"allowed_card_brands": brands},
+			}
+		}
+	}
+	if len(methods) == 0 {
+		return nil
+	}
+
+	// Automatic payment methods would offer whatever the account has on,
+	// so an allowlist turns them into an explicit list.
+	currency := strings.ToLower(stripe.StringValue(params.Currency))
+	candidates := methodsFor(methods, currency, strings.ToUpper(country))
+	if params.AutomaticPaymentMethods == nil && len(params.PaymentMethodTypes) > 0 {
+		offered := candidates
+		candidates = []string{}
+		for _, m := range params.PaymentMethodTypes {
+			if containsString(offered, *m) {
+				candidates = append(candidates, *m)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return &PolicyViolation{
+			Code:    CodeMethodNotAllowed,
+			Message: fmt.Sprintf("None of the payment methods accepted for this tenant take %s", currency),
+			Ext:     gin.H{"allowed_payment_methods": methods},
+		}
+	}
+	params.AutomaticPaymentMethods = nil
+	params.PaymentMethodTypes = stripe.StringSlice(candidates)
+	return nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// CustomerTotalSince sums what a customer has paid, or has authorized, a
+// tenant in currency since the given time. Open intents don't count, so a
+// decline never uses up the limit.
+func (s *Store) CustomerTotalSince(ctx context.Context, tenantID, customerID, currency string, since time.Time) (int64, error) {
+	var total int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(amount), 0) FROM payments
+		WHERE tenant_id = $1 AND customer_id = $2 AND currency = $3 AND created_at >= $4
+			AND status IN ('succeeded', 'processing', 'requires_capture')`,
+		tenantID, customerID, currency, since).Scan(&total)
+	return total, err
+}
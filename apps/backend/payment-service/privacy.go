@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/customer"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+// privacyScope lets an API key answer data subject requests.
+const privacyScope = "privacy"
+
+const (
+	privacyExport = "export"
+	privacyDelete = "delete"
+)
+
+// privacySections are what an export collects of a customer's locally
+// stored data, each the rows of one table, selected by $1, the customer
+// ID. Provider tokens of vaulted payment methods are left out; they are
+// credentials, not data about the customer.
+var privacySections = []struct{ name, query string }{
+	{"payments", `SELECT * FROM payments WHERE customer_id = $1 ORDER BY created_at`},
+	{"refunds", `SELECT * FROM refunds WHERE payment_id IN (SELECT id FROM payments WHERE customer_id = $1) ORDER BY created_at`},
+	{"payment_retries", `SELECT * FROM payment_retries WHERE customer_id = $1 ORDER BY created_at`},
+	{"payment_retry_attempts", `SELECT * FROM payment_retry_attempts WHERE customer_id = $1 ORDER BY created_at`},
+	{"payment_retry_opt_outs", `SELECT * FROM payment_retry_opt_outs WHERE customer_id = $1`},
+	{"wallets", `SELECT * FROM wallets WHERE customer_id = $1 ORDER BY created_at`},
+	{"wallet_transactions", `SELECT * FROM wallet_transactions WHERE wallet_id IN (SELECT id FROM wallets WHERE customer_id = $1) ORDER BY created_at`},
+	{"loyalty_accounts", `SELECT * FROM loyalty_accounts WHERE customer_id = $1 ORDER BY created_at`},
+	{"loyalty_transactions", `SELECT * FROM loyalty_transactions WHERE customer_id = $1 ORDER BY created_at`},
+	{"promotion_redemptions", `SELECT * FROM promotion_redemptions WHERE customer_id = $1 ORDER BY created_at`},
+	{"dunning_cases", `SELECT * FROM dunning_cases WHERE customer_id = $1 ORDER BY created_at`},
+	{"payment_plans", `SELECT * FROM payment_plans WHERE customer_id = $1 ORDER BY created_at`},
+	{"payment_plan_installments", `SELECT * FROM payment_plan_installments WHERE plan_id IN (SELECT id FROM payment_plans WHERE customer_id = $1) ORDER BY plan_id, seq`},
+	{"billing_subscriptions", `SELECT * FROM billing_subscriptions WHERE customer_id = $1 ORDER BY created_at`},
+	{"billing_invoices", `SELECT * FROM billing_invoices WHERE subscription_id IN (SELECT id FROM billing_subscriptions WHERE customer_id = $1) ORDER BY created_at`},
+	{"vaulted_payment_methods", `SELECT * FROM vaulted_payment_methods WHERE customer_id = $1 ORDER BY created_at`},
+	{"customer_tax_ids", `SELECT * FROM customer_tax_ids WHERE customer_id = $1 ORDER BY created_at`},
+	{"checkout_sessions", `SELECT * FROM checkout_sessions WHERE request->>'customer_id' = $1 ORDER BY created_at`},
+	{"webhook_events", `SELECT * FROM webhook_events WHERE payment_id IN (SELECT id FROM payments WHERE customer_id = $1) ORDER BY received_at`},
+	{"dead_letters", `SELECT * FROM dead_letters WHERE ` + privacyDeadLetters + ` ORDER BY created_at`},
+}
+
+// privacyDeadLetters matches the dead letters about $1's payments and
+// subscriptions: Stripe events recorded for a payment, and publishes
+// keyed by one.
+const privacyDeadLetters = `(kind = 'webhook' AND ref IN (
+		SELECT id FROM webhook_events WHERE payment_id IN (SELECT id FROM payments WHERE customer_id = $1)))
+	OR (kind = 'publish' AND key IN (
+		SELECT id FROM payments WHERE customer_id = $1
+		UNION ALL SELECT id FROM billing_subscriptions WHERE customer_id = $1))`
+
+// privacyErasures remove or anonymize a customer's locally stored data,
+// in order: $1 is the customer ID, $2 the pseudonym that replaces it.
+// Payments, refunds, invoices, wallet, loyalty and ledger rows are
+// financial records that must be kept, so they stay with the pseudonym in
+// place of the customer and lose the card fingerprint, BIN, brand and
+// country, the payment method, the description, the device and the email
+// that point back to them. The Stripe payloads kept of their payments,
+// recorded webhook events and dead letters alike, carry billing names,
+// emails and addresses and are emptied; an open dead letter is discarded
+// with its payload. What only serves the customer goes:
+// retry preferences, vaulted cards, trial records and tax IDs that were
+// never verified. Verified tax IDs are the evidence for reverse-charge
+// invoices and are kept. Fraud list entries stay too, under the
+// legitimate interest in preventing fraud.
+var privacyErasures = []struct{ table, action, query string }{
+	{"payment_retry_opt_outs", "deleted", `DELETE FROM payment_retry_opt_outs WHERE customer_id = $1`},
+	{"payment_retry_attempts", "deleted", `DELETE FROM payment_retry_attempts WHERE customer_id = $1`},
+	{"payment_retries", "anonymized", `
+		UPDATE payment_retries SET customer_id = $2, payment_method = '',
+			status = CASE WHEN status = 'scheduled' THEN 'canceled' ELSE status END,
+			resolved_at = CASE WHEN status = 'scheduled' THEN now() ELSE resolved_at END,
+			next_attempt_at = NULL, updated_at = now()
+		WHERE customer_id = $1`},
+	{"vaulted_payment_method_tokens", "deleted", `
+		DELETE FROM vaulted_payment_method_tokens
+		WHERE vault_id IN (SELECT id FROM vaulted_payment_methods WHERE customer_id = $1)`},
+	{"vaulted_payment_methods", "deleted", `DELETE FROM vaulted_payment_methods WHERE customer_id = $1`},
+	{"billing_trials", "deleted", `
+		DELETE FROM billing_trials
+		WHERE subscription_id IN (SELECT id FROM billing_subscriptions WHERE customer_id = $1)`},
+	{"billing_subscriptions", "anonymized", `
+		UPDATE billing_subscriptions SET customer_id = $2, payment_method = '', updated_at = now() WHERE customer_id = $1`},
+	{"payment_plans", "anonymized", `
+		UPDATE payment_plans SET customer_id = $2, payment_method = '', updated_at = now() WHERE customer_id = $1`},
+	{"wallets", "anonymized", `UPDATE wallets SET customer_id = $2, updated_at = now() WHERE customer_id = $1`},
+	{"loyalty_accounts", "anonymized", `UPDATE loyalty_accounts SET customer_id = $2, updated_at = now() WHERE customer_id = $1`},
+	{"loyalty_transactions", "anonymized", `UPDATE loyalty_transactions SET customer_id = $2 WHERE customer_id = $1`},
+	{"promotion_redemptions", "anonymized", `UPDATE promotion_redemptions SET customer_id = $2 WHERE customer_id = $1`},
+	{"dunning_cases", "anonymized", `
+		UPDATE dunning_cases SET customer_id = $2, customer_email = '', updated_at = now() WHERE customer_id = $1`},
+	{"customer_tax_ids", "deleted", `DELETE FROM customer_tax_ids WHERE customer_id = $1 AND consultation_number = ''`},
+	{"customer_tax_ids", "anonymized", `UPDATE customer_tax_ids SET customer_id = $2 WHERE customer_id = $1`},
+	{"checkout_sessions", "anonymized", `
+		UPDATE checkout_sessions
+		SET request = jsonb_set(request - ARRAY['receipt_email', 'client_ip', 'user_agent', 'device_id', 'customer_country', 'metadata'],
+				'{customer_id}', to_jsonb($2::text)),
+			updated_at = now()
+		WHERE request->>'customer_id' = $1`},
+	{"dead_letters", "anonymized", `
+		UPDATE dead_letters SET payload = '{}',
+			status = CASE WHEN status IN ('pending', 'retrying') THEN 'discarded' ELSE status END,
+			resolved_by = CASE WHEN status IN ('pending', 'retrying') THEN 'privacy' ELSE resolved_by END,
+			resolved_at = CASE WHEN status IN ('pending', 'retrying') THEN now() ELSE resolved_at END,
+			updated_at = now()
+		WHERE ` + privacyDeadLetters},
+	{"webhook_events", "anonymized", `
+		UPDATE webhook_events SET payload = '{}'
+		WHERE payment_id IN (SELECT id FROM payments WHERE customer_id = $1)`},
+	{"payment_routes", "anonymized", `
+		UPDATE payment_routes SET card_bin = '', card_country = '', updated_at = now()
+		WHERE payment_id IN (SELECT id FROM payments WHERE customer_id = $1)`},
+	{"payments", "anonymized", `
+		UPDATE payments SET customer_id = $2, card_fingerprint = '', card_bin = '', card_brand = '', card_country = '',
+			payment_method = '', description = '', client_ip = '', user_agent = '', device_id = '',
+			updated_at = now()
+		WHERE customer_id = $1`},
+	{"payment_summaries", "anonymized", `
+		UPDATE payment_summaries SET customer_id = $2, description = '', updated_at = now() WHERE customer_id = $1`},
+	{"customer_ltv", "deleted", `DELETE FROM customer_ltv WHERE customer_id = $1`},
+}
+
+// PrivacyRequest is one entry in the audit log of data subject requests.
+type PrivacyRequest struct {
+	ID         string          `json:"id"`
+	CustomerID string          `json:"customer_id"`
+	Action     string          `json:"action"`
+	Actor      string          `json:"actor,omitempty"`
+	Reason     string          `json:"reason,omitempty"`
+	Summary    json.RawMessage `json:"summary"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+var privacyRequestList = listResource{
+	from:   "privacy_requests q",
+	fields: []string{"id", "customer_id", "action", "actor", "reason", "created_at"},
+	columns: map[string]listField{
+		"id":          {"q.id", textField},
+		"customer_id": {"q.customer_id", textField},
+		"action":      {"q.action", textField},
+		"actor":       {"q.actor", textField},
+		"reason":      {"q.reason", textField},
+		"created_at":  {"q.created_at", timeField},
+	},
+}
+
+// ErasureSummary is what a deletion did, row counts keyed by table.
+type ErasureSummary struct {
+	Deleted                map[string]int64 `json:"deleted"`
+	Anonymized             map[string]int64 `json:"anonymized"`
+	StripeCustomerDeleted  bool             `json:"stripe_customer_deleted"`
+	StripePaymentsScrubbed int              `json:"stripe_payments_scrubbed"`
+}
+
+// PrivacyExport returns the customer's rows of every privacy section, as
+// one consistent snapshot.
+func (s *Store) PrivacyExport(ctx context.Context, customerID string) (map[string]json.RawMessage, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	out := map[string]json.RawMessage{}
+	for _, sec := range privacySections {
+		var raw []byte
+		err := tx.QueryRowContext(ctx,
+			`SELECT coalesce(jsonb_agg(to_jsonb(t)), '[]'::jsonb) FROM (`+sec.query+`) t`, customerID).Scan(&raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sec.name, err)
+		}
+		out[sec.name] = raw
+	}
+	return out, nil
+}
+
+// ErasureBlockers names what must be settled before the customer's data
+// can be erased: money held for them, and billing still running.
+func (s *Store) ErasureBlockers(ctx context.Context, customerID string) ([]string, error) {
+	var wallet, subscription, plan, dunning, retry, review bool
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			EXISTS (SELECT 1 FROM wallets WHERE customer_id = $1 AND balance > 0),
+			EXISTS (SELECT 1 FROM billing_subscriptions WHERE customer_id = $1
+				AND status IN ('incomplete', 'trialing', 'active', 'past_due', 'unpaid')),
+			EXISTS (SELECT 1 FROM payment_plans WHERE customer_id = $1 AND status IN ('active', 'paying_off')),
+			EXISTS (SELECT 1 FROM dunning_cases WHERE customer_id = $1 AND status IN ('retrying', 'grace')),
+			EXISTS (SELECT 1 FROM payment_retries WHERE customer_id = $1 AND status = 'attempting'),
+			EXISTS (SELECT 1 FROM payment_reviews v JOIN payments p ON p.id = v.payment_id
+				WHERE p.customer_id = $1 AND v.status = 'pending')`,
+		customerID).Scan(&wallet, &subscription, &plan, &dunning, &retry, &review)
+	if err != nil {
+		return nil, err
+	}
+	blockers := []string{}
+	for _, b := range []struct {
+		set  bool
+		name string
+	}{
+		{wallet, "wallet_balance"},
+		{subscription, "active_subscription"},
+		{plan, "active_payment_plan"},
+		{dunning, "open_dunning_case"},
+		{retry, "payment_retry_in_progress"},
+		{review, "payment_under_review"},
+	} {
+		if b.set {
+			blockers = append(blockers, b.name)
+		}
+	}
+	return blockers, nil
+}
+
+// EraseCustomer applies the privacy erasures and records req, whose
+// Summary it fills in, in one transaction.
+func (s *Store) EraseCustomer(ctx context.Context, req *PrivacyRequest, summary *ErasureSummary) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	pseudonym := "erased_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	summary.Deleted, summary.Anonymized = map[string]int64{}, map[string]int64{}
+	for _, e := range privacyErasures {
+		res, err := tx.ExecContext(ctx, e.query, req.CustomerID, pseudonym)
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.table, err)
+		}
+		n, _ := res.RowsAffected()
+		if e.action == "deleted" {
+			summary.Deleted[e.table] += n
+		} else {
+			summary.Anonymized[e.table] += n
+		}
+	}
+	if req.Summary, err = json.Marshal(summary); err != nil {
+		return err
+	}
+	if err := insertPrivacyRequest(ctx, tx, req); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordPrivacyRequest adds req to the audit log.
+func (s *Store) RecordPrivacyRequest(ctx context.Context, req *PrivacyRequest) error {
+	return insertPrivacyRequest(ctx, s.db, req)
+}
+
+func insertPrivacyRequest(ctx context.Context, q interface {
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}, req *PrivacyRequest) error {
+	if req.Summary == nil {
+		req.Summary = json.RawMessage("{}")
+	}
+	return q.QueryRowContext(ctx, `
+		INSERT INTO privacy_requests (id, customer_id, action, actor, reason, summary)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at`,
+		req.ID, req.CustomerID, req.Action, req.Actor, req.Reason, []byte(req.Summary)).Scan(&req.CreatedAt)
+}
+
+func (s *Store) PrivacyRequest(ctx context.Context, id string) (*PrivacyRequest, error) {
+	req := &PrivacyRequest{}
+	var summary []byte
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, customer_id, action, actor, reason, summary, created_at FROM privacy_requests WHERE id = $1`, id).
+		Scan(&req.ID, &req.CustomerID, &req.Action, &req.Actor, &req.Reason, &summary, &req.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	req.Summary = summary
+	return req, nil
+}
+
+// Privacy answers data subject requests: an export of what is stored
+// locally about a customer, and erasure of it along with the Stripe
+// customer. Both are kept in an audit log that names the customer but
+// none of their data.
+type Privacy struct {
+	store *Store
+}
+
+func NewPrivacy(store *Store) *Privacy {
+	return &Privacy{store: store}
+}
+
+// RegisterRoutes mounts the endpoints under the privacy scope.
+func (p *Privacy) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/privacy", requireScope(p.store, bootstrapToken, privacyScope), p.requireStore)
+	g.GET("/customers/:id/export", p.export)
+	g.POST("/customers/:id/delete", p.delete)
+	g.GET("/requests", listHandler(p.store, privacyRequestList))
+	g.GET("/requests/:id", p.get)
+}
+
+func (p *Privacy) requireStore(c *gin.Context) {
+	if p.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Privacy requests require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+func newPrivacyRequestID() string {
+	return "prq_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+}
+
+// export returns the customer's Stripe profile, when there still is one,
+// and their rows of every local table, as a download.
+func (p *Privacy) export(c *gin.Context) {
+	ctx := c.Request.Context()
+	customerID := c.Param("id")
+
+	sections, err := p.store.PrivacyExport(ctx, customerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	export := gin.H{"customer_id": customerID, "exported_at": time.Now().UTC(), "local": sections}
+	params := &stripe.CustomerParams{}
+	params.Context = ctx
+	cust, err := customer.Get(customerID, params)
+	var se *stripe.Error
+	switch {
+	case err == nil && !cust.Deleted:
+		export["stripe_customer"] = cust
+	case err != nil && !(errors.As(err, &se) && se.Code == stripe.ErrorCodeResourceMissing):
+		respondError(c, err)
+		return
+	}
+
+	req := &PrivacyRequest{ID: newPrivacyRequestID(), CustomerID: customerID, Action: privacyExport,
+		Actor: c.GetString("api_key_id"), Reason: c.Query("reason")}
+	if err := p.store.RecordPrivacyRequest(ctx, req); err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	export["request_id"] = req.ID
+	logf(ctx, "privacy: exported customer %s (%s)", customerID, req.ID)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="customer_%s.json"`, customerID))
+	respondData(c, http.StatusOK, export)
+}
+
+// delete erases the customer: refused with erasure_blocked while money is
+// held for them or billing still runs, it then removes the receipt email
+// from their Stripe payments, deletes the Stripe customer with its saved
+// cards, and erases or anonymizes the local rows. Stripe keeps the
+// payments themselves, as it must. A failed deletion can be retried; parts
+// already done are skipped.
+func (p *Privacy) delete(c *gin.Context) {
+	var body struct {
+		Reason string `json:"reason" binding:"max=500"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &body) {
+		return
+	}
+	ctx := c.Request.Context()
+	customerID := c.Param("id")
+
+	blockers, err := p.store.ErasureBlockers(ctx, customerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if len(blockers) > 0 {
+		c.JSON(http.StatusConflict, errorBodyWith(c, CodeErasureBlocked,
+			"The customer's data can't be erased until these are settled: "+strings.Join(blockers, ", "),
+			gin.H{"blockers": blockers}))
+		return
+	}
+
+	summary := &ErasureSummary{}
+	if summary.StripePaymentsScrubbed, err = scrubStripePayments(ctx, customerID); err != nil {
+		respondError(c, err)
+		return
+	}
+	del := &stripe.CustomerParams{}
+	del.Context = ctx
+	_, err = customer.Del(customerID, del)
+	var se *stripe.Error
+	switch {
+	case err == nil:
+		summary.StripeCustomerDeleted = true
+	case !(errors.As(err, &se) && se.Code == stripe.ErrorCodeResourceMissing):
+		respondError(c, err)
+		return
+	}
+
+	req := &PrivacyRequest{ID: newPrivacyRequestID(), CustomerID: customerID, Action: privacyDelete,
+		Actor: c.GetString("api_key_id"), Reason: body.Reason}
+	if err := p.store.EraseCustomer(ctx, req, summary); err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	logf(ctx, "privacy: erased customer %s (%s)", customerID, req.ID)
+	respondData(c, http.StatusOK, req)
+}
+
+// scrubStripePayments clears the receipt email this service keeps in the
+// metadata of the customer's payment intents, and reports how many it
+// changed.
+func scrubStripePayments(ctx context.Context, customerID string) (int, error) {
+	params := &stripe.PaymentIntentListParams{Customer: stripe.String(customerID)}
+	params.Context = ctx
+	it := paymentintent.List(params)
+	scrubbed := 0
+	for it.Next() {
+		pi := it.PaymentIntent()
+		if pi.Metadata["receipt_email"] == "" {
+			continue
+		}
+		update := &stripe.PaymentIntentParams{}
+		update.Context = ctx
+		update.AddMetadata("receipt_email", "")
+		if _, err := paymentintent.Update(pi.ID, update); err != nil {
+			return scrubbed, err
+		}
+		scrubbed++
+	}
+	return scrubbed, it.Err()
+}
+
+func (p *Privacy) get(c *gin.Context) {
+	req, err := p.store.PrivacyRequest(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Privacy request not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, req)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Invoice billing reasons, as Stripe names them.
+const (
+	billingReasonCreate = "subscription_create"
+	billingReasonCycle  = "subscription_cycle"
+	billingReasonUpdate = "subscription_update"
+)
+
+// Proration behaviors of a plan change: create_prorations puts the
+// prorated lines on the next renewal invoice, always_invoice charges them
+// now, and none changes the price from the next period without any.
+const (
+	prorationCreate = "create_prorations"
+	prorationAlways = "always_invoice"
+	prorationNone   = "none"
+)
+
+// errPreviewOnly rolls back a change that was only being previewed.
+var errPreviewOnly = errors.New("preview only")
+
+// planChange moves a subscription to another plan, quantity or both.
+// Previewing it with a proration_date and then making it with the same
+// one bills exactly what the preview showed.
+type planChange struct {
+	PlanID            string     `json:"plan_id"`
+	Quantity          int        `json:"quantity" binding:"omitempty,gte=1,lte=100000"`
+	ProrationBehavior string     `json:"proration_behavior" binding:"omitempty,oneof=create_prorations always_invoice none"`
+	ProrationDate     *time.Time `json:"proration_date"`
+}
+
+func (ch *planChange) requested() bool { return ch.PlanID != "" || ch.Quantity != 0 }
+
+// changePlans loads the plans a change is between, answering 422 or 500 and
+// returning false when the new one can't replace the current one.
+// Prorating only works between prices of the same currency and period.
+func (b *Billing) changePlans(c *gin.Context, sub *BillingSubscription, ch *planChange) (from, to *BillingPlan, ok bool) {
+	ctx := c.Request.Context()
+	from, err := b.store.BillingPlan(ctx, sub.PlanID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return nil, nil, false
+	}
+	to = from
+	if ch.PlanID != "" && ch.PlanID != from.ID {
+		to, err = b.store.BillingPlan(ctx, ch.PlanID)
+		if errors.Is(err, sql.ErrNoRows) {
+			validationFailed(c, []FieldError{{Field: "plan_id", Code: "invalid", Message: "no such plan"}})
+			return nil, nil, false
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return nil, nil, false
+		}
+	}
+	var fields []FieldError
+	switch {
+	case from.UsageType == usageMetered || to.UsageType == usageMetered:
+		fields = append(fields, FieldError{Field: "plan_id", Code: "invalid", Message: "metered subscriptions can't change plan or quantity"})
+	case to.Currency != from.Currency || to.Interval != from.Interval || to.IntervalCount != from.IntervalCount:
+		fields = append(fields, FieldError{Field: "plan_id", Code: "invalid", Message: "must have the current plan's currency and billing interval"})
+	case to.TenantID != from.TenantID:
+		fields = append(fields, FieldError{Field: "plan_id", Code: "invalid", Message: "must belong to the subscription's tenant"})
+	case to.ID == from.ID && (ch.Quantity == 0 || ch.Quantity == sub.Quantity):
+		fields = append(fields, FieldError{Field: "plan_id", Code: "invalid", Message: "the subscription already has this plan and quantity"})
+	}
+	if at := ch.ProrationDate; at != nil && (at.Before(sub.CurrentPeriodStart) || !at.Before(sub.CurrentPeriodEnd)) {
+		fields = append(fields, FieldError{Field: "proration_date", Code: "invalid", Message: "must be within the current billing period"})
+	}
+	if len(fields) > 0 {
+		validationFailed(c, fields)
+		return nil, nil, false
+	}
+	return from, to, true
+}
+
+// prorate is what changing from one price and quantity to another at the
+// given time is worth for the rest of the current period: a credit for
+// the unused time on the old price and a charge for the same time on the
+// new one. Each is the share of the period left times what the period
+// costs at that price, so a period that was itself prorated up to a
+// billing cycle anchor is shared out from its prorated price. Amounts
+// are rounded per unit, as invoice lines are.
+func prorate(s *BillingSubscription, from, to *BillingPlan, qty int, at time.Time) []BillingInvoiceLine {
+	start, end := s.CurrentPeriodStart, s.CurrentPeriodEnd
+	left, period := int64(end.Sub(at)), int64(end.Sub(start))
+	_, fromPrice := from.period(s.BillingCycleAnchor, start)
+	_, toPrice := to.period(s.BillingCycleAnchor, start)
+	credit := -fractionOf(fromPrice, left, period, roundHalfUp)
+	charge := fractionOf(toPrice, left, period, roundHalfUp)
+
+	after := " after " + at.Format("2 Jan 2006")
+	lines := []BillingInvoiceLine{}
+	if credit != 0 {
+		n := int64(max(s.Quantity, 1))
+		lines = append(lines, BillingInvoiceLine{Description: "Unused time on " + from.Name + after, Quantity: n, UnitAmount: credit, Amount: credit * n})
+	}
+	if charge != 0 {
+		n := int64(qty)
+		lines = append(lines, BillingInvoiceLine{Description: "Remaining time on " + to.Name + after, Quantity: n, UnitAmount: charge, Amount: charge * n})
+	}
+	return lines
+}
+
+// settlePending adds the subscription's pending items to inv. A credit
+// bigger than the invoice leaves it at zero with the rest carried to the
+// next one, and an invoice for nothing is paid as it is created.
+func settlePending(s *BillingSubscription, inv *BillingInvoice) {
+	for _, l := range s.pending {
+		inv.Lines = append(inv.Lines, l)
+		inv.Amount += l.Amount
+	}
+	s.pending = nil
+	if inv.Amount < 0 {
+		left := inv.Amount
+		inv.Lines = append(inv.Lines, BillingInvoiceLine{Description: "Credit carried to the next invoice", Quantity: 1, UnitAmount: -left, Amount: -left})
+		s.pending = []BillingInvoiceLine{{Description: "Credit from an earlier invoice", Quantity: 1, UnitAmount: left, Amount: left}}
+		inv.Amount = 0
+	}
+	if inv.Amount == 0 {
+		now := time.Now().UTC()
+		inv.Status, inv.NextAttemptAt, inv.PaidAt = billingInvoicePaid, nil, &now
+	}
+}
+
+// applyPlanChange changes s from one plan to another at the given time
+// and returns the prorations, and for always_invoice the invoice charging
+// them with any pending items. A trialing subscription changes without
+// prorations, having paid nothing yet; one that is behind on payment
+// can't change until it catches up.
+func applyPlanChange(s *BillingSubscription, latest *BillingInvoice, from, to *BillingPlan, ch *planChange, at time.Time) (*BillingInvoice, []BillingInvoiceLine, error) {
+	if (s.Status != subscriptionActive && s.Status != subscriptionTrialing) || (latest != nil && latest.unresolved()) {
+		return nil, nil, errSubscriptionState
+	}
+	// The plan or period moved since the caller looked.
+	if s.PlanID != from.ID || at.Before(s.CurrentPeriodStart) || !at.Before(s.CurrentPeriodEnd) {
+		return nil, nil, errSubscriptionState
+	}
+	qty := s.Quantity
+	if ch.Quantity != 0 {
+		qty = ch.Quantity
+	}
+	lines := []BillingInvoiceLine{}
+	if s.Status == subscriptionActive && ch.ProrationBehavior != prorationNone {
+		lines = prorate(s, from, to, qty, at)
+	}
+	s.PlanID, s.Quantity = to.ID, qty
+
+	if ch.ProrationBehavior != prorationAlways || len(lines) == 0 {
+		s.pending = append(s.pending, lines...)
+		return nil, lines, nil
+	}
+	now := time.Now().UTC()
+	inv := &BillingInvoice{
+		ID:             "bin_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		SubscriptionID: s.ID,
+		BillingReason:  billingReasonUpdate,
+		PeriodStart:    at,
+		PeriodEnd:      s.CurrentPeriodEnd,
+		Currency:       to.Currency,
+		Status:         billingInvoiceOpen,
+		NextAttemptAt:  &now,
+		Lines:          append([]BillingInvoiceLine{}, lines...),
+	}
+	for _, l := range lines {
+		inv.Amount += l.Amount
+	}
+	settlePending(s, inv)
+	return inv, lines, nil
+}
+
+// changePlan makes a plan change requested with an update. It returns
+// false once it has answered the request.
+func (b *Billing) changePlan(c *gin.Context, ch *planChange) (*BillingSubscription, bool) {
+	ctx := c.Request.Context()
+	sub, err := b.store.BillingSubscription(ctx, c.Param("id"))
+	if !b.respondChange(c, sub, err) {
+		return nil, false
+	}
+	from, to, ok := b.changePlans(c, sub, ch)
+	if !ok {
+		return nil, false
+	}
+	at := prorationTime(ch)
+	var invoiced *BillingInvoice
+	sub, err = b.change(ctx, sub.ID, func(s *BillingSubscription, latest *BillingInvoice) (*BillingInvoice, error) {
+		inv, _, err := applyPlanChange(s, latest, from, to, ch, at)
+		invoiced = inv
+		return inv, err
+	})
+	if !b.respondChange(c, sub, err) {
+		return nil, false
+	}
+	if invoiced != nil && invoiced.Status == billingInvoiceOpen {
+		sub = b.chargeNow(ctx, sub)
+	}
+	return sub, true
+}
+
+func prorationTime(ch *planChange) time.Time {
+	if ch.ProrationDate != nil {
+		return ch.ProrationDate.UTC()
+	}
+	return time.Now().UTC()
+}
+
+// previewChange shows what a plan or quantity change would bill, without
+// making it: the prorations, the invoice always_invoice would charge
+// now, and the next renewal invoice, as drafts. It runs the change itself
+// and rolls it back. The response's proration_date, sent
+// back with the change, bills exactly this.
+func (b *Billing) previewChange(c *gin.Context) {
+	var ch planChange
+	if !bindJSON(c, &ch) {
+		return
+	}
+	if !ch.requested() {
+		validationFailed(c, []FieldError{{Field: "plan_id", Code: "required", Message: "plan_id or quantity is required"}})
+		return
+	}
+	ctx := c.Request.Context()
+	sub, err := b.store.BillingSubscription(ctx, c.Param("id"))
+	if !b.respondChange(c, sub, err) {
+		return
+	}
+	from, to, ok := b.changePlans(c, sub, &ch)
+	if !ok {
+		return
+	}
+	at := prorationTime(&ch)
+
+	var preview gin.H
+	_, err = b.store.changeBillingSubscription(ctx, sub.ID, func(s *BillingSubscription, latest *BillingInvoice) (*BillingInvoice, error) {
+		inv, lines, err := applyPlanChange(s, latest, from, to, &ch, at)
+		if err != nil {
+			return nil, err
+		}
+		var net int64
+		for _, l := range lines {
+			net += l.Amount
+		}
+		var next *BillingInvoice
+		if !s.CancelAtPeriodEnd {
+			end, price := to.period(s.BillingCycleAnchor, s.CurrentPeriodEnd)
+			next = newBillingInvoice(s, to, s.CurrentPeriodEnd, end, price)
+			settlePending(s, next)
+			next.ID, next.Status, next.NextAttemptAt, next.PaidAt = "", "draft", nil, nil
+		}
+		if inv != nil {
+			inv.ID, inv.Status, inv.NextAttemptAt, inv.PaidAt = "", "draft", nil, nil
+		}
+		behavior := ch.ProrationBehavior
+		if behavior == "" {
+			behavior = prorationCreate
+		}
+		preview = gin.H{
+			"subscription_id":    s.ID,
+			"plan_id":            s.PlanID,
+			"quantity":           s.Quantity,
+			"proration_date":     at,
+			"proration_behavior": behavior,
+			"prorations":         lines,
+			"proration_amount":   net,
+			"invoice":            inv,
+			"next_invoice":       next,
+		}
+		return nil, errPreviewOnly
+	})
+	if errors.Is(err, errPreviewOnly) {
+		respondData(c, http.StatusOK, preview)
+		return
+	}
+	b.respondChange(c, sub, err)
+}
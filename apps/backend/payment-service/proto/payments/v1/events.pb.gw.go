@@ -0,0 +1,147 @@
+// Code generated by protoc-gen-grpc-gateway. DO NOT EDIT.
+// source: payments/v1/events.proto
+
+/*
+Package paymentsv1 is a reverse proxy.
+
+It translates gRPC into RESTful JSON APIs.
+*/
+package paymentsv1
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/utilities"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Suppress "imported and not used" errors
+var _ codes.Code
+var _ io.Reader
+var _ status.Status
+var _ = runtime.String
+var _ = utilities.NewDoubleArray
+var _ = metadata.Join
+
+var (
+	filter_PaymentEventsService_WatchPayments_0 = &utilities.DoubleArray{Encoding: map[string]int{}, Base: []int(nil), Check: []int(nil)}
+)
+
+func request_PaymentEventsService_WatchPayments_0(ctx context.Context, marshaler runtime.Marshaler, client PaymentEventsServiceClient, req *http.Request, pathParams map[string]string) (PaymentEventsService_WatchPaymentsClient, runtime.ServerMetadata, error) {
+	var protoReq WatchPaymentsRequest
+	var metadata runtime.ServerMetadata
+
+	if err := req.ParseForm(); err != nil {
+		return nil, metadata, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if err := runtime.PopulateQueryParameters(&protoReq, req.Form, filter_PaymentEventsService_WatchPayments_0); err != nil {
+		return nil, metadata, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	stream, err := client.WatchPayments(ctx, &protoReq)
+	if err != nil {
+		return nil, metadata, err
+	}
+	header, err := stream.Header()
+	if err != nil {
+		return nil, metadata, err
+	}
+	metadata.HeaderMD = header
+	return stream, metadata, nil
+
+}
+
+// RegisterPaymentEventsServiceHandlerServer registers the http handlers for service PaymentEventsService to "mux".
+// UnaryRPC     :call PaymentEventsServiceServer directly.
+// StreamingRPC :currently unsupported pending https://github.com/grpc/grpc-go/issues/906.
+// Note that using this registration option will cause many gRPC library features to stop working. Consider using RegisterPaymentEventsServiceHandlerFromEndpoint instead.
+func RegisterPaymentEventsServiceHandlerServer(ctx context.Context, mux *runtime.ServeMux, server PaymentEventsServiceServer) error {
+
+	mux.Handle("GET", pattern_PaymentEventsService_WatchPayments_0, func(w http.ResponseWriter, req *http.Request, pathParams map[string]string) {
+		err := status.Error(codes.Unimplemented, "streaming calls are not yet supported in the in-process transport")
+		_, outboundMarshaler := runtime.MarshalerForRequest(mux, req)
+		runtime.HTTPError(ctx, mux, outboundMarshaler, w, req, err)
+		return
+	})
+
+	return nil
+}
+
+// RegisterPaymentEventsServiceHandlerFromEndpoint is same as RegisterPaymentEventsServiceHandler but
+// automatically dials to "endpoint" and closes the connection when "ctx" gets done.
+func RegisterPaymentEventsServiceHandlerFromEndpoint(ctx context.Context, mux *runtime.ServeMux, endpoint string, opts []grpc.DialOption) (err error) {
+	conn, err := grpc.DialContext(ctx, endpoint, opts...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if cerr := conn.Close(); cerr != nil {
+				grpclog.Infof("Failed to close conn to %s: %v", endpoint, cerr)
+			}
+			return
+		}
+		go func() {
+			<-ctx.Done()
+			if cerr := conn.Close(); cerr != nil {
+				grpclog.Infof("Failed to close conn to %s: %v", endpoint, cerr)
+			}
+		}()
+	}()
+
+	return RegisterPaymentEventsServiceHandler(ctx, mux, conn)
+}
+
+// RegisterPaymentEventsServiceHandler registers the http handlers for service PaymentEventsService to "mux".
+// The handlers forward requests to the grpc endpoint over "conn".
+func RegisterPaymentEventsServiceHandler(ctx context.Context, mux *runtime.ServeMux, conn *grpc.ClientConn) error {
+	return RegisterPaymentEventsServiceHandlerClient(ctx, mux, NewPaymentEventsServiceClient(conn))
+}
+
+// RegisterPaymentEventsServiceHandlerClient registers the http handlers for service PaymentEventsService
+// to "mux". The handlers forward requests to the grpc endpoint over the given implementation of "PaymentEventsServiceClient".
+// Note: the gRPC framework executes interceptors within the gRPC handler. If the passed in "PaymentEventsServiceClient"
+// doesn't go through the normal gRPC flow (creating a gRPC client etc.) then it will be up to the passed in
+// "PaymentEventsServiceClient" to call the correct interceptors.
+func RegisterPaymentEventsServiceHandlerClient(ctx context.Context, mux *runtime.ServeMux, client PaymentEventsServiceClient) error {
+
+	mux.Handle("GET", pattern_PaymentEventsService_WatchPayments_0, func(w http.ResponseWriter, req *http.Request, pathParams map[string]string) {
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		inboundMarshaler, outboundMarshaler := runtime.MarshalerForRequest(mux, req)
+		var err error
+		var annotatedContext context.Context
+		annotatedContext, err = runtime.AnnotateContext(ctx, mux, req, "/payments.v1.PaymentEventsService/WatchPayments", runtime.WithHTTPPathPattern("/v1/payments:watch"))
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outboundMarshaler, w, req, err)
+			return
+		}
+		resp, md, err := request_PaymentEventsService_WatchPayments_0(annotatedContext, inboundMarshaler, client, req, pathParams)
+		annotatedContext = runtime.NewServerMetadataContext(annotatedContext, md)
+		if err != nil {
+			runtime.HTTPError(annotatedContext, mux, outboundMarshaler, w, req, err)
+			return
+		}
+
+		forward_PaymentEventsService_WatchPayments_0(annotatedContext, mux, outboundMarshaler, w, req, func() (proto.Message, error) { return resp.Recv() }, mux.GetForwardResponseOptions()...)
+
+	})
+
+	return nil
+}
+
+var (
+	pattern_PaymentEventsService_WatchPayments_0 = runtime.MustPattern(runtime.NewPattern(1, []int{2, 0, 2, 1}, []string{"v1", "payments"}, "watch"))
+)
+
+var (
+	forward_PaymentEventsService_WatchPayments_0 = runtime.ForwardResponseStream
+)
@@ -0,0 +1,151 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: payments/v1/events.proto
+
+// Payment lifecycle events, for internal consumers that want them as they
+// happen rather than by polling the REST API or reading the Kafka topics.
+
+package paymentsv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	PaymentEventsService_WatchPayments_FullMethodName = "/payments.v1.PaymentEventsService/WatchPayments"
+)
+
+// PaymentEventsServiceClient is the client API for PaymentEventsService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PaymentEventsServiceClient interface {
+	// WatchPayments streams lifecycle events of the payments matching the
+	// request, from when the call starts, until the client cancels it.
+	// Filters left empty match everything; set ones must all match. A
+	// consumer that falls behind by more than a small buffer loses events
+	// rather than slowing the service down; payments can be read back from
+	// the REST API to catch up.
+	WatchPayments(ctx context.Context, in *WatchPaymentsRequest, opts ...grpc.CallOption) (PaymentEventsService_WatchPaymentsClient, error)
+}
+
+type paymentEventsServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPaymentEventsServiceClient(cc grpc.ClientConnInterface) PaymentEventsServiceClient {
+	return &paymentEventsServiceClient{cc}
+}
+
+func (c *paymentEventsServiceClient) WatchPayments(ctx context.Context, in *WatchPaymentsRequest, opts ...grpc.CallOption) (PaymentEventsService_WatchPaymentsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &PaymentEventsService_ServiceDesc.Streams[0], PaymentEventsService_WatchPayments_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &paymentEventsServiceWatchPaymentsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type PaymentEventsService_WatchPaymentsClient interface {
+	Recv() (*WatchPaymentsResponse, error)
+	grpc.ClientStream
+}
+
+type paymentEventsServiceWatchPaymentsClient struct {
+	grpc.ClientStream
+}
+
+func (x *paymentEventsServiceWatchPaymentsClient) Recv() (*WatchPaymentsResponse, error) {
+	m := new(WatchPaymentsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PaymentEventsServiceServer is the server API for PaymentEventsService service.
+// All implementations must embed UnimplementedPaymentEventsServiceServer
+// for forward compatibility
+type PaymentEventsServiceServer interface {
+	// WatchPayments streams lifecycle events of the payments matching the
+	// request, from when the call starts, until the client cancels it.
+	// Filters left empty match everything; set ones must all match. A
+	// consumer that falls behind by more than a small buffer loses events
+	// rather than slowing the service down; payments can be read back from
+	// the REST API to catch up.
+	WatchPayments(*WatchPaymentsRequest, PaymentEventsService_WatchPaymentsServer) error
+	mustEmbedUnimplementedPaymentEventsServiceServer()
+}
+
+// UnimplementedPaymentEventsServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedPaymentEventsServiceServer struct {
+}
+
+func (UnimplementedPaymentEventsServiceServer) WatchPayments(*WatchPaymentsRequest, PaymentEventsService_WatchPaymentsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchPayments not implemented")
+}
+func (UnimplementedPaymentEventsServiceServer) mustEmbedUnimplementedPaymentEventsServiceServer() {}
+
+// UnsafePaymentEventsServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PaymentEventsServiceServer will
+// result in compilation errors.
+type UnsafePaymentEventsServiceServer interface {
+	mustEmbedUnimplementedPaymentEventsServiceServer()
+}
+
+func RegisterPaymentEventsServiceServer(s grpc.ServiceRegistrar, srv PaymentEventsServiceServer) {
+	s.RegisterService(&PaymentEventsService_ServiceDesc, srv)
+}
+
+func _PaymentEventsService_WatchPayments_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchPaymentsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PaymentEventsServiceServer).WatchPayments(m, &paymentEventsServiceWatchPaymentsServer{stream})
+}
+
+type PaymentEventsService_WatchPaymentsServer interface {
+	Send(*WatchPaymentsResponse) error
+	grpc.ServerStream
+}
+
+type paymentEventsServiceWatchPaymentsServer struct {
+	grpc.ServerStream
+}
+
+func (x *paymentEventsServiceWatchPaymentsServer) Send(m *WatchPaymentsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// PaymentEventsService_ServiceDesc is the grpc.ServiceDesc for PaymentEventsService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var PaymentEventsService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "payments.v1.PaymentEventsService",
+	HandlerType: (*PaymentEventsServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchPayments",
+			Handler:       _PaymentEventsService_WatchPayments_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "payments/v1/events.proto",
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/balance"
+)
+
+var (
+	providerUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "payment_service_provider_up",
+		Help: "Whether the provider account answered its last health checks, by account (primary, alternate).",
+	}, []string{"account"})
+	providerPingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "payment_service_provider_ping_seconds",
+		Help:    "Latency of the background provider health check, a balance retrieve, by account.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"account"})
+)
+
+// AccountHealth is the cached result of checking one provider account.
+type AccountHealth struct {
+	Healthy   bool      `json:"healthy"`
+	LatencyMS int64     `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+	// Failures counts the checks failed in a row.
+	Failures int    `json:"consecutive_failures"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ProviderHealth retrieves the balance of each Stripe account in the
+// background, the cheapest authenticated call there is, and keeps the
+// outcome and latency for /readyz and the metrics, so an outage with
+// Stripe or a revoked key shows on dashboards and takes instances out
+// of rotation before customers meet it as 500s. An account is unhealthy
+// after failures checks in a row fail, so one slow answer doesn't flap
+// readiness. Until the first check it counts as healthy.
+type ProviderHealth struct {
+	interval time.Duration
+	timeout  time.Duration
+	failures int
+	// keys are the accounts' secret keys, by arm.
+	keys map[string]string
+
+	mu       sync.Mutex
+	accounts map[string]*AccountHealth
+}
+
+func NewProviderHealth(altKey string, interval, timeout time.Duration, failures int) *ProviderHealth {
+	ph := &ProviderHealth{
+		interval: interval,
+		timeout:  timeout,
+		failures: failures,
+		keys:     map[string]string{armPrimary: stripe.Key},
+		accounts: map[string]*AccountHealth{},
+	}
+	if altKey != "" {
+		ph.keys[armAlternate] = altKey
+	}
+	for arm := range ph.keys {
+		ph.accounts[arm] = &AccountHealth{Healthy: true}
+		providerUp.WithLabelValues(arm).Set(1)
+	}
+	return ph
+}
+
+// Run checks every account right away, then every interval until ctx is
+// done.
+func (ph *ProviderHealth) Run(ctx context.Context) {
+	ticker := time.NewTicker(ph.interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for arm, key := range ph.keys {
+			wg.Add(1)
+			go func(arm, key string) {
+				defer wg.Done()
+				ph.check(ctx, arm, key)
+			}(arm, key)
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ph *ProviderHealth) check(ctx context.Context, arm, key string) {
+	ctx, cancel := context.WithTimeout(ctx, ph.timeout)
+	defer cancel()
+	params := &stripe.BalanceParams{}
+	params.Context = ctx
+	client := balance.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
+
+	started := time.Now()
+	_, err := client.Get(params)
+	elapsed := time.Since(started)
+	providerPingDuration.WithLabelValues(arm).Observe(elapsed.Seconds())
+
+	ph.mu.Lock()
+	h := ph.accounts[arm]
+	wasHealthy := h.Healthy
+	h.CheckedAt, h.LatencyMS = time.Now().UTC(), elapsed.Milliseconds()
+	if err != nil {
+		h.Failures++
+		h.Error = err.Error()
+		h.Healthy = h.Failures < ph.failures
+	} else {
+		h.Failures, h.Error, h.Healthy = 0, "", true
+	}
+	healthy := h.Healthy
+	ph.mu.Unlock()
+
+	if healthy {
+		providerUp.WithLabelValues(arm).Set(1)
+	} else {
+		providerUp.WithLabelValues(arm).Set(0)
+	}
+	switch {
+	case wasHealthy && !healthy:
+		log.Printf("provider health: %s account unhealthy after %d failed checks: %v", arm, ph.failures, err)
+	case !wasHealthy && healthy:
+		log.Printf("provider health: %s account healthy again (%dms)", arm, elapsed.Milliseconds())
+	}
+}
+
+// Status is a copy of each account's health, and whether all of them are
+// healthy.
+func (ph *ProviderHealth) Status() (map[string]AccountHealth, bool) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	out := make(map[string]AccountHealth, len(ph.accounts))
+	ok := true
+	for arm, h := range ph.accounts {
+		out[arm] = *h
+		ok = ok && h.Healthy
+	}
+	return out, ok
+}
+
+// readyz answers 200 while the service can take payments: the database,
+// when there is one, answers a ping with connections to spare in its
+// pool, and the provider accounts passed their recent checks. Otherwise
+// it answers 503 with what failed. Unlike /health, which only says the
+// process is up, it is meant for load balancer readiness.
+func readyz(store *Store, ph *ProviderHealth) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ready := true
+		body := gin.H{"service": "payment-service"}
+
+		accounts, ok := ph.Status()
+		body["provider"] = accounts
+		ready = ready && ok
+
+		if store != nil {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second)
+			started := time.Now()
+			err := store.db.PingContext(ctx)
+			cancel()
+			db := gin.H{"healthy": err == nil, "latency_ms": time.Since(started).Milliseconds()}
+			if err != nil {
+				db["error"] = err.Error()
+				ready = false
+			}
+			pool, saturated := store.poolStatus()
+			db["pool"] = pool
+			if saturated {
+				db["healthy"] = false
+				db["error"] = "connection pool saturated"
+				ready = false
+			}
+			body["database"] = db
+		}
+
+		status := http.StatusOK
+		body["status"] = "ready"
+		if !ready {
+			status = http.StatusServiceUnavailable
+			body["status"] = "not_ready"
+		}
+		respondData(c, status, body)
+	}
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+)
+
+var (
+	routedPayments = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_routed_payments_total",
+		Help: "A/B-routed payments by arm and result (created, failed, succeeded, payment_failed).",
+	}, []string{"arm", "result"})
+	routedCreateLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "payment_service_routed_create_seconds",
+		Help:    "Payment creation latency of A/B-routed payments, by arm.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"arm"})
+)
+
+const (
+	armPrimary   = "primary"
+	armAlternate = "alternate"
+
+	// metadataProviderArm records the arm a routed payment went to.
+	metadataProviderArm = "provider_arm"
+
+	// routeCacheSize bounds the payments whose arm is remembered in
+	// memory; past it the cache starts over and reads from the store.
+	routeCacheSize = 10000
+)
+
+// ProviderRoutingConfig sends a share of eligible live payments to the
+// alternate provider account set up with ALT_STRIPE_SECRET_KEY.
+//
+//	"provider_routing": {"alternate_percent": 10, "salt": "2026-10", "currencies": ["eur"]}
+//
+// Assignment is sticky: a customer's bucket is a hash of the salt and
+// their receipt email, or the order when there is none, so raising the
+// percentage only adds customers to the alternate arm and a new salt
+// draws new ones.
+//
+// In smart mode each payment goes to the arm expected to net the most,
+// from the arms' fees and auth rates and their API health; the sticky
+// assignment only decides while there is too little history, so
+// alternate_percent is what gathers it.
+//
+//	"provider_routing": {"mode": "smart", "alternate_percent": 10, "min_samples": 100,
+//	  "fees": {"primary": {"percent": 2.9, "fixed": 30}, "alternate": {"percent": 2.5, "fixed": 25}}}
+//
+// To move between accounts, say when the business moves to a new legal
+// entity, tenants can be pinned to an account one at a time, ahead of
+// the percentage and smart routing. A pinned tenant's payments all go
+// to its account, including those with a customer, saved payment method
+// or transfer, so pin a tenant to the alternate once those have been
+// copied there.
+//
+//	"provider_routing": {"tenant_arms": {"acme": "alternate", "globex": "alternate"}, "alternate_percent": 5}
+type ProviderRoutingConfig struct {
+	AlternatePercent float64 `json:"alternate_percent"`
+	Salt             string  `json:"salt"`
+	// Currencies and Tenants limit the experiment; empty means all.
+	Currencies []string `json:"currencies"`
+	Tenants    []string `json:"tenants"`
+	// TenantArms pins tenants to primary or alternate.
+	TenantArms map[string]string `json:"tenant_arms"`
+	// Mode is percent, the default, or smart.
+	Mode string `json:"mode"`
+	// Fees prices each arm for smart routing; an arm without an entry is
+	// taken to charge nothing.
+	Fees map[string]ArmFees `json:"fees"`
+	// MinSamples is how many decided payments each arm needs with a BIN,
+	// country or method before its auth rate there is trusted. Zero
+	// means 50.
+	MinSamples int `json:"min_samples"`
+	// MaxErrorRate takes an arm out of smart routing while more of its
+	// recent API calls fail. Zero means 0.25.
+	MaxErrorRate float64 `json:"max_error_rate"`
+}
+
+func (cfg ProviderRoutingConfig) validate() error {
+	if cfg.AlternatePercent < 0 || cfg.AlternatePercent > 100 {
+		return fmt.Errorf("provider_routing: alternate_percent must be between 0 and 100")
+	}
+	for _, cur := range cfg.Currencies {
+		if len(cur) != 3 {
+			return fmt.Errorf("provider_routing: currencies %q must be a currency code", cur)
+		}
+	}
+	switch cfg.Mode {
+	case "", routingModePercent, routingModeSmart:
+	default:
+		return fmt.Errorf("provider_routing: mode must be percent or smart")
+	}
+	for tenant, arm := range cfg.TenantArms {
+		if tenant == "" || (arm != armPrimary && arm != armAlternate) {
+			return fmt.Errorf("provider_routing: tenant_arms %q must be primary or alternate", tenant)
+		}
+	}
+	for arm, f := range cfg.Fees {
+		if arm != armPrimary && arm != armAlternate {
+			return fmt.Errorf("provider_routing: fees %q must be primary or alternate", arm)
+		}
+		if f.Percent < 0 || f.Percent >= 100 || f.Fixed < 0 {
+			return fmt.Errorf("provider_routing: fees %s must have a percent below 100 and a fixed fee of at least 0", arm)
+		}
+	}
+	if cfg.MinSamples < 0 {
+		return fmt.Errorf("provider_routing: min_samples must be at least 0")
+	}
+	if cfg.MaxErrorRate < 0 || cfg.MaxErrorRate > 1 {
+		return fmt.Errorf("provider_routing: max_error_rate must be between 0 and 1")
+	}
+	return nil
+}
+
+func (cfg ProviderRoutingConfig) minSamples() int {
+	if cfg.MinSamples == 0 {
+		return 50
+	}
+	return cfg.MinSamples
+}
+
+func (cfg ProviderRoutingConfig) maxErrorRate() float64 {
+	if cfg.MaxErrorRate == 0 {
+		return 0.25
+	}
+	return cfg.MaxErrorRate
+}
+
+// routingKey is what keeps a customer on one arm, or "" when the payment
+// has nothing to stick to.
+func routingKey(req PaymentRequest) string {
+	if req.ReceiptEmail != "" {
+		return "email:" + strings.ToLower(req.ReceiptEmail)
+	}
+	if req.OrderID != "" {
+		return "order:" + req.OrderID
+	}
+	return ""
+}
+
+// eligible reports whether req is part of the experiment. Payments tied
+// to objects only the primary account has, a Stripe customer, a saved
+// payment method or a transfer to a connected account, never are, nor
+// are percentage-routed ones without anything to stick to.
+func (cfg ProviderRoutingConfig) eligible(req PaymentRequest) bool {
+	switch {
+	case cfg.Mode != routingModeSmart && (cfg.AlternatePercent <= 0 || routingKey(req) == ""):
+		return false
+	case req.CustomerID != "", req.PaymentMethod != "", req.transferGroup != "":
+		return false
+	case len(cfg.Currencies) > 0 && !containsFold(cfg.Currencies, req.Currency):
+		return false
+	case len(cfg.Tenants) > 0 && !containsString(cfg.Tenants, req.TenantID):
+		return false
+	}
+	return true
+}
+
+// bucketArm is the sticky assignment of key, or "" for no key.
+func (cfg ProviderRoutingConfig) bucketArm(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(cfg.Salt + "\x00" + key))
+	bucket := binary.BigEndian.Uint64(sum[:8]) % 10000
+	if float64(bucket) < cfg.AlternatePercent*100 {
+		return armAlternate
+	}
+	return armPrimary
+}
+
+// alternatePublishableKey is handed to clients confirming a payment on
+// the alternate arm, whose intents Stripe.js must load with it.
+var alternatePublishableKey string
+
+// ProviderRouting A/B tests an alternate provider account against the
+// primary on live traffic. Payments.Params assigns each eligible payment
+// an arm and marks it in metadata; a backend wrapped around Stripe's then
+// sends the intent's creation, and every later call about it, with the
+// arm's key. Routed payments, eligible ones on either arm, are recorded
+// with their creation latency and outcome, which webhooks from either
+// account update, so the report compares auth rates, latency and synced
+// fees per arm. Payments outside the experiment aren't recorded.
+type ProviderRouting struct {
+	stripe.Backend
+	store    *Store
+	settings *RuntimeSettings
+	altKey   string
+	// interval and lookback are how often and over how long the auth
+	// rates smart routing uses are refreshed.
+	interval time.Duration
+	lookback time.Duration
+
+	mu   sync.Mutex
+	arms map[string]string
+
+	health map[string]*armHealth
+	stats  atomic.Pointer[routingStats]
+}
+
+// NewProviderRouting installs routing when ALT_STRIPE_SECRET_KEY names an
+// alternate account, and otherwise returns nil.
+func NewProviderRouting(store *Store, settings *RuntimeSettings, interval, lookback time.Duration) *ProviderRouting {
+	key := os.Getenv("ALT_STRIPE_SECRET_KEY")
+	if key == "" {
+		return nil
+	}
+	alternatePublishableKey = os.Getenv("ALT_STRIPE_PUBLISHABLE_KEY")
+	pr := &ProviderRouting{
+		Backend:  stripe.GetBackend(stripe.APIBackend),
+		store:    store,
+		settings: settings,
+		altKey:   key,
+		interval: interval,
+		lookback: lookback,
+		arms:     map[string]string{},
+		health:   map[string]*armHealth{armPrimary: {}, armAlternate: {}},
+	}
+	stripe.SetBackend(stripe.APIBackend, pr)
+	return pr
+}
+
+// route marks params with req's arm when it is part of the experiment,
+// and with the decision when smart routing made it. card is the payment's
+// card when known.
+func (pr *ProviderRouting) route(req PaymentRequest, card paymentCard, params *stripe.PaymentIntentParams) {
+	if pr == nil || req.dryRun {
+		return
+	}
+	cfg := pr.settings.Get()
+	routing := cfg.ProviderRouting
+	if arm, ok := routing.TenantArms[req.TenantID]; ok && req.TenantID != "" {
+		params.AddMetadata(metadataProviderArm, arm)
+		params.AddMetadata(metadataRoutingDecision, decisionMetadata(routingDecision{Arm: arm, Reason: routeReasonTenant}))
+		return
+	}
+	if !routing.eligible(req) {
+		return
+	}
+	if routing.Mode != routingModeSmart {
+		if arm := routing.bucketArm(routingKey(req)); arm != "" {
+			params.AddMetadata(metadataProviderArm, arm)
+		}
+		return
+	}
+	country := card.Country
+	if country == "" {
+		country = strings.ToUpper(req.CustomerCountry)
+	}
+	method := ""
+	if len(params.PaymentMethodTypes) == 1 {
+		method = *params.PaymentMethodTypes[0]
+	}
+	d := pr.decide(routing, cfg.Rounding.mode(strings.ToLower(req.Currency)), req.Amount, card.BIN, country, method, routingKey(req))
+	params.AddMetadata(metadataProviderArm, d.Arm)
+	params.AddMetadata(metadataRoutingDecision, decisionMetadata(d))
+}
+
+// alternateKey is the alternate account's secret key, or "" without one.
+func (pr *ProviderRouting) alternateKey() string {
+	if pr == nil {
+		return ""
+	}
+	return pr.altKey
+}
+
+func (pr *ProviderRouting) remember(paymentID, arm string) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if len(pr.arms) >= routeCacheSize {
+		pr.arms = map[string]string{}
+	}
+	pr.arms[paymentID] = arm
+}
+
+// armOf is the arm a payment went to; payments never routed are the
+// primary's.
+func (pr *ProviderRouting) armOf(ctx context.Context, paymentID string) string {
+	pr.mu.Lock()
+	arm, ok := pr.arms[paymentID]
+	pr.mu.Unlock()
+	if ok {
+		return arm
+	}
+	arm = armPrimary
+	if pr.store != nil {
+		err := pr.store.db.QueryRowContext(ctx, `SELECT arm FROM payment_routes WHERE payment_id = $1`, paymentID).Scan(&arm)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			// Not remembered, so the next call asks again.
+			log.Printf("provider routing: arm of %s: %v", paymentID, err)
+			return armPrimary
+		}
+	}
+	pr.remember(paymentID, arm)
+	return arm
+}
+
+// keyFor is the key to send a call with: the alternate's for creating an
+// intent marked for it and for calls about such an intent or its refunds.
+func (pr *ProviderRouting) keyFor(method, path, key string, params stripe.ParamsContainer) string {
+	ctx := context.Background()
+	if p := paramsOf(params); p != nil && p.Context != nil {
+		ctx = p.Context
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/v1/"), "/")
+	arm := armPrimary
+	switch {
+	case path == "/v1/payment_intents" && method == http.MethodPost:
+		if p, ok := params.(*stripe.PaymentIntentParams); ok && p != nil {
+			arm = p.Metadata[metadataProviderArm]
+		}
+	case parts[0] == "payment_intents" && len(parts) > 1 && strings.HasPrefix(parts[1], "pi_"):
+		arm = pr.armOf(ctx, parts[1])
+	case path == "/v1/refunds" && method == http.MethodPost:
+		if p, ok := params.(*stripe.RefundParams); ok && p != nil && p.PaymentIntent != nil {
+			arm = pr.armOf(ctx, *p.PaymentIntent)
+		}
+	}
+	if arm == armAlternate {
+		return pr.altKey
+	}
+	return key
+}
+
+func (pr *ProviderRouting) Call(method, path, key string, params stripe.ParamsContainer, v stripe.LastResponseSetter) error {
+	routed := pr.keyFor(method, path, key, params)
+	err := pr.Backend.Call(method, path, routed, params, v)
+	// Payment calls tell whether each arm's API is up.
+	if strings.HasPrefix(path, "/v1/payment_intents") || path == "/v1/refunds" {
+		arm := armPrimary
+		if routed == pr.altKey {
+			arm = armAlternate
+		}
+		pr.health[arm].record(providerFailure(err))
+	}
+	return err
+}
+
+// created records a routed payment's arm and creation latency.
+func (pr *ProviderRouting) created(ctx context.Context, pi *stripe.PaymentIntent, latency time.Duration) {
+	arm := pi.Metadata[metadataProviderArm]
+	if pr == nil || arm == "" {
+		return
+	}
+	pr.remember(pi.ID, arm)
+	routedPayments.WithLabelValues(arm, "created").Inc()
+	routedCreateLatency.WithLabelValues(arm).Observe(latency.Seconds())
+	if pr.store == nil {
+		return
+	}
+	reason, decision := routeReasonPercent, []byte(nil)
+	if raw := pi.Metadata[metadataRoutingDecision]; raw != "" {
+		var d routingDecision
+		if err := json.Unmarshal([]byte(raw), &d); err == nil {
+			reason, decision = d.Reason, []byte(raw)
+		}
+	}
+	if _, err := pr.store.db.ExecContext(ctx, `
+		INSERT INTO payment_routes (payment_id, arm, latency_ms, reason, decision) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (payment_id) DO NOTHING`, pi.ID, arm, latency.Milliseconds(), reason, decision); err != nil {
+		logf(ctx, "recording route of %s: %v", pi.ID, err)
+	}
+}
+
+// failed counts a routed payment whose creation failed.
+func (pr *ProviderRouting) failed(params *stripe.PaymentIntentParams, latency time.Duration) {
+	arm := params.Metadata[metadataProviderArm]
+	if pr == nil || arm == "" {
+		return
+	}
+	routedPayments.WithLabelValues(arm, "failed").Inc()
+	routedCreateLatency.WithLabelValues(arm).Observe(latency.Seconds())
+}
+
+// paymentIntentEvent records the outcome of a routed payment. A success
+// is final; a failed confirmation may still be followed by one.
+func (pr *ProviderRouting) paymentIntentEvent(ctx context.Context, typ stripe.EventType, pi *stripe.PaymentIntent) error {
+	arm := pi.Metadata[metadataProviderArm]
+	if pr == nil || arm == "" {
+		return nil
+	}
+	var outcome string
+	switch typ {
+	case "payment_intent.succeeded", "payment_intent.amount_capturable_updated":
+		outcome = "succeeded"
+		routedPayments.WithLabelValues(arm, "succeeded").Inc()
+	case "payment_intent.payment_failed":
+		outcome = "failed"
+		routedPayments.WithLabelValues(arm, "payment_failed").Inc()
+	default:
+		return nil
+	}
+	if pr.store == nil {
+		return nil
+	}
+	// A failed attempt's card only comes with the error; a success's
+	// with its charge.
+	var bin, country, method string
+	if pi.LastPaymentError != nil && pi.LastPaymentError.PaymentMethod != nil && outcome == "failed" {
+		pm := pi.LastPaymentError.PaymentMethod
+		method = string(pm.Type)
+		if pm.Card != nil {
+			bin, country = pm.Card.IIN, pm.Card.Country
+		}
+	}
+	_, err := pr.store.db.ExecContext(ctx, `
+		INSERT INTO payment_routes (payment_id, arm, outcome, card_bin, card_country, payment_method) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (payment_id) DO UPDATE SET outcome = EXCLUDED.outcome,
+			card_bin = COALESCE(NULLIF(EXCLUDED.card_bin, ''), payment_routes.card_bin),
+			card_country = COALESCE(NULLIF(EXCLUDED.card_country, ''), payment_routes.card_country),
+			payment_method = COALESCE(NULLIF(EXCLUDED.payment_method, ''), payment_routes.payment_method),
+			updated_at = now()
+		WHERE payment_routes.outcome <> 'succeeded'`, pi.ID, arm, outcome, bin, country, method)
+	if err != nil {
+		return fmt.Errorf("recording outcome of %s: %w", pi.ID, err)
+	}
+	return nil
+}
+
+// ArmReport compares one arm over a period. AuthRate is succeeded over
+// payments with an outcome; fees are those synced so far, in basis
+// points of the amounts they were charged on.
+type ArmReport struct {
+	Arm          string   `json:"arm"`
+	Payments     int64    `json:"payments"`
+	Succeeded    int64    `json:"succeeded"`
+	Failed       int64    `json:"failed"`
+	Pending      int64    `json:"pending"`
+	AuthRate     *float64 `json:"auth_rate"`
+	AvgLatencyMS float64  `json:"avg_latency_ms"`
+	FeesSynced   int64    `json:"fees_synced"`
+	AvgFeeBPS    *float64 `json:"avg_fee_bps"`
+}
+
+func (s *Store) ProviderRoutingReport(ctx context.Context, from, to time.Time) ([]ArmReport, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT r.arm, COUNT(*),
+			COUNT(*) FILTER (WHERE r.outcome = 'succeeded'),
+			COUNT(*) FILTER (WHERE r.outcome = 'failed'),
+			COUNT(*) FILTER (WHERE r.outcome = 'pending'),
+			COALESCE(AVG(r.latency_ms) FILTER (WHERE r.latency_ms > 0), 0),
+			COUNT(f.payment_id),
+			AVG(f.fee::float8 / NULLIF(f.amount, 0)) * 10000
+		FROM payment_routes r
+		LEFT JOIN (
+			SELECT payment_id, SUM(fee) AS fee, SUM(amount) AS amount FROM payment_fees
+			WHERE payment_id <> '' AND type IN ('charge', 'payment') GROUP BY payment_id
+		) f ON f.payment_id = r.payment_id
+		WHERE r.created_at >= $1 AND r.created_at < $2
+		GROUP BY r.arm ORDER BY r.arm`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []ArmReport{}
+	for rows.Next() {
+		var a ArmReport
+		var bps sql.NullFloat64
+		if err := rows.Scan(&a.Arm, &a.Payments, &a.Succeeded, &a.Failed, &a.Pending, &a.AvgLatencyMS, &a.FeesSynced, &bps); err != nil {
+			return nil, err
+		}
+		if decided := a.Succeeded + a.Failed; decided > 0 {
+			rate := float64(a.Succeeded) / float64(decided)
+			a.AuthRate = &rate
+		}
+		if bps.Valid {
+			a.AvgFeeBPS = &bps.Float64
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+func (pr *ProviderRouting) RegisterRoutes(r gin.IRouter, bootstrapToken string) {
+	g := r.Group("/admin/routing", requireScope(pr.store, bootstrapToken, "admin"))
+	g.GET("/report", pr.report)
+	g.GET("/payments/:id", pr.paymentRoute)
+}
+
+// PaymentRoute is how a payment was routed, for audits.
+type PaymentRoute struct {
+	PaymentID     string          `json:"payment_id"`
+	Arm           string          `json:"arm"`
+	Reason        string          `json:"reason"`
+	Decision      json.RawMessage `json:"decision,omitempty"`
+	Outcome       string          `json:"outcome"`
+	LatencyMS     int64           `json:"latency_ms"`
+	CardBIN       string          `json:"card_bin,omitempty"`
+	CardCountry   string          `json:"card_country,omitempty"`
+	PaymentMethod string          `json:"payment_method,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+}
+
+func (s *Store) PaymentRoute(ctx context.Context, paymentID string) (*PaymentRoute, error) {
+	var r PaymentRoute
+	var decision []byte
+	err := s.db.QueryRowContext(ctx, `
+		SELECT payment_id, arm, reason, decision, outcome, latency_ms, card_bin, card_country, payment_method, created_at, updated_at
+		FROM payment_routes WHERE payment_id = $1`, paymentID).
+		Scan(&r.PaymentID, &r.Arm, &r.Reason, &decision, &r.Outcome, &r.LatencyMS, &r.CardBIN, &r.CardCountry, &r.PaymentMethod, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	r.Decision = decision
+	return &r, nil
+}
+
+func (pr *ProviderRouting) paymentRoute(c *gin.Context) {
+	if pr.store == nil {
+		c.JSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Routing reports require DATABASE_URL"))
+		return
+	}
+	route, err := pr.store.PaymentRoute(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Payment was not routed"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, route)
+}
+
+// report compares the arms over from..to, the last 30 days by default.
+func (pr *ProviderRouting) report(c *gin.Context) {
+	if pr.store == nil {
+		c.JSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Routing reports require DATABASE_URL"))
+		return
+	}
+	to, from := time.Now().UTC(), time.Now().UTC().AddDate(0, 0, -30)
+	var err error
+	if v := c.Query("from"); v != "" {
+		if from, err = parseExportTime(v); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "from must be a date (YYYY-MM-DD) or RFC 3339 timestamp"))
+			return
+		}
+	}
+	if v := c.Query("to"); v != "" {
+		if to, err = parseExportTime(v); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "to must be a date (YYYY-MM-DD) or RFC 3339 timestamp"))
+			return
+		}
+	}
+	arms, err := pr.store.ProviderRoutingReport(c.Request.Context(), from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{
+		"from":              from,
+		"to":                to,
+		"alternate_percent": pr.settings.Get().ProviderRouting.AlternatePercent,
+		"arms":              arms,
+	})
+}
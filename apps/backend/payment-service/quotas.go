@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var apiKeyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_api_key_requests_total",
+	Help: "Requests authenticated by an API key, by key and outcome (allowed, throttled).",
+}, []string{"api_key", "outcome"})
+
+// APIKeyQuotaConfig is the quota of keys without one of their own. 0 is
+// unlimited.
+//
+//	"api_key_quotas": {"per_minute": 600, "per_day": 200000}
+type APIKeyQuotaConfig struct {
+	PerMinute int `json:"per_minute"`
+	PerDay    int `json:"per_day"`
+}
+
+func (cfg APIKeyQuotaConfig) validate() error {
+	if cfg.PerMinute < 0 || cfg.PerDay < 0 {
+		return fmt.Errorf("api_key_quotas values must not be negative")
+	}
+	return nil
+}
+
+// quotaWindow is one of the fixed windows a key's requests are counted
+// in: the UTC minute or the UTC day.
+type quotaWindow struct {
+	name string
+	size time.Duration
+}
+
+var quotaWindows = []quotaWindow{{"minute", time.Minute}, {"day", 24 * time.Hour}}
+
+// limit is the key's quota in w, its own or the default.
+func (w quotaWindow) limit(key *APIKey, defaults APIKeyQuotaConfig) int {
+	own, def := key.QuotaPerMinute, defaults.PerMinute
+	if w.size != time.Minute {
+		own, def = key.QuotaPerDay, defaults.PerDay
+	}
+	if own != nil {
+		return *own
+	}
+	return def
+}
+
+// QuotaUsage is a key's standing in one window.
+type QuotaUsage struct {
+	Window   string    `json:"window"`
+	Limit    int       `json:"limit"`
+	Used     int64     `json:"used"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+// quotaScript counts a request in every window unless one is full. It
+// returns the 1-based index of the first full window, or 0, followed by
+// each window's count.
+//
+// KEYS are the counters; ARGV is max and ttl_ms for each.
+const quotaScript = `
+local out = {0}
+for i, key in ipairs(KEYS) do
+  local n = tonumber(redis.call("GET", key) or "0")
+  if n >= tonumber(ARGV[i * 2 - 1]) and out[1] == 0 then
+    out[1] = i
+  end
+  out[i + 1] = n
+end
+if out[1] == 0 then
+  for i, key in ipairs(KEYS) do
+    out[i + 1] = redis.call("INCR", key)
+    if out[i + 1] == 1 then
+      redis.call("PEXPIRE", key, ARGV[i * 2])
+    end
+  end
+end
+return out
+`
+
+// apiKeyQuotas throttles requests authenticated by an API key; nil
+// leaves them unlimited. requireScope consults it once a key passes, so
+// it covers every route a key can reach.
+var apiKeyQuotas *APIKeyQuotas
+
+// APIKeyQuotas counts each API key's requests per UTC minute and day
+// against its quota, so one internal consumer stuck in a loop runs out
+// of its own budget instead of everyone's. Counters live in Redis when
+// it is configured and are shared by the fleet; without it each
+// instance counts for itself. Like the velocity rules, quotas let
+// requests through when Redis is unreachable. Refused requests are not
+// counted.
+type APIKeyQuotas struct {
+	settings *RuntimeSettings
+	redis    *Redis
+
+	mu     sync.Mutex
+	counts map[string]*quotaCount
+	swept  time.Time
+}
+
+type quotaCount struct {
+	n       int64
+	expires time.Time
+}
+
+func NewAPIKeyQuotas(settings *RuntimeSettings, redis *Redis) *APIKeyQuotas {
+	return &APIKeyQuotas{settings: settings, redis: redis, counts: map[string]*quotaCount{}, swept: time.Now()}
+}
+
+// counterKey names key's counter for the window starting at start. The
+// key hash tag keeps both of a key's counters in one cluster slot.
+func counterKey(key *APIKey, w quotaWindow, start time.Time) string {
+	return fmt.Sprintf("quota:{k:%s}:%s:%d", key.ID, w.name, start.Unix())
+}
+
+// take counts a request by key and returns its usage in the windows with
+// a limit, and whether it is within all of them.
+func (q *APIKeyQuotas) take(ctx context.Context, key *APIKey, now time.Time) ([]QuotaUsage, bool) {
+	defaults := q.settings.Get().APIKeyQuotas
+	var usage []QuotaUsage
+	var keys, args []string
+	for _, w := range quotaWindows {
+		limit := w.limit(key, defaults)
+		if limit <= 0 {
+			continue
+		}
+		start := now.UTC().Truncate(w.size)
+		usage = append(usage, QuotaUsage{Window: w.name, Limit: limit, ResetsAt: start.Add(w.size)})
+		keys = append(keys, counterKey(key, w, start))
+		args = append(args, strconv.Itoa(limit), strconv.FormatInt(w.size.Milliseconds()+1000, 10))
+	}
+	if len(keys) == 0 {
+		return nil, true
+	}
+
+	var full int
+	var counts []int64
+	if q.redis != nil {
+		cmd := append([]string{"EVAL", quotaScript, strconv.Itoa(len(keys))}, keys...)
+		reply, err := q.redis.Do(ctx, append(cmd, args...)...)
+		items, _ := reply.([]interface{})
+		if err != nil || len(items) != len(keys)+1 {
+			logf(ctx, "api key quota: %v", err)
+			return nil, true
+		}
+		for i, item := range items {
+			n, _ := item.(int64)
+			if i == 0 {
+				full = int(n)
+			} else {
+				counts = append(counts, n)
+			}
+		}
+	} else {
+		full, counts = q.takeLocal(keys, usage, now)
+	}
+	for i := range usage {
+		usage[i].Used = counts[i]
+	}
+	return usage, full == 0
+}
+
+// takeLocal is quotaScript over this instance's counters.
+func (q *APIKeyQuotas) takeLocal(keys []string, usage []QuotaUsage, now time.Time) (int, []int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if now.Sub(q.swept) > time.Minute {
+		for k, c := range q.counts {
+			if now.After(c.expires) {
+				delete(q.counts, k)
+			}
+		}
+		q.swept = now
+	}
+
+	full := 0
+	counts := make([]int64, len(keys))
+	for i, k := range keys {
+		if c := q.counts[k]; c != nil {
+			counts[i] = c.n
+		}
+		if counts[i] >= int64(usage[i].Limit) && full == 0 {
+			full = i + 1
+		}
+	}
+	if full > 0 {
+		return full, counts
+	}
+	for i, k := range keys {
+		c := q.counts[k]
+		if c == nil {
+			c = &quotaCount{expires: usage[i].ResetsAt}
+			q.counts[k] = c
+		}
+		c.n++
+		counts[i] = c.n
+	}
+	return 0, counts
+}
+
+// usage is key's standing in every window, counting nothing.
+func (q *APIKeyQuotas) usage(ctx context.Context, key *APIKey, now time.Time) ([]QuotaUsage, error) {
+	defaults := q.settings.Get().APIKeyQuotas
+	out := make([]QuotaUsage, 0, len(quotaWindows))
+	for _, w := range quotaWindows {
+		start := now.UTC().Truncate(w.size)
+		u := QuotaUsage{Window: w.name, Limit: w.limit(key, defaults), ResetsAt: start.Add(w.size)}
+		k := counterKey(key, w, start)
+		if q.redis != nil {
+			reply, err := q.redis.Do(ctx, "GET", k)
+			if err != nil {
+				return nil, err
+			}
+			if s, ok := reply.(string); ok {
+				u.Used, _ = strconv.ParseInt(s, 10, 64)
+			}
+		} else {
+			q.mu.Lock()
+			if c := q.counts[k]; c != nil {
+				u.Used = c.n
+			}
+			q.mu.Unlock()
+		}
+		out = append(out, u)
+	}
+	return out, nil
+}
+
+// allow counts the request against key's quota and sets the
+// X-RateLimit-* headers for the window closest to its limit. Over quota,
+// it answers 429 and returns false.
+func (q *APIKeyQuotas) allow(c *gin.Context, key *APIKey) bool {
+	if q == nil {
+		return true
+	}
+	now := time.Now()
+	usage, ok := q.take(c.Request.Context(), key, now)
+	if len(usage) > 0 {
+		tightest := usage[0]
+		for _, u := range usage[1:] {
+			if int64(u.Limit)-u.Used < int64(tightest.Limit)-tightest.Used {
+				tightest = u
+			}
+		}
+		remaining := int64(tightest.Limit) - tightest.Used
+		if remaining < 0 {
+			remaining = 0
+		}
+		c.Header("X-RateLimit-Limit", strconv.Itoa(tightest.Limit))
+		c.Header("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+		c.Header("X-RateLimit-Reset", strconv.FormatInt(tightest.ResetsAt.Unix(), 10))
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(int(tightest.ResetsAt.Sub(now)/time.Second)+1))
+		}
+	}
+	if !ok {
+		apiKeyRequests.WithLabelValues(key.ID, "throttled").Inc()
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, errorBodyWith(c, CodeQuotaExceeded,
+			"API key "+key.Name+" is over its request quota", gin.H{"usage": usage}))
+		return false
+	}
+	apiKeyRequests.WithLabelValues(key.ID, "allowed").Inc()
+	return true
+}
+
+// SetAPIKeyQuota sets key id's own quotas; nil reverts a window to the
+// default and 0 makes it unlimited.
+func (s *Store) SetAPIKeyQuota(ctx context.Context, id string, perMinute, perDay *int) (*APIKey, error) {
+	return scanAPIKey(s.db.QueryRowContext(ctx, `
+		UPDATE api_keys SET quota_per_minute = $2, quota_per_day = $3
+		WHERE id = $1
+		RETURNING `+apiKeyColumns, id, perMinute, perDay))
+}
+
+// keyQuota shows a key's quotas, its own or the defaults, and what it
+// has used of them in the current windows.
+func (a *AdminAPI) keyQuota(c *gin.Context) {
+	key, err := a.Store.APIKey(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "API key not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	a.respondQuota(c, key)
+}
+
+// setKeyQuota replaces a key's own quotas. A window left out or null
+// follows the api_key_quotas default; 0 is unlimited.
+func (a *AdminAPI) setKeyQuota(c *gin.Context) {
+	var req struct {
+		PerMinute *int `json:"per_minute"`
+		PerDay    *int `json:"per_day"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	var fields []FieldError
+	if req.PerMinute != nil && *req.PerMinute < 0 {
+		fields = append(fields, FieldError{Field: "per_minute", Code: "too_small", Message: "must not be negative"})
+	}
+	if req.PerDay != nil && *req.PerDay < 0 {
+		fields = append(fields, FieldError{Field: "per_day", Code: "too_small", Message: "must not be negative"})
+	}
+	if len(fields) > 0 {
+		validationFailed(c, fields)
+		return
+	}
+
+	key, err := a.Store.SetAPIKeyQuota(c.Request.Context(), c.Param("id"), req.PerMinute, req.PerDay)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "API key not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	logf(c.Request.Context(), "api key %s quota set to %s/minute, %s/day by %s", key.ID,
+		quotaString(key.QuotaPerMinute), quotaString(key.QuotaPerDay), c.GetString("api_key_id"))
+	a.respondQuota(c, key)
+}
+
+func (a *AdminAPI) respondQuota(c *gin.Context, key *APIKey) {
+	body := gin.H{"api_key": key}
+	if apiKeyQuotas != nil {
+		usage, err := apiKeyQuotas.usage(c.Request.Context(), key, time.Now())
+		if err != nil {
+			c.JSON(http.StatusBadGateway, errorBody(c, CodeUpstreamFailed, "Quota counters: "+err.Error()))
+			return
+		}
+		body["usage"] = usage
+	}
+	respondData(c, http.StatusOK, body)
+}
+
+func quotaString(n *int) string {
+	if n == nil {
+		return "default"
+	}
+	return strconv.Itoa(*n)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+)
+
+var paymentQuotesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_payment_quotes_total",
+	Help: "Payment quotes, by result (quoted, redeemed, expired, changed).",
+}, []string{"result"})
+
+// metadataQuote records the quote a payment was created from.
+const metadataQuote = "quote_id"
+
+// QuoteConfig sets how long quotes hold and the platform fee they show.
+// The platform fee is our cut of a payment, a percentage plus a fixed
+// amount in minor units of the charge currency; it comes out of what the
+// seller nets and is not added to the customer's total. A tenant's entry
+// replaces the default fee.
+//
+//	"quotes": {"ttl_seconds": 900, "platform_fee": {"percent": 1.5, "fixed": 0}, "tenants": {"acme": {"percent": 2, "fixed": 25}}}
+type QuoteConfig struct {
+	// TTLSeconds zero means 900.
+	TTLSeconds  int                    `json:"ttl_seconds"`
+	PlatformFee PlatformFee            `json:"platform_fee"`
+	Tenants     map[string]PlatformFee `json:"tenants"`
+}
+
+type PlatformFee struct {
+	Percent float64 `json:"percent"`
+	Fixed   int64   `json:"fixed"`
+}
+
+func (cfg QuoteConfig) validate() error {
+	if cfg.TTLSeconds < 0 || cfg.TTLSeconds > 24*60*60 {
+		return fmt.Errorf("quotes: ttl_seconds must be between 0 and 86400")
+	}
+	check := func(name string, fee PlatformFee) error {
+		if fee.Percent < 0 || fee.Percent >= 100 || fee.Fixed < 0 {
+			return fmt.Errorf("quotes %s: percent must be at least 0 and below 100, fixed at least 0", name)
+		}
+		return nil
+	}
+	if err := check("platform_fee", cfg.PlatformFee); err != nil {
+		return err
+	}
+	for tenant, fee := range cfg.Tenants {
+		if err := check("tenants."+tenant, fee); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg QuoteConfig) ttl() time.Duration {
+	if cfg.TTLSeconds == 0 {
+		return 15 * time.Minute
+	}
+	return time.Duration(cfg.TTLSeconds) * time.Second
+}
+
+// platformFee is the tenant's fee on amount, rounded by mode and never
+// more than amount.
+func (cfg QuoteConfig) platformFee(tenantID string, amount int64, mode RoundingMode) int64 {
+	fee := cfg.PlatformFee
+	if override, ok := cfg.Tenants[tenantID]; ok && tenantID != "" {
+		fee = override
+	}
+	if fee.Percent == 0 && fee.Fixed == 0 {
+		return 0
+	}
+	return min(percentOf(amount, fee.Percent, mode)+fee.Fixed, amount)
+}
+
+// quoteRequest is the part of a payment request that decides its price.
+// A payment redeeming a quote must match it field for field.
+type quoteRequest struct {
+	Amount          int64    `json:"amount"`
+	Currency        string   `json:"currency"`
+	TenantID        string   `json:"tenant_id,omitempty"`
+	CustomerID      string   `json:"customer_id,omitempty"`
+	PromoCodes      []string `json:"promo_codes,omitempty"`
+	Tip             int64    `json:"tip,omitempty"`
+	RedeemPoints    int64    `json:"redeem_points,omitempty"`
+	FXQuoteID       string   `json:"fx_quote_id,omitempty"`
+	PaymentMethod   string   `json:"payment_method,omitempty"`
+	CustomerCountry string   `json:"customer_country,omitempty"`
+}
+
+func quoteRequestOf(req PaymentRequest) quoteRequest {
+	return quoteRequest{
+		Amount:          req.Amount,
+		Currency:        strings.ToLower(req.Currency),
+		TenantID:        req.TenantID,
+		CustomerID:      req.CustomerID,
+		PromoCodes:      req.PromoCodes,
+		Tip:             req.Tip,
+		RedeemPoints:    req.RedeemPoints,
+		FXQuoteID:       req.FXQuoteID,
+		PaymentMethod:   req.PaymentMethod,
+		CustomerCountry: strings.ToUpper(req.CustomerCountry),
+	}
+}
+
+// differences names the fields in which q and other differ.
+func (q quoteRequest) differences(other quoteRequest) []string {
+	var fields []string
+	for _, f := range []struct {
+		name string
+		same bool
+	}{
+		{"amount", q.Amount == other.Amount},
+		{"currency", q.Currency == other.Currency},
+		{"tenant_id", q.TenantID == other.TenantID},
+		{"customer_id", q.CustomerID == other.CustomerID},
+		{"promo_codes", strings.Join(q.PromoCodes, ",") == strings.Join(other.PromoCodes, ",")},
+		{"tip", q.Tip == other.Tip},
+		{"redeem_points", q.RedeemPoints == other.RedeemPoints},
+		{"fx_quote_id", q.FXQuoteID == other.FXQuoteID},
+		{"payment_method", q.PaymentMethod == other.PaymentMethod},
+		{"customer_country", q.CustomerCountry == other.CustomerCountry},
+	} {
+		if !f.same {
+			fields = append(fields, f.name)
+		}
+	}
+	return fields
+}
+
+// PaymentQuote is the full price of a payment, worked out by the same
+// code that creates it. Subtotal less Discount and PointsValue, plus
+// Surcharge and Tip, is Total; Tax is the VAT Total includes, not extra.
+// With an FX quote, Total and the fees are in ChargeCurrency and the rest
+// in Currency. PlatformFee and ProviderFee come out of what the seller
+// nets.
+type PaymentQuote struct {
+	ID           string            `json:"id"`
+	TenantID     string            `json:"tenant_id,omitempty"`
+	Currency     string            `json:"currency"`
+	Subtotal     int64             `json:"subtotal"`
+	Discount     int64             `json:"discount"`
+	Discounts    []AppliedDiscount `json:"discounts,omitempty"`
+	PointsValue  int64             `json:"points_value,omitempty"`
+	Surcharge    int64             `json:"surcharge"`
+	Tip          int64             `json:"tip"`
+	Tax          int64             `json:"tax"`
+	TaxRate      float64           `json:"tax_rate"`
+	TaxTreatment string            `json:"tax_treatment,omitempty"`
+	Total        int64             `json:"total"`
+	// ChargeCurrency is Currency unless an FX quote converts the payment.
+	ChargeCurrency string    `json:"charge_currency"`
+	FXQuoteID      string    `json:"fx_quote_id,omitempty"`
+	PlatformFee    int64     `json:"platform_fee"`
+	ProviderFee    int64     `json:"provider_fee"`
+	Net            int64     `json:"net"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	CreatedAt      time.Time `json:"created_at"`
+
+	request quoteRequest
+}
+
+func (q *PaymentQuote) expired(now time.Time) bool {
+	return !now.Before(q.ExpiresAt)
+}
+
+func scanPaymentQuote(row interface{ Scan(...interface{}) error }) (*PaymentQuote, error) {
+	var request, breakdown []byte
+	var q PaymentQuote
+	if err := row.Scan(&request, &breakdown); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(breakdown, &q); err != nil {
+		return nil, fmt.Errorf("decoding payment quote: %w", err)
+	}
+	if err := json.Unmarshal(request, &q.request); err != nil {
+		return nil, fmt.Errorf("decoding payment quote %s: %w", q.ID, err)
+	}
+	return &q, nil
+}
+
+func (s *Store) CreatePaymentQuote(ctx context.Context, q *PaymentQuote) error {
+	request, err := json.Marshal(q.request)
+	if err != nil {
+		return err
+	}
+	breakdown, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO payment_quotes (id, tenant_id, request, breakdown, total, currency, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		q.ID, q.TenantID, request, breakdown, q.Total, q.ChargeCurrency, q.ExpiresAt, q.CreatedAt)
+	return err
+}
+
+func (s *Store) PaymentQuote(ctx context.Context, id string) (*PaymentQuote, error) {
+	return scanPaymentQuote(s.db.QueryRowContext(ctx, `SELECT request, breakdown FROM payment_quotes WHERE id = $1`, id))
+}
+
+// quoteOf breaks down what params would charge for req.
+func (s *PaymentService) quoteOf(req PaymentRequest, params *stripe.PaymentIntentParams, fees FeeSchedule) *PaymentQuote {
+	meta := params.Metadata
+	q := &PaymentQuote{
+		TenantID:       req.TenantID,
+		Currency:       strings.ToLower(req.Currency),
+		Subtotal:       req.Amount,
+		Tip:            req.Tip,
+		Total:          stripe.Int64Value(params.Amount),
+		ChargeCurrency: strings.ToLower(stripe.StringValue(params.Currency)),
+		FXQuoteID:      req.FXQuoteID,
+		TaxTreatment:   meta[metadataTaxTreatment],
+		request:        quoteRequestOf(req),
+	}
+	q.Discount, _ = strconv.ParseInt(meta[metadataDiscount], 10, 64)
+	q.Discounts = parseDiscountsMetadata(meta[metadataDiscounts])
+	q.PointsValue, _ = strconv.ParseInt(meta[metadataPointsValue], 10, 64)
+	q.Surcharge, _ = strconv.ParseInt(meta[metadataSurcharge], 10, 64)
+
+	// Tips carry no VAT, and neither do sales a tax ID exempts. A surcharge
+	// is taxed as part of the sale.
+	cfg := s.settings.Get()
+	if q.TaxTreatment == "" {
+		q.TaxRate = cfg.Invoices.effective(req.TenantID).taxRate()
+		taxed := q.Subtotal - q.Discount + q.Surcharge
+		q.Tax = includedTax(taxed, q.TaxRate, cfg.Rounding.mode(q.Currency))
+	}
+
+	q.ProviderFee, _ = fees.Estimate(q.Total)
+	q.PlatformFee = min(cfg.Quotes.platformFee(req.TenantID, q.Total, cfg.Rounding.mode(q.ChargeCurrency)), q.Total-q.ProviderFee)
+	q.Net = q.Total - q.ProviderFee - q.PlatformFee
+	return q
+}
+
+// redeemableQuote returns req's quote, refusing one that has expired or
+// was made for a different request.
+func (s *PaymentService) redeemableQuote(ctx context.Context, req PaymentRequest) (*PaymentQuote, *refusal) {
+	if s.store == nil {
+		return nil, &refusal{http.StatusServiceUnavailable, CodeNotConfigured, "Payment quotes require DATABASE_URL", nil}
+	}
+	q, err := s.store.PaymentQuote(ctx, req.QuoteID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, &refusal{http.StatusBadRequest, CodeInvalidRequest, "Unknown quote_id", nil}
+	}
+	if err != nil {
+		logf(ctx, "payment quote %s: %v", req.QuoteID, err)
+		return nil, &refusal{http.StatusInternalServerError, CodeInternal, "Could not read the quote", nil}
+	}
+	if q.expired(time.Now()) {
+		paymentQuotesTotal.WithLabelValues("expired").Inc()
+		return nil, &refusal{codeStatus[CodeQuoteExpired], CodeQuoteExpired, "Quote expired at " + q.ExpiresAt.Format(time.RFC3339),
+			gin.H{"expires_at": q.ExpiresAt}}
+	}
+	if fields := q.request.differences(quoteRequestOf(req)); len(fields) > 0 {
+		paymentQuotesTotal.WithLabelValues("changed").Inc()
+		return nil, &refusal{codeStatus[CodeQuoteChanged], CodeQuoteChanged,
+			"The payment differs from its quote in " + strings.Join(fields, ", "), gin.H{"fields": fields}}
+	}
+	return q, nil
+}
+
+// redeem checks that params charge what q quoted and records q on them.
+// Promotions, points or limits that changed since the quote was made
+// make the totals differ, and the customer must be shown a new quote.
+func (q *PaymentQuote) redeem(params *stripe.PaymentIntentParams) *refusal {
+	if q == nil {
+		return nil
+	}
+	total, currency := stripe.Int64Value(params.Amount), strings.ToLower(stripe.StringValue(params.Currency))
+	if total != q.Total || currency != q.ChargeCurrency {
+		paymentQuotesTotal.WithLabelValues("changed").Inc()
+		return &refusal{codeStatus[CodeQuoteChanged], CodeQuoteChanged,
+			fmt.Sprintf("The quote was for %d %s, the payment now comes to %d %s", q.Total, q.ChargeCurrency, total, currency),
+			gin.H{"quoted_total": q.Total, "total": total}}
+	}
+	paymentQuotesTotal.WithLabelValues("redeemed").Inc()
+	params.AddMetadata(metadataQuote, q.ID)
+	return nil
+}
+
+// PaymentQuotes answers POST /payment/quote: the price of a payment,
+// broken down, without creating anything. Checkout frontends show the
+// breakdown and pass its ID as quote_id when they create the payment,
+// which is refused rather than charged differently.
+type PaymentQuotes struct {
+	store    *Store
+	settings *RuntimeSettings
+	payments *PaymentService
+	fees     FeeSchedule
+}
+
+func NewPaymentQuotes(store *Store, settings *RuntimeSettings, payments *PaymentService, fees FeeSchedule) *PaymentQuotes {
+	return &PaymentQuotes{store: store, settings: settings, payments: payments, fees: fees}
+}
+
+func (pq *PaymentQuotes) RegisterRoutes(r gin.IRouter, residency *Residency) {
+	r.POST("/payment/quote", residency.forward, pq.requireStore, pq.quote)
+}
+
+func (pq *PaymentQuotes) requireStore(c *gin.Context) {
+	if pq.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Payment quotes require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// quote prices the body of a payment create request. It goes through the
+// same checks as creation, as a dry run, so a payment that would be
+// refused gets no quote.
+func (pq *PaymentQuotes) quote(c *gin.Context) {
+	var req PaymentRequest
+	if !decodeJSON(c, &req) {
+		return
+	}
+	if fields := req.validate(); len(fields) > 0 {
+		validationFailed(c, fields)
+		return
+	}
+	if req.QuoteID != "" {
+		validationFailed(c, []FieldError{{Field: "quote_id", Code: "invalid", Message: "can't be given when asking for a quote"}})
+		return
+	}
+	req.fillDevice(c)
+	req.dryRun = true
+
+	ctx := c.Request.Context()
+	params, refused := pq.payments.Params(ctx, req)
+	if refused != nil {
+		c.JSON(refused.status, errorBodyWith(c, refused.code, refused.message, refused.ext))
+		return
+	}
+	q := pq.payments.quoteOf(req, params.PaymentIntentParams, pq.fees)
+	q.ID = "quote_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	q.CreatedAt = time.Now().UTC()
+	q.ExpiresAt = q.CreatedAt.Add(pq.settings.Get().Quotes.ttl())
+	if err := pq.store.CreatePaymentQuote(ctx, q); err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	paymentQuotesTotal.WithLabelValues("quoted").Inc()
+	respondData(c, http.StatusCreated, q)
+}
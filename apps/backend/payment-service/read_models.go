@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var readModelLag = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "payment_service_read_model_lag_seconds",
+	Help: "Age of the last payment event the read models applied, zero when caught up.",
+})
+
+const (
+	// readModelCheckpoint names the projector's place in payment_events.
+	readModelCheckpoint = "payments"
+	// readModelBatch is how many events one projector transaction applies.
+	readModelBatch = 500
+)
+
+// paymentSummaryList serves GET /payments from payment_summaries, with
+// the same fields as paymentList and the counts of refunds and disputes.
+var paymentSummaryList = listResource{
+	from: "payment_summaries p",
+	fields: []string{"id", "tenant_id", "customer_id", "order_id", "amount", "amount_received", "amount_refunded",
+		"currency", "status", "state", "payment_method", "description", "region", "refund_count", "dispute_count",
+		"created_at", "updated_at"},
+	columns: map[string]listField{
+		"id":              {"p.id", textField},
+		"tenant_id":       {"p.tenant_id", textField},
+		"customer_id":     {"p.customer_id", textField},
+		"order_id":        {"p.order_id", textField},
+		"amount":          {"p.amount", intField},
+		"amount_received": {"p.amount_received", intField},
+		"amount_refunded": {"p.amount_refunded", intField},
+		"currency":        {"p.currency", textField},
+		"status":          {"p.status", textField},
+		"state":           {"p.state", textField},
+		"payment_method":  {"p.payment_method", textField},
+		"description":     {"p.description", textField},
+		"region":          {"p.region", textField},
+		"refund_count":    {"p.refund_count", intField},
+		"dispute_count":   {"p.dispute_count", intField},
+		"created_at":      {"p.created_at", timeField},
+		"updated_at":      {"p.updated_at", timeField},
+	},
+}
+
+var paymentSummaryReport = reportSource{
+	from:       "payment_summaries p",
+	created:    "p.created_at",
+	dimensions: paymentReport.dimensions,
+	exprs:      paymentReport.exprs,
+	names:      paymentReport.names,
+}
+
+// paymentDailyReport answers payment reports over whole UTC days from
+// payment_daily_totals without touching a row per payment.
+var paymentDailyReport = reportSource{
+	from:    "payment_daily_totals p",
+	created: "(p.day::timestamp AT TIME ZONE 'UTC')",
+	count:   "SUM(p.count)",
+	dimensions: map[string]string{
+		"day":            `to_char(p.day, 'YYYY-MM-DD')`,
+		"week":           `to_char(date_trunc('week', p.day), 'YYYY-MM-DD')`,
+		"currency":       `p.currency`,
+		"status":         `p.status`,
+		"payment_method": `p.payment_method`,
+		"tenant":         `p.tenant_id`,
+	},
+	exprs: []string{"SUM(p.amount)", "SUM(p.amount_received)", "SUM(p.amount_refunded)", "SUM(p.amount_received - p.amount_refunded)"},
+	names: []string{"amount", "amount_received", "amount_refunded", "net"},
+}
+
+var customerLTVList = listResource{
+	from: "customer_ltv l",
+	fields: []string{"tenant_id", "customer_id", "currency", "payments", "amount_received", "amount_refunded", "net",
+		"first_payment_at", "last_payment_at"},
+	columns: map[string]listField{
+		"tenant_id":        {"l.tenant_id", textField},
+		"customer_id":      {"l.customer_id", textField},
+		"currency":         {"l.currency", textField},
+		"payments":         {"l.payments", intField},
+		"amount_received":  {"l.amount_received", intField},
+		"amount_refunded":  {"l.amount_refunded", intField},
+		"net":              {"l.amount_received - l.amount_refunded", intField},
+		"first_payment_at": {"l.first_payment_at", timeField},
+		"last_payment_at":  {"l.last_payment_at", timeField},
+	},
+}
+
+// ReadModels projects payment_events into the read models payment lists
+// and reports are served from, so they do not scan the tables payments
+// are written to. Projection runs behind the event feed; until this
+// instance has caught up once, and whenever it falls a batch behind, the
+// endpoints read the write tables instead.
+type ReadModels struct {
+	store    *Store
+	interval time.Duration
+	caughtUp atomic.Bool
+}
+
+func NewReadModels(store *Store, interval time.Duration) *ReadModels {
+	return &ReadModels{store: store, interval: interval}
+}
+
+// serve picks readModel once the read models are current, else primary.
+func (rm *ReadModels) serve(readModel, primary gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rm != nil && rm.caughtUp.Load() {
+			readModel(c)
+			return
+		}
+		primary(c)
+	}
+}
+
+// paymentReport serves payment reports from the daily totals when from
+// and to are whole UTC days, and from the payment summaries otherwise.
+func (rm *ReadModels) paymentReport(store *Store) gin.HandlerFunc {
+	daily := reportHandler(store, paymentDailyReport)
+	summaries := reportHandler(store, paymentSummaryReport)
+	return rm.serve(func(c *gin.Context) {
+		if wholeDay(c.Query("from")) && wholeDay(c.Query("to")) {
+			daily(c)
+			return
+		}
+		summaries(c)
+	}, reportHandler(store, paymentReport))
+}
+
+func wholeDay(s string) bool {
+	t, err := parseExportTime(s)
+	return err == nil && t.Equal(t.UTC().Truncate(24*time.Hour))
+}
+
+// RegisterRoutes mounts customers' lifetime values under payments:read,
+// like the exports they summarize, and the admin status and rebuild.
+func (rm *ReadModels) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	read := requireScope(rm.store, bootstrapToken, readPaymentsScope)
+	r.GET("/reports/customer-ltv", read, listHandler(rm.store, customerLTVList))
+	r.GET("/customers/:id/ltv", read, rm.customerLTV)
+
+	admin := r.Group("/admin/read-models", requireScope(rm.store, bootstrapToken, "admin"))
+	admin.GET("", rm.status)
+	admin.POST("/rebuild", rm.rebuild)
+}
+
+// Run applies new payment events every interval until ctx is done.
+func (rm *ReadModels) Run(ctx context.Context) {
+	if rm.store == nil {
+		return
+	}
+	ticker := time.NewTicker(rm.interval)
+	defer ticker.Stop()
+	for {
+		rm.sweep(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep applies batches until it reaches the end of the feed.
+func (rm *ReadModels) sweep(ctx context.Context) {
+	for ctx.Err() == nil {
+		n, err := rm.store.ProjectPaymentEvents(ctx, readModelBatch)
+		if err != nil {
+			log.Printf("read models: projecting payment events: %v", err)
+			return
+		}
+		if n < readModelBatch {
+			rm.caughtUp.Store(true)
+			return
+		}
+		rm.caughtUp.Store(false)
+	}
+}
+
+// ProjectPaymentEvents applies up to limit events after the checkpoint
+// to the read models, in one transaction with the checkpoint, and returns
+// how many it applied.
+func (s *Store) ProjectPaymentEvents(ctx context.Context, limit int) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO read_model_checkpoints (name) VALUES ($1) ON CONFLICT DO NOTHING`, readModelCheckpoint); err != nil {
+		return 0, err
+	}
+	var after int64
+	if err := tx.QueryRowContext(ctx, `
+		SELECT last_event_id FROM read_model_checkpoints WHERE name = $1 FOR UPDATE`, readModelCheckpoint).
+		Scan(&after); err != nil {
+		return 0, err
+	}
+	events, err := paymentChangeFeed(ctx, tx, after, limit)
+	if err != nil || len(events) == 0 {
+		readModelLag.Set(0)
+		return 0, err
+	}
+	for _, e := range events {
+		if err := projectPaymentEvent(ctx, tx, e); err != nil {
+			return 0, fmt.Errorf("event %d of %s: %w", e.ID, e.PaymentID, err)
+		}
+	}
+	last := events[len(events)-1]
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE read_model_checkpoints SET last_event_id = $2, updated_at = now() WHERE name = $1`,
+		readModelCheckpoint, last.ID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if len(events) < limit {
+		readModelLag.Set(0)
+	} else {
+		readModelLag.Set(time.Since(last.CreatedAt).Seconds())
+	}
+	return len(events), nil
+}
+
+// projectPaymentEvent folds e into its payment's summary, and moves the
+// payment's share of the daily totals and its customer's lifetime value
+// from what the summary said before to what it says now.
+func projectPaymentEvent(ctx context.Context, tx *sql.Tx, e PaymentChange) error {
+	var version int
+	var raw []byte
+	var prevCustomer string
+	err := tx.QueryRowContext(ctx, `
+		SELECT version, aggregate, customer_id FROM payment_summaries WHERE id = $1 FOR UPDATE`, e.PaymentID).
+		Scan(&version, &raw, &prevCustomer)
+	exists := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if exists && version >= e.Version {
+		return nil
+	}
+
+	prev, next := newPaymentAggregate(), newPaymentAggregate()
+	if exists {
+		if err := prev.apply(raw); err != nil {
+			return err
+		}
+		if err := next.apply(raw); err != nil {
+			return err
+		}
+	}
+	if err := next.apply(e.Data); err != nil {
+		return err
+	}
+	if next.CreatedAt.IsZero() {
+		next.CreatedAt = e.CreatedAt.UTC()
+	}
+
+	// The customer and description are not part of the stream; they are
+	// read as projected.
+	customer, description := prevCustomer, ""
+	if err := tx.QueryRowContext(ctx, `SELECT customer_id, description FROM payments WHERE id = $1`, e.PaymentID).
+		Scan(&customer, &description); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if exists {
+		if err := addDailyTotals(ctx, tx, prev, -1); err != nil {
+			return err
+		}
+		if err := addCustomerLTV(ctx, tx, prev, prevCustomer, -1); err != nil {
+			return err
+		}
+	}
+	if err := addDailyTotals(ctx, tx, next, 1); err != nil {
+		return err
+	}
+	if err := addCustomerLTV(ctx, tx, next, customer, 1); err != nil {
+		return err
+	}
+
+	aggregate, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO payment_summaries (id, tenant_id, customer_id, order_id, amount, amount_received, amount_refunded,
+			currency, status, state, payment_method, description, region, refund_count, dispute_count,
+			version, aggregate, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+		ON CONFLICT (id) DO UPDATE SET
+			tenant_id = EXCLUDED.tenant_id, customer_id = EXCLUDED.customer_id, order_id = EXCLUDED.order_id,
+			amount = EXCLUDED.amount, amount_received = EXCLUDED.amount_received,
+			amount_refunded = EXCLUDED.amount_refunded, currency = EXCLUDED.currency, status = EXCLUDED.status,
+			state = EXCLUDED.state, payment_method = EXCLUDED.payment_method, description = EXCLUDED.description,
+			region = EXCLUDED.region, refund_count = EXCLUDED.refund_count, dispute_count = EXCLUDED.dispute_count,
+			version = EXCLUDED.version, aggregate = EXCLUDED.aggregate, created_at = EXCLUDED.created_at,
+			updated_at = now()`,
+		e.PaymentID, next.TenantID, customer, next.OrderID, next.Amount, next.AmountReceived, next.AmountRefunded,
+		next.Currency, next.Status, next.State, next.PaymentMethod, description, next.Region,
+		len(next.Refunds), len(next.Disputes), e.Version, aggregate, next.CreatedAt)
+	return err
+}
+
+// addDailyTotals adds a's share to its day's totals, or with sign -1
+// takes it away, dropping groups left empty.
+func addDailyTotals(ctx context.Context, tx *sql.Tx, a *PaymentAggregate, sign int64) error {
+	day := a.CreatedAt.UTC().Format("2006-01-02")
+	if sign < 0 {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE payment_daily_totals SET count = count - 1, amount = amount - $6,
+				amount_received = amount_received - $7, amount_refunded = amount_refunded - $8
+			WHERE day = $1 AND tenant_id = $2 AND currency = $3 AND status = $4 AND payment_method = $5`,
+			day, a.TenantID, a.Currency, a.Status, a.PaymentMethod, a.Amount, a.AmountReceived, a.AmountRefunded); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			DELETE FROM payment_daily_totals
+			WHERE day = $1 AND tenant_id = $2 AND currency = $3 AND status = $4 AND payment_method = $5 AND count <= 0`,
+			day, a.TenantID, a.Currency, a.Status, a.PaymentMethod)
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_daily_totals AS t (day, tenant_id, currency, status, payment_method,
+			count, amount, amount_received, amount_refunded)
+		VALUES ($1, $2, $3, $4, $5, 1, $6, $7, $8)
+		ON CONFLICT (day, tenant_id, currency, status, payment_method) DO UPDATE SET
+			count = t.count + 1,
+			amount = t.amount + EXCLUDED.amount,
+			amount_received = t.amount_received + EXCLUDED.amount_received,
+			amount_refunded = t.amount_refunded + EXCLUDED.amount_refunded`,
+		day, a.TenantID, a.Currency, a.Status, a.PaymentMethod, a.Amount, a.AmountReceived, a.AmountRefunded)
+	return err
+}
+
+// addCustomerLTV adds a to its customer's lifetime value, or with sign -1
+// takes it away, which does nothing once the customer was erased. Only
+// payments that received money count.
+func addCustomerLTV(ctx context.Context, tx *sql.Tx, a *PaymentAggregate, customer string, sign int64) error {
+	if customer == "" || a.AmountReceived <= 0 {
+		return nil
+	}
+	if sign < 0 {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE customer_ltv SET payments = payments - 1, amount_received = amount_received - $4,
+				amount_refunded = amount_refunded - $5, updated_at = now()
+			WHERE tenant_id = $1 AND customer_id = $2 AND currency = $3`,
+			a.TenantID, customer, a.Currency, a.AmountReceived, a.AmountRefunded); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			DELETE FROM customer_ltv WHERE tenant_id = $1 AND customer_id = $2 AND currency = $3 AND payments <= 0`,
+			a.TenantID, customer, a.Currency)
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO customer_ltv AS l (tenant_id, customer_id, currency, payments, amount_received, amount_refunded,
+			first_payment_at, last_payment_at)
+		VALUES ($1, $2, $3, 1, $4, $5, $6, $6)
+		ON CONFLICT (tenant_id, customer_id, currency) DO UPDATE SET
+			payments = l.payments + 1,
+			amount_received = l.amount_received + EXCLUDED.amount_received,
+			amount_refunded = l.amount_refunded + EXCLUDED.amount_refunded,
+			first_payment_at = LEAST(l.first_payment_at, EXCLUDED.first_payment_at),
+			last_payment_at = GREATEST(l.last_payment_at, EXCLUDED.last_payment_at),
+			updated_at = now()`,
+		a.TenantID, customer, a.Currency, a.AmountReceived, a.AmountRefunded, a.CreatedAt)
+	return err
+}
+
+// CustomerLTV is what a customer has paid in one currency.
+type CustomerLTV struct {
+	TenantID       string     `json:"tenant_id,omitempty"`
+	Currency       string     `json:"currency"`
+	Payments       int64      `json:"payments"`
+	AmountReceived int64      `json:"amount_received"`
+	AmountRefunded int64      `json:"amount_refunded"`
+	Net            int64      `json:"net"`
+	FirstPaymentAt *time.Time `json:"first_payment_at,omitempty"`
+	LastPaymentAt  *time.Time `json:"last_payment_at,omitempty"`
+}
+
+// CustomerLTV returns a customer's lifetime value per tenant and
+// currency, of tenantID's payments only when it is set.
+func (s *Store) CustomerLTV(ctx context.Context, customerID, tenantID string) ([]CustomerLTV, error) {
+	rows, err := s.reader().QueryContext(ctx, `
+		SELECT tenant_id, currency, payments, amount_received, amount_refunded, first_payment_at, last_payment_at
+		FROM customer_ltv WHERE customer_id = $1 AND ($2 = '' OR tenant_id = $2)
+		ORDER BY tenant_id, currency`, customerID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []CustomerLTV{}
+	for rows.Next() {
+		var l CustomerLTV
+		if err := rows.Scan(&l.TenantID, &l.Currency, &l.Payments, &l.AmountReceived, &l.AmountRefunded,
+			&l.FirstPaymentAt, &l.LastPaymentAt); err != nil {
+			return nil, err
+		}
+		l.Net = l.AmountReceived - l.AmountRefunded
+		out = append(out, l)
+	}
+	return out, rows.Err()
+}
+
+// ReadModelStatus is how far the read models are behind the event stream.
+type ReadModelStatus struct {
+	LastEventID int64     `json:"last_event_id"`
+	HeadEventID int64     `json:"head_event_id"`
+	Behind      int64     `json:"behind"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	CaughtUp    bool      `json:"caught_up"`
+}
+
+func (s *Store) ReadModelStatus(ctx context.Context) (*ReadModelStatus, error) {
+	var st ReadModelStatus
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(c.last_event_id, 0), COALESCE(c.updated_at, now()),
+			(SELECT COALESCE(MAX(id), 0) FROM payment_events),
+			(SELECT count(*) FROM payment_events WHERE id > COALESCE(c.last_event_id, 0))
+		FROM (SELECT 1) one LEFT JOIN read_model_checkpoints c ON c.name = $1`, readModelCheckpoint).
+		Scan(&st.LastEventID, &st.UpdatedAt, &st.HeadEventID, &st.Behind)
+	return &st, err
+}
+
+// ResetReadModels empties the read models and rewinds the checkpoint, so
+// the projector rebuilds them from the first event.
+func (s *Store) ResetReadModels(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `
+		SELECT 1 FROM read_model_checkpoints WHERE name = $1 FOR UPDATE`, readModelCheckpoint); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `TRUNCATE payment_summaries, payment_daily_totals, customer_ltv`); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO read_model_checkpoints (name, last_event_id) VALUES ($1, 0)
+		ON CONFLICT (name) DO UPDATE SET last_event_id = 0, updated_at = now()`, readModelCheckpoint); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (rm *ReadModels) customerLTV(c *gin.Context) {
+	ltv, err := rm.store.CustomerLTV(c.Request.Context(), c.Param("id"), c.Query("tenant_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondList(c, http.StatusOK, ltv, gin.H{"customer_id": c.Param("id")})
+}
+
+func (rm *ReadModels) status(c *gin.Context) {
+	st, err := rm.store.ReadModelStatus(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	st.CaughtUp = rm.caughtUp.Load()
+	respondData(c, http.StatusOK, st)
+}
+
+// rebuild starts the read models over from the first event. Lists and
+// reports read the write tables until the projector catches up again.
+func (rm *ReadModels) rebuild(c *gin.Context) {
+	if err := rm.store.ResetReadModels(c.Request.Context()); err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	rm.caughtUp.Store(false)
+	logf(c.Request.Context(), "read models: rebuild requested")
+	respondData(c, http.StatusAccepted, gin.H{"rebuilding": true})
+}
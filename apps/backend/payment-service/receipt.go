@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+//go:embed templates/receipt.html
+var defaultTemplates embed.FS
+
+// ReceiptItem is one line of the "items" metadata attached at creation.
+// TaxRate is the VAT percentage included in Amount when it differs from
+// the tenant's invoice profile.
+type ReceiptItem struct {
+	Name     string   `json:"name"`
+	Quantity int64    `json:"quantity"`
+	Amount   int64    `json:"amount"`
+	TaxRate  *float64 `json:"tax_rate,omitempty"`
+}
+
+// receiptView is the data handed to receipt templates, with amounts
+// already formatted for display. It is also what receipt links answer
+// with as JSON.
+type receiptView struct {
+	Brand          string        `json:"brand"`
+	PaymentID      string        `json:"payment_id"`
+	Status         string        `json:"status"`
+	Date           string        `json:"date"`
+	Total          string        `json:"total"`
+	Items          []receiptLine `json:"items,omitempty"`
+	CardBrand      string        `json:"card_brand,omitempty"`
+	CardLast4      string        `json:"card_last4,omitempty"`
+	Refunded       bool          `json:"refunded"`
+	RefundedAmount string        `json:"refunded_amount,omitempty"`
+	// Refunds are only listed on the receipt link's page.
+	Refunds []receiptRefund `json:"refunds,omitempty"`
+	// URL is the receipt link, in emails.
+	URL string `json:"-"`
+}
+
+type receiptLine struct {
+	Name     string `json:"name"`
+	Quantity int64  `json:"quantity"`
+	Amount   string `json:"amount"`
+}
+
+type receiptRefund struct {
+	Amount string `json:"amount"`
+	Status string `json:"status"`
+	Date   string `json:"date"`
+}
+
+// ReceiptService renders receipts and sends them through the mailer.
+// Templates are looked up per tenant in templateDir as <tenant>.html,
+// falling back to the built-in template. With documents set, the PDF the
+// tenant's invoice profile asks for is attached, and with links, a link
+// to the receipt online.
+type ReceiptService struct {
+	mailer      *MailerClient
+	brand       string
+	templateDir string
+	fallback    *template.Template
+	documents   *Documents
+	links       *ReceiptLinks
+}
+
+func NewReceiptService(mailer *MailerClient, brand, templateDir string) *ReceiptService {
+	return &ReceiptService{
+		mailer:      mailer,
+		brand:       brand,
+		templateDir: templateDir,
+		fallback:    template.Must(template.ParseFS(defaultTemplates, "templates/receipt.html")),
+	}
+}
+
+func (s *ReceiptService) template(tenantID string) *template.Template {
+	if s.templateDir == "" || tenantID == "" {
+		return s.fallback
+	}
+	path := filepath.Join(s.templateDir, filepath.Base(tenantID)+".html")
+	if _, err := os.Stat(path); err != nil {
+		return s.fallback
+	}
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		log.Printf("receipt template for tenant %s: %v", tenantID, err)
+		return s.fallback
+	}
+	return tmpl
+}
+
+// Send fetches the payment and emails its receipt. An empty to address
+// falls back to the receipt email recorded on the payment.
+func (s *ReceiptService) Send(ctx context.Context, paymentID, to string) error {
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	params.AddExpand("latest_charge")
+	params.AddExpand("customer")
+	pi, err := paymentintent.Get(paymentID, params)
+	if err != nil {
+		return fmt.Errorf("fetching payment %s: %w", paymentID, err)
+	}
+
+	if to == "" {
+		to = receiptEmail(pi)
+	}
+	if to == "" {
+		return fmt.Errorf("payment %s has no receipt email", paymentID)
+	}
+
+	view := s.view(pi)
+	if s.links != nil {
+		view.URL, _ = s.links.Link(pi.ID)
+	}
+	tenantID := pi.Metadata["tenant_id"]
+
+	var html bytes.Buffer
+	if err := s.template(tenantID).Execute(&html, view); err != nil {
+		return fmt.Errorf("rendering receipt: %w", err)
+	}
+
+	subject := fmt.Sprintf("Your %s receipt", s.brand)
+	if view.Refunded {
+		subject = fmt.Sprintf("Your %s refund", s.brand)
+	}
+
+	email := Email{
+		To:       to,
+		Subject:  subject,
+		HTML:     html.String(),
+		Text:     receiptText(view),
+		TenantID: tenantID,
+		Tags:     map[string]string{"payment_id": pi.ID, "kind": "receipt"},
+	}
+	if s.documents != nil {
+		// A receipt without its PDF is better than no receipt.
+		attachment, err := s.documents.Attachment(ctx, pi)
+		if err != nil {
+			logf(ctx, "receipt for %s: not attaching document: %v", pi.ID, err)
+		} else if attachment != nil {
+			email.Attachments = append(email.Attachments, *attachment)
+		}
+	}
+	return s.mailer.Send(ctx, email)
+}
+
+// SendAsync is used from webhooks, where the response to Stripe must not
+// wait on the mailer.
+// The request ID of ctx is kept for logs and the mailer call; its
+// cancellation is not.
+func (s *ReceiptService) SendAsync(ctx context.Context, paymentID string) {
+	ctx = withRequestID(context.Background(), requestIDFrom(ctx))
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		if err := s.Send(ctx, paymentID, ""); err != nil {
+			logf(ctx, "receipt for %s: %v", paymentID, err)
+		}
+	}()
+}
+
+func (s *ReceiptService) view(pi *stripe.PaymentIntent) receiptView {
+	currency := string(pi.Currency)
+	view := receiptView{
+		Brand:     s.brand,
+		PaymentID: pi.ID,
+		Status:    string(pi.Status),
+		Date:      time.Unix(pi.Created, 0).UTC().Format("January 2, 2006"),
+		Total:     formatAmount(pi.Amount, currency),
+	}
+
+	var items []ReceiptItem
+	if raw := pi.Metadata["items"]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &items); err != nil {
+			log.Printf("receipt for %s: ignoring malformed items metadata: %v", pi.ID, err)
+		}
+	}
+	for _, item := range items {
+		if item.Quantity < 1 {
+			item.Quantity = 1
+		}
+		view.Items = append(view.Items, receiptLine{
+			Name:     item.Name,
+			Quantity: item.Quantity,
+			Amount:   formatAmount(item.Amount*item.Quantity, currency),
+		})
+	}
+
+	if ch := pi.LatestCharge; ch != nil {
+		if pmd := ch.PaymentMethodDetails; pmd != nil && pmd.Card != nil {
+			view.CardBrand = titleCase(string(pmd.Card.Brand))
+			view.CardLast4 = pmd.Card.Last4
+		}
+		if ch.AmountRefunded > 0 {
+			view.Refunded = true
+			view.RefundedAmount = formatAmount(ch.AmountRefunded, currency)
+		}
+	}
+	return view
+}
+
+func receiptEmail(pi *stripe.PaymentIntent) string {
+	if email := pi.Metadata["receipt_email"]; email != "" {
+		return email
+	}
+	if pi.Customer != nil {
+		return pi.Customer.Email
+	}
+	return ""
+}
+
+func receiptText(v receiptView) string {
+	var b strings.Builder
+	if v.Refunded {
+		fmt.Fprintf(&b, "Your refund of %s has been processed.\n\n", v.RefundedAmount)
+	} else {
+		fmt.Fprintf(&b, "Thanks for your payment of %s.\n\n", v.Total)
+	}
+	for _, line := range v.Items {
+		fmt.Fprintf(&b, "%s x%d  %s\n", line.Name, line.Quantity, line.Amount)
+	}
+	if v.CardLast4 != "" {
+		fmt.Fprintf(&b, "\nPaid with %s ending in %s.\n", v.CardBrand, v.CardLast4)
+	}
+	fmt.Fprintf(&b, "\nPayment reference %s, %s\n", v.PaymentID, v.Date)
+	if v.URL != "" {
+		fmt.Fprintf(&b, "\nView this receipt online: %s\n", v.URL)
+	}
+	return b.String()
+}
+
+func titleCase(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// zeroDecimalCurrencies are charged in whole units by Stripe.
+var zeroDecimalCurrencies = map[string]bool{
+	"bif": true, "clp": true, "djf": true, "gnf": true, "jpy": true,
+	"kmf": true, "krw": true, "mga": true, "pyg": true, "rwf": true,
+	"ugx": true, "vnd": true, "vuv": true, "xaf": true, "xof": true, "xpf": true,
+}
+
+// formatAmount renders a minor-unit amount as e.g. "12.50 USD".
+func formatAmount(amount int64, currency string) string {
+	code := strings.ToUpper(currency)
+	if zeroDecimalCurrencies[strings.ToLower(currency)] {
+		return fmt.Sprintf("%d %s", amount, code)
+	}
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%02d %s", sign, amount/100, amount%100, code)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"github.com/stripe/stripe-go/v76/refund"
+)
+
+// ReceiptLinks hands out links customers can open without logging in to
+// see a payment's receipt and where its refunds stand, for receipt emails
+// and texts. The token in the link names the payment and when the link
+// expires, signed so it can't be altered or forged; nothing is stored.
+// Lookups are rate limited per client IP, since the route takes no API
+// key. The page uses the tenant's receipt template and shows nothing the
+// receipt doesn't: no email address, name or full card details.
+type ReceiptLinks struct {
+	store      *Store
+	receipts   *ReceiptService
+	signingKey []byte
+	baseURL    string
+	ttl        time.Duration
+	limiter    *ipRateLimiter
+}
+
+// NewReceiptLinks renders with receipts, which need not have a mailer.
+func NewReceiptLinks(store *Store, receipts *ReceiptService, signingKey []byte, baseURL string, ttl time.Duration, perMinute, burst int) *ReceiptLinks {
+	return &ReceiptLinks{
+		store:      store,
+		receipts:   receipts,
+		signingKey: signingKey,
+		baseURL:    baseURL,
+		ttl:        ttl,
+		limiter:    newIPRateLimiter(RateLimitConfig{RequestsPerSecond: float64(perMinute) / 60, Burst: burst}),
+	}
+}
+
+// RegisterRoutes mounts link creation under the receipts scope and the
+// lookup, which takes no API key.
+func (l *ReceiptLinks) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	r.POST("/receipts/links", requireScope(l.store, bootstrapToken, "receipts"), l.create)
+	r.GET("/receipts/:token", l.private, l.rateLimit, l.lookup)
+}
+
+func (l *ReceiptLinks) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, l.signingKey)
+	fmt.Fprintf(mac, "receipt:%s", payload)
+	return mac.Sum(nil)
+}
+
+// Link returns the link to a payment's receipt and when it expires.
+func (l *ReceiptLinks) Link(paymentID string) (string, time.Time) {
+	expires := time.Now().Add(l.ttl).UTC().Truncate(time.Second)
+	token := l.token(paymentID, expires)
+	return l.baseURL + "/receipts/" + token, expires
+}
+
+// token is the payment ID and expiry, then their signature, each
+// base64url-encoded and joined by a dot.
+func (l *ReceiptLinks) token(paymentID string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(paymentID + ":" + strconv.FormatInt(expires.Unix(), 10)))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(l.sign(payload))
+}
+
+// paymentFor returns the payment a token names, or false when it is
+// malformed, altered or expired.
+func (l *ReceiptLinks) paymentFor(token string) (string, bool) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, l.sign(payload)) {
+		return "", false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", false
+	}
+	paymentID, exp, ok := strings.Cut(string(raw), ":")
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if !ok || err != nil || time.Now().Unix() > expires || !strings.HasPrefix(paymentID, "pi_") {
+		return "", false
+	}
+	return paymentID, true
+}
+
+// create returns a receipt link for a payment, to send by text or put in
+// an email of the caller's own.
+func (l *ReceiptLinks) create(c *gin.Context) {
+	var req struct {
+		PaymentID string `json:"payment_id" binding:"required,startswith=pi_"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	params := &stripe.PaymentIntentParams{}
+	params.Context = c.Request.Context()
+	if _, err := paymentintent.Get(req.PaymentID, params); err != nil {
+		respondError(c, err)
+		return
+	}
+	url, expires := l.Link(req.PaymentID)
+	respondData(c, http.StatusOK, gin.H{"url": url, "expires_at": expires})
+}
+
+// private keeps the page out of caches, search engines and the Referer
+// of anything it links to, since its URL is the credential.
+func (l *ReceiptLinks) private(c *gin.Context) {
+	c.Header("Cache-Control", "private, no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("X-Robots-Tag", "noindex, nofollow")
+	c.Next()
+}
+
+func (l *ReceiptLinks) rateLimit(c *gin.Context) {
+	if l.limiter == nil {
+		c.Next()
+		return
+	}
+	if ip := c.ClientIP(); !l.limiter.allow(ip) {
+		c.Header("Retry-After", strconv.Itoa(int(l.limiter.retryAfter(ip)/time.Second)+1))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, errorBody(c, CodeRateLimited, "Too many receipt lookups"))
+		return
+	}
+	c.Next()
+}
+
+// lookup shows the receipt as a page, or as JSON to clients that ask for
+// it, with each refund and its status.
+func (l *ReceiptLinks) lookup(c *gin.Context) {
+	paymentID, ok := l.paymentFor(c.Param("token"))
+	if !ok {
+		c.JSON(http.StatusForbidden, errorBody(c, CodeForbidden, "Invalid or expired receipt link"))
+		return
+	}
+	ctx := c.Request.Context()
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	params.AddExpand("latest_charge")
+	pi, err := paymentintent.Get(paymentID, params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	view := l.receipts.view(pi)
+	list := &stripe.RefundListParams{PaymentIntent: stripe.String(pi.ID)}
+	list.Context = ctx
+	it := refund.List(list)
+	for it.Next() {
+		rf := it.Refund()
+		view.Refunds = append(view.Refunds, receiptRefund{
+			Amount: formatAmount(rf.Amount, string(rf.Currency)),
+			Status: string(rf.Status),
+			Date:   time.Unix(rf.Created, 0).UTC().Format("January 2, 2006"),
+		})
+	}
+	if err := it.Err(); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON {
+		respondData(c, http.StatusOK, view)
+		return
+	}
+	var html bytes.Buffer
+	if err := l.receipts.template(pi.Metadata["tenant_id"]).Execute(&html, view); err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, "Could not render the receipt"))
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", html.Bytes())
+}
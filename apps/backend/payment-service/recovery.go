@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recovery turns a handler panic into a 500 problem document carrying the
+// request ID, so the caller can quote it, and nothing else: the panic value
+// and stack go to the log, the panic metric and the error reporter only.
+// It runs inside requestID and accessLog so both see the request.
+func recovery(reporter ErrorReporter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			// net/http's signal to abort the response silently.
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			err, ok := rec.(error)
+			if !ok {
+				err = fmt.Errorf("panic: %v", rec)
+			}
+			ctx := c.Request.Context()
+			route := c.FullPath()
+			if route == "" {
+				route = "unmatched"
+			}
+
+			// A client hanging up mid-write isn't a bug.
+			if brokenPipe(err) {
+				logf(ctx, "client went away during %s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+				c.Abort()
+				return
+			}
+
+			logf(ctx, "panic in %s %s: %v\n%s", c.Request.Method, route, rec, debug.Stack())
+			panicsTotal.WithLabelValues(route).Inc()
+			reporter.Report(ctx, err, map[string]string{"route": route, "method": c.Request.Method})
+
+			if c.Writer.Written() {
+				// Headers are gone; all we can do is stop.
+				c.Abort()
+				return
+			}
+			// Drop whatever the handler had set, e.g. a JSON Content-Type.
+			c.Writer.Header().Del("Content-Type")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errorBody(c, CodeInternal, "Internal server error"))
+		}()
+		c.Next()
+	}
+}
+
+func brokenPipe(err error) bool {
+	var netErr *net.OpError
+	if !errors.As(err, &netErr) {
+		return false
+	}
+	var sysErr *os.SyscallError
+	if errors.As(netErr, &sysErr) {
+		return errors.Is(sysErr.Err, syscall.EPIPE) || errors.Is(sysErr.Err, syscall.ECONNRESET)
+	}
+	return false
+}
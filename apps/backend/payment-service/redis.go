@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisPoolSize is how many idle connections are kept for reuse.
+const redisPoolSize = 16
+
+// redisError is an error reply from Redis. The connection stays usable.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// Redis speaks just enough RESP for the velocity counters: commands in,
+// simple, error, integer, bulk and array replies out. Like the doctor's
+// check, it needs no client library. Connections are dialed on demand and
+// up to redisPoolSize idle ones are kept.
+type Redis struct {
+	url     *url.URL
+	addr    string
+	timeout time.Duration
+	idle    chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+// NewRedis parses a redis:// or rediss:// URL, optionally with a user,
+// password and /db. Every command must finish within timeout.
+func NewRedis(rawURL string, timeout time.Duration) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") {
+		return nil, fmt.Errorf("invalid REDIS_URL")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	return &Redis{url: u, addr: addr, timeout: timeout, idle: make(chan *redisConn, redisPoolSize)}, nil
+}
+
+func (r *Redis) dial(ctx context.Context) (*redisConn, error) {
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	var err error
+	if r.url.Scheme == "rediss" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: r.url.Hostname()}}).DialContext(ctx, "tcp", r.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", r.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, rd: bufio.NewReader(conn)}
+
+	var setup [][]string
+	if pass, ok := r.url.User.Password(); ok {
+		if name := r.url.User.Username(); name != "" {
+			setup = append(setup, []string{"AUTH", name, pass})
+		} else {
+			setup = append(setup, []string{"AUTH", pass})
+		}
+	}
+	if db := strings.TrimPrefix(r.url.Path, "/"); db != "" && db != "0" {
+		setup = append(setup, []string{"SELECT", db})
+	}
+	for _, args := range setup {
+		if _, err := c.do(ctx, r.timeout, args); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Do runs one command and returns its reply: a string, int64, nil (for a
+// nil bulk or array), []interface{} of those, or a redisError.
+func (r *Redis) Do(ctx context.Context, args ...string) (interface{}, error) {
+	var c *redisConn
+	select {
+	case c = <-r.idle:
+	default:
+		var err error
+		if c, err = r.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.do(ctx, r.timeout, args)
+	var re redisError
+	if err != nil && !errors.As(err, &re) {
+		// The stream may be mid-reply; start afresh next time.
+		c.Close()
+		return nil, err
+	}
+	select {
+	case r.idle <- c:
+	default:
+		c.Close()
+	}
+	return reply, err
+}
+
+func (c *redisConn) do(ctx context.Context, timeout time.Duration, args []string) (interface{}, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.SetDeadline(deadline)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c, b.String()); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+func (c *redisConn) reply() (interface{}, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch body := line[1:]; line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := c.reply()
+			var re redisError
+			if err != nil && !errors.As(err, &re) {
+				return nil, err
+			}
+			if err != nil {
+				item = err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// Close closes the idle connections.
+func (r *Redis) Close() {
+	for {
+		select {
+		case c := <-r.idle:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
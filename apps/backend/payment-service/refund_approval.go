@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"github.com/stripe/stripe-go/v76/refund"
+)
+
+var refundRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_refund_requests_total",
+	Help: "Refund requests held for approval, by outcome (requested, refunded, rejected, failed).",
+}, []string{"outcome"})
+
+// refundApproveScope lets an API key approve or reject held refunds.
+const refundApproveScope = "payments:refund:approve"
+
+// RefundApprovalConfig holds refunds above a per-currency amount, in minor
+// units, until a second API key with the payments:refund:approve scope
+// approves them. Currencies without a threshold refund straight away.
+//
+//	"refund_approval": {"thresholds": {"usd": 50000, "eur": 50000}}
+type RefundApprovalConfig struct {
+	Thresholds map[string]int64 `json:"thresholds"`
+}
+
+func (cfg RefundApprovalConfig) validate() error {
+	for cur, t := range cfg.Thresholds {
+		if len(cur) != 3 || t < 0 {
+			return fmt.Errorf("invalid refund_approval threshold %s=%d", cur, t)
+		}
+	}
+	return nil
+}
+
+func (cfg RefundApprovalConfig) requires(currency string, amount int64) bool {
+	t, ok := cfg.Thresholds[strings.ToLower(currency)]
+	return ok && amount > t
+}
+
+// Refund request statuses. An approved request has its refund in flight,
+// or failed for a reason worth approving it again for; the rest are
+// final.
+const (
+	refundRequestPending  = "pending"
+	refundRequestApproved = "approved"
+	refundRequestRefunded = "refunded"
+	refundRequestRejected = "rejected"
+	refundRequestFailed   = "failed"
+)
+
+// errRefundRequestState refuses a decision the request's status doesn't
+// allow.
+var errRefundRequestState = errors.New("refund request state does not allow this")
+
+// errSelfApproval refuses an approval by the key that requested the
+// refund.
+var errSelfApproval = errors.New("refund requested by the approving key")
+
+// RefundRequest is a refund waiting for, or past, its approval.
+type RefundRequest struct {
+	ID           string     `json:"id"`
+	PaymentID    string     `json:"payment_id"`
+	Currency     string     `json:"currency"`
+	Amount       int64      `json:"amount"`
+	Reason       string     `json:"reason,omitempty"`
+	Status       string     `json:"status"`
+	RequestedBy  string     `json:"requested_by"`
+	DecidedBy    string     `json:"decided_by,omitempty"`
+	DecisionNote string     `json:"decision_note,omitempty"`
+	RefundID     string     `json:"refund_id,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	DecidedAt    *time.Time `json:"decided_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// RefundRequestEvent is one entry in a request's audit trail.
+type RefundRequestEvent struct {
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const refundRequestColumns = `id, payment_id, currency, amount, reason, status, requested_by, decided_by, decision_note,
+	refund_id, last_error, decided_at, created_at, updated_at`
+
+func scanRefundRequest(row interface{ Scan(...interface{}) error }) (*RefundRequest, error) {
+	var r RefundRequest
+	var decided sql.NullTime
+	if err := row.Scan(&r.ID, &r.PaymentID, &r.Currency, &r.Amount, &r.Reason, &r.Status, &r.RequestedBy,
+		&r.DecidedBy, &r.DecisionNote, &r.RefundID, &r.LastError, &decided, &r.CreatedAt, &r.UpdatedAt); err != nil {
+		return nil, err
+	}
+	r.DecidedAt = timeOrNil(decided)
+	return &r, nil
+}
+
+// CreateRefundRequest records a pending request and its "requested" event.
+// A retry with the same idempotency key gets the request the first
+// attempt recorded.
+func (s *Store) CreateRefundRequest(ctx context.Context, r *RefundRequest, idempotencyKey string) (*RefundRequest, error) {
+	key := sql.NullString{String: idempotencyKey, Valid: idempotencyKey != ""}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	created, err := scanRefundRequest(tx.QueryRowContext(ctx, `
+		INSERT INTO refund_requests (id, payment_id, currency, amount, reason, status, requested_by, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (idempotency_key) DO NOTHING
+		RETURNING `+refundRequestColumns,
+		r.ID, r.PaymentID, r.Currency, r.Amount, r.Reason, r.Status, r.RequestedBy, key))
+	if errors.Is(err, sql.ErrNoRows) && key.Valid {
+		return scanRefundRequest(s.db.QueryRowContext(ctx, `
+			SELECT `+refundRequestColumns+` FROM refund_requests WHERE idempotency_key = $1`, key))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO refund_request_events (request_id, action, actor, detail) VALUES ($1, 'requested', $2, $3)`,
+		created.ID, created.RequestedBy, fmt.Sprintf("%d %s", created.Amount, created.Currency)); err != nil {
+		return nil, err
+	}
+	return created, tx.Commit()
+}
+
+func (s *Store) RefundRequest(ctx context.Context, id string) (*RefundRequest, error) {
+	return scanRefundRequest(s.db.QueryRowContext(ctx, `SELECT `+refundRequestColumns+` FROM refund_requests WHERE id = $1`, id))
+}
+
+// ListRefundRequests returns up to 100 requests, newest first, optionally
+// only those in status.
+func (s *Store) ListRefundRequests(ctx context.Context, status string) ([]*RefundRequest, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+refundRequestColumns+` FROM refund_requests
+		WHERE $1 = '' OR status = $1
+		ORDER BY created_at DESC LIMIT 100`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []*RefundRequest{}
+	for rows.Next() {
+		r, err := scanRefundRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, r)
+	}
+	return requests, rows.Err()
+}
+
+// RefundRequestEvents lists a request's audit trail, oldest first.
+func (s *Store) RefundRequestEvents(ctx context.Context, id string) ([]RefundRequestEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT action, actor, detail, created_at FROM refund_request_events
+		WHERE request_id = $1 ORDER BY created_at, id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []RefundRequestEvent{}
+	for rows.Next() {
+		var e RefundRequestEvent
+		if err := rows.Scan(&e.Action, &e.Actor, &e.Detail, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// changeRefundRequest applies fn to a request under its row lock and saves
+// the result with the event fn returns. fn refuses a change by returning
+// an error, in which case the request is returned as it was.
+func (s *Store) changeRefundRequest(ctx context.Context, id string, fn func(r *RefundRequest) (RefundRequestEvent, error)) (*RefundRequest, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	r, err := scanRefundRequest(tx.QueryRowContext(ctx, `
+		SELECT `+refundRequestColumns+` FROM refund_requests WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		return nil, err
+	}
+	before := *r
+	event, err := fn(r)
+	if err != nil {
+		return &before, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO refund_request_events (request_id, action, actor, detail) VALUES ($1, $2, $3, $4)`,
+		id, event.Action, event.Actor, event.Detail); err != nil {
+		return nil, err
+	}
+	r, err = scanRefundRequest(tx.QueryRowContext(ctx, `
+		UPDATE refund_requests SET
+			status = $2, decided_by = $3, decision_note = $4, refund_id = $5, last_error = $6, decided_at = $7,
+			updated_at = now()
+		WHERE id = $1
+		RETURNING `+refundRequestColumns,
+		id, r.Status, r.DecidedBy, r.DecisionNote, r.RefundID, r.LastError, nullTimeOf(r.DecidedAt)))
+	if err != nil {
+		return nil, err
+	}
+	return r, tx.Commit()
+}
+
+// RefundApprovals holds refunds above the configured thresholds for a
+// second pair of eyes. The admin refund endpoint records the request; an
+// API key with the payments:refund:approve scope, other than the one that
+// asked, approves it, which issues the refund, or rejects it. Every step
+// is kept as the request's audit trail.
+type RefundApprovals struct {
+	store    *Store
+	settings *RuntimeSettings
+}
+
+func NewRefundApprovals(store *Store, settings *RuntimeSettings) *RefundApprovals {
+	return &RefundApprovals{store: store, settings: settings}
+}
+
+// RegisterRoutes mounts the approval queue. Approvers need not be admins.
+func (ra *RefundApprovals) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/admin/refund-requests", requireScope(ra.store, bootstrapToken, refundApproveScope), ra.requireStore)
+	g.GET("", ra.list)
+	g.GET("/:id", ra.get)
+	g.POST("/:id/approve", ra.approve)
+	g.POST("/:id/reject", ra.reject)
+}
+
+func (ra *RefundApprovals) requireStore(c *gin.Context) {
+	if ra.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Refund approval requires DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// enabled reports whether any refund can need approval.
+func (ra *RefundApprovals) enabled() bool {
+	return ra != nil && len(ra.settings.Get().RefundApproval.Thresholds) > 0
+}
+
+// hold records a refund request instead of refunding when the refund is
+// above the payment currency's threshold, answering 202 with the pending
+// request. It returns false, having written nothing, when the refund can
+// go ahead; true when it answered the request itself. An amount of 0 is
+// the payment's refundable balance.
+func (ra *RefundApprovals) hold(c *gin.Context, amount int64, reason string) bool {
+	if !ra.enabled() {
+		return false
+	}
+	ctx := c.Request.Context()
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	params.AddExpand("latest_charge")
+	pi, err := paymentintent.Get(c.Param("id"), params)
+	if err != nil {
+		respondError(c, err)
+		return true
+	}
+	if amount == 0 && pi.LatestCharge != nil {
+		amount = pi.LatestCharge.Amount - pi.LatestCharge.AmountRefunded
+	}
+	if amount <= 0 || !ra.settings.Get().RefundApproval.requires(string(pi.Currency), amount) {
+		// Stripe refuses what there is nothing to refund of.
+		return false
+	}
+	if ra.store == nil {
+		c.JSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Refund approval requires DATABASE_URL"))
+		return true
+	}
+
+	want := &RefundRequest{
+		ID:          uuid.NewString(),
+		PaymentID:   pi.ID,
+		Currency:    string(pi.Currency),
+		Amount:      amount,
+		Reason:      reason,
+		Status:      refundRequestPending,
+		RequestedBy: c.GetString("api_key_id"),
+	}
+	req, err := ra.store.CreateRefundRequest(ctx, want, c.GetHeader("Idempotency-Key"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return true
+	}
+	if req.PaymentID != want.PaymentID || req.Amount != want.Amount {
+		c.JSON(http.StatusConflict, errorBody(c, CodeIdempotencyConflict, "Idempotency-Key was already used for a different refund"))
+		return true
+	}
+	if req.ID == want.ID {
+		refundRequestsTotal.WithLabelValues("requested").Inc()
+	}
+	respondData(c, http.StatusAccepted, req)
+	return true
+}
+
+func (ra *RefundApprovals) list(c *gin.Context) {
+	requests, err := ra.store.ListRefundRequests(c.Request.Context(), c.Query("status"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondList(c, http.StatusOK, requests, gin.H{"status": c.Query("status")})
+}
+
+// get returns a request with its audit trail.
+func (ra *RefundApprovals) get(c *gin.Context) {
+	ctx := c.Request.Context()
+	req, err := ra.store.RefundRequest(ctx, c.Param("id"))
+	if !ra.respondChange(c, req, err) {
+		return
+	}
+	events, err := ra.store.RefundRequestEvents(ctx, req.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{"request": req, "events": events})
+}
+
+// respondChange answers a failed lookup or decision, returning false, or
+// returns true when err is nil.
+func (ra *RefundApprovals) respondChange(c *gin.Context, req *RefundRequest, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Refund request not found"))
+	case errors.Is(err, errSelfApproval):
+		c.JSON(http.StatusForbidden, errorBody(c, CodeForbidden, "Refunds must be approved by a different API key than requested them"))
+	case errors.Is(err, errRefundRequestState):
+		c.JSON(http.StatusConflict, errorBodyWith(c, CodeRefundRequestState, "Refund request is "+req.Status,
+			gin.H{"status": req.Status}))
+	default:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+	}
+	return false
+}
+
+// approve marks a pending request approved and issues its refund. The
+// refund's idempotency key is the request's, so approving a request whose
+// refund failed on a network error again can't refund twice. A refund
+// Stripe refuses fails the request for good.
+func (ra *RefundApprovals) approve(c *gin.Context) {
+	var req struct {
+		Note string `json:"note"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+	ctx := c.Request.Context()
+	actor := c.GetString("api_key_id")
+	rr, err := ra.store.changeRefundRequest(ctx, c.Param("id"), func(r *RefundRequest) (RefundRequestEvent, error) {
+		switch {
+		case r.Status == refundRequestApproved && r.DecidedBy == actor:
+			return RefundRequestEvent{Action: "retried", Actor: actor}, nil
+		case r.Status != refundRequestPending:
+			return RefundRequestEvent{}, errRefundRequestState
+		case r.RequestedBy == actor:
+			return RefundRequestEvent{}, errSelfApproval
+		}
+		now := time.Now().UTC()
+		r.Status, r.DecidedBy, r.DecisionNote, r.DecidedAt = refundRequestApproved, actor, req.Note, &now
+		return RefundRequestEvent{Action: "approved", Actor: actor, Detail: req.Note}, nil
+	})
+	if !ra.respondChange(c, rr, err) {
+		return
+	}
+
+	params := &stripe.RefundParams{PaymentIntent: stripe.String(rr.PaymentID), Amount: stripe.Int64(rr.Amount)}
+	params.Context = ctx
+	if rr.Reason != "" {
+		params.Reason = stripe.String(rr.Reason)
+	}
+	params.AddMetadata("requested_by", rr.RequestedBy)
+	params.AddMetadata("approved_by", rr.DecidedBy)
+	params.AddMetadata("refund_request_id", rr.ID)
+	if id := requestIDFrom(ctx); id != "" {
+		params.AddMetadata("request_id", id)
+	}
+	params.SetIdempotencyKey("refund-request-" + rr.ID)
+	rf, rerr := refund.New(params)
+	ctx = context.WithoutCancel(ctx)
+
+	var stripeErr *stripe.Error
+	refused := errors.As(rerr, &stripeErr) &&
+		(stripeErr.Type == stripe.ErrorTypeInvalidRequest || stripeErr.Type == stripe.ErrorTypeCard)
+	rr, err = ra.store.changeRefundRequest(ctx, rr.ID, func(r *RefundRequest) (RefundRequestEvent, error) {
+		switch {
+		case rerr == nil:
+			r.Status, r.RefundID, r.LastError = refundRequestRefunded, rf.ID, ""
+			return RefundRequestEvent{Action: "refunded", Detail: rf.ID}, nil
+		case refused:
+			r.Status = refundRequestFailed
+		}
+		r.LastError = rerr.Error()
+		return RefundRequestEvent{Action: "failed", Detail: rerr.Error()}, nil
+	})
+	if err != nil {
+		logf(ctx, "saving outcome of refund request %s: %v", c.Param("id"), err)
+	}
+	switch {
+	case rerr != nil:
+		if refused {
+			refundRequestsTotal.WithLabelValues("failed").Inc()
+		}
+		respondError(c, rerr)
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+	default:
+		refundRequestsTotal.WithLabelValues("refunded").Inc()
+		respondData(c, http.StatusOK, rr)
+	}
+}
+
+// reject closes a pending request without refunding. Requesters may
+// withdraw their own requests this way.
+func (ra *RefundApprovals) reject(c *gin.Context) {
+	var req struct {
+		Note string `json:"note"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+	actor := c.GetString("api_key_id")
+	rr, err := ra.store.changeRefundRequest(c.Request.Context(), c.Param("id"), func(r *RefundRequest) (RefundRequestEvent, error) {
+		if r.Status != refundRequestPending {
+			return RefundRequestEvent{}, errRefundRequestState
+		}
+		now := time.Now().UTC()
+		r.Status, r.DecidedBy, r.DecisionNote, r.DecidedAt = refundRequestRejected, actor, req.Note, &now
+		return RefundRequestEvent{Action: "rejected", Actor: actor, Detail: req.Note}, nil
+	})
+	if !ra.respondChange(c, rr, err) {
+		return
+	}
+	refundRequestsTotal.WithLabelValues("rejected").Inc()
+	respondData(c, http.StatusOK, rr)
+}
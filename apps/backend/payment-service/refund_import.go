@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// maxRefundImportBody bounds a refund import, whatever its row count.
+const maxRefundImportBody = 16 << 20
+
+// refundablePayment is what the local store knows of a payment's
+// refundable balance.
+type refundablePayment struct {
+	currency           string
+	received, refunded int64
+}
+
+// RefundablePayments returns the stored payments among ids.
+func (s *Store) RefundablePayments(ctx context.Context, ids []string) (map[string]refundablePayment, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, currency, amount_received, amount_refunded FROM payments WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]refundablePayment, len(ids))
+	for rows.Next() {
+		var id string
+		var p refundablePayment
+		if err := rows.Scan(&id, &p.currency, &p.received, &p.refunded); err != nil {
+			return nil, err
+		}
+		out[id] = p
+	}
+	return out, rows.Err()
+}
+
+// refundImportTotal is what an import would refund in one currency.
+type refundImportTotal struct {
+	Payments         int   `json:"payments"`
+	Amount           int64 `json:"amount"`
+	RequiresApproval int   `json:"requires_approval"`
+}
+
+// importCSV starts a bulk refund from a CSV body with a header row and
+// payment_id, amount and reason columns, as finance's spreadsheets have
+// them. amount is in minor units and may be left empty to refund what is
+// left of the payment; reason may be left empty too. Every row is checked
+// against the local store, and nothing is started unless all of them
+// pass. With ?dry_run=true nothing is started either way: the answer is
+// a preview of what would be refunded, per currency, with each row's
+// problems.
+func (br *BulkRefunds) importCSV(c *gin.Context) {
+	r := csv.NewReader(http.MaxBytesReader(c.Writer, c.Request.Body, maxRefundImportBody))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "Body must be CSV with a header row"))
+		return
+	}
+	col := map[string]int{}
+	for i, name := range header {
+		col[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	if _, ok := col["payment_id"]; !ok {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "CSV header lacks a payment_id column"))
+		return
+	}
+
+	var items []BulkRefundItem
+	fields := []FieldError{}
+	seen := map[string]int{}
+	for row := 0; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "Invalid CSV: "+err.Error()))
+			return
+		}
+		if row >= br.maxItems {
+			c.JSON(http.StatusRequestEntityTooLarge, errorBody(c, CodePayloadTooLarge,
+				fmt.Sprintf("A bulk refund takes at most %d payments", br.maxItems)))
+			return
+		}
+		cell := func(name string) string {
+			if i, ok := col[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		prefix := fmt.Sprintf("rows[%d].", row)
+		it := BulkRefundItem{PaymentID: cell("payment_id"), Reason: cell("reason")}
+		switch first, dup := seen[it.PaymentID]; {
+		case it.PaymentID == "":
+			fields = append(fields, FieldError{Field: prefix + "payment_id", Code: "required", Message: "is required"})
+		case dup:
+			fields = append(fields, FieldError{Field: prefix + "payment_id", Code: "invalid",
+				Message: fmt.Sprintf("is also on row %d", first)})
+		default:
+			seen[it.PaymentID] = row
+		}
+		if v := cell("amount"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			switch {
+			case err != nil:
+				fields = append(fields, FieldError{Field: prefix + "amount", Code: "invalid", Message: "must be an integer in minor units"})
+			case n <= 0:
+				fields = append(fields, FieldError{Field: prefix + "amount", Code: "too_small", Message: "must be positive, or empty for the full remainder"})
+			}
+			it.Amount = n
+		}
+		if !validRefundReason(it.Reason) {
+			fields = append(fields, FieldError{Field: prefix + "reason", Code: "invalid_choice",
+				Message: "must be duplicate, fraudulent or requested_by_customer"})
+		}
+		items = append(items, it)
+	}
+	if len(items) == 0 {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "CSV has no rows"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	payments, err := br.store.RefundablePayments(ctx, ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	approval := br.settings.Get().RefundApproval
+	totals := map[string]*refundImportTotal{}
+	for row, it := range items {
+		if it.PaymentID == "" || seen[it.PaymentID] != row {
+			continue
+		}
+		prefix := fmt.Sprintf("rows[%d].", row)
+		p, ok := payments[it.PaymentID]
+		if !ok {
+			fields = append(fields, FieldError{Field: prefix + "payment_id", Code: "not_found", Message: "is not a stored payment"})
+			continue
+		}
+		remaining := p.received - p.refunded
+		amount := it.Amount
+		if amount == 0 {
+			amount = remaining
+		}
+		switch {
+		case remaining <= 0:
+			fields = append(fields, FieldError{Field: prefix + "payment_id", Code: "invalid", Message: "has nothing left to refund"})
+			continue
+		case amount > remaining:
+			fields = append(fields, FieldError{Field: prefix + "amount", Code: "too_large",
+				Message: fmt.Sprintf("exceeds the refundable balance of %d", remaining)})
+			continue
+		case amount <= 0:
+			continue
+		}
+		t := totals[p.currency]
+		if t == nil {
+			t = &refundImportTotal{}
+			totals[p.currency] = t
+		}
+		t.Payments++
+		t.Amount += amount
+		if approval.requires(p.currency, amount) {
+			t.RequiresApproval++
+		}
+	}
+
+	if isDryRun(c) {
+		respondData(c, http.StatusOK, gin.H{
+			"dry_run":  true,
+			"rows":     len(items),
+			"valid":    len(fields) == 0,
+			"totals":   totals,
+			"problems": fields,
+		})
+		return
+	}
+	if len(fields) > 0 {
+		validationFailed(c, fields)
+		return
+	}
+
+	want := &BulkRefund{
+		ID:          "brf_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		RequestedBy: c.GetString("api_key_id"),
+	}
+	b, err := br.store.CreateBulkRefund(ctx, want, items, c.GetHeader("Idempotency-Key"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if b.ID == want.ID {
+		logf(ctx, "bulk refund %s of %d payments imported by %s", b.ID, b.Total, b.RequestedBy)
+	}
+	respondData(c, http.StatusAccepted, b)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+)
+
+var residencyForwardsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_residency_forwards_total",
+	Help: "Payment creations forwarded to the instance of another region, by region.",
+}, []string{"region"})
+
+// serviceRegion is the region this instance serves, such as "eu" or "us".
+// Each region runs its own instances against its own Stripe account and
+// database. Empty turns data residency off.
+var serviceRegion = strings.ToLower(strings.TrimSpace(os.Getenv("REGION")))
+
+// metadataRegion is set on every intent created while REGION is set.
+const metadataRegion = "region"
+
+// regionForwardedHeader marks a request an instance forwarded, so the
+// receiving one never forwards it again.
+const regionForwardedHeader = "X-Region-Forwarded-From"
+
+var regionPattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,31}$`)
+
+// regionEnv reads a region-scoped setting: NAME_EU on the eu instance,
+// falling back to NAME, so one set of secrets can carry every region's
+// Stripe keys and databases.
+func regionEnv(name string) string {
+	if serviceRegion != "" {
+		suffix := strings.ToUpper(strings.ReplaceAll(serviceRegion, "-", "_"))
+		if v := os.Getenv(name + "_" + suffix); v != "" {
+			return v
+		}
+	}
+	return os.Getenv(name)
+}
+
+// ResidencyConfig places customers in regions. A payment belongs to its
+// tenant's region if the tenant is pinned, else to the region the request
+// names, else to that of customer_country, else to Default. Nothing
+// matching, or an empty Default, means the region of the instance asked.
+//
+//	"residency": {"default": "us",
+//	              "countries": {"DE": "eu", "FR": "eu", "IE": "eu"},
+//	              "tenants": {"acme-gmbh": "eu"}}
+type ResidencyConfig struct {
+	Default   string            `json:"default"`
+	Countries map[string]string `json:"countries"`
+	Tenants   map[string]string `json:"tenants"`
+}
+
+func (cfg ResidencyConfig) validate() error {
+	if cfg.Default != "" && !regionPattern.MatchString(cfg.Default) {
+		return fmt.Errorf("residency default: invalid region %q", cfg.Default)
+	}
+	for country, region := range cfg.Countries {
+		if len(country) != 2 || strings.ToUpper(country) != country {
+			return fmt.Errorf("residency countries: %q is not a two-letter country code", country)
+		}
+		if !regionPattern.MatchString(region) {
+			return fmt.Errorf("residency countries.%s: invalid region %q", country, region)
+		}
+	}
+	for tenant, region := range cfg.Tenants {
+		if !regionPattern.MatchString(region) {
+			return fmt.Errorf("residency tenants.%s: invalid region %q", tenant, region)
+		}
+	}
+	return nil
+}
+
+// parseRegionEndpoints reads REGION_ENDPOINTS, the base URLs of the other
+// regions' instances: "eu=https://payments.eu.example.com,us=https://...".
+func parseRegionEndpoints(raw string) (map[string]*url.URL, error) {
+	endpoints := map[string]*url.URL{}
+	for _, entry := range strings.Split(raw, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		region, rawURL, ok := strings.Cut(entry, "=")
+		region = strings.ToLower(strings.TrimSpace(region))
+		if !ok || !regionPattern.MatchString(region) {
+			return nil, fmt.Errorf("invalid REGION_ENDPOINTS entry %q", entry)
+		}
+		u, err := url.Parse(strings.TrimSpace(rawURL))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("REGION_ENDPOINTS %s: not an absolute http(s) URL", region)
+		}
+		endpoints[region] = u
+	}
+	return endpoints, nil
+}
+
+// Residency keeps each payment's data in its customer's region. Payments
+// for this region are created here and stamped with it; those for another
+// are forwarded to that region's instance when REGION_ENDPOINTS names it,
+// and refused otherwise. Payments created elsewhere aren't known here, so
+// calls about an existing payment go to the region its responses name.
+type Residency struct {
+	settings  *RuntimeSettings
+	endpoints map[string]*url.URL
+}
+
+func NewResidency(settings *RuntimeSettings, endpoints map[string]*url.URL) *Residency {
+	return &Residency{settings: settings, endpoints: endpoints}
+}
+
+// region is where req's payment belongs.
+func (r *Residency) region(req PaymentRequest) string {
+	cfg := r.settings.Get().Residency
+	if region := cfg.Tenants[req.TenantID]; region != "" && req.TenantID != "" {
+		return region
+	}
+	if req.Region != "" {
+		return strings.ToLower(req.Region)
+	}
+	if region := cfg.Countries[strings.ToUpper(req.CustomerCountry)]; region != "" {
+		return region
+	}
+	if cfg.Default != "" {
+		return cfg.Default
+	}
+	return serviceRegion
+}
+
+// check refuses a payment that belongs to another region with
+// wrong_region, naming the region and, when known, where it is served.
+func (r *Residency) check(req PaymentRequest) *refusal {
+	if r == nil {
+		return nil
+	}
+	region := r.region(req)
+	if region == serviceRegion {
+		return nil
+	}
+	ext := gin.H{"region": region}
+	if u, ok := r.endpoints[region]; ok {
+		ext["endpoint"] = u.String()
+	}
+	return &refusal{http.StatusMisdirectedRequest, CodeWrongRegion,
+		fmt.Sprintf("This payment belongs to the %s region and can't be processed in %s", region, serviceRegion), ext}
+}
+
+func (r *Residency) addMetadata(params *stripe.PaymentIntentParams) {
+	if r != nil {
+		params.AddMetadata(metadataRegion, serviceRegion)
+	}
+}
+
+// forward sends a payment creation that belongs to another region on to
+// that region's instance unchanged, headers and all, and relays its
+// answer. The request passes through this region but nothing of it is
+// stored here. Anything it can't place continues to the handler, which
+// refuses it.
+func (r *Residency) forward(c *gin.Context) {
+	if r == nil || len(r.endpoints) == 0 || c.GetHeader(regionForwardedHeader) != "" || c.Request.Body == nil {
+		c.Next()
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		c.Next()
+		return
+	}
+	var req PaymentRequest
+	if json.Unmarshal(body, &req) != nil {
+		c.Next()
+		return
+	}
+	region := r.region(req)
+	u, ok := r.endpoints[region]
+	if region == serviceRegion || !ok {
+		c.Next()
+		return
+	}
+	residencyForwardsTotal.WithLabelValues(region).Inc()
+	c.Abort()
+
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	director := proxy.Director
+	proxy.Director = func(out *http.Request) {
+		director(out)
+		out.Host = u.Host
+		out.Header.Set(regionForwardedHeader, serviceRegion)
+	}
+	proxy.ErrorHandler = func(_ http.ResponseWriter, _ *http.Request, err error) {
+		logf(c.Request.Context(), "residency: forwarding to %s: %v", region, err)
+		c.JSON(http.StatusBadGateway, errorBody(c, CodeUpstreamFailed, "The "+region+" region could not be reached"))
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// regionOf is the region a payment was created in, if residency was on.
+func regionOf(pi *stripe.PaymentIntent) string {
+	return pi.Metadata[metadataRegion]
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReportQuery selects the rows and grouping of a report.
+type ReportQuery struct {
+	From     time.Time
+	To       time.Time
+	GroupBy  []string
+	TenantID string
+}
+
+// ReportRow is one group of a report. Amounts are in minor units of the
+// row's currency; reports are always split by currency so totals never mix
+// currencies.
+type ReportRow struct {
+	Group  map[string]string `json:"group"`
+	Count  int64             `json:"count"`
+	Totals map[string]int64  `json:"totals"`
+}
+
+// reportSource describes what a report aggregates. dimensions maps group_by
+// values to SQL expressions; only these are ever interpolated into report
+// queries. exprs and names are the aggregate columns, in scan order, and
+// count the row count, COUNT(*) when empty.
+type reportSource struct {
+	from       string
+	created    string
+	count      string
+	dimensions map[string]string
+	exprs      []string
+	names      []string
+}
+
+// paymentAccount is the Stripe account payment p is on: the one it was
+// routed to, or the primary.
+const paymentAccount = `COALESCE((SELECT pr.arm FROM payment_routes pr WHERE pr.payment_id = p.id), 'primary')`
+
+var paymentReport = reportSource{
+	from:    "payments p",
+	created: "p.created_at",
+	dimensions: map[string]string{
+		"day":            `to_char(date_trunc('day', p.created_at AT TIME ZONE 'UTC'), 'YYYY-MM-DD')`,
+		"week":           `to_char(date_trunc('week', p.created_at AT TIME ZONE 'UTC'), 'YYYY-MM-DD')`,
+		"currency":       `p.currency`,
+		"status":         `p.status`,
+		"payment_method": `p.payment_method`,
+		"tenant":         `p.tenant_id`,
+		"account":        paymentAccount,
+	},
+	exprs: []string{"SUM(p.amount)", "SUM(p.amount_received)", "SUM(p.amount_refunded)", "SUM(p.amount_received - p.amount_refunded)"},
+	names: []string{"amount", "amount_received", "amount_refunded", "net"},
+}
+
+// Refund reports take status and creation time from the refund itself;
+// tenant and payment method come from the refunded payment.
+var refundReport = reportSource{
+	from:    "refunds r JOIN payments p ON p.id = r.payment_id",
+	created: "r.created_at",
+	dimensions: map[string]string{
+		"day":            `to_char(date_trunc('day', r.created_at AT TIME ZONE 'UTC'), 'YYYY-MM-DD')`,
+		"week":           `to_char(date_trunc('week', r.created_at AT TIME ZONE 'UTC'), 'YYYY-MM-DD')`,
+		"currency":       `r.currency`,
+		"status":         `r.status`,
+		"payment_method": `p.payment_method`,
+		"tenant":         `p.tenant_id`,
+		"account":        paymentAccount,
+	},
+	exprs: []string{"SUM(r.amount)"},
+	names: []string{"amount"},
+}
+
+// Fee reports cover every balance transaction, including account-level
+// fees with no payment, so their net matches what was paid out. They are
+// split by balance currency; tenant comes from the payment.
+var feeReport = reportSource{
+	from:    "payment_fees f LEFT JOIN payments p ON p.id = f.payment_id",
+	created: "f.created_at",
+	dimensions: map[string]string{
+		"day":      `to_char(date_trunc('day', f.created_at AT TIME ZONE 'UTC'), 'YYYY-MM-DD')`,
+		"week":     `to_char(date_trunc('week', f.created_at AT TIME ZONE 'UTC'), 'YYYY-MM-DD')`,
+		"month":    `to_char(date_trunc('month', f.created_at AT TIME ZONE 'UTC'), 'YYYY-MM')`,
+		"currency": `f.currency`,
+		"provider": `f.provider`,
+		"type":     `f.type`,
+		"tenant":   `COALESCE(p.tenant_id, '')`,
+		"account":  `f.account`,
+	},
+	exprs: []string{"SUM(f.amount)", "SUM(f.fee)", "SUM(f.processing_fee)", "SUM(f.application_fee)", "SUM(f.tax)", "SUM(f.net)"},
+	names: []string{"gross", "fees", "processing_fees", "application_fees", "tax", "net"},
+}
+
+func (s *Store) Report(ctx context.Context, m reportSource, q ReportQuery) ([]ReportRow, error) {
+	groups := q.GroupBy
+	if !containsString(groups, "currency") {
+		groups = append(groups, "currency")
+	}
+
+	var selects, positions []string
+	for i, g := range groups {
+		selects = append(selects, m.dimensions[g])
+		positions = append(positions, fmt.Sprint(i+1))
+	}
+
+	count := m.count
+	if count == "" {
+		count = "COUNT(*)"
+	}
+	query := fmt.Sprintf(`SELECT %s, %s, %s FROM %s
+		WHERE %s >= $1 AND %s < $2 AND ($3 = '' OR p.tenant_id = $3)
+		GROUP BY %s ORDER BY %s`,
+		strings.Join(selects, ", "), count, strings.Join(m.exprs, ", "), m.from,
+		m.created, m.created, strings.Join(positions, ", "), strings.Join(positions, ", "))
+
+	rows, err := s.reader().QueryContext(ctx, query, q.From, q.To, q.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := []ReportRow{}
+	for rows.Next() {
+		keys := make([]string, len(groups))
+		totals := make([]int64, len(m.names))
+		var count int64
+
+		dest := make([]interface{}, 0, len(groups)+1+len(totals))
+		for i := range keys {
+			dest = append(dest, &keys[i])
+		}
+		dest = append(dest, &count)
+		for i := range totals {
+			dest = append(dest, &totals[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		row := ReportRow{Group: map[string]string{}, Count: count, Totals: map[string]int64{}}
+		for i, g := range groups {
+			row.Group[g] = keys[i]
+		}
+		for i, name := range m.names {
+			row.Totals[name] = totals[i]
+		}
+		report = append(report, row)
+	}
+	return report, rows.Err()
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func parseReportQuery(c *gin.Context, m reportSource) (ReportQuery, error) {
+	q := ReportQuery{
+		To:       time.Now().UTC(),
+		From:     time.Now().UTC().AddDate(0, 0, -30),
+		TenantID: c.Query("tenant_id"),
+	}
+
+	var err error
+	if v := c.Query("from"); v != "" {
+		if q.From, err = parseExportTime(v); err != nil {
+			return q, fmt.Errorf("from must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+		}
+	}
+	if v := c.Query("to"); v != "" {
+		if q.To, err = parseExportTime(v); err != nil {
+			return q, fmt.Errorf("to must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+		}
+	}
+	if !q.To.After(q.From) {
+		return q, fmt.Errorf("to must be after from")
+	}
+
+	for _, g := range strings.Split(c.DefaultQuery("group_by", "day"), ",") {
+		g = strings.TrimSpace(g)
+		if _, ok := m.dimensions[g]; !ok {
+			return q, fmt.Errorf("unknown group_by %q", g)
+		}
+		if !containsString(q.GroupBy, g) {
+			q.GroupBy = append(q.GroupBy, g)
+		}
+	}
+	return q, nil
+}
+
+func reportHandler(store *Store, m reportSource) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if store == nil {
+			c.JSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Reports require DATABASE_URL"))
+			return
+		}
+
+		q, err := parseReportQuery(c, m)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, err.Error()))
+			return
+		}
+
+		rows, err := store.Report(c.Request.Context(), m, q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+
+		respondList(c, http.StatusOK, rows, gin.H{
+			"from":     q.From.Format(time.RFC3339),
+			"to":       q.To.Format(time.RFC3339),
+			"group_by": q.GroupBy,
+		})
+	}
+}
+
+// RegisterReportRoutes mounts the aggregate reporting endpoints, which
+// total every tenant's revenue and so need a key with the payments:read
+// scope. Payment reports come from the read models when there are any.
+func RegisterReportRoutes(r *gin.Engine, store *Store, readModels *ReadModels, bootstrapToken string) {
+	g := r.Group("/reports", requireScope(store, bootstrapToken, readPaymentsScope))
+	g.GET("/payments", readModels.paymentReport(store))
+	g.GET("/refunds", reportHandler(store, refundReport))
+	g.GET("/fees", reportHandler(store, feeReport))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+// PaymentRepository keeps the local copy of payments and their refunds,
+// kept current from create calls and webhooks. Postgres, the Store, is
+// the primary; STORAGE_BACKEND picks DynamoDB, MongoDB or an embedded
+// SQLite file instead, for teams whose platform runs one of those. The
+// other backends keep the records alone: reviews, expiry, lifecycle
+// states, change history, reports and everything else built on SQL
+// still need DATABASE_URL.
+type PaymentRepository interface {
+	// SavePayment upserts the local copy of a PaymentIntent.
+	SavePayment(ctx context.Context, pi *stripe.PaymentIntent) error
+	// SaveCharge records refunds carried on a charge and the running
+	// refunded total of its payment.
+	SaveCharge(ctx context.Context, ch *stripe.Charge) error
+	// PaymentState is the local copy of a payment, or sql.ErrNoRows.
+	PaymentState(ctx context.Context, id string) (*paymentState, error)
+	Close() error
+}
+
+// OpenPaymentRepository opens the repository STORAGE_BACKEND selects:
+// "postgres", the default, is store, which may be nil without
+// DATABASE_URL.
+func OpenPaymentRepository(ctx context.Context, backend string, store *Store) (PaymentRepository, error) {
+	switch backend {
+	case "", "postgres":
+		if store == nil {
+			return nil, nil
+		}
+		return store, nil
+	case "dynamodb":
+		return openDynamoPayments(ctx, os.Getenv("DYNAMODB_TABLE_PREFIX"))
+	case "mongodb":
+		return openMongoPayments(ctx, os.Getenv("MONGODB_URI"), os.Getenv("MONGODB_DATABASE"))
+	case "sqlite":
+		return openSQLitePayments(ctx, os.Getenv("SQLITE_PATH"))
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// paymentRecord is the local copy SavePayment keeps of a PaymentIntent,
+// whichever the backend.
+type paymentRecord struct {
+	ID             string
+	TenantID       string
+	CustomerID     string
+	OrderID        string
+	Amount         int64
+	AmountReceived int64
+	Currency       string
+	Status         string
+	PaymentMethod  string
+	Description    string
+	CreatedAt      time.Time
+	Region         string
+	Device         paymentDevice
+	// Failure is why the last attempt failed, when it did.
+	Failure paymentFailure
+}
+
+// paymentFailure is a payment's last payment error.
+type paymentFailure struct {
+	Code        string
+	DeclineCode string
+	Message     string
+}
+
+// paymentRecordOf is pi's record. Another region's payment must not be
+// stored here.
+func paymentRecordOf(pi *stripe.PaymentIntent) (paymentRecord, error) {
+	rec := paymentRecord{
+		ID:             pi.ID,
+		TenantID:       pi.Metadata["tenant_id"],
+		OrderID:        pi.Metadata["order_id"],
+		Amount:         pi.Amount,
+		AmountReceived: pi.AmountReceived,
+		Currency:       string(pi.Currency),
+		Status:         string(pi.Status),
+		Description:    pi.Description,
+		CreatedAt:      time.Unix(pi.Created, 0).UTC(),
+		Region:         regionOf(pi),
+		Device:         deviceOf(pi),
+	}
+	if pi.Customer != nil {
+		rec.CustomerID = pi.Customer.ID
+	}
+	if pi.PaymentMethod != nil && pi.PaymentMethod.Type != "" {
+		rec.PaymentMethod = string(pi.PaymentMethod.Type)
+	} else if len(pi.PaymentMethodTypes) == 1 {
+		rec.PaymentMethod = pi.PaymentMethodTypes[0]
+	}
+	if e := pi.LastPaymentError; e != nil {
+		rec.Failure = paymentFailure{Code: string(e.Code), DeclineCode: string(e.DeclineCode), Message: e.Msg}
+	}
+	if rec.Region != "" && serviceRegion != "" && rec.Region != serviceRegion {
+		return rec, fmt.Errorf("payment %s belongs to region %s, not %s", pi.ID, rec.Region, serviceRegion)
+	}
+	return rec, nil
+}
+
+// checkStorage opens the payment repository of a backend other than
+// Postgres, which the database check covers.
+func checkStorage(ctx context.Context) (checkStatus, string) {
+	backend := os.Getenv("STORAGE_BACKEND")
+	if backend == "" || backend == "postgres" {
+		return checkSkip, "payments are kept in Postgres"
+	}
+	repo, err := OpenPaymentRepository(ctx, backend, nil)
+	if err != nil {
+		return checkFail, err.Error()
+	}
+	repo.Close()
+	return checkPass, "connected to " + backend
+}
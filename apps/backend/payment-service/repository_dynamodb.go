@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// dynamoPayments keeps payments in the DynamoDB tables <prefix>payments
+// and <prefix>refunds, each with the string hash key "id"; refunds carry
+// their payment_id for a secondary index, should one be wanted. The
+// tables are created by whoever runs the account, not by the service.
+type dynamoPayments struct {
+	client   *dynamodb.Client
+	payments string
+	refunds  string
+}
+
+func openDynamoPayments(ctx context.Context, prefix string) (*dynamoPayments, error) {
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d := &dynamoPayments{client: dynamodb.NewFromConfig(cfg), payments: prefix + "payments", refunds: prefix + "refunds"}
+	for _, table := range []string{d.payments, d.refunds} {
+		if _, err := d.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)}); err != nil {
+			return nil, fmt.Errorf("DynamoDB table %s: %w", table, err)
+		}
+	}
+	return d, nil
+}
+
+func dynamoS(v string) types.AttributeValue { return &types.AttributeValueMemberS{Value: v} }
+func dynamoN(v int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(v, 10)}
+}
+
+func dynamoKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"id": dynamoS(id)}
+}
+
+func (d *dynamoPayments) SavePayment(ctx context.Context, pi *stripe.PaymentIntent) error {
+	rec, err := paymentRecordOf(pi)
+	if err != nil {
+		return err
+	}
+	// payment_method and region keep what they had when the update
+	// doesn't know them; created_at and the refunded total are only set
+	// with the first save.
+	update := "SET tenant_id = :tenant, customer_id = :customer, order_id = :order, amount = :amount, " +
+		"amount_received = :received, currency = :currency, #status = :status, description = :description, " +
+		"created_at = if_not_exists(created_at, :created), amount_refunded = if_not_exists(amount_refunded, :zero), " +
+		"updated_at = :now"
+	values := map[string]types.AttributeValue{
+		":tenant":      dynamoS(rec.TenantID),
+		":customer":    dynamoS(rec.CustomerID),
+		":order":       dynamoS(rec.OrderID),
+		":amount":      dynamoN(rec.Amount),
+		":received":    dynamoN(rec.AmountReceived),
+		":currency":    dynamoS(rec.Currency),
+		":status":      dynamoS(rec.Status),
+		":description": dynamoS(rec.Description),
+		":created":     dynamoS(rec.CreatedAt.Format(time.RFC3339)),
+		":zero":        dynamoN(0),
+		":now":         dynamoS(time.Now().UTC().Format(time.RFC3339)),
+	}
+	if rec.PaymentMethod != "" {
+		update += ", payment_method = :method"
+		values[":method"] = dynamoS(rec.PaymentMethod)
+	}
+	names := map[string]string{"#status": "status"}
+	if rec.Region != "" {
+		update += ", #region = :region"
+		values[":region"] = dynamoS(rec.Region)
+		names["#region"] = "region"
+	}
+	_, err = d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(d.payments),
+		Key:                       dynamoKey(rec.ID),
+		UpdateExpression:          aws.String(update),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+func (d *dynamoPayments) SaveCharge(ctx context.Context, ch *stripe.Charge) error {
+	if ch.PaymentIntent == nil {
+		return nil
+	}
+	paymentID := ch.PaymentIntent.ID
+	now := dynamoS(time.Now().UTC().Format(time.RFC3339))
+
+	// Like Postgres' UPDATE, a payment not stored yet is left for its
+	// own webhook.
+	_, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(d.payments),
+		Key:                 dynamoKey(paymentID),
+		UpdateExpression:    aws.String("SET amount_refunded = :refunded, updated_at = :now"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":refunded": dynamoN(ch.AmountRefunded),
+			":now":      now,
+		},
+	})
+	var missing *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &missing) {
+		return err
+	}
+	if ch.Refunds == nil {
+		return nil
+	}
+	for _, r := range ch.Refunds.Data {
+		if _, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(d.refunds),
+			Key:       dynamoKey(r.ID),
+			UpdateExpression: aws.String("SET payment_id = :payment, amount = :amount, currency = :currency, " +
+				"#status = :status, reason = :reason, created_at = :created, updated_at = :now"),
+			ExpressionAttributeNames: map[string]string{"#status": "status"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":payment":  dynamoS(paymentID),
+				":amount":   dynamoN(r.Amount),
+				":currency": dynamoS(string(r.Currency)),
+				":status":   dynamoS(string(r.Status)),
+				":reason":   dynamoS(string(r.Reason)),
+				":created":  dynamoS(time.Unix(r.Created, 0).UTC().Format(time.RFC3339)),
+				":now":      now,
+			},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dynamoPayments) PaymentState(ctx context.Context, id string) (*paymentState, error) {
+	out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.payments),
+		Key:            dynamoKey(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, sql.ErrNoRows
+	}
+	s := func(name string) string {
+		v, _ := out.Item[name].(*types.AttributeValueMemberS)
+		if v == nil {
+			return ""
+		}
+		return v.Value
+	}
+	n := func(name string) int64 {
+		v, _ := out.Item[name].(*types.AttributeValueMemberN)
+		if v == nil {
+			return 0
+		}
+		i, _ := strconv.ParseInt(v.Value, 10, 64)
+		return i
+	}
+	return &paymentState{
+		Status:         s("status"),
+		Amount:         n("amount"),
+		AmountReceived: n("amount_received"),
+		AmountRefunded: n("amount_refunded"),
+		Currency:       s("currency"),
+		CustomerID:     s("customer_id"),
+		PaymentMethod:  s("payment_method"),
+	}, nil
+}
+
+func (d *dynamoPayments) Close() error { return nil }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoPayments keeps payments in the MongoDB collections payments and
+// refunds, documents keyed by the Stripe ID with the Postgres columns'
+// names as fields.
+type mongoPayments struct {
+	client   *mongo.Client
+	payments *mongo.Collection
+	refunds  *mongo.Collection
+}
+
+func openMongoPayments(ctx context.Context, uri, database string) (*mongoPayments, error) {
+	if uri == "" {
+		return nil, fmt.Errorf("STORAGE_BACKEND=mongodb requires MONGODB_URI")
+	}
+	if database == "" {
+		database = "payments"
+	}
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to MongoDB: %w", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("connecting to MongoDB: %w", err)
+	}
+	db := client.Database(database)
+	m := &mongoPayments{client: client, payments: db.Collection("payments"), refunds: db.Collection("refunds")}
+	if _, err := m.refunds.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "payment_id", Value: 1}}}); err != nil {
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("indexing refunds: %w", err)
+	}
+	return m, nil
+}
+
+func (m *mongoPayments) SavePayment(ctx context.Context, pi *stripe.PaymentIntent) error {
+	rec, err := paymentRecordOf(pi)
+	if err != nil {
+		return err
+	}
+	set := bson.M{
+		"tenant_id":       rec.TenantID,
+		"customer_id":     rec.CustomerID,
+		"order_id":        rec.OrderID,
+		"amount":          rec.Amount,
+		"amount_received": rec.AmountReceived,
+		"currency":        rec.Currency,
+		"status":          rec.Status,
+		"description":     rec.Description,
+		"updated_at":      time.Now().UTC(),
+	}
+	// payment_method and region keep what they had when the update
+	// doesn't know them.
+	if rec.PaymentMethod != "" {
+		set["payment_method"] = rec.PaymentMethod
+	}
+	if rec.Region != "" {
+		set["region"] = rec.Region
+	}
+	_, err = m.payments.UpdateByID(ctx, rec.ID, bson.M{
+		"$set":         set,
+		"$setOnInsert": bson.M{"created_at": rec.CreatedAt, "amount_refunded": int64(0)},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+func (m *mongoPayments) SaveCharge(ctx context.Context, ch *stripe.Charge) error {
+	if ch.PaymentIntent == nil {
+		return nil
+	}
+	paymentID := ch.PaymentIntent.ID
+	now := time.Now().UTC()
+	if _, err := m.payments.UpdateByID(ctx, paymentID, bson.M{
+		"$set": bson.M{"amount_refunded": ch.AmountRefunded, "updated_at": now},
+	}); err != nil {
+		return err
+	}
+	if ch.Refunds == nil {
+		return nil
+	}
+	for _, r := range ch.Refunds.Data {
+		if _, err := m.refunds.UpdateByID(ctx, r.ID, bson.M{"$set": bson.M{
+			"payment_id": paymentID,
+			"amount":     r.Amount,
+			"currency":   string(r.Currency),
+			"status":     string(r.Status),
+			"reason":     string(r.Reason),
+			"created_at": time.Unix(r.Created, 0).UTC(),
+			"updated_at": now,
+		}}, options.Update().SetUpsert(true)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mongoPayments) PaymentState(ctx context.Context, id string) (*paymentState, error) {
+	var doc struct {
+		Status         string `bson:"status"`
+		Amount         int64  `bson:"amount"`
+		AmountReceived int64  `bson:"amount_received"`
+		AmountRefunded int64  `bson:"amount_refunded"`
+		Currency       string `bson:"currency"`
+		CustomerID     string `bson:"customer_id"`
+		PaymentMethod  string `bson:"payment_method"`
+	}
+	err := m.payments.FindOne(ctx, bson.M{"_id": id}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, sql.ErrNoRows
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &paymentState{
+		Status:         doc.Status,
+		Amount:         doc.Amount,
+		AmountReceived: doc.AmountReceived,
+		AmountRefunded: doc.AmountRefunded,
+		Currency:       doc.Currency,
+		CustomerID:     doc.CustomerID,
+		PaymentMethod:  doc.PaymentMethod,
+	}, nil
+}
+
+func (m *mongoPayments) Close() error {
+	return m.client.Disconnect(context.Background())
+}
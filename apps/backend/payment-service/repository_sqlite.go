@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema is the payments and refunds tables of the Postgres
+// migrations, in SQLite's types; timestamps are RFC 3339 text.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS payments (
+    id              TEXT PRIMARY KEY,
+    tenant_id       TEXT NOT NULL DEFAULT '',
+    customer_id     TEXT NOT NULL DEFAULT '',
+    order_id        TEXT NOT NULL DEFAULT '',
+    amount          INTEGER NOT NULL,
+    amount_received INTEGER NOT NULL DEFAULT 0,
+    amount_refunded INTEGER NOT NULL DEFAULT 0,
+    currency        TEXT NOT NULL,
+    status          TEXT NOT NULL,
+    payment_method  TEXT NOT NULL DEFAULT '',
+    description     TEXT NOT NULL DEFAULT '',
+    region          TEXT NOT NULL DEFAULT '',
+    created_at      TEXT NOT NULL,
+    updated_at      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS payments_tenant_created_idx ON payments (tenant_id, created_at);
+
+CREATE TABLE IF NOT EXISTS refunds (
+    id         TEXT PRIMARY KEY,
+    payment_id TEXT NOT NULL,
+    amount     INTEGER NOT NULL,
+    currency   TEXT NOT NULL,
+    status     TEXT NOT NULL,
+    reason     TEXT NOT NULL DEFAULT '',
+    created_at TEXT NOT NULL,
+    updated_at TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS refunds_payment_idx ON refunds (payment_id);
+`
+
+// sqlitePayments keeps payments in an embedded SQLite file, for local
+// development and tests without a database server. ":memory:" keeps them
+// for the life of the process.
+type sqlitePayments struct {
+	db *sql.DB
+}
+
+func openSQLitePayments(ctx context.Context, path string) (*sqlitePayments, error) {
+	if path == "" {
+		return nil, fmt.Errorf("STORAGE_BACKEND=sqlite requires SQLITE_PATH")
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite takes one writer at a time, and every connection to
+	// ":memory:" would be its own database.
+	db.SetMaxOpenConns(1)
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating SQLite schema: %w", err)
+	}
+	return &sqlitePayments{db: db}, nil
+}
+
+func (s *sqlitePayments) SavePayment(ctx context.Context, pi *stripe.PaymentIntent) error {
+	rec, err := paymentRecordOf(pi)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO payments (id, tenant_id, customer_id, order_id, amount, amount_received,
+			currency, status, payment_method, description, region, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			customer_id = excluded.customer_id,
+			amount = excluded.amount,
+			amount_received = excluded.amount_received,
+			status = excluded.status,
+			payment_method = CASE WHEN excluded.payment_method = '' THEN payments.payment_method
+				ELSE excluded.payment_method END,
+			description = excluded.description,
+			region = CASE WHEN excluded.region = '' THEN payments.region ELSE excluded.region END,
+			updated_at = excluded.updated_at`,
+		rec.ID, rec.TenantID, rec.CustomerID, rec.OrderID, rec.Amount, rec.AmountReceived,
+		rec.Currency, rec.Status, rec.PaymentMethod, rec.Description, rec.Region,
+		rec.CreatedAt.Format(time.RFC3339), now)
+	return err
+}
+
+func (s *sqlitePayments) SaveCharge(ctx context.Context, ch *stripe.Charge) error {
+	if ch.PaymentIntent == nil {
+		return nil
+	}
+	paymentID := ch.PaymentIntent.ID
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE payments SET amount_refunded = ?, updated_at = ? WHERE id = ?`,
+		ch.AmountRefunded, now, paymentID); err != nil {
+		return err
+	}
+	if ch.Refunds != nil {
+		for _, r := range ch.Refunds.Data {
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO refunds (id, payment_id, amount, currency, status, reason, created_at, updated_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (id) DO UPDATE SET
+					status = excluded.status,
+					reason = excluded.reason,
+					updated_at = excluded.updated_at`,
+				r.ID, paymentID, r.Amount, string(r.Currency), string(r.Status), string(r.Reason),
+				time.Unix(r.Created, 0).UTC().Format(time.RFC3339), now); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlitePayments) PaymentState(ctx context.Context, id string) (*paymentState, error) {
+	var p paymentState
+	err := s.db.QueryRowContext(ctx, `
+		SELECT status, amount, amount_received, amount_refunded, currency, customer_id, payment_method
+		FROM payments WHERE id = ?`, id).
+		Scan(&p.Status, &p.Amount, &p.AmountReceived, &p.AmountRefunded, &p.Currency, &p.CustomerID, &p.PaymentMethod)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *sqlitePayments) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+var paymentResyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_payment_resyncs_total",
+	Help: "Admin resyncs of payments from Stripe, by result (unchanged, repaired, failed).",
+}, []string{"result"})
+
+// paymentState is the local copy of a payment that a resync compares
+// with Stripe's.
+type paymentState struct {
+	Status         string `json:"status"`
+	Amount         int64  `json:"amount"`
+	AmountReceived int64  `json:"amount_received"`
+	AmountRefunded int64  `json:"amount_refunded"`
+	Currency       string `json:"currency"`
+	CustomerID     string `json:"customer_id,omitempty"`
+	PaymentMethod  string `json:"payment_method,omitempty"`
+}
+
+func (s *Store) PaymentState(ctx context.Context, id string) (*paymentState, error) {
+	var p paymentState
+	err := s.db.QueryRowContext(ctx, `
+		SELECT status, amount, amount_received, amount_refunded, currency, customer_id, payment_method
+		FROM payments WHERE id = $1`, id).
+		Scan(&p.Status, &p.Amount, &p.AmountReceived, &p.AmountRefunded, &p.Currency, &p.CustomerID, &p.PaymentMethod)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// providerState is the state Stripe has for pi, in local terms.
+func providerState(pi *stripe.PaymentIntent) *paymentState {
+	p := &paymentState{
+		Status:         string(pi.Status),
+		Amount:         pi.Amount,
+		AmountReceived: pi.AmountReceived,
+		Currency:       string(pi.Currency),
+	}
+	if pi.Customer != nil {
+		p.CustomerID = pi.Customer.ID
+	}
+	if pi.LatestCharge != nil {
+		p.AmountRefunded = pi.LatestCharge.AmountRefunded
+	}
+	if pi.PaymentMethod != nil && pi.PaymentMethod.Type != "" {
+		p.PaymentMethod = string(pi.PaymentMethod.Type)
+	}
+	return p
+}
+
+// sameStatus reports whether a local status stands for Stripe's: a held
+// payment is pending_review locally and an expired one abandoned.
+func sameStatus(local, provider string) bool {
+	switch local {
+	case paymentStatusPendingReview:
+		return provider == string(stripe.PaymentIntentStatusRequiresCapture)
+	case paymentStatusAbandoned:
+		return provider == string(stripe.PaymentIntentStatusCanceled)
+	}
+	return local == provider
+}
+
+// resyncChange is one field the local copy had wrong.
+type resyncChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+func resyncChanges(local, provider *paymentState) []resyncChange {
+	changes := []resyncChange{}
+	if !sameStatus(local.Status, provider.Status) {
+		changes = append(changes, resyncChange{"status", local.Status, provider.Status})
+	}
+	for _, f := range []struct {
+		name     string
+		from, to int64
+	}{
+		{"amount", local.Amount, provider.Amount},
+		{"amount_received", local.AmountReceived, provider.AmountReceived},
+		{"amount_refunded", local.AmountRefunded, provider.AmountRefunded},
+	} {
+		if f.from != f.to {
+			changes = append(changes, resyncChange{f.name, f.from, f.to})
+		}
+	}
+	if local.CustomerID != provider.CustomerID {
+		changes = append(changes, resyncChange{"customer_id", local.CustomerID, provider.CustomerID})
+	}
+	if provider.PaymentMethod != "" && local.PaymentMethod != provider.PaymentMethod {
+		changes = append(changes, resyncChange{"payment_method", local.PaymentMethod, provider.PaymentMethod})
+	}
+	return changes
+}
+
+// transitionEvent is the webhook Stripe sends when a PaymentIntent
+// reaches status, or "" for statuses that have none.
+func transitionEvent(pi *stripe.PaymentIntent) stripe.EventType {
+	switch pi.Status {
+	case stripe.PaymentIntentStatusSucceeded:
+		return "payment_intent.succeeded"
+	case stripe.PaymentIntentStatusCanceled:
+		return "payment_intent.canceled"
+	case stripe.PaymentIntentStatusRequiresCapture:
+		return "payment_intent.amount_capturable_updated"
+	case stripe.PaymentIntentStatusProcessing:
+		return "payment_intent.processing"
+	case stripe.PaymentIntentStatusRequiresAction:
+		return "payment_intent.requires_action"
+	case stripe.PaymentIntentStatusRequiresPaymentMethod:
+		if pi.LastPaymentError != nil {
+			return "payment_intent.payment_failed"
+		}
+	}
+	return ""
+}
+
+// missedEvents are the webhooks that would have brought local up to pi:
+// the charge's success and the intent's transition when the status
+// moved, and the charge's refunds when the refunded total did. They carry
+// IDs derived from the target state, so replaying the same repair twice
+// is recognisable downstream, and a second resync finds nothing missed.
+func missedEvents(local *paymentState, pi *stripe.PaymentIntent) ([]stripe.Event, error) {
+	var events []stripe.Event
+	add := func(typ stripe.EventType, id string, obj interface{}) error {
+		raw, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		events = append(events, stripe.Event{
+			ID:      "evt_resync_" + id,
+			Object:  "event",
+			Type:    typ,
+			Created: time.Now().Unix(),
+			Data:    &stripe.EventData{Raw: raw},
+		})
+		return nil
+	}
+	ch := pi.LatestCharge
+	if !sameStatus(local.Status, string(pi.Status)) {
+		if typ := transitionEvent(pi); typ != "" {
+			succeeded := pi.Status == stripe.PaymentIntentStatusSucceeded || pi.Status == stripe.PaymentIntentStatusRequiresCapture
+			if succeeded && ch != nil && ch.Status == stripe.ChargeStatusSucceeded {
+				if err := add("charge.succeeded", ch.ID+"_succeeded", ch); err != nil {
+					return nil, err
+				}
+			}
+			if err := add(typ, pi.ID+"_"+string(pi.Status), pi); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if ch != nil && ch.AmountRefunded != local.AmountRefunded && ch.AmountRefunded > 0 {
+		if err := add("charge.refunded", fmt.Sprintf("%s_refunded_%d", ch.ID, ch.AmountRefunded), ch); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// resync repairs a stuck payment: it refetches the PaymentIntent from
+// Stripe, compares it with the local copy, replays the webhooks the
+// service missed through the usual pipeline, so wallets, escrows,
+// loyalty and the rest catch up as they would have, and saves Stripe's
+// copy. The answer lists what changed and what was replayed; with
+// dry_run nothing is replayed or saved. A payment missing locally is
+// replayed from scratch and saved as new. Replays stop at the first failure, which is reported; a
+// later resync picks up from there.
+func (a *AdminAPI) resync(c *gin.Context) {
+	ctx := c.Request.Context()
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	params.AddExpand("latest_charge.refunds")
+	params.AddExpand("payment_method")
+	pi, err := paymentintent.Get(c.Param("id"), params)
+	if err != nil {
+		paymentResyncs.WithLabelValues("failed").Inc()
+		respondError(c, err)
+		return
+	}
+	after := providerState(pi)
+
+	var before *paymentState
+	changes := []resyncChange{}
+	events := []stripe.Event{}
+	if a.Payments != nil {
+		before, err = a.Payments.PaymentState(ctx, pi.ID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			before = nil
+			if events, err = missedEvents(&paymentState{}, pi); err != nil {
+				paymentResyncs.WithLabelValues("failed").Inc()
+				c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+				return
+			}
+		case err != nil:
+			paymentResyncs.WithLabelValues("failed").Inc()
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		default:
+			changes = resyncChanges(before, after)
+			if events, err = missedEvents(before, pi); err != nil {
+				paymentResyncs.WithLabelValues("failed").Inc()
+				c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+				return
+			}
+		}
+	}
+	replayed := make([]string, 0, len(events))
+	for _, ev := range events {
+		replayed = append(replayed, string(ev.Type))
+	}
+	report := gin.H{
+		"id":       pi.ID,
+		"before":   before,
+		"after":    after,
+		"changed":  before == nil || len(changes) > 0,
+		"changes":  changes,
+		"replayed": replayed,
+	}
+	if isDryRun(c) {
+		report["dry_run"] = true
+		respondData(c, http.StatusOK, report)
+		return
+	}
+
+	for i, ev := range events {
+		if err := a.Webhooks.dispatch(ctx, ev); err != nil {
+			paymentResyncs.WithLabelValues("failed").Inc()
+			logf(ctx, "resync %s: replaying %s: %v", pi.ID, ev.Type, err)
+			report["replayed"] = replayed[:i]
+			c.JSON(http.StatusInternalServerError, errorBodyWith(c, CodeInternal,
+				fmt.Sprintf("Replaying %s failed: %v", ev.Type, err), report))
+			return
+		}
+	}
+	if a.Payments != nil {
+		// The replayed transition saved the intent already; this covers
+		// fields no event carries and payments with nothing to replay.
+		if err := a.Payments.SavePayment(ctx, pi); err != nil {
+			paymentResyncs.WithLabelValues("failed").Inc()
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+		if pi.LatestCharge != nil && pi.LatestCharge.PaymentIntent != nil {
+			if err := a.Payments.SaveCharge(ctx, pi.LatestCharge); err != nil {
+				logf(ctx, "resync %s: saving charge: %v", pi.ID, err)
+			}
+		}
+	}
+
+	recordAdminAction(c, a.Store, pi.ID, "payment.resynced", "", gin.H{"changes": changes, "replayed": replayed})
+	if report["changed"] == true {
+		paymentResyncs.WithLabelValues("repaired").Inc()
+		logf(ctx, "resync %s by %s: %d changes, replayed %v", pi.ID, c.GetString("api_key_id"), len(changes), replayed)
+	} else {
+		paymentResyncs.WithLabelValues("unchanged").Inc()
+	}
+	a.Hub.Publish(PaymentEvent{
+		PaymentID:  pi.ID,
+		TenantID:   pi.Metadata["tenant_id"],
+		CustomerID: customerIDOf(pi.Customer),
+		Type:       "payment_intent.resynced",
+		Status:     paymentStatus(pi),
+		Amount:     pi.Amount,
+		Currency:   string(pi.Currency),
+		CreatedAt:  time.Now().UTC(),
+		RequestID:  requestIDFrom(ctx),
+	})
+	respondData(c, http.StatusOK, report)
+}
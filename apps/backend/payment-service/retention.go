@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var retentionRowsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_retention_rows_total",
+	Help: "Rows anonymized, archived or deleted by the retention job, by data class, table and action.",
+}, []string{"class", "table", "action"})
+
+// Data classes. PII is what identifies the customer behind a payment;
+// financial facts are the payments and refunds themselves, which tax and
+// accounting rules require keeping far longer, but not forever.
+const (
+	retentionPII       = "pii"
+	retentionFinancial = "financial"
+)
+
+// retentionMinDays is the shortest retention allowed: card networks take
+// disputes for up to 120 days, and answering one needs the payment and
+// who made it.
+const retentionMinDays = 120
+
+// retentionBatch is how many rows a retention statement touches at once,
+// so no sweep holds locks on much of a table.
+const retentionBatch = 1000
+
+// RetentionPolicy is how many days each data class is kept after the
+// record was created. Zero keeps it forever.
+type RetentionPolicy struct {
+	PIIDays       int `json:"pii_days"`
+	FinancialDays int `json:"financial_days"`
+}
+
+// RetentionConfig is the default policy plus per-tenant ones. A tenant's
+// zero fields take the default's.
+//
+//	"retention": {"pii_days": 730, "financial_days": 3650,
+//	              "tenants": {"acme-gmbh": {"pii_days": 365}}}
+type RetentionConfig struct {
+	PIIDays       int                        `json:"pii_days"`
+	FinancialDays int                        `json:"financial_days"`
+	Tenants       map[string]RetentionPolicy `json:"tenants"`
+}
+
+func (cfg RetentionConfig) validate() error {
+	if err := cfg.policy("").validate("retention"); err != nil {
+		return err
+	}
+	for tenant := range cfg.Tenants {
+		if err := cfg.policy(tenant).validate("retention tenants." + tenant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p RetentionPolicy) validate(name string) error {
+	for _, d := range []struct {
+		field string
+		days  int
+	}{{"pii_days", p.PIIDays}, {"financial_days", p.FinancialDays}} {
+		if d.days < 0 || (d.days > 0 && d.days < retentionMinDays) {
+			return fmt.Errorf("%s: %s must be 0 or at least %d", name, d.field, retentionMinDays)
+		}
+	}
+	// Archived records are kept whole, so PII must be gone first.
+	if p.FinancialDays > 0 && (p.PIIDays == 0 || p.PIIDays > p.FinancialDays) {
+		return fmt.Errorf("%s: pii_days must be set and no more than financial_days", name)
+	}
+	return nil
+}
+
+// policy is tenantID's policy; "" is the default.
+func (cfg RetentionConfig) policy(tenantID string) RetentionPolicy {
+	p := RetentionPolicy{PIIDays: cfg.PIIDays, FinancialDays: cfg.FinancialDays}
+	if t, ok := cfg.Tenants[tenantID]; ok && tenantID != "" {
+		if t.PIIDays != 0 {
+			p.PIIDays = t.PIIDays
+		}
+		if t.FinancialDays != 0 {
+			p.FinancialDays = t.FinancialDays
+		}
+	}
+	return p
+}
+
+func (p RetentionPolicy) days(class string) int {
+	if class == retentionPII {
+		return p.PIIDays
+	}
+	return p.FinancialDays
+}
+
+// retentionStep is one statement of a sweep. due selects the keys of the
+// rows past retention: $1 is the cutoff, and $2 and $3 pick the tenants,
+// those in $2 when $3 is true and all others when it is false. apply is
+// a format with a %s for due, limited to $4 rows.
+type retentionStep struct {
+	class, table, action string
+	due, apply           string
+}
+
+// retentionSteps run in order. PII is anonymized on payments, checkout
+// sessions, finished dunning cases and finished payment retries, and the
+// Stripe payloads of recorded webhook events and settled dead letters,
+// with their billing details, are emptied; what is left of a payment is
+// the amount, currency, status and dates. After
+// financial_days, payments and their refunds move to archived_records,
+// a plain copy kept out of the working tables, and their chargeback risk
+// flags and read model summaries are dropped; the daily totals, which
+// name no payment, keep counting them. Customers' lifetime values go
+// with their PII. Payments still in flight are left alone. Stripe's
+// copy of a payment follows Stripe's own retention, and a resync of an
+// anonymized payment writes its customer back until the next sweep.
+var retentionSteps = []retentionStep{
+	{retentionPII, "payments", "anonymized", `
+		SELECT id FROM payments
+		WHERE created_at < $1 AND (tenant_id = ANY($2)) = $3
+			AND (customer_id <> '' OR card_fingerprint <> '' OR client_ip <> '' OR user_agent <> '' OR device_id <> '')`, `
+		UPDATE payments SET customer_id = '', card_fingerprint = '', client_ip = '', user_agent = '', device_id = '',
+			updated_at = now()
+		WHERE id IN (%s LIMIT $4)`},
+	{retentionPII, "payment_summaries", "anonymized", `
+		SELECT id FROM payment_summaries
+		WHERE created_at < $1 AND (tenant_id = ANY($2)) = $3 AND customer_id <> ''`, `
+		UPDATE payment_summaries SET customer_id = '', updated_at = now()
+		WHERE id IN (%s LIMIT $4)`},
+	{retentionPII, "customer_ltv", "deleted", `
+		SELECT ctid FROM customer_ltv
+		WHERE last_payment_at < $1 AND (tenant_id = ANY($2)) = $3`, `
+		DELETE FROM customer_ltv WHERE ctid IN (%s LIMIT $4)`},
+	{retentionPII, "checkout_sessions", "anonymized", `
+		SELECT id FROM checkout_sessions
+		WHERE created_at < $1 AND (tenant_id = ANY($2)) = $3
+			AND status NOT IN ('created', 'method_selected', 'authenticated')
+			AND request - ARRAY['customer_id', 'receipt_email', 'client_ip', 'user_agent', 'device_id', 'customer_country', 'metadata'] <> request`, `
+		UPDATE checkout_sessions
+		SET request = request - ARRAY['customer_id', 'receipt_email', 'client_ip', 'user_agent', 'device_id', 'customer_country', 'metadata'],
+			updated_at = now()
+		WHERE id IN (%s LIMIT $4)`},
+	{retentionPII, "dunning_cases", "anonymized", `
+		SELECT id FROM dunning_cases
+		WHERE created_at < $1 AND (tenant_id = ANY($2)) = $3 AND status NOT IN ('retrying', 'grace')
+			AND (customer_id <> '' OR customer_email <> '')`, `
+		UPDATE dunning_cases SET customer_id = '', customer_email = '', invoice_url = '', updated_at = now()
+		WHERE id IN (%s LIMIT $4)`},
+	{retentionPII, "payment_retry_attempts", "anonymized", `
+		SELECT a.id FROM payment_retry_attempts a JOIN payment_retries r ON r.payment_id = a.payment_id
+		WHERE a.created_at < $1 AND (r.tenant_id = ANY($2)) = $3 AND a.customer_id <> ''`, `
+		UPDATE payment_retry_attempts SET customer_id = '' WHERE id IN (%s LIMIT $4)`},
+	{retentionPII, "payment_retries", "anonymized", `
+		SELECT payment_id FROM payment_retries
+		WHERE created_at < $1 AND (tenant_id = ANY($2)) = $3 AND status NOT IN ('scheduled', 'attempting')
+			AND (customer_id <> '' OR payment_method <> '')`, `
+		UPDATE payment_retries SET customer_id = '', payment_method = '', updated_at = now()
+		WHERE payment_id IN (%s LIMIT $4)`},
+	{retentionPII, "webhook_events", "anonymized", `
+		SELECT w.id FROM webhook_events w LEFT JOIN payments p ON p.id = w.payment_id
+		WHERE w.received_at < $1 AND (COALESCE(p.tenant_id, '') = ANY($2)) = $3 AND w.payload <> '{}'`, `
+		UPDATE webhook_events SET payload = '{}' WHERE id IN (%s LIMIT $4)`},
+	{retentionPII, "dead_letters", "anonymized", `
+		SELECT d.id FROM dead_letters d LEFT JOIN webhook_events w ON d.kind = 'webhook' AND w.id = d.ref
+			LEFT JOIN payments p ON p.id = COALESCE(w.payment_id, d.key)
+		WHERE d.created_at < $1 AND (COALESCE(p.tenant_id, '') = ANY($2)) = $3
+			AND d.status NOT IN ('pending', 'retrying') AND d.payload <> '{}'`, `
+		UPDATE dead_letters SET payload = '{}', updated_at = now() WHERE id IN (%s LIMIT $4)`},
+	{retentionFinancial, "refunds", "archived", `
+		SELECT r.id FROM refunds r JOIN payments p ON p.id = r.payment_id
+		WHERE p.created_at < $1 AND (p.tenant_id = ANY($2)) = $3
+			AND p.status IN ('succeeded', 'canceled', 'requires_payment_method')`, `
+		WITH moved AS (DELETE FROM refunds WHERE id IN (%s LIMIT $4) RETURNING *)
+		INSERT INTO archived_records (source, id, tenant_id, record, created_at)
+		SELECT 'refunds', m.id, coalesce(p.tenant_id, ''), to_jsonb(m), m.created_at
+		FROM moved m LEFT JOIN payments p ON p.id = m.payment_id
+		ON CONFLICT (source, id) DO NOTHING`},
+	{retentionFinancial, "chargeback_risk_flags", "deleted", `
+		SELECT f.payment_id FROM chargeback_risk_flags f JOIN payments p ON p.id = f.payment_id
+		WHERE p.created_at < $1 AND (p.tenant_id = ANY($2)) = $3
+			AND p.status IN ('succeeded', 'canceled', 'requires_payment_method')`, `
+		DELETE FROM chargeback_risk_flags WHERE payment_id IN (%s LIMIT $4)`},
+	{retentionFinancial, "payment_summaries", "deleted", `
+		SELECT id FROM payment_summaries
+		WHERE created_at < $1 AND (tenant_id = ANY($2)) = $3
+			AND status IN ('succeeded', 'canceled', 'requires_payment_method')`, `
+		DELETE FROM payment_summaries WHERE id IN (%s LIMIT $4)`},
+	{retentionFinancial, "payments", "archived", `
+		SELECT id FROM payments
+		WHERE created_at < $1 AND (tenant_id = ANY($2)) = $3
+			AND status IN ('succeeded', 'canceled', 'requires_payment_method')`, `
+		WITH moved AS (DELETE FROM payments WHERE id IN (%s LIMIT $4) RETURNING *)
+		INSERT INTO archived_records (source, id, tenant_id, record, created_at)
+		SELECT 'payments', id, tenant_id, to_jsonb(moved), created_at FROM moved
+		ON CONFLICT (source, id) DO NOTHING`},
+}
+
+// RetentionResult counts the rows one policy's step affected, or in a dry
+// run would affect.
+type RetentionResult struct {
+	Class    string    `json:"class"`
+	Table    string    `json:"table"`
+	Action   string    `json:"action"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Cutoff   time.Time `json:"cutoff"`
+	Rows     int64     `json:"rows"`
+	Complete bool      `json:"complete"`
+}
+
+// RetentionDue counts the rows of step past cutoff.
+func (s *Store) RetentionDue(ctx context.Context, step retentionStep, cutoff time.Time, tenants []string, in bool) (int64, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM (`+step.due+`) d`, cutoff, tenants, in).Scan(&n)
+	return n, err
+}
+
+// ApplyRetention runs one batch of step and reports how many rows it
+// touched.
+func (s *Store) ApplyRetention(ctx context.Context, step retentionStep, cutoff time.Time, tenants []string, in bool) (int64, error) {
+	res, err := s.db.ExecContext(ctx, fmt.Sprintf(step.apply, step.due), cutoff, tenants, in, retentionBatch)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ArchivedRecord is a row the retention job moved out of source.
+type ArchivedRecord struct {
+	Source     string          `json:"source"`
+	ID         string          `json:"id"`
+	TenantID   string          `json:"tenant_id,omitempty"`
+	Record     json.RawMessage `json:"record"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ArchivedAt time.Time       `json:"archived_at"`
+}
+
+func (s *Store) ArchivedRecord(ctx context.Context, source, id string) (*ArchivedRecord, error) {
+	a := &ArchivedRecord{}
+	var record []byte
+	err := s.db.QueryRowContext(ctx, `
+		SELECT source, id, tenant_id, record, created_at, archived_at FROM archived_records
+		WHERE source = $1 AND id = $2`, source, id).
+		Scan(&a.Source, &a.ID, &a.TenantID, &record, &a.CreatedAt, &a.ArchivedAt)
+	if err != nil {
+		return nil, err
+	}
+	a.Record = record
+	return a, nil
+}
+
+// Retention enforces the retention policies in the runtime config every
+// interval: PII past pii_days is anonymized in place, and payments and
+// refunds past financial_days are archived. Every instance sweeps; the
+// statements are safe to run side by side.
+type Retention struct {
+	store    *Store
+	settings *RuntimeSettings
+	interval time.Duration
+}
+
+func NewRetention(store *Store, settings *RuntimeSettings, interval time.Duration) *Retention {
+	return &Retention{store: store, settings: settings, interval: interval}
+}
+
+// RegisterRoutes mounts the manual run and archive lookup for admins.
+func (rt *Retention) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/admin/retention", requireScope(rt.store, bootstrapToken, "admin"), rt.requireStore)
+	g.POST("/run", rt.run)
+	g.GET("/archive/:source/:id", rt.archived)
+}
+
+func (rt *Retention) requireStore(c *gin.Context) {
+	if rt.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Data retention requires DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// Run sweeps every interval until ctx is done.
+func (rt *Retention) Run(ctx context.Context) {
+	if rt == nil || rt.store == nil {
+		return
+	}
+	ticker := time.NewTicker(rt.interval)
+	defer ticker.Stop()
+	for {
+		results, err := rt.sweep(ctx, false)
+		if err != nil {
+			log.Printf("retention: %v", err)
+		}
+		for _, res := range results {
+			if res.Rows > 0 {
+				log.Printf("retention: %s %d %s rows (%s, tenant %q)", res.Action, res.Rows, res.Table, res.Class, res.Tenant)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep applies each tenant's policy, then the default to every other
+// tenant. A dry run only counts. A step that fails is reported and the
+// sweep goes on with the next.
+func (rt *Retention) sweep(ctx context.Context, dryRun bool) ([]RetentionResult, error) {
+	cfg := rt.settings.Get().Retention
+	overridden := make([]string, 0, len(cfg.Tenants))
+	for tenant := range cfg.Tenants {
+		if tenant != "" {
+			overridden = append(overridden, tenant)
+		}
+	}
+	sort.Strings(overridden)
+
+	now := time.Now()
+	results := []RetentionResult{}
+	var errs []error
+	apply := func(policy RetentionPolicy, label string, tenants []string, in bool) {
+		for _, step := range retentionSteps {
+			days := policy.days(step.class)
+			if days == 0 {
+				continue
+			}
+			res := RetentionResult{Class: step.class, Table: step.table, Action: step.action, Tenant: label,
+				Cutoff: now.AddDate(0, 0, -days).UTC()}
+			var err error
+			if dryRun {
+				res.Rows, err = rt.store.RetentionDue(ctx, step, res.Cutoff, tenants, in)
+				res.Complete = err == nil
+			} else {
+				res.Complete, err = rt.drain(ctx, step, &res, tenants, in)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %s (tenant %q): %w", step.action, step.table, label, err))
+			}
+			results = append(results, res)
+		}
+	}
+	for _, tenant := range overridden {
+		apply(cfg.policy(tenant), tenant, []string{tenant}, true)
+	}
+	apply(cfg.policy(""), "", overridden, false)
+	return results, errors.Join(errs...)
+}
+
+// drain applies step in batches until no row is left or ctx is done.
+func (rt *Retention) drain(ctx context.Context, step retentionStep, res *RetentionResult, tenants []string, in bool) (bool, error) {
+	for ctx.Err() == nil {
+		n, err := rt.store.ApplyRetention(ctx, step, res.Cutoff, tenants, in)
+		if err != nil {
+			return false, err
+		}
+		res.Rows += n
+		retentionRowsTotal.WithLabelValues(step.class, step.table, step.action).Add(float64(n))
+		if n < retentionBatch {
+			return true, nil
+		}
+	}
+	return false, ctx.Err()
+}
+
+// run sweeps now, or with ?dry_run=true counts what a sweep would touch.
+func (rt *Retention) run(c *gin.Context) {
+	dryRun := isDryRun(c)
+	results, err := rt.sweep(c.Request.Context(), dryRun)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondList(c, http.StatusOK, results, gin.H{"dry_run": dryRun})
+}
+
+func (rt *Retention) archived(c *gin.Context) {
+	a, err := rt.store.ArchivedRecord(c.Request.Context(), c.Param("source"), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Archived record not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, a)
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+// Recovery rate is recovered / (recovered + exhausted) from
+// payment_service_payment_retry_results_total.
+var (
+	paymentRetriesScheduled = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "payment_service_payment_retries_scheduled_total",
+		Help: "Declined payments scheduled for off-session retries.",
+	})
+	paymentRetryAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_payment_retry_attempts_total",
+		Help: "Off-session retry attempts, by outcome (succeeded, declined, error, deferred).",
+	}, []string{"outcome"})
+	paymentRetryResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_payment_retry_results_total",
+		Help: "Scheduled retries that ended, by result (recovered, exhausted, canceled).",
+	}, []string{"result"})
+	paymentRetryRecoveredAmount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_payment_retry_recovered_amount_total",
+		Help: "Minor units recovered by off-session retries, by currency.",
+	}, []string{"currency"})
+)
+
+// PaymentRetryConfig schedules off-session retries of one-off payments
+// that were declined for a reason that may pass later, on the customer's
+// saved card. An empty intervals_hours turns retries off. Window limits
+// attempts to a range of UTC hours; max_attempts_per_customer_per_day
+// defers attempts for a customer past the cap.
+//
+//	"payment_retries": {
+//	  "intervals_hours": [4, 24, 72],
+//	  "decline_codes": ["insufficient_funds", "try_again_later"],
+//	  "window": {"start_hour": 8, "end_hour": 20},
+//	  "max_attempts_per_customer_per_day": 3
+//	}
+type PaymentRetryConfig struct {
+	// IntervalsHours are the waits before each attempt, counted from the
+	// decline before it.
+	IntervalsHours []int `json:"intervals_hours"`
+	// DeclineCodes worth retrying; empty means defaultRetryableDeclines.
+	DeclineCodes                 []string    `json:"decline_codes"`
+	Window                       RetryWindow `json:"window"`
+	MaxAttemptsPerCustomerPerDay int         `json:"max_attempts_per_customer_per_day"`
+}
+
+// RetryWindow is a range of UTC hours, [start_hour, end_hour), that may
+// wrap past midnight. Equal hours allow any time.
+type RetryWindow struct {
+	StartHour int `json:"start_hour"`
+	EndHour   int `json:"end_hour"`
+}
+
+// defaultRetryableDeclines are the soft declines card networks expect to
+// be retried: low funds, issuer outages and velocity limits.
+var defaultRetryableDeclines = []string{
+	"insufficient_funds", "processing_error", "try_again_later", "issuer_not_available",
+	"reenter_transaction", "approve_with_id", "card_velocity_exceeded",
+	"withdrawal_count_limit_exceeded", "generic_decline",
+}
+
+// paymentRetryDeferral is how far an attempt over the per-customer cap is
+// pushed back.
+const paymentRetryDeferral = 6 * time.Hour
+
+// paymentRetryLease is how long a claimed attempt stays claimed, so an
+// instance that dies mid-call is covered by another.
+const paymentRetryLease = 10 * time.Minute
+
+// paymentRetryOptOutKey in a payment's metadata keeps it from being
+// retried.
+const paymentRetryOptOutKey = "retry_opt_out"
+
+func (cfg PaymentRetryConfig) validate() error {
+	for _, h := range cfg.IntervalsHours {
+		if h <= 0 {
+			return fmt.Errorf("payment_retries: intervals_hours must be positive")
+		}
+	}
+	w := cfg.Window
+	if w.StartHour < 0 || w.StartHour > 23 || w.EndHour < 0 || w.EndHour > 24 {
+		return fmt.Errorf("payment_retries: window hours must be between 0 and 24")
+	}
+	if cfg.MaxAttemptsPerCustomerPerDay < 0 {
+		return fmt.Errorf("payment_retries: max_attempts_per_customer_per_day must not be negative")
+	}
+	return nil
+}
+
+func (cfg PaymentRetryConfig) retryable(code string) bool {
+	codes := cfg.DeclineCodes
+	if len(codes) == 0 {
+		codes = defaultRetryableDeclines
+	}
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// next is the first time at or after t inside the window.
+func (w RetryWindow) next(t time.Time) time.Time {
+	start, end := w.StartHour, w.EndHour%24
+	if start == end {
+		return t
+	}
+	t = t.UTC()
+	h := t.Hour()
+	if (start < end && h >= start && h < end) || (start > end && (h >= start || h < end)) {
+		return t
+	}
+	opens := time.Date(t.Year(), t.Month(), t.Day(), start, 0, 0, 0, time.UTC)
+	if opens.Before(t) {
+		opens = opens.Add(24 * time.Hour)
+	}
+	return opens
+}
+
+// declineOf is the decline code of a card error, falling back to its
+// error code for errors such as processing_error that carry no decline.
+func declineOf(e *stripe.Error) string {
+	if e == nil {
+		return ""
+	}
+	if e.DeclineCode != "" {
+		return string(e.DeclineCode)
+	}
+	return string(e.Code)
+}
+
+// Payment retry statuses. A scheduled retry is waiting for its next
+// attempt and an attempting one has a claimed attempt in flight; the rest
+// are how retries end.
+const (
+	paymentRetryScheduled  = "scheduled"
+	paymentRetryAttempting = "attempting"
+	paymentRetryRecovered  = "recovered"
+	paymentRetryExhausted  = "exhausted"
+	paymentRetryCanceled   = "canceled"
+)
+
+// PaymentRetry is the retry state of one declined payment.
+type PaymentRetry struct {
+	PaymentID     string     `json:"payment_id"`
+	TenantID      string     `json:"tenant_id,omitempty"`
+	CustomerID    string     `json:"customer_id"`
+	PaymentMethod string     `json:"payment_method"`
+	Currency      string     `json:"currency"`
+	Amount        int64      `json:"amount"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	DeclineCode   string     `json:"decline_code,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+const paymentRetryColumns = `payment_id, tenant_id, customer_id, payment_method, currency, amount, status, attempts,
+	decline_code, next_attempt_at, resolved_at, created_at, updated_at`
+
+func scanPaymentRetry(row interface{ Scan(...interface{}) error }) (*PaymentRetry, error) {
+	var r PaymentRetry
+	var next, resolved sql.NullTime
+	if err := row.Scan(&r.PaymentID, &r.TenantID, &r.CustomerID, &r.PaymentMethod, &r.Currency, &r.Amount, &r.Status,
+		&r.Attempts, &r.DeclineCode, &next, &resolved, &r.CreatedAt, &r.UpdatedAt); err != nil {
+		return nil, err
+	}
+	r.NextAttemptAt = timeOrNil(next)
+	r.ResolvedAt = timeOrNil(resolved)
+	return &r, nil
+}
+
+// SchedulePaymentRetry records r unless the payment already has a retry;
+// created reports which.
+func (s *Store) SchedulePaymentRetry(ctx context.Context, r *PaymentRetry) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO payment_retries
+			(payment_id, tenant_id, customer_id, payment_method, currency, amount, status, decline_code, next_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (payment_id) DO NOTHING`,
+		r.PaymentID, r.TenantID, r.CustomerID, r.PaymentMethod, r.Currency, r.Amount, r.Status, r.DeclineCode,
+		nullTimeOf(r.NextAttemptAt))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *Store) PaymentRetry(ctx context.Context, paymentID string) (*PaymentRetry, error) {
+	return scanPaymentRetry(s.db.QueryRowContext(ctx, `
+		SELECT `+paymentRetryColumns+` FROM payment_retries WHERE payment_id = $1`, paymentID))
+}
+
+// UpdatePaymentRetry saves r's progress if it is still in one of the from
+// statuses, reporting whether it was.
+func (s *Store) UpdatePaymentRetry(ctx context.Context, r *PaymentRetry, from ...string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE payment_retries SET
+			status = $2, attempts = $3, decline_code = $4, next_attempt_at = $5, resolved_at = $6, updated_at = now()
+		WHERE payment_id = $1 AND status = ANY($7)`,
+		r.PaymentID, r.Status, r.Attempts, r.DeclineCode, nullTimeOf(r.NextAttemptAt), nullTimeOf(r.ResolvedAt), from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ClaimDuePaymentRetry marks the next retry that is due as attempting and
+// returns it, or sql.ErrNoRows. next_attempt_at becomes the claim's lease,
+// so an attempt abandoned mid-call becomes due again. skip lists retries
+// that already failed in this sweep.
+func (s *Store) ClaimDuePaymentRetry(ctx context.Context, skip []string) (*PaymentRetry, error) {
+	if skip == nil {
+		skip = []string{}
+	}
+	return scanPaymentRetry(s.db.QueryRowContext(ctx, `
+		UPDATE payment_retries SET status = 'attempting', next_attempt_at = $2, updated_at = now()
+		WHERE payment_id = (
+			SELECT payment_id FROM payment_retries
+			WHERE payment_id <> ALL($1) AND status IN ('scheduled', 'attempting') AND next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING `+paymentRetryColumns,
+		skip, time.Now().Add(paymentRetryLease).UTC()))
+}
+
+func (s *Store) RecordPaymentRetryAttempt(ctx context.Context, r *PaymentRetry, outcome, declineCode string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO payment_retry_attempts (payment_id, customer_id, outcome, decline_code) VALUES ($1, $2, $3, $4)`,
+		r.PaymentID, r.CustomerID, outcome, declineCode)
+	return err
+}
+
+// CustomerRetryAttempts counts a customer's retry attempts since since.
+func (s *Store) CustomerRetryAttempts(ctx context.Context, customerID string, since time.Time) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT count(*) FROM payment_retry_attempts WHERE customer_id = $1 AND created_at >= $2`,
+		customerID, since).Scan(&n)
+	return n, err
+}
+
+func (s *Store) PaymentRetriesOptedOut(ctx context.Context, customerID string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM payment_retry_opt_outs WHERE customer_id = $1`, customerID).Scan(&n)
+	return n > 0, err
+}
+
+// SetPaymentRetriesOptOut opts a customer out of retries, or back in. An
+// opt-out also cancels the customer's scheduled retries.
+func (s *Store) SetPaymentRetriesOptOut(ctx context.Context, customerID string, optOut bool) error {
+	if !optOut {
+		_, err := s.db.ExecContext(ctx, `DELETE FROM payment_retry_opt_outs WHERE customer_id = $1`, customerID)
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_retry_opt_outs (customer_id) VALUES ($1) ON CONFLICT DO NOTHING`, customerID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE payment_retries SET status = 'canceled', next_attempt_at = NULL, resolved_at = now(), updated_at = now()
+		WHERE customer_id = $1 AND status = 'scheduled'`, customerID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PaymentRetries retries declined one-off payments off-session on the
+// card they were declined on, when the decline may pass later and the
+// card is saved to the customer. The payment_intent.payment_failed
+// webhook schedules the first attempt; a worker makes the attempts and
+// records their outcome. The PaymentIntent is confirmed again rather than
+// replaced, so a recovered payment keeps its ID.
+type PaymentRetries struct {
+	store    *Store
+	settings *RuntimeSettings
+	interval time.Duration
+}
+
+func NewPaymentRetries(store *Store, settings *RuntimeSettings, interval time.Duration) *PaymentRetries {
+	return &PaymentRetries{store: store, settings: settings, interval: interval}
+}
+
+// RegisterRoutes mounts a payment's retry state under payments:read, the
+// customer opt-out under the customers scope, since turning retries back
+// on lets the worker charge a saved card, and an admin route that stops a
+// payment's retries.
+func (p *PaymentRetries) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	r.GET("/payment/:id/retry", requireScope(p.store, bootstrapToken, readPaymentsScope), p.requireStore, p.get)
+	customers := r.Group("/customers/:id/payment-retries", requireScope(p.store, bootstrapToken, "customers"), p.requireStore)
+	customers.GET("", p.getOptOut)
+	customers.PUT("", p.setOptOut)
+
+	admin := r.Group("/admin/payments", requireScope(p.store, bootstrapToken, "admin"), p.requireStore)
+	admin.POST("/:id/retry/cancel", p.cancel)
+}
+
+func (p *PaymentRetries) requireStore(c *gin.Context) {
+	if p.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Payment retries require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+func (p *PaymentRetries) get(c *gin.Context) {
+	r, err := p.store.PaymentRetry(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Payment has no scheduled retries"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, r)
+}
+
+// cancel stops a payment's scheduled retries. An attempt already in
+// flight is left to finish.
+func (p *PaymentRetries) cancel(c *gin.Context) {
+	ctx := c.Request.Context()
+	r, err := p.store.PaymentRetry(ctx, c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) || err == nil && r.Status != paymentRetryScheduled {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Payment has no scheduled retries"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if err := p.resolve(ctx, r, paymentRetryCanceled, paymentRetryScheduled); err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, r)
+}
+
+func (p *PaymentRetries) getOptOut(c *gin.Context) {
+	out, err := p.store.PaymentRetriesOptedOut(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{"customer_id": c.Param("id"), "enabled": !out})
+}
+
+// setOptOut turns retries on or off for a customer's payments.
+func (p *PaymentRetries) setOptOut(c *gin.Context) {
+	var req struct {
+		Enabled *bool `json:"enabled" binding:"required"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if err := p.store.SetPaymentRetriesOptOut(c.Request.Context(), c.Param("id"), !*req.Enabled); err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{"customer_id": c.Param("id"), "enabled": *req.Enabled})
+}
+
+// paymentIntentEvent schedules a retry for a declined payment that
+// qualifies, and ends the retry of a payment that succeeds or is
+// canceled. Declines of the worker's own attempts are recorded by the
+// worker, so only a payment's first decline schedules anything.
+func (p *PaymentRetries) paymentIntentEvent(ctx context.Context, typ stripe.EventType, pi *stripe.PaymentIntent) error {
+	if p == nil || p.store == nil {
+		return nil
+	}
+	switch typ {
+	case "payment_intent.payment_failed":
+		return p.schedule(ctx, pi)
+	case "payment_intent.succeeded":
+		return p.end(ctx, pi, paymentRetryRecovered, paymentRetryAttempting)
+	case "payment_intent.canceled":
+		return p.end(ctx, pi, paymentRetryCanceled, paymentRetryScheduled, paymentRetryAttempting)
+	}
+	return nil
+}
+
+func (p *PaymentRetries) schedule(ctx context.Context, pi *stripe.PaymentIntent) error {
+	cfg := p.settings.Get().PaymentRetries
+	e := pi.LastPaymentError
+	if len(cfg.IntervalsHours) == 0 || e == nil || !cfg.retryable(declineOf(e)) ||
+		pi.Customer == nil || pi.Metadata[paymentRetryOptOutKey] == "true" {
+		return nil
+	}
+	// Only cards saved to the customer can be charged off-session.
+	if e.PaymentMethod == nil || e.PaymentMethod.Customer == nil || e.PaymentMethod.Customer.ID != pi.Customer.ID {
+		return nil
+	}
+	out, err := p.store.PaymentRetriesOptedOut(ctx, pi.Customer.ID)
+	if err != nil {
+		return fmt.Errorf("checking retry opt-out for %s: %w", pi.Customer.ID, err)
+	}
+	if out {
+		return nil
+	}
+
+	next := cfg.Window.next(time.Now().Add(time.Duration(cfg.IntervalsHours[0]) * time.Hour))
+	created, err := p.store.SchedulePaymentRetry(ctx, &PaymentRetry{
+		PaymentID:     pi.ID,
+		TenantID:      pi.Metadata["tenant_id"],
+		CustomerID:    pi.Customer.ID,
+		PaymentMethod: e.PaymentMethod.ID,
+		Currency:      string(pi.Currency),
+		Amount:        pi.Amount,
+		Status:        paymentRetryScheduled,
+		DeclineCode:   declineOf(e),
+		NextAttemptAt: &next,
+	})
+	if err != nil {
+		return fmt.Errorf("scheduling retry of %s: %w", pi.ID, err)
+	}
+	if created {
+		paymentRetriesScheduled.Inc()
+	}
+	return nil
+}
+
+// end resolves pi's retry with result if it is in one of the from
+// statuses. A payment that succeeds while an attempt is in flight was
+// recovered by it; one the customer paid between attempts was not, and
+// the worker's next claim finds it already resolved.
+func (p *PaymentRetries) end(ctx context.Context, pi *stripe.PaymentIntent, result string, from ...string) error {
+	r, err := p.store.PaymentRetry(ctx, pi.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading retry of %s: %w", pi.ID, err)
+	}
+	if result == paymentRetryRecovered && r.Status == paymentRetryScheduled {
+		result, from = paymentRetryCanceled, []string{paymentRetryScheduled}
+	}
+	return p.resolve(ctx, r, result, from...)
+}
+
+func (p *PaymentRetries) resolve(ctx context.Context, r *PaymentRetry, result string, from ...string) error {
+	now := time.Now().UTC()
+	r.Status = result
+	r.NextAttemptAt = nil
+	r.ResolvedAt = &now
+	ok, err := p.store.UpdatePaymentRetry(ctx, r, from...)
+	if err != nil {
+		return fmt.Errorf("resolving retry of %s: %w", r.PaymentID, err)
+	}
+	if ok {
+		paymentRetryResults.WithLabelValues(result).Inc()
+		if result == paymentRetryRecovered {
+			paymentRetryRecoveredAmount.WithLabelValues(r.Currency).Add(float64(r.Amount))
+		}
+	}
+	return nil
+}
+
+// Run makes the attempts that are due every interval until ctx is done.
+func (p *PaymentRetries) Run(ctx context.Context) {
+	if p == nil || p.store == nil {
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		if err := p.attemptDue(ctx); err != nil {
+			log.Printf("payment retries: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *PaymentRetries) attemptDue(ctx context.Context) error {
+	var failed []string
+	for {
+		r, err := p.store.ClaimDuePaymentRetry(ctx, failed)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.attempt(ctx, r); err != nil {
+			log.Printf("retrying payment %s: %v", r.PaymentID, err)
+			failed = append(failed, r.PaymentID)
+		}
+	}
+}
+
+// attempt confirms a claimed retry's payment off-session. The idempotency
+// key names the attempt, so one repeated after a crash doesn't charge
+// twice. A decline schedules the next attempt inside the window, unless
+// the intervals have run out or the decline is no longer worth retrying.
+// Errors other than declines leave the claim to expire and be retried.
+func (p *PaymentRetries) attempt(ctx context.Context, r *PaymentRetry) error {
+	cfg := p.settings.Get().PaymentRetries
+	attempting := []string{paymentRetryAttempting}
+	if len(cfg.IntervalsHours) == 0 {
+		return p.resolve(ctx, r, paymentRetryCanceled, attempting...)
+	}
+	out, err := p.store.PaymentRetriesOptedOut(ctx, r.CustomerID)
+	if err != nil {
+		return err
+	}
+	if out {
+		return p.resolve(ctx, r, paymentRetryCanceled, attempting...)
+	}
+	if max := cfg.MaxAttemptsPerCustomerPerDay; max > 0 {
+		n, err := p.store.CustomerRetryAttempts(ctx, r.CustomerID, time.Now().Add(-24*time.Hour))
+		if err != nil {
+			return err
+		}
+		if n >= max {
+			paymentRetryAttempts.WithLabelValues("deferred").Inc()
+			next := cfg.Window.next(time.Now().Add(paymentRetryDeferral))
+			r.Status, r.NextAttemptAt = paymentRetryScheduled, &next
+			_, err := p.store.UpdatePaymentRetry(ctx, r, attempting...)
+			return err
+		}
+	}
+
+	params := &stripe.PaymentIntentConfirmParams{
+		PaymentMethod: stripe.String(r.PaymentMethod),
+		OffSession:    stripe.Bool(true),
+	}
+	params.Context = ctx
+	params.SetIdempotencyKey(fmt.Sprintf("payment-retry-%s-%d", r.PaymentID, r.Attempts+1))
+	_, err = paymentintent.Confirm(r.PaymentID, params)
+	ctx = context.WithoutCancel(ctx)
+
+	var stripeErr *stripe.Error
+	switch {
+	case err == nil:
+		paymentRetryAttempts.WithLabelValues("succeeded").Inc()
+		r.Attempts++
+		if err := p.store.RecordPaymentRetryAttempt(ctx, r, "succeeded", ""); err != nil {
+			logf(ctx, "recording retry attempt of %s: %v", r.PaymentID, err)
+		}
+		return p.resolve(ctx, r, paymentRetryRecovered, attempting...)
+
+	case errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeCard:
+		paymentRetryAttempts.WithLabelValues("declined").Inc()
+		decline := declineOf(stripeErr)
+		r.Attempts++
+		r.DeclineCode = decline
+		if err := p.store.RecordPaymentRetryAttempt(ctx, r, "declined", decline); err != nil {
+			logf(ctx, "recording retry attempt of %s: %v", r.PaymentID, err)
+		}
+		if r.Attempts >= len(cfg.IntervalsHours) || !cfg.retryable(decline) {
+			return p.resolve(ctx, r, paymentRetryExhausted, attempting...)
+		}
+		next := cfg.Window.next(time.Now().Add(time.Duration(cfg.IntervalsHours[r.Attempts]) * time.Hour))
+		r.Status, r.NextAttemptAt = paymentRetryScheduled, &next
+		_, err := p.store.UpdatePaymentRetry(ctx, r, attempting...)
+		return err
+
+	case errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeInvalidRequest:
+		// The intent can't be confirmed any more: paid, canceled, or its
+		// card detached. Nothing later attempts would change.
+		paymentRetryAttempts.WithLabelValues("error").Inc()
+		if rerr := p.resolve(ctx, r, paymentRetryCanceled, attempting...); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	paymentRetryAttempts.WithLabelValues("error").Inc()
+	return err
+}
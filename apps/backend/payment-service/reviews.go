@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+var paymentReviewsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_payment_reviews_total",
+	Help: "Held payments by outcome (cleared, queued, approved, declined, expired).",
+}, []string{"outcome"})
+
+// reviewScope lets an API key work the manual review queue.
+const reviewScope = "payments:review"
+
+// paymentStatusPendingReview is the status of a payment a review holds.
+// Stripe has it as requires_capture.
+const paymentStatusPendingReview = "pending_review"
+
+// Metadata on held payments. metadataReviewHold is reviewCaptureAuto when
+// the service captures the payment once it clears, reviewCaptureManual
+// when the client asked to capture it; metadataReviewStatus is the
+// review's status once it is queued.
+const (
+	metadataReviewHold   = "review_hold"
+	metadataReviewStatus = "review_status"
+
+	reviewCaptureAuto   = "auto"
+	reviewCaptureManual = "manual"
+)
+
+// Payment review statuses. Everything but pending is final.
+const (
+	reviewPending  = "pending"
+	reviewApproved = "approved"
+	reviewDeclined = "declined"
+	reviewExpired  = "expired"
+)
+
+// PaymentReviewConfig holds card payments uncaptured until the risk rules
+// have seen their charge. A payment the chargeback risk score or
+// duplicate detection flags waits in the review queue for a reviewer to
+// approve or decline it; the rest are captured straight away. Reviews not
+// decided within sla_hours are canceled, well before the card
+// authorization would lapse. A tenant's entry turns review on or off for
+// it.
+//
+//	"payment_review": {"enabled": true, "sla_hours": 24, "tenants": {"acme": false}}
+type PaymentReviewConfig struct {
+	Enabled bool            `json:"enabled"`
+	Tenants map[string]bool `json:"tenants"`
+	// SLAHours zero means 24. Authorizations last 7 days, so at most 144.
+	SLAHours int `json:"sla_hours"`
+}
+
+func (cfg PaymentReviewConfig) validate() error {
+	if cfg.SLAHours < 0 || cfg.SLAHours > 144 {
+		return fmt.Errorf("payment_review: sla_hours must be between 0 and 144")
+	}
+	return nil
+}
+
+func (cfg PaymentReviewConfig) enabled(tenantID string) bool {
+	if on, ok := cfg.Tenants[tenantID]; ok && tenantID != "" {
+		return on
+	}
+	return cfg.Enabled
+}
+
+func (cfg PaymentReviewConfig) sla() time.Duration {
+	if cfg.SLAHours == 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(cfg.SLAHours) * time.Hour
+}
+
+// paymentStatus is pi's status, or pending_review while a review holds it.
+func paymentStatus(pi *stripe.PaymentIntent) string {
+	if pi.Status == stripe.PaymentIntentStatusRequiresCapture && pi.Metadata[metadataReviewStatus] == reviewPending {
+		return paymentStatusPendingReview
+	}
+	return string(pi.Status)
+}
+
+// PaymentReview is a held payment in, or through, the review queue.
+type PaymentReview struct {
+	PaymentID string     `json:"payment_id"`
+	TenantID  string     `json:"tenant_id,omitempty"`
+	Amount    int64      `json:"amount"`
+	Currency  string     `json:"currency"`
+	Reasons   []string   `json:"reasons"`
+	Capture   string     `json:"capture"`
+	Status    string     `json:"status"`
+	DecidedBy string     `json:"decided_by,omitempty"`
+	Note      string     `json:"note,omitempty"`
+	DueAt     time.Time  `json:"due_at"`
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+const paymentReviewColumns = `payment_id, tenant_id, amount, currency, reasons, capture, status, decided_by, note,
+	due_at, decided_at, created_at`
+
+func scanPaymentReview(row interface{ Scan(...interface{}) error }) (*PaymentReview, error) {
+	var r PaymentReview
+	var reasons string
+	var decided sql.NullTime
+	if err := row.Scan(&r.PaymentID, &r.TenantID, &r.Amount, &r.Currency, &reasons, &r.Capture, &r.Status,
+		&r.DecidedBy, &r.Note, &r.DueAt, &decided, &r.CreatedAt); err != nil {
+		return nil, err
+	}
+	r.Reasons = strings.Split(reasons, ",")
+	r.DecidedAt = timeOrNil(decided)
+	return &r, nil
+}
+
+// The review queue; filter on status=pending for what is left to decide.
+var paymentReviewList = listResource{
+	from: "payment_reviews v",
+	fields: []string{"payment_id", "tenant_id", "amount", "currency", "reasons", "capture", "status",
+		"decided_by", "note", "due_at", "decided_at", "created_at"},
+	columns: map[string]listField{
+		"payment_id": {"v.payment_id", textField},
+		"tenant_id":  {"v.tenant_id", textField},
+		"amount":     {"v.amount", intField},
+		"currency":   {"v.currency", textField},
+		"reasons":    {"v.reasons", textField},
+		"capture":    {"v.capture", textField},
+		"status":     {"v.status", textField},
+		"decided_by": {"v.decided_by", textField},
+		"note":       {"v.note", textField},
+		"due_at":     {"v.due_at", timeField},
+		"decided_at": {"v.decided_at", timeField},
+		"created_at": {"v.created_at", timeField},
+	},
+}
+
+// PaymentRiskReasons lists the risk rules that flagged a payment:
+// chargeback_risk and duplicate_payment.
+func (s *Store) PaymentRiskReasons(ctx context.Context, paymentID string) ([]string, error) {
+	var risky, duplicate bool
+	err := s.db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM chargeback_risk_flags WHERE payment_id = $1),
+			EXISTS (SELECT 1 FROM payments WHERE id = $1 AND duplicate_of <> '')`, paymentID).
+		Scan(&risky, &duplicate)
+	var reasons []string
+	if risky {
+		reasons = append(reasons, "chargeback_risk")
+	}
+	if duplicate {
+		reasons = append(reasons, "duplicate_payment")
+	}
+	return reasons, err
+}
+
+// CreatePaymentReview queues r and marks its payment pending_review,
+// reporting false when the payment was already queued.
+func (s *Store) CreatePaymentReview(ctx context.Context, r *PaymentReview) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_reviews (payment_id, tenant_id, amount, currency, reasons, capture, status, due_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (payment_id) DO NOTHING`,
+		r.PaymentID, r.TenantID, r.Amount, r.Currency, strings.Join(r.Reasons, ","), r.Capture, r.Status, r.DueAt)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE payments SET status = $2, updated_at = now()
+		WHERE id = $1 AND status = 'requires_capture'`, r.PaymentID, paymentStatusPendingReview); err != nil {
+		return false, err
+	}
+	if err := appendPaymentEvent(ctx, tx, r.PaymentID, "review"); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *Store) PaymentReview(ctx context.Context, paymentID string) (*PaymentReview, error) {
+	return scanPaymentReview(s.db.QueryRowContext(ctx, `
+		SELECT `+paymentReviewColumns+` FROM payment_reviews WHERE payment_id = $1`, paymentID))
+}
+
+// DecidePaymentReview closes a pending review with status, handing the
+// payment back its Stripe status. It returns sql.ErrNoRows when the
+// review was no longer pending.
+func (s *Store) DecidePaymentReview(ctx context.Context, paymentID, status, actor, note string) (*PaymentReview, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	r, err := scanPaymentReview(tx.QueryRowContext(ctx, `
+		UPDATE payment_reviews SET status = $2, decided_by = $3, note = $4, decided_at = now(), updated_at = now()
+		WHERE payment_id = $1 AND status = 'pending'
+		RETURNING `+paymentReviewColumns, paymentID, status, actor, note))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE payments SET status = 'requires_capture', updated_at = now()
+		WHERE id = $1 AND status = $2`, paymentID, paymentStatusPendingReview); err != nil {
+		return nil, err
+	}
+	if err := appendPaymentEvent(ctx, tx, paymentID, "review"); err != nil {
+		return nil, err
+	}
+	return r, tx.Commit()
+}
+
+// DuePaymentReviews returns up to limit pending reviews whose SLA passed
+// before now, oldest first.
+func (s *Store) DuePaymentReviews(ctx context.Context, now time.Time, limit int) ([]*PaymentReview, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+paymentReviewColumns+` FROM payment_reviews
+		WHERE status = 'pending' AND due_at <= $1
+		ORDER BY due_at LIMIT $2`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reviews := []*PaymentReview{}
+	for rows.Next() {
+		r, err := scanPaymentReview(rows)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, r)
+	}
+	return reviews, rows.Err()
+}
+
+// PaymentReviews replaces the reviewers' spreadsheet. Payments of tenants
+// with review on, and those a review risk rule matched, are created for
+// manual capture; when their charge
+// succeeds, after the chargeback risk and duplicate checks have run on
+// it, a flagged one is queued as pending_review and the others are
+// captured. Reviewers with the payments:review scope approve a queued
+// payment, which captures it, or decline it, which cancels it; a worker
+// cancels those left past their SLA. Each outcome is an event on the
+// payment's stream.
+type PaymentReviews struct {
+	store    *Store
+	settings *RuntimeSettings
+	hub      *EventHub
+	interval time.Duration
+}
+
+func NewPaymentReviews(store *Store, settings *RuntimeSettings, hub *EventHub, interval time.Duration) *PaymentReviews {
+	return &PaymentReviews{store: store, settings: settings, hub: hub, interval: interval}
+}
+
+func (pr *PaymentReviews) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/admin/payment-reviews", requireScope(pr.store, bootstrapToken, reviewScope), pr.requireStore)
+	g.GET("", listHandler(pr.store, paymentReviewList))
+	g.GET("/:id", pr.get)
+	g.POST("/:id/approve", pr.approve)
+	g.POST("/:id/decline", pr.decline)
+}
+
+func (pr *PaymentReviews) requireStore(c *gin.Context) {
+	if pr.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Payment review requires DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// hold sets params up for review when the tenant has it on, or when a
+// risk rule forces it, and reports whether it did. Payments the client
+// captures itself are held too, and only capturable once cleared.
+// Payments at a locked FX rate can't wait for capture and aren't held.
+func (pr *PaymentReviews) hold(req PaymentRequest, params *stripe.PaymentIntentParams, force bool) bool {
+	if pr == nil || pr.store == nil || req.FXQuoteID != "" || (!force && !pr.settings.Get().PaymentReview.enabled(req.TenantID)) {
+		return false
+	}
+	if params.Metadata[metadataReviewHold] != "" {
+		return true
+	}
+	if stripe.StringValue(params.CaptureMethod) == string(stripe.PaymentIntentCaptureMethodManual) {
+		params.AddMetadata(metadataReviewHold, reviewCaptureManual)
+		return true
+	}
+	params.CaptureMethod = stripe.String(string(stripe.PaymentIntentCaptureMethodManual))
+	params.AddMetadata(metadataReviewHold, reviewCaptureAuto)
+	return true
+}
+
+// chargeSucceeded screens a held payment once its card is authorized:
+// queued if a risk rule flagged it, captured otherwise.
+func (pr *PaymentReviews) chargeSucceeded(ctx context.Context, ch *stripe.Charge) error {
+	if pr == nil || pr.store == nil || ch.Captured || ch.PaymentIntent == nil {
+		return nil
+	}
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	pi, err := paymentintent.Get(ch.PaymentIntent.ID, params)
+	if err != nil {
+		return fmt.Errorf("loading payment %s: %w", ch.PaymentIntent.ID, err)
+	}
+	capture := pi.Metadata[metadataReviewHold]
+	if capture == "" || pi.Metadata[metadataReviewStatus] != "" || pi.Status != stripe.PaymentIntentStatusRequiresCapture {
+		return nil
+	}
+	reasons, err := pr.store.PaymentRiskReasons(ctx, pi.ID)
+	if err != nil {
+		return fmt.Errorf("risk flags for %s: %w", pi.ID, err)
+	}
+	if pi.Metadata[metadataRiskAction] == riskReview {
+		reasons = append(reasons, "risk_rule:"+pi.Metadata[metadataRiskRule])
+	}
+
+	if len(reasons) == 0 {
+		paymentReviewsTotal.WithLabelValues("cleared").Inc()
+		if capture != reviewCaptureAuto {
+			return nil
+		}
+		_, err := paymentintent.Capture(pi.ID, reviewCaptureParams(ctx, pi))
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeInvalidRequest {
+			// Captured or canceled since; nothing left to do.
+			logf(ctx, "capturing cleared payment %s: %v", pi.ID, err)
+			return nil
+		}
+		return err
+	}
+
+	review := &PaymentReview{
+		PaymentID: pi.ID,
+		TenantID:  pi.Metadata["tenant_id"],
+		Amount:    pi.Amount,
+		Currency:  string(pi.Currency),
+		Reasons:   reasons,
+		Capture:   capture,
+		Status:    reviewPending,
+		DueAt:     time.Now().Add(pr.settings.Get().PaymentReview.sla()).UTC(),
+	}
+	created, err := pr.store.CreatePaymentReview(ctx, review)
+	if err != nil || !created {
+		return err
+	}
+	paymentReviewsTotal.WithLabelValues("queued").Inc()
+	// The review is saved, so failing to mark the intent is logged
+	// rather than redelivered.
+	if pi, err = pr.mark(ctx, pi.ID, reviewPending); err != nil {
+		logf(ctx, "marking payment %s for review: %v", review.PaymentID, err)
+	} else {
+		pr.publish(ctx, pi, "payment.review_pending")
+	}
+	return nil
+}
+
+// reviewCaptureParams captures a held payment once, with its tip.
+func reviewCaptureParams(ctx context.Context, pi *stripe.PaymentIntent) *stripe.PaymentIntentCaptureParams {
+	params := captureParams(ctx, pi)
+	params.SetIdempotencyKey("review-capture-" + pi.ID)
+	return params
+}
+
+func (pr *PaymentReviews) mark(ctx context.Context, paymentID, status string) (*stripe.PaymentIntent, error) {
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	params.AddMetadata(metadataReviewStatus, status)
+	return paymentintent.Update(paymentID, params)
+}
+
+func (pr *PaymentReviews) publish(ctx context.Context, pi *stripe.PaymentIntent, typ string) {
+	pr.hub.Publish(PaymentEvent{
+		PaymentID:  pi.ID,
+		TenantID:   pi.Metadata["tenant_id"],
+		CustomerID: customerIDOf(pi.Customer),
+		Type:       typ,
+		Status:     paymentStatus(pi),
+		Amount:     pi.Amount,
+		Currency:   string(pi.Currency),
+		CreatedAt:  time.Now().UTC(),
+		RequestID:  requestIDFrom(ctx),
+	})
+}
+
+func (pr *PaymentReviews) get(c *gin.Context) {
+	rv, err := pr.store.PaymentReview(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Payment review not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, rv)
+}
+
+// approve captures a queued payment, or for one the client captures,
+// lets it be captured.
+func (pr *PaymentReviews) approve(c *gin.Context) { pr.respondDecision(c, reviewApproved) }
+
+// decline cancels a queued payment as fraudulent.
+func (pr *PaymentReviews) decline(c *gin.Context) { pr.respondDecision(c, reviewDeclined) }
+
+func (pr *PaymentReviews) respondDecision(c *gin.Context, status string) {
+	var req struct {
+		Note string `json:"note" binding:"max=500"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+	ctx := c.Request.Context()
+	rv, err := pr.store.PaymentReview(ctx, c.Param("id"))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Payment review not found"))
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	case rv.Status != reviewPending:
+		c.JSON(http.StatusConflict, errorBodyWith(c, CodePaymentState, "The review is "+rv.Status,
+			gin.H{"status": rv.Status}))
+		return
+	}
+
+	rv, err = pr.decide(ctx, rv, status, c.GetString("api_key_id"), req.Note)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusConflict, errorBody(c, CodePaymentState, "The review was decided meanwhile"))
+	case err != nil:
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+	default:
+		respondData(c, http.StatusOK, rv)
+	}
+}
+
+// decide applies a decision on Stripe, then records it. Capture and
+// cancel carry the review's idempotency keys, so deciding again after a
+// failure in between does it once. Approving a payment the client
+// captures only marks it, which lets the capture through.
+func (pr *PaymentReviews) decide(ctx context.Context, rv *PaymentReview, status, actor, note string) (*PaymentReview, error) {
+	get := &stripe.PaymentIntentParams{}
+	get.Context = ctx
+	pi, err := paymentintent.Get(rv.PaymentID, get)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case status == reviewApproved && rv.Capture == reviewCaptureAuto:
+		pi, err = paymentintent.Capture(pi.ID, reviewCaptureParams(ctx, pi))
+	case status == reviewDeclined, status == reviewExpired:
+		reason := stripe.PaymentIntentCancellationReasonFraudulent
+		if status == reviewExpired {
+			reason = stripe.PaymentIntentCancellationReasonAbandoned
+		}
+		params := &stripe.PaymentIntentCancelParams{CancellationReason: stripe.String(string(reason))}
+		params.Context = ctx
+		params.SetIdempotencyKey("review-cancel-" + pi.ID)
+		pi, err = paymentintent.Cancel(pi.ID, params)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if marked, err := pr.mark(ctx, pi.ID, status); err == nil {
+		pi = marked
+	} else if status == reviewApproved && rv.Capture == reviewCaptureManual {
+		return nil, err
+	} else {
+		logf(ctx, "marking review of %s %s: %v", pi.ID, status, err)
+	}
+
+	rv, err = pr.store.DecidePaymentReview(context.WithoutCancel(ctx), rv.PaymentID, status, actor, note)
+	if err != nil {
+		return nil, err
+	}
+	paymentReviewsTotal.WithLabelValues(status).Inc()
+	pr.publish(ctx, pi, "payment.review_"+status)
+	return rv, nil
+}
+
+// Run cancels reviews past their SLA every interval until ctx is done.
+func (pr *PaymentReviews) Run(ctx context.Context) {
+	if pr == nil || pr.store == nil {
+		return
+	}
+	ticker := time.NewTicker(pr.interval)
+	defer ticker.Stop()
+	for {
+		if err := pr.sweep(ctx); err != nil {
+			log.Printf("payment reviews: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (pr *PaymentReviews) sweep(ctx context.Context) error {
+	due, err := pr.store.DuePaymentReviews(ctx, time.Now(), 100)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, rv := range due {
+		_, err := pr.decide(ctx, rv, reviewExpired, "", "Not reviewed within the SLA")
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeInvalidRequest {
+			// The authorization is gone already; close the review anyway.
+			_, err = pr.store.DecidePaymentReview(ctx, rv.PaymentID, reviewExpired, "", stripeErr.Msg)
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			errs = append(errs, fmt.Errorf("expiring review of %s: %w", rv.PaymentID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
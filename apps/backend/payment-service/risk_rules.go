@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/customer"
+)
+
+var riskRuleDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_risk_rule_decisions_total",
+	Help: "Payments a risk rule matched at creation, by action.",
+}, []string{"action"})
+
+// Risk rule actions. allow ends evaluation with nothing done; challenge
+// asks the card for 3-D Secure; review holds the payment for the review
+// queue; block refuses it with payment_blocked.
+const (
+	riskAllow     = "allow"
+	riskChallenge = "challenge"
+	riskReview    = "review"
+	riskBlock     = "block"
+)
+
+// Metadata naming the rule that challenged or held a payment, and which
+// of the two it did.
+const (
+	metadataRiskRule   = "risk_rule"
+	metadataRiskAction = "risk_action"
+)
+
+type riskSignalKind int
+
+const (
+	riskNumber riskSignalKind = iota
+	riskString
+	riskBool
+)
+
+// riskSignals are what rules can test. Card signals are known for
+// payments created with a payment_method, customer signals for those with
+// a customer_id and device signals for those with a device_id. The _24h
+// counts are the tenant's payments in the last day, before this one;
+// device_customers_24h is the distinct customers who paid on the device.
+var riskSignals = map[string]riskSignalKind{
+	"amount":                riskNumber,
+	"currency":              riskString,
+	"tenant_id":             riskString,
+	"card_bin":              riskString,
+	"card_brand":            riskString,
+	"card_country":          riskString,
+	"customer_age_days":     riskNumber,
+	"billing_country":       riskString,
+	"country_mismatch":      riskBool,
+	"email_mismatch":        riskBool,
+	"card_payments_24h":     riskNumber,
+	"customer_payments_24h": riskNumber,
+	"customer_cards_24h":    riskNumber,
+	"client_ip":             riskString,
+	"device_id":             riskString,
+	"device_payments_24h":   riskNumber,
+	"device_customers_24h":  riskNumber,
+}
+
+// RiskRule acts on the payments matching all of its conditions. Rules are
+// tried in order and the first match decides; one naming tenants applies
+// only to their payments. A condition on a signal the payment doesn't
+// have never matches.
+//
+//	"risk_rules": [
+//	  {"name": "trusted-bins", "when": {"card_bin": {"in": ["424242"]}}, "action": "allow"},
+//	  {"name": "large-foreign", "when": {"amount": {"gte": 50000}, "card_country": {"not_in": ["US", "CA"]}}, "action": "review"},
+//	  {"name": "new-mismatched", "when": {"customer_age_days": {"lt": 1}, "country_mismatch": {"eq": true}}, "action": "challenge"},
+//	  {"name": "card-testing", "tenants": ["acme"], "when": {"card_payments_24h": {"gt": 10}}, "action": "block"},
+//	  {"name": "shared-device", "when": {"device_customers_24h": {"gte": 3}}, "action": "review"}]
+type RiskRule struct {
+	Name    string                   `json:"name"`
+	Tenants []string                 `json:"tenants,omitempty"`
+	When    map[string]RiskCondition `json:"when"`
+	Action  string                   `json:"action"`
+}
+
+// RiskCondition compares one signal. Numbers take gt, gte, lt and lte;
+// strings eq, ne, in and not_in, case-insensitively; booleans eq and ne.
+// Set conditions are ANDed.
+type RiskCondition struct {
+	Eq    interface{} `json:"eq,omitempty"`
+	Ne    interface{} `json:"ne,omitempty"`
+	Gt    *float64    `json:"gt,omitempty"`
+	Gte   *float64    `json:"gte,omitempty"`
+	Lt    *float64    `json:"lt,omitempty"`
+	Lte   *float64    `json:"lte,omitempty"`
+	In    []string    `json:"in,omitempty"`
+	NotIn []string    `json:"not_in,omitempty"`
+}
+
+type RiskRules []RiskRule
+
+func (rules RiskRules) validate() error {
+	names := map[string]bool{}
+	for i, r := range rules {
+		if r.Name == "" || names[r.Name] {
+			return fmt.Errorf("risk_rules[%d]: name must be set and unique", i)
+		}
+		names[r.Name] = true
+		switch r.Action {
+		case riskAllow, riskChallenge, riskReview, riskBlock:
+		default:
+			return fmt.Errorf("risk_rules %s: action must be one of allow, challenge, review, block", r.Name)
+		}
+		if len(r.When) == 0 {
+			return fmt.Errorf("risk_rules %s: when needs at least one condition", r.Name)
+		}
+		for field, cond := range r.When {
+			kind, ok := riskSignals[field]
+			if !ok {
+				return fmt.Errorf("risk_rules %s: unknown signal %q", r.Name, field)
+			}
+			if err := cond.validate(kind); err != nil {
+				return fmt.Errorf("risk_rules %s: %s %v", r.Name, field, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (c RiskCondition) validate(kind riskSignalKind) error {
+	numeric := c.Gt != nil || c.Gte != nil || c.Lt != nil || c.Lte != nil
+	sets := c.In != nil || c.NotIn != nil
+	switch kind {
+	case riskNumber:
+		if !numeric || c.Eq != nil || c.Ne != nil || sets {
+			return fmt.Errorf("takes gt, gte, lt and lte")
+		}
+	case riskString:
+		_, eq := c.Eq.(string)
+		_, ne := c.Ne.(string)
+		if numeric || (c.Eq != nil && !eq) || (c.Ne != nil && !ne) || (c.Eq == nil && c.Ne == nil && !sets) {
+			return fmt.Errorf("takes string eq, ne, in and not_in")
+		}
+	case riskBool:
+		_, eq := c.Eq.(bool)
+		_, ne := c.Ne.(bool)
+		if numeric || sets || (c.Eq != nil && !eq) || (c.Ne != nil && !ne) || (c.Eq == nil && c.Ne == nil) {
+			return fmt.Errorf("takes boolean eq and ne")
+		}
+	}
+	return nil
+}
+
+func (c RiskCondition) matches(v interface{}) bool {
+	switch v := v.(type) {
+	case float64:
+		return (c.Gt == nil || v > *c.Gt) && (c.Gte == nil || v >= *c.Gte) &&
+			(c.Lt == nil || v < *c.Lt) && (c.Lte == nil || v <= *c.Lte)
+	case string:
+		in := func(set []string) bool {
+			for _, s := range set {
+				if strings.EqualFold(s, v) {
+					return true
+				}
+			}
+			return false
+		}
+		eq, _ := c.Eq.(string)
+		ne, _ := c.Ne.(string)
+		return (c.Eq == nil || strings.EqualFold(eq, v)) && (c.Ne == nil || !strings.EqualFold(ne, v)) &&
+			(c.In == nil || in(c.In)) && (c.NotIn == nil || !in(c.NotIn))
+	case bool:
+		return (c.Eq == nil || c.Eq == v) && (c.Ne == nil || c.Ne != v)
+	}
+	return false
+}
+
+func (r RiskRule) appliesTo(tenantID string) bool {
+	if len(r.Tenants) == 0 {
+		return true
+	}
+	for _, t := range r.Tenants {
+		if t == tenantID {
+			return true
+		}
+	}
+	return false
+}
+
+// needs reports whether any rule tests one of fields.
+func (rules RiskRules) needs(fields ...string) bool {
+	for _, r := range rules {
+		for _, f := range fields {
+			if _, ok := r.When[f]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RiskDecision is what the rules made of a payment. Action is allow when
+// no rule matched.
+type RiskDecision struct {
+	Action string `json:"action"`
+	Rule   string `json:"rule,omitempty"`
+	// Matched lists every rule that matched, in order, though only the
+	// first decides.
+	Matched []string               `json:"matched"`
+	Signals map[string]interface{} `json:"signals"`
+}
+
+// paymentHistory is the tenant's recent payments on a card, by a
+// customer and from a device.
+type paymentHistory struct {
+	CardPayments, CustomerPayments, CustomerCards int64
+	DevicePayments, DeviceCustomers               int64
+}
+
+// PaymentHistory counts the tenant's payments since since on the card
+// with fingerprint, by customerID and from deviceID, the customer's
+// distinct cards and the device's distinct customers.
+func (s *Store) PaymentHistory(ctx context.Context, tenantID, fingerprint, customerID, deviceID string, since time.Time) (paymentHistory, error) {
+	var h paymentHistory
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			COUNT(*) FILTER (WHERE $2 <> '' AND card_fingerprint = $2),
+			COUNT(*) FILTER (WHERE $3 <> '' AND customer_id = $3),
+			COUNT(DISTINCT card_fingerprint) FILTER (WHERE $3 <> '' AND customer_id = $3 AND card_fingerprint <> ''),
+			COUNT(*) FILTER (WHERE $4 <> '' AND device_id = $4),
+			COUNT(DISTINCT customer_id) FILTER (WHERE $4 <> '' AND device_id = $4 AND customer_id <> '')
+		FROM payments
+		WHERE tenant_id = $1 AND created_at >= $5
+			AND (($2 <> '' AND card_fingerprint = $2) OR ($3 <> '' AND customer_id = $3) OR ($4 <> '' AND device_id = $4))`,
+		tenantID, fingerprint, customerID, deviceID, since).
+		Scan(&h.CardPayments, &h.CustomerPayments, &h.CustomerCards, &h.DevicePayments, &h.DeviceCustomers)
+	return h, err
+}
+
+// RiskEngine evaluates the risk_rules of the runtime config, reloaded with
+// it, against each payment before its intent is created. Signals that
+// cost a lookup are only gathered when a rule tests them, and a failed
+// lookup leaves them unknown rather than failing the payment.
+type RiskEngine struct {
+	store    *Store
+	settings *RuntimeSettings
+	payments *PaymentService
+}
+
+func NewRiskEngine(store *Store, settings *RuntimeSettings, payments *PaymentService) *RiskEngine {
+	return &RiskEngine{store: store, settings: settings, payments: payments}
+}
+
+// RegisterRoutes mounts the dry run, which the fraud team can also point
+// at rules not yet deployed.
+func (e *RiskEngine) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	r.POST("/risk/evaluate", requireScope(e.store, bootstrapToken, "fraud"), e.evaluateHandler)
+}
+
+// evaluate runs rules over req.
+func (e *RiskEngine) evaluate(ctx context.Context, rules RiskRules, req PaymentRequest, card paymentCard) RiskDecision {
+	d := RiskDecision{Action: riskAllow, Matched: []string{}, Signals: e.signals(ctx, rules, req, card)}
+	for _, r := range rules {
+		if !r.appliesTo(req.TenantID) || !r.matches(d.Signals) {
+			continue
+		}
+		d.Matched = append(d.Matched, r.Name)
+		if d.Rule == "" {
+			d.Action, d.Rule = r.Action, r.Name
+		}
+	}
+	return d
+}
+
+func (r RiskRule) matches(signals map[string]interface{}) bool {
+	for field, cond := range r.When {
+		v, ok := signals[field]
+		if !ok || !cond.matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *RiskEngine) signals(ctx context.Context, rules RiskRules, req PaymentRequest, card paymentCard) map[string]interface{} {
+	s := map[string]interface{}{
+		"amount":    float64(req.Amount),
+		"currency":  req.Currency,
+		"tenant_id": req.TenantID,
+	}
+	for name, v := range map[string]string{
+		"card_bin": card.BIN, "card_brand": card.Brand, "card_country": card.Country,
+		"client_ip": req.ClientIP, "device_id": req.DeviceID,
+	} {
+		if v != "" {
+			s[name] = v
+		}
+	}
+
+	if req.CustomerID != "" && rules.needs("customer_age_days", "billing_country", "country_mismatch", "email_mismatch") {
+		params := &stripe.CustomerParams{}
+		params.Context = ctx
+		cust, err := customer.Get(req.CustomerID, params)
+		if err != nil {
+			logf(ctx, "risk rules: customer %s: %v", req.CustomerID, err)
+		} else {
+			s["customer_age_days"] = time.Since(time.Unix(cust.Created, 0)).Hours() / 24
+			if cust.Address != nil && cust.Address.Country != "" {
+				s["billing_country"] = cust.Address.Country
+				if card.Country != "" {
+					s["country_mismatch"] = !strings.EqualFold(card.Country, cust.Address.Country)
+				}
+			}
+			if req.ReceiptEmail != "" && cust.Email != "" {
+				s["email_mismatch"] = !strings.EqualFold(req.ReceiptEmail, cust.Email)
+			}
+		}
+	}
+
+	if e.store != nil && rules.needs("card_payments_24h", "customer_payments_24h", "customer_cards_24h",
+		"device_payments_24h", "device_customers_24h") {
+		h, err := e.store.PaymentHistory(ctx, req.TenantID, card.Fingerprint, req.CustomerID, req.DeviceID, time.Now().Add(-24*time.Hour))
+		if err != nil {
+			logf(ctx, "risk rules: payment history: %v", err)
+		} else {
+			if card.Fingerprint != "" {
+				s["card_payments_24h"] = float64(h.CardPayments)
+			}
+			if req.CustomerID != "" {
+				s["customer_payments_24h"] = float64(h.CustomerPayments)
+				s["customer_cards_24h"] = float64(h.CustomerCards)
+			}
+			if req.DeviceID != "" {
+				s["device_payments_24h"] = float64(h.DevicePayments)
+				s["device_customers_24h"] = float64(h.DeviceCustomers)
+			}
+		}
+	}
+	return s
+}
+
+// check evaluates the live rules, refusing a payment a block rule
+// matched. The decision is returned for apply once params are built.
+func (e *RiskEngine) check(ctx context.Context, req PaymentRequest, card paymentCard) (RiskDecision, *refusal) {
+	if e == nil {
+		return RiskDecision{Action: riskAllow}, nil
+	}
+	rules := e.settings.Get().RiskRules
+	if len(rules) == 0 {
+		return RiskDecision{Action: riskAllow}, nil
+	}
+	d := e.evaluate(ctx, rules, req, card)
+	if d.Rule == "" {
+		return d, nil
+	}
+	if !req.dryRun {
+		riskRuleDecisions.WithLabelValues(d.Action).Inc()
+	}
+	if d.Action == riskBlock {
+		return d, &refusal{http.StatusForbidden, CodePaymentBlocked, "Payment blocked by risk rule " + d.Rule, gin.H{"rule": d.Rule}}
+	}
+	return d, nil
+}
+
+// apply carries out a challenge or review decision on params. Holding
+// for review needs the review queue; without it the payment is
+// challenged instead.
+func (e *RiskEngine) apply(d RiskDecision, req PaymentRequest, params *stripe.PaymentIntentParams, reviews *PaymentReviews) {
+	if d.Action != riskChallenge && d.Action != riskReview {
+		return
+	}
+	params.AddMetadata(metadataRiskRule, d.Rule)
+	if d.Action == riskReview && reviews.hold(req, params, true) {
+		params.AddMetadata(metadataRiskAction, riskReview)
+		return
+	}
+	params.AddMetadata(metadataRiskAction, riskChallenge)
+	if params.PaymentMethodOptions == nil {
+		params.PaymentMethodOptions = &stripe.PaymentIntentPaymentMethodOptionsParams{}
+	}
+	if params.PaymentMethodOptions.Card == nil {
+		params.PaymentMethodOptions.Card = &stripe.PaymentIntentPaymentMethodOptionsCardParams{}
+	}
+	params.PaymentMethodOptions.Card.RequestThreeDSecure = stripe.String(string(stripe.PaymentIntentPaymentMethodOptionsCardRequestThreeDSecureAny))
+}
+
+// evaluateHandler dry-runs a payment through the rules in effect, or
+// through the rules given, without creating anything or counting it.
+func (e *RiskEngine) evaluateHandler(c *gin.Context) {
+	var body struct {
+		Payment PaymentRequest `json:"payment"`
+		Rules   *RiskRules     `json:"rules"`
+	}
+	if !decodeJSON(c, &body) {
+		return
+	}
+	req := body.Payment
+	if fields := req.validate(); len(fields) > 0 {
+		for i := range fields {
+			fields[i].Field = "payment." + fields[i].Field
+		}
+		validationFailed(c, fields)
+		return
+	}
+	rules := e.settings.Get().RiskRules
+	if body.Rules != nil {
+		if err := body.Rules.validate(); err != nil {
+			validationFailed(c, []FieldError{{Field: "rules", Code: "invalid", Message: err.Error()}})
+			return
+		}
+		rules = *body.Rules
+	}
+	req.dryRun = true
+
+	ctx := c.Request.Context()
+	_, card, refused := e.payments.paymentMethod(ctx, req)
+	if refused != nil {
+		c.JSON(refused.status, errorBodyWith(c, refused.code, refused.message, refused.ext))
+		return
+	}
+	respondData(c, http.StatusOK, e.evaluate(ctx, rules, req, card))
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// RuntimeConfig is the non-secret configuration that can change without a
+// restart. It is read from RUNTIME_CONFIG_FILE and swapped atomically on
+// reload, so requests in flight finish with the config they started with.
+type RuntimeConfig struct {
+	// CORSOrigins lists allowed browser origins; "*" allows any.
+	CORSOrigins []string `json:"cors_origins"`
+	// PaymentMethodTypes is the default when no flag selects methods for
+	// a tenant. Empty leaves the choice to Stripe.
+	PaymentMethodTypes []string `json:"payment_method_types"`
+	// MaxAmounts rejects single payments above a per-currency threshold,
+	// in minor units. AmountPolicies can do the same per tenant.
+	MaxAmounts         map[string]int64        `json:"max_amounts"`
+	AmountPolicies     AmountPolicies          `json:"amount_policies"`
+	RateLimit          RateLimitConfig         `json:"rate_limit"`
+	Promotions         []Promotion             `json:"promotions"`
+	Dunning            DunningPolicies         `json:"dunning"`
+	PaymentRetries     PaymentRetryConfig      `json:"payment_retries"`
+	RefundApproval     RefundApprovalConfig    `json:"refund_approval"`
+	PaymentPlans       PaymentPlanConfig       `json:"payment_plans"`
+	FX                 FXConfig                `json:"fx"`
+	ChargebackRisk     ChargebackRiskConfig    `json:"chargeback_risk"`
+	DuplicatePayments  DuplicatePaymentsConfig `json:"duplicate_payments"`
+	Velocity           VelocityConfig          `json:"velocity"`
+	PaymentReview      PaymentReviewConfig     `json:"payment_review"`
+	RiskRules          RiskRules               `json:"risk_rules"`
+	Residency          ResidencyConfig         `json:"residency"`
+	Retention          RetentionConfig         `json:"retention"`
+	SellerPayouts      SellerPayoutConfig      `json:"seller_payouts"`
+	Loyalty            LoyaltyConfig           `json:"loyalty"`
+	Invoices           InvoiceProfiles         `json:"invoices"`
+	Billing            BillingConfig           `json:"billing"`
+	BillingPortal      BillingPortalProfiles   `json:"billing_portal"`
+	Quotes             QuoteConfig             `json:"quotes"`
+	Surcharges         SurchargeConfig         `json:"surcharges"`
+	AuthorizationHolds AuthorizationHoldConfig `json:"authorization_holds"`
+	Rounding           RoundingConfig          `json:"rounding"`
+	Shadow             ShadowConfig            `json:"shadow"`
+	APIVersionShadow   APIVersionShadowConfig  `json:"api_version_shadow"`
+	ProviderRouting    ProviderRoutingConfig   `json:"provider_routing"`
+	SLOs               SLOConfig               `json:"slos"`
+	APIKeyQuotas       APIKeyQuotaConfig       `json:"api_key_quotas"`
+	OAuth2             OAuth2Config            `json:"oauth2"`
+	TenantLimits       TenantLimitConfig       `json:"tenant_limits"`
+	LifecycleHooks     LifecycleHookConfig     `json:"lifecycle_hooks"`
+	// DisputeReminderHours are how long before a dispute's evidence
+	// deadline reminders are emitted. Empty means 72 and 24.
+	DisputeReminderHours []int `json:"dispute_reminder_hours"`
+}
+
+// RateLimitConfig limits requests per client IP; zero disables it.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+func defaultRuntimeConfig() *RuntimeConfig {
+	cfg := &RuntimeConfig{CORSOrigins: []string{"*"}}
+	if v := os.Getenv("CORS_ALLOWED_ORIGINS"); v != "" {
+		cfg.CORSOrigins = nil
+		for _, o := range strings.Split(v, ",") {
+			if o = strings.TrimSpace(o); o != "" {
+				cfg.CORSOrigins = append(cfg.CORSOrigins, o)
+			}
+		}
+	}
+	return cfg
+}
+
+func (cfg *RuntimeConfig) validate() error {
+	for cur, max := range cfg.MaxAmounts {
+		if len(cur) != 3 || max <= 0 {
+			return fmt.Errorf("invalid max_amounts entry %s=%d", cur, max)
+		}
+	}
+	if err := cfg.AmountPolicies.validate(); err != nil {
+		return err
+	}
+	if err := validatePromotions(cfg.Promotions); err != nil {
+		return err
+	}
+	if err := cfg.Dunning.validate(); err != nil {
+		return err
+	}
+	if err := cfg.PaymentRetries.validate(); err != nil {
+		return err
+	}
+	if err := cfg.RefundApproval.validate(); err != nil {
+		return err
+	}
+	if err := cfg.PaymentPlans.validate(); err != nil {
+		return err
+	}
+	if err := cfg.FX.validate(); err != nil {
+		return err
+	}
+	if err := cfg.ChargebackRisk.validate(); err != nil {
+		return err
+	}
+	if err := cfg.DuplicatePayments.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Velocity.validate(); err != nil {
+		return err
+	}
+	if err := cfg.PaymentReview.validate(); err != nil {
+		return err
+	}
+	if err := cfg.RiskRules.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Residency.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Retention.validate(); err != nil {
+		return err
+	}
+	if err := cfg.SellerPayouts.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Loyalty.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Invoices.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Billing.validate(); err != nil {
+		return err
+	}
+	if err := cfg.BillingPortal.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Quotes.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Surcharges.validate(); err != nil {
+		return err
+	}
+	if err := cfg.AuthorizationHolds.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Rounding.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Shadow.validate(); err != nil {
+		return err
+	}
+	if err := cfg.APIVersionShadow.validate(); err != nil {
+		return err
+	}
+	if err := cfg.ProviderRouting.validate(); err != nil {
+		return err
+	}
+	if err := cfg.SLOs.validate(); err != nil {
+		return err
+	}
+	if err := cfg.APIKeyQuotas.validate(); err != nil {
+		return err
+	}
+	if err := cfg.OAuth2.validate(); err != nil {
+		return err
+	}
+	if err := cfg.TenantLimits.validate(); err != nil {
+		return err
+	}
+	if err := cfg.LifecycleHooks.validate(); err != nil {
+		return err
+	}
+	for _, h := range cfg.DisputeReminderHours {
+		if h <= 0 {
+			return fmt.Errorf("dispute_reminder_hours must be positive")
+		}
+	}
+	if cfg.RateLimit.RequestsPerSecond < 0 || cfg.RateLimit.Burst < 0 {
+		return fmt.Errorf("rate_limit values must not be negative")
+	}
+	return nil
+}
+
+// RuntimeSettings owns the live RuntimeConfig and everything derived from
+// it that must be rebuilt on reload.
+type RuntimeSettings struct {
+	path    string
+	current atomic.Pointer[RuntimeConfig]
+	limiter atomic.Pointer[ipRateLimiter]
+
+	reloadMu sync.Mutex
+	hooks    []func() error
+}
+
+// LoadRuntimeSettings reads path, or uses environment defaults when path
+// is empty (in which case reloads only rerun the hooks).
+func LoadRuntimeSettings(path string) (*RuntimeSettings, error) {
+	s := &RuntimeSettings{path: path}
+	cfg, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	s.apply(cfg)
+	return s, nil
+}
+
+func (s *RuntimeSettings) read() (*RuntimeConfig, error) {
+	cfg := defaultRuntimeConfig()
+	if s.path == "" {
+		return cfg, nil
+	}
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("reading RUNTIME_CONFIG_FILE: %w", err)
+	}
+	if err := json.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("parsing RUNTIME_CONFIG_FILE: %w", err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (s *RuntimeSettings) apply(cfg *RuntimeConfig) {
+	s.current.Store(cfg)
+	s.limiter.Store(newIPRateLimiter(cfg.RateLimit))
+}
+
+// Get returns the config in effect. Callers must not modify it.
+func (s *RuntimeSettings) Get() *RuntimeConfig {
+	return s.current.Load()
+}
+
+// OnReload registers a hook that runs after the config is swapped, for
+// other reloadable state such as the feature flag file.
+func (s *RuntimeSettings) OnReload(hook func() error) {
+	s.hooks = append(s.hooks, hook)
+}
+
+// Reload rereads the config. An invalid file leaves the old config in
+// place.
+func (s *RuntimeSettings) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	cfg, err := s.read()
+	if err != nil {
+		return err
+	}
+	s.apply(cfg)
+	for _, hook := range s.hooks {
+		if err := hook(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReloadOnSIGHUP reloads whenever the process receives SIGHUP.
+func (s *RuntimeSettings) ReloadOnSIGHUP() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			if err := s.Reload(); err != nil {
+				log.Printf("Reloading runtime config: %v", err)
+				continue
+			}
+			log.Println("Runtime config reloaded")
+		}
+	}()
+}
+
+// CORS applies the configured allowed origins.
+func (s *RuntimeSettings) CORS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		for _, allowed := range s.Get().CORSOrigins {
+			if allowed == "*" {
+				c.Header("Access-Control-Allow-Origin", "*")
+				break
+			}
+			if origin != "" && strings.EqualFold(origin, allowed) {
+				c.Header("Access-Control-Allow-Origin", origin)
+				c.Header("Vary", "Origin")
+				break
+			}
+		}
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID, X-Dry-Run, Idempotency-Key, API-Version, If-None-Match")
+		c.Header("Access-Control-Expose-Headers", "X-Request-ID, ETag, API-Version")
+
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(204)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// rateLimitExempt routes are never throttled: probes, and Stripe, whose
+// deliveries arrive from a handful of IPs.
+var rateLimitExempt = map[string]bool{"/health": true, "/readyz": true, "/webhook": true}
+
+// RateLimit enforces the configured per-IP limit.
+func (s *RuntimeSettings) RateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rateLimitExempt[c.FullPath()] {
+			c.Next()
+			return
+		}
+		if l := s.limiter.Load(); l != nil && !l.allow(c.ClientIP()) {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, errorBody(c, CodeRateLimited, "Rate limit exceeded"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// ipRateLimiter holds a token bucket per client IP. Buckets idle for a few
+// minutes are dropped so the map doesn't grow without bound.
+type ipRateLimiter struct {
+	limit rate.Limit
+	burst int
+	idle  time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*ipBucket
+	swept   time.Time
+}
+
+type ipBucket struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+const rateLimitIdle = 5 * time.Minute
+
+func newIPRateLimiter(cfg RateLimitConfig) *ipRateLimiter {
+	if cfg.RequestsPerSecond == 0 {
+		return nil
+	}
+	burst := cfg.Burst
+	if burst == 0 {
+		burst = int(cfg.RequestsPerSecond) + 1
+	}
+	return &ipRateLimiter{
+		limit:   rate.Limit(cfg.RequestsPerSecond),
+		burst:   burst,
+		idle:    rateLimitIdle,
+		buckets: map[string]*ipBucket{},
+		swept:   time.Now(),
+	}
+}
+
+func (l *ipRateLimiter) allow(ip string) bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bucket(ip, now).limiter.AllowN(now, 1)
+}
+
+// retryAfter is how long until ip has a token again, without taking one;
+// 0 if it has one now.
+func (l *ipRateLimiter) retryAfter(ip string) time.Duration {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tokens := l.bucket(ip, now).limiter.TokensAt(now)
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / float64(l.limit) * float64(time.Second))
+}
+
+// bucket must be called with mu held.
+func (l *ipRateLimiter) bucket(ip string, now time.Time) *ipBucket {
+	if now.Sub(l.swept) > l.idle {
+		for k, b := range l.buckets {
+			if now.Sub(b.seen) > l.idle {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &ipBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[ip] = b
+	}
+	b.seen = now
+	return b
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/customer"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"github.com/stripe/stripe-go/v76/paymentmethod"
+	"github.com/stripe/stripe-go/v76/refund"
+	"github.com/stripe/stripe-go/v76/subscription"
+)
+
+// sandboxSeedKey marks every object created by the sandbox seeder so reset
+// only touches fixtures, never hand-made test data.
+const sandboxSeedKey = "sandbox_seed"
+
+// sandboxLimit caps how many objects one seed request may create.
+const sandboxLimit = 100
+
+// sandboxStates is how each seedable payment state is produced: the Stripe
+// test card to confirm with, what to do afterwards, and the percent of
+// the amount a refund returns.
+var sandboxStates = map[string]struct {
+	card   string
+	after  string
+	refund float64
+}{
+	"requires_payment_method": {},
+	"canceled":                {after: "cancel"},
+	"succeeded":               {card: "pm_card_visa"},
+	"requires_action":         {card: "pm_card_authenticationRequired"},
+	"failed":                  {card: "pm_card_chargeDeclined"},
+	"insufficient_funds":      {card: "pm_card_chargeDeclinedInsufficientFunds"},
+	"refunded":                {card: "pm_card_visa", after: "refund", refund: 100},
+	"partially_refunded":      {card: "pm_card_visa", after: "refund", refund: 50},
+}
+
+// sandboxMode reports whether fixtures may be written: only against the
+// mock provider or Stripe test-mode keys, never live ones.
+func sandboxMode(mock *MockStripe) bool {
+	return mock != nil || strings.HasPrefix(stripe.Key, "sk_test_") || strings.HasPrefix(stripe.Key, "rk_test_")
+}
+
+// Sandbox seeds and resets QA fixtures: customers with saved cards and
+// payments in chosen states. It also manages Stripe test clocks, so
+// subscription renewals and dunning can be fast-forwarded.
+type Sandbox struct {
+	Store    *Store
+	Payments PaymentRepository
+	Mock     *MockStripe
+}
+
+func (s *Sandbox) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/sandbox", s.guard, requireScope(s.Store, bootstrapToken, "admin"))
+	g.POST("/seed", s.seed)
+	g.POST("/reset", s.reset)
+	g.POST("/test-clocks", s.createTestClock)
+	g.GET("/test-clocks", s.listTestClocks)
+	g.GET("/test-clocks/:id", s.getTestClock)
+	g.POST("/test-clocks/:id/advance", s.advanceTestClock)
+	g.DELETE("/test-clocks/:id", s.deleteTestClock)
+}
+
+func (s *Sandbox) guard(c *gin.Context) {
+	if !sandboxMode(s.Mock) {
+		c.AbortWithStatusJSON(http.StatusForbidden, errorBody(c, CodeForbidden, "Sandbox endpoints require Stripe test keys or PAYMENT_PROVIDER=mock"))
+		return
+	}
+	c.Next()
+}
+
+type SandboxPayments struct {
+	State    string `json:"state" binding:"required"`
+	Count    int    `json:"count" binding:"omitempty,gte=0"`
+	Amount   int64  `json:"amount" binding:"omitempty,gt=0"`
+	Currency string `json:"currency" binding:"omitempty,len=3"`
+}
+
+type SandboxSeedRequest struct {
+	TenantID         string            `json:"tenant_id"`
+	Customers        int               `json:"customers" binding:"gte=0"`
+	CardsPerCustomer int               `json:"cards_per_customer" binding:"gte=0"`
+	Payments         []SandboxPayments `json:"payments" binding:"dive"`
+	// TestClock puts the seeded customers, and so their subscriptions, on
+	// a test clock.
+	TestClock string `json:"test_clock"`
+	// SubscriptionPrice subscribes each seeded customer to a Stripe price,
+	// after TrialDays of trial. It needs Stripe test keys.
+	SubscriptionPrice string `json:"subscription_price"`
+	TrialDays         int64  `json:"trial_days" binding:"gte=0,lte=730"`
+}
+
+type seededCustomer struct {
+	ID             string   `json:"id"`
+	Email          string   `json:"email"`
+	UserID         string   `json:"user_id"`
+	PaymentMethods []string `json:"payment_methods"`
+	SubscriptionID string   `json:"subscription_id,omitempty"`
+}
+
+type seededPayment struct {
+	ID     string `json:"id"`
+	State  string `json:"state"`
+	Status string `json:"status"`
+	Amount int64  `json:"amount"`
+}
+
+// seed creates the requested fixtures. Payments are spread round-robin
+// over the seeded customers and copied to the local store.
+func (s *Sandbox) seed(c *gin.Context) {
+	req := SandboxSeedRequest{Customers: 1, CardsPerCustomer: 1}
+	if c.Request.ContentLength > 0 {
+		if !bindJSON(c, &req) {
+			return
+		}
+	}
+	if req.SubscriptionPrice != "" && s.Mock != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "subscription_price needs Stripe test keys; the mock provider has no subscriptions"))
+		return
+	}
+	total := req.Customers * (1 + req.CardsPerCustomer)
+	if req.SubscriptionPrice != "" {
+		total += req.Customers
+	}
+	for i, p := range req.Payments {
+		if _, ok := sandboxStates[p.State]; !ok {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, fmt.Sprintf("payments[%d]: unknown state %q", i, p.State)))
+			return
+		}
+		total += p.Count
+	}
+	if total > sandboxLimit {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, fmt.Sprintf("Seed would create %d objects; the limit is %d", total, sandboxLimit)))
+		return
+	}
+
+	ctx := c.Request.Context()
+	tenant := req.TenantID
+	if tenant == "" {
+		tenant = "sandbox"
+	}
+
+	customers := []seededCustomer{}
+	for i := 0; i < req.Customers; i++ {
+		cust, err := s.seedCustomer(ctx, tenant, i+1, req)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		customers = append(customers, cust)
+	}
+
+	payments := []seededPayment{}
+	for _, spec := range req.Payments {
+		if spec.Amount == 0 {
+			spec.Amount = 2000
+		}
+		if spec.Currency == "" {
+			spec.Currency = "usd"
+		}
+		for i := 0; i < spec.Count; i++ {
+			var customerID string
+			if len(customers) > 0 {
+				customerID = customers[len(payments)%len(customers)].ID
+			}
+			pi, err := s.seedPayment(ctx, tenant, customerID, spec)
+			if err != nil {
+				respondError(c, err)
+				return
+			}
+			payments = append(payments, seededPayment{ID: pi.ID, State: spec.State, Status: string(pi.Status), Amount: pi.Amount})
+		}
+	}
+
+	logf(ctx, "Sandbox seeded %d customers and %d payments for tenant %s", len(customers), len(payments), tenant)
+	respondData(c, http.StatusCreated, gin.H{"tenant_id": tenant, "customers": customers, "payments": payments})
+}
+
+func (s *Sandbox) seedCustomer(ctx context.Context, tenant string, n int, req SandboxSeedRequest) (seededCustomer, error) {
+	userID := fmt.Sprintf("%s-user-%d", tenant, n)
+	params := &stripe.CustomerParams{
+		Email: stripe.String(fmt.Sprintf("%s+%d@example.com", tenant, n)),
+		Name:  stripe.String(fmt.Sprintf("Sandbox Customer %d", n)),
+	}
+	params.Context = ctx
+	if req.TestClock != "" {
+		params.TestClock = stripe.String(req.TestClock)
+	}
+	params.AddMetadata(sandboxSeedKey, "true")
+	params.AddMetadata("tenant_id", tenant)
+	params.AddMetadata("user_id", userID)
+
+	cust, err := customer.New(params)
+	if err != nil {
+		return seededCustomer{}, err
+	}
+	seeded := seededCustomer{ID: cust.ID, Email: cust.Email, UserID: userID, PaymentMethods: []string{}}
+
+	tokens := []string{"pm_card_visa", "pm_card_mastercard", "pm_card_amex"}
+	for i := 0; i < req.CardsPerCustomer; i++ {
+		attach := &stripe.PaymentMethodAttachParams{Customer: stripe.String(cust.ID)}
+		attach.Context = ctx
+		pm, err := paymentmethod.Attach(tokens[i%len(tokens)], attach)
+		if err != nil {
+			return seededCustomer{}, err
+		}
+		seeded.PaymentMethods = append(seeded.PaymentMethods, pm.ID)
+	}
+
+	if len(seeded.PaymentMethods) > 0 {
+		update := &stripe.CustomerParams{InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(seeded.PaymentMethods[0]),
+		}}
+		update.Context = ctx
+		if _, err := customer.Update(cust.ID, update); err != nil {
+			return seededCustomer{}, err
+		}
+	}
+
+	if req.SubscriptionPrice != "" {
+		sp := &stripe.SubscriptionParams{
+			Customer: stripe.String(cust.ID),
+			Items:    []*stripe.SubscriptionItemsParams{{Price: stripe.String(req.SubscriptionPrice)}},
+		}
+		sp.Context = ctx
+		if req.TrialDays > 0 {
+			sp.TrialPeriodDays = stripe.Int64(req.TrialDays)
+		}
+		sp.AddMetadata(sandboxSeedKey, "true")
+		sp.AddMetadata("tenant_id", tenant)
+		sub, err := subscription.New(sp)
+		if err != nil {
+			return seededCustomer{}, err
+		}
+		seeded.SubscriptionID = sub.ID
+	}
+	return seeded, nil
+}
+
+// seedPayment drives one intent to spec.State. Declines are the point for
+// some states, so card errors from confirm are expected and swallowed.
+func (s *Sandbox) seedPayment(ctx context.Context, tenant, customerID string, spec SandboxPayments) (*stripe.PaymentIntent, error) {
+	state := sandboxStates[spec.State]
+
+	params := &stripe.PaymentIntentParams{
+		Amount:             stripe.Int64(spec.Amount),
+		Currency:           stripe.String(strings.ToLower(spec.Currency)),
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+		Description:        stripe.String("Sandbox " + spec.State),
+	}
+	params.Context = ctx
+	if customerID != "" {
+		params.Customer = stripe.String(customerID)
+	}
+	params.AddMetadata(sandboxSeedKey, "true")
+	params.AddMetadata("tenant_id", tenant)
+	if id := requestIDFrom(ctx); id != "" {
+		params.AddMetadata("request_id", id)
+	}
+
+	pi, err := paymentintent.New(params)
+	if err != nil {
+		return nil, err
+	}
+
+	if state.card != "" {
+		confirm := &stripe.PaymentIntentConfirmParams{
+			PaymentMethod: stripe.String(state.card),
+			ReturnURL:     stripe.String("https://example.com/sandbox/return"),
+		}
+		confirm.Context = ctx
+		confirmed, err := paymentintent.Confirm(pi.ID, confirm)
+		var se *stripe.Error
+		switch {
+		case err == nil:
+			pi = confirmed
+		case errors.As(err, &se) && se.Type == stripe.ErrorTypeCard:
+			if pi, err = paymentintent.Get(pi.ID, &stripe.PaymentIntentParams{Params: stripe.Params{Context: ctx}}); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, err
+		}
+	}
+
+	switch state.after {
+	case "cancel":
+		cancel := &stripe.PaymentIntentCancelParams{}
+		cancel.Context = ctx
+		if pi, err = paymentintent.Cancel(pi.ID, cancel); err != nil {
+			return nil, err
+		}
+	case "refund":
+		rp := &stripe.RefundParams{
+			PaymentIntent: stripe.String(pi.ID),
+			Amount:        stripe.Int64(percentOf(pi.Amount, state.refund, roundDown)),
+		}
+		rp.Context = ctx
+		rp.AddMetadata(sandboxSeedKey, "true")
+		if _, err := refund.New(rp); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Payments != nil {
+		if err := s.Payments.SavePayment(ctx, pi); err != nil {
+			logf(ctx, "Sandbox: saving %s locally: %v", pi.ID, err)
+		}
+	}
+	return pi, nil
+}
+
+// reset removes seeded fixtures. The mock is wiped outright; in Stripe
+// test mode seeded customers are deleted and open seeded intents
+// cancelled, since payments can't be deleted there. Stripe's search index
+// lags writes by up to a minute, so very fresh fixtures may survive.
+func (s *Sandbox) reset(c *gin.Context) {
+	var req struct {
+		TenantID string `json:"tenant_id"`
+	}
+	if c.Request.ContentLength > 0 {
+		if !bindJSON(c, &req) {
+			return
+		}
+	}
+	ctx := c.Request.Context()
+
+	query := "metadata['" + sandboxSeedKey + "']:'true'"
+	if req.TenantID != "" {
+		query += " AND metadata['tenant_id']:'" + strings.ReplaceAll(req.TenantID, "'", `\'`) + "'"
+	}
+
+	var paymentIDs []string
+	cancelled := 0
+	intents := paymentintent.Search(&stripe.PaymentIntentSearchParams{
+		SearchParams: stripe.SearchParams{Query: query, Context: ctx},
+	})
+	for intents.Next() {
+		pi := intents.PaymentIntent()
+		paymentIDs = append(paymentIDs, pi.ID)
+		if s.Mock != nil {
+			continue
+		}
+		switch pi.Status {
+		case stripe.PaymentIntentStatusSucceeded, stripe.PaymentIntentStatusCanceled, stripe.PaymentIntentStatusProcessing:
+			continue
+		}
+		cancel := &stripe.PaymentIntentCancelParams{}
+		cancel.Context = ctx
+		if _, err := paymentintent.Cancel(pi.ID, cancel); err != nil {
+			respondError(c, err)
+			return
+		}
+		cancelled++
+	}
+	if err := intents.Err(); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	deleted := 0
+	if s.Mock != nil {
+		s.Mock.Reset()
+	} else {
+		customers := customer.Search(&stripe.CustomerSearchParams{
+			SearchParams: stripe.SearchParams{Query: query, Context: ctx},
+		})
+		for customers.Next() {
+			del := &stripe.CustomerParams{}
+			del.Context = ctx
+			if _, err := customer.Del(customers.Customer().ID, del); err != nil {
+				respondError(c, err)
+				return
+			}
+			deleted++
+		}
+		if err := customers.Err(); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+
+	var removed int64
+	if s.Store != nil && len(paymentIDs) > 0 {
+		var err error
+		if removed, err = s.Store.DeletePayments(ctx, paymentIDs); err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+	}
+
+	logf(ctx, "Sandbox reset: %d payments found, %d cancelled, %d customers deleted, %d local rows removed",
+		len(paymentIDs), cancelled, deleted, removed)
+	respondData(c, http.StatusOK, gin.H{
+		"payments_found":      len(paymentIDs),
+		"payments_cancelled":  cancelled,
+		"customers_deleted":   deleted,
+		"local_rows_removed":  removed,
+		"mock_provider_wiped": s.Mock != nil,
+	})
+}
+
+// DeletePayments removes payments and their refunds from the local store.
+func (s *Store) DeletePayments(ctx context.Context, ids []string) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM refunds WHERE payment_id = ANY($1)`, ids); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM payments WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
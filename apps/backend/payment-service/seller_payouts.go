@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/account"
+	"github.com/stripe/stripe-go/v76/balance"
+	"github.com/stripe/stripe-go/v76/payout"
+)
+
+var sellerPayouts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_seller_payouts_total",
+	Help: "On-demand seller payouts by method and outcome (created, refused).",
+}, []string{"method", "outcome"})
+
+// sellerPayoutMinimum is the smallest on-demand payout, in minor units, in
+// currencies without a configured minimum.
+const sellerPayoutMinimum = 100
+
+// SellerPayoutConfig bounds on-demand payouts. Minimums are per currency,
+// in minor units; currencies not listed use 100.
+type SellerPayoutConfig struct {
+	Minimums map[string]int64 `json:"minimums"`
+}
+
+func (cfg SellerPayoutConfig) validate() error {
+	for currency, min := range cfg.Minimums {
+		if min < 0 {
+			return fmt.Errorf("seller_payouts: minimums.%s must not be negative", currency)
+		}
+	}
+	return nil
+}
+
+func (cfg SellerPayoutConfig) minimum(currency string) int64 {
+	if min, ok := cfg.Minimums[strings.ToLower(currency)]; ok {
+		return min
+	}
+	return sellerPayoutMinimum
+}
+
+// PayoutSchedule is when Stripe pays out a seller's available balance on
+// its own. Interval manual leaves it to on-demand payouts.
+type PayoutSchedule struct {
+	Interval      string `json:"interval"`
+	WeeklyAnchor  string `json:"weekly_anchor,omitempty"`
+	MonthlyAnchor int64  `json:"monthly_anchor,omitempty"`
+	DelayDays     int64  `json:"delay_days"`
+}
+
+// Seller payout audit actions.
+const (
+	payoutCreated         = "payout_created"
+	payoutRefused         = "payout_refused"
+	payoutScheduleUpdated = "schedule_updated"
+)
+
+// SellerPayoutAudit is one entry in the audit log of seller payouts: an
+// on-demand payout made or refused, or a schedule change. Reason is why a
+// payout was refused.
+type SellerPayoutAudit struct {
+	ID        string          `json:"id"`
+	AccountID string          `json:"account_id"`
+	TenantID  string          `json:"tenant_id,omitempty"`
+	SellerID  string          `json:"seller_id,omitempty"`
+	Action    string          `json:"action"`
+	PayoutID  string          `json:"payout_id,omitempty"`
+	Amount    int64           `json:"amount,omitempty"`
+	Currency  string          `json:"currency,omitempty"`
+	Method    string          `json:"method,omitempty"`
+	Schedule  *PayoutSchedule `json:"schedule,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+	Actor     string          `json:"actor,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+var sellerPayoutAuditList = listResource{
+	from: "seller_payout_audit a",
+	fields: []string{"id", "account_id", "tenant_id", "seller_id", "action", "payout_id", "amount", "currency",
+		"method", "reason", "actor", "request_id", "created_at"},
+	columns: map[string]listField{
+		"id":         {"a.id", textField},
+		"account_id": {"a.account_id", textField},
+		"tenant_id":  {"a.tenant_id", textField},
+		"seller_id":  {"a.seller_id", textField},
+		"action":     {"a.action", textField},
+		"payout_id":  {"a.payout_id", textField},
+		"amount":     {"a.amount", intField},
+		"currency":   {"a.currency", textField},
+		"method":     {"a.method", textField},
+		"reason":     {"a.reason", textField},
+		"actor":      {"a.actor", textField},
+		"request_id": {"a.request_id", textField},
+		"created_at": {"a.created_at", timeField},
+	},
+}
+
+// RecordSellerPayoutAudit adds e to the audit log. A payout is logged as
+// created once, however often its Idempotency-Key is replayed.
+func (s *Store) RecordSellerPayoutAudit(ctx context.Context, e *SellerPayoutAudit) error {
+	var schedule []byte
+	if e.Schedule != nil {
+		var err error
+		if schedule, err = json.Marshal(e.Schedule); err != nil {
+			return err
+		}
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO seller_payout_audit (id, account_id, tenant_id, seller_id, action, payout_id, amount, currency,
+			method, schedule, reason, actor, request_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (payout_id) WHERE action = 'payout_created' DO NOTHING`,
+		e.ID, e.AccountID, e.TenantID, e.SellerID, e.Action, e.PayoutID, e.Amount, e.Currency, e.Method,
+		schedule, e.Reason, e.Actor, e.RequestID)
+	return err
+}
+
+// SellerPayouts sets sellers' payout schedules and makes on-demand payouts
+// from their connected accounts' balances, keeping an audit log of both.
+type SellerPayouts struct {
+	store    *Store
+	settings *RuntimeSettings
+	connect  *Connect
+}
+
+func NewSellerPayouts(store *Store, settings *RuntimeSettings, connect *Connect) *SellerPayouts {
+	return &SellerPayouts{store: store, settings: settings, connect: connect}
+}
+
+// RegisterRoutes mounts seller payouts under the connect scope.
+func (sp *SellerPayouts) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	auth := requireScope(sp.store, bootstrapToken, connectScope)
+	g := r.Group("/sellers/:id", auth, sp.connect.requireStore)
+	g.GET("/payout-schedule", sp.schedule)
+	g.PUT("/payout-schedule", sp.updateSchedule)
+	g.GET("/balance", sp.balance)
+	g.POST("/payouts", sp.create)
+
+	r.GET("/connect/payout-audit", auth, sp.connect.requireStore, listHandler(sp.store, sellerPayoutAuditList))
+}
+
+func newSellerPayoutAudit(c *gin.Context, a *ConnectedAccount, action string) *SellerPayoutAudit {
+	return &SellerPayoutAudit{
+		ID:        "spa_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		AccountID: a.ID,
+		TenantID:  a.TenantID,
+		SellerID:  a.SellerID,
+		Action:    action,
+		Actor:     c.GetString("api_key_id"),
+		RequestID: requestIDFrom(c.Request.Context()),
+	}
+}
+
+// audit records e. What it records has already happened at Stripe, so a
+// failure is logged rather than failing the request.
+func (sp *SellerPayouts) audit(ctx context.Context, e *SellerPayoutAudit) {
+	if err := sp.store.RecordSellerPayoutAudit(ctx, e); err != nil {
+		logf(ctx, "recording seller payout audit for %s: %v", e.AccountID, err)
+	}
+}
+
+func (sp *SellerPayouts) schedule(c *gin.Context) {
+	a, ok := sellerAccount(c, sp.store)
+	if !ok {
+		return
+	}
+	respondData(c, http.StatusOK, gin.H{"account_id": a.ID, "payout_schedule": a.PayoutSchedule})
+}
+
+// updateSchedule sets when Stripe pays the seller out on its own. Weekly
+// schedules need a weekly_anchor and monthly ones a monthly_anchor;
+// without delay_days the account keeps its current delay.
+func (sp *SellerPayouts) updateSchedule(c *gin.Context) {
+	var req struct {
+		Interval      string `json:"interval" binding:"required,oneof=daily weekly monthly manual"`
+		WeeklyAnchor  string `json:"weekly_anchor" binding:"omitempty,oneof=monday tuesday wednesday thursday friday saturday sunday"`
+		MonthlyAnchor int64  `json:"monthly_anchor" binding:"omitempty,min=1,max=31"`
+		DelayDays     *int64 `json:"delay_days" binding:"omitempty,min=0,max=365"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	switch {
+	case req.Interval == "weekly" && req.WeeklyAnchor == "":
+		validationFailed(c, []FieldError{{Field: "weekly_anchor", Code: "required", Message: "required for weekly payouts"}})
+		return
+	case req.Interval == "monthly" && req.MonthlyAnchor == 0:
+		validationFailed(c, []FieldError{{Field: "monthly_anchor", Code: "required", Message: "required for monthly payouts"}})
+		return
+	}
+	a, ok := sellerAccount(c, sp.store)
+	if !ok {
+		return
+	}
+
+	schedule := &stripe.AccountSettingsPayoutsScheduleParams{Interval: stripe.String(req.Interval), DelayDays: req.DelayDays}
+	if req.Interval == "weekly" {
+		schedule.WeeklyAnchor = stripe.String(req.WeeklyAnchor)
+	}
+	if req.Interval == "monthly" {
+		schedule.MonthlyAnchor = stripe.Int64(req.MonthlyAnchor)
+	}
+	params := &stripe.AccountParams{
+		Settings: &stripe.AccountSettingsParams{Payouts: &stripe.AccountSettingsPayoutsParams{Schedule: schedule}},
+	}
+	params.Context = c.Request.Context()
+	acct, err := account.Update(a.ID, params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	ctx := context.WithoutCancel(c.Request.Context())
+	saved, err := sp.connect.save(ctx, acct)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	e := newSellerPayoutAudit(c, saved, payoutScheduleUpdated)
+	e.Schedule = saved.PayoutSchedule
+	sp.audit(ctx, e)
+	respondData(c, http.StatusOK, gin.H{"account_id": saved.ID, "payout_schedule": saved.PayoutSchedule})
+}
+
+// sellerBalance is a connected account's balance, by currency.
+func sellerBalance(ctx context.Context, accountID string) (*stripe.Balance, error) {
+	params := &stripe.BalanceParams{}
+	params.Context = ctx
+	params.SetStripeAccount(accountID)
+	return balance.Get(params)
+}
+
+// payable is what can be paid out of available once held is kept back.
+// Holds may cover pending funds, but are taken from what is available now
+// so nothing held is paid out before it clears.
+func payable(available, held int64) int64 {
+	if available <= held {
+		return 0
+	}
+	return available - held
+}
+
+// balanceAmount is amounts' value in currency, zero if it has none.
+func balanceAmount(amounts []*stripe.Amount, currency string) int64 {
+	for _, a := range amounts {
+		if strings.EqualFold(string(a.Currency), currency) {
+			return a.Amount
+		}
+	}
+	return 0
+}
+
+// balance answers with the seller's balance per currency, what holds keep
+// back from it, and what they could pay out now.
+func (sp *SellerPayouts) balance(c *gin.Context) {
+	a, ok := sellerAccount(c, sp.store)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	b, err := sellerBalance(ctx, a.ID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	held, err := sp.store.HeldBalances(ctx, a.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	amounts := func(in []*stripe.Amount, net bool) []gin.H {
+		out := []gin.H{}
+		for _, am := range in {
+			amount := am.Amount
+			if net {
+				amount = payable(amount, held[string(am.Currency)])
+			}
+			out = append(out, gin.H{"amount": amount, "currency": am.Currency})
+		}
+		return out
+	}
+	heldOut := []gin.H{}
+	for currency, amount := range held {
+		heldOut = append(heldOut, gin.H{"amount": amount, "currency": currency})
+	}
+	respondData(c, http.StatusOK, gin.H{
+		"account_id":        a.ID,
+		"available":         amounts(b.Available, false),
+		"instant_available": amounts(b.InstantAvailable, false),
+		"pending":           amounts(b.Pending, false),
+		"held":              heldOut,
+		"payable":           amounts(b.Available, true),
+		"instant_payable":   amounts(b.InstantAvailable, true),
+	})
+}
+
+// create pays out part of the seller's available balance now. Instant
+// payouts draw on the instant-available balance and arrive within
+// minutes, for a fee Stripe takes from the seller. Payouts below the
+// currency's minimum, beyond the balance less any holds, or from accounts
+// with payouts disabled are refused; every attempt is audited.
+func (sp *SellerPayouts) create(c *gin.Context) {
+	var req struct {
+		Amount      int64  `json:"amount" binding:"required,min=1"`
+		Currency    string `json:"currency" binding:"required,len=3"`
+		Method      string `json:"method" binding:"omitempty,oneof=standard instant"`
+		Description string `json:"description" binding:"max=200"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.Method == "" {
+		req.Method = string(stripe.PayoutMethodStandard)
+	}
+	req.Currency = strings.ToLower(req.Currency)
+	a, ok := sellerAccount(c, sp.store)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	e := newSellerPayoutAudit(c, a, payoutRefused)
+	e.Amount, e.Currency, e.Method = req.Amount, req.Currency, req.Method
+	refuse := func(status int, code ErrorCode, message string, ext gin.H) {
+		e.Reason = string(code)
+		sp.audit(context.WithoutCancel(ctx), e)
+		sellerPayouts.WithLabelValues(req.Method, "refused").Inc()
+		c.JSON(status, errorBodyWith(c, code, message, ext))
+	}
+
+	if !a.PayoutsEnabled {
+		refuse(http.StatusConflict, CodePayoutsDisabled, "Payouts are disabled for this seller's account",
+			gin.H{"requirements": a.Requirements})
+		return
+	}
+	if min := sp.settings.Get().SellerPayouts.minimum(req.Currency); req.Amount < min {
+		refuse(http.StatusUnprocessableEntity, CodeAmountBelowMinimum,
+			fmt.Sprintf("Amount is below the %d %s minimum", min, req.Currency), gin.H{"limit": min, "currency": req.Currency})
+		return
+	}
+	b, err := sellerBalance(ctx, a.ID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	held, err := sp.store.HeldBalances(ctx, a.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	available := balanceAmount(b.Available, req.Currency)
+	if req.Method == string(stripe.PayoutMethodInstant) {
+		available = balanceAmount(b.InstantAvailable, req.Currency)
+	}
+	if req.Amount > payable(available, held[req.Currency]) {
+		refuse(http.StatusUnprocessableEntity, CodeInsufficientBalance, "Balance is too low for this payout",
+			gin.H{"balance": payable(available, held[req.Currency]), "held": held[req.Currency], "currency": req.Currency})
+		return
+	}
+
+	params := &stripe.PayoutParams{
+		Amount:   stripe.Int64(req.Amount),
+		Currency: stripe.String(req.Currency),
+		Method:   stripe.String(req.Method),
+	}
+	params.Context = ctx
+	params.SetStripeAccount(a.ID)
+	if req.Description != "" {
+		params.Description = stripe.String(req.Description)
+	}
+	params.AddMetadata("requested_by", e.Actor)
+	if e.RequestID != "" {
+		params.AddMetadata("request_id", e.RequestID)
+	}
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		params.SetIdempotencyKey(key)
+	}
+	po, err := payout.New(params)
+	if err != nil {
+		var se *stripe.Error
+		if errors.As(err, &se) {
+			e.Reason = string(se.Code)
+			if e.Reason == "" {
+				e.Reason = se.Msg
+			}
+			sp.audit(context.WithoutCancel(ctx), e)
+			sellerPayouts.WithLabelValues(req.Method, "refused").Inc()
+		}
+		respondError(c, err)
+		return
+	}
+
+	e.Action, e.PayoutID = payoutCreated, po.ID
+	sp.audit(context.WithoutCancel(ctx), e)
+	sellerPayouts.WithLabelValues(req.Method, "created").Inc()
+	respondData(c, http.StatusCreated, gin.H{
+		"id":           po.ID,
+		"account_id":   a.ID,
+		"amount":       po.Amount,
+		"currency":     po.Currency,
+		"method":       po.Method,
+		"status":       po.Status,
+		"arrival_date": time.Unix(po.ArrivalDate, 0).UTC(),
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/netutil"
+)
+
+var (
+	httpConnectionsOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "payment_service_http_connections_open",
+		Help: "Client connections currently open.",
+	})
+	httpConnectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "payment_service_http_connections_total",
+		Help: "Client connections accepted.",
+	})
+	httpConnectionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "payment_service_http_connection_duration_seconds",
+		Help:    "How long client connections stayed open.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 9),
+	})
+	httpRequestsByProtocol = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_http_requests_total",
+		Help: "Requests served, by protocol (HTTP/1.1, HTTP/2.0).",
+	}, []string{"protocol"})
+)
+
+// ServerConfig holds the HTTP server limits. The defaults are tight enough
+// that a client trickling headers or bodies can't hold a connection open
+// for long, while long-lived streams lift the write deadline themselves.
+type ServerConfig struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// MaxConnections caps concurrently open connections; 0 is unlimited.
+	MaxConnections int
+	ShutdownGrace  time.Duration
+
+	// KeepAlives reuses HTTP/1.1 connections between requests.
+	KeepAlives bool
+	// TCPKeepAlive is the interval of TCP keep-alive probes on idle
+	// connections; negative disables them.
+	TCPKeepAlive time.Duration
+
+	// TLSCertFile and TLSKeyFile serve HTTPS, which negotiates h2 with
+	// clients that offer it. Without them, H2C accepts cleartext HTTP/2
+	// from internal callers such as the gateway, alongside HTTP/1.1.
+	TLSCertFile string
+	TLSKeyFile  string
+	H2C         bool
+	// MaxConcurrentStreams caps requests multiplexed on one HTTP/2
+	// connection.
+	MaxConcurrentStreams uint32
+}
+
+func serverConfigFromEnv() ServerConfig {
+	return ServerConfig{
+		ReadTimeout:       envDuration("HTTP_READ_TIMEOUT", 15*time.Second),
+		ReadHeaderTimeout: envDuration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		WriteTimeout:      envDuration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       envDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:    envInt("HTTP_MAX_HEADER_BYTES", 1<<20),
+		MaxConnections:    envInt("HTTP_MAX_CONNECTIONS", 0),
+		ShutdownGrace:     envDuration("SHUTDOWN_GRACE_PERIOD", 30*time.Second),
+
+		KeepAlives:           os.Getenv("HTTP_KEEPALIVES") != "false",
+		TCPKeepAlive:         envDuration("HTTP_TCP_KEEPALIVE", 30*time.Second),
+		TLSCertFile:          os.Getenv("HTTP_TLS_CERT_FILE"),
+		TLSKeyFile:           os.Getenv("HTTP_TLS_KEY_FILE"),
+		H2C:                  os.Getenv("HTTP_H2C") != "false",
+		MaxConcurrentStreams: uint32(envInt("HTTP2_MAX_CONCURRENT_STREAMS", 1000)),
+	}
+}
+
+// serve runs handler on addr until SIGINT or SIGTERM, then stops accepting
+// connections and gives in-flight requests ShutdownGrace to finish.
+// beforeShutdown runs first, e.g. to leave service discovery so no new
+// traffic is routed here while draining.
+func serve(addr string, handler http.Handler, cfg ServerConfig, beforeShutdown func()) error {
+	counted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpRequestsByProtocol.WithLabelValues(r.Proto).Inc()
+		handler.ServeHTTP(w, r)
+	})
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           counted,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	srv.SetKeepAlivesEnabled(cfg.KeepAlives)
+
+	h2 := &http2.Server{
+		MaxConcurrentStreams: cfg.MaxConcurrentStreams,
+		IdleTimeout:          cfg.IdleTimeout,
+	}
+	useTLS := cfg.TLSCertFile != "" || cfg.TLSKeyFile != ""
+	if useTLS {
+		if err := http2.ConfigureServer(srv, h2); err != nil {
+			return err
+		}
+	} else if cfg.H2C {
+		srv.Handler = h2c.NewHandler(counted, h2)
+	}
+
+	lc := net.ListenConfig{KeepAlive: cfg.TCPKeepAlive}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if cfg.MaxConnections > 0 {
+		ln = netutil.LimitListener(ln, cfg.MaxConnections)
+	}
+	ln = countingListener{ln}
+
+	errs := make(chan error, 1)
+	go func() {
+		if useTLS {
+			errs <- srv.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+		} else {
+			errs <- srv.Serve(ln)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	select {
+	case err := <-errs:
+		return err
+	case s := <-sig:
+		log.Printf("Received %s, shutting down", s)
+	}
+
+	beforeShutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGrace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// countingListener tracks connections for the connection metrics. It sits
+// below TLS and h2c, so every connection counts whatever it speaks,
+// including hijacked ones such as WebSockets.
+type countingListener struct {
+	net.Listener
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	httpConnectionsTotal.Inc()
+	httpConnectionsOpen.Inc()
+	return &countedConn{Conn: conn, opened: time.Now()}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	opened time.Time
+	once   sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		httpConnectionsOpen.Dec()
+		httpConnectionDuration.Observe(time.Since(c.opened).Seconds())
+	})
+	return c.Conn.Close()
+}
+
+// disableWriteDeadline lifts the server write timeout for a streaming
+// response such as SSE or a large export.
+func disableWriteDeadline(w http.ResponseWriter) {
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("clearing write deadline: %v", err)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/balancetransaction"
+	"github.com/stripe/stripe-go/v76/payout"
+)
+
+// Match statuses of a settlement item.
+const (
+	matchMatched        = "matched"
+	matchUnmatched      = "unmatched"
+	matchAmountMismatch = "amount_mismatch"
+)
+
+// SettlementItem is one balance transaction of a payout and how it lines
+// up with our local records.
+type SettlementItem struct {
+	BalanceTransactionID string `json:"balance_transaction_id"`
+	Type                 string `json:"type"`
+	SourceID             string `json:"source_id,omitempty"`
+	PaymentID            string `json:"payment_id,omitempty"`
+	Amount               int64  `json:"amount"`
+	Fee                  int64  `json:"fee"`
+	Net                  int64  `json:"net"`
+	MatchStatus          string `json:"match_status"`
+	Note                 string `json:"note,omitempty"`
+}
+
+// SettlementReport reconciles one Stripe payout. Amounts are in the payout
+// currency; Discrepancy is the payout amount minus the net of its items and
+// should be zero.
+type SettlementReport struct {
+	PayoutID       string           `json:"payout_id"`
+	Amount         int64            `json:"amount"`
+	Currency       string           `json:"currency"`
+	Status         string           `json:"status"`
+	ArrivalDate    time.Time        `json:"arrival_date"`
+	Gross          int64            `json:"gross"`
+	Fees           int64            `json:"fees"`
+	Net            int64            `json:"net"`
+	MatchedCount   int              `json:"matched_count"`
+	UnmatchedCount int              `json:"unmatched_count"`
+	Discrepancy    int64            `json:"discrepancy"`
+	ReconciledAt   time.Time        `json:"reconciled_at"`
+	Items          []SettlementItem `json:"items,omitempty"`
+}
+
+// Reconciler matches payouts' balance transactions against the local store.
+type Reconciler struct {
+	store    *Store
+	interval time.Duration
+	lookback time.Duration
+}
+
+func NewReconciler(store *Store, interval, lookback time.Duration) *Reconciler {
+	return &Reconciler{store: store, interval: interval, lookback: lookback}
+}
+
+// Run reconciles recent paid payouts that have no report yet, then repeats
+// every interval until ctx is done.
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.reconcileRecent(ctx); err != nil {
+			log.Printf("settlement reconciliation: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reconciler) reconcileRecent(ctx context.Context) error {
+	params := &stripe.PayoutListParams{
+		Status:       stripe.String("paid"),
+		CreatedRange: &stripe.RangeQueryParams{GreaterThanOrEqual: time.Now().Add(-r.lookback).Unix()},
+	}
+	params.Context = ctx
+
+	it := payout.List(params)
+	for it.Next() {
+		po := it.Payout()
+		if _, err := r.store.SettlementReport(ctx, po.ID); err == nil {
+			continue
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if _, err := r.Reconcile(ctx, po); err != nil {
+			log.Printf("reconciling payout %s: %v", po.ID, err)
+		}
+	}
+	return it.Err()
+}
+
+// Reconcile builds and stores the report for one payout.
+func (r *Reconciler) Reconcile(ctx context.Context, po *stripe.Payout) (*SettlementReport, error) {
+	report := &SettlementReport{
+		PayoutID:     po.ID,
+		Amount:       po.Amount,
+		Currency:     string(po.Currency),
+		Status:       string(po.Status),
+		ArrivalDate:  time.Unix(po.ArrivalDate, 0).UTC(),
+		ReconciledAt: time.Now().UTC(),
+	}
+
+	params := &stripe.BalanceTransactionListParams{Payout: stripe.String(po.ID)}
+	params.Context = ctx
+	params.AddExpand("data.source")
+
+	it := balancetransaction.List(params)
+	for it.Next() {
+		bt := it.BalanceTransaction()
+		// The payout's own transaction is the total we are checking against.
+		if bt.Type == stripe.BalanceTransactionTypePayout {
+			continue
+		}
+
+		item, err := r.match(ctx, bt)
+		if err != nil {
+			return nil, err
+		}
+		report.Items = append(report.Items, item)
+		report.Gross += item.Amount
+		report.Fees += item.Fee
+		report.Net += item.Net
+		if item.MatchStatus == matchMatched {
+			report.MatchedCount++
+		} else {
+			report.UnmatchedCount++
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("listing balance transactions: %w", err)
+	}
+
+	report.Discrepancy = report.Amount - report.Net
+	if err := r.store.SaveSettlementReport(ctx, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (r *Reconciler) match(ctx context.Context, bt *stripe.BalanceTransaction) (SettlementItem, error) {
+	item := SettlementItem{
+		BalanceTransactionID: bt.ID,
+		Type:                 string(bt.Type),
+		Amount:               bt.Amount,
+		Fee:                  bt.Fee,
+		Net:                  bt.Net,
+		MatchStatus:          matchUnmatched,
+	}
+	if bt.Source == nil {
+		item.Note = "no source object"
+		return item, nil
+	}
+	item.SourceID = bt.Source.ID
+
+	switch {
+	case bt.Source.Charge != nil:
+		ch := bt.Source.Charge
+		if ch.PaymentIntent == nil {
+			item.Note = "charge has no payment intent"
+			return item, nil
+		}
+		item.PaymentID = ch.PaymentIntent.ID
+		received, found, err := r.store.paymentAmountReceived(ctx, item.PaymentID)
+		if err != nil || !found {
+			item.Note = "payment not in local store"
+			return item, err
+		}
+		item.MatchStatus, item.Note = compareAmounts(received, ch.Amount)
+
+	case bt.Source.Refund != nil:
+		rf := bt.Source.Refund
+		if rf.PaymentIntent != nil {
+			item.PaymentID = rf.PaymentIntent.ID
+		}
+		amount, found, err := r.store.refundAmount(ctx, rf.ID)
+		if err != nil || !found {
+			item.Note = "refund not in local store"
+			return item, err
+		}
+		item.MatchStatus, item.Note = compareAmounts(amount, rf.Amount)
+
+	default:
+		item.Note = fmt.Sprintf("no local record type for %s", bt.Source.Type)
+	}
+	return item, nil
+}
+
+func compareAmounts(local, provider int64) (string, string) {
+	if local != provider {
+		return matchAmountMismatch, fmt.Sprintf("local amount %d, provider amount %d", local, provider)
+	}
+	return matchMatched, ""
+}
+
+func (s *Store) paymentAmountReceived(ctx context.Context, id string) (int64, bool, error) {
+	var amount int64
+	err := s.db.QueryRowContext(ctx, `SELECT amount_received FROM payments WHERE id = $1`, id).Scan(&amount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return amount, err == nil, err
+}
+
+func (s *Store) refundAmount(ctx context.Context, id string) (int64, bool, error) {
+	var amount int64
+	err := s.db.QueryRowContext(ctx, `SELECT amount FROM refunds WHERE id = $1`, id).Scan(&amount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return amount, err == nil, err
+}
+
+// SaveSettlementReport replaces any previous report for the payout.
+func (s *Store) SaveSettlementReport(ctx context.Context, rep *SettlementReport) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM settlement_reports WHERE payout_id = $1`, rep.PayoutID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO settlement_reports (payout_id, amount, currency, status, arrival_date, gross, fees, net,
+			matched_count, unmatched_count, discrepancy, reconciled_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		rep.PayoutID, rep.Amount, rep.Currency, rep.Status, rep.ArrivalDate, rep.Gross, rep.Fees, rep.Net,
+		rep.MatchedCount, rep.UnmatchedCount, rep.Discrepancy, rep.ReconciledAt); err != nil {
+		return err
+	}
+	for _, it := range rep.Items {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO settlement_items (payout_id, balance_transaction_id, type, source_id, payment_id,
+				amount, fee, net, match_status, note)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			rep.PayoutID, it.BalanceTransactionID, it.Type, it.SourceID, it.PaymentID,
+			it.Amount, it.Fee, it.Net, it.MatchStatus, it.Note); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SettlementReport loads a stored report with its items. It returns
+// sql.ErrNoRows when the payout has not been reconciled.
+func (s *Store) SettlementReport(ctx context.Context, payoutID string) (*SettlementReport, error) {
+	rep := &SettlementReport{PayoutID: payoutID}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT amount, currency, status, arrival_date, gross, fees, net,
+			matched_count, unmatched_count, discrepancy, reconciled_at
+		FROM settlement_reports WHERE payout_id = $1`, payoutID).Scan(
+		&rep.Amount, &rep.Currency, &rep.Status, &rep.ArrivalDate, &rep.Gross, &rep.Fees, &rep.Net,
+		&rep.MatchedCount, &rep.UnmatchedCount, &rep.Discrepancy, &rep.ReconciledAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT balance_transaction_id, type, source_id, payment_id, amount, fee, net, match_status, note
+		FROM settlement_items WHERE payout_id = $1
+		ORDER BY match_status DESC, balance_transaction_id`, payoutID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var it SettlementItem
+		if err := rows.Scan(&it.BalanceTransactionID, &it.Type, &it.SourceID, &it.PaymentID,
+			&it.Amount, &it.Fee, &it.Net, &it.MatchStatus, &it.Note); err != nil {
+			return nil, err
+		}
+		rep.Items = append(rep.Items, it)
+	}
+	return rep, rows.Err()
+}
+
+// RegisterRoutes mounts the settlement report endpoint under
+// payments:read. A payout that has not been reconciled yet is reconciled
+// on demand; refresh=true forces a fresh run and needs the admin scope.
+func (r *Reconciler) RegisterRoutes(router *gin.Engine, bootstrapToken string) {
+	router.GET("/reports/settlements/:payout_id", requireScope(r.store, bootstrapToken, readPaymentsScope), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		payoutID := c.Param("payout_id")
+
+		refresh := c.Query("refresh") == "true"
+		if refresh && !hasScope(c, r.store, bootstrapToken, "admin") {
+			return
+		}
+		if !refresh {
+			rep, err := r.store.SettlementReport(ctx, payoutID)
+			if err == nil {
+				respondData(c, http.StatusOK, rep)
+				return
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+				return
+			}
+		}
+
+		params := &stripe.PayoutParams{}
+		params.Context = ctx
+		po, err := payout.Get(payoutID, params)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		rep, err := r.Reconcile(ctx, po)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, errorBody(c, CodeUpstreamFailed, err.Error()))
+			return
+		}
+		respondData(c, http.StatusOK, rep)
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+)
+
+var (
+	shadowRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_shadow_requests_total",
+		Help: "Payments mirrored to the shadow provider, by result (match, mismatch, error, dropped).",
+	}, []string{"result"})
+	shadowMismatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_shadow_mismatches_total",
+		Help: "Fields on which the shadow provider disagreed with the primary.",
+	}, []string{"field"})
+	shadowLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "payment_service_shadow_latency_seconds",
+		Help:    "Latency of mirrored payment creations, by provider (primary, shadow).",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider"})
+)
+
+// ShadowConfig samples payments to mirror to the shadow provider set up
+// with SHADOW_PROVIDER. It can be turned up or off without a restart.
+//
+//	"shadow": {"sample_rate": 0.05, "test_payment_method": "pm_card_visa"}
+type ShadowConfig struct {
+	// SampleRate is the share of payment creations mirrored, 0 to 1.
+	SampleRate float64 `json:"sample_rate"`
+	// TestPaymentMethod stands in for the customer's payment method,
+	// which only exists with the primary. Empty means pm_card_visa.
+	TestPaymentMethod string `json:"test_payment_method"`
+}
+
+func (cfg ShadowConfig) validate() error {
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return fmt.Errorf("shadow: sample_rate must be between 0 and 1")
+	}
+	if cfg.TestPaymentMethod != "" && !strings.HasPrefix(cfg.TestPaymentMethod, "pm_") {
+		return fmt.Errorf("shadow: test_payment_method must be a payment method ID")
+	}
+	return nil
+}
+
+func (cfg ShadowConfig) testPaymentMethod() string {
+	if cfg.TestPaymentMethod == "" {
+		return "pm_card_visa"
+	}
+	return cfg.TestPaymentMethod
+}
+
+// shadowBackend de-risks a provider migration by sending a sample of
+// payment creations to a second provider as well: after the primary
+// answers, the same payment is created with the shadow in the background,
+// in test mode, and the two answers and latencies are compared, logged
+// and counted. The caller only ever sees the primary's answer and waits
+// no longer for the shadow. Customers, connected accounts and payment
+// methods only exist with the primary, so the shadow gets the payment
+// without them and a test payment method in their place. Shadow intents
+// left open are canceled after the comparison.
+type shadowBackend struct {
+	stripe.Backend
+	shadow   stripe.Backend
+	key      string
+	settings *RuntimeSettings
+	timeout  time.Duration
+	// slots bounds the comparisons in flight; mirrors past it are dropped
+	// rather than queued.
+	slots chan struct{}
+}
+
+// installShadowProvider wraps the installed API backend with a shadow
+// from SHADOW_PROVIDER: "stripe" is another Stripe account, reached with
+// the test mode SHADOW_STRIPE_KEY, and "mock" the in-memory provider.
+// Empty leaves shadowing off.
+func installShadowProvider(settings *RuntimeSettings) {
+	var shadow stripe.Backend
+	var key string
+	switch provider := os.Getenv("SHADOW_PROVIDER"); provider {
+	case "":
+		return
+	case "stripe":
+		key = os.Getenv("SHADOW_STRIPE_KEY")
+		if !strings.HasPrefix(key, "sk_test_") && !strings.HasPrefix(key, "rk_test_") {
+			log.Fatal("SHADOW_PROVIDER=stripe requires a test mode SHADOW_STRIPE_KEY")
+		}
+		shadow = stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+			MaxNetworkRetries: stripe.Int64(0),
+		})
+	case "mock":
+		declines, err := parseMockDeclines(os.Getenv("MOCK_DECLINES"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		key = "sk_test_mock"
+		shadow = NewMockStripe(MockConfig{Declines: declines})
+	default:
+		log.Fatalf("Unknown SHADOW_PROVIDER %q", provider)
+	}
+	stripe.SetBackend(stripe.APIBackend, &shadowBackend{
+		Backend:  stripe.GetBackend(stripe.APIBackend),
+		shadow:   shadow,
+		key:      key,
+		settings: settings,
+		timeout:  envDuration("SHADOW_TIMEOUT", 15*time.Second),
+		slots:    make(chan struct{}, envInt("SHADOW_MAX_IN_FLIGHT", 16)),
+	})
+	log.Printf("SHADOW_PROVIDER=%s, sampled payments are mirrored to it", os.Getenv("SHADOW_PROVIDER"))
+}
+
+func (b *shadowBackend) Call(method, path, key string, params stripe.ParamsContainer, v stripe.LastResponseSetter) error {
+	p, ok := params.(*stripe.PaymentIntentParams)
+	cfg := b.settings.Get().Shadow
+	if !ok || p == nil || method != http.MethodPost || path != "/v1/payment_intents" ||
+		cfg.SampleRate <= 0 || (cfg.SampleRate < 1 && rand.Float64() >= cfg.SampleRate) {
+		return b.Backend.Call(method, path, key, params, v)
+	}
+	// Copied before the call: callers reuse their params once it returns.
+	mirror := shadowParams(p, cfg.testPaymentMethod())
+	parent := p.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	started := time.Now()
+	err := b.Backend.Call(method, path, key, params, v)
+	elapsed := time.Since(started)
+	// Read now: the caller owns the answer once the call returns.
+	primary, _ := v.(*stripe.PaymentIntent)
+	want, primaryID := shadowOutcome(primary, err), ""
+	if primary != nil {
+		primaryID = primary.ID
+	}
+
+	select {
+	case b.slots <- struct{}{}:
+		go func() {
+			defer func() { <-b.slots }()
+			ctx, cancel := context.WithTimeout(withRequestID(context.Background(), requestIDFrom(parent)), b.timeout)
+			defer cancel()
+			b.compare(ctx, mirror, primaryID, want, elapsed)
+		}()
+	default:
+		shadowRequests.WithLabelValues("dropped").Inc()
+	}
+	return err
+}
+
+// shadowParams is the payment of p as the shadow can take it.
+func shadowParams(p *stripe.PaymentIntentParams, testPaymentMethod string) *stripe.PaymentIntentParams {
+	mirror := &stripe.PaymentIntentParams{
+		Amount:                  p.Amount,
+		Currency:                p.Currency,
+		CaptureMethod:           p.CaptureMethod,
+		Confirm:                 p.Confirm,
+		Description:             p.Description,
+		PaymentMethodTypes:      append([]*string(nil), p.PaymentMethodTypes...),
+		AutomaticPaymentMethods: p.AutomaticPaymentMethods,
+		ReturnURL:               p.ReturnURL,
+	}
+	if p.PaymentMethod != nil {
+		mirror.PaymentMethod = stripe.String(testPaymentMethod)
+	}
+	if p.IdempotencyKey != nil {
+		mirror.SetIdempotencyKey("shadow-" + *p.IdempotencyKey)
+	}
+	for k, v := range p.Metadata {
+		mirror.AddMetadata(k, v)
+	}
+	mirror.AddMetadata("shadow", "true")
+	return mirror
+}
+
+// compare creates the mirrored payment with the shadow and reports how
+// its answer differs from the primary's.
+func (b *shadowBackend) compare(ctx context.Context, mirror *stripe.PaymentIntentParams, primaryID string, want map[string]string, primaryElapsed time.Duration) {
+	mirror.Context = ctx
+	if primaryID != "" {
+		mirror.AddMetadata("shadow_of", primaryID)
+	}
+	shadow := &stripe.PaymentIntent{}
+	started := time.Now()
+	err := b.shadow.Call(http.MethodPost, "/v1/payment_intents", b.key, mirror, shadow)
+	elapsed := time.Since(started)
+	shadowLatency.WithLabelValues("primary").Observe(primaryElapsed.Seconds())
+	shadowLatency.WithLabelValues("shadow").Observe(elapsed.Seconds())
+
+	diffs := shadowDiffs(want, shadowOutcome(shadow, err))
+	switch {
+	case err != nil && len(diffs) > 0:
+		shadowRequests.WithLabelValues("error").Inc()
+	case len(diffs) > 0:
+		shadowRequests.WithLabelValues("mismatch").Inc()
+	default:
+		shadowRequests.WithLabelValues("match").Inc()
+	}
+	for _, d := range diffs {
+		shadowMismatches.WithLabelValues(d.Field).Inc()
+	}
+	if len(diffs) > 0 {
+		logf(ctx, "shadow %s: %s differs on %s (primary %v, shadow %v)",
+			primaryID, shadow.ID, formatShadowDiffs(diffs), primaryElapsed.Round(time.Millisecond), elapsed.Round(time.Millisecond))
+	} else {
+		logf(ctx, "shadow %s: matched by %s (primary %v, shadow %v)",
+			primaryID, shadow.ID, primaryElapsed.Round(time.Millisecond), elapsed.Round(time.Millisecond))
+	}
+
+	if err == nil && shadow.ID != "" && shadowCancelable(shadow.Status) {
+		params := &stripe.PaymentIntentCancelParams{}
+		params.Context = ctx
+		if err := b.shadow.Call(http.MethodPost, "/v1/payment_intents/"+shadow.ID+"/cancel", b.key, params, &stripe.PaymentIntent{}); err != nil {
+			logf(ctx, "shadow %s: canceling %s: %v", primaryID, shadow.ID, err)
+		}
+	}
+}
+
+func shadowCancelable(status stripe.PaymentIntentStatus) bool {
+	switch status {
+	case stripe.PaymentIntentStatusSucceeded, stripe.PaymentIntentStatusCanceled, stripe.PaymentIntentStatusProcessing:
+		return false
+	}
+	return true
+}
+
+// shadowOutcome is the part of an answer both providers should agree on.
+func shadowOutcome(pi *stripe.PaymentIntent, err error) map[string]string {
+	out := map[string]string{}
+	var se *stripe.Error
+	switch {
+	case errors.As(err, &se):
+		out["error"] = string(se.Type) + "/" + string(se.Code)
+		out["decline_code"] = string(se.DeclineCode)
+		return out
+	case err != nil:
+		out["error"] = "network"
+		return out
+	case pi == nil:
+		return out
+	}
+	out["status"] = string(pi.Status)
+	out["amount"] = fmt.Sprint(pi.Amount)
+	out["currency"] = string(pi.Currency)
+	out["capture_method"] = string(pi.CaptureMethod)
+	if pi.LastPaymentError != nil {
+		out["decline_code"] = string(pi.LastPaymentError.DeclineCode)
+	}
+	return out
+}
+
+// shadowDiffs lists the fields on which the answers differ. When either
+// provider refused the payment only the refusals are compared.
+func shadowDiffs(p, s map[string]string) []resyncChange {
+	fields := []string{"status", "amount", "currency", "capture_method", "decline_code"}
+	if p["error"] != "" || s["error"] != "" {
+		fields = []string{"error", "decline_code"}
+	}
+	var diffs []resyncChange
+	for _, field := range fields {
+		if p[field] != s[field] {
+			diffs = append(diffs, resyncChange{field, p[field], s[field]})
+		}
+	}
+	return diffs
+}
+
+func formatShadowDiffs(diffs []resyncChange) string {
+	parts := make([]string, len(diffs))
+	for i, d := range diffs {
+		parts[i] = fmt.Sprintf("%s %q/%q", d.Field, d.From, d.To)
+	}
+	return strings.Join(parts, ", ")
+}
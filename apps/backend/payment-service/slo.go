@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	sloRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_slo_requests_total",
+		Help: "Requests to routes under an SLO, by objective and outcome (good, error, slow), for fleet-wide burn rates.",
+	}, []string{"slo", "outcome"})
+	sloBurnRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "payment_service_slo_burn_rate",
+		Help: "How fast this instance spends an SLO's error budget over the last window; 1 spends exactly the budget over the SLO window.",
+	}, []string{"slo", "sli", "window"})
+	sloBudgetRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "payment_service_slo_error_budget_remaining",
+		Help: "Share of an SLO's error budget left over its window on this instance; negative once overspent.",
+	}, []string{"slo", "sli"})
+	sloAlerts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_slo_alerts_total",
+		Help: "SLO alerts raised, by objective, SLI and level (fast_burn, slow_burn, exhausted).",
+	}, []string{"slo", "sli", "level"})
+)
+
+// SLI status levels, worst last.
+const (
+	sloOK        = "ok"
+	sloSlowBurn  = "slow_burn"
+	sloFastBurn  = "fast_burn"
+	sloExhausted = "exhausted"
+)
+
+const (
+	sloDefaultWindowDays = 28
+	// Burn rates over a short and a long window both past the threshold
+	// raise an alert: spending a 28-day budget in about two days, or in
+	// about five.
+	sloFastBurnRate = 14.4
+	sloSlowBurnRate = 6
+)
+
+// sloWindows are the burn rate windows reported besides the SLO window.
+var sloWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"30m", 30 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+}
+
+// SLOConfig sets objectives for routes, named as "METHOD /route" with
+// the route's parameters as registered. A request fails availability
+// with a 5xx status, load shedding's 503 included, and latency when it
+// succeeds slower than latency_ms. Either SLI may be left out.
+//
+//	"slos": {"window_days": 28, "objectives": [
+//	  {"name": "payment-create", "routes": ["POST /payment/create", "POST /payments/batch"],
+//	   "availability": 0.999, "latency_ms": 1500, "latency": 0.99}]}
+type SLOConfig struct {
+	// WindowDays is the period the error budget covers. 0 means 28.
+	WindowDays int            `json:"window_days"`
+	Objectives []SLOObjective `json:"objectives"`
+}
+
+type SLOObjective struct {
+	Name   string   `json:"name"`
+	Routes []string `json:"routes"`
+	// Availability is the share of requests that must not fail, below 1.
+	Availability float64 `json:"availability"`
+	// Latency is the share of successful requests that must take at most
+	// LatencyMS.
+	LatencyMS int     `json:"latency_ms"`
+	Latency   float64 `json:"latency"`
+}
+
+func (cfg SLOConfig) validate() error {
+	if cfg.WindowDays < 0 || cfg.WindowDays > 90 {
+		return fmt.Errorf("slos: window_days must be between 1 and 90")
+	}
+	names := map[string]bool{}
+	for _, o := range cfg.Objectives {
+		if o.Name == "" || names[o.Name] {
+			return fmt.Errorf("slos: objective names must be set and unique")
+		}
+		names[o.Name] = true
+		if len(o.Routes) == 0 {
+			return fmt.Errorf("slos: %s has no routes", o.Name)
+		}
+		for _, r := range o.Routes {
+			method, path, ok := strings.Cut(r, " ")
+			if !ok || method != strings.ToUpper(method) || !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("slos: %s route %q must be \"METHOD /path\"", o.Name, r)
+			}
+		}
+		if o.Availability == 0 && o.Latency == 0 {
+			return fmt.Errorf("slos: %s sets neither availability nor latency", o.Name)
+		}
+		if o.Availability < 0 || o.Availability >= 1 || o.Latency < 0 || o.Latency >= 1 {
+			return fmt.Errorf("slos: %s objectives must be between 0 and 1", o.Name)
+		}
+		if o.Latency > 0 && o.LatencyMS <= 0 {
+			return fmt.Errorf("slos: %s latency needs latency_ms", o.Name)
+		}
+	}
+	return nil
+}
+
+func (cfg SLOConfig) window() time.Duration {
+	days := cfg.WindowDays
+	if days == 0 {
+		days = sloDefaultWindowDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// sloCounts are requests to an objective's routes.
+type sloCounts struct {
+	Total, Errors, Slow int64
+}
+
+func (c *sloCounts) add(o sloCounts) {
+	c.Total += o.Total
+	c.Errors += o.Errors
+	c.Slow += o.Slow
+}
+
+type sloBucket struct {
+	start int64
+	sloCounts
+}
+
+// sloSeries counts an objective's requests by minute for the last six
+// hours and by hour for the SLO window, in rings.
+type sloSeries struct {
+	mu      sync.Mutex
+	minutes []sloBucket
+	hours   []sloBucket
+}
+
+func newSLOSeries() *sloSeries {
+	return &sloSeries{minutes: make([]sloBucket, 6*60), hours: make([]sloBucket, 90*24)}
+}
+
+func (s *sloSeries) add(at time.Time, c sloCounts) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ring := range []struct {
+		buckets []sloBucket
+		size    int64
+	}{{s.minutes, 60}, {s.hours, 3600}} {
+		start := at.Unix() / ring.size
+		b := &ring.buckets[start%int64(len(ring.buckets))]
+		if b.start != start {
+			*b = sloBucket{start: start}
+		}
+		b.add(c)
+	}
+}
+
+// sum adds up the requests since now-d, by minute when d is within six
+// hours and by hour otherwise.
+func (s *sloSeries) sum(now time.Time, d time.Duration) sloCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buckets, size := s.hours, int64(3600)
+	if d <= time.Duration(len(s.minutes))*time.Minute {
+		buckets, size = s.minutes, 60
+	}
+	from := now.Add(-d).Unix() / size
+	var c sloCounts
+	for _, b := range buckets {
+		if b.start > from && b.start <= now.Unix()/size {
+			c.add(b.sloCounts)
+		}
+	}
+	return c
+}
+
+// SLIStatus is one SLI of an objective over its window. BudgetRemaining
+// is the share of the failures the objective allows that are left;
+// BurnRates are how fast the budget goes over each window, 1 being the
+// pace that spends it exactly over the SLO window.
+type SLIStatus struct {
+	Objective       float64            `json:"objective"`
+	LatencyMS       int                `json:"latency_ms,omitempty"`
+	Good            int64              `json:"good"`
+	Total           int64              `json:"total"`
+	Compliance      float64            `json:"compliance"`
+	BudgetRemaining float64            `json:"budget_remaining"`
+	BurnRates       map[string]float64 `json:"burn_rates"`
+	Status          string             `json:"status"`
+}
+
+// SLOStatus is an objective's standing on this instance.
+type SLOStatus struct {
+	Name         string     `json:"name"`
+	Routes       []string   `json:"routes"`
+	WindowDays   int        `json:"window_days"`
+	Availability *SLIStatus `json:"availability,omitempty"`
+	Latency      *SLIStatus `json:"latency,omitempty"`
+}
+
+// sliStatus works out an SLI with objective from the bad and total
+// requests of each window.
+func sliStatus(objective float64, window sloCounts, bad func(sloCounts) (int64, int64), windows map[string]sloCounts) *SLIStatus {
+	budget := 1 - objective
+	burn := func(c sloCounts) float64 {
+		b, total := bad(c)
+		if total == 0 {
+			return 0
+		}
+		return round4(float64(b) / float64(total) / budget)
+	}
+	b, total := bad(window)
+	st := &SLIStatus{Objective: objective, Good: total - b, Total: total, Compliance: 1, BudgetRemaining: 1,
+		BurnRates: map[string]float64{"window": burn(window)}, Status: sloOK}
+	if total > 0 {
+		st.Compliance = round4(float64(total-b) / float64(total))
+		st.BudgetRemaining = round4(1 - float64(b)/(budget*float64(total)))
+	}
+	for name, c := range windows {
+		st.BurnRates[name] = burn(c)
+	}
+	switch {
+	case total > 0 && st.BudgetRemaining <= 0:
+		st.Status = sloExhausted
+	case st.BurnRates["1h"] > sloFastBurnRate && st.BurnRates["5m"] > sloFastBurnRate:
+		st.Status = sloFastBurn
+	case st.BurnRates["6h"] > sloSlowBurnRate && st.BurnRates["30m"] > sloSlowBurnRate:
+		st.Status = sloSlowBurn
+	}
+	return st
+}
+
+// SLOs tracks availability and latency of the routes under the runtime
+// config's objectives, so on-call sees the payment path's health from
+// the service itself. Each instance counts its own requests: the
+// summary and the burn rate gauges are per instance, while
+// payment_service_slo_requests_total adds up across the fleet. Every
+// interval the burn rates are refreshed, and an SLI that starts burning
+// its budget fast or runs out of it is reported to the error reporter,
+// once until it recovers.
+type SLOs struct {
+	settings *RuntimeSettings
+	reporter ErrorReporter
+	interval time.Duration
+
+	// routes maps "METHOD /route" to the objectives covering it.
+	routes atomic.Pointer[map[string][]SLOObjective]
+
+	mu      sync.Mutex
+	series  map[string]*sloSeries
+	alerted map[string]string
+}
+
+func NewSLOs(settings *RuntimeSettings, reporter ErrorReporter, interval time.Duration) *SLOs {
+	s := &SLOs{settings: settings, reporter: reporter, interval: interval,
+		series: map[string]*sloSeries{}, alerted: map[string]string{}}
+	s.index()
+	settings.OnReload(func() error {
+		s.index()
+		sloBurnRate.Reset()
+		sloBudgetRemaining.Reset()
+		return nil
+	})
+	return s
+}
+
+// index rebuilds the route lookup from the config in effect.
+func (s *SLOs) index() {
+	routes := map[string][]SLOObjective{}
+	for _, o := range s.settings.Get().SLOs.Objectives {
+		for _, r := range o.Routes {
+			routes[r] = append(routes[r], o)
+		}
+	}
+	s.routes.Store(&routes)
+}
+
+func (s *SLOs) seriesFor(name string) *sloSeries {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sr := s.series[name]
+	if sr == nil {
+		sr = newSLOSeries()
+		s.series[name] = sr
+	}
+	return sr
+}
+
+// Middleware counts requests to routes under an objective. It goes
+// before load shedding, so shed requests count against availability.
+func (s *SLOs) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		objectives := (*s.routes.Load())[c.Request.Method+" "+c.FullPath()]
+		if len(objectives) == 0 {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		c.Next()
+		elapsed := time.Since(start)
+		failed := c.Writer.Status() >= http.StatusInternalServerError
+		for _, o := range objectives {
+			counts := sloCounts{Total: 1}
+			outcome := "good"
+			switch {
+			case failed:
+				counts.Errors, outcome = 1, "error"
+			case o.LatencyMS > 0 && elapsed > time.Duration(o.LatencyMS)*time.Millisecond:
+				counts.Slow, outcome = 1, "slow"
+			}
+			s.seriesFor(o.Name).add(start, counts)
+			sloRequests.WithLabelValues(o.Name, outcome).Inc()
+		}
+	}
+}
+
+// Status reports every configured objective, by name.
+func (s *SLOs) Status(now time.Time) []SLOStatus {
+	cfg := s.settings.Get().SLOs
+	out := make([]SLOStatus, 0, len(cfg.Objectives))
+	for _, o := range cfg.Objectives {
+		sr := s.seriesFor(o.Name)
+		window := sr.sum(now, cfg.window())
+		windows := make(map[string]sloCounts, len(sloWindows))
+		for _, w := range sloWindows {
+			windows[w.name] = sr.sum(now, w.d)
+		}
+		st := SLOStatus{Name: o.Name, Routes: o.Routes, WindowDays: int(cfg.window() / (24 * time.Hour))}
+		if o.Availability > 0 {
+			st.Availability = sliStatus(o.Availability, window, func(c sloCounts) (int64, int64) {
+				return c.Errors, c.Total
+			}, windows)
+		}
+		if o.Latency > 0 {
+			st.Latency = sliStatus(o.Latency, window, func(c sloCounts) (int64, int64) {
+				return c.Slow, c.Total - c.Errors
+			}, windows)
+			st.Latency.LatencyMS = o.LatencyMS
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Run refreshes the burn rate gauges and raises alerts every interval
+// until ctx is done.
+func (s *SLOs) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.evaluate(ctx, time.Now())
+	}
+}
+
+func (s *SLOs) evaluate(ctx context.Context, now time.Time) {
+	for _, st := range s.Status(now) {
+		for sli, sl := range map[string]*SLIStatus{"availability": st.Availability, "latency": st.Latency} {
+			if sl == nil {
+				continue
+			}
+			for window, rate := range sl.BurnRates {
+				sloBurnRate.WithLabelValues(st.Name, sli, window).Set(rate)
+			}
+			sloBudgetRemaining.WithLabelValues(st.Name, sli).Set(sl.BudgetRemaining)
+			s.alert(ctx, st.Name, sli, sl)
+		}
+	}
+}
+
+// alert reports an SLI whose status got worse than when last reported,
+// and notes its recovery.
+func (s *SLOs) alert(ctx context.Context, name, sli string, st *SLIStatus) {
+	key := name + "/" + sli
+	s.mu.Lock()
+	last := s.alerted[key]
+	if last == "" {
+		last = sloOK
+	}
+	s.alerted[key] = st.Status
+	s.mu.Unlock()
+
+	switch {
+	case st.Status == sloOK && last != sloOK:
+		log.Printf("slo: %s %s recovered, %.1f%% of the error budget left", name, sli, st.BudgetRemaining*100)
+	case sloSeverity(st.Status) > sloSeverity(last):
+		sloAlerts.WithLabelValues(name, sli, st.Status).Inc()
+		err := fmt.Errorf("SLO %s %s: %s (compliance %.4f against %.4f, %.1f%% of the error budget left, burn rate %.1f over 1h)",
+			name, sli, st.Status, st.Compliance, st.Objective, st.BudgetRemaining*100, st.BurnRates["1h"])
+		log.Printf("slo: %v", err)
+		if s.reporter != nil {
+			s.reporter.Report(ctx, err, map[string]string{"slo": name, "sli": sli, "level": st.Status})
+		}
+	}
+}
+
+func sloSeverity(status string) int {
+	switch status {
+	case sloSlowBurn:
+		return 1
+	case sloFastBurn:
+		return 2
+	case sloExhausted:
+		return 3
+	}
+	return 0
+}
+
+func (s *SLOs) RegisterRoutes(r *gin.Engine, store *Store, bootstrapToken string) {
+	r.GET("/admin/slo", requireScope(store, bootstrapToken, "admin"), s.summary)
+}
+
+func (s *SLOs) summary(c *gin.Context) {
+	respondData(c, http.StatusOK, gin.H{"objectives": s.Status(time.Now())})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+const (
+	routingModePercent = "percent"
+	routingModeSmart   = "smart"
+
+	// Reasons a payment went to its arm.
+	routeReasonPercent      = "percent"
+	routeReasonSmart        = "smart"
+	routeReasonInsufficient = "insufficient_data"
+	routeReasonUnhealthy    = "unhealthy"
+	routeReasonTenant       = "tenant"
+
+	// metadataRoutingDecision carries a smart routing decision with its
+	// inputs, as JSON well under Stripe's 500 character limit.
+	metadataRoutingDecision = "routing_decision"
+
+	// healthWindow is how far back an arm's API errors count, over at
+	// most healthSamples calls.
+	healthWindow  = 5 * time.Minute
+	healthSamples = 200
+	// healthMinCalls is how many calls an arm needs in the window before
+	// its error rate can take it out of routing.
+	healthMinCalls = 20
+)
+
+// ArmFees is an arm's pricing: Percent of the amount plus Fixed minor
+// units of the payment's currency.
+type ArmFees struct {
+	Percent float64 `json:"percent"`
+	Fixed   int64   `json:"fixed"`
+}
+
+func (f ArmFees) estimate(amount int64, mode RoundingMode) int64 {
+	return percentOf(amount, f.Percent, mode) + f.Fixed
+}
+
+// armCounts are the decided outcomes of one arm's payments.
+type armCounts struct {
+	Succeeded int64
+	Failed    int64
+}
+
+func (c armCounts) samples() int64 { return c.Succeeded + c.Failed }
+
+func (c armCounts) authRate() float64 {
+	if c.samples() == 0 {
+		return 0
+	}
+	return float64(c.Succeeded) / float64(c.samples())
+}
+
+// routingStats are auth outcomes per arm, under "bin:", "country:" and
+// "method:" keys and "all".
+type routingStats map[string]map[string]armCounts
+
+func (rs routingStats) add(key, arm string, c armCounts) {
+	if rs[key] == nil {
+		rs[key] = map[string]armCounts{}
+	}
+	sum := rs[key][arm]
+	sum.Succeeded += c.Succeeded
+	sum.Failed += c.Failed
+	rs[key][arm] = sum
+}
+
+func (s *Store) RoutingStats(ctx context.Context, since time.Time) (routingStats, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT arm, card_bin, card_country, payment_method,
+			COUNT(*) FILTER (WHERE outcome = 'succeeded'), COUNT(*) FILTER (WHERE outcome = 'failed')
+		FROM payment_routes WHERE outcome <> 'pending' AND created_at >= $1
+		GROUP BY 1, 2, 3, 4`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := routingStats{}
+	for rows.Next() {
+		var arm, bin, country, method string
+		var c armCounts
+		if err := rows.Scan(&arm, &bin, &country, &method, &c.Succeeded, &c.Failed); err != nil {
+			return nil, err
+		}
+		stats.add("all", arm, c)
+		if bin != "" {
+			stats.add("bin:"+bin, arm, c)
+		}
+		if country != "" {
+			stats.add("country:"+country, arm, c)
+		}
+		if method != "" {
+			stats.add("method:"+method, arm, c)
+		}
+	}
+	return stats, rows.Err()
+}
+
+// armHealth remembers whether an arm's recent API calls failed: network
+// errors, timeouts, rate limits and 5xx, not declines or bad requests.
+type armHealth struct {
+	mu    sync.Mutex
+	calls [healthSamples]struct {
+		at     time.Time
+		failed bool
+	}
+	next int
+}
+
+func (h *armHealth) record(failed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls[h.next].at, h.calls[h.next].failed = time.Now(), failed
+	h.next = (h.next + 1) % healthSamples
+}
+
+// errorRate is the share of the arm's calls in healthWindow that failed,
+// and how many there were.
+func (h *armHealth) errorRate() (float64, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	since := time.Now().Add(-healthWindow)
+	var calls, failed int
+	for _, c := range h.calls {
+		if c.at.After(since) {
+			calls++
+			if c.failed {
+				failed++
+			}
+		}
+	}
+	if calls == 0 {
+		return 0, 0
+	}
+	return float64(failed) / float64(calls), calls
+}
+
+// providerFailure reports whether err says the provider, rather than the
+// payment, is at fault.
+func providerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var se *stripe.Error
+	if !errors.As(err, &se) {
+		return true
+	}
+	return se.HTTPStatusCode >= 500 || se.HTTPStatusCode == http.StatusTooManyRequests || se.Type == stripe.ErrorTypeAPI
+}
+
+// armEstimate is what a decision knew about one arm. Value is the
+// expected net of trying the payment there: the auth rate times the
+// amount less the estimated fee.
+type armEstimate struct {
+	Arm       string  `json:"arm"`
+	Basis     string  `json:"basis,omitempty"`
+	Samples   int64   `json:"n"`
+	AuthRate  float64 `json:"auth_rate"`
+	Fee       int64   `json:"fee"`
+	ErrorRate float64 `json:"error_rate"`
+	Healthy   bool    `json:"healthy"`
+	Value     float64 `json:"value"`
+}
+
+// routingDecision is the arm a payment went to, why, and the estimates
+// it was chosen from.
+type routingDecision struct {
+	Arm    string        `json:"arm"`
+	Reason string        `json:"reason"`
+	Arms   []armEstimate `json:"arms,omitempty"`
+}
+
+func round4(f float64) float64 { return math.Round(f*10000) / 10000 }
+
+// decide picks the arm expected to net the most for a payment of amount,
+// paid with a card of bin from country by method; any of them may be
+// unknown. Both arms are compared on the most specific of
+// BIN, country, method and all payments where each has MinSamples
+// decided payments. An arm whose API is failing is left out; with too
+// little history the sticky percentage assignment decides instead.
+func (pr *ProviderRouting) decide(cfg ProviderRoutingConfig, mode RoundingMode, amount int64, bin, country, method, key string) routingDecision {
+	fallback := routingDecision{Arm: cfg.bucketArm(key), Reason: routeReasonInsufficient}
+	if fallback.Arm == "" {
+		fallback.Arm = armPrimary
+	}
+
+	estimates := make([]armEstimate, 0, 2)
+	healthy := 0
+	for _, arm := range []string{armPrimary, armAlternate} {
+		e := armEstimate{Arm: arm, Fee: cfg.Fees[arm].estimate(amount, mode), Healthy: true}
+		rate, calls := pr.health[arm].errorRate()
+		e.ErrorRate = round4(rate)
+		if calls >= healthMinCalls && rate > cfg.maxErrorRate() {
+			e.Healthy = false
+		} else {
+			healthy++
+		}
+		estimates = append(estimates, e)
+	}
+	switch {
+	case healthy == 0:
+		return routingDecision{Arm: armPrimary, Reason: routeReasonUnhealthy, Arms: estimates}
+	case healthy == 1:
+		for _, e := range estimates {
+			if e.Healthy {
+				return routingDecision{Arm: e.Arm, Reason: routeReasonUnhealthy, Arms: estimates}
+			}
+		}
+	}
+
+	stats := pr.stats.Load()
+	if stats == nil {
+		fallback.Arms = estimates
+		return fallback
+	}
+	var keys []string
+	if bin != "" {
+		keys = append(keys, "bin:"+bin)
+	}
+	if country != "" {
+		keys = append(keys, "country:"+country)
+	}
+	if method != "" {
+		keys = append(keys, "method:"+method)
+	}
+	basis := ""
+	for _, k := range append(keys, "all") {
+		counts := (*stats)[k]
+		if counts[armPrimary].samples() >= int64(cfg.minSamples()) && counts[armAlternate].samples() >= int64(cfg.minSamples()) {
+			basis = k
+			break
+		}
+	}
+	if basis == "" {
+		fallback.Arms = estimates
+		return fallback
+	}
+
+	best := 0
+	for i := range estimates {
+		e := &estimates[i]
+		c := (*stats)[basis][e.Arm]
+		e.Basis, e.Samples, e.AuthRate = basis, c.samples(), round4(c.authRate())
+		e.Value = round4(c.authRate() * float64(amount-e.Fee))
+		if e.Value > estimates[best].Value {
+			best = i
+		}
+	}
+	return routingDecision{Arm: estimates[best].Arm, Reason: routeReasonSmart, Arms: estimates}
+}
+
+// refreshStats reloads the auth outcomes decisions are made from.
+func (pr *ProviderRouting) refreshStats(ctx context.Context) error {
+	stats, err := pr.store.RoutingStats(ctx, time.Now().Add(-pr.lookback))
+	if err != nil {
+		return err
+	}
+	pr.stats.Store(&stats)
+	return nil
+}
+
+// Run refreshes the auth outcomes every interval until ctx is done.
+func (pr *ProviderRouting) Run(ctx context.Context) {
+	if pr == nil || pr.store == nil {
+		return
+	}
+	ticker := time.NewTicker(pr.interval)
+	defer ticker.Stop()
+	for {
+		if err := pr.refreshStats(ctx); err != nil {
+			log.Printf("provider routing: refreshing auth rates: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// decisionMetadata is d as recorded on the payment.
+func decisionMetadata(d routingDecision) string {
+	raw, err := json.Marshal(d)
+	if err != nil || len(raw) > 500 {
+		raw, _ = json.Marshal(routingDecision{Arm: d.Arm, Reason: d.Reason})
+	}
+	return string(raw)
+}
+
+// chargeSucceeded records the card a routed payment succeeded with, for
+// auth rates by BIN and country.
+func (pr *ProviderRouting) chargeSucceeded(ctx context.Context, ch *stripe.Charge) error {
+	if pr == nil || pr.store == nil || ch.PaymentIntent == nil || ch.Metadata[metadataProviderArm] == "" {
+		return nil
+	}
+	var bin, country, method string
+	if d := ch.PaymentMethodDetails; d != nil {
+		method = string(d.Type)
+		if d.Card != nil {
+			bin, country = d.Card.IIN, d.Card.Country
+		}
+	}
+	if _, err := pr.store.db.ExecContext(ctx, `
+		UPDATE payment_routes SET card_bin = $2, card_country = $3, payment_method = $4, updated_at = now()
+		WHERE payment_id = $1`, ch.PaymentIntent.ID, bin, country, method); err != nil {
+		return fmt.Errorf("recording card of %s: %w", ch.PaymentIntent.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,708 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+var splitCaptureEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_split_capture_events_total",
+	Help: "Shipment captures of split authorizations, by mode (multicapture, recharge) and event (captured, failed, completed, released, expired).",
+}, []string{"mode", "event"})
+
+// How a split authorization is collected: captured several times where
+// the card allows it, or captured once for the first shipment and the
+// rest charged anew to the saved card.
+const (
+	splitMulticapture = "multicapture"
+	splitRecharge     = "recharge"
+)
+
+// Split capture statuses. Everything but open is final.
+const (
+	splitOpen      = "open"
+	splitCompleted = "completed"
+	splitReleased  = "released"
+	splitExpired   = "expired"
+)
+
+// Shipment capture statuses.
+const (
+	shipmentPending   = "pending"
+	shipmentSucceeded = "succeeded"
+	shipmentFailed    = "failed"
+)
+
+// Metadata on the intents recharging a shipment: the authorized payment
+// it belongs to, and the shipment.
+const (
+	metadataSplitCaptureOf = "split_capture_of"
+	metadataShipmentID     = "shipment_id"
+)
+
+const (
+	// splitReleaseLead is how long before its authorization lapses a
+	// split capture is closed and the rest of the authorization released.
+	splitReleaseLead = time.Hour
+	// shipmentCaptureLease is how long a capture holds its shipment; one
+	// left pending past it, by a restart mid-capture, can be tried again
+	// and replays the same provider call.
+	shipmentCaptureLease = 5 * time.Minute
+)
+
+var (
+	errShipmentCaptured   = errors.New("shipment already captured")
+	errShipmentInProgress = errors.New("shipment capture in progress")
+	errShipmentAmount     = errors.New("shipment capture retried with another amount")
+	errSplitClosed        = errors.New("split capture is not open")
+	errSplitExceeded      = errors.New("shipment exceeds the remaining authorization")
+)
+
+// SplitCapture is an authorization collected in parts, one per shipment.
+// Remaining is what the shipments may still take.
+type SplitCapture struct {
+	PaymentID     string            `json:"payment_id"`
+	TenantID      string            `json:"tenant_id,omitempty"`
+	CustomerID    string            `json:"customer_id,omitempty"`
+	PaymentMethod string            `json:"-"`
+	Currency      string            `json:"currency"`
+	Authorized    int64             `json:"authorized"`
+	Captured      int64             `json:"captured"`
+	Remaining     int64             `json:"remaining"`
+	Mode          string            `json:"mode"`
+	Status        string            `json:"status"`
+	AuthExpiresAt time.Time         `json:"auth_expires_at"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+	EndedAt       *time.Time        `json:"ended_at,omitempty"`
+	Shipments     []ShipmentCapture `json:"shipments"`
+}
+
+// ShipmentCapture is one shipment's part. ChargeID is the intent that
+// collected it.
+type ShipmentCapture struct {
+	ShipmentID string    `json:"shipment_id"`
+	Amount     int64     `json:"amount"`
+	Status     string    `json:"status"`
+	ChargeID   string    `json:"charge_id,omitempty"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"last_error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+const splitCaptureColumns = `payment_id, tenant_id, customer_id, payment_method, currency, authorized, captured, mode,
+	status, auth_expires_at, created_at, updated_at, ended_at`
+
+func scanSplitCapture(row interface{ Scan(...interface{}) error }) (*SplitCapture, error) {
+	var sc SplitCapture
+	var ended sql.NullTime
+	if err := row.Scan(&sc.PaymentID, &sc.TenantID, &sc.CustomerID, &sc.PaymentMethod, &sc.Currency, &sc.Authorized,
+		&sc.Captured, &sc.Mode, &sc.Status, &sc.AuthExpiresAt, &sc.CreatedAt, &sc.UpdatedAt, &ended); err != nil {
+		return nil, err
+	}
+	sc.Remaining = sc.Authorized - sc.Captured
+	sc.EndedAt = timeOrNil(ended)
+	sc.Shipments = []ShipmentCapture{}
+	return &sc, nil
+}
+
+// CreateSplitCapture records sc, or returns the split capture its
+// payment already has.
+func (s *Store) CreateSplitCapture(ctx context.Context, sc *SplitCapture) (*SplitCapture, error) {
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO split_captures (payment_id, tenant_id, customer_id, payment_method, currency, authorized, mode,
+			status, auth_expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT DO NOTHING`,
+		sc.PaymentID, sc.TenantID, sc.CustomerID, sc.PaymentMethod, sc.Currency, sc.Authorized, sc.Mode, sc.Status,
+		sc.AuthExpiresAt); err != nil {
+		return nil, err
+	}
+	return s.SplitCapture(ctx, sc.PaymentID)
+}
+
+// SplitCapture returns a payment's split capture and its shipments, or
+// sql.ErrNoRows.
+func (s *Store) SplitCapture(ctx context.Context, paymentID string) (*SplitCapture, error) {
+	sc, err := scanSplitCapture(s.db.QueryRowContext(ctx, `
+		SELECT `+splitCaptureColumns+` FROM split_captures WHERE payment_id = $1`, paymentID))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT shipment_id, amount, status, charge_id, attempts, last_error, created_at, updated_at
+		FROM shipment_captures WHERE payment_id = $1 ORDER BY created_at, shipment_id`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sh ShipmentCapture
+		if err := rows.Scan(&sh.ShipmentID, &sh.Amount, &sh.Status, &sh.ChargeID, &sh.Attempts, &sh.LastError,
+			&sh.CreatedAt, &sh.UpdatedAt); err != nil {
+			return nil, err
+		}
+		sc.Shipments = append(sc.Shipments, sh)
+	}
+	return sc, rows.Err()
+}
+
+// StartShipmentCapture claims a shipment's capture and sets its amount
+// aside from the authorization. It returns the attempt, which keys the
+// provider call, and what the shipments before it took. A failed
+// shipment is tried again as a new attempt; one left pending past the
+// lease is taken over as the same attempt, its amount already set aside.
+func (s *Store) StartShipmentCapture(ctx context.Context, paymentID, shipmentID string, amount int64) (attempt int, prior int64, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var held int64
+	var updated time.Time
+	err = tx.QueryRowContext(ctx, `
+		SELECT status, amount, attempts, updated_at FROM shipment_captures
+		WHERE payment_id = $1 AND shipment_id = $2 FOR UPDATE`, paymentID, shipmentID).
+		Scan(&status, &held, &attempt, &updated)
+	reserve := true
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO shipment_captures (payment_id, shipment_id, amount, status) VALUES ($1, $2, $3, $4)
+			ON CONFLICT DO NOTHING`, paymentID, shipmentID, amount, shipmentPending)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return 0, 0, errShipmentInProgress
+		}
+		attempt = 1
+	case err != nil:
+		return 0, 0, err
+	case status == shipmentSucceeded:
+		return 0, 0, errShipmentCaptured
+	case status == shipmentPending && time.Since(updated) < shipmentCaptureLease:
+		return 0, 0, errShipmentInProgress
+	case status == shipmentPending && held != amount:
+		return 0, 0, errShipmentAmount
+	case status == shipmentPending:
+		reserve = false
+	default:
+		attempt++
+	}
+	if status != "" {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE shipment_captures SET status = $3, amount = $4, attempts = $5, last_error = '', updated_at = now()
+			WHERE payment_id = $1 AND shipment_id = $2`,
+			paymentID, shipmentID, shipmentPending, amount, attempt); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if !reserve {
+		err = tx.QueryRowContext(ctx, `
+			SELECT captured - $2 FROM split_captures WHERE payment_id = $1 AND status = $3`,
+			paymentID, amount, splitOpen).Scan(&prior)
+	} else {
+		err = tx.QueryRowContext(ctx, `
+			UPDATE split_captures SET captured = captured + $2, updated_at = now()
+			WHERE payment_id = $1 AND status = $3 AND captured + $2 <= authorized
+			RETURNING captured - $2`, paymentID, amount, splitOpen).Scan(&prior)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		var open bool
+		if err := tx.QueryRowContext(ctx, `
+			SELECT status = $2 FROM split_captures WHERE payment_id = $1`, paymentID, splitOpen).Scan(&open); err != nil {
+			return 0, 0, err
+		}
+		if !open {
+			return 0, 0, errSplitClosed
+		}
+		return 0, 0, errSplitExceeded
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return attempt, prior, tx.Commit()
+}
+
+// FinishShipmentCapture records how a shipment's capture went. A failed
+// one gives its amount back to the authorization; a successful one
+// completes the split capture when complete is set.
+func (s *Store) FinishShipmentCapture(ctx context.Context, paymentID, shipmentID, chargeID string, captureErr error, complete bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if captureErr != nil {
+		var amount int64
+		if err := tx.QueryRowContext(ctx, `
+			UPDATE shipment_captures SET status = $3, last_error = $4, updated_at = now()
+			WHERE payment_id = $1 AND shipment_id = $2 AND status = $5
+			RETURNING amount`, paymentID, shipmentID, shipmentFailed, captureErr.Error(), shipmentPending).
+			Scan(&amount); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE split_captures SET captured = captured - $2, updated_at = now() WHERE payment_id = $1`,
+			paymentID, amount); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE shipment_captures SET status = $3, charge_id = $4, updated_at = now()
+		WHERE payment_id = $1 AND shipment_id = $2`, paymentID, shipmentID, shipmentSucceeded, chargeID); err != nil {
+		return err
+	}
+	if complete {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE split_captures SET status = $2, ended_at = now(), updated_at = now()
+			WHERE payment_id = $1 AND status = $3`, paymentID, splitCompleted, splitOpen); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// EndSplitCapture closes an open split capture with status, provided no
+// shipment is being captured. It returns sql.ErrNoRows otherwise.
+func (s *Store) EndSplitCapture(ctx context.Context, paymentID, status string) (*SplitCapture, error) {
+	return scanSplitCapture(s.db.QueryRowContext(ctx, `
+		UPDATE split_captures SET status = $2, ended_at = now(), updated_at = now()
+		WHERE payment_id = $1 AND status = $3
+			AND NOT EXISTS (SELECT 1 FROM shipment_captures WHERE payment_id = $1 AND status = $4)
+		RETURNING `+splitCaptureColumns, paymentID, status, splitOpen, shipmentPending))
+}
+
+// DueSplitCaptures returns up to limit open split captures whose
+// authorization lapses before cutoff.
+func (s *Store) DueSplitCaptures(ctx context.Context, cutoff time.Time, limit int) ([]*SplitCapture, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+splitCaptureColumns+` FROM split_captures
+		WHERE status = $1 AND auth_expires_at <= $2 ORDER BY auth_expires_at LIMIT $3`, splitOpen, cutoff, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*SplitCapture{}
+	for rows.Next() {
+		sc, err := scanSplitCapture(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sc)
+	}
+	return out, rows.Err()
+}
+
+// addMulticapture asks for an authorization that can be captured more
+// than once, for orders shipped in parts, where the card allows it.
+func (r *PaymentRequest) addMulticapture(params *stripe.PaymentIntentParams) {
+	if !r.Multicapture {
+		return
+	}
+	if params.PaymentMethodOptions == nil {
+		params.PaymentMethodOptions = &stripe.PaymentIntentPaymentMethodOptionsParams{}
+	}
+	if params.PaymentMethodOptions.Card == nil {
+		params.PaymentMethodOptions.Card = &stripe.PaymentIntentPaymentMethodOptionsCardParams{}
+	}
+	params.PaymentMethodOptions.Card.RequestMulticapture = stripe.String(string(stripe.PaymentIntentPaymentMethodOptionsCardRequestMulticaptureIfAvailable))
+}
+
+// multicaptureAvailable reports whether pi's authorization can be
+// captured more than once.
+func multicaptureAvailable(pi *stripe.PaymentIntent) bool {
+	ch := pi.LatestCharge
+	if ch == nil || ch.PaymentMethodDetails == nil || ch.PaymentMethodDetails.Card == nil || ch.PaymentMethodDetails.Card.Multicapture == nil {
+		return false
+	}
+	return ch.PaymentMethodDetails.Card.Multicapture.Status == stripe.ChargePaymentMethodDetailsCardMulticaptureStatusAvailable
+}
+
+// rechargeable reports whether pi's card is saved to its customer, so
+// shipments after the first can be charged to it off session.
+func rechargeable(pi *stripe.PaymentIntent) bool {
+	return pi.Customer != nil && pi.PaymentMethod != nil && pi.PaymentMethod.Customer != nil
+}
+
+// SplitCaptures collects a manually captured payment shipment by
+// shipment. Where the card allows multicapture, each shipment captures
+// its part of the one authorization, the last releasing what is left.
+// Otherwise the first shipment captures its part and the authorization's
+// remainder is released at once, and later shipments are new off-session
+// charges on the saved card, which the customer's bank may decline; a
+// card not saved can only be captured once. Either way the shipments can
+// take no more than was authorized, and a worker closes split captures
+// still open shortly before their authorization lapses, releasing the
+// rest.
+type SplitCaptures struct {
+	store    *Store
+	settings *RuntimeSettings
+	hub      *EventHub
+	interval time.Duration
+	payments PaymentRepository
+}
+
+func NewSplitCaptures(store *Store, settings *RuntimeSettings, hub *EventHub, interval time.Duration) *SplitCaptures {
+	return &SplitCaptures{store: store, settings: settings, hub: hub, interval: interval}
+}
+
+// RegisterRoutes mounts the shipment captures of a payment, which need a
+// key with the payments scope.
+func (sp *SplitCaptures) RegisterRoutes(r gin.IRouter, bootstrapToken string) {
+	g := r.Group("/payment/:id/captures", requireScope(sp.store, bootstrapToken, "payments"), sp.requireStore)
+	g.GET("", sp.get)
+	g.POST("", sp.capture)
+	g.POST("/release", sp.release)
+}
+
+func (sp *SplitCaptures) requireStore(c *gin.Context) {
+	if sp.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Split captures require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+func (sp *SplitCaptures) get(c *gin.Context) {
+	sc, err := sp.store.SplitCapture(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "No shipments were captured for this payment"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, sc)
+}
+
+// enroll starts splitting pi's authorization, or returns the split
+// capture it already has.
+func (sp *SplitCaptures) enroll(ctx context.Context, pi *stripe.PaymentIntent) (*SplitCapture, *refusal, error) {
+	sc, err := sp.store.SplitCapture(ctx, pi.ID)
+	if err == nil || !errors.Is(err, sql.ErrNoRows) {
+		return sc, nil, err
+	}
+	if status := paymentStatus(pi); status != string(stripe.PaymentIntentStatusRequiresCapture) {
+		return nil, &refusal{http.StatusConflict, CodePaymentState, "The payment is " + status + " and can't be captured", nil}, nil
+	}
+	if pi.Metadata[metadataAuthHold] != "" {
+		return nil, &refusal{http.StatusConflict, CodePaymentState, "The payment is under an extended hold; capture it through the hold", nil}, nil
+	}
+	if cardNetwork(pi) == "" {
+		return nil, &refusal{http.StatusConflict, CodePaymentState, "Only card payments can be captured by shipment", nil}, nil
+	}
+	mode := splitRecharge
+	if multicaptureAvailable(pi) {
+		mode = splitMulticapture
+	}
+	authorizedAt := time.Unix(pi.LatestCharge.Created, 0).UTC()
+	sc = &SplitCapture{
+		PaymentID:     pi.ID,
+		TenantID:      pi.Metadata["tenant_id"],
+		CustomerID:    customerIDOf(pi.Customer),
+		Currency:      string(pi.Currency),
+		Authorized:    pi.AmountCapturable,
+		Mode:          mode,
+		Status:        splitOpen,
+		AuthExpiresAt: authorizedAt.Add(sp.settings.Get().AuthorizationHolds.validity(cardNetwork(pi))),
+	}
+	if pi.PaymentMethod != nil {
+		sc.PaymentMethod = pi.PaymentMethod.ID
+	}
+	sc, err = sp.store.CreateSplitCapture(ctx, sc)
+	return sc, nil, err
+}
+
+// capture collects one shipment's amount. With final set, or once the
+// shipments have taken the whole authorization, the split capture is
+// completed and what is left released. Capturing a shipment again
+// answers with the split capture as it is.
+func (sp *SplitCaptures) capture(c *gin.Context) {
+	var req struct {
+		ShipmentID string `json:"shipment_id" binding:"required,max=128"`
+		Amount     int64  `json:"amount" binding:"required,min=1"`
+		Final      bool   `json:"final"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	ctx := c.Request.Context()
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	params.AddExpand("latest_charge")
+	params.AddExpand("payment_method")
+	pi, err := paymentintent.Get(c.Param("id"), params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	sc, refused, err := sp.enroll(ctx, pi)
+	if refused != nil {
+		c.JSON(refused.status, errorBodyWith(c, refused.code, refused.message, refused.ext))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if sc.Status != splitOpen {
+		c.JSON(http.StatusConflict, errorBodyWith(c, CodePaymentState, "The split capture is "+sc.Status, gin.H{"status": sc.Status}))
+		return
+	}
+	// Without multicapture, the first capture releases the rest of the
+	// authorization; only a saved card can be charged for what follows.
+	if sc.Mode == splitRecharge && !req.Final && req.Amount < sc.Remaining && !rechargeable(pi) {
+		c.JSON(http.StatusConflict, errorBody(c, CodePaymentState,
+			"The card can't be captured more than once and isn't saved to charge later shipments; capture it once with final"))
+		return
+	}
+
+	attempt, prior, err := sp.store.StartShipmentCapture(ctx, pi.ID, req.ShipmentID, req.Amount)
+	switch {
+	case errors.Is(err, errShipmentCaptured):
+		sp.respond(c, http.StatusOK, pi.ID)
+		return
+	case errors.Is(err, errShipmentInProgress):
+		c.JSON(http.StatusConflict, errorBody(c, CodePaymentState, "The shipment is being captured"))
+		return
+	case errors.Is(err, errShipmentAmount):
+		c.JSON(http.StatusConflict, errorBody(c, CodePaymentState, "The shipment is being captured for another amount"))
+		return
+	case errors.Is(err, errSplitClosed):
+		c.JSON(http.StatusConflict, errorBody(c, CodePaymentState, "The split capture has ended"))
+		return
+	case errors.Is(err, errSplitExceeded):
+		validationFailed(c, []FieldError{{Field: "amount", Code: "too_large",
+			Message: "must be at most the remaining " + strconv.FormatInt(sc.Authorized-sc.Captured, 10)}})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+
+	complete := req.Final || prior+req.Amount == sc.Authorized
+	charged, err := sp.collect(ctx, sc, pi, req.ShipmentID, req.Amount, prior, attempt, complete)
+	chargeID := ""
+	if charged != nil {
+		chargeID = charged.ID
+	}
+	bg := context.WithoutCancel(ctx)
+	if ferr := sp.store.FinishShipmentCapture(bg, pi.ID, req.ShipmentID, chargeID, err, complete); ferr != nil {
+		logf(ctx, "recording shipment %s of %s: %v", req.ShipmentID, pi.ID, ferr)
+	}
+	if err != nil {
+		splitCaptureEvents.WithLabelValues(sc.Mode, "failed").Inc()
+		var r *refusal
+		if errors.As(err, &r) {
+			c.JSON(r.status, errorBodyWith(c, r.code, r.message, r.ext))
+			return
+		}
+		respondError(c, err)
+		return
+	}
+	sp.save(bg, charged)
+	splitCaptureEvents.WithLabelValues(sc.Mode, "captured").Inc()
+	if complete {
+		splitCaptureEvents.WithLabelValues(sc.Mode, splitCompleted).Inc()
+	}
+	sp.publish(bg, charged, pi.ID, "payment.shipment_captured")
+	recordAdminAction(c, sp.store, pi.ID, "split_capture.captured", req.ShipmentID,
+		gin.H{"amount": req.Amount, "final": req.Final, "charged_by": charged.ID})
+	sp.respond(c, http.StatusCreated, pi.ID)
+}
+
+// collect captures amount from the authorization, or recharges it to the
+// saved card once the authorization has been captured, and returns the
+// intent that collected it.
+func (sp *SplitCaptures) collect(ctx context.Context, sc *SplitCapture, pi *stripe.PaymentIntent, shipmentID string, amount, prior int64, attempt int, final bool) (*stripe.PaymentIntent, error) {
+	key := fmt.Sprintf("split-capture-%s-%s-%d", pi.ID, shipmentID, attempt)
+	if sc.Mode == splitMulticapture || prior == 0 {
+		params := &stripe.PaymentIntentCaptureParams{AmountToCapture: stripe.Int64(amount)}
+		params.Context = ctx
+		if sc.Mode == splitMulticapture {
+			params.FinalCapture = stripe.Bool(final)
+		}
+		params.AddMetadata(metadataShipmentID, shipmentID)
+		params.SetIdempotencyKey(key)
+		hp := hookPaymentOf(pi)
+		hp.Amount = amount
+		if refused := lifecycleHooks.preCapture(ctx, hp, params); refused != nil {
+			return nil, refused
+		}
+		return paymentintent.Capture(pi.ID, params)
+	}
+
+	params := &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(amount),
+		Currency:      stripe.String(sc.Currency),
+		Customer:      stripe.String(sc.CustomerID),
+		PaymentMethod: stripe.String(sc.PaymentMethod),
+		Confirm:       stripe.Bool(true),
+		OffSession:    stripe.Bool(true),
+	}
+	params.Context = ctx
+	if pi.Description != "" {
+		params.Description = stripe.String(pi.Description)
+	}
+	for k, v := range pi.Metadata {
+		params.AddMetadata(k, v)
+	}
+	params.AddMetadata(metadataSplitCaptureOf, pi.ID)
+	params.AddMetadata(metadataShipmentID, shipmentID)
+	params.SetIdempotencyKey(key)
+	charged, err := paymentintent.New(params)
+	if err != nil {
+		return nil, err
+	}
+	if charged.Status != stripe.PaymentIntentStatusSucceeded {
+		// Off session nobody can authenticate it; don't leave it waiting.
+		cancel := &stripe.PaymentIntentCancelParams{}
+		cancel.Context = ctx
+		if _, err := paymentintent.Cancel(charged.ID, cancel); err != nil {
+			logf(ctx, "canceling recharge %s of %s: %v", charged.ID, pi.ID, err)
+		}
+		return nil, &refusal{http.StatusPaymentRequired, CodeCardDeclined,
+			"The card needs the customer to authenticate the charge for this shipment", gin.H{"charge_id": charged.ID}}
+	}
+	return charged, nil
+}
+
+// release ends the split capture now, releasing what is left of the
+// authorization.
+func (sp *SplitCaptures) release(c *gin.Context) {
+	_, err := sp.end(c.Request.Context(), c.Param("id"), splitReleased)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusConflict, errorBody(c, CodePaymentState, "The split capture has ended or a shipment is being captured"))
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+	default:
+		recordAdminAction(c, sp.store, c.Param("id"), "split_capture."+splitReleased, "", nil)
+		sp.respond(c, http.StatusOK, c.Param("id"))
+	}
+}
+
+// end closes the split capture with status, then cancels the
+// authorization if it still holds anything: the customer gets back what
+// the shipments didn't take. Had the authorization been captured, its
+// remainder went back then. A failed cancel is logged; the authorization
+// lapses by itself soon after.
+func (sp *SplitCaptures) end(ctx context.Context, paymentID, status string) (*SplitCapture, error) {
+	sc, err := sp.store.EndSplitCapture(ctx, paymentID, status)
+	if err != nil {
+		return nil, err
+	}
+	splitCaptureEvents.WithLabelValues(sc.Mode, status).Inc()
+	ctx = context.WithoutCancel(ctx)
+	get := &stripe.PaymentIntentParams{}
+	get.Context = ctx
+	pi, err := paymentintent.Get(paymentID, get)
+	if err != nil {
+		logf(ctx, "releasing the rest of %s: %v", paymentID, err)
+		return sc, nil
+	}
+	if pi.Status == stripe.PaymentIntentStatusRequiresCapture {
+		cancel := &stripe.PaymentIntentCancelParams{}
+		cancel.Context = ctx
+		cancel.SetIdempotencyKey("split-capture-release-" + paymentID)
+		if pi, err = paymentintent.Cancel(paymentID, cancel); err != nil {
+			logf(ctx, "releasing the rest of %s: %v", paymentID, err)
+			return sc, nil
+		}
+		sp.save(ctx, pi)
+	}
+	sp.publish(ctx, pi, paymentID, "payment.split_capture_"+status)
+	return sc, nil
+}
+
+// save records a changed intent; its webhook fills the gap on failure.
+func (sp *SplitCaptures) save(ctx context.Context, pi *stripe.PaymentIntent) {
+	if sp.payments == nil {
+		return
+	}
+	if err := sp.payments.SavePayment(ctx, pi); err != nil {
+		logf(ctx, "saving payment %s: %v", pi.ID, err)
+	}
+}
+
+func (sp *SplitCaptures) respond(c *gin.Context, status int, paymentID string) {
+	sc, err := sp.store.SplitCapture(c.Request.Context(), paymentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, status, sc)
+}
+
+// publish reports a change to the payment a split capture is of; pi is
+// the intent that changed, which for a recharge is another.
+func (sp *SplitCaptures) publish(ctx context.Context, pi *stripe.PaymentIntent, paymentID, typ string) {
+	sp.hub.Publish(PaymentEvent{
+		PaymentID:  paymentID,
+		TenantID:   pi.Metadata["tenant_id"],
+		CustomerID: customerIDOf(pi.Customer),
+		Type:       typ,
+		Status:     paymentStatus(pi),
+		Amount:     pi.AmountReceived,
+		Currency:   string(pi.Currency),
+		CreatedAt:  time.Now().UTC(),
+		RequestID:  requestIDFrom(ctx),
+	})
+}
+
+// Run closes split captures coming up on their authorization's expiry
+// every interval until ctx is done.
+func (sp *SplitCaptures) Run(ctx context.Context) {
+	if sp == nil || sp.store == nil {
+		return
+	}
+	ticker := time.NewTicker(sp.interval)
+	defer ticker.Stop()
+	for {
+		if err := sp.sweep(ctx); err != nil {
+			log.Printf("split captures: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (sp *SplitCaptures) sweep(ctx context.Context) error {
+	due, err := sp.store.DueSplitCaptures(ctx, time.Now().Add(splitReleaseLead), 100)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, sc := range due {
+		// A shipment being captured keeps it open until the next sweep.
+		if _, err := sp.end(ctx, sc.PaymentID, splitExpired); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			errs = append(errs, fmt.Errorf("closing split capture of %s: %w", sc.PaymentID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// startupWaitInitialBackoff is the first pause between checks of a
+// dependency that isn't up yet; each later pause doubles, up to the
+// configured maximum.
+const startupWaitInitialBackoff = 500 * time.Millisecond
+
+// waitForDependencies blocks until the database, Redis and the broker,
+// those of them configured, answer the doctor's checks, so a service
+// started alongside Postgres in docker-compose or a fresh cluster waits
+// for it instead of crash-looping. Each dependency is retried with
+// exponential backoff, logging what it is waiting on and why; if one is
+// still down after timeout the service exits naming it. A timeout of 0
+// skips the wait.
+func waitForDependencies(timeout, maxBackoff time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	deps := []doctorCheck{
+		{"database", checkDatabase},
+		{"redis", checkRedis},
+		{"broker", checkBroker},
+	}
+	for _, dep := range deps {
+		backoff := startupWaitInitialBackoff
+		for attempt := 1; ; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+			status, detail := dep.run(ctx)
+			cancel()
+			if status != checkFail {
+				if attempt > 1 {
+					log.Printf("Startup: %s is up after %d attempts: %s", dep.name, attempt, detail)
+				}
+				break
+			}
+			left := time.Until(deadline)
+			if left <= 0 {
+				log.Fatalf("Startup: gave up waiting for %s after %s: %s", dep.name, timeout, detail)
+			}
+			if backoff > left {
+				backoff = left
+			}
+			log.Printf("Startup: waiting for %s (attempt %d): %s; retrying in %s", dep.name, attempt, detail, backoff.Round(time.Millisecond))
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
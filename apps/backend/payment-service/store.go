@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Store is the local Postgres copy of payments and refunds, kept current
+// from create calls and webhooks, and the primary PaymentRepository.
+type Store struct {
+	db *sql.DB
+	// replica, when there is one, takes reads that may be a little stale.
+	replica *storeReplica
+	pool    DBPoolConfig
+}
+
+func OpenStore(ctx context.Context, dsn string, pool DBPoolConfig) (*Store, error) {
+	db, err := openPostgres(dsn, pool)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to database: %w", err)
+	}
+	s := &Store{db: db, pool: pool}
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) Close() error {
+	if s.replica != nil {
+		s.replica.db.Close()
+	}
+	return s.db.Close()
+}
+
+// migrate applies embedded migrations in filename order, once each.
+func (s *Store) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	pending, err := pendingMigrations(ctx, s.db)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range pending {
+		body, err := migrations.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, string(body)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("applying %s: %w", name, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (name) VALUES ($1)`, name); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingMigrations lists embedded migrations not yet recorded in
+// schema_migrations, in the order they would be applied.
+func pendingMigrations(ctx context.Context, db *sql.DB) ([]string, error) {
+	names, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	var pending []string
+	for _, name := range names {
+		var applied bool
+		if err := db.QueryRowContext(ctx,
+			`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE name = $1)`, name).Scan(&applied); err != nil {
+			return nil, err
+		}
+		if !applied {
+			pending = append(pending, name)
+		}
+	}
+	return pending, nil
+}
+
+// SavePayment upserts the local copy of a PaymentIntent.
+func (s *Store) SavePayment(ctx context.Context, pi *stripe.PaymentIntent) error {
+	rec, err := paymentRecordOf(pi)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO payments (id, tenant_id, customer_id, order_id, amount, amount_received,
+			currency, status, payment_method, description, created_at, region, client_ip, user_agent, device_id,
+			failure_code, decline_code, failure_message)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+		ON CONFLICT (id) DO UPDATE SET
+			customer_id = EXCLUDED.customer_id,
+			amount = EXCLUDED.amount,
+			amount_received = EXCLUDED.amount_received,
+			status = CASE WHEN EXCLUDED.status = 'requires_capture' AND EXISTS (
+				SELECT 1 FROM payment_reviews v WHERE v.payment_id = payments.id AND v.status = 'pending')
+				THEN 'pending_review'
+				WHEN EXCLUDED.status = 'canceled' AND payments.status = 'abandoned' THEN 'abandoned'
+				ELSE EXCLUDED.status END,
+			payment_method = CASE WHEN EXCLUDED.payment_method = '' THEN payments.payment_method
+				ELSE EXCLUDED.payment_method END,
+			description = EXCLUDED.description,
+			region = CASE WHEN EXCLUDED.region = '' THEN payments.region ELSE EXCLUDED.region END,
+			failure_code = EXCLUDED.failure_code,
+			decline_code = EXCLUDED.decline_code,
+			failure_message = EXCLUDED.failure_message,
+			updated_at = now()`,
+		rec.ID, rec.TenantID, rec.CustomerID, rec.OrderID, rec.Amount, rec.AmountReceived,
+		rec.Currency, rec.Status, rec.PaymentMethod, rec.Description, rec.CreatedAt, rec.Region,
+		rec.Device.ClientIP, rec.Device.UserAgent, rec.Device.DeviceID,
+		rec.Failure.Code, rec.Failure.DeclineCode, rec.Failure.Message); err != nil {
+		return err
+	}
+	failed := pi.Status == stripe.PaymentIntentStatusRequiresPaymentMethod && pi.LastPaymentError != nil
+	if err := advancePaymentState(ctx, tx, pi.ID, "payment_intent", failed); err != nil {
+		return err
+	}
+	if err := appendPaymentEvent(ctx, tx, pi.ID, "payment_intent"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SaveCharge records refunds carried on a charge and the running refunded
+// total of its payment.
+func (s *Store) SaveCharge(ctx context.Context, ch *stripe.Charge) error {
+	if ch.PaymentIntent == nil {
+		return nil
+	}
+	paymentID := ch.PaymentIntent.ID
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE payments SET amount_refunded = $2, updated_at = now() WHERE id = $1`,
+		paymentID, ch.AmountRefunded); err != nil {
+		return err
+	}
+
+	if ch.Refunds != nil {
+		for _, r := range ch.Refunds.Data {
+			if err := saveRefund(ctx, tx, paymentID, r); err != nil {
+				return err
+			}
+		}
+	}
+	if err := advancePaymentState(ctx, tx, paymentID, "charge", false); err != nil {
+		return err
+	}
+	if err := appendPaymentEvent(ctx, tx, paymentID, "charge"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func saveRefund(ctx context.Context, tx *sql.Tx, paymentID string, r *stripe.Refund) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO refunds (id, payment_id, amount, currency, status, reason, requested_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET
+			status = EXCLUDED.status,
+			reason = EXCLUDED.reason,
+			updated_at = now()`,
+		r.ID, paymentID, r.Amount, string(r.Currency), string(r.Status), string(r.Reason),
+		r.Metadata["requested_by"], time.Unix(r.Created, 0).UTC())
+	return err
+}
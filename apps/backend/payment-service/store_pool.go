@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DBPoolConfig sizes a Postgres connection pool. database/sql's defaults,
+// unlimited open connections and two idle ones, collapse under peak
+// traffic: bursts open connections past what Postgres allows, then close
+// them again.
+type DBPoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	// StatementTimeout makes Postgres cancel statements running longer,
+	// so a runaway report frees its connection. 0 leaves the server's.
+	StatementTimeout time.Duration
+	// SaturationThreshold is the share of MaxOpenConns in use at which
+	// /readyz reports the pool saturated.
+	SaturationThreshold float64
+}
+
+func dbPoolConfigFromEnv() DBPoolConfig {
+	threshold := 1.0
+	if v := os.Getenv("DATABASE_POOL_SATURATION_THRESHOLD"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			threshold = f
+		}
+	}
+	return DBPoolConfig{
+		MaxOpenConns:        envInt("DATABASE_MAX_OPEN_CONNS", 50),
+		MaxIdleConns:        envInt("DATABASE_MAX_IDLE_CONNS", 25),
+		ConnMaxLifetime:     envDuration("DATABASE_CONN_MAX_LIFETIME", 30*time.Minute),
+		ConnMaxIdleTime:     envDuration("DATABASE_CONN_MAX_IDLE_TIME", 5*time.Minute),
+		StatementTimeout:    envDuration("DATABASE_STATEMENT_TIMEOUT", 30*time.Second),
+		SaturationThreshold: threshold,
+	}
+}
+
+// openPostgres opens a pool on dsn sized by cfg.
+func openPostgres(dsn string, cfg DBPoolConfig) (*sql.DB, error) {
+	conn, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database URL: %w", err)
+	}
+	if cfg.StatementTimeout > 0 {
+		conn.RuntimeParams["statement_timeout"] = strconv.FormatInt(cfg.StatementTimeout.Milliseconds(), 10)
+	}
+	db := stdlib.OpenDB(*conn)
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+	return db, nil
+}
+
+// poolStatus is the primary pool's use for /readyz, and whether it is
+// saturated: so much of it in use that requests queue for connections.
+func (s *Store) poolStatus() (gin.H, bool) {
+	st := s.db.Stats()
+	saturation := 0.0
+	if st.MaxOpenConnections > 0 {
+		saturation = float64(st.InUse) / float64(st.MaxOpenConnections)
+	}
+	return gin.H{
+		"in_use":     st.InUse,
+		"idle":       st.Idle,
+		"max_open":   st.MaxOpenConnections,
+		"waits":      st.WaitCount,
+		"saturation": saturation,
+	}, st.MaxOpenConnections > 0 && saturation >= s.pool.SaturationThreshold
+}
+
+// dbPoolCollector exports the pools' sql.DBStats at scrape time, labelled
+// by pool (primary, replica).
+type dbPoolCollector struct {
+	store *Store
+}
+
+var (
+	dbPoolMaxOpenDesc = prometheus.NewDesc("payment_service_db_pool_max_open_connections",
+		"Connection limit of the pool.", []string{"pool"}, nil)
+	dbPoolOpenDesc = prometheus.NewDesc("payment_service_db_pool_open_connections",
+		"Connections open, in use or idle.", []string{"pool"}, nil)
+	dbPoolInUseDesc = prometheus.NewDesc("payment_service_db_pool_in_use_connections",
+		"Connections in use.", []string{"pool"}, nil)
+	dbPoolIdleDesc = prometheus.NewDesc("payment_service_db_pool_idle_connections",
+		"Connections idle.", []string{"pool"}, nil)
+	dbPoolWaitsDesc = prometheus.NewDesc("payment_service_db_pool_waits_total",
+		"Times a query waited for a connection.", []string{"pool"}, nil)
+	dbPoolWaitDesc = prometheus.NewDesc("payment_service_db_pool_wait_seconds_total",
+		"Time spent waiting for a connection.", []string{"pool"}, nil)
+	dbPoolClosedDesc = prometheus.NewDesc("payment_service_db_pool_closed_connections_total",
+		"Connections closed, by reason (max_idle, max_idle_time, max_lifetime).", []string{"pool", "reason"}, nil)
+)
+
+func (c dbPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{dbPoolMaxOpenDesc, dbPoolOpenDesc, dbPoolInUseDesc, dbPoolIdleDesc,
+		dbPoolWaitsDesc, dbPoolWaitDesc, dbPoolClosedDesc} {
+		ch <- d
+	}
+}
+
+func (c dbPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	pools := map[string]*sql.DB{"primary": c.store.db}
+	if c.store.replica != nil {
+		pools["replica"] = c.store.replica.db
+	}
+	for pool, db := range pools {
+		st := db.Stats()
+		ch <- prometheus.MustNewConstMetric(dbPoolMaxOpenDesc, prometheus.GaugeValue, float64(st.MaxOpenConnections), pool)
+		ch <- prometheus.MustNewConstMetric(dbPoolOpenDesc, prometheus.GaugeValue, float64(st.OpenConnections), pool)
+		ch <- prometheus.MustNewConstMetric(dbPoolInUseDesc, prometheus.GaugeValue, float64(st.InUse), pool)
+		ch <- prometheus.MustNewConstMetric(dbPoolIdleDesc, prometheus.GaugeValue, float64(st.Idle), pool)
+		ch <- prometheus.MustNewConstMetric(dbPoolWaitsDesc, prometheus.CounterValue, float64(st.WaitCount), pool)
+		ch <- prometheus.MustNewConstMetric(dbPoolWaitDesc, prometheus.CounterValue, st.WaitDuration.Seconds(), pool)
+		ch <- prometheus.MustNewConstMetric(dbPoolClosedDesc, prometheus.CounterValue, float64(st.MaxIdleClosed), pool, "max_idle")
+		ch <- prometheus.MustNewConstMetric(dbPoolClosedDesc, prometheus.CounterValue, float64(st.MaxIdleTimeClosed), pool, "max_idle_time")
+		ch <- prometheus.MustNewConstMetric(dbPoolClosedDesc, prometheus.CounterValue, float64(st.MaxLifetimeClosed), pool, "max_lifetime")
+	}
+}
+
+// RegisterPoolMetrics exports the store's pool stats.
+func (s *Store) RegisterPoolMetrics() {
+	prometheus.MustRegister(dbPoolCollector{store: s})
+}
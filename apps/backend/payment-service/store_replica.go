@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	dbReads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_db_reads_total",
+		Help: "List, report and status reads, by the pool they went to (primary, replica).",
+	}, []string{"pool"})
+	dbReplicaLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "payment_service_db_replica_lag_seconds",
+		Help: "How far the read replica was behind the primary at its last check.",
+	})
+	dbReplicaInUse = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "payment_service_db_replica_in_use",
+		Help: "1 while reads go to the replica, 0 while they fall back to the primary.",
+	})
+)
+
+// replicaLagQuery is how far the replica's replay is behind: zero when it
+// has replayed all it received, else the age of the last transaction it
+// replayed. A server that isn't a replica has no lag.
+const replicaLagQuery = `SELECT COALESCE(CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()) END, 0)`
+
+// storeReplica is a read replica lists, reports and status lookups use,
+// so reporting traffic doesn't contend with the charge write path. Its
+// lag is checked every interval; while it is over maxLag, or the check
+// fails, reads fall back to the primary.
+type storeReplica struct {
+	db     *sql.DB
+	maxLag time.Duration
+	usable atomic.Bool
+}
+
+// AttachReplica opens the read replica at dsn. Reads stay on the primary
+// until WatchReplica has seen the replica's lag.
+func (s *Store) AttachReplica(ctx context.Context, dsn string, pool DBPoolConfig, maxLag time.Duration) error {
+	db, err := openPostgres(dsn, pool)
+	if err != nil {
+		return err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return fmt.Errorf("connecting to replica: %w", err)
+	}
+	s.replica = &storeReplica{db: db, maxLag: maxLag}
+	return nil
+}
+
+// WatchReplica checks the replica's lag every interval until ctx ends.
+func (s *Store) WatchReplica(ctx context.Context, interval time.Duration) {
+	if s.replica == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.replica.check(ctx, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *storeReplica) check(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var seconds float64
+	err := r.db.QueryRowContext(ctx, replicaLagQuery).Scan(&seconds)
+	lag := time.Duration(seconds * float64(time.Second))
+	usable := err == nil && lag <= r.maxLag
+
+	was := r.usable.Swap(usable)
+	dbReplicaLag.Set(seconds)
+	if usable {
+		dbReplicaInUse.Set(1)
+	} else {
+		dbReplicaInUse.Set(0)
+	}
+	switch {
+	case was && err != nil:
+		log.Printf("db replica: check failed, reading from the primary: %v", err)
+	case was && !usable:
+		log.Printf("db replica: %s behind, over %s, reading from the primary", lag.Round(time.Millisecond), r.maxLag)
+	case !was && usable:
+		log.Printf("db replica: %s behind, reading from the replica", lag.Round(time.Millisecond))
+	}
+}
+
+// reader is the pool for reads that may be a little stale: the replica
+// while it is usable, else the primary.
+func (s *Store) reader() *sql.DB {
+	if s.replica != nil && s.replica.usable.Load() {
+		dbReads.WithLabelValues("replica").Inc()
+		return s.replica.db
+	}
+	dbReads.WithLabelValues("primary").Inc()
+	return s.db
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+// streamHeartbeat keeps idle connections alive through proxies.
+const streamHeartbeat = 15 * time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// CORS is open for the REST API, so the socket follows suit.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// currentStatus fetches the payment so new subscribers start from the
+// latest known state instead of waiting for the next webhook.
+func currentStatus(ctx context.Context, paymentID string) (PaymentEvent, error) {
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	pi, err := paymentintent.Get(paymentID, params)
+	if err != nil {
+		return PaymentEvent{}, err
+	}
+	return PaymentEvent{
+		PaymentID: pi.ID,
+		Type:      "payment_intent.current",
+		Status:    paymentStatus(pi),
+		Amount:    pi.Amount,
+		Currency:  string(pi.Currency),
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// paymentEventsSSE streams status transitions for one payment as
+// server-sent events until the payment settles or the client leaves.
+func paymentEventsSSE(hub *EventHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		paymentID := c.Param("id")
+
+		// Subscribe before reading the current state so no transition is lost
+		// in between.
+		events, unsubscribe := hub.Subscribe(paymentID)
+		defer unsubscribe()
+
+		current, err := currentStatus(c.Request.Context(), paymentID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Payment not found"))
+			return
+		}
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		disableWriteDeadline(c.Writer)
+
+		c.SSEvent("status", current)
+		c.Writer.Flush()
+		if isTerminalStatus(current.Status) {
+			return
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-heartbeat.C:
+				c.SSEvent("ping", gin.H{"time": time.Now().UTC()})
+				c.Writer.Flush()
+			case ev := <-events:
+				c.SSEvent("status", ev)
+				c.Writer.Flush()
+				if isTerminalStatus(ev.Status) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// paymentEventsWS is the WebSocket equivalent of paymentEventsSSE for
+// clients that already hold a socket open.
+func paymentEventsWS(hub *EventHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		paymentID := c.Param("id")
+
+		events, unsubscribe := hub.Subscribe(paymentID)
+		defer unsubscribe()
+
+		current, err := currentStatus(c.Request.Context(), paymentID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Payment not found"))
+			return
+		}
+
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			logf(c.Request.Context(), "websocket upgrade for %s: %v", paymentID, err)
+			return
+		}
+		defer conn.Close()
+		// Heartbeats keep the socket alive; the server timeouts would
+		// otherwise cut it off.
+		conn.UnderlyingConn().SetDeadline(time.Time{})
+
+		// Drain client frames so close and ping control messages are handled.
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		if err := conn.WriteJSON(current); err != nil || isTerminalStatus(current.Status) {
+			return
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-closed:
+				return
+			case <-heartbeat.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+					return
+				}
+			case ev := <-events:
+				if err := conn.WriteJSON(ev); err != nil {
+					return
+				}
+				if isTerminalStatus(ev.Status) {
+					conn.WriteMessage(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseNormalClosure, "payment settled"))
+					return
+				}
+			}
+		}
+	}
+}
+
+// paymentEventsTail streams every payment event, or one payment's with
+// ?payment_id=, as server-sent events until the client disconnects.
+func paymentEventsTail(hub *EventHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		events, unsubscribe := hub.Subscribe(c.Query("payment_id"))
+		defer unsubscribe()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		disableWriteDeadline(c.Writer)
+		c.Header("X-Accel-Buffering", "no")
+		c.Writer.WriteHeader(http.StatusOK)
+		c.Writer.Flush()
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-heartbeat.C:
+				c.SSEvent("ping", gin.H{"time": time.Now().UTC()})
+				c.Writer.Flush()
+			case ev := <-events:
+				c.SSEvent("status", ev)
+				c.Writer.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/form"
+)
+
+// StripeHTTPConfig tunes the one connection pool every Stripe call shares.
+// Stripe is a single host, so the per-host idle limit is what keeps
+// connections, and their TLS sessions, alive between bursts.
+type StripeHTTPConfig struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	// MaxNetworkRetries is stripe-go's own retry count for network errors,
+	// 409s and 5xx; retried writes reuse their idempotency key.
+	MaxNetworkRetries int
+}
+
+func stripeHTTPConfigFromEnv() StripeHTTPConfig {
+	return StripeHTTPConfig{
+		MaxIdleConns:          envInt("STRIPE_HTTP_MAX_IDLE_CONNS", 100),
+		MaxIdleConnsPerHost:   envInt("STRIPE_HTTP_MAX_IDLE_CONNS_PER_HOST", 64),
+		MaxConnsPerHost:       envInt("STRIPE_HTTP_MAX_CONNS_PER_HOST", 0),
+		IdleConnTimeout:       envDuration("STRIPE_HTTP_IDLE_CONN_TIMEOUT", 90*time.Second),
+		DialTimeout:           envDuration("STRIPE_HTTP_DIAL_TIMEOUT", 5*time.Second),
+		KeepAlive:             envDuration("STRIPE_HTTP_KEEPALIVE", 30*time.Second),
+		TLSHandshakeTimeout:   envDuration("STRIPE_HTTP_TLS_HANDSHAKE_TIMEOUT", 5*time.Second),
+		ResponseHeaderTimeout: envDuration("STRIPE_HTTP_RESPONSE_HEADER_TIMEOUT", 0),
+		MaxNetworkRetries:     envInt("STRIPE_MAX_NETWORK_RETRIES", 2),
+	}
+}
+
+var (
+	stripeConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_stripe_connections_total",
+		Help: "Connections used for Stripe requests, by whether they were reused from the pool.",
+	}, []string{"reused"})
+	stripeTLSHandshakes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "payment_service_stripe_tls_handshake_seconds",
+		Help:    "TLS handshakes with Stripe; each is a connection the pool could not reuse.",
+		Buckets: prometheus.DefBuckets,
+	})
+	stripeRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_stripe_retries_total",
+		Help: "Stripe requests retried by the SDK, by operation.",
+	}, []string{"operation"})
+	stripeCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "payment_service_stripe_call_duration_seconds",
+		Help:    "Stripe calls including SDK retries, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+)
+
+// installStripeHTTP points the live API backends at a tuned, instrumented
+// client. Not used with the mock, which never touches the network.
+func installStripeHTTP(cfg StripeHTTPConfig) {
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: cfg.KeepAlive}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	client := &http.Client{
+		Transport: tracingTransport{transport},
+		// A backstop only; per-operation deadlines come from StripeTimeouts.
+		Timeout: 80 * time.Second,
+	}
+	for _, backend := range []stripe.SupportedBackend{stripe.APIBackend, stripe.UploadsBackend} {
+		stripe.SetBackend(backend, stripe.GetBackendWithConfig(backend, &stripe.BackendConfig{
+			HTTPClient:        client,
+			MaxNetworkRetries: stripe.Int64(int64(cfg.MaxNetworkRetries)),
+		}))
+	}
+	log.Printf("Stripe HTTP pool: max_idle_per_host=%d max_conns_per_host=%d idle_timeout=%s retries=%d",
+		cfg.MaxIdleConnsPerHost, cfg.MaxConnsPerHost, cfg.IdleConnTimeout, cfg.MaxNetworkRetries)
+}
+
+// tracingTransport records connection reuse and TLS handshakes, and counts
+// attempts for the call's retry metric.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+type attemptsKey struct{}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if n, ok := ctx.Value(attemptsKey{}).(*int32); ok {
+		atomic.AddInt32(n, 1)
+	}
+	var handshake time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			stripeConnections.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+		},
+		TLSHandshakeStart: func() { handshake = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			stripeTLSHandshakes.Observe(time.Since(handshake).Seconds())
+		},
+	}
+	return t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+}
+
+// StripeTimeouts bounds each Stripe API call. Operations are named
+// "<resource>.<verb>", e.g. payment_intents.create, refunds.get or
+// payment_intents.confirm; a bare verb sets the default for that verb.
+// Lists and searches are bounded per page.
+type StripeTimeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	List  time.Duration
+	Ops   map[string]time.Duration
+}
+
+// stripeTimeoutsFromEnv reads STRIPE_TIMEOUT_{READ,WRITE,LIST} and
+// per-operation overrides in STRIPE_TIMEOUTS, as
+// "payment_intents.create=10s,refunds.create=20s,search=45s".
+func stripeTimeoutsFromEnv() StripeTimeouts {
+	t := StripeTimeouts{
+		Read:  envDuration("STRIPE_TIMEOUT_READ", 5*time.Second),
+		Write: envDuration("STRIPE_TIMEOUT_WRITE", 15*time.Second),
+		List:  envDuration("STRIPE_TIMEOUT_LIST", 30*time.Second),
+		Ops:   map[string]time.Duration{},
+	}
+	raw := os.Getenv("STRIPE_TIMEOUTS")
+	if raw == "" {
+		return t
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		op, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		d, err := time.ParseDuration(value)
+		if !ok || err != nil || d <= 0 {
+			log.Fatalf("Invalid STRIPE_TIMEOUTS entry %q: want op=duration", pair)
+		}
+		t.Ops[op] = d
+	}
+	return t
+}
+
+// stripeOperation names a call from its method and path.
+func stripeOperation(method, path string) (op, verb string) {
+	parts := strings.Split(strings.TrimPrefix(path, "/v1/"), "/")
+	resource := parts[0]
+	switch {
+	case len(parts) == 1 && method == http.MethodPost:
+		verb = "create"
+	case len(parts) == 1:
+		verb = "list"
+	case parts[1] == "search":
+		verb = "search"
+	case len(parts) == 2 && method == http.MethodGet:
+		verb = "get"
+	case len(parts) == 2 && method == http.MethodDelete:
+		verb = "delete"
+	case len(parts) == 2:
+		verb = "update"
+	default:
+		// payment_intents/pi_123/confirm and friends.
+		verb = parts[len(parts)-1]
+	}
+	return resource + "." + verb, verb
+}
+
+func (t StripeTimeouts) forCall(method, path string) time.Duration {
+	op, verb := stripeOperation(method, path)
+	if d, ok := t.Ops[op]; ok {
+		return d
+	}
+	if d, ok := t.Ops[verb]; ok {
+		return d
+	}
+	switch {
+	case verb == "list" || verb == "search":
+		return t.List
+	case method == http.MethodGet:
+		return t.Read
+	}
+	return t.Write
+}
+
+// deadlineBackend puts a per-operation deadline on every call, beneath the
+// caller's context, so a Stripe call ends when the client disconnects or
+// its own budget runs out, whichever is first.
+type deadlineBackend struct {
+	stripe.Backend
+	timeouts StripeTimeouts
+}
+
+// installStripeDeadlines wraps whichever API backend is installed,
+// including the mock provider.
+func installStripeDeadlines(t StripeTimeouts) {
+	stripe.SetBackend(stripe.APIBackend, &deadlineBackend{
+		Backend:  stripe.GetBackend(stripe.APIBackend),
+		timeouts: t,
+	})
+}
+
+// withDeadline swaps a bounded context into params for one call. Iterators
+// reuse their params for every page, so the original is put back after.
+func (b *deadlineBackend) withDeadline(method, path string, p *stripe.Params, call func() error) error {
+	if p == nil {
+		return call()
+	}
+	parent := p.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	op, _ := stripeOperation(method, path)
+	var attempts int32
+	ctx, cancel := context.WithTimeout(context.WithValue(parent, attemptsKey{}, &attempts), b.timeouts.forCall(method, path))
+	p.Context = ctx
+	defer func() {
+		cancel()
+		p.Context = parent
+	}()
+
+	started := time.Now()
+	err := call()
+	stripeCallDuration.WithLabelValues(op).Observe(time.Since(started).Seconds())
+	if n := atomic.LoadInt32(&attempts); n > 1 {
+		stripeRetries.WithLabelValues(op).Add(float64(n - 1))
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+		return fmt.Errorf("stripe %s: %w", op, err)
+	}
+	return err
+}
+
+// paramsOf unwraps params, which callers may pass as a typed nil.
+func paramsOf(params stripe.ParamsContainer) *stripe.Params {
+	if params == nil || reflect.ValueOf(params).IsNil() {
+		return nil
+	}
+	return params.GetParams()
+}
+
+func (b *deadlineBackend) Call(method, path, key string, params stripe.ParamsContainer, v stripe.LastResponseSetter) error {
+	return b.withDeadline(method, path, paramsOf(params), func() error {
+		return b.Backend.Call(method, path, key, params, v)
+	})
+}
+
+func (b *deadlineBackend) CallStreaming(method, path, key string, params stripe.ParamsContainer, v stripe.StreamingLastResponseSetter) error {
+	// The body is read after the call returns, so no deadline here.
+	return b.Backend.CallStreaming(method, path, key, params, v)
+}
+
+func (b *deadlineBackend) CallRaw(method, path, key string, body *form.Values, params *stripe.Params, v stripe.LastResponseSetter) error {
+	return b.withDeadline(method, path, params, func() error {
+		return b.Backend.CallRaw(method, path, key, body, params, v)
+	})
+}
+
+func (b *deadlineBackend) CallMultipart(method, path, key, boundary string, body *bytes.Buffer, params *stripe.Params, v stripe.LastResponseSetter) error {
+	return b.withDeadline(method, path, params, func() error {
+		return b.Backend.CallMultipart(method, path, key, boundary, body, params, v)
+	})
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"github.com/stripe/stripe-go/v76/refund"
+)
+
+var stripeImported = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_stripe_imported_total",
+	Help: "Objects backfilled from Stripe, by kind (payment, charge, refund, skipped).",
+}, []string{"kind"})
+
+// Import statuses. Pending and running imports are picked up by the
+// worker; the rest are final.
+const (
+	importPending   = "pending"
+	importRunning   = "running"
+	importCompleted = "completed"
+	importFailed    = "failed"
+	importCanceled  = "canceled"
+)
+
+const (
+	// importPageSize is how many PaymentIntents one page of an import
+	// takes, and how often its cursor is saved.
+	importPageSize = 100
+	// importLease is how long a claimed import stays claimed without a
+	// page being saved; an instance that dies mid-import hands it over.
+	importLease = 5 * time.Minute
+	// importMaxFailures is how many pages in a row may fail before an
+	// import gives up.
+	importMaxFailures = 5
+)
+
+// StripeImport backfills the local store from Stripe's PaymentIntents,
+// their charges and refunds, newest first, optionally only those created
+// in [CreatedGTE, CreatedLT). Cursor is the last PaymentIntent imported.
+type StripeImport struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	CreatedGTE  *time.Time `json:"created_gte,omitempty"`
+	CreatedLT   *time.Time `json:"created_lt,omitempty"`
+	Cursor      string     `json:"cursor,omitempty"`
+	Payments    int        `json:"payments"`
+	Charges     int        `json:"charges"`
+	Refunds     int        `json:"refunds"`
+	Skipped     int        `json:"skipped"`
+	Failures    int        `json:"failures"`
+	LastError   string     `json:"last_error,omitempty"`
+	RequestedBy string     `json:"requested_by,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+const stripeImportColumns = `id, status, created_gte, created_lt, cursor, payments, charges, refunds, skipped, failures,
+	last_error, requested_by, created_at, updated_at, finished_at`
+
+func scanStripeImport(row interface{ Scan(...interface{}) error }) (*StripeImport, error) {
+	var imp StripeImport
+	var gte, lt, finished sql.NullTime
+	if err := row.Scan(&imp.ID, &imp.Status, &gte, &lt, &imp.Cursor, &imp.Payments, &imp.Charges, &imp.Refunds,
+		&imp.Skipped, &imp.Failures, &imp.LastError, &imp.RequestedBy, &imp.CreatedAt, &imp.UpdatedAt, &finished); err != nil {
+		return nil, err
+	}
+	imp.CreatedGTE, imp.CreatedLT, imp.FinishedAt = timeOrNil(gte), timeOrNil(lt), timeOrNil(finished)
+	return &imp, nil
+}
+
+var stripeImportList = listResource{
+	from: "stripe_imports i",
+	fields: []string{"id", "status", "created_gte", "created_lt", "payments", "charges", "refunds", "skipped",
+		"last_error", "requested_by", "created_at", "finished_at"},
+	columns: map[string]listField{
+		"id":           {"i.id", textField},
+		"status":       {"i.status", textField},
+		"created_gte":  {"i.created_gte", timeField},
+		"created_lt":   {"i.created_lt", timeField},
+		"payments":     {"i.payments", intField},
+		"charges":      {"i.charges", intField},
+		"refunds":      {"i.refunds", intField},
+		"skipped":      {"i.skipped", intField},
+		"last_error":   {"i.last_error", textField},
+		"requested_by": {"i.requested_by", textField},
+		"created_at":   {"i.created_at", timeField},
+		"finished_at":  {"i.finished_at", timeField},
+	},
+}
+
+func (s *Store) CreateStripeImport(ctx context.Context, imp *StripeImport) (*StripeImport, error) {
+	return scanStripeImport(s.db.QueryRowContext(ctx, `
+		INSERT INTO stripe_imports (id, status, created_gte, created_lt, requested_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+stripeImportColumns,
+		imp.ID, importPending, imp.CreatedGTE, imp.CreatedLT, imp.RequestedBy))
+}
+
+func (s *Store) StripeImport(ctx context.Context, id string) (*StripeImport, error) {
+	return scanStripeImport(s.db.QueryRowContext(ctx, `SELECT `+stripeImportColumns+` FROM stripe_imports WHERE id = $1`, id))
+}
+
+// ClaimStripeImport marks the oldest open import nobody holds as running
+// for importLease and returns it, or sql.ErrNoRows.
+func (s *Store) ClaimStripeImport(ctx context.Context) (*StripeImport, error) {
+	return scanStripeImport(s.db.QueryRowContext(ctx, `
+		UPDATE stripe_imports SET status = 'running', lease_until = $1, updated_at = now()
+		WHERE id = (
+			SELECT id FROM stripe_imports
+			WHERE status IN ('pending', 'running') AND (lease_until IS NULL OR lease_until <= now())
+			ORDER BY created_at LIMIT 1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING `+stripeImportColumns, time.Now().Add(importLease).UTC()))
+}
+
+// stripeImportPage is what one page added to an import.
+type stripeImportPage struct {
+	cursor                              string
+	payments, charges, refunds, skipped int
+}
+
+// AdvanceStripeImport adds a page to a running import and extends its
+// lease. It returns sql.ErrNoRows once the import was canceled.
+func (s *Store) AdvanceStripeImport(ctx context.Context, id string, page stripeImportPage) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE stripe_imports SET cursor = $2, payments = payments + $3, charges = charges + $4,
+			refunds = refunds + $5, skipped = skipped + $6, failures = 0, last_error = '', lease_until = $7,
+			updated_at = now()
+		WHERE id = $1 AND status = 'running'`,
+		id, page.cursor, page.payments, page.charges, page.refunds, page.skipped, time.Now().Add(importLease).UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+// FailStripeImportPage records a page that failed. The import is retried
+// once its lease runs out, and fails for good after importMaxFailures in
+// a row.
+func (s *Store) FailStripeImportPage(ctx context.Context, id, lastError string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE stripe_imports SET failures = failures + 1, last_error = $2, updated_at = now(),
+			status = CASE WHEN failures + 1 >= $3 THEN 'failed' ELSE status END,
+			finished_at = CASE WHEN failures + 1 >= $3 THEN now() ELSE finished_at END
+		WHERE id = $1 AND status = 'running'`, id, lastError, importMaxFailures)
+	return err
+}
+
+// FinishStripeImport moves an open import to a final status.
+func (s *Store) FinishStripeImport(ctx context.Context, id, status string) (*StripeImport, error) {
+	return scanStripeImport(s.db.QueryRowContext(ctx, `
+		UPDATE stripe_imports SET status = $2, lease_until = NULL, finished_at = now(), updated_at = now()
+		WHERE id = $1 AND status IN ('pending', 'running')
+		RETURNING `+stripeImportColumns, id, status))
+}
+
+// StripeImports backfills the local database from Stripe for deployments
+// that started persisting payments after taking them: an admin starts an
+// import, optionally for a window of creation dates, and a worker pages
+// through Stripe's PaymentIntents saving each with its latest charge,
+// card and refunds. Every page saves the import's cursor and counts, so
+// a restart or a failed page resumes where it left off, and the counts
+// report progress. Saving is an upsert, so re-importing is harmless.
+// Payments of another region are skipped.
+type StripeImports struct {
+	store    *Store
+	payments PaymentRepository
+	interval time.Duration
+}
+
+func NewStripeImports(store *Store, interval time.Duration) *StripeImports {
+	return &StripeImports{store: store, interval: interval}
+}
+
+func (si *StripeImports) RegisterRoutes(r gin.IRouter, bootstrapToken string) {
+	g := r.Group("/admin/imports", requireScope(si.store, bootstrapToken, "admin"))
+	g.POST("", si.create)
+	g.GET("", listHandler(si.store, stripeImportList))
+	g.GET("/:id", si.get)
+	g.POST("/:id/cancel", si.cancel)
+}
+
+func (si *StripeImports) create(c *gin.Context) {
+	var req struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+	imp := &StripeImport{
+		ID:          "imp_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		RequestedBy: c.GetString("api_key_id"),
+	}
+	if req.From != "" {
+		from, err := parseExportTime(req.From)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "from must be a date (YYYY-MM-DD) or RFC 3339 timestamp"))
+			return
+		}
+		imp.CreatedGTE = &from
+	}
+	if req.To != "" {
+		to, err := parseExportTime(req.To)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "to must be a date (YYYY-MM-DD) or RFC 3339 timestamp"))
+			return
+		}
+		imp.CreatedLT = &to
+	}
+	if imp.CreatedGTE != nil && imp.CreatedLT != nil && !imp.CreatedLT.After(*imp.CreatedGTE) {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "to must be after from"))
+		return
+	}
+	created, err := si.store.CreateStripeImport(c.Request.Context(), imp)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	logf(c.Request.Context(), "stripe import %s started by %s", created.ID, created.RequestedBy)
+	respondData(c, http.StatusAccepted, created)
+}
+
+func (si *StripeImports) get(c *gin.Context) {
+	imp, err := si.store.StripeImport(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Import not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, imp)
+}
+
+// cancel stops an open import after the page in flight.
+func (si *StripeImports) cancel(c *gin.Context) {
+	imp, err := si.store.FinishStripeImport(c.Request.Context(), c.Param("id"), importCanceled)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusConflict, errorBody(c, CodeInvalidRequest, "The import is not running"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, imp)
+}
+
+// Run works through open imports every interval until ctx is done.
+func (si *StripeImports) Run(ctx context.Context) {
+	ticker := time.NewTicker(si.interval)
+	defer ticker.Stop()
+	for {
+		if err := si.sweep(ctx); err != nil {
+			log.Printf("stripe import: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep claims open imports one at a time and runs each to the end, or
+// until a page fails.
+func (si *StripeImports) sweep(ctx context.Context) error {
+	for ctx.Err() == nil {
+		imp, err := si.store.ClaimStripeImport(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := si.run(ctx, imp); err != nil {
+			logf(ctx, "stripe import %s: %v", imp.ID, err)
+			if err := si.store.FailStripeImportPage(context.WithoutCancel(ctx), imp.ID, err.Error()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// run imports imp page by page from its cursor.
+func (si *StripeImports) run(ctx context.Context, imp *StripeImport) error {
+	cursor := imp.Cursor
+	for {
+		page, more, err := si.page(ctx, imp, cursor)
+		if err != nil {
+			return err
+		}
+		if page.cursor == "" {
+			page.cursor = cursor
+		}
+		err = si.store.AdvanceStripeImport(ctx, imp.ID, page)
+		if errors.Is(err, sql.ErrNoRows) {
+			logf(ctx, "stripe import %s canceled at %s", imp.ID, page.cursor)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cursor = page.cursor
+		if !more {
+			done, err := si.store.FinishStripeImport(ctx, imp.ID, importCompleted)
+			if err == nil {
+				logf(ctx, "stripe import %s completed: %d payments, %d charges, %d refunds, %d skipped",
+					done.ID, done.Payments, done.Charges, done.Refunds, done.Skipped)
+			}
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// page imports the PaymentIntents after cursor, reporting whether Stripe
+// has more.
+func (si *StripeImports) page(ctx context.Context, imp *StripeImport, cursor string) (stripeImportPage, bool, error) {
+	params := &stripe.PaymentIntentListParams{}
+	params.Context = ctx
+	params.Limit = stripe.Int64(importPageSize)
+	params.Single = true
+	if cursor != "" {
+		params.StartingAfter = stripe.String(cursor)
+	}
+	if imp.CreatedGTE != nil || imp.CreatedLT != nil {
+		params.CreatedRange = &stripe.RangeQueryParams{}
+		if imp.CreatedGTE != nil {
+			params.CreatedRange.GreaterThanOrEqual = imp.CreatedGTE.Unix()
+		}
+		if imp.CreatedLT != nil {
+			params.CreatedRange.LesserThan = imp.CreatedLT.Unix()
+		}
+	}
+	params.AddExpand("data.latest_charge.refunds")
+	params.AddExpand("data.payment_method")
+
+	var page stripeImportPage
+	it := paymentintent.List(params)
+	for it.Next() {
+		pi := it.PaymentIntent()
+		if err := si.save(ctx, pi, &page); err != nil {
+			return page, false, fmt.Errorf("importing %s: %w", pi.ID, err)
+		}
+		page.cursor = pi.ID
+	}
+	if err := it.Err(); err != nil {
+		return page, false, fmt.Errorf("listing payment intents: %w", err)
+	}
+	return page, it.PaymentIntentList().HasMore, nil
+}
+
+// save stores one PaymentIntent with its latest charge, card and every
+// refund.
+func (si *StripeImports) save(ctx context.Context, pi *stripe.PaymentIntent, page *stripeImportPage) error {
+	if region := regionOf(pi); region != "" && serviceRegion != "" && region != serviceRegion {
+		page.skipped++
+		stripeImported.WithLabelValues("skipped").Inc()
+		return nil
+	}
+	if err := si.payments.SavePayment(ctx, pi); err != nil {
+		return err
+	}
+	page.payments++
+	stripeImported.WithLabelValues("payment").Inc()
+
+	ch := pi.LatestCharge
+	if ch == nil || ch.ID == "" {
+		return nil
+	}
+	if ch.PaymentIntent == nil {
+		ch.PaymentIntent = &stripe.PaymentIntent{ID: pi.ID}
+	}
+	if ch.Refunds != nil && ch.Refunds.HasMore {
+		refunds, err := si.refunds(ctx, pi.ID)
+		if err != nil {
+			return err
+		}
+		ch.Refunds.Data = refunds
+	}
+	if err := si.payments.SaveCharge(ctx, ch); err != nil {
+		return err
+	}
+	page.charges++
+	stripeImported.WithLabelValues("charge").Inc()
+	if ch.Refunds != nil {
+		page.refunds += len(ch.Refunds.Data)
+		stripeImported.WithLabelValues("refund").Add(float64(len(ch.Refunds.Data)))
+	}
+	if card, ok := paymentCardOf(ch); ok {
+		if _, err := si.store.SavePaymentCard(ctx, pi.ID, card); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refunds lists every refund of a payment, for charges with more than
+// Stripe embeds.
+func (si *StripeImports) refunds(ctx context.Context, paymentID string) ([]*stripe.Refund, error) {
+	params := &stripe.RefundListParams{PaymentIntent: stripe.String(paymentID)}
+	params.Context = ctx
+	var out []*stripe.Refund
+	it := refund.List(params)
+	for it.Next() {
+		out = append(out, it.Refund())
+	}
+	return out, it.Err()
+}
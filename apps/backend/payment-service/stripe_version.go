@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/form"
+)
+
+// stripeAPIVersion is the Stripe API version the service is written
+// against and sends on every call. stripe-go pins its own version, so a
+// library upgrade can move it; startup refuses to run when the two
+// differ, and raising this is a deliberate change, made once the shadow
+// comparison against the new version comes back clean.
+const stripeAPIVersion = "2023-10-16"
+
+// stripeVersionPattern is the shape of a Stripe API version, with or
+// without a release name such as ".acacia".
+var stripeVersionPattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}(\.[a-z]+)?$`)
+
+// stripeVersionMaxDiffs caps the differences logged for one comparison.
+const stripeVersionMaxDiffs = 20
+
+var (
+	stripeVersionShadowRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_stripe_version_shadow_total",
+		Help: "Stripe reads repeated on the target API version, by result (match, mismatch, error, dropped).",
+	}, []string{"result"})
+	stripeVersionShadowDiffs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_stripe_version_shadow_diffs_total",
+		Help: "Fields a Stripe read answered differently on the target API version, by operation, field and kind (removed, added, type, changed).",
+	}, []string{"operation", "field", "kind"})
+	webhookAPIVersions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_webhook_api_version_mismatches_total",
+		Help: "Webhook events rendered in an API version other than the pinned one, by version.",
+	}, []string{"version"})
+)
+
+// checkStripeAPIVersion stops startup when stripe-go speaks a different
+// API version than the one pinned.
+func checkStripeAPIVersion() {
+	if stripe.APIVersion != stripeAPIVersion {
+		log.Fatalf("stripe-go uses Stripe API version %s but the service is pinned to %s; "+
+			"shadow test the new version with STRIPE_API_VERSION_TARGET before raising stripeAPIVersion",
+			stripe.APIVersion, stripeAPIVersion)
+	}
+}
+
+// checkWebhookAPIVersion counts and logs events Stripe rendered in
+// another API version than the pinned one: the webhook endpoint's version
+// decides their payload's shape, and an account's default version moving
+// on would otherwise change it under us unnoticed.
+func checkWebhookAPIVersion(ctx context.Context, event stripe.Event) {
+	if event.APIVersion == "" || event.APIVersion == stripeAPIVersion {
+		return
+	}
+	webhookAPIVersions.WithLabelValues(event.APIVersion).Inc()
+	logf(ctx, "webhook %s (%s): rendered in Stripe API version %s, pinned is %s",
+		event.ID, event.Type, event.APIVersion, stripeAPIVersion)
+}
+
+// APIVersionShadowConfig samples Stripe reads to repeat on the API
+// version set up with STRIPE_API_VERSION_TARGET. It can be turned up or
+// off without a restart.
+//
+//	"api_version_shadow": {"sample_rate": 0.01}
+type APIVersionShadowConfig struct {
+	// SampleRate is the share of reads repeated, 0 to 1.
+	SampleRate float64 `json:"sample_rate"`
+}
+
+func (cfg APIVersionShadowConfig) validate() error {
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return fmt.Errorf("api_version_shadow: sample_rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// versionShadowBackend tries out a Stripe API version upgrade before it
+// is made: a sample of reads is fetched again in the background, once on
+// the pinned version and once on the target, and the two answers' JSON
+// compared, the differences logged and counted by field. Reads only, so
+// nothing changes at Stripe; the caller's read goes ahead as ever and
+// never waits on the comparison.
+type versionShadowBackend struct {
+	stripe.Backend
+	target   string
+	settings *RuntimeSettings
+	timeout  time.Duration
+	// slots bounds the comparisons in flight; reads past it are dropped
+	// rather than queued.
+	slots chan struct{}
+}
+
+// installAPIVersionShadow wraps the installed API backend to compare
+// reads on STRIPE_API_VERSION_TARGET. Empty leaves it off, as does the
+// mock provider, which has no API versions.
+func installAPIVersionShadow(settings *RuntimeSettings, live bool) {
+	target := os.Getenv("STRIPE_API_VERSION_TARGET")
+	switch {
+	case target == "" || target == stripeAPIVersion:
+		return
+	case !stripeVersionPattern.MatchString(target):
+		log.Fatalf("Invalid STRIPE_API_VERSION_TARGET %q", target)
+	case !live:
+		log.Printf("STRIPE_API_VERSION_TARGET ignored with the mock provider")
+		return
+	}
+	stripe.SetBackend(stripe.APIBackend, &versionShadowBackend{
+		Backend:  stripe.GetBackend(stripe.APIBackend),
+		target:   target,
+		settings: settings,
+		timeout:  envDuration("SHADOW_TIMEOUT", 15*time.Second),
+		slots:    make(chan struct{}, envInt("SHADOW_MAX_IN_FLIGHT", 16)),
+	})
+	log.Printf("STRIPE_API_VERSION_TARGET=%s, sampled reads are compared with %s", target, stripeAPIVersion)
+}
+
+func (b *versionShadowBackend) Call(method, path, key string, params stripe.ParamsContainer, v stripe.LastResponseSetter) error {
+	rate := b.settings.Get().APIVersionShadow.SampleRate
+	if method != http.MethodGet || rate <= 0 || (rate < 1 && rand.Float64() >= rate) {
+		return b.Backend.Call(method, path, key, params, v)
+	}
+	// Encoded before the call: iterators reuse their params for every page.
+	var body *form.Values
+	common, parent := &stripe.Params{}, context.Background()
+	if p := paramsOf(params); p != nil {
+		body = &form.Values{}
+		form.AppendTo(body, params)
+		common.StripeAccount = p.StripeAccount
+		if p.Context != nil {
+			parent = p.Context
+		}
+	}
+
+	select {
+	case b.slots <- struct{}{}:
+		go func() {
+			defer func() { <-b.slots }()
+			ctx, cancel := context.WithTimeout(withRequestID(context.Background(), requestIDFrom(parent)), b.timeout)
+			defer cancel()
+			b.compare(ctx, method, path, key, body, common)
+		}()
+	default:
+		stripeVersionShadowRequests.WithLabelValues("dropped").Inc()
+	}
+	return b.Backend.Call(method, path, key, params, v)
+}
+
+// rawStripeResponse keeps an answer's JSON undecoded.
+type rawStripeResponse struct {
+	body json.RawMessage
+}
+
+func (r *rawStripeResponse) SetLastResponse(*stripe.APIResponse) {}
+
+func (r *rawStripeResponse) UnmarshalJSON(data []byte) error {
+	r.body = append(r.body[:0], data...)
+	return nil
+}
+
+// fetch repeats a read on version.
+func (b *versionShadowBackend) fetch(ctx context.Context, method, path, key, version string, body *form.Values, common *stripe.Params) (interface{}, error) {
+	p := *common
+	p.Context = ctx
+	p.Headers = http.Header{"Stripe-Version": []string{version}}
+	var raw rawStripeResponse
+	if err := b.Backend.CallRaw(method, path, key, body, &p, &raw); err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw.body, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// compare reads path on both versions and reports how the answers differ.
+func (b *versionShadowBackend) compare(ctx context.Context, method, path, key string, body *form.Values, common *stripe.Params) {
+	op, _ := stripeOperation(method, path)
+	pinned, err := b.fetch(ctx, method, path, key, stripeAPIVersion, body, common)
+	if err != nil {
+		stripeVersionShadowRequests.WithLabelValues("error").Inc()
+		logf(ctx, "stripe version shadow %s: reading on %s: %v", op, stripeAPIVersion, err)
+		return
+	}
+	target, err := b.fetch(ctx, method, path, key, b.target, body, common)
+	if err != nil {
+		stripeVersionShadowRequests.WithLabelValues("error").Inc()
+		logf(ctx, "stripe version shadow %s: reading on %s: %v", op, b.target, err)
+		return
+	}
+
+	diffs := stripeVersionDiffs(pinned, target)
+	if len(diffs) == 0 {
+		stripeVersionShadowRequests.WithLabelValues("match").Inc()
+		return
+	}
+	stripeVersionShadowRequests.WithLabelValues("mismatch").Inc()
+	for _, d := range diffs {
+		stripeVersionShadowDiffs.WithLabelValues(op, d.Field, d.kind).Inc()
+	}
+	if len(diffs) > stripeVersionMaxDiffs {
+		diffs = diffs[:stripeVersionMaxDiffs]
+	}
+	parts := make([]string, len(diffs))
+	for i, d := range diffs {
+		parts[i] = fmt.Sprintf("%s %s (%s/%s)", d.Field, d.kind, d.From, d.To)
+	}
+	logf(ctx, "stripe version shadow %s %s: %s differs from %s on %s",
+		op, strings.TrimPrefix(path, "/v1/"), b.target, stripeAPIVersion, strings.Join(parts, ", "))
+}
+
+// stripeVersionDiff is a field the two versions answered differently.
+// Field is its path, with list elements as "[]"; From and To are the
+// pinned and target versions' values, or their types for kind "type".
+type stripeVersionDiff struct {
+	resyncChange
+	kind string
+}
+
+// stripeVersionDiffs walks two answers for fields removed, added, of
+// another type or with another value on the target version. Metadata is
+// the caller's own and skipped; lists are compared element by element as
+// far as both go.
+func stripeVersionDiffs(pinned, target interface{}) []stripeVersionDiff {
+	var diffs []stripeVersionDiff
+	var walk func(field string, a, b interface{})
+	walk = func(field string, a, b interface{}) {
+		ta, tb := jsonKind(a), jsonKind(b)
+		if ta != tb {
+			diffs = append(diffs, stripeVersionDiff{resyncChange{field, ta, tb}, "type"})
+			return
+		}
+		switch a := a.(type) {
+		case map[string]interface{}:
+			b := b.(map[string]interface{})
+			keys := make([]string, 0, len(a)+len(b))
+			for k := range a {
+				keys = append(keys, k)
+			}
+			for k := range b {
+				if _, ok := a[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if k == "metadata" {
+					continue
+				}
+				sub := k
+				if field != "" {
+					sub = field + "." + k
+				}
+				av, inA := a[k]
+				bv, inB := b[k]
+				switch {
+				case !inB:
+					diffs = append(diffs, stripeVersionDiff{resyncChange{sub, jsonKind(av), ""}, "removed"})
+				case !inA:
+					diffs = append(diffs, stripeVersionDiff{resyncChange{sub, "", jsonKind(bv)}, "added"})
+				default:
+					walk(sub, av, bv)
+				}
+			}
+		case []interface{}:
+			b := b.([]interface{})
+			for i := 0; i < len(a) && i < len(b); i++ {
+				walk(field+"[]", a[i], b[i])
+			}
+		default:
+			if fmt.Sprint(a) != fmt.Sprint(b) {
+				diffs = append(diffs, stripeVersionDiff{resyncChange{field, fmt.Sprint(a), fmt.Sprint(b)}, "changed"})
+			}
+		}
+	}
+	walk("", pinned, target)
+	return dedupeVersionDiffs(diffs)
+}
+
+// dedupeVersionDiffs keeps one of each field and kind, as list elements
+// tend to differ alike.
+func dedupeVersionDiffs(diffs []stripeVersionDiff) []stripeVersionDiff {
+	seen := map[string]bool{}
+	out := diffs[:0]
+	for _, d := range diffs {
+		if k := d.Field + " " + d.kind; !seen[k] {
+			seen[k] = true
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+)
+
+var surchargesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_surcharges_total",
+	Help: "Card surcharges at payment creation, by outcome (applied, capped, disallowed).",
+}, []string{"outcome"})
+
+// Metadata recording a payment's surcharge, part of its pre-tip amount,
+// and the percentage it was worked out at.
+const (
+	metadataSurcharge     = "surcharge_amount"
+	metadataSurchargeRate = "surcharge_rate"
+)
+
+// surchargeFundings are the card funding types surcharge rules are set
+// for. Other payment methods, bank debits among them, are never
+// surcharged.
+var surchargeFundings = []string{"credit", "debit", "prepaid"}
+
+// defaultSurchargeCaps are the legal maximums, in percent, where
+// surcharging is capped: the US card networks' 3% and Canada's 2.4%.
+var defaultSurchargeCaps = map[string]float64{"US": 3, "CA": 2.4}
+
+// defaultSurchargeDisallowed are the jurisdictions that ban surcharging
+// consumer cards: the EEA under PSD2, and the UK.
+var defaultSurchargeDisallowed = []string{
+	"AT", "BE", "BG", "CY", "CZ", "DE", "DK", "EE", "ES", "FI", "FR", "GR", "HR", "HU", "IE", "IT", "LT", "LU",
+	"LV", "MT", "NL", "PL", "PT", "RO", "SE", "SI", "SK", "IS", "LI", "NO", "GB",
+}
+
+// SurchargeConfig adds a percentage to card payments by funding type,
+// passing the card fee on to the customer where the law allows it. A
+// tenant's rules replace the default ones. The jurisdiction is the
+// payment's customer_country, or else the card's country; payments in a
+// disallowed jurisdiction, or one the rules don't list, aren't
+// surcharged, and none is surcharged above its jurisdiction's cap. Caps
+// and Disallowed, when set, replace the built-in lists.
+//
+//	"surcharges": {
+//	  "default": {"percent": {"credit": 1.5, "prepaid": 1.5}, "jurisdictions": ["US", "AU"]},
+//	  "tenants": {"acme": {"percent": {"credit": 2.5}}},
+//	  "caps": {"US": 3, "CA": 2.4, "AU": 1.5},
+//	  "disallowed": ["GB", "DE"]
+//	}
+type SurchargeConfig struct {
+	Default    SurchargeRules            `json:"default"`
+	Tenants    map[string]SurchargeRules `json:"tenants"`
+	Caps       map[string]float64        `json:"caps"`
+	Disallowed []string                  `json:"disallowed"`
+}
+
+// SurchargeRules are the percentages per card funding type, credit,
+// debit or prepaid; a funding type left out is not surcharged.
+// Jurisdictions limits them to those countries; empty means everywhere
+// surcharging isn't disallowed.
+type SurchargeRules struct {
+	Percent       map[string]float64 `json:"percent"`
+	Jurisdictions []string           `json:"jurisdictions"`
+}
+
+func (cfg SurchargeConfig) validate() error {
+	for country, cap := range cfg.Caps {
+		if len(country) != 2 || cap < 0 || cap > 10 {
+			return fmt.Errorf("surcharges: caps %s must be a two-letter country and between 0 and 10", country)
+		}
+	}
+	for _, country := range cfg.Disallowed {
+		if len(country) != 2 {
+			return fmt.Errorf("surcharges: disallowed %q is not a two-letter country", country)
+		}
+	}
+	if err := cfg.validateRules("default", cfg.Default); err != nil {
+		return err
+	}
+	for tenant, rules := range cfg.Tenants {
+		if err := cfg.validateRules("tenants."+tenant, rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateRules also refuses rules that surcharge a jurisdiction they
+// list beyond its legal cap, or at all where that is disallowed.
+func (cfg SurchargeConfig) validateRules(name string, rules SurchargeRules) error {
+	for funding, percent := range rules.Percent {
+		if !containsString(surchargeFundings, funding) {
+			return fmt.Errorf("surcharges %s: percent %q must be credit, debit or prepaid", name, funding)
+		}
+		if percent < 0 || percent > 10 {
+			return fmt.Errorf("surcharges %s: percent %s must be between 0 and 10", name, funding)
+		}
+	}
+	for _, country := range rules.Jurisdictions {
+		country = strings.ToUpper(country)
+		if len(country) != 2 {
+			return fmt.Errorf("surcharges %s: jurisdiction %q is not a two-letter country", name, country)
+		}
+		if cfg.disallowed(country) {
+			return fmt.Errorf("surcharges %s: surcharging is not allowed in %s", name, country)
+		}
+		cap, capped := cfg.cap(country)
+		for funding, percent := range rules.Percent {
+			if capped && percent > cap {
+				return fmt.Errorf("surcharges %s: percent %s of %g exceeds the %g%% legal cap in %s", name, funding, percent, cap, country)
+			}
+		}
+	}
+	return nil
+}
+
+func (cfg SurchargeConfig) rules(tenantID string) SurchargeRules {
+	if rules, ok := cfg.Tenants[tenantID]; ok && tenantID != "" {
+		return rules
+	}
+	return cfg.Default
+}
+
+func (cfg SurchargeConfig) cap(country string) (float64, bool) {
+	caps := cfg.Caps
+	if caps == nil {
+		caps = defaultSurchargeCaps
+	}
+	cap, ok := caps[country]
+	return cap, ok
+}
+
+func (cfg SurchargeConfig) disallowed(country string) bool {
+	disallowed := cfg.Disallowed
+	if disallowed == nil {
+		disallowed = defaultSurchargeDisallowed
+	}
+	return containsFold(disallowed, country)
+}
+
+// cardSurcharge is what a payment is surcharged, in minor units of its
+// currency, at Rate percent.
+type cardSurcharge struct {
+	Amount int64
+	Rate   float64
+}
+
+// surcharge works out req's surcharge on amount, rounded by mode, for
+// the card it is paid with. Payments whose card isn't known up front
+// aren't surcharged.
+func (cfg SurchargeConfig) surcharge(req PaymentRequest, card paymentCard, amount int64, mode RoundingMode) cardSurcharge {
+	rules := cfg.rules(req.TenantID)
+	rate := rules.Percent[card.Funding]
+	if rate <= 0 || amount <= 0 {
+		return cardSurcharge{}
+	}
+	country := strings.ToUpper(req.CustomerCountry)
+	if country == "" {
+		country = strings.ToUpper(card.Country)
+	}
+	if country == "" {
+		return cardSurcharge{}
+	}
+	if cfg.disallowed(country) {
+		surchargesTotal.WithLabelValues("disallowed").Inc()
+		return cardSurcharge{}
+	}
+	if len(rules.Jurisdictions) > 0 && !containsFold(rules.Jurisdictions, country) {
+		return cardSurcharge{}
+	}
+	outcome := "applied"
+	if cap, ok := cfg.cap(country); ok && rate > cap {
+		rate, outcome = cap, "capped"
+	}
+	surchargesTotal.WithLabelValues(outcome).Inc()
+	return cardSurcharge{Amount: percentOf(amount, rate, mode), Rate: rate}
+}
+
+func (sc cardSurcharge) addMetadata(params *stripe.PaymentIntentParams) {
+	if sc.Amount == 0 {
+		return
+	}
+	params.AddMetadata(metadataSurcharge, strconv.FormatInt(sc.Amount, 10))
+	params.AddMetadata(metadataSurchargeRate, strconv.FormatFloat(sc.Rate, 'f', -1, 64))
+}
+
+// surchargeOf reads the surcharge recorded on pi.
+func surchargeOf(pi *stripe.PaymentIntent) int64 {
+	amount, _ := strconv.ParseInt(pi.Metadata[metadataSurcharge], 10, 64)
+	return amount
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// Tax ID types, as Stripe names them. EU VAT numbers are checked against
+// VIES; the others, which have no registry we can ask, by format only.
+const (
+	taxIDEUVAT = "eu_vat"
+	taxIDGBVAT = "gb_vat"
+	taxIDCHVAT = "ch_vat"
+	taxIDNOVAT = "no_vat"
+	taxIDAUABN = "au_abn"
+)
+
+// Verification statuses of a tax ID. pending is a VIES check that
+// couldn't be made yet; unavailable is a type nobody can check.
+const (
+	taxIDVerified    = "verified"
+	taxIDUnverified  = "unverified"
+	taxIDPending     = "pending"
+	taxIDUnavailable = "unavailable"
+)
+
+// Tax treatments of a payment to a business customer. Reverse charge is
+// a sale to a VAT-registered business in another EU country, which
+// accounts for the VAT itself; zero-rated is a sale to a business
+// outside the EU, which is outside the scope of EU VAT.
+const (
+	taxReverseCharge = "reverse_charge"
+	taxZeroRated     = "zero_rated"
+)
+
+// Metadata recording a payment's tax treatment and the tax ID it rests on.
+const (
+	metadataTaxTreatment  = "tax_treatment"
+	metadataCustomerTaxID = "customer_tax_id"
+)
+
+// euVATFormats are the VAT number formats of the EU member states after
+// the country prefix. Greece's prefix is EL; XI is Northern Ireland,
+// which stays in the EU VAT area for goods.
+var euVATFormats = map[string]*regexp.Regexp{
+	"AT": regexp.MustCompile(`^U\d{8}$`),
+	"BE": regexp.MustCompile(`^[01]\d{9}$`),
+	"BG": regexp.MustCompile(`^\d{9,10}$`),
+	"CY": regexp.MustCompile(`^\d{8}[A-Z]$`),
+	"CZ": regexp.MustCompile(`^\d{8,10}$`),
+	"DE": regexp.MustCompile(`^\d{9}$`),
+	"DK": regexp.MustCompile(`^\d{8}$`),
+	"EE": regexp.MustCompile(`^\d{9}$`),
+	"EL": regexp.MustCompile(`^\d{9}$`),
+	"ES": regexp.MustCompile(`^[A-Z0-9]\d{7}[A-Z0-9]$`),
+	"FI": regexp.MustCompile(`^\d{8}$`),
+	"FR": regexp.MustCompile(`^[A-HJ-NP-Z0-9]{2}\d{9}$`),
+	"HR": regexp.MustCompile(`^\d{11}$`),
+	"HU": regexp.MustCompile(`^\d{8}$`),
+	"IE": regexp.MustCompile(`^(\d{7}[A-W][A-IW]?|\d[A-Z+*]\d{5}[A-W])$`),
+	"IT": regexp.MustCompile(`^\d{11}$`),
+	"LT": regexp.MustCompile(`^(\d{9}|\d{12})$`),
+	"LU": regexp.MustCompile(`^\d{8}$`),
+	"LV": regexp.MustCompile(`^\d{11}$`),
+	"MT": regexp.MustCompile(`^\d{8}$`),
+	"NL": regexp.MustCompile(`^\d{9}B\d{2}$`),
+	"PL": regexp.MustCompile(`^\d{10}$`),
+	"PT": regexp.MustCompile(`^\d{9}$`),
+	"RO": regexp.MustCompile(`^[1-9]\d{1,9}$`),
+	"SE": regexp.MustCompile(`^\d{10}01$`),
+	"SI": regexp.MustCompile(`^\d{8}$`),
+	"SK": regexp.MustCompile(`^\d{10}$`),
+	"XI": regexp.MustCompile(`^(\d{9}|\d{12}|GD\d{3}|HA\d{3})$`),
+}
+
+// taxIDFormats are the other types' countries and formats, prefix
+// included.
+var taxIDFormats = map[string]struct {
+	country string
+	format  *regexp.Regexp
+}{
+	taxIDGBVAT: {"GB", regexp.MustCompile(`^GB(\d{9}|\d{12}|GD\d{3}|HA\d{3})$`)},
+	taxIDCHVAT: {"CH", regexp.MustCompile(`^CHE\d{9}(MWST|TVA|IVA)?$`)},
+	taxIDNOVAT: {"NO", regexp.MustCompile(`^NO\d{9}MVA$`)},
+	taxIDAUABN: {"AU", regexp.MustCompile(`^\d{11}$`)},
+}
+
+// normalizeTaxID returns value without spaces, dots and dashes and in
+// upper case, and the country it was issued in, or false when it isn't
+// a well-formed number of that type. EU VAT numbers may come as GR
+// rather than EL.
+func normalizeTaxID(typ, value string) (string, string, bool) {
+	value = strings.ToUpper(strings.NewReplacer(" ", "", ".", "", "-", "").Replace(value))
+	if typ == taxIDEUVAT {
+		if strings.HasPrefix(value, "GR") {
+			value = "EL" + value[2:]
+		}
+		if len(value) < 3 {
+			return "", "", false
+		}
+		format, ok := euVATFormats[value[:2]]
+		return value, value[:2], ok && format.MatchString(value[2:])
+	}
+	f, ok := taxIDFormats[typ]
+	return value, f.country, ok && f.format.MatchString(value)
+}
+
+// euVATCountry is the member state a VAT number was issued by, or "" when
+// it isn't an EU VAT number.
+func euVATCountry(vatID string) string {
+	if _, country, ok := normalizeTaxID(taxIDEUVAT, vatID); ok {
+		return country
+	}
+	return ""
+}
+
+// TaxID is a customer's tax ID and what checking it returned. A verified
+// EU VAT number carries the name and address VIES has for it and the
+// consultation number proving it was valid when checked.
+type TaxID struct {
+	ID                 string     `json:"id"`
+	TenantID           string     `json:"tenant_id,omitempty"`
+	CustomerID         string     `json:"customer_id"`
+	Type               string     `json:"type"`
+	Value              string     `json:"value"`
+	Country            string     `json:"country"`
+	Status             string     `json:"status"`
+	VerifiedName       string     `json:"verified_name,omitempty"`
+	VerifiedAddress    string     `json:"verified_address,omitempty"`
+	ConsultationNumber string     `json:"consultation_number,omitempty"`
+	CheckedAt          *time.Time `json:"checked_at,omitempty"`
+	NextCheckAt        *time.Time `json:"next_check_at,omitempty"`
+	CreatedAt          time.Time  `json:"created_at"`
+}
+
+const taxIDColumns = `id, tenant_id, customer_id, type, value, country, status, verified_name, verified_address,
+	consultation_number, checked_at, next_check_at, created_at`
+
+func scanTaxID(row interface{ Scan(...interface{}) error }) (*TaxID, error) {
+	var t TaxID
+	if err := row.Scan(&t.ID, &t.TenantID, &t.CustomerID, &t.Type, &t.Value, &t.Country, &t.Status, &t.VerifiedName,
+		&t.VerifiedAddress, &t.ConsultationNumber, &t.CheckedAt, &t.NextCheckAt, &t.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// CreateTaxID stores a new tax ID, returning sql.ErrNoRows when the
+// customer already has it.
+func (s *Store) CreateTaxID(ctx context.Context, t *TaxID) (*TaxID, error) {
+	return scanTaxID(s.db.QueryRowContext(ctx, `
+		INSERT INTO customer_tax_ids (id, tenant_id, customer_id, type, value, country, status, verified_name,
+			verified_address, consultation_number, checked_at, next_check_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (tenant_id, customer_id, type, value) DO NOTHING
+		RETURNING `+taxIDColumns,
+		t.ID, t.TenantID, t.CustomerID, t.Type, t.Value, t.Country, t.Status, t.VerifiedName,
+		t.VerifiedAddress, t.ConsultationNumber, t.CheckedAt, t.NextCheckAt))
+}
+
+// saveTaxIDCheck records the result of checking a stored tax ID.
+func (s *Store) saveTaxIDCheck(ctx context.Context, t *TaxID) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE customer_tax_ids SET status = $2, verified_name = $3, verified_address = $4, consultation_number = $5,
+			checked_at = $6, next_check_at = $7
+		WHERE id = $1`, t.ID, t.Status, t.VerifiedName, t.VerifiedAddress, t.ConsultationNumber, t.CheckedAt, t.NextCheckAt)
+	return err
+}
+
+// CustomerTaxID returns one of a customer's tax IDs, or sql.ErrNoRows.
+func (s *Store) CustomerTaxID(ctx context.Context, tenantID, customerID, id string) (*TaxID, error) {
+	return scanTaxID(s.db.QueryRowContext(ctx, `
+		SELECT `+taxIDColumns+` FROM customer_tax_ids WHERE id = $1 AND tenant_id = $2 AND customer_id = $3`,
+		id, tenantID, customerID))
+}
+
+// CustomerTaxIDs returns a customer's tax IDs, oldest first.
+func (s *Store) CustomerTaxIDs(ctx context.Context, tenantID, customerID string) ([]*TaxID, error) {
+	return s.queryTaxIDs(ctx, `
+		SELECT `+taxIDColumns+` FROM customer_tax_ids WHERE tenant_id = $1 AND customer_id = $2
+		ORDER BY created_at, id`, tenantID, customerID)
+}
+
+// DueTaxIDChecks returns pending tax IDs whose next check is due.
+func (s *Store) DueTaxIDChecks(ctx context.Context, limit int) ([]*TaxID, error) {
+	return s.queryTaxIDs(ctx, `
+		SELECT `+taxIDColumns+` FROM customer_tax_ids WHERE status = 'pending' AND next_check_at <= now()
+		ORDER BY next_check_at
+		LIMIT $1`, limit)
+}
+
+func (s *Store) queryTaxIDs(ctx context.Context, query string, args ...interface{}) ([]*TaxID, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []*TaxID{}
+	for rows.Next() {
+		t, err := scanTaxID(rows)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, t)
+	}
+	return ids, rows.Err()
+}
+
+// DeleteCustomerTaxID removes one of a customer's tax IDs, returning
+// sql.ErrNoRows when there is no such ID.
+func (s *Store) DeleteCustomerTaxID(ctx context.Context, tenantID, customerID, id string) error {
+	res, err := s.db.ExecContext(ctx, `
+		DELETE FROM customer_tax_ids WHERE id = $1 AND tenant_id = $2 AND customer_id = $3`, id, tenantID, customerID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// viesResult is what VIES says about a VAT number.
+type viesResult struct {
+	Valid              bool
+	Name               string
+	Address            string
+	ConsultationNumber string
+}
+
+// vatChecker checks a VAT number with its member state. requester is the
+// seller's own VAT number, which VIES needs to issue a consultation
+// number; it may be empty. An error means the check couldn't be made.
+type vatChecker interface {
+	Check(ctx context.Context, vatID, requester string) (*viesResult, error)
+}
+
+// defaultVIESURL is the European Commission's VIES REST endpoint.
+const defaultVIESURL = "https://ec.europa.eu/taxation_customs/vies/rest-api/check-vat-number"
+
+// VIES checks VAT numbers with the European Commission's VAT Information
+// Exchange System, which asks the member state's registry. Registries go
+// down for maintenance often, which is reported as an error.
+type VIES struct {
+	url  string
+	http *http.Client
+}
+
+func NewVIES(url string) *VIES {
+	if url == "" {
+		url = defaultVIESURL
+	}
+	return &VIES{url: url, http: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (v *VIES) Check(ctx context.Context, vatID, requester string) (*viesResult, error) {
+	body := map[string]string{"countryCode": vatID[:2], "vatNumber": vatID[2:]}
+	if requester != "" {
+		body["requesterMemberStateCode"], body["requesterNumber"] = requester[:2], requester[2:]
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("VIES request: %w", err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Valid             bool   `json:"valid"`
+		Name              string `json:"name"`
+		Address           string `json:"address"`
+		RequestIdentifier string `json:"requestIdentifier"`
+		ErrorWrappers     []struct {
+			Error string `json:"error"`
+		} `json:"errorWrappers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil && resp.StatusCode < 300 {
+		return nil, fmt.Errorf("decoding VIES response: %w", err)
+	}
+	if len(out.ErrorWrappers) > 0 {
+		return nil, fmt.Errorf("VIES: %s", out.ErrorWrappers[0].Error)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("VIES returned %s", resp.Status)
+	}
+	// VIES answers "---" for a name or address the member state doesn't
+	// share.
+	clean := func(s string) string {
+		if s = strings.TrimSpace(s); s == "---" {
+			return ""
+		}
+		return s
+	}
+	return &viesResult{Valid: out.Valid, Name: clean(out.Name), Address: clean(out.Address), ConsultationNumber: out.RequestIdentifier}, nil
+}
+
+// taxTreatment is how a payment from a customer is taxed, given the
+// seller's invoice profile and the customer's tax IDs, and the ID it
+// rests on; "" is the seller's usual VAT. Only a seller with an EU VAT
+// number reverse-charges or zero-rates anything: a verified VAT number
+// from another member state is reverse-charged, and the tax ID of a
+// business outside the EU is zero-rated unless its registry rejected it.
+func taxTreatment(seller InvoiceProfile, ids []*TaxID) (string, *TaxID) {
+	home := euVATCountry(seller.VATID)
+	if home == "" {
+		return "", nil
+	}
+	var zeroRated *TaxID
+	for _, t := range ids {
+		switch {
+		case t.Type == taxIDEUVAT && t.Status == taxIDVerified && t.Country != home:
+			return taxReverseCharge, t
+		case t.Type != taxIDEUVAT && t.Status != taxIDUnverified && zeroRated == nil:
+			zeroRated = t
+		}
+	}
+	if zeroRated != nil {
+		return taxZeroRated, zeroRated
+	}
+	return "", nil
+}
+
+// addTaxTreatment records on params how the payment is taxed, so its
+// invoice shows the treatment the customer had when they paid. A tax
+// treatment in the request's own metadata is dropped. If the customer's
+// tax IDs can't be read the payment goes ahead with the usual VAT.
+func (s *PaymentService) addTaxTreatment(ctx context.Context, req PaymentRequest, params *stripe.PaymentIntentParams) {
+	delete(params.Metadata, metadataTaxTreatment)
+	delete(params.Metadata, metadataCustomerTaxID)
+	if s.store == nil || req.CustomerID == "" {
+		return
+	}
+	ids, err := s.store.CustomerTaxIDs(ctx, req.TenantID, req.CustomerID)
+	if err != nil {
+		logf(ctx, "tax IDs of customer %s: %v", req.CustomerID, err)
+		return
+	}
+	treatment, id := taxTreatment(s.settings.Get().Invoices.effective(req.TenantID), ids)
+	if treatment != "" {
+		params.AddMetadata(metadataTaxTreatment, treatment)
+		params.AddMetadata(metadataCustomerTaxID, id.Value)
+	}
+}
+
+// TaxIDs keeps customers' tax IDs: VAT numbers checked against VIES when
+// they are added, again in the background while VIES can't be reached,
+// and on request. Payments from a customer with one are reverse-charged
+// or zero-rated per taxTreatment.
+type TaxIDs struct {
+	store    *Store
+	settings *RuntimeSettings
+	vies     vatChecker
+	interval time.Duration
+}
+
+func NewTaxIDs(store *Store, settings *RuntimeSettings, vies vatChecker, interval time.Duration) *TaxIDs {
+	return &TaxIDs{store: store, settings: settings, vies: vies, interval: interval}
+}
+
+// RegisterRoutes mounts customers' tax IDs under the customers scope. They
+// take the tenant as ?tenant_id=.
+func (t *TaxIDs) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/customers/:id/tax-ids", requireScope(t.store, bootstrapToken, "customers"), t.requireStore)
+	g.POST("", t.create)
+	g.GET("", t.list)
+	g.POST("/:tax_id/verify", t.verify)
+	g.DELETE("/:tax_id", t.delete)
+}
+
+func (t *TaxIDs) requireStore(c *gin.Context) {
+	if t.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Tax IDs require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// check checks an EU VAT number with VIES and sets what it returned. A
+// check that couldn't be made leaves it pending, to be tried again.
+// Other types can't be checked and are unavailable.
+func (t *TaxIDs) check(ctx context.Context, id *TaxID) {
+	now := time.Now().UTC()
+	if id.Type != taxIDEUVAT {
+		id.Status = taxIDUnavailable
+		return
+	}
+	requester, _, ok := normalizeTaxID(taxIDEUVAT, t.settings.Get().Invoices.effective(id.TenantID).VATID)
+	if !ok {
+		requester = ""
+	}
+	res, err := t.vies.Check(ctx, id.Value, requester)
+	if err != nil {
+		logf(ctx, "checking VAT number %s: %v", id.Value, err)
+		// A number checked before keeps its last result.
+		if id.CheckedAt == nil {
+			next := now.Add(t.interval)
+			id.Status, id.NextCheckAt = taxIDPending, &next
+		}
+		return
+	}
+	id.CheckedAt, id.NextCheckAt = &now, nil
+	id.VerifiedName, id.VerifiedAddress, id.ConsultationNumber = "", "", ""
+	if !res.Valid {
+		id.Status = taxIDUnverified
+		return
+	}
+	id.Status = taxIDVerified
+	id.VerifiedName, id.VerifiedAddress, id.ConsultationNumber = res.Name, res.Address, res.ConsultationNumber
+}
+
+// create adds a tax ID to a customer, checking it first. Adding one the
+// customer already has checks it again.
+func (t *TaxIDs) create(c *gin.Context) {
+	var req struct {
+		TenantID string `json:"tenant_id"`
+		Type     string `json:"type" binding:"required,oneof=eu_vat gb_vat ch_vat no_vat au_abn"`
+		Value    string `json:"value" binding:"required"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	value, country, ok := normalizeTaxID(req.Type, req.Value)
+	if !ok {
+		validationFailed(c, []FieldError{{Field: "value", Code: "invalid", Message: "is not a well-formed " + req.Type + " number"}})
+		return
+	}
+	ctx := c.Request.Context()
+	customerID := c.Param("id")
+	existing, err := t.store.CustomerTaxIDs(ctx, req.TenantID, customerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	for _, id := range existing {
+		if id.Type == req.Type && id.Value == value {
+			t.recheck(c, id)
+			return
+		}
+	}
+
+	id := &TaxID{
+		ID:         "txi_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		TenantID:   req.TenantID,
+		CustomerID: customerID,
+		Type:       req.Type,
+		Value:      value,
+		Country:    country,
+	}
+	t.check(ctx, id)
+	created, err := t.store.CreateTaxID(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Added by a concurrent request; this check is as good as its.
+		respondData(c, http.StatusOK, id)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusCreated, created)
+}
+
+// list returns the customer's tax IDs with the tax treatment payments
+// from them get now.
+func (t *TaxIDs) list(c *gin.Context) {
+	tenantID := c.Query("tenant_id")
+	ids, err := t.store.CustomerTaxIDs(c.Request.Context(), tenantID, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	treatment, _ := taxTreatment(t.settings.Get().Invoices.effective(tenantID), ids)
+	if treatment == "" {
+		treatment = "standard"
+	}
+	respondList(c, http.StatusOK, ids, gin.H{"tax_treatment": treatment})
+}
+
+// verify checks a tax ID again, such as a VAT number that may have been
+// deregistered since.
+func (t *TaxIDs) verify(c *gin.Context) {
+	id, err := t.store.CustomerTaxID(c.Request.Context(), c.Query("tenant_id"), c.Param("id"), c.Param("tax_id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Tax ID not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	t.recheck(c, id)
+}
+
+func (t *TaxIDs) recheck(c *gin.Context, id *TaxID) {
+	t.check(c.Request.Context(), id)
+	if err := t.store.saveTaxIDCheck(c.Request.Context(), id); err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, id)
+}
+
+func (t *TaxIDs) delete(c *gin.Context) {
+	err := t.store.DeleteCustomerTaxID(c.Request.Context(), c.Query("tenant_id"), c.Param("id"), c.Param("tax_id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Tax ID not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Run checks pending VAT numbers again every interval until ctx is done.
+func (t *TaxIDs) Run(ctx context.Context) {
+	if t == nil || t.store == nil {
+		return
+	}
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		if err := t.checkPending(ctx); err != nil {
+			log.Printf("tax ID checks: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *TaxIDs) checkPending(ctx context.Context) error {
+	ids, err := t.store.DueTaxIDChecks(ctx, 100)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		t.check(ctx, id)
+		if err := t.store.saveTaxIDCheck(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/form"
+	"golang.org/x/time/rate"
+)
+
+var (
+	tenantProviderCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_tenant_provider_calls_total",
+		Help: "Provider calls under tenant limits, by tenant (configured ones by name, the rest as other) and outcome (immediate, queued, throttled).",
+	}, []string{"tenant", "outcome"})
+	tenantProviderWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "payment_service_tenant_provider_wait_seconds",
+		Help:    "How long provider calls waited for their tenant's rate or a share of the account's concurrency.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"tenant"})
+)
+
+// errTenantThrottled refuses a provider call its tenant has no room for
+// within max_wait_ms.
+var errTenantThrottled = errors.New("tenant provider limit reached")
+
+const (
+	defaultTenantMaxWait   = 2 * time.Second
+	defaultTenantMaxQueued = 100
+	tenantLaneIdle         = 5 * time.Minute
+)
+
+// TenantLimit caps one tenant's provider calls. 0 is unlimited.
+type TenantLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	MaxConcurrent     int     `json:"max_concurrent"`
+}
+
+// TenantLimitConfig shares the Stripe account between tenants. The
+// top-level limit applies to every tenant, and tenants overrides it
+// field by field. account_max_concurrent caps calls in flight for all
+// tenants together; when it is reached, waiting calls are let through a
+// tenant at a time, in turn, rather than first come first served. A call
+// that cannot start within max_wait_ms (0 means 2000), or finds
+// max_queued (0 means 100) of its tenant's calls already waiting, is
+// refused as rate_limited.
+//
+//	"tenant_limits": {"requests_per_second": 20, "burst": 40, "max_concurrent": 10,
+//	  "account_max_concurrent": 64, "max_wait_ms": 2000,
+//	  "tenants": {"acme": {"requests_per_second": 60, "max_concurrent": 30}}}
+type TenantLimitConfig struct {
+	TenantLimit
+	AccountMaxConcurrent int                    `json:"account_max_concurrent"`
+	MaxQueued            int                    `json:"max_queued"`
+	MaxWaitMS            int                    `json:"max_wait_ms"`
+	Tenants              map[string]TenantLimit `json:"tenants"`
+}
+
+func (cfg TenantLimitConfig) validate() error {
+	limits := map[string]TenantLimit{"": cfg.TenantLimit}
+	for tenant, l := range cfg.Tenants {
+		limits[tenant] = l
+	}
+	for tenant, l := range limits {
+		if l.RequestsPerSecond < 0 || l.Burst < 0 || l.MaxConcurrent < 0 {
+			return fmt.Errorf("tenant_limits: %q values must not be negative", tenant)
+		}
+	}
+	if cfg.AccountMaxConcurrent < 0 || cfg.MaxQueued < 0 || cfg.MaxWaitMS < 0 {
+		return fmt.Errorf("tenant_limits values must not be negative")
+	}
+	return nil
+}
+
+func (cfg TenantLimitConfig) enabled() bool {
+	return cfg.RequestsPerSecond > 0 || cfg.MaxConcurrent > 0 || cfg.AccountMaxConcurrent > 0 || len(cfg.Tenants) > 0
+}
+
+// limit is tenant's caps. Calls naming no tenant share the account's
+// concurrency but have no caps of their own.
+func (cfg TenantLimitConfig) limit(tenant string) TenantLimit {
+	if tenant == "" {
+		return TenantLimit{}
+	}
+	l := cfg.TenantLimit
+	if o, ok := cfg.Tenants[tenant]; ok {
+		if o.RequestsPerSecond > 0 {
+			l.RequestsPerSecond = o.RequestsPerSecond
+		}
+		if o.Burst > 0 {
+			l.Burst = o.Burst
+		}
+		if o.MaxConcurrent > 0 {
+			l.MaxConcurrent = o.MaxConcurrent
+		}
+	}
+	return l
+}
+
+func (cfg TenantLimitConfig) maxWait() time.Duration {
+	if cfg.MaxWaitMS == 0 {
+		return defaultTenantMaxWait
+	}
+	return time.Duration(cfg.MaxWaitMS) * time.Millisecond
+}
+
+func (cfg TenantLimitConfig) maxQueued() int {
+	if cfg.MaxQueued == 0 {
+		return defaultTenantMaxQueued
+	}
+	return cfg.MaxQueued
+}
+
+// tenantLabel keeps the metrics to the tenants named in the config.
+func (cfg TenantLimitConfig) tenantLabel(tenant string) string {
+	if _, ok := cfg.Tenants[tenant]; ok {
+		return tenant
+	}
+	return "other"
+}
+
+// tenantLane is one tenant's calls: its rate, those in flight and those
+// waiting for a turn, oldest first.
+type tenantLane struct {
+	limiter       *rate.Limiter
+	maxConcurrent int
+	inflight      int
+	waiting       []chan struct{}
+	seen          time.Time
+}
+
+// tenantLimitBackend keeps a flash sale by one tenant from spending the
+// whole Stripe account's rate limit: each call is held to its tenant's
+// rate and concurrency, and beyond account_max_concurrent the tenants
+// with calls waiting take turns. The tenant is the tenant_id metadata
+// the call carries, as payment creations do. It wraps every other
+// backend, so a call it refuses never reaches the provider or counts
+// against provider routing's health.
+type tenantLimitBackend struct {
+	stripe.Backend
+	settings *RuntimeSettings
+
+	mu       sync.Mutex
+	lanes    map[string]*tenantLane
+	inflight int
+	// turns are the lanes with calls waiting; next is whose turn is next.
+	turns []*tenantLane
+	next  int
+	swept time.Time
+}
+
+// installTenantLimits wraps the installed API backend. The limits follow
+// the runtime config and are off until tenant_limits sets one.
+func installTenantLimits(settings *RuntimeSettings) {
+	stripe.SetBackend(stripe.APIBackend, &tenantLimitBackend{
+		Backend:  stripe.GetBackend(stripe.APIBackend),
+		settings: settings,
+		lanes:    map[string]*tenantLane{},
+		swept:    time.Now(),
+	})
+}
+
+// lane returns tenant's lane, brought up to date with l. Called with mu
+// held.
+func (b *tenantLimitBackend) lane(tenant string, l TenantLimit, now time.Time) *tenantLane {
+	if now.Sub(b.swept) > tenantLaneIdle {
+		for t, ln := range b.lanes {
+			if ln.inflight == 0 && len(ln.waiting) == 0 && now.Sub(ln.seen) > tenantLaneIdle {
+				delete(b.lanes, t)
+			}
+		}
+		b.swept = now
+	}
+	ln := b.lanes[tenant]
+	if ln == nil {
+		ln = &tenantLane{}
+		b.lanes[tenant] = ln
+	}
+	ln.seen = now
+	ln.maxConcurrent = l.MaxConcurrent
+	burst := l.Burst
+	if burst == 0 {
+		burst = int(l.RequestsPerSecond) + 1
+	}
+	switch {
+	case l.RequestsPerSecond == 0:
+		ln.limiter = nil
+	case ln.limiter == nil:
+		ln.limiter = rate.NewLimiter(rate.Limit(l.RequestsPerSecond), burst)
+	case ln.limiter.Limit() != rate.Limit(l.RequestsPerSecond) || ln.limiter.Burst() != burst:
+		ln.limiter.SetLimitAt(now, rate.Limit(l.RequestsPerSecond))
+		ln.limiter.SetBurstAt(now, burst)
+	}
+	return ln
+}
+
+// fits reports whether ln may start a call now. Called with mu held.
+func (b *tenantLimitBackend) fits(ln *tenantLane, accountMax int) bool {
+	return (ln.maxConcurrent == 0 || ln.inflight < ln.maxConcurrent) && (accountMax == 0 || b.inflight < accountMax)
+}
+
+// dispatch starts waiting calls, one lane at a time in turn, while the
+// account has room. Called with mu held.
+func (b *tenantLimitBackend) dispatch(accountMax int) {
+	for len(b.turns) > 0 && (accountMax == 0 || b.inflight < accountMax) {
+		started := false
+		for i := 0; i < len(b.turns); i++ {
+			idx := (b.next + i) % len(b.turns)
+			ln := b.turns[idx]
+			if !b.fits(ln, accountMax) {
+				continue
+			}
+			w := ln.waiting[0]
+			ln.waiting = ln.waiting[1:]
+			ln.inflight++
+			b.inflight++
+			w <- struct{}{}
+			if len(ln.waiting) == 0 {
+				b.turns = append(b.turns[:idx], b.turns[idx+1:]...)
+				b.next = idx
+			} else {
+				b.next = idx + 1
+			}
+			if len(b.turns) > 0 {
+				b.next %= len(b.turns)
+			} else {
+				b.next = 0
+			}
+			started = true
+			break
+		}
+		if !started {
+			return
+		}
+	}
+}
+
+// dequeue takes w out of ln's waiting calls, reporting false when it had
+// already been started. Called with mu held.
+func (b *tenantLimitBackend) dequeue(ln *tenantLane, w chan struct{}) bool {
+	for i, x := range ln.waiting {
+		if x != w {
+			continue
+		}
+		ln.waiting = append(ln.waiting[:i], ln.waiting[i+1:]...)
+		if len(ln.waiting) == 0 {
+			for j, t := range b.turns {
+				if t == ln {
+					b.turns = append(b.turns[:j], b.turns[j+1:]...)
+					if b.next > j {
+						b.next--
+					}
+					break
+				}
+			}
+			if len(b.turns) > 0 {
+				b.next %= len(b.turns)
+			} else {
+				b.next = 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (b *tenantLimitBackend) release(ln *tenantLane) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ln.inflight--
+	b.inflight--
+	b.dispatch(b.settings.Get().TenantLimits.AccountMaxConcurrent)
+}
+
+// acquire waits until tenant may make a call and returns the func that
+// ends it, or errTenantThrottled.
+func (b *tenantLimitBackend) acquire(ctx context.Context, tenant string) (func(), error) {
+	cfg := b.settings.Get().TenantLimits
+	if !cfg.enabled() {
+		return func() {}, nil
+	}
+	label := cfg.tenantLabel(tenant)
+	started := time.Now()
+	deadline := started.Add(cfg.maxWait())
+	throttled := func() (func(), error) {
+		tenantProviderCalls.WithLabelValues(label, "throttled").Inc()
+		return nil, fmt.Errorf("%w for tenant %q", errTenantThrottled, tenant)
+	}
+
+	b.mu.Lock()
+	ln := b.lane(tenant, cfg.limit(tenant), started)
+	limiter := ln.limiter
+	b.mu.Unlock()
+
+	if limiter != nil {
+		r := limiter.ReserveN(started, 1)
+		delay := r.DelayFrom(started)
+		if !r.OK() || delay > cfg.maxWait() {
+			r.CancelAt(started)
+			return throttled()
+		}
+		if delay > 0 {
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				r.Cancel()
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	b.mu.Lock()
+	if len(b.turns) == 0 && b.fits(ln, cfg.AccountMaxConcurrent) {
+		ln.inflight++
+		b.inflight++
+		b.mu.Unlock()
+		tenantProviderCalls.WithLabelValues(label, "immediate").Inc()
+		tenantProviderWait.WithLabelValues(label).Observe(time.Since(started).Seconds())
+		return func() { b.release(ln) }, nil
+	}
+	if len(ln.waiting) >= cfg.maxQueued() {
+		b.mu.Unlock()
+		return throttled()
+	}
+	w := make(chan struct{}, 1)
+	if len(ln.waiting) == 0 {
+		b.turns = append(b.turns, ln)
+	}
+	ln.waiting = append(ln.waiting, w)
+	b.dispatch(cfg.AccountMaxConcurrent)
+	b.mu.Unlock()
+
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	var err error
+	select {
+	case <-w:
+	case <-t.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	b.mu.Lock()
+	// A call started just as its wait ran out goes ahead.
+	if len(w) == 0 && b.dequeue(ln, w) {
+		b.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return throttled()
+	}
+	b.mu.Unlock()
+	tenantProviderCalls.WithLabelValues(label, "queued").Inc()
+	tenantProviderWait.WithLabelValues(label).Observe(time.Since(started).Seconds())
+	return func() { b.release(ln) }, nil
+}
+
+// limited runs call under the limits of the tenant p names.
+func (b *tenantLimitBackend) limited(p *stripe.Params, call func() error) error {
+	ctx, tenant := context.Background(), ""
+	if p != nil {
+		if p.Context != nil {
+			ctx = p.Context
+		}
+		tenant = p.Metadata["tenant_id"]
+	}
+	done, err := b.acquire(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return call()
+}
+
+func (b *tenantLimitBackend) Call(method, path, key string, params stripe.ParamsContainer, v stripe.LastResponseSetter) error {
+	return b.limited(paramsOf(params), func() error {
+		return b.Backend.Call(method, path, key, params, v)
+	})
+}
+
+func (b *tenantLimitBackend) CallStreaming(method, path, key string, params stripe.ParamsContainer, v stripe.StreamingLastResponseSetter) error {
+	return b.limited(paramsOf(params), func() error {
+		return b.Backend.CallStreaming(method, path, key, params, v)
+	})
+}
+
+func (b *tenantLimitBackend) CallRaw(method, path, key string, body *form.Values, params *stripe.Params, v stripe.LastResponseSetter) error {
+	return b.limited(params, func() error {
+		return b.Backend.CallRaw(method, path, key, body, params, v)
+	})
+}
+
+func (b *tenantLimitBackend) CallMultipart(method, path, key, boundary string, body *bytes.Buffer, params *stripe.Params, v stripe.LastResponseSetter) error {
+	return b.limited(params, func() error {
+		return b.Backend.CallMultipart(method, path, key, boundary, body, params, v)
+	})
+}
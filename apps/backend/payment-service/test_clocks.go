@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/testhelpers/testclock"
+)
+
+// testClockWait is how long an advance with ?wait=true waits for the clock
+// to be ready again before answering with it still advancing.
+const testClockWait = 30 * time.Second
+
+// TestClock is a Stripe test clock. Customers created on it, and their
+// subscriptions, live at FrozenTime; advancing it runs their renewals,
+// invoices and retries up to the new time, with the webhooks that go with
+// them, so dunning can be watched end to end in minutes. The service's
+// own timers, such as dunning retries and the in-house billing cycle, keep
+// to the server clock; POST /admin/subscriptions/:id/dunning/retry brings
+// a retry forward.
+type TestClock struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name,omitempty"`
+	Status       string    `json:"status"`
+	FrozenTime   time.Time `json:"frozen_time"`
+	DeletesAfter time.Time `json:"deletes_after"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func testClockData(tc *stripe.TestHelpersTestClock) TestClock {
+	return TestClock{
+		ID:           tc.ID,
+		Name:         tc.Name,
+		Status:       string(tc.Status),
+		FrozenTime:   time.Unix(tc.FrozenTime, 0).UTC(),
+		DeletesAfter: time.Unix(tc.DeletesAfter, 0).UTC(),
+		CreatedAt:    time.Unix(tc.Created, 0).UTC(),
+	}
+}
+
+func (s *Sandbox) createTestClock(c *gin.Context) {
+	var req struct {
+		Name string `json:"name" binding:"max=300"`
+		// FrozenTime defaults to now.
+		FrozenTime *time.Time `json:"frozen_time"`
+	}
+	if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+		return
+	}
+	frozen := time.Now()
+	if req.FrozenTime != nil {
+		frozen = *req.FrozenTime
+	}
+	params := &stripe.TestHelpersTestClockParams{FrozenTime: stripe.Int64(frozen.Unix())}
+	params.Context = c.Request.Context()
+	if req.Name != "" {
+		params.Name = stripe.String(req.Name)
+	}
+	tc, err := testclock.New(params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondData(c, http.StatusCreated, testClockData(tc))
+}
+
+func (s *Sandbox) listTestClocks(c *gin.Context) {
+	params := &stripe.TestHelpersTestClockListParams{}
+	params.Context = c.Request.Context()
+	params.Filters.AddFilter("limit", "", "100")
+	it := testclock.List(params)
+	clocks := []TestClock{}
+	for it.Next() && len(clocks) < 100 {
+		clocks = append(clocks, testClockData(it.TestHelpersTestClock()))
+	}
+	if err := it.Err(); err != nil {
+		respondError(c, err)
+		return
+	}
+	respondList(c, http.StatusOK, clocks, nil)
+}
+
+func (s *Sandbox) getTestClock(c *gin.Context) {
+	params := &stripe.TestHelpersTestClockParams{}
+	params.Context = c.Request.Context()
+	tc, err := testclock.Get(c.Param("id"), params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	respondData(c, http.StatusOK, testClockData(tc))
+}
+
+// advanceTestClock moves a clock to frozen_time, or on by advance_by, a
+// duration such as "720h". Stripe advances in the background; with
+// ?wait=true the answer waits until the clock is ready, so a test can
+// check the outcome straight after.
+func (s *Sandbox) advanceTestClock(c *gin.Context) {
+	var req struct {
+		FrozenTime *time.Time `json:"frozen_time"`
+		AdvanceBy  string     `json:"advance_by"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if (req.FrozenTime == nil) == (req.AdvanceBy == "") {
+		validationFailed(c, []FieldError{{Field: "frozen_time", Code: "required", Message: "set exactly one of frozen_time and advance_by"}})
+		return
+	}
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	var to time.Time
+	if req.FrozenTime != nil {
+		to = *req.FrozenTime
+	} else {
+		by, err := time.ParseDuration(req.AdvanceBy)
+		if err != nil || by <= 0 {
+			validationFailed(c, []FieldError{{Field: "advance_by", Code: "invalid", Message: "must be a positive duration such as 720h"}})
+			return
+		}
+		get := &stripe.TestHelpersTestClockParams{}
+		get.Context = ctx
+		tc, err := testclock.Get(id, get)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		to = time.Unix(tc.FrozenTime, 0).Add(by)
+	}
+
+	params := &stripe.TestHelpersTestClockAdvanceParams{FrozenTime: stripe.Int64(to.Unix())}
+	params.Context = ctx
+	tc, err := testclock.Advance(id, params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if c.Query("wait") == "true" {
+		if tc, err = waitForTestClock(ctx, tc); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+	respondData(c, http.StatusOK, testClockData(tc))
+}
+
+// waitForTestClock polls tc until it stops advancing or testClockWait
+// passes.
+func waitForTestClock(ctx context.Context, tc *stripe.TestHelpersTestClock) (*stripe.TestHelpersTestClock, error) {
+	ctx, cancel := context.WithTimeout(ctx, testClockWait)
+	defer cancel()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for tc.Status == stripe.TestHelpersTestClockStatusAdvancing {
+		select {
+		case <-ctx.Done():
+			return tc, nil
+		case <-ticker.C:
+		}
+		params := &stripe.TestHelpersTestClockParams{}
+		params.Context = ctx
+		next, err := testclock.Get(tc.ID, params)
+		if err != nil {
+			if ctx.Err() != nil {
+				return tc, nil
+			}
+			return nil, err
+		}
+		tc = next
+	}
+	return tc, nil
+}
+
+// deleteTestClock deletes a clock and, on Stripe's side, every customer
+// and subscription on it.
+func (s *Sandbox) deleteTestClock(c *gin.Context) {
+	params := &stripe.TestHelpersTestClockParams{}
+	params.Context = c.Request.Context()
+	if _, err := testclock.Del(c.Param("id"), params); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Kinds of timeline entries.
+const (
+	timelineProviderEvent = "provider_event"
+	timelineState         = "state"
+	timelineRefund        = "refund"
+	timelineDispute       = "dispute"
+	timelineEmail         = "email"
+	timelineAdmin         = "admin"
+)
+
+// Email log statuses.
+const (
+	paymentEmailSent   = "sent"
+	paymentEmailFailed = "failed"
+)
+
+// TimelineEntry is one thing that happened to a payment. Actor is who
+// did it, for admin actions, or what, for state transitions; Detail
+// varies with the kind.
+type TimelineEntry struct {
+	At     time.Time       `json:"at"`
+	Kind   string          `json:"kind"`
+	Type   string          `json:"type"`
+	ID     string          `json:"id,omitempty"`
+	Actor  string          `json:"actor,omitempty"`
+	Detail json.RawMessage `json:"detail"`
+}
+
+// PaymentTimeline is everything the service knows happened to a payment,
+// oldest first.
+type PaymentTimeline struct {
+	PaymentID string          `json:"payment_id"`
+	Status    string          `json:"status"`
+	State     string          `json:"state"`
+	Entries   []TimelineEntry `json:"entries"`
+}
+
+// timelineQuery merges a payment's webhook deliveries, lifecycle
+// transitions, refunds, disputes, logged emails, refund approvals, review
+// decisions and other operator actions. Refunds and disputes appear once,
+// when created, with their current status; a refund's actor is the key
+// that requested it. Entries at the same instant keep the order of the
+// union, which is the order they are caused in.
+const timelineQuery = `
+	SELECT at, kind, type, id, actor, detail FROM (
+		SELECT received_at AS at, 1 AS n, 'provider_event' AS kind, type, id, '' AS actor,
+			jsonb_build_object('status', status, 'signature', signature, 'attempts', attempts,
+				'last_error', last_error) AS detail
+		FROM webhook_events WHERE payment_id = $1
+		UNION ALL
+		SELECT created_at, 2, 'state', to_state, '', source,
+			jsonb_build_object('from', from_state, 'provider_status', provider_status)
+		FROM payment_state_transitions WHERE payment_id = $1
+		UNION ALL
+		SELECT created_at, 3, 'refund', 'refund.created', id, requested_by,
+			jsonb_build_object('amount', amount, 'currency', currency, 'status', status, 'reason', reason)
+		FROM refunds WHERE payment_id = $1
+		UNION ALL
+		SELECT created_at, 3, 'dispute', 'dispute.created', id, '',
+			jsonb_build_object('amount', amount, 'currency', currency, 'status', status, 'reason', reason,
+				'evidence_due_by', evidence_due_by)
+		FROM disputes WHERE payment_id = $1
+		UNION ALL
+		SELECT e.created_at, 4, 'admin', 'refund_request.' || e.action, r.id, e.actor,
+			jsonb_build_object('amount', r.amount, 'currency', r.currency, 'detail', e.detail)
+		FROM refund_request_events e JOIN refund_requests r ON r.id = e.request_id WHERE r.payment_id = $1
+		UNION ALL
+		SELECT created_at, 4, 'admin', 'review.queued', payment_id, '',
+			jsonb_build_object('reasons', reasons, 'due_at', due_at)
+		FROM payment_reviews WHERE payment_id = $1
+		UNION ALL
+		SELECT decided_at, 4, 'admin', 'review.' || status, payment_id, decided_by,
+			jsonb_build_object('note', note)
+		FROM payment_reviews WHERE payment_id = $1 AND decided_at IS NOT NULL
+		UNION ALL
+		SELECT created_at, 4, 'admin', action, object_id, actor, detail
+		FROM payment_admin_actions WHERE payment_id = $1
+		UNION ALL
+		SELECT created_at, 5, 'email', kind || '.' || status, '', '',
+			jsonb_build_object('recipient', recipient, 'error', error)
+		FROM payment_emails WHERE payment_id = $1
+	) t
+	ORDER BY at, n`
+
+// PaymentTimeline returns a stored payment's timeline, or sql.ErrNoRows.
+func (s *Store) PaymentTimeline(ctx context.Context, paymentID string) (*PaymentTimeline, error) {
+	t := &PaymentTimeline{PaymentID: paymentID, Entries: []TimelineEntry{}}
+	db := s.reader()
+	if err := db.QueryRowContext(ctx, `SELECT status, state FROM payments WHERE id = $1`, paymentID).
+		Scan(&t.Status, &t.State); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, timelineQuery, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e TimelineEntry
+		var detail []byte
+		if err := rows.Scan(&e.At, &e.Kind, &e.Type, &e.ID, &e.Actor, &detail); err != nil {
+			return nil, err
+		}
+		e.Detail = json.RawMessage(detail)
+		t.Entries = append(t.Entries, e)
+	}
+	return t, rows.Err()
+}
+
+// RecordAdminAction logs an operator's action on a payment, such as
+// "payment.resynced", for its timeline.
+func (s *Store) RecordAdminAction(ctx context.Context, paymentID, action, objectID, actor string, detail gin.H) error {
+	b, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO payment_admin_actions (payment_id, action, object_id, actor, detail) VALUES ($1, $2, $3, $4, $5)`,
+		paymentID, action, objectID, actor, b)
+	return err
+}
+
+// recordAdminAction logs the action c's key took on a payment. The action
+// has happened by then, so a failure to log it is only logged.
+func recordAdminAction(c *gin.Context, store *Store, paymentID, action, objectID string, detail gin.H) {
+	if store == nil || paymentID == "" {
+		return
+	}
+	ctx := context.WithoutCancel(c.Request.Context())
+	if err := store.RecordAdminAction(ctx, paymentID, action, objectID, c.GetString("api_key_id"), detail); err != nil {
+		logf(ctx, "recording %s on %s: %v", action, paymentID, err)
+	}
+}
+
+// RecordPaymentEmail logs an email about a payment, with sendErr the
+// mailer's answer. The recipient is masked.
+func (s *Store) RecordPaymentEmail(ctx context.Context, paymentID, kind, to string, sendErr error) error {
+	status, msg := paymentEmailSent, ""
+	if sendErr != nil {
+		status, msg = paymentEmailFailed, sendErr.Error()
+	}
+	if kind == "" {
+		kind = "email"
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO payment_emails (payment_id, kind, recipient, status, error) VALUES ($1, $2, $3, $4, $5)`,
+		paymentID, kind, maskEmail(to), status, msg)
+	return err
+}
+
+// maskEmail keeps an address's first letter and domain, enough for
+// support to tell which of a customer's addresses was used.
+func maskEmail(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 1 {
+		return ""
+	}
+	return addr[:1] + "***" + addr[at:]
+}
+
+// PaymentTimelines serves payments' merged timelines, the one view
+// support needs to follow what happened to a charge.
+type PaymentTimelines struct {
+	store *Store
+}
+
+func NewPaymentTimelines(store *Store) *PaymentTimelines {
+	return &PaymentTimelines{store: store}
+}
+
+// RegisterRoutes mounts the timeline, which shows which keys acted on a
+// payment and so needs a key with the payments:read scope.
+func (pt *PaymentTimelines) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	r.GET("/payment/:id/timeline", requireScope(pt.store, bootstrapToken, readPaymentsScope), pt.timeline)
+}
+
+// timeline answers a payment's timeline; ?kind= keeps the entries of the
+// comma-separated kinds given.
+func (pt *PaymentTimelines) timeline(c *gin.Context) {
+	var kinds []string
+	if k := c.Query("kind"); k != "" {
+		kinds = strings.Split(k, ",")
+		for _, kind := range kinds {
+			switch kind {
+			case timelineProviderEvent, timelineState, timelineRefund, timelineDispute, timelineEmail, timelineAdmin:
+			default:
+				validationFailed(c, []FieldError{{Field: "kind", Code: "invalid_choice",
+					Message: "must be one of: provider_event, state, refund, dispute, email, admin"}})
+				return
+			}
+		}
+	}
+	t, err := pt.store.PaymentTimeline(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Payment not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if kinds != nil {
+		kept := t.Entries[:0]
+		for _, e := range t.Entries {
+			if containsString(kinds, e.Kind) {
+				kept = append(kept, e)
+			}
+		}
+		t.Entries = kept
+	}
+	respondData(c, http.StatusOK, t)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+var tipAdjustments = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_tip_adjustments_total",
+	Help: "Tip changes on payments, by how they were applied (updated, within_authorization, incremented, refused).",
+}, []string{"method"})
+
+var authorizationIncrements = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_authorization_increments_total",
+	Help: "Requests to raise a payment's authorized amount, by outcome (incremented, refused, failed).",
+}, []string{"outcome"})
+
+// Metadata recording the tip on the PaymentIntent. The pre-tip amount is
+// kept because an intent awaiting capture can't be re-amounted downwards:
+// a smaller tip is captured as less than the authorization instead.
+const (
+	metadataTip    = "tip_amount"
+	metadataPreTip = "pre_tip_amount"
+)
+
+var errTipAdjustment = errors.New("payment can no longer take a tip adjustment")
+
+// tipOf reads the tip and pre-tip amount recorded on pi. Intents created
+// without a tip have all of their amount before the tip.
+func tipOf(pi *stripe.PaymentIntent) (tip, preTip int64) {
+	tip, _ = strconv.ParseInt(pi.Metadata[metadataTip], 10, 64)
+	if preTip, _ = strconv.ParseInt(pi.Metadata[metadataPreTip], 10, 64); preTip == 0 {
+		preTip = pi.Amount - tip
+	}
+	return tip, preTip
+}
+
+// addTipMetadata records req's tip on params. Payments that may have the
+// tip changed after authorization are captured manually and ask for
+// incremental authorization where the card supports it.
+func (r *PaymentRequest) addTipMetadata(params *stripe.PaymentIntentParams, preTip int64) {
+	if r.Tip > 0 || r.CaptureMethod == string(stripe.PaymentIntentCaptureMethodManual) {
+		params.AddMetadata(metadataTip, strconv.FormatInt(r.Tip, 10))
+		params.AddMetadata(metadataPreTip, strconv.FormatInt(preTip, 10))
+	}
+	if r.CaptureMethod == string(stripe.PaymentIntentCaptureMethodManual) {
+		params.CaptureMethod = stripe.String(string(stripe.PaymentIntentCaptureMethodManual))
+		params.PaymentMethodOptions = &stripe.PaymentIntentPaymentMethodOptionsParams{
+			Card: &stripe.PaymentIntentPaymentMethodOptionsCardParams{
+				RequestIncrementalAuthorization: stripe.String(string(stripe.PaymentIntentPaymentMethodOptionsCardRequestIncrementalAuthorizationIfAvailable)),
+			},
+		}
+	}
+}
+
+// Tips changes the tip on a payment after it was created, such as a
+// delivery order tipped once the food arrives, raises the authorization
+// of a payment whose final total came out higher, such as a hotel stay,
+// and captures manually captured payments.
+type Tips struct {
+	store    *Store
+	settings *RuntimeSettings
+	payments PaymentRepository
+}
+
+func NewTips(store *Store, settings *RuntimeSettings) *Tips {
+	return &Tips{store: store, settings: settings}
+}
+
+// RegisterRoutes mounts the tip, increment and capture endpoints, which
+// move money on an existing payment and so need a key with the payments
+// scope.
+func (t *Tips) RegisterRoutes(r gin.IRouter, bootstrapToken string) {
+	g := r.Group("/payment/:id", requireScope(t.store, bootstrapToken, "payments"))
+	g.POST("/tip", t.adjust)
+	g.POST("/increment", t.increment)
+	g.POST("/capture", t.capture)
+}
+
+// adjust sets the payment's tip. An intent not yet confirmed is simply
+// re-amounted. One awaiting capture keeps its authorization when the new
+// total fits inside it, and is incrementally authorized for the rest
+// where the card allows; otherwise the tip can't be raised that far.
+func (t *Tips) adjust(c *gin.Context) {
+	var req struct {
+		Tip int64 `json:"tip" binding:"gte=0"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	ctx := c.Request.Context()
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	params.AddExpand("latest_charge")
+	pi, err := paymentintent.Get(c.Param("id"), params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	pi, method, err := t.setTip(ctx, pi, req.Tip)
+	tipAdjustments.WithLabelValues(method).Inc()
+	switch {
+	case errors.Is(err, errTipAdjustment) && pi.Status == stripe.PaymentIntentStatusRequiresCapture:
+		c.JSON(http.StatusConflict, errorBody(c, CodePaymentState, "The tip exceeds the authorized amount and the card can't be incrementally authorized"))
+		return
+	case errors.Is(err, errTipAdjustment):
+		c.JSON(http.StatusConflict, errorBody(c, CodePaymentState, "The payment is "+string(pi.Status)+" and its tip can't be changed"))
+		return
+	case err != nil:
+		respondError(c, err)
+		return
+	}
+	t.save(ctx, pi)
+	recordAdminAction(c, t.store, pi.ID, "tip.updated", "", gin.H{"tip": req.Tip, "method": method})
+	respondData(c, http.StatusOK, paymentData(pi, false))
+}
+
+func (t *Tips) setTip(ctx context.Context, pi *stripe.PaymentIntent, tip int64) (*stripe.PaymentIntent, string, error) {
+	_, preTip := tipOf(pi)
+	total := preTip + tip
+	meta := map[string]string{
+		metadataTip:    strconv.FormatInt(tip, 10),
+		metadataPreTip: strconv.FormatInt(preTip, 10),
+	}
+
+	switch pi.Status {
+	case stripe.PaymentIntentStatusRequiresPaymentMethod, stripe.PaymentIntentStatusRequiresConfirmation:
+		params := &stripe.PaymentIntentParams{Amount: stripe.Int64(total), Metadata: meta}
+		params.Context = ctx
+		updated, err := paymentintent.Update(pi.ID, params)
+		return updated, "updated", err
+
+	case stripe.PaymentIntentStatusRequiresCapture:
+		if total <= pi.AmountCapturable {
+			params := &stripe.PaymentIntentParams{Metadata: meta}
+			params.Context = ctx
+			updated, err := paymentintent.Update(pi.ID, params)
+			return updated, "within_authorization", err
+		}
+		if !incrementable(pi) {
+			return pi, "refused", errTipAdjustment
+		}
+		params := &stripe.PaymentIntentIncrementAuthorizationParams{Amount: stripe.Int64(total), Metadata: meta}
+		params.Context = ctx
+		updated, err := paymentintent.IncrementAuthorization(pi.ID, params)
+		return updated, "incremented", err
+	}
+	return pi, "refused", errTipAdjustment
+}
+
+// increment raises an authorized payment to a new total, where the card
+// supports incremental authorization. amount is the new total, tip
+// included, and must fit the maximum amounts for the payment's currency
+// and tenant. The tip is kept, so capture collects the new total.
+func (t *Tips) increment(c *gin.Context) {
+	var req struct {
+		Amount      int64  `json:"amount" binding:"required,min=1"`
+		Description string `json:"description" binding:"max=1000"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	ctx := c.Request.Context()
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	params.AddExpand("latest_charge")
+	pi, err := paymentintent.Get(c.Param("id"), params)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	refuse := func(status int, code ErrorCode, message string, ext gin.H) {
+		authorizationIncrements.WithLabelValues("refused").Inc()
+		c.JSON(status, errorBodyWith(c, code, message, ext))
+	}
+	if status := paymentStatus(pi); status != string(stripe.PaymentIntentStatusRequiresCapture) {
+		refuse(http.StatusConflict, CodePaymentState, "The payment is "+status+" and its authorization can't be raised", nil)
+		return
+	}
+	if req.Amount <= pi.Amount {
+		validationFailed(c, []FieldError{{Field: "amount", Code: "too_small",
+			Message: "must be more than the authorized " + strconv.FormatInt(pi.Amount, 10)}})
+		return
+	}
+	if !incrementable(pi) {
+		refuse(http.StatusConflict, CodePaymentState, "The card can't be incrementally authorized", nil)
+		return
+	}
+	currency := string(pi.Currency)
+	cfg := t.settings.Get()
+	_, limits := cfg.AmountPolicies.effective(pi.Metadata["tenant_id"], currency)
+	if max, ok := cfg.MaxAmounts[currency]; ok && (limits.Max == 0 || max < limits.Max) {
+		limits.Max = max
+	}
+	if limits.Max > 0 && req.Amount > limits.Max {
+		refuse(http.StatusUnprocessableEntity, CodeAmountAboveMaximum,
+			fmt.Sprintf("Amount exceeds the %d %s maximum", limits.Max, currency), gin.H{"limit": limits.Max, "currency": currency})
+		return
+	}
+
+	inc := &stripe.PaymentIntentIncrementAuthorizationParams{Amount: stripe.Int64(req.Amount)}
+	inc.Context = ctx
+	if req.Description != "" {
+		inc.Description = stripe.String(req.Description)
+	}
+	if tip, ok := pi.Metadata[metadataTip]; ok {
+		n, _ := strconv.ParseInt(tip, 10, 64)
+		inc.Metadata = map[string]string{metadataPreTip: strconv.FormatInt(req.Amount-n, 10)}
+	}
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		inc.SetIdempotencyKey(key)
+	}
+	updated, err := paymentintent.IncrementAuthorization(pi.ID, inc)
+	if err != nil {
+		authorizationIncrements.WithLabelValues("failed").Inc()
+		respondError(c, err)
+		return
+	}
+	authorizationIncrements.WithLabelValues("incremented").Inc()
+	t.save(ctx, updated)
+	recordAdminAction(c, t.store, updated.ID, "authorization.incremented", "", gin.H{"amount": req.Amount})
+	respondData(c, http.StatusOK, paymentData(updated, false))
+}
+
+// incrementable reports whether pi's card authorization can be raised.
+func incrementable(pi *stripe.PaymentIntent) bool {
+	ch := pi.LatestCharge
+	if ch == nil || ch.PaymentMethodDetails == nil || ch.PaymentMethodDetails.Card == nil || ch.PaymentMethodDetails.Card.IncrementalAuthorization == nil {
+		return false
+	}
+	return ch.PaymentMethodDetails.Card.IncrementalAuthorization.Status == stripe.ChargePaymentMethodDetailsCardIncrementalAuthorizationStatusAvailable
+}
+
+// capture collects a manually captured payment: the pre-tip amount plus
+// the current tip, releasing whatever of the authorization is left over.
+func (t *Tips) capture(c *gin.Context) {
+	ctx := c.Request.Context()
+	pi, err := paymentintent.Get(c.Param("id"), &stripe.PaymentIntentParams{Params: stripe.Params{Context: ctx}})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if status := paymentStatus(pi); status != string(stripe.PaymentIntentStatusRequiresCapture) {
+		c.JSON(http.StatusConflict, errorBody(c, CodePaymentState, "The payment is "+status+" and can't be captured"))
+		return
+	}
+	params := captureParams(ctx, pi)
+	if refused := lifecycleHooks.preCapture(ctx, hookPaymentOf(pi), params); refused != nil {
+		c.JSON(refused.status, errorBodyWith(c, refused.code, refused.message, refused.ext))
+		return
+	}
+	if pi, err = paymentintent.Capture(pi.ID, params); err != nil {
+		respondError(c, err)
+		return
+	}
+	t.save(ctx, pi)
+	recordAdminAction(c, t.store, pi.ID, "payment.captured", "", gin.H{"amount": pi.AmountReceived})
+	respondData(c, http.StatusOK, paymentData(pi, false))
+}
+
+// captureParams captures pi's pre-tip amount plus its current tip.
+func captureParams(ctx context.Context, pi *stripe.PaymentIntent) *stripe.PaymentIntentCaptureParams {
+	params := &stripe.PaymentIntentCaptureParams{}
+	params.Context = ctx
+	if _, ok := pi.Metadata[metadataTip]; ok {
+		tip, preTip := tipOf(pi)
+		params.AmountToCapture = stripe.Int64(preTip + tip)
+	}
+	return params
+}
+
+// save records the changed intent; its webhook fills the gap on failure.
+func (t *Tips) save(ctx context.Context, pi *stripe.PaymentIntent) {
+	if t.payments == nil {
+		return
+	}
+	if err := t.payments.SavePayment(ctx, pi); err != nil {
+		logf(ctx, "saving payment %s: %v", pi.ID, err)
+	}
+}
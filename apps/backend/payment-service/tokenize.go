@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentmethod"
+)
+
+var cardTokenizations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_card_tokenizations_total",
+	Help: "Raw card exchanges for payment method tokens, by outcome (tokenized, invalid, declined, error, rate_limited, insecure).",
+}, []string{"outcome"})
+
+// maxTokenizeBody is far more than a card needs; anything larger isn't one.
+const maxTokenizeBody = 4 << 10
+
+// CardTokenizer exchanges raw card details, collected by internal tools
+// that predate Stripe Elements, for Stripe payment methods, so PANs stop
+// here and no other service in the monorepo stores or forwards them.
+//
+// Nothing on this path may record card data. The body is decoded here,
+// not by the shared binders, so no error echoes what was sent; responses
+// carry only the token, brand, last four digits and expiry; and error
+// reports name fields, never values. Access logs only ever see the path.
+// Requests must arrive over TLS 1.2 or later unless requireTLS is
+// off for local development, and each API key and client IP gets its
+// own token bucket, kept apart from the service-wide limit so card
+// testing through one tool can't be hidden in general traffic.
+type CardTokenizer struct {
+	store      *Store
+	limiter    *ipRateLimiter
+	requireTLS bool
+}
+
+func NewCardTokenizer(store *Store, perMinute, burst int, requireTLS bool) *CardTokenizer {
+	return &CardTokenizer{
+		store:      store,
+		limiter:    newIPRateLimiter(RateLimitConfig{RequestsPerSecond: float64(perMinute) / 60, Burst: burst}),
+		requireTLS: requireTLS,
+	}
+}
+
+func (t *CardTokenizer) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	r.POST("/tokenize/card", t.secure, requireScope(t.store, bootstrapToken, "tokenize"), t.rateLimit, t.tokenize)
+}
+
+// secure refuses plaintext and marks the response as never to be cached
+// or stored by anything between us and the caller.
+func (t *CardTokenizer) secure(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	if !t.requireTLS {
+		c.Next()
+		return
+	}
+	if c.Request.TLS == nil || c.Request.TLS.Version < tls.VersionTLS12 {
+		cardTokenizations.WithLabelValues("insecure").Inc()
+		c.AbortWithStatusJSON(http.StatusForbidden, errorBody(c, CodeForbidden, "Card tokenization requires TLS 1.2 or later"))
+		return
+	}
+	c.Header("Strict-Transport-Security", "max-age=31536000")
+	c.Next()
+}
+
+func (t *CardTokenizer) rateLimit(c *gin.Context) {
+	if t.limiter == nil {
+		c.Next()
+		return
+	}
+	key := c.GetString("api_key_id") + "|" + c.ClientIP()
+	if !t.limiter.allow(key) {
+		cardTokenizations.WithLabelValues("rate_limited").Inc()
+		c.Header("Retry-After", strconv.Itoa(int(t.limiter.retryAfter(key)/time.Second)+1))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, errorBody(c, CodeRateLimited, "Card tokenization rate limit exceeded"))
+		return
+	}
+	c.Next()
+}
+
+// rawCard is the only place card numbers exist in the service.
+type rawCard struct {
+	Number     string `json:"number"`
+	ExpMonth   int64  `json:"exp_month"`
+	ExpYear    int64  `json:"exp_year"`
+	CVC        string `json:"cvc"`
+	Name       string `json:"name"`
+	PostalCode string `json:"postal_code"`
+	// CustomerID, when set, saves the card to that customer.
+	CustomerID string `json:"customer_id"`
+}
+
+// validate checks the card the way its issuer would before Stripe sees
+// it. Messages never include what was sent.
+func (rc *rawCard) validate(now time.Time) []FieldError {
+	var fields []FieldError
+	rc.Number = strings.NewReplacer(" ", "", "-", "").Replace(rc.Number)
+	switch {
+	case rc.Number == "":
+		fields = append(fields, FieldError{Field: "number", Code: "required", Message: "is required"})
+	case len(rc.Number) < 12 || len(rc.Number) > 19 || !digitsOnly(rc.Number) || !luhnValid(rc.Number):
+		fields = append(fields, FieldError{Field: "number", Code: "invalid_card_number", Message: "is not a valid card number"})
+	}
+	if rc.ExpYear < 100 {
+		rc.ExpYear += 2000
+	}
+	switch {
+	case rc.ExpMonth < 1 || rc.ExpMonth > 12:
+		fields = append(fields, FieldError{Field: "exp_month", Code: "invalid", Message: "must be between 1 and 12"})
+	case rc.ExpYear < int64(now.Year()) || rc.ExpYear == int64(now.Year()) && rc.ExpMonth < int64(now.Month()):
+		fields = append(fields, FieldError{Field: "exp_year", Code: "expired_card", Message: "the card has expired"})
+	}
+	if rc.CVC != "" && (len(rc.CVC) < 3 || len(rc.CVC) > 4 || !digitsOnly(rc.CVC)) {
+		fields = append(fields, FieldError{Field: "cvc", Code: "incorrect_cvc", Message: "must be 3 or 4 digits"})
+	}
+	return fields
+}
+
+func digitsOnly(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// luhnValid applies the card number check digit.
+func luhnValid(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// tokenize creates a card payment method from the raw details, saving it
+// to the customer if one is given.
+func (t *CardTokenizer) tokenize(c *gin.Context) {
+	var card rawCard
+	dec := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, maxTokenizeBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&card); err != nil {
+		cardTokenizations.WithLabelValues("invalid").Inc()
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, errorBody(c, CodePayloadTooLarge, "Payload too large"))
+			return
+		}
+		validationFailed(c, []FieldError{{Code: "malformed_json", Message: "request body must be a JSON card object"}})
+		return
+	}
+	if fields := card.validate(time.Now()); len(fields) > 0 {
+		cardTokenizations.WithLabelValues("invalid").Inc()
+		validationFailed(c, fields)
+		return
+	}
+
+	params := &stripe.PaymentMethodParams{
+		Type: stripe.String(string(stripe.PaymentMethodTypeCard)),
+		Card: &stripe.PaymentMethodCardParams{
+			Number:   stripe.String(card.Number),
+			ExpMonth: stripe.Int64(card.ExpMonth),
+			ExpYear:  stripe.Int64(card.ExpYear),
+		},
+	}
+	if card.CVC != "" {
+		params.Card.CVC = stripe.String(card.CVC)
+	}
+	if card.Name != "" || card.PostalCode != "" {
+		params.BillingDetails = &stripe.PaymentMethodBillingDetailsParams{}
+		if card.Name != "" {
+			params.BillingDetails.Name = stripe.String(card.Name)
+		}
+		if card.PostalCode != "" {
+			params.BillingDetails.Address = &stripe.AddressParams{PostalCode: stripe.String(card.PostalCode)}
+		}
+	}
+	params.Context = c.Request.Context()
+	pm, err := paymentmethod.New(params)
+	if err == nil && card.CustomerID != "" {
+		attach := &stripe.PaymentMethodAttachParams{Customer: stripe.String(card.CustomerID)}
+		attach.Context = c.Request.Context()
+		pm, err = paymentmethod.Attach(pm.ID, attach)
+	}
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeCard {
+			cardTokenizations.WithLabelValues("declined").Inc()
+		} else {
+			cardTokenizations.WithLabelValues("error").Inc()
+		}
+		respondError(c, err)
+		return
+	}
+
+	cardTokenizations.WithLabelValues("tokenized").Inc()
+	out := gin.H{"payment_method": pm.ID}
+	if pm.Card != nil {
+		out["brand"] = pm.Card.Brand
+		out["last4"] = pm.Card.Last4
+		out["exp_month"] = pm.Card.ExpMonth
+		out["exp_year"] = pm.Card.ExpYear
+		out["fingerprint"] = pm.Card.Fingerprint
+	}
+	if pm.Customer != nil {
+		out["customer_id"] = pm.Customer.ID
+	}
+	respondData(c, http.StatusCreated, out)
+}
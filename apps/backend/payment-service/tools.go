@@ -0,0 +1,12 @@
+//go:build tools
+
+// Package main pins code generators used by this service so that
+// `go run` resolves them from go.mod.
+package main
+
+import (
+	_ "github.com/99designs/gqlgen"
+	_ "github.com/grpc-ecosystem/grpc-gateway/v2/protoc-gen-grpc-gateway"
+	_ "google.golang.org/grpc/cmd/protoc-gen-go-grpc"
+	_ "google.golang.org/protobuf/cmd/protoc-gen-go"
+)
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentmethod"
+)
+
+// What a trial ending without a payment method does.
+const (
+	trialEndCancel        = "cancel"
+	trialEndCreateInvoice = "create_invoice"
+)
+
+// maxTrial is the longest a trial may run, from the subscription's start.
+const maxTrial = 730 * 24 * time.Hour
+
+var errTrialUsed = errors.New("trial already used")
+
+// trialFingerprints are what a trial is given under: the customer, and
+// the card behind paymentMethod when there is one, so neither gets a
+// second trial.
+func trialFingerprints(ctx context.Context, store *Store, customerID, paymentMethod string) ([]string, error) {
+	fingerprints := []string{"customer:" + customerID}
+	card, err := cardFingerprint(ctx, store, paymentMethod)
+	if err != nil {
+		return nil, err
+	}
+	if card != "" {
+		fingerprints = append(fingerprints, "card:"+card)
+	}
+	return fingerprints, nil
+}
+
+// cardFingerprint is the fingerprint of the card behind a pm_ or vpm_
+// ID, or "" when it isn't a card or has none.
+func cardFingerprint(ctx context.Context, store *Store, id string) (string, error) {
+	switch {
+	case id == "":
+		return "", nil
+	case strings.HasPrefix(id, vaultIDPrefix):
+		m, err := store.VaultedPaymentMethod(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		return m.Fingerprint, nil
+	}
+	params := &stripe.PaymentMethodParams{}
+	params.Context = ctx
+	pm, err := paymentmethod.Get(id, params)
+	if err != nil || pm.Card == nil {
+		return "", err
+	}
+	return pm.Card.Fingerprint, nil
+}
+
+// claimTrial records sub's trial under each fingerprint and reports
+// whether any of them already had a trial on another subscription.
+func claimTrial(ctx context.Context, q queryer, sub *BillingSubscription, fingerprints []string) (bool, error) {
+	used := false
+	for _, fp := range fingerprints {
+		rows, err := q.QueryContext(ctx, `
+			INSERT INTO billing_trials (tenant_id, fingerprint, subscription_id) VALUES ($1, $2, $3)
+			ON CONFLICT (tenant_id, fingerprint) DO UPDATE SET subscription_id = billing_trials.subscription_id
+			RETURNING subscription_id`, sub.TenantID, fp, sub.ID)
+		if err != nil {
+			return false, err
+		}
+		var owner string
+		if rows.Next() {
+			err = rows.Scan(&owner)
+		}
+		rows.Close()
+		if err != nil {
+			return false, err
+		}
+		if owner != sub.ID {
+			used = true
+		}
+	}
+	return used, nil
+}
+
+// awaitPaymentMethod holds the invoice of a trial that ended without a
+// payment method: the subscription is past_due and the invoice is charged
+// once one is added.
+func awaitPaymentMethod(s *BillingSubscription, inv *BillingInvoice) {
+	if inv == nil || inv.Status != billingInvoiceOpen || s.PaymentMethod != "" {
+		return
+	}
+	s.Status, inv.NextAttemptAt = subscriptionPastDue, nil
+}
+
+// ClaimTrialCard records the card a trialing subscription was given and
+// reports whether it had a trial before.
+func (s *Store) ClaimTrialCard(ctx context.Context, sub *BillingSubscription, fingerprint string) (bool, error) {
+	return claimTrial(ctx, s.db, sub, []string{"card:" + fingerprint})
+}
+
+// NoticeTrialsEnding marks trials ending by the given time as announced
+// and returns their subscriptions.
+func (s *Store) NoticeTrialsEnding(ctx context.Context, by time.Time, limit int) ([]*BillingSubscription, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE billing_subscriptions SET trial_will_end_sent_at = now()
+		WHERE id IN (
+			SELECT id FROM billing_subscriptions
+			WHERE status = 'trialing' AND trial_will_end_sent_at IS NULL AND trial_end <= $1
+			ORDER BY trial_end
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED)
+		RETURNING `+billingSubscriptionColumns, by, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subs []*BillingSubscription
+	for rows.Next() {
+		sub, err := scanBillingSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// notifyTrialsEnding publishes customer.subscription.trial_will_end for
+// trials ending within the configured notice, once per trial end.
+func (b *Billing) notifyTrialsEnding(ctx context.Context) error {
+	by := time.Now().Add(b.settings.Get().Billing.trialWillEnd()).UTC()
+	for {
+		subs, err := b.store.NoticeTrialsEnding(ctx, by, 100)
+		if err != nil {
+			return err
+		}
+		for _, sub := range subs {
+			b.emit(ctx, "customer.subscription.trial_will_end", sub, nil)
+		}
+		if len(subs) < 100 {
+			return nil
+		}
+	}
+}
+
+// updateTrial extends a trial or, with trial_end "now", ends it early:
+// the subscription converts at once and its first invoice is charged.
+// A billing cycle anchor that was the trial end moves with it.
+func (b *Billing) updateTrial(c *gin.Context) {
+	var req struct {
+		TrialEnd string `json:"trial_end" binding:"required"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	endNow := req.TrialEnd == "now"
+	at := now
+	if !endNow {
+		t, err := time.Parse(time.RFC3339, req.TrialEnd)
+		if err != nil || !t.After(now) {
+			validationFailed(c, []FieldError{{Field: "trial_end", Code: "invalid", Message: `must be "now" or a future RFC 3339 time`}})
+			return
+		}
+		at = t.UTC().Truncate(time.Second)
+	}
+
+	ctx := c.Request.Context()
+	sub, err := b.store.BillingSubscription(ctx, c.Param("id"))
+	if !b.respondChange(c, sub, err) {
+		return
+	}
+	plan, err := b.store.BillingPlan(ctx, sub.PlanID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if at.Sub(sub.CreatedAt) > maxTrial {
+		validationFailed(c, []FieldError{{Field: "trial_end", Code: "too_large", Message: "trials can run for at most 730 days"}})
+		return
+	}
+	if !endNow && !sub.BillingCycleAnchor.Equal(sub.CurrentPeriodEnd) && plan.boundary(sub.BillingCycleAnchor, -1).After(at) {
+		validationFailed(c, []FieldError{{Field: "trial_end", Code: "invalid", Message: "must be at most one billing period before the billing cycle anchor"}})
+		return
+	}
+
+	sub, err = b.moveTrialEnd(ctx, sub.ID, at)
+	if !b.respondChange(c, sub, err) {
+		return
+	}
+	if endNow {
+		sub = b.convertTrial(ctx, sub)
+	}
+	respondData(c, http.StatusOK, sub)
+}
+
+// moveTrialEnd ends a subscription's trial at the given time, along with
+// its billing cycle anchor when that was the trial end.
+func (b *Billing) moveTrialEnd(ctx context.Context, id string, at time.Time) (*BillingSubscription, error) {
+	return b.change(ctx, id, func(s *BillingSubscription, _ *BillingInvoice) (*BillingInvoice, error) {
+		if s.Status != subscriptionTrialing {
+			return nil, errSubscriptionState
+		}
+		if s.BillingCycleAnchor.Equal(s.CurrentPeriodEnd) {
+			s.BillingCycleAnchor = at
+		}
+		s.TrialEnd, s.CurrentPeriodEnd = &at, at
+		return nil, nil
+	})
+}
+
+// convertTrial renews a subscription whose trial just ended and charges
+// its first invoice, rather than leaving both to the worker.
+func (b *Billing) convertTrial(ctx context.Context, sub *BillingSubscription) *BillingSubscription {
+	if _, err := b.renew(ctx, sub.ID); err != nil {
+		logf(ctx, "converting subscription %s: %v", sub.ID, err)
+		return sub
+	}
+	current, err := b.store.BillingSubscription(ctx, sub.ID)
+	if err != nil {
+		return sub
+	}
+	return b.chargeNow(ctx, current)
+}
+
+// checkTrialCard ends the trial of a subscription given a card that
+// already had one, so a card-less trial can't be used to get a second
+// trial on the same card.
+func (b *Billing) checkTrialCard(ctx context.Context, sub *BillingSubscription) *BillingSubscription {
+	fp, err := cardFingerprint(ctx, b.store, sub.PaymentMethod)
+	used := false
+	if err == nil && fp != "" {
+		used, err = b.store.ClaimTrialCard(ctx, sub, fp)
+	}
+	if err != nil {
+		logf(ctx, "checking the trial card of subscription %s: %v", sub.ID, err)
+		return sub
+	}
+	if !used {
+		return sub
+	}
+	ended, err := b.moveTrialEnd(ctx, sub.ID, time.Now().UTC().Truncate(time.Second))
+	if err != nil {
+		if !errors.Is(err, errSubscriptionState) {
+			logf(ctx, "ending the trial of subscription %s: %v", sub.ID, err)
+		}
+		return sub
+	}
+	return b.convertTrial(ctx, ended)
+}
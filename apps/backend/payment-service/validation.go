@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// FieldError points a client at one offending request field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// fieldCodes names validator tags in terms a frontend can map to copy.
+var fieldCodes = map[string]string{
+	"required": "required",
+	"gt":       "too_small",
+	"gte":      "too_small",
+	"min":      "too_small",
+	"lt":       "too_large",
+	"lte":      "too_large",
+	"max":      "too_large",
+	"len":      "invalid_length",
+	"email":    "invalid_email",
+	"oneof":    "invalid_choice",
+}
+
+func init() {
+	// Report fields by their JSON names rather than Go struct field names.
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(f reflect.StructField) string {
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				return ""
+			}
+			if name == "" {
+				return f.Name
+			}
+			return name
+		})
+	}
+}
+
+// bindJSON binds the body into obj, answering 422 with per-field errors on
+// failure. It returns false when the handler should stop.
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	err := c.ShouldBindJSON(obj)
+	if err == nil {
+		return true
+	}
+	validationFailed(c, fieldErrors(err))
+	return false
+}
+
+// decodeJSON is bindJSON without the validator, for bodies that check
+// themselves.
+func decodeJSON(c *gin.Context, obj interface{}) bool {
+	err := io.EOF
+	if c.Request.Body != nil {
+		err = json.NewDecoder(c.Request.Body).Decode(obj)
+	}
+	if err == nil {
+		return true
+	}
+	validationFailed(c, fieldErrors(err))
+	return false
+}
+
+func validationFailed(c *gin.Context, fields []FieldError) {
+	c.JSON(http.StatusUnprocessableEntity, errorBodyWith(c, CodeValidationFailed, "Request validation failed",
+		gin.H{"fields": fields}))
+}
+
+// validEmail applies the validator's own email rule.
+func validEmail(s string) bool {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	return !ok || v.Var(s, "email") == nil
+}
+
+func fieldErrors(err error) []FieldError {
+	var verrs validator.ValidationErrors
+	if errors.As(err, &verrs) {
+		out := make([]FieldError, 0, len(verrs))
+		for _, fe := range verrs {
+			out = append(out, FieldError{
+				Field:   fieldPath(fe),
+				Code:    fieldCode(fe.Tag()),
+				Message: fieldMessage(fe),
+			})
+		}
+		return out
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return []FieldError{{
+			Field:   typeErr.Field,
+			Code:    "invalid_type",
+			Message: "must be a " + jsonTypeName(typeErr.Type),
+		}}
+	}
+
+	if errors.Is(err, io.EOF) {
+		return []FieldError{{Code: "required", Message: "request body is required"}}
+	}
+	return []FieldError{{Code: "malformed_json", Message: err.Error()}}
+}
+
+// fieldPath drops the top-level struct name from the validator namespace,
+// leaving a dotted JSON path such as "items[0].amount".
+func fieldPath(fe validator.FieldError) string {
+	ns := fe.Namespace()
+	if _, rest, ok := strings.Cut(ns, "."); ok {
+		return rest
+	}
+	return ns
+}
+
+func fieldCode(tag string) string {
+	if code, ok := fieldCodes[tag]; ok {
+		return code
+	}
+	return "invalid"
+}
+
+func fieldMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "gt":
+		return "must be greater than " + fe.Param()
+	case "gte", "min":
+		if unit := lengthUnit(fe.Kind()); unit != "" {
+			return "must have at least " + fe.Param() + " " + unit
+		}
+		return "must be at least " + fe.Param()
+	case "lt":
+		return "must be less than " + fe.Param()
+	case "lte", "max":
+		if unit := lengthUnit(fe.Kind()); unit != "" {
+			return "must have at most " + fe.Param() + " " + unit
+		}
+		return "must be at most " + fe.Param()
+	case "len":
+		if unit := lengthUnit(fe.Kind()); unit != "" {
+			return "must have exactly " + fe.Param() + " " + unit
+		}
+		return "must be " + fe.Param()
+	case "email":
+		return "must be a valid email address"
+	case "oneof":
+		return "must be one of: " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	}
+	return "is invalid"
+}
+
+// lengthUnit is what min/max/len count for a kind, or "" for numbers.
+func lengthUnit(k reflect.Kind) string {
+	switch k {
+	case reflect.String:
+		return "characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return "items"
+	}
+	return ""
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "whole number"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice, reflect.Array:
+		return "list"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	}
+	return "string"
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentmethod"
+)
+
+var vaultChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_vault_changes_total",
+	Help: "Vaulted payment method changes, by action (created, merged, token_set, removed).",
+}, []string{"action"})
+
+// Providers a vaulted payment method can hold a token for. A network
+// token is the card network's replacement for the card number, usable
+// with any acquirer that accepts it; the vault keeps the token service's
+// reference for it, never the token number.
+const (
+	vaultProviderStripe    = "stripe"
+	vaultProviderBraintree = "braintree"
+	vaultProviderNetwork   = "network"
+)
+
+var vaultProviders = []string{vaultProviderStripe, vaultProviderBraintree, vaultProviderNetwork}
+
+// vaultIDPrefix marks our payment method IDs apart from Stripe's pm_.
+const vaultIDPrefix = "vpm_"
+
+const (
+	vaultActive  = "active"
+	vaultRemoved = "removed"
+)
+
+var (
+	errVaultConflict   = errors.New("vaulted payment method was removed")
+	errVaultTokenTaken = errors.New("token is vaulted for another customer or payment method")
+)
+
+// VaultedPaymentMethod is a customer's saved payment method under our own
+// ID, with the token each provider holds for it. Callers store the ID, so
+// moving customers to another provider, or routing a charge to one, means
+// adding that provider's token here rather than asking for the card again.
+type VaultedPaymentMethod struct {
+	ID          string `json:"id"`
+	TenantID    string `json:"tenant_id,omitempty"`
+	CustomerID  string `json:"customer_id"`
+	Brand       string `json:"brand"`
+	Last4       string `json:"last4"`
+	ExpMonth    int64  `json:"exp_month"`
+	ExpYear     int64  `json:"exp_year"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Status      string `json:"status"`
+	// Tokens maps each provider to its token for this payment method.
+	Tokens    map[string]string `json:"tokens"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+const vaultedPaymentMethodColumns = `id, tenant_id, customer_id, brand, last4, exp_month, exp_year, fingerprint, status,
+	created_at, updated_at`
+
+func scanVaultedPaymentMethod(row interface{ Scan(...interface{}) error }) (*VaultedPaymentMethod, error) {
+	var m VaultedPaymentMethod
+	if err := row.Scan(&m.ID, &m.TenantID, &m.CustomerID, &m.Brand, &m.Last4, &m.ExpMonth, &m.ExpYear, &m.Fingerprint,
+		&m.Status, &m.CreatedAt, &m.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// loadVaultTokens fills in m's provider tokens.
+func loadVaultTokens(ctx context.Context, q queryer, m *VaultedPaymentMethod) error {
+	rows, err := q.QueryContext(ctx, `SELECT provider, token FROM vaulted_payment_method_tokens WHERE vault_id = $1`, m.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	m.Tokens = map[string]string{}
+	for rows.Next() {
+		var provider, token string
+		if err := rows.Scan(&provider, &token); err != nil {
+			return err
+		}
+		m.Tokens[provider] = token
+	}
+	return rows.Err()
+}
+
+// VaultPaymentMethod records m's tokens for its customer. A method that
+// already holds one of the tokens, or failing that the customer's active
+// method with the same fingerprint, takes the tokens instead of a new
+// one being created, so the same card vaulted through two providers has
+// one ID. created is false when an existing method was used. A token
+// vaulted for another customer, or tokens naming two different methods,
+// are errVaultTokenTaken.
+func (s *Store) VaultPaymentMethod(ctx context.Context, m *VaultedPaymentMethod) (vaulted *VaultedPaymentMethod, created bool, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// Two requests vaulting the same card must agree on one method.
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('vault:' || $1))`, m.CustomerID); err != nil {
+		return nil, false, err
+	}
+	id := ""
+	for provider, token := range m.Tokens {
+		var owner, customer string
+		err := tx.QueryRowContext(ctx, `
+			SELECT v.id, v.customer_id FROM vaulted_payment_method_tokens t
+			JOIN vaulted_payment_methods v ON v.id = t.vault_id
+			WHERE t.provider = $1 AND t.token = $2`, provider, token).Scan(&owner, &customer)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			continue
+		case err != nil:
+			return nil, false, err
+		case customer != m.CustomerID || id != "" && id != owner:
+			return nil, false, errVaultTokenTaken
+		}
+		id = owner
+	}
+	if id == "" && m.Fingerprint != "" {
+		err := tx.QueryRowContext(ctx, `
+			SELECT id FROM vaulted_payment_methods
+			WHERE customer_id = $1 AND fingerprint = $2 AND status = $3
+			ORDER BY created_at LIMIT 1`, m.CustomerID, m.Fingerprint, vaultActive).Scan(&id)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, false, err
+		}
+	}
+
+	if created = id == ""; created {
+		id = m.ID
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO vaulted_payment_methods
+				(id, tenant_id, customer_id, brand, last4, exp_month, exp_year, fingerprint, status)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			id, m.TenantID, m.CustomerID, m.Brand, m.Last4, m.ExpMonth, m.ExpYear, m.Fingerprint, vaultActive)
+	} else {
+		// Details read from Stripe are fresher than what was vaulted before.
+		_, err = tx.ExecContext(ctx, `
+			UPDATE vaulted_payment_methods SET
+				brand = COALESCE(NULLIF($2, ''), brand), last4 = COALESCE(NULLIF($3, ''), last4),
+				exp_month = COALESCE(NULLIF($4, 0), exp_month), exp_year = COALESCE(NULLIF($5, 0), exp_year),
+				fingerprint = COALESCE(NULLIF($6, ''), fingerprint), updated_at = now()
+			WHERE id = $1`,
+			id, m.Brand, m.Last4, m.ExpMonth, m.ExpYear, m.Fingerprint)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	for provider, token := range m.Tokens {
+		if err := setVaultToken(ctx, tx, id, provider, token); err != nil {
+			return nil, false, err
+		}
+	}
+	vaulted, err = vaultedPaymentMethod(ctx, tx, id, false)
+	if err != nil {
+		return nil, false, err
+	}
+	return vaulted, created, tx.Commit()
+}
+
+func setVaultToken(ctx context.Context, tx *sql.Tx, id, provider, token string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO vaulted_payment_method_tokens (vault_id, provider, token) VALUES ($1, $2, $3)
+		ON CONFLICT (vault_id, provider) DO UPDATE SET token = EXCLUDED.token, created_at = now()`,
+		id, provider, token)
+	return err
+}
+
+// vaultedQueryer is what loading a vaulted method needs from either the
+// pool or a transaction.
+type vaultedQueryer interface {
+	queryer
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func vaultedPaymentMethod(ctx context.Context, q vaultedQueryer, id string, lock bool) (*VaultedPaymentMethod, error) {
+	query := `SELECT ` + vaultedPaymentMethodColumns + ` FROM vaulted_payment_methods WHERE id = $1`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+	m, err := scanVaultedPaymentMethod(q.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return nil, err
+	}
+	return m, loadVaultTokens(ctx, q, m)
+}
+
+func (s *Store) VaultedPaymentMethod(ctx context.Context, id string) (*VaultedPaymentMethod, error) {
+	return vaultedPaymentMethod(ctx, s.db, id, false)
+}
+
+// CustomerVaultedPaymentMethods lists the customer's active methods,
+// oldest first.
+func (s *Store) CustomerVaultedPaymentMethods(ctx context.Context, customerID string) ([]*VaultedPaymentMethod, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+vaultedPaymentMethodColumns+` FROM vaulted_payment_methods
+		WHERE customer_id = $1 AND status = $2 ORDER BY created_at`, customerID, vaultActive)
+	if err != nil {
+		return nil, err
+	}
+	var out []*VaultedPaymentMethod
+	for rows.Next() {
+		m, err := scanVaultedPaymentMethod(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, m := range out {
+		if err := loadVaultTokens(ctx, s.db, m); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// changeVaultedPaymentMethod applies fn to an active vaulted method under
+// its row lock. A removed method is errVaultConflict.
+func (s *Store) changeVaultedPaymentMethod(ctx context.Context, id string, fn func(ctx context.Context, tx *sql.Tx, m *VaultedPaymentMethod) error) (*VaultedPaymentMethod, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	m, err := vaultedPaymentMethod(ctx, tx, id, true)
+	if err != nil {
+		return nil, err
+	}
+	if m.Status != vaultActive {
+		return m, errVaultConflict
+	}
+	if err := fn(ctx, tx, m); err != nil {
+		return m, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE vaulted_payment_methods SET status = $2, updated_at = now() WHERE id = $1`,
+		m.ID, m.Status); err != nil {
+		return nil, err
+	}
+	if m, err = vaultedPaymentMethod(ctx, tx, id, false); err != nil {
+		return nil, err
+	}
+	return m, tx.Commit()
+}
+
+// VaultToken returns provider's token for the customer's active vaulted
+// method id, or sql.ErrNoRows.
+func (s *Store) VaultToken(ctx context.Context, id, customerID, provider string) (string, error) {
+	var token string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT t.token FROM vaulted_payment_method_tokens t
+		JOIN vaulted_payment_methods v ON v.id = t.vault_id
+		WHERE v.id = $1 AND v.customer_id = $2 AND v.status = $3 AND t.provider = $4`,
+		id, customerID, vaultActive, provider).Scan(&token)
+	return token, err
+}
+
+// paymentMethodToken returns the Stripe payment method to charge for id:
+// id itself, or the Stripe token of the vaulted method it names. Only
+// Stripe charges today; the other tokens are kept so a provider switch
+// doesn't orphan customers' saved cards. A vaulted method that is
+// removed, isn't the customer's or has no Stripe token is refused, so
+// callers treat it as they would a declined card.
+func paymentMethodToken(ctx context.Context, store *Store, id, customerID string) (string, error) {
+	if !strings.HasPrefix(id, vaultIDPrefix) {
+		return id, nil
+	}
+	if store == nil {
+		return "", &refusal{http.StatusServiceUnavailable, CodeNotConfigured, "Vaulted payment methods require DATABASE_URL", nil}
+	}
+	token, err := store.VaultToken(ctx, id, customerID, vaultProviderStripe)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", &refusal{http.StatusConflict, CodeVaultConflict, "Vaulted payment method " + id + " can't be charged through Stripe", nil}
+	}
+	return token, err
+}
+
+// Vault maps our payment method IDs to provider tokens.
+type Vault struct {
+	store *Store
+}
+
+func NewVault(store *Store) *Vault {
+	return &Vault{store: store}
+}
+
+func (v *Vault) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/vault/payment-methods", requireScope(v.store, bootstrapToken, "vault"), v.requireStore)
+	g.POST("", v.create)
+	g.GET("", v.list)
+	g.GET("/:id", v.get)
+	g.PUT("/:id/tokens/:provider", v.setToken)
+	g.DELETE("/:id", v.remove)
+}
+
+func (v *Vault) requireStore(c *gin.Context) {
+	if v.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "The payment method vault requires DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// respondChange answers a failed vault change, returning false, or
+// returns true when err is nil.
+func (v *Vault) respondChange(c *gin.Context, m *VaultedPaymentMethod, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Vaulted payment method not found"))
+	case errors.Is(err, errVaultConflict):
+		c.JSON(http.StatusConflict, errorBodyWith(c, CodeVaultConflict, "Vaulted payment method is "+m.Status,
+			gin.H{"status": m.Status}))
+	case errors.Is(err, errVaultTokenTaken):
+		c.JSON(http.StatusConflict, errorBody(c, CodeVaultConflict, "A token is already vaulted for another customer or payment method"))
+	default:
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+	}
+	return false
+}
+
+// validateVaultToken checks one provider token, reporting it under field.
+func validateVaultToken(field, provider, token string) *FieldError {
+	switch {
+	case !containsString(vaultProviders, provider):
+		return &FieldError{Field: field, Code: "invalid_choice", Message: "must be one of: " + strings.Join(vaultProviders, ", ")}
+	case token == "":
+		return &FieldError{Field: field, Code: "required", Message: "is required"}
+	case provider == vaultProviderStripe && !strings.HasPrefix(token, "pm_"):
+		return &FieldError{Field: field, Code: "invalid", Message: "must be a Stripe payment method (pm_)"}
+	case provider == vaultProviderNetwork && len(token) >= 12 && len(token) <= 19 && digitsOnly(token) && luhnValid(token):
+		// A token number is as sensitive as the card number it replaces.
+		return &FieldError{Field: field, Code: "invalid", Message: "must be the token service's reference, not the token number"}
+	}
+	return nil
+}
+
+// create vaults a payment method from provider tokens. With a Stripe
+// token, the card's details and fingerprint are read from Stripe;
+// otherwise they are taken from the request. Vaulting a card the
+// customer already has adds the tokens to it and answers 200 instead
+// of 201.
+func (v *Vault) create(c *gin.Context) {
+	var req struct {
+		CustomerID string            `json:"customer_id" binding:"required"`
+		TenantID   string            `json:"tenant_id"`
+		Tokens     map[string]string `json:"tokens" binding:"required,min=1"`
+		Brand      string            `json:"brand"`
+		Last4      string            `json:"last4" binding:"omitempty,len=4,numeric"`
+		ExpMonth   int64             `json:"exp_month" binding:"omitempty,min=1,max=12"`
+		ExpYear    int64             `json:"exp_year"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	providers := make([]string, 0, len(req.Tokens))
+	for provider := range req.Tokens {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	var fields []FieldError
+	for _, provider := range providers {
+		if fe := validateVaultToken("tokens."+provider, provider, req.Tokens[provider]); fe != nil {
+			fields = append(fields, *fe)
+		}
+	}
+	if len(fields) > 0 {
+		validationFailed(c, fields)
+		return
+	}
+
+	ctx := c.Request.Context()
+	want := &VaultedPaymentMethod{
+		ID:         vaultIDPrefix + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		TenantID:   req.TenantID,
+		CustomerID: req.CustomerID,
+		Brand:      req.Brand,
+		Last4:      req.Last4,
+		ExpMonth:   req.ExpMonth,
+		ExpYear:    req.ExpYear,
+		Tokens:     req.Tokens,
+	}
+	if token := req.Tokens[vaultProviderStripe]; token != "" {
+		params := &stripe.PaymentMethodParams{}
+		params.Context = ctx
+		pm, err := paymentmethod.Get(token, params)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		if pm.Customer != nil && pm.Customer.ID != req.CustomerID {
+			c.JSON(http.StatusConflict, errorBody(c, CodeVaultConflict, "The Stripe payment method is saved to another customer"))
+			return
+		}
+		if pm.Card != nil {
+			want.Brand, want.Last4 = string(pm.Card.Brand), pm.Card.Last4
+			want.ExpMonth, want.ExpYear = pm.Card.ExpMonth, pm.Card.ExpYear
+			want.Fingerprint = pm.Card.Fingerprint
+		}
+	}
+
+	m, created, err := v.store.VaultPaymentMethod(ctx, want)
+	if !v.respondChange(c, nil, err) {
+		return
+	}
+	if !created {
+		vaultChanges.WithLabelValues("merged").Inc()
+		respondData(c, http.StatusOK, m)
+		return
+	}
+	vaultChanges.WithLabelValues("created").Inc()
+	respondData(c, http.StatusCreated, m)
+}
+
+func (v *Vault) list(c *gin.Context) {
+	customerID := c.Query("customer_id")
+	if customerID == "" {
+		validationFailed(c, []FieldError{{Field: "customer_id", Code: "required", Message: "is required"}})
+		return
+	}
+	methods, err := v.store.CustomerVaultedPaymentMethods(c.Request.Context(), customerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	if methods == nil {
+		methods = []*VaultedPaymentMethod{}
+	}
+	respondList(c, http.StatusOK, methods, gin.H{"customer_id": customerID})
+}
+
+func (v *Vault) get(c *gin.Context) {
+	m, err := v.store.VaultedPaymentMethod(c.Request.Context(), c.Param("id"))
+	if !v.respondChange(c, m, err) {
+		return
+	}
+	respondData(c, http.StatusOK, m)
+}
+
+// setToken adds or replaces one provider's token, such as when customers'
+// cards are migrated to a new provider.
+func (v *Vault) setToken(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	provider := c.Param("provider")
+	if fe := validateVaultToken("token", provider, req.Token); fe != nil {
+		if fe.Code == "invalid_choice" {
+			fe.Field = "provider"
+		}
+		validationFailed(c, []FieldError{*fe})
+		return
+	}
+	m, err := v.store.changeVaultedPaymentMethod(c.Request.Context(), c.Param("id"), func(ctx context.Context, tx *sql.Tx, m *VaultedPaymentMethod) error {
+		var owner string
+		err := tx.QueryRowContext(ctx, `SELECT vault_id FROM vaulted_payment_method_tokens WHERE provider = $1 AND token = $2`,
+			provider, req.Token).Scan(&owner)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return err
+		case owner != m.ID:
+			return errVaultTokenTaken
+		}
+		return setVaultToken(ctx, tx, m.ID, provider, req.Token)
+	})
+	if !v.respondChange(c, m, err) {
+		return
+	}
+	vaultChanges.WithLabelValues("token_set").Inc()
+	respondData(c, http.StatusOK, m)
+}
+
+// remove deletes a vaulted method's tokens, so nothing can charge it
+// again, and detaches its Stripe payment method from the customer.
+// Tokens held by other providers are theirs to delete.
+func (v *Vault) remove(c *gin.Context) {
+	var stripeToken string
+	m, err := v.store.changeVaultedPaymentMethod(c.Request.Context(), c.Param("id"), func(ctx context.Context, tx *sql.Tx, m *VaultedPaymentMethod) error {
+		stripeToken = m.Tokens[vaultProviderStripe]
+		m.Status = vaultRemoved
+		_, err := tx.ExecContext(ctx, `DELETE FROM vaulted_payment_method_tokens WHERE vault_id = $1`, m.ID)
+		return err
+	})
+	if !v.respondChange(c, m, err) {
+		return
+	}
+	vaultChanges.WithLabelValues("removed").Inc()
+	if stripeToken != "" {
+		params := &stripe.PaymentMethodDetachParams{}
+		params.Context = c.Request.Context()
+		if _, err := paymentmethod.Detach(stripeToken, params); err != nil {
+			logf(c.Request.Context(), "detaching payment method %s of %s: %v", stripeToken, m.ID, err)
+		}
+	}
+	respondData(c, http.StatusOK, m)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var velocityRefusals = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "payment_service_velocity_refusals_total",
+	Help: "Payments refused for exceeding a velocity rule, by rule key.",
+}, []string{"key"})
+
+// Velocity rule keys: attempts per card, IP, customer or device, and
+// distinct cards per customer.
+const (
+	velocityCard          = "card"
+	velocityIP            = "ip"
+	velocityCustomer      = "customer"
+	velocityDevice        = "device"
+	velocityCustomerCards = "customer_cards"
+)
+
+// VelocityConfig caps how often a card, IP, customer or device may
+// attempt a payment within a window, and how many distinct cards a
+// customer may pay with, to blunt card testing that stays under the
+// per-IP rate limit by spreading across many cards or addresses. Each
+// rule is counted per tenant; a tenant's rules replace the default ones.
+// Cards are only known for payments created with a payment_method,
+// devices for those with a device_id. Counters live in Redis, so without
+// REDIS_URL nothing is limited.
+//
+//	"velocity": {"rules": [{"key": "card", "max": 5, "window_seconds": 3600},
+//	                       {"key": "ip", "max": 20, "window_seconds": 3600},
+//	                       {"key": "device", "max": 10, "window_seconds": 3600},
+//	                       {"key": "customer_cards", "max": 3}],
+//	             "tenants": {"acme": [{"key": "customer", "max": 10, "window_seconds": 600}]}}
+type VelocityConfig struct {
+	Rules   []VelocityRule            `json:"rules"`
+	Tenants map[string][]VelocityRule `json:"tenants"`
+}
+
+type VelocityRule struct {
+	// Key is card, ip, customer or device to count attempts, or
+	// customer_cards to count a customer's distinct cards.
+	Key string `json:"key"`
+	Max int    `json:"max"`
+	// WindowSeconds zero means 86400.
+	WindowSeconds int `json:"window_seconds"`
+}
+
+func (cfg VelocityConfig) validate() error {
+	check := func(name string, rules []VelocityRule) error {
+		for i, r := range rules {
+			switch r.Key {
+			case velocityCard, velocityIP, velocityCustomer, velocityDevice, velocityCustomerCards:
+			default:
+				return fmt.Errorf("velocity %s[%d]: key must be one of card, ip, customer, device, customer_cards", name, i)
+			}
+			if r.Max <= 0 || r.WindowSeconds < 0 {
+				return fmt.Errorf("velocity %s[%d]: max must be positive and window_seconds not negative", name, i)
+			}
+		}
+		return nil
+	}
+	if err := check("rules", cfg.Rules); err != nil {
+		return err
+	}
+	for tenant, rules := range cfg.Tenants {
+		if err := check("tenants."+tenant, rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg VelocityConfig) rules(tenantID string) []VelocityRule {
+	if rules, ok := cfg.Tenants[tenantID]; ok && tenantID != "" {
+		return rules
+	}
+	return cfg.Rules
+}
+
+func (r VelocityRule) window() time.Duration {
+	if r.WindowSeconds == 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(r.WindowSeconds) * time.Second
+}
+
+// velocityScript keeps one sorted set per rule, scored by time: each
+// attempt a new member, each distinct card its fingerprint. It drops what
+// has left the window, then counts. An attempt always counts, so a card
+// tester who keeps going stays refused; a new card past the limit isn't
+// added, so the customer's earlier cards still work. With ARGV[2] "0" it
+// only counts. It returns the 1-based index of the first rule exceeded,
+// or 0.
+//
+// KEYS are the sets; ARGV is now in milliseconds, the record flag, then
+// window_ms, max, member and distinct (1 or 0) for each key.
+const velocityScript = `
+local now = tonumber(ARGV[1])
+local record = ARGV[2] == "1"
+local exceeded = 0
+for i, key in ipairs(KEYS) do
+  local base = 2 + (i - 1) * 4
+  local window = tonumber(ARGV[base + 1])
+  local max = tonumber(ARGV[base + 2])
+  local member = ARGV[base + 3]
+  redis.call("ZREMRANGEBYSCORE", key, "-inf", now - window)
+  local n = redis.call("ZCARD", key)
+  local add = record
+  if ARGV[base + 4] == "1" then
+    if redis.call("ZSCORE", key, member) then
+      n = n - 1
+    elseif n >= max then
+      add = false
+    end
+  end
+  if n + 1 > max and exceeded == 0 then
+    exceeded = i
+  end
+  if add then
+    redis.call("ZADD", key, now, member)
+    redis.call("PEXPIRE", key, window)
+  end
+end
+return exceeded
+`
+
+// Velocity enforces the velocity rules before a payment is created.
+type Velocity struct {
+	redis    *Redis
+	settings *RuntimeSettings
+}
+
+func NewVelocity(redis *Redis, settings *RuntimeSettings) *Velocity {
+	return &Velocity{redis: redis, settings: settings}
+}
+
+// check counts req against the tenant's rules and refuses it with
+// velocity_exceeded when one is over. Dry runs are checked without being
+// counted. Redis being unreachable lets payments through rather than
+// stopping them.
+func (v *Velocity) check(ctx context.Context, req PaymentRequest, card paymentCard) *refusal {
+	if v == nil || v.redis == nil {
+		return nil
+	}
+	rules := v.settings.Get().Velocity.rules(req.TenantID)
+	if len(rules) == 0 {
+		return nil
+	}
+
+	record := "1"
+	if req.dryRun {
+		record = "0"
+	}
+	attempt := uuid.NewString()
+	var keys, args []string
+	var applied []VelocityRule
+	for _, r := range rules {
+		var value, member, distinct string
+		switch r.Key {
+		case velocityCard:
+			value, member, distinct = card.Fingerprint, attempt, "0"
+		case velocityIP:
+			value, member, distinct = req.ClientIP, attempt, "0"
+		case velocityCustomer:
+			value, member, distinct = req.CustomerID, attempt, "0"
+		case velocityDevice:
+			value, member, distinct = req.DeviceID, attempt, "0"
+		case velocityCustomerCards:
+			if card.Fingerprint != "" {
+				value, member, distinct = req.CustomerID, card.Fingerprint, "1"
+			}
+		}
+		if value == "" {
+			continue
+		}
+		// The tenant hash tag keeps a payment's keys in one cluster slot.
+		window := r.window()
+		keys = append(keys, fmt.Sprintf("velocity:{t:%s}:%s:%d:%s", req.TenantID, r.Key, int64(window/time.Second), value))
+		args = append(args, strconv.FormatInt(window.Milliseconds(), 10), strconv.Itoa(r.Max), member, distinct)
+		applied = append(applied, r)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	cmd := append([]string{"EVAL", velocityScript, strconv.Itoa(len(keys))}, keys...)
+	cmd = append(cmd, strconv.FormatInt(time.Now().UnixMilli(), 10), record)
+	reply, err := v.redis.Do(ctx, append(cmd, args...)...)
+	if err != nil {
+		logf(ctx, "velocity: %v", err)
+		return nil
+	}
+	i, _ := reply.(int64)
+	if i < 1 || int(i) > len(applied) {
+		return nil
+	}
+	rule := applied[i-1]
+	velocityRefusals.WithLabelValues(rule.Key).Inc()
+	message := "Too many payment attempts for this " + rule.Key
+	switch rule.Key {
+	case velocityIP:
+		message = "Too many payment attempts from this IP address"
+	case velocityDevice:
+		message = "Too many payment attempts from this device"
+	case velocityCustomerCards:
+		message = "Too many different cards for this customer"
+	}
+	return &refusal{http.StatusTooManyRequests, CodeVelocityExceeded, message, gin.H{"rule": rule.Key}}
+}
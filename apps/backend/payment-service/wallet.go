@@ -0,0 +1,656 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+)
+
+// Wallet is a customer's stored balance in one currency.
+type Wallet struct {
+	ID         string    `json:"id"`
+	TenantID   string    `json:"tenant_id,omitempty"`
+	CustomerID string    `json:"customer_id"`
+	Currency   string    `json:"currency"`
+	Balance    int64     `json:"balance"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Wallet transaction types. Top-ups and adjustments credit or debit the
+// wallet against Stripe and store credit, debits pay for orders, and a
+// reversal undoes one earlier transaction.
+const (
+	walletTopUp      = "top_up"
+	walletDebit      = "debit"
+	walletReversal   = "reversal"
+	walletAdjustment = "adjustment"
+)
+
+// WalletTransaction is one movement of a wallet's balance. Amount is
+// signed: credits are positive, debits negative.
+type WalletTransaction struct {
+	ID           string    `json:"id"`
+	WalletID     string    `json:"wallet_id"`
+	Type         string    `json:"type"`
+	Amount       int64     `json:"amount"`
+	BalanceAfter int64     `json:"balance_after"`
+	PaymentID    string    `json:"payment_id,omitempty"`
+	OrderID      string    `json:"order_id,omitempty"`
+	Description  string    `json:"description,omitempty"`
+	Reverses     string    `json:"reverses,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+var errInsufficientBalance = errors.New("wallet balance is too low")
+
+const walletColumns = `id, tenant_id, customer_id, currency, balance, created_at, updated_at`
+
+func scanWallet(row interface{ Scan(...interface{}) error }) (*Wallet, error) {
+	var w Wallet
+	if err := row.Scan(&w.ID, &w.TenantID, &w.CustomerID, &w.Currency, &w.Balance, &w.CreatedAt, &w.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+const walletTransactionColumns = `id, wallet_id, type, amount, balance_after, payment_id, order_id, description, COALESCE(reverses, ''), created_at`
+
+func scanWalletTransaction(row interface{ Scan(...interface{}) error }) (*WalletTransaction, error) {
+	var t WalletTransaction
+	if err := row.Scan(&t.ID, &t.WalletID, &t.Type, &t.Amount, &t.BalanceAfter, &t.PaymentID, &t.OrderID,
+		&t.Description, &t.Reverses, &t.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// CreateWallet returns the customer's wallet in currency, opening it if
+// there is none yet; created reports which.
+func (s *Store) CreateWallet(ctx context.Context, tenantID, customerID, currency string) (*Wallet, bool, error) {
+	w, err := scanWallet(s.db.QueryRowContext(ctx, `
+		INSERT INTO wallets (id, tenant_id, customer_id, currency) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant_id, customer_id, currency) DO NOTHING
+		RETURNING `+walletColumns,
+		uuid.NewString(), tenantID, customerID, currency))
+	if !errors.Is(err, sql.ErrNoRows) {
+		return w, err == nil, err
+	}
+	w, err = scanWallet(s.db.QueryRowContext(ctx, `
+		SELECT `+walletColumns+` FROM wallets WHERE tenant_id = $1 AND customer_id = $2 AND currency = $3`,
+		tenantID, customerID, currency))
+	return w, false, err
+}
+
+func (s *Store) Wallet(ctx context.Context, id string) (*Wallet, error) {
+	return scanWallet(s.db.QueryRowContext(ctx, `SELECT `+walletColumns+` FROM wallets WHERE id = $1`, id))
+}
+
+func (s *Store) WalletTransaction(ctx context.Context, id string) (*WalletTransaction, error) {
+	return scanWalletTransaction(s.db.QueryRowContext(ctx, `
+		SELECT `+walletTransactionColumns+` FROM wallet_transactions WHERE id = $1`, id))
+}
+
+// WalletTransactions lists a wallet's history, newest first.
+func (s *Store) WalletTransactions(ctx context.Context, walletID string, limit, offset int) ([]*WalletTransaction, bool, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+walletTransactionColumns+` FROM wallet_transactions
+		WHERE wallet_id = $1 ORDER BY created_at DESC, id LIMIT $2 OFFSET $3`,
+		walletID, limit+1, offset)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	txs := []*WalletTransaction{}
+	for rows.Next() {
+		t, err := scanWalletTransaction(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		txs = append(txs, t)
+	}
+	if len(txs) > limit {
+		return txs[:limit], true, rows.Err()
+	}
+	return txs, false, rows.Err()
+}
+
+// WalletTransactionReversed reports whether a reversal of id exists.
+func (s *Store) WalletTransactionReversed(ctx context.Context, id string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM wallet_transactions WHERE reverses = $1`, id).Scan(&n)
+	return n > 0, err
+}
+
+// RecordWalletTopUp records the intent paying for a top-up; replays of
+// the same intent are no-ops.
+func (s *Store) RecordWalletTopUp(ctx context.Context, paymentID, walletID string, amount int64, currency string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO wallet_top_ups (payment_id, wallet_id, amount, currency) VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING`, paymentID, walletID, amount, currency)
+	return err
+}
+
+// WalletTopUp returns the wallet, amount and currency recorded for a
+// top-up intent, or sql.ErrNoRows.
+func (s *Store) WalletTopUp(ctx context.Context, paymentID string) (walletID string, amount int64, currency string, err error) {
+	err = s.db.QueryRowContext(ctx, `
+		SELECT wallet_id, amount, currency FROM wallet_top_ups WHERE payment_id = $1`, paymentID).
+		Scan(&walletID, &amount, &currency)
+	return walletID, amount, currency, err
+}
+
+// SetWalletTransactionPayment records the card payment for the rest of a
+// checkout on its debit, which a cancellation of that payment alone may
+// reverse.
+func (s *Store) SetWalletTransactionPayment(ctx context.Context, id, paymentID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE wallet_transactions SET payment_id = $2 WHERE id = $1 AND payment_id = ''`, id, paymentID)
+	return err
+}
+
+// walletMovement is a change to apply to a wallet. counterAccount is the
+// ledger account on the other side of amount.
+type walletMovement struct {
+	walletID       string
+	typ            string
+	amount         int64
+	counterAccount string
+	paymentID      string
+	orderID        string
+	description    string
+	reverses       string
+	idempotencyKey string
+}
+
+// applyWalletMovement moves a wallet's balance and posts the ledger entry
+// in one database transaction, holding the wallet's row lock throughout so
+// concurrent movements apply one after another. A movement that was
+// already applied, identified by its idempotency key, its top-up payment
+// or the transaction it reverses, returns the original transaction and
+// leaves the balance alone. Debits past the balance fail with
+// errInsufficientBalance.
+func (s *Store) applyWalletMovement(ctx context.Context, m walletMovement) (*WalletTransaction, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var balance int64
+	var currency string
+	if err := tx.QueryRowContext(ctx, `SELECT balance, currency FROM wallets WHERE id = $1 FOR UPDATE`, m.walletID).
+		Scan(&balance, &currency); err != nil {
+		return nil, err
+	}
+
+	if prior, err := priorWalletMovement(ctx, tx, m); !errors.Is(err, sql.ErrNoRows) {
+		return prior, err
+	}
+	after := balance + m.amount
+	if after < 0 {
+		return nil, errInsufficientBalance
+	}
+
+	id := uuid.NewString()
+	ledgerID, err := postLedger(ctx, tx, "wallet."+m.typ, id, currency,
+		LedgerEntry{Account: walletAccount(m.walletID), Amount: m.amount},
+		LedgerEntry{Account: m.counterAccount, Amount: -m.amount})
+	if err != nil {
+		return nil, err
+	}
+	t, err := scanWalletTransaction(tx.QueryRowContext(ctx, `
+		INSERT INTO wallet_transactions
+			(id, wallet_id, type, amount, balance_after, payment_id, order_id, description, reverses, idempotency_key, ledger_transaction_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING `+walletTransactionColumns,
+		id, m.walletID, m.typ, m.amount, after, m.paymentID, m.orderID, m.description,
+		sql.NullString{String: m.reverses, Valid: m.reverses != ""},
+		sql.NullString{String: m.idempotencyKey, Valid: m.idempotencyKey != ""},
+		ledgerID))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE wallets SET balance = $2, updated_at = now() WHERE id = $1`, m.walletID, after); err != nil {
+		return nil, err
+	}
+	return t, tx.Commit()
+}
+
+// priorWalletMovement finds an earlier application of m, or returns
+// sql.ErrNoRows. The wallet's row lock makes the check race free; the
+// unique indexes behind it are a backstop.
+func priorWalletMovement(ctx context.Context, tx *sql.Tx, m walletMovement) (*WalletTransaction, error) {
+	query := `SELECT ` + walletTransactionColumns + ` FROM wallet_transactions WHERE `
+	switch {
+	case m.idempotencyKey != "":
+		return scanWalletTransaction(tx.QueryRowContext(ctx, query+`wallet_id = $1 AND idempotency_key = $2`, m.walletID, m.idempotencyKey))
+	case m.typ == walletTopUp:
+		return scanWalletTransaction(tx.QueryRowContext(ctx, query+`type = 'top_up' AND payment_id = $1`, m.paymentID))
+	case m.reverses != "":
+		return scanWalletTransaction(tx.QueryRowContext(ctx, query+`reverses = $1`, m.reverses))
+	}
+	return nil, sql.ErrNoRows
+}
+
+// Metadata on the PaymentIntents wallets create, read back from webhooks.
+const (
+	walletMetadataID          = "wallet_id"
+	walletMetadataPurpose     = "wallet_purpose"
+	walletMetadataTransaction = "wallet_transaction_id"
+)
+
+// Wallets serves stored-balance accounts: one per customer and currency,
+// topped up by card and spent at checkout, alone or with a card paying the
+// rest. Every movement is a wallet transaction posted to the ledger.
+type Wallets struct {
+	store    *Store
+	payments *PaymentService
+}
+
+func NewWallets(store *Store, payments *PaymentService) *Wallets {
+	return &Wallets{store: store, payments: payments}
+}
+
+// RegisterRoutes mounts the wallet API under the wallets scope, and
+// manual adjustments under the admin scope. Mutations honour
+// Idempotency-Key.
+func (w *Wallets) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/wallets", requireScope(w.store, bootstrapToken, "wallets"), w.requireStore)
+	g.POST("", w.create)
+	g.GET("/:id", w.get)
+	g.GET("/:id/transactions", w.transactions)
+	g.POST("/:id/top-ups", w.topUp)
+	g.POST("/:id/checkout", w.checkout)
+
+	admin := r.Group("/admin/wallets", requireScope(w.store, bootstrapToken, "admin"), w.requireStore)
+	admin.POST("/:id/adjustments", w.adjust)
+}
+
+func (w *Wallets) requireStore(c *gin.Context) {
+	if w.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Wallets require DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+// load fetches the wallet named in the path, answering 404 if there is
+// none.
+func (w *Wallets) load(c *gin.Context) (*Wallet, bool) {
+	wallet, err := w.store.Wallet(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Wallet not found"))
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return nil, false
+	}
+	return wallet, true
+}
+
+// create opens a wallet, or returns the customer's existing one in that
+// currency with 200.
+func (w *Wallets) create(c *gin.Context) {
+	var req struct {
+		TenantID   string `json:"tenant_id"`
+		CustomerID string `json:"customer_id" binding:"required"`
+		Currency   string `json:"currency" binding:"required,len=3"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	wallet, created, err := w.store.CreateWallet(c.Request.Context(), req.TenantID, req.CustomerID, strings.ToLower(req.Currency))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	respondData(c, status, wallet)
+}
+
+func (w *Wallets) get(c *gin.Context) {
+	if wallet, ok := w.load(c); ok {
+		respondData(c, http.StatusOK, wallet)
+	}
+}
+
+func (w *Wallets) transactions(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 100 {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "limit must be between 1 and 100"))
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeInvalidRequest, "offset must be a non-negative integer"))
+		return
+	}
+	wallet, ok := w.load(c)
+	if !ok {
+		return
+	}
+
+	txs, hasMore, err := w.store.WalletTransactions(c.Request.Context(), wallet.ID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondList(c, http.StatusOK, txs, gin.H{
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": hasMore,
+		"balance":  wallet.Balance,
+	})
+}
+
+// topUp creates the PaymentIntent that pays for a top-up. The wallet is
+// credited by the payment_intent.succeeded webhook, not here, so the
+// balance only ever holds money Stripe has collected.
+func (w *Wallets) topUp(c *gin.Context) {
+	var req struct {
+		Amount      int64  `json:"amount" binding:"required,gt=0"`
+		Description string `json:"description"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	wallet, ok := w.load(c)
+	if !ok {
+		return
+	}
+
+	preq := PaymentRequest{
+		Amount:      req.Amount,
+		Currency:    wallet.Currency,
+		Description: req.Description,
+		CustomerID:  wallet.CustomerID,
+		TenantID:    wallet.TenantID,
+		Metadata:    map[string]string{walletMetadataID: wallet.ID, walletMetadataPurpose: walletTopUp},
+	}
+	if preq.Description == "" {
+		preq.Description = "Wallet top-up"
+	}
+	pi, ok := w.payments.createFor(c, preq, c.GetHeader("Idempotency-Key"))
+	if !ok {
+		return
+	}
+	if err := w.store.RecordWalletTopUp(c.Request.Context(), pi.ID, wallet.ID, pi.Amount, string(pi.Currency)); err != nil {
+		// Unrecorded, the payment would never credit the wallet.
+		cancel := &stripe.PaymentIntentCancelParams{}
+		cancel.Context = context.WithoutCancel(c.Request.Context())
+		if _, cerr := paymentintent.Cancel(pi.ID, cancel); cerr != nil {
+			logf(c.Request.Context(), "canceling unrecorded top-up %s: %v", pi.ID, cerr)
+		}
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusCreated, gin.H{"wallet_id": wallet.ID, "payment": paymentData(pi, true)})
+}
+
+// WalletCheckout is the outcome of POST /wallets/:id/checkout.
+type WalletCheckout struct {
+	WalletAmount int64              `json:"wallet_amount"`
+	CardAmount   int64              `json:"card_amount"`
+	Balance      int64              `json:"balance"`
+	Transaction  *WalletTransaction `json:"wallet_transaction,omitempty"`
+	// Payment is the card PaymentIntent for the remainder, which the
+	// client confirms as for any other payment.
+	Payment *Payment `json:"payment,omitempty"`
+}
+
+// checkout pays an order from the wallet. With card_remainder, whatever
+// the balance doesn't cover goes on a PaymentIntent; otherwise the wallet
+// must cover the whole amount. The wallet is debited first and the debit
+// reversed if the card payment can't be created, or is later canceled.
+// Retries with the same Idempotency-Key return the original debit and
+// intent.
+func (w *Wallets) checkout(c *gin.Context) {
+	var req struct {
+		Amount        int64             `json:"amount" binding:"required,gt=0"`
+		OrderID       string            `json:"order_id"`
+		Description   string            `json:"description"`
+		CardRemainder bool              `json:"card_remainder"`
+		Metadata      map[string]string `json:"metadata"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if fields := validateMetadata(req.Metadata); len(fields) > 0 {
+		validationFailed(c, fields)
+		return
+	}
+	wallet, ok := w.load(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	key := c.GetHeader("Idempotency-Key")
+
+	debit := req.Amount
+	if wallet.Balance < debit {
+		if !req.CardRemainder {
+			insufficientBalance(c, wallet.Balance)
+			return
+		}
+		debit = wallet.Balance
+	}
+
+	out := WalletCheckout{Balance: wallet.Balance}
+	if debit > 0 {
+		m := walletMovement{
+			walletID:       wallet.ID,
+			typ:            walletDebit,
+			amount:         -debit,
+			counterAccount: salesAccount(wallet.TenantID),
+			orderID:        req.OrderID,
+			description:    req.Description,
+		}
+		if key != "" {
+			m.idempotencyKey = key + ":debit"
+		}
+		t, err := w.store.applyWalletMovement(ctx, m)
+		if errors.Is(err, errInsufficientBalance) {
+			insufficientBalance(c, wallet.Balance)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			return
+		}
+		// A replayed debit may have been reversed since, and taking the
+		// card payment again would leave the order half paid.
+		if reversed, err := w.store.WalletTransactionReversed(ctx, t.ID); err != nil || reversed {
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+			} else {
+				c.JSON(http.StatusConflict, errorBody(c, CodeIdempotencyConflict, "This checkout was reversed; retry with a new Idempotency-Key"))
+			}
+			return
+		}
+		out.Transaction = t
+		out.WalletAmount = -t.Amount
+		out.Balance = t.BalanceAfter
+	}
+	out.CardAmount = req.Amount - out.WalletAmount
+
+	if out.CardAmount > 0 {
+		metadata := map[string]string{}
+		for k, v := range req.Metadata {
+			metadata[k] = v
+		}
+		metadata[walletMetadataID], metadata[walletMetadataPurpose] = wallet.ID, walletDebit
+		if out.Transaction != nil {
+			metadata[walletMetadataTransaction] = out.Transaction.ID
+		}
+		preq := PaymentRequest{
+			Amount:      out.CardAmount,
+			Currency:    wallet.Currency,
+			Description: req.Description,
+			OrderID:     req.OrderID,
+			CustomerID:  wallet.CustomerID,
+			TenantID:    wallet.TenantID,
+			Metadata:    metadata,
+		}
+		cardKey := ""
+		if key != "" {
+			cardKey = key + ":card"
+		}
+		pi, ok := w.payments.createFor(c, preq, cardKey)
+		if !ok {
+			if out.Transaction != nil {
+				if _, err := w.reverse(context.WithoutCancel(ctx), wallet, out.Transaction, "card payment for the remainder failed"); err != nil {
+					logf(ctx, "reversing wallet debit %s: %v", out.Transaction.ID, err)
+				}
+			}
+			return
+		}
+		if out.Transaction != nil {
+			if err := w.store.SetWalletTransactionPayment(ctx, out.Transaction.ID, pi.ID); err != nil {
+				logf(ctx, "recording payment %s on wallet debit %s: %v", pi.ID, out.Transaction.ID, err)
+			}
+			out.Transaction.PaymentID = pi.ID
+		}
+		p := paymentData(pi, true)
+		out.Payment = &p
+	}
+	respondData(c, http.StatusCreated, out)
+}
+
+func insufficientBalance(c *gin.Context, balance int64) {
+	c.JSON(http.StatusUnprocessableEntity, errorBodyWith(c, CodeInsufficientBalance, "Balance is too low for this amount",
+		gin.H{"balance": balance}))
+}
+
+// reverse undoes a debit, returning its amount to the wallet.
+func (w *Wallets) reverse(ctx context.Context, wallet *Wallet, t *WalletTransaction, why string) (*WalletTransaction, error) {
+	if t.Type != walletDebit {
+		return nil, fmt.Errorf("only debits are reversed, not %s %s", t.Type, t.ID)
+	}
+	return w.store.applyWalletMovement(ctx, walletMovement{
+		walletID:       wallet.ID,
+		typ:            walletReversal,
+		amount:         -t.Amount,
+		counterAccount: salesAccount(wallet.TenantID),
+		paymentID:      t.PaymentID,
+		orderID:        t.OrderID,
+		description:    why,
+		reverses:       t.ID,
+	})
+}
+
+// adjust credits or debits a wallet by hand against store credit, for
+// goodwill gestures and corrections.
+func (w *Wallets) adjust(c *gin.Context) {
+	var req struct {
+		Amount int64  `json:"amount" binding:"required"`
+		Reason string `json:"reason" binding:"required"`
+		// PaymentID is the payment the adjustment is for, if any, whose
+		// timeline then shows it.
+		PaymentID string `json:"payment_id"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	wallet, ok := w.load(c)
+	if !ok {
+		return
+	}
+
+	m := walletMovement{
+		walletID:       wallet.ID,
+		typ:            walletAdjustment,
+		amount:         req.Amount,
+		counterAccount: ledgerStoreCredit,
+		description:    req.Reason,
+		idempotencyKey: c.GetHeader("Idempotency-Key"),
+	}
+	t, err := w.store.applyWalletMovement(c.Request.Context(), m)
+	if errors.Is(err, errInsufficientBalance) {
+		insufficientBalance(c, wallet.Balance)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	recordAdminAction(c, w.store, req.PaymentID, "wallet.adjusted", t.ID,
+		gin.H{"wallet_id": wallet.ID, "amount": req.Amount, "reason": req.Reason})
+	respondData(c, http.StatusCreated, t)
+}
+
+// paymentIntentEvent applies what a webhook means for wallets: a
+// succeeded top-up credits the wallet, and a canceled card payment for a
+// checkout remainder gives the wallet debit back. Both are safe to
+// redeliver. The metadata only says where to look: a wallet is credited
+// only for a top-up recorded for this intent, and a debit reversed only
+// if it records this intent as its card payment.
+func (w *Wallets) paymentIntentEvent(ctx context.Context, typ stripe.EventType, pi *stripe.PaymentIntent) error {
+	walletID := pi.Metadata[walletMetadataID]
+	if w == nil || w.store == nil || walletID == "" {
+		return nil
+	}
+
+	switch {
+	case typ == "payment_intent.succeeded" && pi.Metadata[walletMetadataPurpose] == walletTopUp:
+		recorded, amount, currency, err := w.store.WalletTopUp(ctx, pi.ID)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && recorded != walletID) {
+			logf(ctx, "payment %s names wallet %s but is not a top-up of it", pi.ID, walletID)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("loading top-up %s: %w", pi.ID, err)
+		}
+		if pi.AmountReceived != amount || string(pi.Currency) != currency {
+			return fmt.Errorf("top-up %s received %d %s, not the %d %s recorded", pi.ID, pi.AmountReceived, pi.Currency, amount, currency)
+		}
+		_, err = w.store.applyWalletMovement(ctx, walletMovement{
+			walletID:       walletID,
+			typ:            walletTopUp,
+			amount:         amount,
+			counterAccount: ledgerStripeClearing,
+			paymentID:      pi.ID,
+			description:    pi.Description,
+		})
+		if err != nil {
+			return fmt.Errorf("crediting wallet %s for %s: %w", walletID, pi.ID, err)
+		}
+
+	case typ == "payment_intent.canceled" && pi.Metadata[walletMetadataTransaction] != "":
+		t, err := w.store.WalletTransaction(ctx, pi.Metadata[walletMetadataTransaction])
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("loading wallet transaction for %s: %w", pi.ID, err)
+		}
+		if t.PaymentID != pi.ID || t.WalletID != walletID {
+			logf(ctx, "payment %s names wallet debit %s but is not its card payment", pi.ID, t.ID)
+			return nil
+		}
+		wallet, err := w.store.Wallet(ctx, t.WalletID)
+		if err != nil {
+			return fmt.Errorf("loading wallet %s: %w", t.WalletID, err)
+		}
+		if _, err := w.reverse(ctx, wallet, t, "card payment "+pi.ID+" canceled"); err != nil {
+			return fmt.Errorf("reversing wallet debit %s: %w", t.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+// maxWebhookBody matches the limit Stripe documents for event payloads.
+const maxWebhookBody = 65536
+
+// outcomeEvents maps webhook types to the analytics events they produce.
+var outcomeEvents = map[stripe.EventType]string{
+	"payment_intent.succeeded":      "payment.succeeded",
+	"payment_intent.payment_failed": "payment.failed",
+}
+
+// WebhookHandler verifies Stripe webhook signatures and applies events:
+// PaymentIntent transitions go to the local store and the event hub,
+// receipts are sent on success and refund when a receipt service is
+// configured, wallet and gift card checkouts settle, escrows are funded,
+// frozen and canceled, failed subscription invoices enter dunning,
+// soft-declined payments are scheduled for retries, checkout sessions
+// move through their funnel, installments and the invoices of our own
+// subscriptions settle, loyalty points are earned and reversed,
+// successful cards are scored for chargeback risk and checked for
+// duplicate payments, held payments are queued for review or captured,
+// connected accounts' onboarding is tracked, extended authorization holds
+// end when their payment is captured or canceled, A/B-routed payments
+// record their outcome, and outcomes are reported to analytics. Receipts,
+// Store, Wallets, GiftCards, Escrows, Dunning, Retries, Checkout, Plans,
+// Billing, Risk, Loyalty, Duplicates, Reviews, Connect, AuthHolds and
+// Routing may be nil. ConnectSecret verifies events from a Connect
+// endpoint, which Stripe signs with a secret of its own, and
+// AlternateSecret those of the alternate provider account. Each
+// component's part is a handler in a WebhookRegistry, registered for the
+// event types it cares about in registerHandlers. With a Pool, events are
+// applied in order per payment; without one they run on the request
+// goroutine.
+type WebhookHandler struct {
+	Secret          string
+	ConnectSecret   string
+	AlternateSecret string
+	Hub             *EventHub
+	Receipts        *ReceiptService
+	Analytics       *AnalyticsEmitter
+	Store           *Store
+	Payments        PaymentRepository
+	Wallets         *Wallets
+	GiftCards       *GiftCards
+	Escrows         *Escrows
+	Dunning         *Dunning
+	Retries         *PaymentRetries
+	Checkout        *Checkout
+	Plans           *PaymentPlans
+	Billing         *Billing
+	Risk            *ChargebackRisk
+	Loyalty         *Loyalty
+	Duplicates      *DuplicatePayments
+	Reviews         *PaymentReviews
+	Connect         *Connect
+	AuthHolds       *AuthorizationHolds
+	Routing         *ProviderRouting
+	Pool            *WebhookPool
+	DeadLetters     *DeadLetters
+	Events          *WebhookEvents
+	// DedupeTTL is how long handlers' successes on an event are
+	// remembered; see webhookDedupe.
+	DedupeTTL time.Duration
+
+	registryOnce sync.Once
+	registry     *WebhookRegistry
+}
+
+func (h *WebhookHandler) Handle(c *gin.Context) {
+	if h.Secret == "" {
+		c.JSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "Webhook secret not configured"))
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBody))
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, errorBody(c, CodePayloadTooLarge, "Payload too large"))
+		return
+	}
+
+	opts := webhook.ConstructEventOptions{IgnoreAPIVersionMismatch: true}
+	event, err := webhook.ConstructEventWithOptions(payload, c.GetHeader("Stripe-Signature"), h.Secret, opts)
+	if err != nil && h.ConnectSecret != "" {
+		event, err = webhook.ConstructEventWithOptions(payload, c.GetHeader("Stripe-Signature"), h.ConnectSecret, opts)
+	}
+	if err != nil && h.AlternateSecret != "" {
+		event, err = webhook.ConstructEventWithOptions(payload, c.GetHeader("Stripe-Signature"), h.AlternateSecret, opts)
+	}
+	if err != nil {
+		h.Events.rejected(c.Request.Context(), payload, err)
+		c.JSON(http.StatusBadRequest, errorBody(c, CodeUnauthorized, "Invalid signature"))
+		return
+	}
+
+	checkWebhookAPIVersion(c.Request.Context(), event)
+	h.Events.received(c.Request.Context(), event, payload)
+	err = h.dispatch(c.Request.Context(), event)
+	h.Events.processed(c.Request.Context(), event, err)
+	if err != nil {
+		// A non-2xx response makes Stripe redeliver the event later.
+		logf(c.Request.Context(), "webhook %s (%s): %v", event.ID, event.Type, err)
+		h.DeadLetters.webhookFailed(c.Request.Context(), event, payload, err)
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, "Event processing failed"))
+		return
+	}
+	h.DeadLetters.resolved(c.Request.Context(), deadLetterWebhook, event.ID, "stripe")
+
+	respondData(c, http.StatusOK, gin.H{"received": true})
+}
+
+// dispatch applies event through the pool when there is one.
+func (h *WebhookHandler) dispatch(ctx context.Context, event stripe.Event) error {
+	if h.Pool == nil {
+		return h.handleEvent(ctx, event)
+	}
+	return h.Pool.Dispatch(ctx, event)
+}
+
+func (h *WebhookHandler) handleEvent(ctx context.Context, event stripe.Event) error {
+	return h.handlers().Dispatch(ctx, event)
+}
+
+// handlers is the registry of event handlers, built from the handler's
+// components on first use.
+func (h *WebhookHandler) handlers() *WebhookRegistry {
+	h.registryOnce.Do(func() {
+		h.registry = NewWebhookRegistry(webhookMetrics, webhookLogging, webhookDedupe(h.Store, h.DedupeTTL))
+		h.registerHandlers(h.registry)
+	})
+	return h.registry
+}
+
+// onObject decodes an event's object, what it is named in errors, for fn.
+func onObject[T any](what string, fn func(context.Context, stripe.Event, *T) error) WebhookEventHandler {
+	return func(ctx context.Context, event stripe.Event) error {
+		var obj T
+		if err := json.Unmarshal(event.Data.Raw, &obj); err != nil {
+			return fmt.Errorf("decoding %s: %w", what, err)
+		}
+		return fn(ctx, event, &obj)
+	}
+}
+
+func onPaymentIntent(fn func(context.Context, stripe.EventType, *stripe.PaymentIntent) error) WebhookEventHandler {
+	return onObject("payment intent", func(ctx context.Context, event stripe.Event, pi *stripe.PaymentIntent) error {
+		return fn(ctx, event.Type, pi)
+	})
+}
+
+func onCharge(fn func(context.Context, *stripe.Charge) error) WebhookEventHandler {
+	return onObject("charge", func(ctx context.Context, _ stripe.Event, ch *stripe.Charge) error {
+		return fn(ctx, ch)
+	})
+}
+
+// onRefundedCharge skips refunds of charges without a PaymentIntent.
+func onRefundedCharge(fn func(context.Context, *stripe.Charge) error) WebhookEventHandler {
+	return onCharge(func(ctx context.Context, ch *stripe.Charge) error {
+		if ch.PaymentIntent == nil {
+			return nil
+		}
+		return fn(ctx, ch)
+	})
+}
+
+// registerHandlers registers what each component does with the events it
+// cares about; components that aren't configured register nothing. For
+// one event, handlers run in the order registered here.
+func (h *WebhookHandler) registerHandlers(r *WebhookRegistry) {
+	// PaymentIntent transitions
+	if h.Payments != nil {
+		r.Handle("payment_intent.*", "store.payment_intent", onPaymentIntent(func(ctx context.Context, _ stripe.EventType, pi *stripe.PaymentIntent) error {
+			if err := h.Payments.SavePayment(ctx, pi); err != nil {
+				return fmt.Errorf("saving payment %s: %w", pi.ID, err)
+			}
+			return nil
+		}))
+	}
+	if h.Wallets != nil {
+		r.Handle("payment_intent.*", "wallets.payment_intent", onPaymentIntent(h.Wallets.paymentIntentEvent))
+	}
+	if h.GiftCards != nil {
+		r.Handle("payment_intent.*", "gift_cards.payment_intent", onPaymentIntent(h.GiftCards.paymentIntentEvent))
+	}
+	if h.Escrows != nil {
+		r.Handle("payment_intent.*", "escrows.payment_intent", onPaymentIntent(h.Escrows.paymentIntentEvent))
+	}
+	if h.Retries != nil {
+		r.Handle("payment_intent.*", "retries.payment_intent", onPaymentIntent(h.Retries.paymentIntentEvent))
+	}
+	if h.Checkout != nil {
+		r.Handle("payment_intent.*", "checkout.payment_intent", onPaymentIntent(h.Checkout.paymentIntentEvent))
+	}
+	if h.Plans != nil {
+		r.Handle("payment_intent.*", "plans.payment_intent", onPaymentIntent(h.Plans.paymentIntentEvent))
+	}
+	if h.Billing != nil {
+		r.Handle("payment_intent.*", "billing.payment_intent", onPaymentIntent(h.Billing.paymentIntentEvent))
+	}
+	if h.Loyalty != nil {
+		r.Handle("payment_intent.*", "loyalty.payment_intent", onPaymentIntent(h.Loyalty.paymentIntentEvent))
+	}
+	if h.AuthHolds != nil {
+		r.Handle("payment_intent.*", "auth_holds.payment_intent", onPaymentIntent(h.AuthHolds.paymentIntentEvent))
+	}
+	if h.Routing != nil {
+		r.Handle("payment_intent.*", "routing.payment_intent", onPaymentIntent(h.Routing.paymentIntentEvent))
+	}
+	r.Handle("payment_intent.*", "hub.payment_intent", onObject("payment intent", h.publishPaymentEvent))
+	if h.Receipts != nil {
+		r.Handle("payment_intent.succeeded", "receipts.payment_intent", onPaymentIntent(func(ctx context.Context, _ stripe.EventType, pi *stripe.PaymentIntent) error {
+			h.Receipts.SendAsync(ctx, pi.ID)
+			return nil
+		}))
+	}
+	r.Handle("payment_intent.*", "analytics.payment_intent", onObject("payment intent", h.emitOutcome))
+
+	r.Handle("payment_intent.succeeded", "hooks.post_success", onPaymentIntent(func(ctx context.Context, _ stripe.EventType, pi *stripe.PaymentIntent) error {
+		lifecycleHooks.post(ctx, hookPostSuccess, hookPaymentOf(pi))
+		return nil
+	}))
+
+	// Charges
+	if h.Risk != nil {
+		r.Handle("charge.succeeded", "risk.charge_succeeded", onCharge(h.Risk.chargeSucceeded))
+	}
+	if h.Duplicates != nil {
+		r.Handle("charge.succeeded", "duplicates.charge_succeeded", onCharge(h.Duplicates.chargeSucceeded))
+	}
+	if h.Routing != nil {
+		r.Handle("charge.succeeded", "routing.charge_succeeded", onCharge(h.Routing.chargeSucceeded))
+	}
+	if h.Reviews != nil {
+		r.Handle("charge.succeeded", "reviews.charge_succeeded", onCharge(h.Reviews.chargeSucceeded))
+	}
+	if h.Payments != nil {
+		r.Handle("charge.refunded", "store.charge_refunded", onRefundedCharge(func(ctx context.Context, ch *stripe.Charge) error {
+			if err := h.Payments.SaveCharge(ctx, ch); err != nil {
+				return fmt.Errorf("saving refunds for %s: %w", ch.PaymentIntent.ID, err)
+			}
+			return nil
+		}))
+	}
+	if h.Escrows != nil {
+		r.Handle("charge.refunded", "escrows.charge_refunded", onRefundedCharge(h.Escrows.chargeRefunded))
+	}
+	if h.Loyalty != nil {
+		r.Handle("charge.refunded", "loyalty.charge_refunded", onRefundedCharge(h.Loyalty.chargeRefunded))
+	}
+	if h.Receipts != nil {
+		r.Handle("charge.refunded", "receipts.charge_refunded", onRefundedCharge(func(ctx context.Context, ch *stripe.Charge) error {
+			h.Receipts.SendAsync(ctx, ch.PaymentIntent.ID)
+			return nil
+		}))
+	}
+
+	r.Handle("charge.refunded", "hooks.post_refund", onRefundedCharge(func(ctx context.Context, ch *stripe.Charge) error {
+		lifecycleHooks.post(ctx, hookPostRefund, hookPaymentOfCharge(ch))
+		return nil
+	}))
+
+	// Disputes
+	if h.Store != nil {
+		r.Handle("charge.dispute.*", "store.dispute", onObject("dispute", func(ctx context.Context, _ stripe.Event, d *stripe.Dispute) error {
+			if err := h.Store.SaveDispute(ctx, d); err != nil {
+				return fmt.Errorf("saving dispute %s: %w", d.ID, err)
+			}
+			return nil
+		}))
+	}
+	if h.Escrows != nil {
+		r.Handle("charge.dispute.*", "escrows.dispute", onObject("dispute", func(ctx context.Context, event stripe.Event, d *stripe.Dispute) error {
+			return h.Escrows.disputeEvent(ctx, event.Type, d)
+		}))
+	}
+
+	// Subscriptions and connected accounts
+	if h.Dunning != nil {
+		r.Handle("invoice.*", "dunning.invoice", onObject("invoice", func(ctx context.Context, event stripe.Event, inv *stripe.Invoice) error {
+			return h.Dunning.invoiceEvent(ctx, event.Type, inv)
+		}))
+		r.Handle("customer.subscription.deleted", "dunning.subscription_deleted", onObject("subscription", func(ctx context.Context, _ stripe.Event, sub *stripe.Subscription) error {
+			return h.Dunning.subscriptionDeleted(ctx, sub)
+		}))
+	}
+	if h.Connect != nil {
+		r.Handle("account.updated", "connect.account_updated", onObject("account", func(ctx context.Context, _ stripe.Event, acct *stripe.Account) error {
+			return h.Connect.accountUpdated(ctx, acct)
+		}))
+	}
+}
+
+func (h *WebhookHandler) publishPaymentEvent(_ context.Context, event stripe.Event, pi *stripe.PaymentIntent) error {
+	h.Hub.Publish(PaymentEvent{
+		PaymentID:  pi.ID,
+		TenantID:   pi.Metadata["tenant_id"],
+		CustomerID: customerIDOf(pi.Customer),
+		Type:       string(event.Type),
+		Status:     paymentStatus(pi),
+		Amount:     pi.Amount,
+		Currency:   string(pi.Currency),
+		CreatedAt:  time.Unix(event.Created, 0).UTC(),
+		RequestID:  pi.Metadata["request_id"],
+	})
+	return nil
+}
+
+// emitOutcome reports the outcomes in outcomeEvents to analytics.
+func (h *WebhookHandler) emitOutcome(_ context.Context, event stripe.Event, pi *stripe.PaymentIntent) error {
+	name, ok := outcomeEvents[event.Type]
+	if !ok {
+		return nil
+	}
+	ev := h.Analytics.FromPaymentIntent(name, pi)
+	ev.OccurredAt = time.Unix(event.Created, 0).UTC()
+	ev.LatencyMS = (event.Created - pi.Created) * 1000
+	h.Analytics.Emit(ev)
+	return nil
+}
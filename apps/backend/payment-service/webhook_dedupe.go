@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// webhookClaimLease is how long a handler's claim on an event holds
+// before another instance may take it over, well beyond any handler's
+// run.
+const webhookClaimLease = 5 * time.Minute
+
+const (
+	webhookRunRunning = "running"
+	webhookRunDone    = "done"
+)
+
+// errWebhookInProgress fails an event one of whose handlers another
+// instance is applying right now; Stripe redelivers it, by which time
+// the handler is done and is skipped.
+var errWebhookInProgress = errors.New("event is being applied by another instance")
+
+// claimWebhookRun claims handler's run on eventID. It returns
+// webhookRunDone when the handler already applied the event and
+// webhookRunRunning when another claim holds, and "" when the claim is
+// the caller's. Finished runs are claimable again once they expire.
+func (s *Store) claimWebhookRun(ctx context.Context, eventID, handler string, now time.Time) (string, error) {
+	var claimed string
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO webhook_handler_runs (event_id, handler, status, claimed_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (event_id, handler) DO UPDATE SET
+			status = EXCLUDED.status, claimed_at = EXCLUDED.claimed_at, completed_at = NULL, expires_at = NULL
+		WHERE (webhook_handler_runs.status = $3 AND webhook_handler_runs.claimed_at < $5)
+			OR (webhook_handler_runs.status = $6 AND webhook_handler_runs.expires_at < $4)
+		RETURNING status`,
+		eventID, handler, webhookRunRunning, now, now.Add(-webhookClaimLease), webhookRunDone).Scan(&claimed)
+	if err == nil {
+		return "", nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	var status string
+	err = s.db.QueryRowContext(ctx, `
+		SELECT status FROM webhook_handler_runs WHERE event_id = $1 AND handler = $2`, eventID, handler).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Pruned between the two statements; try again.
+		return s.claimWebhookRun(ctx, eventID, handler, now)
+	}
+	return status, err
+}
+
+// completeWebhookRun marks handler's run on eventID done, remembered
+// until ttl from now.
+func (s *Store) completeWebhookRun(ctx context.Context, eventID, handler string, now time.Time, ttl time.Duration) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO webhook_handler_runs (event_id, handler, status, claimed_at, completed_at, expires_at)
+		VALUES ($1, $2, $3, $4, $4, $5)
+		ON CONFLICT (event_id, handler) DO UPDATE SET
+			status = EXCLUDED.status, completed_at = EXCLUDED.completed_at, expires_at = EXCLUDED.expires_at`,
+		eventID, handler, webhookRunDone, now, now.Add(ttl))
+	return err
+}
+
+// releaseWebhookRun drops a claim whose handler failed, so the
+// redelivery runs it again.
+func (s *Store) releaseWebhookRun(ctx context.Context, eventID, handler string) error {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM webhook_handler_runs WHERE event_id = $1 AND handler = $2 AND status = $3`,
+		eventID, handler, webhookRunRunning)
+	return err
+}
+
+// PruneWebhookRuns deletes finished runs past their TTL and claims long
+// past their lease, a batch at a time, and returns how many went.
+func (s *Store) PruneWebhookRuns(ctx context.Context, now time.Time) (int64, error) {
+	var total int64
+	for {
+		res, err := s.db.ExecContext(ctx, `
+			DELETE FROM webhook_handler_runs WHERE (event_id, handler) IN (
+				SELECT event_id, handler FROM webhook_handler_runs
+				WHERE expires_at < $1 OR (status = $2 AND claimed_at < $3)
+				LIMIT $4)`,
+			now, webhookRunRunning, now.Add(-24*webhookClaimLease), retentionBatch)
+		if err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+		if n < retentionBatch {
+			return total, nil
+		}
+	}
+}
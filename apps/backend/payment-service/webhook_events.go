@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v76"
+)
+
+const (
+	// How a delivery's signature checked out.
+	webhookSignatureValid   = "valid"
+	webhookSignatureInvalid = "invalid"
+
+	// Where an event is: being applied, applied, failed (Stripe will
+	// redeliver it), or rejected for its signature.
+	webhookEventProcessing = "processing"
+	webhookEventSucceeded  = "succeeded"
+	webhookEventFailed     = "failed"
+	webhookEventRejected   = "rejected"
+
+	// webhookEventPruneInterval is how often events past their retention
+	// are deleted.
+	webhookEventPruneInterval = time.Hour
+)
+
+// WebhookEvent is a webhook delivery as received, and what became of it.
+type WebhookEvent struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	PaymentID     string          `json:"payment_id,omitempty"`
+	Signature     string          `json:"signature"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	ReceivedAt    time.Time       `json:"received_at"`
+	LastAttemptAt time.Time       `json:"last_attempt_at"`
+	ProcessedAt   *time.Time      `json:"processed_at,omitempty"`
+}
+
+// The event store without payloads, filterable by type, payment_id,
+// signature or status; GET /admin/webhook-events/:id has the payload.
+var webhookEventList = listResource{
+	from: "webhook_events",
+	fields: []string{"id", "type", "payment_id", "signature", "status", "attempts", "last_error",
+		"received_at", "last_attempt_at", "processed_at"},
+	columns: map[string]listField{
+		"id":              {"id", textField},
+		"type":            {"type", textField},
+		"payment_id":      {"payment_id", textField},
+		"signature":       {"signature", textField},
+		"status":          {"status", textField},
+		"attempts":        {"attempts", intField},
+		"last_error":      {"last_error", textField},
+		"received_at":     {"received_at", timeField},
+		"last_attempt_at": {"last_attempt_at", timeField},
+		"processed_at":    {"processed_at", timeField},
+	},
+}
+
+// RecordWebhookDelivery stores a verified delivery of event as being
+// processed; a redelivery counts as another attempt on its row.
+func (s *Store) RecordWebhookDelivery(ctx context.Context, event stripe.Event, paymentID string, payload []byte) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO webhook_events (id, type, payment_id, signature, status, payload)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO UPDATE SET
+			attempts = webhook_events.attempts + 1,
+			status = EXCLUDED.status,
+			last_attempt_at = now()`,
+		event.ID, string(event.Type), paymentID, webhookSignatureValid, webhookEventProcessing, string(payload))
+	return err
+}
+
+// RecordRejectedWebhook stores a delivery whose signature didn't verify,
+// with the type the payload claims.
+func (s *Store) RecordRejectedWebhook(ctx context.Context, claimedType string, payload []byte, reason string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO webhook_events (id, type, signature, status, last_error, payload, processed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, now())`,
+		"unverified_"+uuid.NewString(), claimedType, webhookSignatureInvalid, webhookEventRejected, reason, string(payload))
+	return err
+}
+
+// FinishWebhookEvent records how processing an event's latest attempt
+// went.
+func (s *Store) FinishWebhookEvent(ctx context.Context, id string, procErr error) error {
+	status, lastError := webhookEventSucceeded, ""
+	if procErr != nil {
+		status, lastError = webhookEventFailed, procErr.Error()
+	}
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE webhook_events SET status = $2, last_error = $3, processed_at = now() WHERE id = $1`,
+		id, status, lastError)
+	return err
+}
+
+func (s *Store) WebhookEvent(ctx context.Context, id string) (*WebhookEvent, error) {
+	var e WebhookEvent
+	var payload string
+	var processedAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, type, payment_id, signature, status, attempts, last_error, payload,
+			received_at, last_attempt_at, processed_at
+		FROM webhook_events WHERE id = $1`, id).
+		Scan(&e.ID, &e.Type, &e.PaymentID, &e.Signature, &e.Status, &e.Attempts, &e.LastError, &payload,
+			&e.ReceivedAt, &e.LastAttemptAt, &processedAt)
+	if err != nil {
+		return nil, err
+	}
+	// A rejected delivery may not even be JSON; show it as a string then.
+	if json.Valid([]byte(payload)) {
+		e.Payload = json.RawMessage(payload)
+	} else {
+		e.Payload, _ = json.Marshal(payload)
+	}
+	if processedAt.Valid {
+		e.ProcessedAt = &processedAt.Time
+	}
+	return &e, nil
+}
+
+// PruneWebhookEvents deletes events received before cutoff, a batch at
+// a time, and returns how many went.
+func (s *Store) PruneWebhookEvents(ctx context.Context, cutoff time.Time) (int64, error) {
+	var total int64
+	for {
+		res, err := s.db.ExecContext(ctx, `
+			DELETE FROM webhook_events WHERE id IN (
+				SELECT id FROM webhook_events WHERE received_at < $1 LIMIT $2)`, cutoff, retentionBatch)
+		if err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+		if n < retentionBatch {
+			return total, nil
+		}
+	}
+}
+
+// WebhookEvents keeps every webhook delivery, verified or not, with its
+// payload and outcome, for retention. Recording is best effort: a
+// failure to record is logged and the event is processed all the same.
+type WebhookEvents struct {
+	store     *Store
+	retention time.Duration
+}
+
+func NewWebhookEvents(store *Store, retention time.Duration) *WebhookEvents {
+	return &WebhookEvents{store: store, retention: retention}
+}
+
+// RegisterRoutes mounts the event store under the admin scope.
+func (we *WebhookEvents) RegisterRoutes(r *gin.Engine, bootstrapToken string) {
+	g := r.Group("/admin/webhook-events", requireScope(we.store, bootstrapToken, "admin"), we.requireStore)
+	g.GET("", listHandler(we.store, webhookEventList))
+	g.GET("/:id", we.get)
+}
+
+func (we *WebhookEvents) requireStore(c *gin.Context) {
+	if we.store == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(c, CodeNotConfigured, "The webhook event store requires DATABASE_URL"))
+		return
+	}
+	c.Next()
+}
+
+func (we *WebhookEvents) get(c *gin.Context) {
+	e, err := we.store.WebhookEvent(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errorBody(c, CodeNotFound, "Webhook event not found"))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, CodeInternal, err.Error()))
+		return
+	}
+	respondData(c, http.StatusOK, e)
+}
+
+// received records a verified delivery before it is processed.
+func (we *WebhookEvents) received(ctx context.Context, event stripe.Event, payload []byte) {
+	if we == nil || we.store == nil {
+		return
+	}
+	var paymentID string
+	if key := webhookOrderKey(event); strings.HasPrefix(key, "pi_") {
+		paymentID = key
+	}
+	if err := we.store.RecordWebhookDelivery(context.WithoutCancel(ctx), event, paymentID, payload); err != nil {
+		logf(ctx, "webhook events: recording %s: %v", event.ID, err)
+	}
+}
+
+// processed records how processing event went.
+func (we *WebhookEvents) processed(ctx context.Context, event stripe.Event, procErr error) {
+	if we == nil || we.store == nil {
+		return
+	}
+	if err := we.store.FinishWebhookEvent(context.WithoutCancel(ctx), event.ID, procErr); err != nil {
+		logf(ctx, "webhook events: recording outcome of %s: %v", event.ID, err)
+	}
+}
+
+// rejected records a delivery whose signature didn't verify.
+func (we *WebhookEvents) rejected(ctx context.Context, payload []byte, sigErr error) {
+	if we == nil || we.store == nil {
+		return
+	}
+	var claimed struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(payload, &claimed)
+	if err := we.store.RecordRejectedWebhook(context.WithoutCancel(ctx), claimed.Type, payload, sigErr.Error()); err != nil {
+		logf(ctx, "webhook events: recording rejected delivery: %v", err)
+	}
+}
+
+// Prune deletes events older than the retention, and the dedupe's
+// handler runs past their TTL, every webhookEventPruneInterval until ctx
+// ends. A retention of 0 keeps the events.
+func (we *WebhookEvents) Prune(ctx context.Context) {
+	if we.store == nil {
+		return
+	}
+	ticker := time.NewTicker(webhookEventPruneInterval)
+	defer ticker.Stop()
+	for {
+		if we.retention > 0 {
+			if n, err := we.store.PruneWebhookEvents(ctx, time.Now().Add(-we.retention)); err != nil {
+				logf(ctx, "webhook events: pruning: %v", err)
+			} else if n > 0 {
+				retentionRowsTotal.WithLabelValues(retentionFinancial, "webhook_events", "deleted").Add(float64(n))
+			}
+		}
+		if n, err := we.store.PruneWebhookRuns(ctx, time.Now()); err != nil {
+			logf(ctx, "webhook events: pruning handler runs: %v", err)
+		} else if n > 0 {
+			retentionRowsTotal.WithLabelValues(retentionFinancial, "webhook_handler_runs", "deleted").Add(float64(n))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
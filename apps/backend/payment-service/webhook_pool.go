@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+)
+
+var (
+	webhookQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "payment_service_webhook_events_queued",
+		Help: "Webhook events waiting for a worker.",
+	})
+	webhookQueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "payment_service_webhook_queue_wait_seconds",
+		Help:    "Time a webhook event waited behind earlier events on its worker.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+)
+
+// errWebhooksClosed refuses events during shutdown; Stripe redelivers them.
+var errWebhooksClosed = fmt.Errorf("webhook workers are shutting down")
+
+// WebhookPool applies webhook events on a fixed set of workers. Events are
+// routed by payment ID, so events for one payment run one at a time in the
+// order they arrived while different payments proceed in parallel. Events
+// for unrelated payments that hash to the same worker also wait on each
+// other, which more workers make rarer.
+type WebhookPool struct {
+	handle func(context.Context, stripe.Event) error
+	shards []chan webhookTask
+	wg     sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+type webhookTask struct {
+	ctx    context.Context
+	event  stripe.Event
+	queued time.Time
+	done   chan error
+}
+
+func NewWebhookPool(workers, depth int, handle func(context.Context, stripe.Event) error) *WebhookPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &WebhookPool{handle: handle, shards: make([]chan webhookTask, workers)}
+	for i := range p.shards {
+		p.shards[i] = make(chan webhookTask, depth)
+		p.wg.Add(1)
+		go p.worker(p.shards[i])
+	}
+	return p
+}
+
+// Dispatch queues event behind earlier events for the same payment and
+// waits for it to be applied. If ctx ends first the event still runs, in
+// its place, and Dispatch returns ctx's error.
+func (p *WebhookPool) Dispatch(ctx context.Context, event stripe.Event) error {
+	task := webhookTask{ctx: context.WithoutCancel(ctx), event: event, queued: time.Now(), done: make(chan error, 1)}
+
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return errWebhooksClosed
+	}
+	shard := p.shards[shardFor(webhookOrderKey(event), len(p.shards))]
+	select {
+	case shard <- task:
+		webhookQueued.Inc()
+	case <-ctx.Done():
+		p.mu.RUnlock()
+		return ctx.Err()
+	}
+	p.mu.RUnlock()
+
+	select {
+	case err := <-task.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *WebhookPool) worker(tasks chan webhookTask) {
+	defer p.wg.Done()
+	for task := range tasks {
+		webhookQueued.Dec()
+		webhookQueueWait.Observe(time.Since(task.queued).Seconds())
+		task.done <- p.handle(task.ctx, task.event)
+	}
+}
+
+// Shutdown stops taking events and waits for queued ones to be applied, or
+// for ctx to end.
+func (p *WebhookPool) Shutdown(ctx context.Context) {
+	p.mu.Lock()
+	p.closed = true
+	for _, shard := range p.shards {
+		close(shard)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() { p.wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logf(ctx, "webhook events still queued at shutdown")
+	}
+}
+
+func shardFor(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// webhookOrderKey is the payment an event belongs to: the intent itself,
+// or the intent a charge, refund or dispute points at. Account events are
+// keyed by the account. Events without one are keyed by their own ID and
+// so are not ordered against anything.
+func webhookOrderKey(event stripe.Event) string {
+	var obj struct {
+		ID            string          `json:"id"`
+		PaymentIntent json.RawMessage `json:"payment_intent"`
+	}
+	if err := json.Unmarshal(event.Data.Raw, &obj); err != nil {
+		return event.ID
+	}
+	if strings.HasPrefix(string(event.Type), "payment_intent.") || strings.HasPrefix(string(event.Type), "account.") {
+		return obj.ID
+	}
+
+	// payment_intent is an ID, or an object when expanded.
+	var id string
+	if json.Unmarshal(obj.PaymentIntent, &id) != nil {
+		var expanded struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(obj.PaymentIntent, &expanded)
+		id = expanded.ID
+	}
+	if id == "" {
+		return event.ID
+	}
+	return id
+}
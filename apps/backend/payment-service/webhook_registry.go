@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stripe/stripe-go/v76"
+)
+
+var (
+	webhookHandlerRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_service_webhook_handler_runs_total",
+		Help: "Webhook event handler runs, by handler and outcome (succeeded, failed, duplicate, in_progress).",
+	}, []string{"handler", "outcome"})
+	webhookHandlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "payment_service_webhook_handler_duration_seconds",
+		Help:    "Time a webhook event handler took, by handler.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"handler"})
+)
+
+// webhookDedupeTTL is how long a handler's success on an event is
+// remembered by default, beyond Stripe's three days of redeliveries and
+// the thirty days an event can be resent from the dashboard;
+// webhookDedupeMax bounds the memory the in-process cache of them takes.
+const (
+	webhookDedupeTTL = 30 * 24 * time.Hour
+	webhookDedupeMax = 100000
+)
+
+// webhookStatsMinutes is how far back the admin API's handler counts go.
+const webhookStatsMinutes = 60
+
+// WebhookEventHandler applies one event of the types it was registered for.
+type WebhookEventHandler func(ctx context.Context, event stripe.Event) error
+
+// WebhookMiddleware wraps every handler in a registry; name is the
+// handler's.
+type WebhookMiddleware func(name string, next WebhookEventHandler) WebhookEventHandler
+
+// webhookRoute is a registered handler and its recent runs.
+type webhookRoute struct {
+	pattern string
+	name    string
+	handle  WebhookEventHandler
+	stats   *webhookHandlerStats
+}
+
+// matches reports whether the route takes t: patterns are an event type,
+// or a prefix ending in ".*" such as "payment_intent.*".
+func (rt *webhookRoute) matches(t stripe.EventType) bool {
+	if prefix, ok := strings.CutSuffix(rt.pattern, "*"); ok {
+		return strings.HasPrefix(string(t), prefix)
+	}
+	return string(t) == rt.pattern
+}
+
+// WebhookRegistry applies webhook events through handlers registered by
+// event type, so a new event type is a registration, not another case in
+// a switch. Every handler matching an event runs, in the order they were
+// registered, stopping at the first error so Stripe redelivers the event;
+// the middleware, outermost first, wraps each handler alike.
+type WebhookRegistry struct {
+	middleware []WebhookMiddleware
+	routes     []*webhookRoute
+}
+
+func NewWebhookRegistry(middleware ...WebhookMiddleware) *WebhookRegistry {
+	return &WebhookRegistry{middleware: middleware}
+}
+
+// Handle registers fn as name for the events pattern matches. Register
+// everything before the first Dispatch.
+func (r *WebhookRegistry) Handle(pattern, name string, fn WebhookEventHandler) {
+	stats := &webhookHandlerStats{}
+	fn = stats.wrap(fn)
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		fn = r.middleware[i](name, fn)
+	}
+	r.routes = append(r.routes, &webhookRoute{pattern: pattern, name: name, handle: fn, stats: stats})
+}
+
+// Dispatch runs event through the handlers registered for its type.
+// Events no handler takes are acknowledged.
+func (r *WebhookRegistry) Dispatch(ctx context.Context, event stripe.Event) error {
+	for _, rt := range r.routes {
+		if !rt.matches(event.Type) {
+			continue
+		}
+		if err := rt.handle(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webhookMetrics counts and times each handler's runs.
+func webhookMetrics(name string, next WebhookEventHandler) WebhookEventHandler {
+	return func(ctx context.Context, event stripe.Event) error {
+		started := time.Now()
+		err := next(ctx, event)
+		webhookHandlerDuration.WithLabelValues(name).Observe(time.Since(started).Seconds())
+		outcome := "succeeded"
+		if err != nil {
+			outcome = "failed"
+		}
+		webhookHandlerRuns.WithLabelValues(name, outcome).Inc()
+		return err
+	}
+}
+
+// webhookLogging logs each handler failure with the handler it was in;
+// the webhook endpoint logs the event's failure as a whole.
+func webhookLogging(name string, next WebhookEventHandler) WebhookEventHandler {
+	return func(ctx context.Context, event stripe.Event) error {
+		err := next(ctx, event)
+		if err != nil {
+			logf(ctx, "webhook %s (%s): handler %s: %v", event.ID, event.Type, name, err)
+		}
+		return err
+	}
+}
+
+type webhookReplayKey struct{}
+
+// withWebhookReplay marks ctx as an operator's replay, which reruns every
+// handler whether or not it already applied the event.
+func withWebhookReplay(ctx context.Context) context.Context {
+	return context.WithValue(ctx, webhookReplayKey{}, true)
+}
+
+// webhookDedupe makes each handler apply an event once. When one handler
+// fails Stripe redelivers the whole event, and it redelivers events it
+// never saw acknowledged anyway, so the handlers that already applied it
+// would otherwise apply it twice: a second receipt, a second order
+// update. With a store, a handler claims its run on the event in
+// webhook_handler_runs first, so redeliveries landing on another
+// instance, after a restart, or while the first delivery is still being
+// applied skip it too; successes are remembered for ttl. Without one,
+// successes are only remembered in memory. The in-memory cache spares
+// the store the handlers this instance already knows applied an event.
+func webhookDedupe(store *Store, ttl time.Duration) WebhookMiddleware {
+	if ttl <= 0 {
+		ttl = webhookDedupeTTL
+	}
+	var mu sync.Mutex
+	seen := map[string]time.Time{}
+	remember := func(key string, now time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(seen) >= webhookDedupeMax {
+			for k, at := range seen {
+				if now.Sub(at) >= ttl || len(seen) >= webhookDedupeMax {
+					delete(seen, k)
+				}
+			}
+		}
+		seen[key] = now
+	}
+	return func(name string, next WebhookEventHandler) WebhookEventHandler {
+		return func(ctx context.Context, event stripe.Event) error {
+			if event.ID == "" {
+				return next(ctx, event)
+			}
+			key := event.ID + "/" + name
+			replay, _ := ctx.Value(webhookReplayKey{}).(bool)
+			if !replay {
+				mu.Lock()
+				at, ok := seen[key]
+				mu.Unlock()
+				if ok && time.Since(at) < ttl {
+					webhookHandlerRuns.WithLabelValues(name, "duplicate").Inc()
+					return nil
+				}
+			}
+			if store != nil && !replay {
+				status, err := store.claimWebhookRun(ctx, event.ID, name, time.Now())
+				if err != nil {
+					return fmt.Errorf("claiming %s: %w", name, err)
+				}
+				switch status {
+				case webhookRunDone:
+					remember(key, time.Now())
+					webhookHandlerRuns.WithLabelValues(name, "duplicate").Inc()
+					return nil
+				case webhookRunRunning:
+					webhookHandlerRuns.WithLabelValues(name, "in_progress").Inc()
+					return errWebhookInProgress
+				}
+			}
+			if err := next(ctx, event); err != nil {
+				if store != nil && !replay {
+					if rerr := store.releaseWebhookRun(context.WithoutCancel(ctx), event.ID, name); rerr != nil {
+						logf(ctx, "webhook %s: releasing %s: %v", event.ID, name, rerr)
+					}
+				}
+				return err
+			}
+			now := time.Now()
+			if store != nil {
+				// The handler's effects are done; should this fail, the
+				// claim lapses after the lease and a redelivery reruns it.
+				if err := store.completeWebhookRun(context.WithoutCancel(ctx), event.ID, name, now, ttl); err != nil {
+					logf(ctx, "webhook %s: recording %s as applied: %v", event.ID, name, err)
+				}
+			}
+			remember(key, now)
+			return nil
+		}
+	}
+}
+
+// webhookHandlerStats counts a handler's runs by minute for the last
+// webhookStatsMinutes, in a ring, and keeps its last success and failure.
+type webhookHandlerStats struct {
+	mu          sync.Mutex
+	minutes     [webhookStatsMinutes]struct{ start, succeeded, failed int64 }
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+}
+
+// wrap records the runs of fn, inside the middleware so duplicates the
+// dedupe skipped don't count.
+func (s *webhookHandlerStats) wrap(fn WebhookEventHandler) WebhookEventHandler {
+	return func(ctx context.Context, event stripe.Event) error {
+		err := fn(ctx, event)
+		s.add(time.Now(), err)
+		return err
+	}
+}
+
+func (s *webhookHandlerStats) add(at time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := at.Unix() / 60
+	b := &s.minutes[start%webhookStatsMinutes]
+	if b.start != start {
+		b.start, b.succeeded, b.failed = start, 0, 0
+	}
+	if err != nil {
+		b.failed++
+		s.lastFailure, s.lastError = at.UTC(), err.Error()
+		return
+	}
+	b.succeeded++
+	s.lastSuccess = at.UTC()
+}
+
+// WebhookHandlerInfo describes a registered handler for the admin API.
+type WebhookHandlerInfo struct {
+	Name           string     `json:"name"`
+	EventTypes     string     `json:"event_types"`
+	Succeeded      int64      `json:"succeeded_last_hour"`
+	Failed         int64      `json:"failed_last_hour"`
+	LastSucceeded  *time.Time `json:"last_succeeded_at,omitempty"`
+	LastFailed     *time.Time `json:"last_failed_at,omitempty"`
+	LastFailReason string     `json:"last_error,omitempty"`
+}
+
+// Handlers lists the registered handlers in the order they run, with
+// their counts for the last hour.
+func (r *WebhookRegistry) Handlers(now time.Time) []WebhookHandlerInfo {
+	out := make([]WebhookHandlerInfo, 0, len(r.routes))
+	since := now.Unix()/60 - webhookStatsMinutes + 1
+	for _, rt := range r.routes {
+		info := WebhookHandlerInfo{Name: rt.name, EventTypes: rt.pattern}
+		s := rt.stats
+		s.mu.Lock()
+		for _, b := range s.minutes {
+			if b.start >= since {
+				info.Succeeded += b.succeeded
+				info.Failed += b.failed
+			}
+		}
+		if !s.lastSuccess.IsZero() {
+			at := s.lastSuccess
+			info.LastSucceeded = &at
+		}
+		if !s.lastFailure.IsZero() {
+			at := s.lastFailure
+			info.LastFailed, info.LastFailReason = &at, s.lastError
+		}
+		s.mu.Unlock()
+		out = append(out, info)
+	}
+	return out
+}
+
+// webhookHandlers lists the webhook handlers and how they have fared.
+func (a *AdminAPI) webhookHandlers(c *gin.Context) {
+	respondData(c, http.StatusOK, gin.H{"handlers": a.Webhooks.handlers().Handlers(time.Now())})
+}